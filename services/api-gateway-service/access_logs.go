@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Structured access logs. Every request the gateway serves is written to
+// stdout as one JSON line: the request ID, the route it matched, the
+// upstream that answered, who the caller authenticated as, and where the
+// time went (authentication, bulkhead queueing, the upstream and the
+// gateway itself).
+//
+// With LOGGING_SERVICE_URL set, entries are also shipped to the logging
+// service's batch endpoint. The request path never waits on shipping:
+// entries go into a bounded buffer and are dropped, and counted, when it is
+// full. A batch the logging service can't take is retried with backoff,
+// honouring Retry-After; when it takes part of a batch only the rest is
+// resent.
+
+const (
+	accessLogKey          = "access_log"
+	accessLogSource       = "access_log"
+	accessLogMaxAttempts  = 5
+	accessLogMaxBackoff   = 30 * time.Second
+	accessLogDrainTimeout = 10 * time.Second
+)
+
+var (
+	accessLogsShipped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "api_gateway_access_logs_shipped_total",
+			Help: "Access log entries accepted by the logging service",
+		},
+	)
+
+	accessLogsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_access_logs_dropped_total",
+			Help: "Access log entries dropped before reaching the logging service",
+		},
+		[]string{"reason"},
+	)
+
+	accessLogBuffer = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "api_gateway_access_log_buffer",
+			Help: "Access log entries waiting to be shipped",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(accessLogsShipped)
+	prometheus.MustRegister(accessLogsDropped)
+	prometheus.MustRegister(accessLogBuffer)
+}
+
+// accessLog collects what the handlers learn about a request
+type accessLog struct {
+	RouteID  string
+	Route    string
+	Service  string
+	Upstream string
+	Attempts int
+
+	AuthTime     time.Duration
+	QueueTime    time.Duration
+	UpstreamTime time.Duration // until the upstream's response headers
+}
+
+// accessLogFor returns the request's access log; handlers outside the
+// middleware get a throwaway one
+func accessLogFor(c *gin.Context) *accessLog {
+	if value, ok := c.Get(accessLogKey); ok {
+		return value.(*accessLog)
+	}
+	return &accessLog{}
+}
+
+func (a *accessLog) setRoute(route *APIRoute) {
+	a.RouteID = route.ID
+	a.Route = route.Method + " " + route.Path
+	a.Service = route.ServiceName
+}
+
+// accessLogEntry is one access log line, shaped as a logging service entry
+type accessLogEntry struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Level     string                 `json:"level"`
+	Service   string                 `json:"service"`
+	Message   string                 `json:"message"`
+	RequestID string                 `json:"request_id,omitempty"`
+	UserID    string                 `json:"user_id,omitempty"`
+	Source    string                 `json:"source"`
+	Tags      []string               `json:"tags"`
+	Fields    map[string]interface{} `json:"fields"`
+}
+
+// accessLogMiddleware writes the access log entry of every request
+func (s *APIGatewayService) accessLogMiddleware() gin.HandlerFunc {
+	stdout := log.New(os.Stdout, "", 0)
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		record := &accessLog{}
+		c.Set(accessLogKey, record)
+
+		c.Next()
+
+		total := time.Since(start)
+		status := c.Writer.Status()
+		level := "info"
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = "error"
+		case status >= http.StatusBadRequest:
+			level = "warn"
+		}
+
+		latency := gin.H{
+			"total_ms":    milliseconds(total),
+			"auth_ms":     milliseconds(record.AuthTime),
+			"queue_ms":    milliseconds(record.QueueTime),
+			"upstream_ms": milliseconds(record.UpstreamTime),
+			"gateway_ms":  milliseconds(total - record.UpstreamTime),
+		}
+		fields := map[string]interface{}{
+			"method":            c.Request.Method,
+			"path":              c.Request.URL.Path,
+			"query":             c.Request.URL.RawQuery,
+			"status":            status,
+			"client_ip":         c.ClientIP(),
+			"user_agent":        c.Request.UserAgent(),
+			"protocol":          c.Request.Proto,
+			"request_bytes":     c.Request.ContentLength,
+			"response_bytes":    c.Writer.Size(),
+			"route_id":          record.RouteID,
+			"route":             record.Route,
+			"upstream_service":  record.Service,
+			"upstream":          record.Upstream,
+			"upstream_attempts": record.Attempts,
+			"route_version":     c.GetString("route_version"),
+			"trace_id":          traceID(c.Request.Context()),
+			"latency":           latency,
+			"auth":              accessLogIdentity(c),
+		}
+		if errs := c.Errors.ByType(gin.ErrorTypePrivate).String(); errs != "" {
+			fields["error"] = errs
+		}
+
+		entry := accessLogEntry{
+			Timestamp: start.UTC(),
+			Level:     level,
+			Service:   "api-gateway-service",
+			Message:   fmt.Sprintf("%s %s %d", c.Request.Method, c.Request.URL.Path, status),
+			RequestID: c.GetString("request_id"),
+			UserID:    c.GetString("user_id"),
+			Source:    accessLogSource,
+			Tags:      []string{accessLogSource},
+			Fields:    fields,
+		}
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("Failed to encode access log entry: %v", err)
+			return
+		}
+		stdout.Println(string(line))
+
+		// Probes and scrapes are not worth shipping
+		if strings.HasPrefix(c.Request.URL.Path, "/health") || strings.HasPrefix(c.Request.URL.Path, "/metrics") {
+			return
+		}
+		s.accessLogs.ship(entry)
+	}
+}
+
+// accessLogIdentity describes how the caller authenticated
+func accessLogIdentity(c *gin.Context) gin.H {
+	identity := gin.H{"method": "none"}
+	switch {
+	case c.GetString("api_key_id") != "":
+		identity["method"] = "api_key"
+		identity["api_key_id"] = c.GetString("api_key_id")
+	case c.GetString("token_issuer") != "":
+		identity["method"] = "oidc"
+		identity["issuer"] = c.GetString("token_issuer")
+	case c.GetString("user_id") != "":
+		identity["method"] = "jwt"
+	}
+	if userID := c.GetString("user_id"); userID != "" {
+		identity["user_id"] = userID
+	}
+	if clientIdentity := c.GetString("client_identity"); clientIdentity != "" {
+		identity["client_cert"] = clientIdentity
+	}
+	return identity
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// accessLogShipper batches access log entries to the logging service
+type accessLogShipper struct {
+	url           string
+	batchSize     int
+	flushInterval time.Duration
+	client        *http.Client
+	entries       chan accessLogEntry
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+// newAccessLogShipper returns nil, shipping nothing, without a logging
+// service URL
+func newAccessLogShipper(config *Config) *accessLogShipper {
+	if config.LoggingServiceURL == "" {
+		return nil
+	}
+	if config.AccessLogBatchSize <= 0 {
+		config.AccessLogBatchSize = 200
+	}
+	if config.AccessLogBufferSize <= 0 {
+		config.AccessLogBufferSize = 10000
+	}
+	if config.AccessLogFlushInterval <= 0 {
+		config.AccessLogFlushInterval = time.Second
+	}
+	return &accessLogShipper{
+		url:           strings.TrimRight(config.LoggingServiceURL, "/") + "/v1/logs/batch",
+		batchSize:     config.AccessLogBatchSize,
+		flushInterval: config.AccessLogFlushInterval,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		entries:       make(chan accessLogEntry, config.AccessLogBufferSize),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// ship queues an entry without blocking
+func (a *accessLogShipper) ship(entry accessLogEntry) {
+	if a == nil {
+		return
+	}
+	select {
+	case a.entries <- entry:
+		accessLogBuffer.Set(float64(len(a.entries)))
+	default:
+		accessLogsDropped.WithLabelValues("buffer_full").Inc()
+	}
+}
+
+// run sends batches until stopped, then sends what is left
+func (a *accessLogShipper) run() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(a.flushInterval)
+	defer ticker.Stop()
+	batch := make([]accessLogEntry, 0, a.batchSize)
+
+	for {
+		select {
+		case entry := <-a.entries:
+			batch = append(batch, entry)
+			if len(batch) < a.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-a.stop:
+			for {
+				select {
+				case entry := <-a.entries:
+					batch = append(batch, entry)
+					if len(batch) >= a.batchSize {
+						a.send(batch)
+						batch = batch[:0]
+					}
+				default:
+					a.send(batch)
+					return
+				}
+			}
+		}
+		accessLogBuffer.Set(float64(len(a.entries)))
+		a.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// send delivers a batch, retrying what the logging service doesn't accept
+func (a *accessLogShipper) send(batch []accessLogEntry) {
+	backoff := 500 * time.Millisecond
+	for attempt := 1; len(batch) > 0; attempt++ {
+		accepted, retryAfter, err := a.post(batch)
+		accessLogsShipped.Add(float64(accepted))
+		batch = batch[accepted:]
+		if err == nil {
+			return
+		}
+		if retryAfter < 0 || attempt >= accessLogMaxAttempts {
+			log.Printf("Dropping %d access log entries: %v", len(batch), err)
+			accessLogsDropped.WithLabelValues("ship_failed").Add(float64(len(batch)))
+			return
+		}
+
+		wait := backoff
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		if wait > accessLogMaxBackoff {
+			wait = accessLogMaxBackoff
+		}
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+// post sends one batch. It reports how many entries were accepted and, on
+// failure, how long to wait before retrying: 0 for the default backoff, or
+// negative when retrying can't help.
+func (a *accessLogShipper) post(batch []accessLogEntry) (int, time.Duration, error) {
+	body, err := json.Marshal(gin.H{"logs": batch})
+	if err != nil {
+		return 0, -1, err
+	}
+	req, err := http.NewRequest(http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Accepted int `json:"accepted"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result)
+	if result.Accepted < 0 || result.Accepted > len(batch) {
+		result.Accepted = 0
+	}
+
+	switch {
+	case resp.StatusCode < http.StatusMultipleChoices:
+		return len(batch), 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		wait, _ := parseRetryAfter(resp.Header.Get("Retry-After"))
+		return result.Accepted, wait, fmt.Errorf("logging service returned %d", resp.StatusCode)
+	default:
+		return result.Accepted, -1, fmt.Errorf("logging service rejected batch with %d", resp.StatusCode)
+	}
+}
+
+// close sends what is buffered, waiting a while for it to go out
+func (a *accessLogShipper) close() {
+	if a == nil {
+		return
+	}
+	close(a.stop)
+	ctx, cancel := context.WithTimeout(context.Background(), accessLogDrainTimeout)
+	defer cancel()
+	select {
+	case <-a.done:
+	case <-ctx.Done():
+		log.Printf("Gave up shipping %d access log entries on shutdown", len(a.entries))
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// API keys. Only a SHA-256 hash of each key is stored; the key itself is
+// shown once, in the response that creates it, and a short prefix is kept
+// so a key can be recognised in listings. Keys are high-entropy random
+// strings, so a plain hash is enough to make a stolen table useless.
+//
+// Rotating a key creates a successor with the same owner, scopes and rate
+// limit. The old key keeps working for an overlap window so clients can
+// switch over, answering with X-API-Key-Expires meanwhile, and then
+// expires.
+//
+// Routes may list RequiredScopes. The caller's credentials, an API key's
+// scopes or a JWT's scopes/scope claim, must grant every one of them.
+// "*" grants everything and "name:*" grants every "name:..." scope.
+
+const (
+	apiKeyPrefix          = "aic_"
+	apiKeyDisplayLength   = 12
+	apiKeyBytes           = 32
+	defaultRotationWindow = 24 * time.Hour
+	maxRotationWindow     = 30 * 24 * time.Hour
+)
+
+// generateAPIKey returns a new random key
+func generateAPIKey() (string, error) {
+	b := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashAPIKey is the form a key is stored and looked up in
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiKeyDisplayPrefix(key string) string {
+	if len(key) > apiKeyDisplayLength {
+		return key[:apiKeyDisplayLength]
+	}
+	return key
+}
+
+// migrateAPIKeyHashes replaces keys stored in plaintext by earlier versions
+// with their hashes
+func migrateAPIKeyHashes(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&APIKey{}, "key") {
+		return nil
+	}
+
+	var plaintext []struct {
+		ID  string
+		Key string
+	}
+	if err := db.Table("api_keys").Select("id, key").Where("key IS NOT NULL AND (key_hash IS NULL OR key_hash = '')").Scan(&plaintext).Error; err != nil {
+		return err
+	}
+	for _, row := range plaintext {
+		err := db.Model(&APIKey{}).Where("id = ?", row.ID).Updates(map[string]interface{}{
+			"key_hash":   hashAPIKey(row.Key),
+			"key_prefix": apiKeyDisplayPrefix(row.Key),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	if err := db.Migrator().DropColumn(&APIKey{}, "key"); err != nil {
+		return err
+	}
+	log.Printf("🔑 Hashed %d API keys stored in plaintext", len(plaintext))
+	return nil
+}
+
+// scopesFromClaims reads a JWT's scopes, given as a list in "scopes" or as
+// a space-separated string in "scope"
+func scopesFromClaims(claims map[string]interface{}) []string {
+	var scopes []string
+	switch v := claims["scopes"].(type) {
+	case []interface{}:
+		for _, scope := range v {
+			if s, ok := scope.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+	case string:
+		scopes = append(scopes, strings.Fields(v)...)
+	}
+	if v, ok := claims["scope"].(string); ok {
+		scopes = append(scopes, strings.Fields(v)...)
+	}
+	return scopes
+}
+
+// hasScope reports whether the granted scopes include required
+func hasScope(granted []string, required string) bool {
+	for _, scope := range granted {
+		switch {
+		case scope == "*", scope == required:
+			return true
+		case strings.HasSuffix(scope, ":*") && strings.HasPrefix(required, strings.TrimSuffix(scope, "*")):
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeScopes checks the caller holds every scope the route requires,
+// answering 403 when not
+func (s *APIGatewayService) authorizeScopes(c *gin.Context, route *APIRoute) bool {
+	if len(route.RequiredScopes) == 0 {
+		return true
+	}
+	granted, _ := c.Get("scopes")
+	scopes, _ := granted.([]string)
+
+	var missing []string
+	for _, required := range route.RequiredScopes {
+		if !hasScope(scopes, required) {
+			missing = append(missing, required)
+		}
+	}
+	if len(missing) == 0 {
+		return true
+	}
+
+	c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, strings.Join(route.RequiredScopes, " ")))
+	c.JSON(http.StatusForbidden, gin.H{
+		"error":           "Insufficient scope",
+		"required_scopes": route.RequiredScopes,
+		"missing_scopes":  missing,
+	})
+	return false
+}
+
+// Create an API key. The key is in this response only.
+func (s *APIGatewayService) createAPIKey(c *gin.Context) {
+	var req struct {
+		Name      string     `json:"name" binding:"required"`
+		UserID    string     `json:"user_id"`
+		Scopes    []string   `json:"scopes"`
+		RateLimit int        `json:"rate_limit" binding:"min=0"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
+		return
+	}
+	apiKey := APIKey{
+		ID:        uuid.New().String(),
+		Key:       key,
+		KeyHash:   hashAPIKey(key),
+		KeyPrefix: apiKeyDisplayPrefix(key),
+		Name:      req.Name,
+		UserID:    req.UserID,
+		Scopes:    req.Scopes,
+		RateLimit: req.RateLimit,
+		IsActive:  true,
+		ExpiresAt: req.ExpiresAt,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if err := s.db.Create(&apiKey).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, apiKey)
+}
+
+// List API keys, without their key material
+func (s *APIGatewayService) listAPIKeys(c *gin.Context) {
+	query := s.db.Order("created_at DESC")
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if active := c.Query("is_active"); active != "" {
+		query = query.Where("is_active = ?", active == "true")
+	}
+
+	var keys []APIKey
+	if err := query.Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API keys"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// Get an API key, without its key material
+func (s *APIGatewayService) getAPIKey(c *gin.Context) {
+	var apiKey APIKey
+	if err := s.db.First(&apiKey, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	c.JSON(http.StatusOK, apiKey)
+}
+
+// Update an API key's name, scopes, rate limit, state or expiry
+func (s *APIGatewayService) updateAPIKey(c *gin.Context) {
+	var apiKey APIKey
+	if err := s.db.First(&apiKey, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	var req struct {
+		Name      *string    `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		RateLimit *int       `json:"rate_limit"`
+		IsActive  *bool      `json:"is_active"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	updates := map[string]interface{}{"updated_at": time.Now()}
+	if req.Name != nil {
+		updates["name"] = *req.Name
+	}
+	if req.Scopes != nil {
+		updates["scopes"] = req.Scopes
+	}
+	if req.RateLimit != nil {
+		if *req.RateLimit < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "rate_limit must not be negative"})
+			return
+		}
+		updates["rate_limit"] = *req.RateLimit
+	}
+	if req.IsActive != nil {
+		updates["is_active"] = *req.IsActive
+	}
+	if req.ExpiresAt != nil {
+		updates["expires_at"] = *req.ExpiresAt
+	}
+
+	if err := s.db.Model(&apiKey).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update API key"})
+		return
+	}
+	s.db.First(&apiKey, "id = ?", apiKey.ID)
+	c.JSON(http.StatusOK, apiKey)
+}
+
+// Delete an API key
+func (s *APIGatewayService) deleteAPIKey(c *gin.Context) {
+	result := s.db.Delete(&APIKey{}, "id = ?", c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete API key"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "API key deleted successfully"})
+}
+
+// Rotate an API key: create its successor and let the old key expire after
+// an overlap window (0 revokes it at once). The new key is in this response
+// only.
+func (s *APIGatewayService) rotateAPIKey(c *gin.Context) {
+	var req struct {
+		OverlapSeconds *int `json:"overlap_seconds"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	overlap := defaultRotationWindow
+	if req.OverlapSeconds != nil {
+		overlap = time.Duration(*req.OverlapSeconds) * time.Second
+		if overlap < 0 || overlap > maxRotationWindow {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("overlap_seconds must be between 0 and %d", int(maxRotationWindow/time.Second))})
+			return
+		}
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
+		return
+	}
+
+	var previous, successor APIKey
+	status := http.StatusInternalServerError
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&previous, "id = ?", c.Param("id")).Error; err != nil {
+			status = http.StatusNotFound
+			return fmt.Errorf("API key not found")
+		}
+		if !previous.IsActive || (previous.ExpiresAt != nil && previous.ExpiresAt.Before(time.Now())) {
+			status = http.StatusConflict
+			return fmt.Errorf("API key is no longer active")
+		}
+		if previous.SuccessorID != "" {
+			status = http.StatusConflict
+			return fmt.Errorf("API key was already rotated to %s", previous.SuccessorID)
+		}
+
+		now := time.Now()
+		successor = APIKey{
+			ID:            uuid.New().String(),
+			Key:           key,
+			KeyHash:       hashAPIKey(key),
+			KeyPrefix:     apiKeyDisplayPrefix(key),
+			Name:          previous.Name,
+			UserID:        previous.UserID,
+			Scopes:        previous.Scopes,
+			RateLimit:     previous.RateLimit,
+			IsActive:      true,
+			ExpiresAt:     previous.ExpiresAt,
+			RotatedFromID: previous.ID,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		if err := tx.Create(&successor).Error; err != nil {
+			return fmt.Errorf("failed to create successor key")
+		}
+
+		expiresAt := now.Add(overlap)
+		if previous.ExpiresAt != nil && previous.ExpiresAt.Before(expiresAt) {
+			expiresAt = *previous.ExpiresAt
+		}
+		updates := map[string]interface{}{
+			"successor_id": successor.ID,
+			"rotated_at":   now,
+			"expires_at":   expiresAt,
+			"updated_at":   now,
+		}
+		if overlap == 0 {
+			updates["is_active"] = false
+		}
+		if err := tx.Model(&previous).Updates(updates).Error; err != nil {
+			return fmt.Errorf("failed to update rotated key")
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.db.First(&previous, "id = ?", previous.ID)
+	log.Printf("🔑 Rotated API key %s (%s) to %s", previous.ID, previous.KeyPrefix, successor.ID)
+	c.JSON(http.StatusCreated, gin.H{
+		"api_key":  successor,
+		"previous": previous,
+	})
+}
+
+// Verify an API key for services that accept platform keys themselves,
+// such as git pushes to the runtime service. An unusable key answers
+// valid=false rather than an error.
+func (s *APIGatewayService) verifyAPIKey(c *gin.Context) {
+	var req struct {
+		Key string `json:"key" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var apiKey APIKey
+	if err := s.db.Where("key_hash = ? AND is_active = true", hashAPIKey(req.Key)).First(&apiKey).Error; err != nil {
+		c.JSON(http.StatusOK, gin.H{"valid": false, "reason": "invalid"})
+		return
+	}
+	if apiKey.ExpiresAt != nil && apiKey.ExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusOK, gin.H{"valid": false, "reason": "expired"})
+		return
+	}
+
+	go func() {
+		s.db.Model(&apiKey).Update("last_used_at", time.Now())
+	}()
+	c.JSON(http.StatusOK, gin.H{
+		"valid":      true,
+		"api_key_id": apiKey.ID,
+		"user_id":    apiKey.UserID,
+		"scopes":     apiKey.Scopes,
+		"expires_at": apiKey.ExpiresAt,
+	})
+}
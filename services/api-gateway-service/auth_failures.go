@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Failed authentications are published on AUTH_FAILURE_CHANNEL so the
+// security service can spot brute-force and credential-stuffing attacks
+// spread across many addresses and keys. Credentials are never published,
+// only a short fingerprint that tells distinct ones apart, except that a
+// honeytoken hit also names the honeytoken.
+
+// authFailureEvent is the message published for each rejected request
+type authFailureEvent struct {
+	Source     string    `json:"source"`
+	IPAddress  string    `json:"ip_address"`
+	Credential string    `json:"credential,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	UserAgent  string    `json:"user_agent"`
+	Reason     string    `json:"reason"`
+	Honeytoken string    `json:"honeytoken,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// credentialFingerprint identifies a presented credential without revealing it
+func credentialFingerprint(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:8])
+}
+
+// publishAuthFailure reports a request rejected for its credentials
+func (s *APIGatewayService) publishAuthFailure(c *gin.Context) {
+	if s.config.AuthFailureChannel == "" {
+		return
+	}
+
+	event := authFailureEvent{
+		Source:    "gateway",
+		IPAddress: c.ClientIP(),
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.Path,
+		UserAgent: c.Request.UserAgent(),
+		Reason:    "missing_credentials",
+		Timestamp: time.Now().UTC(),
+	}
+	if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+		event.Reason = "invalid_api_key"
+		event.Credential = credentialFingerprint(apiKey)
+	} else if token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "); token != c.GetHeader("Authorization") {
+		event.Reason = "invalid_token"
+		event.Credential = credentialFingerprint(token)
+	}
+	if id := c.GetString("honeytoken_id"); id != "" {
+		event.Reason = "honeytoken"
+		event.Honeytoken = id
+	}
+
+	payload, _ := json.Marshal(event)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := s.redis.Publish(ctx, s.config.AuthFailureChannel, payload).Err(); err != nil {
+			log.Printf("Failed to publish auth failure: %v", err)
+		}
+	}()
+}
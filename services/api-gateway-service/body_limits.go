@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Request body limits and streaming.
+//
+// Every proxied request body is capped at the route's MaxBodySize, or
+// MAX_REQUEST_SIZE when the route sets none. A declared Content-Length over
+// the cap is refused with 413 before anything is read; a chunked body is
+// cut off, also with 413, the moment it passes the cap.
+//
+// Routes with StreamBodies set carry long transfers, such as multi-GB
+// uploads to file-storage-service given a MaxBodySize to match. The gateway
+// never holds their request bodies for retries, and the server's read and
+// write deadlines are lifted for them. Their Timeout then bounds inactivity
+// rather than the whole exchange: the request is abandoned once no body
+// bytes have moved in either direction for that long.
+
+var bodyLimitRejections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "api_gateway_body_limit_rejections_total",
+		Help: "Requests refused for bodies over the route limit",
+	},
+	[]string{"service"},
+)
+
+func init() {
+	prometheus.MustRegister(bodyLimitRejections)
+}
+
+// bodyLimit is the largest request body the route accepts
+func (s *APIGatewayService) bodyLimit(route *APIRoute) int64 {
+	if route.MaxBodySize > 0 {
+		return route.MaxBodySize
+	}
+	return s.config.MaxRequestSize
+}
+
+// limitRequestBody refuses a declared oversize body, answering 413, and
+// caps the body otherwise
+func (s *APIGatewayService) limitRequestBody(c *gin.Context, route *APIRoute) bool {
+	limit := s.bodyLimit(route)
+	if c.Request.ContentLength > limit {
+		s.rejectBodyTooLarge(c.Writer, route)
+		return false
+	}
+	if c.Request.Body != nil && c.Request.Body != http.NoBody {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	}
+	return true
+}
+
+// isBodyTooLarge reports whether err comes from reading past the body limit
+func isBodyTooLarge(err error) bool {
+	var maxBytes *http.MaxBytesError
+	return errors.As(err, &maxBytes)
+}
+
+func (s *APIGatewayService) rejectBodyTooLarge(w http.ResponseWriter, route *APIRoute) {
+	limit := s.bodyLimit(route)
+	bodyLimitRejections.WithLabelValues(route.ServiceName).Inc()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write([]byte(`{"error":"Request body too large","max_body_size":` + strconv.FormatInt(limit, 10) + `}`))
+}
+
+// idleWatchdog cancels a streaming exchange once its bodies stop moving
+type idleWatchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu    sync.Mutex
+	fired bool
+}
+
+// startStreaming lifts the server deadlines for the request and returns a
+// context that ends when its bodies have been idle for the route timeout
+func (s *APIGatewayService) startStreaming(c *gin.Context, route *APIRoute) (context.Context, *idleWatchdog, context.CancelFunc) {
+	controller := http.NewResponseController(c.Writer)
+	if err := controller.SetReadDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to lift read deadline for streaming route %s: %v", route.ID, err)
+	}
+	if err := controller.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Failed to lift write deadline for streaming route %s: %v", route.ID, err)
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	watchdog := &idleWatchdog{timeout: time.Duration(route.Timeout) * time.Second}
+	watchdog.timer = time.AfterFunc(watchdog.timeout, func() {
+		watchdog.mu.Lock()
+		watchdog.fired = true
+		watchdog.mu.Unlock()
+		cancel()
+	})
+	stop := func() {
+		watchdog.timer.Stop()
+		cancel()
+	}
+	return ctx, watchdog, stop
+}
+
+func (w *idleWatchdog) touch() {
+	w.timer.Reset(w.timeout)
+}
+
+// timedOut reports whether the exchange was cancelled for idleness
+func (w *idleWatchdog) timedOut() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.fired
+}
+
+// watchedBody keeps the watchdog at bay while bytes flow through it
+type watchedBody struct {
+	io.ReadCloser
+	watchdog *idleWatchdog
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.watchdog.touch()
+	}
+	return n, err
+}
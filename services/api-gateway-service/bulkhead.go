@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Bulkheads cap the number of requests the gateway has in flight to one
+// route, or to all routes of a service, so a slow backend ties up a bounded
+// share of the gateway's connections instead of starving every other route.
+// A route with MaxConcurrentRequests set gets a bulkhead. When it is full,
+// up to BulkheadQueueSize requests wait at most BulkheadQueueTimeout for a
+// slot; everything beyond that is rejected with 503. Routes with
+// BulkheadScope "service" share one bulkhead per ServiceName, sized by the
+// smallest limit among them.
+
+// Bulkhead scopes
+const (
+	BulkheadScopeRoute   = "route"
+	BulkheadScopeService = "service"
+)
+
+var (
+	bulkheadInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "api_gateway_bulkhead_in_flight",
+			Help: "Requests holding a bulkhead slot",
+		},
+		[]string{"bulkhead"},
+	)
+
+	bulkheadRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_bulkhead_rejections_total",
+			Help: "Requests rejected by a full bulkhead",
+		},
+		[]string{"bulkhead", "reason"},
+	)
+
+	bulkheadQueueWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "api_gateway_bulkhead_queue_wait_seconds",
+			Help:    "Time requests waited for a bulkhead slot",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		},
+		[]string{"bulkhead"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(bulkheadInFlight)
+	prometheus.MustRegister(bulkheadRejections)
+	prometheus.MustRegister(bulkheadQueueWait)
+}
+
+// bulkhead is a counting semaphore with a short, bounded wait queue
+type bulkhead struct {
+	name     string
+	slots    chan struct{}
+	queued   int32
+	rejected int64
+
+	mu           sync.Mutex
+	queueSize    int
+	queueTimeout time.Duration
+}
+
+func newBulkhead(name string, limit int) *bulkhead {
+	return &bulkhead{name: name, slots: make(chan struct{}, limit)}
+}
+
+// acquire takes a slot, waiting in the queue if allowed. On success the
+// returned release must be called once the request is done; otherwise the
+// reason names why the request was turned away.
+func (b *bulkhead) acquire(ctx context.Context) (func(), string) {
+	select {
+	case b.slots <- struct{}{}:
+		return b.hold(), ""
+	default:
+	}
+
+	b.mu.Lock()
+	queueSize, queueTimeout := b.queueSize, b.queueTimeout
+	b.mu.Unlock()
+
+	if queueSize <= 0 || queueTimeout <= 0 {
+		return nil, b.reject("full")
+	}
+	if atomic.AddInt32(&b.queued, 1) > int32(queueSize) {
+		atomic.AddInt32(&b.queued, -1)
+		return nil, b.reject("queue_full")
+	}
+	defer atomic.AddInt32(&b.queued, -1)
+
+	start := time.Now()
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case b.slots <- struct{}{}:
+		bulkheadQueueWait.WithLabelValues(b.name).Observe(time.Since(start).Seconds())
+		return b.hold(), ""
+	case <-timer.C:
+		return nil, b.reject("queue_timeout")
+	case <-ctx.Done():
+		return nil, b.reject("canceled")
+	}
+}
+
+func (b *bulkhead) hold() func() {
+	bulkheadInFlight.WithLabelValues(b.name).Inc()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-b.slots
+			bulkheadInFlight.WithLabelValues(b.name).Dec()
+		})
+	}
+}
+
+func (b *bulkhead) reject(reason string) string {
+	atomic.AddInt64(&b.rejected, 1)
+	bulkheadRejections.WithLabelValues(b.name, reason).Inc()
+	return reason
+}
+
+func (b *bulkhead) status() gin.H {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return gin.H{
+		"name":             b.name,
+		"limit":            cap(b.slots),
+		"in_flight":        len(b.slots),
+		"queued":           atomic.LoadInt32(&b.queued),
+		"queue_size":       b.queueSize,
+		"queue_timeout_ms": b.queueTimeout.Milliseconds(),
+		"rejected":         atomic.LoadInt64(&b.rejected),
+	}
+}
+
+// bulkheadRegistry holds the bulkheads by name, and which one each route uses
+type bulkheadRegistry struct {
+	mu        sync.RWMutex
+	bulkheads map[string]*bulkhead
+	byRoute   map[string]*bulkhead
+}
+
+func newBulkheadRegistry() *bulkheadRegistry {
+	return &bulkheadRegistry{
+		bulkheads: make(map[string]*bulkhead),
+		byRoute:   make(map[string]*bulkhead),
+	}
+}
+
+func (r *bulkheadRegistry) forRoute(routeID string) *bulkhead {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byRoute[routeID]
+}
+
+// bulkheadName is the bulkhead a route uses
+func bulkheadName(route *APIRoute) string {
+	if route.BulkheadScope == BulkheadScopeService {
+		return "service:" + route.ServiceName
+	}
+	return "route:" + route.Method + " " + route.Path
+}
+
+// syncBulkheads matches the bulkheads to the routes. A bulkhead whose limit
+// is unchanged is kept, so requests in flight stay counted; one whose limit
+// changed is replaced, and requests holding its old slots release them there.
+func (s *APIGatewayService) syncBulkheads(routes []*APIRoute) {
+	type settings struct {
+		limit, queueSize, queueTimeoutMs int
+	}
+	wanted := map[string]settings{}
+	for _, route := range routes {
+		if route.MaxConcurrentRequests <= 0 {
+			continue
+		}
+		name := bulkheadName(route)
+		current, ok := wanted[name]
+		if !ok || route.MaxConcurrentRequests < current.limit {
+			wanted[name] = settings{route.MaxConcurrentRequests, route.BulkheadQueueSize, route.BulkheadQueueTimeout}
+		}
+	}
+
+	s.bulkheads.mu.Lock()
+	defer s.bulkheads.mu.Unlock()
+
+	bulkheads := make(map[string]*bulkhead, len(wanted))
+	for name, w := range wanted {
+		b, ok := s.bulkheads.bulkheads[name]
+		if !ok || cap(b.slots) != w.limit {
+			b = newBulkhead(name, w.limit)
+		}
+		b.mu.Lock()
+		b.queueSize = w.queueSize
+		b.queueTimeout = time.Duration(w.queueTimeoutMs) * time.Millisecond
+		b.mu.Unlock()
+		bulkheads[name] = b
+	}
+
+	byRoute := make(map[string]*bulkhead)
+	for _, route := range routes {
+		if route.MaxConcurrentRequests > 0 {
+			byRoute[route.ID] = bulkheads[bulkheadName(route)]
+		}
+	}
+	s.bulkheads.bulkheads = bulkheads
+	s.bulkheads.byRoute = byRoute
+}
+
+func (s *APIGatewayService) rejectBulkhead(c *gin.Context, route *APIRoute, reason, requestID string, startTime time.Time) {
+	s.logRequest(c, requestID, route.ServiceName, http.StatusServiceUnavailable, time.Since(startTime), "Bulkhead full: "+reason)
+
+	c.Header("Retry-After", "1")
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":       "Service temporarily unavailable",
+		"reason":      "bulkhead_full",
+		"retry_after": 1,
+	})
+}
+
+// List all bulkheads and their occupancy
+func (s *APIGatewayService) listBulkheads(c *gin.Context) {
+	s.bulkheads.mu.RLock()
+	statuses := make([]gin.H, 0, len(s.bulkheads.bulkheads))
+	for _, b := range s.bulkheads.bulkheads {
+		statuses = append(statuses, b.status())
+	}
+	s.bulkheads.mu.RUnlock()
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i]["name"].(string) < statuses[j]["name"].(string)
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"bulkheads": statuses,
+		"total":     len(statuses),
+	})
+}
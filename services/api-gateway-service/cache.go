@@ -0,0 +1,662 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm/clause"
+)
+
+// Response caching. A route with an enabled cache policy has its GET and
+// HEAD responses stored in Redis and served from there while fresh. The
+// backend's Cache-Control decides what is stored and for how long
+// (s-maxage, max-age or Expires, falling back to the policy TTL); no-store,
+// private and no-cache responses, responses setting cookies and Vary: *
+// responses are never stored. Responses vary on the request headers named
+// in their Vary header. Clients may skip the cache with Cache-Control:
+// no-store, or force a refresh with no-cache or max-age=0.
+//
+// Once a response is stale it is still served for stale-while-revalidate
+// seconds (from the response, or the policy) while one request refreshes it
+// in the background.
+//
+// The cache key is rendered from the policy's key template, which may use
+// {method}, {path}, {query}, {user} and {header:Name}. Responses to
+// authenticated requests are only stored when the key includes {user} or
+// the backend marks them public.
+
+const (
+	cacheKeyPrefix          = "gateway_cache:"
+	defaultCacheKeyTemplate = "{method}:{path}?{query}"
+	defaultCacheMaxBody     = 1 << 20
+	cacheRefreshLockTTL     = 30 * time.Second
+	cacheHeader             = "X-Cache"
+)
+
+// Cache results
+const (
+	CacheResultHit    = "hit"
+	CacheResultStale  = "stale"
+	CacheResultMiss   = "miss"
+	CacheResultBypass = "bypass"
+)
+
+// RouteCachePolicy holds a route's response cache settings
+type RouteCachePolicy struct {
+	RouteID              string    `json:"route_id" gorm:"primaryKey"`
+	Enabled              bool      `json:"enabled"`
+	TTLSeconds           int       `json:"ttl_seconds"`     // when the response sets no lifetime
+	MaxTTLSeconds        int       `json:"max_ttl_seconds"` // 0: no cap
+	StaleWhileRevalidate int       `json:"stale_while_revalidate_seconds"`
+	KeyTemplate          string    `json:"key_template"`
+	MaxBodyBytes         int       `json:"max_body_bytes"`
+	UpdatedAt            time.Time `json:"updated_at"`
+}
+
+var (
+	cacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_cache_requests_total",
+			Help: "Cacheable requests by cache result",
+		},
+		[]string{"service", "result"},
+	)
+
+	cacheStores = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_cache_stores_total",
+			Help: "Responses considered for the cache, by whether they were stored",
+		},
+		[]string{"service", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cacheRequests)
+	prometheus.MustRegister(cacheStores)
+}
+
+// cacheKeyPart is a literal or a placeholder of a key template
+type cacheKeyPart struct {
+	literal string
+	field   string // method, path, query, user or header
+	header  string
+}
+
+// compiledCachePolicy is a cache policy ready to use
+type compiledCachePolicy struct {
+	policy  RouteCachePolicy
+	key     []cacheKeyPart
+	perUser bool
+}
+
+func compileCacheKeyTemplate(template string) ([]cacheKeyPart, bool, error) {
+	var parts []cacheKeyPart
+	perUser := false
+	for template != "" {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			parts = append(parts, cacheKeyPart{literal: template})
+			break
+		}
+		if start > 0 {
+			parts = append(parts, cacheKeyPart{literal: template[:start]})
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			return nil, false, fmt.Errorf("unclosed placeholder in key template")
+		}
+		name := strings.TrimSpace(template[start+1 : start+end])
+		switch {
+		case name == "method", name == "path", name == "query":
+			parts = append(parts, cacheKeyPart{field: name})
+		case name == "user":
+			parts = append(parts, cacheKeyPart{field: name})
+			perUser = true
+		case strings.HasPrefix(name, "header:") && len(name) > len("header:"):
+			parts = append(parts, cacheKeyPart{field: "header", header: http.CanonicalHeaderKey(name[len("header:"):])})
+		default:
+			return nil, false, fmt.Errorf("unknown key placeholder {%s}", name)
+		}
+		template = template[start+end+1:]
+	}
+	return parts, perUser, nil
+}
+
+func compileCachePolicy(policy *RouteCachePolicy) (*compiledCachePolicy, error) {
+	template := policy.KeyTemplate
+	if template == "" {
+		template = defaultCacheKeyTemplate
+	}
+	key, perUser, err := compileCacheKeyTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	if policy.TTLSeconds < 0 || policy.MaxTTLSeconds < 0 || policy.StaleWhileRevalidate < 0 || policy.MaxBodyBytes < 0 {
+		return nil, fmt.Errorf("cache settings must not be negative")
+	}
+	return &compiledCachePolicy{policy: *policy, key: key, perUser: perUser}, nil
+}
+
+// renderKey builds the cache key of a request
+func (p *compiledCachePolicy) renderKey(c *gin.Context) string {
+	var key strings.Builder
+	for _, part := range p.key {
+		switch part.field {
+		case "":
+			key.WriteString(part.literal)
+		case "method":
+			// HEAD is answered from the GET response
+			key.WriteString(http.MethodGet)
+		case "path":
+			key.WriteString(c.Request.URL.Path)
+		case "query":
+			// Sorted, so parameter order does not split the cache
+			key.WriteString(c.Request.URL.Query().Encode())
+		case "user":
+			key.WriteString(c.GetString("user_id"))
+		case "header":
+			key.WriteString(c.GetHeader(part.header))
+		}
+	}
+	return key.String()
+}
+
+func (p *compiledCachePolicy) maxBody() int {
+	if p.policy.MaxBodyBytes > 0 {
+		return p.policy.MaxBodyBytes
+	}
+	return defaultCacheMaxBody
+}
+
+type cacheRegistry struct {
+	mu       sync.RWMutex
+	policies map[string]*compiledCachePolicy
+}
+
+func newCacheRegistry() *cacheRegistry {
+	return &cacheRegistry{policies: make(map[string]*compiledCachePolicy)}
+}
+
+func (r *cacheRegistry) get(routeID string) *compiledCachePolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.policies[routeID]
+}
+
+// syncCaches compiles the cache policies of the routes
+func (s *APIGatewayService) syncCaches(routes []*APIRoute) {
+	policies := make(map[string]*compiledCachePolicy)
+	for _, route := range routes {
+		if route.CachePolicy == nil || !route.CachePolicy.Enabled {
+			continue
+		}
+		policy, err := compileCachePolicy(route.CachePolicy)
+		if err != nil {
+			log.Printf("Ignoring cache policy of route %s: %v", route.ID, err)
+			continue
+		}
+		policies[route.ID] = policy
+	}
+
+	s.caches.mu.Lock()
+	s.caches.policies = policies
+	s.caches.mu.Unlock()
+}
+
+// cacheEntry is a stored response
+type cacheEntry struct {
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+	StoredAt time.Time   `json:"stored_at"`
+	TTL      int         `json:"ttl"`   // seconds fresh
+	Stale    int         `json:"stale"` // seconds served stale while revalidating
+}
+
+// cacheLookup is a cacheable request on its way through the gateway
+type cacheLookup struct {
+	route   *APIRoute
+	policy  *compiledCachePolicy
+	baseKey string
+	request *http.Request // for revalidation
+}
+
+func (l *cacheLookup) varyKey() string {
+	return l.baseKey + "#vary"
+}
+
+// variantKey is the entry key for the request headers the response varies on
+func (l *cacheLookup) variantKey(vary []string, header http.Header) string {
+	if len(vary) == 0 {
+		return l.baseKey + "#"
+	}
+	hash := sha256.New()
+	for _, name := range vary {
+		hash.Write([]byte(name + "=" + strings.Join(header.Values(name), ",") + "\n"))
+	}
+	return l.baseKey + "#" + hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+// parseCacheControl reads a Cache-Control header into lower-cased directives
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(value, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+		name, arg, _ := strings.Cut(directive, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(arg), `"`)
+	}
+	return directives
+}
+
+func directiveSeconds(directives map[string]string, name string) (int, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return seconds, true
+}
+
+// serveFromCache answers the request from the cache when it can. It returns
+// the lookup to store the backend's response with when the request goes on
+// to the backend, and whether the request was answered.
+func (s *APIGatewayService) serveFromCache(c *gin.Context, route *APIRoute) (*cacheLookup, bool) {
+	policy := s.caches.get(route.ID)
+	if policy == nil || (c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead) {
+		return nil, false
+	}
+
+	directives := parseCacheControl(c.GetHeader("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		cacheRequests.WithLabelValues(route.ServiceName, CacheResultBypass).Inc()
+		return nil, false
+	}
+	lookup := &cacheLookup{
+		route:   route,
+		policy:  policy,
+		baseKey: cacheKeyPrefix + route.ID + ":" + policy.renderKey(c),
+		request: c.Request.Clone(context.Background()),
+	}
+	lookup.request.Method = http.MethodGet
+	lookup.request.Body = nil
+	lookup.request.Header.Del("Cache-Control")
+	lookup.request.Header.Del("Pragma")
+
+	// The client asks for a fresh response; store whatever the backend sends
+	maxAge, hasMaxAge := directiveSeconds(directives, "max-age")
+	if _, noCache := directives["no-cache"]; noCache || (hasMaxAge && maxAge == 0) || c.GetHeader("Pragma") == "no-cache" {
+		cacheRequests.WithLabelValues(route.ServiceName, CacheResultBypass).Inc()
+		return lookup, false
+	}
+
+	entry := s.loadCacheEntry(c.Request.Context(), lookup, c.Request.Header)
+	if entry == nil {
+		cacheRequests.WithLabelValues(route.ServiceName, CacheResultMiss).Inc()
+		c.Header(cacheHeader, "MISS")
+		return lookup, false
+	}
+
+	age := int(time.Since(entry.StoredAt).Seconds())
+	var result string
+	switch {
+	case hasMaxAge && age > maxAge:
+		result = CacheResultMiss
+	case age < entry.TTL:
+		result = CacheResultHit
+	case age < entry.TTL+entry.Stale:
+		result = CacheResultStale
+		s.revalidateInBackground(lookup)
+	default:
+		result = CacheResultMiss
+	}
+	if result == CacheResultMiss {
+		cacheRequests.WithLabelValues(route.ServiceName, CacheResultMiss).Inc()
+		c.Header(cacheHeader, "MISS")
+		return lookup, false
+	}
+	cacheRequests.WithLabelValues(route.ServiceName, result).Inc()
+
+	header := c.Writer.Header()
+	for name, values := range entry.Header {
+		header[name] = values
+	}
+	header.Set("Age", strconv.Itoa(age))
+	header.Set(cacheHeader, strings.ToUpper(result))
+	header.Set("X-Request-ID", c.GetString("request_id"))
+	body := s.compressCachedBody(c.Request, route, entry.Status, header, entry.Body)
+	c.Status(entry.Status)
+	if c.Request.Method != http.MethodHead {
+		c.Writer.Write(body)
+	} else {
+		c.Writer.WriteHeaderNow()
+	}
+	return nil, true
+}
+
+// loadCacheEntry finds the stored response matching the request's headers
+func (s *APIGatewayService) loadCacheEntry(ctx context.Context, lookup *cacheLookup, header http.Header) *cacheEntry {
+	var vary []string
+	if raw, err := s.redis.Get(ctx, lookup.varyKey()).Result(); err == nil {
+		json.Unmarshal([]byte(raw), &vary)
+	}
+	raw, err := s.redis.Get(ctx, lookup.variantKey(vary, header)).Bytes()
+	if err != nil {
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil
+	}
+	return &entry
+}
+
+// cacheableStatus lists the statuses stored without explicit freshness
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// responseLifetime works out how long a response stays fresh and may be
+// served stale, or false when it must not be stored
+func (l *cacheLookup) responseLifetime(resp *http.Response) (int, int, bool) {
+	if !cacheableStatus[resp.StatusCode] || resp.Header.Get("Set-Cookie") != "" {
+		return 0, 0, false
+	}
+	directives := parseCacheControl(strings.Join(resp.Header.Values("Cache-Control"), ","))
+	for _, name := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := directives[name]; ok {
+			return 0, 0, false
+		}
+	}
+	if strings.Contains(resp.Header.Get("Vary"), "*") {
+		return 0, 0, false
+	}
+
+	// A shared cache keeps authenticated responses only when told it may,
+	// or when the key keeps users apart
+	_, public := directives["public"]
+	_, shared := directives["s-maxage"]
+	authenticated := l.request.Header.Get("Authorization") != "" || l.request.Header.Get("X-API-Key") != ""
+	if authenticated && !l.policy.perUser && !public && !shared {
+		return 0, 0, false
+	}
+
+	ttl := l.policy.policy.TTLSeconds
+	if seconds, ok := directiveSeconds(directives, "s-maxage"); ok {
+		ttl = seconds
+	} else if seconds, ok := directiveSeconds(directives, "max-age"); ok {
+		ttl = seconds
+	} else if expires, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+		ttl = int(time.Until(expires).Seconds())
+	}
+	if maxTTL := l.policy.policy.MaxTTLSeconds; maxTTL > 0 && ttl > maxTTL {
+		ttl = maxTTL
+	}
+	if ttl <= 0 {
+		return 0, 0, false
+	}
+
+	stale := l.policy.policy.StaleWhileRevalidate
+	if seconds, ok := directiveSeconds(directives, "stale-while-revalidate"); ok {
+		stale = seconds
+	}
+	return ttl, stale, true
+}
+
+// storeCachedResponse stores a backend response if it may be cached. The
+// body is read into memory and handed on unchanged.
+func (s *APIGatewayService) storeCachedResponse(lookup *cacheLookup, resp *http.Response) {
+	service := lookup.route.ServiceName
+	ttl, stale, ok := lookup.responseLifetime(resp)
+	if !ok || resp.ContentLength > int64(lookup.policy.maxBody()) {
+		cacheStores.WithLabelValues(service, "skipped").Inc()
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(lookup.policy.maxBody())+1))
+	if err != nil || len(body) > lookup.policy.maxBody() {
+		// Too large to keep: pass on what was read and the rest
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		cacheStores.WithLabelValues(service, "skipped").Inc()
+		return
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	header := resp.Header.Clone()
+	for _, name := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "X-Request-ID", gatewayRetriesHeader, cacheHeader, "Age"} {
+		header.Del(name)
+	}
+	entry := cacheEntry{
+		Status:   resp.StatusCode,
+		Header:   header,
+		Body:     body,
+		StoredAt: time.Now().UTC(),
+		TTL:      ttl,
+		Stale:    stale,
+	}
+	var vary []string
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	varyData, _ := json.Marshal(vary)
+	expiry := time.Duration(ttl+stale) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, lookup.varyKey(), varyData, expiry)
+	pipe.Set(ctx, lookup.variantKey(vary, lookup.request.Header), data, expiry)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to cache response for %s: %v", lookup.baseKey, err)
+		return
+	}
+	cacheStores.WithLabelValues(service, "stored").Inc()
+}
+
+// revalidateInBackground refreshes a stale entry, once across replicas
+func (s *APIGatewayService) revalidateInBackground(lookup *cacheLookup) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(lookup.route.Timeout)*time.Second)
+		defer cancel()
+
+		claimed, err := s.redis.SetNX(ctx, lookup.baseKey+"#refresh", 1, cacheRefreshLockTTL).Result()
+		if err != nil || !claimed {
+			return
+		}
+		defer s.redis.Del(context.Background(), lookup.baseKey+"#refresh")
+
+		_, endpoint := s.pickUpstream(ctx, lookup.route)
+		if endpoint == nil {
+			return
+		}
+		req := lookup.request.Clone(ctx)
+		req.URL = upstreamURL(endpoint.target, lookup.request.URL)
+		req.Host = ""
+		req.RequestURI = ""
+		req.Header.Set("X-Gateway-Service", "002aic-api-gateway")
+
+		resp, err := s.transportFor(lookup.route).RoundTrip(req)
+		if err != nil {
+			log.Printf("Failed to revalidate %s: %v", lookup.baseKey, err)
+			return
+		}
+		defer resp.Body.Close()
+		if transform := s.transforms.get(lookup.route.ID); transform != nil && transform.response != nil {
+			if err := applyResponseTransform(resp, transform.response); err != nil {
+				return
+			}
+		}
+		s.storeCachedResponse(lookup, resp)
+	}()
+}
+
+// purgeCache deletes the entries of a route, or of all routes, whose key
+// matches a glob pattern
+func (s *APIGatewayService) purgeCache(ctx context.Context, routeID, pattern string) (int64, error) {
+	if routeID == "" {
+		routeID = "*"
+	}
+	if pattern == "" {
+		pattern = "*"
+	}
+	match := cacheKeyPrefix + routeID + ":" + pattern + "#*"
+
+	var purged int64
+	iter := s.redis.Scan(ctx, 0, match, 500).Iterator()
+	var batch []string
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == 500 {
+			n, err := s.redis.Del(ctx, batch...).Result()
+			if err != nil {
+				return purged, err
+			}
+			purged += n
+			batch = batch[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return purged, err
+	}
+	if len(batch) > 0 {
+		n, err := s.redis.Del(ctx, batch...).Result()
+		if err != nil {
+			return purged, err
+		}
+		purged += n
+	}
+	return purged, nil
+}
+
+// Get a route's cache policy
+func (s *APIGatewayService) getRouteCachePolicy(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("CachePolicy").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	policy := RouteCachePolicy{RouteID: route.ID, KeyTemplate: defaultCacheKeyTemplate, MaxBodyBytes: defaultCacheMaxBody}
+	if route.CachePolicy != nil {
+		policy = *route.CachePolicy
+	}
+	c.JSON(http.StatusOK, policy)
+}
+
+// Configure a route's cache policy
+func (s *APIGatewayService) updateRouteCachePolicy(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("CachePolicy").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	policy := RouteCachePolicy{Enabled: true, TTLSeconds: 60, KeyTemplate: defaultCacheKeyTemplate, MaxBodyBytes: defaultCacheMaxBody}
+	if route.CachePolicy != nil {
+		policy = *route.CachePolicy
+	}
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	policy.RouteID = route.ID
+	policy.UpdatedAt = time.Now()
+	if _, err := compileCachePolicy(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save cache policy"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// Remove a route's cache policy and its cached responses
+func (s *APIGatewayService) deleteRouteCachePolicy(c *gin.Context) {
+	if err := s.db.Delete(&RouteCachePolicy{}, "route_id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete cache policy"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+	purged, err := s.purgeCache(c.Request.Context(), c.Param("id"), "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge cached responses"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Cache policy deleted successfully", "purged": purged})
+}
+
+// Purge cached responses by route and/or key pattern
+func (s *APIGatewayService) purgeResponseCache(c *gin.Context) {
+	var req struct {
+		RouteID string `json:"route_id"`
+		Pattern string `json:"pattern"` // glob over rendered cache keys
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.RouteID == "" && req.Pattern == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "route_id or pattern is required"})
+		return
+	}
+
+	purged, err := s.purgeCache(c.Request.Context(), req.RouteID, req.Pattern)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge cache"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"route_id": req.RouteID,
+		"pattern":  req.Pattern,
+		"purged":   purged,
+	})
+}
@@ -0,0 +1,657 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Traffic splitting. A route may run several versions of its backend side
+// by side, each with its own upstream and a weight, e.g. 95 for v1 and 5
+// for a v2 canary. Each request is assigned a version in proportion to the
+// weights. With StickyBy the assignment is a hash of the user (or of a
+// header), so a client keeps seeing the same version for as long as the
+// weights allow. X-Route-Version picks a version explicitly, for testing.
+// The response names the version that served it in the same header.
+//
+// Outcomes are counted per version in Redis, shared by every replica. With
+// AutoRollback, a version other than the baseline whose error rate (5xx or
+// no response) over the evaluation window exceeds MaxErrorRate, with at
+// least MinRequests requests seen, loses its traffic to the baseline.
+
+const (
+	routeVersionHeader    = "X-Route-Version"
+	versionStatsPrefix    = "gateway_version_stats:"
+	versionStatsBucket    = 10 * time.Second
+	canaryCheckInterval   = 15 * time.Second
+	canaryRollbackLockTTL = time.Minute
+)
+
+// Sticky assignment modes
+const (
+	StickyNone   = "none"
+	StickyUser   = "user"
+	StickyHeader = "header"
+)
+
+// RouteTrafficSplit configures how a route's requests are split over its
+// versions
+type RouteTrafficSplit struct {
+	RouteID          string     `json:"route_id" gorm:"primaryKey"`
+	Enabled          bool       `json:"enabled"`
+	StickyBy         string     `json:"sticky_by" gorm:"default:user"` // none, user or header
+	StickyHeader     string     `json:"sticky_header"`
+	AutoRollback     bool       `json:"auto_rollback"`
+	MaxErrorRate     float64    `json:"max_error_rate"`                       // 0-1
+	MinRequests      int        `json:"min_requests" gorm:"default:100"`      // per evaluation window
+	EvaluationWindow int        `json:"evaluation_window" gorm:"default:300"` // seconds
+	RolledBackAt     *time.Time `json:"rolled_back_at"`
+	RollbackReason   string     `json:"rollback_reason"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// RouteVersion is one version of a route's backend
+type RouteVersion struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	RouteID   string    `json:"route_id" gorm:"uniqueIndex:idx_route_version;not null"`
+	Name      string    `json:"name" gorm:"uniqueIndex:idx_route_version;not null"`
+	URL       string    `json:"url" gorm:"not null"`
+	Weight    int       `json:"weight"`
+	Baseline  bool      `json:"baseline"` // receives the traffic of rolled back versions
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var (
+	routeVersionRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_route_version_requests_total",
+			Help: "Requests served per route version",
+		},
+		[]string{"route", "version", "result"},
+	)
+
+	routeVersionRollbacks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_route_version_rollbacks_total",
+			Help: "Route versions rolled back for exceeding their error rate",
+		},
+		[]string{"route", "version"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(routeVersionRequests)
+	prometheus.MustRegister(routeVersionRollbacks)
+}
+
+// liveVersion is a version ready to take traffic
+type liveVersion struct {
+	name     string
+	weight   int
+	baseline bool
+	pool     *upstreamPool
+}
+
+// trafficSplit is the live split of one route
+type trafficSplit struct {
+	config   RouteTrafficSplit
+	versions []*liveVersion // in creation order, so hash ranges stay put
+	total    int
+}
+
+type versionRegistry struct {
+	mu     sync.RWMutex
+	splits map[string]*trafficSplit
+}
+
+func newVersionRegistry() *versionRegistry {
+	return &versionRegistry{splits: make(map[string]*trafficSplit)}
+}
+
+func (r *versionRegistry) get(routeID string) *trafficSplit {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.splits[routeID]
+}
+
+// syncVersions rebuilds the traffic splits of the routes, keeping the
+// endpoint state of versions that remain
+func (s *APIGatewayService) syncVersions(routes []*APIRoute) {
+	s.versions.mu.RLock()
+	previous := s.versions.splits
+	s.versions.mu.RUnlock()
+
+	splits := make(map[string]*trafficSplit)
+	for _, route := range routes {
+		if route.TrafficSplit == nil || !route.TrafficSplit.Enabled || len(route.Versions) == 0 {
+			continue
+		}
+		pools := make(map[string]*upstreamPool)
+		if old, ok := previous[route.ID]; ok {
+			for _, v := range old.versions {
+				pools[v.name] = v.pool
+			}
+		}
+
+		versions := append([]RouteVersion(nil), route.Versions...)
+		sort.SliceStable(versions, func(i, j int) bool { return versions[i].CreatedAt.Before(versions[j].CreatedAt) })
+
+		split := &trafficSplit{config: *route.TrafficSplit}
+		for _, v := range versions {
+			pool, ok := pools[v.Name]
+			if !ok {
+				pool = &upstreamPool{tier: -1}
+			}
+			pool.mu.Lock()
+			pool.routeID = route.ID
+			pool.service = route.ServiceName
+			pool.strategy = LoadBalancingRoundRobin
+			pool.mu.Unlock()
+			pool.setTargets([]upstreamTarget{{URL: v.URL, Weight: 1}})
+
+			split.versions = append(split.versions, &liveVersion{name: v.Name, weight: v.Weight, baseline: v.Baseline, pool: pool})
+			split.total += v.Weight
+		}
+		splits[route.ID] = split
+	}
+
+	s.versions.mu.Lock()
+	s.versions.splits = splits
+	s.versions.mu.Unlock()
+}
+
+// stickyKey is what a request's version assignment is hashed from, or ""
+// to assign at random
+func stickyKey(c *gin.Context, config *RouteTrafficSplit) string {
+	switch config.StickyBy {
+	case StickyUser:
+		if userID := c.GetString("user_id"); userID != "" {
+			return "user:" + userID
+		}
+		if apiKeyID := c.GetString("api_key_id"); apiKeyID != "" {
+			return "api_key:" + apiKeyID
+		}
+		return "ip:" + c.ClientIP()
+	case StickyHeader:
+		return c.GetHeader(config.StickyHeader)
+	}
+	return ""
+}
+
+// selectVersion assigns a request on route to one of its versions; nil when
+// the route does not split its traffic
+func (s *APIGatewayService) selectVersion(c *gin.Context, route *APIRoute) *liveVersion {
+	split := s.versions.get(route.ID)
+	if split == nil {
+		return nil
+	}
+
+	if requested := c.GetHeader(routeVersionHeader); requested != "" {
+		for _, v := range split.versions {
+			if v.name == requested {
+				return v
+			}
+		}
+	}
+	if split.total <= 0 {
+		// Every weight is zero; the baseline still answers
+		for _, v := range split.versions {
+			if v.baseline {
+				return v
+			}
+		}
+		return split.versions[0]
+	}
+
+	var point int
+	if key := stickyKey(c, &split.config); key != "" {
+		h := fnv.New64a()
+		h.Write([]byte(route.ID + "|" + key))
+		point = int(h.Sum64() % uint64(split.total))
+	} else {
+		point = rand.Intn(split.total)
+	}
+	for _, v := range split.versions {
+		if point < v.weight {
+			return v
+		}
+		point -= v.weight
+	}
+	return split.versions[len(split.versions)-1]
+}
+
+// recordVersionOutcome counts a response against the version that served it
+func (s *APIGatewayService) recordVersionOutcome(routeID, version string, status int) {
+	result := "success"
+	if status >= http.StatusInternalServerError {
+		result = "error"
+	}
+	routeVersionRequests.WithLabelValues(routeID, version, result).Inc()
+
+	bucket := time.Now().Truncate(versionStatsBucket).Unix()
+	key := fmt.Sprintf("%s%s:%s:%d", versionStatsPrefix, routeID, version, bucket)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	pipe := s.redis.TxPipeline()
+	pipe.HIncrBy(ctx, key, "total", 1)
+	if result == "error" {
+		pipe.HIncrBy(ctx, key, "failures", 1)
+	}
+	// Kept for the longest evaluation window allowed
+	pipe.Expire(ctx, key, 24*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to record version outcome for route %s: %v", routeID, err)
+	}
+}
+
+// versionStats sums a version's outcomes over the last window
+func (s *APIGatewayService) versionStats(ctx context.Context, routeID, version string, window time.Duration) (int64, int64, error) {
+	now := time.Now().Truncate(versionStatsBucket)
+	pipe := s.redis.Pipeline()
+	var cmds []*redis.SliceCmd
+	for t := now.Add(-window + versionStatsBucket); !t.After(now); t = t.Add(versionStatsBucket) {
+		key := fmt.Sprintf("%s%s:%s:%d", versionStatsPrefix, routeID, version, t.Unix())
+		cmds = append(cmds, pipe.HMGet(ctx, key, "total", "failures"))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return 0, 0, err
+	}
+
+	var total, failures int64
+	for _, cmd := range cmds {
+		values, err := cmd.Result()
+		if err != nil {
+			continue
+		}
+		total += redisInt(values[0])
+		failures += redisInt(values[1])
+	}
+	return total, failures, nil
+}
+
+func redisInt(value interface{}) int64 {
+	s, ok := value.(string)
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// startCanaryMonitor rolls back versions whose error rate is too high
+func (s *APIGatewayService) startCanaryMonitor() {
+	ticker := time.NewTicker(canaryCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.versions.mu.RLock()
+		splits := make(map[string]*trafficSplit, len(s.versions.splits))
+		for routeID, split := range s.versions.splits {
+			splits[routeID] = split
+		}
+		s.versions.mu.RUnlock()
+
+		for routeID, split := range splits {
+			if split.config.AutoRollback && split.config.MaxErrorRate > 0 {
+				s.evaluateCanaries(routeID, split)
+			}
+		}
+	}
+}
+
+func (s *APIGatewayService) evaluateCanaries(routeID string, split *trafficSplit) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	window := time.Duration(split.config.EvaluationWindow) * time.Second
+	if window < versionStatsBucket {
+		window = versionStatsBucket
+	}
+	for _, v := range split.versions {
+		if v.baseline || v.weight == 0 {
+			continue
+		}
+		total, failures, err := s.versionStats(ctx, routeID, v.name, window)
+		if err != nil {
+			log.Printf("Failed to read version stats for route %s: %v", routeID, err)
+			return
+		}
+		if total < int64(split.config.MinRequests) || total == 0 {
+			continue
+		}
+		rate := float64(failures) / float64(total)
+		if rate <= split.config.MaxErrorRate {
+			continue
+		}
+
+		// One replica acts; the others see the result on their next reload
+		lock := versionStatsPrefix + routeID + ":rollback"
+		acquired, err := s.redis.SetNX(ctx, lock, v.name, canaryRollbackLockTTL).Result()
+		if err != nil || !acquired {
+			return
+		}
+		reason := fmt.Sprintf("version %s error rate %.2f%% over %d requests exceeded %.2f%%",
+			v.name, rate*100, total, split.config.MaxErrorRate*100)
+		if err := s.rollbackVersions(routeID, []string{v.name}, reason); err != nil {
+			log.Printf("Failed to roll back route %s: %v", routeID, err)
+			return
+		}
+		routeVersionRollbacks.WithLabelValues(routeID, v.name).Inc()
+		log.Printf("⚠️ Rolled back route %s: %s", routeID, reason)
+	}
+}
+
+// rollbackVersions moves the weight of the named versions to the baseline
+func (s *APIGatewayService) rollbackVersions(routeID string, names []string, reason string) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var versions []RouteVersion
+		if err := tx.Where("route_id = ?", routeID).Find(&versions).Error; err != nil {
+			return err
+		}
+		var baseline *RouteVersion
+		moved := 0
+		rollback := make(map[string]bool, len(names))
+		for _, name := range names {
+			rollback[name] = true
+		}
+		for i := range versions {
+			if versions[i].Baseline {
+				baseline = &versions[i]
+			} else if rollback[versions[i].Name] {
+				moved += versions[i].Weight
+			}
+		}
+		if baseline == nil {
+			return fmt.Errorf("route has no baseline version")
+		}
+
+		now := time.Now()
+		if err := tx.Model(&RouteVersion{}).Where("route_id = ? AND name IN ? AND baseline = ?", routeID, names, false).
+			Updates(map[string]interface{}{"weight": 0, "updated_at": now}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(baseline).Updates(map[string]interface{}{"weight": baseline.Weight + moved, "updated_at": now}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&RouteTrafficSplit{}).Where("route_id = ?", routeID).
+			Updates(map[string]interface{}{"rolled_back_at": now, "rollback_reason": reason, "updated_at": now}).Error
+	})
+	if err != nil {
+		return err
+	}
+	return s.loadRoutes()
+}
+
+// versionsView describes a route's split with each version's recent stats
+func (s *APIGatewayService) versionsView(ctx context.Context, route *APIRoute) gin.H {
+	split := RouteTrafficSplit{RouteID: route.ID, StickyBy: StickyUser, MinRequests: 100, EvaluationWindow: 300}
+	if route.TrafficSplit != nil {
+		split = *route.TrafficSplit
+	}
+	window := time.Duration(split.EvaluationWindow) * time.Second
+
+	versions := make([]gin.H, 0, len(route.Versions))
+	for _, v := range route.Versions {
+		entry := gin.H{"version": v}
+		if total, failures, err := s.versionStats(ctx, route.ID, v.Name, window); err == nil {
+			entry["requests"] = total
+			entry["failures"] = failures
+			if total > 0 {
+				entry["success_rate"] = 1 - float64(failures)/float64(total)
+			}
+		}
+		versions = append(versions, entry)
+	}
+	return gin.H{
+		"route_id": route.ID,
+		"split":    split,
+		"versions": versions,
+	}
+}
+
+// Get a route's versions, split settings and recent per-version stats
+func (s *APIGatewayService) getRouteVersions(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("TrafficSplit").Preload("Versions").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+	c.JSON(http.StatusOK, s.versionsView(c.Request.Context(), &route))
+}
+
+// Replace a route's versions and split settings
+func (s *APIGatewayService) setRouteVersions(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("TrafficSplit").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	var req struct {
+		Enabled          *bool   `json:"enabled"`
+		StickyBy         string  `json:"sticky_by"`
+		StickyHeader     string  `json:"sticky_header"`
+		AutoRollback     bool    `json:"auto_rollback"`
+		MaxErrorRate     float64 `json:"max_error_rate" binding:"min=0,max=1"`
+		MinRequests      int     `json:"min_requests" binding:"min=0"`
+		EvaluationWindow int     `json:"evaluation_window" binding:"min=0,max=86400"`
+		Versions         []struct {
+			Name     string `json:"name" binding:"required"`
+			URL      string `json:"url" binding:"required"`
+			Weight   int    `json:"weight" binding:"min=0"`
+			Baseline bool   `json:"baseline"`
+		} `json:"versions" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	split := RouteTrafficSplit{
+		RouteID:          route.ID,
+		Enabled:          true,
+		StickyBy:         req.StickyBy,
+		StickyHeader:     req.StickyHeader,
+		AutoRollback:     req.AutoRollback,
+		MaxErrorRate:     req.MaxErrorRate,
+		MinRequests:      req.MinRequests,
+		EvaluationWindow: req.EvaluationWindow,
+		UpdatedAt:        time.Now(),
+	}
+	if req.Enabled != nil {
+		split.Enabled = *req.Enabled
+	}
+	switch split.StickyBy {
+	case "":
+		split.StickyBy = StickyUser
+	case StickyNone, StickyUser:
+	case StickyHeader:
+		if split.StickyHeader == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sticky_header is required when sticky_by is header"})
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sticky_by must be none, user or header"})
+		return
+	}
+	if split.MinRequests == 0 {
+		split.MinRequests = 100
+	}
+	if split.EvaluationWindow == 0 {
+		split.EvaluationWindow = 300
+	}
+	if split.AutoRollback && split.MaxErrorRate == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_error_rate is required for auto_rollback"})
+		return
+	}
+
+	now := time.Now()
+	baselines := 0
+	seen := make(map[string]bool)
+	versions := make([]RouteVersion, 0, len(req.Versions))
+	for i, v := range req.Versions {
+		target, err := url.Parse(v.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version URL: " + v.URL})
+			return
+		}
+		if seen[v.Name] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Duplicate version name: " + v.Name})
+			return
+		}
+		seen[v.Name] = true
+		if v.Baseline {
+			baselines++
+		}
+		versions = append(versions, RouteVersion{
+			ID:       uuid.New().String(),
+			RouteID:  route.ID,
+			Name:     v.Name,
+			URL:      v.URL,
+			Weight:   v.Weight,
+			Baseline: v.Baseline,
+			// Keeps the order versions were given in, which fixes their
+			// hash ranges
+			CreatedAt: now.Add(time.Duration(i) * time.Microsecond),
+			UpdatedAt: now,
+		})
+	}
+	if baselines != 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Exactly one version must be the baseline"})
+		return
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("route_id = ?", route.ID).Delete(&RouteVersion{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&versions).Error; err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&split).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save route versions"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	route.TrafficSplit = &split
+	route.Versions = versions
+	c.JSON(http.StatusOK, s.versionsView(c.Request.Context(), &route))
+}
+
+// Shift traffic between a route's versions
+func (s *APIGatewayService) shiftRouteVersionWeights(c *gin.Context) {
+	var req struct {
+		Weights map[string]int `json:"weights" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var versions []RouteVersion
+	if err := s.db.Where("route_id = ?", c.Param("id")).Find(&versions).Error; err != nil || len(versions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route has no versions"})
+		return
+	}
+	known := make(map[string]bool, len(versions))
+	for _, v := range versions {
+		known[v.Name] = true
+	}
+	for name, weight := range req.Weights {
+		if !known[name] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown version: " + name})
+			return
+		}
+		if weight < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Weights must not be negative"})
+			return
+		}
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		for name, weight := range req.Weights {
+			if err := tx.Model(&RouteVersion{}).Where("route_id = ? AND name = ?", c.Param("id"), name).
+				Updates(map[string]interface{}{"weight": weight, "updated_at": time.Now()}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update weights"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	var route APIRoute
+	s.db.Preload("TrafficSplit").Preload("Versions").First(&route, "id = ?", c.Param("id"))
+	c.JSON(http.StatusOK, s.versionsView(c.Request.Context(), &route))
+}
+
+// Send all of a route's traffic back to its baseline version
+func (s *APIGatewayService) rollbackRouteVersions(c *gin.Context) {
+	var versions []RouteVersion
+	if err := s.db.Where("route_id = ? AND baseline = ?", c.Param("id"), false).Find(&versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load route versions"})
+		return
+	}
+	names := make([]string, 0, len(versions))
+	for _, v := range versions {
+		names = append(names, v.Name)
+	}
+	if len(names) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route has no versions to roll back"})
+		return
+	}
+
+	if err := s.rollbackVersions(c.Param("id"), names, "manual rollback by "+c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to roll back: " + err.Error()})
+		return
+	}
+
+	var route APIRoute
+	s.db.Preload("TrafficSplit").Preload("Versions").First(&route, "id = ?", c.Param("id"))
+	c.JSON(http.StatusOK, s.versionsView(c.Request.Context(), &route))
+}
+
+// Stop splitting a route's traffic and remove its versions
+func (s *APIGatewayService) deleteRouteVersions(c *gin.Context) {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("route_id = ?", c.Param("id")).Delete(&RouteVersion{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("route_id = ?", c.Param("id")).Delete(&RouteTrafficSplit{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete route versions"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Route versions deleted successfully"})
+}
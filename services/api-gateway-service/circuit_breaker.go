@@ -0,0 +1,472 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm/clause"
+)
+
+// Circuit breakers stop the gateway from queueing requests behind a backend
+// that is failing or too slow. Each route has a breaker that tracks the
+// outcome of its proxied requests over a sliding window. When enough
+// requests have been seen and the error rate or the rate of slow calls
+// crosses its threshold, the breaker opens and the route answers 503 without
+// contacting the backend. After the open period a few probe requests are let
+// through (half-open); if they succeed the breaker closes, otherwise it opens
+// again. Routes without their own settings use the gateway defaults.
+
+// Circuit breaker states
+const (
+	BreakerStateClosed   = "closed"
+	BreakerStateOpen     = "open"
+	BreakerStateHalfOpen = "half_open"
+)
+
+// RouteCircuitBreaker holds a route's breaker settings
+type RouteCircuitBreaker struct {
+	RouteID               string    `json:"route_id" gorm:"primaryKey"`
+	Enabled               bool      `json:"enabled"`
+	ErrorRateThreshold    float64   `json:"error_rate_threshold"`     // 0-1
+	SlowCallThresholdMs   int       `json:"slow_call_threshold_ms"`   // calls slower than this count as slow
+	SlowCallRateThreshold float64   `json:"slow_call_rate_threshold"` // 0-1, 0 disables
+	MinRequests           int       `json:"min_requests"`
+	WindowSeconds         int       `json:"window_seconds"`
+	OpenSeconds           int       `json:"open_seconds"`
+	HalfOpenProbes        int       `json:"half_open_probes"`
+	UpdatedAt             time.Time `json:"updated_at"`
+}
+
+var (
+	breakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "api_gateway_circuit_breaker_state",
+			Help: "Circuit breaker state per route (0 closed, 1 half-open, 2 open)",
+		},
+		[]string{"route", "service"},
+	)
+
+	breakerTransitions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_circuit_breaker_transitions_total",
+			Help: "Circuit breaker state changes",
+		},
+		[]string{"route", "service", "state"},
+	)
+
+	breakerRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_circuit_breaker_rejections_total",
+			Help: "Requests rejected by an open circuit breaker",
+		},
+		[]string{"route", "service"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(breakerState)
+	prometheus.MustRegister(breakerTransitions)
+	prometheus.MustRegister(breakerRejections)
+}
+
+func breakerStateValue(state string) float64 {
+	switch state {
+	case BreakerStateHalfOpen:
+		return 1
+	case BreakerStateOpen:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// defaultCircuitBreaker returns the gateway-wide settings
+func (s *APIGatewayService) defaultCircuitBreaker(routeID string) RouteCircuitBreaker {
+	return RouteCircuitBreaker{
+		RouteID:               routeID,
+		Enabled:               s.config.CircuitBreakerEnabled,
+		ErrorRateThreshold:    0.5,
+		SlowCallThresholdMs:   5000,
+		SlowCallRateThreshold: 0,
+		MinRequests:           20,
+		WindowSeconds:         30,
+		OpenSeconds:           30,
+		HalfOpenProbes:        3,
+	}
+}
+
+// breakerBucket counts outcomes of one second
+type breakerBucket struct {
+	second   int64
+	total    int
+	failures int
+	slow     int
+}
+
+// circuitBreaker is the live state of one route's breaker
+type circuitBreaker struct {
+	mu       sync.Mutex
+	route    string
+	service  string
+	settings RouteCircuitBreaker
+
+	state     string
+	buckets   []breakerBucket
+	openUntil time.Time
+	probing   int // probes in flight
+	succeeded int // probes succeeded since half-open
+	changedAt time.Time
+}
+
+func newCircuitBreaker(route, service string, settings RouteCircuitBreaker) *circuitBreaker {
+	b := &circuitBreaker{route: route, service: service, state: BreakerStateClosed, changedAt: time.Now()}
+	b.configure(settings)
+	breakerState.WithLabelValues(route, service).Set(0)
+	return b
+}
+
+func (b *circuitBreaker) configure(settings RouteCircuitBreaker) {
+	if settings.WindowSeconds <= 0 {
+		settings.WindowSeconds = 30
+	}
+	if settings.HalfOpenProbes <= 0 {
+		settings.HalfOpenProbes = 1
+	}
+	if settings.OpenSeconds <= 0 {
+		settings.OpenSeconds = 30
+	}
+	if len(b.buckets) != settings.WindowSeconds {
+		b.buckets = make([]breakerBucket, settings.WindowSeconds)
+	}
+	b.settings = settings
+	if !settings.Enabled {
+		b.transition(BreakerStateClosed)
+	}
+}
+
+// transition changes state; the caller holds the mutex
+func (b *circuitBreaker) transition(state string) {
+	if b.state == state {
+		return
+	}
+	log.Printf("Circuit breaker for %s (%s): %s -> %s", b.route, b.service, b.state, state)
+	b.state = state
+	b.changedAt = time.Now()
+	b.probing = 0
+	b.succeeded = 0
+	if state == BreakerStateClosed {
+		for i := range b.buckets {
+			b.buckets[i] = breakerBucket{}
+		}
+	}
+	breakerState.WithLabelValues(b.route, b.service).Set(breakerStateValue(state))
+	breakerTransitions.WithLabelValues(b.route, b.service, state).Inc()
+}
+
+// allow reports whether a request may go to the backend, and if not how long
+// until the breaker will try it again. An allowed request must be followed by
+// exactly one call to done.
+func (b *circuitBreaker) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.settings.Enabled {
+		return true, 0
+	}
+
+	switch b.state {
+	case BreakerStateOpen:
+		wait := time.Until(b.openUntil)
+		if wait > 0 {
+			return false, wait
+		}
+		b.transition(BreakerStateHalfOpen)
+		fallthrough
+	case BreakerStateHalfOpen:
+		if b.probing >= b.settings.HalfOpenProbes {
+			return false, time.Second
+		}
+		b.probing++
+		return true, 0
+	default:
+		return true, 0
+	}
+}
+
+// done records the outcome of an allowed request. ok is false for failures;
+// counted is false for outcomes that say nothing about the backend, such as
+// the client hanging up.
+func (b *circuitBreaker) done(ok, counted bool, latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.settings.Enabled {
+		return
+	}
+
+	slow := b.settings.SlowCallThresholdMs > 0 && latency >= time.Duration(b.settings.SlowCallThresholdMs)*time.Millisecond
+
+	if b.state == BreakerStateHalfOpen {
+		if b.probing > 0 {
+			b.probing--
+		}
+		if !counted {
+			return
+		}
+		if !ok || (slow && b.settings.SlowCallRateThreshold > 0) {
+			b.open()
+			return
+		}
+		b.succeeded++
+		if b.succeeded >= b.settings.HalfOpenProbes {
+			b.transition(BreakerStateClosed)
+		}
+		return
+	}
+	if b.state != BreakerStateClosed || !counted {
+		return
+	}
+
+	now := time.Now().Unix()
+	bucket := &b.buckets[now%int64(len(b.buckets))]
+	if bucket.second != now {
+		*bucket = breakerBucket{second: now}
+	}
+	bucket.total++
+	if !ok {
+		bucket.failures++
+	}
+	if slow {
+		bucket.slow++
+	}
+
+	total, failures, slowCalls := b.window(now)
+	if total < b.settings.MinRequests || total == 0 {
+		return
+	}
+	errorRate := float64(failures) / float64(total)
+	slowRate := float64(slowCalls) / float64(total)
+	if (b.settings.ErrorRateThreshold > 0 && errorRate >= b.settings.ErrorRateThreshold) ||
+		(b.settings.SlowCallRateThreshold > 0 && slowRate >= b.settings.SlowCallRateThreshold) {
+		b.open()
+	}
+}
+
+// open trips the breaker; the caller holds the mutex
+func (b *circuitBreaker) open() {
+	b.transition(BreakerStateOpen)
+	b.openUntil = time.Now().Add(time.Duration(b.settings.OpenSeconds) * time.Second)
+}
+
+// window sums the buckets inside the window; the caller holds the mutex
+func (b *circuitBreaker) window(now int64) (int, int, int) {
+	var total, failures, slow int
+	for _, bucket := range b.buckets {
+		if now-bucket.second < int64(len(b.buckets)) {
+			total += bucket.total
+			failures += bucket.failures
+			slow += bucket.slow
+		}
+	}
+	return total, failures, slow
+}
+
+func (b *circuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.transition(BreakerStateClosed)
+}
+
+func (b *circuitBreaker) status() gin.H {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total, failures, slow := b.window(time.Now().Unix())
+	status := gin.H{
+		"route":      b.route,
+		"service":    b.service,
+		"state":      b.state,
+		"changed_at": b.changedAt.UTC(),
+		"settings":   b.settings,
+		"window": gin.H{
+			"requests":   total,
+			"failures":   failures,
+			"slow_calls": slow,
+		},
+	}
+	if b.state == BreakerStateOpen {
+		status["open_until"] = b.openUntil.UTC()
+	}
+	return status
+}
+
+// breakerRegistry holds the breakers of all routes, by route ID
+type breakerRegistry struct {
+	mu       sync.RWMutex
+	breakers map[string]*circuitBreaker
+}
+
+func newBreakerRegistry() *breakerRegistry {
+	return &breakerRegistry{breakers: make(map[string]*circuitBreaker)}
+}
+
+func (r *breakerRegistry) get(routeID string) *circuitBreaker {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.breakers[routeID]
+}
+
+// syncBreakers creates, reconfigures and drops breakers to match the routes,
+// keeping the state of breakers whose route remains
+func (s *APIGatewayService) syncBreakers(routes []*APIRoute) {
+	s.breakers.mu.Lock()
+	defer s.breakers.mu.Unlock()
+
+	breakers := make(map[string]*circuitBreaker, len(routes))
+	for _, route := range routes {
+		settings := s.defaultCircuitBreaker(route.ID)
+		if route.CircuitBreaker != nil {
+			settings = *route.CircuitBreaker
+		}
+		name := route.Method + " " + route.Path
+
+		if b, ok := s.breakers.breakers[route.ID]; ok {
+			b.mu.Lock()
+			b.route, b.service = name, route.ServiceName
+			b.configure(settings)
+			b.mu.Unlock()
+			breakers[route.ID] = b
+			continue
+		}
+		breakers[route.ID] = newCircuitBreaker(name, route.ServiceName, settings)
+	}
+	s.breakers.breakers = breakers
+}
+
+// breakerFor returns the route's breaker, creating it for routes added since
+// the last reload
+func (s *APIGatewayService) breakerFor(route *APIRoute) *circuitBreaker {
+	if b := s.breakers.get(route.ID); b != nil {
+		return b
+	}
+	s.syncBreakers(s.activeRoutes())
+	if b := s.breakers.get(route.ID); b != nil {
+		return b
+	}
+	return newCircuitBreaker(route.Method+" "+route.Path, route.ServiceName, s.defaultCircuitBreaker(route.ID))
+}
+
+// rejectOpenCircuit answers a request the breaker turned away
+func (s *APIGatewayService) rejectOpenCircuit(c *gin.Context, route *APIRoute, breaker *circuitBreaker, retryAfter time.Duration, requestID string, startTime time.Time) {
+	breakerRejections.WithLabelValues(breaker.route, route.ServiceName).Inc()
+	s.logRequest(c, requestID, route.ServiceName, http.StatusServiceUnavailable, time.Since(startTime), "Circuit breaker open")
+
+	seconds := int(retryAfter.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":       "Service temporarily unavailable",
+		"reason":      "circuit_open",
+		"retry_after": seconds,
+	})
+}
+
+// List all circuit breakers and their state
+func (s *APIGatewayService) listCircuitBreakers(c *gin.Context) {
+	s.breakers.mu.RLock()
+	breakers := make([]*circuitBreaker, 0, len(s.breakers.breakers))
+	for _, b := range s.breakers.breakers {
+		breakers = append(breakers, b)
+	}
+	s.breakers.mu.RUnlock()
+
+	statuses := make([]gin.H, 0, len(breakers))
+	open := 0
+	for _, b := range breakers {
+		status := b.status()
+		if status["state"] != BreakerStateClosed {
+			open++
+		}
+		statuses = append(statuses, status)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"circuit_breakers": statuses,
+		"total":            len(statuses),
+		"not_closed":       open,
+	})
+}
+
+// Get a route's circuit breaker
+func (s *APIGatewayService) getRouteCircuitBreaker(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("CircuitBreaker").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.breakerFor(&route).status())
+}
+
+// Configure a route's circuit breaker
+func (s *APIGatewayService) updateRouteCircuitBreaker(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("CircuitBreaker").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	settings := s.defaultCircuitBreaker(route.ID)
+	if route.CircuitBreaker != nil {
+		settings = *route.CircuitBreaker
+	}
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	settings.RouteID = route.ID
+	settings.UpdatedAt = time.Now()
+
+	if settings.ErrorRateThreshold < 0 || settings.ErrorRateThreshold > 1 ||
+		settings.SlowCallRateThreshold < 0 || settings.SlowCallRateThreshold > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Rate thresholds must be between 0 and 1"})
+		return
+	}
+	if settings.MinRequests < 0 || settings.WindowSeconds < 0 || settings.OpenSeconds < 0 ||
+		settings.HalfOpenProbes < 0 || settings.SlowCallThresholdMs < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Settings must not be negative"})
+		return
+	}
+
+	if err := s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&settings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save circuit breaker settings"})
+		return
+	}
+
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	route.CircuitBreaker = &settings
+	c.JSON(http.StatusOK, s.breakerFor(&route).status())
+}
+
+// Close a route's circuit breaker by hand
+func (s *APIGatewayService) resetRouteCircuitBreaker(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("CircuitBreaker").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	breaker := s.breakerFor(&route)
+	breaker.reset()
+	c.JSON(http.StatusOK, breaker.status())
+}
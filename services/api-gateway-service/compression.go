@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm/clause"
+)
+
+// Body compression. A route with DecompressRequests set accepts gzip,
+// deflate (zlib) and br request bodies and hands its backend the
+// decompressed body. Decompression happens before the body limit applies,
+// so MaxBodySize bounds what the body inflates to, and before GraphQL
+// checks and transformations, which see plain bodies.
+//
+// A route with CompressResponses set has its responses compressed with the
+// first of its encodings the client accepts. Responses already encoded,
+// smaller than MinSize, of types outside ContentTypes, marked no-transform,
+// partial, or on streaming and gRPC routes pass through untouched. Cached
+// responses are stored uncompressed and compressed as they are served.
+
+// Content encodings
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+	EncodingBrotli  = "br"
+)
+
+const defaultCompressionMinSize = 1024
+
+// defaultCompressibleTypes are compressed when a route lists no types; an
+// entry ending in "/" matches every subtype
+var defaultCompressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/graphql-response+json",
+	"application/problem+json",
+	"image/svg+xml",
+}
+
+// RouteCompression holds a route's compression settings
+type RouteCompression struct {
+	RouteID            string    `json:"route_id" gorm:"primaryKey"`
+	DecompressRequests bool      `json:"decompress_requests"`
+	CompressResponses  bool      `json:"compress_responses"`
+	MinSize            int       `json:"min_size"`                         // bytes; 0: 1024
+	Level              int       `json:"level"`                            // 1-9; 0: the encoding's default
+	Encodings          []string  `json:"encodings" gorm:"type:text[]"`     // preference order; empty: br, gzip, deflate
+	ContentTypes       []string  `json:"content_types" gorm:"type:text[]"` // empty: common text types
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+var (
+	compressionBytesSaved = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_compression_bytes_saved_total",
+			Help: "Bytes kept off the wire by body compression",
+		},
+		[]string{"route", "direction", "encoding"}, // direction: request, response
+	)
+
+	compressionBodies = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_compression_bodies_total",
+			Help: "Bodies decompressed or compressed by the gateway",
+		},
+		[]string{"route", "direction", "encoding", "result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(compressionBytesSaved)
+	prometheus.MustRegister(compressionBodies)
+}
+
+// compressionPolicy is a route's compiled compression settings
+type compressionPolicy struct {
+	settings     RouteCompression
+	minSize      int64
+	encodings    []string
+	contentTypes []string
+}
+
+func compileCompression(settings *RouteCompression) (*compressionPolicy, error) {
+	if settings.MinSize < 0 {
+		return nil, errors.New("min_size can't be negative")
+	}
+	if settings.Level < 0 || settings.Level > 9 {
+		return nil, errors.New("level must be between 1 and 9, or 0 for the default")
+	}
+	policy := &compressionPolicy{
+		settings:     *settings,
+		minSize:      int64(settings.MinSize),
+		encodings:    []string{EncodingBrotli, EncodingGzip, EncodingDeflate},
+		contentTypes: defaultCompressibleTypes,
+	}
+	if policy.minSize == 0 {
+		policy.minSize = defaultCompressionMinSize
+	}
+	if len(settings.Encodings) > 0 {
+		policy.encodings = nil
+		for _, encoding := range settings.Encodings {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			switch encoding {
+			case EncodingGzip, EncodingDeflate, EncodingBrotli:
+				policy.encodings = append(policy.encodings, encoding)
+			default:
+				return nil, fmt.Errorf("unsupported encoding %q", encoding)
+			}
+		}
+	}
+	if len(settings.ContentTypes) > 0 {
+		policy.contentTypes = nil
+		for _, contentType := range settings.ContentTypes {
+			if contentType = strings.ToLower(strings.TrimSpace(contentType)); contentType != "" {
+				policy.contentTypes = append(policy.contentTypes, contentType)
+			}
+		}
+	}
+	return policy, nil
+}
+
+func (p *compressionPolicy) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+	for _, allowed := range p.contentTypes {
+		if mediaType == allowed || (strings.HasSuffix(allowed, "/") && strings.HasPrefix(mediaType, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate picks the encoding of a response to the request, or "" to
+// leave it as it is
+func (p *compressionPolicy) negotiate(req *http.Request, route *APIRoute, status int, header http.Header) string {
+	if !p.settings.CompressResponses || route.StreamBodies || route.Protocol == ProtocolGRPC || req.Method == http.MethodHead {
+		return ""
+	}
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusPartialContent || status == http.StatusNotModified {
+		return ""
+	}
+	if header.Get("Content-Encoding") != "" || !p.compressible(header.Get("Content-Type")) {
+		return ""
+	}
+	if _, noTransform := parseCacheControl(header.Get("Cache-Control"))["no-transform"]; noTransform {
+		return ""
+	}
+
+	accepted := parseAcceptEncoding(req.Header.Get("Accept-Encoding"))
+	for _, encoding := range p.encodings {
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > 0 {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// parseAcceptEncoding reads the q-values of an Accept-Encoding header
+func parseAcceptEncoding(value string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(value, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if name, raw, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(name, "q") {
+				if parsed, err := strconv.ParseFloat(raw, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+type compressionRegistry struct {
+	mu       sync.RWMutex
+	policies map[string]*compressionPolicy // by route ID
+}
+
+func newCompressionRegistry() *compressionRegistry {
+	return &compressionRegistry{policies: make(map[string]*compressionPolicy)}
+}
+
+func (r *compressionRegistry) get(routeID string) *compressionPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.policies[routeID]
+}
+
+// syncCompression compiles the routes' compression settings
+func (s *APIGatewayService) syncCompression(routes []*APIRoute) {
+	policies := make(map[string]*compressionPolicy)
+	for _, route := range routes {
+		if route.Compression == nil {
+			continue
+		}
+		policy, err := compileCompression(route.Compression)
+		if err != nil {
+			log.Printf("Ignoring compression settings of route %s: %v", route.ID, err)
+			continue
+		}
+		policies[route.ID] = policy
+	}
+
+	s.compression.mu.Lock()
+	s.compression.policies = policies
+	s.compression.mu.Unlock()
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// decompressedBody inflates a request body, recording the bytes saved once
+// the body is closed
+type decompressedBody struct {
+	io.Reader
+	wire    *countingReader
+	plain   *countingReader
+	decoder io.Closer // nil when the decoder needs no closing
+	body    io.Closer
+	once    sync.Once
+	record  func(wire, plain int64)
+}
+
+func (b *decompressedBody) Close() error {
+	b.once.Do(func() {
+		if b.decoder != nil {
+			b.decoder.Close()
+		}
+		b.record(b.wire.n, b.plain.n)
+	})
+	return b.body.Close()
+}
+
+// decompressRequestBody replaces a compressed request body with its
+// decompressed form, answering 415 or 400 for bodies it can't decode
+func (s *APIGatewayService) decompressRequestBody(c *gin.Context, route *APIRoute) bool {
+	policy := s.compression.get(route.ID)
+	encoding := strings.ToLower(strings.TrimSpace(c.GetHeader("Content-Encoding")))
+	if policy == nil || !policy.settings.DecompressRequests || encoding == "" || encoding == "identity" {
+		return true
+	}
+	if c.Request.Body == nil || c.Request.Body == http.NoBody {
+		return true
+	}
+
+	wire := &countingReader{r: c.Request.Body}
+	var decoder io.Reader
+	var closer io.Closer
+	var err error
+	switch encoding {
+	case EncodingGzip, "x-gzip":
+		encoding = EncodingGzip
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(wire); err == nil {
+			decoder, closer = zr, zr
+		}
+	case EncodingDeflate:
+		var zr io.ReadCloser
+		if zr, err = zlib.NewReader(wire); err == nil {
+			decoder, closer = zr, zr
+		}
+	case EncodingBrotli:
+		decoder = brotli.NewReader(wire)
+	default:
+		compressionBodies.WithLabelValues(route.ID, "request", "unsupported", "rejected").Inc()
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error":               "Unsupported Content-Encoding",
+			"supported_encodings": []string{EncodingGzip, EncodingDeflate, EncodingBrotli},
+		})
+		return false
+	}
+	if err != nil {
+		compressionBodies.WithLabelValues(route.ID, "request", encoding, "rejected").Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request body is not valid " + encoding})
+		return false
+	}
+
+	plain := &countingReader{r: decoder}
+	c.Request.Body = &decompressedBody{
+		Reader:  plain,
+		wire:    wire,
+		plain:   plain,
+		decoder: closer,
+		body:    c.Request.Body,
+		record: func(wireBytes, plainBytes int64) {
+			compressionBodies.WithLabelValues(route.ID, "request", encoding, "ok").Inc()
+			if plainBytes > wireBytes {
+				compressionBytesSaved.WithLabelValues(route.ID, "request", encoding).Add(float64(plainBytes - wireBytes))
+			}
+		},
+	}
+	c.Request.Header.Del("Content-Encoding")
+	c.Request.Header.Del("Content-Length")
+	c.Request.ContentLength = -1
+	return true
+}
+
+// newEncoder starts compressing into w
+func newEncoder(encoding string, level int, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case EncodingDeflate:
+		if level == 0 {
+			level = zlib.DefaultCompression
+		}
+		return zlib.NewWriterLevel(w, level)
+	case EncodingBrotli:
+		if level == 0 {
+			level = brotli.DefaultCompression
+		}
+		return brotli.NewWriterLevel(w, level), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// markEncoded updates the headers of a response being compressed
+func markEncoded(header http.Header, encoding string) {
+	header.Set("Content-Encoding", encoding)
+	header.Del("Content-Length")
+	if !strings.Contains(strings.ToLower(strings.Join(header.Values("Vary"), ",")), "accept-encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	// The compressed bytes differ from those the tag was computed over
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// compressResponse compresses a proxied response as it streams to the
+// client, when the route and the client call for it
+func (s *APIGatewayService) compressResponse(req *http.Request, route *APIRoute, resp *http.Response) {
+	policy := s.compression.get(route.ID)
+	if policy == nil {
+		return
+	}
+	encoding := policy.negotiate(req, route, resp.StatusCode, resp.Header)
+	if encoding == "" {
+		return
+	}
+
+	// Small bodies gain nothing; peek when the length isn't declared
+	body := resp.Body
+	if resp.ContentLength >= 0 {
+		if resp.ContentLength < policy.minSize {
+			return
+		}
+	} else {
+		buffered := bufio.NewReaderSize(resp.Body, int(policy.minSize))
+		peeked, _ := buffered.Peek(int(policy.minSize))
+		body = struct {
+			io.Reader
+			io.Closer
+		}{buffered, resp.Body}
+		if int64(len(peeked)) < policy.minSize {
+			resp.Body = body
+			return
+		}
+	}
+
+	pr, pw := io.Pipe()
+	wire := &countingWriter{w: pw}
+	encoder, err := newEncoder(encoding, policy.settings.Level, wire)
+	if err != nil {
+		resp.Body = body
+		return
+	}
+	go func() {
+		plain, err := io.Copy(encoder, body)
+		if closeErr := encoder.Close(); err == nil {
+			err = closeErr
+		}
+		body.Close()
+		pw.CloseWithError(err)
+
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		compressionBodies.WithLabelValues(route.ID, "response", encoding, result).Inc()
+		if err == nil && plain > wire.n {
+			compressionBytesSaved.WithLabelValues(route.ID, "response", encoding).Add(float64(plain - wire.n))
+		}
+	}()
+
+	markEncoded(resp.Header, encoding)
+	resp.Body = pr
+	resp.ContentLength = -1
+}
+
+// compressCachedBody compresses a cached response about to be served,
+// updating header; the body is returned as it is when it stays unencoded
+func (s *APIGatewayService) compressCachedBody(req *http.Request, route *APIRoute, status int, header http.Header, body []byte) []byte {
+	policy := s.compression.get(route.ID)
+	if policy == nil || int64(len(body)) < policy.minSize {
+		return body
+	}
+	encoding := policy.negotiate(req, route, status, header)
+	if encoding == "" {
+		return body
+	}
+
+	var buf bytes.Buffer
+	encoder, err := newEncoder(encoding, policy.settings.Level, &buf)
+	if err != nil {
+		return body
+	}
+	if _, err := encoder.Write(body); err != nil {
+		return body
+	}
+	if err := encoder.Close(); err != nil {
+		return body
+	}
+
+	compressionBodies.WithLabelValues(route.ID, "response", encoding, "ok").Inc()
+	if buf.Len() < len(body) {
+		compressionBytesSaved.WithLabelValues(route.ID, "response", encoding).Add(float64(len(body) - buf.Len()))
+	}
+	markEncoded(header, encoding)
+	return buf.Bytes()
+}
+
+// Admin handlers
+
+// Get a route's compression settings
+func (s *APIGatewayService) getRouteCompression(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("Compression").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	settings := RouteCompression{RouteID: route.ID}
+	if route.Compression != nil {
+		settings = *route.Compression
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+// Configure a route's compression
+func (s *APIGatewayService) updateRouteCompression(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("Compression").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	var settings RouteCompression
+	if route.Compression != nil {
+		settings = *route.Compression
+	}
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	settings.RouteID = route.ID
+	settings.UpdatedAt = time.Now()
+	if _, err := compileCompression(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&settings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save compression settings"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// Turn off a route's compression
+func (s *APIGatewayService) deleteRouteCompression(c *gin.Context) {
+	if err := s.db.Delete(&RouteCompression{}, "route_id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete compression settings"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Compression settings deleted successfully"})
+}
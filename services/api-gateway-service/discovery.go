@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Dynamic upstreams from discovery-service. A route without a ServiceURL or
+// static upstreams is resolved by its ServiceName (or an explicit
+// DiscoveryService) against discovery-service's healthy instances, so
+// deployments that move instances need no route updates. Instances are
+// cached per service and resolved again at request time once the entry is
+// older than DISCOVERY_CACHE_TTL. The gateway also follows discovery's
+// watch stream and invalidates an entry as soon as the service changes;
+// the periodic refresh stays as a fallback for when the stream is down.
+
+const (
+	discoveryLookupTimeout = 5 * time.Second
+	discoveryWatchIdle     = 45 * time.Second // discovery sends keep-alives every 15s
+	discoveryWatchMaxRetry = 30 * time.Second
+)
+
+var discoveryLookups = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "api_gateway_discovery_lookups_total",
+		Help: "Lookups of healthy instances from discovery-service",
+	},
+	[]string{"service", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(discoveryLookups)
+}
+
+// discoveryEntry caches the healthy instances of one service
+type discoveryEntry struct {
+	lookup sync.Mutex // one lookup per service at a time
+
+	// Guarded by the load balancer's mutex
+	targets   []upstreamTarget
+	fetchedAt time.Time // zero when invalidated
+	lastError string
+}
+
+// discoveredInstance is the part of a discovery-service instance the gateway uses
+type discoveredInstance struct {
+	Host     string            `json:"host"`
+	Port     int               `json:"port"`
+	Protocol string            `json:"protocol"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// discoveryEvent is a change announced on discovery's watch stream
+type discoveryEvent struct {
+	Type        string `json:"type"`
+	ServiceName string `json:"service_name"`
+	InstanceID  string `json:"instance_id"`
+	Status      string `json:"status"`
+}
+
+// discoveryName is the service a route resolves through discovery-service,
+// or "" if the route has a fixed endpoint
+func (r *APIRoute) discoveryName() string {
+	if r.DiscoveryService != "" {
+		return r.DiscoveryService
+	}
+	if r.ServiceURL != "" {
+		return ""
+	}
+	for _, u := range r.Upstreams {
+		if u.IsActive {
+			return ""
+		}
+	}
+	return r.ServiceName
+}
+
+func (lb *loadBalancer) discoveryEntry(name string) *discoveryEntry {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	entry, ok := lb.discovered[name]
+	if !ok {
+		entry = &discoveryEntry{}
+		lb.discovered[name] = entry
+	}
+	return entry
+}
+
+func (lb *loadBalancer) discoveredTargets(name string) []upstreamTarget {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	if entry, ok := lb.discovered[name]; ok {
+		return entry.targets
+	}
+	return nil
+}
+
+// discoveryFresh reports whether the service's instances were resolved
+// within ttl; a ttl of 0 is never fresh
+func (lb *loadBalancer) discoveryFresh(name string, ttl time.Duration) bool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	entry, ok := lb.discovered[name]
+	return ok && !entry.fetchedAt.IsZero() && time.Since(entry.fetchedAt) < ttl
+}
+
+// invalidateDiscovered marks a service's instances stale so the next
+// request resolves them again; "" invalidates every service
+func (lb *loadBalancer) invalidateDiscovered(name string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	for key, entry := range lb.discovered {
+		if name == "" || key == name {
+			entry.fetchedAt = time.Time{}
+		}
+	}
+}
+
+func (lb *loadBalancer) discoveryStatus(name string) gin.H {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	status := gin.H{"service": name, "cached": false}
+	entry, ok := lb.discovered[name]
+	if !ok {
+		return status
+	}
+	status["cached"] = !entry.fetchedAt.IsZero()
+	status["instances"] = len(entry.targets)
+	if !entry.fetchedAt.IsZero() {
+		status["fetched_at"] = entry.fetchedAt
+	}
+	if entry.lastError != "" {
+		status["last_error"] = entry.lastError
+	}
+	return status
+}
+
+// resolveDiscovered looks up a service's healthy instances unless they were
+// resolved within ttl, and updates the pools of the routes using it. On
+// failure the last known instances are kept, and the lookup is retried only
+// after ttl so an unreachable discovery-service does not slow every request.
+func (s *APIGatewayService) resolveDiscovered(ctx context.Context, name string, ttl time.Duration) {
+	if s.balancer.discoveryFresh(name, ttl) {
+		return
+	}
+
+	entry := s.balancer.discoveryEntry(name)
+	entry.lookup.Lock()
+	defer entry.lookup.Unlock()
+
+	// Another request may have resolved it while we waited
+	if s.balancer.discoveryFresh(name, ttl) {
+		return
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, discoveryLookupTimeout)
+	targets, err := s.lookupDiscoveryService(lookupCtx, name)
+	cancel()
+
+	s.balancer.mu.Lock()
+	entry.fetchedAt = time.Now()
+	if err != nil {
+		entry.lastError = err.Error()
+	} else {
+		entry.targets = targets
+		entry.lastError = ""
+	}
+	s.balancer.mu.Unlock()
+
+	if err != nil {
+		discoveryLookups.WithLabelValues(name, "failure").Inc()
+		log.Printf("Failed to resolve %s from discovery service: %v", name, err)
+		return
+	}
+	discoveryLookups.WithLabelValues(name, "success").Inc()
+
+	for _, route := range s.activeRoutes() {
+		if route.discoveryName() != name {
+			continue
+		}
+		if pool := s.balancer.pool(route.ID); pool != nil {
+			pool.setTargets(s.balancer.targetsFor(route))
+		}
+	}
+}
+
+// lookupDiscoveryService fetches the healthy instances of a service
+func (s *APIGatewayService) lookupDiscoveryService(ctx context.Context, name string) ([]upstreamTarget, error) {
+	endpoint := fmt.Sprintf("%s/v1/discovery/services/%s/healthy", strings.TrimRight(s.config.DiscoveryServiceURL, "/"), url.PathEscape(name))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery service returned %d", resp.StatusCode)
+	}
+
+	var body struct {
+		HealthyInstances []discoveredInstance `json:"healthy_instances"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	targets := make([]upstreamTarget, 0, len(body.HealthyInstances))
+	for _, instance := range body.HealthyInstances {
+		protocol := instance.Protocol
+		if protocol == "" {
+			protocol = "http"
+		}
+		weight, _ := strconv.Atoi(instance.Metadata["weight"])
+		targets = append(targets, upstreamTarget{
+			URL:    fmt.Sprintf("%s://%s:%d", protocol, instance.Host, instance.Port),
+			Weight: weight,
+		})
+	}
+	return targets, nil
+}
+
+// refreshDiscoveredUpstreams re-resolves every service that routes discover
+// through discovery-service
+func (s *APIGatewayService) refreshDiscoveredUpstreams() {
+	names := map[string]bool{}
+	for _, route := range s.activeRoutes() {
+		if name := route.discoveryName(); name != "" {
+			names[name] = true
+		}
+	}
+
+	for name := range names {
+		s.resolveDiscovered(context.Background(), name, 0)
+	}
+}
+
+func (s *APIGatewayService) startUpstreamResolver() {
+	if s.config.DiscoveryServiceURL == "" {
+		return
+	}
+
+	s.refreshDiscoveredUpstreams()
+
+	ticker := time.NewTicker(s.config.UpstreamRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.refreshDiscoveredUpstreams()
+		}
+	}
+}
+
+// startDiscoveryWatcher follows discovery's watch stream, reconnecting with
+// backoff when it drops
+func (s *APIGatewayService) startDiscoveryWatcher() {
+	if s.config.DiscoveryServiceURL == "" {
+		return
+	}
+
+	backoff := time.Second
+	for {
+		connected, err := s.watchDiscovery()
+		if connected {
+			backoff = time.Second
+		}
+		log.Printf("Discovery watch stream closed: %v; reconnecting in %s", err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > discoveryWatchMaxRetry {
+			backoff = discoveryWatchMaxRetry
+		}
+	}
+}
+
+// watchDiscovery consumes one connection to the watch stream until it ends,
+// reporting whether it got as far as the ready event
+func (s *APIGatewayService) watchDiscovery() (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The stream is long-lived, so no client timeout; a silent connection is
+	// dropped once keep-alives stop arriving
+	idle := time.AfterFunc(discoveryWatchIdle, cancel)
+	defer idle.Stop()
+
+	endpoint := strings.TrimRight(s.config.DiscoveryServiceURL, "/") + "/v1/discovery/watch"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := (&http.Client{}).Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("discovery service returned %d", resp.StatusCode)
+	}
+
+	connected := false
+	var eventType, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		idle.Reset(discoveryWatchIdle)
+
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// Blank line ends an event
+			if eventType == "ready" {
+				// Changes may have been missed while disconnected
+				connected = true
+				s.balancer.invalidateDiscovered("")
+			} else if eventType == "change" {
+				s.handleDiscoveryEvent(data)
+			}
+			eventType, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return connected, err
+	}
+	return connected, fmt.Errorf("stream ended")
+}
+
+func (s *APIGatewayService) handleDiscoveryEvent(data string) {
+	var event discoveryEvent
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		log.Printf("Invalid discovery event: %v", err)
+		return
+	}
+	// An event without a service (a snapshot import) affects all of them
+	s.balancer.invalidateDiscovered(event.ServiceName)
+}
@@ -0,0 +1,760 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
+	"gorm.io/gorm/clause"
+)
+
+// GraphQL routes. A route with GraphQL settings has every operation it
+// receives parsed before it is proxied, over GET (query, operationName,
+// variables and extensions parameters) or POST (a JSON request, a batch of
+// them, or an application/graphql body). Operations deeper than the
+// route's max_depth or costlier than its max_complexity are refused with a
+// GraphQL error, as is introspection where it is not allowed.
+//
+// Complexity counts one per field, with fragments inlined; a field's
+// children count once per item when it takes a first, last or limit
+// argument, from a literal or a variable. __typename is free.
+//
+// Persisted queries follow Apollo's format: extensions.persistedQuery
+// carries the SHA-256 of the query text. A request carrying only the hash
+// gets the allowlisted query filled in before it reaches the backend, and a
+// route with persisted_queries_only refuses any query not on its allowlist.
+//
+// Requests are counted by operation name rather than by path, in
+// api_gateway_graphql_operations_total and in the path label of the request
+// metrics. Names are those clients choose, so only the first
+// maxGraphQLOperationNames seen on a route get their own label.
+
+const (
+	maxGraphQLTokens         = 20000
+	maxGraphQLVisits         = 100000
+	maxGraphQLOperationNames = 200
+	graphQLComplexityCeiling = 1 << 40
+
+	graphQLOperationsKey = "graphql_operations"
+)
+
+// RouteGraphQL holds a route's GraphQL settings
+type RouteGraphQL struct {
+	RouteID              string    `json:"route_id" gorm:"primaryKey"`
+	MaxDepth             int       `json:"max_depth"`      // 0: unlimited
+	MaxComplexity        int       `json:"max_complexity"` // 0: unlimited
+	MaxBatchSize         int       `json:"max_batch_size"` // 0: unlimited
+	PersistedQueriesOnly bool      `json:"persisted_queries_only"`
+	AllowIntrospection   bool      `json:"allow_introspection"`
+	UpdatedAt            time.Time `json:"updated_at"`
+}
+
+// PersistedQuery is an allowlisted operation of a GraphQL route
+type PersistedQuery struct {
+	RouteID       string    `json:"route_id" gorm:"primaryKey"`
+	Hash          string    `json:"hash" gorm:"primaryKey"` // SHA-256 of Query, hex
+	OperationName string    `json:"operation_name"`
+	Query         string    `json:"query" gorm:"type:text;not null"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+var (
+	graphqlOperations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_graphql_operations_total",
+			Help: "GraphQL operations by route, operation name, type and outcome",
+		},
+		[]string{"route", "operation", "type", "outcome"},
+	)
+
+	graphqlDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "api_gateway_graphql_operation_duration_seconds",
+			Help: "Duration of proxied GraphQL requests by operation name",
+		},
+		[]string{"route", "operation"},
+	)
+
+	graphqlComplexity = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "api_gateway_graphql_operation_complexity",
+			Help:    "Complexity of GraphQL operations received",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+		},
+		[]string{"route"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(graphqlOperations)
+	prometheus.MustRegister(graphqlDuration)
+	prometheus.MustRegister(graphqlComplexity)
+}
+
+// graphqlPolicy is a route's compiled GraphQL settings
+type graphqlPolicy struct {
+	settings  RouteGraphQL
+	persisted map[string]string // hash -> query
+
+	mu    sync.Mutex
+	names map[string]bool // operation names with their own metric label
+}
+
+// metricName bounds the operation names a route reports
+func (p *graphqlPolicy) metricName(name string) string {
+	if name == "" {
+		return "anonymous"
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.names[name] {
+		return name
+	}
+	if len(p.names) >= maxGraphQLOperationNames {
+		return "other"
+	}
+	p.names[name] = true
+	return name
+}
+
+type graphqlRegistry struct {
+	mu       sync.RWMutex
+	policies map[string]*graphqlPolicy // by route ID
+}
+
+func newGraphQLRegistry() *graphqlRegistry {
+	return &graphqlRegistry{policies: make(map[string]*graphqlPolicy)}
+}
+
+func (r *graphqlRegistry) get(routeID string) *graphqlPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.policies[routeID]
+}
+
+// syncGraphQL compiles the routes' GraphQL settings and allowlists, keeping
+// the operation names already labelled for routes that remain
+func (s *APIGatewayService) syncGraphQL(routes []*APIRoute) {
+	s.graphql.mu.RLock()
+	current := s.graphql.policies
+	s.graphql.mu.RUnlock()
+
+	policies := make(map[string]*graphqlPolicy)
+	var routeIDs []string
+	for _, route := range routes {
+		if route.GraphQL == nil {
+			continue
+		}
+		policy := &graphqlPolicy{settings: *route.GraphQL, persisted: map[string]string{}, names: map[string]bool{}}
+		if existing, ok := current[route.ID]; ok {
+			existing.mu.Lock()
+			for name := range existing.names {
+				policy.names[name] = true
+			}
+			existing.mu.Unlock()
+		}
+		policies[route.ID] = policy
+		routeIDs = append(routeIDs, route.ID)
+	}
+
+	if len(routeIDs) > 0 {
+		var queries []PersistedQuery
+		if err := s.db.Where("route_id IN ?", routeIDs).Find(&queries).Error; err != nil {
+			log.Printf("Failed to load persisted queries: %v", err)
+		}
+		for _, q := range queries {
+			policies[q.RouteID].persisted[q.Hash] = q.Query
+		}
+	}
+
+	s.graphql.mu.Lock()
+	s.graphql.policies = policies
+	s.graphql.mu.Unlock()
+}
+
+// graphqlRequest is one operation request. Fields other than the standard
+// ones are kept so a rewritten request loses nothing.
+type graphqlRequest struct {
+	raw map[string]json.RawMessage
+
+	Query         string
+	OperationName string
+	Variables     map[string]interface{}
+	Hash          string // extensions.persistedQuery.sha256Hash
+}
+
+func parseGraphQLRequest(raw map[string]json.RawMessage) (*graphqlRequest, error) {
+	req := &graphqlRequest{raw: raw}
+	if v, ok := raw["query"]; ok && string(v) != "null" {
+		if err := json.Unmarshal(v, &req.Query); err != nil {
+			return nil, errors.New("query must be a string")
+		}
+	}
+	if v, ok := raw["operationName"]; ok && string(v) != "null" {
+		if err := json.Unmarshal(v, &req.OperationName); err != nil {
+			return nil, errors.New("operationName must be a string")
+		}
+	}
+	if v, ok := raw["variables"]; ok && string(v) != "null" {
+		if err := json.Unmarshal(v, &req.Variables); err != nil {
+			return nil, errors.New("variables must be an object")
+		}
+	}
+	if v, ok := raw["extensions"]; ok && string(v) != "null" {
+		var extensions struct {
+			PersistedQuery *struct {
+				SHA256Hash string `json:"sha256Hash"`
+			} `json:"persistedQuery"`
+		}
+		if err := json.Unmarshal(v, &extensions); err != nil {
+			return nil, errors.New("extensions must be an object")
+		}
+		if extensions.PersistedQuery != nil {
+			req.Hash = strings.ToLower(extensions.PersistedQuery.SHA256Hash)
+		}
+	}
+	return req, nil
+}
+
+// readGraphQLRequests reads the operations of a request. batch reports
+// whether a POST body held an array.
+func readGraphQLRequests(r *http.Request) (requests []*graphqlRequest, body []byte, batch bool, err error) {
+	if r.Method == http.MethodGet {
+		params := r.URL.Query()
+		raw := map[string]json.RawMessage{}
+		for _, key := range []string{"query", "operationName"} {
+			if value := params.Get(key); value != "" {
+				encoded, _ := json.Marshal(value)
+				raw[key] = encoded
+			}
+		}
+		for _, key := range []string{"variables", "extensions"} {
+			if value := params.Get(key); value != "" {
+				raw[key] = json.RawMessage(value)
+			}
+		}
+		req, err := parseGraphQLRequest(raw)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		return []*graphqlRequest{req}, nil, false, nil
+	}
+
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil, false, errors.New("request has no GraphQL operation")
+	}
+	body, err = io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/graphql" {
+		return []*graphqlRequest{{Query: string(body)}}, body, false, nil
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	var raws []map[string]json.RawMessage
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		batch = true
+		if err := json.Unmarshal(trimmed, &raws); err != nil {
+			return nil, body, true, errors.New("request body is not a GraphQL request batch")
+		}
+	} else {
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, body, false, errors.New("request body is not a GraphQL request")
+		}
+		raws = []map[string]json.RawMessage{raw}
+	}
+	for _, raw := range raws {
+		req, err := parseGraphQLRequest(raw)
+		if err != nil {
+			return nil, body, batch, err
+		}
+		requests = append(requests, req)
+	}
+	return requests, body, batch, nil
+}
+
+// graphqlAnalysis describes an operation's shape
+type graphqlAnalysis struct {
+	Depth         int  `json:"depth"`
+	Complexity    int  `json:"complexity"`
+	Introspection bool `json:"introspection"`
+	Exhausted     bool `json:"exhausted"` // too large to finish analysing
+}
+
+type graphqlAnalyzer struct {
+	doc       *ast.QueryDocument
+	variables map[string]interface{}
+	visits    int
+	result    graphqlAnalysis
+}
+
+// analyzeGraphQLOperation measures an operation with its fragments inlined
+func analyzeGraphQLOperation(doc *ast.QueryDocument, op *ast.OperationDefinition, variables map[string]interface{}) graphqlAnalysis {
+	a := &graphqlAnalyzer{doc: doc, variables: variables}
+	a.result.Complexity = a.selectionSet(op.SelectionSet, 0, map[string]bool{})
+	return a.result
+}
+
+func (a *graphqlAnalyzer) selectionSet(set ast.SelectionSet, depth int, visiting map[string]bool) int {
+	total := 0
+	for _, selection := range set {
+		if a.visits++; a.visits > maxGraphQLVisits {
+			a.result.Exhausted = true
+			return graphQLComplexityCeiling
+		}
+		switch sel := selection.(type) {
+		case *ast.Field:
+			if sel.Name == "__typename" {
+				continue
+			}
+			if strings.HasPrefix(sel.Name, "__") {
+				a.result.Introspection = true
+			}
+			if depth+1 > a.result.Depth {
+				a.result.Depth = depth + 1
+			}
+			children := a.selectionSet(sel.SelectionSet, depth+1, visiting)
+			total = saturatingAdd(total, saturatingAdd(1, saturatingMul(children, a.multiplier(sel))))
+		case *ast.InlineFragment:
+			total = saturatingAdd(total, a.selectionSet(sel.SelectionSet, depth, visiting))
+		case *ast.FragmentSpread:
+			fragment := a.doc.Fragments.ForName(sel.Name)
+			if fragment == nil || visiting[sel.Name] {
+				continue
+			}
+			visiting[sel.Name] = true
+			total = saturatingAdd(total, a.selectionSet(fragment.SelectionSet, depth, visiting))
+			delete(visiting, sel.Name)
+		}
+	}
+	return total
+}
+
+// multiplier is the page size a field asks for, or 1
+func (a *graphqlAnalyzer) multiplier(field *ast.Field) int {
+	for _, name := range []string{"first", "last", "limit"} {
+		arg := field.Arguments.ForName(name)
+		if arg == nil || arg.Value == nil {
+			continue
+		}
+		var n int64
+		switch arg.Value.Kind {
+		case ast.IntValue:
+			n, _ = strconv.ParseInt(arg.Value.Raw, 10, 64)
+		case ast.Variable:
+			if v, ok := a.variables[arg.Value.Raw].(float64); ok {
+				n = int64(v)
+			}
+		}
+		if n > 1 {
+			if n > graphQLComplexityCeiling {
+				return graphQLComplexityCeiling
+			}
+			return int(n)
+		}
+	}
+	return 1
+}
+
+func saturatingAdd(a, b int) int {
+	if a+b > graphQLComplexityCeiling || a+b < 0 {
+		return graphQLComplexityCeiling
+	}
+	return a + b
+}
+
+func saturatingMul(a, b int) int {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	if a > graphQLComplexityCeiling/b {
+		return graphQLComplexityCeiling
+	}
+	return a * b
+}
+
+// graphqlOperation is what a request's operation is recorded as
+type graphqlOperation struct {
+	Name string
+	Type string
+}
+
+// graphqlError is a refusal in GraphQL's error format
+type graphqlError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *graphqlError) Error() string { return e.message }
+
+func hashGraphQLQuery(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+// vetGraphQLRequest resolves a persisted query and checks the operation
+// against the route's limits
+func (s *APIGatewayService) vetGraphQLRequest(policy *graphqlPolicy, req *graphqlRequest) (*graphqlOperation, *graphqlAnalysis, bool, *graphqlError) {
+	rewritten := false
+	if req.Query == "" {
+		if req.Hash == "" {
+			return nil, nil, false, &graphqlError{http.StatusBadRequest, "BAD_REQUEST", "Request has no query"}
+		}
+		query, ok := policy.persisted[req.Hash]
+		if !ok {
+			return nil, nil, false, &graphqlError{http.StatusBadRequest, "PERSISTED_QUERY_NOT_FOUND", "PersistedQueryNotFound"}
+		}
+		req.Query, rewritten = query, true
+	} else {
+		hash := hashGraphQLQuery(req.Query)
+		if req.Hash != "" && req.Hash != hash {
+			return nil, nil, false, &graphqlError{http.StatusBadRequest, "BAD_REQUEST", "provided sha does not match query"}
+		}
+		if _, ok := policy.persisted[hash]; !ok && policy.settings.PersistedQueriesOnly {
+			return nil, nil, false, &graphqlError{http.StatusForbidden, "PERSISTED_QUERY_NOT_ALLOWED", "Only persisted queries are allowed on this route"}
+		}
+	}
+
+	doc, err := parser.ParseQueryWithTokenLimit(&ast.Source{Input: req.Query}, maxGraphQLTokens)
+	if err != nil {
+		return nil, nil, false, &graphqlError{http.StatusBadRequest, "GRAPHQL_PARSE_FAILED", err.Error()}
+	}
+	var op *ast.OperationDefinition
+	switch {
+	case req.OperationName != "":
+		op = doc.Operations.ForName(req.OperationName)
+	case len(doc.Operations) == 1:
+		op = doc.Operations[0]
+	}
+	if op == nil {
+		return nil, nil, false, &graphqlError{http.StatusBadRequest, "BAD_REQUEST", "operationName does not name exactly one operation of the document"}
+	}
+
+	operation := &graphqlOperation{Name: op.Name, Type: string(op.Operation)}
+	analysis := analyzeGraphQLOperation(doc, op, req.Variables)
+	settings := policy.settings
+	switch {
+	case analysis.Introspection && !settings.AllowIntrospection:
+		return operation, &analysis, false, &graphqlError{http.StatusForbidden, "INTROSPECTION_DISABLED", "Introspection is not allowed on this route"}
+	case settings.MaxDepth > 0 && analysis.Depth > settings.MaxDepth:
+		return operation, &analysis, false, &graphqlError{http.StatusBadRequest, "DEPTH_LIMIT_EXCEEDED",
+			fmt.Sprintf("Operation depth %d exceeds the limit of %d", analysis.Depth, settings.MaxDepth)}
+	case analysis.Exhausted || (settings.MaxComplexity > 0 && analysis.Complexity > settings.MaxComplexity):
+		return operation, &analysis, false, &graphqlError{http.StatusBadRequest, "COMPLEXITY_LIMIT_EXCEEDED",
+			fmt.Sprintf("Operation complexity %d exceeds the limit of %d", analysis.Complexity, settings.MaxComplexity)}
+	}
+	return operation, &analysis, rewritten, nil
+}
+
+// checkGraphQL vets the GraphQL operations of a request to a GraphQL route,
+// filling in persisted queries, and answers the request when one is refused
+func (s *APIGatewayService) checkGraphQL(c *gin.Context, route *APIRoute) bool {
+	policy := s.graphql.get(route.ID)
+	if policy == nil {
+		return true
+	}
+
+	requests, body, batch, err := readGraphQLRequests(c.Request)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			s.rejectBodyTooLarge(c.Writer, route)
+			return false
+		}
+		s.rejectGraphQL(c, route, policy, nil, &graphqlError{http.StatusBadRequest, "BAD_REQUEST", err.Error()})
+		return false
+	}
+	if len(requests) == 0 {
+		s.rejectGraphQL(c, route, policy, nil, &graphqlError{http.StatusBadRequest, "BAD_REQUEST", "Request has no GraphQL operation"})
+		return false
+	}
+	if limit := policy.settings.MaxBatchSize; limit > 0 && len(requests) > limit {
+		s.rejectGraphQL(c, route, policy, nil, &graphqlError{http.StatusBadRequest, "BATCH_LIMIT_EXCEEDED",
+			fmt.Sprintf("Batch of %d operations exceeds the limit of %d", len(requests), limit)})
+		return false
+	}
+
+	operations := make([]graphqlOperation, 0, len(requests))
+	rewrite := false
+	for _, req := range requests {
+		operation, analysis, rewritten, refusal := s.vetGraphQLRequest(policy, req)
+		if analysis != nil {
+			graphqlComplexity.WithLabelValues(route.ID).Observe(float64(analysis.Complexity))
+		}
+		if refusal != nil {
+			s.rejectGraphQL(c, route, policy, operation, refusal)
+			return false
+		}
+		operations = append(operations, *operation)
+		rewrite = rewrite || rewritten
+	}
+	c.Set(graphQLOperationsKey, operations)
+
+	// Hand the backend the request as read, with persisted queries filled in
+	if c.Request.Method == http.MethodGet {
+		if rewrite {
+			params := c.Request.URL.Query()
+			params.Set("query", requests[0].Query)
+			c.Request.URL.RawQuery = params.Encode()
+		}
+		return true
+	}
+	if rewrite {
+		raws := make([]map[string]json.RawMessage, len(requests))
+		for i, req := range requests {
+			query, _ := json.Marshal(req.Query)
+			req.raw["query"] = query
+			raws[i] = req.raw
+		}
+		if batch {
+			body, _ = json.Marshal(raws)
+		} else {
+			body, _ = json.Marshal(raws[0])
+		}
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Request.ContentLength = int64(len(body))
+	c.Request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return true
+}
+
+func (s *APIGatewayService) rejectGraphQL(c *gin.Context, route *APIRoute, policy *graphqlPolicy, operation *graphqlOperation, refusal *graphqlError) {
+	name, opType := "unknown", "unknown"
+	if operation != nil {
+		name, opType = policy.metricName(operation.Name), operation.Type
+	}
+	graphqlOperations.WithLabelValues(route.ID, name, opType, strings.ToLower(refusal.code)).Inc()
+	c.JSON(refusal.status, gin.H{
+		"errors": []gin.H{{
+			"message":    refusal.message,
+			"extensions": gin.H{"code": refusal.code},
+		}},
+	})
+}
+
+// graphqlMetricPath is the path label of a GraphQL request's metrics: the
+// route path with the operation name, or the request path for any other
+func (s *APIGatewayService) graphqlMetricPath(c *gin.Context, route *APIRoute) string {
+	v, ok := c.Get(graphQLOperationsKey)
+	policy := s.graphql.get(route.ID)
+	if !ok || policy == nil {
+		return c.Request.URL.Path
+	}
+	operations := v.([]graphqlOperation)
+	if len(operations) != 1 {
+		return route.Path + "#batch"
+	}
+	return route.Path + "#" + policy.metricName(operations[0].Name)
+}
+
+// recordGraphQLMetrics counts a proxied GraphQL request's operations
+func (s *APIGatewayService) recordGraphQLMetrics(c *gin.Context, route *APIRoute, duration time.Duration) {
+	v, ok := c.Get(graphQLOperationsKey)
+	policy := s.graphql.get(route.ID)
+	if !ok || policy == nil {
+		return
+	}
+	outcome := "ok"
+	if c.Writer.Status() >= http.StatusBadRequest {
+		outcome = "error"
+	}
+	for _, operation := range v.([]graphqlOperation) {
+		name := policy.metricName(operation.Name)
+		graphqlOperations.WithLabelValues(route.ID, name, operation.Type, outcome).Inc()
+		graphqlDuration.WithLabelValues(route.ID, name).Observe(duration.Seconds())
+	}
+}
+
+// Admin handlers
+
+// Get a route's GraphQL settings
+func (s *APIGatewayService) getRouteGraphQL(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("GraphQL").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+	if route.GraphQL == nil {
+		c.JSON(http.StatusOK, gin.H{"graphql": nil, "enabled": false})
+		return
+	}
+
+	var persisted int64
+	s.db.Model(&PersistedQuery{}).Where("route_id = ?", route.ID).Count(&persisted)
+	c.JSON(http.StatusOK, gin.H{"graphql": route.GraphQL, "enabled": true, "persisted_queries": persisted})
+}
+
+// Turn on or configure GraphQL handling of a route
+func (s *APIGatewayService) updateRouteGraphQL(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("GraphQL").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	settings := RouteGraphQL{MaxBatchSize: 10, AllowIntrospection: true}
+	if route.GraphQL != nil {
+		settings = *route.GraphQL
+	}
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if settings.MaxDepth < 0 || settings.MaxComplexity < 0 || settings.MaxBatchSize < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_depth, max_complexity and max_batch_size can't be negative"})
+		return
+	}
+	settings.RouteID = route.ID
+	settings.UpdatedAt = time.Now()
+
+	if err := s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&settings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save GraphQL settings"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// Turn off GraphQL handling of a route; its allowlist is kept
+func (s *APIGatewayService) deleteRouteGraphQL(c *gin.Context) {
+	if err := s.db.Delete(&RouteGraphQL{}, "route_id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete GraphQL settings"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "GraphQL settings deleted successfully"})
+}
+
+// List a route's persisted queries
+func (s *APIGatewayService) listPersistedQueries(c *gin.Context) {
+	var queries []PersistedQuery
+	if err := s.db.Where("route_id = ?", c.Param("id")).Order("operation_name ASC").Find(&queries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch persisted queries"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"persisted_queries": queries, "total": len(queries)})
+}
+
+// Add queries to a route's allowlist, e.g. from a client build's manifest
+func (s *APIGatewayService) addPersistedQueries(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	var req struct {
+		Queries []struct {
+			Query string `json:"query" binding:"required"`
+			Hash  string `json:"hash"` // checked when given
+		} `json:"queries" binding:"required,min=1,dive"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	queries := make([]PersistedQuery, 0, len(req.Queries))
+	for i, q := range req.Queries {
+		hash := hashGraphQLQuery(q.Query)
+		if q.Hash != "" && !strings.EqualFold(q.Hash, hash) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("queries[%d]: hash does not match query", i)})
+			return
+		}
+		doc, err := parser.ParseQueryWithTokenLimit(&ast.Source{Input: q.Query}, maxGraphQLTokens)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("queries[%d]: %v", i, err)})
+			return
+		}
+		name := ""
+		if len(doc.Operations) == 1 {
+			name = doc.Operations[0].Name
+		}
+		queries = append(queries, PersistedQuery{RouteID: route.ID, Hash: hash, OperationName: name, Query: q.Query, CreatedAt: now})
+	}
+
+	if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&queries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save persisted queries"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"persisted_queries": queries})
+}
+
+// Remove a query from a route's allowlist
+func (s *APIGatewayService) deletePersistedQuery(c *gin.Context) {
+	result := s.db.Delete(&PersistedQuery{}, "route_id = ? AND hash = ?", c.Param("id"), strings.ToLower(c.Param("hash")))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete persisted query"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Persisted query not found"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Persisted query deleted successfully"})
+}
+
+// Measure a query against a route's limits without sending it
+func (s *APIGatewayService) analyzeGraphQLQuery(c *gin.Context) {
+	policy := s.graphql.get(c.Param("id"))
+	if policy == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route does not handle GraphQL"})
+		return
+	}
+
+	var body struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req := &graphqlRequest{Query: body.Query, OperationName: body.OperationName, Variables: body.Variables}
+	operation, analysis, _, refusal := s.vetGraphQLRequest(policy, req)
+	response := gin.H{"allowed": refusal == nil, "analysis": analysis, "limits": policy.settings}
+	if operation != nil {
+		response["operation"] = gin.H{"name": operation.Name, "type": operation.Type}
+	}
+	if refusal != nil {
+		response["error"] = gin.H{"code": refusal.code, "message": refusal.message}
+	}
+	c.JSON(http.StatusOK, response)
+}
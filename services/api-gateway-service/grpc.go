@@ -0,0 +1,838 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// gRPC routes. A route's Protocol selects how it reaches its backend:
+//
+//	http      - plain HTTP reverse proxying (the default)
+//	grpc      - gRPC pass-through: gRPC clients connect to the gateway over
+//	            HTTP/2 (cleartext h2c or TLS) and calls are proxied to the
+//	            upstream over HTTP/2 with trailers intact. Routes match the
+//	            call path, e.g. POST /inference.Predictor/*
+//	grpc-json - gRPC-JSON transcoding: REST clients send JSON and the gateway
+//	            calls the unary gRPC method GRPCMethod on the upstream, using
+//	            the message types of an uploaded protobuf descriptor set
+//
+// When transcoding, the JSON request body is decoded into the method's input
+// message; path parameters (":name" segments of the route path) and query
+// parameters then set fields by name, with dots for nested fields such as
+// ?options.top_k=5. The response message is returned as JSON, and gRPC errors
+// are mapped to their HTTP status. Request headers prefixed Grpc-Metadata-
+// are sent as call metadata, and response metadata comes back the same way.
+//
+// Descriptor sets are the output of
+// protoc --include_imports --descriptor_set_out=model.pb model.proto.
+
+// Route protocols
+const (
+	ProtocolHTTP     = "http"
+	ProtocolGRPC     = "grpc"
+	ProtocolGRPCJSON = "grpc-json"
+)
+
+const (
+	grpcMetadataPrefix  = "Grpc-Metadata-"
+	grpcConnIdleTimeout = 5 * time.Minute
+)
+
+// GRPCDescriptorSet is an uploaded FileDescriptorSet
+type GRPCDescriptorSet struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	Name      string    `json:"name" gorm:"uniqueIndex;not null"`
+	Services  []string  `json:"services" gorm:"type:text[]"`
+	Size      int       `json:"size"`
+	Data      []byte    `json:"-" gorm:"type:bytea;not null"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var grpcRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "api_gateway_grpc_requests_total",
+		Help: "gRPC calls through the gateway by gRPC status code",
+	},
+	[]string{"service", "mode", "code"},
+)
+
+func init() {
+	prometheus.MustRegister(grpcRequests)
+}
+
+// grpcMethod is a resolved unary method a transcoded route calls
+type grpcMethod struct {
+	path   string // /package.Service/Method
+	input  protoreflect.MessageDescriptor
+	output protoreflect.MessageDescriptor
+}
+
+type grpcConn struct {
+	conn     *grpc.ClientConn
+	lastUsed time.Time
+}
+
+// grpcRegistry holds the parsed descriptor sets, the method of each
+// transcoded route, and the connections to gRPC upstreams
+type grpcRegistry struct {
+	transport http.RoundTripper // HTTP/2 transport for pass-through routes
+
+	mu      sync.RWMutex
+	files   map[string]*protoregistry.Files // by descriptor set ID
+	methods map[string]*grpcMethod          // by route ID
+	conns   map[string]*grpcConn            // by scheme://host
+}
+
+func newGRPCRegistry() *grpcRegistry {
+	return &grpcRegistry{
+		transport: &grpcTransport{
+			// Cleartext upstreams speak HTTP/2 with prior knowledge (h2c)
+			h2c: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, network, addr)
+				},
+			},
+			tls: &http2.Transport{},
+		},
+		files:   make(map[string]*protoregistry.Files),
+		methods: make(map[string]*grpcMethod),
+		conns:   make(map[string]*grpcConn),
+	}
+}
+
+// grpcTransport sends pass-through calls over HTTP/2, h2c for http:// upstreams
+type grpcTransport struct {
+	h2c *http2.Transport
+	tls *http2.Transport
+}
+
+func (t *grpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		return t.tls.RoundTrip(req)
+	}
+	return t.h2c.RoundTrip(req)
+}
+
+// transportFor is the transport proxied requests on route are sent with
+func (s *APIGatewayService) transportFor(route *APIRoute) http.RoundTripper {
+	if transport := s.upstreamTransport(route); transport != nil {
+		return transport
+	}
+	if route.Protocol == ProtocolGRPC {
+		return s.grpc.transport
+	}
+	return http.DefaultTransport
+}
+
+func (r *grpcRegistry) method(routeID string) *grpcMethod {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.methods[routeID]
+}
+
+// parseDescriptorSet builds a registry from a serialized FileDescriptorSet
+func parseDescriptorSet(data []byte) (*protoregistry.Files, error) {
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("not a FileDescriptorSet: %w", err)
+	}
+	if len(set.File) == 0 {
+		return nil, errors.New("descriptor set has no files")
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set (was it built with --include_imports?): %w", err)
+	}
+	return files, nil
+}
+
+// descriptorServices lists the fully qualified services a registry defines
+func descriptorServices(files *protoregistry.Files) []string {
+	var services []string
+	files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		for i := 0; i < file.Services().Len(); i++ {
+			services = append(services, string(file.Services().Get(i).FullName()))
+		}
+		return true
+	})
+	sort.Strings(services)
+	return services
+}
+
+// resolveGRPCMethod finds a unary method named "package.Service/Method"
+func resolveGRPCMethod(files *protoregistry.Files, name string) (*grpcMethod, error) {
+	serviceName, methodName, ok := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+	if !ok || serviceName == "" || methodName == "" {
+		return nil, fmt.Errorf("gRPC method %q must be package.Service/Method", name)
+	}
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return nil, fmt.Errorf("service %s not found in descriptor set", serviceName)
+	}
+	service, ok := descriptor.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", serviceName)
+	}
+	method := service.Methods().ByName(protoreflect.Name(methodName))
+	if method == nil {
+		return nil, fmt.Errorf("method %s not found in service %s", methodName, serviceName)
+	}
+	if method.IsStreamingClient() || method.IsStreamingServer() {
+		return nil, fmt.Errorf("method %s is streaming; only unary methods can be transcoded", name)
+	}
+	return &grpcMethod{
+		path:   "/" + serviceName + "/" + methodName,
+		input:  method.Input(),
+		output: method.Output(),
+	}, nil
+}
+
+// descriptorFiles returns a descriptor set's registry, parsing it on first use
+func (s *APIGatewayService) descriptorFiles(id string) (*protoregistry.Files, error) {
+	s.grpc.mu.RLock()
+	files, ok := s.grpc.files[id]
+	s.grpc.mu.RUnlock()
+	if ok {
+		return files, nil
+	}
+
+	var set GRPCDescriptorSet
+	if err := s.db.First(&set, "id = ?", id).Error; err != nil {
+		return nil, fmt.Errorf("descriptor set %s not found", id)
+	}
+	files, err := parseDescriptorSet(set.Data)
+	if err != nil {
+		return nil, err
+	}
+	s.grpc.mu.Lock()
+	s.grpc.files[id] = files
+	s.grpc.mu.Unlock()
+	return files, nil
+}
+
+// syncGRPC resolves the method of every transcoded route. Descriptor sets
+// are never modified, so parsed ones are kept for as long as a route uses them.
+func (s *APIGatewayService) syncGRPC(routes []*APIRoute) {
+	methods := make(map[string]*grpcMethod)
+	used := make(map[string]bool)
+	for _, route := range routes {
+		if route.Protocol != ProtocolGRPCJSON {
+			continue
+		}
+		files, err := s.descriptorFiles(route.GRPCDescriptorSetID)
+		if err != nil {
+			log.Printf("Cannot transcode route %s: %v", route.ID, err)
+			continue
+		}
+		used[route.GRPCDescriptorSetID] = true
+		method, err := resolveGRPCMethod(files, route.GRPCMethod)
+		if err != nil {
+			log.Printf("Cannot transcode route %s: %v", route.ID, err)
+			continue
+		}
+		methods[route.ID] = method
+	}
+
+	s.grpc.mu.Lock()
+	defer s.grpc.mu.Unlock()
+	s.grpc.methods = methods
+	for id := range s.grpc.files {
+		if !used[id] {
+			delete(s.grpc.files, id)
+		}
+	}
+}
+
+// conn returns the shared client connection to a gRPC upstream
+func (r *grpcRegistry) conn(target *url.URL) (*grpc.ClientConn, error) {
+	key := target.Scheme + "://" + target.Host
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cached, ok := r.conns[key]; ok {
+		cached.lastUsed = time.Now()
+		return cached.conn, nil
+	}
+
+	creds := insecure.NewCredentials()
+	port := "80"
+	if target.Scheme == "https" {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+		port = "443"
+	}
+	address := target.Host
+	if target.Port() == "" {
+		address = net.JoinHostPort(target.Hostname(), port)
+	}
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	r.conns[key] = &grpcConn{conn: conn, lastUsed: time.Now()}
+	return conn, nil
+}
+
+// startGRPCConnReaper closes connections to upstreams that are no longer called
+func (s *APIGatewayService) startGRPCConnReaper() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cutoff := time.Now().Add(-grpcConnIdleTimeout)
+			s.grpc.mu.Lock()
+			for key, cached := range s.grpc.conns {
+				if cached.lastUsed.Before(cutoff) {
+					cached.conn.Close()
+					delete(s.grpc.conns, key)
+				}
+			}
+			s.grpc.mu.Unlock()
+		}
+	}
+}
+
+// isGRPCRequest reports whether a request is a gRPC call over HTTP/2
+func isGRPCRequest(req *http.Request) bool {
+	return req.ProtoMajor == 2 && strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// writeGRPCError answers a gRPC call with a trailers-only error response
+func writeGRPCError(w http.ResponseWriter, code codes.Code, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(code)))
+	w.Header().Set("Grpc-Message", url.PathEscape(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcStatusBody reports a pass-through call's gRPC status once the proxy
+// has copied the response, when the trailers are known
+type grpcStatusBody struct {
+	io.ReadCloser
+	resp *http.Response
+	done func(code codes.Code)
+	once sync.Once
+}
+
+func (b *grpcStatusBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		// A trailers-only response carries the status in the headers
+		value := b.resp.Header.Get("Grpc-Status")
+		if value == "" {
+			value = b.resp.Trailer.Get("Grpc-Status")
+		}
+		code := codes.Unknown
+		if n, err := strconv.Atoi(value); err == nil {
+			code = codes.Code(n)
+		}
+		b.done(code)
+	})
+	return err
+}
+
+// watchGRPCStatus counts the gRPC status of a proxied call
+func watchGRPCStatus(resp *http.Response, service string) {
+	resp.Body = &grpcStatusBody{
+		ReadCloser: resp.Body,
+		resp:       resp,
+		done: func(code codes.Code) {
+			grpcRequests.WithLabelValues(service, ProtocolGRPC, code.String()).Inc()
+		},
+	}
+}
+
+// grpcServerFault reports whether a status code blames the upstream
+func grpcServerFault(code codes.Code) bool {
+	switch code {
+	case codes.Unknown, codes.DeadlineExceeded, codes.Internal, codes.Unavailable, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+// httpStatusFromGRPC maps a gRPC status code to an HTTP status
+func httpStatusFromGRPC(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// pathParams extracts the ":name" segments of a route path
+func pathParams(pattern, path string) map[string]string {
+	patternParts := strings.Split(pattern, "/")
+	pathParts := strings.Split(path, "/")
+	params := make(map[string]string)
+	for i, part := range patternParts {
+		if i < len(pathParts) && strings.HasPrefix(part, ":") {
+			params[part[1:]] = pathParts[i]
+		}
+	}
+	return params
+}
+
+// setMessageParam sets the field at a dotted path from a parameter's string
+// value, appending to repeated fields
+func setMessageParam(msg protoreflect.Message, path, raw string) error {
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		fields := msg.Descriptor().Fields()
+		field := fields.ByName(protoreflect.Name(part))
+		if field == nil {
+			field = fields.ByJSONName(part)
+		}
+		if field == nil {
+			return fmt.Errorf("unknown field %q", path)
+		}
+
+		if i < len(parts)-1 {
+			if field.Kind() != protoreflect.MessageKind || field.IsList() || field.IsMap() {
+				return fmt.Errorf("field %q has no subfields", strings.Join(parts[:i+1], "."))
+			}
+			msg = msg.Mutable(field).Message()
+			continue
+		}
+
+		if field.IsMap() || field.Kind() == protoreflect.MessageKind || field.Kind() == protoreflect.GroupKind {
+			return fmt.Errorf("field %q cannot be set from a parameter", path)
+		}
+		value, err := parseFieldValue(field, raw)
+		if err != nil {
+			return fmt.Errorf("field %q: %w", path, err)
+		}
+		if field.IsList() {
+			msg.Mutable(field).List().Append(value)
+		} else {
+			msg.Set(field, value)
+		}
+	}
+	return nil
+}
+
+func parseFieldValue(field protoreflect.FieldDescriptor, raw string) (protoreflect.Value, error) {
+	switch field.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(raw), nil
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(raw)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(raw, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(raw, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(raw, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(raw, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(raw, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(raw, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.BytesKind:
+		v, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			v, err = base64.URLEncoding.DecodeString(raw)
+		}
+		return protoreflect.ValueOfBytes(v), err
+	case protoreflect.EnumKind:
+		if value := field.Enum().Values().ByName(protoreflect.Name(raw)); value != nil {
+			return protoreflect.ValueOfEnum(value.Number()), nil
+		}
+		n, err := strconv.ParseInt(raw, 10, 32)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("unknown enum value %q", raw)
+		}
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(n)), nil
+	}
+	return protoreflect.Value{}, fmt.Errorf("unsupported field kind %s", field.Kind())
+}
+
+// transcodedInput builds a method's input message from a JSON request
+func (s *APIGatewayService) transcodedInput(c *gin.Context, route *APIRoute, method *grpcMethod) (*dynamicpb.Message, error) {
+	input := dynamicpb.NewMessage(method.input)
+
+	if c.Request.Body != nil && c.Request.Body != http.NoBody {
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, s.bodyLimit(route)+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > s.bodyLimit(route) {
+			return nil, errors.New("request body too large")
+		}
+		if len(strings.TrimSpace(string(body))) > 0 {
+			if err := protojson.Unmarshal(body, input); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for name, value := range pathParams(route.Path, c.Request.URL.Path) {
+		if err := setMessageParam(input, name, value); err != nil {
+			return nil, err
+		}
+	}
+	for name, values := range c.Request.URL.Query() {
+		for _, value := range values {
+			if err := setMessageParam(input, name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return input, nil
+}
+
+// transcodeGRPC serves a JSON request by calling the route's gRPC method on
+// endpoint
+func (s *APIGatewayService) transcodeGRPC(c *gin.Context, route *APIRoute, pool *upstreamPool, endpoint *upstream, requestID string, startTime time.Time, recordOutcome func(ok, counted bool)) {
+	method := s.grpc.method(route.ID)
+	if method == nil {
+		s.logRequest(c, requestID, route.ServiceName, http.StatusServiceUnavailable, time.Since(startTime), "gRPC method not resolved")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service unavailable"})
+		return
+	}
+	input, err := s.transcodedInput(c, route, method)
+	if err != nil {
+		s.logRequest(c, requestID, route.ServiceName, http.StatusBadRequest, time.Since(startTime), "Invalid transcoded request: "+err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+	conn, err := s.grpc.conn(endpoint.target)
+	if err != nil {
+		recordOutcome(false, true)
+		s.logRequest(c, requestID, route.ServiceName, http.StatusBadGateway, time.Since(startTime), err.Error())
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Service unavailable"})
+		return
+	}
+
+	md := metadata.Pairs(
+		"x-request-id", requestID,
+		"x-forwarded-for", c.ClientIP(),
+		"x-gateway-service", "002aic-api-gateway",
+	)
+	if userID := c.GetString("user_id"); userID != "" {
+		md.Set("x-user-id", userID)
+	}
+	if authorization := c.GetHeader("Authorization"); authorization != "" {
+		md.Set("authorization", authorization)
+	}
+	for name, values := range c.Request.Header {
+		if strings.HasPrefix(name, grpcMetadataPrefix) {
+			md.Append(strings.ToLower(strings.TrimPrefix(name, grpcMetadataPrefix)), values...)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(route.Timeout)*time.Second)
+	defer cancel()
+	ctx, span := startGRPCSpan(ctx, route, method.path, md)
+	defer span.End()
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	host := endpoint.target.Host
+	upstreamActiveConnections.WithLabelValues(route.ServiceName, host).Inc()
+	var header, trailer metadata.MD
+	output := dynamicpb.NewMessage(method.output)
+	err = conn.Invoke(ctx, method.path, input, output, grpc.Header(&header), grpc.Trailer(&trailer))
+	upstreamActiveConnections.WithLabelValues(route.ServiceName, host).Dec()
+	if err != nil {
+		span.RecordError(err)
+	}
+
+	code := status.Code(err)
+	grpcRequests.WithLabelValues(route.ServiceName, ProtocolGRPCJSON, code.String()).Inc()
+	// A client hanging up says nothing about the upstream
+	if !errors.Is(c.Request.Context().Err(), context.Canceled) {
+		ok := !grpcServerFault(code)
+		pool.report(endpoint, ok, s.config.UpstreamEjectionThreshold, s.config.UpstreamEjectionDuration)
+		upstreamRequests.WithLabelValues(route.ServiceName, host, upstreamResult(ok)).Inc()
+		recordOutcome(ok, true)
+	}
+
+	for _, md := range []metadata.MD{header, trailer} {
+		for name, values := range md {
+			for _, value := range values {
+				c.Writer.Header().Add(grpcMetadataPrefix+name, value)
+			}
+		}
+	}
+	c.Header("X-Request-ID", requestID)
+
+	if err != nil {
+		st := status.Convert(err)
+		s.logRequest(c, requestID, route.ServiceName, httpStatusFromGRPC(code), time.Since(startTime), "gRPC error: "+st.Message())
+		c.JSON(httpStatusFromGRPC(code), gin.H{
+			"error":     st.Message(),
+			"code":      code.String(),
+			"grpc_code": int(code),
+		})
+		return
+	}
+
+	body, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(output)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode response"})
+		return
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(string(body))),
+		ContentLength: int64(len(body)),
+	}
+	if transform := s.transforms.get(route.ID); transform != nil && transform.response != nil {
+		if err := applyResponseTransform(resp, transform.response); err != nil {
+			s.logRequest(c, requestID, route.ServiceName, http.StatusBadGateway, time.Since(startTime), "Response transformation failed: "+err.Error())
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Invalid upstream response"})
+			return
+		}
+	}
+	for name, values := range resp.Header {
+		c.Writer.Header()[name] = values
+	}
+	c.Status(resp.StatusCode)
+	io.Copy(c.Writer, resp.Body)
+}
+
+// Upload a protobuf descriptor set, as a multipart "file" or a raw body
+func (s *APIGatewayService) uploadDescriptorSet(c *gin.Context) {
+	name := c.PostForm("name")
+	if name == "" {
+		name = c.Query("name")
+	}
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+
+	var reader io.Reader = c.Request.Body
+	if file, err := c.FormFile("file"); err == nil {
+		opened, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+			return
+		}
+		defer opened.Close()
+		reader = opened
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, s.config.MaxRequestSize+1))
+	if err != nil || int64(len(data)) > s.config.MaxRequestSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read descriptor set"})
+		return
+	}
+
+	files, err := parseDescriptorSet(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	set := GRPCDescriptorSet{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Services:  descriptorServices(files),
+		Size:      len(data),
+		Data:      data,
+		CreatedBy: c.GetString("user_id"),
+		CreatedAt: time.Now(),
+	}
+	if err := s.db.Create(&set).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Failed to save descriptor set: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, set)
+}
+
+// List uploaded descriptor sets
+func (s *APIGatewayService) listDescriptorSets(c *gin.Context) {
+	var sets []GRPCDescriptorSet
+	if err := s.db.Omit("data").Order("name").Find(&sets).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list descriptor sets"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"descriptor_sets": sets,
+		"total":           len(sets),
+	})
+}
+
+// Get a descriptor set with the methods it defines
+func (s *APIGatewayService) getDescriptorSet(c *gin.Context) {
+	var set GRPCDescriptorSet
+	if err := s.db.First(&set, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Descriptor set not found"})
+		return
+	}
+	files, err := parseDescriptorSet(set.Data)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	methods := []gin.H{}
+	for _, name := range set.Services {
+		descriptor, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			continue
+		}
+		service := descriptor.(protoreflect.ServiceDescriptor)
+		for i := 0; i < service.Methods().Len(); i++ {
+			method := service.Methods().Get(i)
+			methods = append(methods, gin.H{
+				"name":             name + "/" + string(method.Name()),
+				"input":            method.Input().FullName(),
+				"output":           method.Output().FullName(),
+				"client_streaming": method.IsStreamingClient(),
+				"server_streaming": method.IsStreamingServer(),
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"descriptor_set": set,
+		"methods":        methods,
+	})
+}
+
+// Delete a descriptor set no route uses
+func (s *APIGatewayService) deleteDescriptorSet(c *gin.Context) {
+	var inUse int64
+	s.db.Model(&APIRoute{}).Where("grpc_descriptor_set_id = ?", c.Param("id")).Count(&inUse)
+	if inUse > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Descriptor set is used by routes", "routes": inUse})
+		return
+	}
+
+	result := s.db.Delete(&GRPCDescriptorSet{}, "id = ?", c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete descriptor set"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Descriptor set not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Descriptor set deleted successfully"})
+}
+
+// Set how a route reaches its backend: HTTP, gRPC pass-through or transcoding
+func (s *APIGatewayService) updateRouteProtocol(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	var req struct {
+		Protocol            string `json:"protocol" binding:"required"`
+		GRPCMethod          string `json:"grpc_method"`
+		GRPCDescriptorSetID string `json:"grpc_descriptor_set_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	switch req.Protocol {
+	case ProtocolHTTP, ProtocolGRPC:
+		req.GRPCMethod, req.GRPCDescriptorSetID = "", ""
+	case ProtocolGRPCJSON:
+		files, err := s.descriptorFiles(req.GRPCDescriptorSetID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		method, err := resolveGRPCMethod(files, req.GRPCMethod)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.GRPCMethod = strings.TrimPrefix(method.path, "/")
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "protocol must be http, grpc or grpc-json"})
+		return
+	}
+
+	if err := s.db.Model(&route).Updates(map[string]interface{}{
+		"protocol":               req.Protocol,
+		"grpc_method":            req.GRPCMethod,
+		"grpc_descriptor_set_id": req.GRPCDescriptorSetID,
+		"updated_at":             time.Now(),
+	}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update route"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"route_id":               route.ID,
+		"protocol":               req.Protocol,
+		"grpc_method":            req.GRPCMethod,
+		"grpc_descriptor_set_id": req.GRPCDescriptorSetID,
+	})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Active health checking. For routes with a HealthCheckURL the health
+// checker probes that path on every endpoint of the route's pool. An
+// endpoint is marked unhealthy after HEALTH_CHECK_UNHEALTHY_THRESHOLD failed
+// probes in a row and healthy again after HEALTH_CHECK_HEALTHY_THRESHOLD
+// successful ones. Unhealthy endpoints take no traffic, which is what fails a
+// route over to its next priority; each such move is recorded as a
+// RouteFailoverEvent.
+
+const (
+	defaultFailoverListLimit = 50
+	maxFailoverListLimit     = 500
+)
+
+// RouteFailoverEvent records a route moving traffic between priorities
+type RouteFailoverEvent struct {
+	ID           string    `json:"id" gorm:"primaryKey"`
+	RouteID      string    `json:"route_id" gorm:"index;not null"`
+	ServiceName  string    `json:"service_name"`
+	FromPriority int       `json:"from_priority"`
+	ToPriority   int       `json:"to_priority"`
+	Reason       string    `json:"reason"` // health_check_failed, ejected, recovered
+	CreatedAt    time.Time `json:"created_at" gorm:"index"`
+}
+
+// upstreamHealth is an endpoint's active health state
+type upstreamHealth struct {
+	healthy   bool
+	successes int // consecutive
+	failures  int // consecutive
+	checkedAt time.Time
+	lastError string
+}
+
+var (
+	upstreamHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "api_gateway_upstream_healthy",
+			Help: "Whether an upstream endpoint passes its health check (1) or not (0)",
+		},
+		[]string{"service", "upstream"},
+	)
+
+	upstreamHealthChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_upstream_health_checks_total",
+			Help: "Health check probes per upstream endpoint",
+		},
+		[]string{"service", "upstream", "result"},
+	)
+
+	upstreamHealthCheckDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "api_gateway_upstream_health_check_duration_seconds",
+			Help:    "Health check probe duration per upstream endpoint",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"service", "upstream"},
+	)
+
+	routeFailovers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_route_failovers_total",
+			Help: "Routes moving traffic to another upstream priority",
+		},
+		[]string{"service", "from_priority", "to_priority", "reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(upstreamHealthy)
+	prometheus.MustRegister(upstreamHealthChecks)
+	prometheus.MustRegister(upstreamHealthCheckDuration)
+	prometheus.MustRegister(routeFailovers)
+}
+
+// healthCheckURL builds the probe URL of an endpoint from a route's
+// HealthCheckURL; only the path and query of an absolute URL are used, so
+// one setting covers every endpoint
+func healthCheckURL(target *url.URL, check string) string {
+	path := check
+	if parsed, err := url.Parse(check); err == nil && parsed.IsAbs() {
+		path = parsed.RequestURI()
+	}
+	return strings.TrimRight(target.String(), "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+// endpoints returns the pool's current endpoints
+func (p *upstreamPool) endpoints() []*upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*upstream(nil), p.upstreams...)
+}
+
+// recordProbe applies a probe result to an endpoint, then re-evaluates which
+// priority takes traffic so failover does not wait for the next request
+func (p *upstreamPool) recordProbe(u *upstream, probeErr error, unhealthyAfter, healthyAfter int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := &u.health
+	h.checkedAt = time.Now()
+	if probeErr == nil {
+		h.failures = 0
+		h.successes++
+		h.lastError = ""
+		if !h.healthy && h.successes >= healthyAfter {
+			h.healthy = true
+			log.Printf("✅ Upstream %s of %s is healthy again", u.target.Host, p.service)
+		}
+	} else {
+		h.successes = 0
+		h.failures++
+		h.lastError = probeErr.Error()
+		if h.healthy && h.failures >= unhealthyAfter {
+			h.healthy = false
+			log.Printf("⚠️ Upstream %s of %s failed %d health checks: %v", u.target.Host, p.service, h.failures, probeErr)
+		}
+	}
+
+	healthy := 0.0
+	if h.healthy {
+		healthy = 1
+	}
+	upstreamHealthy.WithLabelValues(p.service, u.target.Host).Set(healthy)
+
+	if len(p.upstreams) > 0 {
+		p.candidates(h.checkedAt)
+	}
+}
+
+// probe performs one health check request
+func (s *APIGatewayService) probe(ctx context.Context, endpoint string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.config.HealthCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "002aic-api-gateway-health-check")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkUpstreamHealth probes every endpoint of the routes that have a
+// HealthCheckURL. An endpoint shared by several routes with the same check
+// is probed once.
+func (s *APIGatewayService) checkUpstreamHealth() {
+	type check struct {
+		pool     *upstreamPool
+		upstream *upstream
+		url      string
+	}
+	var checks []check
+	probes := map[string]error{}
+	for _, route := range s.activeRoutes() {
+		if route.HealthCheckURL == "" {
+			continue
+		}
+		pool := s.balancer.pool(route.ID)
+		if pool == nil {
+			continue
+		}
+		for _, u := range pool.endpoints() {
+			endpoint := healthCheckURL(u.target, route.HealthCheckURL)
+			checks = append(checks, check{pool: pool, upstream: u, url: endpoint})
+			probes[endpoint] = nil
+		}
+	}
+	if len(checks) == 0 {
+		return
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for endpoint := range probes {
+		wg.Add(1)
+		go func(endpoint string) {
+			defer wg.Done()
+			err := s.probe(context.Background(), endpoint)
+			mu.Lock()
+			probes[endpoint] = err
+			mu.Unlock()
+		}(endpoint)
+	}
+	wg.Wait()
+
+	for _, c := range checks {
+		err := probes[c.url]
+		upstreamHealthChecks.WithLabelValues(c.pool.service, c.upstream.target.Host, upstreamResult(err == nil)).Inc()
+		c.pool.recordProbe(c.upstream, err, s.config.HealthCheckUnhealthyAfter, s.config.HealthCheckHealthyAfter)
+	}
+}
+
+func (s *APIGatewayService) startHealthChecker() {
+	ticker := time.NewTicker(s.config.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.checkUpstreamHealth()
+		}
+	}
+}
+
+// recordFailover is called by a pool, under its lock, when traffic moves to
+// another priority; the event is stored in the background
+func (s *APIGatewayService) recordFailover(routeID, service string, from, to int, reason string) {
+	routeFailovers.WithLabelValues(service, strconv.Itoa(from), strconv.Itoa(to), reason).Inc()
+	log.Printf("🔀 Route %s (%s) failed over from priority %d to %d: %s", routeID, service, from, to, reason)
+
+	event := RouteFailoverEvent{
+		ID:           uuid.New().String(),
+		RouteID:      routeID,
+		ServiceName:  service,
+		FromPriority: from,
+		ToPriority:   to,
+		Reason:       reason,
+		CreatedAt:    time.Now(),
+	}
+	go func() {
+		if err := s.db.Create(&event).Error; err != nil {
+			log.Printf("Failed to record failover of route %s: %v", routeID, err)
+		}
+	}()
+}
+
+// List a route's failover events, newest first
+func (s *APIGatewayService) listRouteFailovers(c *gin.Context) {
+	limit := defaultFailoverListLimit
+	if v, err := strconv.Atoi(c.Query("limit")); err == nil && v > 0 {
+		limit = v
+	}
+	if limit > maxFailoverListLimit {
+		limit = maxFailoverListLimit
+	}
+
+	var events []RouteFailoverEvent
+	if err := s.db.Where("route_id = ?", c.Param("id")).Order("created_at DESC").
+		Limit(limit).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch failover events"})
+		return
+	}
+
+	response := gin.H{"route_id": c.Param("id"), "failovers": events}
+	if pool := s.balancer.pool(c.Param("id")); pool != nil {
+		pool.mu.Lock()
+		response["active_priority"] = pool.tier
+		pool.mu.Unlock()
+	}
+	c.JSON(http.StatusOK, response)
+}
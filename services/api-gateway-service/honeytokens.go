@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Honeytokens are decoy credentials planted by the security service, which
+// mirrors the SHA-256 hashes of the active ones into the Redis hash
+// honeytokenIndexKey (hash -> honeytoken ID). A presented API key or token
+// found there is rejected like any other bad credential, and the auth
+// failure published for it names the honeytoken so the security service
+// raises the alert.
+
+const honeytokenIndexKey = "honeytokens:index"
+
+// honeytokenID returns the ID of the honeytoken a credential belongs to, or ""
+func (s *APIGatewayService) honeytokenID(ctx context.Context, credential string) string {
+	if credential == "" {
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+
+	sum := sha256.Sum256([]byte(credential))
+	id, err := s.redis.HGet(ctx, honeytokenIndexKey, hex.EncodeToString(sum[:])).Result()
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// rejectHoneytoken answers a decoy credential exactly as an invalid one
+func rejectHoneytoken(c *gin.Context, id, message string) bool {
+	c.Set("honeytoken_id", id)
+	c.JSON(http.StatusUnauthorized, gin.H{"error": message})
+	return false
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm/clause"
+)
+
+// Client IP access control. A route may allow or deny clients by CIDR and,
+// with a MaxMind GeoIP2 or GeoLite2 database at GEOIP_DATABASE_PATH, by the
+// country their address is registered to. Access is checked as soon as the
+// route is matched, before maintenance windows and authentication, so
+// blocked clients get no further than a 403:
+//
+//  1. an address in deny_cidrs is refused;
+//  2. an address in allow_cidrs is let through, countries notwithstanding;
+//  3. an address in a country in deny_countries is refused;
+//  4. if the route has allow lists, anything not yet let through is refused
+//     unless its country is in allow_countries.
+//
+// An address whose country is unknown (private ranges, addresses missing
+// from the database) only passes allow_countries through allow_cidrs.
+//
+// The client address is gin's ClientIP, which believes X-Forwarded-For only
+// from TRUSTED_PROXIES; set it to the load balancers in front of the
+// gateway, otherwise clients can pick their own address. The database is
+// checked every GEOIP_RELOAD_INTERVAL and reloaded when it changes.
+
+// RouteAccessPolicy holds a route's client IP and country restrictions
+type RouteAccessPolicy struct {
+	RouteID        string    `json:"route_id" gorm:"primaryKey"`
+	AllowCIDRs     []string  `json:"allow_cidrs" gorm:"type:text[]"`
+	DenyCIDRs      []string  `json:"deny_cidrs" gorm:"type:text[]"`
+	AllowCountries []string  `json:"allow_countries" gorm:"type:text[]"` // ISO 3166-1 alpha-2
+	DenyCountries  []string  `json:"deny_countries" gorm:"type:text[]"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+var accessDenials = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "api_gateway_access_denials_total",
+		Help: "Requests refused by route IP and country access lists",
+	},
+	[]string{"route", "reason"}, // ip_denied, country_denied, not_allowed
+)
+
+func init() {
+	prometheus.MustRegister(accessDenials)
+}
+
+// accessPolicy is a route's compiled access lists
+type accessPolicy struct {
+	allow          []*net.IPNet
+	deny           []*net.IPNet
+	allowCountries map[string]bool
+	denyCountries  map[string]bool
+}
+
+func (p *accessPolicy) usesCountries() bool {
+	return len(p.allowCountries) > 0 || len(p.denyCountries) > 0
+}
+
+// check returns why ip is refused, or "" when it may pass. country is
+// looked up only when needed.
+func (p *accessPolicy) check(ip net.IP, country func() string) string {
+	if containsIP(p.deny, ip) {
+		return "ip_denied"
+	}
+	if containsIP(p.allow, ip) {
+		return ""
+	}
+
+	code := ""
+	if p.usesCountries() {
+		code = country()
+	}
+	if code != "" && p.denyCountries[code] {
+		return "country_denied"
+	}
+	if len(p.allow) > 0 || len(p.allowCountries) > 0 {
+		if code == "" || !p.allowCountries[code] {
+			return "not_allowed"
+		}
+	}
+	return ""
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileAccessPolicy checks a route's access lists
+func compileAccessPolicy(policy *RouteAccessPolicy) (*accessPolicy, error) {
+	compiled := &accessPolicy{}
+	var err error
+	if compiled.allow, err = parseCIDRs(policy.AllowCIDRs); err != nil {
+		return nil, err
+	}
+	if compiled.deny, err = parseCIDRs(policy.DenyCIDRs); err != nil {
+		return nil, err
+	}
+	if compiled.allowCountries, err = parseCountries(policy.AllowCountries); err != nil {
+		return nil, err
+	}
+	if compiled.denyCountries, err = parseCountries(policy.DenyCountries); err != nil {
+		return nil, err
+	}
+	if len(compiled.allow) == 0 && len(compiled.deny) == 0 && !compiled.usesCountries() {
+		return nil, nil
+	}
+	return compiled, nil
+}
+
+// parseCIDRs accepts CIDR blocks and bare addresses
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", value)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func parseCountries(values []string) (map[string]bool, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	codes := make(map[string]bool, len(values))
+	for _, value := range values {
+		code := strings.ToUpper(strings.TrimSpace(value))
+		if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+			return nil, fmt.Errorf("invalid country code %q", value)
+		}
+		codes[code] = true
+	}
+	return codes, nil
+}
+
+// geoIPDatabase is the reloadable country database
+type geoIPDatabase struct {
+	path string
+
+	mu       sync.RWMutex
+	reader   *maxminddb.Reader
+	modTime  time.Time
+	loadedAt time.Time
+	err      error
+}
+
+// reload opens the database again if the file changed, reporting whether it
+// did. A database that fails to open leaves the last good one in use.
+func (g *geoIPDatabase) reload() (bool, error) {
+	modTime, err := latestModTime(g.path)
+	if err != nil {
+		g.setErr(err)
+		return false, err
+	}
+	g.mu.RLock()
+	unchanged := g.reader != nil && modTime.Equal(g.modTime)
+	g.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	reader, err := maxminddb.Open(g.path)
+	if err != nil {
+		g.setErr(err)
+		return false, err
+	}
+	g.mu.Lock()
+	previous := g.reader
+	g.reader, g.modTime, g.loadedAt, g.err = reader, modTime, time.Now(), nil
+	g.mu.Unlock()
+	if previous != nil {
+		// Lookups in flight finish within the grace period
+		time.AfterFunc(time.Minute, func() { previous.Close() })
+	}
+	return true, nil
+}
+
+func (g *geoIPDatabase) setErr(err error) {
+	g.mu.Lock()
+	g.err = err
+	g.mu.Unlock()
+}
+
+// country is the ISO code of the country ip is registered to, or "" when
+// unknown
+func (g *geoIPDatabase) country(ip net.IP) string {
+	g.mu.RLock()
+	reader := g.reader
+	g.mu.RUnlock()
+	if reader == nil {
+		return ""
+	}
+
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+	if err := reader.Lookup(ip, &record); err != nil {
+		return ""
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode
+	}
+	return record.RegisteredCountry.ISOCode
+}
+
+func (g *geoIPDatabase) status() gin.H {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	status := gin.H{"path": g.path, "loaded": g.reader != nil}
+	if g.reader != nil {
+		status["database_type"] = g.reader.Metadata.DatabaseType
+		status["build_time"] = time.Unix(int64(g.reader.Metadata.BuildEpoch), 0).UTC()
+		status["loaded_at"] = g.loadedAt
+	}
+	if g.err != nil {
+		status["error"] = g.err.Error()
+	}
+	return status
+}
+
+type accessRegistry struct {
+	geoip *geoIPDatabase // nil without GEOIP_DATABASE_PATH
+
+	mu       sync.RWMutex
+	policies map[string]*accessPolicy // by route ID
+}
+
+func newAccessRegistry(config *Config) *accessRegistry {
+	r := &accessRegistry{policies: make(map[string]*accessPolicy)}
+	if config.GeoIPDatabasePath != "" {
+		r.geoip = &geoIPDatabase{path: config.GeoIPDatabasePath}
+		if _, err := r.geoip.reload(); err != nil {
+			log.Printf("Failed to load GeoIP database: %v", err)
+		}
+	}
+	return r
+}
+
+func (r *accessRegistry) policy(routeID string) *accessPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.policies[routeID]
+}
+
+// syncAccessPolicies compiles the routes' access lists
+func (s *APIGatewayService) syncAccessPolicies(routes []*APIRoute) {
+	policies := make(map[string]*accessPolicy)
+	for _, route := range routes {
+		if route.AccessPolicy == nil {
+			continue
+		}
+		policy, err := compileAccessPolicy(route.AccessPolicy)
+		if err != nil {
+			log.Printf("Ignoring access lists of route %s: %v", route.ID, err)
+			continue
+		}
+		if policy != nil {
+			policies[route.ID] = policy
+		}
+	}
+
+	s.access.mu.Lock()
+	s.access.policies = policies
+	s.access.mu.Unlock()
+}
+
+// checkAccess applies the route's access lists to the client address,
+// answering the request when it is refused
+func (s *APIGatewayService) checkAccess(c *gin.Context, route *APIRoute) bool {
+	policy := s.access.policy(route.ID)
+	if policy == nil {
+		return true
+	}
+
+	ip := net.ParseIP(c.ClientIP())
+	if ip == nil {
+		accessDenials.WithLabelValues(route.ID, "not_allowed").Inc()
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return false
+	}
+	reason := policy.check(ip, func() string {
+		if s.access.geoip == nil {
+			return ""
+		}
+		return s.access.geoip.country(ip)
+	})
+	if reason == "" {
+		return true
+	}
+
+	accessDenials.WithLabelValues(route.ID, reason).Inc()
+	c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	return false
+}
+
+// startGeoIPReloader picks up database updates, e.g. from geoipupdate
+func (s *APIGatewayService) startGeoIPReloader() {
+	if s.access.geoip == nil || s.config.GeoIPReloadInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.config.GeoIPReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reloaded, err := s.access.geoip.reload()
+		if err != nil {
+			log.Printf("Failed to reload GeoIP database: %v", err)
+			continue
+		}
+		if reloaded {
+			log.Printf("Reloaded GeoIP database %s", s.access.geoip.path)
+		}
+	}
+}
+
+// Admin handlers
+
+// Get a route's access lists
+func (s *APIGatewayService) getRouteAccessPolicy(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("AccessPolicy").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	policy := RouteAccessPolicy{RouteID: route.ID}
+	if route.AccessPolicy != nil {
+		policy = *route.AccessPolicy
+	}
+	response := gin.H{"access": policy}
+	if s.access.geoip != nil {
+		response["geoip"] = s.access.geoip.status()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Configure a route's access lists
+func (s *APIGatewayService) updateRouteAccessPolicy(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("AccessPolicy").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	var policy RouteAccessPolicy
+	if route.AccessPolicy != nil {
+		policy = *route.AccessPolicy
+	}
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	policy.RouteID = route.ID
+	policy.UpdatedAt = time.Now()
+
+	compiled, err := compileAccessPolicy(&policy)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if compiled != nil && compiled.usesCountries() && s.access.geoip == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the gateway has no GeoIP database; set GEOIP_DATABASE_PATH to restrict countries"})
+		return
+	}
+	// Country codes are stored as matched
+	for i, code := range policy.AllowCountries {
+		policy.AllowCountries[i] = strings.ToUpper(strings.TrimSpace(code))
+	}
+	for i, code := range policy.DenyCountries {
+		policy.DenyCountries[i] = strings.ToUpper(strings.TrimSpace(code))
+	}
+
+	if err := s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save access lists"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// Remove a route's access lists
+func (s *APIGatewayService) deleteRouteAccessPolicy(c *gin.Context) {
+	if err := s.db.Delete(&RouteAccessPolicy{}, "route_id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete access lists"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Access lists deleted successfully"})
+}
+
+// Look up the country of an address, to check the database and lists
+func (s *APIGatewayService) lookupGeoIP(c *gin.Context) {
+	if s.access.geoip == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No GeoIP database configured"})
+		return
+	}
+	ip := net.ParseIP(c.Query("ip"))
+	if ip == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ip must be an IP address"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"ip":      ip.String(),
+		"country": s.access.geoip.country(ip),
+		"geoip":   s.access.geoip.status(),
+	})
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Upstream load balancing. A route proxies to a pool of upstream endpoints:
+// its configured RouteUpstreams, the healthy instances discovery-service
+// reports for it (see discovery.go), or its single ServiceURL. The route's
+// LoadBalancing strategy picks an endpoint per request. Endpoints that keep
+// failing (transport errors or 5xx responses) are ejected from the pool for
+// a while; if every endpoint is ejected the pool falls back to all of them
+// rather than failing outright.
+//
+// Static upstreams carry a Priority (0 is the primary). Only the best
+// priority with an available endpoint takes traffic, so secondary and DR
+// targets are used only while every preferred one is ejected or failing
+// its health check (see health_check.go).
+
+// Load balancing strategies
+const (
+	LoadBalancingRoundRobin       = "round_robin"
+	LoadBalancingWeighted         = "weighted"
+	LoadBalancingLeastConnections = "least_connections"
+)
+
+// RouteUpstream is one statically configured endpoint of a route
+type RouteUpstream struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	RouteID   string    `json:"route_id" gorm:"index;not null"`
+	URL       string    `json:"url" gorm:"not null"`
+	Weight    int       `json:"weight" gorm:"default:1"`
+	Priority  int       `json:"priority" gorm:"default:0"` // lower is preferred
+	IsActive  bool      `json:"is_active" gorm:"default:true"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var (
+	upstreamRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_upstream_requests_total",
+			Help: "Proxied requests per upstream endpoint",
+		},
+		[]string{"service", "upstream", "result"},
+	)
+
+	upstreamEjections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_upstream_ejections_total",
+			Help: "Upstream endpoints ejected after consecutive failures",
+		},
+		[]string{"service", "upstream"},
+	)
+
+	upstreamActiveConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "api_gateway_upstream_active_connections",
+			Help: "In-flight requests per upstream endpoint",
+		},
+		[]string{"service", "upstream"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(upstreamRequests)
+	prometheus.MustRegister(upstreamEjections)
+	prometheus.MustRegister(upstreamActiveConnections)
+}
+
+// upstream is the live state of one endpoint
+type upstream struct {
+	target   *url.URL
+	weight   int
+	priority int
+	active   int64
+
+	// Guarded by the pool's mutex
+	currentWeight int
+	failures      int
+	ejectedUntil  time.Time
+	health        upstreamHealth
+}
+
+type upstreamTarget struct {
+	URL      string
+	Weight   int
+	Priority int
+}
+
+// upstreamPool balances one route's requests over its endpoints
+type upstreamPool struct {
+	mu         sync.Mutex
+	routeID    string
+	service    string
+	strategy   string
+	upstreams  []*upstream
+	next       int
+	tier       int // priority currently taking traffic, -1 before the first pick
+	onFailover failoverFunc
+}
+
+// failoverFunc is told when a pool moves traffic to another priority
+type failoverFunc func(routeID, service string, from, to int, reason string)
+
+// loadBalancer holds the pools of all routes, by route ID
+type loadBalancer struct {
+	mu         sync.RWMutex
+	pools      map[string]*upstreamPool
+	discovered map[string]*discoveryEntry // by discovery service name
+	onFailover failoverFunc
+}
+
+func newLoadBalancer(onFailover failoverFunc) *loadBalancer {
+	return &loadBalancer{
+		pools:      make(map[string]*upstreamPool),
+		discovered: make(map[string]*discoveryEntry),
+		onFailover: onFailover,
+	}
+}
+
+// setTargets replaces the pool's endpoints, keeping the state of those that
+// remain
+func (p *upstreamPool) setTargets(targets []upstreamTarget) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	existing := make(map[string]*upstream, len(p.upstreams))
+	for _, u := range p.upstreams {
+		existing[u.target.String()] = u
+	}
+
+	upstreams := make([]*upstream, 0, len(targets))
+	for _, t := range targets {
+		target, err := url.Parse(t.URL)
+		if err != nil || target.Host == "" {
+			log.Printf("Ignoring invalid upstream %q for %s", t.URL, p.service)
+			continue
+		}
+		weight := t.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		if u, ok := existing[target.String()]; ok {
+			u.weight = weight
+			u.priority = t.Priority
+			upstreams = append(upstreams, u)
+			continue
+		}
+		upstreams = append(upstreams, &upstream{
+			target:   target,
+			weight:   weight,
+			priority: t.Priority,
+			health:   upstreamHealth{healthy: true},
+		})
+	}
+	p.upstreams = upstreams
+}
+
+// candidates returns the available endpoints of the best priority that has
+// any, noting a failover when that priority changes. Callers hold p.mu.
+func (p *upstreamPool) candidates(now time.Time) []*upstream {
+	var candidates []*upstream
+	tier := -1
+	for _, u := range p.upstreams {
+		if !now.After(u.ejectedUntil) || !u.health.healthy {
+			continue
+		}
+		switch {
+		case tier == -1 || u.priority < tier:
+			tier = u.priority
+			candidates = append(candidates[:0], u)
+		case u.priority == tier:
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		// Everything is down; a possibly failing endpoint beats none
+		return p.upstreams
+	}
+
+	if tier != p.tier {
+		if p.tier != -1 && p.onFailover != nil {
+			p.onFailover(p.routeID, p.service, p.tier, tier, p.failoverReason(tier))
+		}
+		p.tier = tier
+	}
+	return candidates
+}
+
+// failoverReason explains a move from the current priority to tier
+func (p *upstreamPool) failoverReason(tier int) string {
+	if tier < p.tier {
+		return "recovered"
+	}
+	for _, u := range p.upstreams {
+		if u.priority == p.tier && !u.health.healthy {
+			return "health_check_failed"
+		}
+	}
+	return "ejected"
+}
+
+// pick selects an endpoint for the next request
+func (p *upstreamPool) pick() *upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.upstreams) == 0 {
+		return nil
+	}
+
+	candidates := p.candidates(time.Now())
+
+	switch p.strategy {
+	case LoadBalancingWeighted:
+		// Smooth weighted round robin spreads heavy endpoints' turns out
+		// instead of sending them bursts
+		total := 0
+		var best *upstream
+		for _, u := range candidates {
+			u.currentWeight += u.weight
+			total += u.weight
+			if best == nil || u.currentWeight > best.currentWeight {
+				best = u
+			}
+		}
+		best.currentWeight -= total
+		return best
+
+	case LoadBalancingLeastConnections:
+		// Fewest in-flight requests relative to weight; rotate the starting
+		// point so ties do not all land on the first endpoint
+		p.next++
+		var best *upstream
+		var bestLoad float64
+		for i := range candidates {
+			u := candidates[(p.next+i)%len(candidates)]
+			load := float64(atomic.LoadInt64(&u.active)) / float64(u.weight)
+			if best == nil || load < bestLoad {
+				best, bestLoad = u, load
+			}
+		}
+		return best
+
+	default:
+		p.next++
+		return candidates[p.next%len(candidates)]
+	}
+}
+
+// report records the outcome of a request to an endpoint, ejecting it after
+// too many consecutive failures
+func (p *upstreamPool) report(u *upstream, ok bool, threshold int, ejectFor time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ok {
+		u.failures = 0
+		return
+	}
+	u.failures++
+	if threshold > 0 && u.failures >= threshold {
+		u.failures = 0
+		u.ejectedUntil = time.Now().Add(ejectFor)
+		upstreamEjections.WithLabelValues(p.service, u.target.Host).Inc()
+		log.Printf("⚠️ Ejected upstream %s of %s for %v", u.target.Host, p.service, ejectFor)
+	}
+}
+
+// status describes the pool's endpoints
+func (p *upstreamPool) status() []gin.H {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	status := make([]gin.H, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		entry := gin.H{
+			"url":                  u.target.String(),
+			"weight":               u.weight,
+			"priority":             u.priority,
+			"active_connections":   atomic.LoadInt64(&u.active),
+			"consecutive_failures": u.failures,
+			"ejected":              now.Before(u.ejectedUntil),
+			"healthy":              u.health.healthy,
+			"serving":              u.priority == p.tier,
+		}
+		if now.Before(u.ejectedUntil) {
+			entry["ejected_until"] = u.ejectedUntil.UTC()
+		}
+		if !u.health.checkedAt.IsZero() {
+			entry["last_health_check"] = u.health.checkedAt.UTC()
+		}
+		if u.health.lastError != "" {
+			entry["health_error"] = u.health.lastError
+		}
+		status = append(status, entry)
+	}
+	return status
+}
+
+// targetsFor resolves a route's endpoints: static upstreams first, then
+// discovered instances, then the route's ServiceURL
+func (lb *loadBalancer) targetsFor(route *APIRoute) []upstreamTarget {
+	var targets []upstreamTarget
+	for _, u := range route.Upstreams {
+		if u.IsActive {
+			targets = append(targets, upstreamTarget{URL: u.URL, Weight: u.Weight, Priority: u.Priority})
+		}
+	}
+	if len(targets) == 0 {
+		if name := route.discoveryName(); name != "" {
+			targets = lb.discoveredTargets(name)
+		}
+	}
+	if len(targets) == 0 && route.ServiceURL != "" {
+		targets = []upstreamTarget{{URL: route.ServiceURL, Weight: 1}}
+	}
+	return targets
+}
+
+// sync rebuilds the pools for the given routes, dropping pools of routes
+// that are gone
+func (lb *loadBalancer) sync(routes []*APIRoute) {
+	lb.mu.Lock()
+	pools := make(map[string]*upstreamPool, len(routes))
+	for _, route := range routes {
+		pool, ok := lb.pools[route.ID]
+		if !ok {
+			pool = &upstreamPool{tier: -1, onFailover: lb.onFailover}
+		}
+		pools[route.ID] = pool
+	}
+	lb.pools = pools
+	lb.mu.Unlock()
+
+	for _, route := range routes {
+		pool := pools[route.ID]
+		pool.mu.Lock()
+		pool.routeID = route.ID
+		pool.service = route.ServiceName
+		pool.strategy = route.LoadBalancing
+		pool.mu.Unlock()
+		pool.setTargets(lb.targetsFor(route))
+	}
+}
+
+func (lb *loadBalancer) pool(routeID string) *upstreamPool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.pools[routeID]
+}
+
+// pickUpstream chooses the endpoint for a request on route, first resolving
+// the route's discovered instances if they are missing or stale
+func (s *APIGatewayService) pickUpstream(ctx context.Context, route *APIRoute) (*upstreamPool, *upstream) {
+	pool := s.balancer.pool(route.ID)
+	if pool == nil {
+		// Route added since the last sync
+		s.balancer.sync(s.activeRoutes())
+		if pool = s.balancer.pool(route.ID); pool == nil {
+			return nil, nil
+		}
+	}
+	if name := route.discoveryName(); name != "" && s.config.DiscoveryServiceURL != "" {
+		s.resolveDiscovered(ctx, name, s.config.DiscoveryCacheTTL)
+	}
+	return pool, pool.pick()
+}
+
+func (s *APIGatewayService) activeRoutes() []*APIRoute {
+	s.routesMutex.RLock()
+	defer s.routesMutex.RUnlock()
+
+	routes := make([]*APIRoute, 0, len(s.routes))
+	for _, route := range s.routes {
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// List a route's configured upstreams and their live state
+func (s *APIGatewayService) getRouteUpstreams(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("Upstreams").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	response := gin.H{
+		"route_id":          route.ID,
+		"load_balancing":    route.LoadBalancing,
+		"discovery_service": route.DiscoveryService,
+		"upstreams":         route.Upstreams,
+	}
+	if name := route.discoveryName(); name != "" {
+		response["discovery"] = s.balancer.discoveryStatus(name)
+	}
+	if pool := s.balancer.pool(route.ID); pool != nil {
+		response["pool"] = pool.status()
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Replace a route's upstreams
+func (s *APIGatewayService) setRouteUpstreams(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	var req struct {
+		LoadBalancing    *string `json:"load_balancing"`
+		DiscoveryService *string `json:"discovery_service"`
+		Upstreams        []struct {
+			URL      string `json:"url" binding:"required"`
+			Weight   int    `json:"weight"`
+			Priority int    `json:"priority"`
+			IsActive *bool  `json:"is_active"`
+		} `json:"upstreams"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.LoadBalancing != nil {
+		switch *req.LoadBalancing {
+		case LoadBalancingRoundRobin, LoadBalancingWeighted, LoadBalancingLeastConnections:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "load_balancing must be round_robin, weighted or least_connections"})
+			return
+		}
+	}
+
+	now := time.Now()
+	upstreams := make([]RouteUpstream, 0, len(req.Upstreams))
+	for _, u := range req.Upstreams {
+		target, err := url.Parse(u.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upstream URL: " + u.URL})
+			return
+		}
+		if u.Weight < 0 || u.Priority < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "weight and priority must not be negative"})
+			return
+		}
+		weight := u.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		active := true
+		if u.IsActive != nil {
+			active = *u.IsActive
+		}
+		upstreams = append(upstreams, RouteUpstream{
+			ID:        uuid.New().String(),
+			RouteID:   route.ID,
+			URL:       u.URL,
+			Weight:    weight,
+			Priority:  u.Priority,
+			IsActive:  active,
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+	}
+
+	updates := map[string]interface{}{"updated_at": now}
+	if req.LoadBalancing != nil {
+		updates["load_balancing"] = *req.LoadBalancing
+	}
+	if req.DiscoveryService != nil {
+		updates["discovery_service"] = *req.DiscoveryService
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Where("route_id = ?", route.ID).Delete(&RouteUpstream{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update upstreams"})
+		return
+	}
+	if len(upstreams) > 0 {
+		if err := tx.Create(&upstreams).Error; err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update upstreams"})
+			return
+		}
+	}
+	if err := tx.Model(&route).Updates(updates).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update route"})
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update upstreams"})
+		return
+	}
+
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+	if req.DiscoveryService != nil && *req.DiscoveryService != "" && s.config.DiscoveryServiceURL != "" {
+		go s.refreshDiscoveredUpstreams()
+	}
+
+	s.db.Preload("Upstreams").First(&route, "id = ?", route.ID)
+	c.JSON(http.StatusOK, route)
+}
+
+func upstreamResult(ok bool) string {
+	if ok {
+		return "success"
+	}
+	return "failure"
+}
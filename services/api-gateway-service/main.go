@@ -9,11 +9,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
@@ -31,7 +31,9 @@ import (
 	"gorm.io/gorm/logger"
 	"github.com/go-redis/redis/v8"
 	"github.com/golang-jwt/jwt/v4"
-	"golang.org/x/time/rate"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc/codes"
 	"github.com/gorilla/websocket"
 )
 
@@ -45,30 +47,89 @@ type Config struct {
 	DefaultRateLimit int
 	MaxRequestSize   int64
 	RequestTimeout   time.Duration
-}
-
-// Rate limiting
-type RateLimiter struct {
-	limiters map[string]*rate.Limiter
-	mu       sync.RWMutex
-	rate     rate.Limit
-	burst    int
+	DiscoveryServiceURL       string
+	UpstreamRefreshInterval   time.Duration
+	DiscoveryCacheTTL         time.Duration
+	UpstreamEjectionThreshold int
+	UpstreamEjectionDuration  time.Duration
+	CircuitBreakerEnabled     bool
+	HealthCheckInterval       time.Duration
+	HealthCheckTimeout        time.Duration
+	HealthCheckUnhealthyAfter int
+	HealthCheckHealthyAfter   int
+	GRPCEnabled               bool
+	AuthFailureChannel        string
+	OIDCIssuers               []string
+	OIDCAudiences             []string
+	JWKSRefreshInterval       time.Duration
+	HMACJWTEnabled            bool
+	LoggingServiceURL         string
+	AccessLogBatchSize        int
+	AccessLogBufferSize       int
+	AccessLogFlushInterval    time.Duration
+	UsageFlushInterval        time.Duration
+	MaintenanceRefreshInterval time.Duration
+	TLSCertFile               string
+	TLSKeyFile                string
+	CertReloadInterval        time.Duration
+	RouteChangeChannel        string
+	RouteReloadInterval       time.Duration
+	OTLPEndpoint              string
+	TracingServiceName        string
+	TraceSampleRatio          float64
+	TrustedProxies            []string
+	GeoIPDatabasePath         string
+	GeoIPReloadInterval       time.Duration
 }
 
 // Models
 type APIRoute struct {
 	ID              string                 `json:"id" gorm:"primaryKey"`
-	Path            string                 `json:"path" gorm:"uniqueIndex;not null"`
-	Method          string                 `json:"method" gorm:"not null"`
+	Path            string                 `json:"path" gorm:"uniqueIndex:idx_api_routes_method_path;not null"`
+	Method          string                 `json:"method" gorm:"uniqueIndex:idx_api_routes_method_path;not null"`
 	ServiceName     string                 `json:"service_name" gorm:"not null"`
-	ServiceURL      string                 `json:"service_url" gorm:"not null"`
+	ServiceURL      string                 `json:"service_url"` // empty: resolve ServiceName via discovery-service
 	IsActive        bool                   `json:"is_active" gorm:"default:true"`
 	RequireAuth     bool                   `json:"require_auth" gorm:"default:true"`
+	RequiredScopes  []string               `json:"required_scopes" gorm:"type:text[]"` // all must be granted to the caller
+	AllowedIssuers  []string               `json:"allowed_issuers" gorm:"type:text[]"` // empty: any trusted issuer
 	RateLimit       int                    `json:"rate_limit" gorm:"default:1000"`
-	Timeout         int                    `json:"timeout" gorm:"default:30"`
+	RateLimitWindow int                    `json:"rate_limit_window" gorm:"default:1"` // seconds
+	RateLimitBurst  int                    `json:"rate_limit_burst"`                   // 0: same as RateLimit
+	RateLimitAlgorithm string              `json:"rate_limit_algorithm" gorm:"default:token_bucket"` // token_bucket or sliding_window
+	WebSocket       bool                   `json:"websocket"`                                  // proxy WebSocket upgrades
+	WebSocketIdleTimeout    int            `json:"websocket_idle_timeout" gorm:"default:300"` // seconds without messages either way
+	WebSocketMaxConnections int            `json:"websocket_max_connections"`                 // per replica; 0: unlimited
+	WebSocketMessageRate    int            `json:"websocket_message_rate"`                    // client messages per second per connection; 0: unlimited
+	Timeout         int                    `json:"timeout" gorm:"default:30"` // seconds; of inactivity when StreamBodies
+	MaxBodySize     int64                  `json:"max_body_size"`             // bytes; 0: MAX_REQUEST_SIZE
+	StreamBodies    bool                   `json:"stream_bodies"`             // long unbuffered transfers, e.g. large uploads
 	RetryCount      int                    `json:"retry_count" gorm:"default:3"`
+	RetryBaseDelay  int                    `json:"retry_base_delay_ms" gorm:"default:100"`
+	RetryMaxDelay   int                    `json:"retry_max_delay_ms" gorm:"default:2000"`
+	RetryPerTryTimeout int                 `json:"retry_per_try_timeout_ms"` // 0: only the route timeout applies
+	RetryRespectRetryAfter bool            `json:"retry_respect_retry_after"`
+	Idempotent      bool                   `json:"idempotent"` // retry any method, not just GET/HEAD/PUT/DELETE
+	MaxConcurrentRequests int              `json:"max_concurrent_requests"` // 0: no bulkhead
+	BulkheadQueueSize     int              `json:"bulkhead_queue_size"`
+	BulkheadQueueTimeout  int              `json:"bulkhead_queue_timeout_ms" gorm:"default:100"`
+	BulkheadScope         string           `json:"bulkhead_scope" gorm:"default:route"` // route or service
+	Protocol        string                 `json:"protocol" gorm:"default:http"` // http, grpc or grpc-json
+	GRPCMethod      string                 `json:"grpc_method"`                // package.Service/Method, for grpc-json
+	GRPCDescriptorSetID string             `json:"grpc_descriptor_set_id" gorm:"index"`
 	LoadBalancing   string                 `json:"load_balancing" gorm:"default:round_robin"`
 	HealthCheckURL  string                 `json:"health_check_url"`
+	DiscoveryService string                `json:"discovery_service"` // resolve upstreams from discovery-service
+	Upstreams       []RouteUpstream        `json:"upstreams,omitempty" gorm:"foreignKey:RouteID"`
+	CircuitBreaker  *RouteCircuitBreaker   `json:"circuit_breaker,omitempty" gorm:"foreignKey:RouteID"`
+	Transformation  *RouteTransformation   `json:"transformation,omitempty" gorm:"foreignKey:RouteID"`
+	CachePolicy     *RouteCachePolicy      `json:"cache_policy,omitempty" gorm:"foreignKey:RouteID"`
+	TrafficSplit    *RouteTrafficSplit     `json:"traffic_split,omitempty" gorm:"foreignKey:RouteID"`
+	Versions        []RouteVersion         `json:"versions,omitempty" gorm:"foreignKey:RouteID"`
+	MTLS            *RouteMTLS             `json:"mtls,omitempty" gorm:"foreignKey:RouteID"`
+	AccessPolicy    *RouteAccessPolicy     `json:"access_policy,omitempty" gorm:"foreignKey:RouteID"`
+	GraphQL         *RouteGraphQL          `json:"graphql,omitempty" gorm:"foreignKey:RouteID"`
+	Compression     *RouteCompression      `json:"compression,omitempty" gorm:"foreignKey:RouteID"`
 	Metadata        map[string]interface{} `json:"metadata" gorm:"type:jsonb"`
 	CreatedAt       time.Time              `json:"created_at"`
 	UpdatedAt       time.Time              `json:"updated_at"`
@@ -76,7 +137,9 @@ type APIRoute struct {
 
 type APIKey struct {
 	ID          string    `json:"id" gorm:"primaryKey"`
-	Key         string    `json:"key" gorm:"uniqueIndex;not null"`
+	Key         string    `json:"key,omitempty" gorm:"-"` // only in the response that creates the key
+	KeyHash     string    `json:"-" gorm:"uniqueIndex"`
+	KeyPrefix   string    `json:"key_prefix" gorm:"index"`
 	Name        string    `json:"name" gorm:"not null"`
 	UserID      string    `json:"user_id" gorm:"index"`
 	Scopes      []string  `json:"scopes" gorm:"type:text[]"`
@@ -84,6 +147,9 @@ type APIKey struct {
 	IsActive    bool      `json:"is_active" gorm:"default:true"`
 	ExpiresAt   *time.Time `json:"expires_at"`
 	LastUsedAt  *time.Time `json:"last_used_at"`
+	RotatedFromID string   `json:"rotated_from_id,omitempty" gorm:"index"`
+	SuccessorID string     `json:"successor_id,omitempty"`
+	RotatedAt   *time.Time `json:"rotated_at,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
@@ -114,10 +180,29 @@ type APIGatewayService struct {
 	config       *Config
 	router       *gin.Engine
 	httpServer   *http.Server
-	rateLimiter  *RateLimiter
+	rateLimitOverrides *rateLimitOverrides
+	quotas       *quotaRegistry
+	maintenance  *maintenanceRegistry
 	routes       map[string]*APIRoute
 	routesMutex  sync.RWMutex
 	upgrader     websocket.Upgrader
+	balancer     *loadBalancer
+	breakers     *breakerRegistry
+	bulkheads    *bulkheadRegistry
+	transforms   *transformRegistry
+	grpc         *grpcRegistry
+	caches       *cacheRegistry
+	versions     *versionRegistry
+	webSockets   *wsRegistry
+	oidc         *oidcRegistry
+	mtls         *mtlsRegistry
+	access       *accessRegistry
+	graphql      *graphqlRegistry
+	compression  *compressionRegistry
+	routeSync    *routeSync
+	accessLogs   *accessLogShipper
+	shutdownTracing func(context.Context) error
+	httpClient   *http.Client
 }
 
 // Prometheus metrics
@@ -179,7 +264,40 @@ func main() {
 		DefaultRateLimit: parseInt(getEnv("DEFAULT_RATE_LIMIT", "1000")),
 		MaxRequestSize:   parseInt64(getEnv("MAX_REQUEST_SIZE", "10485760")), // 10MB
 		RequestTimeout:   time.Duration(parseInt(getEnv("REQUEST_TIMEOUT", "30"))) * time.Second,
+		DiscoveryServiceURL:       getEnv("DISCOVERY_SERVICE_URL", ""),
+		UpstreamRefreshInterval:   time.Duration(parseInt(getEnv("UPSTREAM_REFRESH_INTERVAL", "15"))) * time.Second,
+		DiscoveryCacheTTL:         time.Duration(parseInt(getEnv("DISCOVERY_CACHE_TTL", "30"))) * time.Second,
+		UpstreamEjectionThreshold: parseInt(getEnv("UPSTREAM_EJECTION_THRESHOLD", "5")),
+		UpstreamEjectionDuration:  time.Duration(parseInt(getEnv("UPSTREAM_EJECTION_DURATION", "30"))) * time.Second,
+		CircuitBreakerEnabled:     getEnv("CIRCUIT_BREAKER_ENABLED", "true") == "true",
+		HealthCheckInterval:       time.Duration(parseInt(getEnv("HEALTH_CHECK_INTERVAL", "10"))) * time.Second,
+		HealthCheckTimeout:        time.Duration(parseInt(getEnv("HEALTH_CHECK_TIMEOUT", "3"))) * time.Second,
+		HealthCheckUnhealthyAfter: parseInt(getEnv("HEALTH_CHECK_UNHEALTHY_THRESHOLD", "3")),
+		HealthCheckHealthyAfter:   parseInt(getEnv("HEALTH_CHECK_HEALTHY_THRESHOLD", "2")),
+		GRPCEnabled:               getEnv("GRPC_ENABLED", "true") == "true",
+		AuthFailureChannel:        getEnv("AUTH_FAILURE_CHANNEL", "gateway:auth_failures"),
+		OIDCIssuers:               splitList(getEnv("OIDC_ISSUERS", "")),
+		OIDCAudiences:             splitList(getEnv("OIDC_AUDIENCES", "")),
+		JWKSRefreshInterval:       time.Duration(parseInt(getEnv("OIDC_JWKS_REFRESH_INTERVAL", "3600"))) * time.Second,
+		LoggingServiceURL:         getEnv("LOGGING_SERVICE_URL", ""),
+		AccessLogBatchSize:        parseInt(getEnv("ACCESS_LOG_BATCH_SIZE", "200")),
+		AccessLogBufferSize:       parseInt(getEnv("ACCESS_LOG_BUFFER_SIZE", "10000")),
+		AccessLogFlushInterval:    time.Duration(parseInt(getEnv("ACCESS_LOG_FLUSH_INTERVAL", "1000"))) * time.Millisecond,
+		UsageFlushInterval:        time.Duration(parseInt(getEnv("USAGE_FLUSH_INTERVAL", "60"))) * time.Second,
+		MaintenanceRefreshInterval: time.Duration(parseInt(getEnv("MAINTENANCE_REFRESH_INTERVAL", "15"))) * time.Second,
+		TLSCertFile:               getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:                getEnv("TLS_KEY_FILE", ""),
+		CertReloadInterval:        time.Duration(parseInt(getEnv("CERT_RELOAD_INTERVAL", "30"))) * time.Second,
+		RouteChangeChannel:        getEnv("ROUTE_CHANGE_CHANNEL", "gateway:route_changes"),
+		RouteReloadInterval:       time.Duration(parseInt(getEnv("ROUTE_RELOAD_INTERVAL", "60"))) * time.Second,
+		OTLPEndpoint:              getEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "")),
+		TracingServiceName:        getEnv("OTEL_SERVICE_NAME", "api-gateway-service"),
+		TraceSampleRatio:          parseFloat(getEnv("TRACE_SAMPLE_RATIO", "1")),
+		TrustedProxies:            splitList(getEnv("TRUSTED_PROXIES", "")),
+		GeoIPDatabasePath:         getEnv("GEOIP_DATABASE_PATH", ""),
+		GeoIPReloadInterval:       time.Duration(parseInt(getEnv("GEOIP_RELOAD_INTERVAL", "3600"))) * time.Second,
 	}
+	config.HMACJWTEnabled = getEnv("JWT_HMAC_ENABLED", strconv.FormatBool(len(config.OIDCIssuers) == 0)) == "true"
 
 	service, err := NewAPIGatewayService(config)
 	if err != nil {
@@ -201,7 +319,17 @@ func NewAPIGatewayService(config *Config) (*APIGatewayService, error) {
 	}
 
 	// Auto-migrate tables
-	if err := db.AutoMigrate(&APIRoute{}, &APIKey{}, &RequestLog{}); err != nil {
+	if err := db.AutoMigrate(&APIRoute{}, &RouteUpstream{}, &RouteCircuitBreaker{}, &RouteFailoverEvent{}, &RouteTransformation{}, &RouteCachePolicy{}, &RouteTrafficSplit{}, &RouteVersion{}, &RouteMTLS{}, &RouteAccessPolicy{}, &RouteGraphQL{}, &PersistedQuery{}, &RouteCompression{}, &GRPCDescriptorSet{}, &RateLimitOverride{}, &UsageQuota{}, &UsageRecord{}, &MaintenanceWindow{}, &APIKey{}, &RequestLog{}); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	// Routes used to be unique by path alone, which kept one path from
+	// having a route per method
+	if db.Migrator().HasIndex(&APIRoute{}, "idx_api_routes_path") {
+		if err := db.Migrator().DropIndex(&APIRoute{}, "idx_api_routes_path"); err != nil {
+			return nil, fmt.Errorf("failed to migrate database: %w", err)
+		}
+	}
+	if err := migrateAPIKeyHashes(db); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
@@ -219,11 +347,10 @@ func NewAPIGatewayService(config *Config) (*APIGatewayService, error) {
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	// Initialize rate limiter
-	rateLimiter := &RateLimiter{
-		limiters: make(map[string]*rate.Limiter),
-		rate:     rate.Limit(config.DefaultRateLimit),
-		burst:    config.DefaultRateLimit,
+	// Initialize tracing
+	shutdownTracing, err := initTracing(config)
+	if err != nil {
+		return nil, err
 	}
 
 	// Initialize WebSocket upgrader
@@ -237,10 +364,29 @@ func NewAPIGatewayService(config *Config) (*APIGatewayService, error) {
 		db:          db,
 		redis:       redisClient,
 		config:      config,
-		rateLimiter: rateLimiter,
+		rateLimitOverrides: newRateLimitOverrides(),
+		quotas:      newQuotaRegistry(),
+		maintenance: newMaintenanceRegistry(),
 		routes:      make(map[string]*APIRoute),
 		upgrader:    upgrader,
+		breakers:    newBreakerRegistry(),
+		bulkheads:   newBulkheadRegistry(),
+		transforms:  newTransformRegistry(),
+		grpc:        newGRPCRegistry(),
+		caches:      newCacheRegistry(),
+		versions:    newVersionRegistry(),
+		webSockets:  newWSRegistry(),
+		oidc:        newOIDCRegistry(config.OIDCIssuers, config.OIDCAudiences),
+		mtls:        newMTLSRegistry(config),
+		access:      newAccessRegistry(config),
+		graphql:     newGraphQLRegistry(),
+		compression: newCompressionRegistry(),
+		routeSync:   newRouteSync(),
+		accessLogs:  newAccessLogShipper(config),
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		shutdownTracing: shutdownTracing,
 	}
+	service.balancer = newLoadBalancer(service.recordFailover)
 
 	service.setupRoutes()
 	return service, nil
@@ -251,12 +397,21 @@ func (s *APIGatewayService) setupRoutes() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	s.router = gin.Default()
+	s.router = gin.New()
+
+	// X-Forwarded-For is believed only from these; access lists and rate
+	// limits key on the client address
+	if len(s.config.TrustedProxies) > 0 {
+		if err := s.router.SetTrustedProxies(s.config.TrustedProxies); err != nil {
+			log.Printf("Invalid TRUSTED_PROXIES: %v", err)
+		}
+	}
 
 	// Middleware
 	s.router.Use(gin.Recovery())
 	s.router.Use(corsMiddleware())
-	s.router.Use(requestLoggingMiddleware())
+	s.router.Use(s.tracingMiddleware())
+	s.router.Use(s.accessLogMiddleware())
 	s.router.Use(s.rateLimitMiddleware())
 
 	// Set max request size
@@ -269,6 +424,7 @@ func (s *APIGatewayService) setupRoutes() {
 	// Admin API routes
 	admin := s.router.Group("/admin/v1")
 	admin.Use(s.adminAuthMiddleware())
+	admin.Use(s.publishRouteChanges())
 	{
 		// Route management
 		admin.POST("/routes", s.createRoute)
@@ -276,6 +432,72 @@ func (s *APIGatewayService) setupRoutes() {
 		admin.GET("/routes/:id", s.getRoute)
 		admin.PUT("/routes/:id", s.updateRoute)
 		admin.DELETE("/routes/:id", s.deleteRoute)
+		admin.POST("/routes/import", s.importOpenAPIRoutes)
+		admin.GET("/routes/export", s.exportOpenAPIRoutes)
+		admin.GET("/routes/:id/upstreams", s.getRouteUpstreams)
+		admin.PUT("/routes/:id/upstreams", s.setRouteUpstreams)
+		admin.GET("/routes/:id/circuit-breaker", s.getRouteCircuitBreaker)
+		admin.PUT("/routes/:id/circuit-breaker", s.updateRouteCircuitBreaker)
+		admin.POST("/routes/:id/circuit-breaker/reset", s.resetRouteCircuitBreaker)
+		admin.GET("/circuit-breakers", s.listCircuitBreakers)
+		admin.GET("/bulkheads", s.listBulkheads)
+		admin.GET("/routes/:id/transformation", s.getRouteTransformation)
+		admin.PUT("/routes/:id/transformation", s.updateRouteTransformation)
+		admin.DELETE("/routes/:id/transformation", s.deleteRouteTransformation)
+		admin.GET("/routes/:id/failovers", s.listRouteFailovers)
+		admin.PUT("/routes/:id/protocol", s.updateRouteProtocol)
+		admin.GET("/routes/:id/cache", s.getRouteCachePolicy)
+		admin.PUT("/routes/:id/cache", s.updateRouteCachePolicy)
+		admin.DELETE("/routes/:id/cache", s.deleteRouteCachePolicy)
+		admin.POST("/cache/purge", s.purgeResponseCache)
+		admin.GET("/routes/:id/versions", s.getRouteVersions)
+		admin.PUT("/routes/:id/versions", s.setRouteVersions)
+		admin.DELETE("/routes/:id/versions", s.deleteRouteVersions)
+		admin.PUT("/routes/:id/versions/weights", s.shiftRouteVersionWeights)
+		admin.POST("/routes/:id/versions/rollback", s.rollbackRouteVersions)
+		admin.GET("/routes/:id/mtls", s.getRouteMTLS)
+		admin.PUT("/routes/:id/mtls", s.updateRouteMTLS)
+		admin.DELETE("/routes/:id/mtls", s.deleteRouteMTLS)
+		admin.GET("/routes/:id/access", s.getRouteAccessPolicy)
+		admin.PUT("/routes/:id/access", s.updateRouteAccessPolicy)
+		admin.DELETE("/routes/:id/access", s.deleteRouteAccessPolicy)
+		admin.GET("/routes/:id/graphql", s.getRouteGraphQL)
+		admin.PUT("/routes/:id/graphql", s.updateRouteGraphQL)
+		admin.DELETE("/routes/:id/graphql", s.deleteRouteGraphQL)
+		admin.POST("/routes/:id/graphql/analyze", s.analyzeGraphQLQuery)
+		admin.GET("/routes/:id/compression", s.getRouteCompression)
+		admin.PUT("/routes/:id/compression", s.updateRouteCompression)
+		admin.DELETE("/routes/:id/compression", s.deleteRouteCompression)
+		admin.GET("/routes/:id/graphql/persisted-queries", s.listPersistedQueries)
+		admin.POST("/routes/:id/graphql/persisted-queries", s.addPersistedQueries)
+		admin.DELETE("/routes/:id/graphql/persisted-queries/:hash", s.deletePersistedQuery)
+		admin.GET("/geoip/lookup", s.lookupGeoIP)
+		admin.GET("/tls", s.getTLSStatus)
+		admin.POST("/tls/reload", s.reloadTLSCertificates)
+
+		// Rate limit overrides
+		admin.GET("/rate-limits/overrides", s.listRateLimitOverrides)
+		admin.POST("/rate-limits/overrides", s.setRateLimitOverride)
+		admin.DELETE("/rate-limits/overrides/:id", s.deleteRateLimitOverride)
+
+		// Usage quotas and billing
+		admin.GET("/quotas", s.listQuotas)
+		admin.PUT("/quotas", s.setQuota)
+		admin.DELETE("/quotas/:id", s.deleteQuota)
+		admin.GET("/usage", s.getUsageReport)
+		admin.GET("/usage/:subject", s.getSubjectUsage)
+
+		// Maintenance windows
+		admin.GET("/maintenance", s.listMaintenanceWindows)
+		admin.POST("/maintenance", s.createMaintenanceWindow)
+		admin.PUT("/maintenance/:id", s.updateMaintenanceWindow)
+		admin.DELETE("/maintenance/:id", s.deleteMaintenanceWindow)
+
+		// gRPC descriptor sets
+		admin.POST("/grpc/descriptors", s.uploadDescriptorSet)
+		admin.GET("/grpc/descriptors", s.listDescriptorSets)
+		admin.GET("/grpc/descriptors/:id", s.getDescriptorSet)
+		admin.DELETE("/grpc/descriptors/:id", s.deleteDescriptorSet)
 
 		// API Key management
 		admin.POST("/api-keys", s.createAPIKey)
@@ -283,11 +505,18 @@ func (s *APIGatewayService) setupRoutes() {
 		admin.GET("/api-keys/:id", s.getAPIKey)
 		admin.PUT("/api-keys/:id", s.updateAPIKey)
 		admin.DELETE("/api-keys/:id", s.deleteAPIKey)
+		admin.POST("/api-keys/:id/rotate", s.rotateAPIKey)
+		admin.POST("/api-keys/verify", s.verifyAPIKey)
+
+		// OIDC issuers
+		admin.GET("/oidc/providers", s.listOIDCProviders)
+		admin.POST("/oidc/providers/refresh", s.refreshOIDCProviders)
 
 		// Analytics
 		admin.GET("/analytics/requests", s.getRequestAnalytics)
 		admin.GET("/analytics/performance", s.getPerformanceAnalytics)
 		admin.GET("/analytics/errors", s.getErrorAnalytics)
+		admin.GET("/request-logs/:request_id", s.getRequestLogsByRequestID)
 	}
 
 	// WebSocket endpoint
@@ -307,15 +536,42 @@ func (s *APIGatewayService) Start() error {
 	go s.startMetricsUpdater()
 	go s.startHealthChecker()
 	go s.startLogCleaner()
+	go s.startUpstreamResolver()
+	go s.startDiscoveryWatcher()
+	go s.startGRPCConnReaper()
+	go s.startCanaryMonitor()
+	go s.startJWKSRefresher()
+	go s.startUsageFlusher()
+	go s.startMaintenanceRefresher()
+	go s.startCertReloader()
+	go s.startRouteSync()
+	go s.startGeoIPReloader()
+	if s.accessLogs != nil {
+		go s.accessLogs.run()
+	}
+
+	// gRPC clients may connect over cleartext HTTP/2
+	var handler http.Handler = s.router
+	if s.config.GRPCEnabled {
+		handler = h2c.NewHandler(s.router, &http2.Server{})
+	}
 
 	// Start HTTP server
 	s.httpServer = &http.Server{
 		Addr:         ":" + s.config.Port,
-		Handler:      s.router,
+		Handler:      handler,
 		ReadTimeout:  s.config.RequestTimeout,
 		WriteTimeout: s.config.RequestTimeout,
 	}
 
+	if s.mtls.server != nil {
+		tlsConfig, err := s.serverTLSConfig()
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		s.httpServer.TLSConfig = tlsConfig
+	}
+
 	// Graceful shutdown
 	go func() {
 		sigChan := make(chan os.Signal, 1)
@@ -326,6 +582,8 @@ func (s *APIGatewayService) Start() error {
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
+		// Hijacked connections are not closed by Shutdown
+		s.closeWebSockets()
 		if err := s.httpServer.Shutdown(ctx); err != nil {
 			log.Printf("Server shutdown error: %v", err)
 		}
@@ -338,7 +596,13 @@ func (s *APIGatewayService) Start() error {
 	log.Printf("📈 Metrics: http://localhost:%s/metrics", s.config.Port)
 	log.Printf("🔧 Admin API: http://localhost:%s/admin/v1", s.config.Port)
 
-	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	var err error
+	if s.httpServer.TLSConfig != nil {
+		err = s.httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = s.httpServer.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("failed to start HTTP server: %w", err)
 	}
 
@@ -346,6 +610,12 @@ func (s *APIGatewayService) Start() error {
 }
 
 func (s *APIGatewayService) cleanup() {
+	s.accessLogs.close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.shutdownTracing(ctx); err != nil {
+		log.Printf("Failed to flush traces: %v", err)
+	}
 	if s.redis != nil {
 		s.redis.Close()
 	}
@@ -409,6 +679,26 @@ func (s *APIGatewayService) proxyHandler(c *gin.Context) {
 		return
 	}
 
+	accessLogFor(c).setRoute(route)
+
+	// Client IP and country access lists
+	if !s.checkAccess(c, route) {
+		s.logRequest(c, requestID, route.ServiceName, http.StatusForbidden, time.Since(startTime), "Client address not allowed")
+		return
+	}
+
+	// Maintenance windows
+	if !s.checkMaintenance(c, route) {
+		s.logRequest(c, requestID, route.ServiceName, http.StatusServiceUnavailable, time.Since(startTime), "Under maintenance")
+		return
+	}
+
+	// Client certificates
+	if !s.verifyClientCert(c, route) {
+		s.logRequest(c, requestID, route.ServiceName, c.Writer.Status(), time.Since(startTime), "Client certificate rejected")
+		return
+	}
+
 	// Check if route is active
 	if !route.IsActive {
 		s.logRequest(c, requestID, route.ServiceName, http.StatusServiceUnavailable, time.Since(startTime), "Route inactive")
@@ -416,12 +706,54 @@ func (s *APIGatewayService) proxyHandler(c *gin.Context) {
 		return
 	}
 
-	// Authentication check
-	if route.RequireAuth {
-		if !s.authenticateRequest(c) {
+	// gRPC routes only take gRPC calls
+	if route.Protocol == ProtocolGRPC && !isGRPCRequest(c.Request) {
+		s.logRequest(c, requestID, route.ServiceName, http.StatusUnsupportedMediaType, time.Since(startTime), "Not a gRPC request")
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "gRPC route requires an application/grpc request over HTTP/2"})
+		return
+	}
+
+	// WebSocket upgrades only go to routes that proxy them
+	webSocket := isWebSocketRequest(c.Request)
+	if webSocket {
+		if !route.WebSocket {
+			s.logRequest(c, requestID, route.ServiceName, http.StatusBadRequest, time.Since(startTime), "WebSocket not enabled on route")
+			c.JSON(http.StatusBadRequest, gin.H{"error": "WebSocket is not enabled on this route"})
+			return
+		}
+		webSocketCredentials(c.Request)
+	}
+
+	// Authentication check; requiring scopes implies authentication
+	if route.RequireAuth || len(route.RequiredScopes) > 0 {
+		authStart := time.Now()
+		authenticated := s.authenticateRequest(c)
+		accessLogFor(c).AuthTime = time.Since(authStart)
+		if !authenticated {
+			s.publishAuthFailure(c)
 			s.logRequest(c, requestID, route.ServiceName, http.StatusUnauthorized, time.Since(startTime), "Authentication failed")
 			return
 		}
+		if !s.authorizeIssuer(c, route) {
+			s.logRequest(c, requestID, route.ServiceName, http.StatusForbidden, time.Since(startTime), "Token issuer not allowed")
+			return
+		}
+		if !s.authorizeScopes(c, route) {
+			s.logRequest(c, requestID, route.ServiceName, http.StatusForbidden, time.Since(startTime), "Insufficient scope")
+			return
+		}
+	}
+
+	// Compressed request bodies, inflated before the size limit applies
+	if !s.decompressRequestBody(c, route) {
+		s.logRequest(c, requestID, route.ServiceName, c.Writer.Status(), time.Since(startTime), "Undecodable request body")
+		return
+	}
+
+	// Body size limit
+	if !s.limitRequestBody(c, route) {
+		s.logRequest(c, requestID, route.ServiceName, http.StatusRequestEntityTooLarge, time.Since(startTime), "Request body too large")
+		return
 	}
 
 	// Rate limiting
@@ -430,7 +762,25 @@ func (s *APIGatewayService) proxyHandler(c *gin.Context) {
 		return
 	}
 
+	// GraphQL operation limits
+	if !webSocket && !s.checkGraphQL(c, route) {
+		s.logRequest(c, requestID, route.ServiceName, c.Writer.Status(), time.Since(startTime), "GraphQL operation refused")
+		return
+	}
+
+	// Monthly quotas
+	recordUsage, ok := s.checkQuota(c)
+	if !ok {
+		s.logRequest(c, requestID, route.ServiceName, http.StatusTooManyRequests, time.Since(startTime), "Quota exceeded")
+		return
+	}
+	defer recordUsage()
+
 	// Proxy the request
+	if webSocket {
+		s.proxyWebSocket(c, route, requestID, startTime)
+		return
+	}
 	s.proxyRequest(c, route, requestID, startTime)
 }
 
@@ -458,6 +808,49 @@ func (s *APIGatewayService) findRoute(method, path string) *APIRoute {
 	return nil
 }
 
+// Load all routes and their upstreams into the routing table
+func (s *APIGatewayService) loadRoutes() error {
+	var routes []APIRoute
+	if err := s.db.Preload("Upstreams").Preload("CircuitBreaker").Preload("Transformation").Preload("CachePolicy").Preload("TrafficSplit").Preload("Versions").Preload("MTLS").Preload("AccessPolicy").Preload("GraphQL").Preload("Compression").Find(&routes).Error; err != nil {
+		return err
+	}
+
+	table := make(map[string]*APIRoute, len(routes))
+	list := make([]*APIRoute, 0, len(routes))
+	for i := range routes {
+		route := &routes[i]
+		table[route.Method+":"+route.Path] = route
+		list = append(list, route)
+	}
+
+	s.routesMutex.Lock()
+	s.routes = table
+	s.routesMutex.Unlock()
+
+	routesTotal.Set(float64(len(routes)))
+	s.balancer.sync(list)
+	s.syncBreakers(list)
+	s.syncBulkheads(list)
+	s.syncTransforms(list)
+	s.syncGRPC(list)
+	s.syncCaches(list)
+	s.syncVersions(list)
+	s.syncMTLS(list)
+	s.syncAccessPolicies(list)
+	s.syncGraphQL(list)
+	s.syncCompression(list)
+	if err := s.loadRateLimitOverrides(); err != nil {
+		log.Printf("Failed to load rate limit overrides: %v", err)
+	}
+	if err := s.loadQuotas(); err != nil {
+		log.Printf("Failed to load quotas: %v", err)
+	}
+	if err := s.loadMaintenance(); err != nil {
+		log.Printf("Failed to load maintenance windows: %v", err)
+	}
+	return nil
+}
+
 // Simple path matching (can be enhanced with more sophisticated patterns)
 func (s *APIGatewayService) matchPath(pattern, path string) bool {
 	// Handle wildcard patterns
@@ -492,6 +885,9 @@ func (s *APIGatewayService) authenticateRequest(c *gin.Context) bool {
 	// Check for API key
 	apiKey := c.GetHeader("X-API-Key")
 	if apiKey != "" {
+		if id := s.honeytokenID(c.Request.Context(), apiKey); id != "" {
+			return rejectHoneytoken(c, id, "Invalid API key")
+		}
 		return s.validateAPIKey(c, apiKey)
 	}
 
@@ -499,9 +895,19 @@ func (s *APIGatewayService) authenticateRequest(c *gin.Context) bool {
 	authHeader := c.GetHeader("Authorization")
 	if strings.HasPrefix(authHeader, "Bearer ") {
 		token := strings.TrimPrefix(authHeader, "Bearer ")
+		if id := s.honeytokenID(c.Request.Context(), token); id != "" {
+			return rejectHoneytoken(c, id, "Invalid token")
+		}
 		return s.validateJWT(c, token)
 	}
 
+	// Decoy database logins may be tried as basic auth
+	if _, password, ok := c.Request.BasicAuth(); ok {
+		if id := s.honeytokenID(c.Request.Context(), password); id != "" {
+			return rejectHoneytoken(c, id, "Authentication required")
+		}
+	}
+
 	c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
 	return false
 }
@@ -509,7 +915,7 @@ func (s *APIGatewayService) authenticateRequest(c *gin.Context) bool {
 // Validate API key
 func (s *APIGatewayService) validateAPIKey(c *gin.Context, keyValue string) bool {
 	var apiKey APIKey
-	if err := s.db.Where("key = ? AND is_active = true", keyValue).First(&apiKey).Error; err != nil {
+	if err := s.db.Where("key_hash = ? AND is_active = true", hashAPIKey(keyValue)).First(&apiKey).Error; err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
 		return false
 	}
@@ -520,6 +926,11 @@ func (s *APIGatewayService) validateAPIKey(c *gin.Context, keyValue string) bool
 		return false
 	}
 
+	// A rotated key works until its overlap window ends
+	if apiKey.SuccessorID != "" && apiKey.ExpiresAt != nil {
+		c.Header("X-API-Key-Expires", apiKey.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+
 	// Update last used
 	go func() {
 		now := time.Now()
@@ -529,6 +940,7 @@ func (s *APIGatewayService) validateAPIKey(c *gin.Context, keyValue string) bool
 	// Set context
 	c.Set("user_id", apiKey.UserID)
 	c.Set("api_key_id", apiKey.ID)
+	c.Set("api_key_rate_limit", apiKey.RateLimit)
 	c.Set("scopes", apiKey.Scopes)
 
 	return true
@@ -536,12 +948,7 @@ func (s *APIGatewayService) validateAPIKey(c *gin.Context, keyValue string) bool
 
 // Validate JWT token
 func (s *APIGatewayService) validateJWT(c *gin.Context, tokenString string) bool {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(s.config.JWTSecret), nil
-	})
+	token, err := jwt.Parse(tokenString, s.jwtKey)
 
 	if err != nil || !token.Valid {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
@@ -549,8 +956,23 @@ func (s *APIGatewayService) validateJWT(c *gin.Context, tokenString string) bool
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		c.Set("user_id", claims["user_id"])
-		c.Set("scopes", claims["scopes"])
+		// Only OIDC issuers are trusted to name themselves; jwtKey
+		// verified the token with that issuer's key
+		issuer, _ := claims["iss"].(string)
+		if s.oidc.provider(issuer) != nil {
+			if !s.oidc.audienceAllowed(claims) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token audience"})
+				return false
+			}
+			c.Set("token_issuer", issuer)
+		}
+
+		userID, ok := claims["user_id"].(string)
+		if !ok {
+			userID, _ = claims["sub"].(string)
+		}
+		c.Set("user_id", userID)
+		c.Set("scopes", scopesFromClaims(claims))
 		return true
 	}
 
@@ -558,38 +980,6 @@ func (s *APIGatewayService) validateJWT(c *gin.Context, tokenString string) bool
 	return false
 }
 
-// Check rate limit
-func (s *APIGatewayService) checkRateLimit(c *gin.Context, route *APIRoute) bool {
-	// Get identifier for rate limiting
-	identifier := s.getRateLimitIdentifier(c)
-	
-	// Get rate limit for this route/user
-	limit := route.RateLimit
-	if apiKeyID, exists := c.Get("api_key_id"); exists {
-		var apiKey APIKey
-		if err := s.db.First(&apiKey, "id = ?", apiKeyID).Error; err == nil {
-			limit = apiKey.RateLimit
-		}
-	}
-
-	// Check rate limit
-	limiter := s.rateLimiter.getLimiter(identifier, rate.Limit(limit), limit)
-	if !limiter.Allow() {
-		rateLimitHits.WithLabelValues(
-			c.GetString("user_id"),
-			c.GetString("api_key_id"),
-		).Inc()
-		
-		c.JSON(http.StatusTooManyRequests, gin.H{
-			"error": "Rate limit exceeded",
-			"limit": limit,
-		})
-		return false
-	}
-
-	return true
-}
-
 // Get rate limit identifier
 func (s *APIGatewayService) getRateLimitIdentifier(c *gin.Context) string {
 	if userID := c.GetString("user_id"); userID != "" {
@@ -603,16 +993,95 @@ func (s *APIGatewayService) getRateLimitIdentifier(c *gin.Context) string {
 
 // Proxy request to backend service
 func (s *APIGatewayService) proxyRequest(c *gin.Context, route *APIRoute, requestID string, startTime time.Time) {
-	// Parse target URL
-	target, err := url.Parse(route.ServiceURL)
+	// Answer from the response cache when possible
+	cached, served := s.serveFromCache(c, route)
+	if served {
+		s.recordRequestMetrics(c, route, requestID, startTime)
+		return
+	}
+
+	// Fail fast while the backend's circuit is open
+	breaker := s.breakerFor(route)
+	if allowed, retryAfter := breaker.allow(); !allowed {
+		s.rejectOpenCircuit(c, route, breaker, retryAfter, requestID, startTime)
+		return
+	}
+	proxyStart := time.Now()
+	recorded := false
+	recordOutcome := func(ok, counted bool) {
+		if !recorded {
+			recorded = true
+			breaker.done(ok, counted, time.Since(proxyStart))
+		}
+	}
+	defer recordOutcome(true, false)
+
+	// Bound the requests in flight to this route's backend
+	if bulkhead := s.bulkheads.forRoute(route.ID); bulkhead != nil {
+		queueStart := time.Now()
+		release, reason := bulkhead.acquire(c.Request.Context())
+		accessLogFor(c).QueueTime = time.Since(queueStart)
+		if release == nil {
+			s.rejectBulkhead(c, route, reason, requestID, startTime)
+			return
+		}
+		defer release()
+	}
+
+	// Adapt the request for the backend
+	transform := s.transforms.get(route.ID)
+	if transform != nil && transform.request != nil {
+		if err := applyRequestTransform(c, transform.request); err != nil {
+			if isBodyTooLarge(err) {
+				s.logRequest(c, requestID, route.ServiceName, http.StatusRequestEntityTooLarge, time.Since(startTime), "Request body too large")
+				s.rejectBodyTooLarge(c.Writer, route)
+				return
+			}
+			s.logRequest(c, requestID, route.ServiceName, http.StatusBadRequest, time.Since(startTime), "Request transformation failed: "+err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+	}
+
+	// Pick an upstream endpoint
+	var pool *upstreamPool
+	var endpoint *upstream
+	if version := s.selectVersion(c, route); version != nil {
+		c.Set("route_version", version.name)
+		c.Header(routeVersionHeader, version.name)
+		pool, endpoint = version.pool, version.pool.pick()
+	} else {
+		pool, endpoint = s.pickUpstream(c.Request.Context(), route)
+	}
+	if endpoint == nil {
+		s.logRequest(c, requestID, route.ServiceName, http.StatusServiceUnavailable, time.Since(startTime), "No upstream available")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service unavailable"})
+		return
+	}
+	if route.Protocol == ProtocolGRPCJSON {
+		s.transcodeGRPC(c, route, pool, endpoint, requestID, startTime, recordOutcome)
+		s.recordRequestMetrics(c, route, requestID, startTime)
+		return
+	}
+	transport, err := s.newRetryTransport(c, route, pool, endpoint)
 	if err != nil {
-		s.logRequest(c, requestID, route.ServiceName, http.StatusInternalServerError, time.Since(startTime), "Invalid service URL")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Service configuration error"})
+		if isBodyTooLarge(err) {
+			s.logRequest(c, requestID, route.ServiceName, http.StatusRequestEntityTooLarge, time.Since(startTime), "Request body too large")
+			s.rejectBodyTooLarge(c.Writer, route)
+			return
+		}
+		s.logRequest(c, requestID, route.ServiceName, http.StatusBadRequest, time.Since(startTime), "Failed to read request body")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
 		return
 	}
 
-	// Create reverse proxy
-	proxy := httputil.NewSingleHostReverseProxy(target)
+	// Create reverse proxy; the transport picks the endpoint of each attempt
+	proxy := httputil.NewSingleHostReverseProxy(endpoint.target)
+	proxy.Transport = transport
+	if route.Protocol == ProtocolGRPC {
+		// Stream messages as they come rather than buffering
+		proxy.FlushInterval = -1
+	}
 	
 	// Customize the director to modify the request
 	originalDirector := proxy.Director
@@ -623,6 +1092,7 @@ func (s *APIGatewayService) proxyRequest(c *gin.Context, route *APIRoute, reques
 		req.Header.Set("X-Request-ID", requestID)
 		req.Header.Set("X-Forwarded-For", c.ClientIP())
 		req.Header.Set("X-Gateway-Service", "002aic-api-gateway")
+		setClientIdentityHeader(c, req.Header)
 		
 		// Add user context
 		if userID := c.GetString("user_id"); userID != "" {
@@ -630,28 +1100,92 @@ func (s *APIGatewayService) proxyRequest(c *gin.Context, route *APIRoute, reques
 		}
 	}
 
+	// Streaming routes time out on inactivity rather than overall
+	var watchdog *idleWatchdog
+	if route.StreamBodies {
+		ctx, dog, stop := s.startStreaming(c, route)
+		defer stop()
+		watchdog = dog
+		c.Request = c.Request.WithContext(ctx)
+		if c.Request.Body != nil && c.Request.Body != http.NoBody {
+			c.Request.Body = &watchedBody{ReadCloser: c.Request.Body, watchdog: watchdog}
+		}
+	}
+
 	// Handle response
+	record := accessLogFor(c)
+	var upstreamStart time.Time
 	proxy.ModifyResponse = func(resp *http.Response) error {
+		record.UpstreamTime = time.Since(upstreamStart)
+		if watchdog != nil {
+			watchdog.touch()
+			resp.Body = &watchedBody{ReadCloser: resp.Body, watchdog: watchdog}
+		}
+
 		// Add response headers
 		resp.Header.Set("X-Request-ID", requestID)
+		resp.Header.Set(gatewayRetriesHeader, strconv.Itoa(transport.retryCount()))
+
+		recordOutcome(resp.StatusCode < http.StatusInternalServerError, true)
+		if route.Protocol == ProtocolGRPC {
+			watchGRPCStatus(resp, route.ServiceName)
+			return nil
+		}
+		if transform != nil && transform.response != nil {
+			if err := applyResponseTransform(resp, transform.response); err != nil {
+				return err
+			}
+		}
+		if cached != nil {
+			s.storeCachedResponse(cached, resp)
+		}
+		s.compressResponse(c.Request, route, resp)
 		return nil
 	}
 
 	// Handle errors
 	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		record.UpstreamTime = time.Since(upstreamStart)
+		// A client hanging up says nothing about the upstream
+		if isBodyTooLarge(err) {
+			s.logRequest(c, requestID, route.ServiceName, http.StatusRequestEntityTooLarge, time.Since(startTime), "Request body too large")
+			s.rejectBodyTooLarge(w, route)
+			return
+		}
+		if watchdog != nil && watchdog.timedOut() {
+			s.logRequest(c, requestID, route.ServiceName, http.StatusGatewayTimeout, time.Since(startTime), "Body transfer idle timeout")
+			w.WriteHeader(http.StatusGatewayTimeout)
+			json.NewEncoder(w).Encode(gin.H{"error": "Body transfer idle timeout"})
+			return
+		}
+		canceled := errors.Is(err, context.Canceled)
+		recordOutcome(false, !canceled)
 		s.logRequest(c, requestID, route.ServiceName, http.StatusBadGateway, time.Since(startTime), err.Error())
+		w.Header().Set(gatewayRetriesHeader, strconv.Itoa(transport.retryCount()))
+		if route.Protocol == ProtocolGRPC {
+			grpcRequests.WithLabelValues(route.ServiceName, ProtocolGRPC, codes.Unavailable.String()).Inc()
+			writeGRPCError(w, codes.Unavailable, "upstream unavailable")
+			return
+		}
 		w.WriteHeader(http.StatusBadGateway)
 		json.NewEncoder(w).Encode(gin.H{"error": "Service unavailable"})
 	}
 
 	// Set timeout
-	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(route.Timeout)*time.Second)
-	defer cancel()
-	c.Request = c.Request.WithContext(ctx)
+	if watchdog == nil {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(route.Timeout)*time.Second)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+	}
 
 	// Proxy the request
+	upstreamStart = time.Now()
 	proxy.ServeHTTP(c.Writer, c.Request)
+	s.recordRequestMetrics(c, route, requestID, startTime)
+}
 
+// recordRequestMetrics logs a proxied request and updates the request metrics
+func (s *APIGatewayService) recordRequestMetrics(c *gin.Context, route *APIRoute, requestID string, startTime time.Time) {
 	// Log the request
 	duration := time.Since(startTime)
 	statusCode := c.Writer.Status()
@@ -659,32 +1193,24 @@ func (s *APIGatewayService) proxyRequest(c *gin.Context, route *APIRoute, reques
 	s.logRequest(c, requestID, route.ServiceName, statusCode, duration, "")
 
 	// Update metrics
+	path := s.graphqlMetricPath(c, route)
 	requestsTotal.WithLabelValues(
 		c.Request.Method,
-		c.Request.URL.Path,
+		path,
 		route.ServiceName,
 		strconv.Itoa(statusCode),
 	).Inc()
 
 	requestDuration.WithLabelValues(
 		c.Request.Method,
-		c.Request.URL.Path,
+		path,
 		route.ServiceName,
 	).Observe(duration.Seconds())
-}
+	s.recordGraphQLMetrics(c, route, duration)
 
-// Rate limiter methods
-func (rl *RateLimiter) getLimiter(key string, r rate.Limit, burst int) *rate.Limiter {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	limiter, exists := rl.limiters[key]
-	if !exists {
-		limiter = rate.NewLimiter(r, burst)
-		rl.limiters[key] = limiter
+	if version := c.GetString("route_version"); version != "" {
+		s.recordVersionOutcome(route.ID, version, statusCode)
 	}
-
-	return limiter
 }
 
 // Utility functions
@@ -702,6 +1228,13 @@ func parseInt(s string) int {
 	return 0
 }
 
+func parseFloat(s string) float64 {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return 0
+}
+
 func parseInt64(s string) int64 {
 	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
 		return i
@@ -709,6 +1242,17 @@ func parseInt64(s string) int64 {
 	return 0
 }
 
+// splitList parses a comma-separated setting, dropping empty entries
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
@@ -724,22 +1268,6 @@ func corsMiddleware() gin.HandlerFunc {
 	}
 }
 
-func requestLoggingMiddleware() gin.HandlerFunc {
-	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
-		return fmt.Sprintf("%s - [%s] \"%s %s %s %d %s \"%s\" %s\"\n",
-			param.ClientIP,
-			param.TimeStamp.Format(time.RFC1123),
-			param.Method,
-			param.Path,
-			param.Request.Proto,
-			param.StatusCode,
-			param.Latency,
-			param.Request.UserAgent(),
-			param.ErrorMessage,
-		)
-	})
-}
-
 func (s *APIGatewayService) rateLimitMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Skip rate limiting for health check and admin endpoints
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Maintenance mode. A maintenance window takes the whole gateway, one
+// service or one route out of service for a while: matching requests are
+// answered with 503 and Retry-After instead of being proxied, and nothing
+// about the routes themselves changes, so lifting the window puts them
+// straight back. A route window is the route's kill switch.
+//
+// A window starts at StartsAt, now unless scheduled, and lasts until EndsAt
+// or, without one, until it is deleted. The 503 carries the window's Body
+// when it has one, or a default payload with its Message. Retry-After is the
+// window's RetryAfter, or the time left until EndsAt, or five minutes.
+//
+// Windows are read from Postgres every MAINTENANCE_REFRESH_INTERVAL, so
+// every replica picks up a change made through any of them. Health checks,
+// metrics and the admin API are never affected.
+
+const (
+	MaintenanceScopeGateway = "gateway"
+	MaintenanceScopeService = "service"
+	MaintenanceScopeRoute   = "route"
+)
+
+const defaultMaintenanceRetryAfter = 5 * time.Minute
+
+// MaintenanceWindow answers the requests in its scope with 503 while it lasts
+type MaintenanceWindow struct {
+	ID         string          `json:"id" gorm:"primaryKey"`
+	Scope      string          `json:"scope" gorm:"not null"` // gateway, service or route
+	Target     string          `json:"target" gorm:"index"`   // service name or route ID; empty for gateway
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body,omitempty" gorm:"type:jsonb"` // replaces the default 503 payload
+	RetryAfter int             `json:"retry_after"`                      // seconds; 0: until EndsAt, or five minutes
+	StartsAt   time.Time       `json:"starts_at" gorm:"index"`
+	EndsAt     *time.Time      `json:"ends_at" gorm:"index"` // nil: until deleted
+	Reason     string          `json:"reason"`
+	CreatedBy  string          `json:"created_by"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+// activeAt reports whether the window is in effect at t
+func (w *MaintenanceWindow) activeAt(t time.Time) bool {
+	return !t.Before(w.StartsAt) && (w.EndsAt == nil || t.Before(*w.EndsAt))
+}
+
+// retryAfter is how long clients are told to wait
+func (w *MaintenanceWindow) retryAfter(now time.Time) time.Duration {
+	if w.RetryAfter > 0 {
+		return time.Duration(w.RetryAfter) * time.Second
+	}
+	if w.EndsAt != nil {
+		return w.EndsAt.Sub(now)
+	}
+	return defaultMaintenanceRetryAfter
+}
+
+var maintenanceRejections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "api_gateway_maintenance_rejections_total",
+		Help: "Requests answered with 503 because of a maintenance window",
+	},
+	[]string{"scope"},
+)
+
+func init() {
+	prometheus.MustRegister(maintenanceRejections)
+}
+
+type maintenanceRegistry struct {
+	mu      sync.RWMutex
+	windows []*MaintenanceWindow // not yet ended
+}
+
+func newMaintenanceRegistry() *maintenanceRegistry {
+	return &maintenanceRegistry{}
+}
+
+// find returns the window in effect for a route, preferring the route's own
+// over its service's over the gateway's
+func (m *maintenanceRegistry) find(route *APIRoute, now time.Time) *MaintenanceWindow {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var found *MaintenanceWindow
+	rank := 0
+	for _, window := range m.windows {
+		if !window.activeAt(now) {
+			continue
+		}
+		switch {
+		case window.Scope == MaintenanceScopeRoute && window.Target == route.ID:
+			return window
+		case window.Scope == MaintenanceScopeService && window.Target == route.ServiceName && rank < 2:
+			found, rank = window, 2
+		case window.Scope == MaintenanceScopeGateway && rank < 1:
+			found, rank = window, 1
+		}
+	}
+	return found
+}
+
+// loadMaintenance reads the windows that haven't ended into memory
+func (s *APIGatewayService) loadMaintenance() error {
+	var windows []MaintenanceWindow
+	if err := s.db.Where("ends_at IS NULL OR ends_at > ?", time.Now()).Order("starts_at").Find(&windows).Error; err != nil {
+		return err
+	}
+
+	list := make([]*MaintenanceWindow, len(windows))
+	for i := range windows {
+		list[i] = &windows[i]
+	}
+	s.maintenance.mu.Lock()
+	s.maintenance.windows = list
+	s.maintenance.mu.Unlock()
+	return nil
+}
+
+// startMaintenanceRefresher picks up windows changed through other replicas
+func (s *APIGatewayService) startMaintenanceRefresher() {
+	ticker := time.NewTicker(s.config.MaintenanceRefreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.loadMaintenance(); err != nil {
+			log.Printf("Failed to refresh maintenance windows: %v", err)
+		}
+	}
+}
+
+// checkMaintenance answers the request with 503 when the route is under
+// maintenance, reporting whether it may go on
+func (s *APIGatewayService) checkMaintenance(c *gin.Context, route *APIRoute) bool {
+	now := time.Now()
+	window := s.maintenance.find(route, now)
+	if window == nil {
+		return true
+	}
+
+	maintenanceRejections.WithLabelValues(window.Scope).Inc()
+	retryAfter := int(math.Ceil(window.retryAfter(now).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+
+	if len(window.Body) > 0 {
+		c.Data(http.StatusServiceUnavailable, "application/json; charset=utf-8", window.Body)
+		return false
+	}
+	message := window.Message
+	if message == "" {
+		message = "The service is down for maintenance"
+	}
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":          "Service under maintenance",
+		"message":        message,
+		"maintenance_id": window.ID,
+		"ends_at":        window.EndsAt,
+	})
+	return false
+}
+
+// Admin handlers
+
+// List maintenance windows, by default those that haven't ended
+func (s *APIGatewayService) listMaintenanceWindows(c *gin.Context) {
+	query := s.db.Model(&MaintenanceWindow{})
+	if c.Query("all") != "true" {
+		query = query.Where("ends_at IS NULL OR ends_at > ?", time.Now())
+	}
+	if scope := c.Query("scope"); scope != "" {
+		query = query.Where("scope = ?", scope)
+	}
+	if target := c.Query("target"); target != "" {
+		query = query.Where("target = ?", target)
+	}
+
+	var windows []MaintenanceWindow
+	if err := query.Order("starts_at DESC").Find(&windows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list maintenance windows"})
+		return
+	}
+
+	now := time.Now()
+	result := make([]gin.H, len(windows))
+	for i := range windows {
+		result[i] = gin.H{
+			"window": windows[i],
+			"active": windows[i].activeAt(now),
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"windows": result,
+		"total":   len(result),
+	})
+}
+
+type maintenanceWindowRequest struct {
+	Scope      string          `json:"scope" binding:"required,oneof=gateway service route"`
+	Target     string          `json:"target"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+	RetryAfter int             `json:"retry_after" binding:"min=0"`
+	StartsAt   *time.Time      `json:"starts_at"` // nil: now
+	EndsAt     *time.Time      `json:"ends_at"`
+	Reason     string          `json:"reason"`
+}
+
+// applyMaintenanceRequest checks the request and fills in the window from
+// it, returning the status and error to answer with when it is invalid
+func (s *APIGatewayService) applyMaintenanceRequest(window *MaintenanceWindow, req *maintenanceWindowRequest) (int, string) {
+	switch req.Scope {
+	case MaintenanceScopeGateway:
+		if req.Target != "" {
+			return http.StatusBadRequest, "gateway maintenance takes no target"
+		}
+	case MaintenanceScopeService:
+		if req.Target == "" {
+			return http.StatusBadRequest, "target must name the service"
+		}
+	case MaintenanceScopeRoute:
+		var route APIRoute
+		if err := s.db.Select("id").First(&route, "id = ?", req.Target).Error; err != nil {
+			return http.StatusNotFound, "Route not found"
+		}
+	}
+	body := req.Body
+	if len(body) == 0 || string(body) == "null" {
+		body = nil
+	} else if !json.Valid(body) {
+		return http.StatusBadRequest, "body must be valid JSON"
+	}
+
+	startsAt := time.Now()
+	if req.StartsAt != nil {
+		startsAt = *req.StartsAt
+	}
+	if req.EndsAt != nil && !req.EndsAt.After(startsAt) {
+		return http.StatusBadRequest, "ends_at must be after starts_at"
+	}
+
+	window.Scope = req.Scope
+	window.Target = req.Target
+	window.Message = req.Message
+	window.Body = body
+	window.RetryAfter = req.RetryAfter
+	window.StartsAt = startsAt
+	window.EndsAt = req.EndsAt
+	window.Reason = req.Reason
+	window.UpdatedAt = time.Now()
+	return 0, ""
+}
+
+// Put the gateway, a service or a route under maintenance, now or later
+func (s *APIGatewayService) createMaintenanceWindow(c *gin.Context) {
+	var req maintenanceWindowRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	window := MaintenanceWindow{
+		ID:        uuid.New().String(),
+		CreatedBy: c.GetString("user_id"),
+		CreatedAt: time.Now(),
+	}
+	if status, message := s.applyMaintenanceRequest(&window, &req); status != 0 {
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+	if err := s.db.Create(&window).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create maintenance window"})
+		return
+	}
+	if err := s.loadMaintenance(); err != nil {
+		log.Printf("Failed to reload maintenance windows: %v", err)
+	}
+
+	log.Printf("Maintenance window %s created for %s %s from %s", window.ID, window.Scope, window.Target, window.StartsAt.Format(time.RFC3339))
+	c.JSON(http.StatusCreated, window)
+}
+
+// Replace a maintenance window, e.g. to extend or reschedule it
+func (s *APIGatewayService) updateMaintenanceWindow(c *gin.Context) {
+	var window MaintenanceWindow
+	if err := s.db.First(&window, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Maintenance window not found"})
+		return
+	}
+
+	var req maintenanceWindowRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// An active window keeps its start unless given a new one
+	if req.StartsAt == nil && window.activeAt(time.Now()) {
+		req.StartsAt = &window.StartsAt
+	}
+	if status, message := s.applyMaintenanceRequest(&window, &req); status != 0 {
+		c.JSON(status, gin.H{"error": message})
+		return
+	}
+	if err := s.db.Save(&window).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update maintenance window"})
+		return
+	}
+	if err := s.loadMaintenance(); err != nil {
+		log.Printf("Failed to reload maintenance windows: %v", err)
+	}
+
+	c.JSON(http.StatusOK, window)
+}
+
+// Lift or cancel a maintenance window
+func (s *APIGatewayService) deleteMaintenanceWindow(c *gin.Context) {
+	result := s.db.Delete(&MaintenanceWindow{}, "id = ?", c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete maintenance window"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Maintenance window not found"})
+		return
+	}
+	if err := s.loadMaintenance(); err != nil {
+		log.Printf("Failed to reload maintenance windows: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Maintenance window deleted successfully"})
+}
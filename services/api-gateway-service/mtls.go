@@ -0,0 +1,700 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+	"gorm.io/gorm/clause"
+)
+
+// Mutual TLS. With TLS_CERT_FILE and TLS_KEY_FILE set the gateway serves
+// HTTPS and asks clients for a certificate. Which certificates are trusted
+// is up to each route: a route's client CA bundle verifies the certificate a
+// client presents, and a route requiring one refuses clients without. The
+// verified client's identity, its first URI SAN (e.g. a SPIFFE ID), DNS SAN,
+// email SAN or else its common name, is passed upstream in
+// X-Client-Cert-Identity; the header is stripped from every other request so
+// it can't be forged. A route can further allow only certificates with a SAN
+// matching one of its patterns, where * matches within a path segment.
+//
+// Routes to upstreams requiring mTLS name a client certificate, key and
+// optionally a CA bundle to verify the upstream with. These apply to HTTP,
+// gRPC pass-through and WebSocket routes.
+//
+// Certificate files are checked every CERT_RELOAD_INTERVAL and reloaded when
+// they change, or at once through POST /admin/v1/tls/reload, so rotating a
+// certificate needs no restart. A file that fails to load leaves the last
+// good certificate in use.
+
+const clientIdentityHeader = "X-Client-Cert-Identity"
+
+// RouteMTLS holds a route's client and upstream certificate settings
+type RouteMTLS struct {
+	RouteID            string    `json:"route_id" gorm:"primaryKey"`
+	RequireClientCert  bool      `json:"require_client_cert"`
+	ClientCABundle     string    `json:"client_ca_bundle" gorm:"type:text"` // PEM
+	AllowedSANs        []string  `json:"allowed_sans" gorm:"type:text[]"`   // empty: any certificate the bundle verifies
+	UpstreamCertFile   string    `json:"upstream_cert_file"`
+	UpstreamKeyFile    string    `json:"upstream_key_file"`
+	UpstreamCAFile     string    `json:"upstream_ca_file"` // empty: system roots
+	UpstreamServerName string    `json:"upstream_server_name"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+var (
+	clientCertRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_client_cert_rejections_total",
+			Help: "Requests refused for a missing, untrusted or disallowed client certificate",
+		},
+		[]string{"route", "reason"},
+	)
+
+	certificateExpiry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "api_gateway_certificate_expiry_timestamp_seconds",
+			Help: "When the certificates in use expire",
+		},
+		[]string{"certificate"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(clientCertRejections)
+	prometheus.MustRegister(certificateExpiry)
+}
+
+// keyPair is a certificate and key loaded from files, reloaded when either
+// file changes
+type keyPair struct {
+	name     string
+	certFile string
+	keyFile  string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modified time.Time // the later of the files' modification times
+	loadErr  error
+}
+
+// reload loads the files if they changed, reporting whether they did
+func (k *keyPair) reload() (bool, error) {
+	modified, err := latestModTime(k.certFile, k.keyFile)
+	if err != nil {
+		k.setErr(err)
+		return false, err
+	}
+	k.mu.RLock()
+	unchanged := k.cert != nil && modified.Equal(k.modified)
+	k.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		k.setErr(err)
+		return false, err
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if cert.Leaf != nil {
+		certificateExpiry.WithLabelValues(k.name).Set(float64(cert.Leaf.NotAfter.Unix()))
+	}
+
+	k.mu.Lock()
+	k.cert = &cert
+	k.modified = modified
+	k.loadErr = nil
+	k.mu.Unlock()
+	return true, nil
+}
+
+func (k *keyPair) setErr(err error) {
+	k.mu.Lock()
+	k.loadErr = err
+	k.mu.Unlock()
+}
+
+func (k *keyPair) get() *tls.Certificate {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.cert
+}
+
+func (k *keyPair) status() gin.H {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	status := gin.H{"cert_file": k.certFile, "key_file": k.keyFile, "loaded": k.cert != nil}
+	if k.cert != nil && k.cert.Leaf != nil {
+		status["subject"] = k.cert.Leaf.Subject.String()
+		status["not_after"] = k.cert.Leaf.NotAfter
+	}
+	if !k.modified.IsZero() {
+		status["modified_at"] = k.modified
+	}
+	if k.loadErr != nil {
+		status["error"] = k.loadErr.Error()
+	}
+	return status
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// upstreamTLS presents a route's client certificate to its upstreams. The
+// transports are rebuilt whenever the certificate or CA bundle changes.
+type upstreamTLS struct {
+	pair       *keyPair
+	caFile     string
+	serverName string
+
+	mu        sync.RWMutex
+	caMod     time.Time
+	config    *tls.Config
+	http      *http.Transport
+	grpc      *http2.Transport
+	configErr error
+}
+
+func newUpstreamTLS(routeID string, policy *RouteMTLS) *upstreamTLS {
+	return &upstreamTLS{
+		pair: &keyPair{
+			name:     "upstream:" + routeID,
+			certFile: policy.UpstreamCertFile,
+			keyFile:  policy.UpstreamKeyFile,
+		},
+		caFile:     policy.UpstreamCAFile,
+		serverName: policy.UpstreamServerName,
+	}
+}
+
+// sameFiles reports whether the settings are the ones u was built from
+func (u *upstreamTLS) sameFiles(policy *RouteMTLS) bool {
+	return u.pair.certFile == policy.UpstreamCertFile && u.pair.keyFile == policy.UpstreamKeyFile &&
+		u.caFile == policy.UpstreamCAFile && u.serverName == policy.UpstreamServerName
+}
+
+// reload rebuilds the transports when the files changed
+func (u *upstreamTLS) reload() (bool, error) {
+	certChanged, err := u.pair.reload()
+	if err != nil {
+		u.setErr(err)
+		return false, err
+	}
+	caMod, err := latestModTime(u.caFile)
+	if err != nil {
+		u.setErr(err)
+		return false, err
+	}
+	u.mu.RLock()
+	unchanged := !certChanged && u.http != nil && caMod.Equal(u.caMod)
+	u.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: u.serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return u.pair.get(), nil
+		},
+	}
+	if u.caFile != "" {
+		pem, err := os.ReadFile(u.caFile)
+		if err != nil {
+			u.setErr(err)
+			return false, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			err := fmt.Errorf("no certificates in %s", u.caFile)
+			u.setErr(err)
+			return false, err
+		}
+		config.RootCAs = roots
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config.Clone()
+	grpcTransport := &http2.Transport{TLSClientConfig: config.Clone()}
+
+	u.mu.Lock()
+	previous, previousGRPC := u.http, u.grpc
+	u.config, u.http, u.grpc = config, transport, grpcTransport
+	u.caMod = caMod
+	u.configErr = nil
+	u.mu.Unlock()
+
+	// New connections use the new certificate; let the old ones go
+	if previous != nil {
+		previous.CloseIdleConnections()
+		previousGRPC.CloseIdleConnections()
+	}
+	return true, nil
+}
+
+func (u *upstreamTLS) setErr(err error) {
+	u.mu.Lock()
+	u.configErr = err
+	u.mu.Unlock()
+}
+
+// transport returns the transport for the route's protocol, or nil when the
+// certificate has never loaded
+func (u *upstreamTLS) transport(protocol string) http.RoundTripper {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if u.http == nil {
+		return nil
+	}
+	if protocol == ProtocolGRPC {
+		return u.grpc
+	}
+	return u.http
+}
+
+// tlsConfig is the TLS configuration for dialing the route's upstreams
+func (u *upstreamTLS) tlsConfig() *tls.Config {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if u.config == nil {
+		return nil
+	}
+	return u.config.Clone()
+}
+
+func (u *upstreamTLS) status() gin.H {
+	status := u.pair.status()
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	status["ca_file"] = u.caFile
+	if u.configErr != nil {
+		status["error"] = u.configErr.Error()
+	}
+	return status
+}
+
+// unavailableTransport fails requests to upstreams whose client certificate
+// could not be loaded, rather than calling them without one
+type unavailableTransport struct{ err error }
+
+func (t unavailableTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, t.err
+}
+
+// clientCertPolicy is a route's compiled client certificate settings
+type clientCertPolicy struct {
+	require bool
+	roots   *x509.CertPool
+	allowed []string
+}
+
+type mtlsRegistry struct {
+	server *keyPair // nil without TLS
+
+	mu       sync.RWMutex
+	clients  map[string]*clientCertPolicy // by route ID
+	upstream map[string]*upstreamTLS      // by route ID
+}
+
+func newMTLSRegistry(config *Config) *mtlsRegistry {
+	r := &mtlsRegistry{
+		clients:  make(map[string]*clientCertPolicy),
+		upstream: make(map[string]*upstreamTLS),
+	}
+	if config.TLSCertFile != "" {
+		r.server = &keyPair{name: "server", certFile: config.TLSCertFile, keyFile: config.TLSKeyFile}
+	}
+	return r
+}
+
+func (r *mtlsRegistry) client(routeID string) *clientCertPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.clients[routeID]
+}
+
+func (r *mtlsRegistry) upstreamFor(routeID string) *upstreamTLS {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.upstream[routeID]
+}
+
+// compileClientCertPolicy checks a route's client certificate settings
+func compileClientCertPolicy(policy *RouteMTLS) (*clientCertPolicy, error) {
+	if policy.ClientCABundle == "" {
+		if policy.RequireClientCert {
+			return nil, errors.New("client_ca_bundle is required to require client certificates")
+		}
+		return nil, nil
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(policy.ClientCABundle)) {
+		return nil, errors.New("client_ca_bundle holds no PEM certificates")
+	}
+	for _, pattern := range policy.AllowedSANs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid SAN pattern %q", pattern)
+		}
+	}
+	return &clientCertPolicy{require: policy.RequireClientCert, roots: roots, allowed: policy.AllowedSANs}, nil
+}
+
+// syncMTLS compiles the routes' certificate settings, keeping the upstream
+// certificates already loaded for unchanged routes
+func (s *APIGatewayService) syncMTLS(routes []*APIRoute) {
+	s.mtls.mu.RLock()
+	current := s.mtls.upstream
+	s.mtls.mu.RUnlock()
+
+	clients := make(map[string]*clientCertPolicy)
+	upstream := make(map[string]*upstreamTLS)
+	for _, route := range routes {
+		policy := route.MTLS
+		if policy == nil {
+			continue
+		}
+		client, err := compileClientCertPolicy(policy)
+		if err != nil {
+			log.Printf("Ignoring client certificate settings of route %s: %v", route.ID, err)
+		} else if client != nil {
+			clients[route.ID] = client
+		}
+
+		if policy.UpstreamCertFile == "" {
+			continue
+		}
+		if existing, ok := current[route.ID]; ok && existing.sameFiles(policy) {
+			upstream[route.ID] = existing
+			continue
+		}
+		u := newUpstreamTLS(route.ID, policy)
+		if _, err := u.reload(); err != nil {
+			log.Printf("Failed to load upstream client certificate of route %s: %v", route.ID, err)
+		}
+		upstream[route.ID] = u
+	}
+
+	s.mtls.mu.Lock()
+	s.mtls.clients = clients
+	s.mtls.upstream = upstream
+	s.mtls.mu.Unlock()
+}
+
+// upstreamTransport is the transport for a route whose upstreams require a
+// client certificate, or nil for any other route
+func (s *APIGatewayService) upstreamTransport(route *APIRoute) http.RoundTripper {
+	u := s.mtls.upstreamFor(route.ID)
+	if u == nil {
+		return nil
+	}
+	if transport := u.transport(route.Protocol); transport != nil {
+		return transport
+	}
+	return unavailableTransport{err: fmt.Errorf("client certificate for route %s is not loaded", route.ID)}
+}
+
+// serverTLSConfig terminates TLS with the reloadable server certificate.
+// Client certificates are requested but verified per route.
+func (s *APIGatewayService) serverTLSConfig() (*tls.Config, error) {
+	if _, err := s.mtls.server.reload(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		ClientAuth: tls.RequestClientCert,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.mtls.server.get(), nil
+		},
+	}, nil
+}
+
+// verifyClientCert checks the client's certificate against the route's
+// bundle and passes on its identity, answering the request when it fails
+func (s *APIGatewayService) verifyClientCert(c *gin.Context, route *APIRoute) bool {
+	policy := s.mtls.client(route.ID)
+	if policy == nil {
+		return true
+	}
+
+	state := c.Request.TLS
+	if state == nil || len(state.PeerCertificates) == 0 {
+		if !policy.require {
+			return true
+		}
+		clientCertRejections.WithLabelValues(route.ID, "missing").Inc()
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Client certificate required"})
+		return false
+	}
+
+	leaf := state.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         policy.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		clientCertRejections.WithLabelValues(route.ID, "untrusted").Inc()
+		c.JSON(http.StatusForbidden, gin.H{"error": "Client certificate not trusted"})
+		return false
+	}
+	if len(policy.allowed) > 0 && !sanAllowed(leaf, policy.allowed) {
+		clientCertRejections.WithLabelValues(route.ID, "not_allowed").Inc()
+		c.JSON(http.StatusForbidden, gin.H{"error": "Client certificate identity not allowed"})
+		return false
+	}
+
+	c.Set("client_identity", certIdentity(leaf))
+	return true
+}
+
+// certIdentity names the holder of a client certificate
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// sanAllowed reports whether any SAN of the certificate matches a pattern
+func sanAllowed(cert *x509.Certificate, patterns []string) bool {
+	sans := make([]string, 0, len(cert.URIs)+len(cert.DNSNames)+len(cert.EmailAddresses))
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, pattern := range patterns {
+		for _, san := range sans {
+			if ok, _ := path.Match(pattern, san); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setClientIdentityHeader replaces whatever the client sent with the
+// verified identity, if any
+func setClientIdentityHeader(c *gin.Context, header http.Header) {
+	header.Del(clientIdentityHeader)
+	if identity := c.GetString("client_identity"); identity != "" {
+		header.Set(clientIdentityHeader, identity)
+	}
+}
+
+// startCertReloader picks up rotated certificate files
+func (s *APIGatewayService) startCertReloader() {
+	ticker := time.NewTicker(s.config.CertReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.reloadCertificates()
+	}
+}
+
+// reloadCertificates reloads the certificate files that changed, returning
+// the names of those that did and the errors of those that failed
+func (s *APIGatewayService) reloadCertificates() ([]string, map[string]string) {
+	var reloaded []string
+	failed := make(map[string]string)
+	if s.mtls.server != nil {
+		changed, err := s.mtls.server.reload()
+		if err != nil {
+			log.Printf("Failed to reload server certificate: %v", err)
+			failed["server"] = err.Error()
+		} else if changed {
+			log.Printf("Reloaded server certificate")
+			reloaded = append(reloaded, "server")
+		}
+	}
+
+	s.mtls.mu.RLock()
+	upstream := make(map[string]*upstreamTLS, len(s.mtls.upstream))
+	for routeID, u := range s.mtls.upstream {
+		upstream[routeID] = u
+	}
+	s.mtls.mu.RUnlock()
+	for routeID, u := range upstream {
+		changed, err := u.reload()
+		if err != nil {
+			log.Printf("Failed to reload upstream client certificate of route %s: %v", routeID, err)
+			failed["upstream:"+routeID] = err.Error()
+		} else if changed {
+			log.Printf("Reloaded upstream client certificate of route %s", routeID)
+			reloaded = append(reloaded, "upstream:"+routeID)
+		}
+	}
+	return reloaded, failed
+}
+
+// dialUpstreamTLS is the TLS configuration WebSocket connections to a
+// route's upstreams are dialed with, nil for the defaults
+func (s *APIGatewayService) dialUpstreamTLS(route *APIRoute) *tls.Config {
+	if u := s.mtls.upstreamFor(route.ID); u != nil {
+		return u.tlsConfig()
+	}
+	return nil
+}
+
+// Admin handlers
+
+// Get a route's mTLS settings
+func (s *APIGatewayService) getRouteMTLS(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("MTLS").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	policy := RouteMTLS{RouteID: route.ID}
+	if route.MTLS != nil {
+		policy = *route.MTLS
+	}
+	response := gin.H{"mtls": policy}
+	if u := s.mtls.upstreamFor(route.ID); u != nil {
+		response["upstream_certificate"] = u.status()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// Configure a route's mTLS settings
+func (s *APIGatewayService) updateRouteMTLS(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("MTLS").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	var policy RouteMTLS
+	if route.MTLS != nil {
+		policy = *route.MTLS
+	}
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	policy.RouteID = route.ID
+	policy.UpdatedAt = time.Now()
+
+	if _, err := compileClientCertPolicy(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if policy.RequireClientCert && s.mtls.server == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the gateway does not terminate TLS; set TLS_CERT_FILE to require client certificates"})
+		return
+	}
+	if (policy.UpstreamCertFile == "") != (policy.UpstreamKeyFile == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "upstream_cert_file and upstream_key_file go together"})
+		return
+	}
+	if policy.UpstreamCertFile == "" && (policy.UpstreamCAFile != "" || policy.UpstreamServerName != "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "upstream_ca_file and upstream_server_name need an upstream client certificate"})
+		return
+	}
+	if policy.UpstreamCertFile != "" {
+		// Refuse files this replica can't load rather than failing requests
+		if _, err := newUpstreamTLS(route.ID, &policy).reload(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to load upstream client certificate: " + err.Error()})
+			return
+		}
+	}
+
+	if err := s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save mTLS settings"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// Remove a route's mTLS settings
+func (s *APIGatewayService) deleteRouteMTLS(c *gin.Context) {
+	if err := s.db.Delete(&RouteMTLS{}, "route_id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete mTLS settings"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "mTLS settings deleted successfully"})
+}
+
+// Report the certificates in use
+func (s *APIGatewayService) getTLSStatus(c *gin.Context) {
+	response := gin.H{"terminates_tls": s.mtls.server != nil}
+	if s.mtls.server != nil {
+		response["server"] = s.mtls.server.status()
+	}
+
+	s.mtls.mu.RLock()
+	upstream := make(gin.H, len(s.mtls.upstream))
+	for routeID, u := range s.mtls.upstream {
+		upstream[routeID] = u.status()
+	}
+	clientRoutes := make([]string, 0, len(s.mtls.clients))
+	for routeID := range s.mtls.clients {
+		clientRoutes = append(clientRoutes, routeID)
+	}
+	s.mtls.mu.RUnlock()
+
+	response["upstream"] = upstream
+	response["client_cert_routes"] = clientRoutes
+	c.JSON(http.StatusOK, response)
+}
+
+// Reload changed certificate files now
+func (s *APIGatewayService) reloadTLSCertificates(c *gin.Context) {
+	reloaded, failed := s.reloadCertificates()
+	status := http.StatusOK
+	if len(failed) > 0 {
+		status = http.StatusInternalServerError
+	}
+	c.JSON(status, gin.H{
+		"reloaded": reloaded,
+		"failed":   failed,
+	})
+}
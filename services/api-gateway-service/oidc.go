@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OIDC bearer tokens. Tokens whose iss is one of OIDC_ISSUERS are verified
+// against the issuer's published JWKS, located through OpenID discovery,
+// instead of a shared secret. Key sets are cached and refetched every
+// OIDC_JWKS_REFRESH_INTERVAL; a token signed with a kid the cache doesn't
+// know triggers an early refetch, so issuers can rotate signing keys
+// without a gateway restart. When OIDC_AUDIENCES is set, aud must name one
+// of them.
+//
+// Tokens signed with JWT_SECRET are still accepted while JWT_HMAC_ENABLED
+// is on, which by default it is only when no issuer is configured.
+//
+// Routes may list AllowedIssuers to take bearer tokens from those issuers
+// only. API keys are not issued by an issuer and are unaffected.
+
+const (
+	oidcDiscoveryPath      = "/.well-known/openid-configuration"
+	jwksMinRefetchInterval = 30 * time.Second
+)
+
+var jwksRefreshes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "api_gateway_jwks_refreshes_total",
+		Help: "JWKS fetches by issuer and outcome",
+	},
+	[]string{"issuer", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(jwksRefreshes)
+}
+
+// oidcProvider caches one issuer's signing keys
+type oidcProvider struct {
+	issuer string
+
+	mu          sync.RWMutex
+	jwksURI     string
+	keys        map[string]interface{} // by kid
+	fetchedAt   time.Time
+	lastAttempt time.Time
+	lastError   string
+}
+
+type oidcRegistry struct {
+	providers map[string]*oidcProvider // by issuer
+	audiences []string
+	client    *http.Client
+
+	refreshMu sync.Mutex // one fetch at a time
+}
+
+func newOIDCRegistry(issuers, audiences []string) *oidcRegistry {
+	r := &oidcRegistry{
+		providers: make(map[string]*oidcProvider),
+		audiences: audiences,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, issuer := range issuers {
+		r.providers[issuer] = &oidcProvider{issuer: issuer, keys: make(map[string]interface{})}
+	}
+	return r
+}
+
+func (r *oidcRegistry) provider(issuer string) *oidcProvider {
+	return r.providers[issuer]
+}
+
+// audienceAllowed reports whether the token is meant for this gateway
+func (r *oidcRegistry) audienceAllowed(claims jwt.MapClaims) bool {
+	if len(r.audiences) == 0 {
+		return true
+	}
+	for _, audience := range r.audiences {
+		if claims.VerifyAudience(audience, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyFor finds the provider's key with the given kid, refetching the key
+// set once when it is unknown. A token without a kid matches the only
+// key of a single-key set.
+func (r *oidcRegistry) keyFor(p *oidcProvider, kid string) (interface{}, error) {
+	if key, ok := p.key(kid); ok {
+		return key, nil
+	}
+
+	p.mu.RLock()
+	recent := time.Since(p.lastAttempt) < jwksMinRefetchInterval
+	p.mu.RUnlock()
+	if !recent {
+		if err := r.refresh(p); err != nil {
+			return nil, err
+		}
+		if key, ok := p.key(kid); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no key %q published by %s", kid, p.issuer)
+}
+
+func (p *oidcProvider) key(kid string) (interface{}, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// refresh discovers the issuer's JWKS endpoint, if not known yet, and
+// fetches its keys
+func (r *oidcRegistry) refresh(p *oidcProvider) error {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+
+	p.mu.Lock()
+	p.lastAttempt = time.Now()
+	jwksURI := p.jwksURI
+	p.mu.Unlock()
+
+	keys, err := func() (map[string]interface{}, error) {
+		if jwksURI == "" {
+			var discovery struct {
+				Issuer  string `json:"issuer"`
+				JWKSURI string `json:"jwks_uri"`
+			}
+			if err := r.getJSON(strings.TrimSuffix(p.issuer, "/")+oidcDiscoveryPath, &discovery); err != nil {
+				return nil, fmt.Errorf("discovery failed: %w", err)
+			}
+			if discovery.Issuer != p.issuer {
+				return nil, fmt.Errorf("discovery document names issuer %q", discovery.Issuer)
+			}
+			if discovery.JWKSURI == "" {
+				return nil, fmt.Errorf("discovery document has no jwks_uri")
+			}
+			jwksURI = discovery.JWKSURI
+		}
+
+		var jwks struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		if err := r.getJSON(jwksURI, &jwks); err != nil {
+			return nil, fmt.Errorf("JWKS fetch failed: %w", err)
+		}
+		keys := make(map[string]interface{})
+		for _, jwk := range jwks.Keys {
+			if jwk.Use != "" && jwk.Use != "sig" {
+				continue
+			}
+			key, err := jwk.publicKey()
+			if err != nil {
+				log.Printf("Skipping key %q from %s: %v", jwk.Kid, p.issuer, err)
+				continue
+			}
+			keys[jwk.Kid] = key
+		}
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("JWKS has no usable signing keys")
+		}
+		return keys, nil
+	}()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.lastError = err.Error()
+		jwksRefreshes.WithLabelValues(p.issuer, "error").Inc()
+		return fmt.Errorf("%s: %w", p.issuer, err)
+	}
+	p.jwksURI = jwksURI
+	p.keys = keys
+	p.fetchedAt = time.Now()
+	p.lastError = ""
+	jwksRefreshes.WithLabelValues(p.issuer, "success").Inc()
+	return nil
+}
+
+func (r *oidcRegistry) getJSON(url string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jsonWebKey is a public key as published in a JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKField(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKField(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeJWKField(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKField(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeJWKField(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// decodeJWKField decodes base64url, tolerating padding some issuers add
+func decodeJWKField(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// jwtKey picks the key a token must be verified with: its issuer's
+// published key for OIDC issuers, the shared secret otherwise
+func (s *APIGatewayService) jwtKey(token *jwt.Token) (interface{}, error) {
+	claims, _ := token.Claims.(jwt.MapClaims)
+	issuer, _ := claims["iss"].(string)
+
+	if provider := s.oidc.provider(issuer); provider != nil {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			return nil, fmt.Errorf("issuer %s must sign with its published keys", issuer)
+		}
+		kid, _ := token.Header["kid"].(string)
+		return s.oidc.keyFor(provider, kid)
+	}
+
+	if !s.config.HMACJWTEnabled {
+		return nil, fmt.Errorf("untrusted issuer %q", issuer)
+	}
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return []byte(s.config.JWTSecret), nil
+}
+
+// authorizeIssuer checks a bearer token came from an issuer the route
+// allows, answering 403 when not
+func (s *APIGatewayService) authorizeIssuer(c *gin.Context, route *APIRoute) bool {
+	if len(route.AllowedIssuers) == 0 || c.GetString("api_key_id") != "" {
+		return true
+	}
+	issuer := c.GetString("token_issuer")
+	for _, allowed := range route.AllowedIssuers {
+		if issuer == allowed {
+			return true
+		}
+	}
+	c.JSON(http.StatusForbidden, gin.H{
+		"error":           "Token issuer not allowed for this route",
+		"allowed_issuers": route.AllowedIssuers,
+	})
+	return false
+}
+
+// startJWKSRefresher fetches every issuer's keys at startup and keeps them
+// fresh
+func (s *APIGatewayService) startJWKSRefresher() {
+	if len(s.oidc.providers) == 0 {
+		return
+	}
+
+	refreshAll := func() {
+		for _, provider := range s.oidc.providers {
+			if err := s.oidc.refresh(provider); err != nil {
+				log.Printf("OIDC key refresh failed: %v", err)
+			}
+		}
+	}
+	refreshAll()
+
+	ticker := time.NewTicker(s.config.JWKSRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		refreshAll()
+	}
+}
+
+func (s *APIGatewayService) oidcProviderStatus() []gin.H {
+	providers := make([]gin.H, 0, len(s.oidc.providers))
+	for _, provider := range s.oidc.providers {
+		provider.mu.RLock()
+		kids := make([]string, 0, len(provider.keys))
+		for kid := range provider.keys {
+			kids = append(kids, kid)
+		}
+		sort.Strings(kids)
+		status := gin.H{
+			"issuer":     provider.issuer,
+			"jwks_uri":   provider.jwksURI,
+			"key_ids":    kids,
+			"fetched_at": provider.fetchedAt,
+			"last_error": provider.lastError,
+		}
+		provider.mu.RUnlock()
+		providers = append(providers, status)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i]["issuer"].(string) < providers[j]["issuer"].(string)
+	})
+	return providers
+}
+
+// List configured OIDC issuers and the keys cached for them
+func (s *APIGatewayService) listOIDCProviders(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"providers":    s.oidcProviderStatus(),
+		"audiences":    s.oidc.audiences,
+		"hmac_enabled": s.config.HMACJWTEnabled,
+	})
+}
+
+// Refetch every issuer's keys now
+func (s *APIGatewayService) refreshOIDCProviders(c *gin.Context) {
+	var failures []string
+	for _, provider := range s.oidc.providers {
+		if err := s.oidc.refresh(provider); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	status := http.StatusOK
+	if len(failures) > 0 {
+		status = http.StatusBadGateway
+	}
+	c.JSON(status, gin.H{
+		"providers": s.oidcProviderStatus(),
+		"errors":    failures,
+	})
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// OpenAPI import and export. Importing an OpenAPI 3 document creates a
+// route for every operation: the path template becomes the route path
+// ({id} becomes :id), an operation that requires any security scheme
+// requires authentication, and the first absolute server URL of the
+// operation, its path or the document becomes the upstream. Without one the
+// route resolves its service through discovery-service. The gateway's own
+// settings travel as extensions, so a document exported from one gateway
+// imports into another unchanged:
+//
+//	x-gateway-service    service name (operation, or document info)
+//	x-gateway-rate-limit requests per rate limit window
+//	x-gateway-timeout    route timeout in seconds
+//	x-gateway-wildcard   the last path parameter matches the rest of the path
+//
+// Exporting describes the active routes as an OpenAPI 3 document that
+// client SDK generators can consume.
+
+const openAPIVersion = "3.0.3"
+
+const maxOpenAPIDocumentSize = 10 << 20
+
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+var pathParamPattern = regexp.MustCompile(`^\{([^{}]+)\}$`)
+
+type openAPIDocument struct {
+	OpenAPI    string                            `json:"openapi"`
+	Info       openAPIInfo                       `json:"info"`
+	Servers    []openAPIServer                   `json:"servers,omitempty"`
+	Paths      map[string]map[string]interface{} `json:"paths"`
+	Components *openAPIComponents                `json:"components,omitempty"`
+	Security   []map[string][]string             `json:"security,omitempty"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+	Service     string `json:"x-gateway-service,omitempty"`
+}
+
+type openAPIServer struct {
+	URL         string                           `json:"url"`
+	Description string                           `json:"description,omitempty"`
+	Variables   map[string]openAPIServerVariable `json:"variables,omitempty"`
+}
+
+type openAPIServerVariable struct {
+	Default string `json:"default"`
+}
+
+type openAPIComponents struct {
+	SecuritySchemes map[string]interface{} `json:"securitySchemes,omitempty"`
+}
+
+type openAPIOperation struct {
+	OperationID string                     `json:"operationId,omitempty"`
+	Summary     string                     `json:"summary,omitempty"`
+	Description string                     `json:"description,omitempty"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	Security    *[]map[string][]string     `json:"security,omitempty"`
+	Servers     []openAPIServer            `json:"servers,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+	Deprecated  bool                       `json:"deprecated,omitempty"`
+	Service     string                     `json:"x-gateway-service,omitempty"`
+	RateLimit   int                        `json:"x-gateway-rate-limit,omitempty"`
+	Timeout     int                        `json:"x-gateway-timeout,omitempty"`
+	Wildcard    bool                       `json:"x-gateway-wildcard,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name        string                 `json:"name"`
+	In          string                 `json:"in"`
+	Description string                 `json:"description,omitempty"`
+	Required    bool                   `json:"required,omitempty"`
+	Schema      map[string]interface{} `json:"schema,omitempty"`
+}
+
+type openAPIResponse struct {
+	Description string `json:"description"`
+}
+
+// openAPIImportResult reports what an import did with one operation
+type openAPIImportResult struct {
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	RouteID string `json:"route_id,omitempty"`
+	Action  string `json:"action"` // created, updated, skipped or error
+	Error   string `json:"error,omitempty"`
+}
+
+// parseOpenAPIDocument reads an OpenAPI 3 document in JSON or YAML
+func parseOpenAPIDocument(data []byte) (*openAPIDocument, error) {
+	// JSON is YAML, so one parser handles both; going through JSON lets the
+	// document types keep a single set of tags
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid document: %w", err)
+	}
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid document: %w", err)
+	}
+
+	var doc openAPIDocument
+	if err := json.Unmarshal(encoded, &doc); err != nil {
+		return nil, fmt.Errorf("invalid document: %w", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, fmt.Errorf("unsupported OpenAPI version %q, expected 3.x", doc.OpenAPI)
+	}
+	if len(doc.Paths) == 0 {
+		return nil, fmt.Errorf("document has no paths")
+	}
+	return &doc, nil
+}
+
+// routePathFromTemplate turns /users/{id} into /users/:id
+func routePathFromTemplate(template string, wildcard bool) (string, error) {
+	if !strings.HasPrefix(template, "/") {
+		return "", fmt.Errorf("path must start with /")
+	}
+	segments := strings.Split(template, "/")
+	for i, segment := range segments {
+		if !strings.ContainsAny(segment, "{}") {
+			continue
+		}
+		match := pathParamPattern.FindStringSubmatch(segment)
+		if match == nil {
+			return "", fmt.Errorf("segment %q mixes text and parameters, which routes cannot match", segment)
+		}
+		if wildcard && i == len(segments)-1 {
+			segments[i] = "*"
+		} else {
+			segments[i] = ":" + match[1]
+		}
+	}
+	if wildcard && segments[len(segments)-1] != "*" {
+		return "", fmt.Errorf("x-gateway-wildcard needs a trailing path parameter")
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// templateFromRoutePath turns /users/:id into /users/{id}, naming the
+// parameters it finds
+func templateFromRoutePath(path string) (string, []string, bool) {
+	segments := strings.Split(path, "/")
+	var params []string
+	wildcard := false
+	for i, segment := range segments {
+		switch {
+		case strings.HasPrefix(segment, ":"):
+			params = append(params, segment[1:])
+			segments[i] = "{" + segment[1:] + "}"
+		case segment == "*" && i == len(segments)-1:
+			params = append(params, "path")
+			segments[i] = "{path}"
+			wildcard = true
+		}
+	}
+	return strings.Join(segments, "/"), params, wildcard
+}
+
+// serverURL picks the first absolute server URL, filling in variables
+func serverURL(servers ...[]openAPIServer) string {
+	for _, list := range servers {
+		for _, server := range list {
+			resolved := server.URL
+			for name, variable := range server.Variables {
+				resolved = strings.ReplaceAll(resolved, "{"+name+"}", variable.Default)
+			}
+			u, err := url.Parse(resolved)
+			if err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+				return strings.TrimSuffix(resolved, "/")
+			}
+		}
+	}
+	return ""
+}
+
+// requiresAuth reports whether a security requirement list demands
+// credentials; an empty requirement ({}) makes them optional
+func requiresAuth(requirements []map[string][]string) bool {
+	if len(requirements) == 0 {
+		return false
+	}
+	for _, requirement := range requirements {
+		if len(requirement) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// serviceNameFromTitle derives a service name from the document title
+func serviceNameFromTitle(title string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// routesFromOpenAPI builds a route for every operation in the document
+func routesFromOpenAPI(doc *openAPIDocument, serviceName, serviceURL string) ([]*APIRoute, []openAPIImportResult) {
+	if serviceName == "" {
+		serviceName = doc.Info.Service
+	}
+	if serviceName == "" {
+		serviceName = serviceNameFromTitle(doc.Info.Title)
+	}
+
+	templates := make([]string, 0, len(doc.Paths))
+	for template := range doc.Paths {
+		templates = append(templates, template)
+	}
+	sort.Strings(templates)
+
+	var routes []*APIRoute
+	var failures []openAPIImportResult
+	for _, template := range templates {
+		item := doc.Paths[template]
+
+		var pathServers []openAPIServer
+		if raw, ok := item["servers"]; ok {
+			if err := remarshal(raw, &pathServers); err != nil {
+				failures = append(failures, openAPIImportResult{Path: template, Action: "error", Error: "invalid servers: " + err.Error()})
+				continue
+			}
+		}
+
+		for _, method := range openAPIMethods {
+			raw, ok := item[method]
+			if !ok {
+				continue
+			}
+			result := openAPIImportResult{Method: strings.ToUpper(method), Path: template, Action: "error"}
+
+			var op openAPIOperation
+			if err := remarshal(raw, &op); err != nil {
+				result.Error = "invalid operation: " + err.Error()
+				failures = append(failures, result)
+				continue
+			}
+			path, err := routePathFromTemplate(template, op.Wildcard)
+			if err != nil {
+				result.Error = err.Error()
+				failures = append(failures, result)
+				continue
+			}
+
+			security := doc.Security
+			if op.Security != nil {
+				security = *op.Security
+			}
+			upstream := serviceURL
+			if upstream == "" {
+				upstream = serverURL(op.Servers, pathServers, doc.Servers)
+			}
+			service := serviceName
+			if op.Service != "" {
+				service = op.Service
+			}
+			if service == "" {
+				result.Error = "no service name: set service_name, x-gateway-service or info.title"
+				failures = append(failures, result)
+				continue
+			}
+
+			route := &APIRoute{
+				Path:        path,
+				Method:      strings.ToUpper(method),
+				ServiceName: service,
+				ServiceURL:  upstream,
+				IsActive:    !op.Deprecated,
+				RequireAuth: requiresAuth(security),
+				RateLimit:   op.RateLimit,
+				Timeout:     op.Timeout,
+				Metadata: map[string]interface{}{
+					"openapi_operation_id": op.OperationID,
+					"openapi_summary":      op.Summary,
+					"openapi_description":  op.Description,
+					"openapi_tags":         op.Tags,
+				},
+			}
+			routes = append(routes, route)
+		}
+	}
+	return routes, failures
+}
+
+// remarshal converts a decoded JSON value into a typed one
+func remarshal(in interface{}, out interface{}) error {
+	encoded, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, out)
+}
+
+// Import routes from an OpenAPI 3 document
+func (s *APIGatewayService) importOpenAPIRoutes(c *gin.Context) {
+	onConflict := c.DefaultQuery("on_conflict", "skip")
+	if onConflict != "skip" && onConflict != "update" && onConflict != "fail" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "on_conflict must be skip, update or fail"})
+		return
+	}
+	dryRun := c.Query("dry_run") == "true"
+	serviceURL := c.Query("service_url")
+	if serviceURL != "" {
+		if u, err := url.Parse(serviceURL); err != nil || u.Host == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "service_url must be an absolute URL"})
+			return
+		}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxOpenAPIDocumentSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read document"})
+		return
+	}
+	if len(data) > maxOpenAPIDocumentSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Document is too large"})
+		return
+	}
+	doc, err := parseOpenAPIDocument(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	routes, results := routesFromOpenAPI(doc, c.Query("service_name"), serviceURL)
+	if onConflict == "fail" && len(results) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Document has operations that cannot be imported", "results": results})
+		return
+	}
+
+	created, updated, skipped := 0, 0, 0
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		for _, route := range routes {
+			result := openAPIImportResult{Method: route.Method, Path: route.Path}
+
+			var existing APIRoute
+			err := tx.Where("method = ? AND path = ?", route.Method, route.Path).First(&existing).Error
+			switch {
+			case err == nil && onConflict == "fail":
+				return fmt.Errorf("route %s %s already exists", route.Method, route.Path)
+			case err == nil && onConflict == "skip":
+				result.RouteID = existing.ID
+				result.Action = "skipped"
+				skipped++
+			case err == nil:
+				updates := map[string]interface{}{
+					"service_name": route.ServiceName,
+					"service_url":  route.ServiceURL,
+					"is_active":    route.IsActive,
+					"require_auth": route.RequireAuth,
+					"metadata":     route.Metadata,
+					"updated_at":   time.Now(),
+				}
+				if route.RateLimit > 0 {
+					updates["rate_limit"] = route.RateLimit
+				}
+				if route.Timeout > 0 {
+					updates["timeout"] = route.Timeout
+				}
+				if !dryRun {
+					if err := tx.Model(&existing).Updates(updates).Error; err != nil {
+						return err
+					}
+				}
+				result.RouteID = existing.ID
+				result.Action = "updated"
+				updated++
+			case err == gorm.ErrRecordNotFound:
+				route.ID = uuid.New().String()
+				if !dryRun {
+					// Omit fields the document left unset so the column
+					// defaults apply; false would be dropped by GORM anyway
+					omit := []string{}
+					if route.RateLimit == 0 {
+						omit = append(omit, "RateLimit")
+					}
+					if route.Timeout == 0 {
+						omit = append(omit, "Timeout")
+					}
+					if err := tx.Omit(omit...).Create(route).Error; err != nil {
+						return err
+					}
+					// Create skips zero values that have a default
+					if !route.IsActive || !route.RequireAuth {
+						if err := tx.Model(route).Updates(map[string]interface{}{
+							"is_active":    route.IsActive,
+							"require_auth": route.RequireAuth,
+						}).Error; err != nil {
+							return err
+						}
+					}
+				}
+				result.RouteID = route.ID
+				result.Action = "created"
+				created++
+			default:
+				return err
+			}
+			results = append(results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Import failed: " + err.Error()})
+		return
+	}
+
+	if !dryRun && created+updated > 0 {
+		if err := s.loadRoutes(); err != nil {
+			log.Printf("Failed to reload routes: %v", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run": dryRun,
+		"created": created,
+		"updated": updated,
+		"skipped": skipped,
+		"failed":  len(results) - created - updated - skipped,
+		"results": results,
+	})
+}
+
+// Export the registered routes as an OpenAPI 3 document
+func (s *APIGatewayService) exportOpenAPIRoutes(c *gin.Context) {
+	query := s.db.Order("path, method")
+	if c.Query("include_inactive") != "true" {
+		query = query.Where("is_active = ?", true)
+	}
+	if serviceName := c.Query("service_name"); serviceName != "" {
+		query = query.Where("service_name = ?", serviceName)
+	}
+	var routes []APIRoute
+	if err := query.Find(&routes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load routes"})
+		return
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	doc := openAPIDocument{
+		OpenAPI: openAPIVersion,
+		Info: openAPIInfo{
+			Title:   c.DefaultQuery("title", "002AIC API Gateway"),
+			Version: c.DefaultQuery("version", "1.0.0"),
+			Service: c.Query("service_name"),
+		},
+		Servers: []openAPIServer{{URL: scheme + "://" + c.Request.Host}},
+		Paths:   make(map[string]map[string]interface{}),
+		Components: &openAPIComponents{
+			SecuritySchemes: map[string]interface{}{
+				"apiKey":     map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"bearerAuth": map[string]string{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+
+	for _, route := range routes {
+		// Plain gRPC routes are not HTTP APIs a client can call
+		if route.Protocol == ProtocolGRPC {
+			continue
+		}
+		template, params, wildcard := templateFromRoutePath(route.Path)
+		op := openAPIOperation{
+			OperationID: metadataString(route.Metadata, "openapi_operation_id"),
+			Summary:     metadataString(route.Metadata, "openapi_summary"),
+			Description: metadataString(route.Metadata, "openapi_description"),
+			Responses: map[string]openAPIResponse{
+				"default": {Description: "Response from " + route.ServiceName},
+				"429":     {Description: "Rate limit exceeded"},
+			},
+			Deprecated: !route.IsActive,
+			Service:    route.ServiceName,
+			RateLimit:  route.RateLimit,
+			Timeout:    route.Timeout,
+			Wildcard:   wildcard,
+		}
+		if op.OperationID == "" {
+			op.OperationID = operationIDFor(route.Method, route.Path)
+		}
+		if tags, ok := route.Metadata["openapi_tags"].([]interface{}); ok {
+			for _, tag := range tags {
+				if name, ok := tag.(string); ok {
+					op.Tags = append(op.Tags, name)
+				}
+			}
+		}
+		if len(op.Tags) == 0 {
+			op.Tags = []string{route.ServiceName}
+		}
+		for _, name := range params {
+			op.Parameters = append(op.Parameters, openAPIParameter{
+				Name:     name,
+				In:       "path",
+				Required: true,
+				Schema:   map[string]interface{}{"type": "string"},
+			})
+		}
+		if route.RequireAuth {
+			op.Security = &[]map[string][]string{{"apiKey": {}}, {"bearerAuth": {}}}
+			op.Responses["401"] = openAPIResponse{Description: "Missing or invalid credentials"}
+		} else {
+			op.Security = &[]map[string][]string{}
+		}
+
+		item, ok := doc.Paths[template]
+		if !ok {
+			item = make(map[string]interface{})
+			doc.Paths[template] = item
+		}
+		item[strings.ToLower(route.Method)] = op
+	}
+
+	if c.Query("format") == "yaml" {
+		// Round-trip through JSON so YAML keys follow the JSON tags
+		encoded, err := json.Marshal(doc)
+		if err == nil {
+			var generic interface{}
+			if err = json.Unmarshal(encoded, &generic); err == nil {
+				encoded, err = yaml.Marshal(generic)
+			}
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode document"})
+			return
+		}
+		c.Data(http.StatusOK, "application/yaml", encoded)
+		return
+	}
+	c.JSON(http.StatusOK, doc)
+}
+
+func metadataString(metadata map[string]interface{}, key string) string {
+	value, _ := metadata[key].(string)
+	return value
+}
+
+// operationIDFor names an operation after its method and path, e.g.
+// GET /users/:id becomes getUsersById
+func operationIDFor(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, segment := range strings.Split(path, "/") {
+		switch {
+		case segment == "":
+			continue
+		case segment == "*":
+			b.WriteString("Wildcard")
+			continue
+		case strings.HasPrefix(segment, ":"):
+			b.WriteString("By")
+			segment = segment[1:]
+		}
+		for _, word := range strings.FieldsFunc(segment, func(r rune) bool { return r == '-' || r == '_' || r == '.' }) {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
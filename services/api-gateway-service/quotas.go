@@ -0,0 +1,580 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Usage quotas and billing counters. Every proxied request made with an API
+// key or as a user is counted per calendar month (UTC) against the key and
+// the user: requests, request bytes and response bytes. Counting happens in
+// Redis, so every replica sees the same totals, and the totals are copied
+// to Postgres every USAGE_FLUSH_INTERVAL for billing to read from
+// GET /admin/v1/usage.
+//
+// A quota caps the monthly requests and bytes (in plus out) of one API key
+// or user; zero leaves that dimension uncapped. Requests are checked and
+// counted in one step, so replicas can't overshoot a request quota between
+// them. Bytes are only known once a response is done, so a byte quota stops
+// requests after the one that went over. A request over quota is refused
+// with 429 and Retry-After set to the start of next month; X-Quota-* headers
+// report the quota on every counted request. When Redis cannot be reached
+// requests are let through, as with rate limits.
+
+const usageKeyPrefix = "gateway_usage:"
+
+// usageRetention keeps Redis counters past the end of their month, long
+// enough for the last flush to Postgres
+const usageRetention = 35 * 24 * time.Hour
+
+// UsageQuota caps the monthly usage of one API key or user
+type UsageQuota struct {
+	ID              string    `json:"id" gorm:"primaryKey"`
+	Subject         string    `json:"subject" gorm:"uniqueIndex;not null"` // api_key:<id> or user:<id>
+	MonthlyRequests int64     `json:"monthly_requests"`                    // 0: unlimited
+	MonthlyBytes    int64     `json:"monthly_bytes"`                       // request plus response; 0: unlimited
+	Plan            string    `json:"plan"`
+	CreatedBy       string    `json:"created_by"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// UsageRecord is the usage of one API key or user in one month
+type UsageRecord struct {
+	Subject   string    `json:"subject" gorm:"primaryKey"`
+	Period    string    `json:"period" gorm:"primaryKey"` // YYYY-MM
+	Requests  int64     `json:"requests"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var (
+	quotaRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_quota_rejections_total",
+			Help: "Requests refused for exceeding a monthly quota",
+		},
+		[]string{"dimension"},
+	)
+
+	quotaErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "api_gateway_quota_errors_total",
+			Help: "Quota checks that failed open because Redis was unavailable",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(quotaRejections)
+	prometheus.MustRegister(quotaErrors)
+}
+
+// Checks every subject's counters against its limits and, when all are
+// within them, counts the request against each. KEYS are the subjects'
+// hashes; ARGV holds a request limit and a byte limit per key (0 for none)
+// and then the TTL in seconds. Returns {allowed, index of the subject over
+// quota or 0, then requests and bytes of each key}.
+var quotaScript = redis.NewScript(`
+local n = #KEYS
+local usage = {}
+local over = 0
+for i = 1, n do
+  local values = redis.call('HMGET', KEYS[i], 'requests', 'bytes_in', 'bytes_out')
+  local requests = tonumber(values[1]) or 0
+  local bytes = (tonumber(values[2]) or 0) + (tonumber(values[3]) or 0)
+  local request_limit = tonumber(ARGV[2 * i - 1])
+  local byte_limit = tonumber(ARGV[2 * i])
+  if over == 0 and ((request_limit > 0 and requests >= request_limit) or (byte_limit > 0 and bytes >= byte_limit)) then
+    over = i
+  end
+  usage[2 * i - 1] = requests
+  usage[2 * i] = bytes
+end
+local result = {0, over}
+if over == 0 then
+  result[1] = 1
+  local ttl = tonumber(ARGV[2 * n + 1])
+  for i = 1, n do
+    usage[2 * i - 1] = redis.call('HINCRBY', KEYS[i], 'requests', 1)
+    redis.call('EXPIRE', KEYS[i], ttl)
+  end
+end
+for i = 1, 2 * n do
+  result[#result + 1] = usage[i]
+end
+return result
+`)
+
+type quotaRegistry struct {
+	mu     sync.RWMutex
+	quotas map[string]*UsageQuota // by subject
+}
+
+func newQuotaRegistry() *quotaRegistry {
+	return &quotaRegistry{quotas: make(map[string]*UsageQuota)}
+}
+
+func (q *quotaRegistry) find(subject string) *UsageQuota {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.quotas[subject]
+}
+
+// loadQuotas reads the quotas into memory
+func (s *APIGatewayService) loadQuotas() error {
+	var quotas []UsageQuota
+	if err := s.db.Find(&quotas).Error; err != nil {
+		return err
+	}
+
+	bySubject := make(map[string]*UsageQuota, len(quotas))
+	for i := range quotas {
+		bySubject[quotas[i].Subject] = &quotas[i]
+	}
+	s.quotas.mu.Lock()
+	s.quotas.quotas = bySubject
+	s.quotas.mu.Unlock()
+	return nil
+}
+
+// usagePeriod is the month t falls in, and when the next one starts
+func usagePeriod(t time.Time) (string, time.Time) {
+	t = t.UTC()
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start.Format("2006-01"), start.AddDate(0, 1, 0)
+}
+
+func usageKey(period, subject string) string {
+	return usageKeyPrefix + period + ":" + subject
+}
+
+func usageSubjectsKey(period string) string {
+	return usageKeyPrefix + period + ":subjects"
+}
+
+// usageSubjects are the identities a request is billed to
+func usageSubjects(c *gin.Context) []string {
+	var subjects []string
+	if apiKeyID := c.GetString("api_key_id"); apiKeyID != "" {
+		subjects = append(subjects, "api_key:"+apiKeyID)
+	}
+	if userID := c.GetString("user_id"); userID != "" {
+		subjects = append(subjects, "user:"+userID)
+	}
+	return subjects
+}
+
+// checkQuota counts a request against the monthly usage of its caller,
+// refusing it when a quota is used up. The returned function records the
+// request's bytes once it is done; it is nil when the request is refused.
+func (s *APIGatewayService) checkQuota(c *gin.Context) (func(), bool) {
+	subjects := usageSubjects(c)
+	if len(subjects) == 0 {
+		return func() {}, true
+	}
+
+	period, reset := usagePeriod(time.Now())
+	keys := make([]string, len(subjects))
+	args := make([]interface{}, 0, 2*len(subjects)+1)
+	quotas := make([]*UsageQuota, len(subjects))
+	for i, subject := range subjects {
+		keys[i] = usageKey(period, subject)
+		quotas[i] = s.quotas.find(subject)
+		if quotas[i] != nil {
+			args = append(args, quotas[i].MonthlyRequests, quotas[i].MonthlyBytes)
+		} else {
+			args = append(args, 0, 0)
+		}
+	}
+	args = append(args, int(usageRetention.Seconds()))
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 500*time.Millisecond)
+	defer cancel()
+	values, err := quotaScript.Run(ctx, s.redis, keys, args...).Int64Slice()
+	if err != nil {
+		quotaErrors.Inc()
+		log.Printf("Quota check failed for %s: %v", strings.Join(subjects, ", "), err)
+		return func() {}, true
+	}
+	s.redis.SAdd(ctx, usageSubjectsKey(period), subjects)
+	s.redis.Expire(ctx, usageSubjectsKey(period), usageRetention)
+
+	// Headers describe the most specific subject with a quota
+	for i, quota := range quotas {
+		if quota == nil {
+			continue
+		}
+		setQuotaHeaders(c, quota, values[2+2*i], values[3+2*i], reset)
+		break
+	}
+
+	if values[0] == 0 {
+		over := values[1] - 1
+		quota := quotas[over]
+		setQuotaHeaders(c, quota, values[2+2*over], values[3+2*over], reset)
+
+		dimension := "requests"
+		if quota.MonthlyRequests <= 0 || values[2+2*over] < quota.MonthlyRequests {
+			dimension = "bytes"
+		}
+		quotaRejections.WithLabelValues(dimension).Inc()
+
+		retryAfter := int(time.Until(reset).Seconds()) + 1
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       "Monthly quota exceeded",
+			"subject":     quota.Subject,
+			"dimension":   dimension,
+			"period":      period,
+			"resets_at":   reset,
+			"retry_after": retryAfter,
+		})
+		return nil, false
+	}
+
+	// Count the body as it is read; Content-Length is absent when chunked
+	body := &countingBody{ReadCloser: c.Request.Body}
+	if c.Request.Body != nil && c.Request.Body != http.NoBody {
+		c.Request.Body = body
+	}
+	return func() {
+		s.recordUsageBytes(period, subjects, body.count(), int64(c.Writer.Size()))
+	}, true
+}
+
+func setQuotaHeaders(c *gin.Context, quota *UsageQuota, requests, bytes int64, reset time.Time) {
+	if quota.MonthlyRequests > 0 {
+		c.Header("X-Quota-Limit-Requests", strconv.FormatInt(quota.MonthlyRequests, 10))
+		c.Header("X-Quota-Remaining-Requests", strconv.FormatInt(max64(quota.MonthlyRequests-requests, 0), 10))
+	}
+	if quota.MonthlyBytes > 0 {
+		c.Header("X-Quota-Limit-Bytes", strconv.FormatInt(quota.MonthlyBytes, 10))
+		c.Header("X-Quota-Remaining-Bytes", strconv.FormatInt(max64(quota.MonthlyBytes-bytes, 0), 10))
+	}
+	c.Header("X-Quota-Reset", strconv.FormatInt(reset.Unix(), 10))
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// recordUsageBytes adds a finished request's bytes to its subjects' usage
+func (s *APIGatewayService) recordUsageBytes(period string, subjects []string, bytesIn, bytesOut int64) {
+	if bytesOut < 0 {
+		bytesOut = 0
+	}
+	if bytesIn == 0 && bytesOut == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	pipe := s.redis.Pipeline()
+	for _, subject := range subjects {
+		key := usageKey(period, subject)
+		pipe.HIncrBy(ctx, key, "bytes_in", bytesIn)
+		pipe.HIncrBy(ctx, key, "bytes_out", bytesOut)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		quotaErrors.Inc()
+		log.Printf("Failed to record usage bytes for %s: %v", strings.Join(subjects, ", "), err)
+	}
+}
+
+// countingBody counts the bytes read through it
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
+func (b *countingBody) count() int64 {
+	return atomic.LoadInt64(&b.n)
+}
+
+// startUsageFlusher copies the Redis usage counters to Postgres
+func (s *APIGatewayService) startUsageFlusher() {
+	ticker := time.NewTicker(s.config.UsageFlushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.flushUsage(context.Background()); err != nil {
+			log.Printf("Failed to flush usage counters: %v", err)
+		}
+	}
+}
+
+// flushUsage writes this month's and last month's counters to Postgres;
+// last month's keep arriving until its final requests have finished
+func (s *APIGatewayService) flushUsage(ctx context.Context) error {
+	now := time.Now().UTC()
+	current, _ := usagePeriod(now)
+	previous, _ := usagePeriod(now.AddDate(0, 0, -now.Day()))
+
+	for _, period := range []string{previous, current} {
+		subjects, err := s.redis.SMembers(ctx, usageSubjectsKey(period)).Result()
+		if err != nil {
+			return err
+		}
+		if len(subjects) == 0 {
+			continue
+		}
+
+		pipe := s.redis.Pipeline()
+		commands := make([]*redis.SliceCmd, len(subjects))
+		for i, subject := range subjects {
+			commands[i] = pipe.HMGet(ctx, usageKey(period, subject), "requests", "bytes_in", "bytes_out")
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return err
+		}
+
+		now := time.Now()
+		records := make([]UsageRecord, 0, len(subjects))
+		for i, subject := range subjects {
+			values := commands[i].Val()
+			if len(values) != 3 || values[0] == nil {
+				continue
+			}
+			records = append(records, UsageRecord{
+				Subject:   subject,
+				Period:    period,
+				Requests:  redisInt64(values[0]),
+				BytesIn:   redisInt64(values[1]),
+				BytesOut:  redisInt64(values[2]),
+				UpdatedAt: now,
+			})
+		}
+		if len(records) == 0 {
+			continue
+		}
+
+		// Redis holds the running totals, so the latest copy wins
+		err = s.db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "subject"}, {Name: "period"}},
+			DoUpdates: clause.AssignmentColumns([]string{"requests", "bytes_in", "bytes_out", "updated_at"}),
+		}).CreateInBatches(&records, 500).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func redisInt64(value interface{}) int64 {
+	s, _ := value.(string)
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// List usage quotas
+func (s *APIGatewayService) listQuotas(c *gin.Context) {
+	query := s.db.Model(&UsageQuota{})
+	if subject := c.Query("subject"); subject != "" {
+		query = query.Where("subject = ?", subject)
+	}
+
+	var quotas []UsageQuota
+	if err := query.Order("subject").Find(&quotas).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list quotas"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"quotas": quotas,
+		"total":  len(quotas),
+	})
+}
+
+// Create or replace the quota of an API key or user
+func (s *APIGatewayService) setQuota(c *gin.Context) {
+	var req struct {
+		Subject         string `json:"subject" binding:"required"`
+		MonthlyRequests int64  `json:"monthly_requests" binding:"min=0"`
+		MonthlyBytes    int64  `json:"monthly_bytes" binding:"min=0"`
+		Plan            string `json:"plan"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	kind, value, _ := strings.Cut(req.Subject, ":")
+	if value == "" || (kind != "user" && kind != "api_key") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "subject must be api_key:<id> or user:<id>"})
+		return
+	}
+	if req.MonthlyRequests == 0 && req.MonthlyBytes == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "monthly_requests or monthly_bytes is required"})
+		return
+	}
+
+	quota := UsageQuota{
+		ID:              uuid.New().String(),
+		Subject:         req.Subject,
+		MonthlyRequests: req.MonthlyRequests,
+		MonthlyBytes:    req.MonthlyBytes,
+		Plan:            req.Plan,
+		CreatedBy:       c.GetString("user_id"),
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+	// Replace any quota for the same subject
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("subject = ?", req.Subject).Delete(&UsageQuota{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&quota).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save quota"})
+		return
+	}
+	if err := s.loadQuotas(); err != nil {
+		log.Printf("Failed to reload quotas: %v", err)
+	}
+
+	c.JSON(http.StatusOK, quota)
+}
+
+// Delete a usage quota
+func (s *APIGatewayService) deleteQuota(c *gin.Context) {
+	result := s.db.Delete(&UsageQuota{}, "id = ?", c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete quota"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quota not found"})
+		return
+	}
+	if err := s.loadQuotas(); err != nil {
+		log.Printf("Failed to reload quotas: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Quota deleted successfully"})
+}
+
+// Usage report of a month for billing, with each subject's quota
+func (s *APIGatewayService) getUsageReport(c *gin.Context) {
+	period := c.Query("period")
+	current, _ := usagePeriod(time.Now())
+	if period == "" {
+		period = current
+	}
+	if _, err := time.Parse("2006-01", period); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period must be YYYY-MM"})
+		return
+	}
+
+	// Bring the month's figures up to date before reporting them
+	if err := s.flushUsage(c.Request.Context()); err != nil {
+		log.Printf("Failed to flush usage counters for report: %v", err)
+	}
+
+	query := s.db.Where("period = ?", period)
+	if subject := c.Query("subject"); subject != "" {
+		query = query.Where("subject = ?", subject)
+	}
+	if kind := c.Query("kind"); kind != "" {
+		query = query.Where("subject LIKE ?", kind+":%")
+	}
+	var records []UsageRecord
+	if err := query.Order("subject").Find(&records).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch usage"})
+		return
+	}
+
+	// A request is billed to both its key and its user, so the kinds are
+	// totalled apart
+	type usageTotals struct {
+		Requests int64 `json:"requests"`
+		BytesIn  int64 `json:"bytes_in"`
+		BytesOut int64 `json:"bytes_out"`
+	}
+	totals := map[string]*usageTotals{"api_key": {}, "user": {}}
+	usage := make([]gin.H, 0, len(records))
+	for _, record := range records {
+		entry := gin.H{
+			"subject":    record.Subject,
+			"requests":   record.Requests,
+			"bytes_in":   record.BytesIn,
+			"bytes_out":  record.BytesOut,
+			"updated_at": record.UpdatedAt,
+		}
+		if quota := s.quotas.find(record.Subject); quota != nil {
+			entry["plan"] = quota.Plan
+			entry["monthly_requests"] = quota.MonthlyRequests
+			entry["monthly_bytes"] = quota.MonthlyBytes
+			entry["requests_over_quota"] = quota.MonthlyRequests > 0 && record.Requests >= quota.MonthlyRequests
+			entry["bytes_over_quota"] = quota.MonthlyBytes > 0 && record.BytesIn+record.BytesOut >= quota.MonthlyBytes
+		}
+		usage = append(usage, entry)
+
+		kind, _, _ := strings.Cut(record.Subject, ":")
+		if total, ok := totals[kind]; ok {
+			total.Requests += record.Requests
+			total.BytesIn += record.BytesIn
+			total.BytesOut += record.BytesOut
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"period":   period,
+		"complete": period < current,
+		"usage":    usage,
+		"total":    len(usage),
+		"totals":   totals,
+	})
+}
+
+// Live usage of one API key or user this month
+func (s *APIGatewayService) getSubjectUsage(c *gin.Context) {
+	subject := c.Param("subject")
+	period, reset := usagePeriod(time.Now())
+
+	values, err := s.redis.HMGet(c.Request.Context(), usageKey(period, subject), "requests", "bytes_in", "bytes_out").Result()
+	if err != nil && err != redis.Nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Usage counters unavailable"})
+		return
+	}
+	for len(values) < 3 {
+		values = append(values, nil)
+	}
+
+	response := gin.H{
+		"subject":   subject,
+		"period":    period,
+		"resets_at": reset,
+		"requests":  redisInt64(values[0]),
+		"bytes_in":  redisInt64(values[1]),
+		"bytes_out": redisInt64(values[2]),
+	}
+	if quota := s.quotas.find(subject); quota != nil {
+		response["quota"] = quota
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Distributed rate limiting. Limits are counted in Redis so every gateway
+// replica enforces the same budget, and every counter expires once it is
+// idle, so nothing accumulates for clients that have gone away. A route
+// allows RateLimit requests per RateLimitWindow seconds to each client
+// (user, API key or IP address), counted with its RateLimitAlgorithm:
+//
+//	token_bucket   - the bucket holds RateLimitBurst tokens (RateLimit when
+//	                 unset) and refills at RateLimit per window (default)
+//	sliding_window - the current fixed window plus the overlapping share of
+//	                 the previous one
+//
+// An API key's own RateLimit replaces the route's. Overrides set a different
+// limit for one client on one route, or on every route, optionally until a
+// given time. When Redis cannot be reached requests are let through.
+
+// Rate limit algorithms
+const (
+	RateLimitTokenBucket   = "token_bucket"
+	RateLimitSlidingWindow = "sliding_window"
+)
+
+const rateLimitKeyPrefix = "gateway_rate_limit:"
+
+// RateLimitOverride replaces the limit of one client, on one route or all
+type RateLimitOverride struct {
+	ID            string     `json:"id" gorm:"primaryKey"`
+	RouteID       string     `json:"route_id" gorm:"uniqueIndex:idx_rate_limit_override"`         // empty: every route
+	Subject       string     `json:"subject" gorm:"uniqueIndex:idx_rate_limit_override;not null"` // user:<id>, api_key:<id> or ip:<address>
+	Limit         int        `json:"limit" gorm:"not null"`
+	WindowSeconds int        `json:"window_seconds"`
+	Burst         int        `json:"burst"`
+	Reason        string     `json:"reason"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	CreatedBy     string     `json:"created_by"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+var rateLimitErrors = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "api_gateway_rate_limit_errors_total",
+		Help: "Rate limit checks that failed open because Redis was unavailable",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(rateLimitErrors)
+}
+
+// Refills the bucket for the time since its last use, then takes a token.
+// Uses the Redis clock so replicas with skewed clocks agree. Returns
+// {allowed, tokens left, milliseconds until the next token}.
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local per_ms = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1]) or capacity
+local ts = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * per_ms)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / per_ms)
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(capacity / per_ms) + 1000)
+return {allowed, math.floor(tokens), wait}
+`)
+
+// Counts the request in the current window unless the sliding estimate is
+// already at the limit. Returns {allowed, estimate}.
+var slidingWindowScript = redis.NewScript(`
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+local previous = tonumber(redis.call('GET', KEYS[2]) or '0')
+local estimate = previous * tonumber(ARGV[2]) + current
+if estimate >= tonumber(ARGV[1]) then
+  return {0, math.floor(estimate)}
+end
+redis.call('INCR', KEYS[1])
+redis.call('EXPIRE', KEYS[1], tonumber(ARGV[3]))
+return {1, math.floor(estimate + 1)}
+`)
+
+// rateLimit is the limit that applies to one request
+type rateLimit struct {
+	key       string
+	limit     int
+	window    time.Duration
+	burst     int
+	algorithm string
+}
+
+// rateLimitDecision is the outcome of counting a request
+type rateLimitDecision struct {
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration
+}
+
+type rateLimitOverrides struct {
+	mu        sync.RWMutex
+	overrides map[string]*RateLimitOverride // by route ID + "|" + subject
+}
+
+func newRateLimitOverrides() *rateLimitOverrides {
+	return &rateLimitOverrides{overrides: make(map[string]*RateLimitOverride)}
+}
+
+// find returns the override for a subject on a route, preferring one made
+// for the route over one for every route
+func (o *rateLimitOverrides) find(routeID, subject string) *RateLimitOverride {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	for _, key := range []string{routeID + "|" + subject, "|" + subject} {
+		if override, ok := o.overrides[key]; ok {
+			if override.ExpiresAt == nil || override.ExpiresAt.After(time.Now()) {
+				return override
+			}
+		}
+	}
+	return nil
+}
+
+// loadRateLimitOverrides reads the unexpired overrides into memory
+func (s *APIGatewayService) loadRateLimitOverrides() error {
+	var overrides []RateLimitOverride
+	if err := s.db.Where("expires_at IS NULL OR expires_at > ?", time.Now()).Find(&overrides).Error; err != nil {
+		return err
+	}
+
+	byKey := make(map[string]*RateLimitOverride, len(overrides))
+	for i := range overrides {
+		byKey[overrides[i].RouteID+"|"+overrides[i].Subject] = &overrides[i]
+	}
+	s.rateLimitOverrides.mu.Lock()
+	s.rateLimitOverrides.overrides = byKey
+	s.rateLimitOverrides.mu.Unlock()
+	return nil
+}
+
+// rateLimitSubjects are the identities a request can be limited by, most
+// specific first
+func rateLimitSubjects(c *gin.Context) []string {
+	var subjects []string
+	if apiKeyID := c.GetString("api_key_id"); apiKeyID != "" {
+		subjects = append(subjects, "api_key:"+apiKeyID)
+	}
+	if userID := c.GetString("user_id"); userID != "" {
+		subjects = append(subjects, "user:"+userID)
+	}
+	return append(subjects, "ip:"+c.ClientIP())
+}
+
+// rateLimitFor works out which limit applies to a request on route
+func (s *APIGatewayService) rateLimitFor(c *gin.Context, route *APIRoute) rateLimit {
+	window := time.Duration(route.RateLimitWindow) * time.Second
+	if window <= 0 {
+		window = time.Second
+	}
+	algorithm := route.RateLimitAlgorithm
+	if algorithm == "" {
+		algorithm = RateLimitTokenBucket
+	}
+	limit := rateLimit{
+		key:       rateLimitKeyPrefix + route.ID + ":" + s.getRateLimitIdentifier(c),
+		limit:     route.RateLimit,
+		window:    window,
+		burst:     route.RateLimitBurst,
+		algorithm: algorithm,
+	}
+	if limit.limit <= 0 {
+		limit.limit = s.config.DefaultRateLimit
+	}
+	if keyLimit := c.GetInt("api_key_rate_limit"); keyLimit > 0 {
+		limit.limit = keyLimit
+	}
+
+	for _, subject := range rateLimitSubjects(c) {
+		override := s.rateLimitOverrides.find(route.ID, subject)
+		if override == nil {
+			continue
+		}
+		limit.key = rateLimitKeyPrefix + route.ID + ":" + subject
+		limit.limit = override.Limit
+		limit.burst = override.Burst
+		if override.WindowSeconds > 0 {
+			limit.window = time.Duration(override.WindowSeconds) * time.Second
+		}
+		break
+	}
+	return limit
+}
+
+// takeRateLimit counts one request against a limit
+func (s *APIGatewayService) takeRateLimit(ctx context.Context, limit rateLimit) (rateLimitDecision, error) {
+	if limit.algorithm == RateLimitSlidingWindow {
+		size := limit.window.Nanoseconds()
+		now := time.Now().UnixNano()
+		index := now / size
+		weight := 1 - float64(now-index*size)/float64(size)
+		keys := []string{fmt.Sprintf("%s:%d", limit.key, index), fmt.Sprintf("%s:%d", limit.key, index-1)}
+		values, err := slidingWindowScript.Run(ctx, s.redis, keys, limit.limit, weight, int(limit.window.Seconds())*2+1).Int64Slice()
+		if err != nil {
+			return rateLimitDecision{}, err
+		}
+		decision := rateLimitDecision{allowed: values[0] == 1, remaining: limit.limit - int(values[1])}
+		if !decision.allowed {
+			decision.retryAfter = time.Duration(size - (now - index*size))
+		}
+		return decision, nil
+	}
+
+	capacity := limit.burst
+	if capacity <= 0 {
+		capacity = limit.limit
+	}
+	perMs := float64(limit.limit) / float64(limit.window.Milliseconds())
+	values, err := tokenBucketScript.Run(ctx, s.redis, []string{limit.key}, capacity, perMs).Int64Slice()
+	if err != nil {
+		return rateLimitDecision{}, err
+	}
+	return rateLimitDecision{
+		allowed:    values[0] == 1,
+		remaining:  int(values[1]),
+		retryAfter: time.Duration(values[2]) * time.Millisecond,
+	}, nil
+}
+
+// Check rate limit
+func (s *APIGatewayService) checkRateLimit(c *gin.Context, route *APIRoute) bool {
+	limit := s.rateLimitFor(c, route)
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 500*time.Millisecond)
+	defer cancel()
+	decision, err := s.takeRateLimit(ctx, limit)
+	if err != nil {
+		// Better to let traffic through than to fail every request
+		rateLimitErrors.Inc()
+		log.Printf("Rate limit check failed for %s: %v", limit.key, err)
+		return true
+	}
+
+	remaining := decision.remaining
+	if remaining < 0 {
+		remaining = 0
+	}
+	c.Header("X-RateLimit-Limit", strconv.Itoa(limit.limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	if decision.allowed {
+		return true
+	}
+
+	rateLimitHits.WithLabelValues(
+		c.GetString("user_id"),
+		c.GetString("api_key_id"),
+	).Inc()
+
+	retryAfter := int((decision.retryAfter + time.Second - 1) / time.Second)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "Rate limit exceeded",
+		"limit":       limit.limit,
+		"window":      int(limit.window.Seconds()),
+		"retry_after": retryAfter,
+	})
+	return false
+}
+
+// List rate limit overrides
+func (s *APIGatewayService) listRateLimitOverrides(c *gin.Context) {
+	query := s.db.Model(&RateLimitOverride{})
+	if routeID := c.Query("route_id"); routeID != "" {
+		query = query.Where("route_id = ?", routeID)
+	}
+	if subject := c.Query("subject"); subject != "" {
+		query = query.Where("subject = ?", subject)
+	}
+
+	var overrides []RateLimitOverride
+	if err := query.Order("created_at DESC").Find(&overrides).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list rate limit overrides"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"overrides": overrides,
+		"total":     len(overrides),
+	})
+}
+
+// Create or replace the override for a subject on a route
+func (s *APIGatewayService) setRateLimitOverride(c *gin.Context) {
+	var req struct {
+		RouteID       string     `json:"route_id"`
+		Subject       string     `json:"subject" binding:"required"`
+		Limit         int        `json:"limit" binding:"required,min=1"`
+		WindowSeconds int        `json:"window_seconds" binding:"min=0"`
+		Burst         int        `json:"burst" binding:"min=0"`
+		Reason        string     `json:"reason"`
+		ExpiresAt     *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	kind, value, _ := strings.Cut(req.Subject, ":")
+	if value == "" || (kind != "user" && kind != "api_key" && kind != "ip") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "subject must be user:<id>, api_key:<id> or ip:<address>"})
+		return
+	}
+	if req.RouteID != "" {
+		var route APIRoute
+		if err := s.db.First(&route, "id = ?", req.RouteID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+			return
+		}
+	}
+
+	override := RateLimitOverride{
+		ID:            uuid.New().String(),
+		RouteID:       req.RouteID,
+		Subject:       req.Subject,
+		Limit:         req.Limit,
+		WindowSeconds: req.WindowSeconds,
+		Burst:         req.Burst,
+		Reason:        req.Reason,
+		ExpiresAt:     req.ExpiresAt,
+		CreatedBy:     c.GetString("user_id"),
+		CreatedAt:     time.Now(),
+	}
+	// Replace any override for the same route and subject
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("route_id = ? AND subject = ?", req.RouteID, req.Subject).Delete(&RateLimitOverride{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&override).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save rate limit override"})
+		return
+	}
+	if err := s.loadRateLimitOverrides(); err != nil {
+		log.Printf("Failed to reload rate limit overrides: %v", err)
+	}
+
+	c.JSON(http.StatusOK, override)
+}
+
+// Delete a rate limit override
+func (s *APIGatewayService) deleteRateLimitOverride(c *gin.Context) {
+	result := s.db.Delete(&RateLimitOverride{}, "id = ?", c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete rate limit override"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rate limit override not found"})
+		return
+	}
+	if err := s.loadRateLimitOverrides(); err != nil {
+		log.Printf("Failed to reload rate limit overrides: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Rate limit override deleted successfully"})
+}
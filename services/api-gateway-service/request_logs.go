@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Get the gateway's log entries for one request ID; used by the logging
+// service to correlate gateway and service logs
+func (s *APIGatewayService) getRequestLogsByRequestID(c *gin.Context) {
+	var logs []RequestLog
+	if err := s.db.Where("request_id = ?", c.Param("request_id")).Order("created_at ASC").Find(&logs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch request logs"})
+		return
+	}
+	if len(logs) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Request not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"request_id":   c.Param("request_id"),
+		"request_logs": logs,
+	})
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Upstream retries. A route's RetryCount is the number of extra attempts a
+// request gets when the upstream fails with a transport error or a 502, 503
+// or 504. Only idempotent requests are retried: GET, HEAD, PUT and DELETE,
+// or any method on a route flagged Idempotent. Attempts wait with
+// exponential backoff and jitter between them, may each get a timeout of
+// their own, and go to a freshly picked endpoint so a retry can land on a
+// healthy one. With RetryRespectRetryAfter the upstream's Retry-After is
+// honoured instead, and 429 becomes retryable too. The response carries the
+// number of retries in X-Gateway-Retries.
+
+const (
+	retryBodyLimit       = 1 << 20 // bodies above this are streamed and not retried
+	retryDrainLimit      = 4096
+	gatewayRetriesHeader = "X-Gateway-Retries"
+)
+
+var upstreamRetries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "api_gateway_upstream_retries_total",
+		Help: "Upstream request retries",
+	},
+	[]string{"service", "reason"},
+)
+
+func init() {
+	prometheus.MustRegister(upstreamRetries)
+}
+
+// retryTransport sends one proxied request, retrying it over the route's
+// pool as the route's policy allows
+type retryTransport struct {
+	s        *APIGatewayService
+	route    *APIRoute
+	pool     *upstreamPool
+	first    *upstream
+	inbound  *url.URL
+	body     []byte // replayable body; nil when there is none
+	attempts int
+	retries  int32
+	record   *accessLog
+}
+
+// isIdempotent reports whether a request on route may be sent again
+func isIdempotent(route *APIRoute, method string) bool {
+	if route.Idempotent {
+		return true
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// newRetryTransport prepares the transport for a request, buffering its body
+// when the request may be retried
+func (s *APIGatewayService) newRetryTransport(c *gin.Context, route *APIRoute, pool *upstreamPool, first *upstream) (*retryTransport, error) {
+	t := &retryTransport{
+		s:        s,
+		route:    route,
+		pool:     pool,
+		first:    first,
+		inbound:  c.Request.URL,
+		attempts: 1,
+		record:   accessLogFor(c),
+	}
+	if route.RetryCount <= 0 || !isIdempotent(route, c.Request.Method) {
+		return t, nil
+	}
+
+	req := c.Request
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength < 0 || req.ContentLength > retryBodyLimit || route.StreamBodies {
+			return t, nil
+		}
+		body, err := io.ReadAll(io.LimitReader(req.Body, retryBodyLimit+1))
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		t.body = body
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	t.attempts = route.RetryCount + 1
+	return t, nil
+}
+
+func (t *retryTransport) retryCount() int {
+	return int(atomic.LoadInt32(&t.retries))
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := t.first
+	for attempt := 1; ; attempt++ {
+		resp, err := t.try(req, endpoint)
+
+		wait, reason, ok := t.shouldRetry(req.Context(), attempt, resp, err)
+		if !ok {
+			return resp, err
+		}
+		next := t.nextEndpoint(endpoint)
+		if next == nil {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, retryDrainLimit))
+			resp.Body.Close()
+		}
+
+		upstreamRetries.WithLabelValues(t.route.ServiceName, reason).Inc()
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		atomic.AddInt32(&t.retries, 1)
+		endpoint = next
+	}
+}
+
+// try sends one attempt to endpoint
+func (t *retryTransport) try(req *http.Request, endpoint *upstream) (*http.Response, error) {
+	ctx := req.Context()
+	cancel := func() {}
+	if t.route.RetryPerTryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t.route.RetryPerTryTimeout)*time.Millisecond)
+	}
+
+	out := req.Clone(ctx)
+	out.URL = upstreamURL(endpoint.target, t.inbound)
+	if t.body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(t.body))
+		out.ContentLength = int64(len(t.body))
+	}
+
+	t.record.Upstream = endpoint.target.String()
+	t.record.Attempts++
+
+	span := startUpstreamSpan(out, t.route, t.record.Attempts)
+	host := endpoint.target.Host
+	atomic.AddInt64(&endpoint.active, 1)
+	upstreamActiveConnections.WithLabelValues(t.route.ServiceName, host).Inc()
+	release := func() {
+		cancel()
+		atomic.AddInt64(&endpoint.active, -1)
+		upstreamActiveConnections.WithLabelValues(t.route.ServiceName, host).Dec()
+		span.End()
+	}
+
+	resp, err := t.s.transportFor(t.route).RoundTrip(out)
+	endUpstreamSpan(span, resp, err)
+
+	// A client hanging up says nothing about the upstream
+	if !errors.Is(req.Context().Err(), context.Canceled) {
+		ok := err == nil && resp.StatusCode < http.StatusInternalServerError
+		t.pool.report(endpoint, ok, t.s.config.UpstreamEjectionThreshold, t.s.config.UpstreamEjectionDuration)
+		upstreamRequests.WithLabelValues(t.route.ServiceName, host, upstreamResult(ok)).Inc()
+	}
+
+	if err != nil {
+		release()
+		return nil, err
+	}
+	// The attempt lasts until the proxy has copied the body
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// shouldRetry decides whether a failed attempt is sent again, and after how long
+func (t *retryTransport) shouldRetry(ctx context.Context, attempt int, resp *http.Response, err error) (time.Duration, string, bool) {
+	if attempt >= t.attempts || ctx.Err() != nil {
+		return 0, "", false
+	}
+
+	var reason string
+	switch {
+	case err != nil && errors.Is(err, context.DeadlineExceeded):
+		reason = "timeout"
+	case err != nil:
+		reason = "error"
+	case resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusServiceUnavailable,
+		resp.StatusCode == http.StatusGatewayTimeout:
+		reason = strconv.Itoa(resp.StatusCode)
+	case resp.StatusCode == http.StatusTooManyRequests && t.route.RetryRespectRetryAfter:
+		reason = strconv.Itoa(resp.StatusCode)
+	default:
+		return 0, "", false
+	}
+
+	wait := retryBackoff(attempt, t.route.RetryBaseDelay, t.route.RetryMaxDelay)
+	if resp != nil && t.route.RetryRespectRetryAfter {
+		if after, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			wait = after
+		}
+	}
+	// Waiting past the request's deadline only turns this answer into a timeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= wait {
+		return 0, "", false
+	}
+	return wait, reason, true
+}
+
+// nextEndpoint picks the endpoint for a retry, preferring another one
+func (t *retryTransport) nextEndpoint(failed *upstream) *upstream {
+	next := t.pool.pick()
+	if next == failed {
+		if other := t.pool.pick(); other != nil {
+			next = other
+		}
+	}
+	return next
+}
+
+// retryBackoff is the delay before retry number attempt: exponential from
+// baseMs, capped at maxMs, with the upper half jittered
+func retryBackoff(attempt, baseMs, maxMs int) time.Duration {
+	if baseMs <= 0 {
+		baseMs = 100
+	}
+	if maxMs < baseMs {
+		maxMs = baseMs
+	}
+	delay := baseMs
+	for i := 1; i < attempt && delay < maxMs; i++ {
+		delay *= 2
+	}
+	if delay > maxMs {
+		delay = maxMs
+	}
+	half := delay / 2
+	return time.Duration(half+rand.Intn(delay-half+1)) * time.Millisecond
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// upstreamURL maps the client's request URL onto an endpoint, the way
+// httputil.NewSingleHostReverseProxy does
+func upstreamURL(target, inbound *url.URL) *url.URL {
+	out := *inbound
+	out.Scheme = target.Scheme
+	out.Host = target.Host
+	out.RawPath = ""
+	switch {
+	case target.Path == "":
+	case strings.HasSuffix(target.Path, "/") && strings.HasPrefix(inbound.Path, "/"):
+		out.Path = target.Path + inbound.Path[1:]
+	case !strings.HasSuffix(target.Path, "/") && !strings.HasPrefix(inbound.Path, "/"):
+		out.Path = target.Path + "/" + inbound.Path
+	default:
+		out.Path = target.Path + inbound.Path
+	}
+	switch {
+	case target.RawQuery == "":
+	case inbound.RawQuery == "":
+		out.RawQuery = target.RawQuery
+	default:
+		out.RawQuery = target.RawQuery + "&" + inbound.RawQuery
+	}
+	return &out
+}
+
+// releasingBody ends an attempt when the response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	closed  int32
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		b.release()
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Route change propagation. Each replica keeps its routing table, and what
+// loadRoutes derives from it, in memory, so a change made through one
+// replica's admin API must reach the others. Every successful admin write
+// publishes a notification on ROUTE_CHANGE_CHANNEL in Redis; a replica
+// seeing one from another replica reloads its routes. Notifications that
+// arrive together are coalesced into one reload.
+//
+// Pub/sub delivers only to replicas connected at the time, so routes are
+// also reloaded every ROUTE_RELOAD_INTERVAL to catch up anything a replica
+// missed while cut off from Redis. API keys are looked up on every request
+// and need no propagation.
+
+var routeReloads = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "api_gateway_route_reloads_total",
+		Help: "Routing table reloads after changes through other replicas or on the reload interval",
+	},
+	[]string{"trigger", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(routeReloads)
+}
+
+// routeChangeExempt lists admin writes that change nothing replicas hold
+var routeChangeExempt = map[string]bool{
+	"/admin/v1/api-keys/verify": true,
+}
+
+// routeChange is the notification published for an admin write
+type routeChange struct {
+	Instance string    `json:"instance"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	At       time.Time `json:"at"`
+}
+
+type routeSync struct {
+	instance string
+	pending  chan struct{}
+}
+
+func newRouteSync() *routeSync {
+	host, _ := os.Hostname()
+	return &routeSync{
+		instance: host + "-" + uuid.New().String()[:8],
+		pending:  make(chan struct{}, 1),
+	}
+}
+
+// publishRouteChanges announces every successful admin write to the other
+// replicas
+func (s *APIGatewayService) publishRouteChanges() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+		if s.config.RouteChangeChannel == "" || c.Writer.Status() >= 300 || routeChangeExempt[c.FullPath()] {
+			return
+		}
+
+		payload, _ := json.Marshal(routeChange{
+			Instance: s.routeSync.instance,
+			Method:   c.Request.Method,
+			Path:     c.FullPath(),
+			At:       time.Now().UTC(),
+		})
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			if err := s.redis.Publish(ctx, s.config.RouteChangeChannel, payload).Err(); err != nil {
+				log.Printf("Failed to publish route change: %v", err)
+			}
+		}()
+	}
+}
+
+// startRouteSync reloads routes when another replica changes them and on
+// the reload interval
+func (s *APIGatewayService) startRouteSync() {
+	if s.config.RouteChangeChannel != "" {
+		go s.subscribeRouteChanges()
+	}
+
+	var tick <-chan time.Time
+	if s.config.RouteReloadInterval > 0 {
+		ticker := time.NewTicker(s.config.RouteReloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.routeSync.pending:
+			s.reloadRoutes("notification")
+		case <-tick:
+			s.reloadRoutes("interval")
+		}
+	}
+}
+
+// subscribeRouteChanges queues a reload for each change made through
+// another replica. The subscription is restored after Redis reconnects.
+func (s *APIGatewayService) subscribeRouteChanges() {
+	pubsub := s.redis.Subscribe(context.Background(), s.config.RouteChangeChannel)
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		var change routeChange
+		if err := json.Unmarshal([]byte(msg.Payload), &change); err != nil {
+			log.Printf("Ignoring malformed route change: %v", err)
+			continue
+		}
+		if change.Instance == s.routeSync.instance {
+			continue
+		}
+		select {
+		case s.routeSync.pending <- struct{}{}:
+		default:
+			// A reload is already queued and will see this change too
+		}
+	}
+}
+
+func (s *APIGatewayService) reloadRoutes(trigger string) {
+	if err := s.loadRoutes(); err != nil {
+		routeReloads.WithLabelValues(trigger, "error").Inc()
+		log.Printf("Failed to reload routes: %v", err)
+		return
+	}
+	routeReloads.WithLabelValues(trigger, "success").Inc()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// Distributed tracing. Every request gets a server span, continuing the
+// caller's trace when it sends a W3C traceparent, and every upstream
+// attempt a client span whose context goes to the upstream in traceparent
+// and tracestate. Spans are exported over OTLP/HTTP to
+// OTEL_EXPORTER_OTLP_ENDPOINT (Jaeger's collector listens on :4318), sampled
+// at TRACE_SAMPLE_RATIO unless the caller already decided. Without an
+// endpoint nothing is recorded, but trace context still passes through to
+// upstreams.
+
+var tracer = otel.Tracer("api-gateway-service")
+
+// initTracing installs the W3C propagator and, with an OTLP endpoint, the
+// exporting tracer provider. The returned function flushes spans on
+// shutdown.
+func initTracing(config *Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if config.OTLPEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	ctx := context.Background()
+	// The exporter reads OTEL_EXPORTER_OTLP_* itself
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(
+			attribute.String("service.name", config.TracingServiceName),
+			attribute.String("deployment.environment", config.Environment),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe tracing resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.TraceSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	log.Printf("Tracing to %s (sample ratio %.2f)", config.OTLPEndpoint, config.TraceSampleRatio)
+	return provider.Shutdown, nil
+}
+
+// tracingMiddleware starts or continues the request's trace. The span is
+// named after the matched route once the request has been handled.
+func (s *APIGatewayService) tracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if strings.HasPrefix(path, "/health") || strings.HasPrefix(path, "/metrics") {
+			c.Next()
+			return
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := tracer.Start(ctx, c.Request.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", c.Request.Method),
+				attribute.String("url.path", path),
+				attribute.String("url.scheme", requestScheme(c.Request)),
+				attribute.String("server.address", c.Request.Host),
+				attribute.String("client.address", c.ClientIP()),
+				attribute.String("user_agent.original", c.Request.UserAgent()),
+			),
+		)
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		record := accessLogFor(c)
+		if record.Route != "" {
+			span.SetName(record.Route)
+			span.SetAttributes(
+				attribute.String("http.route", record.Route),
+				attribute.String("gateway.route_id", record.RouteID),
+				attribute.String("gateway.upstream_service", record.Service),
+				attribute.Int("gateway.upstream_attempts", record.Attempts),
+			)
+		}
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", status),
+			attribute.String("gateway.request_id", c.GetString("request_id")),
+		)
+		if version := c.GetString("route_version"); version != "" {
+			span.SetAttributes(attribute.String("gateway.route_version", version))
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// traceID is the request's trace ID, or empty when it has none
+func traceID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// startUpstreamSpan starts the client span of one upstream attempt and
+// sends its context along in the request's headers
+func startUpstreamSpan(req *http.Request, route *APIRoute, attempt int) trace.Span {
+	ctx, span := tracer.Start(req.Context(), req.Method+" "+route.ServiceName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.String()),
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("peer.service", route.ServiceName),
+			attribute.Int("http.request.resend_count", attempt-1),
+		),
+	)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return span
+}
+
+// endUpstreamSpan records an attempt's outcome on its span
+func endUpstreamSpan(span trace.Span, resp *http.Response, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+}
+
+// startGRPCSpan starts the client span of a transcoded gRPC call and adds
+// its context to the call's metadata
+func startGRPCSpan(ctx context.Context, route *APIRoute, method string, md metadata.MD) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.method", method),
+			attribute.String("peer.service", route.ServiceName),
+		),
+	)
+	otel.GetTextMapPropagator().Inject(ctx, grpcMetadataCarrier(md))
+	return ctx, span
+}
+
+// grpcMetadataCarrier adapts gRPC metadata for propagators
+type grpcMetadataCarrier metadata.MD
+
+func (m grpcMetadataCarrier) Get(key string) string {
+	if values := metadata.MD(m).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (m grpcMetadataCarrier) Set(key, value string) {
+	metadata.MD(m).Set(key, value)
+}
+
+func (m grpcMetadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
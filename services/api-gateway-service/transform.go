@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+// Request and response transformation. A route can carry a pipeline that
+// adapts traffic between clients and the backend without touching either:
+// headers are added, removed or renamed, the path is rewritten with a
+// regular expression, query parameters are injected, and JSON bodies are
+// reshaped by mapping target fields to JSONPath templates. The request
+// stage runs before the request is proxied; the response stage runs on the
+// backend's response before it is returned.
+//
+// A body template is either a single JSONPath expression such as
+// "$.user.name", which copies the value with its type, or a string with
+// "{{ $.path }}" placeholders, which is interpolated. Any other value is a
+// literal.
+
+const maxTransformBodySize = 10 << 20
+
+// Body mapping modes
+const (
+	BodyModeMerge   = "merge"   // keep the body, set the mapped fields
+	BodyModeReplace = "replace" // the body is only the mapped fields
+)
+
+// RouteTransformation stores a route's pipeline as JSON
+type RouteTransformation struct {
+	RouteID   string    `json:"route_id" gorm:"primaryKey"`
+	Request   string    `json:"request" gorm:"type:jsonb"`  // transformStage
+	Response  string    `json:"response" gorm:"type:jsonb"` // transformStage
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// transformStage is the configuration of one direction of the pipeline
+type transformStage struct {
+	AddHeaders    map[string]string      `json:"add_headers,omitempty"`
+	RemoveHeaders []string               `json:"remove_headers,omitempty"`
+	RenameHeaders map[string]string      `json:"rename_headers,omitempty"`
+	PathRewrite   *pathRewrite           `json:"path_rewrite,omitempty"` // request only
+	AddQuery      map[string]string      `json:"add_query,omitempty"`    // request only
+	BodyMode      string                 `json:"body_mode,omitempty"`    // merge or replace
+	BodyMapping   map[string]interface{} `json:"body_mapping,omitempty"` // target field -> template
+	BodyRemove    []string               `json:"body_remove,omitempty"`  // dotted fields to drop
+}
+
+type pathRewrite struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// compiledStage is a transformStage ready to apply
+type compiledStage struct {
+	stage    transformStage
+	rewrite  *regexp.Regexp
+	mappings []bodyMapping
+}
+
+type bodyMapping struct {
+	target   []string
+	template bodyTemplate
+}
+
+// routeTransform is a route's compiled pipeline
+type routeTransform struct {
+	request  *compiledStage
+	response *compiledStage
+}
+
+// transformRegistry holds the compiled pipelines, by route ID
+type transformRegistry struct {
+	mu         sync.RWMutex
+	transforms map[string]*routeTransform
+}
+
+func newTransformRegistry() *transformRegistry {
+	return &transformRegistry{transforms: make(map[string]*routeTransform)}
+}
+
+func (r *transformRegistry) get(routeID string) *routeTransform {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.transforms[routeID]
+}
+
+// compileStage validates and compiles a stage; an empty document is no stage
+func compileStage(raw string, request bool) (*compiledStage, error) {
+	if strings.TrimSpace(raw) == "" || strings.TrimSpace(raw) == "null" {
+		return nil, nil
+	}
+	var stage transformStage
+	if err := json.Unmarshal([]byte(raw), &stage); err != nil {
+		return nil, fmt.Errorf("invalid stage: %w", err)
+	}
+	compiled := &compiledStage{stage: stage}
+
+	if !request && (stage.PathRewrite != nil || len(stage.AddQuery) > 0) {
+		return nil, errors.New("path_rewrite and add_query only apply to requests")
+	}
+	if stage.PathRewrite != nil {
+		re, err := regexp.Compile(stage.PathRewrite.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path_rewrite pattern: %w", err)
+		}
+		compiled.rewrite = re
+	}
+	switch stage.BodyMode {
+	case "", BodyModeMerge, BodyModeReplace:
+	default:
+		return nil, errors.New("body_mode must be merge or replace")
+	}
+	for target, value := range stage.BodyMapping {
+		if target == "" {
+			return nil, errors.New("body_mapping targets must not be empty")
+		}
+		template, err := compileBodyTemplate(value)
+		if err != nil {
+			return nil, fmt.Errorf("body_mapping %q: %w", target, err)
+		}
+		compiled.mappings = append(compiled.mappings, bodyMapping{target: strings.Split(target, "."), template: template})
+	}
+	return compiled, nil
+}
+
+func compileRouteTransform(t *RouteTransformation) (*routeTransform, error) {
+	request, err := compileStage(t.Request, true)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	response, err := compileStage(t.Response, false)
+	if err != nil {
+		return nil, fmt.Errorf("response: %w", err)
+	}
+	if request == nil && response == nil {
+		return nil, nil
+	}
+	return &routeTransform{request: request, response: response}, nil
+}
+
+// syncTransforms compiles the pipelines of the routes; a stored pipeline
+// that no longer compiles is skipped rather than failing the route
+func (s *APIGatewayService) syncTransforms(routes []*APIRoute) {
+	transforms := make(map[string]*routeTransform)
+	for _, route := range routes {
+		if route.Transformation == nil {
+			continue
+		}
+		transform, err := compileRouteTransform(route.Transformation)
+		if err != nil {
+			log.Printf("Ignoring transformation of route %s: %v", route.ID, err)
+			continue
+		}
+		if transform != nil {
+			transforms[route.ID] = transform
+		}
+	}
+
+	s.transforms.mu.Lock()
+	s.transforms.transforms = transforms
+	s.transforms.mu.Unlock()
+}
+
+func applyHeaderOps(header http.Header, stage *transformStage) {
+	for _, name := range stage.RemoveHeaders {
+		header.Del(name)
+	}
+	for from, to := range stage.RenameHeaders {
+		if values, ok := header[http.CanonicalHeaderKey(from)]; ok {
+			header.Del(from)
+			for _, v := range values {
+				header.Add(to, v)
+			}
+		}
+	}
+	for name, value := range stage.AddHeaders {
+		header.Set(name, value)
+	}
+}
+
+// transformBody reshapes a JSON document; ok is false when the body was
+// left alone because it is not a JSON object
+func (cs *compiledStage) transformBody(body []byte) ([]byte, bool, error) {
+	if len(cs.mappings) == 0 && len(cs.stage.BodyRemove) == 0 {
+		return body, false, nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return body, false, nil
+	}
+
+	out, isObject := doc.(map[string]interface{})
+	if cs.stage.BodyMode == BodyModeReplace {
+		out, isObject = map[string]interface{}{}, true
+	}
+	if !isObject {
+		return body, false, nil
+	}
+
+	// Render from the original before removing anything, so a field can be
+	// moved by mapping it and removing its old name
+	values := make([]interface{}, len(cs.mappings))
+	found := make([]bool, len(cs.mappings))
+	for i, m := range cs.mappings {
+		values[i], found[i] = m.template.render(doc)
+	}
+	for _, field := range cs.stage.BodyRemove {
+		deleteField(out, strings.Split(field, "."))
+	}
+	for i, m := range cs.mappings {
+		if found[i] {
+			setField(out, m.target, values[i])
+		}
+	}
+
+	transformed, err := json.Marshal(out)
+	if err != nil {
+		return body, false, err
+	}
+	return transformed, true, nil
+}
+
+func isJSONContent(contentType string) bool {
+	return strings.Contains(strings.ToLower(contentType), "json")
+}
+
+// applyRequestTransform runs a route's request stage on the incoming request
+func applyRequestTransform(c *gin.Context, cs *compiledStage) error {
+	req := c.Request
+	applyHeaderOps(req.Header, &cs.stage)
+
+	if cs.rewrite != nil {
+		req.URL.Path = cs.rewrite.ReplaceAllString(req.URL.Path, cs.stage.PathRewrite.Replacement)
+		req.URL.RawPath = ""
+	}
+	if len(cs.stage.AddQuery) > 0 {
+		query := req.URL.Query()
+		for name, value := range cs.stage.AddQuery {
+			query.Set(name, value)
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+
+	if len(cs.mappings) == 0 && len(cs.stage.BodyRemove) == 0 {
+		return nil
+	}
+	if req.Body == nil || req.Body == http.NoBody || !isJSONContent(req.Header.Get("Content-Type")) {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxTransformBodySize+1))
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(body) > maxTransformBodySize {
+		return errors.New("request body too large to transform")
+	}
+	if transformed, ok, err := cs.transformBody(body); err != nil {
+		return err
+	} else if ok {
+		body = transformed
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// applyResponseTransform runs a route's response stage on the backend's
+// response. Compressed bodies are passed through untouched.
+func applyResponseTransform(resp *http.Response, cs *compiledStage) error {
+	applyHeaderOps(resp.Header, &cs.stage)
+
+	if len(cs.mappings) == 0 && len(cs.stage.BodyRemove) == 0 {
+		return nil
+	}
+	if !isJSONContent(resp.Header.Get("Content-Type")) || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTransformBodySize+1))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(body) > maxTransformBodySize {
+		return errors.New("response body too large to transform")
+	}
+	if transformed, ok, err := cs.transformBody(body); err != nil {
+		return err
+	} else if ok {
+		body = transformed
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// Get a route's transformation pipeline
+func (s *APIGatewayService) getRouteTransformation(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.Preload("Transformation").First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+	if route.Transformation == nil {
+		c.JSON(http.StatusOK, gin.H{"route_id": route.ID, "request": nil, "response": nil})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"route_id":   route.ID,
+		"request":    json.RawMessage(nonEmptyJSON(route.Transformation.Request)),
+		"response":   json.RawMessage(nonEmptyJSON(route.Transformation.Response)),
+		"updated_at": route.Transformation.UpdatedAt,
+	})
+}
+
+// Replace a route's transformation pipeline
+func (s *APIGatewayService) updateRouteTransformation(c *gin.Context) {
+	var route APIRoute
+	if err := s.db.First(&route, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	var req struct {
+		Request  json.RawMessage `json:"request"`
+		Response json.RawMessage `json:"response"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	transformation := RouteTransformation{
+		RouteID:   route.ID,
+		Request:   nonEmptyJSON(string(req.Request)),
+		Response:  nonEmptyJSON(string(req.Response)),
+		UpdatedAt: time.Now(),
+	}
+	if _, err := compileRouteTransform(&transformation); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&transformation).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save transformation"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"route_id":   route.ID,
+		"request":    json.RawMessage(transformation.Request),
+		"response":   json.RawMessage(transformation.Response),
+		"updated_at": transformation.UpdatedAt,
+	})
+}
+
+// Remove a route's transformation pipeline
+func (s *APIGatewayService) deleteRouteTransformation(c *gin.Context) {
+	if err := s.db.Delete(&RouteTransformation{}, "route_id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete transformation"})
+		return
+	}
+	if err := s.loadRoutes(); err != nil {
+		log.Printf("Failed to reload routes: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Transformation removed"})
+}
+
+func nonEmptyJSON(raw string) string {
+	if strings.TrimSpace(raw) == "" {
+		return "null"
+	}
+	return raw
+}
+
+// JSONPath subset: $, .field, ['field'] and [index]
+
+type jsonPath []interface{} // string keys and int indexes
+
+func parseJSONPath(expr string) (jsonPath, error) {
+	expr = strings.TrimSpace(expr)
+	if !strings.HasPrefix(expr, "$") {
+		return nil, errors.New("JSONPath must start with $")
+	}
+	path := jsonPath{}
+	rest := expr[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("empty field in %q", expr)
+			}
+			path = append(path, key)
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated [ in %q", expr)
+			}
+			inner := rest[1:end]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				path = append(path, inner[1:len(inner)-1])
+			} else if index, err := strconv.Atoi(inner); err == nil && index >= 0 {
+				path = append(path, index)
+			} else {
+				return nil, fmt.Errorf("invalid index %q in %q", inner, expr)
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q in %q", rest[0], expr)
+		}
+	}
+	return path, nil
+}
+
+func (p jsonPath) get(doc interface{}) (interface{}, bool) {
+	current := doc
+	for _, step := range p {
+		switch key := step.(type) {
+		case string:
+			object, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if current, ok = object[key]; !ok {
+				return nil, false
+			}
+		case int:
+			array, ok := current.([]interface{})
+			if !ok || key >= len(array) {
+				return nil, false
+			}
+			current = array[key]
+		}
+	}
+	return current, true
+}
+
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*(\$[^}]*?)\s*\}\}`)
+
+// bodyTemplate produces a mapped field's value from the source document
+type bodyTemplate struct {
+	literal interface{}
+	path    jsonPath   // a single expression, copied with its type
+	parts   []string   // interpolation: literal text around the paths
+	paths   []jsonPath // interpolation: one path between each pair of parts
+}
+
+func compileBodyTemplate(value interface{}) (bodyTemplate, error) {
+	text, ok := value.(string)
+	if !ok {
+		return bodyTemplate{literal: value}, nil
+	}
+	if path, err := parseJSONPath(text); err == nil {
+		return bodyTemplate{path: path}, nil
+	}
+
+	matches := templatePlaceholder.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return bodyTemplate{literal: text}, nil
+	}
+	var t bodyTemplate
+	last := 0
+	for _, m := range matches {
+		path, err := parseJSONPath(text[m[2]:m[3]])
+		if err != nil {
+			return bodyTemplate{}, err
+		}
+		t.parts = append(t.parts, text[last:m[0]])
+		t.paths = append(t.paths, path)
+		last = m[1]
+	}
+	t.parts = append(t.parts, text[last:])
+	return t, nil
+}
+
+// render evaluates the template; ok is false when a single-path template
+// finds nothing, so the field is left unset
+func (t bodyTemplate) render(doc interface{}) (interface{}, bool) {
+	switch {
+	case t.path != nil:
+		return t.path.get(doc)
+	case t.paths != nil:
+		var b strings.Builder
+		for i, path := range t.paths {
+			b.WriteString(t.parts[i])
+			if value, ok := path.get(doc); ok && value != nil {
+				if s, isString := value.(string); isString {
+					b.WriteString(s)
+				} else {
+					encoded, _ := json.Marshal(value)
+					b.Write(encoded)
+				}
+			}
+		}
+		b.WriteString(t.parts[len(t.parts)-1])
+		return b.String(), true
+	default:
+		return t.literal, true
+	}
+}
+
+// setField sets a dotted field, creating intermediate objects
+func setField(doc map[string]interface{}, path []string, value interface{}) {
+	current := doc
+	for _, key := range path[:len(path)-1] {
+		next, ok := current[key].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			current[key] = next
+		}
+		current = next
+	}
+	current[path[len(path)-1]] = value
+}
+
+func deleteField(doc map[string]interface{}, path []string) {
+	current := doc
+	for _, key := range path[:len(path)-1] {
+		next, ok := current[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		current = next
+	}
+	delete(current, path[len(path)-1])
+}
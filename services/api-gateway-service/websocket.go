@@ -0,0 +1,424 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/time/rate"
+)
+
+// WebSocket proxying. On a route with WebSocket set, an upgrade request is
+// authenticated and rate limited like any other request, then the gateway
+// dials the upstream endpoint, completes the handshake with the client
+// (passing the subprotocol the backend chose) and relays messages both
+// ways until either side closes. Close codes are passed through.
+//
+// Browsers cannot set headers on a WebSocket handshake, so credentials may
+// also come in the access_token (JWT) or api_key query parameters; they are
+// moved into headers and removed before the request goes upstream.
+//
+// Limits per route: WebSocketMaxConnections open connections on this
+// replica, WebSocketMessageRate messages per second from each client
+// (exceeding it closes the connection with 1008), and an idle timeout after
+// which a connection with no traffic either way is closed.
+
+const (
+	defaultWebSocketIdleTimeout = 300 // seconds
+	webSocketCloseGrace         = time.Second
+)
+
+// Why a proxied WebSocket connection ended
+const (
+	wsCloseClient      = "client"
+	wsCloseUpstream    = "upstream"
+	wsCloseIdle        = "idle_timeout"
+	wsCloseRateLimited = "rate_limited"
+	wsCloseShutdown    = "shutdown"
+)
+
+// Handshake headers the dialer sets itself
+var webSocketHandshakeHeaders = map[string]bool{
+	"Upgrade":                  true,
+	"Connection":               true,
+	"Sec-Websocket-Key":        true,
+	"Sec-Websocket-Version":    true,
+	"Sec-Websocket-Extensions": true,
+	"Sec-Websocket-Protocol":   true,
+	"Keep-Alive":               true,
+	"Te":                       true,
+	"Trailer":                  true,
+	"Transfer-Encoding":        true,
+	"Proxy-Authorization":      true,
+	"Proxy-Connection":         true,
+}
+
+var (
+	webSocketConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "api_gateway_websocket_connections",
+			Help: "Open proxied WebSocket connections",
+		},
+		[]string{"route", "service"},
+	)
+
+	webSocketConnectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_websocket_connections_total",
+			Help: "WebSocket connection attempts by outcome",
+		},
+		[]string{"route", "service", "result"},
+	)
+
+	webSocketMessages = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_gateway_websocket_messages_total",
+			Help: "WebSocket messages relayed",
+		},
+		[]string{"route", "direction"},
+	)
+
+	webSocketDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "api_gateway_websocket_connection_duration_seconds",
+			Help:    "Lifetime of proxied WebSocket connections",
+			Buckets: []float64{1, 10, 60, 300, 900, 1800, 3600, 7200, 14400},
+		},
+		[]string{"route", "close_reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(webSocketConnections)
+	prometheus.MustRegister(webSocketConnectionsTotal)
+	prometheus.MustRegister(webSocketMessages)
+	prometheus.MustRegister(webSocketDuration)
+}
+
+// wsSession is one proxied connection
+type wsSession struct {
+	client   *websocket.Conn
+	upstream *websocket.Conn
+	activity int64 // unix nanos of the last message either way
+	once     sync.Once
+	reason   string
+	done     chan struct{}
+}
+
+// touch records traffic on the connection
+func (ws *wsSession) touch() {
+	atomic.StoreInt64(&ws.activity, time.Now().UnixNano())
+}
+
+// close ends the session, telling both sides why
+func (ws *wsSession) close(reason string, code int, text string) {
+	ws.once.Do(func() {
+		ws.reason = reason
+		deadline := time.Now().Add(webSocketCloseGrace)
+		message := websocket.FormatCloseMessage(code, text)
+		ws.client.WriteControl(websocket.CloseMessage, message, deadline)
+		ws.upstream.WriteControl(websocket.CloseMessage, message, deadline)
+		ws.client.Close()
+		ws.upstream.Close()
+		close(ws.done)
+	})
+}
+
+// wsRegistry counts connections per route, so limits can be enforced, and
+// holds the open sessions so they can be closed on shutdown
+type wsRegistry struct {
+	mu       sync.Mutex
+	counts   map[string]int
+	sessions map[*wsSession]bool
+}
+
+func newWSRegistry() *wsRegistry {
+	return &wsRegistry{counts: make(map[string]int), sessions: make(map[*wsSession]bool)}
+}
+
+// reserve claims a connection slot on a route; limit 0 is unlimited
+func (r *wsRegistry) reserve(routeID string, limit int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if limit > 0 && r.counts[routeID] >= limit {
+		return false
+	}
+	r.counts[routeID]++
+	return true
+}
+
+func (r *wsRegistry) release(routeID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.counts[routeID]--; r.counts[routeID] <= 0 {
+		delete(r.counts, routeID)
+	}
+}
+
+func (r *wsRegistry) track(ws *wsSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[ws] = true
+}
+
+func (r *wsRegistry) untrack(ws *wsSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, ws)
+}
+
+// closeAll ends every open session
+func (r *wsRegistry) closeAll() {
+	r.mu.Lock()
+	all := make([]*wsSession, 0, len(r.sessions))
+	for ws := range r.sessions {
+		all = append(all, ws)
+	}
+	r.mu.Unlock()
+
+	for _, ws := range all {
+		ws.close(wsCloseShutdown, websocket.CloseGoingAway, "gateway shutting down")
+	}
+}
+
+// The /ws endpoint is routed like any other path, to a route with
+// WebSocket set
+func (s *APIGatewayService) handleWebSocket(c *gin.Context) {
+	s.proxyHandler(c)
+}
+
+// webSocketCredentials moves credentials from the query string into the
+// headers authentication reads
+func webSocketCredentials(req *http.Request) {
+	query := req.URL.Query()
+	token, key := query.Get("access_token"), query.Get("api_key")
+	if token == "" && key == "" {
+		return
+	}
+	if key != "" && req.Header.Get("X-API-Key") == "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	if token != "" && req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	query.Del("access_token")
+	query.Del("api_key")
+	req.URL.RawQuery = query.Encode()
+}
+
+// webSocketURL maps the client's request onto an endpoint's ws(s) URL
+func webSocketURL(target, inbound *url.URL) *url.URL {
+	out := upstreamURL(target, inbound)
+	switch out.Scheme {
+	case "https":
+		out.Scheme = "wss"
+	case "http":
+		out.Scheme = "ws"
+	}
+	return out
+}
+
+// Proxy a WebSocket connection to the route's backend
+func (s *APIGatewayService) proxyWebSocket(c *gin.Context, route *APIRoute, requestID string, startTime time.Time) {
+	var pool *upstreamPool
+	var endpoint *upstream
+	if version := s.selectVersion(c, route); version != nil {
+		c.Set("route_version", version.name)
+		pool, endpoint = version.pool, version.pool.pick()
+	} else {
+		pool, endpoint = s.pickUpstream(c.Request.Context(), route)
+	}
+	if endpoint == nil {
+		webSocketConnectionsTotal.WithLabelValues(route.ID, route.ServiceName, "no_upstream").Inc()
+		s.logRequest(c, requestID, route.ServiceName, http.StatusServiceUnavailable, time.Since(startTime), "No upstream available")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service unavailable"})
+		return
+	}
+
+	if !s.webSockets.reserve(route.ID, route.WebSocketMaxConnections) {
+		webSocketConnectionsTotal.WithLabelValues(route.ID, route.ServiceName, "limit_exceeded").Inc()
+		s.logRequest(c, requestID, route.ServiceName, http.StatusServiceUnavailable, time.Since(startTime), "WebSocket connection limit reached")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many open connections"})
+		return
+	}
+	defer s.webSockets.release(route.ID)
+
+	// Dial the backend first, so a failure can still be answered over HTTP
+	header := http.Header{}
+	for name, values := range c.Request.Header {
+		if !webSocketHandshakeHeaders[http.CanonicalHeaderKey(name)] {
+			header[name] = values
+		}
+	}
+	header.Set("X-Request-ID", requestID)
+	header.Set("X-Forwarded-For", c.ClientIP())
+	header.Set("X-Gateway-Service", "002aic-api-gateway")
+	setClientIdentityHeader(c, header)
+	if userID := c.GetString("user_id"); userID != "" {
+		header.Set("X-User-ID", userID)
+	}
+	otel.GetTextMapPropagator().Inject(c.Request.Context(), propagation.HeaderCarrier(header))
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: time.Duration(route.Timeout) * time.Second,
+		Subprotocols:     websocket.Subprotocols(c.Request),
+		TLSClientConfig:  s.dialUpstreamTLS(route),
+	}
+	target := webSocketURL(endpoint.target, c.Request.URL)
+	upstreamConn, resp, err := dialer.DialContext(c.Request.Context(), target.String(), header)
+	if err != nil {
+		pool.report(endpoint, false, s.config.UpstreamEjectionThreshold, s.config.UpstreamEjectionDuration)
+		upstreamRequests.WithLabelValues(route.ServiceName, endpoint.target.Host, upstreamResult(false)).Inc()
+		webSocketConnectionsTotal.WithLabelValues(route.ID, route.ServiceName, "upstream_failed").Inc()
+
+		status := http.StatusBadGateway
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			// The backend refused the upgrade; pass its answer on
+			status = resp.StatusCode
+		}
+		s.logRequest(c, requestID, route.ServiceName, status, time.Since(startTime), "WebSocket upstream handshake failed: "+err.Error())
+		c.JSON(status, gin.H{"error": "Upstream WebSocket handshake failed"})
+		return
+	}
+	pool.report(endpoint, true, s.config.UpstreamEjectionThreshold, s.config.UpstreamEjectionDuration)
+	upstreamRequests.WithLabelValues(route.ServiceName, endpoint.target.Host, upstreamResult(true)).Inc()
+
+	responseHeader := http.Header{}
+	responseHeader.Set("X-Request-ID", requestID)
+	if version := c.GetString("route_version"); version != "" {
+		responseHeader.Set(routeVersionHeader, version)
+	}
+	if protocol := upstreamConn.Subprotocol(); protocol != "" {
+		responseHeader.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	clientConn, err := s.upgrader.Upgrade(c.Writer, c.Request, responseHeader)
+	if err != nil {
+		// The upgrader has already answered the client
+		upstreamConn.Close()
+		webSocketConnectionsTotal.WithLabelValues(route.ID, route.ServiceName, "upgrade_failed").Inc()
+		s.logRequest(c, requestID, route.ServiceName, http.StatusBadRequest, time.Since(startTime), "WebSocket upgrade failed: "+err.Error())
+		return
+	}
+
+	ws := &wsSession{client: clientConn, upstream: upstreamConn, done: make(chan struct{})}
+	ws.touch()
+	s.webSockets.track(ws)
+	defer s.webSockets.untrack(ws)
+	webSocketConnectionsTotal.WithLabelValues(route.ID, route.ServiceName, "accepted").Inc()
+	webSocketConnections.WithLabelValues(route.ID, route.ServiceName).Inc()
+	atomic.AddInt64(&endpoint.active, 1)
+	upstreamActiveConnections.WithLabelValues(route.ServiceName, endpoint.target.Host).Inc()
+	connected := time.Now()
+	defer func() {
+		atomic.AddInt64(&endpoint.active, -1)
+		upstreamActiveConnections.WithLabelValues(route.ServiceName, endpoint.target.Host).Dec()
+		webSocketConnections.WithLabelValues(route.ID, route.ServiceName).Dec()
+		webSocketDuration.WithLabelValues(route.ID, ws.reason).Observe(time.Since(connected).Seconds())
+		s.logRequest(c, requestID, route.ServiceName, http.StatusSwitchingProtocols, time.Since(startTime), "WebSocket closed: "+ws.reason)
+	}()
+
+	// Pings count as traffic; they are answered here rather than relayed
+	for _, conn := range []*websocket.Conn{clientConn, upstreamConn} {
+		conn := conn
+		conn.SetPingHandler(func(data string) error {
+			ws.touch()
+			err := conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(webSocketCloseGrace))
+			if err == websocket.ErrCloseSent {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil
+			}
+			return err
+		})
+		conn.SetPongHandler(func(string) error {
+			ws.touch()
+			return nil
+		})
+	}
+
+	var limiter *rate.Limiter
+	if route.WebSocketMessageRate > 0 {
+		limiter = rate.NewLimiter(rate.Limit(route.WebSocketMessageRate), route.WebSocketMessageRate*2)
+	}
+	go s.relayWebSocket(ws, route, clientConn, upstreamConn, "client_to_upstream", wsCloseClient, limiter)
+	go s.relayWebSocket(ws, route, upstreamConn, clientConn, "upstream_to_client", wsCloseUpstream, nil)
+
+	idleTimeout := time.Duration(route.WebSocketIdleTimeout) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = defaultWebSocketIdleTimeout * time.Second
+	}
+	ticker := time.NewTicker(idleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ws.done:
+			return
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&ws.activity))
+			if time.Since(last) > idleTimeout {
+				ws.close(wsCloseIdle, websocket.CloseGoingAway, "idle timeout")
+			}
+		}
+	}
+}
+
+// relayWebSocket copies messages from src to dst until either fails
+func (s *APIGatewayService) relayWebSocket(ws *wsSession, route *APIRoute, src, dst *websocket.Conn, direction, side string, limiter *rate.Limiter) {
+	for {
+		messageType, data, err := src.ReadMessage()
+		if err != nil {
+			// Pass the closing side's code on to the other side
+			code, text := websocket.CloseNormalClosure, ""
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				code, text = closeErr.Code, closeErr.Text
+				if code == websocket.CloseNoStatusReceived || code == websocket.CloseAbnormalClosure {
+					code = websocket.CloseNormalClosure
+				}
+			} else if side == wsCloseUpstream {
+				code = websocket.CloseInternalServerErr
+			}
+			ws.close(side, code, text)
+			return
+		}
+		if limiter != nil && !limiter.Allow() {
+			ws.close(wsCloseRateLimited, websocket.ClosePolicyViolation, "message rate limit exceeded")
+			return
+		}
+
+		ws.touch()
+		if err := dst.WriteMessage(messageType, data); err != nil {
+			ws.close(side, websocket.CloseGoingAway, "")
+			return
+		}
+		webSocketMessages.WithLabelValues(route.ID, direction).Inc()
+	}
+}
+
+// isWebSocketRequest reports whether the request asks for a WebSocket
+// upgrade
+func isWebSocketRequest(req *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(req) && strings.EqualFold(req.Method, http.MethodGet)
+}
+
+// closeWebSockets closes proxied connections when the gateway stops
+func (s *APIGatewayService) closeWebSockets() {
+	s.webSockets.closeAll()
+	log.Printf("🔌 Closed proxied WebSocket connections")
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Backup agents run next to customer-managed databases and file systems
+// outside the cluster. An agent registers once with the shared registration
+// key and receives its own token. It then polls for backup jobs assigned to
+// it (BackupJob.AgentID), uploads the backup in numbered chunks, reports
+// progress, and completes the job. Completion assembles the chunks into a
+// BackupFile, so agent backups follow the same retention and recovery paths
+// as in-cluster ones.
+
+// Agent status
+const (
+	AgentStatusOnline   = "online"
+	AgentStatusOffline  = "offline"
+	AgentStatusDisabled = "disabled"
+)
+
+const (
+	contextAgent = "backup_agent"
+
+	// Longest a job poll may wait for work
+	maxAgentPollWait = 30 * time.Second
+)
+
+type BackupAgent struct {
+	ID           string                 `json:"id" gorm:"primaryKey"`
+	Name         string                 `json:"name" gorm:"not null"`
+	Hostname     string                 `json:"hostname"`
+	Version      string                 `json:"version"`
+	Platform     string                 `json:"platform"`
+	Capabilities []string               `json:"capabilities" gorm:"type:text[]"` // postgres, mysql, filesystem, ...
+	Labels       map[string]interface{} `json:"labels" gorm:"type:jsonb"`
+	TokenHash    string                 `json:"-" gorm:"uniqueIndex"`
+	Status       string                 `json:"status" gorm:"index"`
+	LastSeenAt   *time.Time             `json:"last_seen_at"`
+	CreatedAt    time.Time              `json:"created_at"`
+	UpdatedAt    time.Time              `json:"updated_at"`
+}
+
+// BackupChunk is one uploaded piece of an agent backup
+type BackupChunk struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	JobID     string    `json:"job_id" gorm:"uniqueIndex:idx_backup_chunk_job_index"`
+	Index     int       `json:"index" gorm:"column:chunk_index;uniqueIndex:idx_backup_chunk_job_index"`
+	Size      int64     `json:"size"`
+	Checksum  string    `json:"checksum"`
+	Path      string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var agentChunkBytes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "backup_agent_uploaded_bytes_total",
+		Help: "Backup data uploaded by agents",
+	},
+	[]string{"agent"},
+)
+
+func init() {
+	prometheus.MustRegister(agentChunkBytes)
+}
+
+func hashAgentToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAgentToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "bka_" + hex.EncodeToString(buf), nil
+}
+
+func (s *BackupService) agentChunkDir(jobID string) string {
+	return filepath.Join(s.config.BackupStoragePath, "agent-uploads", jobID)
+}
+
+// agentAuth authenticates agent calls by their bearer token
+func (s *BackupService) agentAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Agent token required"})
+			return
+		}
+
+		var agent BackupAgent
+		if err := s.db.First(&agent, "token_hash = ?", hashAgentToken(strings.TrimPrefix(header, "Bearer "))).Error; err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid agent token"})
+			return
+		}
+		if agent.Status == AgentStatusDisabled {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Agent is disabled"})
+			return
+		}
+
+		// Any authenticated call counts as a heartbeat
+		now := time.Now().UTC()
+		s.db.Model(&agent).Updates(map[string]interface{}{"status": AgentStatusOnline, "last_seen_at": now})
+		agent.Status = AgentStatusOnline
+		agent.LastSeenAt = &now
+
+		c.Set(contextAgent, &agent)
+		c.Next()
+	}
+}
+
+func currentAgent(c *gin.Context) *BackupAgent {
+	return c.MustGet(contextAgent).(*BackupAgent)
+}
+
+// agentJob loads a running job owned by the calling agent
+func (s *BackupService) agentJob(c *gin.Context) *BackupJob {
+	var job BackupJob
+	if err := s.db.First(&job, "id = ? AND agent_id = ?", c.Param("id"), currentAgent(c).ID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return nil
+	}
+	if job.Status != BackupStatusRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job is not running", "status": job.Status})
+		return nil
+	}
+	return &job
+}
+
+// Register an agent
+func (s *BackupService) registerAgent(c *gin.Context) {
+	if s.config.AgentRegistrationKey == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Agent registration is disabled"})
+		return
+	}
+	key := c.GetHeader("X-Registration-Key")
+	if subtle.ConstantTimeCompare([]byte(key), []byte(s.config.AgentRegistrationKey)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid registration key"})
+		return
+	}
+
+	var req struct {
+		Name         string                 `json:"name" binding:"required"`
+		Hostname     string                 `json:"hostname"`
+		Version      string                 `json:"version"`
+		Platform     string                 `json:"platform"`
+		Capabilities []string               `json:"capabilities"`
+		Labels       map[string]interface{} `json:"labels"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := newAgentToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue agent token"})
+		return
+	}
+
+	now := time.Now().UTC()
+	agent := &BackupAgent{
+		ID:           uuid.New().String(),
+		Name:         req.Name,
+		Hostname:     req.Hostname,
+		Version:      req.Version,
+		Platform:     req.Platform,
+		Capabilities: req.Capabilities,
+		Labels:       req.Labels,
+		TokenHash:    hashAgentToken(token),
+		Status:       AgentStatusOnline,
+		LastSeenAt:   &now,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := s.db.Create(agent).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register agent"})
+		return
+	}
+
+	log.Printf("Backup agent %s registered from %s", agent.Name, agent.Hostname)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"agent":              agent,
+		"token":              token,
+		"max_chunk_size":     s.config.AgentMaxChunkSize,
+		"heartbeat_interval": int(s.config.AgentHeartbeatTimeout.Seconds() / 3),
+	})
+}
+
+// Heartbeat from an agent
+func (s *BackupService) agentHeartbeat(c *gin.Context) {
+	agent := currentAgent(c)
+
+	var req struct {
+		Version string `json:"version"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Version != "" && req.Version != agent.Version {
+		s.db.Model(agent).Update("version", req.Version)
+	}
+
+	var pending int64
+	s.db.Model(&BackupJob{}).Where("agent_id = ? AND status = ?", agent.ID, BackupStatusPending).Count(&pending)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":       agent.Status,
+		"pending_jobs": pending,
+	})
+}
+
+// claimAgentJob atomically moves the agent's oldest pending job to running
+func (s *BackupService) claimAgentJob(agentID string) (*BackupJob, error) {
+	var job BackupJob
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("agent_id = ? AND status = ? AND is_active = ?", agentID, BackupStatusPending, true).
+			Order("created_at ASC").First(&job).Error; err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		job.Status = BackupStatusRunning
+		job.Progress = 0
+		job.ErrorMessage = ""
+		job.StartedAt = &now
+		job.CompletedAt = nil
+		job.UpdatedAt = now
+		return tx.Save(&job).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Hand the next job to an agent, waiting up to ?wait= seconds for one
+func (s *BackupService) pollAgentJob(c *gin.Context) {
+	agent := currentAgent(c)
+
+	wait, _ := strconv.Atoi(c.DefaultQuery("wait", "0"))
+	deadline := time.Now().Add(time.Duration(wait) * time.Second)
+	if latest := time.Now().Add(maxAgentPollWait); deadline.After(latest) {
+		deadline = latest
+	}
+
+	for {
+		job, err := s.claimAgentJob(agent.ID)
+		if err == nil {
+			backupJobsTotal.WithLabelValues(job.Type, BackupStatusRunning).Inc()
+			c.JSON(http.StatusOK, gin.H{
+				"job":            job,
+				"max_chunk_size": s.config.AgentMaxChunkSize,
+				"upload_url":     fmt.Sprintf("/v1/agent/jobs/%s/chunks/{index}", job.ID),
+			})
+			return
+		}
+		if err != gorm.ErrRecordNotFound {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch jobs"})
+			return
+		}
+		if time.Now().After(deadline) {
+			c.Status(http.StatusNoContent)
+			return
+		}
+
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// Receive one chunk of backup data. Re-sending an index replaces it, so
+// agents can retry failed uploads.
+func (s *BackupService) uploadAgentChunk(c *gin.Context) {
+	job := s.agentJob(c)
+	if job == nil {
+		return
+	}
+
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil || index < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Chunk index must be a non-negative integer"})
+		return
+	}
+	if c.Request.ContentLength > s.config.AgentMaxChunkSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Chunk too large", "max_chunk_size": s.config.AgentMaxChunkSize})
+		return
+	}
+
+	dir := s.agentChunkDir(job.ID)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare upload storage"})
+		return
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%08d.part", index))
+	tmp := path + ".tmp"
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
+		return
+	}
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hasher), http.MaxBytesReader(c.Writer, c.Request.Body, s.config.AgentMaxChunkSize))
+	file.Close()
+	if err != nil {
+		os.Remove(tmp)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read chunk: " + err.Error()})
+		return
+	}
+
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if expected := c.GetHeader("X-Chunk-Checksum"); expected != "" && !strings.EqualFold(expected, checksum) {
+		os.Remove(tmp)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Chunk checksum mismatch", "checksum": checksum})
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store chunk"})
+		return
+	}
+
+	chunk := &BackupChunk{
+		ID:        uuid.New().String(),
+		JobID:     job.ID,
+		Index:     index,
+		Size:      size,
+		Checksum:  checksum,
+		Path:      path,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "job_id"}, {Name: "chunk_index"}},
+		DoUpdates: clause.AssignmentColumns([]string{"size", "checksum", "path", "created_at"}),
+	}).Create(chunk).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record chunk"})
+		return
+	}
+	agentChunkBytes.WithLabelValues(currentAgent(c).Name).Add(float64(size))
+
+	c.JSON(http.StatusCreated, gin.H{
+		"index":    index,
+		"size":     size,
+		"checksum": checksum,
+	})
+}
+
+// Progress report from an agent. The response tells the agent whether the
+// job was cancelled meanwhile.
+func (s *BackupService) reportAgentProgress(c *gin.Context) {
+	var job BackupJob
+	if err := s.db.First(&job, "id = ? AND agent_id = ?", c.Param("id"), currentAgent(c).ID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if job.Status == BackupStatusCancelled {
+		c.JSON(http.StatusOK, gin.H{"cancel": true})
+		return
+	}
+	if job.Status != BackupStatusRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job is not running", "status": job.Status})
+		return
+	}
+
+	var req struct {
+		Progress       float64 `json:"progress" binding:"min=0,max=100"`
+		BytesProcessed int64   `json:"bytes_processed"`
+		Message        string  `json:"message"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	updates := map[string]interface{}{
+		"progress":   req.Progress,
+		"updated_at": time.Now().UTC(),
+	}
+	if req.BytesProcessed > 0 {
+		updates["size"] = req.BytesProcessed
+	}
+	s.db.Model(&job).Updates(updates)
+
+	if req.Message != "" {
+		s.redis.Set(c.Request.Context(), "backup_job_message:"+job.ID, req.Message, 24*time.Hour)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"cancel": false})
+}
+
+// Finish an agent backup: verify and assemble the chunks into a BackupFile
+func (s *BackupService) completeAgentJob(c *gin.Context) {
+	job := s.agentJob(c)
+	if job == nil {
+		return
+	}
+
+	var req struct {
+		TotalChunks  int                    `json:"total_chunks" binding:"required,min=1"`
+		Filename     string                 `json:"filename"`
+		Checksum     string                 `json:"checksum"` // SHA-256 of the whole backup
+		OriginalSize int64                  `json:"original_size"`
+		Compressed   bool                   `json:"compressed"`
+		Encrypted    bool                   `json:"encrypted"`
+		Metadata     map[string]interface{} `json:"metadata"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var chunks []BackupChunk
+	s.db.Where("job_id = ?", job.ID).Order("chunk_index ASC").Find(&chunks)
+	var missing []int
+	for i, next := 0, 0; next < req.TotalChunks; next++ {
+		if i < len(chunks) && chunks[i].Index == next {
+			i++
+			continue
+		}
+		missing = append(missing, next)
+	}
+	if len(missing) > 0 || len(chunks) != req.TotalChunks {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":          "Backup is incomplete",
+			"missing_chunks": missing,
+			"received":       len(chunks),
+		})
+		return
+	}
+
+	filename := filepath.Base(req.Filename)
+	if filename == "" || filename == "." || filename == "/" {
+		filename = fmt.Sprintf("%s-%s.bak", job.Name, time.Now().UTC().Format("20060102T150405Z"))
+	}
+	dir := filepath.Join(s.config.BackupStoragePath, job.ID)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare backup storage"})
+		return
+	}
+	path := filepath.Join(dir, filename)
+
+	size, checksum, err := assembleChunks(path, chunks)
+	if err != nil {
+		os.Remove(path)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to assemble backup: " + err.Error()})
+		return
+	}
+	if req.Checksum != "" && !strings.EqualFold(req.Checksum, checksum) {
+		os.Remove(path)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Backup checksum mismatch", "checksum": checksum})
+		return
+	}
+
+	now := time.Now().UTC()
+	expiresAt := now.AddDate(0, 0, s.config.RetentionDays)
+	metadata := req.Metadata
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	metadata["agent_id"] = currentAgent(c).ID
+	metadata["chunks"] = len(chunks)
+
+	backupFile := &BackupFile{
+		ID:          uuid.New().String(),
+		JobID:       job.ID,
+		Filename:    filename,
+		Path:        path,
+		Size:        size,
+		Checksum:    checksum,
+		Encrypted:   req.Encrypted,
+		Compressed:  req.Compressed,
+		StorageType: StorageTypeLocal,
+		Metadata:    metadata,
+		ExpiresAt:   &expiresAt,
+		CreatedAt:   now,
+	}
+
+	// Move the assembled backup into the deduplicated store
+	var manifest []BackupManifestEntry
+	if s.dedupEnabled(job) {
+		in, err := os.Open(path)
+		if err != nil {
+			os.Remove(path)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read assembled backup"})
+			return
+		}
+		entries, stats, err := s.ingestDedup(c.Request.Context(), backupFile.ID, in)
+		in.Close()
+		if err != nil {
+			os.Remove(path)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store backup: " + err.Error()})
+			return
+		}
+		manifest = entries
+		backupFile.StorageType = StorageTypeDedup
+		backupFile.Path = "dedup://" + backupFile.ID
+		metadata["dedup"] = stats
+	}
+
+	originalSize := req.OriginalSize
+	if originalSize == 0 {
+		originalSize = size
+	}
+	var duration int64
+	if job.StartedAt != nil {
+		duration = int64(now.Sub(*job.StartedAt).Seconds())
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(backupFile).Error; err != nil {
+			return err
+		}
+		if len(manifest) > 0 {
+			if err := tx.CreateInBatches(manifest, 1000).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("job_id = ?", job.ID).Delete(&BackupChunk{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(job).Updates(map[string]interface{}{
+			"status":          BackupStatusCompleted,
+			"progress":        100,
+			"size":            originalSize,
+			"compressed_size": size,
+			"completed_at":    now,
+			"duration":        duration,
+			"updated_at":      now,
+		}).Error
+	})
+	if err != nil {
+		os.Remove(path)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record backup"})
+		return
+	}
+	os.RemoveAll(s.agentChunkDir(job.ID))
+	if backupFile.StorageType == StorageTypeDedup {
+		os.Remove(path)
+	}
+
+	backupDuration.WithLabelValues(job.ID, job.Type).Observe(float64(duration))
+	backupSize.WithLabelValues(job.Type).Observe(float64(size))
+	backupJobsTotal.WithLabelValues(job.Type, BackupStatusCompleted).Inc()
+
+	c.JSON(http.StatusOK, gin.H{
+		"job_id":      job.ID,
+		"backup_file": backupFile,
+	})
+}
+
+// assembleChunks concatenates chunks into path, returning size and SHA-256
+func assembleChunks(path string, chunks []BackupChunk) (int64, string, error) {
+	out, err := os.Create(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer out.Close()
+
+	hasher := sha256.New()
+	writer := io.MultiWriter(out, hasher)
+	var total int64
+	for _, chunk := range chunks {
+		in, err := os.Open(chunk.Path)
+		if err != nil {
+			return 0, "", fmt.Errorf("chunk %d: %w", chunk.Index, err)
+		}
+		n, err := io.Copy(writer, in)
+		in.Close()
+		if err != nil {
+			return 0, "", fmt.Errorf("chunk %d: %w", chunk.Index, err)
+		}
+		total += n
+	}
+	if err := out.Sync(); err != nil {
+		return 0, "", err
+	}
+	return total, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Report a failed agent backup
+func (s *BackupService) failAgentJob(c *gin.Context) {
+	job := s.agentJob(c)
+	if job == nil {
+		return
+	}
+
+	var req struct {
+		Error string `json:"error" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now().UTC()
+	s.db.Model(job).Updates(map[string]interface{}{
+		"status":        BackupStatusFailed,
+		"error_message": req.Error,
+		"completed_at":  now,
+		"updated_at":    now,
+	})
+	s.db.Where("job_id = ?", job.ID).Delete(&BackupChunk{})
+	os.RemoveAll(s.agentChunkDir(job.ID))
+	backupJobsTotal.WithLabelValues(job.Type, BackupStatusFailed).Inc()
+
+	c.JSON(http.StatusOK, gin.H{"job_id": job.ID, "status": BackupStatusFailed})
+}
+
+// List registered agents
+func (s *BackupService) listAgents(c *gin.Context) {
+	query := s.db.Model(&BackupAgent{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var agents []BackupAgent
+	if err := query.Order("name ASC").Find(&agents).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list agents"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"agents": agents,
+		"count":  len(agents),
+	})
+}
+
+// Get an agent with its recent jobs
+func (s *BackupService) getAgent(c *gin.Context) {
+	var agent BackupAgent
+	if err := s.db.First(&agent, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
+
+	var jobs []BackupJob
+	s.db.Where("agent_id = ?", agent.ID).Order("updated_at DESC").Limit(20).Find(&jobs)
+
+	c.JSON(http.StatusOK, gin.H{
+		"agent": agent,
+		"jobs":  jobs,
+	})
+}
+
+// Disable an agent; its token stops working and its pending jobs stay queued
+func (s *BackupService) disableAgent(c *gin.Context) {
+	result := s.db.Model(&BackupAgent{}).Where("id = ?", c.Param("id")).
+		Updates(map[string]interface{}{"status": AgentStatusDisabled, "updated_at": time.Now().UTC()})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable agent"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Agent disabled"})
+}
+
+// Mark agents offline when they stop calling in
+func (s *BackupService) startAgentMonitor() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cutoff := time.Now().UTC().Add(-s.config.AgentHeartbeatTimeout)
+			result := s.db.Model(&BackupAgent{}).
+				Where("status = ? AND last_seen_at < ?", AgentStatusOnline, cutoff).
+				Update("status", AgentStatusOffline)
+			if result.RowsAffected > 0 {
+				log.Printf("Marked %d backup agents offline", result.RowsAffected)
+			}
+		}
+	}
+}
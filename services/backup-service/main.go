@@ -40,6 +40,20 @@ type Config struct {
 	BackupInterval      time.Duration
 	MaxConcurrentBackups int
 	Environment         string
+	AgentRegistrationKey  string
+	AgentMaxChunkSize     int64
+	AgentHeartbeatTimeout time.Duration
+	S3Endpoint            string
+	S3AccessKey           string
+	S3SecretKey           string
+	S3UseSSL              bool
+	DedupEnabled          bool
+	DedupAvgChunkSize     int
+	DedupGCInterval       time.Duration
+	DedupGCGrace          time.Duration
+	SelftestDatabaseURL   string
+	SelftestRedisURL      string
+	SelftestTimeout       time.Duration
 }
 
 // Backup types
@@ -87,6 +101,7 @@ type BackupJob struct {
 	Metadata        map[string]interface{} `json:"metadata" gorm:"type:jsonb"`
 	RetentionPolicy string                 `json:"retention_policy"`
 	IsActive        bool                   `json:"is_active" gorm:"default:true"`
+	AgentID         string                 `json:"agent_id,omitempty" gorm:"index"` // run by an external backup agent
 	CreatedBy       string                 `json:"created_by"`
 	CreatedAt       time.Time              `json:"created_at"`
 	UpdatedAt       time.Time              `json:"updated_at"`
@@ -135,6 +150,7 @@ type BackupService struct {
 	config     *Config
 	router     *gin.Engine
 	httpServer *http.Server
+	chunks     chunkStore
 }
 
 // Prometheus metrics
@@ -200,6 +216,20 @@ func main() {
 		BackupInterval:       time.Duration(parseInt(getEnv("BACKUP_INTERVAL", "3600"))) * time.Second,
 		MaxConcurrentBackups: parseInt(getEnv("MAX_CONCURRENT_BACKUPS", "3")),
 		Environment:          getEnv("ENVIRONMENT", "development"),
+		AgentRegistrationKey:  getEnv("AGENT_REGISTRATION_KEY", ""),
+		AgentMaxChunkSize:     int64(parseInt(getEnv("AGENT_MAX_CHUNK_SIZE_MB", "64"))) << 20,
+		AgentHeartbeatTimeout: time.Duration(parseInt(getEnv("AGENT_HEARTBEAT_TIMEOUT", "180"))) * time.Second,
+		S3Endpoint:            getEnv("S3_ENDPOINT", ""),
+		S3AccessKey:           getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey:           getEnv("S3_SECRET_KEY", ""),
+		S3UseSSL:              getEnv("S3_USE_SSL", "true") == "true",
+		DedupEnabled:          getEnv("DEDUP_ENABLED", "true") == "true",
+		DedupAvgChunkSize:     parseInt(getEnv("DEDUP_AVG_CHUNK_KB", "1024")) << 10,
+		DedupGCInterval:       time.Duration(parseInt(getEnv("DEDUP_GC_INTERVAL_HOURS", "24"))) * time.Hour,
+		DedupGCGrace:          time.Duration(parseInt(getEnv("DEDUP_GC_GRACE_HOURS", "24"))) * time.Hour,
+		SelftestDatabaseURL:   getEnv("SELFTEST_DATABASE_URL", ""),
+		SelftestRedisURL:      getEnv("SELFTEST_REDIS_URL", ""),
+		SelftestTimeout:       time.Duration(parseInt(getEnv("SELFTEST_TIMEOUT", "120"))) * time.Second,
 	}
 
 	service, err := NewBackupService(config)
@@ -222,7 +252,7 @@ func NewBackupService(config *Config) (*BackupService, error) {
 	}
 
 	// Auto-migrate tables
-	if err := db.AutoMigrate(&BackupJob{}, &BackupFile{}, &RecoveryJob{}); err != nil {
+	if err := db.AutoMigrate(&BackupJob{}, &BackupFile{}, &RecoveryJob{}, &BackupAgent{}, &BackupChunk{}, &DedupChunk{}, &BackupManifestEntry{}); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
@@ -245,10 +275,17 @@ func NewBackupService(config *Config) (*BackupService, error) {
 		return nil, fmt.Errorf("failed to create backup storage directory: %w", err)
 	}
 
+	// Initialize deduplicated chunk store
+	chunks, err := initChunkStore(config)
+	if err != nil {
+		return nil, err
+	}
+
 	service := &BackupService{
 		db:     db,
 		redis:  redisClient,
 		config: config,
+		chunks: chunks,
 	}
 
 	service.setupRoutes()
@@ -304,10 +341,35 @@ func (s *BackupService) setupRoutes() {
 		v1.POST("/backup/validate/:id", s.validateBackup)
 		v1.GET("/backup/integrity/:id", s.checkBackupIntegrity)
 
+		// Pipeline self-test
+		v1.POST("/backup/selftest", s.runSelftest)
+		v1.GET("/backup/selftest", s.getSelftestReport)
+
 		// Analytics
 		v1.GET("/analytics/backup", s.getBackupAnalytics)
 		v1.GET("/analytics/storage", s.getStorageAnalytics)
 		v1.GET("/analytics/recovery", s.getRecoveryAnalytics)
+
+		// Deduplicated store
+		v1.GET("/dedup/stats", s.getDedupStats)
+		v1.POST("/dedup/gc", s.triggerDedupGC)
+
+		// Backup agents
+		v1.POST("/agents/register", s.registerAgent)
+		v1.GET("/agents", s.listAgents)
+		v1.GET("/agents/:id", s.getAgent)
+		v1.DELETE("/agents/:id", s.disableAgent)
+	}
+
+	// Agent protocol, authenticated by agent token
+	agent := s.router.Group("/v1/agent", s.agentAuth())
+	{
+		agent.POST("/heartbeat", s.agentHeartbeat)
+		agent.GET("/jobs/next", s.pollAgentJob)
+		agent.PUT("/jobs/:id/chunks/:index", s.uploadAgentChunk)
+		agent.POST("/jobs/:id/progress", s.reportAgentProgress)
+		agent.POST("/jobs/:id/complete", s.completeAgentJob)
+		agent.POST("/jobs/:id/fail", s.failAgentJob)
 	}
 }
 
@@ -318,6 +380,8 @@ func (s *BackupService) Start() error {
 	go s.startRecoveryWorker()
 	go s.startCleanupWorker()
 	go s.startMetricsUpdater()
+	go s.startAgentMonitor()
+	go s.startDedupGCWorker()
 
 	// Start HTTP server
 	s.httpServer = &http.Server{
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Backup self-test. POST /v1/backup/selftest runs a miniature backup and
+// restore through the same pieces real jobs use, so operators can check
+// that the whole pipeline works in their environment: it seeds a throwaway
+// Postgres schema and a few Redis keys, backs them up with pg_dump and
+// DUMP, stores the backups in the deduplicated store, reads them back,
+// restores them over the dropped originals and compares the result with
+// what was seeded.
+//
+// The targets are ephemeral: a backup_selftest_* schema in
+// SELFTEST_DATABASE_URL (the service's own database by default) and
+// backup:selftest:* keys in SELFTEST_REDIS_URL (its own Redis), both
+// removed afterwards whatever the outcome. Manifests are never saved, so
+// the chunks written are unreferenced and go at the next GC after the
+// grace period. Only one self-test runs at a time across replicas, and the
+// last report is kept for GET /v1/backup/selftest.
+
+// Self-test step results
+const (
+	SelftestPassed  = "passed"
+	SelftestFailed  = "failed"
+	SelftestSkipped = "skipped"
+)
+
+const (
+	selftestLockKey   = "backup:selftest:lock"
+	selftestReportKey = "backup:selftest:last"
+
+	selftestDefaultRows = 1000
+	selftestMaxRows     = 100000
+	selftestDefaultKeys = 50
+	selftestMaxKeys     = 10000
+)
+
+var selftestRuns = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "backup_selftest_runs_total",
+		Help: "Backup self-test runs",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(selftestRuns)
+}
+
+// SelftestStep is the outcome of one stage of a self-test
+type SelftestStep struct {
+	Name       string                 `json:"name"`
+	Status     string                 `json:"status"`
+	DurationMs int64                  `json:"duration_ms"`
+	Error      string                 `json:"error,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+// SelftestReport is the outcome of a self-test run
+type SelftestReport struct {
+	ID          string         `json:"id"`
+	Status      string         `json:"status"`
+	Store       string         `json:"store"`
+	Steps       []SelftestStep `json:"steps"`
+	StartedAt   time.Time      `json:"started_at"`
+	CompletedAt time.Time      `json:"completed_at"`
+	DurationMs  int64          `json:"duration_ms"`
+}
+
+// selftestArtifact is one backup taken by the self-test
+type selftestArtifact struct {
+	checksum string
+	manifest []BackupManifestEntry
+	restored []byte
+}
+
+type selftest struct {
+	s      *BackupService
+	db     *gorm.DB
+	dbURL  string
+	redis  *redis.Client
+	schema string
+	prefix string
+	rows   int
+	keys   int
+
+	seededRows     int64
+	seededChecksum string
+	seededKeys     map[string]string
+	pgDump         *selftestArtifact
+	redisDump      *selftestArtifact
+}
+
+// Run a miniature backup and restore against ephemeral targets
+func (s *BackupService) runSelftest(c *gin.Context) {
+	var req struct {
+		Rows int `json:"rows"`
+		Keys int `json:"keys"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Rows <= 0 {
+		req.Rows = selftestDefaultRows
+	}
+	if req.Keys <= 0 {
+		req.Keys = selftestDefaultKeys
+	}
+	if req.Rows > selftestMaxRows || req.Keys > selftestMaxKeys {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("A self-test seeds at most %d rows and %d keys", selftestMaxRows, selftestMaxKeys),
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	acquired, err := s.redis.SetNX(ctx, selftestLockKey, "1", s.config.SelftestTimeout+time.Minute).Result()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to acquire self-test lock"})
+		return
+	}
+	if !acquired {
+		c.JSON(http.StatusConflict, gin.H{"error": "A self-test is already running"})
+		return
+	}
+	defer s.redis.Del(context.Background(), selftestLockKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.SelftestTimeout)
+	defer cancel()
+	report := s.selftest(ctx, req.Rows, req.Keys)
+
+	if payload, err := json.Marshal(report); err == nil {
+		if err := s.redis.Set(context.Background(), selftestReportKey, payload, 0).Err(); err != nil {
+			log.Printf("Failed to save self-test report: %v", err)
+		}
+	}
+	selftestRuns.WithLabelValues(report.Status).Inc()
+
+	status := http.StatusOK
+	if report.Status != SelftestPassed {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
+
+// Get the last self-test report
+func (s *BackupService) getSelftestReport(c *gin.Context) {
+	payload, err := s.redis.Get(c.Request.Context(), selftestReportKey).Bytes()
+	if err == redis.Nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No self-test has run yet"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read self-test report"})
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", payload)
+}
+
+func (s *BackupService) selftest(ctx context.Context, rows, keys int) *SelftestReport {
+	id := uuid.New().String()
+	short := strings.ReplaceAll(id, "-", "")[:12]
+	report := &SelftestReport{
+		ID:        id,
+		Status:    SelftestPassed,
+		Store:     s.chunks.Kind(),
+		StartedAt: time.Now().UTC(),
+	}
+	t := &selftest{
+		s:      s,
+		schema: "backup_selftest_" + short,
+		prefix: "backup:selftest:" + short + ":",
+		rows:   rows,
+		keys:   keys,
+	}
+
+	steps := []struct {
+		name string
+		run  func(context.Context) (map[string]interface{}, error)
+	}{
+		{"connect", t.connect},
+		{"seed_postgres", t.seedPostgres},
+		{"seed_redis", t.seedRedis},
+		{"backup_postgres", t.backupPostgres},
+		{"backup_redis", t.backupRedis},
+		{"read_back", t.readBack},
+		{"restore_postgres", t.restorePostgres},
+		{"restore_redis", t.restoreRedis},
+	}
+	for _, step := range steps {
+		if report.Status != SelftestPassed {
+			report.Steps = append(report.Steps, SelftestStep{Name: step.name, Status: SelftestSkipped})
+			continue
+		}
+		result := runSelftestStep(ctx, step.name, step.run)
+		if result.Status == SelftestFailed {
+			report.Status = SelftestFailed
+		}
+		report.Steps = append(report.Steps, result)
+	}
+
+	// Cleanup runs on its own deadline so a timed-out run still tidies up
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cleanup := runSelftestStep(cleanupCtx, "cleanup", t.cleanup)
+	if cleanup.Status == SelftestFailed {
+		report.Status = SelftestFailed
+	}
+	report.Steps = append(report.Steps, cleanup)
+
+	report.CompletedAt = time.Now().UTC()
+	report.DurationMs = report.CompletedAt.Sub(report.StartedAt).Milliseconds()
+	if report.Status != SelftestPassed {
+		log.Printf("Backup self-test %s failed", id)
+	}
+	return report
+}
+
+func runSelftestStep(ctx context.Context, name string, run func(context.Context) (map[string]interface{}, error)) SelftestStep {
+	started := time.Now()
+	details, err := run(ctx)
+	step := SelftestStep{
+		Name:       name,
+		Status:     SelftestPassed,
+		DurationMs: time.Since(started).Milliseconds(),
+		Details:    details,
+	}
+	if err == nil && ctx.Err() != nil {
+		err = fmt.Errorf("self-test timed out: %w", ctx.Err())
+	}
+	if err != nil {
+		step.Status = SelftestFailed
+		step.Error = err.Error()
+	}
+	return step
+}
+
+// connect opens the self-test targets
+func (t *selftest) connect(ctx context.Context) (map[string]interface{}, error) {
+	t.db, t.dbURL = t.s.db, t.s.config.DatabaseURL
+	if url := t.s.config.SelftestDatabaseURL; url != "" {
+		db, err := gorm.Open(postgres.Open(url), &gorm.Config{Logger: logger.Default.LogMode(logger.Warn)})
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to self-test database: %w", err)
+		}
+		t.db, t.dbURL = db, url
+	}
+
+	t.redis = t.s.redis
+	if url := t.s.config.SelftestRedisURL; url != "" {
+		opt, err := redis.ParseURL(url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse self-test Redis URL: %w", err)
+		}
+		t.redis = redis.NewClient(opt)
+		if err := t.redis.Ping(ctx).Err(); err != nil {
+			return nil, fmt.Errorf("failed to connect to self-test Redis: %w", err)
+		}
+	}
+
+	for _, tool := range []string{"pg_dump", "pg_restore"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil, fmt.Errorf("%s is not installed", tool)
+		}
+	}
+	return map[string]interface{}{"schema": t.schema, "key_prefix": t.prefix}, nil
+}
+
+// seedPostgres fills the throwaway schema with random rows
+func (t *selftest) seedPostgres(ctx context.Context) (map[string]interface{}, error) {
+	db := t.db.WithContext(ctx)
+	if err := db.Exec(fmt.Sprintf(`CREATE SCHEMA %q`, t.schema)).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Exec(fmt.Sprintf(`CREATE TABLE %q.items (
+		id integer PRIMARY KEY,
+		payload text NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now()
+	)`, t.schema)).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Exec(fmt.Sprintf(`INSERT INTO %q.items (id, payload)
+		SELECT i, repeat(md5(random()::text), 4) FROM generate_series(1, ?) AS i`, t.schema), t.rows).Error; err != nil {
+		return nil, err
+	}
+
+	rows, checksum, err := t.tableChecksum(ctx)
+	if err != nil {
+		return nil, err
+	}
+	t.seededRows, t.seededChecksum = rows, checksum
+	return map[string]interface{}{"rows": rows, "checksum": checksum}, nil
+}
+
+func (t *selftest) tableChecksum(ctx context.Context) (int64, string, error) {
+	var result struct {
+		Rows     int64
+		Checksum string
+	}
+	err := t.db.WithContext(ctx).Raw(fmt.Sprintf(`SELECT COUNT(*) AS rows,
+		COALESCE(md5(string_agg(id::text || ':' || payload || ':' || created_at::text, ',' ORDER BY id)), '') AS checksum
+		FROM %q.items`, t.schema)).Scan(&result).Error
+	return result.Rows, result.Checksum, err
+}
+
+// seedRedis writes random values under the self-test prefix
+func (t *selftest) seedRedis(ctx context.Context) (map[string]interface{}, error) {
+	t.seededKeys = make(map[string]string, t.keys)
+	pipe := t.redis.Pipeline()
+	for i := 0; i < t.keys; i++ {
+		key := fmt.Sprintf("%s%d", t.prefix, i)
+		value := uuid.New().String()
+		t.seededKeys[key] = value
+		pipe.Set(ctx, key, value, 0)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"keys": len(t.seededKeys)}, nil
+}
+
+// backupPostgres dumps the schema and stores the dump
+func (t *selftest) backupPostgres(ctx context.Context) (map[string]interface{}, error) {
+	cmd := exec.CommandContext(ctx, "pg_dump", "--format=custom", "--no-owner", "--no-privileges",
+		"--schema="+t.schema, "--dbname="+t.dbURL)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	dump, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("pg_dump failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	artifact, stats, err := t.store(ctx, dump)
+	if err != nil {
+		return nil, err
+	}
+	t.pgDump = artifact
+	return map[string]interface{}{"bytes": len(dump), "checksum": artifact.checksum, "dedup": stats}, nil
+}
+
+// backupRedis dumps every seeded key and stores the dumps
+func (t *selftest) backupRedis(ctx context.Context) (map[string]interface{}, error) {
+	dumps := make(map[string]string, len(t.seededKeys))
+	for key := range t.seededKeys {
+		dump, err := t.redis.Dump(ctx, key).Result()
+		if err != nil {
+			return nil, fmt.Errorf("DUMP %s: %w", key, err)
+		}
+		dumps[key] = base64.StdEncoding.EncodeToString([]byte(dump))
+	}
+	data, err := json.Marshal(dumps)
+	if err != nil {
+		return nil, err
+	}
+
+	artifact, stats, err := t.store(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	t.redisDump = artifact
+	return map[string]interface{}{"bytes": len(data), "checksum": artifact.checksum, "dedup": stats}, nil
+}
+
+// store ingests a backup into the deduplicated store, keeping its manifest
+// in memory only
+func (t *selftest) store(ctx context.Context, data []byte) (*selftestArtifact, *dedupIngestStats, error) {
+	sum := sha256.Sum256(data)
+	manifest, stats, err := t.s.ingestDedup(ctx, "selftest-"+uuid.New().String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to store backup: %w", err)
+	}
+	return &selftestArtifact{checksum: hex.EncodeToString(sum[:]), manifest: manifest}, stats, nil
+}
+
+// readBack reassembles both backups from the store and checks them
+func (t *selftest) readBack(ctx context.Context) (map[string]interface{}, error) {
+	details := map[string]interface{}{}
+	for name, artifact := range map[string]*selftestArtifact{"postgres": t.pgDump, "redis": t.redisDump} {
+		var buf bytes.Buffer
+		if err := t.s.writeManifest(ctx, artifact.manifest, &buf); err != nil {
+			return details, fmt.Errorf("%s backup: %w", name, err)
+		}
+		sum := sha256.Sum256(buf.Bytes())
+		if checksum := hex.EncodeToString(sum[:]); checksum != artifact.checksum {
+			return details, fmt.Errorf("%s backup read back with checksum %s, stored %s", name, checksum, artifact.checksum)
+		}
+		artifact.restored = buf.Bytes()
+		details[name+"_chunks"] = len(artifact.manifest)
+	}
+	return details, nil
+}
+
+// restorePostgres drops the schema, restores it from the read-back dump
+// and compares it with what was seeded
+func (t *selftest) restorePostgres(ctx context.Context) (map[string]interface{}, error) {
+	if err := t.db.WithContext(ctx).Exec(fmt.Sprintf(`DROP SCHEMA %q CASCADE`, t.schema)).Error; err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, "pg_restore", "--no-owner", "--no-privileges", "--exit-on-error",
+		"--dbname="+t.dbURL)
+	cmd.Stdin = bytes.NewReader(t.pgDump.restored)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("pg_restore failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	rows, checksum, err := t.tableChecksum(ctx)
+	if err != nil {
+		return nil, err
+	}
+	details := map[string]interface{}{"rows": rows, "checksum": checksum}
+	if rows != t.seededRows || checksum != t.seededChecksum {
+		return details, fmt.Errorf("restored %d rows with checksum %s, seeded %d with %s",
+			rows, checksum, t.seededRows, t.seededChecksum)
+	}
+	return details, nil
+}
+
+// restoreRedis deletes the seeded keys, restores them from the read-back
+// dumps and compares their values
+func (t *selftest) restoreRedis(ctx context.Context) (map[string]interface{}, error) {
+	var dumps map[string]string
+	if err := json.Unmarshal(t.redisDump.restored, &dumps); err != nil {
+		return nil, fmt.Errorf("unreadable Redis backup: %w", err)
+	}
+	if len(dumps) != len(t.seededKeys) {
+		return nil, fmt.Errorf("Redis backup holds %d keys, seeded %d", len(dumps), len(t.seededKeys))
+	}
+
+	for key, encoded := range dumps {
+		dump, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("unreadable dump of %s: %w", key, err)
+		}
+		if err := t.redis.Del(ctx, key).Err(); err != nil {
+			return nil, err
+		}
+		if err := t.redis.Restore(ctx, key, 0, string(dump)).Err(); err != nil {
+			return nil, fmt.Errorf("RESTORE %s: %w", key, err)
+		}
+	}
+
+	mismatched := 0
+	for key, value := range t.seededKeys {
+		restored, err := t.redis.Get(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		if restored != value {
+			mismatched++
+		}
+	}
+	details := map[string]interface{}{"keys": len(dumps)}
+	if mismatched > 0 {
+		return details, fmt.Errorf("%d of %d restored keys differ from what was seeded", mismatched, len(t.seededKeys))
+	}
+	return details, nil
+}
+
+// cleanup removes the ephemeral targets and closes connections opened for
+// them
+func (t *selftest) cleanup(ctx context.Context) (map[string]interface{}, error) {
+	var errs []string
+	if t.db != nil {
+		if err := t.db.WithContext(ctx).Exec(fmt.Sprintf(`DROP SCHEMA IF EXISTS %q CASCADE`, t.schema)).Error; err != nil {
+			errs = append(errs, "drop schema: "+err.Error())
+		}
+		if t.db != t.s.db {
+			if sqlDB, err := t.db.DB(); err == nil {
+				sqlDB.Close()
+			}
+		}
+	}
+	if t.redis != nil {
+		if len(t.seededKeys) > 0 {
+			keys := make([]string, 0, len(t.seededKeys))
+			for key := range t.seededKeys {
+				keys = append(keys, key)
+			}
+			if err := t.redis.Del(ctx, keys...).Err(); err != nil {
+				errs = append(errs, "delete keys: "+err.Error())
+			}
+		}
+		if t.redis != t.s.redis {
+			t.redis.Close()
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil, nil
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+// Durable entries. Keys under one of DURABLE_KEY_PREFIXES are persisted to
+// Postgres behind the Redis tier: sets and deletes land in a pending set,
+// where a later write to a key replaces an earlier one, and are written out
+// in batches every WRITE_BEHIND_FLUSH_INTERVAL or as soon as a batch fills.
+// Reads never touch Postgres.
+//
+// When Redis comes up empty, after a restart or a flush, the persisted
+// entries that have not expired are loaded back with their remaining TTL.
+// Loading only sets keys Redis doesn't hold, so it never overwrites a newer
+// value. Pending writes are flushed on shutdown; a crash loses at most one
+// flush interval.
+
+const (
+	hydratedMarkerKey     = "cache:durable:hydrated"
+	hydrateBatchSize      = 500
+	hydrateCheckInterval  = 30 * time.Second
+	durableExpiryInterval = 10 * time.Minute
+)
+
+// DurableCacheEntry is the persisted copy of a Redis entry
+type DurableCacheEntry struct {
+	Key       string     `json:"key" gorm:"primaryKey"`
+	Value     string     `json:"value" gorm:"type:text;not null"` // JSON, as stored in Redis
+	ExpiresAt *time.Time `json:"expires_at" gorm:"index"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+var (
+	writeBehindPending = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cache_write_behind_pending",
+			Help: "Durable writes waiting to be persisted",
+		},
+	)
+
+	writeBehindWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_write_behind_writes_total",
+			Help: "Durable writes persisted, by operation and status",
+		},
+		[]string{"operation", "status"},
+	)
+
+	writeBehindDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_write_behind_dropped_total",
+			Help: "Durable writes dropped because the pending set was full",
+		},
+	)
+
+	cacheRehydrated = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_rehydrated_keys_total",
+			Help: "Durable entries loaded back into Redis",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(writeBehindPending)
+	prometheus.MustRegister(writeBehindWrites)
+	prometheus.MustRegister(writeBehindDropped)
+	prometheus.MustRegister(cacheRehydrated)
+}
+
+// durableWrite is a pending set, or a delete when value is nil
+type durableWrite struct {
+	value     []byte
+	expiresAt *time.Time
+}
+
+type durableStore struct {
+	db            *gorm.DB
+	prefixes      []string
+	batchSize     int
+	maxPending    int
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	pending map[string]durableWrite
+	full    chan struct{} // a batch is ready
+
+	flushMu       sync.Mutex // one flush at a time
+	lastFlush     time.Time
+	lastError     string
+	lastHydration time.Time
+}
+
+func newDurableStore(config *Config) (*durableStore, error) {
+	if len(config.DurablePrefixes) == 0 {
+		return nil, nil
+	}
+	if config.DatabaseURL == "" {
+		return nil, fmt.Errorf("DURABLE_KEY_PREFIXES requires DATABASE_URL")
+	}
+
+	db, err := gorm.Open(postgres.Open(config.DatabaseURL), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Warn),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	if err := db.AutoMigrate(&DurableCacheEntry{}); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	if config.WriteBehindBatchSize <= 0 {
+		config.WriteBehindBatchSize = 500
+	}
+	if config.WriteBehindMaxPending <= 0 {
+		config.WriteBehindMaxPending = 100000
+	}
+	if config.WriteBehindFlushInterval <= 0 {
+		config.WriteBehindFlushInterval = time.Second
+	}
+
+	return &durableStore{
+		db:            db,
+		prefixes:      config.DurablePrefixes,
+		batchSize:     config.WriteBehindBatchSize,
+		maxPending:    config.WriteBehindMaxPending,
+		flushInterval: config.WriteBehindFlushInterval,
+		pending:       make(map[string]durableWrite),
+		full:          make(chan struct{}, 1),
+	}, nil
+}
+
+func (d *durableStore) durable(key string) bool {
+	if d == nil {
+		return false
+	}
+	for _, prefix := range d.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueueSet records a set of a durable key; ttl 0 never expires
+func (d *durableStore) enqueueSet(key string, data []byte, ttl time.Duration) {
+	write := durableWrite{value: data}
+	if ttl > 0 {
+		expiresAt := time.Now().Add(ttl)
+		write.expiresAt = &expiresAt
+	}
+	d.enqueue(key, write)
+}
+
+func (d *durableStore) enqueueDelete(key string) {
+	d.enqueue(key, durableWrite{})
+}
+
+func (d *durableStore) enqueue(key string, write durableWrite) {
+	d.mu.Lock()
+	if _, queued := d.pending[key]; !queued && len(d.pending) >= d.maxPending {
+		d.mu.Unlock()
+		writeBehindDropped.Inc()
+		return
+	}
+	d.pending[key] = write
+	size := len(d.pending)
+	d.mu.Unlock()
+
+	writeBehindPending.Set(float64(size))
+	if size >= d.batchSize {
+		select {
+		case d.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush persists everything pending. Writes that fail go back to the
+// pending set unless a newer write to the key arrived meanwhile.
+func (d *durableStore) flush() error {
+	d.flushMu.Lock()
+	defer d.flushMu.Unlock()
+
+	d.mu.Lock()
+	batch := d.pending
+	d.pending = make(map[string]durableWrite)
+	d.mu.Unlock()
+	if len(batch) == 0 {
+		writeBehindPending.Set(0)
+		return nil
+	}
+
+	var upserts []DurableCacheEntry
+	var deletes []string
+	now := time.Now()
+	for key, write := range batch {
+		if write.value == nil {
+			deletes = append(deletes, key)
+			continue
+		}
+		upserts = append(upserts, DurableCacheEntry{
+			Key:       key,
+			Value:     string(write.value),
+			ExpiresAt: write.expiresAt,
+			UpdatedAt: now,
+		})
+	}
+
+	failed := make(map[string]bool)
+	var firstErr error
+	for start := 0; start < len(upserts); start += d.batchSize {
+		end := start + d.batchSize
+		if end > len(upserts) {
+			end = len(upserts)
+		}
+		chunk := upserts[start:end]
+		err := d.db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "key"}},
+			DoUpdates: clause.AssignmentColumns([]string{"value", "expires_at", "updated_at"}),
+		}).Create(&chunk).Error
+		if err != nil {
+			writeBehindWrites.WithLabelValues(OpSet, "error").Add(float64(len(chunk)))
+			for _, entry := range chunk {
+				failed[entry.Key] = true
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		writeBehindWrites.WithLabelValues(OpSet, "success").Add(float64(len(chunk)))
+	}
+	for start := 0; start < len(deletes); start += d.batchSize {
+		end := start + d.batchSize
+		if end > len(deletes) {
+			end = len(deletes)
+		}
+		chunk := deletes[start:end]
+		if err := d.db.Where("key IN ?", chunk).Delete(&DurableCacheEntry{}).Error; err != nil {
+			writeBehindWrites.WithLabelValues(OpDelete, "error").Add(float64(len(chunk)))
+			for _, key := range chunk {
+				failed[key] = true
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		writeBehindWrites.WithLabelValues(OpDelete, "success").Add(float64(len(chunk)))
+	}
+
+	d.mu.Lock()
+	for key := range failed {
+		if _, newer := d.pending[key]; !newer {
+			d.pending[key] = batch[key]
+		}
+	}
+	writeBehindPending.Set(float64(len(d.pending)))
+	d.lastFlush = now
+	d.lastError = ""
+	if firstErr != nil {
+		d.lastError = firstErr.Error()
+	}
+	d.mu.Unlock()
+
+	if firstErr != nil {
+		return fmt.Errorf("failed to persist %d of %d durable writes: %w", len(failed), len(batch), firstErr)
+	}
+	return nil
+}
+
+// startWriteBehind flushes on an interval and whenever a batch fills, and
+// drops persisted entries once they expire
+func (s *CachingService) startWriteBehind() {
+	if s.durable == nil {
+		return
+	}
+
+	ticker := time.NewTicker(s.durable.flushInterval)
+	defer ticker.Stop()
+	expiry := time.NewTicker(durableExpiryInterval)
+	defer expiry.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.durable.full:
+		case <-expiry.C:
+			if err := s.durable.db.Where("expires_at < ?", time.Now()).Delete(&DurableCacheEntry{}).Error; err != nil {
+				log.Printf("Failed to drop expired durable entries: %v", err)
+			}
+			continue
+		}
+		if err := s.durable.flush(); err != nil {
+			log.Printf("Write-behind flush failed: %v", err)
+		}
+	}
+}
+
+// startRehydrationWatcher loads the durable entries into Redis at startup,
+// and again whenever Redis turns out to have lost them
+func (s *CachingService) startRehydrationWatcher() {
+	if s.durable == nil {
+		return
+	}
+
+	check := func() {
+		ctx := context.Background()
+		exists, err := s.redisClient.Exists(ctx, hydratedMarkerKey).Result()
+		if err != nil || exists > 0 {
+			return
+		}
+		loaded, err := s.rehydrate(ctx)
+		if err != nil {
+			log.Printf("Cache rehydration failed after %d keys: %v", loaded, err)
+			return
+		}
+		s.redisClient.Set(ctx, hydratedMarkerKey, time.Now().UTC().Format(time.RFC3339), 0)
+		log.Printf("💾 Rehydrated %d durable cache entries into Redis", loaded)
+	}
+	check()
+
+	ticker := time.NewTicker(hydrateCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		check()
+	}
+}
+
+// rehydrate loads every unexpired durable entry Redis doesn't hold
+func (s *CachingService) rehydrate(ctx context.Context) (int, error) {
+	loaded := 0
+	lastKey := ""
+	for {
+		var entries []DurableCacheEntry
+		err := s.durable.db.Where("key > ? AND (expires_at IS NULL OR expires_at > ?)", lastKey, time.Now()).
+			Order("key ASC").
+			Limit(hydrateBatchSize).
+			Find(&entries).Error
+		if err != nil {
+			return loaded, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		pipe := s.redisClient.Pipeline()
+		commands := make([]*redis.BoolCmd, 0, len(entries))
+		for _, entry := range entries {
+			var ttl time.Duration
+			if entry.ExpiresAt != nil {
+				if ttl = time.Until(*entry.ExpiresAt); ttl <= 0 {
+					continue
+				}
+			}
+			commands = append(commands, pipe.SetNX(ctx, entry.Key, entry.Value, ttl))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return loaded, err
+		}
+		for _, cmd := range commands {
+			if cmd.Val() {
+				loaded++
+			}
+		}
+
+		if len(entries) < hydrateBatchSize {
+			break
+		}
+		lastKey = entries[len(entries)-1].Key
+	}
+
+	s.durable.mu.Lock()
+	s.durable.lastHydration = time.Now()
+	s.durable.mu.Unlock()
+	cacheRehydrated.Add(float64(loaded))
+	return loaded, nil
+}
+
+// Durability settings and write-behind state
+func (s *CachingService) getDurabilityStatus(c *gin.Context) {
+	if s.durable == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+
+	var persisted int64
+	s.durable.db.Model(&DurableCacheEntry{}).Count(&persisted)
+
+	s.durable.mu.Lock()
+	status := gin.H{
+		"enabled":           true,
+		"prefixes":          s.durable.prefixes,
+		"pending":           len(s.durable.pending),
+		"max_pending":       s.durable.maxPending,
+		"batch_size":        s.durable.batchSize,
+		"flush_interval_ms": s.durable.flushInterval.Milliseconds(),
+		"last_flush":        s.durable.lastFlush,
+		"last_error":        s.durable.lastError,
+		"last_rehydration":  s.durable.lastHydration,
+		"persisted_entries": persisted,
+	}
+	s.durable.mu.Unlock()
+
+	c.JSON(http.StatusOK, status)
+}
+
+// Persist pending writes now
+func (s *CachingService) flushDurable(c *gin.Context) {
+	if s.durable == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Durable entries are not enabled"})
+		return
+	}
+	if err := s.durable.flush(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Pending writes persisted"})
+}
+
+// Load the durable entries into Redis now
+func (s *CachingService) rehydrateDurable(c *gin.Context) {
+	if s.durable == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Durable entries are not enabled"})
+		return
+	}
+	loaded, err := s.rehydrate(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "loaded": loaded})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"loaded": loaded})
+}
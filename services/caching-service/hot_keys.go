@@ -0,0 +1,504 @@
+package main
+
+import (
+	"container/heap"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Hot-key and access pattern tracking. A sample of cache operations is fed
+// into a bounded top-K counter (space-saving algorithm, with a min-heap for
+// eviction) per tier and into per-prefix aggregates. Each tier is counted
+// under its own lock and prefixes are merged across tiers when reported.
+// Counts are scaled by the sample rate, so reported numbers are estimates.
+// Windows rotate every HotKeyWindow; the API reports the last completed
+// window, or the current one before the first rotation.
+//
+// L1 reads do not know the encoded value size, so L1 read bandwidth is not
+// tracked.
+//
+// Only the metricPrefixes busiest prefixes of the last completed window are
+// exported as cache_prefix_operations_total labels; the rest are counted
+// under _other. Series of prefixes that drop out are deleted on rotation,
+// so the label set stays bounded however many prefixes the keys use.
+
+const (
+	prefixOther  = "_other"
+	maxPrefixes  = 200
+	noPrefixName = "_none"
+)
+
+// Prefixes exported as cache_prefix_operations_total labels
+const metricPrefixes = 20
+
+// Size bucket upper bounds for the per-prefix value size histogram
+var prefixSizeBuckets = []int64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304}
+
+var cachePrefixOperations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cache_prefix_operations_total",
+		Help: "Sampled cache operations by key prefix",
+	},
+	[]string{"prefix", "operation", "tier"},
+)
+
+func init() {
+	prometheus.MustRegister(cachePrefixOperations)
+}
+
+type hotKeyCounter struct {
+	Key      string
+	Requests float64
+	Bytes    float64
+	Error    float64 // space-saving overestimate bound
+	index    int     // position in the tier's min-heap
+}
+
+// counterHeap orders a tier's counters by requests, smallest first, so the
+// space-saving eviction candidate is always at the root
+type counterHeap []*hotKeyCounter
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i].Requests < h[j].Requests }
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *counterHeap) Push(x interface{}) {
+	counter := x.(*hotKeyCounter)
+	counter.index = len(*h)
+	*h = append(*h, counter)
+}
+
+func (h *counterHeap) Pop() interface{} {
+	old := *h
+	counter := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return counter
+}
+
+type prefixCounter struct {
+	Operations map[string]float64
+	Hits       float64
+	Misses     float64
+	Bytes      float64
+	Sizes      []float64 // len(prefixSizeBuckets)+1, last is overflow
+}
+
+func newPrefixCounter() *prefixCounter {
+	return &prefixCounter{
+		Operations: make(map[string]float64),
+		Sizes:      make([]float64, len(prefixSizeBuckets)+1),
+	}
+}
+
+// add folds another counter into this one
+func (p *prefixCounter) add(other *prefixCounter) {
+	for operation, count := range other.Operations {
+		p.Operations[operation] += count
+	}
+	p.Hits += other.Hits
+	p.Misses += other.Misses
+	p.Bytes += other.Bytes
+	for i, count := range other.Sizes {
+		p.Sizes[i] += count
+	}
+}
+
+// tierWindow holds one tier's counters for a window. Each tier has its own
+// lock, so operations on different tiers do not contend.
+type tierWindow struct {
+	mutex    sync.Mutex
+	keys     map[string]*hotKeyCounter
+	heap     counterHeap
+	prefixes map[string]*prefixCounter
+}
+
+type accessWindow struct {
+	Start time.Time
+	End   time.Time
+	mutex sync.RWMutex // guards tiers
+	tiers map[string]*tierWindow
+}
+
+// prefixSeries is one cache_prefix_operations_total series
+type prefixSeries struct {
+	prefix, operation, tier string
+}
+
+type hotKeyTracker struct {
+	mutex      sync.RWMutex // guards current, previous and labelled
+	sampleRate float64
+	capacity   int
+	delimiter  string
+	current    *accessWindow
+	previous   *accessWindow
+	labelled   map[string]bool // prefixes exported as metric labels
+	series     sync.Map        // prefixSeries -> struct{}
+}
+
+func newHotKeyTracker(sampleRate float64, capacity int, delimiter string) *hotKeyTracker {
+	if sampleRate <= 0 || sampleRate > 1 {
+		sampleRate = 1
+	}
+	if capacity <= 0 {
+		capacity = 1000
+	}
+	return &hotKeyTracker{
+		sampleRate: sampleRate,
+		capacity:   capacity,
+		delimiter:  delimiter,
+		current:    newAccessWindow(),
+		labelled:   make(map[string]bool),
+	}
+}
+
+func newAccessWindow() *accessWindow {
+	return &accessWindow{
+		Start: time.Now().UTC(),
+		tiers: make(map[string]*tierWindow),
+	}
+}
+
+// tier returns the counters of a tier, creating them on first use
+func (w *accessWindow) tier(name string) *tierWindow {
+	w.mutex.RLock()
+	shard, ok := w.tiers[name]
+	w.mutex.RUnlock()
+	if ok {
+		return shard
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if shard, ok = w.tiers[name]; !ok {
+		shard = &tierWindow{
+			keys:     make(map[string]*hotKeyCounter),
+			prefixes: make(map[string]*prefixCounter),
+		}
+		w.tiers[name] = shard
+	}
+	return shard
+}
+
+// tierNames returns the tiers that have counters in this window
+func (w *accessWindow) tierNames() []string {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	names := make([]string, 0, len(w.tiers))
+	for name := range w.tiers {
+		names = append(names, name)
+	}
+	return names
+}
+
+// prefixTotals merges the per-tier prefix aggregates of the window
+func (w *accessWindow) prefixTotals() map[string]*prefixCounter {
+	totals := make(map[string]*prefixCounter)
+	for _, name := range w.tierNames() {
+		shard := w.tier(name)
+		shard.mutex.Lock()
+		for prefix, stats := range shard.prefixes {
+			total, ok := totals[prefix]
+			if !ok {
+				total = newPrefixCounter()
+				totals[prefix] = total
+			}
+			total.add(stats)
+		}
+		shard.mutex.Unlock()
+	}
+	return totals
+}
+
+// record samples a single cache operation. hit is only meaningful for gets.
+func (t *hotKeyTracker) record(tier, operation, key string, size int, hit bool) {
+	if t.sampleRate < 1 && rand.Float64() >= t.sampleRate {
+		return
+	}
+	weight := 1 / t.sampleRate
+	bytes := float64(size) * weight
+	prefix := t.prefixOf(key)
+
+	t.mutex.RLock()
+	window := t.current
+	labelled := t.labelled
+	t.mutex.RUnlock()
+
+	shard := window.tier(tier)
+	shard.mutex.Lock()
+
+	// Top-K per tier
+	counter, ok := shard.keys[key]
+	if !ok {
+		counter = &hotKeyCounter{Key: key}
+		if len(shard.keys) >= t.capacity {
+			// Replace the smallest counter and inherit its count as error
+			min := shard.heap[0]
+			delete(shard.keys, min.Key)
+			counter.Requests = min.Requests
+			counter.Bytes = min.Bytes
+			counter.Error = min.Requests
+			counter.index = 0
+			shard.heap[0] = counter
+		} else {
+			heap.Push(&shard.heap, counter)
+		}
+		shard.keys[key] = counter
+	}
+	counter.Requests += weight
+	counter.Bytes += bytes
+	heap.Fix(&shard.heap, counter.index)
+
+	// Per-prefix aggregates
+	stats, ok := shard.prefixes[prefix]
+	if !ok {
+		if len(shard.prefixes) >= maxPrefixes {
+			prefix = prefixOther
+			stats, ok = shard.prefixes[prefix]
+		}
+		if !ok {
+			stats = newPrefixCounter()
+			shard.prefixes[prefix] = stats
+		}
+	}
+	stats.Operations[operation] += weight
+	stats.Bytes += bytes
+	if operation == OpGet {
+		if hit {
+			stats.Hits += weight
+		} else {
+			stats.Misses += weight
+		}
+	}
+	if size > 0 {
+		bucket := sort.Search(len(prefixSizeBuckets), func(i int) bool { return int64(size) <= prefixSizeBuckets[i] })
+		stats.Sizes[bucket] += weight
+	}
+	shard.mutex.Unlock()
+
+	label := prefix
+	if !labelled[label] {
+		label = prefixOther
+	}
+	series := prefixSeries{label, operation, tier}
+	if _, ok := t.series.Load(series); !ok {
+		t.series.Store(series, struct{}{})
+	}
+	cachePrefixOperations.WithLabelValues(label, operation, tier).Add(weight)
+}
+
+func (t *hotKeyTracker) prefixOf(key string) string {
+	if t.delimiter == "" {
+		return noPrefixName
+	}
+	if i := strings.Index(key, t.delimiter); i > 0 {
+		return key[:i]
+	}
+	return noPrefixName
+}
+
+// rotate closes the current window
+func (t *hotKeyTracker) rotate() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.current.End = time.Now().UTC()
+	t.previous = t.current
+	t.current = newAccessWindow()
+	t.relabel(t.previous)
+}
+
+// relabel exports the busiest prefixes of a window as metric labels and
+// deletes the series of those that are no longer exported
+func (t *hotKeyTracker) relabel(window *accessWindow) {
+	type prefixTotal struct {
+		prefix     string
+		operations float64
+	}
+	prefixes := window.prefixTotals()
+	totals := make([]prefixTotal, 0, len(prefixes))
+	for prefix, stats := range prefixes {
+		if prefix == prefixOther {
+			continue
+		}
+		total := 0.0
+		for _, count := range stats.Operations {
+			total += count
+		}
+		totals = append(totals, prefixTotal{prefix, total})
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].operations > totals[j].operations })
+	if len(totals) > metricPrefixes {
+		totals = totals[:metricPrefixes]
+	}
+
+	t.labelled = make(map[string]bool, len(totals))
+	for _, total := range totals {
+		t.labelled[total.prefix] = true
+	}
+	t.series.Range(func(key, _ interface{}) bool {
+		series := key.(prefixSeries)
+		if series.prefix != prefixOther && !t.labelled[series.prefix] {
+			cachePrefixOperations.DeleteLabelValues(series.prefix, series.operation, series.tier)
+			t.series.Delete(series)
+		}
+		return true
+	})
+}
+
+// reportWindow returns the window to report and its length in seconds
+func (t *hotKeyTracker) reportWindow() (*accessWindow, float64) {
+	window := t.previous
+	end := time.Now().UTC()
+	if window == nil {
+		window = t.current
+	} else {
+		end = window.End
+	}
+	seconds := end.Sub(window.Start).Seconds()
+	if seconds < 1 {
+		seconds = 1
+	}
+	return window, seconds
+}
+
+func (s *CachingService) startHotKeyWindowRotation() {
+	if s.config.HotKeyWindow <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.config.HotKeyWindow)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.hotKeys.rotate()
+		}
+	}
+}
+
+// Top-K hot keys by request rate or bandwidth, per tier
+func (s *CachingService) getHotKeys(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 20
+	}
+	orderBy := c.DefaultQuery("by", "requests")
+	if orderBy != "requests" && orderBy != "bytes" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "by must be requests or bytes"})
+		return
+	}
+	tierFilter := c.Query("tier")
+
+	s.hotKeys.mutex.RLock()
+	window, seconds := s.hotKeys.reportWindow()
+	s.hotKeys.mutex.RUnlock()
+
+	tiers := gin.H{}
+	for _, tier := range window.tierNames() {
+		if tierFilter != "" && tier != tierFilter {
+			continue
+		}
+		shard := window.tier(tier)
+		shard.mutex.Lock()
+		counters := make([]hotKeyCounter, 0, len(shard.keys))
+		for _, counter := range shard.keys {
+			counters = append(counters, *counter)
+		}
+		shard.mutex.Unlock()
+		sort.Slice(counters, func(i, j int) bool {
+			if orderBy == "bytes" {
+				return counters[i].Bytes > counters[j].Bytes
+			}
+			return counters[i].Requests > counters[j].Requests
+		})
+		if len(counters) > limit {
+			counters = counters[:limit]
+		}
+
+		entries := make([]gin.H, 0, len(counters))
+		for _, counter := range counters {
+			entries = append(entries, gin.H{
+				"key":                 counter.Key,
+				"prefix":              s.hotKeys.prefixOf(counter.Key),
+				"requests":            int64(counter.Requests),
+				"requests_per_second": counter.Requests / seconds,
+				"bytes":               int64(counter.Bytes),
+				"bytes_per_second":    counter.Bytes / seconds,
+				"max_overestimate":    int64(counter.Error),
+			})
+		}
+		tiers[tier] = entries
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"window_start":   window.Start,
+		"window_seconds": seconds,
+		"sample_rate":    s.hotKeys.sampleRate,
+		"order_by":       orderBy,
+		"tiers":          tiers,
+	})
+}
+
+// Per-prefix operation counts, hit rates and value size histograms
+func (s *CachingService) getAccessPatterns(c *gin.Context) {
+	s.hotKeys.mutex.RLock()
+	window, seconds := s.hotKeys.reportWindow()
+	s.hotKeys.mutex.RUnlock()
+
+	totals := window.prefixTotals()
+	prefixes := make([]gin.H, 0, len(totals))
+	for prefix, stats := range totals {
+		operations := gin.H{}
+		total := 0.0
+		for operation, count := range stats.Operations {
+			operations[operation] = int64(count)
+			total += count
+		}
+
+		histogram := make([]gin.H, 0, len(stats.Sizes))
+		for i, count := range stats.Sizes {
+			le := "+Inf"
+			if i < len(prefixSizeBuckets) {
+				le = strconv.FormatInt(prefixSizeBuckets[i], 10)
+			}
+			histogram = append(histogram, gin.H{"le": le, "count": int64(count)})
+		}
+
+		hitRate := 0.0
+		if stats.Hits+stats.Misses > 0 {
+			hitRate = stats.Hits / (stats.Hits + stats.Misses)
+		}
+
+		prefixes = append(prefixes, gin.H{
+			"prefix":              prefix,
+			"operations":          operations,
+			"requests_per_second": total / seconds,
+			"bytes_per_second":    stats.Bytes / seconds,
+			"hit_rate":            hitRate,
+			"value_size":          histogram,
+		})
+	}
+
+	sort.Slice(prefixes, func(i, j int) bool {
+		return prefixes[i]["requests_per_second"].(float64) > prefixes[j]["requests_per_second"].(float64)
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"window_start":   window.Start,
+		"window_seconds": seconds,
+		"sample_rate":    s.hotKeys.sampleRate,
+		"delimiter":      s.hotKeys.delimiter,
+		"prefixes":       prefixes,
+	})
+}
@@ -16,6 +16,7 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -36,7 +37,20 @@ type Config struct {
 	DefaultTTL     time.Duration
 	MaxKeySize     int
 	MaxValueSize   int64
+	MaxBatchBodySize int64
 	ClusterMode    bool
+	HotKeySampleRate float64
+	HotKeyWindow     time.Duration
+	HotKeyCapacity   int
+	KeyPrefixDelimiter string
+	DatabaseURL        string
+	DurablePrefixes    []string
+	WriteBehindBatchSize     int
+	WriteBehindMaxPending    int
+	WriteBehindFlushInterval time.Duration
+	ReadRepairSampleRate     float64
+	ReadRepairWorkers        int
+	ReadRepairQueueSize      int
 }
 
 // Cache tiers
@@ -60,6 +74,7 @@ type CacheEntry struct {
 	Value     interface{} `json:"value"`
 	TTL       int64       `json:"ttl"`
 	Tier      string      `json:"tier"`
+	Version   int64       `json:"version"`
 	CreatedAt time.Time   `json:"created_at"`
 	ExpiresAt time.Time   `json:"expires_at"`
 }
@@ -82,6 +97,10 @@ type CachingService struct {
 	redisClient  *redis.Client
 	memcacheClient *memcache.Client
 	l1Cache      map[string]*CacheEntry
+	l1Mutex      sync.Mutex
+	hotKeys      *hotKeyTracker
+	durable      *durableStore
+	repairer     *readRepairer
 }
 
 // Prometheus metrics
@@ -153,7 +172,20 @@ func main() {
 		DefaultTTL:   time.Duration(parseInt(getEnv("DEFAULT_TTL", "3600"))) * time.Second,
 		MaxKeySize:   parseInt(getEnv("MAX_KEY_SIZE", "250")),
 		MaxValueSize: parseInt64(getEnv("MAX_VALUE_SIZE", "1048576")), // 1MB
+		MaxBatchBodySize: parseInt64(getEnv("MAX_BATCH_BODY_SIZE", "10485760")), // 10MB
 		ClusterMode:  getBool(getEnv("CLUSTER_MODE", "false")),
+		HotKeySampleRate: parseFloat(getEnv("HOTKEY_SAMPLE_RATE", "0.1")),
+		HotKeyWindow:     time.Duration(parseInt(getEnv("HOTKEY_WINDOW", "60"))) * time.Second,
+		HotKeyCapacity:   parseInt(getEnv("HOTKEY_CAPACITY", "1000")),
+		KeyPrefixDelimiter: getEnv("KEY_PREFIX_DELIMITER", ":"),
+		DatabaseURL:        getEnv("DATABASE_URL", ""),
+		DurablePrefixes:    parseList(getEnv("DURABLE_KEY_PREFIXES", "")),
+		WriteBehindBatchSize:     parseInt(getEnv("WRITE_BEHIND_BATCH_SIZE", "500")),
+		WriteBehindMaxPending:    parseInt(getEnv("WRITE_BEHIND_MAX_PENDING", "100000")),
+		WriteBehindFlushInterval: time.Duration(parseInt(getEnv("WRITE_BEHIND_FLUSH_INTERVAL", "1000"))) * time.Millisecond,
+		ReadRepairSampleRate:     parseFloat(getEnv("READ_REPAIR_SAMPLE_RATE", "0.1")),
+		ReadRepairWorkers:        parseInt(getEnv("READ_REPAIR_WORKERS", "2")),
+		ReadRepairQueueSize:      parseInt(getEnv("READ_REPAIR_QUEUE_SIZE", "1000")),
 	}
 
 	service, err := NewCachingService(config)
@@ -185,11 +217,20 @@ func NewCachingService(config *Config) (*CachingService, error) {
 	memcacheClient := memcache.New(config.MemcachedURL)
 	memcacheClient.Timeout = 100 * time.Millisecond
 
+	// Initialize durable entries, when configured
+	durable, err := newDurableStore(config)
+	if err != nil {
+		return nil, err
+	}
+
 	service := &CachingService{
 		config:         config,
 		redisClient:    redisClient,
 		memcacheClient: memcacheClient,
 		l1Cache:        make(map[string]*CacheEntry),
+		hotKeys:        newHotKeyTracker(config.HotKeySampleRate, config.HotKeyCapacity, config.KeyPrefixDelimiter),
+		durable:        durable,
+		repairer:       newReadRepairer(config.ReadRepairQueueSize),
 	}
 
 	service.setupRoutes()
@@ -213,17 +254,17 @@ func (s *CachingService) setupRoutes() {
 	s.router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
 	// API routes
-	v1 := s.router.Group("/v1")
+	v1 := s.router.Group("/v1", s.keySizeMiddleware())
 	{
 		// Cache operations
 		v1.GET("/cache/:key", s.getCache)
-		v1.POST("/cache/:key", s.setCache)
-		v1.PUT("/cache/:key", s.setCache)
+		v1.POST("/cache/:key", s.bodySizeMiddleware(s.entryBodyLimit()), s.setCache)
+		v1.PUT("/cache/:key", s.bodySizeMiddleware(s.entryBodyLimit()), s.setCache)
 		v1.DELETE("/cache/:key", s.deleteCache)
 		
 		// Batch operations
 		v1.POST("/cache/batch/get", s.batchGet)
-		v1.POST("/cache/batch/set", s.batchSet)
+		v1.POST("/cache/batch/set", s.bodySizeMiddleware(s.config.MaxBatchBodySize), s.batchSet)
 		v1.POST("/cache/batch/delete", s.batchDelete)
 
 		// Cache management
@@ -231,15 +272,22 @@ func (s *CachingService) setupRoutes() {
 		v1.POST("/cache/invalidate", s.invalidatePattern)
 		v1.GET("/cache/stats", s.getCacheStats)
 		v1.GET("/cache/keys", s.listKeys)
+		v1.GET("/cache/hotkeys", s.getHotKeys)
+		v1.GET("/cache/access-patterns", s.getAccessPatterns)
 
 		// Multi-tier operations
 		v1.GET("/cache/multi/:key", s.getMultiTier)
-		v1.POST("/cache/multi/:key", s.setMultiTier)
+		v1.POST("/cache/multi/:key", s.bodySizeMiddleware(s.entryBodyLimit()), s.setMultiTier)
 		v1.DELETE("/cache/multi/:key", s.deleteMultiTier)
 
 		// Cache warming
-		v1.POST("/cache/warm", s.warmCache)
+		v1.POST("/cache/warm", s.bodySizeMiddleware(s.config.MaxBatchBodySize), s.warmCache)
 		v1.GET("/cache/health/:tier", s.getTierHealth)
+
+		// Durable entries
+		v1.GET("/cache/durability", s.getDurabilityStatus)
+		v1.POST("/cache/durability/flush", s.flushDurable)
+		v1.POST("/cache/durability/rehydrate", s.rehydrateDurable)
 	}
 }
 
@@ -248,6 +296,10 @@ func (s *CachingService) Start() error {
 	go s.startL1CacheEviction()
 	go s.startMetricsUpdater()
 	go s.startHealthChecker()
+	go s.startHotKeyWindowRotation()
+	go s.startWriteBehind()
+	go s.startRehydrationWatcher()
+	s.startReadRepair()
 
 	// Start HTTP server
 	s.httpServer = &http.Server{
@@ -277,6 +329,9 @@ func (s *CachingService) Start() error {
 	log.Printf("📈 Metrics: http://localhost:%s/metrics", s.config.Port)
 	log.Printf("🔄 Redis: %s", s.config.RedisURL)
 	log.Printf("💾 Memcached: %s", s.config.MemcachedURL)
+	if s.durable != nil {
+		log.Printf("🗄️  Durable key prefixes: %s", strings.Join(s.config.DurablePrefixes, ", "))
+	}
 
 	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("failed to start HTTP server: %w", err)
@@ -286,6 +341,11 @@ func (s *CachingService) Start() error {
 }
 
 func (s *CachingService) cleanup() {
+	if s.durable != nil {
+		if err := s.durable.flush(); err != nil {
+			log.Printf("Final write-behind flush failed: %v", err)
+		}
+	}
 	if s.redisClient != nil {
 		s.redisClient.Close()
 	}
@@ -377,6 +437,9 @@ func (s *CachingService) setCache(c *gin.Context) {
 	}
 	
 	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		if respondSizeLimit(c, bodySizeError(err)) {
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 		return
 	}
@@ -397,6 +460,9 @@ func (s *CachingService) setCache(c *gin.Context) {
 	
 	if err != nil {
 		cacheOperations.WithLabelValues(OpSet, tier, "error").Inc()
+		if respondSizeLimit(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -439,48 +505,56 @@ func (s *CachingService) deleteCache(c *gin.Context) {
 // Multi-tier cache operations
 func (s *CachingService) getMultiTier(c *gin.Context) {
 	key := c.Param("key")
+	policy, err := parseTierPolicy(c.GetHeader(tierPolicyHeader))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tierPolicyRequests.WithLabelValues(policyLabel(policy)).Inc()
 	
 	start := time.Now()
+	ctx := c.Request.Context()
 	
 	// Try L1 cache first
-	if value, found := s.getL1Cache(key); found {
-		cacheHits.WithLabelValues(TierL1).Inc()
-		c.JSON(http.StatusOK, gin.H{
-			"key":   key,
-			"value": value.Value,
-			"tier":  TierL1,
-			"found": true,
-		})
-		return
-	}
-	
-	// Try L2 cache (Redis)
-	if value, found, err := s.getCacheValue(key, TierL2); err == nil && found {
-		cacheHits.WithLabelValues(TierL2).Inc()
-		// Promote to L1
-		s.setL1Cache(key, value, s.config.DefaultTTL)
-		c.JSON(http.StatusOK, gin.H{
-			"key":   key,
-			"value": value,
-			"tier":  TierL2,
-			"found": true,
-		})
-		return
+	if policy == TierPolicyDefault || policy == TierPolicyL1Only {
+		if entry, found := s.getL1Cache(key); found {
+			cacheHits.WithLabelValues(TierL1).Inc()
+			if policy == TierPolicyDefault {
+				s.sampleL1Repair(key)
+			}
+			respondTier(c, key, TierL1, entry.Value, entry.Version)
+			return
+		}
 	}
 	
-	// Try L3 cache (Memcached)
-	if value, found, err := s.getCacheValue(key, TierL3); err == nil && found {
-		cacheHits.WithLabelValues(TierL3).Inc()
-		// Promote to L1 and L2
-		s.setL1Cache(key, value, s.config.DefaultTTL)
-		s.setCacheValue(key, value, s.config.DefaultTTL, TierL2)
-		c.JSON(http.StatusOK, gin.H{
-			"key":   key,
-			"value": value,
-			"tier":  TierL3,
-			"found": true,
-		})
-		return
+	if policy != TierPolicyL1Only {
+		// Try L2 cache (Redis)
+		if value, found, err := s.readTier(ctx, key, TierL2, true); err == nil && found {
+			cacheHits.WithLabelValues(TierL2).Inc()
+			// Promote to L1
+			if policy != TierPolicySkipL1 {
+				s.setL1Cache(key, value.value, s.repairTTL(value), value.version)
+			}
+			s.scheduleRepair(key, value)
+			respondTier(c, key, TierL2, value.value, value.version)
+			return
+		}
+		
+		// Try L3 cache (Memcached)
+		if value, found, err := s.readTier(ctx, key, TierL3, true); err == nil && found {
+			cacheHits.WithLabelValues(TierL3).Inc()
+			version := value.version
+			if version == 0 {
+				version = newVersion()
+			}
+			// Promote to L1 and L2
+			if policy != TierPolicySkipL1 {
+				s.setL1Cache(key, value.value, s.config.DefaultTTL, version)
+			}
+			s.setCacheValueVersion(key, value.value, s.config.DefaultTTL, TierL2, version)
+			respondTier(c, key, TierL3, value.value, value.version)
+			return
+		}
 	}
 	
 	// Cache miss on all tiers
@@ -499,40 +573,18 @@ func (s *CachingService) getCacheValue(key, tier string) (interface{}, bool, err
 	switch tier {
 	case TierL1:
 		if entry, found := s.getL1Cache(key); found {
+			s.hotKeys.record(tier, OpGet, key, 0, true)
 			return entry.Value, true, nil
 		}
+		s.hotKeys.record(tier, OpGet, key, 0, false)
 		return nil, false, nil
 		
-	case TierL2:
-		ctx := context.Background()
-		val, err := s.redisClient.Get(ctx, key).Result()
-		if err == redis.Nil {
-			return nil, false, nil
-		}
-		if err != nil {
-			return nil, false, err
-		}
-		
-		var value interface{}
-		if err := json.Unmarshal([]byte(val), &value); err != nil {
+	case TierL2, TierL3:
+		read, found, err := s.readTier(context.Background(), key, tier, true)
+		if err != nil || !found {
 			return nil, false, err
 		}
-		return value, true, nil
-		
-	case TierL3:
-		item, err := s.memcacheClient.Get(key)
-		if err == memcache.ErrCacheMiss {
-			return nil, false, nil
-		}
-		if err != nil {
-			return nil, false, err
-		}
-		
-		var value interface{}
-		if err := json.Unmarshal(item.Value, &value); err != nil {
-			return nil, false, err
-		}
-		return value, true, nil
+		return read.value, true, nil
 		
 	default:
 		return nil, false, fmt.Errorf("unsupported cache tier: %s", tier)
@@ -540,31 +592,52 @@ func (s *CachingService) getCacheValue(key, tier string) (interface{}, bool, err
 }
 
 func (s *CachingService) setCacheValue(key string, value interface{}, ttl time.Duration, tier string) error {
+	return s.setCacheValueVersion(key, value, ttl, tier, newVersion())
+}
+
+// setCacheValueVersion writes a value carrying the version it was first
+// written with
+func (s *CachingService) setCacheValueVersion(key string, value interface{}, ttl time.Duration, tier string, version int64) error {
+	if err := s.checkKeySize(key); err != nil {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err := s.checkValueSize(data); err != nil {
+		return err
+	}
+
 	switch tier {
 	case TierL1:
-		s.setL1Cache(key, value, ttl)
+		s.setL1Cache(key, value, ttl, version)
+		cacheValueSize.WithLabelValues(tier).Observe(float64(len(data)))
+		s.hotKeys.record(tier, OpSet, key, len(data), false)
 		return nil
 		
 	case TierL2:
-		data, err := json.Marshal(value)
-		if err != nil {
+		ctx := context.Background()
+		pipe := s.redisClient.TxPipeline()
+		pipe.Set(ctx, key, data, ttl)
+		pipe.Set(ctx, versionKeyPrefix+key, version, ttl)
+		if _, err := pipe.Exec(ctx); err != nil {
 			return err
 		}
-		
-		ctx := context.Background()
-		return s.redisClient.Set(ctx, key, data, ttl).Err()
+		if s.durable.durable(key) {
+			s.durable.enqueueSet(key, data, ttl)
+		}
+		cacheValueSize.WithLabelValues(tier).Observe(float64(len(data)))
+		s.hotKeys.record(tier, OpSet, key, len(data), false)
+		return nil
 		
 	case TierL3:
-		data, err := json.Marshal(value)
-		if err != nil {
+		if err := s.memcacheClient.Set(l3Item(key, data, ttl, version)); err != nil {
 			return err
 		}
-		
-		return s.memcacheClient.Set(&memcache.Item{
-			Key:        key,
-			Value:      data,
-			Expiration: int32(ttl.Seconds()),
-		})
+		cacheValueSize.WithLabelValues(tier).Observe(float64(len(data)))
+		s.hotKeys.record(tier, OpSet, key, len(data), false)
+		return nil
 		
 	default:
 		return fmt.Errorf("unsupported cache tier: %s", tier)
@@ -572,14 +645,24 @@ func (s *CachingService) setCacheValue(key string, value interface{}, ttl time.D
 }
 
 func (s *CachingService) deleteCacheValue(key, tier string) error {
+	s.hotKeys.record(tier, OpDelete, key, 0, false)
+
 	switch tier {
 	case TierL1:
+		s.l1Mutex.Lock()
 		delete(s.l1Cache, key)
+		s.l1Mutex.Unlock()
 		return nil
 		
 	case TierL2:
 		ctx := context.Background()
-		return s.redisClient.Del(ctx, key).Err()
+		if err := s.redisClient.Del(ctx, key, versionKeyPrefix+key).Err(); err != nil {
+			return err
+		}
+		if s.durable.durable(key) {
+			s.durable.enqueueDelete(key)
+		}
+		return nil
 		
 	case TierL3:
 		return s.memcacheClient.Delete(key)
@@ -591,6 +674,9 @@ func (s *CachingService) deleteCacheValue(key, tier string) error {
 
 // L1 cache operations
 func (s *CachingService) getL1Cache(key string) (*CacheEntry, bool) {
+	s.l1Mutex.Lock()
+	defer s.l1Mutex.Unlock()
+
 	entry, found := s.l1Cache[key]
 	if !found {
 		return nil, false
@@ -605,12 +691,16 @@ func (s *CachingService) getL1Cache(key string) (*CacheEntry, bool) {
 	return entry, true
 }
 
-func (s *CachingService) setL1Cache(key string, value interface{}, ttl time.Duration) {
+func (s *CachingService) setL1Cache(key string, value interface{}, ttl time.Duration, version int64) {
+	s.l1Mutex.Lock()
+	defer s.l1Mutex.Unlock()
+
 	s.l1Cache[key] = &CacheEntry{
 		Key:       key,
 		Value:     value,
 		TTL:       int64(ttl.Seconds()),
 		Tier:      TierL1,
+		Version:   version,
 		CreatedAt: time.Now(),
 		ExpiresAt: time.Now().Add(ttl),
 	}
@@ -630,6 +720,9 @@ func (s *CachingService) startL1CacheEviction() {
 }
 
 func (s *CachingService) evictExpiredL1Entries() {
+	s.l1Mutex.Lock()
+	defer s.l1Mutex.Unlock()
+
 	now := time.Now()
 	for key, entry := range s.l1Cache {
 		if now.After(entry.ExpiresAt) {
@@ -718,10 +811,27 @@ func parseInt64(s string) int64 {
 	return 0
 }
 
+func parseFloat(s string) float64 {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return 0
+}
+
 func getBool(s string) bool {
 	return strings.ToLower(s) == "true"
 }
 
+func parseList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Tier policies and read-repair. Every write carries a version, the time
+// it was first written in nanoseconds, which copies between tiers keep: L1
+// entries hold it, L2 keeps it next to the value under versionKeyPrefix,
+// and L3 items flagged l3VersionedFlag start with it as 8 bytes big-endian.
+// Entries written before versions existed, or loaded from the durable
+// store, have version 0.
+//
+// Multi-tier reads take a policy in the X-Cache-Tier-Policy header:
+//
+//   - l1-only: answer from L1 alone, a miss otherwise
+//   - skip-l1: neither read nor fill L1
+//   - refresh: read past L1 and overwrite it with what is below
+//
+// When a read sees L2, and on a ReadRepairSampleRate share of L1 hits, a
+// background worker compares L2's version with L1 and L3 and rewrites the
+// tiers holding an older version from L2. Tiers that don't hold the key are
+// left alone, and nothing is repaired when L2's version is unknown.
+
+// Tier policies
+const (
+	TierPolicyDefault = ""
+	TierPolicyL1Only  = "l1-only"
+	TierPolicySkipL1  = "skip-l1"
+	TierPolicyRefresh = "refresh"
+)
+
+const (
+	tierPolicyHeader = "X-Cache-Tier-Policy"
+	versionKeyPrefix = "cache:version:"
+	l3VersionedFlag  = 1
+)
+
+var (
+	tierPolicyRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_tier_policy_requests_total",
+			Help: "Multi-tier reads by tier policy",
+		},
+		[]string{"policy"},
+	)
+
+	readRepairChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_read_repair_checks_total",
+			Help: "Tier versions compared with L2, by tier and outcome",
+		},
+		[]string{"tier", "outcome"},
+	)
+
+	readRepairs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_read_repairs_total",
+			Help: "Stale tiers rewritten from L2, by tier and status",
+		},
+		[]string{"tier", "status"},
+	)
+
+	readRepairDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_read_repair_dropped_total",
+			Help: "Read-repairs skipped because the queue was full",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tierPolicyRequests)
+	prometheus.MustRegister(readRepairChecks)
+	prometheus.MustRegister(readRepairs)
+	prometheus.MustRegister(readRepairDropped)
+}
+
+// policyLabel names a policy in metrics
+func policyLabel(policy string) string {
+	if policy == TierPolicyDefault {
+		return "default"
+	}
+	return policy
+}
+
+// tierValue is a value read from a tier with its metadata
+type tierValue struct {
+	value   interface{}
+	data    []byte
+	version int64
+	ttl     time.Duration // remaining; 0 when unknown or unlimited
+}
+
+// repairJob checks a key's tiers against L2; source is L2 as the read saw
+// it, nil for the worker to read it
+type repairJob struct {
+	key    string
+	source *tierValue
+}
+
+type readRepairer struct {
+	queue    chan repairJob
+	inflight sync.Map
+}
+
+func newReadRepairer(queueSize int) *readRepairer {
+	if queueSize <= 0 {
+		queueSize = 1000
+	}
+	return &readRepairer{queue: make(chan repairJob, queueSize)}
+}
+
+func newVersion() int64 {
+	return time.Now().UnixNano()
+}
+
+func parseTierPolicy(policy string) (string, error) {
+	switch policy {
+	case TierPolicyDefault, TierPolicyL1Only, TierPolicySkipL1, TierPolicyRefresh:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown tier policy %q, expected %s, %s or %s", policy, TierPolicyL1Only, TierPolicySkipL1, TierPolicyRefresh)
+	}
+}
+
+// readTier reads a value with its version from L2 or L3. Reads made for
+// clients are tracked for hot keys, repair reads are not.
+func (s *CachingService) readTier(ctx context.Context, key, tier string, tracked bool) (*tierValue, bool, error) {
+	read := &tierValue{}
+	switch tier {
+	case TierL2:
+		pipe := s.redisClient.Pipeline()
+		get := pipe.Get(ctx, key)
+		version := pipe.Get(ctx, versionKeyPrefix+key)
+		ttl := pipe.PTTL(ctx, key)
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, false, err
+		}
+		if get.Err() == redis.Nil {
+			if tracked {
+				s.hotKeys.record(tier, OpGet, key, 0, false)
+			}
+			return nil, false, nil
+		}
+		read.data = []byte(get.Val())
+		read.version, _ = version.Int64()
+		if remaining := ttl.Val(); remaining > 0 {
+			read.ttl = remaining
+		}
+
+	case TierL3:
+		item, err := s.memcacheClient.Get(key)
+		if err == memcache.ErrCacheMiss {
+			if tracked {
+				s.hotKeys.record(tier, OpGet, key, 0, false)
+			}
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		read.data = item.Value
+		if item.Flags&l3VersionedFlag != 0 && len(item.Value) >= 8 {
+			read.version = int64(binary.BigEndian.Uint64(item.Value))
+			read.data = item.Value[8:]
+		}
+
+	default:
+		return nil, false, fmt.Errorf("unsupported cache tier: %s", tier)
+	}
+
+	if tracked {
+		s.hotKeys.record(tier, OpGet, key, len(read.data), true)
+	}
+	if err := json.Unmarshal(read.data, &read.value); err != nil {
+		return nil, false, err
+	}
+	return read, true, nil
+}
+
+// l3Item wraps encoded data with its version
+func l3Item(key string, data []byte, ttl time.Duration, version int64) *memcache.Item {
+	value := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint64(value, uint64(version))
+	copy(value[8:], data)
+	return &memcache.Item{
+		Key:        key,
+		Value:      value,
+		Flags:      l3VersionedFlag,
+		Expiration: int32(ttl.Seconds()),
+	}
+}
+
+// repairTTL is how long a repaired copy lives: as long as L2's
+func (s *CachingService) repairTTL(source *tierValue) time.Duration {
+	if source.ttl > 0 {
+		return source.ttl
+	}
+	return s.config.DefaultTTL
+}
+
+// scheduleRepair queues a key's tiers for checking, once at a time per key
+func (s *CachingService) scheduleRepair(key string, source *tierValue) {
+	if source != nil && source.version == 0 {
+		return
+	}
+	if _, busy := s.repairer.inflight.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	select {
+	case s.repairer.queue <- repairJob{key: key, source: source}:
+	default:
+		s.repairer.inflight.Delete(key)
+		readRepairDropped.Inc()
+	}
+}
+
+// sampleL1Repair queues a check of an L1 hit on a share of reads
+func (s *CachingService) sampleL1Repair(key string) {
+	if rate := s.config.ReadRepairSampleRate; rate > 0 && (rate >= 1 || rand.Float64() < rate) {
+		s.scheduleRepair(key, nil)
+	}
+}
+
+// startReadRepair runs the repair workers
+func (s *CachingService) startReadRepair() {
+	workers := s.config.ReadRepairWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range s.repairer.queue {
+				s.repair(job)
+				s.repairer.inflight.Delete(job.key)
+			}
+		}()
+	}
+}
+
+// repair rewrites the tiers holding an older version of a key than L2
+func (s *CachingService) repair(job repairJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	source := job.source
+	if source == nil {
+		read, found, err := s.readTier(ctx, job.key, TierL2, false)
+		if err != nil || !found {
+			return
+		}
+		source = read
+	}
+	if source.version == 0 {
+		readRepairChecks.WithLabelValues(TierL2, "unversioned").Inc()
+		return
+	}
+
+	if entry, found := s.getL1Cache(job.key); found {
+		if entry.Version >= source.version {
+			readRepairChecks.WithLabelValues(TierL1, "fresh").Inc()
+		} else {
+			readRepairChecks.WithLabelValues(TierL1, "stale").Inc()
+			s.setL1Cache(job.key, source.value, s.repairTTL(source), source.version)
+			readRepairs.WithLabelValues(TierL1, "success").Inc()
+		}
+	} else {
+		readRepairChecks.WithLabelValues(TierL1, "missing").Inc()
+	}
+
+	current, found, err := s.readTier(ctx, job.key, TierL3, false)
+	switch {
+	case err != nil:
+		readRepairChecks.WithLabelValues(TierL3, "error").Inc()
+	case !found:
+		readRepairChecks.WithLabelValues(TierL3, "missing").Inc()
+	case current.version >= source.version:
+		readRepairChecks.WithLabelValues(TierL3, "fresh").Inc()
+	default:
+		readRepairChecks.WithLabelValues(TierL3, "stale").Inc()
+		if err := s.memcacheClient.Set(l3Item(job.key, source.data, s.repairTTL(source), source.version)); err != nil {
+			log.Printf("Read-repair of %s in L3 failed: %v", job.key, err)
+			readRepairs.WithLabelValues(TierL3, "error").Inc()
+			return
+		}
+		readRepairs.WithLabelValues(TierL3, "success").Inc()
+	}
+}
+
+// respondTier answers a multi-tier read
+func respondTier(c *gin.Context, key, tier string, value interface{}, version int64) {
+	c.Header("X-Cache-Tier", tier)
+	c.JSON(http.StatusOK, gin.H{
+		"key":     key,
+		"value":   value,
+		"tier":    tier,
+		"version": version,
+		"found":   true,
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Entry size limits. Keys are checked against MaxKeySize on every keyed
+// route; values are checked against MaxValueSize on their JSON encoding,
+// which is what Redis and Memcached actually store. Request bodies are
+// capped before decoding so an oversized upload is rejected as soon as the
+// limit is crossed instead of being buffered in full.
+
+// Size limit error codes
+const (
+	ErrCodeKeyTooLarge     = "key_too_large"
+	ErrCodeValueTooLarge   = "value_too_large"
+	ErrCodeRequestTooLarge = "request_too_large"
+)
+
+// Allowance for the request envelope ({"value": ..., "ttl": ...}) on top of MaxValueSize
+const requestEnvelopeOverhead = 4096
+
+// SizeLimitError reports an entry or request that exceeds a configured limit
+type SizeLimitError struct {
+	Code  string `json:"code"`
+	Limit int64  `json:"limit"`
+	Size  int64  `json:"size,omitempty"`
+}
+
+func (e *SizeLimitError) Error() string {
+	if e.Size > 0 {
+		return fmt.Sprintf("%s: %d bytes exceeds limit of %d bytes", e.Code, e.Size, e.Limit)
+	}
+	return fmt.Sprintf("%s: exceeds limit of %d bytes", e.Code, e.Limit)
+}
+
+var (
+	cacheValueSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "cache_value_size_bytes",
+			Help:    "Size distribution of stored cache values",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 10), // 64B .. 16MB
+		},
+		[]string{"tier"},
+	)
+
+	cacheSizeRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_size_limit_rejections_total",
+			Help: "Total requests rejected for exceeding size limits",
+		},
+		[]string{"code"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cacheValueSize)
+	prometheus.MustRegister(cacheSizeRejections)
+}
+
+// Check a key against MaxKeySize
+func (s *CachingService) checkKeySize(key string) error {
+	if s.config.MaxKeySize > 0 && len(key) > s.config.MaxKeySize {
+		return &SizeLimitError{Code: ErrCodeKeyTooLarge, Limit: int64(s.config.MaxKeySize), Size: int64(len(key))}
+	}
+	return nil
+}
+
+// Check an encoded value against MaxValueSize
+func (s *CachingService) checkValueSize(data []byte) error {
+	if s.config.MaxValueSize > 0 && int64(len(data)) > s.config.MaxValueSize {
+		return &SizeLimitError{Code: ErrCodeValueTooLarge, Limit: s.config.MaxValueSize, Size: int64(len(data))}
+	}
+	return nil
+}
+
+// Reject keyed requests whose key exceeds MaxKeySize
+func (s *CachingService) keySizeMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := c.Param("key"); key != "" {
+			if err := s.checkKeySize(key); err != nil {
+				respondSizeLimit(c, err)
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// Cap the request body at limit bytes. A declared Content-Length over the
+// limit is rejected without reading; otherwise the body is wrapped so
+// decoding fails as soon as the limit is crossed.
+func (s *CachingService) bodySizeMiddleware(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > limit {
+			respondSizeLimit(c, &SizeLimitError{Code: ErrCodeRequestTooLarge, Limit: limit, Size: c.Request.ContentLength})
+			c.Abort()
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// Body limit for single-entry writes
+func (s *CachingService) entryBodyLimit() int64 {
+	if s.config.MaxValueSize <= 0 {
+		return 0
+	}
+	return s.config.MaxValueSize + requestEnvelopeOverhead
+}
+
+// Translate body read errors caused by bodySizeMiddleware into a SizeLimitError
+func bodySizeError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return &SizeLimitError{Code: ErrCodeRequestTooLarge, Limit: maxBytesErr.Limit}
+	}
+	return nil
+}
+
+// Write a structured 413 for size limit errors. Returns false for other errors.
+func respondSizeLimit(c *gin.Context, err error) bool {
+	var sizeErr *SizeLimitError
+	if !errors.As(err, &sizeErr) {
+		return false
+	}
+	cacheSizeRejections.WithLabelValues(sizeErr.Code).Inc()
+	c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+		"error": sizeErr.Error(),
+		"code":  sizeErr.Code,
+		"limit": sizeErr.Limit,
+		"size":  sizeErr.Size,
+	})
+	return true
+}
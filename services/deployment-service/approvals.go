@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Deployment approvals. An environment with an active ApprovalPolicy is
+// protected: deployments to it wait in pending_approval until enough
+// people holding one of the policy's roles, and every claim it requires,
+// have approved, and one rejection stops them. With TwoPersonReview the
+// person who asked for the deployment cannot approve it.
+//
+// Requesters and approvers are identified by their bearer token, which the
+// security-service validates; the subject and roles come from its claims,
+// roles from APPROVAL_ROLES_CLAIM as a list or a space-separated string.
+// Validated identities are cached in Redis for IdentityCacheTTL, never past
+// the token's expiry.
+
+// Deployment statuses while approvals are outstanding
+const (
+	DeploymentStatusPendingApproval = "pending_approval"
+	DeploymentStatusRejected        = "rejected"
+)
+
+// Approval decisions
+const (
+	ApprovalDecisionApprove = "approve"
+	ApprovalDecisionReject  = "reject"
+)
+
+const identityCachePrefix = "deployment:identity:"
+
+// ApprovalPolicy protects an environment
+type ApprovalPolicy struct {
+	ID                string            `json:"id" gorm:"primaryKey"`
+	Environment       string            `json:"environment" gorm:"uniqueIndex;not null"`
+	ApproverRoles     []string          `json:"approver_roles" gorm:"type:jsonb;serializer:json"`  // approvers need one of these
+	RequiredClaims    map[string]string `json:"required_claims" gorm:"type:jsonb;serializer:json"` // and all of these claim values
+	RequiredApprovals int               `json:"required_approvals" gorm:"default:1"`
+	TwoPersonReview   bool              `json:"two_person_review"` // the requester cannot approve
+	IsActive          bool              `json:"is_active" gorm:"default:true"`
+	CreatedBy         string            `json:"created_by"`
+	CreatedAt         time.Time         `json:"created_at"`
+	UpdatedAt         time.Time         `json:"updated_at"`
+}
+
+// DeploymentApproval is one approver's decision on a deployment
+type DeploymentApproval struct {
+	ID           string    `json:"id" gorm:"primaryKey"`
+	DeploymentID string    `json:"deployment_id" gorm:"uniqueIndex:idx_deployment_approver;not null"`
+	PolicyID     string    `json:"policy_id"`
+	Approver     string    `json:"approver" gorm:"uniqueIndex:idx_deployment_approver;not null"`
+	Roles        []string  `json:"roles" gorm:"type:jsonb;serializer:json"` // the approver's roles when deciding
+	Decision     string    `json:"decision"`
+	Comment      string    `json:"comment"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// identity is who a bearer token belongs to
+type identity struct {
+	Subject   string                 `json:"subject"`
+	Roles     []string               `json:"roles"`
+	Claims    map[string]interface{} `json:"claims"`
+	ExpiresAt time.Time              `json:"expires_at"`
+}
+
+var (
+	errNoToken         = errors.New("a bearer token is required")
+	errInvalidToken    = errors.New("invalid token")
+	errDecided         = errors.New("deployment already decided")
+	errAlreadyApproved = errors.New("already approved")
+)
+
+var (
+	deploymentApprovalsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "deployment_approvals_total",
+			Help: "Total number of approval decisions on deployments",
+		},
+		[]string{"environment", "decision"},
+	)
+
+	identityLookupsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "deployment_identity_lookups_total",
+			Help: "Total number of token identity lookups, by result",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(deploymentApprovalsTotal)
+	prometheus.MustRegister(identityLookupsTotal)
+}
+
+// hasRole is true when any of roles is among held
+func hasRole(held, roles []string) bool {
+	for _, role := range roles {
+		for _, h := range held {
+			if h == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimRoles reads roles from a claim holding a list or a space-separated
+// string
+func claimRoles(value interface{}) []string {
+	switch roles := value.(type) {
+	case []interface{}:
+		result := make([]string, 0, len(roles))
+		for _, role := range roles {
+			if name, ok := role.(string); ok && name != "" {
+				result = append(result, name)
+			}
+		}
+		return result
+	case string:
+		return strings.Fields(roles)
+	}
+	return nil
+}
+
+// canApprove explains why an identity may not approve under a policy, or
+// returns "" when it may
+func (p *ApprovalPolicy) canApprove(approver *identity, requester string) string {
+	if p.TwoPersonReview && approver.Subject == requester {
+		return "two-person review: the requester cannot approve their own deployment"
+	}
+	if len(p.ApproverRoles) > 0 && !hasRole(approver.Roles, p.ApproverRoles) {
+		return fmt.Sprintf("approving needs one of the roles %s", strings.Join(p.ApproverRoles, ", "))
+	}
+	for claim, want := range p.RequiredClaims {
+		value, ok := approver.Claims[claim]
+		if !ok || fmt.Sprint(value) != want {
+			return fmt.Sprintf("approving needs claim %s=%s", claim, want)
+		}
+	}
+	return ""
+}
+
+// bearerToken is the token in the request's Authorization header
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// identityStatus is the status to answer a failed identity lookup with
+func identityStatus(err error) int {
+	if errors.Is(err, errNoToken) || errors.Is(err, errInvalidToken) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadGateway
+}
+
+// requestIdentity resolves who made the request from its bearer token
+func (s *DeploymentService) requestIdentity(c *gin.Context) (*identity, error) {
+	token := bearerToken(c)
+	if token == "" {
+		return nil, errNoToken
+	}
+	return s.resolveIdentity(c.Request.Context(), token)
+}
+
+// resolveIdentity validates a token with the security-service, or takes
+// its identity from the cache
+func (s *DeploymentService) resolveIdentity(ctx context.Context, token string) (*identity, error) {
+	digest := sha256.Sum256([]byte(token))
+	cacheKey := identityCachePrefix + hex.EncodeToString(digest[:])
+	if cached, err := s.redis.Get(ctx, cacheKey).Result(); err == nil {
+		var who identity
+		if json.Unmarshal([]byte(cached), &who) == nil && time.Now().Before(who.ExpiresAt) {
+			identityLookupsTotal.WithLabelValues("cache_hit").Inc()
+			return &who, nil
+		}
+	} else if err != redis.Nil {
+		log.Printf("Identity cache unavailable: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]string{"token": token})
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimRight(s.config.SecurityServiceURL, "/")+"/v1/validate/token", strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		identityLookupsTotal.WithLabelValues("error").Inc()
+		return nil, fmt.Errorf("security-service unavailable: %w", err)
+	}
+	defer response.Body.Close()
+
+	var validation struct {
+		Valid  bool                   `json:"valid"`
+		Error  string                 `json:"error"`
+		Claims map[string]interface{} `json:"claims"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&validation); err != nil {
+		identityLookupsTotal.WithLabelValues("error").Inc()
+		return nil, fmt.Errorf("invalid security-service response: %w", err)
+	}
+	if response.StatusCode == http.StatusUnauthorized || !validation.Valid {
+		identityLookupsTotal.WithLabelValues("invalid").Inc()
+		return nil, fmt.Errorf("%w: %s", errInvalidToken, validation.Error)
+	}
+	if response.StatusCode != http.StatusOK {
+		identityLookupsTotal.WithLabelValues("error").Inc()
+		return nil, fmt.Errorf("security-service returned %d", response.StatusCode)
+	}
+
+	subject, _ := validation.Claims["sub"].(string)
+	if subject == "" {
+		identityLookupsTotal.WithLabelValues("invalid").Inc()
+		return nil, fmt.Errorf("%w: no subject", errInvalidToken)
+	}
+	who := &identity{
+		Subject:   subject,
+		Roles:     claimRoles(validation.Claims[s.config.ApprovalRolesClaim]),
+		Claims:    validation.Claims,
+		ExpiresAt: time.Now().Add(s.config.IdentityCacheTTL),
+	}
+	if exp, ok := validation.Claims["exp"].(float64); ok {
+		if expiry := time.Unix(int64(exp), 0); expiry.Before(who.ExpiresAt) {
+			who.ExpiresAt = expiry
+		}
+	}
+	identityLookupsTotal.WithLabelValues("valid").Inc()
+
+	if ttl := time.Until(who.ExpiresAt); ttl > 0 {
+		if encoded, err := json.Marshal(who); err == nil {
+			s.redis.Set(ctx, cacheKey, encoded, ttl)
+		}
+	}
+	return who, nil
+}
+
+// approvalPolicy is the active policy protecting an environment, nil when
+// it isn't protected
+func (s *DeploymentService) approvalPolicy(environment string) (*ApprovalPolicy, error) {
+	var policy ApprovalPolicy
+	err := s.db.Where("environment = ? AND is_active = ?", environment, true).First(&policy).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// Create or replace an environment's approval policy
+func (s *DeploymentService) setApprovalPolicy(c *gin.Context) {
+	var request struct {
+		Environment       string            `json:"environment" binding:"required"`
+		ApproverRoles     []string          `json:"approver_roles"`
+		RequiredClaims    map[string]string `json:"required_claims"`
+		RequiredApprovals int               `json:"required_approvals" binding:"min=0,max=10"`
+		TwoPersonReview   bool              `json:"two_person_review"`
+		IsActive          *bool             `json:"is_active"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(request.ApproverRoles) == 0 && len(request.RequiredClaims) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A policy needs approver_roles or required_claims"})
+		return
+	}
+	if request.RequiredApprovals == 0 {
+		request.RequiredApprovals = 1
+	}
+
+	now := time.Now().UTC()
+	policy := &ApprovalPolicy{
+		ID:                uuid.New().String(),
+		Environment:       request.Environment,
+		ApproverRoles:     request.ApproverRoles,
+		RequiredClaims:    request.RequiredClaims,
+		RequiredApprovals: request.RequiredApprovals,
+		TwoPersonReview:   request.TwoPersonReview,
+		IsActive:          request.IsActive == nil || *request.IsActive,
+		CreatedBy:         c.GetHeader("X-User-ID"),
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	err := s.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "environment"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"approver_roles", "required_claims", "required_approvals",
+			"two_person_review", "is_active", "updated_at",
+		}),
+	}).Create(policy).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save approval policy"})
+		return
+	}
+	s.db.Where("environment = ?", policy.Environment).First(policy)
+
+	c.JSON(http.StatusOK, policy)
+}
+
+func (s *DeploymentService) listApprovalPolicies(c *gin.Context) {
+	var policies []ApprovalPolicy
+	if err := s.db.Order("environment ASC").Find(&policies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list approval policies"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"policies": policies})
+}
+
+func (s *DeploymentService) getApprovalPolicy(c *gin.Context) {
+	var policy ApprovalPolicy
+	if err := s.db.Where("environment = ?", c.Param("environment")).First(&policy).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Approval policy not found"})
+		return
+	}
+	c.JSON(http.StatusOK, policy)
+}
+
+func (s *DeploymentService) deleteApprovalPolicy(c *gin.Context) {
+	result := s.db.Where("environment = ?", c.Param("environment")).Delete(&ApprovalPolicy{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete approval policy"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Approval policy not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Approval policy deleted"})
+}
+
+// Approvals given on a deployment, and how many it still needs
+func (s *DeploymentService) listDeploymentApprovals(c *gin.Context) {
+	var deployment Deployment
+	if err := s.db.Where("id = ?", c.Param("id")).First(&deployment).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deployment not found"})
+		return
+	}
+	var approvals []DeploymentApproval
+	if err := s.db.Where("deployment_id = ?", deployment.ID).Order("created_at ASC").Find(&approvals).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load approvals"})
+		return
+	}
+
+	response := gin.H{
+		"deployment_id": deployment.ID,
+		"status":        deployment.Status,
+		"approved_by":   deployment.ApprovedBy,
+		"approvals":     approvals,
+	}
+	var policy ApprovalPolicy
+	if deployment.ApprovalPolicyID != "" && s.db.Where("id = ?", deployment.ApprovalPolicyID).First(&policy).Error == nil {
+		response["policy"] = policy
+		if remaining := policy.RequiredApprovals - len(deployment.ApprovedBy); remaining > 0 && deployment.Status == DeploymentStatusPendingApproval {
+			response["approvals_remaining"] = remaining
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (s *DeploymentService) approveDeployment(c *gin.Context) {
+	s.decideDeployment(c, ApprovalDecisionApprove)
+}
+
+func (s *DeploymentService) rejectDeployment(c *gin.Context) {
+	s.decideDeployment(c, ApprovalDecisionReject)
+}
+
+// decideDeployment records an approver's decision; the approval that
+// completes the policy starts the rollout
+func (s *DeploymentService) decideDeployment(c *gin.Context, decision string) {
+	var request struct {
+		Comment string `json:"comment"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	approver, err := s.requestIdentity(c)
+	if err != nil {
+		c.JSON(identityStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	var deployment Deployment
+	if err := s.db.Where("id = ?", c.Param("id")).First(&deployment).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deployment not found"})
+		return
+	}
+	if deployment.Status != DeploymentStatusPendingApproval {
+		c.JSON(http.StatusConflict, gin.H{"error": "Deployment is not awaiting approval", "status": deployment.Status})
+		return
+	}
+	var policy ApprovalPolicy
+	if err := s.db.Where("id = ?", deployment.ApprovalPolicyID).First(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load approval policy"})
+		return
+	}
+	if reason := policy.canApprove(approver, deployment.DeployedBy); reason != "" {
+		deploymentApprovalsTotal.WithLabelValues(deployment.Environment, "forbidden").Inc()
+		c.JSON(http.StatusForbidden, gin.H{"error": reason})
+		return
+	}
+
+	now := time.Now().UTC()
+	approval := &DeploymentApproval{
+		ID:           uuid.New().String(),
+		DeploymentID: deployment.ID,
+		PolicyID:     policy.ID,
+		Approver:     approver.Subject,
+		Roles:        approver.Roles,
+		Decision:     decision,
+		Comment:      request.Comment,
+		CreatedAt:    now,
+	}
+
+	started := false
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", deployment.ID).First(&deployment).Error; err != nil {
+			return err
+		}
+		if deployment.Status != DeploymentStatusPendingApproval {
+			return errDecided
+		}
+		for _, subject := range deployment.ApprovedBy {
+			if subject == approver.Subject {
+				return errAlreadyApproved
+			}
+		}
+		if err := tx.Create(approval).Error; err != nil {
+			return err
+		}
+
+		if decision == ApprovalDecisionReject {
+			deployment.Status = DeploymentStatusRejected
+		} else {
+			deployment.ApprovedBy = append(deployment.ApprovedBy, approver.Subject)
+			if len(deployment.ApprovedBy) >= policy.RequiredApprovals {
+				deployment.Status = DeploymentStatusDeploying
+				deployment.ApprovedAt = &now
+				started = true
+			}
+		}
+		deployment.UpdatedAt = now
+		return tx.Model(&deployment).Select("status", "approved_by", "approved_at", "updated_at").Updates(&deployment).Error
+	})
+	switch {
+	case errors.Is(err, errDecided):
+		c.JSON(http.StatusConflict, gin.H{"error": "Deployment is not awaiting approval", "status": deployment.Status})
+		return
+	case errors.Is(err, errAlreadyApproved):
+		c.JSON(http.StatusConflict, gin.H{"error": "You have already approved this deployment"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record approval"})
+		return
+	}
+	deploymentApprovalsTotal.WithLabelValues(deployment.Environment, decision).Inc()
+
+	if decision == ApprovalDecisionReject {
+		s.db.Model(&ClusterDeployment{}).Where("deployment_id = ? AND status = ?", deployment.ID, ClusterStatusPending).
+			Updates(map[string]interface{}{"status": ClusterStatusSkipped, "message": "deployment rejected", "updated_at": now})
+		deploymentsTotal.WithLabelValues(deployment.Environment, DeploymentStatusRejected).Inc()
+	}
+	if started {
+		replicas, haltOnFailure := rolloutSettings(&deployment)
+		go s.runClusterRollout(deployment.ID, replicas, haltOnFailure)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deployment": deployment,
+		"approval":   approval,
+		"started":    started,
+	})
+}
+
+// rolloutSettings reads back the rollout options a deployment held for
+// its approvals
+func rolloutSettings(deployment *Deployment) (int32, bool) {
+	replicas := int32(1)
+	if value, ok := deployment.Config["replicas"].(float64); ok && value > 0 {
+		replicas = int32(value)
+	}
+	haltOnFailure := true
+	if value, ok := deployment.Config["halt_on_failure"].(bool); ok {
+		haltOnFailure = value
+	}
+	return replicas, haltOnFailure
+}
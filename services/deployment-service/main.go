@@ -46,6 +46,10 @@ type Config struct {
 	Environment  string
 	MaxBuilds    int
 	BuildTimeout int
+
+	SecurityServiceURL string
+	ApprovalRolesClaim string        // token claim holding approver roles
+	IdentityCacheTTL   time.Duration // how long validated tokens are trusted
 }
 
 // Pipeline status constants
@@ -83,6 +87,7 @@ type Pipeline struct {
 	Status      string                 `json:"status" gorm:"index"`
 	Triggers    []string               `json:"triggers" gorm:"type:text[]"`
 	Environment string                 `json:"environment" gorm:"index"`
+	Parameters  []PipelineParameter    `json:"parameters" gorm:"type:jsonb;serializer:json"` // inputs of manual runs
 	UserID      string                 `json:"user_id" gorm:"index"`
 	ProjectID   string                 `json:"project_id" gorm:"index"`
 	CreatedAt   time.Time              `json:"created_at"`
@@ -99,6 +104,7 @@ type Build struct {
 	CommitMsg    string                 `json:"commit_message"`
 	Author       string                 `json:"author"`
 	Config       map[string]interface{} `json:"config" gorm:"type:jsonb"`
+	Parameters   map[string]string      `json:"parameters" gorm:"type:jsonb;serializer:json"` // secrets masked
 	Logs         string                 `json:"logs" gorm:"type:text"`
 	Artifacts    []string               `json:"artifacts" gorm:"type:text[]"`
 	StartedAt    *time.Time             `json:"started_at"`
@@ -123,6 +129,9 @@ type Deployment struct {
 	DeployedAt    *time.Time             `json:"deployed_at"`
 	RolledBackAt  *time.Time             `json:"rolled_back_at"`
 	DeployedBy    string                 `json:"deployed_by"`
+	ApprovalPolicyID string              `json:"approval_policy_id,omitempty"`
+	ApprovedBy    []string               `json:"approved_by" gorm:"type:jsonb;serializer:json"` // approvers' token subjects
+	ApprovedAt    *time.Time             `json:"approved_at"`
 	CreatedAt     time.Time              `json:"created_at"`
 	UpdatedAt     time.Time              `json:"updated_at"`
 }
@@ -150,6 +159,7 @@ type DeploymentService struct {
 	config       *Config
 	router       *gin.Engine
 	httpServer   *http.Server
+	clusters     *clusterClients
 }
 
 // Prometheus metrics
@@ -223,6 +233,10 @@ func main() {
 		Environment:  getEnv("ENVIRONMENT", "development"),
 		MaxBuilds:    parseInt(getEnv("MAX_BUILDS", "10")),
 		BuildTimeout: parseInt(getEnv("BUILD_TIMEOUT", "3600")),
+
+		SecurityServiceURL: getEnv("SECURITY_SERVICE_URL", "http://security-service:8080"),
+		ApprovalRolesClaim: getEnv("APPROVAL_ROLES_CLAIM", "roles"),
+		IdentityCacheTTL:   time.Duration(parseInt(getEnv("IDENTITY_CACHE_TTL_SECONDS", "300"))) * time.Second,
 	}
 
 	service, err := NewDeploymentService(config)
@@ -245,7 +259,7 @@ func NewDeploymentService(config *Config) (*DeploymentService, error) {
 	}
 
 	// Auto-migrate tables
-	if err := db.AutoMigrate(&Pipeline{}, &Build{}, &Deployment{}, &Environment{}); err != nil {
+	if err := db.AutoMigrate(&Pipeline{}, &Build{}, &Deployment{}, &Environment{}, &TestReport{}, &TestResult{}, &TestQuarantine{}, &Cluster{}, &ClusterDeployment{}, &ApprovalPolicy{}, &DeploymentApproval{}); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
@@ -299,6 +313,7 @@ func NewDeploymentService(config *Config) (*DeploymentService, error) {
 		kubeClient:   kubeClient,
 		dockerClient: dockerClient,
 		config:       config,
+		clusters:     &clusterClients{clients: make(map[string]kubernetes.Interface)},
 	}
 
 	service.setupRoutes()
@@ -332,6 +347,8 @@ func (s *DeploymentService) setupRoutes() {
 		v1.DELETE("/pipelines/:id", s.deletePipeline)
 
 		// Build management
+		v1.GET("/pipelines/:id/parameters", s.getPipelineParameters)
+		v1.PUT("/pipelines/:id/parameters", s.setPipelineParameters)
 		v1.POST("/pipelines/:id/builds", s.triggerBuild)
 		v1.GET("/pipelines/:id/builds", s.listBuilds)
 		v1.GET("/builds/:id", s.getBuild)
@@ -339,6 +356,16 @@ func (s *DeploymentService) setupRoutes() {
 		v1.GET("/builds/:id/logs", s.getBuildLogs)
 		v1.GET("/builds/:id/artifacts", s.getBuildArtifacts)
 
+		// Test reports and flaky test tracking
+		v1.POST("/pipelines/:id/test-reports", s.ingestTestReport)
+		v1.GET("/pipelines/:id/test-reports", s.listTestReports)
+		v1.GET("/test-reports/:id", s.getTestReport)
+		v1.GET("/pipelines/:id/tests/history", s.getTestHistory)
+		v1.GET("/pipelines/:id/tests/flaky", s.listFlakyTests)
+		v1.POST("/pipelines/:id/quarantine", s.quarantineTest)
+		v1.GET("/pipelines/:id/quarantine", s.listQuarantinedTests)
+		v1.DELETE("/pipelines/:id/quarantine/:quarantine_id", s.releaseQuarantinedTest)
+
 		// Deployment management
 		v1.POST("/builds/:id/deploy", s.deployBuild)
 		v1.GET("/deployments", s.listDeployments)
@@ -346,6 +373,23 @@ func (s *DeploymentService) setupRoutes() {
 		v1.POST("/deployments/:id/rollback", s.rollbackDeployment)
 		v1.GET("/deployments/:id/status", s.getDeploymentStatus)
 
+		// Deployment approvals for protected environments
+		v1.PUT("/approval-policies", s.setApprovalPolicy)
+		v1.GET("/approval-policies", s.listApprovalPolicies)
+		v1.GET("/approval-policies/:environment", s.getApprovalPolicy)
+		v1.DELETE("/approval-policies/:environment", s.deleteApprovalPolicy)
+		v1.GET("/deployments/:id/approvals", s.listDeploymentApprovals)
+		v1.POST("/deployments/:id/approve", s.approveDeployment)
+		v1.POST("/deployments/:id/reject", s.rejectDeployment)
+
+		// Multi-cluster deployments
+		v1.POST("/builds/:id/deploy/clusters", s.deployBuildToClusters)
+		v1.GET("/deployments/:id/clusters", s.getClusterDeployments)
+		v1.POST("/deployments/:id/clusters/rollback", s.rollbackClusterDeployments)
+		v1.POST("/clusters", s.createCluster)
+		v1.GET("/clusters", s.listClusters)
+		v1.DELETE("/clusters/:id", s.deleteCluster)
+
 		// Environment management
 		v1.POST("/environments", s.createEnvironment)
 		v1.GET("/environments", s.listEnvironments)
@@ -361,6 +405,7 @@ func (s *DeploymentService) setupRoutes() {
 		v1.GET("/analytics/pipelines", s.getPipelineAnalytics)
 		v1.GET("/analytics/deployments", s.getDeploymentAnalytics)
 		v1.GET("/analytics/environments", s.getEnvironmentAnalytics)
+		v1.GET("/analytics/tests", s.getTestAnalytics)
 	}
 }
 
@@ -0,0 +1,747 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Multi-cluster deployments. One Deployment fans out to several registered
+// clusters, either all at once or in waves. Each cluster is tracked by its
+// own ClusterDeployment so a failure in one region doesn't hide the state of
+// the others, and only the clusters that failed need to be rolled back.
+
+// Cluster deployment statuses
+const (
+	ClusterStatusPending     = "pending"
+	ClusterStatusDeploying   = "deploying"
+	ClusterStatusDeployed    = "deployed"
+	ClusterStatusFailed      = "failed"
+	ClusterStatusSkipped     = "skipped"
+	ClusterStatusRollingBack = "rolling_back"
+	ClusterStatusRolledBack  = "rolled_back"
+)
+
+// Aggregate status when only some clusters succeeded
+const DeploymentStatusPartiallyDeployed = "partially_deployed"
+
+// Rollout strategies
+const (
+	RolloutStrategyParallel = "parallel"
+	RolloutStrategyWaves    = "waves"
+)
+
+const (
+	clusterRolloutTimeout  = 10 * time.Minute
+	clusterRolloutInterval = 5 * time.Second
+)
+
+// Cluster is a registered deployment target
+type Cluster struct {
+	ID         string            `json:"id" gorm:"primaryKey"`
+	Name       string            `json:"name" gorm:"uniqueIndex;not null"`
+	Region     string            `json:"region" gorm:"index"`
+	KubeConfig string            `json:"-" gorm:"type:text"` // empty means the service's own cluster
+	Context    string            `json:"context"`
+	Labels     map[string]string `json:"labels" gorm:"type:jsonb"`
+	IsActive   bool              `json:"is_active" gorm:"default:true"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// ClusterDeployment is one cluster's part of a multi-cluster Deployment
+type ClusterDeployment struct {
+	ID            string     `json:"id" gorm:"primaryKey"`
+	DeploymentID  string     `json:"deployment_id" gorm:"index"`
+	ClusterID     string     `json:"cluster_id" gorm:"index"`
+	ClusterName   string     `json:"cluster_name"`
+	Region        string     `json:"region"`
+	Wave          int        `json:"wave"`
+	Namespace     string     `json:"namespace"`
+	Workload      string     `json:"workload"`
+	Image         string     `json:"image"`
+	PreviousImage string     `json:"previous_image"`
+	Created       bool       `json:"created"` // workload did not exist before this rollout
+	Status        string     `json:"status" gorm:"index"`
+	Message       string     `json:"message"`
+	StartedAt     *time.Time `json:"started_at"`
+	CompletedAt   *time.Time `json:"completed_at"`
+	RolledBackAt  *time.Time `json:"rolled_back_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// clusterClients caches Kubernetes clients per registered cluster
+type clusterClients struct {
+	mutex   sync.Mutex
+	clients map[string]kubernetes.Interface
+}
+
+var clusterDeploymentsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "cluster_deployments_total",
+		Help: "Total number of per-cluster deployment outcomes",
+	},
+	[]string{"cluster", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(clusterDeploymentsTotal)
+}
+
+// Register a deployment target cluster
+func (s *DeploymentService) createCluster(c *gin.Context) {
+	var request struct {
+		Name       string            `json:"name" binding:"required"`
+		Region     string            `json:"region"`
+		KubeConfig string            `json:"kubeconfig"`
+		Context    string            `json:"context"`
+		Labels     map[string]string `json:"labels"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now().UTC()
+	cluster := &Cluster{
+		ID:         uuid.New().String(),
+		Name:       request.Name,
+		Region:     request.Region,
+		KubeConfig: request.KubeConfig,
+		Context:    request.Context,
+		Labels:     request.Labels,
+		IsActive:   true,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	// Fail fast on an unusable kubeconfig
+	if _, err := s.clusterClient(cluster); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.db.Create(cluster).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register cluster"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, cluster)
+}
+
+// List registered clusters
+func (s *DeploymentService) listClusters(c *gin.Context) {
+	query := s.db.Model(&Cluster{})
+	if region := c.Query("region"); region != "" {
+		query = query.Where("region = ?", region)
+	}
+
+	var clusters []Cluster
+	if err := query.Order("name ASC").Find(&clusters).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list clusters"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"clusters": clusters,
+		"total":    len(clusters),
+	})
+}
+
+// Remove a registered cluster
+func (s *DeploymentService) deleteCluster(c *gin.Context) {
+	id := c.Param("id")
+	result := s.db.Delete(&Cluster{}, "id = ?", id)
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete cluster"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cluster not found"})
+		return
+	}
+
+	s.clusters.mutex.Lock()
+	delete(s.clusters.clients, id)
+	s.clusters.mutex.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{"message": "Cluster deleted"})
+}
+
+// Deploy a build to several clusters
+func (s *DeploymentService) deployBuildToClusters(c *gin.Context) {
+	var request struct {
+		Environment   string `json:"environment" binding:"required"`
+		Image         string `json:"image" binding:"required"`
+		Version       string `json:"version"`
+		Namespace     string `json:"namespace"`
+		Workload      string `json:"workload"`
+		Replicas      int32  `json:"replicas"`
+		Strategy      string `json:"strategy"`
+		HaltOnFailure *bool  `json:"halt_on_failure"`
+		Clusters      []struct {
+			Cluster string `json:"cluster" binding:"required"`
+			Wave    int    `json:"wave"`
+		} `json:"clusters" binding:"required,min=1"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Strategy == "" {
+		request.Strategy = RolloutStrategyParallel
+	}
+	if request.Strategy != RolloutStrategyParallel && request.Strategy != RolloutStrategyWaves {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "strategy must be parallel or waves"})
+		return
+	}
+	if request.Namespace == "" {
+		request.Namespace = "default"
+	}
+	if request.Replicas <= 0 {
+		request.Replicas = 1
+	}
+
+	var build Build
+	if err := s.db.Preload("Pipeline").Where("id = ?", c.Param("id")).First(&build).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Build not found"})
+		return
+	}
+	if request.Workload == "" {
+		request.Workload = build.Pipeline.Name
+	}
+	if request.Version == "" {
+		request.Version = build.CommitSHA
+	}
+	haltOnFailure := request.HaltOnFailure == nil || *request.HaltOnFailure
+
+	// Protected environments wait for approvals, and need to know who asked
+	policy, err := s.approvalPolicy(request.Environment)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load approval policy"})
+		return
+	}
+	requester := c.GetHeader("X-User-ID")
+	if policy != nil {
+		who, err := s.requestIdentity(c)
+		if err != nil {
+			c.JSON(identityStatus(err), gin.H{"error": "Deploying to a protected environment: " + err.Error()})
+			return
+		}
+		requester = who.Subject
+	}
+
+	now := time.Now().UTC()
+	deployment := &Deployment{
+		ID:          uuid.New().String(),
+		BuildID:     build.ID,
+		Environment: request.Environment,
+		Status:      DeploymentStatusDeploying,
+		Version:     request.Version,
+		Config: map[string]interface{}{
+			"multi_cluster":   true,
+			"strategy":        request.Strategy,
+			"image":           request.Image,
+			"namespace":       request.Namespace,
+			"workload":        request.Workload,
+			"replicas":        request.Replicas,
+			"halt_on_failure": haltOnFailure,
+		},
+		DeployedBy: requester,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if policy != nil {
+		deployment.Status = DeploymentStatusPendingApproval
+		deployment.ApprovalPolicyID = policy.ID
+	}
+
+	targets := make([]ClusterDeployment, 0, len(request.Clusters))
+	seen := make(map[string]bool)
+	for _, target := range request.Clusters {
+		var cluster Cluster
+		if err := s.db.Where("(id = ? OR name = ?) AND is_active = ?", target.Cluster, target.Cluster, true).First(&cluster).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown or inactive cluster %q", target.Cluster)})
+			return
+		}
+		if seen[cluster.ID] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Cluster %q listed twice", cluster.Name)})
+			return
+		}
+		seen[cluster.ID] = true
+
+		wave := target.Wave
+		if request.Strategy == RolloutStrategyParallel {
+			wave = 0
+		}
+		targets = append(targets, ClusterDeployment{
+			ID:           uuid.New().String(),
+			DeploymentID: deployment.ID,
+			ClusterID:    cluster.ID,
+			ClusterName:  cluster.Name,
+			Region:       cluster.Region,
+			Wave:         wave,
+			Namespace:    request.Namespace,
+			Workload:     request.Workload,
+			Image:        request.Image,
+			Status:       ClusterStatusPending,
+			CreatedAt:    now,
+			UpdatedAt:    now,
+		})
+	}
+
+	if err := s.db.Omit("Build").Create(deployment).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create deployment"})
+		return
+	}
+	if err := s.db.Create(&targets).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create cluster deployments"})
+		return
+	}
+
+	if policy != nil {
+		c.JSON(http.StatusAccepted, gin.H{
+			"deployment":        deployment,
+			"clusters":          targets,
+			"approval_required": policy,
+		})
+		return
+	}
+	go s.runClusterRollout(deployment.ID, request.Replicas, haltOnFailure)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"deployment": deployment,
+		"clusters":   targets,
+	})
+}
+
+// Per-cluster and aggregate status of a deployment
+func (s *DeploymentService) getClusterDeployments(c *gin.Context) {
+	var deployment Deployment
+	if err := s.db.Where("id = ?", c.Param("id")).First(&deployment).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deployment not found"})
+		return
+	}
+
+	var targets []ClusterDeployment
+	if err := s.db.Where("deployment_id = ?", deployment.ID).Order("wave ASC, cluster_name ASC").Find(&targets).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cluster deployments"})
+		return
+	}
+
+	counts := make(map[string]int)
+	regions := make(map[string]map[string]int)
+	for _, target := range targets {
+		counts[target.Status]++
+		if regions[target.Region] == nil {
+			regions[target.Region] = make(map[string]int)
+		}
+		regions[target.Region][target.Status]++
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"deployment_id": deployment.ID,
+		"status":        aggregateClusterStatus(targets),
+		"counts":        counts,
+		"regions":       regions,
+		"clusters":      targets,
+	})
+}
+
+// Roll back some clusters of a deployment; by default only the failed ones
+func (s *DeploymentService) rollbackClusterDeployments(c *gin.Context) {
+	var request struct {
+		Clusters []string `json:"clusters"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	deploymentID := c.Param("id")
+	query := s.db.Where("deployment_id = ?", deploymentID)
+	if len(request.Clusters) > 0 {
+		query = query.Where("(cluster_id IN ? OR cluster_name IN ?) AND status IN ?", request.Clusters, request.Clusters,
+			[]string{ClusterStatusDeployed, ClusterStatusFailed})
+	} else {
+		query = query.Where("status = ?", ClusterStatusFailed)
+	}
+
+	var targets []ClusterDeployment
+	if err := query.Find(&targets).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cluster deployments"})
+		return
+	}
+	if len(targets) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No clusters eligible for rollback"})
+		return
+	}
+
+	ids := make([]string, 0, len(targets))
+	for _, target := range targets {
+		ids = append(ids, target.ID)
+	}
+	s.db.Model(&ClusterDeployment{}).Where("id IN ?", ids).Updates(map[string]interface{}{
+		"status":     ClusterStatusRollingBack,
+		"updated_at": time.Now().UTC(),
+	})
+
+	go func() {
+		var wg sync.WaitGroup
+		for i := range targets {
+			wg.Add(1)
+			go func(target *ClusterDeployment) {
+				defer wg.Done()
+				s.rollbackCluster(target)
+			}(&targets[i])
+		}
+		wg.Wait()
+		s.updateAggregateStatus(deploymentID)
+	}()
+
+	names := make([]string, 0, len(targets))
+	for _, target := range targets {
+		names = append(names, target.ClusterName)
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"deployment_id": deploymentID,
+		"rolling_back":  names,
+	})
+}
+
+// runClusterRollout deploys wave by wave; clusters within a wave run in parallel
+func (s *DeploymentService) runClusterRollout(deploymentID string, replicas int32, haltOnFailure bool) {
+	start := time.Now()
+
+	var targets []ClusterDeployment
+	if err := s.db.Where("deployment_id = ?", deploymentID).Find(&targets).Error; err != nil {
+		log.Printf("Multi-cluster rollout %s: failed to load targets: %v", deploymentID, err)
+		return
+	}
+
+	waves := make(map[int][]*ClusterDeployment)
+	order := []int{}
+	for i := range targets {
+		wave := targets[i].Wave
+		if _, ok := waves[wave]; !ok {
+			order = append(order, wave)
+		}
+		waves[wave] = append(waves[wave], &targets[i])
+	}
+	sort.Ints(order)
+
+	halted := false
+	for _, wave := range order {
+		if halted {
+			for _, target := range waves[wave] {
+				s.setClusterStatus(target, ClusterStatusSkipped, "Skipped after failure in an earlier wave")
+			}
+			continue
+		}
+
+		var wg sync.WaitGroup
+		for _, target := range waves[wave] {
+			wg.Add(1)
+			go func(target *ClusterDeployment) {
+				defer wg.Done()
+				s.deployToCluster(target, replicas)
+			}(target)
+		}
+		wg.Wait()
+
+		for _, target := range waves[wave] {
+			if target.Status == ClusterStatusFailed && haltOnFailure {
+				halted = true
+			}
+		}
+	}
+
+	status := s.updateAggregateStatus(deploymentID)
+	deploymentsTotal.WithLabelValues("multi_cluster", status).Inc()
+	deploymentDuration.WithLabelValues("multi_cluster").Observe(time.Since(start).Seconds())
+}
+
+func (s *DeploymentService) deployToCluster(target *ClusterDeployment, replicas int32) {
+	now := time.Now().UTC()
+	target.StartedAt = &now
+	s.setClusterStatus(target, ClusterStatusDeploying, "")
+
+	var cluster Cluster
+	if err := s.db.Where("id = ?", target.ClusterID).First(&cluster).Error; err != nil {
+		s.finishCluster(target, ClusterStatusFailed, "Cluster no longer registered")
+		return
+	}
+	client, err := s.clusterClient(&cluster)
+	if err != nil {
+		s.finishCluster(target, ClusterStatusFailed, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clusterRolloutTimeout)
+	defer cancel()
+
+	deployments := client.AppsV1().Deployments(target.Namespace)
+	existing, err := deployments.Get(ctx, target.Workload, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		target.Created = true
+		_, err = deployments.Create(ctx, newWorkload(target, replicas), metav1.CreateOptions{})
+	case err == nil:
+		containers := existing.Spec.Template.Spec.Containers
+		if len(containers) == 0 {
+			err = fmt.Errorf("workload %s has no containers", target.Workload)
+			break
+		}
+		index := workloadContainer(existing, target.Workload)
+		target.PreviousImage = containers[index].Image
+		containers[index].Image = target.Image
+		_, err = deployments.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		s.finishCluster(target, ClusterStatusFailed, err.Error())
+		return
+	}
+	s.db.Model(target).Updates(map[string]interface{}{
+		"previous_image": target.PreviousImage,
+		"created":        target.Created,
+	})
+
+	if err := waitForRollout(ctx, client, target.Namespace, target.Workload); err != nil {
+		s.finishCluster(target, ClusterStatusFailed, err.Error())
+		return
+	}
+	s.finishCluster(target, ClusterStatusDeployed, "Rollout complete")
+}
+
+func (s *DeploymentService) rollbackCluster(target *ClusterDeployment) {
+	var cluster Cluster
+	if err := s.db.Where("id = ?", target.ClusterID).First(&cluster).Error; err != nil {
+		s.setClusterStatus(target, ClusterStatusFailed, "Rollback failed: cluster no longer registered")
+		return
+	}
+	client, err := s.clusterClient(&cluster)
+	if err != nil {
+		s.setClusterStatus(target, ClusterStatusFailed, "Rollback failed: "+err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clusterRolloutTimeout)
+	defer cancel()
+	deployments := client.AppsV1().Deployments(target.Namespace)
+
+	// A workload this rollout created is removed rather than reverted
+	if target.Created {
+		err = deployments.Delete(ctx, target.Workload, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			s.setClusterStatus(target, ClusterStatusFailed, "Rollback failed: "+err.Error())
+			return
+		}
+	} else if target.PreviousImage != "" {
+		existing, err := deployments.Get(ctx, target.Workload, metav1.GetOptions{})
+		if err == nil {
+			index := workloadContainer(existing, target.Workload)
+			existing.Spec.Template.Spec.Containers[index].Image = target.PreviousImage
+			_, err = deployments.Update(ctx, existing, metav1.UpdateOptions{})
+		}
+		if err == nil {
+			err = waitForRollout(ctx, client, target.Namespace, target.Workload)
+		}
+		if err != nil {
+			s.setClusterStatus(target, ClusterStatusFailed, "Rollback failed: "+err.Error())
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	target.RolledBackAt = &now
+	s.db.Model(target).Update("rolled_back_at", now)
+	s.setClusterStatus(target, ClusterStatusRolledBack, "Rolled back")
+	clusterDeploymentsTotal.WithLabelValues(target.ClusterName, ClusterStatusRolledBack).Inc()
+}
+
+func (s *DeploymentService) setClusterStatus(target *ClusterDeployment, status, message string) {
+	target.Status = status
+	target.Message = message
+	s.db.Model(target).Updates(map[string]interface{}{
+		"status":     status,
+		"message":    message,
+		"started_at": target.StartedAt,
+		"updated_at": time.Now().UTC(),
+	})
+}
+
+func (s *DeploymentService) finishCluster(target *ClusterDeployment, status, message string) {
+	now := time.Now().UTC()
+	target.CompletedAt = &now
+	s.db.Model(target).Update("completed_at", now)
+	s.setClusterStatus(target, status, message)
+	clusterDeploymentsTotal.WithLabelValues(target.ClusterName, status).Inc()
+}
+
+// updateAggregateStatus writes the rolled-up status onto the Deployment
+func (s *DeploymentService) updateAggregateStatus(deploymentID string) string {
+	var targets []ClusterDeployment
+	s.db.Where("deployment_id = ?", deploymentID).Find(&targets)
+	status := aggregateClusterStatus(targets)
+
+	updates := map[string]interface{}{"status": status, "updated_at": time.Now().UTC()}
+	switch status {
+	case DeploymentStatusDeployed, DeploymentStatusPartiallyDeployed:
+		updates["deployed_at"] = time.Now().UTC()
+	case DeploymentStatusRolledBack:
+		updates["rolled_back_at"] = time.Now().UTC()
+	}
+	s.db.Model(&Deployment{}).Where("id = ?", deploymentID).Updates(updates)
+	return status
+}
+
+func aggregateClusterStatus(targets []ClusterDeployment) string {
+	counts := make(map[string]int)
+	for _, target := range targets {
+		counts[target.Status]++
+	}
+	total := len(targets)
+
+	switch {
+	case total == 0:
+		return DeploymentStatusPending
+	case counts[ClusterStatusPending]+counts[ClusterStatusDeploying]+counts[ClusterStatusRollingBack] > 0:
+		return DeploymentStatusDeploying
+	case counts[ClusterStatusDeployed] == total:
+		return DeploymentStatusDeployed
+	case counts[ClusterStatusRolledBack] == total:
+		return DeploymentStatusRolledBack
+	case counts[ClusterStatusDeployed] > 0:
+		return DeploymentStatusPartiallyDeployed
+	default:
+		return DeploymentStatusFailed
+	}
+}
+
+// clusterClient returns a cached client for a cluster
+func (s *DeploymentService) clusterClient(cluster *Cluster) (kubernetes.Interface, error) {
+	if cluster.KubeConfig == "" {
+		if s.kubeClient == nil {
+			return nil, fmt.Errorf("cluster %s has no kubeconfig and no in-cluster client is available", cluster.Name)
+		}
+		return s.kubeClient, nil
+	}
+
+	s.clusters.mutex.Lock()
+	defer s.clusters.mutex.Unlock()
+	if client, ok := s.clusters.clients[cluster.ID]; ok {
+		return client, nil
+	}
+
+	apiConfig, err := clientcmd.Load([]byte(cluster.KubeConfig))
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig for cluster %s: %w", cluster.Name, err)
+	}
+	restConfig, err := clientcmd.NewDefaultClientConfig(*apiConfig, &clientcmd.ConfigOverrides{
+		CurrentContext: cluster.Context,
+	}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig for cluster %s: %w", cluster.Name, err)
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client for cluster %s: %w", cluster.Name, err)
+	}
+
+	if cluster.ID != "" {
+		s.clusters.clients[cluster.ID] = client
+	}
+	return client, nil
+}
+
+func newWorkload(target *ClusterDeployment, replicas int32) *appsv1.Deployment {
+	labels := map[string]string{"app": target.Workload}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      target.Workload,
+			Namespace: target.Namespace,
+			Labels:    labels,
+			Annotations: map[string]string{
+				"002aic.io/deployment-id": target.DeploymentID,
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  target.Workload,
+						Image: target.Image,
+					}},
+				},
+			},
+		},
+	}
+}
+
+// The container named after the workload, else the first one
+func workloadContainer(deployment *appsv1.Deployment, name string) int {
+	for i, container := range deployment.Spec.Template.Spec.Containers {
+		if container.Name == name {
+			return i
+		}
+	}
+	return 0
+}
+
+// waitForRollout polls until every replica runs the new template
+func waitForRollout(ctx context.Context, client kubernetes.Interface, namespace, name string) error {
+	ticker := time.NewTicker(clusterRolloutInterval)
+	defer ticker.Stop()
+
+	for {
+		deployment, err := client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		for _, condition := range deployment.Status.Conditions {
+			if condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+				return fmt.Errorf("rollout exceeded its progress deadline: %s", condition.Message)
+			}
+		}
+
+		desired := int32(1)
+		if deployment.Spec.Replicas != nil {
+			desired = *deployment.Spec.Replicas
+		}
+		if deployment.Status.ObservedGeneration >= deployment.Generation &&
+			deployment.Status.UpdatedReplicas == desired &&
+			deployment.Status.AvailableReplicas == desired &&
+			deployment.Status.Replicas == desired {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for rollout of %s/%s", namespace, name)
+		case <-ticker.C:
+		}
+	}
+}
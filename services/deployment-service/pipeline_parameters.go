@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Pipeline parameters. A pipeline declares the typed parameters an operator
+// supplies when triggering a manual run:
+//
+//	string - free text, optionally matching a pattern
+//	enum   - one of the declared options
+//	bool   - true or false
+//	secret - free text that is never stored or shown
+//
+// Supplied values are validated, defaults filled in, and each is handed to
+// the build as an environment variable of the parameter's name. The Build
+// records every value, secrets masked, so the run can be reproduced. Secret
+// values only live in Redis, under buildEnvKey, until the build worker
+// collects them.
+
+// Parameter types
+const (
+	ParameterTypeString = "string"
+	ParameterTypeEnum   = "enum"
+	ParameterTypeBool   = "bool"
+	ParameterTypeSecret = "secret"
+)
+
+const (
+	buildQueueKey     = "deployment:build_queue"
+	buildEnvKeyPrefix = "deployment:build_env:"
+	buildEnvTTL       = 24 * time.Hour
+	maskedValue       = "********"
+	maxParameters     = 50
+	maxParameterValue = 4096
+)
+
+// Environment variable names; also keeps parameters clear of each other
+var parameterNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Names the build environment sets itself
+var reservedParameterNames = map[string]bool{
+	"PATH": true, "HOME": true, "BUILD_ID": true, "BUILD_NUMBER": true,
+	"PIPELINE_ID": true, "COMMIT_SHA": true, "BRANCH": true,
+}
+
+// PipelineParameter is a typed input of a manual pipeline run
+type PipelineParameter struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Required    bool     `json:"required"`
+	Default     *string  `json:"default,omitempty"` // not allowed for secrets
+	Options     []string `json:"options,omitempty"` // enum
+	Pattern     string   `json:"pattern,omitempty"` // string; anchored regular expression
+}
+
+func buildEnvKey(buildID string) string {
+	return buildEnvKeyPrefix + buildID
+}
+
+func validatePipelineParameters(parameters []PipelineParameter) error {
+	if len(parameters) > maxParameters {
+		return fmt.Errorf("at most %d parameters are allowed", maxParameters)
+	}
+	names := make(map[string]bool)
+	for i := range parameters {
+		p := &parameters[i]
+		if !parameterNamePattern.MatchString(p.Name) {
+			return fmt.Errorf("parameter %d: name must be a valid environment variable name", i)
+		}
+		if reservedParameterNames[strings.ToUpper(p.Name)] {
+			return fmt.Errorf("parameter %s: name is reserved", p.Name)
+		}
+		if names[strings.ToUpper(p.Name)] {
+			return fmt.Errorf("parameter %s: duplicate name", p.Name)
+		}
+		names[strings.ToUpper(p.Name)] = true
+
+		switch p.Type {
+		case ParameterTypeString:
+			if p.Pattern != "" {
+				if _, err := regexp.Compile("^(?:" + p.Pattern + ")$"); err != nil {
+					return fmt.Errorf("parameter %s: invalid pattern: %v", p.Name, err)
+				}
+			}
+		case ParameterTypeEnum:
+			if len(p.Options) == 0 {
+				return fmt.Errorf("parameter %s: enum requires options", p.Name)
+			}
+		case ParameterTypeBool:
+		case ParameterTypeSecret:
+			if p.Default != nil {
+				return fmt.Errorf("parameter %s: secrets cannot have a default", p.Name)
+			}
+		default:
+			return fmt.Errorf("parameter %s: type must be string, enum, bool or secret", p.Name)
+		}
+		if p.Type != ParameterTypeEnum && len(p.Options) > 0 {
+			return fmt.Errorf("parameter %s: options are only for enums", p.Name)
+		}
+		if p.Type != ParameterTypeString && p.Pattern != "" {
+			return fmt.Errorf("parameter %s: pattern is only for strings", p.Name)
+		}
+		if p.Default != nil {
+			if _, err := p.parse(*p.Default); err != nil {
+				return fmt.Errorf("parameter %s: invalid default: %v", p.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parse checks a value against the parameter and normalizes it
+func (p *PipelineParameter) parse(value string) (string, error) {
+	if len(value) > maxParameterValue {
+		return "", fmt.Errorf("value longer than %d bytes", maxParameterValue)
+	}
+	switch p.Type {
+	case ParameterTypeBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("must be true or false")
+		}
+		return strconv.FormatBool(b), nil
+	case ParameterTypeEnum:
+		for _, option := range p.Options {
+			if value == option {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("must be one of %s", strings.Join(p.Options, ", "))
+	case ParameterTypeString:
+		if p.Pattern != "" && !regexp.MustCompile("^(?:"+p.Pattern+")$").MatchString(value) {
+			return "", fmt.Errorf("must match %s", p.Pattern)
+		}
+	}
+	return value, nil
+}
+
+// resolveParameters validates the supplied values of a run and fills in
+// defaults. It returns the environment for the build and the values to
+// record, secrets masked.
+func resolveParameters(declared []PipelineParameter, supplied map[string]interface{}) (map[string]string, map[string]string, []string) {
+	env := make(map[string]string)
+	recorded := make(map[string]string)
+	var problems []string
+
+	known := make(map[string]bool, len(declared))
+	for _, p := range declared {
+		known[p.Name] = true
+	}
+	for name := range supplied {
+		if !known[name] {
+			problems = append(problems, fmt.Sprintf("%s: unknown parameter", name))
+		}
+	}
+
+	for i := range declared {
+		p := &declared[i]
+		raw, ok := supplied[p.Name]
+		var value string
+		switch {
+		case !ok || raw == nil:
+			if p.Default == nil {
+				if p.Required {
+					problems = append(problems, fmt.Sprintf("%s: required", p.Name))
+				}
+				continue
+			}
+			value = *p.Default
+		default:
+			switch v := raw.(type) {
+			case string:
+				value = v
+			case bool:
+				value = strconv.FormatBool(v)
+			default:
+				problems = append(problems, fmt.Sprintf("%s: must be a string or boolean", p.Name))
+				continue
+			}
+		}
+
+		if value == "" && p.Required {
+			problems = append(problems, fmt.Sprintf("%s: required", p.Name))
+			continue
+		}
+		parsed, err := p.parse(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", p.Name, err))
+			continue
+		}
+		env[p.Name] = parsed
+		if p.Type == ParameterTypeSecret {
+			recorded[p.Name] = maskedValue
+		} else {
+			recorded[p.Name] = parsed
+		}
+	}
+	return env, recorded, problems
+}
+
+// Parameters a pipeline takes on manual runs
+func (s *DeploymentService) getPipelineParameters(c *gin.Context) {
+	var pipeline Pipeline
+	if err := s.db.First(&pipeline, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pipeline not found"})
+		return
+	}
+
+	parameters := pipeline.Parameters
+	if parameters == nil {
+		parameters = []PipelineParameter{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"pipeline_id": pipeline.ID,
+		"parameters":  parameters,
+	})
+}
+
+// Replace the parameters a pipeline takes
+func (s *DeploymentService) setPipelineParameters(c *gin.Context) {
+	var pipeline Pipeline
+	if err := s.db.First(&pipeline, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pipeline not found"})
+		return
+	}
+
+	var req struct {
+		Parameters []PipelineParameter `json:"parameters"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validatePipelineParameters(req.Parameters); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	pipeline.Parameters = req.Parameters
+	pipeline.UpdatedAt = time.Now()
+	if err := s.db.Model(&pipeline).Select("parameters", "updated_at").Updates(&pipeline).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update pipeline parameters"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"pipeline_id": pipeline.ID,
+		"parameters":  req.Parameters,
+	})
+}
+
+// Trigger a manual run of a pipeline with parameter values
+func (s *DeploymentService) triggerBuild(c *gin.Context) {
+	var pipeline Pipeline
+	if err := s.db.First(&pipeline, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pipeline not found"})
+		return
+	}
+
+	var req struct {
+		Parameters map[string]interface{} `json:"parameters"`
+		CommitSHA  string                 `json:"commit_sha"`
+		Branch     string                 `json:"branch"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	env, recorded, problems := resolveParameters(pipeline.Parameters, req.Parameters)
+	if len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid parameters",
+			"details": problems,
+		})
+		return
+	}
+
+	branch := req.Branch
+	if branch == "" {
+		branch = pipeline.Branch
+	}
+	build := Build{
+		ID:          uuid.New().String(),
+		PipelineID:  pipeline.ID,
+		Status:      PipelineStatusPending,
+		CommitSHA:   req.CommitSHA,
+		Config:      map[string]interface{}{"trigger": "manual", "branch": branch},
+		Parameters:  recorded,
+		TriggeredBy: c.GetHeader("X-User-ID"),
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+
+	// Number the build under a lock on the pipeline, so concurrent runs
+	// can't take the same number
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT id FROM pipelines WHERE id = ? FOR UPDATE", pipeline.ID).Error; err != nil {
+			return err
+		}
+		var last int
+		if err := tx.Model(&Build{}).Where("pipeline_id = ?", pipeline.ID).Select("COALESCE(MAX(number), 0)").Scan(&last).Error; err != nil {
+			return err
+		}
+		build.Number = last + 1
+		return tx.Omit("Pipeline").Create(&build).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create build"})
+		return
+	}
+
+	if err := s.queueBuild(c.Request.Context(), &build, env); err != nil {
+		s.db.Model(&build).Updates(map[string]interface{}{
+			"status":     PipelineStatusFailed,
+			"logs":       "Failed to queue build: " + err.Error(),
+			"updated_at": time.Now(),
+		})
+		buildsTotal.WithLabelValues(pipeline.ID, PipelineStatusFailed).Inc()
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to queue build"})
+		return
+	}
+	buildsTotal.WithLabelValues(pipeline.ID, PipelineStatusPending).Inc()
+
+	c.JSON(http.StatusCreated, build)
+}
+
+// queueBuild hands a build and its environment to the build worker
+func (s *DeploymentService) queueBuild(ctx context.Context, build *Build, env map[string]string) error {
+	if len(env) > 0 {
+		values := make(map[string]interface{}, len(env))
+		for name, value := range env {
+			values[name] = value
+		}
+		pipe := s.redis.TxPipeline()
+		pipe.HSet(ctx, buildEnvKey(build.ID), values)
+		pipe.Expire(ctx, buildEnvKey(build.ID), buildEnvTTL)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	return s.redis.RPush(ctx, buildQueueKey, build.ID).Err()
+}
+
+// buildEnvironment collects a build's parameter environment, deleting it so
+// secrets don't outlive the build's start. The build worker calls it once,
+// when starting the build.
+func (s *DeploymentService) buildEnvironment(ctx context.Context, build *Build) ([]string, error) {
+	values, err := s.redis.HGetAll(ctx, buildEnvKey(build.ID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 && len(build.Parameters) > 0 {
+		return nil, errors.New("build parameters have expired")
+	}
+	s.redis.Del(ctx, buildEnvKey(build.ID))
+
+	env := []string{
+		"BUILD_ID=" + build.ID,
+		"BUILD_NUMBER=" + strconv.Itoa(build.Number),
+		"PIPELINE_ID=" + build.PipelineID,
+		"COMMIT_SHA=" + build.CommitSHA,
+	}
+	if branch, ok := build.Config["branch"].(string); ok {
+		env = append(env, "BRANCH="+branch)
+	}
+	for name, value := range values {
+		env = append(env, name+"="+value)
+	}
+	return env, nil
+}
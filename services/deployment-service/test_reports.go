@@ -0,0 +1,793 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Test report ingestion. Build steps upload JUnit XML or `go test -json`
+// output; every test result is stored so pass/fail history can be tracked
+// per pipeline. Flakiness is the rate at which a test flips between pass and
+// fail over its recent runs. Quarantined tests still have their results
+// recorded but their failures don't fail the build gate.
+
+// Test result statuses
+const (
+	TestStatusPassed  = "passed"
+	TestStatusFailed  = "failed"
+	TestStatusSkipped = "skipped"
+)
+
+// Test report formats
+const (
+	TestReportFormatJUnit  = "junit"
+	TestReportFormatGoJSON = "go-json"
+)
+
+const (
+	maxTestReportSize     = 20 << 20
+	maxTestMessageLength  = 4096
+	defaultFlakyWindow    = 30
+	defaultFlakyThreshold = 0.1
+	minFlakyRuns          = 5
+)
+
+type TestReport struct {
+	ID                  string    `json:"id" gorm:"primaryKey"`
+	PipelineID          string    `json:"pipeline_id" gorm:"index"`
+	BuildID             string    `json:"build_id" gorm:"index"`
+	Repository          string    `json:"repository" gorm:"index"`
+	Format              string    `json:"format"`
+	Total               int       `json:"total"`
+	Passed              int       `json:"passed"`
+	Failed              int       `json:"failed"`
+	Skipped             int       `json:"skipped"`
+	QuarantinedFailures int       `json:"quarantined_failures"`
+	Duration            float64   `json:"duration_seconds"`
+	GatePassed          bool      `json:"gate_passed"`
+	CreatedAt           time.Time `json:"created_at" gorm:"index"`
+}
+
+type TestResult struct {
+	ID         string    `json:"id" gorm:"primaryKey"`
+	ReportID   string    `json:"report_id" gorm:"index"`
+	PipelineID string    `json:"pipeline_id" gorm:"index:idx_test_results_pipeline_test"`
+	TestID     string    `json:"test_id" gorm:"index:idx_test_results_pipeline_test"`
+	BuildID    string    `json:"build_id"`
+	Repository string    `json:"repository" gorm:"index"`
+	Suite      string    `json:"suite"`
+	Name       string    `json:"name"`
+	Status     string    `json:"status" gorm:"index"`
+	Duration   float64   `json:"duration_seconds"`
+	Message    string    `json:"message,omitempty" gorm:"type:text"`
+	CommitSHA  string    `json:"commit_sha"`
+	CreatedAt  time.Time `json:"created_at" gorm:"index"`
+}
+
+type TestQuarantine struct {
+	ID             string     `json:"id" gorm:"primaryKey"`
+	PipelineID     string     `json:"pipeline_id" gorm:"uniqueIndex:idx_test_quarantine_pipeline_test"`
+	TestID         string     `json:"test_id" gorm:"uniqueIndex:idx_test_quarantine_pipeline_test"`
+	Reason         string     `json:"reason"`
+	FlakinessScore float64    `json:"flakiness_score"`
+	QuarantinedBy  string     `json:"quarantined_by"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// FlakyTest summarizes a test's recent history
+type FlakyTest struct {
+	TestID         string     `json:"test_id"`
+	Runs           int        `json:"runs"`
+	Passes         int        `json:"passes"`
+	Failures       int        `json:"failures"`
+	Flips          int        `json:"flips"`
+	FlakinessScore float64    `json:"flakiness_score"`
+	LastStatus     string     `json:"last_status"`
+	LastFailure    *time.Time `json:"last_failure,omitempty"`
+	Quarantined    bool       `json:"quarantined"`
+}
+
+var testResultsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "test_results_total",
+		Help: "Total number of ingested test results",
+	},
+	[]string{"repository", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(testResultsTotal)
+}
+
+// Ingest a JUnit or Go test JSON report for a pipeline
+func (s *DeploymentService) ingestTestReport(c *gin.Context) {
+	var pipeline Pipeline
+	if err := s.db.Where("id = ?", c.Param("id")).First(&pipeline).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pipeline not found"})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxTestReportSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read report"})
+		return
+	}
+	if len(body) > maxTestReportSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Report exceeds %d bytes", maxTestReportSize)})
+		return
+	}
+
+	format := c.Query("format")
+	if format == "" {
+		format = detectTestReportFormat(c.ContentType(), body)
+	}
+
+	var results []TestResult
+	switch format {
+	case TestReportFormatJUnit:
+		results, err = parseJUnitReport(body)
+	case TestReportFormatGoJSON:
+		results, err = parseGoTestJSON(body)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be junit or go-json"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse report: " + err.Error()})
+		return
+	}
+	if len(results) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Report contains no test results"})
+		return
+	}
+
+	buildID := c.Query("build_id")
+	commitSHA := c.Query("commit_sha")
+	if buildID != "" && commitSHA == "" {
+		var build Build
+		if err := s.db.Select("commit_sha").Where("id = ?", buildID).First(&build).Error; err == nil {
+			commitSHA = build.CommitSHA
+		}
+	}
+
+	quarantined, err := s.activeQuarantines(pipeline.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load quarantined tests"})
+		return
+	}
+
+	now := time.Now().UTC()
+	report := &TestReport{
+		ID:         uuid.New().String(),
+		PipelineID: pipeline.ID,
+		BuildID:    buildID,
+		Repository: pipeline.Repository,
+		Format:     format,
+		Total:      len(results),
+		CreatedAt:  now,
+	}
+
+	blocking := []string{}
+	quarantinedFailures := []string{}
+	for i := range results {
+		result := &results[i]
+		result.ID = uuid.New().String()
+		result.ReportID = report.ID
+		result.PipelineID = pipeline.ID
+		result.BuildID = buildID
+		result.Repository = pipeline.Repository
+		result.CommitSHA = commitSHA
+		result.CreatedAt = now
+		report.Duration += result.Duration
+
+		switch result.Status {
+		case TestStatusPassed:
+			report.Passed++
+		case TestStatusSkipped:
+			report.Skipped++
+		case TestStatusFailed:
+			report.Failed++
+			if quarantined[result.TestID] {
+				quarantinedFailures = append(quarantinedFailures, result.TestID)
+			} else {
+				blocking = append(blocking, result.TestID)
+			}
+		}
+		testResultsTotal.WithLabelValues(pipeline.Repository, result.Status).Inc()
+	}
+	report.QuarantinedFailures = len(quarantinedFailures)
+	report.GatePassed = len(blocking) == 0
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(report).Error; err != nil {
+			return err
+		}
+		return tx.CreateInBatches(results, 500).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store test report"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"report": report,
+		"gate": gin.H{
+			"passed":               report.GatePassed,
+			"blocking_failures":    blocking,
+			"quarantined_failures": quarantinedFailures,
+		},
+	})
+}
+
+// List test reports for a pipeline
+func (s *DeploymentService) listTestReports(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	query := s.db.Where("pipeline_id = ?", c.Param("id"))
+	if buildID := c.Query("build_id"); buildID != "" {
+		query = query.Where("build_id = ?", buildID)
+	}
+
+	var reports []TestReport
+	if err := query.Order("created_at DESC").Limit(limit).Find(&reports).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list test reports"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"reports": reports,
+		"total":   len(reports),
+	})
+}
+
+// Get a test report with its results
+func (s *DeploymentService) getTestReport(c *gin.Context) {
+	var report TestReport
+	if err := s.db.Where("id = ?", c.Param("id")).First(&report).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Test report not found"})
+		return
+	}
+
+	query := s.db.Where("report_id = ?", report.ID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var results []TestResult
+	if err := query.Order("test_id ASC").Find(&results).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load test results"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"report":  report,
+		"results": results,
+	})
+}
+
+// Pass/fail history of a single test
+func (s *DeploymentService) getTestHistory(c *gin.Context) {
+	testID := c.Query("test_id")
+	if testID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "test_id is required"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	var results []TestResult
+	if err := s.db.Where("pipeline_id = ? AND test_id = ?", c.Param("id"), testID).
+		Order("created_at DESC").Limit(limit).Find(&results).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load test history"})
+		return
+	}
+
+	summaries := computeFlakiness(results)
+	var summary *FlakyTest
+	if len(summaries) > 0 {
+		summary = &summaries[0]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"test_id": testID,
+		"history": results,
+		"summary": summary,
+	})
+}
+
+// List tests whose recent history flips between pass and fail
+func (s *DeploymentService) listFlakyTests(c *gin.Context) {
+	window, _ := strconv.Atoi(c.DefaultQuery("window", strconv.Itoa(defaultFlakyWindow)))
+	if window < minFlakyRuns || window > 500 {
+		window = defaultFlakyWindow
+	}
+	threshold, err := strconv.ParseFloat(c.DefaultQuery("threshold", fmt.Sprintf("%g", defaultFlakyThreshold)), 64)
+	if err != nil || threshold < 0 {
+		threshold = defaultFlakyThreshold
+	}
+
+	flaky, err := s.flakyTests(c.Param("id"), window, threshold)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute flakiness"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tests":     flaky,
+		"total":     len(flaky),
+		"window":    window,
+		"threshold": threshold,
+	})
+}
+
+// Quarantine a test so its failures no longer fail the pipeline gate
+func (s *DeploymentService) quarantineTest(c *gin.Context) {
+	var request struct {
+		TestID         string `json:"test_id" binding:"required"`
+		Reason         string `json:"reason"`
+		ExpiresInHours int    `json:"expires_in_hours"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var pipeline Pipeline
+	if err := s.db.Where("id = ?", c.Param("id")).First(&pipeline).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pipeline not found"})
+		return
+	}
+
+	// Record the score at the time of quarantine for later review
+	var history []TestResult
+	s.db.Where("pipeline_id = ? AND test_id = ?", pipeline.ID, request.TestID).
+		Order("created_at DESC").Limit(defaultFlakyWindow).Find(&history)
+	score := 0.0
+	if summaries := computeFlakiness(history); len(summaries) > 0 {
+		score = summaries[0].FlakinessScore
+	}
+
+	now := time.Now().UTC()
+	quarantine := &TestQuarantine{
+		ID:             uuid.New().String(),
+		PipelineID:     pipeline.ID,
+		TestID:         request.TestID,
+		Reason:         request.Reason,
+		FlakinessScore: score,
+		QuarantinedBy:  c.GetHeader("X-User-ID"),
+		CreatedAt:      now,
+	}
+	if request.ExpiresInHours > 0 {
+		expires := now.Add(time.Duration(request.ExpiresInHours) * time.Hour)
+		quarantine.ExpiresAt = &expires
+	}
+
+	// Re-quarantining a test replaces the previous entry
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("pipeline_id = ? AND test_id = ?", pipeline.ID, request.TestID).Delete(&TestQuarantine{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(quarantine).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to quarantine test"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, quarantine)
+}
+
+// List quarantined tests for a pipeline
+func (s *DeploymentService) listQuarantinedTests(c *gin.Context) {
+	var quarantines []TestQuarantine
+	if err := s.db.Where("pipeline_id = ? AND (expires_at IS NULL OR expires_at > ?)", c.Param("id"), time.Now().UTC()).
+		Order("created_at DESC").Find(&quarantines).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list quarantined tests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"quarantined": quarantines,
+		"total":       len(quarantines),
+	})
+}
+
+// Release a test from quarantine
+func (s *DeploymentService) releaseQuarantinedTest(c *gin.Context) {
+	result := s.db.Where("id = ? AND pipeline_id = ?", c.Param("quarantine_id"), c.Param("id")).Delete(&TestQuarantine{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release test"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quarantine entry not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Test released from quarantine"})
+}
+
+// Daily test trends for a repository
+func (s *DeploymentService) getTestAnalytics(c *gin.Context) {
+	repository := c.Query("repository")
+	if repository == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "repository is required"})
+		return
+	}
+	days, _ := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if days <= 0 || days > 365 {
+		days = 30
+	}
+	since := time.Now().UTC().AddDate(0, 0, -days)
+
+	var trend []struct {
+		Day      time.Time
+		Reports  int
+		Total    int
+		Passed   int
+		Failed   int
+		Skipped  int
+		GateFail int
+		Duration float64
+	}
+	err := s.db.Model(&TestReport{}).
+		Select(`date_trunc('day', created_at) AS day,
+			COUNT(*) AS reports,
+			COALESCE(SUM(total), 0) AS total,
+			COALESCE(SUM(passed), 0) AS passed,
+			COALESCE(SUM(failed), 0) AS failed,
+			COALESCE(SUM(skipped), 0) AS skipped,
+			COUNT(*) FILTER (WHERE NOT gate_passed) AS gate_fail,
+			COALESCE(AVG(duration), 0) AS duration`).
+		Where("repository = ? AND created_at >= ?", repository, since).
+		Group("day").Order("day ASC").
+		Scan(&trend).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute test trends"})
+		return
+	}
+
+	daily := make([]gin.H, 0, len(trend))
+	for _, day := range trend {
+		passRate := 0.0
+		if executed := day.Passed + day.Failed; executed > 0 {
+			passRate = float64(day.Passed) / float64(executed) * 100
+		}
+		daily = append(daily, gin.H{
+			"day":                  day.Day.Format("2006-01-02"),
+			"reports":              day.Reports,
+			"total":                day.Total,
+			"passed":               day.Passed,
+			"failed":               day.Failed,
+			"skipped":              day.Skipped,
+			"gate_failures":        day.GateFail,
+			"pass_rate":            passRate,
+			"avg_duration_seconds": day.Duration,
+		})
+	}
+
+	// Flaky tests across every pipeline of the repository
+	var pipelineIDs []string
+	s.db.Model(&Pipeline{}).Where("repository = ?", repository).Pluck("id", &pipelineIDs)
+
+	flaky := []gin.H{}
+	for _, pipelineID := range pipelineIDs {
+		tests, err := s.flakyTests(pipelineID, defaultFlakyWindow, defaultFlakyThreshold)
+		if err != nil {
+			continue
+		}
+		for _, test := range tests {
+			flaky = append(flaky, gin.H{
+				"pipeline_id":     pipelineID,
+				"test_id":         test.TestID,
+				"flakiness_score": test.FlakinessScore,
+				"quarantined":     test.Quarantined,
+			})
+		}
+	}
+	sort.Slice(flaky, func(i, j int) bool {
+		return flaky[i]["flakiness_score"].(float64) > flaky[j]["flakiness_score"].(float64)
+	})
+	if len(flaky) > 20 {
+		flaky = flaky[:20]
+	}
+
+	var quarantinedCount int64
+	if len(pipelineIDs) > 0 {
+		s.db.Model(&TestQuarantine{}).
+			Where("pipeline_id IN ? AND (expires_at IS NULL OR expires_at > ?)", pipelineIDs, time.Now().UTC()).
+			Count(&quarantinedCount)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"repository":        repository,
+		"days":              days,
+		"trend":             daily,
+		"top_flaky_tests":   flaky,
+		"quarantined_tests": quarantinedCount,
+	})
+}
+
+func (s *DeploymentService) activeQuarantines(pipelineID string) (map[string]bool, error) {
+	var testIDs []string
+	err := s.db.Model(&TestQuarantine{}).
+		Where("pipeline_id = ? AND (expires_at IS NULL OR expires_at > ?)", pipelineID, time.Now().UTC()).
+		Pluck("test_id", &testIDs).Error
+	if err != nil {
+		return nil, err
+	}
+	quarantined := make(map[string]bool, len(testIDs))
+	for _, testID := range testIDs {
+		quarantined[testID] = true
+	}
+	return quarantined, nil
+}
+
+// flakyTests scores the last `window` executed runs of every test in a pipeline
+func (s *DeploymentService) flakyTests(pipelineID string, window int, threshold float64) ([]FlakyTest, error) {
+	var results []TestResult
+	err := s.db.Raw(`
+		SELECT test_id, status, created_at FROM (
+			SELECT test_id, status, created_at,
+				ROW_NUMBER() OVER (PARTITION BY test_id ORDER BY created_at DESC) AS rn
+			FROM test_results
+			WHERE pipeline_id = ? AND status <> ?
+		) recent
+		WHERE rn <= ?
+		ORDER BY test_id, created_at DESC`, pipelineID, TestStatusSkipped, window).
+		Scan(&results).Error
+	if err != nil {
+		return nil, err
+	}
+
+	quarantined, err := s.activeQuarantines(pipelineID)
+	if err != nil {
+		return nil, err
+	}
+
+	flaky := []FlakyTest{}
+	for _, test := range computeFlakiness(results) {
+		if test.Runs < minFlakyRuns || test.FlakinessScore < threshold || test.Flips == 0 {
+			continue
+		}
+		test.Quarantined = quarantined[test.TestID]
+		flaky = append(flaky, test)
+	}
+	sort.Slice(flaky, func(i, j int) bool {
+		return flaky[i].FlakinessScore > flaky[j].FlakinessScore
+	})
+	return flaky, nil
+}
+
+// computeFlakiness groups results (newest first within each test) and scores
+// each test as the fraction of consecutive runs whose outcome changed.
+func computeFlakiness(results []TestResult) []FlakyTest {
+	byTest := make(map[string]*FlakyTest)
+	previous := make(map[string]string)
+	order := []string{}
+
+	for _, result := range results {
+		if result.Status == TestStatusSkipped {
+			continue
+		}
+		test, ok := byTest[result.TestID]
+		if !ok {
+			test = &FlakyTest{TestID: result.TestID, LastStatus: result.Status}
+			byTest[result.TestID] = test
+			order = append(order, result.TestID)
+		}
+		test.Runs++
+		if result.Status == TestStatusFailed {
+			test.Failures++
+			if test.LastFailure == nil {
+				failedAt := result.CreatedAt
+				test.LastFailure = &failedAt
+			}
+		} else {
+			test.Passes++
+		}
+		if prev, ok := previous[result.TestID]; ok && prev != result.Status {
+			test.Flips++
+		}
+		previous[result.TestID] = result.Status
+	}
+
+	summaries := make([]FlakyTest, 0, len(order))
+	for _, testID := range order {
+		test := byTest[testID]
+		if test.Runs > 1 {
+			test.FlakinessScore = float64(test.Flips) / float64(test.Runs-1)
+		}
+		summaries = append(summaries, *test)
+	}
+	return summaries
+}
+
+func detectTestReportFormat(contentType string, body []byte) string {
+	switch {
+	case strings.Contains(contentType, "xml"):
+		return TestReportFormatJUnit
+	case strings.Contains(contentType, "json"):
+		return TestReportFormatGoJSON
+	}
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '<' {
+		return TestReportFormatJUnit
+	}
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return TestReportFormatGoJSON
+	}
+	return ""
+}
+
+type junitTestCase struct {
+	Name      string  `xml:"name,attr"`
+	ClassName string  `xml:"classname,attr"`
+	Time      float64 `xml:"time,attr"`
+	Failure   *struct {
+		Message string `xml:"message,attr"`
+		Body    string `xml:",chardata"`
+	} `xml:"failure"`
+	Error *struct {
+		Message string `xml:"message,attr"`
+		Body    string `xml:",chardata"`
+	} `xml:"error"`
+	Skipped *struct{} `xml:"skipped"`
+}
+
+type junitTestSuite struct {
+	Name      string           `xml:"name,attr"`
+	TestCases []junitTestCase  `xml:"testcase"`
+	Suites    []junitTestSuite `xml:"testsuite"`
+}
+
+// parseJUnitReport accepts a <testsuites> or bare <testsuite> document
+func parseJUnitReport(body []byte) ([]TestResult, error) {
+	var root struct {
+		XMLName   xml.Name
+		Name      string           `xml:"name,attr"`
+		TestCases []junitTestCase  `xml:"testcase"`
+		Suites    []junitTestSuite `xml:"testsuite"`
+	}
+	if err := xml.Unmarshal(body, &root); err != nil {
+		return nil, err
+	}
+
+	var results []TestResult
+	var walk func(suite junitTestSuite)
+	walk = func(suite junitTestSuite) {
+		for _, tc := range suite.TestCases {
+			suiteName := tc.ClassName
+			if suiteName == "" {
+				suiteName = suite.Name
+			}
+			result := TestResult{
+				Suite:    suiteName,
+				Name:     tc.Name,
+				TestID:   testIdentifier(suiteName, tc.Name),
+				Status:   TestStatusPassed,
+				Duration: tc.Time,
+			}
+			switch {
+			case tc.Failure != nil:
+				result.Status = TestStatusFailed
+				result.Message = truncateMessage(strings.TrimSpace(tc.Failure.Message + "\n" + tc.Failure.Body))
+			case tc.Error != nil:
+				result.Status = TestStatusFailed
+				result.Message = truncateMessage(strings.TrimSpace(tc.Error.Message + "\n" + tc.Error.Body))
+			case tc.Skipped != nil:
+				result.Status = TestStatusSkipped
+			}
+			results = append(results, result)
+		}
+		for _, child := range suite.Suites {
+			walk(child)
+		}
+	}
+
+	switch root.XMLName.Local {
+	case "testsuites", "testsuite":
+		walk(junitTestSuite{Name: root.Name, TestCases: root.TestCases, Suites: root.Suites})
+	default:
+		return nil, fmt.Errorf("unexpected root element <%s>", root.XMLName.Local)
+	}
+	return results, nil
+}
+
+// parseGoTestJSON reads the event stream produced by `go test -json`
+func parseGoTestJSON(body []byte) ([]TestResult, error) {
+	type event struct {
+		Action  string  `json:"Action"`
+		Package string  `json:"Package"`
+		Test    string  `json:"Test"`
+		Elapsed float64 `json:"Elapsed"`
+		Output  string  `json:"Output"`
+	}
+
+	output := make(map[string]*strings.Builder)
+	var results []TestResult
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	for {
+		var ev event
+		if err := decoder.Decode(&ev); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		if ev.Test == "" {
+			continue
+		}
+		key := testIdentifier(ev.Package, ev.Test)
+
+		switch ev.Action {
+		case "output":
+			buf, ok := output[key]
+			if !ok {
+				buf = &strings.Builder{}
+				output[key] = buf
+			}
+			if buf.Len() < maxTestMessageLength {
+				buf.WriteString(ev.Output)
+			}
+		case "pass", "fail", "skip":
+			status := TestStatusPassed
+			if ev.Action == "fail" {
+				status = TestStatusFailed
+			} else if ev.Action == "skip" {
+				status = TestStatusSkipped
+			}
+			result := TestResult{
+				Suite:    ev.Package,
+				Name:     ev.Test,
+				TestID:   key,
+				Status:   status,
+				Duration: ev.Elapsed,
+			}
+			if status == TestStatusFailed {
+				if buf, ok := output[key]; ok {
+					result.Message = truncateMessage(buf.String())
+				}
+			}
+			delete(output, key)
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+func testIdentifier(suite, name string) string {
+	if suite == "" {
+		return name
+	}
+	return suite + "::" + name
+}
+
+func truncateMessage(message string) string {
+	if len(message) > maxTestMessageLength {
+		return message[:maxTestMessageLength]
+	}
+	return message
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// Client bootstrap. A service is issued a bootstrap token naming it and the
+// services it calls. On startup its client SDK makes one call,
+// GET /v1/discovery/bootstrap with the token as a bearer token, and gets
+// back everything it used to fetch piecemeal: the registration to send for
+// itself, the healthy instances of its upstreams, the revision to watch from
+// and how often to heartbeat and refresh. Only a hash of each token is kept.
+
+const (
+	bootstrapTokenPrefix = "dsb_"
+	defaultRefreshSecs   = 30
+)
+
+// BootstrapToken identifies a service to the bootstrap endpoint and holds
+// its registration template
+type BootstrapToken struct {
+	ID           string            `json:"id" gorm:"primaryKey"`
+	Token        string            `json:"token,omitempty" gorm:"-"` // only when created
+	TokenHash    string            `json:"-" gorm:"uniqueIndex;not null"`
+	TokenPrefix  string            `json:"token_prefix"`
+	ServiceName  string            `json:"service_name" gorm:"not null;index"`
+	Dependencies []string          `json:"dependencies" gorm:"type:jsonb"`
+	Protocol     string            `json:"protocol"`
+	HealthCheck  string            `json:"health_check"` // path on the instance
+	Environment  string            `json:"environment"`
+	Region       string            `json:"region"`
+	Tags         []string          `json:"tags" gorm:"type:jsonb"`
+	Metadata     map[string]string `json:"metadata" gorm:"type:jsonb"`
+	TTL          int               `json:"ttl"`
+	ExpiresAt    *time.Time        `json:"expires_at"`
+	RevokedAt    *time.Time        `json:"revoked_at"`
+	LastUsedAt   *time.Time        `json:"last_used_at"`
+	CreatedAt    time.Time         `json:"created_at"`
+}
+
+func hashBootstrapToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue a bootstrap token for a service
+func (ds *DiscoveryService) createBootstrapToken(c *gin.Context) {
+	var req BootstrapToken
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ServiceName == "" {
+		c.JSON(400, gin.H{"error": "service_name is required"})
+		return
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		c.JSON(400, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	token := bootstrapTokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	bootstrap := BootstrapToken{
+		ID:           uuid.New().String(),
+		Token:        token,
+		TokenHash:    hashBootstrapToken(token),
+		TokenPrefix:  token[:len(bootstrapTokenPrefix)+6],
+		ServiceName:  req.ServiceName,
+		Dependencies: req.Dependencies,
+		Protocol:     req.Protocol,
+		HealthCheck:  req.HealthCheck,
+		Environment:  req.Environment,
+		Region:       req.Region,
+		Tags:         req.Tags,
+		Metadata:     req.Metadata,
+		TTL:          req.TTL,
+		ExpiresAt:    req.ExpiresAt,
+		CreatedAt:    time.Now(),
+	}
+	if bootstrap.Protocol == "" {
+		bootstrap.Protocol = "http"
+	}
+	if bootstrap.Environment == "" {
+		bootstrap.Environment = "production"
+	}
+	if bootstrap.Region == "" {
+		bootstrap.Region = "us-east-1"
+	}
+	if bootstrap.TTL <= 0 {
+		bootstrap.TTL = 30
+	}
+
+	if err := ds.db.Create(&bootstrap).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create bootstrap token"})
+		return
+	}
+
+	ds.logger.Info("Bootstrap token issued",
+		zap.String("token_id", bootstrap.ID),
+		zap.String("service_name", bootstrap.ServiceName))
+	c.JSON(201, bootstrap)
+}
+
+// List bootstrap tokens, without the tokens themselves
+func (ds *DiscoveryService) listBootstrapTokens(c *gin.Context) {
+	query := ds.db.Order("created_at DESC")
+	if serviceName := c.Query("service_name"); serviceName != "" {
+		query = query.Where("service_name = ?", serviceName)
+	}
+
+	var tokens []BootstrapToken
+	if err := query.Find(&tokens).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch bootstrap tokens"})
+		return
+	}
+	c.JSON(200, gin.H{"tokens": tokens})
+}
+
+// Revoke a bootstrap token
+func (ds *DiscoveryService) revokeBootstrapToken(c *gin.Context) {
+	result := ds.db.Model(&BootstrapToken{}).
+		Where("id = ? AND revoked_at IS NULL", c.Param("id")).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": "Failed to revoke bootstrap token"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"error": "Bootstrap token not found"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Bootstrap token revoked"})
+}
+
+// Everything a service client needs on startup, in one call
+func (ds *DiscoveryService) bootstrap(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token == "" || token == c.GetHeader("Authorization") {
+		c.JSON(401, gin.H{"error": "Bootstrap token required"})
+		return
+	}
+
+	var bootstrap BootstrapToken
+	if err := ds.db.Where("token_hash = ?", hashBootstrapToken(token)).First(&bootstrap).Error; err != nil {
+		c.JSON(401, gin.H{"error": "Invalid bootstrap token"})
+		return
+	}
+	if bootstrap.RevokedAt != nil {
+		c.JSON(401, gin.H{"error": "Bootstrap token revoked"})
+		return
+	}
+	if bootstrap.ExpiresAt != nil && bootstrap.ExpiresAt.Before(time.Now()) {
+		c.JSON(401, gin.H{"error": "Bootstrap token expired"})
+		return
+	}
+
+	// Read the revision before the registry, so anything that changes in
+	// between shows up as a resync on the watch
+	revision, err := ds.registryRevision(c.Request.Context())
+	if err != nil {
+		c.JSON(503, gin.H{"error": "Registry revision unavailable"})
+		return
+	}
+
+	dependencies := append([]string(nil), bootstrap.Dependencies...)
+	sort.Strings(dependencies)
+	var instances []ServiceInstance
+	if len(dependencies) > 0 {
+		if err := ds.db.Where("service_name IN ? AND status = ? AND environment = ?", dependencies, "healthy", bootstrap.Environment).
+			Find(&instances).Error; err != nil {
+			serviceDiscoveries.WithLabelValues(bootstrap.ServiceName, "error").Inc()
+			c.JSON(500, gin.H{"error": "Failed to fetch upstreams"})
+			return
+		}
+	}
+
+	upstreams := make(map[string]gin.H, len(dependencies))
+	for _, name := range dependencies {
+		upstreams[name] = gin.H{"instances": []ServiceInstance{}, "endpoints": []string{}}
+	}
+	for _, instance := range instances {
+		upstream := upstreams[instance.ServiceName]
+		upstream["instances"] = append(upstream["instances"].([]ServiceInstance), instance)
+		upstream["endpoints"] = append(upstream["endpoints"].([]string),
+			fmt.Sprintf("%s://%s:%d", instance.Protocol, instance.Host, instance.Port))
+	}
+
+	// The client fills in its id, version, host and port
+	registration := ServiceInstance{
+		ServiceName: bootstrap.ServiceName,
+		Protocol:    bootstrap.Protocol,
+		HealthCheck: bootstrap.HealthCheck,
+		Environment: bootstrap.Environment,
+		Region:      bootstrap.Region,
+		Tags:        bootstrap.Tags,
+		Metadata:    bootstrap.Metadata,
+		TTL:         bootstrap.TTL,
+	}
+
+	heartbeat := bootstrap.TTL / 3
+	if heartbeat < 1 {
+		heartbeat = 1
+	}
+	refresh, err := strconv.Atoi(getEnv("BOOTSTRAP_REFRESH_INTERVAL", strconv.Itoa(defaultRefreshSecs)))
+	if err != nil || refresh <= 0 {
+		refresh = defaultRefreshSecs
+	}
+
+	watch := url.Values{}
+	watch.Set("since", strconv.FormatInt(revision, 10))
+	if len(dependencies) > 0 {
+		watch.Set("services", strings.Join(dependencies, ","))
+	}
+
+	now := time.Now()
+	ds.db.Model(&bootstrap).Update("last_used_at", now)
+	serviceDiscoveries.WithLabelValues(bootstrap.ServiceName, "success").Inc()
+
+	c.JSON(200, gin.H{
+		"service":      bootstrap.ServiceName,
+		"registration": registration,
+		"upstreams":    upstreams,
+		"watch": gin.H{
+			"url":                "/v1/discovery/watch?" + watch.Encode(),
+			"revision":           revision,
+			"keep_alive_seconds": int(watchKeepAlive.Seconds()),
+		},
+		"intervals": gin.H{
+			"heartbeat_seconds": heartbeat,
+			"refresh_seconds":   refresh,
+		},
+		"token_expires_at": bootstrap.ExpiresAt,
+		"generated_at":     now.UTC(),
+	})
+}
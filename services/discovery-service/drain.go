@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Draining. An instance about to shut down is marked draining: it drops out
+// of the healthy instances at once, and the status change reaches watchers
+// such as the API gateway, so new requests go elsewhere while the instance
+// finishes the ones it has. Heartbeats and health checks leave a draining
+// instance draining until it deregisters or goes stale.
+
+const InstanceStatusDraining = "draining"
+
+// Mark the instances of a service on one host (and port) as draining
+func (ds *DiscoveryService) drainInstances(c *gin.Context) {
+	serviceName := c.Param("name")
+
+	var req struct {
+		Host string `json:"host" binding:"required"`
+		Port int    `json:"port"` // 0: every port on the host
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := ds.db.Where("service_name = ? AND host = ?", serviceName, req.Host)
+	if req.Port > 0 {
+		query = query.Where("port = ?", req.Port)
+	}
+	var instances []ServiceInstance
+	if err := query.Find(&instances).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch service instances"})
+		return
+	}
+	if len(instances) == 0 {
+		c.JSON(404, gin.H{"error": "No matching instances"})
+		return
+	}
+
+	drained := make([]string, 0, len(instances))
+	for i := range instances {
+		instance := &instances[i]
+		if instance.Status == InstanceStatusDraining {
+			drained = append(drained, instance.ID)
+			continue
+		}
+		wasHealthy := instance.Status == "healthy"
+		instance.Status = InstanceStatusDraining
+		if err := ds.db.Model(instance).Update("status", InstanceStatusDraining).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to drain instance"})
+			return
+		}
+
+		ds.mutex.Lock()
+		ds.services[instance.ID] = instance
+		ds.mutex.Unlock()
+
+		serviceData, _ := json.Marshal(instance)
+		cacheKey := fmt.Sprintf("service:%s", instance.ID)
+		ds.redis.Set(context.Background(), cacheKey, serviceData, time.Duration(instance.TTL*2)*time.Second)
+
+		if wasHealthy {
+			healthyServices.WithLabelValues(instance.ServiceName, instance.Environment).Dec()
+		}
+		ds.publishRegistryEvent(RegistryEventStatusChanged, instance)
+		drained = append(drained, instance.ID)
+
+		ds.logger.Info("Service instance draining",
+			zap.String("service_id", instance.ID),
+			zap.String("service_name", instance.ServiceName),
+			zap.String("host", instance.Host))
+	}
+
+	c.JSON(200, gin.H{
+		"message":   "Instances draining",
+		"instances": drained,
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Instance metadata keys controlling gRPC health checks
+const (
+	MetaGRPCHealthService = "grpc_health_service"  // comma-separated service names, "" = overall server health
+	MetaGRPCHealthAddress = "grpc_health_address"  // host:port override, defaults to host:port of the instance
+	MetaGRPCTLS           = "grpc_tls"             // "true" to dial with TLS
+	MetaGRPCTLSServerName = "grpc_tls_server_name" // SNI / certificate name override
+	MetaGRPCTLSSkipVerify = "grpc_tls_skip_verify" // "true" to skip certificate verification
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+var healthCheckResults = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "discovery_health_checks_total",
+		Help: "Total number of health checks performed",
+	},
+	[]string{"protocol", "status"},
+)
+
+// probeInstance runs the health check appropriate to the instance protocol
+// and returns "healthy" or "unhealthy" plus an error description.
+func (ds *DiscoveryService) probeInstance(service *ServiceInstance) (string, string) {
+	protocol := "http"
+	var err error
+	if strings.EqualFold(service.Protocol, "grpc") {
+		protocol = "grpc"
+		err = probeGRPC(service)
+	} else {
+		err = probeHTTP(service.HealthCheck)
+	}
+
+	status := "healthy"
+	errorMsg := ""
+	if err != nil {
+		status = "unhealthy"
+		errorMsg = err.Error()
+	}
+	healthCheckResults.WithLabelValues(protocol, status).Inc()
+	return status, errorMsg
+}
+
+func probeHTTP(url string) error {
+	client := &http.Client{Timeout: healthCheckTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// probeGRPC calls grpc.health.v1.Health/Check for every configured service
+// name; the instance is healthy only if all of them report SERVING.
+func probeGRPC(service *ServiceInstance) error {
+	address := service.Metadata[MetaGRPCHealthAddress]
+	if address == "" {
+		address = net.JoinHostPort(service.Host, strconv.Itoa(service.Port))
+	}
+
+	creds := insecure.NewCredentials()
+	if service.Metadata[MetaGRPCTLS] == "true" {
+		creds = credentials.NewTLS(&tls.Config{
+			ServerName:         service.Metadata[MetaGRPCTLSServerName],
+			InsecureSkipVerify: service.Metadata[MetaGRPCTLSSkipVerify] == "true",
+		})
+	}
+
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return fmt.Errorf("dial %s: %w", address, err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	client := healthpb.NewHealthClient(conn)
+	for _, name := range strings.Split(service.Metadata[MetaGRPCHealthService], ",") {
+		name = strings.TrimSpace(name)
+		resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: name})
+		if err != nil {
+			return fmt.Errorf("grpc health check %q: %w", name, err)
+		}
+		if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+			if name == "" {
+				return fmt.Errorf("grpc status %s", resp.GetStatus())
+			}
+			return fmt.Errorf("grpc status %s for %q", resp.GetStatus(), name)
+		}
+	}
+	return nil
+}
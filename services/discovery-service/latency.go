@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// Latency-aware selection. Every successful health check records how long
+// the probe took, per instance and per region the discovery service runs
+// in (REGION), keeping the last probeSampleLimit samples for
+// probeSampleWindow. Selection endpoints return each instance's recent
+// probe latency, and with strategy=fastest they return the N healthy
+// instances with the lowest p95. A caller passing its region is ranked by
+// the probes run from that region, falling back to probes from any region
+// for instances it has none for; instances without samples rank last.
+
+// Selection strategies
+const (
+	SelectionStrategyAll     = "all"
+	SelectionStrategyFastest = "fastest"
+)
+
+const (
+	probeSampleLimit   = 50
+	probeSampleWindow  = 15 * time.Minute
+	defaultFastestN    = 3
+	probeLatencyPrefix = "discovery:probe_latency:"
+)
+
+// ProbeLatency summarizes an instance's recent health check response times
+type ProbeLatency struct {
+	Region       string    `json:"region,omitempty"` // where the probes ran from; empty: every region
+	Samples      int       `json:"samples"`
+	LastMs       int64     `json:"last_ms"`
+	P50Ms        int64     `json:"p50_ms"`
+	P95Ms        int64     `json:"p95_ms"`
+	LastProbedAt time.Time `json:"last_probed_at"`
+}
+
+var probeLatencySeconds = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "discovery_probe_latency_seconds",
+		Help:    "Response time of successful health checks",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	},
+	[]string{"service_name", "region"},
+)
+
+// probeRegion is the region health checks run from
+func probeRegion() string {
+	return getEnv("REGION", "default")
+}
+
+func probeLatencyKey(instanceID, region string) string {
+	return probeLatencyPrefix + instanceID + ":" + region
+}
+
+func probeRegionsKey(instanceID string) string {
+	return probeLatencyPrefix + instanceID + ":regions"
+}
+
+// recordProbeLatency keeps one health check response time
+func (ds *DiscoveryService) recordProbeLatency(service *ServiceInstance, latency time.Duration) {
+	region := probeRegion()
+	probeLatencySeconds.WithLabelValues(service.ServiceName, region).Observe(latency.Seconds())
+
+	ctx := context.Background()
+	key := probeLatencyKey(service.ID, region)
+	sample := fmt.Sprintf("%d:%d", time.Now().UnixMilli(), latency.Milliseconds())
+	pipe := ds.redis.TxPipeline()
+	pipe.LPush(ctx, key, sample)
+	pipe.LTrim(ctx, key, 0, probeSampleLimit-1)
+	pipe.Expire(ctx, key, probeSampleWindow)
+	pipe.SAdd(ctx, probeRegionsKey(service.ID), region)
+	pipe.Expire(ctx, probeRegionsKey(service.ID), probeSampleWindow)
+	if _, err := pipe.Exec(ctx); err != nil {
+		ds.logger.Warn("Failed to record probe latency", zap.String("service_id", service.ID), zap.Error(err))
+	}
+}
+
+// forgetProbeLatency drops the samples of a deregistered instance
+func (ds *DiscoveryService) forgetProbeLatency(instanceID string) {
+	ctx := context.Background()
+	regions, _ := ds.redis.SMembers(ctx, probeRegionsKey(instanceID)).Result()
+	keys := []string{probeRegionsKey(instanceID)}
+	for _, region := range regions {
+		keys = append(keys, probeLatencyKey(instanceID, region))
+	}
+	ds.redis.Del(ctx, keys...)
+}
+
+// summarizeProbes turns "unixms:latencyms" samples into a summary, ignoring
+// samples older than the window
+func summarizeProbes(samples []string, region string) *ProbeLatency {
+	cutoff := time.Now().Add(-probeSampleWindow).UnixMilli()
+	var latencies []int64
+	var last, lastAt int64
+	for _, sample := range samples {
+		at, ms, ok := strings.Cut(sample, ":")
+		if !ok {
+			continue
+		}
+		atMs, err1 := strconv.ParseInt(at, 10, 64)
+		latency, err2 := strconv.ParseInt(ms, 10, 64)
+		if err1 != nil || err2 != nil || atMs < cutoff {
+			continue
+		}
+		latencies = append(latencies, latency)
+		if atMs > lastAt {
+			last, lastAt = latency, atMs
+		}
+	}
+	if len(latencies) == 0 {
+		return nil
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return &ProbeLatency{
+		Region:       region,
+		Samples:      len(latencies),
+		LastMs:       last,
+		P50Ms:        percentile(latencies, 0.50),
+		P95Ms:        percentile(latencies, 0.95),
+		LastProbedAt: time.UnixMilli(lastAt).UTC(),
+	}
+}
+
+// percentile picks the nearest-rank percentile of sorted values
+func percentile(sorted []int64, p float64) int64 {
+	rank := int(p*float64(len(sorted))+0.999999) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// probeLatencies summarizes the probes of instances as seen from a region,
+// or from every region when region is empty or has no samples of one
+func (ds *DiscoveryService) probeLatencies(ctx context.Context, instances []ServiceInstance, region string) map[string]*ProbeLatency {
+	latencies := make(map[string]*ProbeLatency, len(instances))
+
+	if region != "" {
+		pipe := ds.redis.Pipeline()
+		commands := make([]*redis.StringSliceCmd, len(instances))
+		for i := range instances {
+			commands[i] = pipe.LRange(ctx, probeLatencyKey(instances[i].ID, region), 0, -1)
+		}
+		pipe.Exec(ctx)
+		for i, command := range commands {
+			if summary := summarizeProbes(command.Val(), region); summary != nil {
+				latencies[instances[i].ID] = summary
+			}
+		}
+	}
+
+	for i := range instances {
+		id := instances[i].ID
+		if latencies[id] != nil {
+			continue
+		}
+		regions, err := ds.redis.SMembers(ctx, probeRegionsKey(id)).Result()
+		if err != nil || len(regions) == 0 {
+			continue
+		}
+		var samples []string
+		for _, probedFrom := range regions {
+			regionSamples, err := ds.redis.LRange(ctx, probeLatencyKey(id, probedFrom), 0, -1).Result()
+			if err == nil {
+				samples = append(samples, regionSamples...)
+			}
+		}
+		if summary := summarizeProbes(samples, ""); summary != nil {
+			latencies[id] = summary
+		}
+	}
+	return latencies
+}
+
+// rankFastest orders instances by p95 probe latency, lowest first, those
+// in the caller's region ahead of others on ties and those without samples
+// last
+func rankFastest(instances []ServiceInstance, region string) {
+	sort.SliceStable(instances, func(i, j int) bool {
+		a, b := instances[i].ProbeLatency, instances[j].ProbeLatency
+		if (a == nil) != (b == nil) {
+			return a != nil
+		}
+		if a != nil && a.P95Ms != b.P95Ms {
+			return a.P95Ms < b.P95Ms
+		}
+		if a != nil && a.P50Ms != b.P50Ms {
+			return a.P50Ms < b.P50Ms
+		}
+		return region != "" && instances[i].Region == region && instances[j].Region != region
+	})
+}
+
+// selectInstances adds probe latencies to the instances and applies the
+// strategy asked for, answering the request when it is invalid
+func (ds *DiscoveryService) selectInstances(c *gin.Context, instances []ServiceInstance) ([]ServiceInstance, bool) {
+	region := c.Query("region")
+	strategy := c.DefaultQuery("strategy", SelectionStrategyAll)
+	if strategy != SelectionStrategyAll && strategy != SelectionStrategyFastest {
+		c.JSON(400, gin.H{"error": "Unknown strategy", "strategies": []string{SelectionStrategyAll, SelectionStrategyFastest}})
+		return nil, false
+	}
+
+	latencies := ds.probeLatencies(c.Request.Context(), instances, region)
+	for i := range instances {
+		instances[i].ProbeLatency = latencies[instances[i].ID]
+	}
+	if strategy == SelectionStrategyAll {
+		return instances, true
+	}
+
+	n := defaultFastestN
+	if value := c.Query("n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			c.JSON(400, gin.H{"error": "n must be a positive number"})
+			return nil, false
+		}
+		n = parsed
+	}
+
+	healthy := make([]ServiceInstance, 0, len(instances))
+	for _, instance := range instances {
+		if instance.Status == "healthy" {
+			healthy = append(healthy, instance)
+		}
+	}
+	rankFastest(healthy, region)
+	if len(healthy) > n {
+		healthy = healthy[:n]
+	}
+	return healthy, true
+}
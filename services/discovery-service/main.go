@@ -7,11 +7,13 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
+	"github.com/minio/minio-go/v7"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -37,6 +39,8 @@ type ServiceInstance struct {
 	LastSeen    time.Time         `json:"last_seen"`
 	RegisteredAt time.Time        `json:"registered_at"`
 	TTL         int               `json:"ttl" gorm:"default:30"` // seconds
+
+	ProbeLatency *ProbeLatency `json:"probe_latency,omitempty" gorm:"-"` // filled in by selection endpoints
 }
 
 // ServiceHealth represents health check status
@@ -45,6 +49,7 @@ type ServiceHealth struct {
 	Status      string    `json:"status"`
 	LastCheck   time.Time `json:"last_check"`
 	ResponseTime int64    `json:"response_time_ms"`
+	P95ResponseTime int64 `json:"p95_response_time_ms"` // over recent probes
 	Error       string    `json:"error,omitempty"`
 }
 
@@ -55,6 +60,10 @@ type DiscoveryService struct {
 	logger   *zap.Logger
 	services map[string]*ServiceInstance
 	mutex    sync.RWMutex
+
+	// Object storage for registry snapshots (nil when not configured)
+	snapshots      *minio.Client
+	snapshotBucket string
 }
 
 // Metrics
@@ -103,12 +112,20 @@ func main() {
 	// Initialize Redis
 	redisClient := initRedis()
 
+	// Initialize snapshot storage
+	snapshotStore, snapshotBucket, err := initSnapshotStore()
+	if err != nil {
+		logger.Fatal("Failed to initialize snapshot storage", zap.Error(err))
+	}
+
 	// Initialize service
 	discoveryService := &DiscoveryService{
-		db:       db,
-		redis:    redisClient,
-		logger:   logger,
-		services: make(map[string]*ServiceInstance),
+		db:             db,
+		redis:          redisClient,
+		logger:         logger,
+		services:       make(map[string]*ServiceInstance),
+		snapshots:      snapshotStore,
+		snapshotBucket: snapshotBucket,
 	}
 
 	// Start health check routine
@@ -162,6 +179,14 @@ func main() {
 		v1.GET("/services/:name", discoveryService.getService)
 		v1.GET("/services/:name/instances", discoveryService.getServiceInstances)
 		v1.GET("/services/:name/healthy", discoveryService.getHealthyInstances)
+		v1.POST("/services/:name/drain", discoveryService.drainInstances)
+		v1.GET("/watch", discoveryService.watchRegistry)
+
+		// Client bootstrap
+		v1.GET("/bootstrap", discoveryService.bootstrap)
+		v1.POST("/bootstrap-tokens", discoveryService.createBootstrapToken)
+		v1.GET("/bootstrap-tokens", discoveryService.listBootstrapTokens)
+		v1.DELETE("/bootstrap-tokens/:id", discoveryService.revokeBootstrapToken)
 		
 		// Health checks
 		v1.GET("/health/:id", discoveryService.getServiceHealth)
@@ -170,6 +195,12 @@ func main() {
 		// Service mesh integration
 		v1.GET("/endpoints", discoveryService.getEndpoints)
 		v1.GET("/catalog", discoveryService.getServiceCatalog)
+
+		// Registry snapshots (disaster recovery)
+		v1.POST("/snapshots", discoveryService.exportSnapshot)
+		v1.GET("/snapshots", discoveryService.listSnapshots)
+		v1.GET("/snapshots/:id", discoveryService.downloadSnapshot)
+		v1.POST("/snapshots/:id/import", discoveryService.importSnapshot)
 	}
 
 	// Start server
@@ -198,7 +229,7 @@ func initDatabase() (*gorm.DB, error) {
 	}
 
 	// Auto-migrate the schema
-	err = db.AutoMigrate(&ServiceInstance{})
+	err = db.AutoMigrate(&ServiceInstance{}, &BootstrapToken{})
 	if err != nil {
 		return nil, err
 	}
@@ -251,6 +282,7 @@ func (ds *DiscoveryService) registerService(c *gin.Context) {
 	registeredServices.WithLabelValues(service.ServiceName, service.Environment).Inc()
 	healthyServices.WithLabelValues(service.ServiceName, service.Environment).Inc()
 	serviceRegistrations.WithLabelValues(service.ServiceName, "success").Inc()
+	ds.publishRegistryEvent(RegistryEventRegistered, &service)
 
 	ds.logger.Info("Service registered", 
 		zap.String("service_id", service.ID),
@@ -298,6 +330,7 @@ func (ds *DiscoveryService) updateService(c *gin.Context) {
 	serviceData, _ := json.Marshal(service)
 	cacheKey := fmt.Sprintf("service:%s", service.ID)
 	ds.redis.Set(context.Background(), cacheKey, serviceData, time.Duration(service.TTL*2)*time.Second)
+	ds.publishRegistryEvent(RegistryEventUpdated, &service)
 
 	c.JSON(200, service)
 }
@@ -324,6 +357,7 @@ func (ds *DiscoveryService) deregisterService(c *gin.Context) {
 
 	cacheKey := fmt.Sprintf("service:%s", id)
 	ds.redis.Del(context.Background(), cacheKey)
+	ds.forgetProbeLatency(id)
 
 	// Update metrics
 	registeredServices.WithLabelValues(service.ServiceName, service.Environment).Dec()
@@ -331,6 +365,8 @@ func (ds *DiscoveryService) deregisterService(c *gin.Context) {
 		healthyServices.WithLabelValues(service.ServiceName, service.Environment).Dec()
 	}
 
+	ds.publishRegistryEvent(RegistryEventDeregistered, &service)
+
 	ds.logger.Info("Service deregistered", zap.String("service_id", id))
 	c.JSON(200, gin.H{"message": "Service deregistered successfully"})
 }
@@ -344,9 +380,12 @@ func (ds *DiscoveryService) heartbeat(c *gin.Context) {
 		return
 	}
 
-	// Update last seen
+	// Update last seen; a draining instance stays draining
+	wasHealthy := service.Status == "healthy"
 	service.LastSeen = time.Now()
-	service.Status = "healthy"
+	if service.Status != InstanceStatusDraining {
+		service.Status = "healthy"
+	}
 
 	if err := ds.db.Save(&service).Error; err != nil {
 		c.JSON(500, gin.H{"error": "Failed to update heartbeat"})
@@ -361,6 +400,9 @@ func (ds *DiscoveryService) heartbeat(c *gin.Context) {
 	serviceData, _ := json.Marshal(service)
 	cacheKey := fmt.Sprintf("service:%s", service.ID)
 	ds.redis.Set(context.Background(), cacheKey, serviceData, time.Duration(service.TTL*2)*time.Second)
+	if !wasHealthy && service.Status == "healthy" {
+		ds.publishRegistryEvent(RegistryEventStatusChanged, &service)
+	}
 
 	c.JSON(200, gin.H{"message": "Heartbeat received", "last_seen": service.LastSeen})
 }
@@ -411,6 +453,11 @@ func (ds *DiscoveryService) getService(c *gin.Context) {
 		return
 	}
 
+	services, ok := ds.selectInstances(c, services)
+	if !ok {
+		return
+	}
+
 	serviceDiscoveries.WithLabelValues(serviceName, "success").Inc()
 	c.JSON(200, gin.H{"service": serviceName, "instances": services})
 }
@@ -424,6 +471,11 @@ func (ds *DiscoveryService) getServiceInstances(c *gin.Context) {
 		return
 	}
 
+	services, ok := ds.selectInstances(c, services)
+	if !ok {
+		return
+	}
+
 	c.JSON(200, gin.H{"instances": services})
 }
 
@@ -436,6 +488,11 @@ func (ds *DiscoveryService) getHealthyInstances(c *gin.Context) {
 		return
 	}
 
+	services, ok := ds.selectInstances(c, services)
+	if !ok {
+		return
+	}
+
 	c.JSON(200, gin.H{"healthy_instances": services})
 }
 
@@ -453,6 +510,11 @@ func (ds *DiscoveryService) getServiceHealth(c *gin.Context) {
 		Status:    service.Status,
 		LastCheck: service.LastSeen,
 	}
+	latencies := ds.probeLatencies(c.Request.Context(), []ServiceInstance{service}, c.Query("region"))
+	if latency := latencies[service.ID]; latency != nil {
+		health.ResponseTime = latency.LastMs
+		health.P95ResponseTime = latency.P95Ms
+	}
 
 	c.JSON(200, health)
 }
@@ -541,38 +603,29 @@ func (ds *DiscoveryService) performHealthChecks() {
 	}
 
 	for _, service := range services {
+		if service.Status == InstanceStatusDraining {
+			continue
+		}
 		go ds.checkServiceHealth(&service)
 	}
 }
 
 func (ds *DiscoveryService) checkServiceHealth(service *ServiceInstance) {
-	if service.HealthCheck == "" {
+	// gRPC instances are probed over grpc.health.v1 and need no health check URL
+	if service.HealthCheck == "" && !strings.EqualFold(service.Protocol, "grpc") {
 		return
 	}
 
-	client := &http.Client{Timeout: 5 * time.Second}
 	start := time.Now()
-	
-	resp, err := client.Get(service.HealthCheck)
-	responseTime := time.Since(start).Milliseconds()
-	
-	var status string
-	var errorMsg string
-	
-	if err != nil {
-		status = "unhealthy"
-		errorMsg = err.Error()
-	} else {
-		defer resp.Body.Close()
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			status = "healthy"
-		} else {
-			status = "unhealthy"
-			errorMsg = fmt.Sprintf("HTTP %d", resp.StatusCode)
-		}
+	status, errorMsg := ds.probeInstance(service)
+	elapsed := time.Since(start)
+	responseTime := elapsed.Milliseconds()
+	if status == "healthy" {
+		ds.recordProbeLatency(service, elapsed)
 	}
 
 	// Update service status
+	previousStatus := service.Status
 	service.Status = status
 	service.LastSeen = time.Now()
 	
@@ -586,6 +639,10 @@ func (ds *DiscoveryService) checkServiceHealth(service *ServiceInstance) {
 	ds.services[service.ID] = service
 	ds.mutex.Unlock()
 
+	if status != previousStatus {
+		ds.publishRegistryEvent(RegistryEventStatusChanged, service)
+	}
+
 	// Update metrics
 	if status == "healthy" {
 		healthyServices.WithLabelValues(service.ServiceName, service.Environment).Set(1)
@@ -620,8 +677,11 @@ func (ds *DiscoveryService) cleanupStaleServices() {
 
 	for _, service := range staleServices {
 		// Mark as unhealthy first
-		service.Status = "unhealthy"
-		ds.db.Save(&service)
+		if service.Status != "unhealthy" {
+			service.Status = "unhealthy"
+			ds.db.Save(&service)
+			ds.publishRegistryEvent(RegistryEventStatusChanged, &service)
+		}
 		
 		// Remove after 10 minutes
 		if service.LastSeen.Before(time.Now().Add(-10 * time.Minute)) {
@@ -639,6 +699,8 @@ func (ds *DiscoveryService) cleanupStaleServices() {
 			registeredServices.WithLabelValues(service.ServiceName, service.Environment).Dec()
 			healthyServices.WithLabelValues(service.ServiceName, service.Environment).Dec()
 			
+			ds.publishRegistryEvent(RegistryEventRemoved, &service)
+
 			ds.logger.Info("Removed stale service", zap.String("service_id", service.ID))
 		}
 	}
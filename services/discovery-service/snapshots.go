@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Registry snapshots for disaster recovery. A snapshot is the full instance
+// registry (including metadata and last known health) stored as gzipped JSON
+// in object storage, so a fresh discovery instance can bootstrap routing.
+
+const (
+	SnapshotFormatVersion = 1
+	snapshotPrefix        = "snapshots/"
+	snapshotSuffix        = ".json.gz"
+
+	// maxSnapshotBytes bounds both the stored object and its decompressed
+	// JSON, so a corrupt or hostile snapshot cannot exhaust memory
+	maxSnapshotBytes = 256 << 20
+)
+
+// RegistrySnapshot is the serialized registry
+type RegistrySnapshot struct {
+	FormatVersion int               `json:"format_version"`
+	ID            string            `json:"id"`
+	CreatedAt     time.Time         `json:"created_at"`
+	SourceRegion  string            `json:"source_region"`
+	InstanceCount int               `json:"instance_count"`
+	Instances     []ServiceInstance `json:"instances"`
+}
+
+func initSnapshotStore() (*minio.Client, string, error) {
+	endpoint := getEnv("SNAPSHOT_S3_ENDPOINT", "")
+	if endpoint == "" {
+		return nil, "", nil
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(getEnv("SNAPSHOT_S3_ACCESS_KEY", ""), getEnv("SNAPSHOT_S3_SECRET_KEY", ""), ""),
+		Secure: getEnv("SNAPSHOT_S3_USE_SSL", "true") == "true",
+		Region: getEnv("SNAPSHOT_S3_REGION", ""),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to initialize snapshot store: %w", err)
+	}
+
+	bucket := getEnv("SNAPSHOT_S3_BUCKET", "discovery-snapshots")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to check snapshot bucket: %w", err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+			return nil, "", fmt.Errorf("failed to create snapshot bucket: %w", err)
+		}
+	}
+
+	return client, bucket, nil
+}
+
+func (ds *DiscoveryService) snapshotStoreReady(c *gin.Context) bool {
+	if ds.snapshots == nil {
+		c.JSON(503, gin.H{"error": "Snapshot storage is not configured"})
+		return false
+	}
+	return true
+}
+
+// Export the registry as a new snapshot
+func (ds *DiscoveryService) exportSnapshot(c *gin.Context) {
+	if !ds.snapshotStoreReady(c) {
+		return
+	}
+
+	var instances []ServiceInstance
+	if err := ds.db.Order("service_name, id").Find(&instances).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read registry"})
+		return
+	}
+
+	now := time.Now().UTC()
+	snapshot := RegistrySnapshot{
+		FormatVersion: SnapshotFormatVersion,
+		ID:            now.Format("20060102T150405Z"),
+		CreatedAt:     now,
+		SourceRegion:  getEnv("REGION", ""),
+		InstanceCount: len(instances),
+		Instances:     instances,
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(snapshot); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to encode snapshot"})
+		return
+	}
+	if err := gz.Close(); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to compress snapshot"})
+		return
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	checksum := hex.EncodeToString(sum[:])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	_, err := ds.snapshots.PutObject(ctx, ds.snapshotBucket, snapshotPrefix+snapshot.ID+snapshotSuffix,
+		bytes.NewReader(buf.Bytes()), int64(buf.Len()), minio.PutObjectOptions{
+			ContentType:     "application/json",
+			ContentEncoding: "gzip",
+			UserMetadata: map[string]string{
+				"format-version": fmt.Sprint(SnapshotFormatVersion),
+				"instance-count": fmt.Sprint(len(instances)),
+				"sha256":         checksum,
+			},
+		})
+	if err != nil {
+		ds.logger.Error("Failed to upload registry snapshot", zap.Error(err))
+		c.JSON(500, gin.H{"error": "Failed to upload snapshot"})
+		return
+	}
+
+	ds.logger.Info("Registry snapshot exported",
+		zap.String("snapshot_id", snapshot.ID),
+		zap.Int("instances", len(instances)))
+
+	c.JSON(201, gin.H{
+		"id":             snapshot.ID,
+		"format_version": SnapshotFormatVersion,
+		"instance_count": len(instances),
+		"size_bytes":     buf.Len(),
+		"sha256":         checksum,
+		"created_at":     snapshot.CreatedAt,
+	})
+}
+
+// List stored snapshots, newest first
+func (ds *DiscoveryService) listSnapshots(c *gin.Context) {
+	if !ds.snapshotStoreReady(c) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	snapshots := []gin.H{}
+	for object := range ds.snapshots.ListObjects(ctx, ds.snapshotBucket, minio.ListObjectsOptions{
+		Prefix: snapshotPrefix,
+	}) {
+		if object.Err != nil {
+			c.JSON(500, gin.H{"error": "Failed to list snapshots"})
+			return
+		}
+		snapshots = append([]gin.H{{
+			"id":         strings.TrimSuffix(strings.TrimPrefix(object.Key, snapshotPrefix), snapshotSuffix),
+			"size_bytes": object.Size,
+			"created_at": object.LastModified,
+		}}, snapshots...)
+	}
+
+	c.JSON(200, gin.H{"snapshots": snapshots})
+}
+
+// Download a snapshot as stored
+func (ds *DiscoveryService) downloadSnapshot(c *gin.Context) {
+	if !ds.snapshotStoreReady(c) {
+		return
+	}
+
+	key := snapshotPrefix + c.Param("id") + snapshotSuffix
+	object, err := ds.snapshots.GetObject(context.Background(), ds.snapshotBucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to read snapshot"})
+		return
+	}
+	defer object.Close()
+
+	info, err := object.Stat()
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Snapshot not found"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", c.Param("id")+snapshotSuffix))
+	c.DataFromReader(200, info.Size, "application/gzip", object, nil)
+}
+
+// Import a snapshot into this registry.
+//
+// mode=merge (default) upserts snapshot instances and keeps anything already
+// registered; mode=replace removes instances that are not in the snapshot.
+// Restored instances get LastSeen=now so they survive the stale-instance
+// cleanup long enough to start heartbeating again.
+func (ds *DiscoveryService) importSnapshot(c *gin.Context) {
+	if !ds.snapshotStoreReady(c) {
+		return
+	}
+
+	mode := c.DefaultQuery("mode", "merge")
+	if mode != "merge" && mode != "replace" {
+		c.JSON(400, gin.H{"error": "mode must be merge or replace"})
+		return
+	}
+	dryRun := c.Query("dry_run") == "true"
+
+	snapshot, err := ds.readSnapshot(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if dryRun {
+		var existing int64
+		ds.db.Model(&ServiceInstance{}).Count(&existing)
+		c.JSON(200, gin.H{
+			"id":                 snapshot.ID,
+			"mode":               mode,
+			"dry_run":            true,
+			"snapshot_instances": snapshot.InstanceCount,
+			"current_instances":  existing,
+		})
+		return
+	}
+
+	now := time.Now()
+	ids := make([]string, 0, len(snapshot.Instances))
+	for i := range snapshot.Instances {
+		snapshot.Instances[i].LastSeen = now
+		ids = append(ids, snapshot.Instances[i].ID)
+	}
+
+	removed := int64(0)
+	var removedIDs []string
+	err = ds.db.Transaction(func(tx *gorm.DB) error {
+		if mode == "replace" {
+			query := tx.Model(&ServiceInstance{})
+			if len(ids) > 0 {
+				query = query.Where("id NOT IN ?", ids)
+			}
+			if err := query.Pluck("id", &removedIDs).Error; err != nil {
+				return err
+			}
+			if len(removedIDs) > 0 {
+				result := tx.Where("id IN ?", removedIDs).Delete(&ServiceInstance{})
+				if result.Error != nil {
+					return result.Error
+				}
+				removed = result.RowsAffected
+			}
+		}
+		if len(snapshot.Instances) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).
+			CreateInBatches(snapshot.Instances, 200).Error
+	})
+	if err != nil {
+		ds.logger.Error("Failed to import registry snapshot", zap.Error(err))
+		c.JSON(500, gin.H{"error": "Failed to import snapshot"})
+		return
+	}
+
+	// Rebuild the in-memory and Redis caches
+	ds.mutex.Lock()
+	if mode == "replace" {
+		ds.services = make(map[string]*ServiceInstance)
+		for _, id := range removedIDs {
+			ds.redis.Del(context.Background(), fmt.Sprintf("service:%s", id))
+		}
+	}
+	for i := range snapshot.Instances {
+		instance := snapshot.Instances[i]
+		ds.services[instance.ID] = &instance
+
+		serviceData, _ := json.Marshal(instance)
+		cacheKey := fmt.Sprintf("service:%s", instance.ID)
+		ds.redis.Set(context.Background(), cacheKey, serviceData, time.Duration(instance.TTL*2)*time.Second)
+	}
+	ds.mutex.Unlock()
+	ds.publishRegistryEvent(RegistryEventImported, nil)
+
+	ds.logger.Info("Registry snapshot imported",
+		zap.String("snapshot_id", snapshot.ID),
+		zap.String("mode", mode),
+		zap.Int("instances", len(snapshot.Instances)),
+		zap.Int64("removed", removed))
+
+	c.JSON(200, gin.H{
+		"id":       snapshot.ID,
+		"mode":     mode,
+		"imported": len(snapshot.Instances),
+		"removed":  removed,
+	})
+}
+
+func (ds *DiscoveryService) readSnapshot(id string) (*RegistrySnapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	object, err := ds.snapshots.GetObject(ctx, ds.snapshotBucket, snapshotPrefix+id+snapshotSuffix, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	defer object.Close()
+
+	data, err := io.ReadAll(io.LimitReader(object, maxSnapshotBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s not found", id)
+	}
+	if len(data) > maxSnapshotBytes {
+		return nil, fmt.Errorf("snapshot %s is larger than %d bytes", id, maxSnapshotBytes)
+	}
+	info, err := object.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s not found", id)
+	}
+
+	// The checksum recorded at export must match what was read back
+	var expected string
+	for key, value := range info.UserMetadata {
+		if strings.EqualFold(key, "sha256") {
+			expected = value
+		}
+	}
+	if expected == "" {
+		return nil, fmt.Errorf("snapshot %s has no sha256 checksum", id)
+	}
+	sum := sha256.Sum256(data)
+	if actual := hex.EncodeToString(sum[:]); actual != strings.ToLower(expected) {
+		return nil, fmt.Errorf("snapshot %s is corrupt: sha256 %s does not match %s", id, actual, expected)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("snapshot is not gzip encoded: %w", err)
+	}
+	defer gz.Close()
+
+	var snapshot RegistrySnapshot
+	if err := json.NewDecoder(io.LimitReader(gz, maxSnapshotBytes)).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	if snapshot.FormatVersion != SnapshotFormatVersion {
+		return nil, fmt.Errorf("unsupported snapshot format version %d", snapshot.FormatVersion)
+	}
+	if snapshot.InstanceCount != len(snapshot.Instances) {
+		return nil, fmt.Errorf("snapshot is truncated: expected %d instances, found %d", snapshot.InstanceCount, len(snapshot.Instances))
+	}
+
+	return &snapshot, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// Registry change notifications. Changes that affect discovery results are
+// published on a Redis channel, so every replica sees them, and
+// GET /v1/discovery/watch streams them as server-sent events. Clients such as
+// the API gateway use the stream to drop cached instances instead of waiting
+// for their cache to expire.
+//
+// Every event carries a registry revision. A client that read the registry
+// at some revision, say from the bootstrap endpoint, passes it as since=;
+// when changes were published after it and before the watch began, the
+// stream opens with a resync event telling the client to re-read.
+
+const (
+	registryEventsChannel = "discovery:events"
+	registryRevisionKey   = "discovery:revision"
+	watchKeepAlive        = 15 * time.Second
+)
+
+// Registry event types
+const (
+	RegistryEventRegistered    = "registered"
+	RegistryEventUpdated       = "updated"
+	RegistryEventDeregistered  = "deregistered"
+	RegistryEventStatusChanged = "status_changed"
+	RegistryEventRemoved       = "removed"
+	RegistryEventImported      = "imported" // affects every service
+)
+
+// RegistryEvent describes one change to the registry
+type RegistryEvent struct {
+	Type        string    `json:"type"`
+	ServiceName string    `json:"service_name,omitempty"`
+	InstanceID  string    `json:"instance_id,omitempty"`
+	Status      string    `json:"status,omitempty"`
+	Revision    int64     `json:"revision"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// publishRegistryEvent announces a change to an instance; a nil instance
+// announces a change to the whole registry
+func (ds *DiscoveryService) publishRegistryEvent(eventType string, service *ServiceInstance) {
+	event := RegistryEvent{Type: eventType, Timestamp: time.Now().UTC()}
+	if service != nil {
+		event.ServiceName = service.ServiceName
+		event.InstanceID = service.ID
+		event.Status = service.Status
+	}
+	revision, err := ds.redis.Incr(context.Background(), registryRevisionKey).Result()
+	if err != nil {
+		ds.logger.Warn("Failed to advance registry revision", zap.Error(err))
+	}
+	event.Revision = revision
+
+	data, _ := json.Marshal(event)
+	if err := ds.redis.Publish(context.Background(), registryEventsChannel, data).Err(); err != nil {
+		ds.logger.Warn("Failed to publish registry event",
+			zap.String("type", eventType),
+			zap.String("service_name", event.ServiceName),
+			zap.Error(err))
+	}
+}
+
+// registryRevision is the revision of the latest published change
+func (ds *DiscoveryService) registryRevision(ctx context.Context) (int64, error) {
+	revision, err := ds.redis.Get(ctx, registryRevisionKey).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return revision, err
+}
+
+// Stream registry changes as server-sent events, optionally only those of
+// the comma-separated services
+func (ds *DiscoveryService) watchRegistry(c *gin.Context) {
+	filter := map[string]bool{}
+	for _, name := range strings.Split(c.Query("services"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			filter[name] = true
+		}
+	}
+
+	ctx := c.Request.Context()
+	pubsub := ds.redis.Subscribe(ctx, registryEventsChannel)
+	defer pubsub.Close()
+
+	// Confirm the subscription before reporting ready, so a client that
+	// re-resolves on ready cannot miss a change in between
+	if _, err := pubsub.Receive(ctx); err != nil {
+		c.JSON(503, gin.H{"error": "Registry events unavailable"})
+		return
+	}
+
+	revision, err := ds.registryRevision(ctx)
+	if err != nil {
+		c.JSON(503, gin.H{"error": "Registry events unavailable"})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.SSEvent("ready", gin.H{"timestamp": time.Now().UTC(), "revision": revision})
+	if since, err := strconv.ParseInt(c.Query("since"), 10, 64); err == nil && since < revision {
+		c.SSEvent("resync", gin.H{"since": since, "revision": revision})
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	messages := pubsub.Channel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-keepAlive.C:
+			if _, err := c.Writer.WriteString(": keep-alive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			var event RegistryEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				continue
+			}
+			if len(filter) > 0 && event.ServiceName != "" && !filter[event.ServiceName] {
+				continue
+			}
+			c.SSEvent("change", event)
+			c.Writer.Flush()
+		}
+	}
+}
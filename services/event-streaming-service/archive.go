@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Event retention. Events older than RetentionPeriod leave Postgres: with
+// an archive bucket configured they are moved into object storage as
+// gzipped NDJSON, one object per UTC day per run,
+//
+//	events/2024/03/17/<partition id>.ndjson.gz
+//
+// and recorded as an EventArchivePartition; without one they are deleted.
+
+const (
+	archiveBatchSize   = 50000
+	archiveDeleteChunk = 1000
+)
+
+// EventArchivePartition describes one archived object
+type EventArchivePartition struct {
+	ID           string     `json:"id" gorm:"primaryKey"`
+	Day          time.Time  `json:"day" gorm:"index;type:date"`
+	ObjectKey    string     `json:"object_key" gorm:"uniqueIndex;not null"`
+	EventCount   int        `json:"event_count"`
+	MinTimestamp time.Time  `json:"min_timestamp" gorm:"index"`
+	MaxTimestamp time.Time  `json:"max_timestamp" gorm:"index"`
+	SizeBytes    int64      `json:"size_bytes"`
+	SHA256       string     `json:"sha256"`
+	RewrittenAt  *time.Time `json:"rewritten_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// Guards against archival overlapping itself or an erasure
+var archiveMutex sync.Mutex
+
+func initEventArchive(config *Config) (*minio.Client, error) {
+	if config.ArchiveS3Endpoint == "" {
+		return nil, nil
+	}
+
+	client, err := minio.New(config.ArchiveS3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.ArchiveS3AccessKey, config.ArchiveS3SecretKey, ""),
+		Secure: config.ArchiveS3UseSSL,
+		Region: config.ArchiveS3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize event archive: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, config.ArchiveS3Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check archive bucket: %w", err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, config.ArchiveS3Bucket, minio.MakeBucketOptions{Region: config.ArchiveS3Region}); err != nil {
+			return nil, fmt.Errorf("failed to create archive bucket: %w", err)
+		}
+	}
+
+	return client, nil
+}
+
+func (s *EventStreamingService) startCleanupWorker() {
+	if s.config.RetentionPeriod <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if s.archive == nil {
+				if err := s.deleteExpiredEvents(); err != nil {
+					log.Printf("Event cleanup failed: %v", err)
+				}
+				continue
+			}
+			if _, err := s.archiveExpiredEvents(); err != nil {
+				log.Printf("Event archival failed: %v", err)
+			}
+		}
+	}
+}
+
+func (s *EventStreamingService) retentionCutoff() time.Time {
+	return time.Now().UTC().Add(-s.config.RetentionPeriod)
+}
+
+func (s *EventStreamingService) deleteExpiredEvents() error {
+	result := s.db.Where("timestamp < ?", s.retentionCutoff()).Delete(&Event{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Deleted %d expired events", result.RowsAffected)
+	}
+	return nil
+}
+
+// archiveExpiredEvents moves expired events into object storage. Rows are
+// deleted only after their partition has been uploaded and recorded.
+func (s *EventStreamingService) archiveExpiredEvents() (int, error) {
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+
+	cutoff := s.retentionCutoff()
+	archived := 0
+
+	for {
+		var events []Event
+		if err := s.db.Where("timestamp < ?", cutoff).
+			Order("timestamp ASC").
+			Limit(archiveBatchSize).
+			Find(&events).Error; err != nil {
+			return archived, fmt.Errorf("failed to load expired events: %w", err)
+		}
+		if len(events) == 0 {
+			return archived, nil
+		}
+
+		// Split the batch into UTC days
+		start := 0
+		for i := 1; i <= len(events); i++ {
+			if i < len(events) && sameUTCDay(events[i].Timestamp, events[start].Timestamp) {
+				continue
+			}
+			if err := s.archivePartition(events[start:i]); err != nil {
+				return archived, err
+			}
+			archived += i - start
+			start = i
+		}
+
+		if len(events) < archiveBatchSize {
+			return archived, nil
+		}
+	}
+}
+
+func (s *EventStreamingService) archivePartition(events []Event) error {
+	day := events[0].Timestamp.UTC()
+	partition := &EventArchivePartition{
+		ID:           uuid.New().String(),
+		Day:          time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC),
+		EventCount:   len(events),
+		MinTimestamp: events[0].Timestamp,
+		MaxTimestamp: events[len(events)-1].Timestamp,
+		CreatedAt:    time.Now().UTC(),
+	}
+	partition.ObjectKey = fmt.Sprintf("events/%s/%s.ndjson.gz", day.Format("2006/01/02"), partition.ID)
+
+	if err := s.writeArchiveObject(partition, events); err != nil {
+		return err
+	}
+	if err := s.db.Create(partition).Error; err != nil {
+		return fmt.Errorf("failed to record partition %s: %w", partition.ObjectKey, err)
+	}
+
+	ids := make([]string, 0, len(events))
+	for i := range events {
+		ids = append(ids, events[i].ID)
+	}
+	for start := 0; start < len(ids); start += archiveDeleteChunk {
+		end := start + archiveDeleteChunk
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := s.db.Where("id IN ?", ids[start:end]).Delete(&Event{}).Error; err != nil {
+			return fmt.Errorf("failed to delete archived events: %w", err)
+		}
+	}
+
+	log.Printf("Archived %d events to %s", len(events), partition.ObjectKey)
+	return nil
+}
+
+// writeArchiveObject uploads events as the partition's object, filling in
+// its size and checksum
+func (s *EventStreamingService) writeArchiveObject(partition *EventArchivePartition, events []Event) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(gz)
+	for i := range events {
+		if err := encoder.Encode(&events[i]); err != nil {
+			return fmt.Errorf("failed to encode event %s: %w", events[i].ID, err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress partition: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	if _, err := s.archive.PutObject(ctx, s.config.ArchiveS3Bucket, partition.ObjectKey,
+		bytes.NewReader(buf.Bytes()), int64(buf.Len()), minio.PutObjectOptions{
+			ContentType:     "application/x-ndjson",
+			ContentEncoding: "gzip",
+		}); err != nil {
+		return fmt.Errorf("failed to upload partition %s: %w", partition.ObjectKey, err)
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	partition.SHA256 = hex.EncodeToString(sum[:])
+	partition.SizeBytes = int64(buf.Len())
+	return nil
+}
+
+// readArchivedEvents reads every event in a partition
+func (s *EventStreamingService) readArchivedEvents(key string) ([]Event, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	object, err := s.archive.GetObject(ctx, s.config.ArchiveS3Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	gz, err := gzip.NewReader(object)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+func sameUTCDay(a, b time.Time) bool {
+	a, b = a.UTC(), b.UTC()
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay()
+}
@@ -0,0 +1,703 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Personal data and subject erasure.
+//
+// With PERSONAL_DATA_KEY set, the fields named in PERSONAL_DATA_FIELDS are
+// encrypted at ingest, at the top level of an event's data and metadata,
+// under a key of the event's user. Subject keys are stored wrapped by the
+// master key. Webhook deliveries carry the fields decrypted; Postgres,
+// Kafka, peer regions and the archive only ever hold ciphertext.
+//
+// Erasing a user then
+//   - deletes their subject key, crypto-shredding every encrypted field
+//     wherever a copy of it lives, backups and peer regions included,
+//   - redacts what is stored in the clear, in hot rows and archived
+//     partitions alike: the user and session IDs, personal fields written
+//     before encryption was enabled, and any value equal to the user ID,
+//   - and produces an Ed25519-signed report, which can be verified with
+//     the key served at /v1/erasures/public-key.
+
+const (
+	encryptedFieldPrefix = "pii:v1:"
+	erasedValue          = "[ERASED]"
+	subjectKeyCacheTTL   = 5 * time.Minute
+	erasureBatchSize     = 1000
+
+	// Matches the user ID as a value anywhere in a jsonb document
+	referencePath = "$.** ? (@ == $id)"
+)
+
+// Erasure statuses
+const (
+	ErasureStatusPending   = "pending"
+	ErasureStatusRunning   = "running"
+	ErasureStatusCompleted = "completed"
+	ErasureStatusFailed    = "failed"
+)
+
+// SubjectKey is a user's data key, wrapped by the master key
+type SubjectKey struct {
+	UserID     string    `json:"user_id" gorm:"primaryKey"`
+	WrappedKey []byte    `json:"-" gorm:"not null"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ErasureRequest tracks one subject erasure and holds its signed report
+type ErasureRequest struct {
+	ID                  string     `json:"id" gorm:"primaryKey"`
+	UserID              string     `json:"user_id" gorm:"index;not null"`
+	Reason              string     `json:"reason"`
+	RequestedBy         string     `json:"requested_by"`
+	Status              string     `json:"status" gorm:"index"`
+	Error               string     `json:"error,omitempty"`
+	HotEvents           int        `json:"hot_events"`
+	ArchivedEvents      int        `json:"archived_events"`
+	PartitionsScanned   int        `json:"partitions_scanned"`
+	PartitionsRewritten int        `json:"partitions_rewritten"`
+	RedactedFields      int        `json:"redacted_fields"`
+	ShreddedFields      int        `json:"shredded_fields"`
+	KeyShredded         bool       `json:"key_shredded"`
+	Report              string     `json:"-" gorm:"type:text"`
+	Signature           string     `json:"-"`
+	CreatedAt           time.Time  `json:"created_at"`
+	CompletedAt         *time.Time `json:"completed_at"`
+}
+
+// ErasureReport is the signed record of a completed erasure. It names the
+// subject by hash only.
+type ErasureReport struct {
+	RequestID           string            `json:"request_id"`
+	SubjectSHA256       string            `json:"subject_sha256"`
+	Region              string            `json:"region"`
+	Reason              string            `json:"reason,omitempty"`
+	RequestedBy         string            `json:"requested_by,omitempty"`
+	RequestedAt         time.Time         `json:"requested_at"`
+	CompletedAt         time.Time         `json:"completed_at"`
+	HotEvents           int               `json:"hot_events"`
+	ArchivedEvents      int               `json:"archived_events"`
+	EventIDsSHA256      string            `json:"event_ids_sha256"`
+	PartitionsScanned   int               `json:"partitions_scanned"`
+	RewrittenPartitions []ReportPartition `json:"rewritten_partitions"`
+	RedactedFields      int               `json:"redacted_fields"`
+	ShreddedFields      int               `json:"shredded_fields"`
+	KeyShredded         bool              `json:"key_shredded"`
+	PersonalDataFields  []string          `json:"personal_data_fields"`
+	SigningKeyID        string            `json:"signing_key_id"`
+}
+
+// ReportPartition is an archived object as it stands after redaction
+type ReportPartition struct {
+	ObjectKey string `json:"object_key"`
+	SHA256    string `json:"sha256"`
+}
+
+var erasuresTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "event_erasures_total",
+		Help: "Subject erasures by outcome",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(erasuresTotal)
+}
+
+// personalDataVault encrypts personal fields under per-subject keys
+type personalDataVault struct {
+	master cipher.AEAD // nil when encryption is off
+	fields map[string]bool
+
+	mu   sync.Mutex
+	keys map[string]cachedSubjectKey
+}
+
+type cachedSubjectKey struct {
+	aead     cipher.AEAD
+	loadedAt time.Time
+}
+
+func newPersonalDataVault(config *Config) (*personalDataVault, error) {
+	vault := &personalDataVault{
+		fields: make(map[string]bool),
+		keys:   make(map[string]cachedSubjectKey),
+	}
+	for _, field := range config.PersonalDataFields {
+		vault.fields[field] = true
+	}
+	if config.PersonalDataKey == "" {
+		return vault, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(config.PersonalDataKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("PERSONAL_DATA_KEY must be 32 base64-encoded bytes")
+	}
+	if vault.master, err = newAEAD(key); err != nil {
+		return nil, err
+	}
+	return vault, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func unseal(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func (v *personalDataVault) forget(userID string) {
+	v.mu.Lock()
+	delete(v.keys, userID)
+	v.mu.Unlock()
+}
+
+// subjectCipher returns the user's data key, creating it when asked to.
+// A user without a key, and not asked to create one, gets nil.
+func (s *EventStreamingService) subjectCipher(userID string, create bool) (cipher.AEAD, error) {
+	vault := s.personalData
+	vault.mu.Lock()
+	cached, ok := vault.keys[userID]
+	vault.mu.Unlock()
+	if ok && time.Since(cached.loadedAt) < subjectKeyCacheTTL {
+		return cached.aead, nil
+	}
+
+	var subjectKey SubjectKey
+	err := s.db.First(&subjectKey, "user_id = ?", userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if !create {
+			vault.forget(userID)
+			return nil, nil
+		}
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		wrapped, err := seal(vault.master, key, []byte(userID))
+		if err != nil {
+			return nil, err
+		}
+		// Another instance may create the key first; theirs wins
+		if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&SubjectKey{
+			UserID:     userID,
+			WrappedKey: wrapped,
+			CreatedAt:  time.Now().UTC(),
+		}).Error; err != nil {
+			return nil, err
+		}
+		err = s.db.First(&subjectKey, "user_id = ?", userID).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := unseal(vault.master, subjectKey.WrappedKey, []byte(userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap subject key: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	vault.mu.Lock()
+	vault.keys[userID] = cachedSubjectKey{aead: aead, loadedAt: time.Now()}
+	vault.mu.Unlock()
+	return aead, nil
+}
+
+func isEncryptedField(value interface{}) bool {
+	str, ok := value.(string)
+	return ok && strings.HasPrefix(str, encryptedFieldPrefix)
+}
+
+func fieldAdditionalData(eventID, field string) []byte {
+	return []byte(eventID + "/" + field)
+}
+
+// protectPersonalData encrypts the event's personal fields
+func (s *EventStreamingService) protectPersonalData(event *Event) error {
+	if s.personalData.master == nil || event.UserID == "" {
+		return nil
+	}
+
+	var aead cipher.AEAD
+	for _, values := range []map[string]interface{}{event.Data, event.Metadata} {
+		for field, value := range values {
+			if !s.personalData.fields[field] || value == nil || isEncryptedField(value) {
+				continue
+			}
+			if aead == nil {
+				var err error
+				if aead, err = s.subjectCipher(event.UserID, true); err != nil {
+					return err
+				}
+			}
+			plaintext, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			sealed, err := seal(aead, plaintext, fieldAdditionalData(event.ID, field))
+			if err != nil {
+				return err
+			}
+			values[field] = encryptedFieldPrefix + base64.RawStdEncoding.EncodeToString(sealed)
+		}
+	}
+	return nil
+}
+
+// revealPersonalData returns a copy of the event with its personal fields
+// decrypted. Fields whose key has been shredded read as erased.
+func (s *EventStreamingService) revealPersonalData(event *Event) *Event {
+	if s.personalData.master == nil || event.UserID == "" {
+		return event
+	}
+
+	revealed := *event
+	revealed.Data = s.revealFields(event.ID, event.UserID, event.Data)
+	revealed.Metadata = s.revealFields(event.ID, event.UserID, event.Metadata)
+	return &revealed
+}
+
+func (s *EventStreamingService) revealFields(eventID, userID string, values map[string]interface{}) map[string]interface{} {
+	if values == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(values))
+	for field, value := range values {
+		out[field] = value
+		if !isEncryptedField(value) {
+			continue
+		}
+
+		aead, err := s.subjectCipher(userID, false)
+		if err != nil {
+			log.Printf("Failed to load subject key for event %s: %v", eventID, err)
+			continue
+		}
+		if aead == nil {
+			out[field] = erasedValue
+			continue
+		}
+		sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(value.(string), encryptedFieldPrefix))
+		if err != nil {
+			continue
+		}
+		plaintext, err := unseal(aead, sealed, fieldAdditionalData(eventID, field))
+		if err != nil {
+			continue
+		}
+		var decoded interface{}
+		if json.Unmarshal(plaintext, &decoded) == nil {
+			out[field] = decoded
+		}
+	}
+	return out
+}
+
+// erasureTally accumulates what an erasure touched
+type erasureTally struct {
+	eventIDs []string
+	redacted int
+	shredded int
+}
+
+// eraseSubject strips the user from one event, reporting whether it changed.
+// Personal fields are only redacted in the user's own events; elsewhere
+// only references to the user ID are.
+func (s *EventStreamingService) eraseSubject(event *Event, userID, requestID string, tally *erasureTally) bool {
+	owned := event.UserID == userID
+	changed := false
+	if owned {
+		event.UserID = ""
+		event.SessionID = ""
+		changed = true
+	}
+	if event.Subject == userID {
+		event.Subject = erasedValue
+		changed = true
+	}
+
+	for _, values := range []map[string]interface{}{event.Data, event.Metadata} {
+		for field, value := range values {
+			if owned && s.personalData.fields[field] && value != nil {
+				if isEncryptedField(value) {
+					tally.shredded++
+					continue
+				}
+				if value != erasedValue {
+					values[field] = erasedValue
+					tally.redacted++
+					changed = true
+				}
+				continue
+			}
+			if redacted, ok := redactReferences(value, userID, tally); ok {
+				values[field] = redacted
+				changed = true
+			}
+		}
+	}
+
+	if changed {
+		if event.Metadata == nil {
+			event.Metadata = make(map[string]interface{})
+		}
+		event.Metadata["erasure_id"] = requestID
+		tally.eventIDs = append(tally.eventIDs, event.ID)
+	}
+	return changed
+}
+
+// redactReferences replaces strings equal to the user ID, at any depth
+func redactReferences(value interface{}, userID string, tally *erasureTally) (interface{}, bool) {
+	switch v := value.(type) {
+	case string:
+		if v == userID {
+			tally.redacted++
+			return erasedValue, true
+		}
+	case map[string]interface{}:
+		changed := false
+		for key, item := range v {
+			if redacted, ok := redactReferences(item, userID, tally); ok {
+				v[key] = redacted
+				changed = true
+			}
+		}
+		return v, changed
+	case []interface{}:
+		changed := false
+		for i, item := range v {
+			if redacted, ok := redactReferences(item, userID, tally); ok {
+				v[i] = redacted
+				changed = true
+			}
+		}
+		return v, changed
+	}
+	return value, false
+}
+
+// Request the erasure of a user's personal data
+func (s *EventStreamingService) createErasure(c *gin.Context) {
+	var req struct {
+		UserID      string `json:"user_id" binding:"required"`
+		Reason      string `json:"reason"`
+		RequestedBy string `json:"requested_by"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var inFlight int64
+	s.db.Model(&ErasureRequest{}).
+		Where("user_id = ? AND status IN ?", req.UserID, []string{ErasureStatusPending, ErasureStatusRunning}).
+		Count(&inFlight)
+	if inFlight > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "An erasure for this user is already in progress"})
+		return
+	}
+
+	request := &ErasureRequest{
+		ID:          uuid.New().String(),
+		UserID:      req.UserID,
+		Reason:      req.Reason,
+		RequestedBy: req.RequestedBy,
+		Status:      ErasureStatusPending,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := s.db.Create(request).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create erasure request"})
+		return
+	}
+
+	go s.runErasure(request)
+
+	c.JSON(http.StatusAccepted, request)
+}
+
+// resumeErasures restarts erasures interrupted by a shutdown. Erasing is
+// idempotent, so they simply run again.
+func (s *EventStreamingService) resumeErasures() {
+	var requests []ErasureRequest
+	if err := s.db.Where("status IN ?", []string{ErasureStatusPending, ErasureStatusRunning}).
+		Order("created_at ASC").Find(&requests).Error; err != nil {
+		log.Printf("Failed to load unfinished erasures: %v", err)
+		return
+	}
+	for i := range requests {
+		s.runErasure(&requests[i])
+	}
+}
+
+func (s *EventStreamingService) runErasure(request *ErasureRequest) {
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+
+	s.db.Model(request).Update("status", ErasureStatusRunning)
+	log.Printf("🧹 Erasing personal data for erasure %s", request.ID)
+
+	report, err := s.eraseUserData(request)
+	now := time.Now().UTC()
+	request.CompletedAt = &now
+	if err != nil {
+		request.Status = ErasureStatusFailed
+		request.Error = err.Error()
+		log.Printf("Erasure %s failed: %v", request.ID, err)
+	} else {
+		report.CompletedAt = now
+		payload, _ := json.Marshal(report)
+		request.Report = string(payload)
+		request.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.erasureSigner, payload))
+		request.Status = ErasureStatusCompleted
+		request.Error = ""
+		log.Printf("🧹 Erasure %s completed: %d hot and %d archived events", request.ID, request.HotEvents, request.ArchivedEvents)
+	}
+	erasuresTotal.WithLabelValues(request.Status).Inc()
+
+	if err := s.db.Save(request).Error; err != nil {
+		log.Printf("Failed to record erasure %s: %v", request.ID, err)
+	}
+}
+
+func (s *EventStreamingService) eraseUserData(request *ErasureRequest) (*ErasureReport, error) {
+	userID := request.UserID
+	tally := &erasureTally{}
+
+	// Shred the key first; it covers every encrypted copy at once
+	result := s.db.Where("user_id = ?", userID).Delete(&SubjectKey{})
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to shred subject key: %w", result.Error)
+	}
+	s.personalData.forget(userID)
+	request.KeyShredded = result.RowsAffected > 0
+
+	// Hot events
+	lastID := ""
+	for {
+		var events []Event
+		err := s.db.Where("id > ?", lastID).
+			Where(s.db.Where("user_id = ? OR subject = ?", userID, userID).
+				Or("jsonb_path_exists(data, ?::jsonpath, jsonb_build_object('id', ?::text))", referencePath, userID).
+				Or("jsonb_path_exists(metadata, ?::jsonpath, jsonb_build_object('id', ?::text))", referencePath, userID)).
+			Order("id ASC").
+			Limit(erasureBatchSize).
+			Find(&events).Error
+		if err != nil {
+			return nil, fmt.Errorf("failed to find events: %w", err)
+		}
+		for i := range events {
+			event := &events[i]
+			if !s.eraseSubject(event, userID, request.ID, tally) {
+				continue
+			}
+			if err := s.db.Model(event).
+				Select("user_id", "session_id", "subject", "data", "metadata").
+				Updates(event).Error; err != nil {
+				return nil, fmt.Errorf("failed to redact event %s: %w", event.ID, err)
+			}
+			request.HotEvents++
+		}
+		if len(events) < erasureBatchSize {
+			break
+		}
+		lastID = events[len(events)-1].ID
+	}
+
+	// Archived partitions; nothing indexes them by user, so each is read
+	var rewritten []ReportPartition
+	if s.archive != nil {
+		var partitions []EventArchivePartition
+		if err := s.db.Order("day ASC, created_at ASC").Find(&partitions).Error; err != nil {
+			return nil, fmt.Errorf("failed to list archive partitions: %w", err)
+		}
+		for i := range partitions {
+			partition := &partitions[i]
+			events, err := s.readArchivedEvents(partition.ObjectKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read partition %s: %w", partition.ObjectKey, err)
+			}
+			request.PartitionsScanned++
+
+			erased := 0
+			for j := range events {
+				if s.eraseSubject(&events[j], userID, request.ID, tally) {
+					erased++
+				}
+			}
+			if erased == 0 {
+				continue
+			}
+
+			if err := s.writeArchiveObject(partition, events); err != nil {
+				return nil, err
+			}
+			now := time.Now().UTC()
+			partition.RewrittenAt = &now
+			if err := s.db.Model(partition).
+				Select("size_bytes", "sha256", "rewritten_at").
+				Updates(partition).Error; err != nil {
+				return nil, fmt.Errorf("failed to record partition %s: %w", partition.ObjectKey, err)
+			}
+			request.ArchivedEvents += erased
+			request.PartitionsRewritten++
+			rewritten = append(rewritten, ReportPartition{ObjectKey: partition.ObjectKey, SHA256: partition.SHA256})
+		}
+	}
+
+	request.RedactedFields = tally.redacted
+	request.ShreddedFields = tally.shredded
+
+	sort.Strings(tally.eventIDs)
+	idsDigest := sha256.Sum256([]byte(strings.Join(tally.eventIDs, "\n")))
+	subjectDigest := sha256.Sum256([]byte(userID))
+	fields := make([]string, 0, len(s.personalData.fields))
+	for field := range s.personalData.fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	return &ErasureReport{
+		RequestID:           request.ID,
+		SubjectSHA256:       hex.EncodeToString(subjectDigest[:]),
+		Region:              s.config.Region,
+		Reason:              request.Reason,
+		RequestedBy:         request.RequestedBy,
+		RequestedAt:         request.CreatedAt,
+		HotEvents:           request.HotEvents,
+		ArchivedEvents:      request.ArchivedEvents,
+		EventIDsSHA256:      hex.EncodeToString(idsDigest[:]),
+		PartitionsScanned:   request.PartitionsScanned,
+		RewrittenPartitions: rewritten,
+		RedactedFields:      request.RedactedFields,
+		ShreddedFields:      request.ShreddedFields,
+		KeyShredded:         request.KeyShredded,
+		PersonalDataFields:  fields,
+		SigningKeyID:        s.erasureSigningKeyID(),
+	}, nil
+}
+
+// List erasure requests
+func (s *EventStreamingService) listErasures(c *gin.Context) {
+	query := s.db.Order("created_at DESC")
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var requests []ErasureRequest
+	if err := query.Limit(500).Find(&requests).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list erasures"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"erasures": requests, "total": len(requests)})
+}
+
+// Get an erasure request
+func (s *EventStreamingService) getErasure(c *gin.Context) {
+	var request ErasureRequest
+	if err := s.db.First(&request, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Erasure not found"})
+		return
+	}
+	c.JSON(http.StatusOK, request)
+}
+
+// Get the signed report of a completed erasure. The signature covers the
+// report exactly as returned.
+func (s *EventStreamingService) getErasureReport(c *gin.Context) {
+	var request ErasureRequest
+	if err := s.db.First(&request, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Erasure not found"})
+		return
+	}
+	if request.Status != ErasureStatusCompleted {
+		c.JSON(http.StatusConflict, gin.H{"error": "Erasure has not completed", "status": request.Status})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"report":    json.RawMessage(request.Report),
+		"signature": request.Signature,
+		"algorithm": "Ed25519",
+		"key_id":    s.erasureSigningKeyID(),
+	})
+}
+
+// Get the public key erasure reports are signed with
+func (s *EventStreamingService) getErasurePublicKey(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"algorithm":  "Ed25519",
+		"key_id":     s.erasureSigningKeyID(),
+		"public_key": base64.StdEncoding.EncodeToString(s.erasureSigner.Public().(ed25519.PublicKey)),
+	})
+}
+
+func (s *EventStreamingService) erasureSigningKeyID() string {
+	sum := sha256.Sum256(s.erasureSigner.Public().(ed25519.PublicKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// loadErasureSigner reads the report signing key from an Ed25519 seed,
+// falling back to a key that lasts until restart
+func loadErasureSigner(seed string) (ed25519.PrivateKey, error) {
+	if seed == "" {
+		log.Printf("Warning: ERASURE_SIGNING_KEY not set, erasure reports are signed with an ephemeral key")
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(seed)
+	if err != nil || len(raw) != ed25519.SeedSize {
+		return nil, fmt.Errorf("ERASURE_SIGNING_KEY must be a base64-encoded %d-byte Ed25519 seed", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(raw), nil
+}
@@ -0,0 +1,728 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Stream functions
+//
+// A stream can run user-supplied WebAssembly functions over each of its
+// events, in order, to filter them or rewrite them (enrich, redact,
+// reshape) without redeploying the service. A module must export:
+//
+//	memory
+//	alloc(size i32) i32               buffer for the input, in its memory
+//	process(ptr i32, len i32) i64     (out_ptr << 32) | out_len
+//
+// process receives the event as JSON and returns the event to pass on, as
+// JSON, or a zero length to drop it. Only subject, priority, data and
+// metadata of the returned event are kept. Modules may import WASI (with no
+// filesystem, network or environment) and env.log(ptr, len).
+//
+// Every call runs in a fresh instance, with the function's own memory cap
+// and time limit, so one event cannot see another's data and a runaway or
+// crashing function affects only itself: on error the event is passed on
+// unchanged or dropped, as the function says, and a function failing
+// MaxConsecutiveErrors times in a row is disabled.
+
+// Function runtimes
+const (
+	FunctionRuntimeWASM = "wasm"
+)
+
+// What to do with an event when a function fails on it
+const (
+	FunctionOnErrorPass = "pass"
+	FunctionOnErrorDrop = "drop"
+)
+
+const (
+	maxFunctionModuleSize = 8 << 20
+	maxFunctionTimeout    = 1000 // ms
+	maxFunctionMemoryMB   = 128
+	maxFunctionLogLength  = 1024
+	wasmPagesPerMB        = 16
+	functionRetireDelay   = 30 * time.Second
+)
+
+// StreamFunction is a user function run over a stream's events
+type StreamFunction struct {
+	ID                   string     `json:"id" gorm:"primaryKey"`
+	StreamID             string     `json:"stream_id" gorm:"index;not null"`
+	Name                 string     `json:"name" gorm:"not null"`
+	Description          string     `json:"description"`
+	Runtime              string     `json:"runtime" gorm:"default:wasm"`
+	Module               []byte     `json:"-" gorm:"type:bytea"`
+	ModuleSHA256         string     `json:"module_sha256"`
+	ModuleSize           int        `json:"module_size"`
+	Position             int        `json:"position"` // functions run in ascending position
+	OnError              string     `json:"on_error" gorm:"default:pass"`
+	TimeoutMs            int        `json:"timeout_ms" gorm:"default:50"`
+	MaxMemoryMB          int        `json:"max_memory_mb" gorm:"default:16"`
+	MaxConsecutiveErrors int        `json:"max_consecutive_errors" gorm:"default:25"` // 0: never disable
+	IsActive             bool       `json:"is_active" gorm:"default:true"`
+	DisabledReason       string     `json:"disabled_reason"`
+	LastError            string     `json:"last_error"`
+	LastErrorAt          *time.Time `json:"last_error_at"`
+	CreatedBy            string     `json:"created_by"`
+	CreatedAt            time.Time  `json:"created_at"`
+	UpdatedAt            time.Time  `json:"updated_at"`
+}
+
+var (
+	streamFunctionInvocations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "stream_function_invocations_total",
+			Help: "Stream function calls by outcome",
+		},
+		[]string{"stream", "function", "result"},
+	)
+
+	streamFunctionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "stream_function_duration_seconds",
+			Help:    "Time taken by a stream function per event",
+			Buckets: []float64{0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1},
+		},
+		[]string{"stream", "function"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(streamFunctionInvocations)
+	prometheus.MustRegister(streamFunctionDuration)
+}
+
+// compiledFunction is a function ready to run. Each has its own runtime,
+// since the memory cap is a runtime setting.
+type compiledFunction struct {
+	fn       StreamFunction
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+
+	consecutiveErrors int32
+	invocations       int64
+	failures          int64
+	dropped           int64
+}
+
+// functionResult is the outcome of running one function on one event
+type functionResult struct {
+	Event    *Event        `json:"event,omitempty"`
+	Dropped  bool          `json:"dropped"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+type functionRegistry struct {
+	mu       sync.RWMutex
+	byStream map[string][]*compiledFunction
+	byID     map[string]*compiledFunction
+}
+
+func newFunctionRegistry() *functionRegistry {
+	return &functionRegistry{
+		byStream: make(map[string][]*compiledFunction),
+		byID:     make(map[string]*compiledFunction),
+	}
+}
+
+func (r *functionRegistry) forStream(streamID string) []*compiledFunction {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byStream[streamID]
+}
+
+func (r *functionRegistry) get(id string) *compiledFunction {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byID[id]
+}
+
+// compileFunction checks a module against the ABI and prepares it to run
+func compileFunction(fn StreamFunction) (*compiledFunction, error) {
+	ctx := context.Background()
+	config := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(fn.MaxMemoryMB * wasmPagesPerMB)).
+		WithCloseOnContextDone(true)
+	runtime := wazero.NewRuntimeWithConfig(ctx, config)
+
+	compiled, err := runtime.CompileModule(ctx, fn.Module)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("invalid WebAssembly module: %w", err)
+	}
+	if err := checkFunctionExports(compiled); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to provide WASI: %w", err)
+	}
+	name := fn.Name
+	_, err = runtime.NewHostModuleBuilder("env").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, ptr, length uint32) {
+			if length > maxFunctionLogLength {
+				length = maxFunctionLogLength
+			}
+			if message, ok := m.Memory().Read(ptr, length); ok {
+				log.Printf("Stream function %s: %s", name, message)
+			}
+		}).
+		Export("log").
+		Instantiate(ctx)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to provide env: %w", err)
+	}
+
+	return &compiledFunction{fn: fn, runtime: runtime, compiled: compiled}, nil
+}
+
+func checkFunctionExports(compiled wazero.CompiledModule) error {
+	if _, ok := compiled.ExportedMemories()["memory"]; !ok {
+		return errors.New("module must export its memory as \"memory\"")
+	}
+	i32, i64 := api.ValueTypeI32, api.ValueTypeI64
+	want := map[string][2][]api.ValueType{
+		"alloc":   {{i32}, {i32}},
+		"process": {{i32, i32}, {i64}},
+	}
+	exports := compiled.ExportedFunctions()
+	for name, signature := range want {
+		def, ok := exports[name]
+		if !ok {
+			return fmt.Errorf("module must export %q", name)
+		}
+		if !sameTypes(def.ParamTypes(), signature[0]) || !sameTypes(def.ResultTypes(), signature[1]) {
+			return fmt.Errorf("export %q has the wrong signature", name)
+		}
+	}
+	return nil
+}
+
+func sameTypes(a, b []api.ValueType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *compiledFunction) close() {
+	f.runtime.Close(context.Background())
+}
+
+// call runs the function on one event's JSON in a fresh instance. A nil
+// result with no error drops the event.
+func (f *compiledFunction) call(input []byte, maxOutput int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(f.fn.TimeoutMs)*time.Millisecond)
+	defer cancel()
+
+	config := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize")
+	mod, err := f.runtime.InstantiateModule(ctx, f.compiled, config)
+	if err != nil {
+		return nil, fmt.Errorf("instantiate: %w", err)
+	}
+	defer mod.Close(context.Background())
+
+	results, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("alloc: %w", err)
+	}
+	ptr := api.DecodeU32(results[0])
+	if !mod.Memory().Write(ptr, input) {
+		return nil, errors.New("alloc returned a buffer outside memory")
+	}
+
+	results, err = mod.ExportedFunction("process").Call(ctx, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("timed out after %dms", f.fn.TimeoutMs)
+		}
+		return nil, fmt.Errorf("process: %w", err)
+	}
+	outPtr, outLen := uint32(results[0]>>32), uint32(results[0])
+	if outLen == 0 {
+		return nil, nil
+	}
+	if int(outLen) > maxOutput {
+		return nil, fmt.Errorf("output of %d bytes exceeds the %d byte limit", outLen, maxOutput)
+	}
+	out, ok := mod.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, errors.New("output lies outside memory")
+	}
+	// The view dies with the instance
+	return append([]byte(nil), out...), nil
+}
+
+// run applies the function to an event, without changing the event
+func (s *EventStreamingService) runFunction(f *compiledFunction, event *Event) functionResult {
+	start := time.Now()
+	input, err := json.Marshal(event)
+	if err != nil {
+		return functionResult{Error: err.Error()}
+	}
+
+	var out []byte
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("function panicked: %v", r)
+			}
+		}()
+		out, err = f.call(input, int(s.config.MaxEventSize))
+	}()
+	result := functionResult{Duration: time.Since(start)}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if out == nil {
+		result.Dropped = true
+		return result
+	}
+
+	var returned Event
+	if err := json.Unmarshal(out, &returned); err != nil {
+		result.Error = "output is not an event: " + err.Error()
+		return result
+	}
+	// Only the content of the event is the function's to change
+	transformed := *event
+	transformed.Subject = returned.Subject
+	transformed.Priority = returned.Priority
+	transformed.Data = returned.Data
+	transformed.Metadata = returned.Metadata
+	if transformed.Priority == "" {
+		transformed.Priority = event.Priority
+	}
+	if err := s.validateEvent(&transformed); err != nil {
+		result.Error = "output is not a valid event: " + err.Error()
+		return result
+	}
+	result.Event = &transformed
+	return result
+}
+
+// applyStreamFunctions runs a stream's functions over an event in order. It
+// returns the event to deliver, which is not the one passed in if any
+// function changed it, or false when a function dropped it.
+func (s *EventStreamingService) applyStreamFunctions(streamID string, event *Event) (*Event, bool) {
+	return s.runStreamFunctions(streamID, event, true)
+}
+
+// previewStreamFunctions is applyStreamFunctions for previews: outcomes
+// are not counted and failures do not count towards disabling a function
+func (s *EventStreamingService) previewStreamFunctions(streamID string, event *Event) (*Event, bool) {
+	return s.runStreamFunctions(streamID, event, false)
+}
+
+func (s *EventStreamingService) runStreamFunctions(streamID string, event *Event, record bool) (*Event, bool) {
+	for _, f := range s.functions.forStream(streamID) {
+		result := s.runFunction(f, event)
+		if !record {
+			if (result.Error != "" && f.fn.OnError == FunctionOnErrorDrop) || result.Dropped {
+				return nil, false
+			}
+			if result.Event != nil {
+				event = result.Event
+			}
+			continue
+		}
+		atomic.AddInt64(&f.invocations, 1)
+		streamFunctionDuration.WithLabelValues(streamID, f.fn.Name).Observe(result.Duration.Seconds())
+
+		switch {
+		case result.Error != "":
+			streamFunctionInvocations.WithLabelValues(streamID, f.fn.Name, "error").Inc()
+			atomic.AddInt64(&f.failures, 1)
+			s.functionFailed(f, result.Error)
+			if f.fn.OnError == FunctionOnErrorDrop {
+				atomic.AddInt64(&f.dropped, 1)
+				return nil, false
+			}
+		case result.Dropped:
+			streamFunctionInvocations.WithLabelValues(streamID, f.fn.Name, "dropped").Inc()
+			atomic.StoreInt32(&f.consecutiveErrors, 0)
+			atomic.AddInt64(&f.dropped, 1)
+			return nil, false
+		default:
+			streamFunctionInvocations.WithLabelValues(streamID, f.fn.Name, "ok").Inc()
+			atomic.StoreInt32(&f.consecutiveErrors, 0)
+			event = result.Event
+		}
+	}
+	return event, true
+}
+
+// functionFailed records a failure, disabling the function once it has
+// failed too many times in a row
+func (s *EventStreamingService) functionFailed(f *compiledFunction, message string) {
+	n := atomic.AddInt32(&f.consecutiveErrors, 1)
+	limit := f.fn.MaxConsecutiveErrors
+	// Record the first failure of a run and the one that disables
+	if n != 1 && (limit <= 0 || int(n) != limit) {
+		return
+	}
+
+	now := time.Now().UTC()
+	updates := map[string]interface{}{"last_error": message, "last_error_at": now}
+	disable := limit > 0 && int(n) >= limit
+	if disable {
+		updates["is_active"] = false
+		updates["disabled_reason"] = fmt.Sprintf("disabled after %d consecutive errors", n)
+	}
+	go func() {
+		if err := s.db.Model(&StreamFunction{}).Where("id = ?", f.fn.ID).Updates(updates).Error; err != nil {
+			log.Printf("Failed to record stream function error: %v", err)
+			return
+		}
+		if disable {
+			log.Printf("⚠️ Disabled stream function %s on stream %s: %s", f.fn.Name, f.fn.StreamID, message)
+			if err := s.loadStreamFunctions(); err != nil {
+				log.Printf("Failed to reload stream functions: %v", err)
+			}
+		}
+	}()
+}
+
+// loadStreamFunctions compiles the active functions, reusing the compiled
+// form of any whose module and limits have not changed
+func (s *EventStreamingService) loadStreamFunctions() error {
+	var functions []StreamFunction
+	if err := s.db.Where("is_active = ?", true).Order("stream_id, position, created_at").Find(&functions).Error; err != nil {
+		return err
+	}
+
+	s.functions.mu.RLock()
+	previous := s.functions.byID
+	s.functions.mu.RUnlock()
+
+	byStream := make(map[string][]*compiledFunction)
+	byID := make(map[string]*compiledFunction, len(functions))
+	for _, fn := range functions {
+		compiled, ok := previous[fn.ID]
+		if ok && compiled.fn.ModuleSHA256 == fn.ModuleSHA256 && compiled.fn.MaxMemoryMB == fn.MaxMemoryMB {
+			// Settings other than the module and memory take effect in place
+			compiled = &compiledFunction{fn: fn, runtime: compiled.runtime, compiled: compiled.compiled,
+				invocations: atomic.LoadInt64(&compiled.invocations),
+				failures:    atomic.LoadInt64(&compiled.failures),
+				dropped:     atomic.LoadInt64(&compiled.dropped)}
+		} else {
+			var err error
+			compiled, err = compileFunction(fn)
+			if err != nil {
+				log.Printf("Skipping stream function %s: %v", fn.ID, err)
+				continue
+			}
+		}
+		compiled.fn.Module = nil
+		byStream[fn.StreamID] = append(byStream[fn.StreamID], compiled)
+		byID[fn.ID] = compiled
+	}
+
+	s.functions.mu.Lock()
+	s.functions.byStream = byStream
+	s.functions.byID = byID
+	s.functions.mu.Unlock()
+
+	// Close runtimes no longer used, once calls in progress have finished
+	for id, old := range previous {
+		if current, ok := byID[id]; ok && current.runtime == old.runtime {
+			continue
+		}
+		time.AfterFunc(functionRetireDelay, old.close)
+	}
+	return nil
+}
+
+// functionRequest is the body of a function create or update. Module is
+// the WebAssembly binary, base64 encoded.
+type functionRequest struct {
+	Name                 *string `json:"name"`
+	Description          *string `json:"description"`
+	Runtime              *string `json:"runtime"`
+	Module               []byte  `json:"module"`
+	Position             *int    `json:"position"`
+	OnError              *string `json:"on_error"`
+	TimeoutMs            *int    `json:"timeout_ms"`
+	MaxMemoryMB          *int    `json:"max_memory_mb"`
+	MaxConsecutiveErrors *int    `json:"max_consecutive_errors"`
+	IsActive             *bool   `json:"is_active"`
+}
+
+// apply copies the request onto fn and checks the result
+func (req *functionRequest) apply(fn *StreamFunction) error {
+	if req.Name != nil {
+		fn.Name = *req.Name
+	}
+	if req.Description != nil {
+		fn.Description = *req.Description
+	}
+	if req.Runtime != nil {
+		fn.Runtime = *req.Runtime
+	}
+	if req.Position != nil {
+		fn.Position = *req.Position
+	}
+	if req.OnError != nil {
+		fn.OnError = *req.OnError
+	}
+	if req.TimeoutMs != nil {
+		fn.TimeoutMs = *req.TimeoutMs
+	}
+	if req.MaxMemoryMB != nil {
+		fn.MaxMemoryMB = *req.MaxMemoryMB
+	}
+	if req.MaxConsecutiveErrors != nil {
+		fn.MaxConsecutiveErrors = *req.MaxConsecutiveErrors
+	}
+	if req.Module != nil {
+		sum := sha256.Sum256(req.Module)
+		fn.Module = req.Module
+		fn.ModuleSHA256 = hex.EncodeToString(sum[:])
+		fn.ModuleSize = len(req.Module)
+	}
+
+	switch {
+	case fn.Name == "":
+		return errors.New("name is required")
+	case fn.Runtime != FunctionRuntimeWASM:
+		return fmt.Errorf("unsupported runtime %q; only %q is available", fn.Runtime, FunctionRuntimeWASM)
+	case len(fn.Module) == 0:
+		return errors.New("module is required")
+	case len(fn.Module) > maxFunctionModuleSize:
+		return fmt.Errorf("module exceeds %d bytes", maxFunctionModuleSize)
+	case fn.OnError != FunctionOnErrorPass && fn.OnError != FunctionOnErrorDrop:
+		return errors.New("on_error must be pass or drop")
+	case fn.TimeoutMs <= 0 || fn.TimeoutMs > maxFunctionTimeout:
+		return fmt.Errorf("timeout_ms must be between 1 and %d", maxFunctionTimeout)
+	case fn.MaxMemoryMB <= 0 || fn.MaxMemoryMB > maxFunctionMemoryMB:
+		return fmt.Errorf("max_memory_mb must be between 1 and %d", maxFunctionMemoryMB)
+	case fn.MaxConsecutiveErrors < 0:
+		return errors.New("max_consecutive_errors must not be negative")
+	}
+	return nil
+}
+
+// functionView adds a function's live counters on this instance
+func (s *EventStreamingService) functionView(fn StreamFunction) gin.H {
+	view := gin.H{"function": fn}
+	if f := s.functions.get(fn.ID); f != nil {
+		view["stats"] = gin.H{
+			"invocations":        atomic.LoadInt64(&f.invocations),
+			"errors":             atomic.LoadInt64(&f.failures),
+			"dropped":            atomic.LoadInt64(&f.dropped),
+			"consecutive_errors": atomic.LoadInt32(&f.consecutiveErrors),
+		}
+	}
+	return view
+}
+
+// Attach a function to a stream
+func (s *EventStreamingService) createStreamFunction(c *gin.Context) {
+	var stream EventStream
+	if err := s.db.First(&stream, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	var req functionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	fn := StreamFunction{
+		ID:                   uuid.New().String(),
+		StreamID:             stream.ID,
+		Runtime:              FunctionRuntimeWASM,
+		OnError:              FunctionOnErrorPass,
+		TimeoutMs:            50,
+		MaxMemoryMB:          16,
+		MaxConsecutiveErrors: 25,
+		IsActive:             true,
+		CreatedBy:            c.GetHeader("X-User-ID"),
+		CreatedAt:            time.Now().UTC(),
+		UpdatedAt:            time.Now().UTC(),
+	}
+	if err := req.apply(&fn); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	compiled, err := compileFunction(fn)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	compiled.close()
+
+	if err := s.db.Create(&fn).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create stream function"})
+		return
+	}
+	if req.IsActive != nil && !*req.IsActive {
+		// The column default would override false on create
+		s.db.Model(&fn).Update("is_active", false)
+		fn.IsActive = false
+	}
+	if err := s.loadStreamFunctions(); err != nil {
+		log.Printf("Failed to reload stream functions: %v", err)
+	}
+
+	c.JSON(http.StatusCreated, s.functionView(fn))
+}
+
+// List the functions of a stream, in the order they run
+func (s *EventStreamingService) listStreamFunctions(c *gin.Context) {
+	var functions []StreamFunction
+	if err := s.db.Where("stream_id = ?", c.Param("id")).Order("position, created_at").Find(&functions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch stream functions"})
+		return
+	}
+
+	views := make([]gin.H, 0, len(functions))
+	for _, fn := range functions {
+		views = append(views, s.functionView(fn))
+	}
+	c.JSON(http.StatusOK, gin.H{"functions": views})
+}
+
+// Get a stream function
+func (s *EventStreamingService) getStreamFunction(c *gin.Context) {
+	var fn StreamFunction
+	if err := s.db.First(&fn, "id = ? AND stream_id = ?", c.Param("function_id"), c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream function not found"})
+		return
+	}
+	c.JSON(http.StatusOK, s.functionView(fn))
+}
+
+// Update a stream function's settings or module. Activating a disabled
+// function clears why it was disabled.
+func (s *EventStreamingService) updateStreamFunction(c *gin.Context) {
+	var fn StreamFunction
+	if err := s.db.First(&fn, "id = ? AND stream_id = ?", c.Param("function_id"), c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream function not found"})
+		return
+	}
+
+	var req functionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.apply(&fn); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Module != nil || req.MaxMemoryMB != nil {
+		compiled, err := compileFunction(fn)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		compiled.close()
+	}
+	if req.IsActive != nil {
+		fn.IsActive = *req.IsActive
+		if fn.IsActive {
+			fn.DisabledReason = ""
+		}
+	}
+	fn.UpdatedAt = time.Now().UTC()
+
+	if err := s.db.Save(&fn).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update stream function"})
+		return
+	}
+	if err := s.loadStreamFunctions(); err != nil {
+		log.Printf("Failed to reload stream functions: %v", err)
+	}
+
+	c.JSON(http.StatusOK, s.functionView(fn))
+}
+
+// Remove a function from a stream
+func (s *EventStreamingService) deleteStreamFunction(c *gin.Context) {
+	result := s.db.Where("id = ? AND stream_id = ?", c.Param("function_id"), c.Param("id")).Delete(&StreamFunction{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete stream function"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream function not found"})
+		return
+	}
+	if err := s.loadStreamFunctions(); err != nil {
+		log.Printf("Failed to reload stream functions: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Stream function deleted successfully"})
+}
+
+// Run a stream function on a sample event, active or not, without counting
+// the outcome against it
+func (s *EventStreamingService) testStreamFunction(c *gin.Context) {
+	var fn StreamFunction
+	if err := s.db.First(&fn, "id = ? AND stream_id = ?", c.Param("function_id"), c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream function not found"})
+		return
+	}
+
+	var eventData map[string]interface{}
+	if err := c.ShouldBindJSON(&eventData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event data"})
+		return
+	}
+	event := &Event{
+		ID:        uuid.New().String(),
+		Type:      getString(eventData, "type", EventTypeSystemEvent),
+		Source:    getString(eventData, "source", "function-test"),
+		Subject:   getString(eventData, "subject", ""),
+		Priority:  getString(eventData, "priority", PriorityNormal),
+		Data:      getMap(eventData, "data"),
+		Metadata:  getMap(eventData, "metadata"),
+		UserID:    getString(eventData, "user_id", ""),
+		Timestamp: time.Now().UTC(),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	compiled, err := compileFunction(fn)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	defer compiled.close()
+
+	result := s.runFunction(compiled, event)
+	c.JSON(http.StatusOK, gin.H{
+		"input":  event,
+		"result": result,
+	})
+}
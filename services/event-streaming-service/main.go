@@ -8,6 +8,7 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -32,6 +33,7 @@ import (
 	"github.com/segmentio/kafka-go"
 	"github.com/nats-io/nats.go"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/minio/minio-go/v7"
 )
 
 // Configuration
@@ -46,6 +48,31 @@ type Config struct {
 	RetentionPeriod time.Duration
 	BatchSize       int
 	FlushInterval   time.Duration
+
+	// Buffer fill ratio at which producers are asked to slow down
+	BackpressureThreshold float64
+
+	// HMAC key used to sign webhook deliveries
+	WebhookSigningSecret string
+
+	// Multi-region replication
+	Region             string
+	ReplicationEnabled bool
+	ReplicationPeers   []ReplicationPeer
+	ReplicationToken   string
+
+	// Archive bucket for events past retention; empty deletes them instead
+	ArchiveS3Endpoint  string
+	ArchiveS3AccessKey string
+	ArchiveS3SecretKey string
+	ArchiveS3Bucket    string
+	ArchiveS3Region    string
+	ArchiveS3UseSSL    bool
+
+	// Personal data encryption and erasure
+	PersonalDataFields []string
+	PersonalDataKey    string
+	ErasureSigningKey  string
 }
 
 // Event types
@@ -132,6 +159,14 @@ type EventStreamingService struct {
 	eventBuffer     chan *Event
 	subscribers     map[string][]*EventSubscription
 	subscribersMu   sync.RWMutex
+	deliveries      chan *Event
+	retries         chan *deliveryRetry
+	clock           *hybridClock
+	functions       *functionRegistry
+	archive         *minio.Client
+	personalData    *personalDataVault
+	erasureSigner   ed25519.PrivateKey
+	quotas          *streamQuotaCache
 }
 
 // Prometheus metrics
@@ -211,6 +246,26 @@ func main() {
 		RetentionPeriod: time.Duration(parseInt(getEnv("RETENTION_DAYS", "30"))) * 24 * time.Hour,
 		BatchSize:       parseInt(getEnv("BATCH_SIZE", "100")),
 		FlushInterval:   time.Duration(parseInt(getEnv("FLUSH_INTERVAL", "1000"))) * time.Millisecond,
+
+		BackpressureThreshold: parseFloat(getEnv("BACKPRESSURE_THRESHOLD", "0.8")),
+
+		WebhookSigningSecret: getEnv("WEBHOOK_SIGNING_SECRET", ""),
+
+		Region:             getEnv("REGION", "local"),
+		ReplicationEnabled: getEnv("REPLICATION_ENABLED", "false") == "true",
+		ReplicationPeers:   parseReplicationPeers(getEnv("REPLICATION_PEERS", "")),
+		ReplicationToken:   getEnv("REPLICATION_TOKEN", ""),
+
+		ArchiveS3Endpoint:  getEnv("ARCHIVE_S3_ENDPOINT", ""),
+		ArchiveS3AccessKey: getEnv("ARCHIVE_S3_ACCESS_KEY", ""),
+		ArchiveS3SecretKey: getEnv("ARCHIVE_S3_SECRET_KEY", ""),
+		ArchiveS3Bucket:    getEnv("ARCHIVE_S3_BUCKET", "event-archive"),
+		ArchiveS3Region:    getEnv("ARCHIVE_S3_REGION", "us-east-1"),
+		ArchiveS3UseSSL:    getEnv("ARCHIVE_S3_USE_SSL", "true") == "true",
+
+		PersonalDataFields: strings.Split(getEnv("PERSONAL_DATA_FIELDS", "email,name,phone,address,ip_address"), ","),
+		PersonalDataKey:    getEnv("PERSONAL_DATA_KEY", ""),
+		ErasureSigningKey:  getEnv("ERASURE_SIGNING_KEY", ""),
 	}
 
 	service, err := NewEventStreamingService(config)
@@ -233,7 +288,7 @@ func NewEventStreamingService(config *Config) (*EventStreamingService, error) {
 	}
 
 	// Auto-migrate tables
-	if err := db.AutoMigrate(&Event{}, &EventStream{}, &EventSubscription{}); err != nil {
+	if err := db.AutoMigrate(&Event{}, &EventStream{}, &EventSubscription{}, &DeliveryAttempt{}, &StreamFunction{}, &EventArchivePartition{}, &SubjectKey{}, &ErasureRequest{}, &StreamQuota{}); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
@@ -277,6 +332,22 @@ func NewEventStreamingService(config *Config) (*EventStreamingService, error) {
 		log.Printf("Warning: Failed to connect to NATS: %v", err)
 	}
 
+	// Initialize event archive
+	archive, err := initEventArchive(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialize personal data protection
+	personalData, err := newPersonalDataVault(config)
+	if err != nil {
+		return nil, err
+	}
+	erasureSigner, err := loadErasureSigner(config.ErasureSigningKey)
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize WebSocket upgrader
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
@@ -295,6 +366,14 @@ func NewEventStreamingService(config *Config) (*EventStreamingService, error) {
 		wsConnections: make(map[string]*websocket.Conn),
 		eventBuffer:   make(chan *Event, config.BatchSize*10),
 		subscribers:   make(map[string][]*EventSubscription),
+		deliveries:    make(chan *Event, config.BatchSize*10),
+		retries:       make(chan *deliveryRetry, dispatchWorkers*deliveryRetryBatchSize),
+		clock:         &hybridClock{},
+		functions:     newFunctionRegistry(),
+		archive:       archive,
+		personalData:  personalData,
+		erasureSigner: erasureSigner,
+		quotas:        newStreamQuotaCache(),
 	}
 
 	service.setupRoutes()
@@ -332,6 +411,21 @@ func (s *EventStreamingService) setupRoutes() {
 		v1.GET("/streams/:id", s.getStream)
 		v1.PUT("/streams/:id", s.updateStream)
 		v1.DELETE("/streams/:id", s.deleteStream)
+		v1.POST("/streams/:id/preview", s.previewStream)
+
+		// Stream quotas
+		v1.GET("/streams/:id/quota", s.getStreamQuota)
+		v1.PUT("/streams/:id/quota", s.setStreamQuota)
+		v1.DELETE("/streams/:id/quota", s.deleteStreamQuota)
+		v1.GET("/quotas", s.listStreamQuotas)
+
+		// Stream functions
+		v1.POST("/streams/:id/functions", s.createStreamFunction)
+		v1.GET("/streams/:id/functions", s.listStreamFunctions)
+		v1.GET("/streams/:id/functions/:function_id", s.getStreamFunction)
+		v1.PUT("/streams/:id/functions/:function_id", s.updateStreamFunction)
+		v1.DELETE("/streams/:id/functions/:function_id", s.deleteStreamFunction)
+		v1.POST("/streams/:id/functions/:function_id/test", s.testStreamFunction)
 
 		// Event subscriptions
 		v1.POST("/subscriptions", s.createSubscription)
@@ -339,6 +433,9 @@ func (s *EventStreamingService) setupRoutes() {
 		v1.GET("/subscriptions/:id", s.getSubscription)
 		v1.PUT("/subscriptions/:id", s.updateSubscription)
 		v1.DELETE("/subscriptions/:id", s.deleteSubscription)
+		v1.POST("/subscriptions/:id/test", s.testSubscription)
+		v1.POST("/subscriptions/:id/preview", s.previewSubscription)
+		v1.GET("/subscriptions/:id/deliveries", s.listDeliveryAttempts)
 
 		// Real-time streaming
 		v1.GET("/stream/:stream_id/ws", s.handleWebSocket)
@@ -348,6 +445,18 @@ func (s *EventStreamingService) setupRoutes() {
 		v1.GET("/analytics/events", s.getEventAnalytics)
 		v1.GET("/analytics/streams", s.getStreamAnalytics)
 		v1.GET("/analytics/performance", s.getPerformanceAnalytics)
+
+		// Multi-region replication
+		v1.POST("/replication/events", s.receiveReplicatedEvents)
+		v1.GET("/replication/events", s.listOrderedEvents)
+		v1.GET("/replication/status", s.getReplicationStatus)
+
+		// Subject erasure
+		v1.POST("/erasures", s.createErasure)
+		v1.GET("/erasures", s.listErasures)
+		v1.GET("/erasures/public-key", s.getErasurePublicKey)
+		v1.GET("/erasures/:id", s.getErasure)
+		v1.GET("/erasures/:id/report", s.getErasureReport)
 	}
 }
 
@@ -357,12 +466,25 @@ func (s *EventStreamingService) Start() error {
 		return fmt.Errorf("failed to load subscriptions: %w", err)
 	}
 
+	// Compile stream functions
+	if err := s.loadStreamFunctions(); err != nil {
+		return fmt.Errorf("failed to load stream functions: %w", err)
+	}
+
+	// Load stream quotas
+	if err := s.loadStreamQuotas(); err != nil {
+		return fmt.Errorf("failed to load stream quotas: %w", err)
+	}
+
 	// Start background workers
 	go s.startEventProcessor()
 	go s.startKafkaConsumer()
 	go s.startEventDispatcher()
 	go s.startMetricsUpdater()
 	go s.startCleanupWorker()
+	go s.startReplicationWorker()
+	go s.resumeErasures()
+	go s.startQuotaRefresher()
 
 	// Start HTTP server
 	s.httpServer = &http.Server{
@@ -391,6 +513,10 @@ func (s *EventStreamingService) Start() error {
 	log.Printf("📊 Health check: http://localhost:%s/health", s.config.Port)
 	log.Printf("📈 Metrics: http://localhost:%s/metrics", s.config.Port)
 	log.Printf("🔄 Kafka brokers: %v", s.config.KafkaBrokers)
+	log.Printf("🌍 Region: %s (replication: %v, peers: %d)", s.config.Region, s.config.ReplicationEnabled, len(s.config.ReplicationPeers))
+	if s.config.ReplicationEnabled && s.config.ReplicationToken == "" {
+		log.Println("⚠️ REPLICATION_TOKEN is not set; replicated events from peers will be refused")
+	}
 
 	if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("failed to start HTTP server: %w", err)
@@ -496,6 +622,8 @@ func (s *EventStreamingService) healthCheck(c *gin.Context) {
 
 // Event ingestion endpoint
 func (s *EventStreamingService) ingestEvent(c *gin.Context) {
+	s.setBackpressureHeaders(c)
+
 	var eventData map[string]interface{}
 	if err := c.ShouldBindJSON(&eventData); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event data"})
@@ -524,10 +652,26 @@ func (s *EventStreamingService) ingestEvent(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := s.protectPersonalData(event); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt personal data"})
+		return
+	}
+
+	s.stampReplicationMetadata(event)
+
+	reserved, denied := s.reserveStreamQuotas([]*Event{event})
+	if denied != nil {
+		s.rejectOverQuota(c, denied)
+		return
+	}
+	s.setQuotaHeaders(c, reserved)
 
 	// Add to buffer for processing
 	select {
 	case s.eventBuffer <- event:
+		s.enqueueReplication(event)
+		s.queueDelivery(event)
+
 		// Update metrics
 		eventsIngested.WithLabelValues(event.Type, event.Source, event.Priority).Inc()
 		eventBufferSize.Set(float64(len(s.eventBuffer)))
@@ -537,6 +681,8 @@ func (s *EventStreamingService) ingestEvent(c *gin.Context) {
 			"status":   "accepted",
 		})
 	default:
+		s.releaseStreamQuotas(reserved)
+		c.Header("Retry-After", "1")
 		c.JSON(http.StatusServiceUnavailable, gin.H{
 			"error": "Event buffer full, please try again later",
 		})
@@ -545,6 +691,8 @@ func (s *EventStreamingService) ingestEvent(c *gin.Context) {
 
 // Batch event ingestion
 func (s *EventStreamingService) ingestBatchEvents(c *gin.Context) {
+	s.setBackpressureHeaders(c)
+
 	var batchData struct {
 		Events []map[string]interface{} `json:"events"`
 	}
@@ -596,22 +744,38 @@ func (s *EventStreamingService) ingestBatchEvents(c *gin.Context) {
 			})
 			return
 		}
+		if err := s.protectPersonalData(event); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encrypt personal data"})
+			return
+		}
 
+		s.stampReplicationMetadata(event)
 		events = append(events, event)
 		eventIDs = append(eventIDs, event.ID)
 	}
 
+	reserved, denied := s.reserveStreamQuotas(events)
+	if denied != nil {
+		s.rejectOverQuota(c, denied)
+		return
+	}
+	s.setQuotaHeaders(c, reserved)
+
 	// Add events to buffer
 	accepted := 0
+	var dropped []*Event
 	for _, event := range events {
 		select {
 		case s.eventBuffer <- event:
 			accepted++
 			eventsIngested.WithLabelValues(event.Type, event.Source, event.Priority).Inc()
+			s.enqueueReplication(event)
+			s.queueDelivery(event)
 		default:
-			break
+			dropped = append(dropped, event)
 		}
 	}
+	s.releaseEvents(dropped)
 
 	eventBufferSize.Set(float64(len(s.eventBuffer)))
 
@@ -722,6 +886,13 @@ func parseInt64(s string) int64 {
 	return 0
 }
 
+func parseFloat(s string) float64 {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return 0
+}
+
 func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
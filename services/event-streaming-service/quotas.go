@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Stream storage quotas and producer backpressure.
+//
+// A stream with a StreamQuota has the events matching it counted at ingest,
+// by number and encoded size, in one Redis hash per UTC day. Usage is the
+// sum of the days still within RetentionPeriod, so it falls as old events
+// leave the store; the oldest day counts whole until it is out of the
+// window. An event that would take a stream past MaxEvents or MaxBytes is
+// rejected with 429, and a batch is rejected whole. X-Quota-* headers
+// describe the stream closest to its limits. A quota with no limits only
+// measures. Counting starts when the quota is set.
+//
+// Every ingest response carries X-Backpressure, the fill ratio of the
+// ingest buffer; at BACKPRESSURE_THRESHOLD and above X-Backpressure-Hint
+// asks producers to slow down before the buffer fills and requests fail
+// with 503.
+//
+// When Redis is unavailable quotas are not enforced.
+
+const (
+	quotaRefreshInterval = 30 * time.Second
+	quotaUsageKeyPrefix  = "stream_usage:"
+)
+
+// StreamQuota limits what a stream may hold
+type StreamQuota struct {
+	StreamID  string    `json:"stream_id" gorm:"primaryKey"`
+	MaxEvents int64     `json:"max_events"` // 0: unlimited
+	MaxBytes  int64     `json:"max_bytes"`  // 0: unlimited
+	UpdatedBy string    `json:"updated_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var (
+	quotaRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "stream_quota_rejections_total",
+			Help: "Ingest requests rejected for taking a stream past its quota",
+		},
+		[]string{"stream", "limit"},
+	)
+
+	quotaUsageRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "stream_quota_usage_ratio",
+			Help: "Share of a stream's quota in use",
+		},
+		[]string{"stream", "limit"},
+	)
+
+	eventBufferFillRatio = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "event_buffer_fill_ratio",
+			Help: "Share of the ingest buffer in use",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(quotaRejections)
+	prometheus.MustRegister(quotaUsageRatio)
+	prometheus.MustRegister(eventBufferFillRatio)
+}
+
+// Sums a stream's usage over KEYS, the day buckets in the window with
+// today's last, and counts ARGV[3] events of ARGV[4] bytes against today
+// when that stays within ARGV[1] events and ARGV[2] bytes (0 for no limit).
+// ARGV[5] is the TTL of today's bucket, 0 for none. Returns {allowed,
+// events, bytes}, usage including the new events when allowed.
+var streamQuotaScript = redis.NewScript(`
+local events, bytes = 0, 0
+for i = 1, #KEYS do
+  local values = redis.call('HMGET', KEYS[i], 'events', 'bytes')
+  events = events + (tonumber(values[1]) or 0)
+  bytes = bytes + (tonumber(values[2]) or 0)
+end
+local max_events, max_bytes = tonumber(ARGV[1]), tonumber(ARGV[2])
+local add_events, add_bytes = tonumber(ARGV[3]), tonumber(ARGV[4])
+if (max_events > 0 and events + add_events > max_events) or (max_bytes > 0 and bytes + add_bytes > max_bytes) then
+  return {0, events, bytes}
+end
+local today = KEYS[#KEYS]
+redis.call('HINCRBY', today, 'events', add_events)
+redis.call('HINCRBY', today, 'bytes', add_bytes)
+local ttl = tonumber(ARGV[5])
+if ttl > 0 then
+  redis.call('EXPIRE', today, ttl)
+end
+return {1, events + add_events, bytes + add_bytes}
+`)
+
+// quotaStream is an active stream with a quota
+type quotaStream struct {
+	stream EventStream
+	quota  StreamQuota
+}
+
+type streamQuotaCache struct {
+	mu      sync.RWMutex
+	streams []quotaStream
+}
+
+func newStreamQuotaCache() *streamQuotaCache {
+	return &streamQuotaCache{}
+}
+
+func (q *streamQuotaCache) all() []quotaStream {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.streams
+}
+
+func (q *streamQuotaCache) replace(streams []quotaStream) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.streams = streams
+}
+
+// quotaCharge is what a set of events counts against one stream
+type quotaCharge struct {
+	entry  quotaStream
+	events int64
+	bytes  int64
+
+	// Usage after the charge, or at the time of a rejection
+	usedEvents int64
+	usedBytes  int64
+}
+
+// ratio is how close the stream is to its tightest limit
+func (q *quotaCharge) ratio() float64 {
+	ratio := 0.0
+	if q.entry.quota.MaxEvents > 0 {
+		ratio = float64(q.usedEvents) / float64(q.entry.quota.MaxEvents)
+	}
+	if q.entry.quota.MaxBytes > 0 {
+		if r := float64(q.usedBytes) / float64(q.entry.quota.MaxBytes); r > ratio {
+			ratio = r
+		}
+	}
+	return ratio
+}
+
+// usageKeys are a stream's day buckets in the retention window, oldest
+// first, or its single bucket when events are kept forever
+func (s *EventStreamingService) usageKeys(streamID string, now time.Time) []string {
+	prefix := quotaUsageKeyPrefix + "{" + streamID + "}:"
+	if s.config.RetentionPeriod <= 0 {
+		return []string{prefix + "all"}
+	}
+	today := now.UTC().Truncate(24 * time.Hour)
+	var keys []string
+	for day := s.retentionCutoff().Truncate(24 * time.Hour); !day.After(today); day = day.Add(24 * time.Hour) {
+		keys = append(keys, prefix+day.Format("2006-01-02"))
+	}
+	return keys
+}
+
+// usageTTL keeps a day bucket until its day has left the window
+func (s *EventStreamingService) usageTTL() time.Duration {
+	if s.config.RetentionPeriod <= 0 {
+		return 0
+	}
+	return s.config.RetentionPeriod + 48*time.Hour
+}
+
+// quotaReset is when the oldest day leaves the window and frees its usage
+func (s *EventStreamingService) quotaReset(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+func eventSize(event *Event) int64 {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return 0
+	}
+	return int64(len(payload))
+}
+
+// chargesFor totals the events matching each stream with a quota
+func (s *EventStreamingService) chargesFor(events []*Event) []*quotaCharge {
+	var charges []*quotaCharge
+	streams := s.quotas.all()
+	if len(streams) == 0 {
+		return nil
+	}
+	sizes := make([]int64, len(events))
+	for i, event := range events {
+		sizes[i] = eventSize(event)
+	}
+	for _, entry := range streams {
+		charge := &quotaCharge{entry: entry}
+		for i, event := range events {
+			if eventMatches(event, entry.stream.EventTypes, entry.stream.Filters) {
+				charge.events++
+				charge.bytes += sizes[i]
+			}
+		}
+		if charge.events > 0 {
+			charges = append(charges, charge)
+		}
+	}
+	return charges
+}
+
+// reserveStreamQuotas counts events against the quotas of the streams they
+// match. When one stream would go over, nothing is counted and that
+// stream's charge is returned as denied.
+func (s *EventStreamingService) reserveStreamQuotas(events []*Event) (reserved []*quotaCharge, denied *quotaCharge) {
+	ctx := context.Background()
+	now := time.Now()
+	ttl := int64(s.usageTTL() / time.Second)
+
+	for _, charge := range s.chargesFor(events) {
+		quota := charge.entry.quota
+		result, err := streamQuotaScript.Run(ctx, s.redis, s.usageKeys(quota.StreamID, now),
+			quota.MaxEvents, quota.MaxBytes, charge.events, charge.bytes, ttl).Int64Slice()
+		if err != nil {
+			log.Printf("Quota check failed for stream %s: %v", quota.StreamID, err)
+			continue
+		}
+		charge.usedEvents, charge.usedBytes = result[1], result[2]
+		if result[0] == 0 {
+			s.releaseStreamQuotas(reserved)
+			return nil, charge
+		}
+		reserved = append(reserved, charge)
+	}
+	return reserved, nil
+}
+
+// releaseStreamQuotas takes back charges for events that were not accepted
+func (s *EventStreamingService) releaseStreamQuotas(charges []*quotaCharge) {
+	ctx := context.Background()
+	now := time.Now()
+	for _, charge := range charges {
+		keys := s.usageKeys(charge.entry.quota.StreamID, now)
+		today := keys[len(keys)-1]
+		pipe := s.redis.TxPipeline()
+		pipe.HIncrBy(ctx, today, "events", -charge.events)
+		pipe.HIncrBy(ctx, today, "bytes", -charge.bytes)
+		if _, err := pipe.Exec(ctx); err != nil {
+			log.Printf("Failed to release quota of stream %s: %v", charge.entry.quota.StreamID, err)
+		}
+	}
+}
+
+// releaseEvents takes back the charges of events dropped after reservation
+func (s *EventStreamingService) releaseEvents(events []*Event) {
+	if len(events) == 0 {
+		return
+	}
+	s.releaseStreamQuotas(s.chargesFor(events))
+}
+
+// setQuotaHeaders describes the stream closest to its limits
+func (s *EventStreamingService) setQuotaHeaders(c *gin.Context, charges []*quotaCharge) {
+	var tightest *quotaCharge
+	for _, charge := range charges {
+		if tightest == nil || charge.ratio() > tightest.ratio() {
+			tightest = charge
+		}
+	}
+	if tightest == nil {
+		return
+	}
+	quota := tightest.entry.quota
+	c.Header("X-Quota-Stream", tightest.entry.stream.Name)
+	if quota.MaxEvents > 0 {
+		c.Header("X-Quota-Limit-Events", strconv.FormatInt(quota.MaxEvents, 10))
+		c.Header("X-Quota-Remaining-Events", strconv.FormatInt(max64(quota.MaxEvents-tightest.usedEvents, 0), 10))
+	}
+	if quota.MaxBytes > 0 {
+		c.Header("X-Quota-Limit-Bytes", strconv.FormatInt(quota.MaxBytes, 10))
+		c.Header("X-Quota-Remaining-Bytes", strconv.FormatInt(max64(quota.MaxBytes-tightest.usedBytes, 0), 10))
+	}
+}
+
+// rejectOverQuota answers a request that would take a stream past its quota
+func (s *EventStreamingService) rejectOverQuota(c *gin.Context, denied *quotaCharge) {
+	quota := denied.entry.quota
+	limit := "events"
+	if quota.MaxBytes > 0 && denied.usedBytes+denied.bytes > quota.MaxBytes {
+		limit = "bytes"
+	}
+	quotaRejections.WithLabelValues(denied.entry.stream.Name, limit).Inc()
+
+	s.setQuotaHeaders(c, []*quotaCharge{denied})
+	response := gin.H{
+		"error":       "Stream quota exceeded",
+		"stream_id":   quota.StreamID,
+		"stream":      denied.entry.stream.Name,
+		"limit":       limit,
+		"max_events":  quota.MaxEvents,
+		"max_bytes":   quota.MaxBytes,
+		"used_events": denied.usedEvents,
+		"used_bytes":  denied.usedBytes,
+	}
+	if s.config.RetentionPeriod > 0 {
+		now := time.Now()
+		reset := s.quotaReset(now)
+		c.Header("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+		response["retry_at"] = reset
+	}
+	c.JSON(http.StatusTooManyRequests, response)
+}
+
+// setBackpressureHeaders tells producers how full the ingest buffer is
+func (s *EventStreamingService) setBackpressureHeaders(c *gin.Context) float64 {
+	ratio := 0.0
+	if capacity := cap(s.eventBuffer); capacity > 0 {
+		ratio = float64(len(s.eventBuffer)) / float64(capacity)
+	}
+	eventBufferFillRatio.Set(ratio)
+	c.Header("X-Backpressure", strconv.FormatFloat(ratio, 'f', 3, 64))
+	if ratio >= s.config.BackpressureThreshold {
+		c.Header("X-Backpressure-Hint", "slow-down")
+	}
+	return ratio
+}
+
+// Quota cache
+
+func (s *EventStreamingService) loadStreamQuotas() error {
+	var quotas []StreamQuota
+	if err := s.db.Find(&quotas).Error; err != nil {
+		return err
+	}
+	if len(quotas) == 0 {
+		s.quotas.replace(nil)
+		return nil
+	}
+	ids := make([]string, len(quotas))
+	for i, quota := range quotas {
+		ids[i] = quota.StreamID
+	}
+	var streams []EventStream
+	if err := s.db.Where("id IN ? AND is_active = true", ids).Find(&streams).Error; err != nil {
+		return err
+	}
+	byID := make(map[string]EventStream, len(streams))
+	for _, stream := range streams {
+		byID[stream.ID] = stream
+	}
+
+	var entries []quotaStream
+	for _, quota := range quotas {
+		if stream, ok := byID[quota.StreamID]; ok {
+			entries = append(entries, quotaStream{stream: stream, quota: quota})
+		}
+	}
+	s.quotas.replace(entries)
+	return nil
+}
+
+// startQuotaRefresher picks up quota and stream changes made elsewhere and
+// publishes usage
+func (s *EventStreamingService) startQuotaRefresher() {
+	ticker := time.NewTicker(quotaRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.loadStreamQuotas(); err != nil {
+				log.Printf("Failed to load stream quotas: %v", err)
+				continue
+			}
+			for _, entry := range s.quotas.all() {
+				events, bytes, err := s.streamUsage(entry.quota.StreamID)
+				if err != nil {
+					continue
+				}
+				if entry.quota.MaxEvents > 0 {
+					quotaUsageRatio.WithLabelValues(entry.stream.Name, "events").Set(float64(events) / float64(entry.quota.MaxEvents))
+				}
+				if entry.quota.MaxBytes > 0 {
+					quotaUsageRatio.WithLabelValues(entry.stream.Name, "bytes").Set(float64(bytes) / float64(entry.quota.MaxBytes))
+				}
+			}
+		}
+	}
+}
+
+// streamUsage sums a stream's day buckets in the window
+func (s *EventStreamingService) streamUsage(streamID string) (int64, int64, error) {
+	ctx := context.Background()
+	keys := s.usageKeys(streamID, time.Now())
+	pipe := s.redis.Pipeline()
+	commands := make([]*redis.SliceCmd, len(keys))
+	for i, key := range keys {
+		commands[i] = pipe.HMGet(ctx, key, "events", "bytes")
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return 0, 0, err
+	}
+
+	var events, bytes int64
+	for _, command := range commands {
+		values, err := command.Result()
+		if err != nil || len(values) != 2 {
+			continue
+		}
+		events += redisInt(values[0])
+		bytes += redisInt(values[1])
+	}
+	return events, bytes, nil
+}
+
+func redisInt(value interface{}) int64 {
+	text, ok := value.(string)
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.ParseInt(text, 10, 64)
+	return n
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Handlers
+
+func (s *EventStreamingService) quotaView(stream EventStream, quota StreamQuota) (gin.H, error) {
+	events, bytes, err := s.streamUsage(stream.ID)
+	if err != nil {
+		return nil, err
+	}
+	usage := gin.H{"events": events, "bytes": bytes}
+	if quota.MaxEvents > 0 {
+		usage["events_ratio"] = float64(events) / float64(quota.MaxEvents)
+	}
+	if quota.MaxBytes > 0 {
+		usage["bytes_ratio"] = float64(bytes) / float64(quota.MaxBytes)
+	}
+	view := gin.H{
+		"stream_id":   stream.ID,
+		"stream":      stream.Name,
+		"quota":       quota,
+		"usage":       usage,
+		"window_days": int(s.config.RetentionPeriod / (24 * time.Hour)),
+	}
+	if s.config.RetentionPeriod > 0 {
+		view["next_release_at"] = s.quotaReset(time.Now())
+	}
+	return view, nil
+}
+
+// Get a stream's quota and usage
+func (s *EventStreamingService) getStreamQuota(c *gin.Context) {
+	var stream EventStream
+	if err := s.db.First(&stream, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+	var quota StreamQuota
+	if err := s.db.First(&quota, "stream_id = ?", stream.ID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Stream has no quota"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch quota"})
+		return
+	}
+
+	view, err := s.quotaView(stream, quota)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to read quota usage"})
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// Set a stream's quota
+func (s *EventStreamingService) setStreamQuota(c *gin.Context) {
+	var stream EventStream
+	if err := s.db.First(&stream, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	var request struct {
+		MaxEvents int64 `json:"max_events" binding:"min=0"`
+		MaxBytes  int64 `json:"max_bytes" binding:"min=0"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now().UTC()
+	quota := StreamQuota{StreamID: stream.ID, CreatedAt: now}
+	if err := s.db.First(&quota, "stream_id = ?", stream.ID).Error; err != nil && err != gorm.ErrRecordNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch quota"})
+		return
+	}
+	quota.MaxEvents = request.MaxEvents
+	quota.MaxBytes = request.MaxBytes
+	quota.UpdatedBy = c.GetHeader("X-User-ID")
+	quota.UpdatedAt = now
+	if err := s.db.Save(&quota).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save quota"})
+		return
+	}
+	if err := s.loadStreamQuotas(); err != nil {
+		log.Printf("Failed to load stream quotas: %v", err)
+	}
+
+	view, err := s.quotaView(stream, quota)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"stream_id": stream.ID, "stream": stream.Name, "quota": quota})
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// Remove a stream's quota; its usage stops being counted
+func (s *EventStreamingService) deleteStreamQuota(c *gin.Context) {
+	result := s.db.Delete(&StreamQuota{}, "stream_id = ?", c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete quota"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream has no quota"})
+		return
+	}
+	if err := s.loadStreamQuotas(); err != nil {
+		log.Printf("Failed to load stream quotas: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := s.redis.Del(ctx, s.usageKeys(c.Param("id"), time.Now())...).Err(); err != nil {
+		log.Printf("Failed to clear usage of stream %s: %v", c.Param("id"), err)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Quota deleted"})
+}
+
+// List the quotas of active streams with their usage
+func (s *EventStreamingService) listStreamQuotas(c *gin.Context) {
+	entries := s.quotas.all()
+	views := make([]gin.H, 0, len(entries))
+	for _, entry := range entries {
+		view, err := s.quotaView(entry.stream, entry.quota)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("Failed to read usage of stream %s", entry.stream.Name)})
+			return
+		}
+		views = append(views, view)
+	}
+	c.JSON(http.StatusOK, gin.H{"quotas": views, "count": len(views)})
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Multi-region replication
+//
+// Every event ingested locally is stamped with its origin region and a hybrid
+// logical clock (HLC) timestamp. Events are forwarded to peer regions through
+// a Redis-backed outbox; a locally ingested event gets its per-region
+// sequence number as it is queued, so only events the buffer accepted are
+// numbered and peers can read a gap in the sequence as lost events. Ordering by
+// (hlc, origin_region, origin_sequence) gives every region the same total
+// order without coordination, and the replicated_via list prevents loops.
+// Inbound batches are only accepted with replication enabled and a shared
+// REPLICATION_TOKEN configured.
+
+// Replication metadata keys
+const (
+	MetaOriginRegion   = "origin_region"
+	MetaOriginSequence = "origin_sequence"
+	MetaHLC            = "hlc"
+	MetaReplicatedVia  = "replicated_via"
+)
+
+const (
+	replicationRegionHeader = "X-Replication-Region"
+	replicationTokenHeader  = "X-Replication-Token"
+	replicationBatchSize    = 500
+)
+
+// ReplicationPeer is a remote event-streaming cluster in another region
+type ReplicationPeer struct {
+	Region string `json:"region"`
+	URL    string `json:"url"`
+}
+
+var (
+	eventsReplicated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "events_replicated_total",
+			Help: "Total number of events forwarded to peer regions",
+		},
+		[]string{"peer", "status"},
+	)
+
+	replicationEventsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "replication_events_dropped_total",
+			Help: "Total number of inbound replicated events dropped",
+		},
+		[]string{"reason"},
+	)
+
+	replicationOutboxSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "replication_outbox_size",
+			Help: "Number of events waiting to be forwarded to a peer region",
+		},
+		[]string{"peer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(eventsReplicated)
+	prometheus.MustRegister(replicationEventsDropped)
+	prometheus.MustRegister(replicationOutboxSize)
+}
+
+// hybridClock is a hybrid logical clock: physical milliseconds plus a logical
+// counter that breaks ties and absorbs clock skew between regions.
+type hybridClock struct {
+	mu       sync.Mutex
+	physical int64
+	logical  int64
+}
+
+// Tick advances the clock for a local event
+func (h *hybridClock) Tick() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	if now > h.physical {
+		h.physical, h.logical = now, 0
+	} else {
+		h.logical++
+	}
+	return formatHLC(h.physical, h.logical)
+}
+
+// Observe merges a remote timestamp so later local events sort after it
+func (h *hybridClock) Observe(remote string) {
+	physical, logical, ok := parseHLC(remote)
+	if !ok {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	switch {
+	case now > h.physical && now > physical:
+		h.physical, h.logical = now, 0
+	case physical > h.physical:
+		h.physical, h.logical = physical, logical+1
+	case physical == h.physical:
+		if logical > h.logical {
+			h.logical = logical
+		}
+		h.logical++
+	default:
+		h.logical++
+	}
+}
+
+// Fixed-width encoding so HLC timestamps compare lexically
+func formatHLC(physical, logical int64) string {
+	return fmt.Sprintf("%015d.%06d", physical, logical)
+}
+
+func parseHLC(value string) (int64, int64, bool) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	physical, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	logical, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return physical, logical, true
+}
+
+// Parse REPLICATION_PEERS ("region=url,region=url")
+func parseReplicationPeers(value string) []ReplicationPeer {
+	var peers []ReplicationPeer
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		peers = append(peers, ReplicationPeer{
+			Region: parts[0],
+			URL:    strings.TrimRight(parts[1], "/"),
+		})
+	}
+	return peers
+}
+
+// Stamp a locally ingested event with its origin ordering metadata
+func (s *EventStreamingService) stampReplicationMetadata(event *Event) {
+	if event.Metadata == nil {
+		event.Metadata = make(map[string]interface{})
+	}
+
+	event.Metadata[MetaOriginRegion] = s.config.Region
+	event.Metadata[MetaHLC] = s.clock.Tick()
+	event.Metadata[MetaReplicatedVia] = []string{s.config.Region}
+}
+
+// Queue an event for every peer that has not seen it yet
+func (s *EventStreamingService) enqueueReplication(event *Event) {
+	if !s.config.ReplicationEnabled || len(s.config.ReplicationPeers) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	seen := replicatedVia(event)
+
+	// The buffer may already be handing the event on, so the sequence goes
+	// on the copy sent to peers
+	outgoing := event
+	if _, numbered := event.Metadata[MetaOriginSequence]; !numbered && getString(event.Metadata, MetaOriginRegion, "") == s.config.Region {
+		// Unnumbered when the sequence can't be allocated; peers skip gap
+		// tracking for it
+		if sequence, err := s.redis.Incr(ctx, "replication:seq:"+s.config.Region).Result(); err == nil {
+			numberedEvent := *event
+			numberedEvent.Metadata = make(map[string]interface{}, len(event.Metadata)+1)
+			for key, value := range event.Metadata {
+				numberedEvent.Metadata[key] = value
+			}
+			numberedEvent.Metadata[MetaOriginSequence] = sequence
+			outgoing = &numberedEvent
+		} else {
+			log.Printf("Replication: failed to allocate sequence for event %s: %v", event.ID, err)
+		}
+	}
+
+	payload, err := json.Marshal(outgoing)
+	if err != nil {
+		log.Printf("Replication: failed to encode event %s: %v", event.ID, err)
+		return
+	}
+
+	for _, peer := range s.config.ReplicationPeers {
+		if seen[peer.Region] {
+			continue
+		}
+		if err := s.redis.RPush(ctx, replicationOutboxKey(peer.Region), payload).Err(); err != nil {
+			log.Printf("Replication: failed to queue event %s for %s: %v", event.ID, peer.Region, err)
+		}
+	}
+}
+
+// Receive a batch of events replicated from a peer region
+func (s *EventStreamingService) receiveReplicatedEvents(c *gin.Context) {
+	// Peers must share a token; without one the endpoint is closed
+	if !s.config.ReplicationEnabled || s.config.ReplicationToken == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Replication is not enabled"})
+		return
+	}
+	token := c.GetHeader(replicationTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.config.ReplicationToken)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid replication token"})
+		return
+	}
+
+	var batch struct {
+		Events []*Event `json:"events"`
+	}
+	if err := c.ShouldBindJSON(&batch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid replication batch"})
+		return
+	}
+
+	ctx := context.Background()
+	accepted, duplicates, looped := 0, 0, 0
+	for _, event := range batch.Events {
+		origin := getString(event.Metadata, MetaOriginRegion, "")
+		if origin == "" || event.ID == "" {
+			replicationEventsDropped.WithLabelValues("missing_metadata").Inc()
+			continue
+		}
+
+		// Loop prevention: never re-ingest our own events or ones already routed through us
+		if origin == s.config.Region || replicatedVia(event)[s.config.Region] {
+			looped++
+			replicationEventsDropped.WithLabelValues("loop").Inc()
+			continue
+		}
+
+		// Idempotency: the same event may arrive through several peers
+		fresh, err := s.redis.SetNX(ctx, "replication:seen:"+event.ID, origin, s.config.RetentionPeriod).Result()
+		if err != nil || !fresh {
+			duplicates++
+			replicationEventsDropped.WithLabelValues("duplicate").Inc()
+			continue
+		}
+
+		s.clock.Observe(getString(event.Metadata, MetaHLC, ""))
+		event.Metadata[MetaReplicatedVia] = append(replicatedViaList(event), s.config.Region)
+		s.trackOriginSequence(ctx, origin, event.Metadata[MetaOriginSequence])
+
+		select {
+		case s.eventBuffer <- event:
+			accepted++
+			eventsIngested.WithLabelValues(event.Type, event.Source, event.Priority).Inc()
+			s.enqueueReplication(event)
+			s.queueDelivery(event)
+		default:
+			// Let the peer retry the event later
+			s.redis.Del(ctx, "replication:seen:"+event.ID)
+		}
+	}
+
+	eventBufferSize.Set(float64(len(s.eventBuffer)))
+
+	status := http.StatusAccepted
+	if accepted+duplicates+looped < len(batch.Events) {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{
+		"region":     s.config.Region,
+		"received":   len(batch.Events),
+		"accepted":   accepted,
+		"duplicates": duplicates,
+		"looped":     looped,
+	})
+}
+
+// Return events in the region-independent total order
+func (s *EventStreamingService) listOrderedEvents(c *gin.Context) {
+	limit := parseInt(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	query := s.db.Model(&Event{}).Where("metadata->>? IS NOT NULL", MetaHLC)
+	if since := c.Query("since_hlc"); since != "" {
+		query = query.Where("metadata->>? > ?", MetaHLC, since)
+	}
+	if origin := c.Query("origin_region"); origin != "" {
+		query = query.Where("metadata->>? = ?", MetaOriginRegion, origin)
+	}
+
+	var events []Event
+	err := query.
+		Order("metadata->>'hlc', metadata->>'origin_region', (metadata->>'origin_sequence')::bigint").
+		Limit(limit).
+		Find(&events).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query events"})
+		return
+	}
+
+	nextCursor := c.Query("since_hlc")
+	if len(events) > 0 {
+		nextCursor = getString(events[len(events)-1].Metadata, MetaHLC, nextCursor)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events":      events,
+		"count":       len(events),
+		"next_cursor": nextCursor,
+	})
+}
+
+// Replication status for this region
+func (s *EventStreamingService) getReplicationStatus(c *gin.Context) {
+	ctx := context.Background()
+
+	peers := make([]gin.H, 0, len(s.config.ReplicationPeers))
+	for _, peer := range s.config.ReplicationPeers {
+		depth, _ := s.redis.LLen(ctx, replicationOutboxKey(peer.Region)).Result()
+		lastSuccess, _ := s.redis.Get(ctx, "replication:last_success:"+peer.Region).Result()
+		peers = append(peers, gin.H{
+			"region":          peer.Region,
+			"url":             peer.URL,
+			"outbox_size":     depth,
+			"last_success_at": lastSuccess,
+		})
+	}
+
+	origins, _ := s.redis.HGetAll(ctx, "replication:origin_sequences").Result()
+	gaps, _ := s.redis.HGetAll(ctx, "replication:origin_gaps").Result()
+
+	c.JSON(http.StatusOK, gin.H{
+		"region":           s.config.Region,
+		"enabled":          s.config.ReplicationEnabled,
+		"peers":            peers,
+		"origin_sequences": origins,
+		"sequence_gaps":    gaps,
+	})
+}
+
+// Forward queued events to peer regions
+func (s *EventStreamingService) startReplicationWorker() {
+	if !s.config.ReplicationEnabled || len(s.config.ReplicationPeers) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, peer := range s.config.ReplicationPeers {
+				s.flushReplicationOutbox(peer)
+			}
+		}
+	}
+}
+
+func (s *EventStreamingService) flushReplicationOutbox(peer ReplicationPeer) {
+	ctx := context.Background()
+	key := replicationOutboxKey(peer.Region)
+
+	items, err := s.redis.LRange(ctx, key, 0, replicationBatchSize-1).Result()
+	if err != nil || len(items) == 0 {
+		replicationOutboxSize.WithLabelValues(peer.Region).Set(0)
+		return
+	}
+
+	events := make([]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		events = append(events, json.RawMessage(item))
+	}
+	payload, _ := json.Marshal(map[string]interface{}{"events": events})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer.URL+"/v1/replication/events", bytes.NewReader(payload))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(replicationRegionHeader, s.config.Region)
+	if s.config.ReplicationToken != "" {
+		req.Header.Set(replicationTokenHeader, s.config.ReplicationToken)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Replication: failed to reach %s: %v", peer.Region, err)
+		eventsReplicated.WithLabelValues(peer.Region, "error").Add(float64(len(items)))
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		log.Printf("Replication: %s rejected batch with status %d", peer.Region, resp.StatusCode)
+		eventsReplicated.WithLabelValues(peer.Region, "error").Add(float64(len(items)))
+		return
+	}
+
+	// Delivered in order; drop the batch from the head of the outbox
+	s.redis.LTrim(ctx, key, int64(len(items)), -1)
+	s.redis.Set(ctx, "replication:last_success:"+peer.Region, time.Now().UTC().Format(time.RFC3339), 0)
+	eventsReplicated.WithLabelValues(peer.Region, "success").Add(float64(len(items)))
+
+	depth, _ := s.redis.LLen(ctx, key).Result()
+	replicationOutboxSize.WithLabelValues(peer.Region).Set(float64(depth))
+}
+
+// Record the highest sequence seen per origin region and flag gaps
+func (s *EventStreamingService) trackOriginSequence(ctx context.Context, origin string, value interface{}) {
+	var sequence int64
+	switch v := value.(type) {
+	case float64:
+		sequence = int64(v)
+	case int64:
+		sequence = v
+	case json.Number:
+		sequence, _ = v.Int64()
+	default:
+		return
+	}
+
+	last, err := s.redis.HGet(ctx, "replication:origin_sequences", origin).Int64()
+	if err == nil && sequence > last+1 {
+		s.redis.HSet(ctx, "replication:origin_gaps", origin, fmt.Sprintf("%d-%d", last+1, sequence-1))
+	}
+	if err != nil || sequence > last {
+		s.redis.HSet(ctx, "replication:origin_sequences", origin, sequence)
+	}
+}
+
+func replicationOutboxKey(region string) string {
+	return "replication:outbox:" + region
+}
+
+func replicatedViaList(event *Event) []string {
+	var regions []string
+	switch via := event.Metadata[MetaReplicatedVia].(type) {
+	case []string:
+		regions = append(regions, via...)
+	case []interface{}:
+		for _, region := range via {
+			if r, ok := region.(string); ok {
+				regions = append(regions, r)
+			}
+		}
+	}
+	return regions
+}
+
+func replicatedVia(event *Event) map[string]bool {
+	seen := make(map[string]bool)
+	for _, region := range replicatedViaList(event) {
+		seen[region] = true
+	}
+	if origin := getString(event.Metadata, MetaOriginRegion, ""); origin != "" {
+		seen[origin] = true
+	}
+	return seen
+}
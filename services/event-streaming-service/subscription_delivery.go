@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
+)
+
+// Subscription delivery. Every accepted event is queued for the dispatcher,
+// which posts it to the webhook of each active subscription whose stream and
+// filters match, as the stream's functions leave it. A failed delivery is
+// retried per the subscription's retry_policy (max_attempts, backoff_ms,
+// doubling each time) and every attempt is recorded as a DeliveryAttempt,
+// so delivery history covers real deliveries as well as tests. Retries wait
+// in the Redis sorted set deliveryRetryKey, scored by when they are due,
+// rather than in a worker, so a failing webhook does not hold up delivery
+// to the others.
+
+const (
+	dispatchWorkers            = 8
+	subscriptionReloadInterval = 30 * time.Second
+	defaultDeliveryAttempts    = 3
+	defaultDeliveryBackoff     = 500 * time.Millisecond
+	maxDeliveryAttempts        = 10
+
+	deliveryRetryKey       = "subscription_delivery_retries"
+	deliveryRetryPoll      = time.Second
+	deliveryRetryBatchSize = 100
+)
+
+// deliveryRetry is a failed delivery waiting in deliveryRetryKey
+type deliveryRetry struct {
+	SubscriptionID string `json:"subscription_id"`
+	Event          *Event `json:"event"`
+	Attempts       int    `json:"attempts"` // made so far
+}
+
+// loadSubscriptions indexes the active webhook subscriptions by stream
+func (s *EventStreamingService) loadSubscriptions() error {
+	var subscriptions []EventSubscription
+	if err := s.db.Preload("Stream").
+		Where("is_active = ? AND webhook_url <> ''", true).
+		Find(&subscriptions).Error; err != nil {
+		return err
+	}
+
+	byStream := make(map[string][]*EventSubscription)
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		byStream[subscription.StreamID] = append(byStream[subscription.StreamID], subscription)
+	}
+
+	s.subscribersMu.Lock()
+	s.subscribers = byStream
+	s.subscribersMu.Unlock()
+	activeSubscriptions.Set(float64(len(subscriptions)))
+	return nil
+}
+
+// queueDelivery hands an accepted event to the dispatcher. A full queue
+// drops the delivery rather than hold up ingestion.
+func (s *EventStreamingService) queueDelivery(event *Event) {
+	select {
+	case s.deliveries <- event:
+	default:
+		log.Printf("Delivery queue full, event %s not delivered to subscriptions", event.ID)
+	}
+}
+
+func (s *EventStreamingService) startEventDispatcher() {
+	for i := 0; i < dispatchWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case event := <-s.deliveries:
+					s.dispatchEvent(event)
+				case retry := <-s.retries:
+					s.retryDelivery(retry)
+				}
+			}
+		}()
+	}
+	go s.startDeliveryRetryPoller()
+
+	ticker := time.NewTicker(subscriptionReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.loadSubscriptions(); err != nil {
+			log.Printf("Failed to reload subscriptions: %v", err)
+		}
+	}
+}
+
+// dispatchEvent delivers an event to every subscription that matches it
+func (s *EventStreamingService) dispatchEvent(event *Event) {
+	s.subscribersMu.RLock()
+	byStream := s.subscribers
+	s.subscribersMu.RUnlock()
+
+	for streamID, subscriptions := range byStream {
+		delivered := event
+		if streamID != "" {
+			stream := subscriptions[0].Stream
+			if !stream.IsActive || !eventMatches(event, stream.EventTypes, stream.Filters) {
+				continue
+			}
+			var ok bool
+			if delivered, ok = s.applyStreamFunctions(streamID, event); !ok {
+				continue
+			}
+		}
+		for _, subscription := range subscriptions {
+			if eventMatches(delivered, subscription.EventTypes, subscription.Filters) {
+				s.deliver(subscription, delivered, 0)
+			}
+		}
+	}
+}
+
+// deliver makes one delivery attempt. A failure with attempts left is
+// scheduled for retry; otherwise the subscription's counters are updated.
+func (s *EventStreamingService) deliver(subscription *EventSubscription, event *Event, previous int) {
+	attempts, backoff := retryPolicy(subscription.RetryPolicy)
+
+	attempt := s.deliverToWebhook(subscription, event, false)
+	made := previous + 1
+	if !attempt.Success && made < attempts {
+		err := s.scheduleRetry(subscription.ID, event, made, backoff<<(made-1))
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to schedule retry of event %s for subscription %s: %v", event.ID, subscription.ID, err)
+	}
+
+	updates := map[string]interface{}{"last_event_at": attempt.AttemptedAt}
+	if attempt.Success {
+		updates["event_count"] = gorm.Expr("event_count + 1")
+		eventsProcessed.WithLabelValues(event.Type, "delivered").Inc()
+	} else {
+		updates["error_count"] = gorm.Expr("error_count + 1")
+		eventsProcessed.WithLabelValues(event.Type, "delivery_failed").Inc()
+	}
+	s.db.Model(&EventSubscription{}).Where("id = ?", subscription.ID).Updates(updates)
+}
+
+// scheduleRetry queues a delivery to be retried after a delay
+func (s *EventStreamingService) scheduleRetry(subscriptionID string, event *Event, attempts int, delay time.Duration) error {
+	member, err := json.Marshal(&deliveryRetry{SubscriptionID: subscriptionID, Event: event, Attempts: attempts})
+	if err != nil {
+		return err
+	}
+	due := time.Now().Add(delay).UnixMilli()
+	return s.redis.ZAdd(context.Background(), deliveryRetryKey, &redis.Z{Score: float64(due), Member: member}).Err()
+}
+
+// startDeliveryRetryPoller hands due retries to the dispatch workers. ZREM
+// claims each one, so with several replicas only one retries it.
+func (s *EventStreamingService) startDeliveryRetryPoller() {
+	ctx := context.Background()
+	ticker := time.NewTicker(deliveryRetryPoll)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		due, err := s.redis.ZRangeByScore(ctx, deliveryRetryKey, &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   strconv.FormatInt(time.Now().UnixMilli(), 10),
+			Count: deliveryRetryBatchSize,
+		}).Result()
+		if err != nil {
+			log.Printf("Failed to read delivery retries: %v", err)
+			continue
+		}
+
+		for _, member := range due {
+			if claimed, err := s.redis.ZRem(ctx, deliveryRetryKey, member).Result(); err != nil || claimed == 0 {
+				continue
+			}
+			var retry deliveryRetry
+			if err := json.Unmarshal([]byte(member), &retry); err != nil || retry.Event == nil {
+				log.Printf("Dropping unreadable delivery retry: %v", err)
+				continue
+			}
+			select {
+			case s.retries <- &retry:
+			default:
+				// Workers are busy; try again on a later poll
+				s.redis.ZAdd(ctx, deliveryRetryKey, &redis.Z{
+					Score:  float64(time.Now().Add(deliveryRetryPoll).UnixMilli()),
+					Member: member,
+				})
+			}
+		}
+	}
+}
+
+// retryDelivery retries a delivery if its subscription is still active
+func (s *EventStreamingService) retryDelivery(retry *deliveryRetry) {
+	s.subscribersMu.RLock()
+	var subscription *EventSubscription
+	for _, subscriptions := range s.subscribers {
+		for _, candidate := range subscriptions {
+			if candidate.ID == retry.SubscriptionID {
+				subscription = candidate
+			}
+		}
+	}
+	s.subscribersMu.RUnlock()
+
+	if subscription == nil {
+		log.Printf("Dropping retry of event %s: subscription %s is no longer active", retry.Event.ID, retry.SubscriptionID)
+		return
+	}
+	s.deliver(subscription, retry.Event, retry.Attempts)
+}
+
+// retryPolicy reads a subscription's attempts and initial backoff
+func retryPolicy(policy map[string]interface{}) (int, time.Duration) {
+	attempts, backoff := defaultDeliveryAttempts, defaultDeliveryBackoff
+	if n, ok := policy["max_attempts"].(float64); ok && n >= 1 {
+		attempts = int(n)
+	}
+	if attempts > maxDeliveryAttempts {
+		attempts = maxDeliveryAttempts
+	}
+	if ms, ok := policy["backoff_ms"].(float64); ok && ms >= 0 {
+		backoff = time.Duration(ms) * time.Millisecond
+	}
+	return attempts, backoff
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Subscription testing, filter preview and delivery history. The history
+// covers real deliveries, made by startEventDispatcher, as well as tests.
+
+const (
+	signatureHeader          = "X-Event-Signature"
+	signatureTimestampHeader = "X-Event-Timestamp"
+	testEventHeader          = "X-Event-Test"
+	maxRecordedResponseBytes = 1024
+)
+
+// DeliveryAttempt records a single webhook delivery to a subscription
+type DeliveryAttempt struct {
+	ID             string    `json:"id" gorm:"primaryKey"`
+	SubscriptionID string    `json:"subscription_id" gorm:"index;not null"`
+	EventID        string    `json:"event_id" gorm:"index"`
+	WebhookURL     string    `json:"webhook_url"`
+	Test           bool      `json:"test" gorm:"default:false"`
+	Success        bool      `json:"success" gorm:"index"`
+	StatusCode     int       `json:"status_code"`
+	LatencyMs      int64     `json:"latency_ms"`
+	Error          string    `json:"error"`
+	ResponseBody   string    `json:"response_body"`
+	AttemptedAt    time.Time `json:"attempted_at" gorm:"index"`
+}
+
+// Send a synthetic, signed test event to a subscription's webhook
+func (s *EventStreamingService) testSubscription(c *gin.Context) {
+	var subscription EventSubscription
+	if err := s.db.First(&subscription, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+		return
+	}
+	if subscription.WebhookURL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Subscription has no webhook URL"})
+		return
+	}
+
+	var request struct {
+		Type    string                 `json:"type"`
+		Subject string                 `json:"subject"`
+		Data    map[string]interface{} `json:"data"`
+	}
+	// The body is optional
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	eventType := request.Type
+	if eventType == "" {
+		eventType = EventTypeSystemEvent
+		if len(subscription.EventTypes) > 0 {
+			eventType = subscription.EventTypes[0]
+		}
+	}
+	data := request.Data
+	if data == nil {
+		data = map[string]interface{}{"message": "This is a test event"}
+	}
+
+	event := &Event{
+		ID:        "test-" + uuid.New().String(),
+		Type:      eventType,
+		Source:    "event-streaming-service",
+		Subject:   request.Subject,
+		Priority:  PriorityNormal,
+		Data:      data,
+		Metadata:  map[string]interface{}{"test": true},
+		Timestamp: time.Now().UTC(),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	attempt := s.deliverToWebhook(&subscription, event, true)
+
+	status := http.StatusOK
+	if !attempt.Success {
+		status = http.StatusBadGateway
+	}
+	c.JSON(status, gin.H{
+		"event":   event,
+		"attempt": attempt,
+	})
+}
+
+// Preview which recent events would match a subscription without delivering them
+func (s *EventStreamingService) previewSubscription(c *gin.Context) {
+	var subscription EventSubscription
+	if err := s.db.First(&subscription, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+		return
+	}
+
+	// A subscription only sees events its stream accepts
+	var stream EventStream
+	if subscription.StreamID != "" {
+		if err := s.db.First(&stream, "id = ?", subscription.StreamID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+			return
+		}
+	}
+
+	s.previewMatches(c, func(eventTypes []string, filters map[string]interface{}, event *Event) (*Event, bool) {
+		if !eventMatches(event, stream.EventTypes, stream.Filters) {
+			return nil, false
+		}
+		// Subscribers see events as the stream's functions leave them
+		if stream.ID != "" {
+			var ok bool
+			if event, ok = s.previewStreamFunctions(stream.ID, event); !ok {
+				return nil, false
+			}
+		}
+		return event, eventMatches(event, eventTypes, filters)
+	}, subscription.EventTypes, subscription.Filters)
+}
+
+// Preview which recent events would match a stream
+func (s *EventStreamingService) previewStream(c *gin.Context) {
+	var stream EventStream
+	if err := s.db.First(&stream, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	s.previewMatches(c, func(eventTypes []string, filters map[string]interface{}, event *Event) (*Event, bool) {
+		if !eventMatches(event, eventTypes, filters) {
+			return nil, false
+		}
+		return s.previewStreamFunctions(stream.ID, event)
+	}, stream.EventTypes, stream.Filters)
+}
+
+// Shared preview logic. The request body may override the stored event types
+// and filters to try out a change before saving it. match returns the event
+// as it would be delivered.
+func (s *EventStreamingService) previewMatches(
+	c *gin.Context,
+	match func(eventTypes []string, filters map[string]interface{}, event *Event) (*Event, bool),
+	eventTypes []string,
+	filters map[string]interface{},
+) {
+	var request struct {
+		EventTypes []string               `json:"event_types"`
+		Filters    map[string]interface{} `json:"filters"`
+		Window     string                 `json:"window"`
+		Limit      int                    `json:"limit"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.EventTypes != nil {
+		eventTypes = request.EventTypes
+	}
+	if request.Filters != nil {
+		filters = request.Filters
+	}
+
+	window := time.Hour
+	if request.Window != "" {
+		parsed, err := time.ParseDuration(request.Window)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid window duration"})
+			return
+		}
+		window = parsed
+	}
+	limit := request.Limit
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	// Scan a bounded number of recent events
+	var recent []Event
+	if err := s.db.Where("timestamp > ?", time.Now().UTC().Add(-window)).
+		Order("timestamp DESC").
+		Limit(5000).
+		Find(&recent).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load recent events"})
+		return
+	}
+
+	matched := make([]Event, 0, limit)
+	total := 0
+	for i := range recent {
+		if delivered, ok := match(eventTypes, filters, &recent[i]); ok {
+			total++
+			if len(matched) < limit {
+				matched = append(matched, *delivered)
+			}
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"scanned":     len(recent),
+		"matched":     total,
+		"events":      matched,
+		"event_types": eventTypes,
+		"filters":     filters,
+		"window":      window.String(),
+	})
+}
+
+// List recent delivery attempts for a subscription
+func (s *EventStreamingService) listDeliveryAttempts(c *gin.Context) {
+	limit := parseInt(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	query := s.db.Where("subscription_id = ?", c.Param("id"))
+	switch c.Query("status") {
+	case "success":
+		query = query.Where("success = ?", true)
+	case "failed":
+		query = query.Where("success = ?", false)
+	}
+	if c.Query("include_tests") == "false" {
+		query = query.Where("test = ?", false)
+	}
+
+	var attempts []DeliveryAttempt
+	if err := query.Order("attempted_at DESC").Limit(limit).Find(&attempts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list delivery attempts"})
+		return
+	}
+
+	var stats struct {
+		Total        int64
+		Failed       int64
+		AvgLatencyMs float64
+	}
+	s.db.Model(&DeliveryAttempt{}).
+		Select("COUNT(*) AS total, COUNT(*) FILTER (WHERE NOT success) AS failed, COALESCE(AVG(latency_ms), 0) AS avg_latency_ms").
+		Where("subscription_id = ? AND attempted_at > ?", c.Param("id"), time.Now().UTC().Add(-24*time.Hour)).
+		Scan(&stats)
+
+	c.JSON(http.StatusOK, gin.H{
+		"attempts": attempts,
+		"count":    len(attempts),
+		"last_24h": gin.H{
+			"total":          stats.Total,
+			"failed":         stats.Failed,
+			"avg_latency_ms": stats.AvgLatencyMs,
+		},
+	})
+}
+
+// Deliver an event to a subscription webhook and record the attempt
+func (s *EventStreamingService) deliverToWebhook(subscription *EventSubscription, event *Event, test bool) *DeliveryAttempt {
+	attempt := &DeliveryAttempt{
+		ID:             uuid.New().String(),
+		SubscriptionID: subscription.ID,
+		EventID:        event.ID,
+		WebhookURL:     subscription.WebhookURL,
+		Test:           test,
+		AttemptedAt:    time.Now().UTC(),
+	}
+	defer func() {
+		s.db.Create(attempt)
+	}()
+
+	payload, err := json.Marshal(s.revealPersonalData(event))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.WebhookURL, bytes.NewReader(payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(signatureTimestampHeader, timestamp)
+	if s.config.WebhookSigningSecret != "" {
+		req.Header.Set(signatureHeader, signPayload(s.config.WebhookSigningSecret, timestamp, payload))
+	}
+	if test {
+		req.Header.Set(testEventHeader, "true")
+	}
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	attempt.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxRecordedResponseBytes))
+	attempt.StatusCode = resp.StatusCode
+	attempt.ResponseBody = string(body)
+	attempt.Success = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !attempt.Success {
+		attempt.Error = fmt.Sprintf("webhook returned status %d", resp.StatusCode)
+	}
+	return attempt
+}
+
+// Signature over "<timestamp>.<body>" so receivers can reject replays
+func signPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check an event against event types and field filters. Filter keys name an
+// event field (type, source, subject, priority, user_id, session_id) or a
+// dotted path into data/metadata; values are a scalar or a list of
+// alternatives.
+func eventMatches(event *Event, eventTypes []string, filters map[string]interface{}) bool {
+	if len(eventTypes) > 0 {
+		found := false
+		for _, t := range eventTypes {
+			if t == event.Type || t == "*" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for key, expected := range filters {
+		actual, ok := eventField(event, key)
+		if !ok || !filterValueMatches(expected, actual) {
+			return false
+		}
+	}
+	return true
+}
+
+func eventField(event *Event, key string) (interface{}, bool) {
+	switch key {
+	case "type":
+		return event.Type, true
+	case "source":
+		return event.Source, true
+	case "subject":
+		return event.Subject, true
+	case "priority":
+		return event.Priority, true
+	case "user_id":
+		return event.UserID, true
+	case "session_id":
+		return event.SessionID, true
+	}
+
+	parts := strings.Split(key, ".")
+	var current interface{}
+	switch parts[0] {
+	case "data":
+		current = event.Data
+	case "metadata":
+		current = event.Metadata
+	default:
+		return nil, false
+	}
+	for _, part := range parts[1:] {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func filterValueMatches(expected, actual interface{}) bool {
+	if alternatives, ok := expected.([]interface{}); ok {
+		for _, alternative := range alternatives {
+			if filterValueMatches(alternative, actual) {
+				return true
+			}
+		}
+		return false
+	}
+	return fmt.Sprint(expected) == fmt.Sprint(actual)
+}
@@ -28,6 +28,7 @@ func (s *FileStorageService) batchUpload(c *gin.Context) {
 
 	userID := c.PostForm("user_id")
 	projectID := c.PostForm("project_id")
+	folder := normalizeFolder(c.PostForm("folder"))
 	storageType := c.DefaultPostForm("storage_type", StorageTypeMinio)
 
 	var results []gin.H
@@ -106,6 +107,7 @@ func (s *FileStorageService) batchUpload(c *gin.Context) {
 			Version:      1,
 			UserID:       userID,
 			ProjectID:    projectID,
+			Folder:       folder,
 			Metadata:     make(map[string]string),
 			CreatedAt:    time.Now().UTC(),
 			UpdatedAt:    time.Now().UTC(),
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Change feed for sync clients. Every write to a file's metadata appends
+// to the file_changes log from the FileMetadata save and delete hooks, in
+// the same transaction, so uploads, moves, deletes and expiry are all
+// recorded without each handler doing it. Clients mirror a project, or a
+// folder of it, by taking a cursor, doing one full listing, then polling
+// /v1/files/changes with the cursor each response returns.
+//
+// Only active and archived files are visible to sync: a file appearing
+// (uploaded, restored) is "created", a change to a visible file "updated",
+// and a file disappearing (deleted, expired) "deleted". A file moved to
+// another folder or project is "deleted" where it was and "created" where
+// it went.
+//
+// Changes are served only once they are a few seconds old, so a change
+// whose transaction commits late is not skipped by a cursor that already
+// moved past its sequence number. The log is pruned after
+// FILE_CHANGE_RETENTION_DAYS; older cursors get 410 and must resync.
+
+// File change types
+const (
+	FileChangeCreated = "created"
+	FileChangeUpdated = "updated"
+	FileChangeDeleted = "deleted"
+)
+
+const (
+	changeSettleWindow = 2 * time.Second
+	maxChangesPage     = 1000
+
+	previousScopeKey = "file_changes:previous"
+)
+
+// FileChange is one entry of the change log
+type FileChange struct {
+	Seq        int64     `json:"-" gorm:"primaryKey;autoIncrement;index:idx_file_changes_project_seq,priority:2"`
+	FileID     string    `json:"file_id" gorm:"index;not null"`
+	ProjectID  string    `json:"project_id" gorm:"index:idx_file_changes_project_seq,priority:1"`
+	Folder     string    `json:"folder"`
+	Type       string    `json:"type" gorm:"not null"`
+	RecordedAt time.Time `json:"recorded_at" gorm:"not null;default:clock_timestamp();index"`
+}
+
+// fileScope is where a file sits and whether sync can see it
+type fileScope struct {
+	ProjectID string
+	Folder    string
+	Status    string
+}
+
+func (scope *fileScope) visible() bool {
+	return scope != nil && (scope.Status == FileStatusActive || scope.Status == FileStatusArchived)
+}
+
+// BeforeSave notes where the file was before this write
+func (f *FileMetadata) BeforeSave(tx *gorm.DB) error {
+	if f.ID == "" {
+		return nil
+	}
+	var previous fileScope
+	err := tx.Session(&gorm.Session{NewDB: true}).Model(&FileMetadata{}).
+		Select("project_id", "folder", "status").
+		Where("id = ?", f.ID).
+		Take(&previous).Error
+	switch {
+	case err == nil:
+		tx.InstanceSet(previousScopeKey, &previous)
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		return err
+	}
+	return nil
+}
+
+// AfterSave records the change the write made
+func (f *FileMetadata) AfterSave(tx *gorm.DB) error {
+	if f.ID == "" {
+		return nil
+	}
+	var previous *fileScope
+	if v, ok := tx.InstanceGet(previousScopeKey); ok {
+		previous, _ = v.(*fileScope)
+	}
+	return recordFileChanges(tx, f.ID, previous, &fileScope{ProjectID: f.ProjectID, Folder: f.Folder, Status: f.Status})
+}
+
+// AfterDelete records a visible file's removal
+func (f *FileMetadata) AfterDelete(tx *gorm.DB) error {
+	if f.ID == "" {
+		return nil
+	}
+	return recordFileChanges(tx, f.ID, &fileScope{ProjectID: f.ProjectID, Folder: f.Folder, Status: f.Status}, nil)
+}
+
+func recordFileChanges(tx *gorm.DB, fileID string, previous, next *fileScope) error {
+	moved := previous.visible() && next.visible() &&
+		(previous.ProjectID != next.ProjectID || previous.Folder != next.Folder)
+
+	var changes []FileChange
+	if previous.visible() && (!next.visible() || moved) {
+		changes = append(changes, FileChange{FileID: fileID, ProjectID: previous.ProjectID, Folder: previous.Folder, Type: FileChangeDeleted})
+	}
+	if next.visible() {
+		changeType := FileChangeUpdated
+		if !previous.visible() || moved {
+			changeType = FileChangeCreated
+		}
+		changes = append(changes, FileChange{FileID: fileID, ProjectID: next.ProjectID, Folder: next.Folder, Type: changeType})
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return tx.Session(&gorm.Session{NewDB: true}).Create(&changes).Error
+}
+
+// changeCursor is a position in the change log, with the time it was
+// issued so that cursors older than the log's retention are refused
+type changeCursor struct {
+	Seq    int64
+	Issued time.Time
+}
+
+func (cur changeCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("v1:%d:%d", cur.Seq, cur.Issued.Unix())))
+}
+
+func parseChangeCursor(value string) (changeCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return changeCursor{}, errors.New("invalid cursor")
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 || parts[0] != "v1" {
+		return changeCursor{}, errors.New("invalid cursor")
+	}
+	seq, err1 := strconv.ParseInt(parts[1], 10, 64)
+	issued, err2 := strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil || seq < 0 {
+		return changeCursor{}, errors.New("invalid cursor")
+	}
+	return changeCursor{Seq: seq, Issued: time.Unix(issued, 0).UTC()}, nil
+}
+
+// settledChanges selects log entries old enough to be served
+func (s *FileStorageService) settledChanges() *gorm.DB {
+	return s.db.Model(&FileChange{}).
+		Where("recorded_at <= clock_timestamp() - ?::interval", fmt.Sprintf("%d milliseconds", changeSettleWindow.Milliseconds()))
+}
+
+// Get the changes to a project's files, or a folder's, since a cursor.
+// Without a cursor only the current cursor is returned.
+func (s *FileStorageService) getFileChanges(c *gin.Context) {
+	projectID := c.Query("project_id")
+	if projectID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "project_id is required"})
+		return
+	}
+	folder := normalizeFolder(c.Query("folder"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "500"))
+	if limit <= 0 || limit > maxChangesPage {
+		limit = maxChangesPage
+	}
+	now := time.Now().UTC()
+
+	if c.Query("cursor") == "" {
+		var head int64
+		if err := s.settledChanges().Select("COALESCE(MAX(seq), 0)").Scan(&head).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read changes"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"changes":  []gin.H{},
+			"cursor":   changeCursor{Seq: head, Issued: now}.String(),
+			"has_more": false,
+		})
+		return
+	}
+
+	cursor, err := parseChangeCursor(c.Query("cursor"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Entries the cursor has yet to serve may be a settle window older than it
+	if cursor.Issued.Before(now.Add(-s.config.ChangeRetention + changeSettleWindow)) {
+		c.JSON(http.StatusGone, gin.H{"error": "Cursor has expired; resync with a full listing"})
+		return
+	}
+
+	query := s.settledChanges().Where("seq > ? AND project_id = ?", cursor.Seq, projectID)
+	if folder != "" {
+		query = query.Where("(folder = ? OR folder LIKE ?)", folder, escapeLike(folder)+"/%")
+	}
+	var entries []FileChange
+	if err := query.Order("seq ASC").Limit(limit + 1).Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read changes"})
+		return
+	}
+	hasMore := len(entries) > limit
+	if hasMore {
+		entries = entries[:limit]
+	}
+
+	next := changeCursor{Seq: cursor.Seq, Issued: now}
+	if len(entries) > 0 {
+		next.Seq = entries[len(entries)-1].Seq
+	}
+
+	changes, err := s.collapseChanges(entries)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read changed files"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"changes":  changes,
+		"cursor":   next.String(),
+		"has_more": hasMore,
+	})
+}
+
+// collapseChanges keeps each file's last change in the page, in log order,
+// with the file's current metadata for those not deleted. A file no longer
+// visible is reported deleted even if its deletion is yet to be served.
+func (s *FileStorageService) collapseChanges(entries []FileChange) ([]gin.H, error) {
+	last := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		last[entry.FileID] = i
+	}
+	var ids []string
+	for id, i := range last {
+		if entries[i].Type != FileChangeDeleted {
+			ids = append(ids, id)
+		}
+	}
+
+	files := make(map[string]*FileMetadata, len(ids))
+	if len(ids) > 0 {
+		var found []FileMetadata
+		if err := s.db.Where("id IN ?", ids).Find(&found).Error; err != nil {
+			return nil, err
+		}
+		for i := range found {
+			files[found[i].ID] = &found[i]
+		}
+	}
+
+	changes := make([]gin.H, 0, len(last))
+	for i, entry := range entries {
+		if last[entry.FileID] != i {
+			continue
+		}
+		change := gin.H{
+			"type":        entry.Type,
+			"file_id":     entry.FileID,
+			"recorded_at": entry.RecordedAt,
+		}
+		if entry.Type == FileChangeDeleted {
+			change["project_id"] = entry.ProjectID
+			change["folder"] = entry.Folder
+		} else if file := files[entry.FileID]; file != nil && (&fileScope{Status: file.Status}).visible() {
+			change["file"] = file
+		} else {
+			change["type"] = FileChangeDeleted
+			change["project_id"] = entry.ProjectID
+			change["folder"] = entry.Folder
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// pruneFileChanges drops change log entries past retention
+func (s *FileStorageService) pruneFileChanges() {
+	cutoff := time.Now().UTC().Add(-s.config.ChangeRetention)
+	result := s.db.Where("recorded_at < ?", cutoff).Delete(&FileChange{})
+	if result.Error != nil {
+		log.Printf("Failed to prune file changes: %v", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Pruned %d file changes", result.RowsAffected)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"gorm.io/gorm"
+)
+
+// Folder shares. A FileShare with a ProjectID and no FileID shares every
+// active file of the project under Prefix (the empty prefix shares the whole
+// project). The link lists the folder and offers "download all", which
+// streams a zip straight to the client without staging it on disk.
+//
+// Folder share permissions: "list" allows browsing the folder and
+// "download" allows fetching files or the zip. A share without permissions
+// allows both.
+
+const (
+	SharePermissionList     = "list"
+	SharePermissionDownload = "download"
+
+	// Upper bound on files bundled into one zip
+	maxFolderArchiveFiles = 10000
+)
+
+type FolderShareRequest struct {
+	FileShareRequest
+	Prefix string `json:"prefix"`
+}
+
+// normalizeFolder turns user input like "/reports//2024/" into "reports/2024"
+func normalizeFolder(folder string) string {
+	folder = strings.Trim(strings.TrimSpace(folder), "/")
+	if folder == "" {
+		return ""
+	}
+	folder = path.Clean(folder)
+	if folder == "." || strings.HasPrefix(folder, "..") {
+		return ""
+	}
+	return folder
+}
+
+// IsFolder reports whether the share covers a folder rather than one file
+func (share *FileShare) IsFolder() bool {
+	return share.FileID == "" && share.ProjectID != ""
+}
+
+func (share *FileShare) allows(permission string) bool {
+	if len(share.Permissions) == 0 {
+		return true
+	}
+	for _, p := range share.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// folderFiles selects the active files under the share's prefix
+func (s *FileStorageService) folderFiles(share *FileShare) *gorm.DB {
+	query := s.db.Model(&FileMetadata{}).Where("project_id = ? AND status = ?", share.ProjectID, FileStatusActive)
+	if share.Prefix != "" {
+		query = query.Where("(folder = ? OR folder LIKE ?)", share.Prefix, escapeLike(share.Prefix)+"/%")
+	}
+	return query
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+// openFolderShare loads a usable folder share, writing the error response
+// and returning nil otherwise
+func (s *FileStorageService) openFolderShare(c *gin.Context, permission string) *FileShare {
+	var share FileShare
+	if err := s.db.Where("share_token = ?", c.Param("token")).First(&share).Error; err != nil || !share.IsFolder() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return nil
+	}
+
+	if share.ExpiresAt != nil && share.ExpiresAt.Before(time.Now().UTC()) {
+		c.JSON(http.StatusGone, gin.H{"error": "Share has expired"})
+		return nil
+	}
+
+	if share.ShareType == "password" && share.Password != c.Query("password") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+		return nil
+	}
+
+	if !share.allows(permission) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("Share does not allow %s", permission)})
+		return nil
+	}
+
+	return &share
+}
+
+// consumeShareDownload counts one download against the share's cap. The
+// check and increment are one statement so concurrent downloads cannot
+// overshoot it.
+func (s *FileStorageService) consumeShareDownload(share *FileShare) bool {
+	result := s.db.Model(&FileShare{}).
+		Where("id = ? AND (max_downloads = 0 OR download_count < max_downloads)", share.ID).
+		Updates(map[string]interface{}{
+			"download_count": gorm.Expr("download_count + 1"),
+			"updated_at":     time.Now().UTC(),
+		})
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// Create a folder share
+func (s *FileStorageService) createFolderShare(c *gin.Context) {
+	projectID := c.Param("project_id")
+
+	var req FolderShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, permission := range req.Permissions {
+		if permission != SharePermissionList && permission != SharePermissionDownload {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown permission %q", permission)})
+			return
+		}
+	}
+
+	prefix := normalizeFolder(req.Prefix)
+	share := &FileShare{
+		ID:           uuid.New().String(),
+		ProjectID:    projectID,
+		Prefix:       prefix,
+		ShareToken:   uuid.New().String(),
+		ShareType:    req.ShareType,
+		Password:     req.Password,
+		Permissions:  req.Permissions,
+		ExpiresAt:    req.ExpiresAt,
+		MaxDownloads: req.MaxDownloads,
+		CreatedBy:    c.GetString("user_id"), // From auth middleware
+		CreatedAt:    time.Now().UTC(),
+		UpdatedAt:    time.Now().UTC(),
+	}
+
+	var count int64
+	s.folderFiles(share).Count(&count)
+	if count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder is empty or does not exist"})
+		return
+	}
+
+	if err := s.db.Create(share).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create folder share"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"share_id":     share.ID,
+		"share_token":  share.ShareToken,
+		"share_url":    fmt.Sprintf("/v1/shared/%s", share.ShareToken),
+		"download_url": fmt.Sprintf("/v1/shared/%s/download", share.ShareToken),
+		"prefix":       share.Prefix,
+		"file_count":   count,
+		"expires_at":   share.ExpiresAt,
+		"message":      "Folder share created successfully",
+	})
+}
+
+// List a project's folder shares
+func (s *FileStorageService) getProjectShares(c *gin.Context) {
+	projectID := c.Param("project_id")
+
+	var shares []FileShare
+	if err := s.db.Where("project_id = ? AND (file_id = '' OR file_id IS NULL)", projectID).Find(&shares).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve folder shares"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"project_id": projectID,
+		"shares":     shares,
+		"count":      len(shares),
+	})
+}
+
+// List the contents of a shared folder
+func (s *FileStorageService) listSharedFolder(c *gin.Context) {
+	share := s.openFolderShare(c, SharePermissionList)
+	if share == nil {
+		return
+	}
+
+	var files []FileMetadata
+	if err := s.folderFiles(share).Order("folder ASC, original_name ASC").Find(&files).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list folder"})
+		return
+	}
+
+	var totalSize int64
+	entries := make([]gin.H, 0, len(files))
+	for _, file := range files {
+		totalSize += file.Size
+		entries = append(entries, gin.H{
+			"id":         file.ID,
+			"name":       file.OriginalName,
+			"path":       folderEntryPath(share.Prefix, &file),
+			"size":       file.Size,
+			"mime_type":  file.MimeType,
+			"updated_at": file.UpdatedAt,
+		})
+	}
+
+	remaining := -1
+	if share.MaxDownloads > 0 {
+		remaining = share.MaxDownloads - share.DownloadCount
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"share_token":         share.ShareToken,
+		"prefix":              share.Prefix,
+		"files":               entries,
+		"count":               len(entries),
+		"total_size":          totalSize,
+		"can_download":        share.allows(SharePermissionDownload) && remaining != 0,
+		"downloads_remaining": remaining,
+	})
+}
+
+// folderEntryPath is a file's path relative to the shared prefix
+func folderEntryPath(prefix string, file *FileMetadata) string {
+	relative := strings.TrimPrefix(strings.TrimPrefix(file.Folder, prefix), "/")
+	return path.Join(relative, path.Base(file.OriginalName))
+}
+
+// Download one file from a shared folder
+func (s *FileStorageService) downloadSharedFolderFile(c *gin.Context) {
+	share := s.openFolderShare(c, SharePermissionDownload)
+	if share == nil {
+		return
+	}
+
+	var metadata FileMetadata
+	if err := s.folderFiles(share).Where("id = ?", c.Param("file_id")).First(&metadata).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	if !s.consumeShareDownload(share) {
+		c.JSON(http.StatusGone, gin.H{"error": "Download limit exceeded"})
+		return
+	}
+
+	switch metadata.StorageType {
+	case StorageTypeMinio:
+		s.serveFileFromMinio(c, &metadata)
+	case StorageTypeLocal:
+		s.serveFileLocally(c, &metadata)
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unsupported storage type"})
+		return
+	}
+	filesDownloaded.WithLabelValues(metadata.StorageType).Inc()
+}
+
+// Stream every file in a shared folder as one zip archive
+func (s *FileStorageService) downloadSharedFolderArchive(c *gin.Context) {
+	share := s.openFolderShare(c, SharePermissionDownload)
+	if share == nil {
+		return
+	}
+
+	var files []FileMetadata
+	if err := s.folderFiles(share).Order("folder ASC, original_name ASC").Limit(maxFolderArchiveFiles + 1).Find(&files).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list folder"})
+		return
+	}
+	if len(files) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder is empty"})
+		return
+	}
+	if len(files) > maxFolderArchiveFiles {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":     "Folder has too many files to bundle",
+			"max_files": maxFolderArchiveFiles,
+		})
+		return
+	}
+
+	if !s.consumeShareDownload(share) {
+		c.JSON(http.StatusGone, gin.H{"error": "Download limit exceeded"})
+		return
+	}
+
+	name := share.Prefix
+	if name == "" {
+		name = share.ProjectID
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", path.Base(name)))
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+
+	// From here on the response has started; failures can only be logged
+	archive := zip.NewWriter(c.Writer)
+	ctx := c.Request.Context()
+	used := make(map[string]int, len(files))
+
+	for i := range files {
+		file := &files[i]
+		entryName := uniqueEntryName(used, folderEntryPath(share.Prefix, file))
+
+		writer, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     entryName,
+			Method:   zip.Deflate,
+			Modified: file.UpdatedAt,
+		})
+		if err != nil {
+			log.Printf("Failed to add %s to archive for share %s: %v", file.ID, share.ID, err)
+			break
+		}
+
+		if err := s.copyStoredFile(ctx, writer, file); err != nil {
+			log.Printf("Failed to stream %s into archive for share %s: %v", file.ID, share.ID, err)
+			if ctx.Err() != nil {
+				// Client went away
+				return
+			}
+			continue
+		}
+		filesDownloaded.WithLabelValues(file.StorageType).Inc()
+	}
+
+	if err := archive.Close(); err != nil {
+		log.Printf("Failed to finish archive for share %s: %v", share.ID, err)
+	}
+}
+
+// uniqueEntryName suffixes repeated names the way file managers do
+func uniqueEntryName(used map[string]int, name string) string {
+	n := used[name]
+	used[name] = n + 1
+	if n == 0 {
+		return name
+	}
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// copyStoredFile writes a stored file's content to w
+func (s *FileStorageService) copyStoredFile(ctx context.Context, w io.Writer, metadata *FileMetadata) error {
+	var reader io.ReadCloser
+	switch metadata.StorageType {
+	case StorageTypeMinio:
+		object, err := s.minioClient.GetObject(ctx, s.config.MinioBucket, metadata.StoredName, minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+		reader = object
+	case StorageTypeLocal:
+		file, err := os.Open(metadata.Path)
+		if err != nil {
+			return err
+		}
+		reader = file
+	default:
+		return fmt.Errorf("unsupported storage type: %s", metadata.StorageType)
+	}
+	defer reader.Close()
+
+	_, err := io.Copy(w, reader)
+	return err
+}
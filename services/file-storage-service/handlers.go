@@ -72,6 +72,7 @@ func (s *FileStorageService) uploadFile(c *gin.Context) {
 	// Get additional metadata from form
 	userID := c.PostForm("user_id")
 	projectID := c.PostForm("project_id")
+	folder := normalizeFolder(c.PostForm("folder"))
 	tags := strings.Split(c.PostForm("tags"), ",")
 	storageType := c.DefaultPostForm("storage_type", StorageTypeMinio)
 
@@ -114,6 +115,7 @@ func (s *FileStorageService) uploadFile(c *gin.Context) {
 		Version:      1,
 		UserID:       userID,
 		ProjectID:    projectID,
+		Folder:       folder,
 		Tags:         tags,
 		Metadata:     make(map[string]string),
 		CreatedAt:    time.Now().UTC(),
@@ -322,6 +324,7 @@ func (s *FileStorageService) updateFileMetadata(c *gin.Context) {
 
 	var req struct {
 		OriginalName string            `json:"original_name"`
+		Folder       *string           `json:"folder"`
 		Tags         []string          `json:"tags"`
 		Metadata     map[string]string `json:"metadata"`
 		ExpiresAt    *time.Time        `json:"expires_at"`
@@ -343,6 +346,9 @@ func (s *FileStorageService) updateFileMetadata(c *gin.Context) {
 	if req.OriginalName != "" {
 		metadata.OriginalName = req.OriginalName
 	}
+	if req.Folder != nil {
+		metadata.Folder = normalizeFolder(*req.Folder)
+	}
 	if req.Tags != nil {
 		metadata.Tags = req.Tags
 	}
@@ -48,6 +48,7 @@ type Config struct {
 	StoragePath  string
 	MaxFileSize  int64
 	Environment  string
+	ChangeRetention time.Duration
 }
 
 // File status constants
@@ -84,6 +85,7 @@ type FileMetadata struct {
 	ParentID        string            `json:"parent_id" gorm:"index"`
 	UserID          string            `json:"user_id" gorm:"index"`
 	ProjectID       string            `json:"project_id" gorm:"index"`
+	Folder          string            `json:"folder" gorm:"index"`
 	Tags            []string          `json:"tags" gorm:"type:text[]"`
 	Metadata        map[string]string `json:"metadata" gorm:"type:jsonb"`
 	ExpiresAt       *time.Time        `json:"expires_at"`
@@ -96,6 +98,8 @@ type FileMetadata struct {
 type FileShare struct {
 	ID          string     `json:"id" gorm:"primaryKey"`
 	FileID      string     `json:"file_id" gorm:"index"`
+	ProjectID   string     `json:"project_id,omitempty" gorm:"index"` // folder shares
+	Prefix      string     `json:"prefix,omitempty"`
 	ShareToken  string     `json:"share_token" gorm:"uniqueIndex"`
 	ShareType   string     `json:"share_type"` // public, private, password
 	Password    string     `json:"password,omitempty"`
@@ -193,6 +197,7 @@ func main() {
 		StoragePath:  getEnv("STORAGE_PATH", "/tmp/002aic-storage"),
 		MaxFileSize:  parseSize(getEnv("MAX_FILE_SIZE", "100MB")),
 		Environment:  getEnv("ENVIRONMENT", "development"),
+		ChangeRetention: parseDays(getEnv("FILE_CHANGE_RETENTION_DAYS", "30")),
 	}
 
 	service, err := NewFileStorageService(config)
@@ -215,7 +220,7 @@ func NewFileStorageService(config *Config) (*FileStorageService, error) {
 	}
 
 	// Auto-migrate tables
-	if err := db.AutoMigrate(&FileMetadata{}, &FileShare{}, &FileChunk{}); err != nil {
+	if err := db.AutoMigrate(&FileMetadata{}, &FileShare{}, &FileChunk{}, &FileChange{}); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
@@ -307,6 +312,7 @@ func (s *FileStorageService) setupRoutes() {
 		v1.GET("/files", s.listFiles)
 		v1.GET("/files/search", s.searchFiles)
 		v1.GET("/files/duplicates", s.findDuplicates)
+		v1.GET("/files/changes", s.getFileChanges)
 
 		// File sharing
 		v1.POST("/files/:id/share", s.createFileShare)
@@ -314,6 +320,9 @@ func (s *FileStorageService) setupRoutes() {
 		v1.DELETE("/shares/:token", s.deleteFileShare)
 		v1.GET("/shared/:token", s.getSharedFile)
 		v1.GET("/shared/:token/download", s.downloadSharedFile)
+		v1.GET("/shared/:token/files/:file_id/download", s.downloadSharedFolderFile)
+		v1.POST("/projects/:project_id/shares", s.createFolderShare)
+		v1.GET("/projects/:project_id/shares", s.getProjectShares)
 
 		// Batch operations
 		v1.POST("/files/batch/upload", s.batchUpload)
@@ -454,6 +463,14 @@ func parseSize(sizeStr string) int64 {
 	return size * multiplier
 }
 
+func parseDays(daysStr string) time.Duration {
+	days, err := strconv.Atoi(daysStr)
+	if err != nil || days <= 0 {
+		return 30 * 24 * time.Hour // Default 30 days
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
 func getSizeCategory(size int64) string {
 	if size < 1024*1024 {
 		return "small" // < 1MB
@@ -293,6 +293,7 @@ func (s *FileStorageService) startCleanupWorker() {
 		case <-ticker.C:
 			s.cleanupExpiredFiles()
 			s.cleanupOrphanedFiles()
+			s.pruneFileChanges()
 		}
 	}
 }
@@ -458,6 +459,11 @@ func (s *FileStorageService) getSharedFile(c *gin.Context) {
 		return
 	}
 
+	if share.IsFolder() {
+		s.listSharedFolder(c)
+		return
+	}
+
 	// Check if share is expired
 	if share.ExpiresAt != nil && share.ExpiresAt.Before(time.Now().UTC()) {
 		c.JSON(http.StatusGone, gin.H{"error": "Share has expired"})
@@ -495,6 +501,11 @@ func (s *FileStorageService) downloadSharedFile(c *gin.Context) {
 		return
 	}
 
+	if share.IsFolder() {
+		s.downloadSharedFolderArchive(c)
+		return
+	}
+
 	// Check if share is expired
 	if share.ExpiresAt != nil && share.ExpiresAt.Before(time.Now().UTC()) {
 		c.JSON(http.StatusGone, gin.H{"error": "Share has expired"})
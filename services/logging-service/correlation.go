@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Request correlation. The API gateway tags every proxied request with an
+// X-Request-ID and services log it as request_id. Given that ID, the
+// timeline endpoint merges the gateway's request log (fetched from the
+// gateway admin API) with the service logs carrying the ID into one
+// chronological view, with the time between consecutive events, so slow
+// hops and silent stretches stand out.
+
+const (
+	maxTimelineLogs         = 2000
+	defaultTimelineGapMs    = 250
+	gatewayRequestLogSource = "api-gateway"
+)
+
+// gatewayRequestLog is the part of the gateway's RequestLog the timeline uses
+type gatewayRequestLog struct {
+	ID           string                 `json:"id"`
+	RequestID    string                 `json:"request_id"`
+	Method       string                 `json:"method"`
+	Path         string                 `json:"path"`
+	ServiceName  string                 `json:"service_name"`
+	UserID       string                 `json:"user_id"`
+	IPAddress    string                 `json:"ip_address"`
+	StatusCode   int                    `json:"status_code"`
+	ResponseTime int64                  `json:"response_time_ms"`
+	ErrorMessage string                 `json:"error_message"`
+	Metadata     map[string]interface{} `json:"metadata"`
+	CreatedAt    time.Time              `json:"created_at"`
+}
+
+// timelineEvent is one point of the request timeline
+type timelineEvent struct {
+	Timestamp time.Time              `json:"timestamp"`
+	OffsetMs  float64                `json:"offset_ms"`
+	GapMs     float64                `json:"gap_ms"`
+	Source    string                 `json:"source"` // service name, or api-gateway
+	Kind      string                 `json:"kind"`   // gateway_request_start, gateway_request_end, log
+	Level     string                 `json:"level,omitempty"`
+	Message   string                 `json:"message"`
+	LogID     string                 `json:"log_id,omitempty"`
+	TraceID   string                 `json:"trace_id,omitempty"`
+	SpanID    string                 `json:"span_id,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// fetchGatewayRequestLogs asks the gateway for its logs of a request
+func (s *LoggingService) fetchGatewayRequestLogs(ctx context.Context, requestID string) ([]gatewayRequestLog, error) {
+	endpoint := fmt.Sprintf("%s/admin/v1/request-logs/%s", strings.TrimRight(s.config.GatewayURL, "/"), url.PathEscape(requestID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Admin-Token", s.config.GatewayAdminToken)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gateway returned %d", resp.StatusCode)
+	}
+
+	var body struct {
+		RequestLogs []gatewayRequestLog `json:"request_logs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.RequestLogs, nil
+}
+
+// Chronological view of a request across the gateway and services
+func (s *LoggingService) getRequestTimeline(c *gin.Context) {
+	requestID := c.Param("request_id")
+
+	gapThreshold := float64(defaultTimelineGapMs)
+	if v, err := strconv.ParseFloat(c.Query("gap_threshold_ms"), 64); err == nil && v > 0 {
+		gapThreshold = v
+	}
+
+	var logs []LogEntry
+	if err := s.db.Where("request_id = ?", requestID).Order("timestamp ASC").
+		Limit(maxTimelineLogs + 1).Find(&logs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch logs"})
+		return
+	}
+	truncated := len(logs) > maxTimelineLogs
+	if truncated {
+		logs = logs[:maxTimelineLogs]
+	}
+
+	// The gateway is optional; service logs alone still make a timeline
+	var (
+		gatewayLogs  []gatewayRequestLog
+		gatewayError string
+	)
+	if s.config.GatewayURL != "" {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+		var err error
+		gatewayLogs, err = s.fetchGatewayRequestLogs(ctx, requestID)
+		cancel()
+		if err != nil {
+			gatewayError = err.Error()
+		}
+	}
+
+	if len(logs) == 0 && len(gatewayLogs) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No logs found for request", "gateway_error": gatewayError})
+		return
+	}
+
+	events := make([]timelineEvent, 0, len(logs)+2*len(gatewayLogs))
+	for _, entry := range gatewayLogs {
+		// The gateway logs once the response is sent
+		end := entry.CreatedAt
+		start := end.Add(-time.Duration(entry.ResponseTime) * time.Millisecond)
+		events = append(events, timelineEvent{
+			Timestamp: start,
+			Source:    gatewayRequestLogSource,
+			Kind:      "gateway_request_start",
+			Message:   fmt.Sprintf("%s %s -> %s", entry.Method, entry.Path, entry.ServiceName),
+			Fields: map[string]interface{}{
+				"user_id":    entry.UserID,
+				"ip_address": entry.IPAddress,
+			},
+		})
+		finish := timelineEvent{
+			Timestamp: end,
+			Source:    gatewayRequestLogSource,
+			Kind:      "gateway_request_end",
+			Message:   fmt.Sprintf("%d in %dms", entry.StatusCode, entry.ResponseTime),
+			Fields: map[string]interface{}{
+				"status_code":      entry.StatusCode,
+				"response_time_ms": entry.ResponseTime,
+			},
+		}
+		if entry.ErrorMessage != "" {
+			finish.Level = LogLevelError
+			finish.Fields["error_message"] = entry.ErrorMessage
+		}
+		events = append(events, finish)
+	}
+	for _, entry := range logs {
+		events = append(events, timelineEvent{
+			Timestamp: entry.Timestamp,
+			Source:    entry.Service,
+			Kind:      "log",
+			Level:     entry.Level,
+			Message:   entry.Message,
+			LogID:     entry.ID,
+			TraceID:   entry.TraceID,
+			SpanID:    entry.SpanID,
+			Fields:    entry.Fields,
+		})
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+
+	type serviceSummary struct {
+		Service    string         `json:"service"`
+		FirstSeen  time.Time      `json:"first_seen"`
+		LastSeen   time.Time      `json:"last_seen"`
+		DurationMs float64        `json:"duration_ms"`
+		Logs       int            `json:"logs"`
+		Levels     map[string]int `json:"levels"`
+	}
+	summaries := map[string]*serviceSummary{}
+	var order []string
+	var gaps []gin.H
+
+	first := events[0].Timestamp
+	for i := range events {
+		event := &events[i]
+		event.OffsetMs = float64(event.Timestamp.Sub(first).Microseconds()) / 1000
+		if i > 0 {
+			event.GapMs = float64(event.Timestamp.Sub(events[i-1].Timestamp).Microseconds()) / 1000
+			if event.GapMs >= gapThreshold {
+				gaps = append(gaps, gin.H{
+					"after":   events[i-1].Source,
+					"before":  event.Source,
+					"gap_ms":  event.GapMs,
+					"at":      events[i-1].Timestamp,
+					"resumed": event.Timestamp,
+				})
+			}
+		}
+
+		if event.Kind != "log" {
+			continue
+		}
+		summary, ok := summaries[event.Source]
+		if !ok {
+			summary = &serviceSummary{Service: event.Source, FirstSeen: event.Timestamp, Levels: map[string]int{}}
+			summaries[event.Source] = summary
+			order = append(order, event.Source)
+		}
+		summary.LastSeen = event.Timestamp
+		summary.Logs++
+		summary.Levels[event.Level]++
+	}
+
+	services := make([]*serviceSummary, 0, len(order))
+	for _, name := range order {
+		summary := summaries[name]
+		summary.DurationMs = float64(summary.LastSeen.Sub(summary.FirstSeen).Microseconds()) / 1000
+		services = append(services, summary)
+	}
+
+	response := gin.H{
+		"request_id":  requestID,
+		"started_at":  first,
+		"ended_at":    events[len(events)-1].Timestamp,
+		"duration_ms": events[len(events)-1].OffsetMs,
+		"events":      events,
+		"services":    services,
+		"gaps":        gaps,
+		"truncated":   truncated,
+	}
+	if len(gatewayLogs) > 0 {
+		response["gateway"] = gatewayLogs
+	}
+	if gatewayError != "" {
+		response["gateway_error"] = gatewayError
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Incident bundles. When an alert fires, the monitoring-service asks for
+// the logs around it to be kept as evidence: those of the affected services
+// in a window around the firing time, and every log of the traces and
+// requests the alert names, with the gateway's records of those requests.
+// The logs are copied into the bundle, so they outlive the retention that
+// deletes the originals, and a bundle is never changed after it is made;
+// its checksum over the copied logs is verified whenever it is read.
+//
+// A bundle can be shared through a link holding a random token, readable
+// without other credentials until it expires or is revoked. Only the
+// token's hash is stored, so a lost link is replaced, not recovered.
+// Creating a bundle for an alert firing that already has one returns the
+// existing bundle, so the monitoring-service may retry freely.
+
+const (
+	defaultIncidentWindowBefore = 15 * time.Minute
+	defaultIncidentWindowAfter  = 5 * time.Minute
+	maxIncidentWindow           = 24 * time.Hour
+	maxIncidentLogs             = 20000
+	maxIncidentGatewayRequests  = 50
+	incidentLogsPage            = 1000
+
+	incidentShareTokenPrefix = "lgs_"
+)
+
+// IncidentBundle is the evidence kept for one alert firing
+type IncidentBundle struct {
+	ID             string                 `json:"id" gorm:"primaryKey"`
+	AlertKey       string                 `json:"-" gorm:"uniqueIndex;not null"`
+	Source         string                 `json:"source" gorm:"index"` // the system that raised the alert
+	AlertID        string                 `json:"alert_id" gorm:"index"`
+	AlertName      string                 `json:"alert_name" gorm:"index"`
+	Severity       string                 `json:"severity"`
+	Summary        string                 `json:"summary"`
+	FiredAt        time.Time              `json:"fired_at" gorm:"index"`
+	WindowStart    time.Time              `json:"window_start"`
+	WindowEnd      time.Time              `json:"window_end"`
+	Services       []string               `json:"services" gorm:"type:text[]"`
+	TraceIDs       []string               `json:"trace_ids" gorm:"type:text[]"`
+	RequestIDs     []string               `json:"request_ids" gorm:"type:text[]"`
+	Labels         map[string]interface{} `json:"labels" gorm:"type:jsonb"`
+	GatewayLogs    []gatewayRequestLog    `json:"gateway_logs,omitempty" gorm:"type:jsonb;serializer:json"`
+	LogCount       int                    `json:"log_count"`
+	Truncated      bool                   `json:"truncated"`
+	Checksum       string                 `json:"checksum"` // SHA-256 over the bundled logs in order
+	ShareTokenHash string                 `json:"-" gorm:"index"`
+	ShareExpiresAt *time.Time             `json:"share_expires_at"`
+	CreatedBy      string                 `json:"created_by"`
+	CreatedAt      time.Time              `json:"created_at"`
+}
+
+// IncidentBundleLog is a copy of a log entry taken into a bundle
+type IncidentBundleLog struct {
+	BundleID  string                 `json:"-" gorm:"primaryKey"`
+	Seq       int                    `json:"seq" gorm:"primaryKey"`
+	LogID     string                 `json:"log_id"`
+	Timestamp time.Time              `json:"timestamp"`
+	Level     string                 `json:"level"`
+	Service   string                 `json:"service"`
+	Message   string                 `json:"message"`
+	Fields    map[string]interface{} `json:"fields" gorm:"type:jsonb"`
+	TraceID   string                 `json:"trace_id"`
+	SpanID    string                 `json:"span_id"`
+	UserID    string                 `json:"user_id"`
+	RequestID string                 `json:"request_id"`
+	Source    string                 `json:"source"`
+	Tags      []string               `json:"tags" gorm:"type:text[]"`
+}
+
+var incidentBundlesCreated = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "incident_bundles_created_total",
+		Help: "Incident log bundles created",
+	},
+	[]string{"source", "severity"},
+)
+
+func init() {
+	prometheus.MustRegister(incidentBundlesCreated)
+}
+
+func hashShareToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newShareToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return incidentShareTokenPrefix + hex.EncodeToString(buf), nil
+}
+
+// bundleChecksum hashes the bundled logs in order. Timestamps are taken at
+// the precision and zone the database returns them in.
+func bundleChecksum(logs []IncidentBundleLog) string {
+	hasher := sha256.New()
+	encoder := json.NewEncoder(hasher)
+	for _, entry := range logs {
+		entry.Timestamp = entry.Timestamp.UTC().Truncate(time.Microsecond)
+		encoder.Encode(&entry)
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func (s *LoggingService) shareURL(token string) string {
+	return strings.TrimRight(s.config.IncidentShareBaseURL, "/") + "/v1/incidents/shared/" + token
+}
+
+// issueShareLink gives a bundle a new share token, replacing any previous
+// one
+func (s *LoggingService) issueShareLink(bundle *IncidentBundle, ttl time.Duration) (gin.H, error) {
+	token, err := newShareToken()
+	if err != nil {
+		return nil, err
+	}
+	var expiresAt *time.Time
+	if ttl > 0 {
+		t := time.Now().UTC().Add(ttl)
+		expiresAt = &t
+	}
+	if err := s.db.Model(bundle).Updates(map[string]interface{}{
+		"share_token_hash": hashShareToken(token),
+		"share_expires_at": expiresAt,
+	}).Error; err != nil {
+		return nil, err
+	}
+	bundle.ShareExpiresAt = expiresAt
+	return gin.H{"url": s.shareURL(token), "token": token, "expires_at": expiresAt}, nil
+}
+
+// Snapshot the logs around an alert into an incident bundle
+func (s *LoggingService) createIncidentBundle(c *gin.Context) {
+	var req struct {
+		Source              string                 `json:"source"`
+		AlertID             string                 `json:"alert_id" binding:"required"`
+		AlertName           string                 `json:"alert_name"`
+		Severity            string                 `json:"severity"`
+		Summary             string                 `json:"summary"`
+		FiredAt             *time.Time             `json:"fired_at"`
+		WindowStart         *time.Time             `json:"window_start"`
+		WindowEnd           *time.Time             `json:"window_end"`
+		WindowBeforeMinutes int                    `json:"window_before_minutes"`
+		WindowAfterMinutes  int                    `json:"window_after_minutes"`
+		Services            []string               `json:"services"`
+		TraceIDs            []string               `json:"trace_ids"`
+		RequestIDs          []string               `json:"request_ids"`
+		Labels              map[string]interface{} `json:"labels"`
+		ShareTTLHours       *int                   `json:"share_ttl_hours"`
+		CreatedBy           string                 `json:"created_by"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Services) == 0 && len(req.TraceIDs) == 0 && len(req.RequestIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one of services, trace_ids or request_ids is required"})
+		return
+	}
+	if req.Source == "" {
+		req.Source = "monitoring-service"
+	}
+
+	firedAt := time.Now().UTC()
+	if req.FiredAt != nil {
+		firedAt = req.FiredAt.UTC()
+	}
+	start := firedAt.Add(-defaultIncidentWindowBefore)
+	end := firedAt.Add(defaultIncidentWindowAfter)
+	if req.WindowBeforeMinutes > 0 {
+		start = firedAt.Add(-time.Duration(req.WindowBeforeMinutes) * time.Minute)
+	}
+	if req.WindowAfterMinutes > 0 {
+		end = firedAt.Add(time.Duration(req.WindowAfterMinutes) * time.Minute)
+	}
+	if req.WindowStart != nil {
+		start = req.WindowStart.UTC()
+	}
+	if req.WindowEnd != nil {
+		end = req.WindowEnd.UTC()
+	}
+	if !end.After(start) || end.Sub(start) > maxIncidentWindow {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("The window must end after it starts and span at most %s", maxIncidentWindow)})
+		return
+	}
+
+	// One bundle per alert firing
+	alertKey := fmt.Sprintf("%s:%s:%d", req.Source, req.AlertID, firedAt.Unix())
+	var existing IncidentBundle
+	err := s.db.Where("alert_key = ?", alertKey).First(&existing).Error
+	if err == nil {
+		c.JSON(http.StatusOK, gin.H{"bundle": existing, "created": false})
+		return
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up bundles"})
+		return
+	}
+
+	// Services' logs in the window, and all logs of the named traces and requests
+	query := s.db.Model(&LogEntry{})
+	var conditions []string
+	var args []interface{}
+	if len(req.Services) > 0 {
+		conditions = append(conditions, "(service IN ? AND timestamp BETWEEN ? AND ?)")
+		args = append(args, req.Services, start, end)
+	}
+	if len(req.TraceIDs) > 0 {
+		conditions = append(conditions, "trace_id IN ?")
+		args = append(args, req.TraceIDs)
+	}
+	if len(req.RequestIDs) > 0 {
+		conditions = append(conditions, "request_id IN ?")
+		args = append(args, req.RequestIDs)
+	}
+	var entries []LogEntry
+	if err := query.Where(strings.Join(conditions, " OR "), args...).
+		Order("timestamp ASC, id ASC").Limit(maxIncidentLogs + 1).Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch logs"})
+		return
+	}
+	truncated := len(entries) > maxIncidentLogs
+	if truncated {
+		entries = entries[:maxIncidentLogs]
+	}
+
+	bundle := &IncidentBundle{
+		ID:          uuid.New().String(),
+		AlertKey:    alertKey,
+		Source:      req.Source,
+		AlertID:     req.AlertID,
+		AlertName:   req.AlertName,
+		Severity:    req.Severity,
+		Summary:     req.Summary,
+		FiredAt:     firedAt,
+		WindowStart: start,
+		WindowEnd:   end,
+		Services:    req.Services,
+		TraceIDs:    req.TraceIDs,
+		RequestIDs:  req.RequestIDs,
+		Labels:      req.Labels,
+		LogCount:    len(entries),
+		Truncated:   truncated,
+		CreatedBy:   req.CreatedBy,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	// The gateway's view of the named requests, when it has one
+	if s.config.GatewayURL != "" {
+		for i, requestID := range req.RequestIDs {
+			if i == maxIncidentGatewayRequests {
+				break
+			}
+			ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+			gatewayLogs, err := s.fetchGatewayRequestLogs(ctx, requestID)
+			cancel()
+			if err != nil {
+				log.Printf("Failed to fetch gateway logs of request %s for incident bundle: %v", requestID, err)
+				continue
+			}
+			bundle.GatewayLogs = append(bundle.GatewayLogs, gatewayLogs...)
+		}
+	}
+
+	logs := make([]IncidentBundleLog, len(entries))
+	for i, entry := range entries {
+		logs[i] = IncidentBundleLog{
+			BundleID:  bundle.ID,
+			Seq:       i,
+			LogID:     entry.ID,
+			Timestamp: entry.Timestamp,
+			Level:     entry.Level,
+			Service:   entry.Service,
+			Message:   entry.Message,
+			Fields:    entry.Fields,
+			TraceID:   entry.TraceID,
+			SpanID:    entry.SpanID,
+			UserID:    entry.UserID,
+			RequestID: entry.RequestID,
+			Source:    entry.Source,
+			Tags:      entry.Tags,
+		}
+	}
+	bundle.Checksum = bundleChecksum(logs)
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(bundle).Error; err != nil {
+			return err
+		}
+		if len(logs) > 0 {
+			return tx.CreateInBatches(logs, incidentLogsPage).Error
+		}
+		return nil
+	})
+	if err != nil {
+		// A concurrent retry of the same firing got there first
+		if s.db.Where("alert_key = ?", alertKey).First(&existing).Error == nil {
+			c.JSON(http.StatusOK, gin.H{"bundle": existing, "created": false})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save incident bundle"})
+		return
+	}
+
+	ttl := time.Duration(s.config.IncidentShareTTLHours) * time.Hour
+	if req.ShareTTLHours != nil {
+		ttl = time.Duration(*req.ShareTTLHours) * time.Hour
+	}
+	share, err := s.issueShareLink(bundle, ttl)
+	if err != nil {
+		log.Printf("Failed to issue share link for incident bundle %s: %v", bundle.ID, err)
+	}
+	incidentBundlesCreated.WithLabelValues(bundle.Source, bundle.Severity).Inc()
+
+	c.JSON(http.StatusCreated, gin.H{"bundle": bundle, "share": share, "created": true})
+}
+
+// List incident bundles
+func (s *LoggingService) listIncidentBundles(c *gin.Context) {
+	query := s.db.Model(&IncidentBundle{})
+	if alertID := c.Query("alert_id"); alertID != "" {
+		query = query.Where("alert_id = ?", alertID)
+	}
+	if alertName := c.Query("alert_name"); alertName != "" {
+		query = query.Where("alert_name = ?", alertName)
+	}
+	if service := c.Query("service"); service != "" {
+		query = query.Where("? = ANY(services)", service)
+	}
+	if since, err := time.Parse(time.RFC3339, c.Query("since")); err == nil {
+		query = query.Where("fired_at >= ?", since)
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+
+	var total int64
+	query.Count(&total)
+	var bundles []IncidentBundle
+	if err := query.Order("fired_at DESC").Limit(limit).Offset(offset).Find(&bundles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch incident bundles"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"bundles": bundles,
+		"total":   total,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// Get an incident bundle with its logs
+func (s *LoggingService) getIncidentBundle(c *gin.Context) {
+	var bundle IncidentBundle
+	if err := s.db.First(&bundle, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Incident bundle not found"})
+		return
+	}
+	s.respondWithBundle(c, &bundle)
+}
+
+// Read a bundle through its share link
+func (s *LoggingService) getSharedIncidentBundle(c *gin.Context) {
+	token := c.Param("token")
+	var bundle IncidentBundle
+	if !strings.HasPrefix(token, incidentShareTokenPrefix) ||
+		s.db.First(&bundle, "share_token_hash = ?", hashShareToken(token)).Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Incident bundle not found"})
+		return
+	}
+	if bundle.ShareExpiresAt != nil && bundle.ShareExpiresAt.Before(time.Now()) {
+		c.JSON(http.StatusGone, gin.H{"error": "Share link has expired"})
+		return
+	}
+	s.respondWithBundle(c, &bundle)
+}
+
+// respondWithBundle sends a bundle with its logs, verified against the
+// checksum taken when it was made
+func (s *LoggingService) respondWithBundle(c *gin.Context, bundle *IncidentBundle) {
+	var logs []IncidentBundleLog
+	if err := s.db.Where("bundle_id = ?", bundle.ID).Order("seq ASC").Find(&logs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch bundled logs"})
+		return
+	}
+	verified := len(logs) == bundle.LogCount && bundleChecksum(logs) == bundle.Checksum
+	if !verified {
+		log.Printf("Incident bundle %s fails verification", bundle.ID)
+	}
+
+	if c.Query("format") == "ndjson" {
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "incident-"+bundle.ID+".ndjson"))
+		c.Header("X-Bundle-Checksum", bundle.Checksum)
+		c.Header("X-Bundle-Verified", strconv.FormatBool(verified))
+		c.Status(http.StatusOK)
+		c.Writer.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(c.Writer)
+		for i := range logs {
+			if err := encoder.Encode(&logs[i]); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"bundle":   bundle,
+		"logs":     logs,
+		"verified": verified,
+	})
+}
+
+// Issue a new share link for a bundle, revoking the previous one
+func (s *LoggingService) shareIncidentBundle(c *gin.Context) {
+	var bundle IncidentBundle
+	if err := s.db.First(&bundle, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Incident bundle not found"})
+		return
+	}
+
+	var req struct {
+		TTLHours *int `json:"ttl_hours"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	ttl := time.Duration(s.config.IncidentShareTTLHours) * time.Hour
+	if req.TTLHours != nil {
+		ttl = time.Duration(*req.TTLHours) * time.Hour
+	}
+
+	share, err := s.issueShareLink(&bundle, ttl)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue share link"})
+		return
+	}
+	c.JSON(http.StatusOK, share)
+}
+
+// Revoke a bundle's share link
+func (s *LoggingService) revokeIncidentShare(c *gin.Context) {
+	result := s.db.Model(&IncidentBundle{}).Where("id = ?", c.Param("id")).Updates(map[string]interface{}{
+		"share_token_hash": "",
+		"share_expires_at": nil,
+	})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share link"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Incident bundle not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Share link revoked successfully"})
+}
@@ -41,6 +41,10 @@ type Config struct {
 	MaxLogSize      int64
 	BatchSize       int
 	FlushInterval   time.Duration
+	GatewayURL        string
+	GatewayAdminToken string
+	IncidentShareBaseURL  string
+	IncidentShareTTLHours int
 }
 
 // Log levels
@@ -94,6 +98,7 @@ type LoggingService struct {
 	router     *gin.Engine
 	httpServer *http.Server
 	logBuffer  chan *LogEntry
+	httpClient *http.Client
 }
 
 // Prometheus metrics
@@ -147,6 +152,10 @@ func main() {
 		MaxLogSize:       parseInt64(getEnv("MAX_LOG_SIZE", "1048576")), // 1MB
 		BatchSize:        parseInt(getEnv("BATCH_SIZE", "100")),
 		FlushInterval:    time.Duration(parseInt(getEnv("FLUSH_INTERVAL", "5"))) * time.Second,
+		GatewayURL:        getEnv("API_GATEWAY_URL", "http://api-gateway-service:8080"),
+		GatewayAdminToken: getEnv("API_GATEWAY_ADMIN_TOKEN", ""),
+		IncidentShareBaseURL:  getEnv("INCIDENT_SHARE_BASE_URL", ""),
+		IncidentShareTTLHours: parseInt(getEnv("INCIDENT_SHARE_TTL_HOURS", "720")),
 	}
 
 	service, err := NewLoggingService(config)
@@ -169,7 +178,7 @@ func NewLoggingService(config *Config) (*LoggingService, error) {
 	}
 
 	// Auto-migrate tables
-	if err := db.AutoMigrate(&LogEntry{}, &LogAlert{}); err != nil {
+	if err := db.AutoMigrate(&LogEntry{}, &LogAlert{}, &LogRetentionPolicy{}, &IncidentBundle{}, &IncidentBundleLog{}); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
@@ -202,6 +211,11 @@ func NewLoggingService(config *Config) (*LoggingService, error) {
 		es:        es,
 		config:    config,
 		logBuffer: make(chan *LogEntry, config.BatchSize*10),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if err := service.initializeRetentionPolicies(); err != nil {
+		return nil, fmt.Errorf("failed to initialize retention policies: %w", err)
 	}
 
 	service.setupRoutes()
@@ -236,6 +250,9 @@ func (s *LoggingService) setupRoutes() {
 		v1.GET("/logs/:id", s.getLog)
 		v1.GET("/logs/stream", s.streamLogs)
 
+		// Cross-service request correlation
+		v1.GET("/requests/:request_id/timeline", s.getRequestTimeline)
+
 		// Log alerts
 		v1.POST("/alerts", s.createLogAlert)
 		v1.GET("/alerts", s.listLogAlerts)
@@ -247,6 +264,21 @@ func (s *LoggingService) setupRoutes() {
 		v1.GET("/analytics/summary", s.getLogSummary)
 		v1.GET("/analytics/trends", s.getLogTrends)
 		v1.GET("/analytics/errors", s.getErrorAnalytics)
+
+		// Retention policies
+		v1.POST("/retention/policies", s.createRetentionPolicy)
+		v1.GET("/retention/policies", s.listRetentionPolicies)
+		v1.PUT("/retention/policies/:id", s.updateRetentionPolicy)
+		v1.DELETE("/retention/policies/:id", s.deleteRetentionPolicy)
+		v1.POST("/retention/simulate", s.simulateRetention)
+
+		// Incident bundles
+		v1.POST("/incidents/bundles", s.createIncidentBundle)
+		v1.GET("/incidents/bundles", s.listIncidentBundles)
+		v1.GET("/incidents/bundles/:id", s.getIncidentBundle)
+		v1.POST("/incidents/bundles/:id/share", s.shareIncidentBundle)
+		v1.DELETE("/incidents/bundles/:id/share", s.revokeIncidentShare)
+		v1.GET("/incidents/shared/:token", s.getSharedIncidentBundle)
 	}
 }
 
@@ -357,21 +389,7 @@ func (s *LoggingService) ingestLog(c *gin.Context) {
 	}
 
 	// Create log entry
-	logEntry := &LogEntry{
-		ID:        uuid.New().String(),
-		Timestamp: time.Now().UTC(),
-		Level:     getString(logData, "level", LogLevelInfo),
-		Service:   getString(logData, "service", "unknown"),
-		Message:   getString(logData, "message", ""),
-		Fields:    getMap(logData, "fields"),
-		TraceID:   getString(logData, "trace_id", ""),
-		SpanID:    getString(logData, "span_id", ""),
-		UserID:    getString(logData, "user_id", ""),
-		RequestID: getString(logData, "request_id", ""),
-		Source:    getString(logData, "source", c.ClientIP()),
-		Tags:      getStringSlice(logData, "tags"),
-		CreatedAt: time.Now().UTC(),
-	}
+	logEntry := newLogEntry(logData, c.ClientIP())
 
 	// Add to buffer for processing
 	select {
@@ -391,6 +409,68 @@ func (s *LoggingService) ingestLog(c *gin.Context) {
 	}
 }
 
+// Batch log ingestion endpoint. Entries are buffered in order; when the
+// buffer fills part way through, the response says how many were accepted
+// so the sender can retry the rest.
+func (s *LoggingService) ingestBatchLogs(c *gin.Context) {
+	var req struct {
+		Logs []map[string]interface{} `json:"logs" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid log batch"})
+		return
+	}
+	if len(req.Logs) > cap(s.logBuffer) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":          "Log batch too large",
+			"max_batch_size": cap(s.logBuffer),
+		})
+		return
+	}
+
+	for i, logData := range req.Logs {
+		logEntry := newLogEntry(logData, c.ClientIP())
+		select {
+		case s.logBuffer <- logEntry:
+			logsIngested.WithLabelValues(logEntry.Service, logEntry.Level).Inc()
+		default:
+			logBufferSize.Set(float64(len(s.logBuffer)))
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error":    "Log buffer full, please try again later",
+				"accepted": i,
+				"rejected": len(req.Logs) - i,
+			})
+			return
+		}
+	}
+	logBufferSize.Set(float64(len(s.logBuffer)))
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"accepted": len(req.Logs),
+		"status":   "accepted",
+	})
+}
+
+// newLogEntry builds a log entry from submitted log data
+func newLogEntry(logData map[string]interface{}, clientIP string) *LogEntry {
+	return &LogEntry{
+		ID:        uuid.New().String(),
+		Timestamp: getTime(logData, "timestamp", time.Now().UTC()),
+		Level:     getString(logData, "level", LogLevelInfo),
+		Service:   getString(logData, "service", "unknown"),
+		Message:   getString(logData, "message", ""),
+		Fields:    getMap(logData, "fields"),
+		TraceID:   getString(logData, "trace_id", ""),
+		SpanID:    getString(logData, "span_id", ""),
+		UserID:    getString(logData, "user_id", ""),
+		RequestID: getString(logData, "request_id", ""),
+		Source:    getString(logData, "source", clientIP),
+		Tags:      getStringSlice(logData, "tags"),
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
 // Background workers
 func (s *LoggingService) startLogProcessor() {
 	batch := make([]*LogEntry, 0, s.config.BatchSize)
@@ -448,6 +528,17 @@ func getString(data map[string]interface{}, key, defaultValue string) string {
 	return defaultValue
 }
 
+// getTime reads an RFC3339 timestamp, so logs keep the time they were
+// written rather than the time they arrived
+func getTime(data map[string]interface{}, key string, defaultValue time.Time) time.Time {
+	if value, ok := data[key].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t.UTC()
+		}
+	}
+	return defaultValue
+}
+
 func getMap(data map[string]interface{}, key string) map[string]interface{} {
 	if value, ok := data[key].(map[string]interface{}); ok {
 		return value
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Tiered log retention. A policy keeps logs matching its levels, services
+// and tags (empty lists match anything) for RetentionDays. When several
+// policies match a log the longest retention wins, so a debug log tagged
+// "security" stays as long as the security policy says; logs no policy
+// matches fall back to LOG_RETENTION_DAYS. The cleanup worker deletes logs
+// past their effective retention, and the simulation endpoint evaluates a
+// candidate policy set against stored logs before it is applied.
+
+const (
+	retentionDeleteBatch = 5000
+
+	// Days of recent ingest used to project steady-state storage
+	retentionProjectionDays = 7
+)
+
+// LogRetentionPolicy keeps matching logs for RetentionDays
+type LogRetentionPolicy struct {
+	ID            string    `json:"id" gorm:"primaryKey"`
+	Name          string    `json:"name" gorm:"uniqueIndex;not null"`
+	Description   string    `json:"description"`
+	Levels        []string  `json:"levels" gorm:"type:text[]"`
+	Services      []string  `json:"services" gorm:"type:text[]"`
+	Tags          []string  `json:"tags" gorm:"type:text[]"`
+	RetentionDays int       `json:"retention_days" gorm:"not null"`
+	IsActive      bool      `json:"is_active" gorm:"default:true"`
+	CreatedBy     string    `json:"created_by"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+var logsExpired = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "logs_expired_total",
+		Help: "Logs deleted by retention policies",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(logsExpired)
+}
+
+// defaultRetentionPolicies are created on first start
+func defaultRetentionPolicies() []LogRetentionPolicy {
+	return []LogRetentionPolicy{
+		{Name: "errors", Description: "Errors and fatal logs", Levels: []string{LogLevelError, LogLevelFatal}, RetentionDays: 90},
+		{Name: "debug", Description: "Debug and trace logs", Levels: []string{LogLevelDebug, LogLevelTrace}, RetentionDays: 3},
+		{Name: "security", Description: "Security-tagged logs", Tags: []string{"security"}, RetentionDays: 365},
+	}
+}
+
+func (s *LoggingService) initializeRetentionPolicies() error {
+	var count int64
+	if err := s.db.Model(&LogRetentionPolicy{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	policies := defaultRetentionPolicies()
+	for i := range policies {
+		policies[i].ID = uuid.New().String()
+		policies[i].IsActive = true
+		policies[i].CreatedBy = "system"
+		policies[i].CreatedAt = now
+		policies[i].UpdatedAt = now
+	}
+	return s.db.Create(&policies).Error
+}
+
+func (s *LoggingService) activeRetentionPolicies() ([]LogRetentionPolicy, error) {
+	var policies []LogRetentionPolicy
+	err := s.db.Where("is_active = ?", true).Find(&policies).Error
+	return policies, err
+}
+
+// retentionExpr builds the effective retention in days of a log_entries row
+// aliased l under the given policies. The returned CTE defines them as
+// relation p, takes the returned arguments and must precede the query using
+// the expression.
+func retentionExpr(policies []LogRetentionPolicy, defaultDays int) (string, []interface{}, string) {
+	var (
+		rows []string
+		args []interface{}
+	)
+	for _, p := range policies {
+		rows = append(rows, "(?::text[], ?::text[], ?::text[], ?::int)")
+		args = append(args, pgTextArray(p.Levels), pgTextArray(p.Services), pgTextArray(p.Tags), p.RetentionDays)
+	}
+	values := "SELECT NULL::text[], NULL::text[], NULL::text[], NULL::int WHERE false"
+	if len(rows) > 0 {
+		values = "VALUES " + strings.Join(rows, ", ")
+	}
+
+	cte := "WITH p(levels, services, tags, days) AS (" + values + ")"
+	expr := fmt.Sprintf(`COALESCE((SELECT MAX(p.days) FROM p
+		WHERE (cardinality(p.levels) = 0 OR l.level = ANY(p.levels))
+		AND (cardinality(p.services) = 0 OR l.service = ANY(p.services))
+		AND (cardinality(p.tags) = 0 OR l.tags && p.tags)), %d)`, defaultDays)
+	return cte, args, expr
+}
+
+// pgTextArray formats a text[] literal, so the query does not depend on the
+// driver's array support
+func pgTextArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		v = strings.ReplaceAll(v, `\`, `\\`)
+		v = strings.ReplaceAll(v, `"`, `\"`)
+		quoted[i] = `"` + v + `"`
+	}
+	return "{" + strings.Join(quoted, ",") + "}"
+}
+
+// minRetentionDays is the shortest retention any log can have, which bounds
+// the rows a sweep has to look at
+func minRetentionDays(policies []LogRetentionPolicy, defaultDays int) int {
+	days := defaultDays
+	for _, p := range policies {
+		if p.RetentionDays < days {
+			days = p.RetentionDays
+		}
+	}
+	return days
+}
+
+// enforceRetention deletes logs past their effective retention
+func (s *LoggingService) enforceRetention() (int64, error) {
+	policies, err := s.activeRetentionPolicies()
+	if err != nil {
+		return 0, err
+	}
+
+	cte, args, expr := retentionExpr(policies, s.config.LogRetentionDays)
+	floor := time.Now().UTC().AddDate(0, 0, -minRetentionDays(policies, s.config.LogRetentionDays))
+	query := cte + `, expired AS (
+		SELECT l.id FROM log_entries l
+		WHERE l.timestamp < ? AND l.timestamp < now() - make_interval(days => ` + expr + `)
+		LIMIT ?)
+		DELETE FROM log_entries WHERE id IN (SELECT id FROM expired)`
+	args = append(args, floor, retentionDeleteBatch)
+
+	var total int64
+	for {
+		result := s.db.Exec(query, args...)
+		if result.Error != nil {
+			return total, result.Error
+		}
+		total += result.RowsAffected
+		logsExpired.Add(float64(result.RowsAffected))
+		if result.RowsAffected < retentionDeleteBatch {
+			return total, nil
+		}
+	}
+}
+
+func (s *LoggingService) startCleanupWorker() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			start := time.Now()
+			deleted, err := s.enforceRetention()
+			if err != nil {
+				log.Printf("Log retention sweep failed: %v", err)
+				continue
+			}
+			logProcessingDuration.WithLabelValues("retention").Observe(time.Since(start).Seconds())
+			if deleted > 0 {
+				log.Printf("Log retention removed %d expired logs", deleted)
+			}
+		}
+	}
+}
+
+// retentionImpact is what a policy set means for stored logs
+type retentionImpact struct {
+	ExpiredLogs      int64 `json:"expired_logs"`
+	ExpiredBytes     int64 `json:"expired_bytes"`
+	RetainedLogs     int64 `json:"retained_logs"`
+	RetainedBytes    int64 `json:"retained_bytes"`
+	ProjectedBytes   int64 `json:"projected_steady_state_bytes"`
+	DailyIngestBytes int64 `json:"daily_ingest_bytes"`
+}
+
+// estimateRetention measures a policy set against the stored logs: what a
+// sweep would delete now, what it would keep, and the storage it settles at
+// given recent ingest
+func (s *LoggingService) estimateRetention(db *gorm.DB, policies []LogRetentionPolicy, defaultDays int) (*retentionImpact, error) {
+	cte, args, expr := retentionExpr(policies, defaultDays)
+
+	var impact retentionImpact
+	query := cte + `
+		SELECT
+			COUNT(*) FILTER (WHERE expired) AS expired_logs,
+			COALESCE(SUM(size) FILTER (WHERE expired), 0) AS expired_bytes,
+			COUNT(*) FILTER (WHERE NOT expired) AS retained_logs,
+			COALESCE(SUM(size) FILTER (WHERE NOT expired), 0) AS retained_bytes
+		FROM (
+			SELECT pg_column_size(l.*)::bigint AS size,
+				l.timestamp < now() - make_interval(days => ` + expr + `) AS expired
+			FROM log_entries l
+		) sized`
+	if err := db.Raw(query, args...).Scan(&impact).Error; err != nil {
+		return nil, err
+	}
+
+	// Each log of a recent day is kept for its effective retention, so the
+	// steady state holds that many days of it
+	var projection struct {
+		DailyIngestBytes int64
+		ProjectedBytes   int64
+	}
+	query = cte + `
+		SELECT
+			COALESCE(SUM(pg_column_size(l.*)::bigint), 0) / ? AS daily_ingest_bytes,
+			COALESCE(SUM(pg_column_size(l.*)::bigint * ` + expr + `), 0) / ? AS projected_bytes
+		FROM log_entries l
+		WHERE l.timestamp >= now() - make_interval(days => ?)`
+	args = append(args, retentionProjectionDays, retentionProjectionDays, retentionProjectionDays)
+	if err := db.Raw(query, args...).Scan(&projection).Error; err != nil {
+		return nil, err
+	}
+	impact.DailyIngestBytes = projection.DailyIngestBytes
+	impact.ProjectedBytes = projection.ProjectedBytes
+
+	return &impact, nil
+}
+
+func validateRetentionPolicy(policy *LogRetentionPolicy) error {
+	if policy.RetentionDays <= 0 {
+		return fmt.Errorf("retention_days must be positive")
+	}
+	for _, level := range policy.Levels {
+		switch level {
+		case LogLevelTrace, LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError, LogLevelFatal:
+		default:
+			return fmt.Errorf("unknown log level %q", level)
+		}
+	}
+	return nil
+}
+
+// Create a retention policy
+func (s *LoggingService) createRetentionPolicy(c *gin.Context) {
+	var policy LogRetentionPolicy
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if policy.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	}
+	if err := validateRetentionPolicy(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now().UTC()
+	policy.ID = uuid.New().String()
+	policy.IsActive = true
+	policy.CreatedBy = c.GetHeader("X-User-ID")
+	policy.CreatedAt = now
+	policy.UpdatedAt = now
+
+	if err := s.db.Create(&policy).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Failed to create retention policy"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, policy)
+}
+
+// List retention policies
+func (s *LoggingService) listRetentionPolicies(c *gin.Context) {
+	var policies []LogRetentionPolicy
+	if err := s.db.Order("retention_days DESC").Find(&policies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list retention policies"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"policies":               policies,
+		"default_retention_days": s.config.LogRetentionDays,
+	})
+}
+
+// Update a retention policy
+func (s *LoggingService) updateRetentionPolicy(c *gin.Context) {
+	var policy LogRetentionPolicy
+	if err := s.db.First(&policy, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retention policy not found"})
+		return
+	}
+
+	var req struct {
+		Description   *string   `json:"description"`
+		Levels        *[]string `json:"levels"`
+		Services      *[]string `json:"services"`
+		Tags          *[]string `json:"tags"`
+		RetentionDays *int      `json:"retention_days"`
+		IsActive      *bool     `json:"is_active"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Description != nil {
+		policy.Description = *req.Description
+	}
+	if req.Levels != nil {
+		policy.Levels = *req.Levels
+	}
+	if req.Services != nil {
+		policy.Services = *req.Services
+	}
+	if req.Tags != nil {
+		policy.Tags = *req.Tags
+	}
+	if req.RetentionDays != nil {
+		policy.RetentionDays = *req.RetentionDays
+	}
+	if req.IsActive != nil {
+		policy.IsActive = *req.IsActive
+	}
+	if err := validateRetentionPolicy(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	policy.UpdatedAt = time.Now().UTC()
+
+	if err := s.db.Save(&policy).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update retention policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// Delete a retention policy
+func (s *LoggingService) deleteRetentionPolicy(c *gin.Context) {
+	result := s.db.Delete(&LogRetentionPolicy{}, "id = ?", c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete retention policy"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retention policy not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Retention policy deleted"})
+}
+
+// Estimate the storage impact of a candidate policy set against the current
+// one. Without policies the current set is evaluated under the given default.
+func (s *LoggingService) simulateRetention(c *gin.Context) {
+	var req struct {
+		Policies             []LogRetentionPolicy `json:"policies"`
+		DefaultRetentionDays int                  `json:"default_retention_days"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	current, err := s.activeRetentionPolicies()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load retention policies"})
+		return
+	}
+
+	proposed := req.Policies
+	if proposed == nil {
+		proposed = current
+	}
+	for i := range proposed {
+		if err := validateRetentionPolicy(&proposed[i]); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("policy %d: %v", i, err)})
+			return
+		}
+	}
+	defaultDays := req.DefaultRetentionDays
+	if defaultDays <= 0 {
+		defaultDays = s.config.LogRetentionDays
+	}
+
+	// Both estimates read the same snapshot
+	var before, after *retentionImpact
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ READ ONLY").Error; err != nil {
+			return err
+		}
+		var err error
+		if before, err = s.estimateRetention(tx, current, s.config.LogRetentionDays); err != nil {
+			return err
+		}
+		after, err = s.estimateRetention(tx, proposed, defaultDays)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to simulate retention"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"current":  before,
+		"proposed": after,
+		"change": gin.H{
+			"expired_logs":                 after.ExpiredLogs - before.ExpiredLogs,
+			"retained_bytes":               after.RetainedBytes - before.RetainedBytes,
+			"projected_steady_state_bytes": after.ProjectedBytes - before.ProjectedBytes,
+		},
+		"default_retention_days": defaultDays,
+	})
+}
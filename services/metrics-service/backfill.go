@@ -0,0 +1,912 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Historical backfill. An import job loads samples exported from another
+// monitoring stack into MetricData, either from an uploaded file or from an
+// object in storage (s3://bucket/key, or an http(s) URL such as a presigned
+// link). Two formats are understood:
+//
+//	ndjson - one {"metric_name", "value", "labels", "timestamp"} per line
+//	csv    - a header naming metric_name, value and timestamp; a labels
+//	         column holds a JSON object, any other column becomes a label
+//
+// Timestamps are RFC 3339 strings or Unix times in seconds or milliseconds.
+// Samples may arrive in any order: each batch is sorted before it is
+// written. A sample is rejected if it fails validation, falls outside the
+// retention period (the cleanup worker would delete it straight away) or
+// lies in the future. A sample with the same metric, labels and timestamp as
+// one already stored is a duplicate; it is skipped, or replaces the stored
+// value when the job asks to overwrite. Jobs run in the background and
+// report their progress as they go.
+
+// Import job statuses
+const (
+	ImportStatusPending   = "pending"
+	ImportStatusRunning   = "running"
+	ImportStatusCompleted = "completed"
+	ImportStatusFailed    = "failed"
+	ImportStatusCancelled = "cancelled"
+)
+
+// Import formats
+const (
+	ImportFormatNDJSON = "ndjson"
+	ImportFormatCSV    = "csv"
+)
+
+// What to do with a sample that is already stored
+const (
+	DuplicateSkip      = "skip"
+	DuplicateOverwrite = "overwrite"
+)
+
+const (
+	importErrorSamples  = 100             // error messages kept on a job
+	importFutureSkew    = 5 * time.Minute // tolerated clock skew for new samples
+	importMaxLineLength = 1 << 20
+)
+
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// MetricImportJob tracks one backfill
+type MetricImportJob struct {
+	ID          string     `json:"id" gorm:"primaryKey"`
+	Format      string     `json:"format" gorm:"not null"`
+	Source      string     `json:"source"` // file name of an upload, or the object's URI
+	OnDuplicate string     `json:"on_duplicate" gorm:"default:skip"`
+	MaxErrors   int        `json:"max_errors"` // fail once this many samples are rejected, 0: never
+	Status      string     `json:"status" gorm:"index"`
+	BytesTotal  int64      `json:"bytes_total"` // 0 when the size is not known up front
+	BytesRead   int64      `json:"bytes_read"`
+	RowsRead    int64      `json:"rows_read"`
+	Imported    int64      `json:"imported"`
+	Overwritten int64      `json:"overwritten"`
+	Duplicates  int64      `json:"duplicates"`
+	Rejected    int64      `json:"rejected"`
+	Errors      []string   `json:"errors" gorm:"type:text[]"`
+	Error       string     `json:"error"`
+	OldestTime  *time.Time `json:"oldest_timestamp"`
+	NewestTime  *time.Time `json:"newest_timestamp"`
+	CreatedBy   string     `json:"created_by"`
+	StartedAt   *time.Time `json:"started_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// Progress is the share of the input read so far, when its size is known
+func (j *MetricImportJob) Progress() float64 {
+	if j.Status == ImportStatusCompleted {
+		return 100
+	}
+	if j.BytesTotal <= 0 {
+		return 0
+	}
+	return math.Min(100, float64(j.BytesRead)*100/float64(j.BytesTotal))
+}
+
+var metricImportSamples = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "metric_import_samples_total",
+		Help: "Samples processed by backfill imports",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(metricImportSamples)
+}
+
+// importRunner limits how many imports run at once and lets them be cancelled
+type importRunner struct {
+	slots   chan struct{}
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+func newImportRunner(concurrency int) *importRunner {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &importRunner{
+		slots:   make(chan struct{}, concurrency),
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+// track registers a job so it can be cancelled before it gets a slot
+func (r *importRunner) track(jobID string) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.mu.Lock()
+	r.cancels[jobID] = cancel
+	r.mu.Unlock()
+	return ctx
+}
+
+func (r *importRunner) untrack(jobID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancel, ok := r.cancels[jobID]; ok {
+		cancel()
+		delete(r.cancels, jobID)
+	}
+}
+
+func (r *importRunner) cancel(jobID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cancel, ok := r.cancels[jobID]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// importSample is one parsed input row
+type importSample struct {
+	line   int64
+	metric string
+	value  float64
+	labels map[string]interface{}
+	ts     time.Time
+}
+
+// seriesKey identifies a sample for deduplication
+func seriesKey(metric string, labels map[string]interface{}, ts time.Time) string {
+	// encoding/json writes map keys in sorted order, so equal label sets
+	// encode the same way
+	encoded, _ := json.Marshal(labels)
+	return metric + "|" + string(encoded) + "|" + strconv.FormatInt(ts.UnixNano(), 10)
+}
+
+// parseImportTimestamp accepts RFC 3339 or Unix seconds or milliseconds
+func parseImportTimestamp(raw interface{}) (time.Time, error) {
+	switch v := raw.(type) {
+	case nil:
+		return time.Time{}, errors.New("timestamp is required")
+	case float64:
+		return unixTimestamp(v), nil
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", v)
+		}
+		return unixTimestamp(f), nil
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return unixTimestamp(f), nil
+		}
+		ts, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", v)
+		}
+		return ts.UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %v", raw)
+}
+
+func unixTimestamp(v float64) time.Time {
+	// Anything past the year 33658 in seconds is taken as milliseconds
+	if math.Abs(v) >= 1e12 {
+		return time.UnixMilli(int64(v)).UTC()
+	}
+	sec, frac := math.Modf(v)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC()
+}
+
+// validateSample checks a sample against the rules every import follows
+func (s *MetricsService) validateSample(sample *importSample, now time.Time) error {
+	if !metricNamePattern.MatchString(sample.metric) {
+		return fmt.Errorf("invalid metric name %q", sample.metric)
+	}
+	if math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+		return fmt.Errorf("value of %s is not a finite number", sample.metric)
+	}
+	for name, value := range sample.labels {
+		if !metricNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		switch value.(type) {
+		case string, float64, bool, json.Number:
+		default:
+			return fmt.Errorf("label %s must be a string, number or boolean", name)
+		}
+	}
+	if sample.ts.After(now.Add(importFutureSkew)) {
+		return fmt.Errorf("timestamp %s is in the future", sample.ts.Format(time.RFC3339))
+	}
+	if s.config.RetentionDays > 0 && sample.ts.Before(now.AddDate(0, 0, -s.config.RetentionDays)) {
+		return fmt.Errorf("timestamp %s is older than the %d day retention period", sample.ts.Format(time.RFC3339), s.config.RetentionDays)
+	}
+	return nil
+}
+
+// sampleReader yields parsed samples from an input stream
+type sampleReader interface {
+	next() (*importSample, error) // io.EOF at the end; other errors reject one row
+}
+
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+	line    int64
+}
+
+func newNDJSONReader(r io.Reader) *ndjsonReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), importMaxLineLength)
+	return &ndjsonReader{scanner: scanner}
+}
+
+func (n *ndjsonReader) next() (*importSample, error) {
+	for n.scanner.Scan() {
+		n.line++
+		text := strings.TrimSpace(n.scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var row struct {
+			MetricName string                 `json:"metric_name"`
+			Value      *float64               `json:"value"`
+			Labels     map[string]interface{} `json:"labels"`
+			Timestamp  interface{}            `json:"timestamp"`
+		}
+		if err := json.Unmarshal([]byte(text), &row); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n.line, err)
+		}
+		if row.Value == nil {
+			return nil, fmt.Errorf("line %d: value is required", n.line)
+		}
+		ts, err := parseImportTimestamp(row.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n.line, err)
+		}
+		return &importSample{line: n.line, metric: row.MetricName, value: *row.Value, labels: row.Labels, ts: ts}, nil
+	}
+	if err := n.scanner.Err(); err != nil {
+		// A line too long to buffer leaves the rest of the input unreadable
+		return nil, &fatalImportError{err}
+	}
+	return nil, io.EOF
+}
+
+type csvReader struct {
+	reader  *csv.Reader
+	columns []string
+	line    int64
+}
+
+func newCSVReader(r io.Reader) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+
+	seen := make(map[string]bool, len(header))
+	for i, column := range header {
+		header[i] = strings.TrimSpace(column)
+		seen[header[i]] = true
+	}
+	for _, required := range []string{"metric_name", "value", "timestamp"} {
+		if !seen[required] {
+			return nil, fmt.Errorf("CSV header has no %s column", required)
+		}
+	}
+	return &csvReader{reader: reader, columns: header, line: 1}, nil
+}
+
+func (c *csvReader) next() (*importSample, error) {
+	record, err := c.reader.Read()
+	c.line++
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, fmt.Errorf("line %d: %v", c.line, err)
+		}
+		return nil, &fatalImportError{err}
+	}
+	if len(record) != len(c.columns) {
+		return nil, fmt.Errorf("line %d: expected %d fields, got %d", c.line, len(c.columns), len(record))
+	}
+
+	sample := &importSample{line: c.line, labels: make(map[string]interface{})}
+	var timestamp string
+	for i, column := range c.columns {
+		field := strings.TrimSpace(record[i])
+		switch column {
+		case "metric_name":
+			sample.metric = field
+		case "value":
+			value, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid value %q", c.line, field)
+			}
+			sample.value = value
+		case "timestamp":
+			timestamp = field
+		case "labels":
+			if field == "" {
+				continue
+			}
+			if err := json.Unmarshal([]byte(field), &sample.labels); err != nil {
+				return nil, fmt.Errorf("line %d: labels must be a JSON object: %v", c.line, err)
+			}
+		default:
+			if field != "" {
+				sample.labels[column] = field
+			}
+		}
+	}
+	ts, err := parseImportTimestamp(timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", c.line, err)
+	}
+	sample.ts = ts
+	return sample, nil
+}
+
+// fatalImportError stops a job rather than rejecting a single row
+type fatalImportError struct{ err error }
+
+func (e *fatalImportError) Error() string { return e.err.Error() }
+
+// Create a metric import job from an upload or an object in storage
+func (s *MetricsService) createImportJob(c *gin.Context) {
+	job := &MetricImportJob{
+		ID:          uuid.New().String(),
+		Format:      c.Query("format"),
+		OnDuplicate: c.DefaultQuery("on_duplicate", DuplicateSkip),
+		MaxErrors:   parseInt(c.DefaultQuery("max_errors", "0")),
+		Status:      ImportStatusPending,
+		CreatedBy:   c.GetHeader("X-User-ID"),
+		CreatedAt:   time.Now().UTC(),
+		UpdatedAt:   time.Now().UTC(),
+	}
+
+	var spooled string
+	mediaType, _, _ := mime.ParseMediaType(c.ContentType())
+	switch mediaType {
+	case "application/json":
+		var req struct {
+			SourceURI   string `json:"source_uri" binding:"required"`
+			Format      string `json:"format"`
+			OnDuplicate string `json:"on_duplicate"`
+			MaxErrors   int    `json:"max_errors" binding:"min=0"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		u, err := url.Parse(req.SourceURI)
+		if err != nil || (u.Scheme != "s3" && u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "source_uri must be an s3://, http:// or https:// URI"})
+			return
+		}
+		if u.Scheme == "s3" && s.config.S3Endpoint == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Object storage is not configured"})
+			return
+		}
+		job.Source = req.SourceURI
+		job.Format = req.Format
+		if req.OnDuplicate != "" {
+			job.OnDuplicate = req.OnDuplicate
+		}
+		job.MaxErrors = req.MaxErrors
+		if job.Format == "" {
+			job.Format = formatFromName(u.Path)
+		}
+
+	case "multipart/form-data":
+		header, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file is required"})
+			return
+		}
+		file, err := header.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read upload"})
+			return
+		}
+		defer file.Close()
+		job.Source = header.Filename
+		if job.Format == "" {
+			job.Format = c.PostForm("format")
+		}
+		if job.Format == "" {
+			job.Format = formatFromName(header.Filename)
+		}
+		if spooled, job.BytesTotal, err = s.spoolImport(job.ID, file); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+	default:
+		// The body is the data itself
+		switch mediaType {
+		case "application/x-ndjson", "application/jsonl":
+			job.Format = ImportFormatNDJSON
+		case "text/csv":
+			job.Format = ImportFormatCSV
+		}
+		job.Source = "upload"
+		body := http.MaxBytesReader(c.Writer, c.Request.Body, int64(s.config.ImportMaxUploadMB)<<20)
+		var err error
+		if spooled, job.BytesTotal, err = s.spoolImport(job.ID, body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if job.Format != ImportFormatNDJSON && job.Format != ImportFormatCSV {
+		os.Remove(spooled)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be ndjson or csv"})
+		return
+	}
+	if job.OnDuplicate != DuplicateSkip && job.OnDuplicate != DuplicateOverwrite {
+		os.Remove(spooled)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "on_duplicate must be skip or overwrite"})
+		return
+	}
+
+	if err := s.db.Create(job).Error; err != nil {
+		os.Remove(spooled)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create import job"})
+		return
+	}
+
+	go s.runImportJob(s.imports.track(job.ID), job, spooled)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"job_id":  job.ID,
+		"status":  job.Status,
+		"message": "Metric import started",
+	})
+}
+
+// formatFromName guesses the format from a file extension
+func formatFromName(name string) string {
+	switch strings.ToLower(filepath.Ext(strings.TrimSuffix(name, ".gz"))) {
+	case ".csv":
+		return ImportFormatCSV
+	case ".ndjson", ".jsonl", ".json":
+		return ImportFormatNDJSON
+	}
+	return ""
+}
+
+// spoolImport copies an upload to disk so the request can return before
+// the import finishes
+func (s *MetricsService) spoolImport(jobID string, r io.Reader) (string, int64, error) {
+	if err := os.MkdirAll(s.config.ImportDir, 0o700); err != nil {
+		return "", 0, fmt.Errorf("failed to prepare import directory: %w", err)
+	}
+	path := filepath.Join(s.config.ImportDir, jobID)
+	file, err := os.Create(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to store upload: %w", err)
+	}
+	defer file.Close()
+
+	limit := int64(s.config.ImportMaxUploadMB) << 20
+	n, err := io.Copy(file, io.LimitReader(r, limit+1))
+	if err == nil && n > limit {
+		err = fmt.Errorf("upload exceeds %d MB", s.config.ImportMaxUploadMB)
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", 0, fmt.Errorf("failed to store upload: %w", err)
+	}
+	if n == 0 {
+		os.Remove(path)
+		return "", 0, errors.New("upload is empty")
+	}
+	return path, n, nil
+}
+
+// openImportSource opens a job's input, reporting its size when known
+func (s *MetricsService) openImportSource(ctx context.Context, job *MetricImportJob, spooled string) (io.ReadCloser, int64, error) {
+	if spooled != "" {
+		file, err := os.Open(spooled)
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		return file, info.Size(), nil
+	}
+
+	u, err := url.Parse(job.Source)
+	if err != nil {
+		return nil, 0, err
+	}
+	if u.Scheme == "s3" {
+		client, err := minio.New(s.config.S3Endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(s.config.S3AccessKey, s.config.S3SecretKey, ""),
+			Secure: s.config.S3UseSSL,
+			Region: s.config.S3Region,
+		})
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to initialize object storage client: %w", err)
+		}
+		key := strings.TrimPrefix(u.Path, "/")
+		info, err := client.StatObject(ctx, u.Host, key, minio.StatObjectOptions{})
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to stat %s: %w", job.Source, err)
+		}
+		object, err := client.GetObject(ctx, u.Host, key, minio.GetObjectOptions{})
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to open %s: %w", job.Source, err)
+		}
+		return object, info.Size, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, job.Source, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch %s: %w", u.Redacted(), err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("failed to fetch %s: %s", u.Redacted(), resp.Status)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// runImportJob reads, validates and stores a job's samples
+func (s *MetricsService) runImportJob(ctx context.Context, job *MetricImportJob, spooled string) {
+	if spooled != "" {
+		defer os.Remove(spooled)
+	}
+	defer s.imports.untrack(job.ID)
+
+	// Wait for a free slot
+	select {
+	case s.imports.slots <- struct{}{}:
+		defer func() { <-s.imports.slots }()
+	case <-ctx.Done():
+		s.finishImportJob(job, ImportStatusCancelled, "")
+		return
+	}
+
+	now := time.Now().UTC()
+	job.Status = ImportStatusRunning
+	job.StartedAt = &now
+	s.saveImportProgress(job)
+
+	err := s.importSamples(ctx, job, spooled)
+	switch {
+	case ctx.Err() != nil:
+		s.finishImportJob(job, ImportStatusCancelled, "")
+	case err != nil:
+		log.Printf("Metric import %s failed: %v", job.ID, err)
+		s.finishImportJob(job, ImportStatusFailed, err.Error())
+	default:
+		s.finishImportJob(job, ImportStatusCompleted, "")
+	}
+}
+
+func (s *MetricsService) importSamples(ctx context.Context, job *MetricImportJob, spooled string) error {
+	source, size, err := s.openImportSource(ctx, job, spooled)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	if size > 0 {
+		job.BytesTotal = size
+	}
+
+	counter := &countingReader{r: source}
+	var reader sampleReader
+	if job.Format == ImportFormatCSV {
+		if reader, err = newCSVReader(counter); err != nil {
+			return err
+		}
+	} else {
+		reader = newNDJSONReader(counter)
+	}
+
+	batch := make([]*importSample, 0, s.config.ImportBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := s.storeImportBatch(ctx, job, batch); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		job.BytesRead = counter.n
+		s.saveImportProgress(job)
+		return nil
+	}
+
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		sample, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		var fatal *fatalImportError
+		if errors.As(err, &fatal) {
+			return fatal.err
+		}
+		job.RowsRead++
+		if err == nil {
+			err = s.validateSample(sample, time.Now().UTC())
+			if err != nil {
+				err = fmt.Errorf("line %d: %v", sample.line, err)
+			}
+		}
+		if err != nil {
+			job.Rejected++
+			metricImportSamples.WithLabelValues("rejected").Inc()
+			if len(job.Errors) < importErrorSamples {
+				job.Errors = append(job.Errors, err.Error())
+			}
+			if job.MaxErrors > 0 && job.Rejected >= int64(job.MaxErrors) {
+				if err := flush(); err != nil {
+					return err
+				}
+				return fmt.Errorf("stopped after %d rejected samples", job.Rejected)
+			}
+			continue
+		}
+
+		batch = append(batch, sample)
+		if len(batch) >= s.config.ImportBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+	job.BytesRead = counter.n
+	return nil
+}
+
+// storeImportBatch writes a batch, skipping or overwriting duplicates
+func (s *MetricsService) storeImportBatch(ctx context.Context, job *MetricImportJob, batch []*importSample) error {
+	// Sorting keeps rows for a series together however the input was ordered
+	sort.SliceStable(batch, func(i, j int) bool {
+		if batch[i].metric != batch[j].metric {
+			return batch[i].metric < batch[j].metric
+		}
+		return batch[i].ts.Before(batch[j].ts)
+	})
+
+	names := make([]string, 0)
+	timestamps := make([]time.Time, 0, len(batch))
+	seenName := make(map[string]bool)
+	seenTime := make(map[int64]bool)
+	for _, sample := range batch {
+		if !seenName[sample.metric] {
+			seenName[sample.metric] = true
+			names = append(names, sample.metric)
+		}
+		if !seenTime[sample.ts.UnixNano()] {
+			seenTime[sample.ts.UnixNano()] = true
+			timestamps = append(timestamps, sample.ts)
+		}
+	}
+
+	var stored []MetricData
+	if err := s.db.WithContext(ctx).
+		Select("id", "metric_name", "labels", "timestamp").
+		Where("metric_name IN ? AND timestamp IN ?", names, timestamps).
+		Find(&stored).Error; err != nil {
+		return fmt.Errorf("failed to check for duplicates: %w", err)
+	}
+	existing := make(map[string]string, len(stored))
+	for _, row := range stored {
+		existing[seriesKey(row.MetricName, row.Labels, row.Timestamp)] = row.ID
+	}
+
+	now := time.Now().UTC()
+	rows := make([]*MetricData, 0, len(batch))
+	inBatch := make(map[string]int, len(batch))
+	overwrites := make(map[string]float64)
+	for _, sample := range batch {
+		key := seriesKey(sample.metric, sample.labels, sample.ts)
+		if id, ok := existing[key]; ok {
+			if job.OnDuplicate == DuplicateOverwrite {
+				overwrites[id] = sample.value
+			} else {
+				job.Duplicates++
+			}
+			continue
+		}
+		if i, ok := inBatch[key]; ok {
+			// Repeated within the input: the last value wins on overwrite
+			if job.OnDuplicate == DuplicateOverwrite {
+				rows[i].Value = sample.value
+			}
+			job.Duplicates++
+			continue
+		}
+		inBatch[key] = len(rows)
+		rows = append(rows, &MetricData{
+			ID:         uuid.New().String(),
+			MetricName: sample.metric,
+			Value:      sample.value,
+			Labels:     sample.labels,
+			Timestamp:  sample.ts,
+			CreatedAt:  now,
+		})
+
+		if job.OldestTime == nil || sample.ts.Before(*job.OldestTime) {
+			ts := sample.ts
+			job.OldestTime = &ts
+		}
+		if job.NewestTime == nil || sample.ts.After(*job.NewestTime) {
+			ts := sample.ts
+			job.NewestTime = &ts
+		}
+	}
+
+	if len(rows) > 0 {
+		if err := s.db.WithContext(ctx).CreateInBatches(rows, len(rows)).Error; err != nil {
+			return fmt.Errorf("failed to store samples: %w", err)
+		}
+	}
+	for id, value := range overwrites {
+		if err := s.db.WithContext(ctx).Model(&MetricData{}).Where("id = ?", id).Update("value", value).Error; err != nil {
+			return fmt.Errorf("failed to overwrite sample: %w", err)
+		}
+	}
+
+	job.Imported += int64(len(rows))
+	job.Overwritten += int64(len(overwrites))
+	metricImportSamples.WithLabelValues("imported").Add(float64(len(rows)))
+	metricImportSamples.WithLabelValues("overwritten").Add(float64(len(overwrites)))
+	metricImportSamples.WithLabelValues("duplicate").Add(float64(len(batch) - len(rows) - len(overwrites)))
+	return nil
+}
+
+func (s *MetricsService) saveImportProgress(job *MetricImportJob) {
+	job.UpdatedAt = time.Now().UTC()
+	if err := s.db.Save(job).Error; err != nil {
+		log.Printf("Failed to save progress of metric import %s: %v", job.ID, err)
+	}
+}
+
+func (s *MetricsService) finishImportJob(job *MetricImportJob, status, message string) {
+	now := time.Now().UTC()
+	job.Status = status
+	job.Error = message
+	job.CompletedAt = &now
+	s.saveImportProgress(job)
+	log.Printf("Metric import %s %s: %d imported, %d overwritten, %d duplicates, %d rejected",
+		job.ID, status, job.Imported, job.Overwritten, job.Duplicates, job.Rejected)
+}
+
+// recoverImportJobs fails jobs left behind by a previous run; their
+// uploads did not survive the restart
+func (s *MetricsService) recoverImportJobs() {
+	result := s.db.Model(&MetricImportJob{}).
+		Where("status IN ?", []string{ImportStatusPending, ImportStatusRunning}).
+		Updates(map[string]interface{}{
+			"status":       ImportStatusFailed,
+			"error":        "interrupted by a service restart",
+			"completed_at": time.Now().UTC(),
+		})
+	if result.Error != nil {
+		log.Printf("Failed to recover metric import jobs: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Marked %d interrupted metric import jobs as failed", result.RowsAffected)
+	}
+}
+
+func importJobView(job *MetricImportJob) gin.H {
+	return gin.H{
+		"job":      job,
+		"progress": job.Progress(),
+	}
+}
+
+// List metric import jobs
+func (s *MetricsService) listImportJobs(c *gin.Context) {
+	query := s.db.Model(&MetricImportJob{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var jobs []MetricImportJob
+	if err := query.Order("created_at DESC").Limit(100).Find(&jobs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list import jobs"})
+		return
+	}
+
+	views := make([]gin.H, 0, len(jobs))
+	for i := range jobs {
+		views = append(views, importJobView(&jobs[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"jobs":  views,
+		"total": len(views),
+	})
+}
+
+// Get a metric import job
+func (s *MetricsService) getImportJob(c *gin.Context) {
+	var job MetricImportJob
+	if err := s.db.First(&job, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Import job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, importJobView(&job))
+}
+
+// Cancel a metric import job
+func (s *MetricsService) cancelImportJob(c *gin.Context) {
+	var job MetricImportJob
+	if err := s.db.First(&job, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Import job not found"})
+		return
+	}
+	if job.Status != ImportStatusPending && job.Status != ImportStatusRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": "Import job is not running"})
+		return
+	}
+	if !s.imports.cancel(job.ID) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Import job is running on another instance"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Import job cancelled"})
+}
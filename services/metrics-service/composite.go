@@ -0,0 +1,1275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Composite metrics. A composite metric is a formula over other metrics,
+// such as
+//
+//	error_rate       = sum(http_errors) / sum(http_requests)
+//	cost_per_request = sum(cost_usd{team="ml"}) / count(inference_requests)
+//
+// A formula combines numbers and series with + - * / and parentheses, plus
+// abs(). A series is a metric name with optional label matchers
+// ({k="v", k!="v"}), wrapped in one of sum, avg, min, max, count or rate to
+// say how its samples are combined within each step; a bare name uses the
+// composite's aggregation. rate is a series' increase over the step, per
+// second. A name that belongs to another composite metric refers to that
+// composite's own values and cannot be aggregated again.
+//
+// Formulas are evaluated step by step over MetricData. When a series has no
+// samples in a step, sum and count series count as 0 as long as some other
+// series in the formula has samples there; otherwise the step is left out.
+// Steps that divide by zero are left out too. A composite may also be
+// materialized: every Interval its finished steps are written back to
+// MetricData under its own name, so dashboards and alerts can read it like
+// any other metric.
+//
+// Composites record the names they reference. A composite cannot be saved
+// if it would close a cycle, and cannot be deleted while another composite
+// references it.
+
+const (
+	compositeMaxPoints       = 11000
+	compositeMaxFormulaLen   = 4096
+	compositeMaterializeTick = 30 * time.Second
+	compositeSourceLabel     = "composite"
+)
+
+var compositeAggregations = map[string]bool{
+	AggregationSum:   true,
+	AggregationAvg:   true,
+	AggregationMin:   true,
+	AggregationMax:   true,
+	AggregationCount: true,
+	AggregationRate:  true,
+}
+
+// CompositeMetric is a metric derived from others by a formula
+type CompositeMetric struct {
+	ID                 string     `json:"id" gorm:"primaryKey"`
+	Name               string     `json:"name" gorm:"uniqueIndex;not null"`
+	Description        string     `json:"description"`
+	Formula            string     `json:"formula" gorm:"not null"`
+	Unit               string     `json:"unit"`
+	Aggregation        string     `json:"aggregation"`  // for bare series names
+	StepSeconds        int        `json:"step_seconds"` // resolution of queries and materialization
+	Materialize        bool       `json:"materialize"`
+	IntervalSeconds    int        `json:"interval_seconds"` // how often to materialize
+	LookbackSeconds    int        `json:"lookback_seconds"` // how far back the first materialization reaches
+	Dependencies       []string   `json:"dependencies" gorm:"type:text[]"`
+	MaterializedUntil  *time.Time `json:"materialized_until"`
+	LastMaterializedAt *time.Time `json:"last_materialized_at"`
+	LastError          string     `json:"last_error"`
+	CreatedBy          string     `json:"created_by"`
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+}
+
+var (
+	compositeEvaluations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "composite_metric_evaluations_total",
+			Help: "Composite metric evaluations by trigger and result",
+		},
+		[]string{"trigger", "result"},
+	)
+
+	compositePointsMaterialized = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "composite_metric_points_materialized_total",
+			Help: "Points written to MetricData by composite metrics",
+		},
+		[]string{"metric"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(compositeEvaluations)
+	prometheus.MustRegister(compositePointsMaterialized)
+}
+
+// Formula parsing
+
+// labelMatcher restricts a series to samples whose label does (not) equal a value
+type labelMatcher struct {
+	Label    string `json:"label"`
+	NotEqual bool   `json:"not_equal,omitempty"`
+	Value    string `json:"value"`
+}
+
+// seriesRef is a metric referenced by a formula
+type seriesRef struct {
+	Name        string
+	Aggregation string // empty for a bare name
+	Matchers    []labelMatcher
+}
+
+// key identifies a series within one evaluation
+func (r *seriesRef) key(defaultAggregation string) string {
+	aggregation := r.Aggregation
+	if aggregation == "" {
+		aggregation = defaultAggregation
+	}
+	var b strings.Builder
+	b.WriteString(aggregation + "(" + r.Name)
+	for _, m := range r.Matchers {
+		op := "="
+		if m.NotEqual {
+			op = "!="
+		}
+		b.WriteString("," + m.Label + op + strconv.Quote(m.Value))
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+type formulaKind int
+
+const (
+	formulaNumber formulaKind = iota
+	formulaSeries
+	formulaBinary
+	formulaNegate
+	formulaAbs
+)
+
+// formulaExpr is a node of a parsed formula
+type formulaExpr struct {
+	kind   formulaKind
+	number float64
+	series *seriesRef
+	op     byte
+	args   []*formulaExpr
+}
+
+// seriesRefs lists the series a formula references, in order of appearance
+func (e *formulaExpr) seriesRefs() []*seriesRef {
+	var refs []*seriesRef
+	var walk func(*formulaExpr)
+	walk = func(n *formulaExpr) {
+		if n.kind == formulaSeries {
+			refs = append(refs, n.series)
+		}
+		for _, arg := range n.args {
+			walk(arg)
+		}
+	}
+	walk(e)
+	return refs
+}
+
+// evaluate computes the formula for one step. lookup returns a series'
+// value in that step; false leaves the step out.
+func (e *formulaExpr) evaluate(lookup func(*seriesRef) (float64, bool)) (float64, bool) {
+	switch e.kind {
+	case formulaNumber:
+		return e.number, true
+	case formulaSeries:
+		return lookup(e.series)
+	case formulaNegate:
+		v, ok := e.args[0].evaluate(lookup)
+		return -v, ok
+	case formulaAbs:
+		v, ok := e.args[0].evaluate(lookup)
+		return math.Abs(v), ok
+	}
+
+	left, ok := e.args[0].evaluate(lookup)
+	if !ok {
+		return 0, false
+	}
+	right, ok := e.args[1].evaluate(lookup)
+	if !ok {
+		return 0, false
+	}
+	var v float64
+	switch e.op {
+	case '+':
+		v = left + right
+	case '-':
+		v = left - right
+	case '*':
+		v = left * right
+	case '/':
+		if right == 0 {
+			return 0, false
+		}
+		v = left / right
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
+	return v, true
+}
+
+// formulaParser is a recursive descent parser over a formula's text
+type formulaParser struct {
+	src string
+	pos int
+}
+
+// parseFormula parses a composite metric formula
+func parseFormula(src string) (*formulaExpr, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, errors.New("formula is empty")
+	}
+	if len(src) > compositeMaxFormulaLen {
+		return nil, fmt.Errorf("formula is longer than %d characters", compositeMaxFormulaLen)
+	}
+	p := &formulaParser{src: src}
+	expr, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos])
+	}
+	if len(expr.seriesRefs()) == 0 {
+		return nil, errors.New("formula does not reference any metric")
+	}
+	return expr, nil
+}
+
+func (p *formulaParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("formula position %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *formulaParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// accept consumes c if it comes next
+func (p *formulaParser) accept(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *formulaParser) expect(c byte) error {
+	if !p.accept(c) {
+		if p.pos >= len(p.src) {
+			return p.errorf("expected %q at end of formula", c)
+		}
+		return p.errorf("expected %q, found %q", c, p.src[p.pos])
+	}
+	return nil
+}
+
+// sum := product (('+' | '-') product)*
+func (p *formulaParser) parseSum() (*formulaExpr, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op byte
+		switch {
+		case p.accept('+'):
+			op = '+'
+		case p.accept('-'):
+			op = '-'
+		default:
+			return left, nil
+		}
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &formulaExpr{kind: formulaBinary, op: op, args: []*formulaExpr{left, right}}
+	}
+}
+
+// product := unary (('*' | '/') unary)*
+func (p *formulaParser) parseProduct() (*formulaExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op byte
+		switch {
+		case p.accept('*'):
+			op = '*'
+		case p.accept('/'):
+			op = '/'
+		default:
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &formulaExpr{kind: formulaBinary, op: op, args: []*formulaExpr{left, right}}
+	}
+}
+
+// unary := '-' unary | primary
+func (p *formulaParser) parseUnary() (*formulaExpr, error) {
+	if p.accept('-') {
+		arg, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &formulaExpr{kind: formulaNegate, args: []*formulaExpr{arg}}, nil
+	}
+	return p.parsePrimary()
+}
+
+// primary := number | '(' sum ')' | 'abs' '(' sum ')' | aggregation '(' selector ')' | selector
+func (p *formulaParser) parsePrimary() (*formulaExpr, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("unexpected end of formula")
+	}
+	c := p.src[p.pos]
+
+	if c == '(' {
+		p.pos++
+		expr, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(')')
+	}
+	if c == '.' || (c >= '0' && c <= '9') {
+		return p.parseNumber()
+	}
+
+	name := p.parseName()
+	if name == "" {
+		return nil, p.errorf("unexpected %q", c)
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == '(' {
+		p.pos++
+		if name == "abs" {
+			arg, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			return &formulaExpr{kind: formulaAbs, args: []*formulaExpr{arg}}, p.expect(')')
+		}
+		if !compositeAggregations[name] {
+			return nil, p.errorf("unknown function %q", name)
+		}
+		p.skipSpace()
+		inner := p.parseName()
+		if inner == "" {
+			return nil, p.errorf("%s() takes a metric name", name)
+		}
+		ref, err := p.parseSelector(inner)
+		if err != nil {
+			return nil, err
+		}
+		ref.Aggregation = name
+		return &formulaExpr{kind: formulaSeries, series: ref}, p.expect(')')
+	}
+
+	ref, err := p.parseSelector(name)
+	if err != nil {
+		return nil, err
+	}
+	return &formulaExpr{kind: formulaSeries, series: ref}, nil
+}
+
+func (p *formulaParser) parseNumber() (*formulaExpr, error) {
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		isExponentSign := (c == '+' || c == '-') && p.pos > start && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E')
+		if !(c >= '0' && c <= '9') && c != '.' && c != 'e' && c != 'E' && !isExponentSign {
+			break
+		}
+		p.pos++
+	}
+	v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+	if err != nil {
+		text := p.src[start:p.pos]
+		p.pos = start
+		return nil, p.errorf("invalid number %q", text)
+	}
+	return &formulaExpr{kind: formulaNumber, number: v}, nil
+}
+
+// parseName reads a metric, function or label name
+func (p *formulaParser) parseName() string {
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (p.pos > start && c >= '0' && c <= '9') {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.src[start:p.pos]
+}
+
+// parseSelector reads the label matchers that may follow a metric name
+func (p *formulaParser) parseSelector(name string) (*seriesRef, error) {
+	if !metricNamePattern.MatchString(name) {
+		return nil, p.errorf("invalid metric name %q", name)
+	}
+	ref := &seriesRef{Name: name}
+	if !p.accept('{') {
+		return ref, nil
+	}
+	if p.accept('}') {
+		return ref, nil
+	}
+	for {
+		p.skipSpace()
+		label := p.parseName()
+		if label == "" {
+			return nil, p.errorf("expected a label name")
+		}
+		matcher := labelMatcher{Label: label}
+		if p.accept('!') {
+			matcher.NotEqual = true
+		}
+		if err := p.expect('='); err != nil {
+			return nil, err
+		}
+		value, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		matcher.Value = value
+		ref.Matchers = append(ref.Matchers, matcher)
+
+		if p.accept('}') {
+			break
+		}
+		if err := p.expect(','); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(ref.Matchers, func(i, j int) bool { return ref.Matchers[i].Label < ref.Matchers[j].Label })
+	return ref, nil
+}
+
+func (p *formulaParser) parseString() (string, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) || p.src[p.pos] != '"' {
+		return "", p.errorf("expected a quoted label value")
+	}
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos += 2
+			continue
+		case '"':
+			p.pos++
+			value, err := strconv.Unquote(p.src[start:p.pos])
+			if err != nil {
+				return "", p.errorf("invalid label value %s", p.src[start:p.pos])
+			}
+			return value, nil
+		}
+		p.pos++
+	}
+	p.pos = start
+	return "", p.errorf("unterminated label value")
+}
+
+// Dependencies
+
+// formulaDependencies lists the distinct metric names a formula references
+func formulaDependencies(expr *formulaExpr) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, ref := range expr.seriesRefs() {
+		if !seen[ref.Name] {
+			seen[ref.Name] = true
+			names = append(names, ref.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// findCompositeCycle returns the cycle through start, if any, in a graph of
+// composite names to the names they reference
+func findCompositeCycle(graph map[string][]string, start string) []string {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(string) []string
+	visit = func(name string) []string {
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range graph[name] {
+			if _, isComposite := graph[dep]; !isComposite {
+				continue
+			}
+			switch state[dep] {
+			case visiting:
+				for i, n := range path {
+					if n == dep {
+						return append(append([]string{}, path[i:]...), dep)
+					}
+				}
+			case unvisited:
+				if cycle := visit(dep); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+		return nil
+	}
+	return visit(start)
+}
+
+// loadComposites returns every composite metric by name
+func (s *MetricsService) loadComposites() (map[string]*CompositeMetric, error) {
+	var list []CompositeMetric
+	if err := s.db.Find(&list).Error; err != nil {
+		return nil, err
+	}
+	composites := make(map[string]*CompositeMetric, len(list))
+	for i := range list {
+		composites[list[i].Name] = &list[i]
+	}
+	return composites, nil
+}
+
+// checkCompositeGraph rejects a composite that would close a cycle or
+// aggregate another composite
+func checkCompositeGraph(composites map[string]*CompositeMetric, metric *CompositeMetric, expr *formulaExpr) error {
+	for _, ref := range expr.seriesRefs() {
+		if ref.Name == metric.Name {
+			return fmt.Errorf("%s references itself", metric.Name)
+		}
+		if _, isComposite := composites[ref.Name]; isComposite && (ref.Aggregation != "" || len(ref.Matchers) > 0) {
+			return fmt.Errorf("%s is a composite metric and cannot be aggregated or filtered by label", ref.Name)
+		}
+	}
+
+	graph := make(map[string][]string, len(composites)+1)
+	for name, composite := range composites {
+		graph[name] = composite.Dependencies
+	}
+	graph[metric.Name] = metric.Dependencies
+	if cycle := findCompositeCycle(graph, metric.Name); cycle != nil {
+		return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return nil
+}
+
+// compositeDependents lists the composites that reference name
+func compositeDependents(composites map[string]*CompositeMetric, name string) []string {
+	var dependents []string
+	for other, composite := range composites {
+		for _, dep := range composite.Dependencies {
+			if dep == name {
+				dependents = append(dependents, other)
+				break
+			}
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+// Evaluation
+
+type compositePoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// compositeEvaluator evaluates formulas over one time range at one step,
+// evaluating each series and composite once
+type compositeEvaluator struct {
+	s          *MetricsService
+	ctx        context.Context
+	composites map[string]*CompositeMetric
+	start      time.Time
+	end        time.Time
+	step       int64 // seconds
+	series     map[string]map[int64]float64
+	evaluated  map[string]map[int64]float64
+	inProgress map[string]bool
+}
+
+func (s *MetricsService) newCompositeEvaluator(ctx context.Context, composites map[string]*CompositeMetric, start, end time.Time, step time.Duration) *compositeEvaluator {
+	return &compositeEvaluator{
+		s:          s,
+		ctx:        ctx,
+		composites: composites,
+		start:      start,
+		end:        end,
+		step:       int64(step / time.Second),
+		series:     make(map[string]map[int64]float64),
+		evaluated:  make(map[string]map[int64]float64),
+		inProgress: make(map[string]bool),
+	}
+}
+
+// aggregationSQL is how a series' samples are combined within a step
+func aggregationSQL(aggregation string) string {
+	switch aggregation {
+	case AggregationSum:
+		return "SUM(value)"
+	case AggregationMin:
+		return "MIN(value)"
+	case AggregationMax:
+		return "MAX(value)"
+	case AggregationCount:
+		return "COUNT(*)"
+	case AggregationRate:
+		return "(MAX(value) - MIN(value)) / ?"
+	}
+	return "AVG(value)"
+}
+
+// loadSeries buckets a raw metric's samples into steps
+func (e *compositeEvaluator) loadSeries(ref *seriesRef, aggregation string) (map[int64]float64, error) {
+	key := ref.key(aggregation)
+	if values, ok := e.series[key]; ok {
+		return values, nil
+	}
+
+	selectArgs := []interface{}{e.step, e.step}
+	if aggregation == AggregationRate {
+		selectArgs = append(selectArgs, e.step)
+	}
+	query := e.s.db.WithContext(e.ctx).Model(&MetricData{}).
+		Select("FLOOR(EXTRACT(EPOCH FROM timestamp) / ?) * ? AS bucket, "+aggregationSQL(aggregation)+" AS value", selectArgs...).
+		Where("metric_name = ? AND timestamp >= ? AND timestamp < ?", ref.Name, e.start, e.end)
+	for _, m := range ref.Matchers {
+		if m.NotEqual {
+			query = query.Where("labels->>? IS DISTINCT FROM ?", m.Label, m.Value)
+		} else {
+			query = query.Where("labels->>? = ?", m.Label, m.Value)
+		}
+	}
+
+	var rows []struct {
+		Bucket float64
+		Value  float64
+	}
+	if err := query.Group("bucket").Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", ref.Name, err)
+	}
+	values := make(map[int64]float64, len(rows))
+	for _, row := range rows {
+		values[int64(row.Bucket)] = row.Value
+	}
+	e.series[key] = values
+	return values, nil
+}
+
+// evaluate computes a composite's value for each step, keyed by the step's
+// start in Unix seconds
+func (e *compositeEvaluator) evaluate(metric *CompositeMetric) (map[int64]float64, error) {
+	if values, ok := e.evaluated[metric.Name]; ok {
+		return values, nil
+	}
+	if e.inProgress[metric.Name] {
+		return nil, fmt.Errorf("dependency cycle through %s", metric.Name)
+	}
+	e.inProgress[metric.Name] = true
+	defer delete(e.inProgress, metric.Name)
+
+	expr, err := parseFormula(metric.Formula)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", metric.Name, err)
+	}
+	values, err := e.evaluateExpr(expr, metric.Aggregation)
+	if err != nil {
+		return nil, err
+	}
+	e.evaluated[metric.Name] = values
+	return values, nil
+}
+
+func (e *compositeEvaluator) evaluateExpr(expr *formulaExpr, defaultAggregation string) (map[int64]float64, error) {
+	if defaultAggregation == "" {
+		defaultAggregation = AggregationAvg
+	}
+
+	type resolved struct {
+		values      map[int64]float64
+		zeroIfEmpty bool
+	}
+	inputs := make(map[*seriesRef]resolved)
+	buckets := make(map[int64]bool)
+	for _, ref := range expr.seriesRefs() {
+		var r resolved
+		if composite, ok := e.composites[ref.Name]; ok {
+			if ref.Aggregation != "" || len(ref.Matchers) > 0 {
+				return nil, fmt.Errorf("%s is a composite metric and cannot be aggregated or filtered by label", ref.Name)
+			}
+			values, err := e.evaluate(composite)
+			if err != nil {
+				return nil, err
+			}
+			r.values = values
+		} else {
+			aggregation := ref.Aggregation
+			if aggregation == "" {
+				aggregation = defaultAggregation
+			}
+			values, err := e.loadSeries(ref, aggregation)
+			if err != nil {
+				return nil, err
+			}
+			r.values = values
+			r.zeroIfEmpty = aggregation == AggregationSum || aggregation == AggregationCount
+		}
+		inputs[ref] = r
+		for bucket := range r.values {
+			buckets[bucket] = true
+		}
+	}
+
+	result := make(map[int64]float64, len(buckets))
+	for bucket := range buckets {
+		v, ok := expr.evaluate(func(ref *seriesRef) (float64, bool) {
+			r := inputs[ref]
+			if v, ok := r.values[bucket]; ok {
+				return v, true
+			}
+			return 0, r.zeroIfEmpty
+		})
+		if ok {
+			result[bucket] = v
+		}
+	}
+	return result, nil
+}
+
+// sortedPoints orders a composite's values by time
+func sortedPoints(values map[int64]float64) []compositePoint {
+	points := make([]compositePoint, 0, len(values))
+	for bucket, v := range values {
+		points = append(points, compositePoint{Timestamp: time.Unix(bucket, 0).UTC(), Value: v})
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Timestamp.Before(points[j].Timestamp) })
+	return points
+}
+
+// parseQueryTime reads a start or end query parameter
+func parseQueryTime(raw string, fallback time.Time) (time.Time, error) {
+	if raw == "" {
+		return fallback, nil
+	}
+	return parseImportTimestamp(raw)
+}
+
+// parseStep reads a step as a duration ("5m") or in seconds
+func parseStep(raw string, fallback int) (time.Duration, error) {
+	if raw == "" {
+		return time.Duration(fallback) * time.Second, nil
+	}
+	if seconds, err := strconv.Atoi(raw); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	step, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid step %q", raw)
+	}
+	return step, nil
+}
+
+// queryRange reads and checks start, end and step query parameters
+func queryRange(c *gin.Context, defaultStep int) (time.Time, time.Time, time.Duration, error) {
+	now := time.Now().UTC()
+	end, err := parseQueryTime(c.Query("end"), now)
+	if err != nil {
+		return time.Time{}, time.Time{}, 0, err
+	}
+	start, err := parseQueryTime(c.Query("start"), end.Add(-time.Hour))
+	if err != nil {
+		return time.Time{}, time.Time{}, 0, err
+	}
+	step, err := parseStep(c.Query("step"), defaultStep)
+	if err != nil {
+		return time.Time{}, time.Time{}, 0, err
+	}
+	if step < time.Second || step%time.Second != 0 {
+		return time.Time{}, time.Time{}, 0, errors.New("step must be a whole number of seconds")
+	}
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, 0, errors.New("end must be after start")
+	}
+	if end.Sub(start)/step > compositeMaxPoints {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("range would return more than %d points; use a larger step", compositeMaxPoints)
+	}
+	// Align to whole steps, so results do not shift with the request time
+	return start.Truncate(step), end, step, nil
+}
+
+// Handlers
+
+type compositeMetricRequest struct {
+	Name            string `json:"name"`
+	Description     string `json:"description"`
+	Formula         string `json:"formula" binding:"required"`
+	Unit            string `json:"unit"`
+	Aggregation     string `json:"aggregation"`
+	StepSeconds     int    `json:"step_seconds"`
+	Materialize     bool   `json:"materialize"`
+	IntervalSeconds int    `json:"interval_seconds"`
+	LookbackSeconds int    `json:"lookback_seconds"`
+}
+
+// applyCompositeRequest validates a request into metric
+func (s *MetricsService) applyCompositeRequest(metric *CompositeMetric, req *compositeMetricRequest) (*formulaExpr, error) {
+	if !metricNamePattern.MatchString(metric.Name) {
+		return nil, fmt.Errorf("invalid metric name %q", metric.Name)
+	}
+	if req.Aggregation != "" && !compositeAggregations[req.Aggregation] {
+		return nil, fmt.Errorf("unknown aggregation %q", req.Aggregation)
+	}
+	if req.StepSeconds < 0 || req.IntervalSeconds < 0 || req.LookbackSeconds < 0 {
+		return nil, errors.New("step, interval and lookback cannot be negative")
+	}
+	expr, err := parseFormula(req.Formula)
+	if err != nil {
+		return nil, err
+	}
+
+	metric.Description = req.Description
+	metric.Formula = req.Formula
+	metric.Unit = req.Unit
+	metric.Aggregation = req.Aggregation
+	if metric.Aggregation == "" {
+		metric.Aggregation = AggregationAvg
+	}
+	metric.StepSeconds = req.StepSeconds
+	if metric.StepSeconds == 0 {
+		metric.StepSeconds = 60
+	}
+	metric.Materialize = req.Materialize
+	metric.IntervalSeconds = req.IntervalSeconds
+	if metric.IntervalSeconds == 0 {
+		metric.IntervalSeconds = 5 * metric.StepSeconds
+	}
+	if metric.IntervalSeconds < metric.StepSeconds {
+		return nil, errors.New("interval_seconds cannot be shorter than step_seconds")
+	}
+	metric.LookbackSeconds = req.LookbackSeconds
+	if metric.LookbackSeconds == 0 {
+		metric.LookbackSeconds = 3600
+	}
+	metric.Dependencies = formulaDependencies(expr)
+	return expr, nil
+}
+
+// Create a composite metric
+func (s *MetricsService) createCompositeMetric(c *gin.Context) {
+	var req compositeMetricRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	metric := CompositeMetric{
+		ID:        uuid.New().String(),
+		Name:      req.Name,
+		CreatedBy: c.GetHeader("X-User-ID"),
+		CreatedAt: time.Now().UTC(),
+		UpdatedAt: time.Now().UTC(),
+	}
+	expr, err := s.applyCompositeRequest(&metric, &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Materialized values land in MetricData under the composite's name
+	var existing int64
+	s.db.Model(&CustomMetric{}).Where("name = ?", metric.Name).Count(&existing)
+	if existing == 0 {
+		s.db.Model(&MetricData{}).Where("metric_name = ?", metric.Name).Count(&existing)
+	}
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A metric with this name already exists"})
+		return
+	}
+
+	composites, err := s.loadComposites()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load composite metrics"})
+		return
+	}
+	if _, ok := composites[metric.Name]; ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "A composite metric with this name already exists"})
+		return
+	}
+	if err := checkCompositeGraph(composites, &metric, expr); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := s.db.Create(&metric).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create composite metric"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, metric)
+}
+
+// List composite metrics
+func (s *MetricsService) listCompositeMetrics(c *gin.Context) {
+	var metrics []CompositeMetric
+	if err := s.db.Order("name ASC").Find(&metrics).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list composite metrics"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"metrics": metrics,
+		"total":   len(metrics),
+	})
+}
+
+// Get a composite metric
+func (s *MetricsService) getCompositeMetric(c *gin.Context) {
+	var metric CompositeMetric
+	if err := s.db.First(&metric, "name = ?", c.Param("name")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Composite metric not found"})
+		return
+	}
+	c.JSON(http.StatusOK, metric)
+}
+
+// Update a composite metric's formula and settings
+func (s *MetricsService) updateCompositeMetric(c *gin.Context) {
+	var req compositeMetricRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	composites, err := s.loadComposites()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load composite metrics"})
+		return
+	}
+	current, ok := composites[c.Param("name")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Composite metric not found"})
+		return
+	}
+
+	metric := *current
+	expr, err := s.applyCompositeRequest(&metric, &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkCompositeGraph(composites, &metric, expr); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Values materialized so far came from the old formula; later steps use
+	// the new one
+	metric.LastError = ""
+	metric.UpdatedAt = time.Now().UTC()
+
+	if err := s.db.Save(&metric).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update composite metric"})
+		return
+	}
+	c.JSON(http.StatusOK, metric)
+}
+
+// Delete a composite metric no other composite depends on
+func (s *MetricsService) deleteCompositeMetric(c *gin.Context) {
+	composites, err := s.loadComposites()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load composite metrics"})
+		return
+	}
+	metric, ok := composites[c.Param("name")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Composite metric not found"})
+		return
+	}
+	if dependents := compositeDependents(composites, metric.Name); len(dependents) > 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":      "Composite metric is referenced by other composite metrics",
+			"dependents": dependents,
+		})
+		return
+	}
+
+	if err := s.db.Delete(metric).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete composite metric"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Composite metric deleted"})
+}
+
+// Get what a composite metric depends on, directly and transitively, and
+// what depends on it
+func (s *MetricsService) getCompositeDependencies(c *gin.Context) {
+	composites, err := s.loadComposites()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load composite metrics"})
+		return
+	}
+	metric, ok := composites[c.Param("name")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Composite metric not found"})
+		return
+	}
+
+	rawSet := make(map[string]bool)
+	compositeSet := make(map[string]bool)
+	var walk func(*CompositeMetric)
+	walk = func(m *CompositeMetric) {
+		for _, dep := range m.Dependencies {
+			if dependency, ok := composites[dep]; ok {
+				if !compositeSet[dep] {
+					compositeSet[dep] = true
+					walk(dependency)
+				}
+			} else {
+				rawSet[dep] = true
+			}
+		}
+	}
+	walk(metric)
+
+	setToList := func(set map[string]bool) []string {
+		list := make([]string, 0, len(set))
+		for name := range set {
+			list = append(list, name)
+		}
+		sort.Strings(list)
+		return list
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"metric":       metric.Name,
+		"direct":       metric.Dependencies,
+		"composites":   setToList(compositeSet),
+		"base_metrics": setToList(rawSet),
+		"dependents":   compositeDependents(composites, metric.Name),
+	})
+}
+
+// Evaluate a composite metric over a time range
+func (s *MetricsService) queryCompositeMetric(c *gin.Context) {
+	composites, err := s.loadComposites()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load composite metrics"})
+		return
+	}
+	metric, ok := composites[c.Param("name")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Composite metric not found"})
+		return
+	}
+	start, end, step, err := queryRange(c, metric.StepSeconds)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	began := time.Now()
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+	values, err := s.newCompositeEvaluator(ctx, composites, start, end, step).evaluate(metric)
+	queryExecutionDuration.WithLabelValues("composite").Observe(time.Since(began).Seconds())
+	if err != nil {
+		compositeEvaluations.WithLabelValues("query", "error").Inc()
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	compositeEvaluations.WithLabelValues("query", "success").Inc()
+
+	c.JSON(http.StatusOK, gin.H{
+		"metric":  metric.Name,
+		"formula": metric.Formula,
+		"unit":    metric.Unit,
+		"start":   start,
+		"end":     end,
+		"step":    int(step / time.Second),
+		"points":  sortedPoints(values),
+	})
+}
+
+// Evaluate a formula without saving it
+func (s *MetricsService) evaluateFormula(c *gin.Context) {
+	var req struct {
+		Formula     string `json:"formula" binding:"required"`
+		Aggregation string `json:"aggregation"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Aggregation != "" && !compositeAggregations[req.Aggregation] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown aggregation %q", req.Aggregation)})
+		return
+	}
+	expr, err := parseFormula(req.Formula)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	start, end, step, err := queryRange(c, 60)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	composites, err := s.loadComposites()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load composite metrics"})
+		return
+	}
+
+	began := time.Now()
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+	values, err := s.newCompositeEvaluator(ctx, composites, start, end, step).evaluateExpr(expr, req.Aggregation)
+	queryExecutionDuration.WithLabelValues("composite").Observe(time.Since(began).Seconds())
+	if err != nil {
+		compositeEvaluations.WithLabelValues("adhoc", "error").Inc()
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+	compositeEvaluations.WithLabelValues("adhoc", "success").Inc()
+
+	c.JSON(http.StatusOK, gin.H{
+		"formula":      req.Formula,
+		"dependencies": formulaDependencies(expr),
+		"start":        start,
+		"end":          end,
+		"step":         int(step / time.Second),
+		"points":       sortedPoints(values),
+	})
+}
+
+// Materialization
+
+func (s *MetricsService) startCompositeMaterializer() {
+	ticker := time.NewTicker(compositeMaterializeTick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.materializeComposites()
+	}
+}
+
+func (s *MetricsService) materializeComposites() {
+	composites, err := s.loadComposites()
+	if err != nil {
+		log.Printf("Failed to load composite metrics: %v", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, metric := range composites {
+		if !metric.Materialize {
+			continue
+		}
+		if metric.LastMaterializedAt != nil && now.Sub(*metric.LastMaterializedAt) < time.Duration(metric.IntervalSeconds)*time.Second {
+			continue
+		}
+		// One instance materializes each composite per interval
+		lockKey := "composite:materialize:" + metric.Name
+		locked, err := s.redis.SetNX(context.Background(), lockKey, 1, time.Duration(metric.IntervalSeconds)*time.Second).Result()
+		if err != nil || !locked {
+			continue
+		}
+		s.materializeComposite(composites, metric, now)
+	}
+}
+
+// materializeComposite writes the composite's finished steps since it last
+// ran to MetricData
+func (s *MetricsService) materializeComposite(composites map[string]*CompositeMetric, metric *CompositeMetric, now time.Time) {
+	step := time.Duration(metric.StepSeconds) * time.Second
+	// Only whole steps that have ended
+	end := now.Truncate(step)
+	start := end.Add(-time.Duration(metric.LookbackSeconds) * time.Second).Truncate(step)
+	if metric.MaterializedUntil != nil && metric.MaterializedUntil.After(start) {
+		start = *metric.MaterializedUntil
+	}
+	// Do not fall further behind than the retention period
+	if oldest := now.AddDate(0, 0, -s.config.RetentionDays).Truncate(step); start.Before(oldest) {
+		start = oldest
+	}
+	if limit := end.Add(-step * compositeMaxPoints); start.Before(limit) {
+		start = limit
+	}
+
+	updates := map[string]interface{}{"last_materialized_at": now}
+	if !end.After(start) {
+		s.db.Model(metric).Updates(updates)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	values, err := s.newCompositeEvaluator(ctx, composites, start, end, step).evaluate(metric)
+	if err != nil {
+		compositeEvaluations.WithLabelValues("materialize", "error").Inc()
+		log.Printf("Failed to materialize composite metric %s: %v", metric.Name, err)
+		updates["last_error"] = err.Error()
+		s.db.Model(metric).Updates(updates)
+		return
+	}
+
+	points := sortedPoints(values)
+	rows := make([]MetricData, 0, len(points))
+	for _, point := range points {
+		rows = append(rows, MetricData{
+			ID:         uuid.New().String(),
+			MetricName: metric.Name,
+			Value:      point.Value,
+			Labels:     map[string]interface{}{"source": compositeSourceLabel},
+			Timestamp:  point.Timestamp,
+			CreatedAt:  now,
+		})
+	}
+	if len(rows) > 0 {
+		if err := s.db.CreateInBatches(rows, s.config.ImportBatchSize).Error; err != nil {
+			compositeEvaluations.WithLabelValues("materialize", "error").Inc()
+			log.Printf("Failed to store composite metric %s: %v", metric.Name, err)
+			updates["last_error"] = err.Error()
+			s.db.Model(metric).Updates(updates)
+			return
+		}
+	}
+	compositeEvaluations.WithLabelValues("materialize", "success").Inc()
+	compositePointsMaterialized.WithLabelValues(metric.Name).Add(float64(len(rows)))
+
+	updates["materialized_until"] = end
+	updates["last_error"] = ""
+	s.db.Model(metric).Updates(updates)
+}
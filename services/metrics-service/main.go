@@ -44,6 +44,15 @@ type Config struct {
 	RetentionDays  int
 	SampleInterval time.Duration
 	AlertThreshold float64
+	ImportDir         string
+	ImportMaxUploadMB int
+	ImportBatchSize   int
+	ImportConcurrency int
+	S3Endpoint        string
+	S3AccessKey       string
+	S3SecretKey       string
+	S3Region          string
+	S3UseSSL          bool
 }
 
 // Metric types
@@ -136,6 +145,7 @@ type MetricsService struct {
 	router         *gin.Engine
 	httpServer     *http.Server
 	customMetrics  map[string]*prometheus.MetricVec
+	imports        *importRunner
 }
 
 // Prometheus metrics for the service itself
@@ -196,6 +206,15 @@ func main() {
 		RetentionDays:  parseInt(getEnv("RETENTION_DAYS", "30")),
 		SampleInterval: time.Duration(parseInt(getEnv("SAMPLE_INTERVAL", "15"))) * time.Second,
 		AlertThreshold: parseFloat(getEnv("ALERT_THRESHOLD", "0.8")),
+		ImportDir:         getEnv("IMPORT_DIR", os.TempDir()+"/metric-imports"),
+		ImportMaxUploadMB: parseInt(getEnv("IMPORT_MAX_UPLOAD_MB", "512")),
+		ImportBatchSize:   parseInt(getEnv("IMPORT_BATCH_SIZE", "1000")),
+		ImportConcurrency: parseInt(getEnv("IMPORT_CONCURRENCY", "2")),
+		S3Endpoint:        getEnv("S3_ENDPOINT", ""),
+		S3AccessKey:       getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey:       getEnv("S3_SECRET_KEY", ""),
+		S3Region:          getEnv("S3_REGION", "us-east-1"),
+		S3UseSSL:          getEnv("S3_USE_SSL", "true") == "true",
 	}
 
 	service, err := NewMetricsService(config)
@@ -218,7 +237,7 @@ func NewMetricsService(config *Config) (*MetricsService, error) {
 	}
 
 	// Auto-migrate tables
-	if err := db.AutoMigrate(&CustomMetric{}, &MetricData{}, &Dashboard{}, &DashboardWidget{}, &Alert{}); err != nil {
+	if err := db.AutoMigrate(&CustomMetric{}, &MetricData{}, &Dashboard{}, &DashboardWidget{}, &Alert{}, &MetricImportJob{}, &CompositeMetric{}); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
@@ -251,6 +270,7 @@ func NewMetricsService(config *Config) (*MetricsService, error) {
 		prometheusAPI: prometheusAPI,
 		config:        config,
 		customMetrics: make(map[string]*prometheus.MetricVec),
+		imports:       newImportRunner(config.ImportConcurrency),
 	}
 
 	service.setupRoutes()
@@ -283,10 +303,26 @@ func (s *MetricsService) setupRoutes() {
 		v1.PUT("/metrics/custom/:name", s.updateCustomMetric)
 		v1.DELETE("/metrics/custom/:name", s.deleteCustomMetric)
 
+		// Composite metrics
+		v1.POST("/metrics/composite", s.createCompositeMetric)
+		v1.GET("/metrics/composite", s.listCompositeMetrics)
+		v1.POST("/metrics/composite/evaluate", s.evaluateFormula)
+		v1.GET("/metrics/composite/:name", s.getCompositeMetric)
+		v1.PUT("/metrics/composite/:name", s.updateCompositeMetric)
+		v1.DELETE("/metrics/composite/:name", s.deleteCompositeMetric)
+		v1.GET("/metrics/composite/:name/query", s.queryCompositeMetric)
+		v1.GET("/metrics/composite/:name/dependencies", s.getCompositeDependencies)
+
 		// Metric data ingestion
 		v1.POST("/metrics/data", s.ingestMetricData)
 		v1.POST("/metrics/data/batch", s.ingestBatchMetricData)
 
+		// Historical backfill
+		v1.POST("/metrics/import", s.createImportJob)
+		v1.GET("/metrics/imports", s.listImportJobs)
+		v1.GET("/metrics/imports/:id", s.getImportJob)
+		v1.POST("/metrics/imports/:id/cancel", s.cancelImportJob)
+
 		// Metric queries
 		v1.GET("/metrics/query", s.queryMetrics)
 		v1.POST("/metrics/query", s.queryMetricsAdvanced)
@@ -325,11 +361,14 @@ func (s *MetricsService) Start() error {
 		return fmt.Errorf("failed to load custom metrics: %w", err)
 	}
 
+	s.recoverImportJobs()
+
 	// Start background workers
 	go s.startMetricsSampler()
 	go s.startAlertProcessor()
 	go s.startCleanupWorker()
 	go s.startMetricsUpdater()
+	go s.startCompositeMaterializer()
 
 	// Start HTTP server
 	s.httpServer = &http.Server{
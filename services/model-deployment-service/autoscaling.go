@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Autoscaling on inference metrics. A deployment's HorizontalPodAutoscaler
+// scales on CPU unless metrics are configured for it, which may be:
+//
+//	cpu, memory      - utilization percent of the pods' requests (metrics-server)
+//	rps              - requests per second per pod
+//	queue_depth      - requests waiting per pod, or with source "external" a
+//	                   queue's backlog, divided among the pods
+//	gpu_utilization  - GPU utilization percent per pod, from DCGM
+//	custom           - any pods or external metric, by name
+//
+// All but cpu and memory come through the custom or external metrics API,
+// so an adapter (prometheus-adapter, KEDA) has to serve them. Before an HPA
+// is changed, each metric is checked: its metrics API must be registered
+// and serving, and the metric must be listed by it. A metric with no value
+// for the deployment's pods yet is reported but not refused, since new pods
+// take a while to be scraped. Deployments on the keda autoscaler scale on
+// the same metrics through a ScaledObject instead, see keda.go.
+
+// Autoscaling metric types
+const (
+	ScaleMetricCPU            = "cpu"
+	ScaleMetricMemory         = "memory"
+	ScaleMetricRPS            = "rps"
+	ScaleMetricQueueDepth     = "queue_depth"
+	ScaleMetricGPUUtilization = "gpu_utilization"
+	ScaleMetricCustom         = "custom"
+)
+
+// Where a metric comes from
+const (
+	ScaleSourceResource = "resource"
+	ScaleSourcePods     = "pods"
+	ScaleSourceExternal = "external"
+)
+
+const (
+	resourceMetricsAPI = "metrics.k8s.io/v1beta1"
+	customMetricsAPI   = "custom.metrics.k8s.io/v1beta1"
+	externalMetricsAPI = "external.metrics.k8s.io/v1beta1"
+	maxScaleMetrics    = 10
+)
+
+// AutoscalingMetric is one metric a deployment's HPA scales on
+type AutoscalingMetric struct {
+	ID           uint              `json:"id" gorm:"primaryKey"`
+	DeploymentID uint              `json:"deployment_id" gorm:"index;not null"`
+	Type         string            `json:"type" gorm:"not null"`
+	Source       string            `json:"source"`
+	MetricName   string            `json:"metric_name"`
+	Selector     map[string]string `json:"selector,omitempty" gorm:"type:jsonb;serializer:json"` // labels of an external metric
+	Target       string            `json:"target" gorm:"not null"`                               // percent for cpu and memory, else a per-pod quantity
+	CreatedAt    time.Time         `json:"created_at"`
+}
+
+// metricCheck is the outcome of checking one metric's pipeline
+type metricCheck struct {
+	Metric  string `json:"metric"`
+	OK      bool   `json:"ok"`
+	Warning bool   `json:"warning,omitempty"`
+	Message string `json:"message"`
+}
+
+// normalizeScaleMetric fills in a metric's source and name and checks its
+// target
+func normalizeScaleMetric(metric *AutoscalingMetric, deployment *ModelDeployment) error {
+	switch metric.Type {
+	case ScaleMetricCPU, ScaleMetricMemory:
+		metric.Source = ScaleSourceResource
+		metric.MetricName = metric.Type
+		if percent, err := strconv.Atoi(metric.Target); err != nil || percent < 1 || percent > 1000 {
+			return fmt.Errorf("%s target must be a utilization percent", metric.Type)
+		}
+		return nil
+	case ScaleMetricRPS:
+		metric.Source = ScaleSourcePods
+		if metric.MetricName == "" {
+			metric.MetricName = getEnv("HPA_RPS_METRIC", "inference_requests_per_second")
+		}
+	case ScaleMetricQueueDepth:
+		if metric.Source != ScaleSourceExternal {
+			metric.Source = ScaleSourcePods
+		}
+		if metric.MetricName == "" {
+			if metric.Source == ScaleSourceExternal {
+				return fmt.Errorf("an external queue_depth metric needs metric_name")
+			}
+			metric.MetricName = getEnv("HPA_QUEUE_DEPTH_METRIC", "inference_queue_depth")
+		}
+	case ScaleMetricGPUUtilization:
+		if deployment.GPU == 0 {
+			return fmt.Errorf("gpu_utilization needs a deployment with GPUs")
+		}
+		metric.Source = ScaleSourcePods
+		if metric.MetricName == "" {
+			metric.MetricName = getEnv("HPA_GPU_METRIC", "DCGM_FI_DEV_GPU_UTIL")
+		}
+	case ScaleMetricCustom:
+		if metric.Source != ScaleSourcePods && metric.Source != ScaleSourceExternal {
+			return fmt.Errorf("a custom metric's source must be pods or external")
+		}
+		if metric.MetricName == "" {
+			return fmt.Errorf("a custom metric needs metric_name")
+		}
+	default:
+		return fmt.Errorf("unknown metric type %q", metric.Type)
+	}
+
+	if metric.Source != ScaleSourceExternal {
+		metric.Selector = nil
+	}
+	for key, value := range metric.Selector {
+		if _, err := labels.NewRequirement(key, "=", []string{value}); err != nil {
+			return fmt.Errorf("invalid selector %s=%s: %w", key, value, err)
+		}
+	}
+	target, err := resource.ParseQuantity(metric.Target)
+	if err != nil || target.Sign() <= 0 {
+		return fmt.Errorf("%s target must be a positive quantity", metric.Type)
+	}
+	return nil
+}
+
+// metricSpec is the HPA form of a metric
+func metricSpec(metric *AutoscalingMetric) autoscalingv2.MetricSpec {
+	switch metric.Source {
+	case ScaleSourceResource:
+		value, _ := strconv.Atoi(metric.Target)
+		percent := int32(value)
+		name := corev1.ResourceCPU
+		if metric.Type == ScaleMetricMemory {
+			name = corev1.ResourceMemory
+		}
+		return autoscalingv2.MetricSpec{
+			Type: autoscalingv2.ResourceMetricSourceType,
+			Resource: &autoscalingv2.ResourceMetricSource{
+				Name: name,
+				Target: autoscalingv2.MetricTarget{
+					Type:               autoscalingv2.UtilizationMetricType,
+					AverageUtilization: &percent,
+				},
+			},
+		}
+	case ScaleSourceExternal:
+		target := resource.MustParse(metric.Target)
+		identifier := autoscalingv2.MetricIdentifier{Name: metric.MetricName}
+		if len(metric.Selector) > 0 {
+			identifier.Selector = &metav1.LabelSelector{MatchLabels: metric.Selector}
+		}
+		return autoscalingv2.MetricSpec{
+			Type: autoscalingv2.ExternalMetricSourceType,
+			External: &autoscalingv2.ExternalMetricSource{
+				Metric: identifier,
+				Target: autoscalingv2.MetricTarget{
+					Type:         autoscalingv2.AverageValueMetricType,
+					AverageValue: &target,
+				},
+			},
+		}
+	}
+	target := resource.MustParse(metric.Target)
+	return autoscalingv2.MetricSpec{
+		Type: autoscalingv2.PodsMetricSourceType,
+		Pods: &autoscalingv2.PodsMetricSource{
+			Metric: autoscalingv2.MetricIdentifier{Name: metric.MetricName},
+			Target: autoscalingv2.MetricTarget{
+				Type:         autoscalingv2.AverageValueMetricType,
+				AverageValue: &target,
+			},
+		},
+	}
+}
+
+// buildHPA describes a deployment's HPA; without metrics it scales on CPU
+func buildHPA(deployment *ModelDeployment, metrics []AutoscalingMetric) *autoscalingv2.HorizontalPodAutoscaler {
+	if len(metrics) == 0 {
+		metrics = []AutoscalingMetric{{Type: ScaleMetricCPU, Source: ScaleSourceResource, Target: fmt.Sprint(deployment.TargetCPU)}}
+	}
+	specs := make([]autoscalingv2.MetricSpec, 0, len(metrics))
+	for i := range metrics {
+		specs = append(specs, metricSpec(&metrics[i]))
+	}
+
+	scaleUpWindow := int32(deployment.ScaleUpStabilizationSeconds)
+	scaleDownWindow := int32(deployment.ScaleDownStabilizationSeconds)
+	return &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      deployment.Name,
+			Namespace: namespaceOf(deployment),
+			Labels: map[string]string{
+				"app":        deployment.Name,
+				"managed-by": "002aic-platform",
+			},
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       deployment.Name,
+			},
+			MinReplicas: int32Ptr(int32(deployment.MinReplicas)),
+			MaxReplicas: int32(deployment.MaxReplicas),
+			Metrics:     specs,
+			Behavior: &autoscalingv2.HorizontalPodAutoscalerBehavior{
+				ScaleUp:   &autoscalingv2.HPAScalingRules{StabilizationWindowSeconds: &scaleUpWindow},
+				ScaleDown: &autoscalingv2.HPAScalingRules{StabilizationWindowSeconds: &scaleDownWindow},
+			},
+		},
+	}
+}
+
+// applyHPA creates, updates or removes the deployment's HPA
+func (ds *ModelDeploymentService) applyHPA(ctx context.Context, deployment *ModelDeployment, metrics []AutoscalingMetric) error {
+	client := ds.k8sClient.AutoscalingV2().HorizontalPodAutoscalers(namespaceOf(deployment))
+	if !deployment.AutoScaling {
+		err := client.Delete(ctx, deployment.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete HPA: %w", err)
+		}
+		return nil
+	}
+
+	desired := buildHPA(deployment, metrics)
+	existing, err := client.Get(ctx, deployment.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if _, err := client.Create(ctx, desired, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create HPA: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get HPA: %w", err)
+	}
+	existing.Spec = desired.Spec
+	if _, err := client.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update HPA: %w", err)
+	}
+	return nil
+}
+
+// servedMetrics lists what a metrics API serves, or why it can't be used
+func (ds *ModelDeploymentService) servedMetrics(groupVersion string) (map[string]bool, error) {
+	list, err := ds.k8sClient.Discovery().ServerResourcesForGroupVersion(groupVersion)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not available (%v); install an adapter that serves it", groupVersion, err)
+	}
+	served := make(map[string]bool, len(list.APIResources))
+	for _, r := range list.APIResources {
+		served[r.Name] = true
+	}
+	return served, nil
+}
+
+// currentMetricValues reads a metric's values for the deployment's pods,
+// or an external metric's for its selector
+func (ds *ModelDeploymentService) currentMetricValues(ctx context.Context, deployment *ModelDeployment, metric *AutoscalingMetric) (int, error) {
+	request := ds.k8sClient.Discovery().RESTClient().Get()
+	if metric.Source == ScaleSourceExternal {
+		request = request.AbsPath("/apis/"+externalMetricsAPI, "namespaces", namespaceOf(deployment), metric.MetricName)
+		if len(metric.Selector) > 0 {
+			request = request.Param("labelSelector", labels.SelectorFromSet(metric.Selector).String())
+		}
+	} else {
+		request = request.AbsPath("/apis/"+customMetricsAPI, "namespaces", namespaceOf(deployment), "pods", "*", metric.MetricName).
+			Param("labelSelector", "app="+deployment.Name)
+	}
+	raw, err := request.DoRaw(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var values struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return 0, err
+	}
+	return len(values.Items), nil
+}
+
+// checkScaleMetrics checks that every metric's pipeline is in place
+func (ds *ModelDeploymentService) checkScaleMetrics(ctx context.Context, deployment *ModelDeployment, metrics []AutoscalingMetric) ([]metricCheck, bool) {
+	apis := make(map[string]map[string]bool)
+	apiErrors := make(map[string]error)
+	served := func(groupVersion string) (map[string]bool, error) {
+		if _, checked := apis[groupVersion]; !checked {
+			if _, failed := apiErrors[groupVersion]; !failed {
+				list, err := ds.servedMetrics(groupVersion)
+				if err != nil {
+					apiErrors[groupVersion] = err
+				} else {
+					apis[groupVersion] = list
+				}
+			}
+		}
+		return apis[groupVersion], apiErrors[groupVersion]
+	}
+
+	checks := make([]metricCheck, 0, len(metrics))
+	ok := true
+	for i := range metrics {
+		metric := &metrics[i]
+		check := metricCheck{Metric: metric.Type + ":" + metric.MetricName}
+
+		switch metric.Source {
+		case ScaleSourceResource:
+			if _, err := served(resourceMetricsAPI); err != nil {
+				check.Message = err.Error()
+			} else {
+				check.OK = true
+				check.Message = "served by " + resourceMetricsAPI
+			}
+		default:
+			groupVersion, resourceName := customMetricsAPI, "pods/"+metric.MetricName
+			if metric.Source == ScaleSourceExternal {
+				groupVersion, resourceName = externalMetricsAPI, metric.MetricName
+			}
+			list, err := served(groupVersion)
+			switch {
+			case err != nil:
+				check.Message = err.Error()
+			case !list[resourceName] && !list[strings.ToLower(resourceName)]:
+				check.Message = fmt.Sprintf("%s does not serve %s; add a rule for it to the metrics adapter", groupVersion, resourceName)
+			default:
+				check.OK = true
+				check.Message = "served by " + groupVersion
+				if n, err := ds.currentMetricValues(ctx, deployment, metric); err != nil || n == 0 {
+					check.Warning = true
+					check.Message += "; no current values for this deployment yet"
+				}
+			}
+		}
+
+		if !check.OK {
+			ok = false
+		}
+		checks = append(checks, check)
+	}
+	return checks, ok
+}
+
+// Get a deployment's autoscaling settings and HPA status
+func (ds *ModelDeploymentService) getAutoscaling(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	var metrics []AutoscalingMetric
+	ds.db.Where("deployment_id = ?", deployment.ID).Order("id ASC").Find(&metrics)
+
+	response := gin.H{
+		"enabled":                          deployment.AutoScaling,
+		"min_replicas":                     deployment.MinReplicas,
+		"max_replicas":                     deployment.MaxReplicas,
+		"scale_up_stabilization_seconds":   deployment.ScaleUpStabilizationSeconds,
+		"scale_down_stabilization_seconds": deployment.ScaleDownStabilizationSeconds,
+		"autoscaler":                       deployment.Autoscaler,
+		"scale_to_zero":                    deployment.ScaleToZero,
+		"scale_to_zero_idle_seconds":       int(scaleToZeroIdle(&deployment).Seconds()),
+		"cold_start_timeout_seconds":       int(coldStartTimeout(&deployment).Seconds()),
+		"warmer":                           deployment.Warmer,
+		"metrics":                          metrics,
+	}
+	if deployment.AutoScaling && usesKEDA(&deployment) {
+		if status, found := ds.scaledObjectStatus(c.Request.Context(), &deployment); found {
+			response["status"] = status
+		}
+	} else if deployment.AutoScaling {
+		hpa, err := ds.k8sClient.AutoscalingV2().HorizontalPodAutoscalers(namespaceOf(&deployment)).Get(c.Request.Context(), deployment.Name, metav1.GetOptions{})
+		if err == nil {
+			response["status"] = hpa.Status
+		}
+	}
+	c.JSON(200, response)
+}
+
+// Set the metrics a deployment scales on
+func (ds *ModelDeploymentService) updateAutoscaling(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+
+	var request struct {
+		Enabled                       *bool               `json:"enabled"`
+		MinReplicas                   int                 `json:"min_replicas" binding:"min=0,max=50"`
+		MaxReplicas                   int                 `json:"max_replicas" binding:"min=0,max=50"`
+		ScaleUpStabilizationSeconds   *int                `json:"scale_up_stabilization_seconds" binding:"omitempty,min=0,max=3600"`
+		ScaleDownStabilizationSeconds *int                `json:"scale_down_stabilization_seconds" binding:"omitempty,min=0,max=3600"`
+		Autoscaler                    *string             `json:"autoscaler"`
+		ScaleToZero                   *bool               `json:"scale_to_zero"`
+		ScaleToZeroIdleSeconds        *int                `json:"scale_to_zero_idle_seconds"`
+		ColdStartTimeoutSeconds       *int                `json:"cold_start_timeout_seconds"`
+		Warmer                        *ColdStartWarmer    `json:"warmer"` // replicas 0 removes it
+		Metrics                       []AutoscalingMetric `json:"metrics"`
+		SkipValidation                bool                `json:"skip_validation"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if request.Enabled != nil {
+		deployment.AutoScaling = *request.Enabled
+	}
+	if request.MinReplicas > 0 {
+		deployment.MinReplicas = request.MinReplicas
+	}
+	if request.MaxReplicas > 0 {
+		deployment.MaxReplicas = request.MaxReplicas
+	}
+	if request.ScaleUpStabilizationSeconds != nil {
+		deployment.ScaleUpStabilizationSeconds = *request.ScaleUpStabilizationSeconds
+	}
+	if request.ScaleDownStabilizationSeconds != nil {
+		deployment.ScaleDownStabilizationSeconds = *request.ScaleDownStabilizationSeconds
+	}
+	if request.Autoscaler != nil {
+		deployment.Autoscaler = *request.Autoscaler
+	}
+	if request.ScaleToZero != nil {
+		deployment.ScaleToZero = *request.ScaleToZero
+	}
+	if request.ScaleToZeroIdleSeconds != nil {
+		deployment.ScaleToZeroIdleSeconds = *request.ScaleToZeroIdleSeconds
+	}
+	if request.ColdStartTimeoutSeconds != nil {
+		deployment.ColdStartTimeoutSeconds = *request.ColdStartTimeoutSeconds
+	}
+	if request.Warmer != nil {
+		deployment.Warmer = request.Warmer
+		if request.Warmer.Replicas == 0 {
+			deployment.Warmer = nil
+		}
+	}
+	if deployment.MinReplicas > deployment.MaxReplicas {
+		c.JSON(400, gin.H{"error": "min_replicas cannot exceed max_replicas"})
+		return
+	}
+	if err := ds.validateScaler(&deployment); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if len(request.Metrics) > maxScaleMetrics {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("at most %d metrics", maxScaleMetrics)})
+		return
+	}
+
+	metrics := request.Metrics
+	seen := make(map[string]bool)
+	for i := range metrics {
+		metrics[i].ID = 0
+		metrics[i].DeploymentID = deployment.ID
+		metrics[i].CreatedAt = time.Now()
+		if err := normalizeScaleMetric(&metrics[i], &deployment); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		key := metrics[i].Source + "/" + metrics[i].MetricName
+		if seen[key] {
+			c.JSON(400, gin.H{"error": "metric listed twice: " + metrics[i].MetricName})
+			return
+		}
+		seen[key] = true
+	}
+
+	// The CPU default needs metrics-server as much as anything else does.
+	// KEDA reads Prometheus itself, so only KEDA has to be there for it.
+	checked := metrics
+	if len(checked) == 0 {
+		checked = []AutoscalingMetric{{Type: ScaleMetricCPU, Source: ScaleSourceResource, MetricName: ScaleMetricCPU}}
+	}
+	var checks []metricCheck
+	if deployment.AutoScaling && usesKEDA(&deployment) && !request.SkipValidation {
+		check := ds.checkKEDA()
+		checks = []metricCheck{check}
+		if !check.OK {
+			c.JSON(422, gin.H{"error": "KEDA is not installed", "checks": checks})
+			return
+		}
+	} else if deployment.AutoScaling && !request.SkipValidation {
+		var ok bool
+		checks, ok = ds.checkScaleMetrics(c.Request.Context(), &deployment, checked)
+		if !ok {
+			c.JSON(422, gin.H{"error": "Metrics pipeline not ready for these metrics", "checks": checks})
+			return
+		}
+	}
+
+	if err := ds.applyAutoscaler(c.Request.Context(), &deployment, metrics); err != nil {
+		ds.logger.Error("Failed to apply autoscaler", zap.String("deployment", deployment.Name), zap.Error(err))
+		c.JSON(500, gin.H{"error": "Failed to apply autoscaler"})
+		return
+	}
+
+	err := ds.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("deployment_id = ?", deployment.ID).Delete(&AutoscalingMetric{}).Error; err != nil {
+			return err
+		}
+		if len(metrics) > 0 {
+			if err := tx.Create(&metrics).Error; err != nil {
+				return err
+			}
+		}
+		deployment.UpdatedAt = time.Now()
+		return tx.Model(&deployment).Select(
+			"auto_scaling", "min_replicas", "max_replicas",
+			"scale_up_stabilization_seconds", "scale_down_stabilization_seconds",
+			"autoscaler", "scale_to_zero", "scale_to_zero_idle_seconds",
+			"cold_start_timeout_seconds", "warmer", "updated_at",
+		).Updates(&deployment).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save autoscaling settings"})
+		return
+	}
+
+	ds.logger.Info("Autoscaling updated",
+		zap.String("deployment", deployment.Name),
+		zap.Bool("enabled", deployment.AutoScaling),
+		zap.Int("metrics", len(metrics)))
+
+	c.JSON(200, gin.H{
+		"enabled":       deployment.AutoScaling,
+		"min_replicas":  deployment.MinReplicas,
+		"max_replicas":  deployment.MaxReplicas,
+		"autoscaler":    deployment.Autoscaler,
+		"scale_to_zero": deployment.ScaleToZero,
+		"warmer":        deployment.Warmer,
+		"metrics":       metrics,
+		"checks":        checks,
+	})
+}
+
+// Check the metrics pipeline for a set of metrics without applying them
+func (ds *ModelDeploymentService) validateAutoscaling(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	var request struct {
+		Metrics []AutoscalingMetric `json:"metrics" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if len(request.Metrics) > maxScaleMetrics {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("at most %d metrics", maxScaleMetrics)})
+		return
+	}
+	for i := range request.Metrics {
+		if err := normalizeScaleMetric(&request.Metrics[i], &deployment); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	checks, ok := ds.checkScaleMetrics(c.Request.Context(), &deployment, request.Metrics)
+	c.JSON(200, gin.H{"ok": ok, "checks": checks})
+}
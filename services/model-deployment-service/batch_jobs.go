@@ -0,0 +1,701 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"gorm.io/gorm/clause"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Batch prediction jobs. A job runs a dataset from file-storage-service
+// through a deployment's model. It becomes an Indexed Kubernetes Job in the
+// serving namespace with one completion per shard: the pod with completion
+// index i takes every record whose line number is i modulo the shard count,
+// posts them to the deployment's Service in batches, and uploads its
+// results to file-storage-service as part-<i>.jsonl in the job's output
+// folder. Each pod reports its shard to this service with the job's
+// callback token, which reaches the pods through a Secret owned by the Job.
+//
+// The Job's own conditions decide when the batch job has succeeded or
+// failed; they are synced every batchJobSyncInterval. A failed shard is
+// retried up to BATCH_JOB_SHARD_RETRIES times before the Job fails.
+// Cancelling deletes the Job and its pods.
+
+// Batch job statuses
+const (
+	BatchJobStatusPending   = "pending"
+	BatchJobStatusRunning   = "running"
+	BatchJobStatusSucceeded = "succeeded"
+	BatchJobStatusFailed    = "failed"
+	BatchJobStatusCancelled = "cancelled"
+)
+
+// Shard statuses, as reported by the worker pods
+const (
+	ShardStatusSucceeded = "succeeded"
+	ShardStatusFailed    = "failed"
+)
+
+const (
+	fileStorageURIScheme  = "file-storage://"
+	batchJobSyncInterval  = 15 * time.Second
+	batchJobTTLAfterDone  = int32(24 * 60 * 60)
+	maxBatchJobShards     = 1000
+	batchJobTokenEnv      = "CALLBACK_TOKEN"
+	batchJobComponentName = "batch-prediction"
+)
+
+// BatchPredictionJob runs a dataset through a deployment's model
+type BatchPredictionJob struct {
+	ID                uint       `json:"id" gorm:"primaryKey"`
+	DeploymentID      uint       `json:"deployment_id" gorm:"index;not null"`
+	InputURI          string     `json:"input_uri" gorm:"not null"`
+	InputFileID       string     `json:"input_file_id"`
+	InputFormat       string     `json:"input_format"` // jsonl or csv
+	InputSize         int64      `json:"input_size"`
+	OutputFolder      string     `json:"output_folder"`
+	Shards            int        `json:"shards"`
+	Parallelism       int        `json:"parallelism"`
+	BatchSize         int        `json:"batch_size"` // records per prediction request
+	TimeoutSeconds    int        `json:"timeout_seconds"`
+	Status            string     `json:"status" gorm:"index"`
+	K8sJobName        string     `json:"k8s_job_name"`
+	Namespace         string     `json:"namespace"` // of the Kubernetes Job, the deployment's
+	CompletedShards   int        `json:"completed_shards"`
+	FailedShards      int        `json:"failed_shards"`
+	Records           int64      `json:"records"`
+	FailedRecords     int64      `json:"failed_records"`
+	Error             string     `json:"error,omitempty"`
+	CallbackTokenHash string     `json:"-"`
+	CreatedBy         string     `json:"created_by"`
+	CreatedAt         time.Time  `json:"created_at"`
+	StartedAt         *time.Time `json:"started_at"`
+	CompletedAt       *time.Time `json:"completed_at"`
+}
+
+// BatchPredictionShard is one worker's share of a batch job
+type BatchPredictionShard struct {
+	JobID         uint      `json:"job_id" gorm:"primaryKey"`
+	ShardIndex    int       `json:"shard_index" gorm:"primaryKey"`
+	Status        string    `json:"status"`
+	Records       int64     `json:"records"`
+	FailedRecords int64     `json:"failed_records"`
+	OutputFileID  string    `json:"output_file_id"`
+	Attempt       int       `json:"attempt"`
+	Error         string    `json:"error,omitempty"`
+	ReportedAt    time.Time `json:"reported_at"`
+}
+
+var (
+	batchJobsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_batch_jobs_total",
+			Help: "Batch prediction jobs by final status",
+		},
+		[]string{"deployment", "status"},
+	)
+	batchJobRecords = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_batch_job_records_total",
+			Help: "Records processed by batch prediction shards",
+		},
+		[]string{"deployment", "result"},
+	)
+	batchJobDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "model_batch_job_duration_seconds",
+			Help:    "Time from start to completion of batch prediction jobs",
+			Buckets: []float64{30, 60, 300, 600, 1800, 3600, 7200, 21600, 86400},
+		},
+		[]string{"deployment", "status"},
+	)
+)
+
+func fileStorageURL() string {
+	return strings.TrimRight(getEnv("FILE_STORAGE_SERVICE_URL", "http://file-storage-service:8080"), "/")
+}
+
+// parseDatasetURI reads a file-storage://<file id> reference
+func parseDatasetURI(uri string) (string, error) {
+	if !strings.HasPrefix(uri, fileStorageURIScheme) {
+		return "", fmt.Errorf("dataset must be a %s<file id> URI", fileStorageURIScheme)
+	}
+	fileID := strings.Trim(strings.TrimPrefix(uri, fileStorageURIScheme), "/")
+	if fileID == "" || strings.Contains(fileID, "/") {
+		return "", fmt.Errorf("dataset URI %q does not name a file", uri)
+	}
+	return fileID, nil
+}
+
+// datasetFile is what file-storage-service knows of an input file
+type datasetFile struct {
+	ID           string `json:"id"`
+	OriginalName string `json:"original_name"`
+	Size         int64  `json:"size"`
+	MimeType     string `json:"mime_type"`
+	Status       string `json:"status"`
+}
+
+// lookupDataset checks that the input file exists
+func lookupDataset(ctx context.Context, fileID string) (*datasetFile, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileStorageURL()+"/v1/files/"+fileID, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("file-storage-service answered %d", resp.StatusCode)
+	}
+	var file datasetFile
+	if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
+		return nil, resp.StatusCode, err
+	}
+	return &file, resp.StatusCode, nil
+}
+
+// datasetFormat guesses the record format of an input file
+func datasetFormat(file *datasetFile) string {
+	switch strings.ToLower(path.Ext(file.OriginalName)) {
+	case ".csv":
+		return "csv"
+	}
+	if strings.Contains(file.MimeType, "csv") {
+		return "csv"
+	}
+	return "jsonl"
+}
+
+func hashCallbackToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func batchJobName(job *BatchPredictionJob, deployment *ModelDeployment) string {
+	name := fmt.Sprintf("%s-batch-%d", deployment.Name, job.ID)
+	if len(name) > 63 {
+		name = fmt.Sprintf("batch-%d", job.ID)
+	}
+	return name
+}
+
+// buildBatchK8sJob describes the Kubernetes Job of a batch job
+func buildBatchK8sJob(job *BatchPredictionJob, deployment *ModelDeployment) *batchv1.Job {
+	// Not app/model-id: the Service, drains and the termination watcher
+	// select on those, and batch pods serve nothing
+	labels := map[string]string{
+		"deployment":   deployment.Name,
+		"component":    batchJobComponentName,
+		"batch-job-id": strconv.FormatUint(uint64(job.ID), 10),
+		"managed-by":   "002aic-platform",
+	}
+	completions := int32(job.Shards)
+	parallelism := int32(job.Parallelism)
+	retries := int32(getEnvInt("BATCH_JOB_SHARD_RETRIES", 2))
+	deadline := int64(job.TimeoutSeconds)
+	ttl := batchJobTTLAfterDone
+	indexed := batchv1.IndexedCompletion
+	secretName := job.K8sJobName + "-callback"
+
+	env := []corev1.EnvVar{
+		{Name: "BATCH_JOB_ID", Value: strconv.FormatUint(uint64(job.ID), 10)},
+		{Name: "DEPLOYMENT_NAME", Value: deployment.Name},
+		{Name: "SHARD_COUNT", Value: strconv.Itoa(job.Shards)},
+		{Name: "BATCH_SIZE", Value: strconv.Itoa(job.BatchSize)},
+		{Name: "INPUT_URL", Value: fmt.Sprintf("%s/v1/files/%s/download", fileStorageURL(), job.InputFileID)},
+		{Name: "INPUT_FORMAT", Value: job.InputFormat},
+		{Name: "PREDICT_URL", Value: "http://" + inferenceHost(deployment) + inferencePath(deployment)},
+		{Name: "PREDICT_TIMEOUT_SECONDS", Value: strconv.Itoa(int(inferenceTimeout(deployment).Seconds()))},
+		{Name: "PREDICT_MAX_RETRIES", Value: strconv.Itoa(deployment.InferenceMaxRetries)},
+		{Name: "OUTPUT_UPLOAD_URL", Value: fileStorageURL() + "/v1/files/upload"},
+		{Name: "OUTPUT_FOLDER", Value: job.OutputFolder},
+		{Name: "CALLBACK_URL", Value: fmt.Sprintf("%s/internal/batch-jobs/%d/shards",
+			strings.TrimRight(getEnv("MODEL_DEPLOYMENT_SERVICE_URL", "http://model-deployment-service:8080"), "/"), job.ID)},
+		{Name: batchJobTokenEnv, ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+				Key:                  "token",
+			},
+		}},
+	}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      job.K8sJobName,
+			Namespace: job.Namespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			Completions:             &completions,
+			Parallelism:             &parallelism,
+			CompletionMode:          &indexed,
+			BackoffLimitPerIndex:    &retries,
+			ActiveDeadlineSeconds:   &deadline,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:  "batch-predictor",
+							Image: getEnv("BATCH_WORKER_IMAGE", "002aic/batch-predictor:latest"),
+							Env:   env,
+							Resources: corev1.ResourceRequirements{
+								Requests: corev1.ResourceList{
+									corev1.ResourceCPU:    parseQuantity(getEnv("BATCH_WORKER_CPU", "250m")),
+									corev1.ResourceMemory: parseQuantity(getEnv("BATCH_WORKER_MEMORY", "512Mi")),
+								},
+								Limits: corev1.ResourceList{
+									corev1.ResourceCPU:    parseQuantity(getEnv("BATCH_WORKER_CPU", "250m")),
+									corev1.ResourceMemory: parseQuantity(getEnv("BATCH_WORKER_MEMORY", "512Mi")),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// startBatchK8sJob creates the Job and the Secret holding its callback token
+func (ds *ModelDeploymentService) startBatchK8sJob(ctx context.Context, job *BatchPredictionJob, deployment *ModelDeployment, token string) error {
+	created, err := ds.k8sClient.BatchV1().Jobs(job.Namespace).Create(ctx, buildBatchK8sJob(job, deployment), metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to create job: %w", err)
+	}
+
+	// Owned by the Job, so it goes when the Job does
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      created.Name + "-callback",
+			Namespace: job.Namespace,
+			Labels:    created.Labels,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(created, batchv1.SchemeGroupVersion.WithKind("Job")),
+			},
+		},
+		StringData: map[string]string{"token": token},
+	}
+	if _, err := ds.k8sClient.CoreV1().Secrets(job.Namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		ds.deleteBatchK8sJob(ctx, job)
+		return fmt.Errorf("failed to create callback secret: %w", err)
+	}
+	return nil
+}
+
+func (ds *ModelDeploymentService) deleteBatchK8sJob(ctx context.Context, job *BatchPredictionJob) error {
+	propagation := metav1.DeletePropagationBackground
+	err := ds.k8sClient.BatchV1().Jobs(batchNamespace(job)).Delete(ctx, job.K8sJobName, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Start a batch prediction job over a dataset in file-storage-service
+func (ds *ModelDeploymentService) batchPredict(c *gin.Context) {
+	deployment, ok := ds.runningDeployment(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Dataset        string `json:"dataset" binding:"required"` // file-storage://<file id>
+		Format         string `json:"format" binding:"omitempty,oneof=jsonl csv"`
+		Shards         int    `json:"shards" binding:"min=0"`
+		Parallelism    int    `json:"parallelism" binding:"min=0"`
+		BatchSize      int    `json:"batch_size" binding:"min=0,max=10000"`
+		TimeoutSeconds int    `json:"timeout_seconds" binding:"min=0"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	fileID, err := parseDatasetURI(request.Dataset)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	file, code, err := lookupDataset(c.Request.Context(), fileID)
+	if err != nil {
+		if code == http.StatusNotFound {
+			c.JSON(404, gin.H{"error": "Dataset not found"})
+			return
+		}
+		ds.logger.Error("Failed to look up dataset", zap.String("file_id", fileID), zap.Error(err))
+		c.JSON(502, gin.H{"error": "Failed to look up dataset"})
+		return
+	}
+
+	job := &BatchPredictionJob{
+		DeploymentID:   deployment.ID,
+		InputURI:       request.Dataset,
+		InputFileID:    fileID,
+		InputFormat:    request.Format,
+		InputSize:      file.Size,
+		Shards:         request.Shards,
+		Parallelism:    request.Parallelism,
+		BatchSize:      request.BatchSize,
+		TimeoutSeconds: request.TimeoutSeconds,
+		Status:         BatchJobStatusPending,
+		CreatedBy:      c.GetHeader("X-User-ID"),
+		CreatedAt:      time.Now(),
+	}
+	if job.InputFormat == "" {
+		job.InputFormat = datasetFormat(file)
+	}
+	if job.Shards == 0 {
+		// One shard per BATCH_JOB_SHARD_SIZE_MB of input
+		shardSize := int64(getEnvInt("BATCH_JOB_SHARD_SIZE_MB", 64)) << 20
+		job.Shards = int((file.Size + shardSize - 1) / shardSize)
+		if job.Shards < 1 {
+			job.Shards = 1
+		}
+	}
+	if job.Shards > maxBatchJobShards {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("at most %d shards", maxBatchJobShards)})
+		return
+	}
+	if job.Parallelism == 0 || job.Parallelism > job.Shards {
+		job.Parallelism = job.Shards
+	}
+	if limit := getEnvInt("BATCH_JOB_MAX_PARALLELISM", 20); job.Parallelism > limit {
+		job.Parallelism = limit
+	}
+	if job.BatchSize == 0 {
+		job.BatchSize = 32
+	}
+	if job.TimeoutSeconds == 0 {
+		job.TimeoutSeconds = 6 * 60 * 60
+	}
+
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create batch job"})
+		return
+	}
+	token := hex.EncodeToString(tokenBytes)
+	job.CallbackTokenHash = hashCallbackToken(token)
+
+	if err := ds.db.Create(job).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create batch job"})
+		return
+	}
+	job.K8sJobName = batchJobName(job, deployment)
+	job.Namespace = namespaceOf(deployment)
+	job.OutputFolder = fmt.Sprintf("/batch-predictions/%s/%d", deployment.Name, job.ID)
+
+	if err := ds.startBatchK8sJob(c.Request.Context(), job, deployment, token); err != nil {
+		now := time.Now()
+		job.Status = BatchJobStatusFailed
+		job.Error = err.Error()
+		job.CompletedAt = &now
+		ds.db.Save(job)
+		batchJobsTotal.WithLabelValues(deployment.Name, BatchJobStatusFailed).Inc()
+		ds.logger.Error("Failed to start batch prediction job", zap.Uint("job_id", job.ID), zap.Error(err))
+		c.JSON(500, gin.H{"error": "Failed to start batch job", "job": job})
+		return
+	}
+	ds.db.Save(job)
+
+	ds.logger.Info("Batch prediction job started",
+		zap.String("deployment", deployment.Name),
+		zap.Uint("job_id", job.ID),
+		zap.String("dataset", job.InputURI),
+		zap.Int("shards", job.Shards))
+
+	c.JSON(202, job)
+}
+
+// batchJobFor loads a job of the deployment in the path
+func (ds *ModelDeploymentService) batchJobFor(c *gin.Context) (*BatchPredictionJob, bool) {
+	var job BatchPredictionJob
+	if err := ds.db.First(&job, "id = ? AND deployment_id = ?", c.Param("job_id"), c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Batch job not found"})
+		return nil, false
+	}
+	return &job, true
+}
+
+// List a deployment's batch jobs
+func (ds *ModelDeploymentService) listBatchJobs(c *gin.Context) {
+	query := ds.db.Where("deployment_id = ?", c.Param("id"))
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var jobs []BatchPredictionJob
+	if err := query.Order("created_at DESC").Limit(100).Find(&jobs).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch batch jobs"})
+		return
+	}
+	c.JSON(200, gin.H{"jobs": jobs})
+}
+
+// Get a batch job and its shards
+func (ds *ModelDeploymentService) getBatchJob(c *gin.Context) {
+	job, ok := ds.batchJobFor(c)
+	if !ok {
+		return
+	}
+	var shards []BatchPredictionShard
+	ds.db.Where("job_id = ?", job.ID).Order("shard_index ASC").Find(&shards)
+
+	c.JSON(200, gin.H{"job": job, "shards": shards})
+}
+
+// Cancel a batch job, stopping its pods
+func (ds *ModelDeploymentService) cancelBatchJob(c *gin.Context) {
+	job, ok := ds.batchJobFor(c)
+	if !ok {
+		return
+	}
+	if job.Status != BatchJobStatusPending && job.Status != BatchJobStatusRunning {
+		c.JSON(409, gin.H{"error": "Batch job already finished", "status": job.Status})
+		return
+	}
+
+	if err := ds.deleteBatchK8sJob(c.Request.Context(), job); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to delete Kubernetes job"})
+		return
+	}
+
+	var deployment ModelDeployment
+	ds.db.Select("id", "name").First(&deployment, job.DeploymentID)
+	ds.finishBatchJob(job, &deployment, BatchJobStatusCancelled, "")
+
+	c.JSON(200, job)
+}
+
+// Get where a batch job's results are
+func (ds *ModelDeploymentService) getBatchJobResults(c *gin.Context) {
+	job, ok := ds.batchJobFor(c)
+	if !ok {
+		return
+	}
+
+	var shards []BatchPredictionShard
+	ds.db.Where("job_id = ? AND status = ?", job.ID, ShardStatusSucceeded).Order("shard_index ASC").Find(&shards)
+
+	results := make([]gin.H, 0, len(shards))
+	for _, shard := range shards {
+		results = append(results, gin.H{
+			"shard_index":  shard.ShardIndex,
+			"records":      shard.Records,
+			"failed":       shard.FailedRecords,
+			"file_id":      shard.OutputFileID,
+			"uri":          fileStorageURIScheme + shard.OutputFileID,
+			"download_url": fmt.Sprintf("%s/v1/files/%s/download", fileStorageURL(), shard.OutputFileID),
+		})
+	}
+
+	c.JSON(200, gin.H{
+		"job_id":        job.ID,
+		"status":        job.Status,
+		"complete":      job.Status == BatchJobStatusSucceeded,
+		"output_folder": job.OutputFolder,
+		"results":       results,
+		"missing":       job.Shards - len(results),
+	})
+}
+
+// Report a shard's outcome; called by the job's worker pods
+func (ds *ModelDeploymentService) reportBatchShard(c *gin.Context) {
+	var job BatchPredictionJob
+	if err := ds.db.First(&job, c.Param("job_id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Batch job not found"})
+		return
+	}
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if token == "" || hashCallbackToken(token) != job.CallbackTokenHash {
+		c.JSON(401, gin.H{"error": "Invalid callback token"})
+		return
+	}
+
+	var report struct {
+		ShardIndex    int    `json:"shard_index" binding:"min=0"`
+		Status        string `json:"status" binding:"required,oneof=succeeded failed"`
+		Records       int64  `json:"records" binding:"min=0"`
+		FailedRecords int64  `json:"failed_records" binding:"min=0"`
+		OutputFileID  string `json:"output_file_id"`
+		Attempt       int    `json:"attempt"`
+		Error         string `json:"error"`
+	}
+	if err := c.ShouldBindJSON(&report); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if report.ShardIndex >= job.Shards {
+		c.JSON(400, gin.H{"error": "shard_index out of range"})
+		return
+	}
+	if report.Status == ShardStatusSucceeded && report.OutputFileID == "" {
+		c.JSON(400, gin.H{"error": "output_file_id is required for a succeeded shard"})
+		return
+	}
+
+	shard := BatchPredictionShard{
+		JobID:         job.ID,
+		ShardIndex:    report.ShardIndex,
+		Status:        report.Status,
+		Records:       report.Records,
+		FailedRecords: report.FailedRecords,
+		OutputFileID:  report.OutputFileID,
+		Attempt:       report.Attempt,
+		Error:         report.Error,
+		ReportedAt:    time.Now(),
+	}
+	// A retried shard's latest attempt replaces the earlier one
+	if err := ds.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&shard).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to record shard"})
+		return
+	}
+
+	var deployment ModelDeployment
+	ds.db.Select("id", "name").First(&deployment, job.DeploymentID)
+	batchJobRecords.WithLabelValues(deployment.Name, "ok").Add(float64(report.Records - report.FailedRecords))
+	batchJobRecords.WithLabelValues(deployment.Name, "failed").Add(float64(report.FailedRecords))
+
+	ds.refreshBatchTotals(&job)
+	c.JSON(200, gin.H{"recorded": true})
+}
+
+// refreshBatchTotals sums a job's shard reports into it
+func (ds *ModelDeploymentService) refreshBatchTotals(job *BatchPredictionJob) {
+	var totals struct {
+		Completed     int
+		Failed        int
+		Records       int64
+		FailedRecords int64
+	}
+	ds.db.Model(&BatchPredictionShard{}).
+		Select("COUNT(*) FILTER (WHERE status = ?) AS completed, COUNT(*) FILTER (WHERE status = ?) AS failed, "+
+			"COALESCE(SUM(records), 0) AS records, COALESCE(SUM(failed_records), 0) AS failed_records",
+			ShardStatusSucceeded, ShardStatusFailed).
+		Where("job_id = ?", job.ID).
+		Scan(&totals)
+
+	job.CompletedShards = totals.Completed
+	job.FailedShards = totals.Failed
+	job.Records = totals.Records
+	job.FailedRecords = totals.FailedRecords
+	ds.db.Model(job).Updates(map[string]interface{}{
+		"completed_shards": job.CompletedShards,
+		"failed_shards":    job.FailedShards,
+		"records":          job.Records,
+		"failed_records":   job.FailedRecords,
+	})
+}
+
+// finishBatchJob records a job's final status
+func (ds *ModelDeploymentService) finishBatchJob(job *BatchPredictionJob, deployment *ModelDeployment, status, message string) {
+	now := time.Now()
+	job.Status = status
+	job.Error = message
+	job.CompletedAt = &now
+	ds.db.Model(job).Updates(map[string]interface{}{
+		"status":       status,
+		"error":        message,
+		"completed_at": now,
+	})
+	ds.refreshBatchTotals(job)
+
+	batchJobsTotal.WithLabelValues(deployment.Name, status).Inc()
+	if job.StartedAt != nil {
+		batchJobDuration.WithLabelValues(deployment.Name, status).Observe(now.Sub(*job.StartedAt).Seconds())
+	}
+	ds.logger.Info("Batch prediction job finished",
+		zap.String("deployment", deployment.Name),
+		zap.Uint("job_id", job.ID),
+		zap.String("status", status),
+		zap.Int64("records", job.Records),
+		zap.Int64("failed_records", job.FailedRecords))
+}
+
+// startBatchJobSync follows the Kubernetes Jobs of unfinished batch jobs
+func (ds *ModelDeploymentService) startBatchJobSync() {
+	ticker := time.NewTicker(batchJobSyncInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ds.syncBatchJobs()
+	}
+}
+
+func (ds *ModelDeploymentService) syncBatchJobs() {
+	var jobs []BatchPredictionJob
+	if err := ds.db.Where("status IN ?", []string{BatchJobStatusPending, BatchJobStatusRunning}).Find(&jobs).Error; err != nil {
+		ds.logger.Error("Failed to fetch batch jobs", zap.Error(err))
+		return
+	}
+
+	ctx := context.Background()
+	for i := range jobs {
+		job := &jobs[i]
+		var deployment ModelDeployment
+		ds.db.Select("id", "name").First(&deployment, job.DeploymentID)
+
+		k8sJob, err := ds.k8sClient.BatchV1().Jobs(batchNamespace(job)).Get(ctx, job.K8sJobName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			ds.finishBatchJob(job, &deployment, BatchJobStatusFailed, "Kubernetes job no longer exists")
+			continue
+		}
+		if err != nil {
+			ds.logger.Warn("Failed to get batch Kubernetes job", zap.String("job", job.K8sJobName), zap.Error(err))
+			continue
+		}
+
+		if job.Status == BatchJobStatusPending && (k8sJob.Status.Active > 0 || k8sJob.Status.StartTime != nil) {
+			started := time.Now()
+			if k8sJob.Status.StartTime != nil {
+				started = k8sJob.Status.StartTime.Time
+			}
+			job.Status = BatchJobStatusRunning
+			job.StartedAt = &started
+			ds.db.Model(job).Updates(map[string]interface{}{"status": job.Status, "started_at": started})
+		}
+
+		for _, condition := range k8sJob.Status.Conditions {
+			if condition.Status != corev1.ConditionTrue {
+				continue
+			}
+			switch condition.Type {
+			case batchv1.JobComplete:
+				ds.finishBatchJob(job, &deployment, BatchJobStatusSucceeded, "")
+			case batchv1.JobFailed:
+				message := condition.Message
+				if message == "" {
+					message = condition.Reason
+				}
+				ds.finishBatchJob(job, &deployment, BatchJobStatusFailed, message)
+			default:
+				continue
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,1198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
+	"gorm.io/gorm"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// Canary releases. A canary runs a new model version next to the current
+// one as <name>-canary, a copy of the deployment's pods with MODEL_VERSION
+// changed, behind a Service of its own. Once its pods are ready it takes
+// TrafficPercent of the deployment's predictions; the rest keep going to
+// the stable pods.
+//
+// The split happens here, where predictions are proxied, so every request
+// is known to have gone to one variant or the other. Forwarded requests
+// carry x-model-variant, and with ISTIO_ENABLED a VirtualService on the
+// stable host honours that header and splits everything else by the same
+// weights, so clients calling the Service inside the mesh are split too.
+// Responses say which variant answered in X-Model-Variant; clients may post
+// quality scores for either variant to /canary/feedback.
+//
+// Each instance gathers error counts, latencies and scores per variant and
+// writes them out every canaryControlInterval. The canary is compared with
+// stable over a bake window, per step:
+//
+//   - its error rate may not exceed MaxErrorRate, nor stable's by more
+//     than MaxErrorRateIncrease
+//   - its p95 latency may not exceed stable's by more than
+//     MaxLatencyIncrease (a fraction: 0.2 allows 20% slower)
+//   - with MaxQualityDrop set and enough scores for both variants, its mean
+//     score may not fall more than that below stable's
+//
+// Nothing is decided before the canary has served MinRequests in the step,
+// but once it has, a failure ends the step early. A failing canary is
+// rolled back (its traffic returns to stable and its pods are removed), or
+// held at its current weight when AutoRollback is off. A canary that passes
+// moves up by StepPercent, if set, and bakes again; after the last step it
+// is promoted, or waits for a manual promotion when AutoPromote is off.
+// Promotion rolls the stable pods to the canary's version and removes the
+// canary once they are all available.
+
+// Canary statuses
+const (
+	CanaryStatusDeploying  = "deploying"
+	CanaryStatusBaking     = "baking"
+	CanaryStatusHeld       = "held"   // failed its criteria, waiting for a decision
+	CanaryStatusPassed     = "passed" // passed every step, waiting for a promotion
+	CanaryStatusPromoting  = "promoting"
+	CanaryStatusPromoted   = "promoted"
+	CanaryStatusRolledBack = "rolled_back"
+	CanaryStatusFailed     = "failed" // never became ready
+)
+
+// Which release served a request
+const (
+	variantStable = "stable"
+	variantCanary = "canary"
+	variantHeader = "x-model-variant"
+)
+
+const canaryControlInterval = 15 * time.Second
+
+// activeCanaryStatuses have canary pods running
+var activeCanaryStatuses = []string{CanaryStatusDeploying, CanaryStatusBaking, CanaryStatusHeld, CanaryStatusPassed, CanaryStatusPromoting}
+
+// canaryLatencyBoundsMs are the upper bounds of the latency buckets
+var canaryLatencyBoundsMs = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+var virtualServiceResource = schema.GroupVersionResource{
+	Group:    "networking.istio.io",
+	Version:  "v1beta1",
+	Resource: "virtualservices",
+}
+
+// CanaryRelease is a new model version tried on part of a deployment's traffic
+type CanaryRelease struct {
+	ID                   uint       `json:"id" gorm:"primaryKey"`
+	DeploymentID         uint       `json:"deployment_id" gorm:"index;not null"`
+	ModelVersion         string     `json:"model_version" gorm:"not null"`
+	PreviousVersion      string     `json:"previous_version"`
+	ArtifactURI          string     `json:"artifact_uri"` // the version's model artifact, when the deployment pulls one
+	ArtifactSHA256       string     `json:"artifact_sha256"`
+	ArtifactSizeBytes    int64      `json:"artifact_size_bytes"`
+	Replicas             int        `json:"replicas"`
+	Status               string     `json:"status" gorm:"index"`
+	InitialPercent       int        `json:"initial_percent"`
+	TrafficPercent       int        `json:"traffic_percent"` // current share of the canary
+	StepPercent          int        `json:"step_percent"`    // added after each passed step; 0: one step
+	Step                 int        `json:"step"`
+	StepStartedAt        *time.Time `json:"step_started_at"`
+	BakeWindowSeconds    int        `json:"bake_window_seconds"`
+	ReadyTimeoutSeconds  int        `json:"ready_timeout_seconds"`
+	MinRequests          int64      `json:"min_requests"`
+	MaxErrorRate         float64    `json:"max_error_rate"`
+	MaxErrorRateIncrease float64    `json:"max_error_rate_increase"`
+	MaxLatencyIncrease   float64    `json:"max_latency_increase"`
+	MaxQualityDrop       float64    `json:"max_quality_drop"` // 0: quality not compared
+	MinQualitySamples    int64      `json:"min_quality_samples"`
+	AutoPromote          bool       `json:"auto_promote"`
+	AutoRollback         bool       `json:"auto_rollback"`
+	Decision             string     `json:"decision"`
+	LastComparison       string     `json:"last_comparison" gorm:"type:jsonb"`
+	CreatedBy            string     `json:"created_by"`
+	CreatedAt            time.Time  `json:"created_at"`
+	UpdatedAt            time.Time  `json:"updated_at"`
+	CompletedAt          *time.Time `json:"completed_at"`
+}
+
+// CanaryObservation is what one instance saw of one variant during a step
+type CanaryObservation struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	CanaryID       uint      `json:"canary_id" gorm:"index:idx_canary_step"`
+	Step           int       `json:"step" gorm:"index:idx_canary_step"`
+	Variant        string    `json:"variant"`
+	Requests       int64     `json:"requests"`
+	Errors         int64     `json:"errors"`
+	LatencyBuckets string    `json:"latency_buckets" gorm:"type:jsonb"` // counts per canaryLatencyBoundsMs, then overflow
+	QualitySum     float64   `json:"quality_sum"`
+	QualityCount   int64     `json:"quality_count"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+var (
+	canaryReleases = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_canary_releases_total",
+			Help: "Canary releases by outcome",
+		},
+		[]string{"deployment", "outcome"},
+	)
+	canaryTrafficPercent = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "model_canary_traffic_percent",
+			Help: "Share of a deployment's predictions sent to its canary",
+		},
+		[]string{"deployment"},
+	)
+	canaryRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_canary_requests_total",
+			Help: "Predictions served while a canary runs, by variant",
+		},
+		[]string{"deployment", "variant", "status"},
+	)
+)
+
+// servingVariant is the release picked to serve one request
+type servingVariant struct {
+	canaryID uint
+	step     int
+	name     string
+}
+
+// canaryRoute is how a deployment's traffic is split
+type canaryRoute struct {
+	canaryID uint
+	step     int
+	percent  int
+}
+
+type canaryStatsKey struct {
+	canaryID uint
+	step     int
+	variant  string
+}
+
+type canaryWindow struct {
+	requests int64
+	errors   int64
+	buckets  []int64
+}
+
+// canaryRouter holds the traffic splits of running canaries and the
+// requests seen since they were last written out
+type canaryRouter struct {
+	mu     sync.Mutex
+	routes map[uint]canaryRoute
+	stats  map[canaryStatsKey]*canaryWindow
+}
+
+func newCanaryRouter() *canaryRouter {
+	return &canaryRouter{
+		routes: make(map[uint]canaryRoute),
+		stats:  make(map[canaryStatsKey]*canaryWindow),
+	}
+}
+
+func (r *canaryRouter) set(deploymentID uint, route canaryRoute) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[deploymentID] = route
+}
+
+func (r *canaryRouter) clear(deploymentID uint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.routes, deploymentID)
+}
+
+// replace swaps in the splits read from the database
+func (r *canaryRouter) replace(routes map[uint]canaryRoute) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes = routes
+}
+
+// pick chooses the variant to serve a request of a deployment
+func (r *canaryRouter) pick(deploymentID uint) *servingVariant {
+	r.mu.Lock()
+	route, ok := r.routes[deploymentID]
+	r.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	variant := &servingVariant{canaryID: route.canaryID, step: route.step, name: variantStable}
+	if rand.Intn(100) < route.percent {
+		variant.name = variantCanary
+	}
+	return variant
+}
+
+func (r *canaryRouter) record(variant *servingVariant, latency time.Duration, failed bool) {
+	key := canaryStatsKey{canaryID: variant.canaryID, step: variant.step, variant: variant.name}
+	ms := float64(latency) / float64(time.Millisecond)
+	bucket := len(canaryLatencyBoundsMs)
+	for i, bound := range canaryLatencyBoundsMs {
+		if ms <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	window, ok := r.stats[key]
+	if !ok {
+		window = &canaryWindow{buckets: make([]int64, len(canaryLatencyBoundsMs)+1)}
+		r.stats[key] = window
+	}
+	window.requests++
+	if failed {
+		window.errors++
+	}
+	window.buckets[bucket]++
+}
+
+// take hands over the requests seen since the last call
+func (r *canaryRouter) take() map[canaryStatsKey]*canaryWindow {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	r.stats = make(map[canaryStatsKey]*canaryWindow)
+	return stats
+}
+
+// routeCanary picks the variant that serves a prediction while the
+// deployment has a canary
+func (ds *ModelDeploymentService) routeCanary(c *gin.Context, deployment *ModelDeployment) {
+	deployment.variant = ds.canaries.pick(deployment.ID)
+	if deployment.variant != nil {
+		c.Header("X-Model-Variant", deployment.variant.name)
+	}
+}
+
+// variantContext adds the variant to the metadata of a gRPC call
+func variantContext(ctx context.Context, deployment *ModelDeployment) context.Context {
+	if deployment.variant == nil {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, variantHeader, deployment.variant.name)
+}
+
+func canaryName(deployment *ModelDeployment) string {
+	return deployment.Name + "-canary"
+}
+
+func canaryHost(deployment *ModelDeployment) string {
+	return fmt.Sprintf("%s.%s.svc.%s", canaryName(deployment), namespaceOf(deployment), getEnv("CLUSTER_DOMAIN", "cluster.local"))
+}
+
+// initDynamicClient creates the client used for custom resources: Istio
+// VirtualServices and KEDA ScaledObjects
+func initDynamicClient() (dynamic.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Kubernetes config: %w", err)
+	}
+	return dynamic.NewForConfig(config)
+}
+
+// Kubernetes resources
+
+// setModelVersion points a pod template's model server at a model version
+func setModelVersion(template *corev1.PodTemplateSpec, version string) {
+	for i := range template.Spec.Containers {
+		container := &template.Spec.Containers[i]
+		if container.Name != "model-server" {
+			continue
+		}
+		found := false
+		for j := range container.Env {
+			if container.Env[j].Name == "MODEL_VERSION" {
+				container.Env[j].Value = version
+				found = true
+			}
+		}
+		if !found {
+			container.Env = append(container.Env, corev1.EnvVar{Name: "MODEL_VERSION", Value: version})
+		}
+	}
+}
+
+// modelVersionOf reads the model version a pod template serves
+func modelVersionOf(template *corev1.PodTemplateSpec) string {
+	for _, container := range template.Spec.Containers {
+		if container.Name != "model-server" {
+			continue
+		}
+		for _, env := range container.Env {
+			if env.Name == "MODEL_VERSION" {
+				return env.Value
+			}
+		}
+	}
+	return ""
+}
+
+// createCanaryResources starts the canary's pods and Service, copied from
+// the stable ones
+func (ds *ModelDeploymentService) createCanaryResources(ctx context.Context, deployment *ModelDeployment, canary *CanaryRelease) error {
+	stable, err := ds.k8sClient.AppsV1().Deployments(namespaceOf(deployment)).Get(ctx, deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get deployment: %w", err)
+	}
+	name := canaryName(deployment)
+
+	labels := map[string]string{}
+	for k, v := range stable.Labels {
+		labels[k] = v
+	}
+	labels["app"] = name
+	labels["canary-of"] = deployment.Name
+
+	template := *stable.Spec.Template.DeepCopy()
+	template.Labels["app"] = name
+	template.Labels["canary-of"] = deployment.Name
+	template.Labels[servingLabel] = "true"
+	template.Annotations = gpuAnnotations(deployment)
+	setModelVersion(&template, canary.ModelVersion)
+	if artifact := canaryArtifact(canary); artifact != nil {
+		setModelArtifact(&template, artifact, canary.ModelVersion)
+	}
+
+	k8sDeployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespaceOf(deployment),
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: int32Ptr(int32(canary.Replicas)),
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": name},
+			},
+			Template: template,
+		},
+	}
+	if _, err := ds.k8sClient.AppsV1().Deployments(namespaceOf(deployment)).Create(ctx, k8sDeployment, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create canary deployment: %w", err)
+	}
+
+	stableService, err := ds.k8sClient.CoreV1().Services(namespaceOf(deployment)).Get(ctx, deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get service: %w", err)
+	}
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespaceOf(deployment),
+			Labels:    labels,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{
+				"app":        name,
+				servingLabel: "true",
+			},
+			Ports: stableService.Spec.Ports,
+			Type:  corev1.ServiceTypeClusterIP,
+		},
+	}
+	if _, err := ds.k8sClient.CoreV1().Services(namespaceOf(deployment)).Create(ctx, service, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create canary service: %w", err)
+	}
+	return nil
+}
+
+// deleteCanaryResources removes the canary's pods, Service and traffic split
+func (ds *ModelDeploymentService) deleteCanaryResources(ctx context.Context, deployment *ModelDeployment) error {
+	ds.canaries.clear(deployment.ID)
+	canaryTrafficPercent.WithLabelValues(deployment.Name).Set(0)
+
+	name := canaryName(deployment)
+	propagation := metav1.DeletePropagationBackground
+	if err := ds.k8sClient.AppsV1().Deployments(namespaceOf(deployment)).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &propagation}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete canary deployment: %w", err)
+	}
+	if err := ds.k8sClient.CoreV1().Services(namespaceOf(deployment)).Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete canary service: %w", err)
+	}
+	if ds.istio != nil {
+		err := ds.istio.Resource(virtualServiceResource).Namespace(namespaceOf(deployment)).Delete(ctx, deployment.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete virtual service: %w", err)
+		}
+	}
+	return nil
+}
+
+// canaryVirtualService routes pinned requests to their variant and splits
+// the rest by weight
+func canaryVirtualService(deployment *ModelDeployment, percent int) *unstructured.Unstructured {
+	stableHost := inferenceHost(deployment)
+	canaryHostName := canaryHost(deployment)
+	pinned := func(variant, host string) interface{} {
+		return map[string]interface{}{
+			"match": []interface{}{
+				map[string]interface{}{
+					"headers": map[string]interface{}{
+						variantHeader: map[string]interface{}{"exact": variant},
+					},
+				},
+			},
+			"route": []interface{}{
+				map[string]interface{}{"destination": map[string]interface{}{"host": host}},
+			},
+		}
+	}
+
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": virtualServiceResource.Group + "/" + virtualServiceResource.Version,
+		"kind":       "VirtualService",
+		"metadata": map[string]interface{}{
+			"name":      deployment.Name,
+			"namespace": namespaceOf(deployment),
+			"labels": map[string]interface{}{
+				"app":        deployment.Name,
+				"managed-by": "002aic-platform",
+			},
+		},
+		"spec": map[string]interface{}{
+			"hosts": []interface{}{stableHost},
+			"http": []interface{}{
+				pinned(variantStable, stableHost),
+				pinned(variantCanary, canaryHostName),
+				map[string]interface{}{
+					"route": []interface{}{
+						map[string]interface{}{
+							"destination": map[string]interface{}{"host": stableHost},
+							"weight":      int64(100 - percent),
+						},
+						map[string]interface{}{
+							"destination": map[string]interface{}{"host": canaryHostName},
+							"weight":      int64(percent),
+						},
+					},
+				},
+			},
+		},
+	}}
+}
+
+// applyCanaryTraffic sends percent of a deployment's traffic to its canary
+func (ds *ModelDeploymentService) applyCanaryTraffic(ctx context.Context, deployment *ModelDeployment, canary *CanaryRelease) error {
+	ds.canaries.set(deployment.ID, canaryRoute{canaryID: canary.ID, step: canary.Step, percent: canary.TrafficPercent})
+	canaryTrafficPercent.WithLabelValues(deployment.Name).Set(float64(canary.TrafficPercent))
+
+	if ds.istio == nil {
+		return nil
+	}
+	client := ds.istio.Resource(virtualServiceResource).Namespace(namespaceOf(deployment))
+	desired := canaryVirtualService(deployment, canary.TrafficPercent)
+	existing, err := client.Get(ctx, deployment.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(ctx, desired, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	desired.SetResourceVersion(existing.GetResourceVersion())
+	_, err = client.Update(ctx, desired, metav1.UpdateOptions{})
+	return err
+}
+
+// setStableVersion rolls the stable pods to a model version and its
+// artifact, if any, reporting whether every pod runs it
+func (ds *ModelDeploymentService) setStableVersion(ctx context.Context, deployment *ModelDeployment, version string, artifact *ModelArtifact) (bool, error) {
+	k8sDeployment, err := ds.k8sClient.AppsV1().Deployments(namespaceOf(deployment)).Get(ctx, deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to get deployment: %w", err)
+	}
+	if modelVersionOf(&k8sDeployment.Spec.Template) != version {
+		setModelVersion(&k8sDeployment.Spec.Template, version)
+		if artifact != nil {
+			setModelArtifact(&k8sDeployment.Spec.Template, artifact, version)
+		}
+		if _, err := ds.k8sClient.AppsV1().Deployments(namespaceOf(deployment)).Update(ctx, k8sDeployment, metav1.UpdateOptions{}); err != nil {
+			return false, fmt.Errorf("failed to update deployment: %w", err)
+		}
+		return false, nil
+	}
+
+	replicas := currentReplicas(k8sDeployment)
+	status := k8sDeployment.Status
+	done := status.ObservedGeneration >= k8sDeployment.Generation &&
+		int(status.UpdatedReplicas) >= replicas &&
+		int(status.AvailableReplicas) >= replicas &&
+		status.Replicas == status.UpdatedReplicas
+	return done, nil
+}
+
+// Comparison
+
+// variantSummary is what a variant did during a step, across instances
+type variantSummary struct {
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	P95LatencyMs float64 `json:"p95_latency_ms"`
+	QualityMean  float64 `json:"quality_mean"`
+	QualityCount int64   `json:"quality_count"`
+}
+
+// canaryComparison is the verdict on one step of a canary
+type canaryComparison struct {
+	Step       int            `json:"step"`
+	Verdict    string         `json:"verdict"` // pass, fail or pending
+	Reasons    []string       `json:"reasons,omitempty"`
+	Stable     variantSummary `json:"stable"`
+	Canary     variantSummary `json:"canary"`
+	BakedFor   float64        `json:"baked_for_seconds"`
+	EvaluateAt time.Time      `json:"evaluated_at"`
+}
+
+// bucketPercentile estimates a percentile from latency bucket counts
+func bucketPercentile(buckets []int64, p float64) float64 {
+	var total int64
+	for _, n := range buckets {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	target := p * float64(total)
+	var cumulative float64
+	for i, n := range buckets {
+		if n == 0 {
+			continue
+		}
+		if cumulative+float64(n) >= target {
+			lower := 0.0
+			if i > 0 {
+				lower = canaryLatencyBoundsMs[i-1]
+			}
+			if i >= len(canaryLatencyBoundsMs) {
+				return lower
+			}
+			upper := canaryLatencyBoundsMs[i]
+			return lower + (upper-lower)*(target-cumulative)/float64(n)
+		}
+		cumulative += float64(n)
+	}
+	return canaryLatencyBoundsMs[len(canaryLatencyBoundsMs)-1]
+}
+
+// summarizeCanary adds up the observations of the canary's current step
+func (ds *ModelDeploymentService) summarizeCanary(canary *CanaryRelease) (map[string]*variantSummary, error) {
+	var observations []CanaryObservation
+	if err := ds.db.Where("canary_id = ? AND step = ?", canary.ID, canary.Step).Find(&observations).Error; err != nil {
+		return nil, err
+	}
+
+	summaries := map[string]*variantSummary{variantStable: {}, variantCanary: {}}
+	buckets := map[string][]int64{
+		variantStable: make([]int64, len(canaryLatencyBoundsMs)+1),
+		variantCanary: make([]int64, len(canaryLatencyBoundsMs)+1),
+	}
+	qualitySums := map[string]float64{}
+	for _, o := range observations {
+		summary, ok := summaries[o.Variant]
+		if !ok {
+			continue
+		}
+		summary.Requests += o.Requests
+		summary.Errors += o.Errors
+		summary.QualityCount += o.QualityCount
+		qualitySums[o.Variant] += o.QualitySum
+		if o.LatencyBuckets != "" {
+			var counts []int64
+			if json.Unmarshal([]byte(o.LatencyBuckets), &counts) == nil {
+				for i := 0; i < len(counts) && i < len(buckets[o.Variant]); i++ {
+					buckets[o.Variant][i] += counts[i]
+				}
+			}
+		}
+	}
+	for variant, summary := range summaries {
+		if summary.Requests > 0 {
+			summary.ErrorRate = float64(summary.Errors) / float64(summary.Requests)
+		}
+		if summary.QualityCount > 0 {
+			summary.QualityMean = qualitySums[variant] / float64(summary.QualityCount)
+		}
+		summary.P95LatencyMs = math.Round(bucketPercentile(buckets[variant], 0.95)*100) / 100
+	}
+	return summaries, nil
+}
+
+// compareCanary judges the canary's current step against its criteria
+func (ds *ModelDeploymentService) compareCanary(canary *CanaryRelease, now time.Time) (*canaryComparison, error) {
+	summaries, err := ds.summarizeCanary(canary)
+	if err != nil {
+		return nil, err
+	}
+	result := &canaryComparison{
+		Step:       canary.Step,
+		Verdict:    "pending",
+		Stable:     *summaries[variantStable],
+		Canary:     *summaries[variantCanary],
+		EvaluateAt: now,
+	}
+	if canary.StepStartedAt != nil {
+		result.BakedFor = now.Sub(*canary.StepStartedAt).Seconds()
+	}
+	stable, candidate := result.Stable, result.Canary
+
+	if candidate.Requests < canary.MinRequests {
+		result.Reasons = append(result.Reasons, fmt.Sprintf("canary has served %d of %d requests", candidate.Requests, canary.MinRequests))
+		return result, nil
+	}
+
+	var failures []string
+	if candidate.ErrorRate > canary.MaxErrorRate {
+		failures = append(failures, fmt.Sprintf("error rate %.4f above %.4f", candidate.ErrorRate, canary.MaxErrorRate))
+	}
+	if stable.Requests > 0 && candidate.ErrorRate-stable.ErrorRate > canary.MaxErrorRateIncrease {
+		failures = append(failures, fmt.Sprintf("error rate %.4f exceeds stable's %.4f by more than %.4f",
+			candidate.ErrorRate, stable.ErrorRate, canary.MaxErrorRateIncrease))
+	}
+	if stable.P95LatencyMs > 0 && candidate.P95LatencyMs > stable.P95LatencyMs*(1+canary.MaxLatencyIncrease) {
+		failures = append(failures, fmt.Sprintf("p95 latency %.1fms exceeds stable's %.1fms by more than %.0f%%",
+			candidate.P95LatencyMs, stable.P95LatencyMs, canary.MaxLatencyIncrease*100))
+	}
+	if canary.MaxQualityDrop > 0 && stable.QualityCount >= canary.MinQualitySamples && candidate.QualityCount >= canary.MinQualitySamples &&
+		stable.QualityMean-candidate.QualityMean > canary.MaxQualityDrop {
+		failures = append(failures, fmt.Sprintf("quality %.4f is more than %.4f below stable's %.4f",
+			candidate.QualityMean, canary.MaxQualityDrop, stable.QualityMean))
+	}
+	if len(failures) > 0 {
+		result.Verdict = "fail"
+		result.Reasons = failures
+		return result, nil
+	}
+
+	if result.BakedFor < float64(canary.BakeWindowSeconds) {
+		result.Reasons = append(result.Reasons, fmt.Sprintf("baking for %.0fs of %ds", result.BakedFor, canary.BakeWindowSeconds))
+		return result, nil
+	}
+	if canary.MaxQualityDrop > 0 && (stable.QualityCount < canary.MinQualitySamples || candidate.QualityCount < canary.MinQualitySamples) {
+		result.Reasons = append(result.Reasons, fmt.Sprintf("waiting for %d quality scores per variant", canary.MinQualitySamples))
+		return result, nil
+	}
+	result.Verdict = "pass"
+	return result, nil
+}
+
+// Control loop
+
+// startCanaryController writes out canary observations and moves canaries
+// through their steps
+func (ds *ModelDeploymentService) startCanaryController() {
+	ticker := time.NewTicker(canaryControlInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ds.flushCanaryStats()
+		ds.reconcileCanaries()
+	}
+}
+
+func (ds *ModelDeploymentService) flushCanaryStats() {
+	now := time.Now()
+	for key, window := range ds.canaries.take() {
+		buckets, _ := json.Marshal(window.buckets)
+		observation := CanaryObservation{
+			CanaryID:       key.canaryID,
+			Step:           key.step,
+			Variant:        key.variant,
+			Requests:       window.requests,
+			Errors:         window.errors,
+			LatencyBuckets: string(buckets),
+			CreatedAt:      now,
+		}
+		if err := ds.db.Create(&observation).Error; err != nil {
+			ds.logger.Warn("Failed to store canary observation", zap.Uint("canary_id", key.canaryID), zap.Error(err))
+		}
+	}
+}
+
+func (ds *ModelDeploymentService) reconcileCanaries() {
+	var canaries []CanaryRelease
+	if err := ds.db.Where("status IN ?", activeCanaryStatuses).Find(&canaries).Error; err != nil {
+		ds.logger.Error("Failed to fetch canaries", zap.Error(err))
+		return
+	}
+
+	// Other instances change splits too; take them from the database
+	routes := make(map[uint]canaryRoute)
+	for _, canary := range canaries {
+		if canary.Status != CanaryStatusDeploying && canary.TrafficPercent > 0 {
+			routes[canary.DeploymentID] = canaryRoute{canaryID: canary.ID, step: canary.Step, percent: canary.TrafficPercent}
+		}
+	}
+	ds.canaries.replace(routes)
+
+	ctx := context.Background()
+	for i := range canaries {
+		canary := &canaries[i]
+		var deployment ModelDeployment
+		if err := ds.db.First(&deployment, canary.DeploymentID).Error; err != nil {
+			continue
+		}
+		if err := ds.advanceCanary(ctx, &deployment, canary); err != nil {
+			ds.logger.Warn("Failed to advance canary",
+				zap.String("deployment", deployment.Name),
+				zap.Uint("canary_id", canary.ID),
+				zap.Error(err))
+		}
+	}
+}
+
+// transitionCanary applies updates to a canary still in the status and step
+// it was read in, reporting whether this instance made the change
+func (ds *ModelDeploymentService) transitionCanary(canary *CanaryRelease, updates map[string]interface{}) bool {
+	updates["updated_at"] = time.Now()
+	result := ds.db.Model(&CanaryRelease{}).
+		Where("id = ? AND status = ? AND step = ?", canary.ID, canary.Status, canary.Step).
+		Updates(updates)
+	if result.Error != nil || result.RowsAffected != 1 {
+		return false
+	}
+	ds.db.First(canary, canary.ID)
+	return true
+}
+
+func (ds *ModelDeploymentService) advanceCanary(ctx context.Context, deployment *ModelDeployment, canary *CanaryRelease) error {
+	now := time.Now()
+	switch canary.Status {
+	case CanaryStatusDeploying:
+		k8sDeployment, err := ds.k8sClient.AppsV1().Deployments(namespaceOf(deployment)).Get(ctx, canaryName(deployment), metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		if err == nil && int(k8sDeployment.Status.AvailableReplicas) >= canary.Replicas {
+			if !ds.transitionCanary(canary, map[string]interface{}{
+				"status":          CanaryStatusBaking,
+				"step":            1,
+				"traffic_percent": canary.InitialPercent,
+				"step_started_at": now,
+			}) {
+				return nil
+			}
+			ds.logger.Info("Canary ready, taking traffic",
+				zap.String("deployment", deployment.Name),
+				zap.String("model_version", canary.ModelVersion),
+				zap.Int("traffic_percent", canary.TrafficPercent))
+			return ds.applyCanaryTraffic(ctx, deployment, canary)
+		}
+		if now.Sub(canary.CreatedAt) > time.Duration(canary.ReadyTimeoutSeconds)*time.Second {
+			return ds.endCanary(ctx, deployment, canary, CanaryStatusFailed, "canary pods did not become ready in time")
+		}
+		return nil
+
+	case CanaryStatusBaking:
+		comparison, err := ds.compareCanary(canary, now)
+		if err != nil {
+			return err
+		}
+		encoded, _ := json.Marshal(comparison)
+		ds.db.Model(&CanaryRelease{}).Where("id = ?", canary.ID).Update("last_comparison", string(encoded))
+
+		switch comparison.Verdict {
+		case "fail":
+			reason := "criteria failed: " + strings.Join(comparison.Reasons, "; ")
+			if canary.AutoRollback {
+				return ds.endCanary(ctx, deployment, canary, CanaryStatusRolledBack, reason)
+			}
+			if ds.transitionCanary(canary, map[string]interface{}{"status": CanaryStatusHeld, "decision": reason}) {
+				ds.logger.Warn("Canary held", zap.String("deployment", deployment.Name), zap.String("reason", reason))
+			}
+			return nil
+		case "pass":
+			if canary.StepPercent > 0 && canary.TrafficPercent < 100 {
+				next := canary.TrafficPercent + canary.StepPercent
+				if next > 100 {
+					next = 100
+				}
+				if !ds.transitionCanary(canary, map[string]interface{}{
+					"step":            canary.Step + 1,
+					"traffic_percent": next,
+					"step_started_at": now,
+					"decision":        fmt.Sprintf("step %d passed", canary.Step),
+				}) {
+					return nil
+				}
+				ds.logger.Info("Canary step passed",
+					zap.String("deployment", deployment.Name),
+					zap.Int("step", canary.Step),
+					zap.Int("traffic_percent", canary.TrafficPercent))
+				return ds.applyCanaryTraffic(ctx, deployment, canary)
+			}
+			if canary.AutoPromote {
+				return ds.startPromotion(ctx, deployment, canary, "passed every step")
+			}
+			ds.transitionCanary(canary, map[string]interface{}{"status": CanaryStatusPassed, "decision": "passed every step; awaiting promotion"})
+		}
+		return nil
+
+	case CanaryStatusPromoting:
+		done, err := ds.setStableVersion(ctx, deployment, canary.ModelVersion, canaryArtifact(canary))
+		if err != nil || !done {
+			return err
+		}
+		if err := ds.endCanary(ctx, deployment, canary, CanaryStatusPromoted, canary.Decision); err != nil {
+			return err
+		}
+		deployment.ModelVersion = canary.ModelVersion
+		deployment.ArtifactURI = canary.ArtifactURI
+		deployment.ArtifactSHA256 = canary.ArtifactSHA256
+		deployment.ArtifactSizeBytes = canary.ArtifactSizeBytes
+		ds.db.Model(deployment).Updates(map[string]interface{}{
+			"model_version":       canary.ModelVersion,
+			"artifact_uri":        canary.ArtifactURI,
+			"artifact_sha256":     canary.ArtifactSHA256,
+			"artifact_size_bytes": canary.ArtifactSizeBytes,
+			"updated_at":          now,
+		})
+		if _, err := ds.recordRevision(deployment, RevisionSourceCanary, canary.Decision, canary.CreatedBy, 0); err != nil {
+			ds.logger.Warn("Failed to record revision", zap.String("deployment", deployment.Name), zap.Error(err))
+		}
+		return nil
+	}
+	return nil
+}
+
+// startPromotion rolls the stable pods to the canary's version; the canary
+// keeps its traffic until they are done
+func (ds *ModelDeploymentService) startPromotion(ctx context.Context, deployment *ModelDeployment, canary *CanaryRelease, reason string) error {
+	if !ds.transitionCanary(canary, map[string]interface{}{"status": CanaryStatusPromoting, "decision": reason}) {
+		return nil
+	}
+	ds.logger.Info("Promoting canary",
+		zap.String("deployment", deployment.Name),
+		zap.String("model_version", canary.ModelVersion),
+		zap.String("reason", reason))
+	_, err := ds.setStableVersion(ctx, deployment, canary.ModelVersion, canaryArtifact(canary))
+	return err
+}
+
+// endCanary removes the canary and records how it ended
+func (ds *ModelDeploymentService) endCanary(ctx context.Context, deployment *ModelDeployment, canary *CanaryRelease, status, reason string) error {
+	previous := canary.Status
+	now := time.Now()
+	if !ds.transitionCanary(canary, map[string]interface{}{
+		"status":          status,
+		"decision":        reason,
+		"traffic_percent": 0,
+		"completed_at":    now,
+	}) {
+		return nil
+	}
+
+	// A rollback during promotion also returns the stable pods to the
+	// version they ran
+	if previous == CanaryStatusPromoting && status == CanaryStatusRolledBack {
+		if _, err := ds.setStableVersion(ctx, deployment, canary.PreviousVersion, deployedArtifact(deployment)); err != nil {
+			ds.logger.Error("Failed to restore stable model version", zap.String("deployment", deployment.Name), zap.Error(err))
+		}
+	}
+
+	canaryReleases.WithLabelValues(deployment.Name, status).Inc()
+	ds.logger.Info("Canary ended",
+		zap.String("deployment", deployment.Name),
+		zap.String("model_version", canary.ModelVersion),
+		zap.String("status", status),
+		zap.String("reason", reason))
+	return ds.deleteCanaryResources(ctx, deployment)
+}
+
+// Handlers
+
+// activeCanary loads the deployment's running canary
+func (ds *ModelDeploymentService) activeCanary(deploymentID uint) (*CanaryRelease, error) {
+	var canary CanaryRelease
+	err := ds.db.Where("deployment_id = ? AND status IN ?", deploymentID, activeCanaryStatuses).First(&canary).Error
+	if err != nil {
+		return nil, err
+	}
+	return &canary, nil
+}
+
+// Start a canary release of a new model version
+func (ds *ModelDeploymentService) createCanaryDeployment(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	if deployment.Status != "running" {
+		c.JSON(409, gin.H{"error": "Deployment not running"})
+		return
+	}
+
+	var request struct {
+		ModelVersion         string   `json:"model_version" binding:"required"`
+		Replicas             int      `json:"replicas" binding:"min=0,max=50"`
+		TrafficPercent       int      `json:"traffic_percent" binding:"min=0,max=100"`
+		StepPercent          int      `json:"step_percent" binding:"min=0,max=100"`
+		BakeWindowSeconds    int      `json:"bake_window_seconds" binding:"min=0"`
+		ReadyTimeoutSeconds  int      `json:"ready_timeout_seconds" binding:"min=0"`
+		MinRequests          *int64   `json:"min_requests"`
+		MaxErrorRate         *float64 `json:"max_error_rate"`
+		MaxErrorRateIncrease *float64 `json:"max_error_rate_increase"`
+		MaxLatencyIncrease   *float64 `json:"max_latency_increase"`
+		MaxQualityDrop       float64  `json:"max_quality_drop" binding:"min=0"`
+		MinQualitySamples    int64    `json:"min_quality_samples" binding:"min=0"`
+		AutoPromote          *bool    `json:"auto_promote"`
+		AutoRollback         *bool    `json:"auto_rollback"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if request.ModelVersion == deployment.ModelVersion {
+		c.JSON(400, gin.H{"error": "Canary must run a different model version"})
+		return
+	}
+	if _, err := ds.activeCanary(deployment.ID); err == nil {
+		c.JSON(409, gin.H{"error": "Deployment already has a canary"})
+		return
+	} else if err != gorm.ErrRecordNotFound {
+		c.JSON(500, gin.H{"error": "Failed to check canaries"})
+		return
+	}
+
+	canary := CanaryRelease{
+		DeploymentID:         deployment.ID,
+		ModelVersion:         request.ModelVersion,
+		PreviousVersion:      deployment.ModelVersion,
+		Replicas:             request.Replicas,
+		Status:               CanaryStatusDeploying,
+		InitialPercent:       request.TrafficPercent,
+		StepPercent:          request.StepPercent,
+		BakeWindowSeconds:    request.BakeWindowSeconds,
+		ReadyTimeoutSeconds:  request.ReadyTimeoutSeconds,
+		MinRequests:          100,
+		MaxErrorRate:         0.05,
+		MaxErrorRateIncrease: 0.01,
+		MaxLatencyIncrease:   0.2,
+		MaxQualityDrop:       request.MaxQualityDrop,
+		MinQualitySamples:    request.MinQualitySamples,
+		AutoPromote:          true,
+		AutoRollback:         true,
+		LastComparison:       "{}",
+		CreatedBy:            c.GetHeader("X-User-ID"),
+		CreatedAt:            time.Now(),
+		UpdatedAt:            time.Now(),
+	}
+	if canary.Replicas == 0 {
+		canary.Replicas = 1
+	}
+	if canary.InitialPercent == 0 {
+		canary.InitialPercent = 10
+	}
+	if canary.BakeWindowSeconds == 0 {
+		canary.BakeWindowSeconds = 600
+	}
+	if canary.ReadyTimeoutSeconds == 0 {
+		canary.ReadyTimeoutSeconds = 600
+	}
+	if canary.MinQualitySamples == 0 {
+		canary.MinQualitySamples = 30
+	}
+	if request.MinRequests != nil {
+		canary.MinRequests = *request.MinRequests
+	}
+	if request.MaxErrorRate != nil {
+		canary.MaxErrorRate = *request.MaxErrorRate
+	}
+	if request.MaxErrorRateIncrease != nil {
+		canary.MaxErrorRateIncrease = *request.MaxErrorRateIncrease
+	}
+	if request.MaxLatencyIncrease != nil {
+		canary.MaxLatencyIncrease = *request.MaxLatencyIncrease
+	}
+	if request.AutoPromote != nil {
+		canary.AutoPromote = *request.AutoPromote
+	}
+	if request.AutoRollback != nil {
+		canary.AutoRollback = *request.AutoRollback
+	}
+	if canary.MinRequests < 0 || canary.MaxErrorRate < 0 || canary.MaxErrorRateIncrease < 0 || canary.MaxLatencyIncrease < 0 {
+		c.JSON(400, gin.H{"error": "Canary criteria cannot be negative"})
+		return
+	}
+
+	artifact, err := versionArtifact(c.Request.Context(), &deployment, canary.ModelVersion)
+	if err != nil {
+		ds.respondArtifactError(c, &deployment, err)
+		return
+	}
+	if artifact != nil {
+		canary.ArtifactURI = artifact.URI
+		canary.ArtifactSHA256 = artifact.SHA256
+		canary.ArtifactSizeBytes = artifact.SizeBytes
+	}
+
+	if err := ds.db.Create(&canary).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create canary"})
+		return
+	}
+
+	if err := ds.createCanaryResources(c.Request.Context(), &deployment, &canary); err != nil {
+		ds.logger.Error("Failed to start canary", zap.String("deployment", deployment.Name), zap.Error(err))
+		ds.endCanary(c.Request.Context(), &deployment, &canary, CanaryStatusFailed, err.Error())
+		c.JSON(500, gin.H{"error": "Failed to start canary", "canary": canary})
+		return
+	}
+
+	ds.logger.Info("Canary started",
+		zap.String("deployment", deployment.Name),
+		zap.String("model_version", canary.ModelVersion),
+		zap.String("previous_version", canary.PreviousVersion))
+
+	c.JSON(202, canary)
+}
+
+// Get the deployment's current or latest canary, compared with stable
+func (ds *ModelDeploymentService) getCanaryDeployment(c *gin.Context) {
+	var canary CanaryRelease
+	if err := ds.db.Where("deployment_id = ?", c.Param("id")).Order("created_at DESC").First(&canary).Error; err != nil {
+		c.JSON(404, gin.H{"error": "No canary for this deployment"})
+		return
+	}
+
+	response := gin.H{"canary": canary}
+	if canary.Step > 0 {
+		comparison, err := ds.compareCanary(&canary, time.Now())
+		if err == nil {
+			response["comparison"] = comparison
+		}
+	}
+	c.JSON(200, response)
+}
+
+// List the deployment's canaries
+func (ds *ModelDeploymentService) listCanaryDeployments(c *gin.Context) {
+	var canaries []CanaryRelease
+	if err := ds.db.Where("deployment_id = ?", c.Param("id")).Order("created_at DESC").Limit(50).Find(&canaries).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch canaries"})
+		return
+	}
+	c.JSON(200, gin.H{"canaries": canaries})
+}
+
+// Promote the deployment's canary now, whatever its comparison says
+func (ds *ModelDeploymentService) promoteCanaryDeployment(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	canary, err := ds.activeCanary(deployment.ID)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "No running canary"})
+		return
+	}
+	if canary.Status == CanaryStatusDeploying || canary.Status == CanaryStatusPromoting {
+		c.JSON(409, gin.H{"error": "Canary cannot be promoted while " + canary.Status})
+		return
+	}
+
+	reason := "promoted manually"
+	if user := c.GetHeader("X-User-ID"); user != "" {
+		reason += " by " + user
+	}
+	if err := ds.startPromotion(c.Request.Context(), &deployment, canary, reason); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to promote canary"})
+		return
+	}
+	if canary.Status != CanaryStatusPromoting {
+		c.JSON(409, gin.H{"error": "Canary changed while promoting; try again"})
+		return
+	}
+	c.JSON(202, canary)
+}
+
+// Roll the deployment's canary back, returning all traffic to stable
+func (ds *ModelDeploymentService) rollbackCanaryDeployment(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	canary, err := ds.activeCanary(deployment.ID)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "No running canary"})
+		return
+	}
+
+	reason := "rolled back manually"
+	if user := c.GetHeader("X-User-ID"); user != "" {
+		reason += " by " + user
+	}
+	if err := ds.endCanary(c.Request.Context(), &deployment, canary, CanaryStatusRolledBack, reason); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to remove canary resources"})
+		return
+	}
+	if canary.Status != CanaryStatusRolledBack {
+		c.JSON(409, gin.H{"error": "Canary changed while rolling back; try again"})
+		return
+	}
+	c.JSON(200, canary)
+}
+
+// Record quality scores for predictions of one variant
+func (ds *ModelDeploymentService) canaryFeedback(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	var request struct {
+		Variant string    `json:"variant" binding:"required,oneof=stable canary"`
+		Scores  []float64 `json:"scores" binding:"required,min=1,max=1000"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	canary, err := ds.activeCanary(deployment.ID)
+	if err != nil || canary.Step == 0 {
+		c.JSON(409, gin.H{"error": "No canary is taking traffic"})
+		return
+	}
+
+	observation := CanaryObservation{
+		CanaryID:       canary.ID,
+		Step:           canary.Step,
+		Variant:        request.Variant,
+		LatencyBuckets: "[]",
+		CreatedAt:      time.Now(),
+	}
+	for _, score := range request.Scores {
+		if math.IsNaN(score) || math.IsInf(score, 0) {
+			c.JSON(400, gin.H{"error": "Scores must be finite numbers"})
+			return
+		}
+		observation.QualitySum += score
+		observation.QualityCount++
+	}
+	if err := ds.db.Create(&observation).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to record feedback"})
+		return
+	}
+	c.JSON(200, gin.H{"recorded": observation.QualityCount, "step": canary.Step})
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"gorm.io/gorm/clause"
+)
+
+// Traffic capture. A deployment can have a share of its HTTP predictions
+// kept whole, request and response, for debugging what a model was sent and
+// what it answered. Payloads pass through the deployment's redactors
+// before they're stored: a capture a redactor fails on is dropped, never
+// stored as it came. Captures are kept for RetentionDays.
+//
+// Redactors are looked up by name in captureRedactors; built in are
+// pattern redactors (email, phone, credit_card, ssn, ip_address), fields,
+// which masks the values of the configured JSON keys at any depth, and
+// service, which sends payloads to PII_REDACTION_SERVICE_URL and stores
+// what it returns.
+
+const (
+	defaultCaptureMaxBytes  = 64 << 10
+	defaultCaptureRetention = 7
+	maxCapturesPage         = 200
+	redactionMark           = "[REDACTED]"
+)
+
+// defaultRedactors run when a capture config names none
+var defaultRedactors = []string{"email", "credit_card", "ssn", "phone"}
+
+// CaptureConfig is how a deployment's traffic is captured
+type CaptureConfig struct {
+	ID              uint      `json:"id" gorm:"primaryKey"`
+	DeploymentID    uint      `json:"deployment_id" gorm:"uniqueIndex;not null"`
+	Enabled         bool      `json:"enabled"`
+	SampleRate      float64   `json:"sample_rate"` // share of predictions captured, 0-1
+	Redactors       []string  `json:"redactors" gorm:"type:jsonb;serializer:json"`
+	RedactFields    []string  `json:"redact_fields" gorm:"type:jsonb;serializer:json"` // JSON keys the fields redactor masks
+	MaxPayloadBytes int       `json:"max_payload_bytes"`                               // longer payloads are cut
+	RetentionDays   int       `json:"retention_days"`
+	CreatedBy       string    `json:"created_by"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// CapturedInference is one captured prediction, redacted
+type CapturedInference struct {
+	ID                uint      `json:"id" gorm:"primaryKey"`
+	DeploymentID      uint      `json:"deployment_id" gorm:"index:idx_captures_deployment_time,priority:1;not null"`
+	RequestID         string    `json:"request_id" gorm:"index"`
+	Variant           string    `json:"variant,omitempty"`
+	StatusCode        int       `json:"status_code"`
+	LatencyMs         int64     `json:"latency_ms"`
+	ContentType       string    `json:"content_type"`
+	Request           string    `json:"request"`
+	Response          string    `json:"response"`
+	RequestTruncated  bool      `json:"request_truncated"`
+	ResponseTruncated bool      `json:"response_truncated"`
+	Redactions        int       `json:"redactions"` // values masked
+	RedactedBy        []string  `json:"redacted_by" gorm:"type:jsonb;serializer:json"`
+	CapturedAt        time.Time `json:"captured_at" gorm:"index:idx_captures_deployment_time,priority:2;index"`
+}
+
+// Redactor removes personal data from a payload, returning it with the
+// number of values masked
+type Redactor interface {
+	Redact(ctx context.Context, payload []byte) ([]byte, int, error)
+}
+
+// captureRedactors builds the redactors a capture config can name
+var captureRedactors = map[string]func(config *CaptureConfig) Redactor{
+	"email":       patternRedactor(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	"phone":       patternRedactor(`\+?\d{1,3}[\s.\-]?\(?\d{3}\)?[\s.\-]?\d{3}[\s.\-]?\d{4}\b`),
+	"credit_card": patternRedactor(`\b(?:\d[ \-]?){13,16}\b`),
+	"ssn":         patternRedactor(`\b\d{3}-\d{2}-\d{4}\b`),
+	"ip_address":  patternRedactor(`\b(?:\d{1,3}\.){3}\d{1,3}\b`),
+	"fields": func(config *CaptureConfig) Redactor {
+		fields := make(map[string]bool, len(config.RedactFields))
+		for _, field := range config.RedactFields {
+			fields[strings.ToLower(field)] = true
+		}
+		return fieldRedactor(fields)
+	},
+	"service": func(*CaptureConfig) Redactor { return serviceRedactor{} },
+}
+
+var (
+	capturedInferences = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_inference_captures_total",
+			Help: "Predictions captured, by outcome",
+		},
+		[]string{"deployment", "outcome"},
+	)
+	captureRedactions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_inference_capture_redactions_total",
+			Help: "Values masked in captured payloads, by redactor",
+		},
+		[]string{"redactor"},
+	)
+)
+
+// regexRedactor masks what a pattern matches
+type regexRedactor struct{ pattern *regexp.Regexp }
+
+func patternRedactor(pattern string) func(*CaptureConfig) Redactor {
+	redactor := regexRedactor{pattern: regexp.MustCompile(pattern)}
+	return func(*CaptureConfig) Redactor { return redactor }
+}
+
+func (r regexRedactor) Redact(_ context.Context, payload []byte) ([]byte, int, error) {
+	count := 0
+	redacted := r.pattern.ReplaceAllFunc(payload, func([]byte) []byte {
+		count++
+		return []byte(redactionMark)
+	})
+	return redacted, count, nil
+}
+
+// fieldRedactor masks the values of JSON keys, matched case-insensitively;
+// payloads that aren't JSON pass untouched
+type fieldRedactor map[string]bool
+
+func (r fieldRedactor) Redact(_ context.Context, payload []byte) ([]byte, int, error) {
+	var decoded interface{}
+	if len(r) == 0 || json.Unmarshal(payload, &decoded) != nil {
+		return payload, 0, nil
+	}
+	count := 0
+	var walk func(value interface{}) interface{}
+	walk = func(value interface{}) interface{} {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			for key, v := range value {
+				if r[strings.ToLower(key)] {
+					value[key] = redactionMark
+					count++
+				} else {
+					value[key] = walk(v)
+				}
+			}
+		case []interface{}:
+			for i, v := range value {
+				value[i] = walk(v)
+			}
+		}
+		return value
+	}
+	decoded = walk(decoded)
+	if count == 0 {
+		return payload, 0, nil
+	}
+	redacted, err := json.Marshal(decoded)
+	return redacted, count, err
+}
+
+// serviceRedactor has an external service redact payloads. It answers
+// {"payload": ..., "redactions": n} to {"payload": ...}.
+type serviceRedactor struct{}
+
+func (serviceRedactor) Redact(ctx context.Context, payload []byte) ([]byte, int, error) {
+	url := getEnv("PII_REDACTION_SERVICE_URL", "")
+	if url == "" {
+		return nil, 0, errors.New("PII_REDACTION_SERVICE_URL is not set")
+	}
+	body, _ := json.Marshal(gin.H{"payload": string(payload)})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("redaction service answered %d", resp.StatusCode)
+	}
+	var result struct {
+		Payload    *string `json:"payload"`
+		Redactions int     `json:"redactions"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&result); err != nil || result.Payload == nil {
+		return nil, 0, errors.New("redaction service returned no payload")
+	}
+	return []byte(*result.Payload), result.Redactions, nil
+}
+
+// pendingCapture is a prediction waiting to be redacted and stored
+type pendingCapture struct {
+	config  *CaptureConfig
+	capture CapturedInference
+	name    string
+	request []byte
+	reply   []byte
+}
+
+// captureRecorder samples predictions of deployments with capture on
+type captureRecorder struct {
+	mutex   sync.RWMutex
+	configs map[uint]*CaptureConfig
+	queue   chan pendingCapture
+}
+
+func newCaptureRecorder() *captureRecorder {
+	return &captureRecorder{configs: make(map[uint]*CaptureConfig), queue: make(chan pendingCapture, 256)}
+}
+
+func (r *captureRecorder) set(config *CaptureConfig) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !config.Enabled || config.SampleRate <= 0 {
+		delete(r.configs, config.DeploymentID)
+		return
+	}
+	r.configs[config.DeploymentID] = config
+}
+
+// capture queues a prediction when it falls in the deployment's share
+func (r *captureRecorder) capture(c *gin.Context, deployment *ModelDeployment, request, reply []byte, status int, latency time.Duration) {
+	r.mutex.RLock()
+	config, ok := r.configs[deployment.ID]
+	r.mutex.RUnlock()
+	if !ok || (config.SampleRate < 1 && rand.Float64() >= config.SampleRate) {
+		return
+	}
+
+	pending := pendingCapture{
+		config: config,
+		name:   deployment.Name,
+		capture: CapturedInference{
+			DeploymentID: deployment.ID,
+			RequestID:    c.GetHeader("X-Request-ID"),
+			StatusCode:   status,
+			LatencyMs:    latency.Milliseconds(),
+			ContentType:  c.ContentType(),
+			CapturedAt:   time.Now().UTC(),
+		},
+	}
+	if deployment.variant != nil {
+		pending.capture.Variant = deployment.variant.name
+	}
+	// Whole copies: payloads are cut to length only once redacted, so a cut
+	// can't hide a field from the redactors
+	pending.request = append([]byte(nil), request...)
+	pending.reply = append([]byte(nil), reply...)
+
+	select {
+	case r.queue <- pending:
+	default:
+		capturedInferences.WithLabelValues(deployment.Name, "dropped").Inc()
+	}
+}
+
+func clip(payload []byte, limit int) (string, bool) {
+	if len(payload) > limit {
+		return string(payload[:limit]), true
+	}
+	return string(payload), false
+}
+
+// redactPayload runs a config's redactors over a payload in order
+func redactPayload(ctx context.Context, config *CaptureConfig, payload []byte) ([]byte, int, error) {
+	total := 0
+	for _, name := range config.Redactors {
+		factory, ok := captureRedactors[name]
+		if !ok {
+			return nil, 0, fmt.Errorf("unknown redactor %s", name)
+		}
+		redacted, count, err := factory(config).Redact(ctx, payload)
+		if err != nil {
+			return nil, 0, fmt.Errorf("redactor %s: %w", name, err)
+		}
+		payload = redacted
+		total += count
+		captureRedactions.WithLabelValues(name).Add(float64(count))
+	}
+	return payload, total, nil
+}
+
+// store redacts a capture and saves it
+func (ds *ModelDeploymentService) storeCapture(pending pendingCapture) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	request, requestRedactions, err := redactPayload(ctx, pending.config, pending.request)
+	if err == nil {
+		var reply []byte
+		var replyRedactions int
+		reply, replyRedactions, err = redactPayload(ctx, pending.config, pending.reply)
+		limit := pending.config.MaxPayloadBytes
+		pending.capture.Request, pending.capture.RequestTruncated = clip(request, limit)
+		pending.capture.Response, pending.capture.ResponseTruncated = clip(reply, limit)
+		pending.capture.Redactions = requestRedactions + replyRedactions
+	}
+	if err != nil {
+		capturedInferences.WithLabelValues(pending.name, "redaction_failed").Inc()
+		ds.logger.Warn("Dropped capture that failed redaction", zap.String("deployment", pending.name), zap.Error(err))
+		return
+	}
+	pending.capture.RedactedBy = pending.config.Redactors
+
+	if err := ds.db.Create(&pending.capture).Error; err != nil {
+		capturedInferences.WithLabelValues(pending.name, "error").Inc()
+		ds.logger.Warn("Failed to store capture", zap.String("deployment", pending.name), zap.Error(err))
+		return
+	}
+	capturedInferences.WithLabelValues(pending.name, "stored").Inc()
+}
+
+// startTrafficCapture stores queued captures, keeps the capture configs
+// fresh and removes captures past their retention
+func (ds *ModelDeploymentService) startTrafficCapture() {
+	go func() {
+		for pending := range ds.captures.queue {
+			ds.storeCapture(pending)
+		}
+	}()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		var configs []CaptureConfig
+		if err := ds.db.Find(&configs).Error; err != nil {
+			ds.logger.Warn("Failed to load capture configs", zap.Error(err))
+			continue
+		}
+		for i := range configs {
+			config := &configs[i]
+			ds.captures.set(config)
+			cutoff := time.Now().AddDate(0, 0, -config.RetentionDays)
+			ds.db.Where("deployment_id = ? AND captured_at < ?", config.DeploymentID, cutoff).Delete(&CapturedInference{})
+		}
+	}
+}
+
+// Turn capture on or off for a deployment, or change how it captures
+func (ds *ModelDeploymentService) setCaptureConfig(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+
+	config := CaptureConfig{Enabled: true}
+	if err := c.ShouldBindJSON(&config); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if config.SampleRate < 0 || config.SampleRate > 1 {
+		c.JSON(400, gin.H{"error": "sample_rate must be between 0 and 1"})
+		return
+	}
+	if config.SampleRate == 0 {
+		config.SampleRate = 0.01
+	}
+	if len(config.Redactors) == 0 {
+		config.Redactors = defaultRedactors
+	}
+	for _, name := range config.Redactors {
+		if _, ok := captureRedactors[name]; !ok {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Unknown redactor %s", name)})
+			return
+		}
+		if name == "service" && getEnv("PII_REDACTION_SERVICE_URL", "") == "" {
+			c.JSON(400, gin.H{"error": "The service redactor needs PII_REDACTION_SERVICE_URL"})
+			return
+		}
+		if name == "fields" && len(config.RedactFields) == 0 {
+			c.JSON(400, gin.H{"error": "The fields redactor needs redact_fields"})
+			return
+		}
+	}
+	if config.MaxPayloadBytes <= 0 {
+		config.MaxPayloadBytes = defaultCaptureMaxBytes
+	}
+	if config.RetentionDays <= 0 {
+		config.RetentionDays = defaultCaptureRetention
+	}
+	config.ID = 0
+	config.DeploymentID = deployment.ID
+
+	err := ds.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "deployment_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"enabled", "sample_rate", "redactors", "redact_fields",
+			"max_payload_bytes", "retention_days", "created_by", "updated_at"}),
+	}).Create(&config).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save capture config"})
+		return
+	}
+	ds.db.Where("deployment_id = ?", deployment.ID).First(&config)
+	ds.captures.set(&config)
+
+	ds.logger.Info("Traffic capture configured",
+		zap.String("deployment", deployment.Name),
+		zap.Bool("enabled", config.Enabled),
+		zap.Float64("sample_rate", config.SampleRate),
+		zap.Strings("redactors", config.Redactors))
+	c.JSON(200, config)
+}
+
+// Capture config of a deployment
+func (ds *ModelDeploymentService) getCaptureConfig(c *gin.Context) {
+	var config CaptureConfig
+	if err := ds.db.Where("deployment_id = ?", c.Param("id")).First(&config).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Capture not configured"})
+		return
+	}
+	var stored int64
+	ds.db.Model(&CapturedInference{}).Where("deployment_id = ?", config.DeploymentID).Count(&stored)
+	c.JSON(200, gin.H{"config": config, "captures": stored})
+}
+
+// Captured predictions of a deployment, newest first. Pages follow the
+// cursor of the previous one.
+func (ds *ModelDeploymentService) listCaptures(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > maxCapturesPage {
+		limit = 50
+	}
+	query := ds.db.Where("deployment_id = ?", c.Param("id"))
+	if cursor := c.Query("cursor"); cursor != "" {
+		before, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		query = query.Where("id < ?", before)
+	}
+	if requestID := c.Query("request_id"); requestID != "" {
+		query = query.Where("request_id = ?", requestID)
+	}
+	if status := c.Query("status_code"); status != "" {
+		query = query.Where("status_code = ?", status)
+	}
+	if c.Query("errors") == "true" {
+		query = query.Where("status_code >= ?", 400)
+	}
+	for param, op := range map[string]string{"since": ">=", "until": "<"} {
+		if value := c.Query(param); value != "" {
+			at, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(400, gin.H{"error": param + " must be an RFC 3339 time"})
+				return
+			}
+			query = query.Where("captured_at "+op+" ?", at)
+		}
+	}
+
+	var captures []CapturedInference
+	if err := query.Order("id DESC").Limit(limit + 1).Find(&captures).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list captures"})
+		return
+	}
+	hasMore := len(captures) > limit
+	if hasMore {
+		captures = captures[:limit]
+	}
+	cursor := ""
+	if hasMore {
+		cursor = strconv.FormatUint(uint64(captures[len(captures)-1].ID), 10)
+	}
+	c.JSON(200, gin.H{"captures": captures, "cursor": cursor, "has_more": hasMore})
+}
+
+// One captured prediction
+func (ds *ModelDeploymentService) getCapture(c *gin.Context) {
+	var capture CapturedInference
+	if err := ds.db.Where("deployment_id = ? AND id = ?", c.Param("id"), c.Param("capture_id")).First(&capture).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Capture not found"})
+		return
+	}
+	c.JSON(200, capture)
+}
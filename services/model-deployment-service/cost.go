@@ -0,0 +1,932 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Cost tracking. A deployment costs what its replicas request: CPU cores,
+// memory and GPUs, each priced per hour from the resource_prices table, or
+// from the built-in list prices where the table has no row. Replica counts
+// come from Kubernetes, so replicas added by the autoscaler are paid for
+// too. Every hour the cost of each running deployment is recorded, and
+// reports show what was spent over a period next to the current run rate.
+//
+// Costs are reported by team, project, model or environment, and by any
+// of the cost labels deployments carry, e.g. cost-center; samples keep the
+// team, project and labels the deployment had at the time.
+//
+// A deployment is an idle-waste candidate when its utilization stayed low
+// through the whole idle window: its metric samples cover the window and at
+// least idleSustainedShare of them are below the CPU threshold (and, with
+// GPUs, the GPU threshold).
+
+// Priced resources
+const (
+	PriceResourceCPU    = "cpu"    // per core-hour
+	PriceResourceMemory = "memory" // per GiB-hour
+	PriceResourceGPU    = "gpu"    // per GPU-hour, by GPU type
+)
+
+// Idle deployment recommendations
+const (
+	IdleRecommendScaleDown = "scale_to_min_replicas"
+	IdleRecommendRemove    = "remove_or_consolidate"
+)
+
+// costLabelKey is what a cost label key may look like
+var costLabelKey = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]{0,61}[a-z0-9])?$`)
+
+const (
+	hoursPerMonth      = 730
+	idleSustainedShare = 0.95
+	costSampleInterval = time.Hour
+)
+
+// List prices used where resource_prices has no row
+var (
+	defaultResourcePrices = map[string]float64{
+		PriceResourceCPU:    0.0316,
+		PriceResourceMemory: 0.0042,
+		PriceResourceGPU:    2.48,
+	}
+	defaultGPUPrices = map[string]float64{
+		"nvidia-tesla-t4":   0.35,
+		"nvidia-l4":         0.71,
+		"nvidia-tesla-v100": 2.48,
+		"nvidia-tesla-a100": 2.93,
+		"nvidia-h100-80gb":  9.80,
+	}
+)
+
+// ResourcePrice is the hourly price of a resource. GPU prices are per GPU
+// type; the row with no type prices GPUs of any other type.
+type ResourcePrice struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Resource    string    `json:"resource" gorm:"uniqueIndex:idx_resource_price;not null"`
+	GPUType     string    `json:"gpu_type" gorm:"uniqueIndex:idx_resource_price"`
+	HourlyPrice float64   `json:"hourly_price"`
+	Currency    string    `json:"currency" gorm:"default:'USD'"`
+	UpdatedBy   string    `json:"updated_by"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// DeploymentCostSample is what a deployment cost during one hour
+type DeploymentCostSample struct {
+	ID           uint              `json:"id" gorm:"primaryKey"`
+	DeploymentID uint              `json:"deployment_id" gorm:"uniqueIndex:idx_cost_sample_hour"`
+	Hour         time.Time         `json:"hour" gorm:"uniqueIndex:idx_cost_sample_hour;index"`
+	Team         string            `json:"team" gorm:"index"`
+	Project      string            `json:"project" gorm:"index"`
+	Labels       map[string]string `json:"labels" gorm:"type:jsonb;serializer:json"`
+	ModelID      string            `json:"model_id" gorm:"index"`
+	Environment  string            `json:"environment"`
+	Replicas     int               `json:"replicas"`
+	CPUCost      float64           `json:"cpu_cost"`
+	MemoryCost   float64           `json:"memory_cost"`
+	GPUCost      float64           `json:"gpu_cost"`
+	Cost         float64           `json:"cost"`
+}
+
+// DeploymentCost is the run rate of a deployment
+type DeploymentCost struct {
+	DeploymentID uint    `json:"deployment_id"`
+	Name         string  `json:"name"`
+	ModelID      string  `json:"model_id"`
+	Team         string  `json:"team"`
+	Project      string  `json:"project"`
+	Environment  string  `json:"environment"`
+	Replicas     int     `json:"replicas"`
+	CPUCores     float64 `json:"cpu_cores"`  // per replica
+	MemoryGiB    float64 `json:"memory_gib"` // per replica
+	GPUs         int     `json:"gpus"`       // per replica
+	GPUShare     float64 `json:"gpu_share"`  // whole GPUs taken up per replica, less than gpus when shared
+	GPUType      string  `json:"gpu_type,omitempty"`
+	CPUCost      float64 `json:"cpu_hourly_cost"`
+	MemoryCost   float64 `json:"memory_hourly_cost"`
+	GPUCost      float64 `json:"gpu_hourly_cost"`
+	HourlyCost   float64 `json:"hourly_cost"`
+	MonthlyCost  float64 `json:"monthly_cost"`
+	Currency     string  `json:"currency"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// IdleDeployment is a deployment that has been using little of what it pays for
+type IdleDeployment struct {
+	DeploymentCost
+	Samples           int64   `json:"samples"`
+	LowShare          float64 `json:"low_utilization_share"`
+	AvgCPUUtilization float64 `json:"avg_cpu_utilization"`
+	AvgGPUUtilization float64 `json:"avg_gpu_utilization"`
+	AvgThroughputRPS  float64 `json:"avg_throughput_rps"`
+	Recommendation    string  `json:"recommendation"`
+	MonthlySavings    float64 `json:"monthly_savings"`
+}
+
+// idleCriteria is what counts as idle
+type idleCriteria struct {
+	Window       time.Duration
+	CPUThreshold float64 // percent
+	GPUThreshold float64 // percent
+}
+
+var (
+	deploymentHourlyCost = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "model_deployment_hourly_cost",
+			Help: "Current hourly cost of a model deployment",
+		},
+		[]string{"deployment", "team", "environment"},
+	)
+	deploymentIdleWaste = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "model_deployment_idle_monthly_waste",
+			Help: "Monthly cost that could be saved on an idle model deployment",
+		},
+		[]string{"deployment", "team"},
+	)
+)
+
+// priceTable is the effective price of every resource
+type priceTable struct {
+	cpu        float64
+	memory     float64
+	defaultGPU float64
+	gpu        map[string]float64
+	currency   string
+}
+
+// gpuPrice prices a GPU type; of several types, the dearest, since pods
+// may land on any of them
+func (p *priceTable) gpuPrice(gpuType string) float64 {
+	price, found := 0.0, false
+	for _, t := range strings.Split(gpuType, ",") {
+		if typePrice, ok := p.gpu[strings.TrimSpace(t)]; ok && typePrice > price {
+			price, found = typePrice, true
+		}
+	}
+	if found {
+		return price
+	}
+	return p.defaultGPU
+}
+
+// loadPrices overlays the configured prices on the list prices
+func (ds *ModelDeploymentService) loadPrices() (*priceTable, error) {
+	prices := &priceTable{
+		cpu:        defaultResourcePrices[PriceResourceCPU],
+		memory:     defaultResourcePrices[PriceResourceMemory],
+		defaultGPU: defaultResourcePrices[PriceResourceGPU],
+		gpu:        make(map[string]float64, len(defaultGPUPrices)),
+		currency:   "USD",
+	}
+	for gpuType, price := range defaultGPUPrices {
+		prices.gpu[gpuType] = price
+	}
+
+	var rows []ResourcePrice
+	if err := ds.db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		switch row.Resource {
+		case PriceResourceCPU:
+			prices.cpu = row.HourlyPrice
+		case PriceResourceMemory:
+			prices.memory = row.HourlyPrice
+		case PriceResourceGPU:
+			if row.GPUType == "" {
+				prices.defaultGPU = row.HourlyPrice
+			} else {
+				prices.gpu[row.GPUType] = row.HourlyPrice
+			}
+		}
+		if row.Currency != "" {
+			prices.currency = row.Currency
+		}
+	}
+	return prices, nil
+}
+
+// liveReplicas is the replica count of each serving Deployment, by name
+func (ds *ModelDeploymentService) liveReplicas(ctx context.Context) (map[string]int, error) {
+	list, err := ds.k8sClient.AppsV1().Deployments(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: "managed-by=002aic-platform",
+	})
+	if err != nil {
+		return nil, err
+	}
+	replicas := make(map[string]int, len(list.Items))
+	for _, item := range list.Items {
+		replicas[item.Name] = int(item.Status.Replicas)
+	}
+	return replicas, nil
+}
+
+// replicasOf prefers the count Kubernetes reports over the requested one
+func replicasOf(deployment *ModelDeployment, live map[string]int) int {
+	if n, ok := live[deployment.Name]; ok {
+		return n
+	}
+	return deployment.Replicas
+}
+
+func quantityValue(s string) float64 {
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		return 0
+	}
+	return q.AsApproximateFloat64()
+}
+
+// costOf prices a deployment running the given number of replicas
+func costOf(deployment *ModelDeployment, replicas int, prices *priceTable) DeploymentCost {
+	cost := DeploymentCost{
+		DeploymentID: deployment.ID,
+		Name:         deployment.Name,
+		ModelID:      deployment.ModelID,
+		Team:         deployment.Team,
+		Project:      deployment.Project,
+		Environment:  deployment.Environment,
+		Replicas:     replicas,
+		CPUCores:     quantityValue(deployment.CPU),
+		MemoryGiB:    quantityValue(deployment.Memory) / (1 << 30),
+		GPUs:         deployment.GPU,
+		GPUShare:     gpuShare(deployment),
+		GPUType:      deployment.GPUType,
+		Currency:     prices.currency,
+		Labels:       deployment.CostLabels,
+	}
+	n := float64(replicas)
+	cost.CPUCost = n * cost.CPUCores * prices.cpu
+	cost.MemoryCost = n * cost.MemoryGiB * prices.memory
+	if deployment.GPU > 0 {
+		cost.GPUCost = n * cost.GPUShare * prices.gpuPrice(deployment.GPUType)
+	}
+	cost.HourlyCost = cost.CPUCost + cost.MemoryCost + cost.GPUCost
+	cost.MonthlyCost = cost.HourlyCost * hoursPerMonth
+	return cost
+}
+
+// costFilter narrows cost queries to a team, project or environment, and to
+// the caller's namespaces
+type costFilter struct {
+	team        string
+	project     string
+	environment string
+	namespaces  []string
+	limited     bool
+}
+
+func costFilterFrom(c *gin.Context) costFilter {
+	filter := costFilter{team: c.Query("team"), project: c.Query("project"), environment: c.Query("environment")}
+	filter.namespaces, filter.limited = grantedNamespaces(c)
+	return filter
+}
+
+// apply narrows a query of deployments or cost samples
+func (f costFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.team != "" {
+		query = query.Where("team = ?", f.team)
+	}
+	if f.project != "" {
+		query = query.Where("project = ?", f.project)
+	}
+	if f.environment != "" {
+		query = query.Where("environment = ?", f.environment)
+	}
+	return query
+}
+
+// runningCosts prices every running deployment matching the filter
+func (ds *ModelDeploymentService) runningCosts(ctx context.Context, filter costFilter) ([]ModelDeployment, []DeploymentCost, error) {
+	query := filter.apply(ds.db.Where("status IN ?", []string{DeploymentStatusRunning, DeploymentStatusDegraded}))
+	if filter.limited {
+		query = query.Where("namespace IN ?", filter.namespaces)
+	}
+	var deployments []ModelDeployment
+	if err := query.Find(&deployments).Error; err != nil {
+		return nil, nil, err
+	}
+
+	prices, err := ds.loadPrices()
+	if err != nil {
+		return nil, nil, err
+	}
+	live, err := ds.liveReplicas(ctx)
+	if err != nil {
+		ds.logger.Warn("Failed to read live replica counts; using requested replicas", zap.Error(err))
+	}
+
+	costs := make([]DeploymentCost, 0, len(deployments))
+	for i := range deployments {
+		costs = append(costs, costOf(&deployments[i], replicasOf(&deployments[i], live), prices))
+	}
+	return deployments, costs, nil
+}
+
+// utilizationSummary aggregates a deployment's metric samples over a window
+type utilizationSummary struct {
+	DeploymentID  uint
+	Samples       int64
+	LowCPUSamples int64
+	LowAllSamples int64
+	AvgCPU        float64
+	AvgGPU        float64
+	AvgRPS        float64
+	FirstSample   time.Time
+}
+
+// findIdle picks the idle deployments out of costs
+func (ds *ModelDeploymentService) findIdle(deployments []ModelDeployment, costs []DeploymentCost, criteria idleCriteria) ([]IdleDeployment, error) {
+	since := time.Now().Add(-criteria.Window)
+
+	var summaries []utilizationSummary
+	err := ds.db.Model(&DeploymentMetrics{}).
+		Select(`deployment_id,
+			count(*) AS samples,
+			sum(CASE WHEN cpu_utilization < ? THEN 1 ELSE 0 END) AS low_cpu_samples,
+			sum(CASE WHEN cpu_utilization < ? AND gpu_utilization < ? THEN 1 ELSE 0 END) AS low_all_samples,
+			avg(cpu_utilization) AS avg_cpu,
+			avg(gpu_utilization) AS avg_gpu,
+			avg(throughput_rps) AS avg_rps,
+			min(timestamp) AS first_sample`,
+			criteria.CPUThreshold, criteria.CPUThreshold, criteria.GPUThreshold).
+		Where("timestamp >= ?", since).
+		Group("deployment_id").
+		Scan(&summaries).Error
+	if err != nil {
+		return nil, err
+	}
+	byDeployment := make(map[uint]utilizationSummary, len(summaries))
+	for _, summary := range summaries {
+		byDeployment[summary.DeploymentID] = summary
+	}
+
+	// Samples must reach back to near the start of the window, so a
+	// deployment is not judged on the last few minutes of it
+	coverage := since.Add(criteria.Window / 10)
+
+	idle := make([]IdleDeployment, 0)
+	for i, deployment := range deployments {
+		summary, ok := byDeployment[deployment.ID]
+		if !ok || summary.Samples == 0 || summary.FirstSample.After(coverage) {
+			continue
+		}
+		low := summary.LowCPUSamples
+		if deployment.GPU > 0 {
+			low = summary.LowAllSamples
+		}
+		share := float64(low) / float64(summary.Samples)
+		if share < idleSustainedShare {
+			continue
+		}
+
+		cost := costs[i]
+		entry := IdleDeployment{
+			DeploymentCost:    cost,
+			Samples:           summary.Samples,
+			LowShare:          share,
+			AvgCPUUtilization: summary.AvgCPU,
+			AvgGPUUtilization: summary.AvgGPU,
+			AvgThroughputRPS:  summary.AvgRPS,
+		}
+		if deployment.MinReplicas > 0 && cost.Replicas > deployment.MinReplicas {
+			entry.Recommendation = IdleRecommendScaleDown
+			entry.MonthlySavings = cost.MonthlyCost * float64(cost.Replicas-deployment.MinReplicas) / float64(cost.Replicas)
+		} else {
+			entry.Recommendation = IdleRecommendRemove
+			entry.MonthlySavings = cost.MonthlyCost
+		}
+		idle = append(idle, entry)
+	}
+
+	sort.Slice(idle, func(i, j int) bool { return idle[i].MonthlySavings > idle[j].MonthlySavings })
+	return idle, nil
+}
+
+// defaultIdleCriteria comes from IDLE_WINDOW_HOURS, IDLE_CPU_THRESHOLD and
+// IDLE_GPU_THRESHOLD
+func defaultIdleCriteria() idleCriteria {
+	criteria := idleCriteria{Window: 24 * time.Hour, CPUThreshold: 10, GPUThreshold: 10}
+	if hours, err := strconv.Atoi(os.Getenv("IDLE_WINDOW_HOURS")); err == nil && hours > 0 {
+		criteria.Window = time.Duration(hours) * time.Hour
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("IDLE_CPU_THRESHOLD"), 64); err == nil && v > 0 {
+		criteria.CPUThreshold = v
+	}
+	if v, err := strconv.ParseFloat(os.Getenv("IDLE_GPU_THRESHOLD"), 64); err == nil && v > 0 {
+		criteria.GPUThreshold = v
+	}
+	return criteria
+}
+
+// idleCriteriaFrom lets a request override the default criteria
+func idleCriteriaFrom(c *gin.Context) (idleCriteria, error) {
+	criteria := defaultIdleCriteria()
+	if v := c.Query("window_hours"); v != "" {
+		hours, err := strconv.Atoi(v)
+		if err != nil || hours <= 0 || hours > 24*90 {
+			return criteria, fmt.Errorf("window_hours must be between 1 and %d", 24*90)
+		}
+		criteria.Window = time.Duration(hours) * time.Hour
+	}
+	if v := c.Query("cpu_threshold"); v != "" {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil || threshold <= 0 || threshold > 100 {
+			return criteria, fmt.Errorf("cpu_threshold must be a percentage")
+		}
+		criteria.CPUThreshold = threshold
+	}
+	if v := c.Query("gpu_threshold"); v != "" {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil || threshold <= 0 || threshold > 100 {
+			return criteria, fmt.Errorf("gpu_threshold must be a percentage")
+		}
+		criteria.GPUThreshold = threshold
+	}
+	return criteria, nil
+}
+
+// costPeriod reads from/to (RFC3339) with a default start
+func costPeriod(c *gin.Context, defaultFrom time.Time) (time.Time, time.Time, error) {
+	from, to := defaultFrom, time.Now()
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid from: %w", err)
+		}
+		from = t
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid to: %w", err)
+		}
+		to = t
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+func startOfMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// startCostTracking records the cost of running deployments every hour
+func (ds *ModelDeploymentService) startCostTracking() {
+	ds.recordCostSamples()
+
+	ticker := time.NewTicker(costSampleInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ds.recordCostSamples()
+	}
+}
+
+func (ds *ModelDeploymentService) recordCostSamples() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	deployments, costs, err := ds.runningCosts(ctx, costFilter{})
+	if err != nil {
+		ds.logger.Error("Failed to price deployments", zap.Error(err))
+		return
+	}
+
+	hour := time.Now().UTC().Truncate(time.Hour)
+	deploymentHourlyCost.Reset()
+	for _, cost := range costs {
+		sample := DeploymentCostSample{
+			DeploymentID: cost.DeploymentID,
+			Hour:         hour,
+			Team:         cost.Team,
+			Project:      cost.Project,
+			Labels:       cost.Labels,
+			ModelID:      cost.ModelID,
+			Environment:  cost.Environment,
+			Replicas:     cost.Replicas,
+			CPUCost:      cost.CPUCost,
+			MemoryCost:   cost.MemoryCost,
+			GPUCost:      cost.GPUCost,
+			Cost:         cost.HourlyCost,
+		}
+		// A restart within the hour replaces the hour's sample
+		err := ds.db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "deployment_id"}, {Name: "hour"}},
+			DoUpdates: clause.AssignmentColumns([]string{"team", "project", "labels", "model_id", "environment", "replicas", "cpu_cost", "memory_cost", "gpu_cost", "cost"}),
+		}).Create(&sample).Error
+		if err != nil {
+			ds.logger.Warn("Failed to record deployment cost", zap.String("name", cost.Name), zap.Error(err))
+		}
+		deploymentHourlyCost.WithLabelValues(cost.Name, cost.Team, cost.Environment).Set(cost.HourlyCost)
+	}
+
+	idle, err := ds.findIdle(deployments, costs, defaultIdleCriteria())
+	if err != nil {
+		ds.logger.Error("Failed to find idle deployments", zap.Error(err))
+		return
+	}
+	deploymentIdleWaste.Reset()
+	for _, entry := range idle {
+		deploymentIdleWaste.WithLabelValues(entry.Name, entry.Team).Set(entry.MonthlySavings)
+	}
+}
+
+// Get the run rate of a deployment and what it has cost over a period
+func (ds *ModelDeploymentService) getDeploymentCost(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	from, to, err := costPeriod(c, time.Now().AddDate(0, 0, -30))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	granularity := c.DefaultQuery("granularity", "day")
+	if granularity != "hour" && granularity != "day" {
+		c.JSON(400, gin.H{"error": "granularity must be hour or day"})
+		return
+	}
+
+	prices, err := ds.loadPrices()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load resource prices"})
+		return
+	}
+	live, err := ds.liveReplicas(c.Request.Context())
+	if err != nil {
+		ds.logger.Warn("Failed to read live replica counts; using requested replicas", zap.Error(err))
+	}
+	replicas := 0
+	if servingStatus(deployment.Status) {
+		replicas = replicasOf(&deployment, live)
+	}
+
+	var accrued struct {
+		Cost       float64
+		CPUCost    float64
+		MemoryCost float64
+		GPUCost    float64
+		Hours      int64
+	}
+	samples := ds.db.Model(&DeploymentCostSample{}).
+		Where("deployment_id = ? AND hour >= ? AND hour < ?", deployment.ID, from, to)
+	samples.Session(&gorm.Session{}).
+		Select("coalesce(sum(cost), 0) AS cost, coalesce(sum(cpu_cost), 0) AS cpu_cost, " +
+			"coalesce(sum(memory_cost), 0) AS memory_cost, coalesce(sum(gpu_cost), 0) AS gpu_cost, count(*) AS hours").
+		Scan(&accrued)
+
+	// What it cost per hour or day over the period
+	var series []costPoint
+	err = samples.Session(&gorm.Session{}).
+		Select("date_trunc(?, hour) AS period, sum(cpu_cost) AS cpu_cost, sum(memory_cost) AS memory_cost, "+
+			"sum(gpu_cost) AS gpu_cost, sum(cost) AS cost, max(replicas) AS max_replicas", granularity).
+		Group("period").Order("period").Scan(&series).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to sum deployment costs"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"current":      costOf(&deployment, replicas, prices),
+		"from":         from,
+		"to":           to,
+		"accrued_cost": accrued.Cost,
+		"accrued_breakdown": gin.H{
+			"cpu":    accrued.CPUCost,
+			"memory": accrued.MemoryCost,
+			"gpu":    accrued.GPUCost,
+		},
+		"hours":       accrued.Hours,
+		"granularity": granularity,
+		"series":      series,
+	})
+}
+
+// costPoint is what a deployment cost over one hour or day
+type costPoint struct {
+	Period      time.Time `json:"period"`
+	CPUCost     float64   `json:"cpu_cost"`
+	MemoryCost  float64   `json:"memory_cost"`
+	GPUCost     float64   `json:"gpu_cost"`
+	Cost        float64   `json:"cost"`
+	MaxReplicas int       `json:"max_replicas"`
+}
+
+// Set the project and cost labels a deployment's costs are reported under
+func (ds *ModelDeploymentService) setCostAllocation(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	var request struct {
+		Team    *string           `json:"team"`
+		Project *string           `json:"project"`
+		Labels  map[string]string `json:"labels"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	for key := range request.Labels {
+		if !costLabelKey.MatchString(key) {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("Invalid cost label %q", key)})
+			return
+		}
+	}
+
+	columns := []string{"updated_at"}
+	deployment.UpdatedAt = time.Now()
+	if request.Team != nil {
+		deployment.Team = *request.Team
+		columns = append(columns, "team")
+	}
+	if request.Project != nil {
+		deployment.Project = *request.Project
+		columns = append(columns, "project")
+	}
+	if request.Labels != nil {
+		deployment.CostLabels = request.Labels
+		columns = append(columns, "cost_labels")
+	}
+	if err := ds.db.Model(&deployment).Select(columns).Updates(&deployment).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to update cost allocation"})
+		return
+	}
+	c.JSON(200, gin.H{
+		"deployment": deployment.Name,
+		"team":       deployment.Team,
+		"project":    deployment.Project,
+		"labels":     deployment.CostLabels,
+	})
+}
+
+// costGroup totals the deployments sharing a team, model or environment
+type costGroup struct {
+	Key             string  `json:"key"`
+	Deployments     int     `json:"deployments"`
+	Replicas        int     `json:"replicas"`
+	HourlyCost      float64 `json:"hourly_cost"`
+	MonthlyCost     float64 `json:"monthly_cost"`
+	AccruedCost     float64 `json:"accrued_cost"`
+	IdleDeployments int     `json:"idle_deployments"`
+	IdleWaste       float64 `json:"idle_monthly_waste"`
+}
+
+// Report costs grouped by team, project, model, environment or a cost
+// label (group_by=label:<key>)
+func (ds *ModelDeploymentService) getCostReport(c *gin.Context) {
+	groupBy := c.DefaultQuery("group_by", "team")
+	var column string
+	var columnArgs []interface{}
+	label, byLabel := strings.CutPrefix(groupBy, "label:")
+	switch {
+	case groupBy == "team":
+		column = "team"
+	case groupBy == "project":
+		column = "project"
+	case groupBy == "model":
+		column = "model_id"
+	case groupBy == "environment":
+		column = "environment"
+	case byLabel && costLabelKey.MatchString(label):
+		column, columnArgs = "labels->>?", []interface{}{label}
+	default:
+		c.JSON(400, gin.H{"error": "group_by must be team, project, model, environment or label:<key>"})
+		return
+	}
+	from, to, err := costPeriod(c, startOfMonth(time.Now()))
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	criteria, err := idleCriteriaFrom(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	filter := costFilterFrom(c)
+	deployments, costs, err := ds.runningCosts(c.Request.Context(), filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to price deployments"})
+		return
+	}
+	idle, err := ds.findIdle(deployments, costs, criteria)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to evaluate deployment utilization"})
+		return
+	}
+
+	keyOf := func(cost DeploymentCost) string {
+		if byLabel {
+			return cost.Labels[label]
+		}
+		switch groupBy {
+		case "project":
+			return cost.Project
+		case "model":
+			return cost.ModelID
+		case "environment":
+			return cost.Environment
+		}
+		return cost.Team
+	}
+	groups := make(map[string]*costGroup)
+	group := func(key string) *costGroup {
+		if key == "" {
+			key = "unassigned"
+		}
+		g, ok := groups[key]
+		if !ok {
+			g = &costGroup{Key: key}
+			groups[key] = g
+		}
+		return g
+	}
+	for _, cost := range costs {
+		g := group(keyOf(cost))
+		g.Deployments++
+		g.Replicas += cost.Replicas
+		g.HourlyCost += cost.HourlyCost
+		g.MonthlyCost += cost.MonthlyCost
+	}
+	for _, entry := range idle {
+		g := group(keyOf(entry.DeploymentCost))
+		g.IdleDeployments++
+		g.IdleWaste += entry.MonthlySavings
+	}
+
+	// Spend over the period includes deployments no longer running
+	var accrued []struct {
+		GroupKey string
+		Cost     float64
+	}
+	query := filter.apply(ds.db.Model(&DeploymentCostSample{})).
+		Select(column+" AS group_key, sum(cost) AS cost", columnArgs...).
+		Where("hour >= ? AND hour < ?", from, to)
+	if filter.limited {
+		query = query.Where("deployment_id IN (?)",
+			ds.db.Model(&ModelDeployment{}).Select("id").Where("namespace IN ?", filter.namespaces))
+	}
+	if err := query.Group("group_key").Scan(&accrued).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to sum deployment costs"})
+		return
+	}
+	for _, row := range accrued {
+		group(row.GroupKey).AccruedCost += row.Cost
+	}
+
+	report := make([]*costGroup, 0, len(groups))
+	total := costGroup{Key: "total"}
+	for _, g := range groups {
+		report = append(report, g)
+		total.Deployments += g.Deployments
+		total.Replicas += g.Replicas
+		total.HourlyCost += g.HourlyCost
+		total.MonthlyCost += g.MonthlyCost
+		total.AccruedCost += g.AccruedCost
+		total.IdleDeployments += g.IdleDeployments
+		total.IdleWaste += g.IdleWaste
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].MonthlyCost > report[j].MonthlyCost })
+
+	currency := "USD"
+	if len(costs) > 0 {
+		currency = costs[0].Currency
+	}
+	c.JSON(200, gin.H{
+		"group_by": groupBy,
+		"from":     from,
+		"to":       to,
+		"currency": currency,
+		"groups":   report,
+		"total":    total,
+	})
+}
+
+// List running deployments with sustained low utilization
+func (ds *ModelDeploymentService) listIdleDeployments(c *gin.Context) {
+	criteria, err := idleCriteriaFrom(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	deployments, costs, err := ds.runningCosts(c.Request.Context(), costFilterFrom(c))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to price deployments"})
+		return
+	}
+	idle, err := ds.findIdle(deployments, costs, criteria)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to evaluate deployment utilization"})
+		return
+	}
+
+	savings := 0.0
+	for _, entry := range idle {
+		savings += entry.MonthlySavings
+	}
+	c.JSON(200, gin.H{
+		"window_hours":          int(criteria.Window / time.Hour),
+		"cpu_threshold":         criteria.CPUThreshold,
+		"gpu_threshold":         criteria.GPUThreshold,
+		"deployments":           idle,
+		"total_monthly_savings": savings,
+	})
+}
+
+// List the effective hourly price of every resource
+func (ds *ModelDeploymentService) listResourcePrices(c *gin.Context) {
+	prices, err := ds.loadPrices()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load resource prices"})
+		return
+	}
+
+	gpuTypes := make([]string, 0, len(prices.gpu))
+	for gpuType := range prices.gpu {
+		gpuTypes = append(gpuTypes, gpuType)
+	}
+	sort.Strings(gpuTypes)
+	list := []ResourcePrice{
+		{Resource: PriceResourceCPU, HourlyPrice: prices.cpu, Currency: prices.currency},
+		{Resource: PriceResourceMemory, HourlyPrice: prices.memory, Currency: prices.currency},
+		{Resource: PriceResourceGPU, HourlyPrice: prices.defaultGPU, Currency: prices.currency},
+	}
+	for _, gpuType := range gpuTypes {
+		list = append(list, ResourcePrice{Resource: PriceResourceGPU, GPUType: gpuType, HourlyPrice: prices.gpu[gpuType], Currency: prices.currency})
+	}
+
+	c.JSON(200, gin.H{"prices": list})
+}
+
+// Set the hourly price of a resource
+func (ds *ModelDeploymentService) setResourcePrice(c *gin.Context) {
+	var price ResourcePrice
+	if err := c.ShouldBindJSON(&price); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	switch price.Resource {
+	case PriceResourceCPU, PriceResourceMemory:
+		if price.GPUType != "" {
+			c.JSON(400, gin.H{"error": "gpu_type only applies to gpu prices"})
+			return
+		}
+	case PriceResourceGPU:
+	default:
+		c.JSON(400, gin.H{"error": "resource must be cpu, memory or gpu"})
+		return
+	}
+	if price.HourlyPrice < 0 {
+		c.JSON(400, gin.H{"error": "hourly_price must not be negative"})
+		return
+	}
+	if price.Currency == "" {
+		price.Currency = "USD"
+	}
+	price.ID = 0
+	price.UpdatedBy = c.GetHeader("X-User-ID")
+	price.UpdatedAt = time.Now()
+
+	err := ds.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "resource"}, {Name: "gpu_type"}},
+		DoUpdates: clause.AssignmentColumns([]string{"hourly_price", "currency", "updated_by", "updated_at"}),
+	}).Create(&price).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save resource price"})
+		return
+	}
+
+	ds.logger.Info("Resource price updated",
+		zap.String("resource", price.Resource),
+		zap.String("gpu_type", price.GPUType),
+		zap.Float64("hourly_price", price.HourlyPrice))
+
+	c.JSON(200, price)
+}
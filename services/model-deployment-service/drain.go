@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// Connection draining. A model server pod that is going away should finish
+// the inference requests it holds instead of dropping them, so:
+//
+//   - Every pod gets a preStop hook that keeps it serving for
+//     PreStopDelaySeconds after termination starts, while endpoints and the
+//     gateway stop routing to it, and a termination grace period long enough
+//     to also cover DrainTimeoutSeconds of in-flight work.
+//   - Scaling down through the API drains first: the pods to remove are taken
+//     out of the Service (serving=false), marked draining in
+//     discovery-service, given the lowest deletion cost so the ReplicaSet
+//     removes exactly those, and watched until their in-flight count reaches
+//     zero or the drain timeout passes. Only then is the Deployment scaled.
+//   - Pods terminated by anything else (the autoscaler, a node drain) are
+//     seen by a watch and marked draining in discovery-service too.
+//
+// The in-flight count is read from the pod's metrics port, from the gauge
+// named by DRAIN_INFLIGHT_METRIC. A server that does not export it is
+// considered drained once the preStop delay has passed.
+
+// Pod drain outcomes
+const (
+	DrainStatusDraining = "draining"
+	DrainStatusDrained  = "drained"
+	DrainStatusTimedOut = "timed_out"
+	DrainStatusFailed   = "failed"
+)
+
+// Why a pod was drained
+const (
+	DrainReasonScaleDown   = "scale_down"
+	DrainReasonTermination = "termination"
+)
+
+const (
+	servingNamespace   = "model-serving" // deployments from before namespace mapping
+	servingLabel       = "serving"       // "true" while the pod is in the Service
+	podDeletionCostKey = "controller.kubernetes.io/pod-deletion-cost"
+	drainPollInterval  = time.Second
+)
+
+// PodDrain records the draining of one pod
+type PodDrain struct {
+	ID              uint       `json:"id" gorm:"primaryKey"`
+	DeploymentID    uint       `json:"deployment_id" gorm:"index"`
+	PodName         string     `json:"pod_name" gorm:"index"`
+	PodIP           string     `json:"pod_ip"`
+	Reason          string     `json:"reason"`
+	Status          string     `json:"status"`
+	InFlightAtStart int        `json:"in_flight_at_start"` // -1: not reported by the server
+	InFlightAtEnd   int        `json:"in_flight_at_end"`
+	DurationMs      int64      `json:"duration_ms"`
+	Error           string     `json:"error,omitempty"`
+	StartedAt       time.Time  `json:"started_at"`
+	CompletedAt     *time.Time `json:"completed_at"`
+}
+
+var (
+	podDrainDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "model_deployment_pod_drain_duration_seconds",
+			Help:    "Time taken to drain in-flight requests from a model server pod",
+			Buckets: []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300},
+		},
+		[]string{"deployment", "reason", "outcome"},
+	)
+	podsDraining = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "model_deployment_pods_draining",
+			Help: "Model server pods currently draining",
+		},
+		[]string{"deployment"},
+	)
+	drainAbandonedRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_deployment_drain_abandoned_requests_total",
+			Help: "In-flight requests still open when a drain timed out",
+		},
+		[]string{"deployment"},
+	)
+)
+
+// drainTracker keeps one drain per pod
+type drainTracker struct {
+	mu   sync.Mutex
+	pods map[string]bool
+}
+
+func newDrainTracker() *drainTracker {
+	return &drainTracker{pods: make(map[string]bool)}
+}
+
+// claim reports whether the caller should drain the pod
+func (t *drainTracker) claim(pod string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pods[pod] {
+		return false
+	}
+	t.pods[pod] = true
+	return true
+}
+
+func (t *drainTracker) release(pod string) {
+	t.mu.Lock()
+	delete(t.pods, pod)
+	t.mu.Unlock()
+}
+
+// applyDrainSettings adds the preStop hook and grace period to a pod spec
+func applyDrainSettings(spec *corev1.PodSpec, deployment *ModelDeployment) {
+	delay := int64(deployment.PreStopDelaySeconds)
+	grace := delay + int64(deployment.DrainTimeoutSeconds)
+	if grace < 30 {
+		// Never below the Kubernetes default
+		grace = 30
+	}
+	spec.TerminationGracePeriodSeconds = &grace
+
+	if delay <= 0 {
+		return
+	}
+	for i := range spec.Containers {
+		spec.Containers[i].Lifecycle = &corev1.Lifecycle{
+			PreStop: &corev1.LifecycleHandler{
+				Sleep: &corev1.SleepAction{Seconds: delay},
+			},
+		}
+	}
+}
+
+// inFlightRequests reads a pod's in-flight request count from its metrics;
+// false when the server does not report one
+func (ds *ModelDeploymentService) inFlightRequests(ctx context.Context, podIP string) (int, bool) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s:8082/metrics", podIP), nil)
+	if err != nil {
+		return 0, false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, false
+	}
+
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return 0, false
+	}
+	family, ok := families[getEnv("DRAIN_INFLIGHT_METRIC", "model_server_inflight_requests")]
+	if !ok {
+		return 0, false
+	}
+	total := 0.0
+	for _, metric := range family.GetMetric() {
+		if gauge := metric.GetGauge(); gauge != nil {
+			total += gauge.GetValue()
+		} else if untyped := metric.GetUntyped(); untyped != nil {
+			total += untyped.GetValue()
+		}
+	}
+	return int(total), true
+}
+
+// markDrainingInDiscovery takes the pod out of discovery-service's healthy
+// instances; pods that never registered are not an error
+func (ds *ModelDeploymentService) markDrainingInDiscovery(ctx context.Context, deployment *ModelDeployment, podIP string) {
+	body, _ := json.Marshal(map[string]interface{}{"host": podIP})
+	endpoint := fmt.Sprintf("%s/v1/discovery/services/%s/drain",
+		strings.TrimRight(getEnv("DISCOVERY_SERVICE_URL", "http://discovery-service:8080"), "/"), deployment.Name)
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ds.logger.Warn("Failed to mark pod draining in discovery",
+			zap.String("deployment", deployment.Name),
+			zap.String("pod_ip", podIP),
+			zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		ds.logger.Warn("Discovery rejected pod drain",
+			zap.String("deployment", deployment.Name),
+			zap.String("pod_ip", podIP),
+			zap.Int("status", resp.StatusCode))
+	}
+}
+
+// drainPod stops new traffic to a pod and waits for its in-flight requests
+// to finish, up to the deployment's drain timeout
+func (ds *ModelDeploymentService) drainPod(ctx context.Context, deployment *ModelDeployment, pod *corev1.Pod, reason string) *PodDrain {
+	drain := &PodDrain{
+		DeploymentID: deployment.ID,
+		PodName:      pod.Name,
+		PodIP:        pod.Status.PodIP,
+		Reason:       reason,
+		Status:       DrainStatusDraining,
+		StartedAt:    time.Now(),
+	}
+	if err := ds.db.Create(drain).Error; err != nil {
+		ds.logger.Warn("Failed to record pod drain", zap.String("pod", pod.Name), zap.Error(err))
+	}
+	podsDraining.WithLabelValues(deployment.Name).Inc()
+	defer podsDraining.WithLabelValues(deployment.Name).Dec()
+
+	if reason == DrainReasonScaleDown {
+		// Leave the Service and go first when the ReplicaSet shrinks
+		patch, _ := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"labels":      map[string]string{servingLabel: "false"},
+				"annotations": map[string]string{podDeletionCostKey: "-1000"},
+			},
+		})
+		if _, err := ds.k8sClient.CoreV1().Pods(pod.Namespace).Patch(
+			ctx, pod.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{}); err != nil {
+			return ds.finishDrain(deployment, drain, DrainStatusFailed, fmt.Sprintf("failed to remove pod from service: %v", err))
+		}
+	}
+	if drain.PodIP != "" {
+		ds.markDrainingInDiscovery(ctx, deployment, drain.PodIP)
+	}
+
+	inFlight, reported := ds.inFlightRequests(ctx, drain.PodIP)
+	drain.InFlightAtStart = -1
+	if reported {
+		drain.InFlightAtStart = inFlight
+	}
+
+	// Give endpoints and the gateway time to stop sending new requests
+	settle := time.Duration(deployment.PreStopDelaySeconds) * time.Second
+	deadline := drain.StartedAt.Add(settle + time.Duration(deployment.DrainTimeoutSeconds)*time.Second)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		if time.Since(drain.StartedAt) >= settle {
+			inFlight, reported = ds.inFlightRequests(ctx, drain.PodIP)
+			if !reported || inFlight == 0 {
+				drain.InFlightAtEnd = 0
+				return ds.finishDrain(deployment, drain, DrainStatusDrained, "")
+			}
+			drain.InFlightAtEnd = inFlight
+		}
+		if time.Now().After(deadline) {
+			drainAbandonedRequests.WithLabelValues(deployment.Name).Add(float64(drain.InFlightAtEnd))
+			return ds.finishDrain(deployment, drain, DrainStatusTimedOut, "")
+		}
+
+		select {
+		case <-ctx.Done():
+			return ds.finishDrain(deployment, drain, DrainStatusFailed, ctx.Err().Error())
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ds *ModelDeploymentService) finishDrain(deployment *ModelDeployment, drain *PodDrain, status, message string) *PodDrain {
+	now := time.Now()
+	drain.Status = status
+	drain.Error = message
+	drain.CompletedAt = &now
+	drain.DurationMs = now.Sub(drain.StartedAt).Milliseconds()
+	if drain.ID != 0 {
+		ds.db.Save(drain)
+	}
+	podDrainDuration.WithLabelValues(deployment.Name, drain.Reason, status).Observe(now.Sub(drain.StartedAt).Seconds())
+
+	ds.logger.Info("Pod drain finished",
+		zap.String("deployment", deployment.Name),
+		zap.String("pod", drain.PodName),
+		zap.String("reason", drain.Reason),
+		zap.String("status", status),
+		zap.Int("in_flight_at_end", drain.InFlightAtEnd),
+		zap.Int64("duration_ms", drain.DurationMs))
+	return drain
+}
+
+// selectDrainVictims picks the pods to remove when scaling down: pods that
+// are not ready first, then the youngest, which hold the least warm state
+func (ds *ModelDeploymentService) selectDrainVictims(ctx context.Context, deployment *ModelDeployment, count int) ([]corev1.Pod, error) {
+	pods, err := ds.k8sClient.CoreV1().Pods(namespaceOf(deployment)).List(ctx, metav1.ListOptions{
+		LabelSelector: "app=" + deployment.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]corev1.Pod, 0, len(pods.Items))
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp == nil && pod.Labels[servingLabel] != "false" {
+			candidates = append(candidates, pod)
+		}
+	}
+	ready := func(pod *corev1.Pod) bool {
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == corev1.PodReady {
+				return condition.Status == corev1.ConditionTrue
+			}
+		}
+		return false
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		iReady, jReady := ready(&candidates[i]), ready(&candidates[j])
+		if iReady != jReady {
+			return !iReady
+		}
+		return candidates[i].CreationTimestamp.After(candidates[j].CreationTimestamp.Time)
+	})
+
+	if count > len(candidates) {
+		count = len(candidates)
+	}
+	return candidates[:count], nil
+}
+
+// drainAndScale drains the chosen pods, then scales the Deployment so the
+// ReplicaSet removes them
+func (ds *ModelDeploymentService) drainAndScale(deployment ModelDeployment, victims []corev1.Pod, replicas int) {
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := range victims {
+		pod := &victims[i]
+		if !ds.drains.claim(pod.Name) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ds.drainPod(ctx, &deployment, pod, DrainReasonScaleDown)
+		}()
+	}
+	wg.Wait()
+
+	// The claims stay until the pods are deleted, so their termination is
+	// not drained a second time
+	if err := ds.setReplicas(ctx, &deployment, replicas); err != nil {
+		for i := range victims {
+			ds.drains.release(victims[i].Name)
+		}
+		ds.logger.Error("Failed to scale deployment after draining",
+			zap.String("name", deployment.Name),
+			zap.Int("replicas", replicas),
+			zap.Error(err))
+		return
+	}
+	ds.logger.Info("Deployment scaled down after draining",
+		zap.String("name", deployment.Name),
+		zap.Int("replicas", replicas),
+		zap.Int("drained", len(victims)))
+}
+
+func (ds *ModelDeploymentService) setReplicas(ctx context.Context, deployment *ModelDeployment, replicas int) error {
+	k8sDeployment, err := ds.k8sClient.AppsV1().Deployments(namespaceOf(deployment)).Get(ctx, deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	k8sDeployment.Spec.Replicas = int32Ptr(int32(replicas))
+	_, err = ds.k8sClient.AppsV1().Deployments(namespaceOf(deployment)).Update(ctx, k8sDeployment, metav1.UpdateOptions{})
+	return err
+}
+
+// currentReplicas is the replica count the Deployment asks for
+func currentReplicas(k8sDeployment *appsv1.Deployment) int {
+	if k8sDeployment.Spec.Replicas == nil {
+		return 1
+	}
+	return int(*k8sDeployment.Spec.Replicas)
+}
+
+// startPodTerminationWatcher drains model server pods that start
+// terminating for reasons other than an API scale-down
+func (ds *ModelDeploymentService) startPodTerminationWatcher() {
+	for {
+		w, err := ds.k8sClient.CoreV1().Pods(metav1.NamespaceAll).Watch(context.Background(), metav1.ListOptions{
+			LabelSelector: "model-id",
+		})
+		if err != nil {
+			ds.logger.Warn("Failed to watch model server pods", zap.Error(err))
+			time.Sleep(10 * time.Second)
+			continue
+		}
+
+		for event := range w.ResultChan() {
+			pod, ok := event.Object.(*corev1.Pod)
+			if !ok {
+				continue
+			}
+			if event.Type == watch.Deleted {
+				ds.drains.release(pod.Name)
+				continue
+			}
+			if event.Type != watch.Modified || pod.DeletionTimestamp == nil || pod.Status.PodIP == "" {
+				continue
+			}
+			if !ds.drains.claim(pod.Name) {
+				continue
+			}
+
+			var deployment ModelDeployment
+			if err := ds.db.Where("name = ?", pod.Labels["app"]).First(&deployment).Error; err != nil {
+				ds.drains.release(pod.Name)
+				continue
+			}
+			// The claim is released when the pod is deleted, so later
+			// updates to it do not start a second drain
+			go ds.drainPod(context.Background(), &deployment, pod, DrainReasonTermination)
+		}
+		// The API server ends watches periodically; start a new one
+	}
+}
+
+// List the pod drains of a deployment
+func (ds *ModelDeploymentService) listPodDrains(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+
+	query := ds.db.Where("deployment_id = ?", deployment.ID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var drains []PodDrain
+	if err := query.Order("started_at DESC").Limit(100).Find(&drains).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch pod drains"})
+		return
+	}
+
+	c.JSON(200, gin.H{"drains": drains})
+}
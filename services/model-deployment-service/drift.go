@@ -0,0 +1,834 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Drift detection. A deployment's training data is registered as a
+// baseline: per feature, the share of values in each bin (numeric) or
+// category. A drift monitor samples the deployment's predictions into the
+// inference log, and on its interval the predictions of the last window are
+// binned the same way and compared with the baseline by population
+// stability index and KL divergence. Features of the request are compared,
+// and of the response under the "prediction." prefix.
+//
+// A feature is drifting when its PSI or KL passes the monitor's threshold.
+// A deployment with any drifting feature is marked drifting, which is
+// exported as model_deployment_drifting and, on the change, posted to
+// DRIFT_ALERT_WEBHOOK_URL; it's marked ok again once a check finds no drift.
+
+// Drift statuses
+const (
+	DriftStatusOK           = "ok"
+	DriftStatusDrifting     = "drifting"
+	DriftStatusInsufficient = "insufficient_data"
+)
+
+// Feature types of a baseline
+const (
+	FeatureNumeric     = "numeric"
+	FeatureCategorical = "categorical"
+)
+
+const (
+	defaultBaselineBins   = 10
+	maxBaselineBins       = 100
+	maxBaselineCategories = 50
+	driftEpsilon          = 1e-4 // floor for empty bins, so PSI and KL stay finite
+)
+
+// DriftMonitor is how a deployment is watched for drift
+type DriftMonitor struct {
+	ID              uint       `json:"id" gorm:"primaryKey"`
+	DeploymentID    uint       `json:"deployment_id" gorm:"uniqueIndex;not null"`
+	Enabled         bool       `json:"enabled"`
+	SampleRate      float64    `json:"sample_rate"`   // share of predictions logged, 0-1
+	PSIThreshold    float64    `json:"psi_threshold"` // a feature drifts past either threshold
+	KLThreshold     float64    `json:"kl_threshold"`
+	MinSamples      int        `json:"min_samples"` // fewer logged rows in the window aren't judged
+	WindowHours     int        `json:"window_hours"`
+	IntervalMinutes int        `json:"interval_minutes"`
+	LastCheckedAt   *time.Time `json:"last_checked_at"`
+	CreatedBy       string     `json:"created_by"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// FeatureBaseline is the training distribution of one feature. Numeric
+// bins are (-inf, edges[0]], (edges[0], edges[1]], ..., (edges[n-1], +inf);
+// categorical values not listed fall in the rest.
+type FeatureBaseline struct {
+	Type        string             `json:"type"`
+	Edges       []float64          `json:"edges,omitempty"`
+	Proportions []float64          `json:"proportions,omitempty"`
+	Categories  map[string]float64 `json:"categories,omitempty"`
+}
+
+// DriftBaseline is the registered training distribution of a deployment
+type DriftBaseline struct {
+	ID           uint                       `json:"id" gorm:"primaryKey"`
+	DeploymentID uint                       `json:"deployment_id" gorm:"uniqueIndex;not null"`
+	ModelVersion string                     `json:"model_version"`
+	Source       string                     `json:"source"` // e.g. the training dataset
+	Samples      int                        `json:"samples"`
+	Features     map[string]FeatureBaseline `json:"features" gorm:"type:jsonb;serializer:json"`
+	CreatedBy    string                     `json:"created_by"`
+	CreatedAt    time.Time                  `json:"created_at"`
+	UpdatedAt    time.Time                  `json:"updated_at"`
+}
+
+// FeatureDrift is how far one feature moved from its baseline
+type FeatureDrift struct {
+	PSI      float64 `json:"psi"`
+	KL       float64 `json:"kl"`
+	Samples  int     `json:"samples"`
+	Missing  int     `json:"missing"` // rows without a usable value
+	Drifting bool    `json:"drifting"`
+}
+
+// DriftReport is the outcome of one drift check
+type DriftReport struct {
+	ID               uint                    `json:"id" gorm:"primaryKey"`
+	DeploymentID     uint                    `json:"deployment_id" gorm:"index;not null"`
+	BaselineID       uint                    `json:"baseline_id"`
+	WindowStart      time.Time               `json:"window_start"`
+	WindowEnd        time.Time               `json:"window_end"`
+	Batches          int                     `json:"batches"`
+	Samples          int                     `json:"samples"`
+	Features         map[string]FeatureDrift `json:"features" gorm:"type:jsonb;serializer:json"`
+	MaxPSI           float64                 `json:"max_psi"`
+	MaxKL            float64                 `json:"max_kl"`
+	DriftingFeatures []string                `json:"drifting_features" gorm:"type:jsonb;serializer:json"`
+	Status           string                  `json:"status" gorm:"index"`
+	CreatedAt        time.Time               `json:"created_at" gorm:"index"`
+}
+
+var (
+	errNoBaseline = errors.New("no drift baseline registered")
+
+	featureDriftPSI = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "model_feature_drift_psi",
+			Help: "Population stability index of a feature against its baseline",
+		},
+		[]string{"deployment", "feature"},
+	)
+	featureDriftKL = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "model_feature_drift_kl",
+			Help: "KL divergence of a feature from its baseline",
+		},
+		[]string{"deployment", "feature"},
+	)
+	deploymentDrifting = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "model_deployment_drifting",
+			Help: "Whether a deployment's inputs or predictions drift from the baseline",
+		},
+		[]string{"deployment"},
+	)
+	driftChecks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_drift_checks_total",
+			Help: "Drift checks, by status",
+		},
+		[]string{"deployment", "status"},
+	)
+	driftAlerts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_drift_alerts_total",
+			Help: "Drift alerts raised and resolved",
+		},
+		[]string{"deployment", "state"},
+	)
+)
+
+// inputFeatureKeys hold the rows of a request; outputFeatureKeys of a response
+var (
+	inputFeatureKeys  = []string{"instances", "inputs", "data"}
+	outputFeatureKeys = []string{"predictions", "outputs", "result"}
+)
+
+// featureRows turns a JSON payload into rows of named feature values. The
+// rows are under one of keys, or the payload itself: an array of objects,
+// an array of arrays (features f0, f1, ...) or an array of scalars.
+func featureRows(payload json.RawMessage, keys []string, prefix string) []map[string]interface{} {
+	var decoded interface{}
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		return nil
+	}
+	if object, ok := decoded.(map[string]interface{}); ok {
+		for _, key := range keys {
+			if value, ok := object[key]; ok {
+				decoded = value
+				break
+			}
+		}
+	}
+
+	var rows []map[string]interface{}
+	addRow := func(value interface{}) {
+		row := make(map[string]interface{})
+		switch value := value.(type) {
+		case map[string]interface{}:
+			for name, v := range value {
+				if isScalar(v) {
+					row[prefix+name] = v
+				}
+			}
+		case []interface{}:
+			for i, v := range value {
+				if isScalar(v) {
+					row[fmt.Sprintf("%sf%d", prefix, i)] = v
+				}
+			}
+		default:
+			if isScalar(value) {
+				name := strings.TrimSuffix(prefix, ".")
+				if name == "" {
+					name = "value"
+				}
+				row[name] = value
+			}
+		}
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+	}
+	if list, ok := decoded.([]interface{}); ok {
+		for _, value := range list {
+			addRow(value)
+		}
+	} else {
+		addRow(decoded)
+	}
+	return rows
+}
+
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case float64, string, bool:
+		return true
+	}
+	return false
+}
+
+// recordRows is the features of sampled predictions, request and response
+// together when both have the same number of rows
+func recordRows(records []inferenceRecord) []map[string]interface{} {
+	var rows []map[string]interface{}
+	for _, record := range records {
+		inputs := featureRows(record.Request, inputFeatureKeys, "")
+		outputs := featureRows(record.Response, outputFeatureKeys, "prediction.")
+		if len(outputs) == len(inputs) {
+			for i := range inputs {
+				for name, value := range outputs[i] {
+					inputs[i][name] = value
+				}
+			}
+		} else {
+			inputs = append(inputs, outputs...)
+		}
+		rows = append(rows, inputs...)
+	}
+	return rows
+}
+
+// computeBaseline bins training rows; numeric features get quantile bins
+func computeBaseline(rows []map[string]interface{}, bins int) map[string]FeatureBaseline {
+	values := make(map[string][]interface{})
+	for _, row := range rows {
+		for name, value := range row {
+			values[name] = append(values[name], value)
+		}
+	}
+
+	features := make(map[string]FeatureBaseline, len(values))
+	for name, column := range values {
+		numbers := make([]float64, 0, len(column))
+		for _, value := range column {
+			if number, ok := value.(float64); ok {
+				numbers = append(numbers, number)
+			}
+		}
+		if len(numbers) == len(column) {
+			sort.Float64s(numbers)
+			var edges []float64
+			for i := 1; i < bins; i++ {
+				edge := numbers[(len(numbers)-1)*i/bins]
+				if len(edges) == 0 || edge > edges[len(edges)-1] {
+					edges = append(edges, edge)
+				}
+			}
+			features[name] = FeatureBaseline{
+				Type:        FeatureNumeric,
+				Edges:       edges,
+				Proportions: shares(binCounts(edges, numbers), len(numbers)),
+			}
+			continue
+		}
+
+		counts := make(map[string]int)
+		for _, value := range column {
+			counts[fmt.Sprint(value)]++
+		}
+		categories := make([]string, 0, len(counts))
+		for category := range counts {
+			categories = append(categories, category)
+		}
+		sort.Slice(categories, func(i, j int) bool { return counts[categories[i]] > counts[categories[j]] })
+		if len(categories) > maxBaselineCategories {
+			categories = categories[:maxBaselineCategories]
+		}
+		baseline := FeatureBaseline{Type: FeatureCategorical, Categories: make(map[string]float64, len(categories))}
+		for _, category := range categories {
+			baseline.Categories[category] = float64(counts[category]) / float64(len(column))
+		}
+		features[name] = baseline
+	}
+	return features
+}
+
+func binCounts(edges, numbers []float64) []int {
+	counts := make([]int, len(edges)+1)
+	for _, number := range numbers {
+		counts[sort.SearchFloat64s(edges, number)]++
+	}
+	return counts
+}
+
+func shares(counts []int, total int) []float64 {
+	proportions := make([]float64, len(counts))
+	for i, count := range counts {
+		if total > 0 {
+			proportions[i] = float64(count) / float64(total)
+		}
+	}
+	return proportions
+}
+
+// validateBaseline checks a feature's bins add up
+func validateBaseline(name string, feature FeatureBaseline) error {
+	switch feature.Type {
+	case FeatureNumeric:
+		if len(feature.Proportions) != len(feature.Edges)+1 {
+			return fmt.Errorf("feature %s: numeric features need one proportion more than edges", name)
+		}
+		if !sort.Float64sAreSorted(feature.Edges) {
+			return fmt.Errorf("feature %s: edges must be ascending", name)
+		}
+		if sum := sumOf(feature.Proportions); math.Abs(sum-1) > 0.01 {
+			return fmt.Errorf("feature %s: proportions add up to %.3f, not 1", name, sum)
+		}
+	case FeatureCategorical:
+		if len(feature.Categories) == 0 {
+			return fmt.Errorf("feature %s: categorical features need categories", name)
+		}
+		sum := 0.0
+		for _, share := range feature.Categories {
+			sum += share
+		}
+		if sum > 1.01 {
+			return fmt.Errorf("feature %s: category shares add up to %.3f, more than 1", name, sum)
+		}
+	default:
+		return fmt.Errorf("feature %s: type must be %s or %s", name, FeatureNumeric, FeatureCategorical)
+	}
+	return nil
+}
+
+func sumOf(values []float64) float64 {
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	return sum
+}
+
+// compareFeature bins the observed values of a feature and compares them
+// with its baseline
+func compareFeature(baseline FeatureBaseline, values []interface{}) FeatureDrift {
+	var expected []float64
+	var counts []int
+	drift := FeatureDrift{}
+
+	if baseline.Type == FeatureNumeric {
+		numbers := make([]float64, 0, len(values))
+		for _, value := range values {
+			if number, ok := value.(float64); ok {
+				numbers = append(numbers, number)
+			} else {
+				drift.Missing++
+			}
+		}
+		expected = baseline.Proportions
+		counts = binCounts(baseline.Edges, numbers)
+		drift.Samples = len(numbers)
+	} else {
+		categories := make([]string, 0, len(baseline.Categories))
+		for category := range baseline.Categories {
+			categories = append(categories, category)
+		}
+		sort.Strings(categories)
+		index := make(map[string]int, len(categories))
+		for i, category := range categories {
+			index[category] = i
+			expected = append(expected, baseline.Categories[category])
+		}
+		expected = append(expected, math.Max(0, 1-sumOf(expected)))
+		counts = make([]int, len(expected))
+		for _, value := range values {
+			if i, ok := index[fmt.Sprint(value)]; ok {
+				counts[i]++
+			} else {
+				counts[len(counts)-1]++
+			}
+		}
+		drift.Samples = len(values)
+	}
+	if drift.Samples == 0 {
+		return drift
+	}
+
+	actual := shares(counts, drift.Samples)
+	for i := range actual {
+		a := math.Max(actual[i], driftEpsilon)
+		e := math.Max(expected[i], driftEpsilon)
+		drift.PSI += (a - e) * math.Log(a/e)
+		drift.KL += a * math.Log(a/e)
+	}
+	return drift
+}
+
+// monitorDefaults fills what a drift monitor left out
+func monitorDefaults(monitor *DriftMonitor) {
+	if monitor.SampleRate <= 0 {
+		monitor.SampleRate = 0.1
+	}
+	if monitor.PSIThreshold <= 0 {
+		monitor.PSIThreshold = 0.2
+	}
+	if monitor.KLThreshold <= 0 {
+		monitor.KLThreshold = 0.1
+	}
+	if monitor.MinSamples <= 0 {
+		monitor.MinSamples = 200
+	}
+	if monitor.WindowHours <= 0 {
+		monitor.WindowHours = 24
+	}
+	if monitor.IntervalMinutes <= 0 {
+		monitor.IntervalMinutes = 60
+	}
+}
+
+// checkDrift compares a deployment's logged predictions of the monitor's
+// window with its baseline, and marks the deployment
+func (ds *ModelDeploymentService) checkDrift(ctx context.Context, deployment *ModelDeployment, monitor *DriftMonitor) (*DriftReport, error) {
+	var baseline DriftBaseline
+	if err := ds.db.Where("deployment_id = ?", deployment.ID).First(&baseline).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errNoBaseline
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	report := &DriftReport{
+		DeploymentID: deployment.ID,
+		BaselineID:   baseline.ID,
+		WindowStart:  now.Add(-time.Duration(monitor.WindowHours) * time.Hour),
+		WindowEnd:    now,
+		Features:     make(map[string]FeatureDrift),
+		CreatedAt:    now,
+	}
+
+	var batches []InferenceLogBatch
+	if err := ds.db.Where("deployment_id = ? AND last_at >= ?", deployment.ID, report.WindowStart).
+		Order("last_at DESC").Limit(getEnvInt("DRIFT_MAX_BATCHES", 50)).Find(&batches).Error; err != nil {
+		return nil, err
+	}
+	var rows []map[string]interface{}
+	for i := range batches {
+		records, err := readInferenceLog(ctx, &batches[i])
+		if err != nil {
+			ds.logger.Warn("Failed to read inference log",
+				zap.String("deployment", deployment.Name),
+				zap.String("file_id", batches[i].FileID),
+				zap.Error(err))
+			continue
+		}
+		report.Batches++
+		rows = append(rows, recordRows(records)...)
+	}
+	report.Samples = len(rows)
+
+	report.Status = DriftStatusInsufficient
+	if report.Samples >= monitor.MinSamples {
+		report.Status = DriftStatusOK
+		for name, feature := range baseline.Features {
+			values := make([]interface{}, 0, len(rows))
+			missing := 0
+			for _, row := range rows {
+				if value, ok := row[name]; ok {
+					values = append(values, value)
+				} else {
+					missing++
+				}
+			}
+			drift := compareFeature(feature, values)
+			drift.Missing += missing
+			drift.Drifting = drift.Samples > 0 && (drift.PSI > monitor.PSIThreshold || drift.KL > monitor.KLThreshold)
+			report.Features[name] = drift
+			report.MaxPSI = math.Max(report.MaxPSI, drift.PSI)
+			report.MaxKL = math.Max(report.MaxKL, drift.KL)
+			if drift.Drifting {
+				report.DriftingFeatures = append(report.DriftingFeatures, name)
+			}
+			featureDriftPSI.WithLabelValues(deployment.Name, name).Set(drift.PSI)
+			featureDriftKL.WithLabelValues(deployment.Name, name).Set(drift.KL)
+		}
+		sort.Strings(report.DriftingFeatures)
+		if len(report.DriftingFeatures) > 0 {
+			report.Status = DriftStatusDrifting
+		}
+	}
+
+	if err := ds.db.Create(report).Error; err != nil {
+		return nil, err
+	}
+	driftChecks.WithLabelValues(deployment.Name, report.Status).Inc()
+	ds.db.Model(monitor).Update("last_checked_at", now)
+
+	// Too few samples say nothing either way; the mark stays as it was
+	if report.Status == DriftStatusInsufficient {
+		return report, nil
+	}
+	previous := deployment.DriftStatus
+	ds.db.Model(deployment).Updates(map[string]interface{}{"drift_status": report.Status, "drift_checked_at": now})
+	if report.Status == DriftStatusDrifting {
+		deploymentDrifting.WithLabelValues(deployment.Name).Set(1)
+	} else {
+		deploymentDrifting.WithLabelValues(deployment.Name).Set(0)
+	}
+	if previous != report.Status && (previous == DriftStatusDrifting || report.Status == DriftStatusDrifting) {
+		ds.raiseDriftAlert(deployment, report)
+	}
+	return report, nil
+}
+
+// raiseDriftAlert reports a deployment starting or stopping to drift
+func (ds *ModelDeploymentService) raiseDriftAlert(deployment *ModelDeployment, report *DriftReport) {
+	state := "resolved"
+	if report.Status == DriftStatusDrifting {
+		state = "firing"
+		ds.logger.Warn("Model deployment drifting",
+			zap.String("deployment", deployment.Name),
+			zap.Strings("features", report.DriftingFeatures),
+			zap.Float64("max_psi", report.MaxPSI),
+			zap.Float64("max_kl", report.MaxKL))
+	} else {
+		ds.logger.Info("Model deployment no longer drifting", zap.String("deployment", deployment.Name))
+	}
+	driftAlerts.WithLabelValues(deployment.Name, state).Inc()
+
+	webhook := getEnv("DRIFT_ALERT_WEBHOOK_URL", "")
+	if webhook == "" {
+		return
+	}
+	payload, _ := json.Marshal(gin.H{
+		"alert":             "model_drift",
+		"state":             state,
+		"deployment":        deployment.Name,
+		"deployment_id":     deployment.ID,
+		"model_id":          deployment.ModelID,
+		"model_version":     deployment.ModelVersion,
+		"environment":       deployment.Environment,
+		"drifting_features": report.DriftingFeatures,
+		"max_psi":           report.MaxPSI,
+		"max_kl":            report.MaxKL,
+		"report_id":         report.ID,
+		"window_start":      report.WindowStart,
+		"window_end":        report.WindowEnd,
+	})
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			ds.logger.Warn("Failed to send drift alert", zap.String("deployment", deployment.Name), zap.Error(err))
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			ds.logger.Warn("Drift alert webhook refused the alert",
+				zap.String("deployment", deployment.Name),
+				zap.Int("status", resp.StatusCode))
+		}
+	}()
+}
+
+// startDriftMonitor runs the drift checks that are due
+func (ds *ModelDeploymentService) startDriftMonitor() {
+	ticker := time.NewTicker(time.Duration(getEnvInt("DRIFT_CHECK_INTERVAL_SECONDS", 60)) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var monitors []DriftMonitor
+		if err := ds.db.Where("enabled = ?", true).Find(&monitors).Error; err != nil {
+			ds.logger.Error("Failed to load drift monitors", zap.Error(err))
+			continue
+		}
+		for i := range monitors {
+			monitor := &monitors[i]
+			interval := time.Duration(monitor.IntervalMinutes) * time.Minute
+			if monitor.LastCheckedAt != nil && time.Since(*monitor.LastCheckedAt) < interval {
+				continue
+			}
+			var deployment ModelDeployment
+			if err := ds.db.First(&deployment, monitor.DeploymentID).Error; err != nil {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			_, err := ds.checkDrift(ctx, &deployment, monitor)
+			cancel()
+			if err != nil && !errors.Is(err, errNoBaseline) {
+				ds.logger.Error("Drift check failed", zap.String("deployment", deployment.Name), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Register the training distribution drift is measured against. Features
+// come binned, or are binned here from training rows.
+func (ds *ModelDeploymentService) setDriftBaseline(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+
+	var request struct {
+		ModelVersion string                     `json:"model_version"`
+		Source       string                     `json:"source"`
+		Samples      int                        `json:"samples"`
+		Features     map[string]FeatureBaseline `json:"features"`
+		Records      []json.RawMessage          `json:"records"` // training rows, binned here
+		Bins         int                        `json:"bins"`
+		CreatedBy    string                     `json:"created_by"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if (len(request.Features) == 0) == (len(request.Records) == 0) {
+		c.JSON(400, gin.H{"error": "Give either features or records"})
+		return
+	}
+
+	baseline := DriftBaseline{
+		DeploymentID: deployment.ID,
+		ModelVersion: request.ModelVersion,
+		Source:       request.Source,
+		Samples:      request.Samples,
+		Features:     request.Features,
+		CreatedBy:    request.CreatedBy,
+	}
+	if baseline.ModelVersion == "" {
+		baseline.ModelVersion = deployment.ModelVersion
+	}
+	if len(request.Records) > 0 {
+		bins := request.Bins
+		if bins <= 0 {
+			bins = defaultBaselineBins
+		}
+		if bins < 2 || bins > maxBaselineBins {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("bins must be between 2 and %d", maxBaselineBins)})
+			return
+		}
+		var rows []map[string]interface{}
+		for _, record := range request.Records {
+			rows = append(rows, featureRows(record, inputFeatureKeys, "")...)
+		}
+		if len(rows) == 0 {
+			c.JSON(400, gin.H{"error": "Records have no features"})
+			return
+		}
+		baseline.Features = computeBaseline(rows, bins)
+		baseline.Samples = len(rows)
+	}
+	for name, feature := range baseline.Features {
+		if err := validateBaseline(name, feature); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	err := ds.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "deployment_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"model_version", "source", "samples", "features", "created_by", "updated_at"}),
+	}).Create(&baseline).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save drift baseline"})
+		return
+	}
+	ds.db.Where("deployment_id = ?", deployment.ID).First(&baseline)
+
+	ds.logger.Info("Drift baseline registered",
+		zap.String("deployment", deployment.Name),
+		zap.String("model_version", baseline.ModelVersion),
+		zap.Int("features", len(baseline.Features)))
+	c.JSON(200, baseline)
+}
+
+// Training distribution of a deployment
+func (ds *ModelDeploymentService) getDriftBaseline(c *gin.Context) {
+	var baseline DriftBaseline
+	if err := ds.db.Where("deployment_id = ?", c.Param("id")).First(&baseline).Error; err != nil {
+		c.JSON(404, gin.H{"error": "No drift baseline registered"})
+		return
+	}
+	c.JSON(200, baseline)
+}
+
+// Start, change or stop watching a deployment for drift
+func (ds *ModelDeploymentService) setDriftMonitor(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+
+	monitor := DriftMonitor{Enabled: true}
+	if err := c.ShouldBindJSON(&monitor); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if monitor.SampleRate > 1 || monitor.SampleRate < 0 {
+		c.JSON(400, gin.H{"error": "sample_rate must be between 0 and 1"})
+		return
+	}
+	monitorDefaults(&monitor)
+	monitor.ID = 0
+	monitor.DeploymentID = deployment.ID
+	monitor.LastCheckedAt = nil
+
+	err := ds.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "deployment_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"enabled", "sample_rate", "psi_threshold", "kl_threshold",
+			"min_samples", "window_hours", "interval_minutes", "created_by", "updated_at"}),
+	}).Create(&monitor).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save drift monitor"})
+		return
+	}
+	ds.db.Where("deployment_id = ?", deployment.ID).First(&monitor)
+
+	rate := monitor.SampleRate
+	if !monitor.Enabled {
+		rate = 0
+		ds.db.Model(&deployment).Update("drift_status", "")
+		deploymentDrifting.DeleteLabelValues(deployment.Name)
+	}
+	ds.inferenceLog.setRate(deployment.ID, rate)
+	c.JSON(200, monitor)
+}
+
+// Drift status of a deployment with its monitor and latest report
+func (ds *ModelDeploymentService) getDrift(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+
+	response := gin.H{
+		"deployment":       deployment.Name,
+		"drift_status":     deployment.DriftStatus,
+		"drift_checked_at": deployment.DriftCheckedAt,
+	}
+	var monitor DriftMonitor
+	if ds.db.Where("deployment_id = ?", deployment.ID).First(&monitor).Error == nil {
+		response["monitor"] = monitor
+	}
+	var baseline DriftBaseline
+	if ds.db.Select("id", "model_version", "source", "samples", "created_at", "updated_at").
+		Where("deployment_id = ?", deployment.ID).First(&baseline).Error == nil {
+		response["baseline"] = gin.H{
+			"id":            baseline.ID,
+			"model_version": baseline.ModelVersion,
+			"source":        baseline.Source,
+			"samples":       baseline.Samples,
+			"updated_at":    baseline.UpdatedAt,
+		}
+	}
+	var report DriftReport
+	if ds.db.Where("deployment_id = ?", deployment.ID).Order("created_at DESC").First(&report).Error == nil {
+		response["latest_report"] = report
+	}
+	c.JSON(200, response)
+}
+
+// Run a drift check now
+func (ds *ModelDeploymentService) runDriftCheck(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	var monitor DriftMonitor
+	if err := ds.db.Where("deployment_id = ?", deployment.ID).First(&monitor).Error; err != nil {
+		c.JSON(409, gin.H{"error": "Deployment has no drift monitor"})
+		return
+	}
+
+	report, err := ds.checkDrift(c.Request.Context(), &deployment, &monitor)
+	if errors.Is(err, errNoBaseline) {
+		c.JSON(409, gin.H{"error": "No drift baseline registered"})
+		return
+	}
+	if err != nil {
+		ds.logger.Error("Drift check failed", zap.String("deployment", deployment.Name), zap.Error(err))
+		c.JSON(500, gin.H{"error": "Drift check failed"})
+		return
+	}
+	c.JSON(200, report)
+}
+
+// Past drift checks of a deployment, newest first
+func (ds *ModelDeploymentService) listDriftReports(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	query := ds.db.Where("deployment_id = ?", c.Param("id"))
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var reports []DriftReport
+	if err := query.Order("created_at DESC").Limit(limit).Find(&reports).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list drift reports"})
+		return
+	}
+	c.JSON(200, gin.H{"reports": reports})
+}
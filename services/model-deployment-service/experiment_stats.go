@@ -0,0 +1,199 @@
+package main
+
+import "math"
+
+// Significance tests for experiment reports: chi-square for rates, Welch's
+// t-test for means. p-values come from the regularized incomplete gamma and
+// beta functions, evaluated as in Numerical Recipes.
+
+const (
+	statsMaxIterations = 300
+	statsEpsilon       = 3e-14
+	statsTiny          = 1e-300
+)
+
+// regularizedGammaQ is Q(a, x) = 1 - P(a, x)
+func regularizedGammaQ(a, x float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+	lnGammaA, _ := math.Lgamma(a)
+	if x < a+1 {
+		// Series for P
+		sum := 1 / a
+		term := sum
+		for n := 1; n < statsMaxIterations; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*statsEpsilon {
+				break
+			}
+		}
+		return 1 - sum*math.Exp(-x+a*math.Log(x)-lnGammaA)
+	}
+
+	// Continued fraction for Q
+	b := x + 1 - a
+	c := 1 / statsTiny
+	d := 1 / b
+	h := d
+	for i := 1; i < statsMaxIterations; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < statsTiny {
+			d = statsTiny
+		}
+		c = b + an/c
+		if math.Abs(c) < statsTiny {
+			c = statsTiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < statsEpsilon {
+			break
+		}
+	}
+	return math.Exp(-x+a*math.Log(x)-lnGammaA) * h
+}
+
+// betaContinuedFraction evaluates the continued fraction of I_x(a, b)
+func betaContinuedFraction(x, a, b float64) float64 {
+	qab, qap, qam := a+b, a+1, a-1
+	c := 1.0
+	d := 1 - qab*x/qap
+	if math.Abs(d) < statsTiny {
+		d = statsTiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m < statsMaxIterations; m++ {
+		fm := float64(m)
+		m2 := 2 * fm
+		aa := fm * (b - fm) * x / ((qam + m2) * (a + m2))
+		d = 1 + aa*d
+		if math.Abs(d) < statsTiny {
+			d = statsTiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < statsTiny {
+			c = statsTiny
+		}
+		d = 1 / d
+		h *= d * c
+		aa = -(a + fm) * (qab + fm) * x / ((a + m2) * (qap + m2))
+		d = 1 + aa*d
+		if math.Abs(d) < statsTiny {
+			d = statsTiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < statsTiny {
+			c = statsTiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < statsEpsilon {
+			break
+		}
+	}
+	return h
+}
+
+// regularizedBeta is I_x(a, b)
+func regularizedBeta(x, a, b float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	lgAB, _ := math.Lgamma(a + b)
+	lgA, _ := math.Lgamma(a)
+	lgB, _ := math.Lgamma(b)
+	front := math.Exp(lgAB - lgA - lgB + a*math.Log(x) + b*math.Log(1-x))
+	if x < (a+1)/(a+b+2) {
+		return front * betaContinuedFraction(x, a, b) / a
+	}
+	return 1 - front*betaContinuedFraction(1-x, b, a)/b
+}
+
+// chiSquarePValue is the chance of a statistic at least this large with df
+// degrees of freedom
+func chiSquarePValue(statistic float64, df int) float64 {
+	if df < 1 || math.IsNaN(statistic) {
+		return 1
+	}
+	return regularizedGammaQ(float64(df)/2, statistic/2)
+}
+
+// studentTPValue is the two-sided p-value of t with df degrees of freedom
+func studentTPValue(t, df float64) float64 {
+	if df <= 0 || math.IsNaN(t) {
+		return 1
+	}
+	return regularizedBeta(df/(df+t*t), df/2, 0.5)
+}
+
+// chiSquareTest tests whether success rates differ across groups. It
+// reports false when an expected count is below 5, where the test is
+// unreliable.
+func chiSquareTest(successes, totals []float64) (statistic, pValue float64, ok bool) {
+	var allSuccesses, all float64
+	for i := range totals {
+		allSuccesses += successes[i]
+		all += totals[i]
+	}
+	if all == 0 || allSuccesses == 0 || allSuccesses == all {
+		return 0, 1, false
+	}
+	for i := range totals {
+		observed := [2]float64{successes[i], totals[i] - successes[i]}
+		expected := [2]float64{totals[i] * allSuccesses / all, totals[i] * (all - allSuccesses) / all}
+		for j := range observed {
+			if expected[j] < 5 {
+				return 0, 1, false
+			}
+			statistic += (observed[j] - expected[j]) * (observed[j] - expected[j]) / expected[j]
+		}
+	}
+	return statistic, chiSquarePValue(statistic, len(totals)-1), true
+}
+
+// sampleSummary describes a sample by its moments
+type sampleSummary struct {
+	n     float64
+	sum   float64
+	sumSq float64
+}
+
+func (s sampleSummary) mean() float64 {
+	if s.n == 0 {
+		return 0
+	}
+	return s.sum / s.n
+}
+
+func (s sampleSummary) variance() float64 {
+	if s.n < 2 {
+		return 0
+	}
+	v := (s.sumSq - s.n*s.mean()*s.mean()) / (s.n - 1)
+	return math.Max(v, 0)
+}
+
+// welchTTest tests whether two samples' means differ, without assuming
+// equal variances
+func welchTTest(a, b sampleSummary) (t, df, pValue float64, ok bool) {
+	if a.n < 2 || b.n < 2 {
+		return 0, 0, 1, false
+	}
+	va, vb := a.variance()/a.n, b.variance()/b.n
+	if va+vb == 0 {
+		return 0, 0, 1, false
+	}
+	t = (b.mean() - a.mean()) / math.Sqrt(va+vb)
+	df = (va + vb) * (va + vb) / (va*va/(a.n-1) + vb*vb/(b.n-1))
+	return t, df, studentTPValue(t, df), true
+}
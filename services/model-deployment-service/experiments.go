@@ -0,0 +1,986 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// A/B test experiments. An experiment splits a deployment's users between
+// the deployment itself, the "control" variant, and other running
+// deployments. Users are assigned by hashing the experiment's salt with
+// X-User-ID (or X-Experiment-Key), so a user keeps their variant for the
+// life of the experiment on every instance, and events sent later can be
+// attributed without looking the assignment up. Predictions without either
+// header go to control and are left out of the experiment.
+//
+// Each instance counts predictions, errors and latencies per variant and
+// records the users it exposed; both are written out every
+// experimentFlushInterval. Clients post business metrics (conversions,
+// revenue, ...) per user to /ab-test/events. Only user hashes are stored.
+//
+// Reports compare every variant with control: binary metrics by the share
+// of exposed users with an event (chi-square), continuous metrics by the
+// per-user total over exposed users (Welch's t-test), plus prediction error
+// rates and latencies.
+
+// Experiment statuses
+const (
+	ExperimentStatusRunning = "running"
+	ExperimentStatusStopped = "stopped"
+)
+
+// Experiment metric types
+const (
+	ExperimentMetricBinary     = "binary"     // did the user convert
+	ExperimentMetricContinuous = "continuous" // how much per user
+)
+
+const (
+	controlVariant          = "control"
+	experimentBuckets       = 10000
+	experimentFlushInterval = 15 * time.Second
+	experimentSeenLimit     = 100000 // user hashes remembered per instance before starting over
+)
+
+// ABExperiment splits a deployment's users between variants
+type ABExperiment struct {
+	ID            uint                  `json:"id" gorm:"primaryKey"`
+	DeploymentID  uint                  `json:"deployment_id" gorm:"index;not null"`
+	Name          string                `json:"name" gorm:"not null"`
+	Hypothesis    string                `json:"hypothesis"`
+	Status        string                `json:"status" gorm:"index"`
+	Salt          string                `json:"-" gorm:"not null"`
+	Variants      []ExperimentVariant   `json:"variants" gorm:"type:jsonb;serializer:json"`
+	Metrics       []ExperimentMetricDef `json:"metrics" gorm:"type:jsonb;serializer:json"`
+	PrimaryMetric string                `json:"primary_metric"`
+	Alpha         float64               `json:"alpha"`           // significance level
+	MinSampleSize int64                 `json:"min_sample_size"` // exposed users per variant before results count
+	Winner        string                `json:"winner"`
+	CreatedBy     string                `json:"created_by"`
+	CreatedAt     time.Time             `json:"created_at"`
+	UpdatedAt     time.Time             `json:"updated_at"`
+	StoppedAt     *time.Time            `json:"stopped_at"`
+}
+
+// ExperimentVariant is a deployment serving part of an experiment's users
+type ExperimentVariant struct {
+	Name         string `json:"name"`
+	DeploymentID uint   `json:"deployment_id"`
+	Weight       int    `json:"weight"`
+}
+
+// ExperimentMetricDef is a business metric an experiment tracks
+type ExperimentMetricDef struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// ExperimentAssignment records that a user was served by a variant
+type ExperimentAssignment struct {
+	ExperimentID uint      `json:"experiment_id" gorm:"primaryKey"`
+	UserHash     string    `json:"user_hash" gorm:"primaryKey"`
+	Variant      string    `json:"variant" gorm:"index"`
+	AssignedAt   time.Time `json:"assigned_at"`
+}
+
+// ExperimentUserMetric totals one user's events of one metric
+type ExperimentUserMetric struct {
+	ExperimentID uint      `json:"experiment_id" gorm:"primaryKey"`
+	Metric       string    `json:"metric" gorm:"primaryKey"`
+	UserHash     string    `json:"user_hash" gorm:"primaryKey"`
+	Variant      string    `json:"variant"`
+	Value        float64   `json:"value"`
+	Events       int64     `json:"events"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ExperimentOutcome is what one instance saw of one variant's predictions
+type ExperimentOutcome struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	ExperimentID uint      `json:"experiment_id" gorm:"index"`
+	Variant      string    `json:"variant"`
+	Requests     int64     `json:"requests"`
+	Errors       int64     `json:"errors"`
+	LatencySumMs float64   `json:"latency_sum_ms"`
+	LatencySumSq float64   `json:"latency_sum_sq"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+var experimentRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "model_experiment_requests_total",
+		Help: "Predictions served in A/B test experiments, by variant",
+	},
+	[]string{"experiment", "variant", "status"},
+)
+
+// experimentAssignment is the variant picked to serve one request
+type experimentAssignment struct {
+	experimentID uint
+	name         string
+	variant      string
+	userHash     string
+}
+
+type experimentStatsKey struct {
+	experimentID uint
+	variant      string
+}
+
+type experimentWindow struct {
+	requests     int64
+	errors       int64
+	latencySum   float64
+	latencySumSq float64
+}
+
+// experimentRouter holds the running experiments, the predictions seen
+// since they were last written out and the users exposed meanwhile
+type experimentRouter struct {
+	mu          sync.Mutex
+	experiments map[uint]*ABExperiment
+	stats       map[experimentStatsKey]*experimentWindow
+	exposed     []ExperimentAssignment
+	seen        map[string]bool
+}
+
+func newExperimentRouter() *experimentRouter {
+	return &experimentRouter{
+		experiments: make(map[uint]*ABExperiment),
+		stats:       make(map[experimentStatsKey]*experimentWindow),
+		seen:        make(map[string]bool),
+	}
+}
+
+func (r *experimentRouter) set(experiment *ABExperiment) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.experiments[experiment.DeploymentID] = experiment
+}
+
+func (r *experimentRouter) clear(deploymentID uint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.experiments, deploymentID)
+}
+
+// replace swaps in the experiments read from the database
+func (r *experimentRouter) replace(experiments map[uint]*ABExperiment) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.experiments = experiments
+}
+
+func (r *experimentRouter) get(deploymentID uint) *ABExperiment {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.experiments[deploymentID]
+}
+
+// expose queues the first exposure of a user seen by this instance
+func (r *experimentRouter) expose(assignment *experimentAssignment) {
+	key := fmt.Sprintf("%d:%s", assignment.experimentID, assignment.userHash)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen[key] {
+		return
+	}
+	if len(r.seen) >= experimentSeenLimit {
+		r.seen = make(map[string]bool)
+	}
+	r.seen[key] = true
+	r.exposed = append(r.exposed, ExperimentAssignment{
+		ExperimentID: assignment.experimentID,
+		UserHash:     assignment.userHash,
+		Variant:      assignment.variant,
+		AssignedAt:   time.Now(),
+	})
+}
+
+func (r *experimentRouter) record(assignment *experimentAssignment, latency time.Duration, failed bool) {
+	key := experimentStatsKey{experimentID: assignment.experimentID, variant: assignment.variant}
+	ms := float64(latency) / float64(time.Millisecond)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	window, ok := r.stats[key]
+	if !ok {
+		window = &experimentWindow{}
+		r.stats[key] = window
+	}
+	window.requests++
+	if failed {
+		window.errors++
+	}
+	window.latencySum += ms
+	window.latencySumSq += ms * ms
+}
+
+// take hands over the predictions and exposures seen since the last call
+func (r *experimentRouter) take() (map[experimentStatsKey]*experimentWindow, []ExperimentAssignment) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats, exposed := r.stats, r.exposed
+	r.stats = make(map[experimentStatsKey]*experimentWindow)
+	r.exposed = nil
+	return stats, exposed
+}
+
+// experimentUserHash is how a user is known to an experiment
+func experimentUserHash(experiment *ABExperiment, userKey string) string {
+	sum := sha256.Sum256([]byte(experiment.Salt + ":" + userKey))
+	return hex.EncodeToString(sum[:16])
+}
+
+// assignVariant picks the variant of a user from their hash, so every
+// instance picks the same one
+func assignVariant(experiment *ABExperiment, userHash string) *ExperimentVariant {
+	raw, err := hex.DecodeString(userHash)
+	if err != nil || len(raw) < 8 {
+		return nil
+	}
+	total := 0
+	for _, variant := range experiment.Variants {
+		total += variant.Weight
+	}
+	if total == 0 {
+		return nil
+	}
+	bucket := int(binary.BigEndian.Uint64(raw[:8]) % experimentBuckets)
+	point := bucket * total / experimentBuckets
+	for i := range experiment.Variants {
+		if point < experiment.Variants[i].Weight {
+			return &experiment.Variants[i]
+		}
+		point -= experiment.Variants[i].Weight
+	}
+	return nil
+}
+
+func experimentUserKey(c *gin.Context) string {
+	if key := c.GetHeader("X-User-ID"); key != "" {
+		return key
+	}
+	return c.GetHeader("X-Experiment-Key")
+}
+
+// routeExperiment picks the deployment that serves a prediction while the
+// deployment runs an experiment. A variant whose deployment isn't running
+// gives way to control, and the request is left out of the experiment.
+func (ds *ModelDeploymentService) routeExperiment(c *gin.Context, deployment *ModelDeployment) *ModelDeployment {
+	experiment := ds.experiments.get(deployment.ID)
+	if experiment == nil {
+		return deployment
+	}
+	userKey := experimentUserKey(c)
+	if userKey == "" {
+		return deployment
+	}
+	userHash := experimentUserHash(experiment, userKey)
+	variant := assignVariant(experiment, userHash)
+	if variant == nil {
+		return deployment
+	}
+
+	target := deployment
+	if variant.DeploymentID != deployment.ID {
+		var other ModelDeployment
+		if err := ds.db.First(&other, variant.DeploymentID).Error; err != nil || other.Status != "running" {
+			return deployment
+		}
+		target = &other
+	}
+	target.experiment = &experimentAssignment{
+		experimentID: experiment.ID,
+		name:         experiment.Name,
+		variant:      variant.Name,
+		userHash:     userHash,
+	}
+	ds.experiments.expose(target.experiment)
+	c.Header("X-Experiment-Variant", variant.Name)
+	return target
+}
+
+// startExperimentTracking writes out experiment predictions and exposures
+// and picks up experiments started or stopped by other instances
+func (ds *ModelDeploymentService) startExperimentTracking() {
+	ds.loadExperiments()
+
+	ticker := time.NewTicker(experimentFlushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ds.flushExperimentStats()
+		ds.loadExperiments()
+	}
+}
+
+func (ds *ModelDeploymentService) loadExperiments() {
+	var experiments []ABExperiment
+	if err := ds.db.Where("status = ?", ExperimentStatusRunning).Find(&experiments).Error; err != nil {
+		ds.logger.Error("Failed to fetch experiments", zap.Error(err))
+		return
+	}
+	running := make(map[uint]*ABExperiment)
+	for i := range experiments {
+		running[experiments[i].DeploymentID] = &experiments[i]
+	}
+	ds.experiments.replace(running)
+}
+
+func (ds *ModelDeploymentService) flushExperimentStats() {
+	stats, exposed := ds.experiments.take()
+	now := time.Now()
+	for key, window := range stats {
+		outcome := ExperimentOutcome{
+			ExperimentID: key.experimentID,
+			Variant:      key.variant,
+			Requests:     window.requests,
+			Errors:       window.errors,
+			LatencySumMs: window.latencySum,
+			LatencySumSq: window.latencySumSq,
+			CreatedAt:    now,
+		}
+		if err := ds.db.Create(&outcome).Error; err != nil {
+			ds.logger.Warn("Failed to store experiment outcome", zap.Uint("experiment_id", key.experimentID), zap.Error(err))
+		}
+	}
+	if len(exposed) > 0 {
+		err := ds.db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(exposed, 500).Error
+		if err != nil {
+			ds.logger.Warn("Failed to store experiment assignments", zap.Int("count", len(exposed)), zap.Error(err))
+		}
+	}
+}
+
+// runningExperiment is the deployment's experiment in progress
+func (ds *ModelDeploymentService) runningExperiment(deploymentID uint) (*ABExperiment, error) {
+	var experiment ABExperiment
+	err := ds.db.Where("deployment_id = ? AND status = ?", deploymentID, ExperimentStatusRunning).First(&experiment).Error
+	if err != nil {
+		return nil, err
+	}
+	return &experiment, nil
+}
+
+// experimentFor loads the experiment named by ?experiment_id, or the
+// deployment's latest
+func (ds *ModelDeploymentService) experimentFor(c *gin.Context) (*ABExperiment, bool) {
+	query := ds.db.Where("deployment_id = ?", c.Param("id"))
+	if id := c.Query("experiment_id"); id != "" {
+		query = query.Where("id = ?", id)
+	}
+	var experiment ABExperiment
+	if err := query.Order("created_at DESC").First(&experiment).Error; err != nil {
+		c.JSON(404, gin.H{"error": "No A/B test for this deployment"})
+		return nil, false
+	}
+	return &experiment, true
+}
+
+// Report
+
+// variantCounts are the totals of one variant
+type variantCounts struct {
+	exposed      int64
+	requests     int64
+	errors       int64
+	latencySum   float64
+	latencySumSq float64
+	metrics      map[string]sampleSummary // per metric: users with events, value sum, value sum of squares
+}
+
+// experimentCounts totals an experiment's exposures, predictions and
+// metrics per variant
+func (ds *ModelDeploymentService) experimentCounts(experiment *ABExperiment) (map[string]*variantCounts, error) {
+	counts := make(map[string]*variantCounts)
+	for _, variant := range experiment.Variants {
+		counts[variant.Name] = &variantCounts{metrics: make(map[string]sampleSummary)}
+	}
+
+	var exposures []struct {
+		Variant string
+		Users   int64
+	}
+	err := ds.db.Model(&ExperimentAssignment{}).
+		Select("variant, COUNT(*) AS users").
+		Where("experiment_id = ?", experiment.ID).
+		Group("variant").
+		Scan(&exposures).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range exposures {
+		if vc, ok := counts[row.Variant]; ok {
+			vc.exposed = row.Users
+		}
+	}
+
+	var outcomes []struct {
+		Variant      string
+		Requests     int64
+		Errors       int64
+		LatencySumMs float64
+		LatencySumSq float64
+	}
+	err = ds.db.Model(&ExperimentOutcome{}).
+		Select("variant, SUM(requests) AS requests, SUM(errors) AS errors, SUM(latency_sum_ms) AS latency_sum_ms, SUM(latency_sum_sq) AS latency_sum_sq").
+		Where("experiment_id = ?", experiment.ID).
+		Group("variant").
+		Scan(&outcomes).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range outcomes {
+		if vc, ok := counts[row.Variant]; ok {
+			vc.requests = row.Requests
+			vc.errors = row.Errors
+			vc.latencySum = row.LatencySumMs
+			vc.latencySumSq = row.LatencySumSq
+		}
+	}
+
+	// Events of users never served by the experiment don't count
+	var metrics []struct {
+		Metric  string
+		Variant string
+		Users   int64
+		Total   float64
+		SumSq   float64
+	}
+	err = ds.db.Table("experiment_user_metrics AS m").
+		Select("m.metric, a.variant, COUNT(*) AS users, SUM(m.value) AS total, SUM(m.value * m.value) AS sum_sq").
+		Joins("JOIN experiment_assignments a ON a.experiment_id = m.experiment_id AND a.user_hash = m.user_hash").
+		Where("m.experiment_id = ?", experiment.ID).
+		Group("m.metric, a.variant").
+		Scan(&metrics).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range metrics {
+		if vc, ok := counts[row.Variant]; ok {
+			vc.metrics[row.Metric] = sampleSummary{n: float64(row.Users), sum: row.Total, sumSq: row.SumSq}
+		}
+	}
+	return counts, nil
+}
+
+// comparisonResult compares one variant with control on one measure
+type comparisonResult struct {
+	Test        string   `json:"test"`
+	Control     float64  `json:"control"`
+	Variant     float64  `json:"variant"`
+	Lift        *float64 `json:"lift,omitempty"` // relative to control
+	Statistic   float64  `json:"statistic"`
+	PValue      float64  `json:"p_value"`
+	Significant bool     `json:"significant"`
+	Note        string   `json:"note,omitempty"`
+}
+
+func newComparison(test string, control, variant float64) comparisonResult {
+	result := comparisonResult{Test: test, Control: control, Variant: variant, PValue: 1}
+	if control != 0 {
+		lift := (variant - control) / math.Abs(control)
+		result.Lift = &lift
+	}
+	return result
+}
+
+// compareRates compares the share of successes with a 2x2 chi-square test
+func compareRates(controlSuccesses, controlTotal, successes, total, alpha float64) comparisonResult {
+	var controlRate, rate float64
+	if controlTotal > 0 {
+		controlRate = controlSuccesses / controlTotal
+	}
+	if total > 0 {
+		rate = successes / total
+	}
+	result := newComparison("chi_square", controlRate, rate)
+	statistic, pValue, ok := chiSquareTest([]float64{controlSuccesses, successes}, []float64{controlTotal, total})
+	if !ok {
+		result.Note = "not enough data"
+		return result
+	}
+	result.Statistic, result.PValue = statistic, pValue
+	result.Significant = pValue < alpha
+	return result
+}
+
+// compareMeans compares means with Welch's t-test
+func compareMeans(control, variant sampleSummary, alpha float64) comparisonResult {
+	result := newComparison("welch_t_test", control.mean(), variant.mean())
+	t, _, pValue, ok := welchTTest(control, variant)
+	if !ok {
+		result.Note = "not enough data"
+		return result
+	}
+	result.Statistic, result.PValue = t, pValue
+	result.Significant = pValue < alpha
+	return result
+}
+
+// perUser spreads a metric over every exposed user, counting users without
+// events as zero
+func perUser(summary sampleSummary, exposed int64) sampleSummary {
+	return sampleSummary{n: float64(exposed), sum: summary.sum, sumSq: summary.sumSq}
+}
+
+// experimentReport compares every variant of an experiment with control
+func (ds *ModelDeploymentService) experimentReport(experiment *ABExperiment) (gin.H, error) {
+	counts, err := ds.experimentCounts(experiment)
+	if err != nil {
+		return nil, err
+	}
+	control := counts[controlVariant]
+
+	ready := true
+	var variants []gin.H
+	successes := make(map[string][]float64)
+	totals := make(map[string][]float64)
+	var winner string
+	var bestLift float64
+	for _, variant := range experiment.Variants {
+		vc := counts[variant.Name]
+		if vc.exposed < experiment.MinSampleSize {
+			ready = false
+		}
+
+		predictions := gin.H{"requests": vc.requests, "errors": vc.errors, "error_rate": 0.0, "mean_latency_ms": 0.0}
+		if vc.requests > 0 {
+			predictions["error_rate"] = float64(vc.errors) / float64(vc.requests)
+			predictions["mean_latency_ms"] = vc.latencySum / float64(vc.requests)
+		}
+
+		metrics := gin.H{}
+		for _, metric := range experiment.Metrics {
+			summary := vc.metrics[metric.Name]
+			if metric.Type == ExperimentMetricBinary {
+				rate := 0.0
+				if vc.exposed > 0 {
+					rate = summary.n / float64(vc.exposed)
+				}
+				metrics[metric.Name] = gin.H{"type": metric.Type, "converted_users": int64(summary.n), "rate": rate}
+				successes[metric.Name] = append(successes[metric.Name], summary.n)
+				totals[metric.Name] = append(totals[metric.Name], float64(vc.exposed))
+				continue
+			}
+			metrics[metric.Name] = gin.H{
+				"type":         metric.Type,
+				"active_users": int64(summary.n),
+				"total":        summary.sum,
+				"per_user":     perUser(summary, vc.exposed).mean(),
+			}
+		}
+
+		entry := gin.H{
+			"name":          variant.Name,
+			"deployment_id": variant.DeploymentID,
+			"weight":        variant.Weight,
+			"exposed_users": vc.exposed,
+			"predictions":   predictions,
+			"metrics":       metrics,
+		}
+
+		if variant.Name != controlVariant {
+			comparisons := gin.H{}
+			for _, metric := range experiment.Metrics {
+				var result comparisonResult
+				if metric.Type == ExperimentMetricBinary {
+					result = compareRates(control.metrics[metric.Name].n, float64(control.exposed),
+						vc.metrics[metric.Name].n, float64(vc.exposed), experiment.Alpha)
+				} else {
+					result = compareMeans(perUser(control.metrics[metric.Name], control.exposed),
+						perUser(vc.metrics[metric.Name], vc.exposed), experiment.Alpha)
+				}
+				comparisons[metric.Name] = result
+				if metric.Name == experiment.PrimaryMetric && result.Significant && result.Lift != nil && *result.Lift > bestLift {
+					winner, bestLift = variant.Name, *result.Lift
+				}
+			}
+			comparisons["error_rate"] = compareRates(float64(control.errors), float64(control.requests),
+				float64(vc.errors), float64(vc.requests), experiment.Alpha)
+			comparisons["latency_ms"] = compareMeans(
+				sampleSummary{n: float64(control.requests), sum: control.latencySum, sumSq: control.latencySumSq},
+				sampleSummary{n: float64(vc.requests), sum: vc.latencySum, sumSq: vc.latencySumSq},
+				experiment.Alpha)
+			entry["vs_control"] = comparisons
+		}
+		variants = append(variants, entry)
+	}
+
+	// With more than two variants, whether any binary metric differs at all
+	overall := gin.H{}
+	if len(experiment.Variants) > 2 {
+		for _, metric := range experiment.Metrics {
+			if metric.Type != ExperimentMetricBinary {
+				continue
+			}
+			statistic, pValue, ok := chiSquareTest(successes[metric.Name], totals[metric.Name])
+			result := gin.H{"test": "chi_square", "statistic": statistic, "p_value": pValue, "degrees_of_freedom": len(experiment.Variants) - 1, "significant": ok && pValue < experiment.Alpha}
+			if !ok {
+				result["note"] = "not enough data"
+			}
+			overall[metric.Name] = result
+		}
+	}
+
+	report := gin.H{
+		"experiment":   experiment,
+		"variants":     variants,
+		"overall":      overall,
+		"sample_ready": ready,
+		"generated_at": time.Now(),
+	}
+	// A winner is only called once every variant has its sample
+	if ready && winner != "" {
+		report["recommended_variant"] = winner
+	}
+	return report, nil
+}
+
+// Handlers
+
+// Start an A/B test on a deployment
+func (ds *ModelDeploymentService) createABTest(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	if deployment.Status != "running" {
+		c.JSON(409, gin.H{"error": "Deployment not running"})
+		return
+	}
+
+	var request struct {
+		Name          string                `json:"name" binding:"required"`
+		Hypothesis    string                `json:"hypothesis"`
+		ControlWeight int                   `json:"control_weight" binding:"min=0"`
+		Variants      []ExperimentVariant   `json:"variants" binding:"required,min=1,max=10"`
+		Metrics       []ExperimentMetricDef `json:"metrics"`
+		PrimaryMetric string                `json:"primary_metric"`
+		Alpha         float64               `json:"alpha" binding:"min=0,max=0.5"`
+		MinSampleSize int64                 `json:"min_sample_size" binding:"min=0"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create A/B test"})
+		return
+	}
+	experiment := ABExperiment{
+		DeploymentID:  deployment.ID,
+		Name:          request.Name,
+		Hypothesis:    request.Hypothesis,
+		Status:        ExperimentStatusRunning,
+		Salt:          hex.EncodeToString(salt),
+		Metrics:       request.Metrics,
+		PrimaryMetric: request.PrimaryMetric,
+		Alpha:         request.Alpha,
+		MinSampleSize: request.MinSampleSize,
+		CreatedBy:     c.GetHeader("X-User-ID"),
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+	}
+	if experiment.Alpha == 0 {
+		experiment.Alpha = 0.05
+	}
+	if experiment.MinSampleSize == 0 {
+		experiment.MinSampleSize = 1000
+	}
+	if experiment.Metrics == nil {
+		experiment.Metrics = []ExperimentMetricDef{}
+	}
+	controlWeight := request.ControlWeight
+	if controlWeight == 0 {
+		controlWeight = 50
+	}
+	experiment.Variants = append(experiment.Variants, ExperimentVariant{Name: controlVariant, DeploymentID: deployment.ID, Weight: controlWeight})
+
+	names := map[string]bool{controlVariant: true}
+	for _, variant := range request.Variants {
+		if variant.Name == "" || names[variant.Name] {
+			c.JSON(400, gin.H{"error": "Variant names must be unique and not \"control\""})
+			return
+		}
+		names[variant.Name] = true
+		if variant.Weight <= 0 {
+			c.JSON(400, gin.H{"error": "Variant weights must be positive", "variant": variant.Name})
+			return
+		}
+		if variant.DeploymentID == deployment.ID {
+			c.JSON(400, gin.H{"error": "Variants must be other deployments", "variant": variant.Name})
+			return
+		}
+		var other ModelDeployment
+		if err := ds.db.First(&other, variant.DeploymentID).Error; err != nil {
+			c.JSON(400, gin.H{"error": "Variant deployment not found", "variant": variant.Name})
+			return
+		}
+		if other.Status != "running" {
+			c.JSON(409, gin.H{"error": "Variant deployment not running", "variant": variant.Name})
+			return
+		}
+		experiment.Variants = append(experiment.Variants, variant)
+	}
+
+	metricNames := map[string]bool{}
+	for _, metric := range experiment.Metrics {
+		if metric.Name == "" || metricNames[metric.Name] {
+			c.JSON(400, gin.H{"error": "Metric names must be unique"})
+			return
+		}
+		if metric.Type != ExperimentMetricBinary && metric.Type != ExperimentMetricContinuous {
+			c.JSON(400, gin.H{"error": "Metric type must be binary or continuous", "metric": metric.Name})
+			return
+		}
+		metricNames[metric.Name] = true
+	}
+	if experiment.PrimaryMetric == "" && len(experiment.Metrics) > 0 {
+		experiment.PrimaryMetric = experiment.Metrics[0].Name
+	}
+	if experiment.PrimaryMetric != "" && !metricNames[experiment.PrimaryMetric] {
+		c.JSON(400, gin.H{"error": "Primary metric is not one of the metrics"})
+		return
+	}
+
+	if _, err := ds.runningExperiment(deployment.ID); err == nil {
+		c.JSON(409, gin.H{"error": "Deployment already has an A/B test running"})
+		return
+	} else if err != gorm.ErrRecordNotFound {
+		c.JSON(500, gin.H{"error": "Failed to check A/B tests"})
+		return
+	}
+
+	if err := ds.db.Create(&experiment).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create A/B test"})
+		return
+	}
+	ds.experiments.set(&experiment)
+
+	ds.logger.Info("A/B test started",
+		zap.String("deployment", deployment.Name),
+		zap.String("experiment", experiment.Name),
+		zap.Int("variants", len(experiment.Variants)))
+
+	c.JSON(201, experiment)
+}
+
+// Get the deployment's current or latest A/B test with its counts so far
+func (ds *ModelDeploymentService) getABTestResults(c *gin.Context) {
+	experiment, ok := ds.experimentFor(c)
+	if !ok {
+		return
+	}
+	counts, err := ds.experimentCounts(experiment)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch A/B test results"})
+		return
+	}
+
+	var variants []gin.H
+	for _, variant := range experiment.Variants {
+		vc := counts[variant.Name]
+		variants = append(variants, gin.H{
+			"name":          variant.Name,
+			"deployment_id": variant.DeploymentID,
+			"weight":        variant.Weight,
+			"exposed_users": vc.exposed,
+			"requests":      vc.requests,
+			"errors":        vc.errors,
+		})
+	}
+	c.JSON(200, gin.H{"experiment": experiment, "variants": variants})
+}
+
+// Compare the variants of the deployment's current or latest A/B test
+func (ds *ModelDeploymentService) getABTestReport(c *gin.Context) {
+	experiment, ok := ds.experimentFor(c)
+	if !ok {
+		return
+	}
+	report, err := ds.experimentReport(experiment)
+	if err != nil {
+		ds.logger.Error("Failed to build A/B test report", zap.Uint("experiment_id", experiment.ID), zap.Error(err))
+		c.JSON(500, gin.H{"error": "Failed to build A/B test report"})
+		return
+	}
+	c.JSON(200, report)
+}
+
+// List the deployment's A/B tests
+func (ds *ModelDeploymentService) listABTests(c *gin.Context) {
+	var experiments []ABExperiment
+	if err := ds.db.Where("deployment_id = ?", c.Param("id")).Order("created_at DESC").Limit(50).Find(&experiments).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch A/B tests"})
+		return
+	}
+	c.JSON(200, gin.H{"experiments": experiments})
+}
+
+// Tell which variant serves a user
+func (ds *ModelDeploymentService) getABTestAssignment(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	experiment, err := ds.runningExperiment(deployment.ID)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "No A/B test running"})
+		return
+	}
+	userKey := c.Query("user_id")
+	if userKey == "" {
+		c.JSON(400, gin.H{"error": "user_id is required"})
+		return
+	}
+	variant := assignVariant(experiment, experimentUserHash(experiment, userKey))
+	if variant == nil {
+		c.JSON(500, gin.H{"error": "Failed to assign variant"})
+		return
+	}
+	c.JSON(200, gin.H{"experiment_id": experiment.ID, "variant": variant.Name, "deployment_id": variant.DeploymentID})
+}
+
+// Record business metric events of users in the running A/B test
+func (ds *ModelDeploymentService) recordABTestEvents(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	experiment, err := ds.runningExperiment(deployment.ID)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "No A/B test running"})
+		return
+	}
+
+	var request struct {
+		Events []struct {
+			UserID string  `json:"user_id" binding:"required"`
+			Metric string  `json:"metric" binding:"required"`
+			Value  float64 `json:"value"`
+		} `json:"events" binding:"required,min=1,max=1000,dive"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	types := make(map[string]string)
+	for _, metric := range experiment.Metrics {
+		types[metric.Name] = metric.Type
+	}
+
+	// Events of one user and metric are added up before they are stored
+	rows := make(map[[2]string]*ExperimentUserMetric)
+	var order [][2]string
+	now := time.Now()
+	for _, event := range request.Events {
+		metricType, ok := types[event.Metric]
+		if !ok {
+			c.JSON(400, gin.H{"error": "Unknown metric", "metric": event.Metric})
+			return
+		}
+		value := event.Value
+		if metricType == ExperimentMetricBinary {
+			value = 0
+		}
+		userHash := experimentUserHash(experiment, event.UserID)
+		key := [2]string{event.Metric, userHash}
+		row, ok := rows[key]
+		if !ok {
+			variant := assignVariant(experiment, userHash)
+			if variant == nil {
+				continue
+			}
+			row = &ExperimentUserMetric{ExperimentID: experiment.ID, Metric: event.Metric, UserHash: userHash, Variant: variant.Name, UpdatedAt: now}
+			rows[key] = row
+			order = append(order, key)
+		}
+		row.Value += value
+		row.Events++
+	}
+
+	batch := make([]ExperimentUserMetric, 0, len(order))
+	for _, key := range order {
+		batch = append(batch, *rows[key])
+	}
+	if len(batch) > 0 {
+		err = ds.db.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "experiment_id"}, {Name: "metric"}, {Name: "user_hash"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"value":      gorm.Expr("experiment_user_metrics.value + EXCLUDED.value"),
+				"events":     gorm.Expr("experiment_user_metrics.events + EXCLUDED.events"),
+				"updated_at": now,
+			}),
+		}).Create(&batch).Error
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to record events"})
+			return
+		}
+	}
+	c.JSON(202, gin.H{"accepted": len(request.Events)})
+}
+
+// Stop the running A/B test, optionally naming the variant that won
+func (ds *ModelDeploymentService) stopABTest(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	experiment, err := ds.runningExperiment(deployment.ID)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "No A/B test running"})
+		return
+	}
+	var request struct {
+		Winner string `json:"winner"`
+	}
+	c.ShouldBindJSON(&request)
+	if request.Winner != "" {
+		found := false
+		for _, variant := range experiment.Variants {
+			found = found || variant.Name == request.Winner
+		}
+		if !found {
+			c.JSON(400, gin.H{"error": "Winner is not a variant of the A/B test"})
+			return
+		}
+	}
+
+	now := time.Now()
+	result := ds.db.Model(&ABExperiment{}).
+		Where("id = ? AND status = ?", experiment.ID, ExperimentStatusRunning).
+		Updates(map[string]interface{}{"status": ExperimentStatusStopped, "winner": request.Winner, "stopped_at": now, "updated_at": now})
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": "Failed to stop A/B test"})
+		return
+	}
+	ds.experiments.clear(experiment.DeploymentID)
+	// Predictions served so far still count
+	ds.flushExperimentStats()
+
+	experiment.Status, experiment.Winner, experiment.StoppedAt = ExperimentStatusStopped, request.Winner, &now
+	ds.logger.Info("A/B test stopped", zap.Uint("experiment_id", experiment.ID), zap.String("winner", request.Winner))
+	c.JSON(200, experiment)
+}
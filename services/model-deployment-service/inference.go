@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// Inference proxying. Predictions are forwarded to the deployment's
+// in-cluster Service: over HTTP to port 80, at InferencePath or the
+// framework's usual predict path, and over gRPC to port 8081.
+//
+// HTTP responses come back wrapped as {"result", "latency_ms",
+// "deployment"}, except streams (text/event-stream, application/x-ndjson),
+// which are relayed as they arrive. gRPC calls are made with the message
+// bytes the client posts, so any model server API can be called without the
+// service knowing its protos; server-streaming calls return the messages
+// varint length-delimited.
+//
+// Connection failures and 502, 503 and 504 answers are retried up to
+// InferenceMaxRetries times with backoff, as long as nothing has been sent
+// to the client yet. Every attempt is bounded by InferenceTimeoutSeconds; a
+// stream only until its response starts.
+
+const (
+	inferenceRetryBackoff      = 100 * time.Millisecond
+	maxInferenceLatencySamples = 10000
+)
+
+var (
+	inferenceLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "model_inference_latency_seconds",
+			Help:    "Model inference latency as seen by the deployment service",
+			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"deployment", "protocol"},
+	)
+	inferenceRetries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_inference_retries_total",
+			Help: "Inference attempts retried after a failed attempt",
+		},
+		[]string{"deployment", "protocol"},
+	)
+)
+
+// inferenceHTTPClient is shared so connections to model servers are reused
+var inferenceHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        512,
+		MaxIdleConnsPerHost: 64,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// inferenceStats gathers the requests of each deployment between metrics
+// collections
+type inferenceStats struct {
+	mu      sync.Mutex
+	windows map[uint]*inferenceWindow
+}
+
+type inferenceWindow struct {
+	requests  int64
+	errors    int64
+	latencies []float64 // ms, sampled once full
+	since     time.Time
+}
+
+func newInferenceStats() *inferenceStats {
+	return &inferenceStats{windows: make(map[uint]*inferenceWindow)}
+}
+
+func (s *inferenceStats) record(deploymentID uint, latency time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.windows[deploymentID]
+	if !ok {
+		w = &inferenceWindow{since: time.Now()}
+		s.windows[deploymentID] = w
+	}
+	w.requests++
+	if failed {
+		w.errors++
+	}
+	ms := float64(latency.Microseconds()) / 1000
+	if len(w.latencies) < maxInferenceLatencySamples {
+		w.latencies = append(w.latencies, ms)
+	} else if i := rand.Int63n(w.requests); i < maxInferenceLatencySamples {
+		w.latencies[i] = ms
+	}
+}
+
+// take returns and resets a deployment's window; nil when it had no requests
+func (s *inferenceStats) take(deploymentID uint) *inferenceWindow {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.windows[deploymentID]
+	delete(s.windows, deploymentID)
+	return w
+}
+
+// apply fills in the request figures of a metrics sample
+func (w *inferenceWindow) apply(metrics *DeploymentMetrics, now time.Time) {
+	if w == nil || w.requests == 0 {
+		return
+	}
+	metrics.RequestCount = w.requests
+	metrics.ErrorCount = w.errors
+	if elapsed := now.Sub(w.since).Seconds(); elapsed > 0 {
+		metrics.ThroughputRPS = float64(w.requests) / elapsed
+	}
+
+	sort.Float64s(w.latencies)
+	var total float64
+	for _, ms := range w.latencies {
+		total += ms
+	}
+	metrics.AvgLatencyMs = total / float64(len(w.latencies))
+	metrics.P95LatencyMs = percentile(w.latencies, 0.95)
+	metrics.P99LatencyMs = percentile(w.latencies, 0.99)
+}
+
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+// inferenceHost is the deployment's Service in the cluster, or its
+// canary's when the request was routed there
+func inferenceHost(deployment *ModelDeployment) string {
+	if deployment.variant != nil && deployment.variant.name == variantCanary {
+		return canaryHost(deployment)
+	}
+	return fmt.Sprintf("%s.%s.svc.%s", deployment.Name, namespaceOf(deployment), getEnv("CLUSTER_DOMAIN", "cluster.local"))
+}
+
+// inferencePath is where the deployment's model server takes predictions
+func inferencePath(deployment *ModelDeployment) string {
+	if deployment.InferencePath != "" {
+		return deployment.InferencePath
+	}
+	switch deployment.Framework {
+	case "pytorch":
+		return "/predictions/" + deployment.Name
+	default:
+		return "/v1/models/" + deployment.Name + ":predict"
+	}
+}
+
+func inferenceTimeout(deployment *ModelDeployment) time.Duration {
+	if deployment.InferenceTimeoutSeconds > 0 {
+		return time.Duration(deployment.InferenceTimeoutSeconds) * time.Second
+	}
+	return 30 * time.Second
+}
+
+// retryDelay backs off exponentially with jitter
+func retryDelay(attempt int) time.Duration {
+	delay := inferenceRetryBackoff << attempt
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)))
+}
+
+func isStreamingContent(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/event-stream" || mediaType == "application/x-ndjson"
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// runningDeployment loads the deployment of a serving request, answering
+// the request when it can't serve
+func (ds *ModelDeploymentService) runningDeployment(c *gin.Context) (*ModelDeployment, bool) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return nil, false
+	}
+	if !servingStatus(deployment.Status) {
+		c.JSON(503, gin.H{"error": "Deployment not ready", "status": deployment.Status, "reason": deployment.StatusReason})
+		return nil, false
+	}
+	return &deployment, true
+}
+
+// recordInference updates the metrics of one inference request
+func (ds *ModelDeploymentService) recordInference(deployment *ModelDeployment, protocol, outcome string, latency time.Duration) {
+	modelInferenceRequests.WithLabelValues(deployment.Name, outcome).Inc()
+	inferenceLatency.WithLabelValues(deployment.Name, protocol).Observe(latency.Seconds())
+	ds.inference.record(deployment.ID, latency, outcome != "success" && outcome != "client_error")
+	if deployment.variant != nil {
+		canaryRequests.WithLabelValues(deployment.Name, deployment.variant.name, outcome).Inc()
+		ds.canaries.record(deployment.variant, latency, outcome != "success" && outcome != "client_error")
+	}
+	if deployment.experiment != nil {
+		experimentRequests.WithLabelValues(deployment.experiment.name, deployment.experiment.variant, outcome).Inc()
+		ds.experiments.record(deployment.experiment, latency, outcome != "success" && outcome != "client_error")
+	}
+}
+
+func (ds *ModelDeploymentService) predict(c *gin.Context) {
+	deployment, ok := ds.runningDeployment(c)
+	if !ok {
+		return
+	}
+
+	maxBody := int64(getEnvInt("INFERENCE_MAX_BODY_BYTES", 32<<20))
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxBody+1))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	if int64(len(body)) > maxBody {
+		c.JSON(413, gin.H{"error": "Request body too large", "max_body_bytes": maxBody})
+		return
+	}
+	contentType := c.GetHeader("Content-Type")
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/json" && !json.Valid(body) {
+		c.JSON(400, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	deployment = ds.routeExperiment(c, deployment)
+	if !ds.awaitWarm(c, deployment) {
+		return
+	}
+	ds.routeCanary(c, deployment)
+	target := "http://" + inferenceHost(deployment) + inferencePath(deployment)
+	if c.Request.URL.RawQuery != "" {
+		target += "?" + c.Request.URL.RawQuery
+	}
+	timeout := inferenceTimeout(deployment)
+	start := time.Now()
+
+	var resp *http.Response
+	var cancel context.CancelFunc
+	var timer *time.Timer
+	for attempt := 0; ; attempt++ {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(c.Request.Context())
+		timer = time.AfterFunc(timeout, cancel)
+
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		if accept := c.GetHeader("Accept"); accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if requestID := c.GetHeader("X-Request-ID"); requestID != "" {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		if deployment.variant != nil {
+			req.Header.Set(variantHeader, deployment.variant.name)
+		}
+
+		resp, err = inferenceHTTPClient.Do(req)
+		retry := err != nil || retryableStatus(resp.StatusCode)
+		if !retry || attempt >= deployment.InferenceMaxRetries || c.Request.Context().Err() != nil {
+			break
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		timer.Stop()
+		cancel()
+		inferenceRetries.WithLabelValues(deployment.Name, "http").Inc()
+		time.Sleep(retryDelay(attempt))
+	}
+	defer cancel()
+
+	if err != nil {
+		timer.Stop()
+		latency := time.Since(start)
+		outcome, code, message := "error", 502, "Model server unavailable"
+		if errors.Is(err, context.Canceled) && c.Request.Context().Err() == nil {
+			outcome, code, message = "timeout", 504, "Model server timed out"
+		}
+		ds.recordInference(deployment, "http", outcome, latency)
+		ds.logger.Warn("Model prediction failed",
+			zap.String("deployment", deployment.Name),
+			zap.Duration("latency", latency),
+			zap.Error(err))
+		c.JSON(code, gin.H{"error": message, "deployment": deployment.Name})
+		return
+	}
+	defer resp.Body.Close()
+
+	// Streams are relayed as they come, for as long as the client listens
+	if isStreamingContent(resp.Header.Get("Content-Type")) && resp.StatusCode < 300 {
+		timer.Stop()
+		ds.relayStream(c, deployment, resp, start)
+		return
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	timer.Stop()
+	latency := time.Since(start)
+	if err != nil {
+		outcome := "error"
+		if errors.Is(err, context.Canceled) {
+			outcome = "timeout"
+		}
+		ds.recordInference(deployment, "http", outcome, latency)
+		c.JSON(502, gin.H{"error": "Failed to read model server response", "deployment": deployment.Name})
+		return
+	}
+
+	var result interface{} = string(raw)
+	if json.Valid(raw) {
+		result = json.RawMessage(raw)
+	}
+	ds.captures.capture(c, deployment, body, raw, resp.StatusCode, latency)
+	switch {
+	case resp.StatusCode >= 500:
+		ds.recordInference(deployment, "http", "error", latency)
+		c.JSON(502, gin.H{"error": "Model server error", "status": resp.StatusCode, "detail": result, "deployment": deployment.Name})
+		return
+	case resp.StatusCode >= 400:
+		ds.recordInference(deployment, "http", "client_error", latency)
+		c.JSON(resp.StatusCode, gin.H{"error": "Model server rejected the request", "detail": result, "deployment": deployment.Name})
+		return
+	}
+
+	ds.recordInference(deployment, "http", "success", latency)
+	ds.logger.Info("Model prediction",
+		zap.String("deployment", deployment.Name),
+		zap.String("model_id", deployment.ModelID),
+		zap.Int64("latency_ms", latency.Milliseconds()))
+	ds.inferenceLog.sample(deployment, body, raw, latency)
+
+	c.JSON(200, gin.H{
+		"result":     result,
+		"latency_ms": latency.Milliseconds(),
+		"deployment": deployment.Name,
+	})
+}
+
+// relayStream copies a streaming model response to the client, flushing
+// each chunk
+func (ds *ModelDeploymentService) relayStream(c *gin.Context, deployment *ModelDeployment, resp *http.Response, start time.Time) {
+	c.Header("Content-Type", resp.Header.Get("Content-Type"))
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(resp.StatusCode)
+
+	buf := make([]byte, 32<<10)
+	var err error
+	for {
+		var n int
+		n, err = resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := c.Writer.Write(buf[:n]); werr != nil {
+				err = werr
+				break
+			}
+			c.Writer.Flush()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	latency := time.Since(start)
+	outcome := "success"
+	if err != io.EOF && c.Request.Context().Err() == nil {
+		outcome = "error"
+		ds.logger.Warn("Model prediction stream broke off",
+			zap.String("deployment", deployment.Name),
+			zap.Error(err))
+	}
+	ds.recordInference(deployment, "http", outcome, latency)
+}
+
+// rawCodec passes gRPC messages through as the bytes they are
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("rawCodec: unexpected message type %T", v)
+	}
+	return *b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("rawCodec: unexpected message type %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string { return "proto" }
+
+// grpcConns keeps one client connection per model Service
+type grpcConns struct {
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func newGRPCConns() *grpcConns {
+	return &grpcConns{conns: make(map[string]*grpc.ClientConn)}
+}
+
+func (p *grpcConns) get(address string) (*grpc.ClientConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn, ok := p.conns[address]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})))
+	if err != nil {
+		return nil, err
+	}
+	p.conns[address] = conn
+	return conn, nil
+}
+
+// grpcHTTPStatus maps a gRPC status to the answer given to the client
+func grpcHTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return 400
+	case codes.Unauthenticated:
+		return 401
+	case codes.PermissionDenied:
+		return 403
+	case codes.NotFound:
+		return 404
+	case codes.ResourceExhausted:
+		return 429
+	case codes.Unimplemented:
+		return 501
+	case codes.DeadlineExceeded:
+		return 504
+	default:
+		return 502
+	}
+}
+
+func grpcOutcome(code codes.Code) string {
+	switch grpcHTTPStatus(code) {
+	case 400, 401, 403, 404, 429:
+		return "client_error"
+	case 504:
+		return "timeout"
+	}
+	return "error"
+}
+
+// Call a method of the deployment's model server over gRPC. The body is the
+// serialized request message; ?stream=true calls a server-streaming method.
+func (ds *ModelDeploymentService) predictGRPC(c *gin.Context) {
+	deployment, ok := ds.runningDeployment(c)
+	if !ok {
+		return
+	}
+
+	maxBody := int64(getEnvInt("INFERENCE_MAX_BODY_BYTES", 32<<20))
+	message, err := io.ReadAll(io.LimitReader(c.Request.Body, maxBody+1))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	if int64(len(message)) > maxBody {
+		c.JSON(413, gin.H{"error": "Request body too large", "max_body_bytes": maxBody})
+		return
+	}
+
+	deployment = ds.routeExperiment(c, deployment)
+	if !ds.awaitWarm(c, deployment) {
+		return
+	}
+	ds.routeCanary(c, deployment)
+	conn, err := ds.grpcConns.get(net.JoinHostPort(inferenceHost(deployment), "8081"))
+	if err != nil {
+		c.JSON(502, gin.H{"error": "Model server unavailable", "deployment": deployment.Name})
+		return
+	}
+	method := "/" + c.Param("service") + "/" + c.Param("method")
+	timeout := inferenceTimeout(deployment)
+	start := time.Now()
+
+	if c.Query("stream") == "true" {
+		ds.streamGRPC(c, deployment, conn, method, message, timeout, start)
+		return
+	}
+
+	var reply []byte
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(variantContext(c.Request.Context(), deployment), timeout)
+		err = conn.Invoke(ctx, method, &message, &reply)
+		cancel()
+		if status.Code(err) != codes.Unavailable || attempt >= deployment.InferenceMaxRetries || c.Request.Context().Err() != nil {
+			break
+		}
+		inferenceRetries.WithLabelValues(deployment.Name, "grpc").Inc()
+		time.Sleep(retryDelay(attempt))
+	}
+	latency := time.Since(start)
+
+	if err != nil {
+		st := status.Convert(err)
+		ds.recordInference(deployment, "grpc", grpcOutcome(st.Code()), latency)
+		c.JSON(grpcHTTPStatus(st.Code()), gin.H{
+			"error":      st.Message(),
+			"grpc_code":  st.Code().String(),
+			"deployment": deployment.Name,
+		})
+		return
+	}
+
+	ds.recordInference(deployment, "grpc", "success", latency)
+	c.Header("X-Latency-Ms", strconv.FormatInt(latency.Milliseconds(), 10))
+	c.Data(200, "application/x-protobuf", reply)
+}
+
+// streamGRPC relays the replies of a server-streaming call, each prefixed
+// with its varint length
+func (ds *ModelDeploymentService) streamGRPC(c *gin.Context, deployment *ModelDeployment, conn *grpc.ClientConn, method string, message []byte, timeout time.Duration, start time.Time) {
+	ctx, cancel := context.WithCancel(variantContext(c.Request.Context(), deployment))
+	defer cancel()
+	timer := time.AfterFunc(timeout, cancel)
+	defer timer.Stop()
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, method)
+	if err == nil {
+		err = stream.SendMsg(&message)
+	}
+	if err == nil {
+		err = stream.CloseSend()
+	}
+
+	var reply []byte
+	if err == nil {
+		err = stream.RecvMsg(&reply)
+	}
+	if err != nil && err != io.EOF {
+		st := status.Convert(err)
+		ds.recordInference(deployment, "grpc", grpcOutcome(st.Code()), time.Since(start))
+		c.JSON(grpcHTTPStatus(st.Code()), gin.H{
+			"error":      st.Message(),
+			"grpc_code":  st.Code().String(),
+			"deployment": deployment.Name,
+		})
+		return
+	}
+
+	// The stream has started; it now runs as long as the client listens
+	timer.Stop()
+	c.Header("Content-Type", "application/x-protobuf; delimited=true")
+	c.Status(200)
+	prefix := make([]byte, binary.MaxVarintLen64)
+	for err == nil {
+		n := binary.PutUvarint(prefix, uint64(len(reply)))
+		if _, err = c.Writer.Write(prefix[:n]); err == nil {
+			_, err = c.Writer.Write(reply)
+		}
+		c.Writer.Flush()
+		if err == nil {
+			err = stream.RecvMsg(&reply)
+		}
+	}
+
+	outcome := "success"
+	if err != io.EOF && c.Request.Context().Err() == nil {
+		outcome = grpcOutcome(status.Code(err))
+		ds.logger.Warn("Model gRPC stream broke off",
+			zap.String("deployment", deployment.Name),
+			zap.String("method", method),
+			zap.Error(err))
+	}
+	ds.recordInference(deployment, "grpc", outcome, time.Since(start))
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(getEnv(key, "")); err == nil {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// Inference logging. Deployments with a drift monitor have a share of their
+// predictions, the monitor's SampleRate, kept with request and response.
+// The records are uploaded to file-storage-service as JSONL in the folder
+// inference-logs/<deployment>, a file per deployment every
+// INFERENCE_LOG_FLUSH_SECONDS or INFERENCE_LOG_BATCH_SIZE records, and each
+// file is recorded as an InferenceLogBatch for drift checks to read back.
+// Records that can't be uploaded are dropped, not retried.
+
+const inferenceLogFolder = "inference-logs"
+
+// InferenceLogBatch is one uploaded file of sampled predictions
+type InferenceLogBatch struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	DeploymentID uint      `json:"deployment_id" gorm:"index;not null"`
+	FileID       string    `json:"file_id" gorm:"not null"`
+	Records      int       `json:"records"`
+	Bytes        int64     `json:"bytes"`
+	FirstAt      time.Time `json:"first_at"`
+	LastAt       time.Time `json:"last_at" gorm:"index"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// inferenceRecord is one sampled prediction
+type inferenceRecord struct {
+	Time      time.Time       `json:"time"`
+	Variant   string          `json:"variant,omitempty"`
+	LatencyMs int64           `json:"latency_ms"`
+	Request   json.RawMessage `json:"request"`
+	Response  json.RawMessage `json:"response"`
+}
+
+var inferenceLogRecords = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "model_inference_log_records_total",
+		Help: "Predictions sampled into the inference log, by status",
+	},
+	[]string{"deployment", "status"},
+)
+
+// inferenceLogger buffers sampled predictions per deployment
+type inferenceLogger struct {
+	mutex   sync.Mutex
+	rates   map[uint]float64
+	buffers map[uint][]inferenceRecord
+	names   map[uint]string
+	flushes chan logFlush
+}
+
+// logFlush is a buffer on its way to storage
+type logFlush struct {
+	deploymentID uint
+	name         string
+	records      []inferenceRecord
+}
+
+func newInferenceLogger() *inferenceLogger {
+	return &inferenceLogger{
+		rates:   make(map[uint]float64),
+		buffers: make(map[uint][]inferenceRecord),
+		names:   make(map[uint]string),
+		flushes: make(chan logFlush, 64),
+	}
+}
+
+// setRate sets the share of a deployment's predictions sampled; 0 stops it
+func (l *inferenceLogger) setRate(deploymentID uint, rate float64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if rate <= 0 {
+		delete(l.rates, deploymentID)
+		return
+	}
+	l.rates[deploymentID] = rate
+}
+
+// sample keeps a prediction when it falls in the deployment's share
+func (l *inferenceLogger) sample(deployment *ModelDeployment, request, response []byte, latency time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	rate, ok := l.rates[deployment.ID]
+	if !ok || (rate < 1 && rand.Float64() >= rate) {
+		return
+	}
+	if !json.Valid(request) || !json.Valid(response) {
+		return
+	}
+
+	record := inferenceRecord{
+		Time:      time.Now().UTC(),
+		LatencyMs: latency.Milliseconds(),
+		Request:   json.RawMessage(request),
+		Response:  json.RawMessage(response),
+	}
+	if deployment.variant != nil {
+		record.Variant = deployment.variant.name
+	}
+	l.buffers[deployment.ID] = append(l.buffers[deployment.ID], record)
+	l.names[deployment.ID] = deployment.Name
+	inferenceLogRecords.WithLabelValues(deployment.Name, "sampled").Inc()
+
+	if len(l.buffers[deployment.ID]) >= getEnvInt("INFERENCE_LOG_BATCH_SIZE", 500) {
+		l.take(deployment.ID)
+	}
+}
+
+// take hands a deployment's buffer to the uploader; the mutex is held
+func (l *inferenceLogger) take(deploymentID uint) {
+	records := l.buffers[deploymentID]
+	if len(records) == 0 {
+		return
+	}
+	delete(l.buffers, deploymentID)
+	flush := logFlush{deploymentID: deploymentID, name: l.names[deploymentID], records: records}
+	select {
+	case l.flushes <- flush:
+	default:
+		inferenceLogRecords.WithLabelValues(flush.name, "dropped").Add(float64(len(records)))
+	}
+}
+
+// takeAll hands every buffer to the uploader
+func (l *inferenceLogger) takeAll() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for deploymentID := range l.buffers {
+		l.take(deploymentID)
+	}
+}
+
+// startInferenceLogger uploads sampled predictions and keeps the sample
+// rates in step with the drift monitors
+func (ds *ModelDeploymentService) startInferenceLogger() {
+	go func() {
+		for flush := range ds.inferenceLog.flushes {
+			ds.uploadInferenceLog(flush)
+		}
+	}()
+
+	interval := time.Duration(getEnvInt("INFERENCE_LOG_FLUSH_SECONDS", 60)) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ds.refreshSampleRates()
+		<-ticker.C
+		ds.inferenceLog.takeAll()
+	}
+}
+
+func (ds *ModelDeploymentService) refreshSampleRates() {
+	var monitors []DriftMonitor
+	if err := ds.db.Find(&monitors).Error; err != nil {
+		ds.logger.Warn("Failed to load drift monitors", zap.Error(err))
+		return
+	}
+	for _, monitor := range monitors {
+		rate := monitor.SampleRate
+		if !monitor.Enabled {
+			rate = 0
+		}
+		ds.inferenceLog.setRate(monitor.DeploymentID, rate)
+	}
+}
+
+// uploadInferenceLog stores a buffer in file-storage-service as JSONL
+func (ds *ModelDeploymentService) uploadInferenceLog(flush logFlush) {
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	for i := range flush.records {
+		encoder.Encode(&flush.records[i])
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("folder", inferenceLogFolder+"/"+flush.name)
+	form.WriteField("user_id", "model-deployment-service")
+	form.WriteField("tags", "inference-log,"+flush.name)
+	form.WriteField("meta_deployment_id", strconv.FormatUint(uint64(flush.deploymentID), 10))
+	filename := fmt.Sprintf("%s-%d.jsonl", flush.name, time.Now().UnixNano())
+	part, _ := form.CreateFormFile("file", filename)
+	part.Write(data.Bytes())
+	form.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, fileStorageURL()+"/v1/files/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	fileID, err := func() (string, error) {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+			return "", fmt.Errorf("file-storage-service answered %d", resp.StatusCode)
+		}
+		var uploaded struct {
+			FileID string `json:"file_id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&uploaded); err != nil || uploaded.FileID == "" {
+			return "", fmt.Errorf("file-storage-service returned no file id")
+		}
+		return uploaded.FileID, nil
+	}()
+	if err != nil {
+		inferenceLogRecords.WithLabelValues(flush.name, "dropped").Add(float64(len(flush.records)))
+		ds.logger.Warn("Failed to upload inference log", zap.String("deployment", flush.name), zap.Error(err))
+		return
+	}
+
+	batch := InferenceLogBatch{
+		DeploymentID: flush.deploymentID,
+		FileID:       fileID,
+		Records:      len(flush.records),
+		Bytes:        int64(data.Len()),
+		FirstAt:      flush.records[0].Time,
+		LastAt:       flush.records[len(flush.records)-1].Time,
+		CreatedAt:    time.Now(),
+	}
+	if err := ds.db.Create(&batch).Error; err != nil {
+		ds.logger.Warn("Failed to record inference log batch", zap.String("deployment", flush.name), zap.Error(err))
+		return
+	}
+	inferenceLogRecords.WithLabelValues(flush.name, "uploaded").Add(float64(len(flush.records)))
+}
+
+// readInferenceLog downloads the records of a batch
+func readInferenceLog(ctx context.Context, batch *InferenceLogBatch) ([]inferenceRecord, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/v1/files/%s/download", fileStorageURL(), batch.FileID), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("file-storage-service answered %d", resp.StatusCode)
+	}
+
+	records := make([]inferenceRecord, 0, batch.Records)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+	for scanner.Scan() {
+		var record inferenceRecord
+		if json.Unmarshal(scanner.Bytes(), &record) == nil {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// Uploaded inference log files of a deployment
+func (ds *ModelDeploymentService) listInferenceLogs(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	var batches []InferenceLogBatch
+	if err := ds.db.Where("deployment_id = ?", deployment.ID).Order("last_at DESC").Limit(limit).Find(&batches).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list inference logs"})
+		return
+	}
+	files := make([]gin.H, 0, len(batches))
+	for _, batch := range batches {
+		files = append(files, gin.H{
+			"batch":        batch,
+			"uri":          fileStorageURIScheme + batch.FileID,
+			"download_url": fmt.Sprintf("%s/v1/files/%s/download", fileStorageURL(), batch.FileID),
+		})
+	}
+	c.JSON(200, gin.H{"inference_logs": files})
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// KEDA autoscaling and scale-to-zero. With Autoscaler "keda" a deployment
+// is scaled by a KEDA ScaledObject instead of an HPA, on the same metrics,
+// read straight from Prometheus:
+//
+//	rps              - requests per second through this service, per pod
+//	queue_depth      - the pods' metric summed, or an external one, per pod
+//	gpu_utilization  - the pods' GPU utilization, averaged
+//	custom           - any pods or external metric, by name
+//	cpu, memory      - KEDA's resource triggers
+//
+// Without metrics it scales on rps, at KEDA_DEFAULT_RPS_TARGET per pod.
+//
+// ScaleToZero lets it go to no pods once its triggers have been idle for
+// ScaleToZeroIdleSeconds. A prediction arriving then is held while the
+// deployment is scaled to one pod, for up to ColdStartTimeoutSeconds, and
+// answered 503 with Retry-After if no pod is ready by then; held requests
+// are also exported as a trigger, so KEDA keeps the pod it gets. A Warmer
+// keeps Replicas pods up on a cron schedule, by default business hours,
+// so the first requests of the day don't wait.
+
+// Autoscalers
+const (
+	AutoscalerHPA  = "hpa"
+	AutoscalerKEDA = "keda"
+)
+
+const (
+	defaultScaleToZeroIdle  = 300 * time.Second
+	defaultColdStartTimeout = 120 * time.Second
+	coldStartPollInterval   = time.Second
+	coldStartReadyTTL       = 10 * time.Second
+)
+
+var scaledObjectResource = schema.GroupVersionResource{
+	Group:    "keda.sh",
+	Version:  "v1alpha1",
+	Resource: "scaledobjects",
+}
+
+// ColdStartWarmer keeps pods up on a schedule
+type ColdStartWarmer struct {
+	Replicas int    `json:"replicas"` // 0 removes the warmer
+	Timezone string `json:"timezone"` // IANA name; default UTC
+	Start    string `json:"start"`    // cron; default 0 8 * * 1-5
+	End      string `json:"end"`      // cron; default 0 18 * * 1-5
+}
+
+var (
+	coldStarts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_deployment_cold_starts_total",
+			Help: "Predictions that found a deployment scaled to zero, by outcome",
+		},
+		[]string{"deployment", "outcome"},
+	)
+	coldStartWaiting = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "model_inference_cold_start_waiting",
+			Help: "Predictions waiting for a deployment scaled to zero to start",
+		},
+		[]string{"deployment"},
+	)
+	coldStartDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "model_deployment_cold_start_seconds",
+			Help:    "Time predictions waited for a deployment to start from zero",
+			Buckets: []float64{1, 2.5, 5, 10, 20, 30, 60, 120, 300},
+		},
+		[]string{"deployment"},
+	)
+)
+
+// coldStartTracker remembers which deployments were recently seen ready
+// and which are being started, so requests don't each ask Kubernetes
+type coldStartTracker struct {
+	mu       sync.Mutex
+	ready    map[uint]time.Time
+	starting map[uint]bool
+}
+
+func newColdStartTracker() *coldStartTracker {
+	return &coldStartTracker{
+		ready:    make(map[uint]time.Time),
+		starting: make(map[uint]bool),
+	}
+}
+
+func (t *coldStartTracker) recentlyReady(id uint) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Since(t.ready[id]) < coldStartReadyTTL
+}
+
+func (t *coldStartTracker) markReady(id uint) {
+	t.mu.Lock()
+	t.ready[id] = time.Now()
+	t.mu.Unlock()
+}
+
+// startOnce is true for the first caller while a start is in progress
+func (t *coldStartTracker) startOnce(id uint) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.starting[id] {
+		return false
+	}
+	t.starting[id] = true
+	return true
+}
+
+func (t *coldStartTracker) started(id uint) {
+	t.mu.Lock()
+	delete(t.starting, id)
+	t.mu.Unlock()
+}
+
+func usesKEDA(deployment *ModelDeployment) bool {
+	return deployment.Autoscaler == AutoscalerKEDA
+}
+
+func scaleToZeroIdle(deployment *ModelDeployment) time.Duration {
+	if deployment.ScaleToZeroIdleSeconds > 0 {
+		return time.Duration(deployment.ScaleToZeroIdleSeconds) * time.Second
+	}
+	return defaultScaleToZeroIdle
+}
+
+func coldStartTimeout(deployment *ModelDeployment) time.Duration {
+	if deployment.ColdStartTimeoutSeconds > 0 {
+		return time.Duration(deployment.ColdStartTimeoutSeconds) * time.Second
+	}
+	return defaultColdStartTimeout
+}
+
+// validateScaler checks a deployment's autoscaler settings and fills in
+// the warmer's defaults
+func (ds *ModelDeploymentService) validateScaler(deployment *ModelDeployment) error {
+	switch deployment.Autoscaler {
+	case "", AutoscalerHPA:
+	case AutoscalerKEDA:
+		if ds.keda == nil {
+			return fmt.Errorf("KEDA autoscaling is not enabled")
+		}
+	default:
+		return fmt.Errorf("unknown autoscaler %q, expected %s or %s", deployment.Autoscaler, AutoscalerHPA, AutoscalerKEDA)
+	}
+	if deployment.ScaleToZeroIdleSeconds < 0 || deployment.ScaleToZeroIdleSeconds > 86400 {
+		return fmt.Errorf("scale_to_zero_idle_seconds must be between 0 and 86400")
+	}
+	if deployment.ColdStartTimeoutSeconds < 0 || deployment.ColdStartTimeoutSeconds > 900 {
+		return fmt.Errorf("cold_start_timeout_seconds must be between 0 and 900")
+	}
+	if deployment.ScaleToZero && !usesKEDA(deployment) {
+		return fmt.Errorf("scale_to_zero needs the %s autoscaler", AutoscalerKEDA)
+	}
+
+	warmer := deployment.Warmer
+	if warmer == nil {
+		return nil
+	}
+	if !usesKEDA(deployment) {
+		return fmt.Errorf("a warmer needs the %s autoscaler", AutoscalerKEDA)
+	}
+	if warmer.Replicas < 1 || warmer.Replicas > deployment.MaxReplicas {
+		return fmt.Errorf("warmer replicas must be between 1 and max_replicas")
+	}
+	if warmer.Timezone == "" {
+		warmer.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(warmer.Timezone); err != nil {
+		return fmt.Errorf("invalid warmer timezone %q", warmer.Timezone)
+	}
+	if warmer.Start == "" {
+		warmer.Start = getEnv("KEDA_WARMER_START", "0 8 * * 1-5")
+	}
+	if warmer.End == "" {
+		warmer.End = getEnv("KEDA_WARMER_END", "0 18 * * 1-5")
+	}
+	for _, schedule := range []string{warmer.Start, warmer.End} {
+		if len(strings.Fields(schedule)) != 5 {
+			return fmt.Errorf("invalid warmer schedule %q, expected five cron fields", schedule)
+		}
+	}
+	return nil
+}
+
+// podsSelector matches the deployment's pods, and not those of deployments
+// whose names it prefixes
+func podsSelector(deployment *ModelDeployment) string {
+	return fmt.Sprintf(`namespace=%q,pod=~"%s-[a-z0-9]+-[a-z0-9]+"`, namespaceOf(deployment), deployment.Name)
+}
+
+// promSelector renders an external metric's labels
+func promSelector(selector map[string]string) string {
+	keys := make([]string, 0, len(selector))
+	for key := range selector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	matchers := make([]string, 0, len(keys))
+	for _, key := range keys {
+		matchers = append(matchers, fmt.Sprintf("%s=%q", key, selector[key]))
+	}
+	return strings.Join(matchers, ",")
+}
+
+func prometheusTrigger(name, query, threshold string) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "prometheus",
+		"name": name,
+		"metadata": map[string]interface{}{
+			"serverAddress":       getEnv("PROMETHEUS_URL", "http://prometheus.monitoring:9090"),
+			"query":               query,
+			"threshold":           threshold,
+			"activationThreshold": "0",
+		},
+	}
+}
+
+// scaleTrigger is the KEDA form of a metric
+func scaleTrigger(deployment *ModelDeployment, metric *AutoscalingMetric) map[string]interface{} {
+	name := strings.ReplaceAll(metric.Type+"-"+metric.MetricName, "_", "-")
+	switch {
+	case metric.Source == ScaleSourceResource:
+		return map[string]interface{}{
+			"type":       metric.Type,
+			"name":       metric.Type,
+			"metricType": "Utilization",
+			"metadata":   map[string]interface{}{"value": metric.Target},
+		}
+	case metric.Type == ScaleMetricRPS:
+		query := fmt.Sprintf(`sum(rate(model_inference_requests_total{deployment=%q}[%s])) or vector(0)`,
+			deployment.Name, getEnv("KEDA_RPS_WINDOW", "1m"))
+		return prometheusTrigger("rps", query, metric.Target)
+	case metric.Source == ScaleSourceExternal:
+		query := fmt.Sprintf(`sum(%s{%s}) or vector(0)`, metric.MetricName, promSelector(metric.Selector))
+		return prometheusTrigger(name, query, metric.Target)
+	}
+	query := fmt.Sprintf(`sum(%s{%s}) or vector(0)`, metric.MetricName, podsSelector(deployment))
+	return prometheusTrigger(name, query, metric.Target)
+}
+
+// buildScaledObject describes a deployment's ScaledObject; without metrics
+// it scales on requests per second
+func buildScaledObject(deployment *ModelDeployment, metrics []AutoscalingMetric) *unstructured.Unstructured {
+	if len(metrics) == 0 {
+		metrics = []AutoscalingMetric{{Type: ScaleMetricRPS, Source: ScaleSourcePods, Target: getEnv("KEDA_DEFAULT_RPS_TARGET", "10")}}
+	}
+	triggers := make([]interface{}, 0, len(metrics)+2)
+	for i := range metrics {
+		triggers = append(triggers, scaleTrigger(deployment, &metrics[i]))
+	}
+
+	minReplicas := int64(deployment.MinReplicas)
+	if deployment.ScaleToZero {
+		minReplicas = 0
+		query := fmt.Sprintf(`sum(model_inference_cold_start_waiting{deployment=%q}) or vector(0)`, deployment.Name)
+		triggers = append(triggers, prometheusTrigger("cold-start", query, "1"))
+	}
+	if warmer := deployment.Warmer; warmer != nil {
+		triggers = append(triggers, map[string]interface{}{
+			"type": "cron",
+			"name": "warmer",
+			"metadata": map[string]interface{}{
+				"timezone":        warmer.Timezone,
+				"start":           warmer.Start,
+				"end":             warmer.End,
+				"desiredReplicas": strconv.Itoa(warmer.Replicas),
+			},
+		})
+	}
+
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": scaledObjectResource.Group + "/" + scaledObjectResource.Version,
+		"kind":       "ScaledObject",
+		"metadata": map[string]interface{}{
+			"name":      deployment.Name,
+			"namespace": namespaceOf(deployment),
+			"labels": map[string]interface{}{
+				"app":        deployment.Name,
+				"managed-by": "002aic-platform",
+			},
+		},
+		"spec": map[string]interface{}{
+			"scaleTargetRef":  map[string]interface{}{"name": deployment.Name},
+			"pollingInterval": int64(getEnvInt("KEDA_POLLING_INTERVAL", 15)),
+			"cooldownPeriod":  int64(scaleToZeroIdle(deployment).Seconds()),
+			"minReplicaCount": minReplicas,
+			"maxReplicaCount": int64(deployment.MaxReplicas),
+			"advanced": map[string]interface{}{
+				"horizontalPodAutoscalerConfig": map[string]interface{}{
+					"behavior": map[string]interface{}{
+						"scaleUp":   map[string]interface{}{"stabilizationWindowSeconds": int64(deployment.ScaleUpStabilizationSeconds)},
+						"scaleDown": map[string]interface{}{"stabilizationWindowSeconds": int64(deployment.ScaleDownStabilizationSeconds)},
+					},
+				},
+			},
+			"triggers": triggers,
+		},
+	}}
+}
+
+// applyScaledObject creates, updates or removes the deployment's
+// ScaledObject
+func (ds *ModelDeploymentService) applyScaledObject(ctx context.Context, deployment *ModelDeployment, metrics []AutoscalingMetric) error {
+	if ds.keda == nil {
+		return nil
+	}
+	client := ds.keda.Resource(scaledObjectResource).Namespace(namespaceOf(deployment))
+	if !deployment.AutoScaling || !usesKEDA(deployment) {
+		err := client.Delete(ctx, deployment.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete ScaledObject: %w", err)
+		}
+		return nil
+	}
+
+	desired := buildScaledObject(deployment, metrics)
+	existing, err := client.Get(ctx, deployment.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if _, err := client.Create(ctx, desired, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create ScaledObject: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get ScaledObject: %w", err)
+	}
+	desired.SetResourceVersion(existing.GetResourceVersion())
+	if _, err := client.Update(ctx, desired, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update ScaledObject: %w", err)
+	}
+	return nil
+}
+
+// applyAutoscaler puts the deployment under the autoscaler it asks for and
+// removes the other, since an HPA and KEDA's would fight over replicas
+func (ds *ModelDeploymentService) applyAutoscaler(ctx context.Context, deployment *ModelDeployment, metrics []AutoscalingMetric) error {
+	if usesKEDA(deployment) {
+		withoutHPA := *deployment
+		withoutHPA.AutoScaling = false
+		if err := ds.applyHPA(ctx, &withoutHPA, nil); err != nil {
+			return err
+		}
+		return ds.applyScaledObject(ctx, deployment, metrics)
+	}
+	if err := ds.applyScaledObject(ctx, deployment, nil); err != nil {
+		return err
+	}
+	return ds.applyHPA(ctx, deployment, metrics)
+}
+
+// checkKEDA checks that KEDA serves ScaledObjects
+func (ds *ModelDeploymentService) checkKEDA() metricCheck {
+	groupVersion := scaledObjectResource.Group + "/" + scaledObjectResource.Version
+	check := metricCheck{Metric: "keda:" + scaledObjectResource.Resource}
+	list, err := ds.servedMetrics(groupVersion)
+	switch {
+	case err != nil:
+		check.Message = err.Error()
+	case !list[scaledObjectResource.Resource]:
+		check.Message = groupVersion + " does not serve " + scaledObjectResource.Resource + "; install KEDA"
+	default:
+		check.OK = true
+		check.Message = "served by " + groupVersion
+	}
+	return check
+}
+
+// scaledObjectStatus is the status KEDA reports for the deployment
+func (ds *ModelDeploymentService) scaledObjectStatus(ctx context.Context, deployment *ModelDeployment) (interface{}, bool) {
+	if ds.keda == nil {
+		return nil, false
+	}
+	object, err := ds.keda.Resource(scaledObjectResource).Namespace(namespaceOf(deployment)).Get(ctx, deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, false
+	}
+	status, found := object.Object["status"]
+	return status, found
+}
+
+// readyReplicas is the number of the deployment's pods ready to serve
+func (ds *ModelDeploymentService) readyReplicas(ctx context.Context, deployment *ModelDeployment) (int, int, error) {
+	k8sDeployment, err := ds.k8sClient.AppsV1().Deployments(namespaceOf(deployment)).Get(ctx, deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(k8sDeployment.Status.ReadyReplicas), currentReplicas(k8sDeployment), nil
+}
+
+// awaitWarm holds a prediction to a deployment scaled to zero until one of
+// its pods is ready, starting one if none is. When none becomes ready in
+// time it answers the request itself and returns false.
+func (ds *ModelDeploymentService) awaitWarm(c *gin.Context, deployment *ModelDeployment) bool {
+	if !deployment.ScaleToZero || ds.coldStarts.recentlyReady(deployment.ID) {
+		return true
+	}
+	ctx := c.Request.Context()
+	ready, replicas, err := ds.readyReplicas(ctx, deployment)
+	if err != nil {
+		// Let the proxy try, and fail, as it would without scale-to-zero
+		ds.logger.Warn("Failed to get deployment replicas", zap.String("name", deployment.Name), zap.Error(err))
+		return true
+	}
+	if ready > 0 {
+		ds.coldStarts.markReady(deployment.ID)
+		return true
+	}
+
+	waiting := coldStartWaiting.WithLabelValues(deployment.Name)
+	waiting.Inc()
+	defer waiting.Dec()
+	start := time.Now()
+
+	if replicas == 0 && ds.coldStarts.startOnce(deployment.ID) {
+		err := ds.setReplicas(ctx, deployment, 1)
+		ds.coldStarts.started(deployment.ID)
+		if err != nil && !apierrors.IsConflict(err) {
+			ds.logger.Error("Failed to scale deployment from zero", zap.String("name", deployment.Name), zap.Error(err))
+		} else {
+			ds.logger.Info("Scaling deployment from zero", zap.String("name", deployment.Name))
+		}
+	}
+
+	timeout := coldStartTimeout(deployment)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(coldStartPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			coldStarts.WithLabelValues(deployment.Name, "cancelled").Inc()
+			return false
+		case <-deadline.C:
+			coldStarts.WithLabelValues(deployment.Name, "timeout").Inc()
+			retryAfter := int(timeout.Seconds() / 2)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.JSON(503, gin.H{
+				"error":               "Deployment is starting",
+				"deployment":          deployment.Name,
+				"retry_after_seconds": retryAfter,
+			})
+			return false
+		case <-ticker.C:
+			if ready, _, err := ds.readyReplicas(ctx, deployment); err == nil && ready > 0 {
+				ds.coldStarts.markReady(deployment.ID)
+				coldStarts.WithLabelValues(deployment.Name, "ready").Inc()
+				coldStartDuration.WithLabelValues(deployment.Name).Observe(time.Since(start).Seconds())
+				c.Header("X-Cold-Start", "true")
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Deployment logs. /v1/deployments/:id/logs reads the logs of every pod of
+// a deployment, its canary's included, and merges them line by line, each
+// line marked with its pod and container. Without follow the lines come
+// ordered by time and the response ends; with follow=true they're streamed
+// as they're written, over chunked transfer or, when the request is a
+// WebSocket upgrade, as one message per line, until the caller leaves.
+// format=ndjson gives each line as an object with the pod's labels.
+//
+// /logs/download packages the same logs into a zip, a file per container.
+//
+// Filters: pod, container (default every container), tail (lines per
+// container, default 500), since (a duration such as 15m), since_time
+// (RFC 3339) and previous (the containers' previous instance).
+
+const (
+	defaultLogTail = 500
+	maxLogTail     = 10000
+)
+
+var logRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "model_deployment_log_requests_total",
+		Help: "Requests for deployment logs, by mode",
+	},
+	[]string{"deployment", "mode"},
+)
+
+// logQuery is what logs were asked for
+type logQuery struct {
+	pod       string
+	container string
+	tail      int64
+	since     *metav1.Time
+	previous  bool
+	follow    bool
+	ndjson    bool
+	times     bool
+}
+
+// logLine is one line of a container's log
+type logLine struct {
+	Time      time.Time         `json:"time"`
+	Pod       string            `json:"pod"`
+	Container string            `json:"container"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Line      string            `json:"line"`
+}
+
+// logSource is one container of one pod
+type logSource struct {
+	pod       *corev1.Pod
+	container string
+}
+
+func parseLogQuery(c *gin.Context) (*logQuery, error) {
+	query := &logQuery{
+		pod:       c.Query("pod"),
+		container: c.Query("container"),
+		tail:      defaultLogTail,
+		previous:  c.Query("previous") == "true",
+		follow:    c.Query("follow") == "true",
+		ndjson:    c.Query("format") == "ndjson",
+		times:     c.Query("timestamps") == "true",
+	}
+	if tail := c.Query("tail"); tail != "" {
+		lines, err := strconv.ParseInt(tail, 10, 64)
+		if err != nil || lines < 0 || lines > maxLogTail {
+			return nil, fmt.Errorf("tail must be between 0 and %d", maxLogTail)
+		}
+		query.tail = lines
+	}
+	if since := c.Query("since"); since != "" {
+		duration, err := time.ParseDuration(since)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("since must be a duration such as 15m")
+		}
+		query.since = &metav1.Time{Time: time.Now().Add(-duration)}
+	}
+	if sinceTime := c.Query("since_time"); sinceTime != "" {
+		at, err := time.Parse(time.RFC3339, sinceTime)
+		if err != nil {
+			return nil, fmt.Errorf("since_time must be an RFC 3339 time")
+		}
+		query.since = &metav1.Time{Time: at}
+	}
+	if format := c.Query("format"); format != "" && format != "text" && format != "ndjson" {
+		return nil, fmt.Errorf("format must be text or ndjson")
+	}
+	return query, nil
+}
+
+// logSources lists the containers whose logs a query reads
+func (ds *ModelDeploymentService) logSources(ctx context.Context, deployment *ModelDeployment, query *logQuery) ([]logSource, error) {
+	var pods []corev1.Pod
+	for _, selector := range []string{"app=" + deployment.Name, "canary-of=" + deployment.Name} {
+		list, err := ds.k8sClient.CoreV1().Pods(namespaceOf(deployment)).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, list.Items...)
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+
+	var sources []logSource
+	for i := range pods {
+		pod := &pods[i]
+		if query.pod != "" && pod.Name != query.pod {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			if query.container != "" && container.Name != query.container {
+				continue
+			}
+			sources = append(sources, logSource{pod: pod, container: container.Name})
+		}
+	}
+	return sources, nil
+}
+
+// openLog opens the log of one container; lines start with their timestamp
+func (ds *ModelDeploymentService) openLog(ctx context.Context, source logSource, query *logQuery, follow bool) (io.ReadCloser, error) {
+	options := &corev1.PodLogOptions{
+		Container:  source.container,
+		Follow:     follow,
+		Previous:   query.previous,
+		Timestamps: true,
+		SinceTime:  query.since,
+		TailLines:  &query.tail,
+	}
+	limit := int64(getEnvInt("LOG_MAX_BYTES_PER_CONTAINER", 10<<20))
+	if !follow {
+		options.LimitBytes = &limit
+	}
+	return ds.k8sClient.CoreV1().Pods(source.pod.Namespace).GetLogs(source.pod.Name, options).Stream(ctx)
+}
+
+// readLog sends a container's log lines until it ends or ctx is done
+func readLog(ctx context.Context, body io.Reader, source logSource, lines chan<- logLine) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := logLine{Pod: source.pod.Name, Container: source.container, Labels: source.pod.Labels, Line: scanner.Text()}
+		if stamp, text, ok := strings.Cut(line.Line, " "); ok {
+			if at, err := time.Parse(time.RFC3339Nano, stamp); err == nil {
+				line.Time, line.Line = at, text
+			}
+		}
+		select {
+		case lines <- line:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// format renders a line for a text or ndjson response
+func (query *logQuery) format(line *logLine) []byte {
+	if query.ndjson {
+		encoded, _ := json.Marshal(line)
+		return append(encoded, '\n')
+	}
+	prefix := fmt.Sprintf("[%s %s] ", line.Pod, line.Container)
+	if query.times && !line.Time.IsZero() {
+		prefix = line.Time.Format(time.RFC3339Nano) + " " + prefix
+	}
+	return []byte(prefix + line.Line + "\n")
+}
+
+// Logs of a deployment's pods, merged
+func (ds *ModelDeploymentService) getDeploymentLogs(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	query, err := parseLogQuery(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		query.follow = true
+	}
+
+	sources, err := ds.logSources(c.Request.Context(), &deployment, query)
+	if err != nil {
+		ds.logger.Error("Failed to list pods for logs", zap.String("deployment", deployment.Name), zap.Error(err))
+		c.JSON(500, gin.H{"error": "Failed to list pods"})
+		return
+	}
+	if len(sources) == 0 {
+		c.JSON(404, gin.H{"error": "No pods match", "deployment": deployment.Name})
+		return
+	}
+
+	if !query.follow {
+		logRequests.WithLabelValues(deployment.Name, "tail").Inc()
+		ds.writeLogs(c, &deployment, sources, query)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	lines := make(chan logLine, 256)
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		body, err := ds.openLog(ctx, source, query, true)
+		if err != nil {
+			ds.logger.Warn("Failed to open pod log",
+				zap.String("pod", source.pod.Name),
+				zap.String("container", source.container),
+				zap.Error(err))
+			continue
+		}
+		wg.Add(1)
+		go func(source logSource, body io.ReadCloser) {
+			defer wg.Done()
+			defer body.Close()
+			readLog(ctx, body, source, lines)
+		}(source, body)
+	}
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		logRequests.WithLabelValues(deployment.Name, "websocket").Inc()
+		ds.followLogsWebSocket(c, ctx, cancel, lines)
+		return
+	}
+
+	logRequests.WithLabelValues(deployment.Name, "follow").Inc()
+	if query.ndjson {
+		c.Header("Content-Type", "application/x-ndjson")
+	} else {
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(200)
+	flusher, _ := c.Writer.(http.Flusher)
+	for line := range lines {
+		if _, err := c.Writer.Write(query.format(&line)); err != nil {
+			return
+		}
+		// Flush once the lines on hand are written
+		if len(lines) == 0 && flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// followLogsWebSocket sends each log line as a JSON message; the caller
+// closing the socket ends the stream
+func (ds *ModelDeploymentService) followLogsWebSocket(c *gin.Context, ctx context.Context, cancel context.CancelFunc, lines <-chan logLine) {
+	conn, err := streamUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return // the upgrader has answered the caller
+	}
+	defer conn.Close()
+
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, "logs ended"), time.Now().Add(time.Second))
+				return
+			}
+			message, _ := json.Marshal(&line)
+			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// writeLogs reads every container's log to its end and writes the lines
+// ordered by time
+func (ds *ModelDeploymentService) writeLogs(c *gin.Context, deployment *ModelDeployment, sources []logSource, query *logQuery) {
+	ctx := c.Request.Context()
+	var merged []logLine
+	for _, source := range sources {
+		body, err := ds.openLog(ctx, source, query, false)
+		if err != nil {
+			ds.logger.Warn("Failed to read pod log",
+				zap.String("deployment", deployment.Name),
+				zap.String("pod", source.pod.Name),
+				zap.String("container", source.container),
+				zap.Error(err))
+			continue
+		}
+		lines := make(chan logLine)
+		go func() {
+			defer close(lines)
+			readLog(ctx, body, source, lines)
+		}()
+		for line := range lines {
+			merged = append(merged, line)
+		}
+		body.Close()
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Time.Before(merged[j].Time) })
+
+	contentType := "text/plain; charset=utf-8"
+	if query.ndjson {
+		contentType = "application/x-ndjson"
+	}
+	c.Header("Content-Type", contentType)
+	c.Status(200)
+	for i := range merged {
+		if _, err := c.Writer.Write(query.format(&merged[i])); err != nil {
+			return
+		}
+	}
+}
+
+// Logs of a deployment's pods as a zip, a file per container
+func (ds *ModelDeploymentService) downloadDeploymentLogs(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	query, err := parseLogQuery(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	sources, err := ds.logSources(c.Request.Context(), &deployment, query)
+	if err != nil {
+		ds.logger.Error("Failed to list pods for logs", zap.String("deployment", deployment.Name), zap.Error(err))
+		c.JSON(500, gin.H{"error": "Failed to list pods"})
+		return
+	}
+	if len(sources) == 0 {
+		c.JSON(404, gin.H{"error": "No pods match", "deployment": deployment.Name})
+		return
+	}
+	logRequests.WithLabelValues(deployment.Name, "download").Inc()
+
+	now := time.Now().UTC()
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s-logs-%s.zip", deployment.Name, now.Format("20060102T150405Z"))))
+	c.Status(200)
+
+	archive := zip.NewWriter(c.Writer)
+	defer archive.Close()
+	for _, source := range sources {
+		body, err := ds.openLog(c.Request.Context(), source, query, false)
+		if err != nil {
+			ds.logger.Warn("Failed to read pod log",
+				zap.String("deployment", deployment.Name),
+				zap.String("pod", source.pod.Name),
+				zap.String("container", source.container),
+				zap.Error(err))
+			continue
+		}
+		name := fmt.Sprintf("%s/%s.log", source.pod.Name, source.container)
+		if query.previous {
+			name = fmt.Sprintf("%s/%s.previous.log", source.pod.Name, source.container)
+		}
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+		if err == nil {
+			_, err = io.Copy(file, body)
+		}
+		body.Close()
+		if err != nil {
+			return
+		}
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -21,6 +20,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -33,11 +33,29 @@ type ModelDeployment struct {
 	ModelVersion    string    `json:"model_version" gorm:"not null"`
 	Framework       string    `json:"framework" gorm:"not null"`
 	Status          string    `json:"status" gorm:"default:'pending'"`
+	StatusReason    string    `json:"status_reason"` // why, when the reconciler set the status
+	StatusChangedAt *time.Time `json:"status_changed_at"`
 	Environment     string    `json:"environment" gorm:"default:'production'"`
+	Namespace       string    `json:"namespace" gorm:"index"` // from the environment and team's mapping; "" is model-serving
 	Replicas        int       `json:"replicas" gorm:"default:1"`
 	CPU             string    `json:"cpu" gorm:"default:'500m'"`
 	Memory          string    `json:"memory" gorm:"default:'1Gi'"`
 	GPU             int       `json:"gpu" gorm:"default:0"`
+	GPUType         string    `json:"gpu_type"` // e.g. nvidia-tesla-t4; schedules onto that GPU and prices it
+	GPUSharing      string    `json:"gpu_sharing"` // "", mig or time-slicing
+	GPUMIGProfile   string    `json:"gpu_mig_profile"` // e.g. 1g.10gb, with MIG sharing
+	GPUFraction     float64   `json:"gpu_fraction"` // share of a GPU needed, with time-slicing
+	NodeSelector    map[string]string `json:"node_selector" gorm:"type:jsonb;serializer:json"`
+	Tolerations     []DeploymentToleration `json:"tolerations" gorm:"type:jsonb;serializer:json"`
+	ModelSource     string    `json:"model_source"` // "", registry or uri; where the model artifact comes from
+	ArtifactURI     string    `json:"artifact_uri"`
+	ArtifactSHA256  string    `json:"artifact_sha256"`
+	ArtifactSignature string  `json:"artifact_signature,omitempty"`
+	ArtifactSizeBytes int64   `json:"artifact_size_bytes"`
+	ArtifactRegistry  string  `json:"artifact_registry"` // internal or mlflow, when resolved from a registry
+	Team            string    `json:"team" gorm:"index"`
+	Project         string    `json:"project" gorm:"index"`
+	CostLabels      map[string]string `json:"cost_labels" gorm:"type:jsonb;serializer:json"` // showback labels, e.g. cost-center
 	EndpointURL     string    `json:"endpoint_url"`
 	HealthCheckURL  string    `json:"health_check_url"`
 	MetricsURL      string    `json:"metrics_url"`
@@ -46,11 +64,31 @@ type ModelDeployment struct {
 	MaxReplicas     int       `json:"max_replicas" gorm:"default:10"`
 	TargetCPU       int       `json:"target_cpu" gorm:"default:70"`
 	TargetMemory    int       `json:"target_memory" gorm:"default:80"`
+	ScaleUpStabilizationSeconds   int `json:"scale_up_stabilization_seconds" gorm:"default:0"`
+	ScaleDownStabilizationSeconds int `json:"scale_down_stabilization_seconds" gorm:"default:300"`
+	Autoscaler      string    `json:"autoscaler"` // "" or hpa, or keda
+	ScaleToZero     bool      `json:"scale_to_zero"` // with keda: no pods while idle
+	ScaleToZeroIdleSeconds  int `json:"scale_to_zero_idle_seconds" gorm:"default:300"` // idle time before scaling to zero
+	ColdStartTimeoutSeconds int `json:"cold_start_timeout_seconds" gorm:"default:120"` // how long predictions wait for a pod from zero
+	Warmer          *ColdStartWarmer `json:"warmer,omitempty" gorm:"type:jsonb;serializer:json"` // keeps pods up on a schedule, with keda
+	PreStopDelaySeconds int   `json:"pre_stop_delay_seconds" gorm:"default:5"` // pods keep serving this long after termination starts
+	DrainTimeoutSeconds int   `json:"drain_timeout_seconds" gorm:"default:30"` // time allowed for in-flight requests to finish
+	InferencePath   string    `json:"inference_path"` // model server predict path; empty: the framework's default
+	StreamPath      string    `json:"stream_path"` // model server streaming path; empty: InferencePath
+	StreamProtocol  string    `json:"stream_protocol"` // "" or sse, or websocket; how the model server streams
+	InferenceTimeoutSeconds int `json:"inference_timeout_seconds" gorm:"default:30"`
+	InferenceMaxRetries int   `json:"inference_max_retries" gorm:"default:2"`
 	Config          string    `json:"config" gorm:"type:jsonb"`
+	Revision        int       `json:"revision"` // current DeploymentRevision
+	DriftStatus     string    `json:"drift_status"` // "", ok or drifting, with a drift monitor
+	DriftCheckedAt  *time.Time `json:"drift_checked_at"`
 	CreatedAt       time.Time `json:"created_at"`
 	UpdatedAt       time.Time `json:"updated_at"`
 	DeployedAt      *time.Time `json:"deployed_at"`
 	CreatedBy       string    `json:"created_by"`
+
+	variant    *servingVariant       // set on predictions routed while a canary runs
+	experiment *experimentAssignment // set on predictions of users in an A/B test
 }
 
 // DeploymentMetrics represents deployment performance metrics
@@ -72,9 +110,23 @@ type DeploymentMetrics struct {
 
 // ModelDeploymentService handles model deployment operations
 type ModelDeploymentService struct {
-	db        *gorm.DB
-	k8sClient *kubernetes.Clientset
-	logger    *zap.Logger
+	db          *gorm.DB
+	k8sClient   *kubernetes.Clientset
+	logger      *zap.Logger
+	drains      *drainTracker
+	inference   *inferenceStats
+	grpcConns   *grpcConns
+	canaries    *canaryRouter
+	experiments *experimentRouter
+	coldStarts  *coldStartTracker
+	streams     *streamRegistry
+	inferenceLog *inferenceLogger
+	reconciler  *statusReconciler
+	captures    *captureRecorder
+	namespaces  *namespaceCache
+	grants      *grantCache
+	istio       dynamic.Interface // nil unless ISTIO_ENABLED
+	keda        dynamic.Interface // nil unless KEDA_ENABLED
 }
 
 // Metrics
@@ -128,14 +180,69 @@ func main() {
 
 	// Initialize service
 	deploymentService := &ModelDeploymentService{
-		db:        db,
-		k8sClient: k8sClient,
-		logger:    logger,
+		db:          db,
+		k8sClient:   k8sClient,
+		logger:      logger,
+		drains:      newDrainTracker(),
+		inference:   newInferenceStats(),
+		grpcConns:   newGRPCConns(),
+		canaries:    newCanaryRouter(),
+		experiments: newExperimentRouter(),
+		coldStarts:  newColdStartTracker(),
+		streams:     newStreamRegistry(),
+		inferenceLog: newInferenceLogger(),
+		reconciler:  newStatusReconciler(),
+		captures:    newCaptureRecorder(),
+		namespaces:  newNamespaceCache(),
+		grants:      newGrantCache(),
+	}
+
+	// Canary traffic is also split in the mesh when Istio runs
+	if getEnv("ISTIO_ENABLED", "false") == "true" {
+		istio, err := initDynamicClient()
+		if err != nil {
+			logger.Fatal("Failed to initialize Istio client", zap.Error(err))
+		}
+		deploymentService.istio = istio
+	}
+
+	// Deployments may scale with KEDA, and to zero, when it is installed
+	if getEnv("KEDA_ENABLED", "false") == "true" {
+		keda, err := initDynamicClient()
+		if err != nil {
+			logger.Fatal("Failed to initialize KEDA client", zap.Error(err))
+		}
+		deploymentService.keda = keda
 	}
 
 	// Start metrics collection routine
 	go deploymentService.startMetricsCollection()
 
+	// Drain pods that terminate outside an API scale-down
+	go deploymentService.startPodTerminationWatcher()
+
+	// Record what deployments cost
+	go deploymentService.startCostTracking()
+
+	// Follow the Kubernetes Jobs of batch predictions
+	go deploymentService.startBatchJobSync()
+
+	// Compare canaries with stable and promote or roll them back
+	go deploymentService.startCanaryController()
+
+	// Route A/B test users and write out what their variants served
+	go deploymentService.startExperimentTracking()
+
+	// Sample predictions to storage and check them for drift
+	go deploymentService.startInferenceLogger()
+	go deploymentService.startDriftMonitor()
+
+	// Keep the traffic of deployments with capture on, redacted
+	go deploymentService.startTrafficCapture()
+
+	// Keep statuses in step with what Kubernetes runs
+	go deploymentService.startStatusReconciler()
+
 	// Initialize Gin router
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
@@ -168,7 +275,7 @@ func main() {
 	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
 	// Model deployment API routes
-	v1 := router.Group("/v1/deployments")
+	v1 := router.Group("/v1/deployments", deploymentService.namespaceAccess())
 	{
 		// Deployment management
 		v1.GET("/", deploymentService.listDeployments)
@@ -179,28 +286,93 @@ func main() {
 		
 		// Deployment operations
 		v1.POST("/:id/scale", deploymentService.scaleDeployment)
+		v1.GET("/:id/drains", deploymentService.listPodDrains)
+		v1.GET("/:id/autoscaling", deploymentService.getAutoscaling)
+		v1.PUT("/:id/autoscaling", deploymentService.updateAutoscaling)
+		v1.POST("/:id/autoscaling/validate", deploymentService.validateAutoscaling)
 		v1.POST("/:id/restart", deploymentService.restartDeployment)
 		v1.POST("/:id/rollback", deploymentService.rollbackDeployment)
+		v1.GET("/:id/revisions", deploymentService.listRevisions)
+		v1.GET("/:id/revisions/:revision", deploymentService.getRevision)
 		v1.GET("/:id/status", deploymentService.getDeploymentStatus)
+		v1.GET("/:id/status/history", deploymentService.listStatusTransitions)
 		v1.GET("/:id/logs", deploymentService.getDeploymentLogs)
+		v1.GET("/:id/logs/download", deploymentService.downloadDeploymentLogs)
 		
 		// Model serving
 		v1.POST("/:id/predict", deploymentService.predict)
 		v1.POST("/:id/batch-predict", deploymentService.batchPredict)
+		v1.GET("/:id/batch-jobs", deploymentService.listBatchJobs)
+		v1.GET("/:id/batch-jobs/:job_id", deploymentService.getBatchJob)
+		v1.POST("/:id/batch-jobs/:job_id/cancel", deploymentService.cancelBatchJob)
+		v1.GET("/:id/batch-jobs/:job_id/results", deploymentService.getBatchJobResults)
+		v1.POST("/:id/grpc/:service/:method", deploymentService.predictGRPC)
+		v1.POST("/:id/stream", deploymentService.streamPredict)
+		v1.GET("/:id/stream", deploymentService.streamPredict)
+		v1.GET("/:id/streams", deploymentService.listStreams)
+		v1.POST("/:id/streams/:stream_id/cancel", deploymentService.cancelStream)
 		
 		// Metrics and monitoring
 		v1.GET("/:id/metrics", deploymentService.getDeploymentMetrics)
 		v1.GET("/:id/health", deploymentService.checkDeploymentHealth)
+		v1.GET("/:id/inference-logs", deploymentService.listInferenceLogs)
+
+		// Traffic capture
+		v1.PUT("/:id/capture", deploymentService.setCaptureConfig)
+		v1.GET("/:id/capture", deploymentService.getCaptureConfig)
+		v1.GET("/:id/captures", deploymentService.listCaptures)
+		v1.GET("/:id/captures/:capture_id", deploymentService.getCapture)
+
+		// Drift detection
+		v1.GET("/:id/drift", deploymentService.getDrift)
+		v1.PUT("/:id/drift/monitor", deploymentService.setDriftMonitor)
+		v1.PUT("/:id/drift/baseline", deploymentService.setDriftBaseline)
+		v1.GET("/:id/drift/baseline", deploymentService.getDriftBaseline)
+		v1.POST("/:id/drift/check", deploymentService.runDriftCheck)
+		v1.GET("/:id/drift/reports", deploymentService.listDriftReports)
 		
 		// A/B testing
 		v1.POST("/:id/ab-test", deploymentService.createABTest)
 		v1.GET("/:id/ab-test", deploymentService.getABTestResults)
+		v1.GET("/:id/ab-test/history", deploymentService.listABTests)
+		v1.GET("/:id/ab-test/report", deploymentService.getABTestReport)
+		v1.GET("/:id/ab-test/assignment", deploymentService.getABTestAssignment)
+		v1.POST("/:id/ab-test/events", deploymentService.recordABTestEvents)
+		v1.POST("/:id/ab-test/stop", deploymentService.stopABTest)
 		
 		// Canary deployments
 		v1.POST("/:id/canary", deploymentService.createCanaryDeployment)
+		v1.GET("/:id/canary", deploymentService.getCanaryDeployment)
+		v1.GET("/:id/canary/history", deploymentService.listCanaryDeployments)
 		v1.POST("/:id/canary/promote", deploymentService.promoteCanaryDeployment)
+		v1.POST("/:id/canary/rollback", deploymentService.rollbackCanaryDeployment)
+		v1.POST("/:id/canary/feedback", deploymentService.canaryFeedback)
+
+		// Cost
+		v1.GET("/:id/cost", deploymentService.getDeploymentCost)
+		v1.PUT("/:id/cost/allocation", deploymentService.setCostAllocation)
 	}
 
+	// Cost reporting
+	costs := router.Group("/v1/costs", deploymentService.namespaceAccess())
+	{
+		costs.GET("/report", deploymentService.getCostReport)
+		costs.GET("/idle", deploymentService.listIdleDeployments)
+		costs.GET("/prices", deploymentService.listResourcePrices)
+		costs.PUT("/prices", deploymentService.namespaceAdmin(), deploymentService.setResourcePrice)
+	}
+
+	// Namespace mapping
+	namespaces := router.Group("/v1/namespaces", deploymentService.namespaceAccess(), deploymentService.namespaceAdmin())
+	{
+		namespaces.GET("/mappings", deploymentService.listNamespaceMappings)
+		namespaces.PUT("/mappings", deploymentService.setNamespaceMapping)
+		namespaces.DELETE("/mappings/:mapping_id", deploymentService.deleteNamespaceMapping)
+	}
+
+	// Batch prediction workers report their shards here
+	router.POST("/internal/batch-jobs/:job_id/shards", deploymentService.reportBatchShard)
+
 	// Start server
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -227,7 +399,7 @@ func initDatabase() (*gorm.DB, error) {
 	}
 
 	// Auto-migrate the schema
-	err = db.AutoMigrate(&ModelDeployment{}, &DeploymentMetrics{})
+	err = db.AutoMigrate(&ModelDeployment{}, &DeploymentMetrics{}, &PodDrain{}, &ResourcePrice{}, &DeploymentCostSample{}, &BatchPredictionJob{}, &BatchPredictionShard{}, &CanaryRelease{}, &CanaryObservation{}, &AutoscalingMetric{}, &ABExperiment{}, &ExperimentAssignment{}, &ExperimentUserMetric{}, &ExperimentOutcome{}, &DeploymentRevision{}, &InferenceLogBatch{}, &DriftBaseline{}, &DriftMonitor{}, &DriftReport{}, &DeploymentStatusTransition{}, &CaptureConfig{}, &CapturedInference{}, &NamespaceMapping{})
 	if err != nil {
 		return nil, err
 	}
@@ -255,7 +427,7 @@ func (ds *ModelDeploymentService) listDeployments(c *gin.Context) {
 	status := c.Query("status")
 	
 	var deployments []ModelDeployment
-	query := ds.db
+	query := scopeToGrant(c, ds.db)
 	
 	if framework != "" {
 		query = query.Where("framework = ?", framework)
@@ -282,11 +454,39 @@ func (ds *ModelDeploymentService) createDeployment(c *gin.Context) {
 		return
 	}
 	
+	if err := validateScheduling(&deployment); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := ds.validateScaler(&deployment); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if protocol := deployment.StreamProtocol; protocol != "" && protocol != StreamProtocolSSE && protocol != StreamProtocolWebSocket {
+		c.JSON(400, gin.H{"error": "stream_protocol must be sse or websocket"})
+		return
+	}
+	if err := resolveDeploymentArtifact(c.Request.Context(), &deployment); err != nil {
+		ds.respondArtifactError(c, &deployment, err)
+		return
+	}
+
+	namespace, _, err := ds.resolveNamespace(&deployment)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to resolve namespace", "details": err.Error()})
+		return
+	}
+	if !namespaceAllowed(c, namespace) {
+		return
+	}
+	deployment.Namespace = namespace
+
 	start := time.Now()
 	
 	deployment.CreatedAt = time.Now()
 	deployment.UpdatedAt = time.Now()
 	deployment.Status = "deploying"
+	deployment.Revision = 0
 	
 	// Save deployment to database
 	if err := ds.db.Create(&deployment).Error; err != nil {
@@ -296,7 +496,7 @@ func (ds *ModelDeploymentService) createDeployment(c *gin.Context) {
 	}
 	
 	// Deploy to Kubernetes
-	err := ds.deployModelToKubernetes(&deployment)
+	err = ds.deployModelToKubernetes(&deployment)
 	if err != nil {
 		deployment.Status = "failed"
 		ds.db.Save(&deployment)
@@ -315,6 +515,11 @@ func (ds *ModelDeploymentService) createDeployment(c *gin.Context) {
 	deployment.MetricsURL = fmt.Sprintf("https://api.002aic.com/v1/models/%s/metrics", deployment.Name)
 	ds.db.Save(&deployment)
 	
+	// The deployment's first revision
+	if _, err := ds.recordRevision(&deployment, RevisionSourceCreate, "created", c.GetHeader("X-User-ID"), 0); err != nil {
+		ds.logger.Warn("Failed to record revision", zap.String("name", deployment.Name), zap.Error(err))
+	}
+	
 	// Update metrics
 	activeDeployments.WithLabelValues(deployment.Framework, deployment.Environment).Inc()
 	deploymentRequests.WithLabelValues(deployment.Framework, "success").Inc()
@@ -329,28 +534,28 @@ func (ds *ModelDeploymentService) createDeployment(c *gin.Context) {
 	c.JSON(201, deployment)
 }
 
-func (ds *ModelDeploymentService) deployModelToKubernetes(deployment *ModelDeployment) error {
-	namespace := "model-serving"
-	
-	// Parse configuration
-	var config map[string]interface{}
-	if deployment.Config != "" {
-		json.Unmarshal([]byte(deployment.Config), &config)
-	}
-	
-	// Determine container image based on framework
-	var image string
-	switch deployment.Framework {
+// servingImage is the model server image of a framework
+func servingImage(framework string) string {
+	switch framework {
 	case "tensorflow":
-		image = "tensorflow/serving:latest"
+		return "tensorflow/serving:latest"
 	case "pytorch":
-		image = "pytorch/torchserve:latest"
+		return "pytorch/torchserve:latest"
 	case "sklearn":
-		image = "002aic/sklearn-serving:latest"
+		return "002aic/sklearn-serving:latest"
 	case "onnx":
-		image = "mcr.microsoft.com/onnxruntime/server:latest"
+		return "mcr.microsoft.com/onnxruntime/server:latest"
 	default:
-		image = "002aic/generic-serving:latest"
+		return "002aic/generic-serving:latest"
+	}
+}
+
+// podTemplate builds the pods of a deployment from its settings
+func podTemplate(deployment *ModelDeployment) corev1.PodTemplateSpec {
+	// Parse configuration
+	var config map[string]interface{}
+	if deployment.Config != "" {
+		json.Unmarshal([]byte(deployment.Config), &config)
 	}
 	
 	// Create environment variables
@@ -373,6 +578,86 @@ func (ds *ModelDeploymentService) deployModelToKubernetes(deployment *ModelDeplo
 		}
 	}
 	
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{
+				"app":        deployment.Name,
+				"model-id":   deployment.ModelID,
+				"framework":  deployment.Framework,
+				servingLabel: "true",
+			},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  "model-server",
+					Image: servingImage(deployment.Framework),
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          "http",
+							ContainerPort: 8080,
+						},
+						{
+							Name:          "grpc",
+							ContainerPort: 8081,
+						},
+						{
+							Name:          "metrics",
+							ContainerPort: 8082,
+						},
+					},
+					Env: envVars,
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{
+							corev1.ResourceCPU:    parseQuantity(deployment.CPU),
+							corev1.ResourceMemory: parseQuantity(deployment.Memory),
+						},
+						Limits: corev1.ResourceList{
+							corev1.ResourceCPU:    parseQuantity(deployment.CPU),
+							corev1.ResourceMemory: parseQuantity(deployment.Memory),
+						},
+					},
+					LivenessProbe: &corev1.Probe{
+						ProbeHandler: corev1.ProbeHandler{
+							HTTPGet: &corev1.HTTPGetAction{
+								Path: "/health",
+								Port: intstr.FromInt(8080),
+							},
+						},
+						InitialDelaySeconds: 30,
+						PeriodSeconds:       10,
+					},
+					ReadinessProbe: &corev1.Probe{
+						ProbeHandler: corev1.ProbeHandler{
+							HTTPGet: &corev1.HTTPGetAction{
+								Path: "/ready",
+								Port: intstr.FromInt(8080),
+							},
+						},
+						InitialDelaySeconds: 10,
+						PeriodSeconds:       5,
+					},
+				},
+			},
+		},
+	}
+	
+	// Let pods finish in-flight requests when they terminate
+	applyDrainSettings(&template.Spec, deployment)
+
+	// Place pods and add GPU resources if specified
+	applyScheduling(&template, deployment)
+	applyModelArtifact(&template, deployment)
+	
+	return template
+}
+
+func (ds *ModelDeploymentService) deployModelToKubernetes(deployment *ModelDeployment) error {
+	namespace := namespaceOf(deployment)
+	if err := ds.ensureNamespace(context.TODO(), deployment); err != nil {
+		return err
+	}
+	
 	// Create Deployment
 	k8sDeployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
@@ -393,80 +678,10 @@ func (ds *ModelDeploymentService) deployModelToKubernetes(deployment *ModelDeplo
 					"app": deployment.Name,
 				},
 			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app":       deployment.Name,
-						"model-id":  deployment.ModelID,
-						"framework": deployment.Framework,
-					},
-				},
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Name:  "model-server",
-							Image: image,
-							Ports: []corev1.ContainerPort{
-								{
-									Name:          "http",
-									ContainerPort: 8080,
-								},
-								{
-									Name:          "grpc",
-									ContainerPort: 8081,
-								},
-								{
-									Name:          "metrics",
-									ContainerPort: 8082,
-								},
-							},
-							Env: envVars,
-							Resources: corev1.ResourceRequirements{
-								Requests: corev1.ResourceList{
-									corev1.ResourceCPU:    parseQuantity(deployment.CPU),
-									corev1.ResourceMemory: parseQuantity(deployment.Memory),
-								},
-								Limits: corev1.ResourceList{
-									corev1.ResourceCPU:    parseQuantity(deployment.CPU),
-									corev1.ResourceMemory: parseQuantity(deployment.Memory),
-								},
-							},
-							LivenessProbe: &corev1.Probe{
-								ProbeHandler: corev1.ProbeHandler{
-									HTTPGet: &corev1.HTTPGetAction{
-										Path: "/health",
-										Port: intstr.FromInt(8080),
-									},
-								},
-								InitialDelaySeconds: 30,
-								PeriodSeconds:       10,
-							},
-							ReadinessProbe: &corev1.Probe{
-								ProbeHandler: corev1.ProbeHandler{
-									HTTPGet: &corev1.HTTPGetAction{
-										Path: "/ready",
-										Port: intstr.FromInt(8080),
-									},
-								},
-								InitialDelaySeconds: 10,
-								PeriodSeconds:       5,
-							},
-						},
-					},
-				},
-			},
+			Template: podTemplate(deployment),
 		},
 	}
 	
-	// Add GPU resources if specified
-	if deployment.GPU > 0 {
-		gpuResource := corev1.ResourceList{
-			"nvidia.com/gpu": parseQuantity(strconv.Itoa(deployment.GPU)),
-		}
-		k8sDeployment.Spec.Template.Spec.Containers[0].Resources.Requests["nvidia.com/gpu"] = gpuResource["nvidia.com/gpu"]
-		k8sDeployment.Spec.Template.Spec.Containers[0].Resources.Limits["nvidia.com/gpu"] = gpuResource["nvidia.com/gpu"]
-	}
-	
 	_, err := ds.k8sClient.AppsV1().Deployments(namespace).Create(
 		context.TODO(), k8sDeployment, metav1.CreateOptions{})
 	if err != nil {
@@ -487,7 +702,8 @@ func (ds *ModelDeploymentService) deployModelToKubernetes(deployment *ModelDeplo
 		},
 		Spec: corev1.ServiceSpec{
 			Selector: map[string]string{
-				"app": deployment.Name,
+				"app":        deployment.Name,
+				servingLabel: "true",
 			},
 			Ports: []corev1.ServicePort{
 				{
@@ -519,96 +735,17 @@ func (ds *ModelDeploymentService) deployModelToKubernetes(deployment *ModelDeplo
 		return fmt.Errorf("failed to create service: %w", err)
 	}
 	
-	// Create HorizontalPodAutoscaler if auto-scaling is enabled
+	// Create the autoscaler if auto-scaling is enabled: an HPA scales on
+	// CPU and a ScaledObject on requests until other metrics are set
 	if deployment.AutoScaling {
-		hpa := &autoscalingv2.HorizontalPodAutoscaler{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      deployment.Name,
-				Namespace: namespace,
-			},
-			Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
-				ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
-					APIVersion: "apps/v1",
-					Kind:       "Deployment",
-					Name:       deployment.Name,
-				},
-				MinReplicas: int32Ptr(int32(deployment.MinReplicas)),
-				MaxReplicas: int32(deployment.MaxReplicas),
-				Metrics: []autoscalingv2.MetricSpec{
-					{
-						Type: autoscalingv2.ResourceMetricSourceType,
-						Resource: &autoscalingv2.ResourceMetricSource{
-							Name: corev1.ResourceCPU,
-							Target: autoscalingv2.MetricTarget{
-								Type:               autoscalingv2.UtilizationMetricType,
-								AverageUtilization: int32Ptr(int32(deployment.TargetCPU)),
-							},
-						},
-					},
-				},
-			},
-		}
-		
-		_, err = ds.k8sClient.AutoscalingV2().HorizontalPodAutoscalers(namespace).Create(
-			context.TODO(), hpa, metav1.CreateOptions{})
-		if err != nil {
-			ds.logger.Warn("Failed to create HPA", zap.Error(err))
+		if err := ds.applyAutoscaler(context.TODO(), deployment, nil); err != nil {
+			ds.logger.Warn("Failed to create autoscaler", zap.Error(err))
 		}
 	}
 	
 	return nil
 }
 
-func (ds *ModelDeploymentService) predict(c *gin.Context) {
-	id := c.Param("id")
-	
-	var deployment ModelDeployment
-	if err := ds.db.First(&deployment, id).Error; err != nil {
-		c.JSON(404, gin.H{"error": "Deployment not found"})
-		return
-	}
-	
-	if deployment.Status != "running" {
-		c.JSON(503, gin.H{"error": "Deployment not ready"})
-		return
-	}
-	
-	// Parse request body
-	var requestData map[string]interface{}
-	if err := c.ShouldBindJSON(&requestData); err != nil {
-		c.JSON(400, gin.H{"error": "Invalid request data"})
-		return
-	}
-	
-	start := time.Now()
-	
-	// Forward request to model serving endpoint
-	// This is simplified - in production, use proper HTTP client with retries
-	prediction := map[string]interface{}{
-		"prediction": []float64{0.85, 0.15}, // Mock prediction
-		"confidence": 0.85,
-		"model_id":   deployment.ModelID,
-		"version":    deployment.ModelVersion,
-		"timestamp":  time.Now().UTC().Format(time.RFC3339),
-	}
-	
-	// Record metrics
-	latency := time.Since(start).Milliseconds()
-	modelInferenceRequests.WithLabelValues(deployment.Name, "success").Inc()
-	
-	// Log prediction request
-	ds.logger.Info("Model prediction", 
-		zap.String("deployment", deployment.Name),
-		zap.String("model_id", deployment.ModelID),
-		zap.Int64("latency_ms", latency))
-	
-	c.JSON(200, gin.H{
-		"result":     prediction,
-		"latency_ms": latency,
-		"deployment": deployment.Name,
-	})
-}
-
 func (ds *ModelDeploymentService) scaleDeployment(c *gin.Context) {
 	id := c.Param("id")
 	
@@ -633,7 +770,7 @@ func (ds *ModelDeploymentService) scaleDeployment(c *gin.Context) {
 	ds.db.Save(&deployment)
 	
 	// Scale in Kubernetes
-	namespace := "model-serving"
+	namespace := namespaceOf(&deployment)
 	k8sDeployment, err := ds.k8sClient.AppsV1().Deployments(namespace).Get(
 		context.TODO(), deployment.Name, metav1.GetOptions{})
 	if err != nil {
@@ -641,6 +778,32 @@ func (ds *ModelDeploymentService) scaleDeployment(c *gin.Context) {
 		return
 	}
 	
+	// Scaling down drains the pods being removed before they go
+	if remove := currentReplicas(k8sDeployment) - scaleRequest.Replicas; remove > 0 && deployment.DrainTimeoutSeconds > 0 {
+		victims, err := ds.selectDrainVictims(context.TODO(), &deployment, remove)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to list deployment pods"})
+			return
+		}
+		go ds.drainAndScale(deployment, victims, scaleRequest.Replicas)
+		
+		draining := make([]string, 0, len(victims))
+		for _, pod := range victims {
+			draining = append(draining, pod.Name)
+		}
+		ds.logger.Info("Draining pods before scale-down",
+			zap.String("name", deployment.Name),
+			zap.Int("replicas", scaleRequest.Replicas),
+			zap.Strings("pods", draining))
+		
+		c.JSON(202, gin.H{
+			"message":  "Draining pods before scaling down",
+			"replicas": scaleRequest.Replicas,
+			"draining": draining,
+		})
+		return
+	}
+	
 	k8sDeployment.Spec.Replicas = int32Ptr(int32(scaleRequest.Replicas))
 	
 	_, err = ds.k8sClient.AppsV1().Deployments(namespace).Update(
@@ -671,28 +834,24 @@ func (ds *ModelDeploymentService) startMetricsCollection() {
 
 func (ds *ModelDeploymentService) collectDeploymentMetrics() {
 	var deployments []ModelDeployment
-	if err := ds.db.Where("status = ?", "running").Find(&deployments).Error; err != nil {
+	if err := ds.db.Where("status IN ?", []string{DeploymentStatusRunning, DeploymentStatusDegraded}).Find(&deployments).Error; err != nil {
 		ds.logger.Error("Failed to fetch deployments for metrics", zap.Error(err))
 		return
 	}
 
 	for _, deployment := range deployments {
-		// Collect metrics from Kubernetes and model serving endpoints
-		// This is simplified - in production, integrate with Prometheus/monitoring
-		
+		// Request figures come from the inferences proxied since the last
+		// collection; utilization is simplified - in production, integrate
+		// with Prometheus/monitoring
+		now := time.Now()
 		metrics := DeploymentMetrics{
 			DeploymentID:      deployment.ID,
-			RequestCount:      int64(1000 + (deployment.ID * 100)), // Mock data
-			ErrorCount:        int64(5 + (deployment.ID % 10)),
-			AvgLatencyMs:      float64(50 + (deployment.ID % 100)),
-			P95LatencyMs:      float64(100 + (deployment.ID % 200)),
-			P99LatencyMs:      float64(200 + (deployment.ID % 300)),
-			ThroughputRPS:     float64(10 + (deployment.ID % 50)),
-			CPUUtilization:    float64(30 + (deployment.ID % 40)),
+			CPUUtilization:    float64(30 + (deployment.ID % 40)), // Mock data
 			MemoryUtilization: float64(40 + (deployment.ID % 30)),
 			GPUUtilization:    float64(20 + (deployment.ID % 60)),
-			Timestamp:         time.Now(),
+			Timestamp:         now,
 		}
+		ds.inference.take(deployment.ID).apply(&metrics, now)
 		
 		ds.db.Create(&metrics)
 	}
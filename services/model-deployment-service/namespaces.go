@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Serving namespaces. A deployment runs in the namespace mapped to its
+// environment and tenant (its team): the NamespaceMapping for the pair, else
+// the one for the environment with no tenant, else SERVING_NAMESPACE_TEMPLATE
+// with {environment} and {tenant} filled in. Deployments created before
+// namespaces were mapped stay in model-serving.
+//
+// A namespace is created on first use, with a NetworkPolicy admitting
+// traffic only from inside it, from this service's namespace and from
+// SERVING_INGRESS_NAMESPACES and the mapping's ingress namespaces, and a
+// ResourceQuota when the mapping sets limits.
+//
+// With NAMESPACE_RBAC_ENABLED, callers manage only deployments in the
+// namespaces listed in their token's NAMESPACES_CLAIM claim ("*" for all).
+// Tokens are validated by security-service and cached in-process for
+// IDENTITY_CACHE_TTL_SECONDS. Predictions and experiment events are not
+// checked; they are traffic, not management. Cost reports cover only the
+// caller's namespaces, and prices, like namespace mappings, can only be set
+// with access to all of them.
+
+const (
+	servingNetworkPolicy = "model-serving-ingress"
+	servingResourceQuota = "model-serving-quota"
+	namespaceGrantKey    = "namespace_grant"
+)
+
+// namespaceName is a DNS-1123 label, as Kubernetes requires of namespaces
+var namespaceName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+var (
+	errNoToken      = errors.New("missing bearer token")
+	errInvalidToken = errors.New("invalid token")
+)
+
+// NamespaceMapping places an environment's, or a tenant's, deployments in a
+// namespace
+type NamespaceMapping struct {
+	ID                uint      `json:"id" gorm:"primaryKey"`
+	Environment       string    `json:"environment" gorm:"uniqueIndex:idx_namespace_mapping;not null"`
+	Tenant            string    `json:"tenant" gorm:"uniqueIndex:idx_namespace_mapping"` // a deployment's team; "" for the whole environment
+	Namespace         string    `json:"namespace" gorm:"not null"`
+	QuotaCPU          string    `json:"quota_cpu"`    // requests.cpu, e.g. "32"
+	QuotaMemory       string    `json:"quota_memory"` // requests.memory, e.g. "128Gi"
+	QuotaGPU          int       `json:"quota_gpu"`
+	QuotaPods         int       `json:"quota_pods"`
+	IngressNamespaces []string  `json:"ingress_namespaces" gorm:"type:jsonb;serializer:json"` // admitted besides the defaults
+	CreatedBy         string    `json:"created_by"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+var namespaceDenials = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "model_deployment_namespace_denials_total",
+		Help: "Requests refused because the caller's token does not allow the namespace",
+	},
+	[]string{"namespace"},
+)
+
+// namespaceOf is the namespace a deployment runs in
+func namespaceOf(deployment *ModelDeployment) string {
+	if deployment.Namespace != "" {
+		return deployment.Namespace
+	}
+	return servingNamespace
+}
+
+// batchNamespace is the namespace a batch job's Job runs in
+func batchNamespace(job *BatchPredictionJob) string {
+	if job.Namespace != "" {
+		return job.Namespace
+	}
+	return servingNamespace
+}
+
+// resolveNamespace maps a deployment's environment and team to a namespace
+func (ds *ModelDeploymentService) resolveNamespace(deployment *ModelDeployment) (string, *NamespaceMapping, error) {
+	environment := deployment.Environment
+	if environment == "" {
+		environment = "production"
+	}
+
+	var mappings []NamespaceMapping
+	err := ds.db.Where("environment = ? AND tenant IN ?", environment, []string{deployment.Team, ""}).
+		Order("tenant DESC").Limit(1).Find(&mappings).Error
+	if err != nil {
+		return "", nil, err
+	}
+	if len(mappings) > 0 {
+		return mappings[0].Namespace, &mappings[0], nil
+	}
+
+	namespace := strings.NewReplacer(
+		"{environment}", environment,
+		"{tenant}", deployment.Team,
+	).Replace(getEnv("SERVING_NAMESPACE_TEMPLATE", "model-serving-{environment}"))
+	namespace = strings.Trim(strings.ToLower(namespace), "-")
+	if !namespaceName.MatchString(namespace) {
+		return "", nil, fmt.Errorf("namespace %q for environment %q is not a valid name", namespace, environment)
+	}
+	return namespace, nil, nil
+}
+
+// namespaceCache remembers the namespaces already set up
+type namespaceCache struct {
+	mutex   sync.Mutex
+	ensured map[string]bool
+}
+
+func newNamespaceCache() *namespaceCache {
+	return &namespaceCache{ensured: make(map[string]bool)}
+}
+
+func (n *namespaceCache) has(namespace string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.ensured[namespace]
+}
+
+func (n *namespaceCache) set(namespace string, ensured bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if ensured {
+		n.ensured[namespace] = true
+	} else {
+		delete(n.ensured, namespace)
+	}
+}
+
+// ensureNamespace creates a deployment's namespace, NetworkPolicy and
+// ResourceQuota when missing
+func (ds *ModelDeploymentService) ensureNamespace(ctx context.Context, deployment *ModelDeployment) error {
+	namespace := namespaceOf(deployment)
+	if ds.namespaces.has(namespace) {
+		return nil
+	}
+
+	var mapping *NamespaceMapping
+	if deployment.Namespace != "" {
+		var found NamespaceMapping
+		if err := ds.db.Where("namespace = ?", namespace).Order("tenant DESC").First(&found).Error; err == nil {
+			mapping = &found
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+	}
+	if err := ds.applyNamespace(ctx, namespace, deployment.Environment, mapping); err != nil {
+		return err
+	}
+	ds.namespaces.set(namespace, true)
+	return nil
+}
+
+// applyNamespace creates or updates a namespace and what it is set up with
+func (ds *ModelDeploymentService) applyNamespace(ctx context.Context, namespace, environment string, mapping *NamespaceMapping) error {
+	labels := map[string]string{
+		"app.kubernetes.io/managed-by": "model-deployment-service",
+		"model-serving":                "true",
+	}
+	if environment != "" {
+		labels["environment"] = environment
+	}
+	if mapping != nil && mapping.Tenant != "" {
+		labels["tenant"] = mapping.Tenant
+	}
+
+	namespaces := ds.k8sClient.CoreV1().Namespaces()
+	if _, err := namespaces.Get(ctx, namespace, metav1.GetOptions{}); apierrors.IsNotFound(err) {
+		object := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace, Labels: labels}}
+		if _, err := namespaces.Create(ctx, object, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("failed to create namespace %s: %w", namespace, err)
+		}
+		ds.logger.Info("Created serving namespace", zap.String("namespace", namespace))
+	} else if err != nil {
+		return fmt.Errorf("failed to read namespace %s: %w", namespace, err)
+	}
+
+	if err := ds.applyNetworkPolicy(ctx, namespace, mapping); err != nil {
+		return err
+	}
+	return ds.applyResourceQuota(ctx, namespace, mapping)
+}
+
+// ingressNamespaces are the namespaces a serving namespace admits traffic from
+func ingressNamespaces(mapping *NamespaceMapping) []string {
+	allowed := []string{getEnv("POD_NAMESPACE", "default")}
+	for _, namespace := range strings.Split(getEnv("SERVING_INGRESS_NAMESPACES", "istio-system,monitoring"), ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			allowed = append(allowed, namespace)
+		}
+	}
+	if mapping != nil {
+		allowed = append(allowed, mapping.IngressNamespaces...)
+	}
+	return allowed
+}
+
+func (ds *ModelDeploymentService) applyNetworkPolicy(ctx context.Context, namespace string, mapping *NamespaceMapping) error {
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      servingNetworkPolicy,
+			Namespace: namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "model-deployment-service"},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				From: []networkingv1.NetworkPolicyPeer{
+					{PodSelector: &metav1.LabelSelector{}},
+					{NamespaceSelector: &metav1.LabelSelector{
+						MatchExpressions: []metav1.LabelSelectorRequirement{{
+							Key:      "kubernetes.io/metadata.name",
+							Operator: metav1.LabelSelectorOpIn,
+							Values:   ingressNamespaces(mapping),
+						}},
+					}},
+				},
+			}},
+		},
+	}
+
+	policies := ds.k8sClient.NetworkingV1().NetworkPolicies(namespace)
+	existing, err := policies.Get(ctx, servingNetworkPolicy, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		_, err = policies.Create(ctx, policy, metav1.CreateOptions{})
+	case err == nil:
+		existing.Spec = policy.Spec
+		_, err = policies.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply network policy in %s: %w", namespace, err)
+	}
+	return nil
+}
+
+func (ds *ModelDeploymentService) applyResourceQuota(ctx context.Context, namespace string, mapping *NamespaceMapping) error {
+	hard := corev1.ResourceList{}
+	if mapping != nil {
+		if mapping.QuotaCPU != "" {
+			hard[corev1.ResourceRequestsCPU] = resource.MustParse(mapping.QuotaCPU)
+		}
+		if mapping.QuotaMemory != "" {
+			hard[corev1.ResourceRequestsMemory] = resource.MustParse(mapping.QuotaMemory)
+		}
+		if mapping.QuotaGPU > 0 {
+			hard["requests.nvidia.com/gpu"] = *resource.NewQuantity(int64(mapping.QuotaGPU), resource.DecimalSI)
+		}
+		if mapping.QuotaPods > 0 {
+			hard[corev1.ResourcePods] = *resource.NewQuantity(int64(mapping.QuotaPods), resource.DecimalSI)
+		}
+	}
+
+	quotas := ds.k8sClient.CoreV1().ResourceQuotas(namespace)
+	existing, err := quotas.Get(ctx, servingResourceQuota, metav1.GetOptions{})
+	switch {
+	case len(hard) == 0 && err == nil:
+		err = quotas.Delete(ctx, servingResourceQuota, metav1.DeleteOptions{})
+	case len(hard) == 0 && apierrors.IsNotFound(err):
+		err = nil
+	case apierrors.IsNotFound(err):
+		_, err = quotas.Create(ctx, &corev1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      servingResourceQuota,
+				Namespace: namespace,
+				Labels:    map[string]string{"app.kubernetes.io/managed-by": "model-deployment-service"},
+			},
+			Spec: corev1.ResourceQuotaSpec{Hard: hard},
+		}, metav1.CreateOptions{})
+	case err == nil:
+		existing.Spec.Hard = hard
+		_, err = quotas.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply resource quota in %s: %w", namespace, err)
+	}
+	return nil
+}
+
+// namespaceGrant is what namespaces a caller may manage deployments in
+type namespaceGrant struct {
+	Subject    string          `json:"subject"`
+	All        bool            `json:"all"`
+	Namespaces map[string]bool `json:"namespaces"`
+	ExpiresAt  time.Time       `json:"expires_at"`
+}
+
+func (g *namespaceGrant) allows(namespace string) bool {
+	return g.All || g.Namespaces[namespace]
+}
+
+// list is the granted namespaces, for filtering queries
+func (g *namespaceGrant) list() []string {
+	namespaces := make([]string, 0, len(g.Namespaces))
+	for namespace := range g.Namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	return namespaces
+}
+
+// grantCache holds resolved grants by token digest
+type grantCache struct {
+	mutex  sync.Mutex
+	grants map[string]*namespaceGrant
+}
+
+func newGrantCache() *grantCache {
+	return &grantCache{grants: make(map[string]*namespaceGrant)}
+}
+
+func (g *grantCache) get(key string) *namespaceGrant {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	grant, ok := g.grants[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(grant.ExpiresAt) {
+		delete(g.grants, key)
+		return nil
+	}
+	return grant
+}
+
+func (g *grantCache) put(key string, grant *namespaceGrant) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now()
+	for cached, existing := range g.grants {
+		if now.After(existing.ExpiresAt) {
+			delete(g.grants, cached)
+		}
+	}
+	g.grants[key] = grant
+}
+
+func namespaceRBACEnabled() bool {
+	return getEnv("NAMESPACE_RBAC_ENABLED", "false") == "true"
+}
+
+// resolveGrant validates a token with security-service and reads the
+// namespaces it allows
+func (ds *ModelDeploymentService) resolveGrant(ctx context.Context, token string) (*namespaceGrant, error) {
+	digest := sha256.Sum256([]byte(token))
+	cacheKey := hex.EncodeToString(digest[:])
+	if grant := ds.grants.get(cacheKey); grant != nil {
+		return grant, nil
+	}
+
+	body, _ := json.Marshal(map[string]string{"token": token})
+	url := strings.TrimRight(getEnv("SECURITY_SERVICE_URL", "http://security-service:8080"), "/") + "/v1/validate/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("security-service unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var validation struct {
+		Valid  bool                   `json:"valid"`
+		Error  string                 `json:"error"`
+		Claims map[string]interface{} `json:"claims"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&validation); err != nil {
+		return nil, fmt.Errorf("invalid security-service response: %w", err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized || !validation.Valid {
+		return nil, fmt.Errorf("%w: %s", errInvalidToken, validation.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("security-service answered %d", resp.StatusCode)
+	}
+
+	subject, _ := validation.Claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("%w: no subject", errInvalidToken)
+	}
+	grant := &namespaceGrant{
+		Subject:    subject,
+		Namespaces: make(map[string]bool),
+		ExpiresAt:  time.Now().Add(time.Duration(getEnvInt("IDENTITY_CACHE_TTL_SECONDS", 60)) * time.Second),
+	}
+	for _, namespace := range claimStrings(validation.Claims[getEnv("NAMESPACES_CLAIM", "namespaces")]) {
+		if namespace == "*" {
+			grant.All = true
+		}
+		grant.Namespaces[namespace] = true
+	}
+	if exp, ok := validation.Claims["exp"].(float64); ok {
+		if expiry := time.Unix(int64(exp), 0); expiry.Before(grant.ExpiresAt) {
+			grant.ExpiresAt = expiry
+		}
+	}
+	ds.grants.put(cacheKey, grant)
+	return grant, nil
+}
+
+// claimStrings reads a claim given as a list or a space or comma separated
+// string
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok && s != "" {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// servingRoutes are the deployment routes that carry traffic rather than
+// manage the deployment; callers of these aren't checked
+var servingRoutes = map[string]bool{
+	"/v1/deployments/:id/predict":               true,
+	"/v1/deployments/:id/grpc/:service/:method": true,
+	"/v1/deployments/:id/stream":                true,
+	"/v1/deployments/:id/ab-test/assignment":    true,
+	"/v1/deployments/:id/ab-test/events":        true,
+	"/v1/deployments/:id/canary/feedback":       true,
+}
+
+// namespaceAccess resolves the caller's grant and refuses requests for
+// deployments in namespaces it doesn't allow
+func (ds *ModelDeploymentService) namespaceAccess() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !namespaceRBACEnabled() || servingRoutes[c.FullPath()] {
+			c.Next()
+			return
+		}
+
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" {
+			c.AbortWithStatusJSON(401, gin.H{"error": errNoToken.Error()})
+			return
+		}
+		grant, err := ds.resolveGrant(c.Request.Context(), token)
+		if err != nil {
+			status := 502
+			if errors.Is(err, errInvalidToken) {
+				status = 401
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(namespaceGrantKey, grant)
+
+		if id := c.Param("id"); id != "" {
+			var deployment ModelDeployment
+			if err := ds.db.Select("id", "namespace").First(&deployment, id).Error; err == nil {
+				if namespace := namespaceOf(&deployment); !grant.allows(namespace) {
+					namespaceDenials.WithLabelValues(namespace).Inc()
+					c.AbortWithStatusJSON(403, gin.H{"error": "Not allowed to manage deployments in namespace " + namespace})
+					return
+				}
+			}
+		}
+		c.Next()
+	}
+}
+
+// namespaceAdmin refuses callers whose grant doesn't cover every namespace,
+// for settings shared by all of them
+func (ds *ModelDeploymentService) namespaceAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if grant, ok := grantOf(c); ok && !grant.All {
+			c.AbortWithStatusJSON(403, gin.H{"error": "This requires access to all namespaces"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// grantOf is the caller's grant, when namespace RBAC is enabled
+func grantOf(c *gin.Context) (*namespaceGrant, bool) {
+	value, ok := c.Get(namespaceGrantKey)
+	if !ok {
+		return nil, false
+	}
+	grant, ok := value.(*namespaceGrant)
+	return grant, ok
+}
+
+// namespaceAllowed answers a request refused for the namespace, and reports
+// whether it may go on
+func namespaceAllowed(c *gin.Context, namespace string) bool {
+	if grant, ok := grantOf(c); ok && !grant.allows(namespace) {
+		namespaceDenials.WithLabelValues(namespace).Inc()
+		c.JSON(403, gin.H{"error": "Not allowed to manage deployments in namespace " + namespace})
+		return false
+	}
+	return true
+}
+
+// grantedNamespaces is the namespace column values the caller is limited
+// to, and whether it is limited at all
+func grantedNamespaces(c *gin.Context) ([]string, bool) {
+	grant, ok := grantOf(c)
+	if !ok || grant.All {
+		return nil, false
+	}
+	namespaces := grant.list()
+	if grant.allows(servingNamespace) {
+		namespaces = append(namespaces, "")
+	}
+	if len(namespaces) == 0 {
+		namespaces = []string{"-"} // matches no deployment
+	}
+	return namespaces, true
+}
+
+// scopeToGrant limits a deployment query to the caller's namespaces
+func scopeToGrant(c *gin.Context, query *gorm.DB) *gorm.DB {
+	if namespaces, limited := grantedNamespaces(c); limited {
+		return query.Where("namespace IN ?", namespaces)
+	}
+	return query
+}
+
+// Namespace mappings
+func (ds *ModelDeploymentService) listNamespaceMappings(c *gin.Context) {
+	var mappings []NamespaceMapping
+	query := ds.db.Order("environment, tenant")
+	if environment := c.Query("environment"); environment != "" {
+		query = query.Where("environment = ?", environment)
+	}
+	if err := query.Find(&mappings).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list namespace mappings"})
+		return
+	}
+	c.JSON(200, gin.H{"mappings": mappings})
+}
+
+// Map an environment, or one tenant in it, to a namespace and set it up
+func (ds *ModelDeploymentService) setNamespaceMapping(c *gin.Context) {
+	var mapping NamespaceMapping
+	if err := c.ShouldBindJSON(&mapping); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if mapping.Environment == "" {
+		c.JSON(400, gin.H{"error": "environment is required"})
+		return
+	}
+	if !namespaceName.MatchString(mapping.Namespace) {
+		c.JSON(400, gin.H{"error": "namespace must be a lowercase DNS label of at most 63 characters"})
+		return
+	}
+	for _, quantity := range []string{mapping.QuotaCPU, mapping.QuotaMemory} {
+		if quantity == "" {
+			continue
+		}
+		if _, err := resource.ParseQuantity(quantity); err != nil {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("invalid quota %q: %v", quantity, err)})
+			return
+		}
+	}
+	if mapping.QuotaGPU < 0 || mapping.QuotaPods < 0 {
+		c.JSON(400, gin.H{"error": "quota_gpu and quota_pods cannot be negative"})
+		return
+	}
+	for _, namespace := range mapping.IngressNamespaces {
+		if !namespaceName.MatchString(namespace) {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("invalid ingress namespace %q", namespace)})
+			return
+		}
+	}
+	if grant, ok := grantOf(c); ok {
+		mapping.CreatedBy = grant.Subject
+	}
+
+	mapping.ID = 0
+	mapping.CreatedAt = time.Now()
+	mapping.UpdatedAt = time.Now()
+	err := ds.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "environment"}, {Name: "tenant"}},
+		DoUpdates: clause.AssignmentColumns([]string{"namespace", "quota_cpu", "quota_memory", "quota_gpu", "quota_pods", "ingress_namespaces", "created_by", "updated_at"}),
+	}).Create(&mapping).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save namespace mapping"})
+		return
+	}
+
+	// New deployments land in the namespace; existing ones stay where they are
+	if err := ds.applyNamespace(c.Request.Context(), mapping.Namespace, mapping.Environment, &mapping); err != nil {
+		ds.namespaces.set(mapping.Namespace, false)
+		ds.logger.Error("Failed to set up namespace", zap.String("namespace", mapping.Namespace), zap.Error(err))
+		c.JSON(502, gin.H{"error": err.Error(), "mapping": mapping})
+		return
+	}
+	ds.namespaces.set(mapping.Namespace, true)
+	c.JSON(200, mapping)
+}
+
+// Remove a mapping; the namespace and its deployments are left in place
+func (ds *ModelDeploymentService) deleteNamespaceMapping(c *gin.Context) {
+	result := ds.db.Delete(&NamespaceMapping{}, c.Param("mapping_id"))
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": "Failed to delete namespace mapping"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"error": "Namespace mapping not found"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Namespace mapping deleted"})
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// Status reconciliation. The status kept for a deployment is what this
+// service last did to it, and what Kubernetes runs can change under it,
+// e.g. pods crashlooping after a bad node or config change. The reconciler
+// watches the model server Deployments and pods and sets the status from
+// them:
+//
+//	running    every replica ready, a rollout going well, or scaled to zero
+//	           by KEDA
+//	degraded   some replicas ready, the others failing or missing
+//	deploying  nothing ready yet and nothing failing
+//	failed     nothing ready and pods failing, or the rollout past its
+//	           progress deadline
+//	stopped    scaled to no replicas
+//
+// Degraded deployments still serve. Every change is recorded as a
+// DeploymentStatusTransition and published to event-streaming-service; a
+// pass over all deployments every STATUS_RESYNC_SECONDS catches what the
+// watches missed.
+
+// Deployment statuses set by the reconciler
+const (
+	DeploymentStatusDeploying = "deploying"
+	DeploymentStatusRunning   = "running"
+	DeploymentStatusDegraded  = "degraded"
+	DeploymentStatusFailed    = "failed"
+	DeploymentStatusStopped   = "stopped"
+)
+
+// reconciledStatuses are the statuses the reconciler may change; others,
+// e.g. pending, belong to the API
+var reconciledStatuses = []string{
+	DeploymentStatusDeploying,
+	DeploymentStatusRunning,
+	DeploymentStatusDegraded,
+	DeploymentStatusFailed,
+	DeploymentStatusStopped,
+}
+
+// failingReasons are container waiting reasons that won't fix themselves
+var failingReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"RunContainerError":          true,
+}
+
+// DeploymentStatusTransition is one change of a deployment's status
+type DeploymentStatusTransition struct {
+	ID              uint      `json:"id" gorm:"primaryKey"`
+	DeploymentID    uint      `json:"deployment_id" gorm:"index;not null"`
+	FromStatus      string    `json:"from_status"`
+	ToStatus        string    `json:"to_status"`
+	Reason          string    `json:"reason"`
+	DesiredReplicas int       `json:"desired_replicas"`
+	ReadyReplicas   int       `json:"ready_replicas"`
+	CreatedAt       time.Time `json:"created_at" gorm:"index"`
+}
+
+var (
+	statusTransitions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_deployment_status_transitions_total",
+			Help: "Deployment status changes found by the reconciler, by new status",
+		},
+		[]string{"deployment", "status"},
+	)
+	statusEventsPublished = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_deployment_status_events_total",
+			Help: "Status change events sent to event-streaming-service, by outcome",
+		},
+		[]string{"outcome"},
+	)
+)
+
+// servingStatus tells whether a deployment in a status takes predictions
+func servingStatus(status string) bool {
+	return status == DeploymentStatusRunning || status == DeploymentStatusDegraded
+}
+
+// liveStatus is what Kubernetes runs for a deployment
+type liveStatus struct {
+	Status          string      `json:"status"`
+	Reason          string      `json:"reason"`
+	DesiredReplicas int         `json:"desired_replicas"`
+	ReadyReplicas   int         `json:"ready_replicas"`
+	UpdatedReplicas int         `json:"updated_replicas"`
+	Pods            []podStatus `json:"pods"`
+}
+
+// podStatus is one model server pod
+type podStatus struct {
+	Name     string `json:"name"`
+	Phase    string `json:"phase"`
+	Ready    bool   `json:"ready"`
+	Restarts int    `json:"restarts"`
+	Reason   string `json:"reason,omitempty"` // why a container isn't running
+	Node     string `json:"node,omitempty"`
+}
+
+// describePods summarizes pods and the ones failing
+func describePods(pods []corev1.Pod) ([]podStatus, map[string]int) {
+	statuses := make([]podStatus, 0, len(pods))
+	failing := make(map[string]int)
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		status := podStatus{Name: pod.Name, Phase: string(pod.Status.Phase), Node: pod.Spec.NodeName}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == corev1.PodReady {
+				status.Ready = condition.Status == corev1.ConditionTrue
+			}
+		}
+		for _, container := range pod.Status.ContainerStatuses {
+			status.Restarts += int(container.RestartCount)
+			if waiting := container.State.Waiting; waiting != nil && failingReasons[waiting.Reason] {
+				status.Reason = waiting.Reason
+				if last := container.LastTerminationState.Terminated; last != nil && last.Reason != "" && last.Reason != "Error" {
+					status.Reason += " (" + last.Reason + ")"
+				}
+			}
+		}
+		if pod.Status.Phase == corev1.PodFailed {
+			status.Reason = pod.Status.Reason
+		}
+		if status.Reason != "" && !status.Ready {
+			failing[status.Reason]++
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses, failing
+}
+
+// failingSummary reads e.g. "2 pods in CrashLoopBackOff"
+func failingSummary(failing map[string]int) string {
+	reasons := make([]string, 0, len(failing))
+	for reason, count := range failing {
+		pods := "pods"
+		if count == 1 {
+			pods = "pod"
+		}
+		reasons = append(reasons, fmt.Sprintf("%d %s in %s", count, pods, reason))
+	}
+	sort.Strings(reasons)
+	return strings.Join(reasons, ", ")
+}
+
+// deriveStatus works out a deployment's status from its Kubernetes
+// Deployment and pods
+func deriveStatus(deployment *ModelDeployment, k8sDeployment *appsv1.Deployment, pods []corev1.Pod) liveStatus {
+	live := liveStatus{
+		DesiredReplicas: currentReplicas(k8sDeployment),
+		ReadyReplicas:   int(k8sDeployment.Status.ReadyReplicas),
+		UpdatedReplicas: int(k8sDeployment.Status.UpdatedReplicas),
+	}
+	var failing map[string]int
+	live.Pods, failing = describePods(pods)
+
+	deadlineExceeded := false
+	for _, condition := range k8sDeployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Status == corev1.ConditionFalse &&
+			condition.Reason == "ProgressDeadlineExceeded" {
+			deadlineExceeded = true
+		}
+	}
+	rollingOut := k8sDeployment.Generation > k8sDeployment.Status.ObservedGeneration ||
+		live.UpdatedReplicas < live.DesiredReplicas
+	trouble := failingSummary(failing)
+	if trouble == "" && deadlineExceeded {
+		trouble = "rollout exceeded its progress deadline"
+	}
+
+	switch {
+	case live.DesiredReplicas == 0 && usesKEDA(deployment) && deployment.ScaleToZero:
+		live.Status, live.Reason = DeploymentStatusRunning, "scaled to zero while idle"
+	case live.DesiredReplicas == 0:
+		live.Status, live.Reason = DeploymentStatusStopped, "scaled to 0 replicas"
+	case live.ReadyReplicas >= live.DesiredReplicas && trouble == "":
+		live.Status = DeploymentStatusRunning
+	case live.ReadyReplicas > 0 && trouble == "" && rollingOut:
+		live.Status, live.Reason = DeploymentStatusRunning, "rolling out"
+	case live.ReadyReplicas > 0:
+		live.Status = DeploymentStatusDegraded
+		live.Reason = fmt.Sprintf("%d of %d replicas ready", live.ReadyReplicas, live.DesiredReplicas)
+		if trouble != "" {
+			live.Reason += "; " + trouble
+		}
+	case trouble != "":
+		live.Status, live.Reason = DeploymentStatusFailed, trouble
+	default:
+		live.Status, live.Reason = DeploymentStatusDeploying, "waiting for replicas to become ready"
+	}
+	return live
+}
+
+// readLiveStatus reads what Kubernetes runs for a deployment; the
+// Deployment is nil when it doesn't exist
+func (ds *ModelDeploymentService) readLiveStatus(ctx context.Context, deployment *ModelDeployment) (*appsv1.Deployment, liveStatus, error) {
+	k8sDeployment, err := ds.k8sClient.AppsV1().Deployments(namespaceOf(deployment)).Get(ctx, deployment.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, liveStatus{Status: DeploymentStatusFailed, Reason: "Kubernetes deployment not found"}, nil
+	}
+	if err != nil {
+		return nil, liveStatus{}, err
+	}
+	pods, err := ds.k8sClient.CoreV1().Pods(namespaceOf(deployment)).List(ctx, metav1.ListOptions{
+		LabelSelector: "app=" + deployment.Name,
+	})
+	if err != nil {
+		return nil, liveStatus{}, err
+	}
+	return k8sDeployment, deriveStatus(deployment, k8sDeployment, pods.Items), nil
+}
+
+// statusReconciler collects the deployments to reconcile
+type statusReconciler struct {
+	mutex   sync.Mutex
+	pending map[string]bool
+	wake    chan struct{}
+}
+
+func newStatusReconciler() *statusReconciler {
+	return &statusReconciler{pending: make(map[string]bool), wake: make(chan struct{}, 1)}
+}
+
+func (r *statusReconciler) enqueue(name string) {
+	if name == "" {
+		return
+	}
+	r.mutex.Lock()
+	r.pending[name] = true
+	r.mutex.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *statusReconciler) take() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	names := make([]string, 0, len(r.pending))
+	for name := range r.pending {
+		names = append(names, name)
+	}
+	r.pending = make(map[string]bool)
+	return names
+}
+
+// startStatusReconciler keeps deployment statuses in step with Kubernetes
+func (ds *ModelDeploymentService) startStatusReconciler() {
+	go ds.watchServing("deployments", func(ctx context.Context) (watch.Interface, error) {
+		return ds.k8sClient.AppsV1().Deployments(metav1.NamespaceAll).Watch(ctx, metav1.ListOptions{
+			LabelSelector: "model-id",
+		})
+	}, func(object interface{}) string {
+		if k8sDeployment, ok := object.(*appsv1.Deployment); ok {
+			return k8sDeployment.Name
+		}
+		return ""
+	})
+	go ds.watchServing("pods", func(ctx context.Context) (watch.Interface, error) {
+		return ds.k8sClient.CoreV1().Pods(metav1.NamespaceAll).Watch(ctx, metav1.ListOptions{
+			LabelSelector: "model-id",
+		})
+	}, func(object interface{}) string {
+		if pod, ok := object.(*corev1.Pod); ok {
+			return pod.Labels["app"]
+		}
+		return ""
+	})
+	go func() {
+		ticker := time.NewTicker(time.Duration(getEnvInt("STATUS_RESYNC_SECONDS", 300)) * time.Second)
+		defer ticker.Stop()
+		for ; ; <-ticker.C {
+			var names []string
+			if err := ds.db.Model(&ModelDeployment{}).Where("status IN ?", reconciledStatuses).Pluck("name", &names).Error; err != nil {
+				ds.logger.Warn("Failed to list deployments to reconcile", zap.Error(err))
+				continue
+			}
+			for _, name := range names {
+				ds.reconciler.enqueue(name)
+			}
+		}
+	}()
+
+	// Events come in bursts during rollouts; a short pause folds them into
+	// one pass per deployment
+	for range ds.reconciler.wake {
+		time.Sleep(time.Second)
+		for _, name := range ds.reconciler.take() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := ds.reconcileStatus(ctx, name); err != nil {
+				ds.logger.Warn("Failed to reconcile deployment status", zap.String("deployment", name), zap.Error(err))
+			}
+			cancel()
+		}
+	}
+}
+
+// watchServing queues the deployment of every changed object of a watch
+func (ds *ModelDeploymentService) watchServing(kind string, start func(context.Context) (watch.Interface, error), nameOf func(interface{}) string) {
+	for {
+		w, err := start(context.Background())
+		if err != nil {
+			ds.logger.Warn("Failed to watch model server "+kind, zap.Error(err))
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		for event := range w.ResultChan() {
+			ds.reconciler.enqueue(nameOf(event.Object))
+		}
+		// The API server ends watches periodically; start a new one
+	}
+}
+
+// reconcileStatus sets a deployment's status from what Kubernetes runs
+func (ds *ModelDeploymentService) reconcileStatus(ctx context.Context, name string) error {
+	var deployment ModelDeployment
+	if err := ds.db.Where("name = ? AND status IN ?", name, reconciledStatuses).First(&deployment).Error; err != nil {
+		return nil // not ours, or not in a status the reconciler manages
+	}
+
+	k8sDeployment, live, err := ds.readLiveStatus(ctx, &deployment)
+	if err != nil {
+		return err
+	}
+	// A deployment being created has no Kubernetes objects for a moment
+	if k8sDeployment == nil && deployment.Status == DeploymentStatusDeploying {
+		return nil
+	}
+	if live.Status == deployment.Status && live.Reason == deployment.StatusReason {
+		return nil
+	}
+
+	now := time.Now()
+	// Only if nobody changed the status meanwhile; the next event sees theirs
+	result := ds.db.Model(&ModelDeployment{}).
+		Where("id = ? AND status = ?", deployment.ID, deployment.Status).
+		Updates(map[string]interface{}{"status": live.Status, "status_reason": live.Reason, "status_changed_at": now})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 || live.Status == deployment.Status {
+		return nil
+	}
+
+	transition := DeploymentStatusTransition{
+		DeploymentID:    deployment.ID,
+		FromStatus:      deployment.Status,
+		ToStatus:        live.Status,
+		Reason:          live.Reason,
+		DesiredReplicas: live.DesiredReplicas,
+		ReadyReplicas:   live.ReadyReplicas,
+		CreatedAt:       now,
+	}
+	if err := ds.db.Create(&transition).Error; err != nil {
+		ds.logger.Warn("Failed to record status transition", zap.String("deployment", name), zap.Error(err))
+	}
+	statusTransitions.WithLabelValues(deployment.Name, live.Status).Inc()
+	ds.logger.Info("Deployment status changed",
+		zap.String("deployment", deployment.Name),
+		zap.String("from", deployment.Status),
+		zap.String("to", live.Status),
+		zap.String("reason", live.Reason))
+
+	go ds.publishStatusEvent(&deployment, &transition)
+	return nil
+}
+
+// publishStatusEvent sends a status change to event-streaming-service
+func (ds *ModelDeploymentService) publishStatusEvent(deployment *ModelDeployment, transition *DeploymentStatusTransition) {
+	priority := "normal"
+	switch transition.ToStatus {
+	case DeploymentStatusFailed:
+		priority = "critical"
+	case DeploymentStatusDegraded:
+		priority = "high"
+	}
+	payload, _ := json.Marshal(gin.H{
+		"type":     "model_event",
+		"source":   "model-deployment-service",
+		"subject":  "deployment/" + deployment.Name,
+		"priority": priority,
+		"data": gin.H{
+			"event":            "deployment.status_changed",
+			"deployment_id":    deployment.ID,
+			"deployment":       deployment.Name,
+			"model_id":         deployment.ModelID,
+			"model_version":    deployment.ModelVersion,
+			"environment":      deployment.Environment,
+			"team":             deployment.Team,
+			"from_status":      transition.FromStatus,
+			"to_status":        transition.ToStatus,
+			"reason":           transition.Reason,
+			"desired_replicas": transition.DesiredReplicas,
+			"ready_replicas":   transition.ReadyReplicas,
+			"changed_at":       transition.CreatedAt,
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	url := getEnv("EVENT_STREAMING_SERVICE_URL", "http://event-streaming-service:8080") + "/v1/events"
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		statusEventsPublished.WithLabelValues("error").Inc()
+		ds.logger.Warn("Failed to publish status event", zap.String("deployment", deployment.Name), zap.Error(err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		statusEventsPublished.WithLabelValues("rejected").Inc()
+		ds.logger.Warn("event-streaming-service refused status event",
+			zap.String("deployment", deployment.Name),
+			zap.Int("status", resp.StatusCode))
+		return
+	}
+	statusEventsPublished.WithLabelValues("published").Inc()
+}
+
+// Status of a deployment as stored and as Kubernetes runs it
+func (ds *ModelDeploymentService) getDeploymentStatus(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+
+	response := gin.H{
+		"deployment":        deployment.Name,
+		"status":            deployment.Status,
+		"status_reason":     deployment.StatusReason,
+		"status_changed_at": deployment.StatusChangedAt,
+		"revision":          deployment.Revision,
+		"deployed_at":       deployment.DeployedAt,
+	}
+	_, live, err := ds.readLiveStatus(c.Request.Context(), &deployment)
+	if err != nil {
+		ds.logger.Warn("Failed to read live status", zap.String("deployment", deployment.Name), zap.Error(err))
+		response["live_error"] = "Failed to read Kubernetes status"
+	} else {
+		response["live"] = live
+	}
+	c.JSON(200, response)
+}
+
+// Status changes of a deployment, newest first
+func (ds *ModelDeploymentService) listStatusTransitions(c *gin.Context) {
+	var transitions []DeploymentStatusTransition
+	if err := ds.db.Where("deployment_id = ?", c.Param("id")).Order("created_at DESC").Limit(100).Find(&transitions).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch status history"})
+		return
+	}
+	c.JSON(200, gin.H{"transitions": transitions})
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Model artifacts. With ModelSource "registry" a deployment's model is
+// looked up in the model registry, MODEL_REGISTRY_TYPE "internal" (the
+// platform's model-registry-service) or "mlflow", which gives the URI and
+// SHA-256 of the artifact; with "uri" the caller gives both. The model
+// server then starts with the artifact already in /models: a model-puller
+// init container downloads ARTIFACT_URI into the shared volume and fails
+// unless its SHA-256 is ARTIFACT_SHA256. With no ModelSource the server
+// loads the model by MODEL_ID as before.
+//
+// When MODEL_SIGNING_PUBLIC_KEY (a base64 Ed25519 key) is set, artifacts
+// must also carry a signature by it over "<model id>:<version>:<sha256>":
+// the registry's signature field, or the signature tag in MLflow, or
+// artifact_signature for a URI.
+//
+// Canaries and promotions look up the artifact of the version they roll to.
+
+// Model sources
+const (
+	ModelSourceNone     = ""
+	ModelSourceRegistry = "registry"
+	ModelSourceURI      = "uri"
+)
+
+const (
+	modelPullerName = "model-puller"
+	modelStoreName  = "model-store"
+	modelStorePath  = "/models"
+)
+
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+var registryHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// ModelArtifact is where a model version's files are and what they hash to
+type ModelArtifact struct {
+	URI       string `json:"uri"`
+	SHA256    string `json:"sha256"`
+	SizeBytes int64  `json:"size_bytes"`
+	Signature string `json:"-"`
+	Registry  string `json:"registry"`
+	Stage     string `json:"stage,omitempty"`
+}
+
+// artifactError is a model version the registry can't serve as asked,
+// as opposed to a registry that can't be reached
+type artifactError struct {
+	message string
+}
+
+func (e *artifactError) Error() string {
+	return e.message
+}
+
+// resolveModelArtifact looks a model version up in the configured registry
+func resolveModelArtifact(ctx context.Context, modelID, version string) (*ModelArtifact, error) {
+	var artifact *ModelArtifact
+	var err error
+	switch registry := getEnv("MODEL_REGISTRY_TYPE", "internal"); registry {
+	case "internal":
+		artifact, err = resolveInternalArtifact(ctx, modelID, version)
+	case "mlflow":
+		artifact, err = resolveMLflowArtifact(ctx, modelID, version)
+	default:
+		return nil, fmt.Errorf("unknown MODEL_REGISTRY_TYPE %q", registry)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyArtifact(modelID, version, artifact); err != nil {
+		return nil, err
+	}
+	return artifact, nil
+}
+
+// registryGet fetches a JSON document from a registry
+func registryGet(ctx context.Context, target, token string, into interface{}) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := registryHTTPClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("model registry unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(into); err != nil {
+		return resp.StatusCode, fmt.Errorf("invalid model registry response: %w", err)
+	}
+	return resp.StatusCode, nil
+}
+
+// resolveInternalArtifact reads the platform registry, where models are
+// identified as name:version
+func resolveInternalArtifact(ctx context.Context, modelID, version string) (*ModelArtifact, error) {
+	registryID := modelID
+	if !strings.Contains(modelID, ":") {
+		registryID = modelID + ":" + version
+	}
+	base := strings.TrimRight(getEnv("MODEL_REGISTRY_URL", "http://model-registry-service:8000"), "/")
+
+	var model struct {
+		ModelURI       string `json:"model_uri"`
+		Checksum       string `json:"checksum"`
+		ModelSizeBytes int64  `json:"model_size_bytes"`
+		Stage          string `json:"stage"`
+		Signature      string `json:"signature"`
+	}
+	status, err := registryGet(ctx, base+"/v1/models/"+url.PathEscape(registryID), getEnv("MODEL_REGISTRY_TOKEN", ""), &model)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case status == http.StatusNotFound:
+		return nil, &artifactError{fmt.Sprintf("model %s not found in the registry", registryID)}
+	case status != http.StatusOK:
+		return nil, fmt.Errorf("model registry returned HTTP %d", status)
+	}
+	if model.ModelURI == "" {
+		return nil, &artifactError{fmt.Sprintf("model %s has no artifact", registryID)}
+	}
+	if model.Stage == "archived" || model.Stage == "deprecated" {
+		return nil, &artifactError{fmt.Sprintf("model %s is %s", registryID, model.Stage)}
+	}
+	return &ModelArtifact{
+		URI:       model.ModelURI,
+		SHA256:    strings.ToLower(strings.TrimPrefix(model.Checksum, "sha256:")),
+		SizeBytes: model.ModelSizeBytes,
+		Signature: model.Signature,
+		Registry:  "internal",
+		Stage:     model.Stage,
+	}, nil
+}
+
+// resolveMLflowArtifact reads a registered model version from MLflow. The
+// checksum and signature come from the version's tags.
+func resolveMLflowArtifact(ctx context.Context, modelID, version string) (*ModelArtifact, error) {
+	base := strings.TrimRight(getEnv("MLFLOW_TRACKING_URI", "http://mlflow:5000"), "/")
+	query := url.Values{"name": {modelID}, "version": {version}}
+
+	var response struct {
+		ModelVersion struct {
+			Source       string `json:"source"`
+			Status       string `json:"status"`
+			CurrentStage string `json:"current_stage"`
+			Tags         []struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			} `json:"tags"`
+		} `json:"model_version"`
+	}
+	status, err := registryGet(ctx, base+"/api/2.0/mlflow/model-versions/get?"+query.Encode(), getEnv("MLFLOW_TRACKING_TOKEN", ""), &response)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case status == http.StatusNotFound:
+		return nil, &artifactError{fmt.Sprintf("model %s version %s not found in MLflow", modelID, version)}
+	case status != http.StatusOK:
+		return nil, fmt.Errorf("MLflow returned HTTP %d", status)
+	}
+	mv := response.ModelVersion
+	if mv.Status != "READY" {
+		return nil, &artifactError{fmt.Sprintf("model %s version %s is %s in MLflow", modelID, version, mv.Status)}
+	}
+	if mv.CurrentStage == "Archived" {
+		return nil, &artifactError{fmt.Sprintf("model %s version %s is archived", modelID, version)}
+	}
+
+	artifact := &ModelArtifact{URI: mv.Source, Registry: "mlflow", Stage: mv.CurrentStage}
+	checksumTag := getEnv("MLFLOW_CHECKSUM_TAG", "sha256")
+	for _, tag := range mv.Tags {
+		switch tag.Key {
+		case checksumTag:
+			artifact.SHA256 = strings.ToLower(strings.TrimPrefix(tag.Value, "sha256:"))
+		case "signature":
+			artifact.Signature = tag.Value
+		}
+	}
+	// Artifacts proxied by the tracking server are fetched through it
+	if path, ok := strings.CutPrefix(artifact.URI, "mlflow-artifacts:"); ok {
+		artifact.URI = base + "/api/2.0/mlflow-artifacts/artifacts/" + strings.TrimLeft(path, "/")
+	}
+	return artifact, nil
+}
+
+// verifyArtifact checks an artifact's checksum and, with a signing key
+// configured, its signature
+func verifyArtifact(modelID, version string, artifact *ModelArtifact) error {
+	if artifact.SHA256 == "" {
+		if getEnv("MODEL_REQUIRE_CHECKSUM", "true") == "true" {
+			return &artifactError{fmt.Sprintf("model %s version %s has no SHA-256 checksum", modelID, version)}
+		}
+	} else if !sha256Pattern.MatchString(artifact.SHA256) {
+		return &artifactError{fmt.Sprintf("model %s version %s has an invalid SHA-256 checksum", modelID, version)}
+	}
+
+	encodedKey := getEnv("MODEL_SIGNING_PUBLIC_KEY", "")
+	if encodedKey == "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("MODEL_SIGNING_PUBLIC_KEY is not a base64 Ed25519 public key")
+	}
+	if artifact.Signature == "" {
+		return &artifactError{fmt.Sprintf("model %s version %s is not signed", modelID, version)}
+	}
+	signature, err := base64.StdEncoding.DecodeString(artifact.Signature)
+	if err != nil {
+		return &artifactError{fmt.Sprintf("model %s version %s has a malformed signature", modelID, version)}
+	}
+	message := []byte(modelID + ":" + version + ":" + artifact.SHA256)
+	if !ed25519.Verify(ed25519.PublicKey(key), message, signature) {
+		return &artifactError{fmt.Sprintf("signature of model %s version %s does not verify", modelID, version)}
+	}
+	return nil
+}
+
+// resolveDeploymentArtifact fills in where a new deployment's model comes
+// from
+func resolveDeploymentArtifact(ctx context.Context, deployment *ModelDeployment) error {
+	switch deployment.ModelSource {
+	case ModelSourceNone:
+		if deployment.ArtifactURI != "" {
+			return &artifactError{"artifact_uri needs model_source uri"}
+		}
+		return nil
+	case ModelSourceRegistry:
+		artifact, err := resolveModelArtifact(ctx, deployment.ModelID, deployment.ModelVersion)
+		if err != nil {
+			return err
+		}
+		deployment.ArtifactURI = artifact.URI
+		deployment.ArtifactSHA256 = artifact.SHA256
+		deployment.ArtifactSizeBytes = artifact.SizeBytes
+		deployment.ArtifactSignature = artifact.Signature
+		deployment.ArtifactRegistry = artifact.Registry
+		return nil
+	case ModelSourceURI:
+		if deployment.ArtifactURI == "" {
+			return &artifactError{"model_source uri needs artifact_uri"}
+		}
+		deployment.ArtifactSHA256 = strings.ToLower(deployment.ArtifactSHA256)
+		deployment.ArtifactRegistry = ""
+		artifact := &ModelArtifact{URI: deployment.ArtifactURI, SHA256: deployment.ArtifactSHA256, Signature: deployment.ArtifactSignature}
+		return verifyArtifact(deployment.ModelID, deployment.ModelVersion, artifact)
+	default:
+		return &artifactError{fmt.Sprintf("unknown model_source %q", deployment.ModelSource)}
+	}
+}
+
+// respondArtifactError answers a request whose model artifact couldn't be
+// resolved
+func (ds *ModelDeploymentService) respondArtifactError(c *gin.Context, deployment *ModelDeployment, err error) {
+	var invalid *artifactError
+	if errors.As(err, &invalid) {
+		c.JSON(422, gin.H{"error": err.Error()})
+		return
+	}
+	ds.logger.Error("Failed to resolve model artifact",
+		zap.String("model_id", deployment.ModelID),
+		zap.Error(err))
+	c.JSON(502, gin.H{"error": "Failed to resolve model artifact"})
+}
+
+// versionArtifact is the artifact of another version of a deployment's
+// model, nil when the deployment doesn't pull artifacts
+func versionArtifact(ctx context.Context, deployment *ModelDeployment, version string) (*ModelArtifact, error) {
+	switch deployment.ModelSource {
+	case ModelSourceRegistry:
+		return resolveModelArtifact(ctx, deployment.ModelID, version)
+	case ModelSourceURI:
+		if version != deployment.ModelVersion {
+			return nil, &artifactError{"changing the model version needs model_source registry"}
+		}
+		return deployedArtifact(deployment), nil
+	default:
+		return nil, nil
+	}
+}
+
+// deployedArtifact is the artifact a deployment's stable pods pull
+func deployedArtifact(deployment *ModelDeployment) *ModelArtifact {
+	if deployment.ArtifactURI == "" {
+		return nil
+	}
+	return &ModelArtifact{URI: deployment.ArtifactURI, SHA256: deployment.ArtifactSHA256, SizeBytes: deployment.ArtifactSizeBytes}
+}
+
+// canaryArtifact is the artifact a canary's version pulls
+func canaryArtifact(canary *CanaryRelease) *ModelArtifact {
+	if canary.ArtifactURI == "" {
+		return nil
+	}
+	return &ModelArtifact{URI: canary.ArtifactURI, SHA256: canary.ArtifactSHA256, SizeBytes: canary.ArtifactSizeBytes}
+}
+
+// applyModelArtifact adds the init container that pulls the deployment's
+// artifact and the volume it shares with the model server
+func applyModelArtifact(template *corev1.PodTemplateSpec, deployment *ModelDeployment) {
+	if deployment.ArtifactURI == "" {
+		return
+	}
+	spec := &template.Spec
+
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name:         modelStoreName,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{SizeLimit: modelStoreLimit(deployment.ArtifactSizeBytes)}},
+	})
+
+	puller := corev1.Container{
+		Name:  modelPullerName,
+		Image: getEnv("MODEL_PULLER_IMAGE", "002aic/model-puller:latest"),
+		Env: []corev1.EnvVar{
+			{Name: "MODEL_ID", Value: deployment.ModelID},
+			{Name: "MODEL_VERSION", Value: deployment.ModelVersion},
+			{Name: "ARTIFACT_URI", Value: deployment.ArtifactURI},
+			{Name: "ARTIFACT_SHA256", Value: deployment.ArtifactSHA256},
+			{Name: "MODEL_DIR", Value: modelStorePath},
+		},
+		VolumeMounts: []corev1.VolumeMount{{Name: modelStoreName, MountPath: modelStorePath}},
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    parseQuantity("100m"),
+				corev1.ResourceMemory: parseQuantity("256Mi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceMemory: parseQuantity("1Gi"),
+			},
+		},
+	}
+	if secret := getEnv("MODEL_ARTIFACT_CREDENTIALS_SECRET", ""); secret != "" {
+		optional := true
+		puller.EnvFrom = []corev1.EnvFromSource{{
+			SecretRef: &corev1.SecretEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+				Optional:             &optional,
+			},
+		}}
+	}
+	spec.InitContainers = append(spec.InitContainers, puller)
+
+	for i := range spec.Containers {
+		container := &spec.Containers[i]
+		if container.Name != "model-server" {
+			continue
+		}
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{Name: modelStoreName, MountPath: modelStorePath, ReadOnly: true})
+		container.Env = append(container.Env, corev1.EnvVar{Name: "MODEL_PATH", Value: modelStorePath})
+	}
+}
+
+// modelStoreLimit leaves room for an artifact and whatever it unpacks to;
+// nil when its size is unknown
+func modelStoreLimit(sizeBytes int64) *resource.Quantity {
+	if sizeBytes <= 0 {
+		return nil
+	}
+	return resource.NewQuantity(3*sizeBytes+(1<<30), resource.BinarySI)
+}
+
+// setModelArtifact points a pod template's model puller at an artifact
+func setModelArtifact(template *corev1.PodTemplateSpec, artifact *ModelArtifact, version string) {
+	for i := range template.Spec.Volumes {
+		volume := &template.Spec.Volumes[i]
+		if volume.Name == modelStoreName && volume.EmptyDir != nil {
+			volume.EmptyDir.SizeLimit = modelStoreLimit(artifact.SizeBytes)
+		}
+	}
+	for i := range template.Spec.InitContainers {
+		container := &template.Spec.InitContainers[i]
+		if container.Name != modelPullerName {
+			continue
+		}
+		for j := range container.Env {
+			switch container.Env[j].Name {
+			case "ARTIFACT_URI":
+				container.Env[j].Value = artifact.URI
+			case "ARTIFACT_SHA256":
+				container.Env[j].Value = artifact.SHA256
+			case "MODEL_VERSION":
+				container.Env[j].Value = version
+			}
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Deployment revisions. Every change to what a deployment's pods run, its
+// image, model version and artifact, resources, placement or config, is
+// kept as a numbered revision, starting at 1 when the deployment is
+// created. Scaling is not a revision. Rolling back to a revision rebuilds
+// the pods from its spec and records that as a new revision, so history
+// is never rewritten.
+
+// Revision sources
+const (
+	RevisionSourceCreate   = "create"
+	RevisionSourceCanary   = "canary-promotion"
+	RevisionSourceRollback = "rollback"
+)
+
+// RevisionSpec is what a revision runs
+type RevisionSpec struct {
+	ModelID           string                 `json:"model_id"`
+	ModelVersion      string                 `json:"model_version"`
+	Framework         string                 `json:"framework"`
+	Image             string                 `json:"image"`
+	CPU               string                 `json:"cpu"`
+	Memory            string                 `json:"memory"`
+	GPU               int                    `json:"gpu"`
+	GPUType           string                 `json:"gpu_type"`
+	GPUSharing        string                 `json:"gpu_sharing"`
+	GPUMIGProfile     string                 `json:"gpu_mig_profile"`
+	GPUFraction       float64                `json:"gpu_fraction"`
+	NodeSelector      map[string]string      `json:"node_selector"`
+	Tolerations       []DeploymentToleration `json:"tolerations"`
+	ModelSource       string                 `json:"model_source"`
+	ArtifactURI       string                 `json:"artifact_uri"`
+	ArtifactSHA256    string                 `json:"artifact_sha256"`
+	ArtifactSizeBytes int64                  `json:"artifact_size_bytes"`
+	InferencePath     string                 `json:"inference_path"`
+	StreamPath        string                 `json:"stream_path"`
+	StreamProtocol    string                 `json:"stream_protocol"`
+	Config            string                 `json:"config"`
+}
+
+// DeploymentRevision is one version of a deployment's spec
+type DeploymentRevision struct {
+	ID             uint         `json:"id" gorm:"primaryKey"`
+	DeploymentID   uint         `json:"deployment_id" gorm:"uniqueIndex:idx_deployment_revision;not null"`
+	Revision       int          `json:"revision" gorm:"uniqueIndex:idx_deployment_revision;not null"`
+	Spec           RevisionSpec `json:"spec" gorm:"type:jsonb;serializer:json"`
+	Changes        []string     `json:"changes" gorm:"type:jsonb;serializer:json"` // spec fields changed from the revision before
+	Source         string       `json:"source"`
+	Reason         string       `json:"reason"`
+	RolledBackFrom int          `json:"rolled_back_from,omitempty"` // the revision a rollback went back to
+	CreatedBy      string       `json:"created_by"`
+	CreatedAt      time.Time    `json:"created_at"`
+}
+
+var deploymentRollbacks = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "model_deployment_rollbacks_total",
+		Help: "Rollbacks of deployments to earlier revisions, by status",
+	},
+	[]string{"deployment", "status"},
+)
+
+// revisionSpec captures what a deployment runs
+func revisionSpec(deployment *ModelDeployment) RevisionSpec {
+	return RevisionSpec{
+		ModelID:           deployment.ModelID,
+		ModelVersion:      deployment.ModelVersion,
+		Framework:         deployment.Framework,
+		Image:             servingImage(deployment.Framework),
+		CPU:               deployment.CPU,
+		Memory:            deployment.Memory,
+		GPU:               deployment.GPU,
+		GPUType:           deployment.GPUType,
+		GPUSharing:        deployment.GPUSharing,
+		GPUMIGProfile:     deployment.GPUMIGProfile,
+		GPUFraction:       deployment.GPUFraction,
+		NodeSelector:      deployment.NodeSelector,
+		Tolerations:       deployment.Tolerations,
+		ModelSource:       deployment.ModelSource,
+		ArtifactURI:       deployment.ArtifactURI,
+		ArtifactSHA256:    deployment.ArtifactSHA256,
+		ArtifactSizeBytes: deployment.ArtifactSizeBytes,
+		InferencePath:     deployment.InferencePath,
+		StreamPath:        deployment.StreamPath,
+		StreamProtocol:    deployment.StreamProtocol,
+		Config:            deployment.Config,
+	}
+}
+
+// applyRevisionSpec sets a deployment back to what a revision ran
+func applyRevisionSpec(deployment *ModelDeployment, spec RevisionSpec) {
+	deployment.ModelID = spec.ModelID
+	deployment.ModelVersion = spec.ModelVersion
+	deployment.Framework = spec.Framework
+	deployment.CPU = spec.CPU
+	deployment.Memory = spec.Memory
+	deployment.GPU = spec.GPU
+	deployment.GPUType = spec.GPUType
+	deployment.GPUSharing = spec.GPUSharing
+	deployment.GPUMIGProfile = spec.GPUMIGProfile
+	deployment.GPUFraction = spec.GPUFraction
+	deployment.NodeSelector = spec.NodeSelector
+	deployment.Tolerations = spec.Tolerations
+	deployment.ModelSource = spec.ModelSource
+	deployment.ArtifactURI = spec.ArtifactURI
+	deployment.ArtifactSHA256 = spec.ArtifactSHA256
+	deployment.ArtifactSizeBytes = spec.ArtifactSizeBytes
+	deployment.InferencePath = spec.InferencePath
+	deployment.StreamPath = spec.StreamPath
+	deployment.StreamProtocol = spec.StreamProtocol
+	deployment.Config = spec.Config
+}
+
+// specChanges lists the fields two specs differ in, by JSON name
+func specChanges(previous, current RevisionSpec) []string {
+	var before, after map[string]interface{}
+	encoded, _ := json.Marshal(previous)
+	json.Unmarshal(encoded, &before)
+	encoded, _ = json.Marshal(current)
+	json.Unmarshal(encoded, &after)
+
+	changes := []string{}
+	for field, value := range after {
+		if !reflect.DeepEqual(before[field], value) {
+			changes = append(changes, field)
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// recordRevision adds a revision for the deployment's current spec, unless
+// it is the spec of its latest revision
+func (ds *ModelDeploymentService) recordRevision(deployment *ModelDeployment, source, reason, user string, rolledBackFrom int) (*DeploymentRevision, error) {
+	revision := DeploymentRevision{
+		DeploymentID:   deployment.ID,
+		Spec:           revisionSpec(deployment),
+		Source:         source,
+		Reason:         reason,
+		RolledBackFrom: rolledBackFrom,
+		CreatedBy:      user,
+		CreatedAt:      time.Now(),
+	}
+
+	err := ds.db.Transaction(func(tx *gorm.DB) error {
+		var latest DeploymentRevision
+		err := tx.Where("deployment_id = ?", deployment.ID).Order("revision DESC").First(&latest).Error
+		switch {
+		case err == gorm.ErrRecordNotFound:
+			revision.Revision = 1
+			revision.Changes = []string{}
+		case err != nil:
+			return err
+		default:
+			revision.Changes = specChanges(latest.Spec, revision.Spec)
+			if len(revision.Changes) == 0 {
+				revision = latest
+				return nil
+			}
+			revision.Revision = latest.Revision + 1
+		}
+		if err := tx.Create(&revision).Error; err != nil {
+			return err
+		}
+		return tx.Model(deployment).Update("revision", revision.Revision).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	deployment.Revision = revision.Revision
+	return &revision, nil
+}
+
+// Deployment revision history
+func (ds *ModelDeploymentService) listRevisions(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+
+	var revisions []DeploymentRevision
+	if err := ds.db.Where("deployment_id = ?", deployment.ID).Order("revision DESC").Find(&revisions).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to list revisions"})
+		return
+	}
+	c.JSON(200, gin.H{"revisions": revisions, "current_revision": deployment.Revision})
+}
+
+func (ds *ModelDeploymentService) getRevision(c *gin.Context) {
+	number, err := strconv.Atoi(c.Param("revision"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid revision"})
+		return
+	}
+	var revision DeploymentRevision
+	if err := ds.db.Where("deployment_id = ? AND revision = ?", c.Param("id"), number).First(&revision).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Revision not found"})
+		return
+	}
+	c.JSON(200, revision)
+}
+
+// Roll a deployment back to an earlier revision, by default the one
+// before the current
+func (ds *ModelDeploymentService) rollbackDeployment(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+
+	var request struct {
+		Revision int    `json:"revision" binding:"min=0"`
+		Reason   string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if _, err := ds.activeCanary(deployment.ID); err == nil {
+		c.JSON(409, gin.H{"error": "Deployment has a canary; roll the canary back instead"})
+		return
+	} else if err != gorm.ErrRecordNotFound {
+		c.JSON(500, gin.H{"error": "Failed to check canaries"})
+		return
+	}
+
+	var target DeploymentRevision
+	query := ds.db.Where("deployment_id = ?", deployment.ID)
+	if request.Revision > 0 {
+		query = query.Where("revision = ?", request.Revision)
+	} else {
+		query = query.Where("revision < ?", deployment.Revision).Order("revision DESC")
+	}
+	if err := query.First(&target).Error; err != nil {
+		c.JSON(404, gin.H{"error": "No revision to roll back to"})
+		return
+	}
+	if target.Revision == deployment.Revision {
+		c.JSON(400, gin.H{"error": "Deployment already runs this revision"})
+		return
+	}
+
+	previousRevision := deployment.Revision
+	applyRevisionSpec(&deployment, target.Spec)
+	if err := validateScheduling(&deployment); err != nil {
+		c.JSON(422, gin.H{"error": "Revision is no longer valid: " + err.Error()})
+		return
+	}
+
+	ctx := context.TODO()
+	k8sDeployment, err := ds.k8sClient.AppsV1().Deployments(namespaceOf(&deployment)).Get(ctx, deployment.Name, metav1.GetOptions{})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to get deployment"})
+		return
+	}
+	k8sDeployment.Spec.Template = podTemplate(&deployment)
+	if _, err := ds.k8sClient.AppsV1().Deployments(namespaceOf(&deployment)).Update(ctx, k8sDeployment, metav1.UpdateOptions{}); err != nil {
+		deploymentRollbacks.WithLabelValues(deployment.Name, "failed").Inc()
+		ds.logger.Error("Failed to roll back deployment", zap.String("name", deployment.Name), zap.Error(err))
+		c.JSON(500, gin.H{"error": "Failed to roll back deployment"})
+		return
+	}
+
+	deployment.UpdatedAt = time.Now()
+	if err := ds.db.Save(&deployment).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save deployment"})
+		return
+	}
+	reason := request.Reason
+	if reason == "" {
+		reason = "rolled back to revision " + strconv.Itoa(target.Revision)
+	}
+	revision, err := ds.recordRevision(&deployment, RevisionSourceRollback, reason, c.GetHeader("X-User-ID"), target.Revision)
+	if err != nil {
+		ds.logger.Error("Failed to record revision", zap.String("name", deployment.Name), zap.Error(err))
+	}
+	deploymentRollbacks.WithLabelValues(deployment.Name, "success").Inc()
+
+	ds.logger.Info("Deployment rolled back",
+		zap.String("name", deployment.Name),
+		zap.Int("from_revision", previousRevision),
+		zap.Int("to_revision", target.Revision))
+
+	c.JSON(200, gin.H{
+		"message":        "Deployment rolled back",
+		"deployment":     deployment,
+		"revision":       revision,
+		"rolled_back_to": target.Revision,
+	})
+}
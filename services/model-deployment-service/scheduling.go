@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Pod placement and GPU sharing. A deployment may pin its pods with
+// NodeSelector and Tolerations, and pick GPUs by GPUType, the product as
+// labelled by GPU feature discovery (several types separated by commas
+// schedule onto any of them).
+//
+// GPUs are whole and exclusive unless GPUSharing says otherwise:
+//
+//   - "mig": GPU instances of GPUMIGProfile (e.g. 1g.10gb), requested as
+//     nvidia.com/mig-<profile> from a device plugin running the mixed MIG
+//     strategy
+//   - "time-slicing": slices of GPUs the device plugin shares by time,
+//     requested as GPU_SHARED_RESOURCE on nodes labelled with the
+//     time-slicing strategy. GPUFraction is the share of a GPU the model
+//     needs; it is passed to the pod as an annotation for schedulers that
+//     pack by it and is what the deployment is charged for
+//
+// GPU counts how many devices, instances or slices each replica gets. Pods
+// with GPUs tolerate the GPU node taint, GPU_TOLERATION_KEY.
+
+// GPU sharing modes
+const (
+	GPUSharingNone        = ""
+	GPUSharingMIG         = "mig"
+	GPUSharingTimeSlicing = "time-slicing"
+)
+
+// migComputeSlices is how many compute slices make up a whole MIG-capable GPU
+const migComputeSlices = 7
+
+var migProfilePattern = regexp.MustCompile(`^([1-7])g\.[0-9]+gb(\+me)?$`)
+
+// DeploymentToleration lets a deployment's pods onto tainted nodes
+type DeploymentToleration struct {
+	Key               string `json:"key"`
+	Operator          string `json:"operator"` // Equal or Exists
+	Value             string `json:"value"`
+	Effect            string `json:"effect"` // NoSchedule, PreferNoSchedule or NoExecute; empty: all
+	TolerationSeconds *int64 `json:"toleration_seconds,omitempty"`
+}
+
+// validateScheduling checks a deployment's placement and GPU settings
+func validateScheduling(deployment *ModelDeployment) error {
+	if deployment.GPU < 0 {
+		return fmt.Errorf("gpu cannot be negative")
+	}
+	for key := range deployment.NodeSelector {
+		if key == "" {
+			return fmt.Errorf("node selector keys cannot be empty")
+		}
+	}
+	for _, toleration := range deployment.Tolerations {
+		switch toleration.Operator {
+		case "", string(corev1.TolerationOpEqual):
+			if toleration.Key == "" {
+				return fmt.Errorf("tolerations with operator Equal need a key")
+			}
+		case string(corev1.TolerationOpExists):
+			if toleration.Value != "" {
+				return fmt.Errorf("tolerations with operator Exists cannot have a value")
+			}
+		default:
+			return fmt.Errorf("unknown toleration operator %q", toleration.Operator)
+		}
+		switch corev1.TaintEffect(toleration.Effect) {
+		case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			return fmt.Errorf("unknown toleration effect %q", toleration.Effect)
+		}
+		if toleration.TolerationSeconds != nil && toleration.Effect != string(corev1.TaintEffectNoExecute) {
+			return fmt.Errorf("toleration_seconds only applies to NoExecute tolerations")
+		}
+	}
+
+	switch deployment.GPUSharing {
+	case GPUSharingNone:
+		if deployment.GPUMIGProfile != "" || deployment.GPUFraction != 0 {
+			return fmt.Errorf("gpu_mig_profile and gpu_fraction need gpu_sharing")
+		}
+	case GPUSharingMIG:
+		if deployment.GPU == 0 {
+			return fmt.Errorf("MIG sharing needs gpu set to the number of GPU instances")
+		}
+		if !migProfilePattern.MatchString(deployment.GPUMIGProfile) {
+			return fmt.Errorf("invalid MIG profile %q, expected e.g. 1g.10gb", deployment.GPUMIGProfile)
+		}
+		if deployment.GPUFraction != 0 {
+			return fmt.Errorf("gpu_fraction does not apply to MIG; the profile sets the share")
+		}
+	case GPUSharingTimeSlicing:
+		if deployment.GPU == 0 {
+			return fmt.Errorf("time-slicing needs gpu set to the number of GPU slices")
+		}
+		if deployment.GPUMIGProfile != "" {
+			return fmt.Errorf("gpu_mig_profile does not apply to time-slicing")
+		}
+		if deployment.GPUFraction < 0 || deployment.GPUFraction > 1 {
+			return fmt.Errorf("gpu_fraction must be between 0 and 1")
+		}
+	default:
+		return fmt.Errorf("unknown gpu_sharing %q", deployment.GPUSharing)
+	}
+	return nil
+}
+
+// gpuResourceName is the extended resource the deployment's GPUs come as
+func gpuResourceName(deployment *ModelDeployment) corev1.ResourceName {
+	switch deployment.GPUSharing {
+	case GPUSharingMIG:
+		return corev1.ResourceName("nvidia.com/mig-" + deployment.GPUMIGProfile)
+	case GPUSharingTimeSlicing:
+		return corev1.ResourceName(getEnv("GPU_SHARED_RESOURCE", "nvidia.com/gpu.shared"))
+	default:
+		return "nvidia.com/gpu"
+	}
+}
+
+// gpuShare is how many physical GPUs one replica takes up
+func gpuShare(deployment *ModelDeployment) float64 {
+	gpus := float64(deployment.GPU)
+	switch deployment.GPUSharing {
+	case GPUSharingMIG:
+		match := migProfilePattern.FindStringSubmatch(deployment.GPUMIGProfile)
+		if match == nil {
+			return gpus
+		}
+		slices, _ := strconv.Atoi(match[1])
+		return gpus * float64(slices) / migComputeSlices
+	case GPUSharingTimeSlicing:
+		if deployment.GPUFraction > 0 {
+			return gpus * deployment.GPUFraction
+		}
+		return gpus / float64(getEnvInt("GPU_TIME_SLICE_REPLICAS", 4))
+	default:
+		return gpus
+	}
+}
+
+// applyScheduling places a deployment's pods and gives them their GPUs
+func applyScheduling(template *corev1.PodTemplateSpec, deployment *ModelDeployment) {
+	spec := &template.Spec
+
+	if len(deployment.NodeSelector) > 0 {
+		if spec.NodeSelector == nil {
+			spec.NodeSelector = map[string]string{}
+		}
+		for key, value := range deployment.NodeSelector {
+			spec.NodeSelector[key] = value
+		}
+	}
+	for _, toleration := range deployment.Tolerations {
+		operator := corev1.TolerationOperator(toleration.Operator)
+		if operator == "" {
+			operator = corev1.TolerationOpEqual
+		}
+		spec.Tolerations = append(spec.Tolerations, corev1.Toleration{
+			Key:               toleration.Key,
+			Operator:          operator,
+			Value:             toleration.Value,
+			Effect:            corev1.TaintEffect(toleration.Effect),
+			TolerationSeconds: toleration.TolerationSeconds,
+		})
+	}
+
+	if deployment.GPU == 0 {
+		return
+	}
+
+	resource := gpuResourceName(deployment)
+	quantity := parseQuantity(strconv.Itoa(deployment.GPU))
+	for i := range spec.Containers {
+		container := &spec.Containers[i]
+		if container.Name != "model-server" {
+			continue
+		}
+		if container.Resources.Requests == nil {
+			container.Resources.Requests = corev1.ResourceList{}
+		}
+		if container.Resources.Limits == nil {
+			container.Resources.Limits = corev1.ResourceList{}
+		}
+		container.Resources.Requests[resource] = quantity
+		container.Resources.Limits[resource] = quantity
+	}
+
+	if key := getEnv("GPU_TOLERATION_KEY", "nvidia.com/gpu"); key != "" {
+		spec.Tolerations = append(spec.Tolerations, corev1.Toleration{
+			Key:      key,
+			Operator: corev1.TolerationOpExists,
+			Effect:   corev1.TaintEffectNoSchedule,
+		})
+	}
+
+	if deployment.GPUType != "" {
+		productLabel := getEnv("GPU_TYPE_NODE_LABEL", "nvidia.com/gpu.product")
+		var types []string
+		for _, gpuType := range strings.Split(deployment.GPUType, ",") {
+			if gpuType = strings.TrimSpace(gpuType); gpuType != "" {
+				types = append(types, gpuType)
+			}
+		}
+		if len(types) == 1 {
+			if spec.NodeSelector == nil {
+				spec.NodeSelector = map[string]string{}
+			}
+			spec.NodeSelector[productLabel] = types[0]
+		} else if len(types) > 1 {
+			spec.Affinity = &corev1.Affinity{
+				NodeAffinity: &corev1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+						NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+							MatchExpressions: []corev1.NodeSelectorRequirement{{
+								Key:      productLabel,
+								Operator: corev1.NodeSelectorOpIn,
+								Values:   types,
+							}},
+						}},
+					},
+				},
+			}
+		}
+	}
+
+	if deployment.GPUSharing == GPUSharingTimeSlicing {
+		if spec.NodeSelector == nil {
+			spec.NodeSelector = map[string]string{}
+		}
+		spec.NodeSelector[getEnv("GPU_SHARING_NODE_LABEL", "nvidia.com/gpu.sharing-strategy")] = GPUSharingTimeSlicing
+	}
+	for key, value := range gpuAnnotations(deployment) {
+		if template.Annotations == nil {
+			template.Annotations = map[string]string{}
+		}
+		template.Annotations[key] = value
+	}
+}
+
+// gpuAnnotations tell fractional GPU schedulers what a pod shares
+func gpuAnnotations(deployment *ModelDeployment) map[string]string {
+	if deployment.GPU == 0 || deployment.GPUSharing != GPUSharingTimeSlicing {
+		return nil
+	}
+	annotations := map[string]string{"nvidia.com/gpu-sharing": GPUSharingTimeSlicing}
+	if deployment.GPUFraction > 0 {
+		annotations[getEnv("GPU_FRACTION_ANNOTATION", "gpu-fraction")] = strconv.FormatFloat(deployment.GPUFraction, 'f', -1, 64)
+	}
+	return annotations
+}
@@ -0,0 +1,675 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// Streaming inference. /v1/deployments/:id/stream relays a model's output
+// as it is generated, token by token: to callers POSTing to it as
+// server-sent events, and to callers opening a WebSocket on it as one text
+// message per token, after their first message, which is the request.
+//
+// The model server streams over StreamProtocol: "sse", the default, takes
+// the request as a POST to StreamPath (InferencePath when unset) and answers
+// with text/event-stream or application/x-ndjson; "websocket" takes a
+// WebSocket on StreamPath and gets the request as its first message.
+// WebSocket callers' later messages are passed on to a WebSocket model
+// server, for models that take input mid-stream.
+//
+// A stream ends when the model server ends it, when it sends nothing for
+// STREAM_IDLE_TIMEOUT_SECONDS, or when it is cancelled: by the caller going
+// away, by a WebSocket caller sending {"type":"cancel"}, or through
+// /streams/:stream_id/cancel with the ID answered in X-Stream-ID. The model
+// server's connection is closed as soon as the stream ends, so it can stop
+// generating.
+
+// Stream protocols of model servers
+const (
+	StreamProtocolSSE       = "sse"
+	StreamProtocolWebSocket = "websocket"
+)
+
+// Stream transports to callers
+const (
+	streamTransportSSE       = "sse"
+	streamTransportWebSocket = "websocket"
+)
+
+// Stream outcomes
+const (
+	streamCompleted   = "completed"
+	streamCancelled   = "cancelled"
+	streamIdleTimeout = "idle_timeout"
+	streamError       = "error"
+)
+
+const streamIDHeader = "X-Stream-ID"
+
+var (
+	streamsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_inference_streams_total",
+			Help: "Inference streams, by transport and outcome",
+		},
+		[]string{"deployment", "transport", "outcome"},
+	)
+	activeStreams = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "model_inference_active_streams",
+			Help: "Inference streams in progress",
+		},
+		[]string{"deployment"},
+	)
+	streamTokens = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "model_inference_stream_tokens_total",
+			Help: "Tokens relayed on inference streams",
+		},
+		[]string{"deployment"},
+	)
+	timeToFirstToken = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "model_inference_time_to_first_token_seconds",
+			Help:    "Time from a stream's request to its first token",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30},
+		},
+		[]string{"deployment"},
+	)
+	interTokenLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "model_inference_inter_token_seconds",
+			Help:    "Time between consecutive tokens of a stream",
+			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
+		},
+		[]string{"deployment"},
+	)
+)
+
+var streamUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true // Origins are checked at the gateway
+	},
+}
+
+// streamChunk is one token from the model server
+type streamChunk struct {
+	event []byte // as a server-sent event, ending in a blank line
+	data  []byte // the payload; nil for SSE comments and keep-alives
+}
+
+// streamUpstream reads a model server's stream; next returns io.EOF at its
+// end
+type streamUpstream interface {
+	next() (*streamChunk, error)
+	close()
+}
+
+// sseEvent wraps a payload as a server-sent event
+func sseEvent(data []byte) []byte {
+	var event bytes.Buffer
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		event.WriteString("data: ")
+		event.Write(line)
+		event.WriteByte('\n')
+	}
+	event.WriteByte('\n')
+	return event.Bytes()
+}
+
+// sseUpstream reads server-sent events, or NDJSON lines, from a response
+type sseUpstream struct {
+	resp   *http.Response
+	reader *bufio.Reader
+	ndjson bool
+	cancel context.CancelFunc
+}
+
+func (u *sseUpstream) next() (*streamChunk, error) {
+	if u.ndjson {
+		for {
+			line, err := u.reader.ReadBytes('\n')
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				return &streamChunk{event: sseEvent(line), data: line}, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var event bytes.Buffer
+	var data [][]byte
+	for {
+		line, err := u.reader.ReadBytes('\n')
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 && len(line) > 0 {
+			if event.Len() == 0 {
+				continue
+			}
+			event.WriteByte('\n')
+			break
+		}
+		if len(trimmed) > 0 {
+			event.Write(trimmed)
+			event.WriteByte('\n')
+			if payload, ok := bytes.CutPrefix(trimmed, []byte("data:")); ok {
+				data = append(data, bytes.TrimPrefix(payload, []byte(" ")))
+			}
+		}
+		if err != nil {
+			if event.Len() == 0 {
+				return nil, err
+			}
+			event.WriteByte('\n')
+			break
+		}
+	}
+	chunk := &streamChunk{event: event.Bytes()}
+	if data != nil {
+		chunk.data = bytes.Join(data, []byte("\n"))
+	}
+	return chunk, nil
+}
+
+func (u *sseUpstream) close() {
+	u.resp.Body.Close()
+	u.cancel()
+}
+
+// wsUpstream reads a model server's WebSocket, a message per token
+type wsUpstream struct {
+	conn *websocket.Conn
+}
+
+func (u *wsUpstream) next() (*streamChunk, error) {
+	_, message, err := u.conn.ReadMessage()
+	if err != nil {
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return &streamChunk{event: sseEvent(message), data: message}, nil
+}
+
+func (u *wsUpstream) close() {
+	u.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	u.conn.Close()
+}
+
+// upstreamError is a model server refusing a stream
+type upstreamError struct {
+	status int
+	detail interface{}
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("model server answered %d", e.status)
+}
+
+// activeStream is a stream in progress
+type activeStream struct {
+	ID           string    `json:"id"`
+	DeploymentID uint      `json:"deployment_id"`
+	Transport    string    `json:"transport"`
+	StartedAt    time.Time `json:"started_at"`
+	Tokens       int64     `json:"tokens"`
+
+	cancel    context.CancelFunc
+	cancelled int32
+}
+
+func (s *activeStream) stop() {
+	atomic.StoreInt32(&s.cancelled, 1)
+	s.cancel()
+}
+
+// streamRegistry tracks the streams in progress, for cancelling them
+type streamRegistry struct {
+	mutex   sync.Mutex
+	streams map[string]*activeStream
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{streams: make(map[string]*activeStream)}
+}
+
+func (r *streamRegistry) add(stream *activeStream) {
+	r.mutex.Lock()
+	r.streams[stream.ID] = stream
+	r.mutex.Unlock()
+}
+
+func (r *streamRegistry) remove(id string) {
+	r.mutex.Lock()
+	delete(r.streams, id)
+	r.mutex.Unlock()
+}
+
+func (r *streamRegistry) get(id string) (*activeStream, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stream, ok := r.streams[id]
+	return stream, ok
+}
+
+func (r *streamRegistry) list(deploymentID uint) []activeStream {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	list := []activeStream{}
+	for _, stream := range r.streams {
+		if stream.DeploymentID == deploymentID {
+			list = append(list, activeStream{
+				ID:           stream.ID,
+				DeploymentID: stream.DeploymentID,
+				Transport:    stream.Transport,
+				StartedAt:    stream.StartedAt,
+				Tokens:       atomic.LoadInt64(&stream.Tokens),
+			})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+func newStreamID() string {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// streamPath is where the deployment's model server streams
+func streamPath(deployment *ModelDeployment) string {
+	if deployment.StreamPath != "" {
+		return deployment.StreamPath
+	}
+	return inferencePath(deployment)
+}
+
+// openStream starts the model server's stream for a request. Connection
+// failures and 502, 503 and 504 answers are retried as for predictions.
+func (ds *ModelDeploymentService) openStream(ctx context.Context, c *gin.Context, deployment *ModelDeployment, body []byte, contentType string) (streamUpstream, error) {
+	header := http.Header{}
+	if requestID := c.GetHeader("X-Request-ID"); requestID != "" {
+		header.Set("X-Request-ID", requestID)
+	}
+	if deployment.variant != nil {
+		header.Set(variantHeader, deployment.variant.name)
+	}
+	timeout := inferenceTimeout(deployment)
+
+	if deployment.StreamProtocol == StreamProtocolWebSocket {
+		dialer := websocket.Dialer{HandshakeTimeout: timeout}
+		target := "ws://" + inferenceHost(deployment) + streamPath(deployment)
+		var conn *websocket.Conn
+		var resp *http.Response
+		var err error
+		for attempt := 0; ; attempt++ {
+			conn, resp, err = dialer.DialContext(ctx, target, header)
+			retry := err != nil && (resp == nil || retryableStatus(resp.StatusCode))
+			if !retry || attempt >= deployment.InferenceMaxRetries || ctx.Err() != nil {
+				break
+			}
+			inferenceRetries.WithLabelValues(deployment.Name, "stream").Inc()
+			time.Sleep(retryDelay(attempt))
+		}
+		if err != nil {
+			if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+				return nil, &upstreamError{status: resp.StatusCode}
+			}
+			return nil, err
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, body); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &wsUpstream{conn: conn}, nil
+	}
+
+	header.Set("Content-Type", contentType)
+	header.Set("Accept", "text/event-stream")
+	target := "http://" + inferenceHost(deployment) + streamPath(deployment)
+	for attempt := 0; ; attempt++ {
+		// The timeout bounds the wait for the stream to start, not the stream
+		attemptCtx, cancel := context.WithCancel(ctx)
+		timer := time.AfterFunc(timeout, cancel)
+		req, _ := http.NewRequestWithContext(attemptCtx, http.MethodPost, target, bytes.NewReader(body))
+		req.Header = header.Clone()
+		resp, err := inferenceHTTPClient.Do(req)
+		timer.Stop()
+		lastAttempt := attempt >= deployment.InferenceMaxRetries || ctx.Err() != nil
+
+		if err == nil && (!retryableStatus(resp.StatusCode) || lastAttempt) {
+			if resp.StatusCode >= 300 {
+				defer cancel()
+				defer resp.Body.Close()
+				raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+				var detail interface{} = string(raw)
+				if json.Valid(raw) {
+					detail = json.RawMessage(raw)
+				}
+				return nil, &upstreamError{status: resp.StatusCode, detail: detail}
+			}
+			mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			return &sseUpstream{
+				resp:   resp,
+				reader: bufio.NewReaderSize(resp.Body, 64<<10),
+				ndjson: mediaType == "application/x-ndjson",
+				cancel: cancel,
+			}, nil
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		cancel()
+		if lastAttempt {
+			return nil, err
+		}
+		inferenceRetries.WithLabelValues(deployment.Name, "stream").Inc()
+		time.Sleep(retryDelay(attempt))
+	}
+}
+
+// pumpStream relays tokens to emit until the stream ends, recording their
+// latencies, and says how it ended
+func (ds *ModelDeploymentService) pumpStream(deployment *ModelDeployment, stream *activeStream, upstream streamUpstream, emit func(*streamChunk) error) (string, error) {
+	idleTimeout := time.Duration(getEnvInt("STREAM_IDLE_TIMEOUT_SECONDS", 60)) * time.Second
+	var idle int32
+	idleTimer := time.AfterFunc(idleTimeout, func() {
+		atomic.StoreInt32(&idle, 1)
+		stream.cancel()
+	})
+	defer idleTimer.Stop()
+
+	last := stream.StartedAt
+	for {
+		chunk, err := upstream.next()
+		if err != nil {
+			switch {
+			case atomic.LoadInt32(&stream.cancelled) == 1:
+				return streamCancelled, nil
+			case atomic.LoadInt32(&idle) == 1:
+				return streamIdleTimeout, nil
+			case err == io.EOF:
+				return streamCompleted, nil
+			case errors.Is(err, context.Canceled):
+				return streamCancelled, nil
+			}
+			return streamError, err
+		}
+		idleTimer.Reset(idleTimeout)
+
+		if chunk.data != nil {
+			now := time.Now()
+			if atomic.AddInt64(&stream.Tokens, 1) == 1 {
+				timeToFirstToken.WithLabelValues(deployment.Name).Observe(now.Sub(stream.StartedAt).Seconds())
+			} else {
+				interTokenLatency.WithLabelValues(deployment.Name).Observe(now.Sub(last).Seconds())
+			}
+			last = now
+			streamTokens.WithLabelValues(deployment.Name).Inc()
+		}
+		if err := emit(chunk); err != nil {
+			// The caller went away
+			return streamCancelled, nil
+		}
+	}
+}
+
+// beginStream registers a stream of a deployment
+func (ds *ModelDeploymentService) beginStream(ctx context.Context, deployment *ModelDeployment, transport string) (*activeStream, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream := &activeStream{
+		ID:           newStreamID(),
+		DeploymentID: deployment.ID,
+		Transport:    transport,
+		StartedAt:    time.Now(),
+		cancel:       cancel,
+	}
+	ds.streams.add(stream)
+	activeStreams.WithLabelValues(deployment.Name).Inc()
+	return stream, ctx
+}
+
+// endStream records how a stream ended
+func (ds *ModelDeploymentService) endStream(deployment *ModelDeployment, stream *activeStream, outcome string, err error) {
+	stream.cancel()
+	ds.streams.remove(stream.ID)
+	activeStreams.WithLabelValues(deployment.Name).Dec()
+	streamsTotal.WithLabelValues(deployment.Name, stream.Transport, outcome).Inc()
+
+	// Callers leaving is not the model's failure, as with relayed predictions
+	inferenceOutcome := "success"
+	switch outcome {
+	case streamIdleTimeout:
+		inferenceOutcome = "timeout"
+	case streamError:
+		inferenceOutcome = "error"
+	}
+	ds.recordInference(deployment, "stream", inferenceOutcome, time.Since(stream.StartedAt))
+
+	fields := []zap.Field{
+		zap.String("deployment", deployment.Name),
+		zap.String("stream_id", stream.ID),
+		zap.String("transport", stream.Transport),
+		zap.String("outcome", outcome),
+		zap.Int64("tokens", atomic.LoadInt64(&stream.Tokens)),
+		zap.Duration("duration", time.Since(stream.StartedAt)),
+	}
+	if err != nil {
+		ds.logger.Warn("Inference stream failed", append(fields, zap.Error(err))...)
+		return
+	}
+	ds.logger.Info("Inference stream ended", fields...)
+}
+
+// streamFailure answers a stream that could not start
+func (ds *ModelDeploymentService) streamFailure(deployment *ModelDeployment, err error) (int, gin.H) {
+	var refused *upstreamError
+	if errors.As(err, &refused) {
+		if refused.status >= 500 {
+			return 502, gin.H{"error": "Model server error", "status": refused.status, "detail": refused.detail, "deployment": deployment.Name}
+		}
+		return refused.status, gin.H{"error": "Model server rejected the request", "detail": refused.detail, "deployment": deployment.Name}
+	}
+	ds.logger.Warn("Failed to start inference stream", zap.String("deployment", deployment.Name), zap.Error(err))
+	return 502, gin.H{"error": "Model server unavailable", "deployment": deployment.Name}
+}
+
+// Stream a prediction, over server-sent events or a WebSocket
+func (ds *ModelDeploymentService) streamPredict(c *gin.Context) {
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		ds.streamWebSocket(c)
+		return
+	}
+	deployment, ok := ds.runningDeployment(c)
+	if !ok {
+		return
+	}
+
+	maxBody := int64(getEnvInt("INFERENCE_MAX_BODY_BYTES", 32<<20))
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxBody+1))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	if int64(len(body)) > maxBody {
+		c.JSON(413, gin.H{"error": "Request body too large", "max_body_bytes": maxBody})
+		return
+	}
+	contentType := c.GetHeader("Content-Type")
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/json" && !json.Valid(body) {
+		c.JSON(400, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	deployment = ds.routeExperiment(c, deployment)
+	if !ds.awaitWarm(c, deployment) {
+		return
+	}
+	ds.routeCanary(c, deployment)
+
+	stream, ctx := ds.beginStream(c.Request.Context(), deployment, streamTransportSSE)
+	upstream, err := ds.openStream(ctx, c, deployment, body, contentType)
+	if err != nil {
+		ds.endStream(deployment, stream, streamError, err)
+		c.JSON(ds.streamFailure(deployment, err))
+		return
+	}
+	defer upstream.close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Header(streamIDHeader, stream.ID)
+	c.Status(200)
+	c.Writer.Flush()
+
+	outcome, err := ds.pumpStream(deployment, stream, upstream, func(chunk *streamChunk) error {
+		if _, err := c.Writer.Write(chunk.event); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+	if outcome == streamError || outcome == streamIdleTimeout {
+		message, _ := json.Marshal(gin.H{"error": "Stream ended: " + outcome, "stream_id": stream.ID})
+		c.Writer.Write(append([]byte("event: error\n"), sseEvent(message)...))
+		c.Writer.Flush()
+	}
+	ds.endStream(deployment, stream, outcome, err)
+}
+
+// streamWebSocket streams a prediction over a WebSocket; the caller's
+// first message is the request
+func (ds *ModelDeploymentService) streamWebSocket(c *gin.Context) {
+	deployment, ok := ds.runningDeployment(c)
+	if !ok {
+		return
+	}
+	deployment = ds.routeExperiment(c, deployment)
+	if !ds.awaitWarm(c, deployment) {
+		return
+	}
+	ds.routeCanary(c, deployment)
+
+	stream, ctx := ds.beginStream(c.Request.Context(), deployment, streamTransportWebSocket)
+	conn, err := streamUpgrader.Upgrade(c.Writer, c.Request, http.Header{streamIDHeader: []string{stream.ID}})
+	if err != nil {
+		// The upgrader has answered the caller
+		ds.endStream(deployment, stream, streamError, err)
+		return
+	}
+	defer conn.Close()
+	closeWith := func(code int, text string) {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
+	}
+
+	conn.SetReadLimit(int64(getEnvInt("INFERENCE_MAX_BODY_BYTES", 32<<20)))
+	conn.SetReadDeadline(time.Now().Add(inferenceTimeout(deployment)))
+	_, body, err := conn.ReadMessage()
+	if err != nil {
+		ds.endStream(deployment, stream, streamCancelled, nil)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	upstream, err := ds.openStream(ctx, c, deployment, body, "application/json")
+	if err != nil {
+		_, response := ds.streamFailure(deployment, err)
+		message, _ := json.Marshal(response)
+		conn.WriteMessage(websocket.TextMessage, message)
+		closeWith(websocket.CloseTryAgainLater, "model server unavailable")
+		ds.endStream(deployment, stream, streamError, err)
+		return
+	}
+	defer upstream.close()
+
+	// The caller's messages: a cancel, or input for a WebSocket model server
+	go func() {
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				stream.stop()
+				return
+			}
+			var control struct {
+				Type string `json:"type"`
+			}
+			if json.Unmarshal(message, &control) == nil && control.Type == "cancel" {
+				stream.stop()
+				return
+			}
+			if ws, ok := upstream.(*wsUpstream); ok {
+				if err := ws.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	outcome, err := ds.pumpStream(deployment, stream, upstream, func(chunk *streamChunk) error {
+		if chunk.data == nil {
+			return nil
+		}
+		return conn.WriteMessage(websocket.TextMessage, chunk.data)
+	})
+	switch outcome {
+	case streamCompleted:
+		closeWith(websocket.CloseNormalClosure, "")
+	case streamCancelled:
+		closeWith(websocket.CloseNormalClosure, "cancelled")
+	case streamIdleTimeout:
+		closeWith(websocket.CloseGoingAway, "idle timeout")
+	default:
+		closeWith(websocket.CloseInternalServerErr, "model server stream failed")
+	}
+	ds.endStream(deployment, stream, outcome, err)
+}
+
+// Streams of a deployment in progress
+func (ds *ModelDeploymentService) listStreams(c *gin.Context) {
+	var deployment ModelDeployment
+	if err := ds.db.First(&deployment, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Deployment not found"})
+		return
+	}
+	c.JSON(200, gin.H{"streams": ds.streams.list(deployment.ID)})
+}
+
+// Cancel a stream mid-way
+func (ds *ModelDeploymentService) cancelStream(c *gin.Context) {
+	stream, ok := ds.streams.get(c.Param("stream_id"))
+	if !ok || fmt.Sprint(stream.DeploymentID) != strings.TrimSpace(c.Param("id")) {
+		c.JSON(404, gin.H{"error": "Stream not found"})
+		return
+	}
+	stream.stop()
+	c.JSON(200, gin.H{"message": "Stream cancelled", "stream_id": stream.ID, "tokens": atomic.LoadInt64(&stream.Tokens)})
+}
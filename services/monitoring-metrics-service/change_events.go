@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	"gorm.io/gorm/clause"
+)
+
+// Change events. Deployments, rollbacks, config changes, scaling and other
+// changes to a service are kept as annotations, so dashboards and the
+// metrics-service can mark on graphs what changed when. Services report
+// them with POST /v1/monitoring/annotations, or by publishing the same
+// JSON to the CHANGE_EVENTS_CHANNEL Redis channel when they don't want to
+// wait on the call; overridden deploy gate checks are recorded here too.
+//
+// An event reported again with the same source and source_id updates the
+// first one, so a deployment can be reported when it starts and again with
+// ends_at when it finishes. Events are kept for CHANGE_EVENT_RETENTION.
+
+// Change event kinds
+const (
+	ChangeKindDeployment  = "deployment"
+	ChangeKindRollback    = "rollback"
+	ChangeKindConfig      = "config"
+	ChangeKindScaling     = "scaling"
+	ChangeKindFeatureFlag = "feature_flag"
+	ChangeKindDeployGate  = "deploy_gate"
+	ChangeKindIncident    = "incident"
+	ChangeKindMaintenance = "maintenance"
+	ChangeKindOther       = "other"
+)
+
+var changeKinds = map[string]bool{
+	ChangeKindDeployment:  true,
+	ChangeKindRollback:    true,
+	ChangeKindConfig:      true,
+	ChangeKindScaling:     true,
+	ChangeKindFeatureFlag: true,
+	ChangeKindDeployGate:  true,
+	ChangeKindIncident:    true,
+	ChangeKindMaintenance: true,
+	ChangeKindOther:       true,
+}
+
+const (
+	defaultAnnotationRange = 24 * time.Hour
+	defaultAnnotationLimit = 500
+	maxAnnotationLimit     = 5000
+	maxAnnotationBatch     = 500
+)
+
+// ChangeEvent is one change to a service, shown as an annotation
+type ChangeEvent struct {
+	ID          uint              `json:"id" gorm:"primaryKey"`
+	Service     string            `json:"service" gorm:"index:idx_change_events_service_time,priority:1;not null"`
+	Environment string            `json:"environment" gorm:"index"`
+	Kind        string            `json:"kind" gorm:"index;not null"`
+	Title       string            `json:"title" gorm:"not null"`
+	Text        string            `json:"text"`
+	Tags        []string          `json:"tags" gorm:"type:jsonb;serializer:json"`
+	Metadata    map[string]string `json:"metadata" gorm:"type:jsonb;serializer:json"`             // e.g. version, deployment_id, replicas
+	Source      string            `json:"source" gorm:"uniqueIndex:idx_change_events_source_ref"` // the reporting service
+	SourceID    *string           `json:"source_id,omitempty" gorm:"uniqueIndex:idx_change_events_source_ref"`
+	StartsAt    time.Time         `json:"starts_at" gorm:"index:idx_change_events_service_time,priority:2;index"`
+	EndsAt      *time.Time        `json:"ends_at"` // for changes that take a while, e.g. a rollout
+	CreatedBy   string            `json:"created_by"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+var (
+	changeEventsRecorded = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "change_events_recorded_total",
+			Help: "Change events recorded, by kind and how they arrived",
+		},
+		[]string{"kind", "via"},
+	)
+
+	changeEventsRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "change_events_rejected_total",
+			Help: "Change events that were invalid or could not be stored",
+		},
+		[]string{"via"},
+	)
+)
+
+// validateChangeEvent checks an event and fills in its defaults
+func validateChangeEvent(event *ChangeEvent) error {
+	event.Service = strings.TrimSpace(event.Service)
+	event.Kind = strings.TrimSpace(event.Kind)
+	if event.Service == "" {
+		return fmt.Errorf("service is required")
+	}
+	if event.Title == "" {
+		return fmt.Errorf("title is required")
+	}
+	if event.Kind == "" {
+		event.Kind = ChangeKindOther
+	}
+	if !changeKinds[event.Kind] {
+		return fmt.Errorf("unknown kind %q", event.Kind)
+	}
+	if event.StartsAt.IsZero() {
+		event.StartsAt = time.Now()
+	}
+	if event.EndsAt != nil && event.EndsAt.Before(event.StartsAt) {
+		return fmt.Errorf("ends_at is before starts_at")
+	}
+	if event.SourceID != nil && *event.SourceID == "" {
+		event.SourceID = nil
+	}
+	if event.SourceID != nil && event.Source == "" {
+		return fmt.Errorf("source_id needs a source")
+	}
+	if event.Tags == nil {
+		event.Tags = []string{}
+	}
+	if event.Metadata == nil {
+		event.Metadata = map[string]string{}
+	}
+	return nil
+}
+
+// recordChangeEvent stores an event, updating the earlier report of it
+func (ms *MonitoringService) recordChangeEvent(event *ChangeEvent, via string) error {
+	if err := validateChangeEvent(event); err != nil {
+		changeEventsRejected.WithLabelValues(via).Inc()
+		return err
+	}
+	event.ID = 0
+	event.CreatedAt = time.Now()
+	event.UpdatedAt = event.CreatedAt
+
+	err := ms.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "source"}, {Name: "source_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"environment", "kind", "title", "text", "tags", "metadata", "starts_at", "ends_at", "updated_at"}),
+	}).Create(event).Error
+	if err != nil {
+		changeEventsRejected.WithLabelValues(via).Inc()
+		return err
+	}
+	changeEventsRecorded.WithLabelValues(event.Kind, via).Inc()
+	return nil
+}
+
+// startChangeEventSubscriber records the events services publish
+func (ms *MonitoringService) startChangeEventSubscriber() {
+	channel := getEnv("CHANGE_EVENTS_CHANNEL", "platform:change_events")
+	pubsub := ms.redis.Subscribe(context.Background(), channel)
+	defer pubsub.Close()
+
+	for message := range pubsub.Channel() {
+		var event ChangeEvent
+		if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+			changeEventsRejected.WithLabelValues("pubsub").Inc()
+			ms.logger.Warn("Invalid change event", zap.String("channel", channel), zap.Error(err))
+			continue
+		}
+		if err := ms.recordChangeEvent(&event, "pubsub"); err != nil {
+			ms.logger.Warn("Failed to record change event",
+				zap.String("service", event.Service),
+				zap.String("kind", event.Kind),
+				zap.Error(err))
+		}
+	}
+}
+
+// startChangeEventRetention drops events older than the retention
+func (ms *MonitoringService) startChangeEventRetention() {
+	retention, err := time.ParseDuration(getEnv("CHANGE_EVENT_RETENTION", "2160h"))
+	if err != nil || retention <= 0 {
+		retention = 90 * 24 * time.Hour
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cutoff := time.Now().Add(-retention)
+		if err := ms.db.Where("starts_at < ? AND (ends_at IS NULL OR ends_at < ?)", cutoff, cutoff).Delete(&ChangeEvent{}).Error; err != nil {
+			ms.logger.Error("Failed to drop old change events", zap.Error(err))
+		}
+	}
+}
+
+// recordGateOverride marks a deploy that went ahead past the deploy gate
+func (ms *MonitoringService) recordGateOverride(decision *GateDecision, override *GateOverride) {
+	sourceID := strconv.FormatUint(uint64(decision.ID), 10)
+	event := ChangeEvent{
+		Service:     decision.Service,
+		Environment: decision.Environment,
+		Kind:        ChangeKindDeployGate,
+		Title:       "Deploy gate overridden",
+		Text:        decision.Reason,
+		Tags:        []string{"override"},
+		Metadata: map[string]string{
+			"deployment_id": decision.DeploymentID,
+			"version":       decision.Version,
+			"override_id":   strconv.FormatUint(uint64(override.ID), 10),
+		},
+		Source:    "deploy-gate",
+		SourceID:  &sourceID,
+		StartsAt:  decision.CreatedAt,
+		CreatedBy: decision.RequestedBy,
+	}
+	if err := ms.recordChangeEvent(&event, "gate"); err != nil {
+		ms.logger.Warn("Failed to record deploy gate override", zap.String("service", decision.Service), zap.Error(err))
+	}
+}
+
+// parseAnnotationTime reads RFC 3339 or Unix milliseconds, as dashboards
+// send them
+func parseAnnotationTime(value string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// splitList reads a comma separated, possibly repeated, query parameter
+func splitList(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// Annotations handlers
+func (ms *MonitoringService) createAnnotation(c *gin.Context) {
+	var event ChangeEvent
+	if err := c.ShouldBindJSON(&event); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if event.CreatedBy == "" {
+		event.CreatedBy = c.GetHeader("X-User-ID")
+	}
+	if err := validateChangeEvent(&event); err != nil {
+		changeEventsRejected.WithLabelValues("api").Inc()
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := ms.recordChangeEvent(&event, "api"); err != nil {
+		ms.logger.Error("Failed to record change event", zap.String("service", event.Service), zap.Error(err))
+		c.JSON(500, gin.H{"error": "Failed to record change event"})
+		return
+	}
+	c.JSON(201, event)
+}
+
+func (ms *MonitoringService) createAnnotationBatch(c *gin.Context) {
+	var request struct {
+		Events []ChangeEvent `json:"events" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if len(request.Events) > maxAnnotationBatch {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("At most %d events per batch", maxAnnotationBatch)})
+		return
+	}
+
+	user := c.GetHeader("X-User-ID")
+	recorded := 0
+	failures := []gin.H{}
+	for i := range request.Events {
+		event := &request.Events[i]
+		if event.CreatedBy == "" {
+			event.CreatedBy = user
+		}
+		if err := ms.recordChangeEvent(event, "api"); err != nil {
+			failures = append(failures, gin.H{"index": i, "error": err.Error()})
+			continue
+		}
+		recorded++
+	}
+	c.JSON(200, gin.H{"recorded": recorded, "failed": failures})
+}
+
+// Change events overlapping a time range, for dashboards to overlay;
+// format=grafana answers in the shape of Grafana's JSON annotations
+func (ms *MonitoringService) listAnnotations(c *gin.Context) {
+	to := time.Now()
+	if value := c.Query("to"); value != "" {
+		parsed, err := parseAnnotationTime(value)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid to format"})
+			return
+		}
+		to = parsed
+	}
+	from := to.Add(-defaultAnnotationRange)
+	if value := c.Query("from"); value != "" {
+		parsed, err := parseAnnotationTime(value)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid from format"})
+			return
+		}
+		from = parsed
+	}
+	if from.After(to) {
+		c.JSON(400, gin.H{"error": "from is after to"})
+		return
+	}
+
+	query := ms.db.Where("starts_at <= ? AND COALESCE(ends_at, starts_at) >= ?", to, from)
+	if services := splitList(c.QueryArray("service")); len(services) > 0 {
+		query = query.Where("service IN ?", services)
+	}
+	if kinds := splitList(c.QueryArray("kind")); len(kinds) > 0 {
+		query = query.Where("kind IN ?", kinds)
+	}
+	if environment := c.Query("environment"); environment != "" {
+		query = query.Where("environment = ?", environment)
+	}
+	if tags := splitList(c.QueryArray("tag")); len(tags) > 0 {
+		data, _ := json.Marshal(tags)
+		query = query.Where("tags @> ?::jsonb", string(data))
+	}
+	limit := defaultAnnotationLimit
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= maxAnnotationLimit {
+		limit = l
+	}
+
+	var events []ChangeEvent
+	if err := query.Order("starts_at DESC").Limit(limit).Find(&events).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch change events"})
+		return
+	}
+
+	if c.Query("format") == "grafana" {
+		annotations := make([]gin.H, 0, len(events))
+		for _, event := range events {
+			annotation := gin.H{
+				"id":    event.ID,
+				"time":  event.StartsAt.UnixMilli(),
+				"title": event.Title,
+				"text":  event.Text,
+				"tags":  append([]string{event.Service, event.Kind}, event.Tags...),
+			}
+			if event.EndsAt != nil {
+				annotation["timeEnd"] = event.EndsAt.UnixMilli()
+			}
+			annotations = append(annotations, annotation)
+		}
+		c.JSON(200, annotations)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"annotations": events,
+		"from":        from,
+		"to":          to,
+	})
+}
+
+func (ms *MonitoringService) getAnnotation(c *gin.Context) {
+	var event ChangeEvent
+	if err := ms.db.First(&event, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Change event not found"})
+		return
+	}
+	c.JSON(200, event)
+}
+
+func (ms *MonitoringService) deleteAnnotation(c *gin.Context) {
+	result := ms.db.Delete(&ChangeEvent{}, c.Param("id"))
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": "Failed to delete change event"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"error": "Change event not found"})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Change event deleted"})
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+)
+
+// Composite health checks. A composite check defines the components a
+// service depends on (HTTP probes, TCP reachability of databases and
+// brokers, Prometheus queries such as Kafka consumer lag, and other
+// services' composite checks) and rolls them up into one status:
+//
+//	healthy   - every component passes
+//	degraded  - only non-critical components fail
+//	unhealthy - a critical component fails
+//
+// Results are cached in Redis under health:composite:<service> and used by
+// /health/services, dashboards and the status page.
+
+const (
+	HealthStatusHealthy   = "healthy"
+	HealthStatusDegraded  = "degraded"
+	HealthStatusUnhealthy = "unhealthy"
+	HealthStatusUnknown   = "unknown"
+)
+
+const (
+	ComponentTypeHTTP       = "http"
+	ComponentTypeTCP        = "tcp"
+	ComponentTypePrometheus = "prometheus"
+	ComponentTypeService    = "service"
+)
+
+// CompositeCheck defines the rolled-up health of a service
+type CompositeCheck struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Service     string    `json:"service" gorm:"uniqueIndex;not null"`
+	Description string    `json:"description"`
+	Components  string    `json:"components" gorm:"type:jsonb"`
+	Enabled     bool      `json:"enabled" gorm:"default:true"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	CreatedBy   string    `json:"created_by"`
+}
+
+// HealthComponent is a single dependency of a composite check
+type HealthComponent struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Critical *bool  `json:"critical,omitempty"` // defaults to true
+	Timeout  string `json:"timeout,omitempty"`  // defaults to 5s
+
+	// http
+	URL            string `json:"url,omitempty"`
+	ExpectedStatus int    `json:"expected_status,omitempty"` // 0 = any 2xx
+
+	// tcp
+	Address string `json:"address,omitempty"`
+
+	// prometheus: fails when <query result> <condition> <threshold>
+	Query     string  `json:"query,omitempty"`
+	Condition string  `json:"condition,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+
+	// service
+	DependsOn string `json:"depends_on,omitempty"`
+}
+
+// ComponentResult is the outcome of one component check
+type ComponentResult struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Critical   bool     `json:"critical"`
+	Status     string   `json:"status"`
+	Error      string   `json:"error,omitempty"`
+	Value      *float64 `json:"value,omitempty"`
+	LatencyMs  int64    `json:"latency_ms"`
+	RootCauses []string `json:"root_causes,omitempty"`
+}
+
+// CompositeHealthResult is the rolled-up status of a service
+type CompositeHealthResult struct {
+	Service    string            `json:"service"`
+	Status     string            `json:"status"`
+	Reason     string            `json:"reason,omitempty"`
+	RootCauses []string          `json:"root_causes,omitempty"`
+	Components []ComponentResult `json:"components"`
+	LastCheck  string            `json:"last_check"`
+}
+
+var compositeHealthStatus = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "composite_health_status",
+		Help: "Rolled-up service health (1=healthy, 0.5=degraded, 0=unhealthy)",
+	},
+	[]string{"service"},
+)
+
+var statusSeverity = map[string]int{
+	HealthStatusHealthy:   0,
+	HealthStatusUnknown:   1,
+	HealthStatusDegraded:  2,
+	HealthStatusUnhealthy: 3,
+}
+
+func compositeHealthKey(service string) string {
+	return fmt.Sprintf("health:composite:%s", service)
+}
+
+func (hc *HealthComponent) isCritical() bool {
+	return hc.Critical == nil || *hc.Critical
+}
+
+func (hc *HealthComponent) timeout() time.Duration {
+	if d, err := time.ParseDuration(hc.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return 5 * time.Second
+}
+
+func validateHealthComponents(components []HealthComponent) error {
+	if len(components) == 0 {
+		return fmt.Errorf("at least one component is required")
+	}
+	names := make(map[string]bool)
+	for i, component := range components {
+		if component.Name == "" {
+			return fmt.Errorf("component %d: name is required", i)
+		}
+		if names[component.Name] {
+			return fmt.Errorf("duplicate component name %q", component.Name)
+		}
+		names[component.Name] = true
+
+		switch component.Type {
+		case ComponentTypeHTTP:
+			if component.URL == "" {
+				return fmt.Errorf("component %s: url is required", component.Name)
+			}
+		case ComponentTypeTCP:
+			if _, _, err := net.SplitHostPort(component.Address); err != nil {
+				return fmt.Errorf("component %s: address must be host:port", component.Name)
+			}
+		case ComponentTypePrometheus:
+			if component.Query == "" {
+				return fmt.Errorf("component %s: query is required", component.Name)
+			}
+			if _, ok := comparators[component.Condition]; !ok {
+				return fmt.Errorf("component %s: condition must be one of >, <, >=, <=, ==, !=", component.Name)
+			}
+		case ComponentTypeService:
+			if component.DependsOn == "" {
+				return fmt.Errorf("component %s: depends_on is required", component.Name)
+			}
+		default:
+			return fmt.Errorf("component %s: unsupported type %q", component.Name, component.Type)
+		}
+	}
+	return nil
+}
+
+var comparators = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	"<":  func(a, b float64) bool { return a < b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+type compositeCheckRequest struct {
+	Service     string            `json:"service"`
+	Description string            `json:"description"`
+	Components  []HealthComponent `json:"components"`
+	Enabled     *bool             `json:"enabled"`
+}
+
+func (ms *MonitoringService) listCompositeChecks(c *gin.Context) {
+	var checks []CompositeCheck
+	if err := ms.db.Order("service").Find(&checks).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch composite checks"})
+		return
+	}
+
+	c.JSON(200, gin.H{"checks": checks})
+}
+
+func (ms *MonitoringService) createCompositeCheck(c *gin.Context) {
+	var request compositeCheckRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Service == "" {
+		c.JSON(400, gin.H{"error": "service is required"})
+		return
+	}
+	if err := validateHealthComponents(request.Components); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	components, _ := json.Marshal(request.Components)
+	check := CompositeCheck{
+		Service:     request.Service,
+		Description: request.Description,
+		Components:  string(components),
+		Enabled:     request.Enabled == nil || *request.Enabled,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+		CreatedBy:   c.GetHeader("X-User-ID"),
+	}
+
+	if err := ms.db.Create(&check).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create composite check"})
+		return
+	}
+
+	ms.logger.Info("Composite check created", zap.String("service", check.Service))
+	c.JSON(201, check)
+}
+
+func (ms *MonitoringService) getCompositeCheck(c *gin.Context) {
+	var check CompositeCheck
+	if err := ms.db.Where("service = ?", c.Param("service")).First(&check).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Composite check not found"})
+		return
+	}
+
+	c.JSON(200, check)
+}
+
+func (ms *MonitoringService) updateCompositeCheck(c *gin.Context) {
+	var check CompositeCheck
+	if err := ms.db.Where("service = ?", c.Param("service")).First(&check).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Composite check not found"})
+		return
+	}
+
+	var request compositeCheckRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Components != nil {
+		if err := validateHealthComponents(request.Components); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		components, _ := json.Marshal(request.Components)
+		check.Components = string(components)
+	}
+	if request.Description != "" {
+		check.Description = request.Description
+	}
+	if request.Enabled != nil {
+		check.Enabled = *request.Enabled
+	}
+	check.UpdatedAt = time.Now()
+
+	if err := ms.db.Save(&check).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to update composite check"})
+		return
+	}
+
+	c.JSON(200, check)
+}
+
+func (ms *MonitoringService) deleteCompositeCheck(c *gin.Context) {
+	service := c.Param("service")
+	result := ms.db.Where("service = ?", service).Delete(&CompositeCheck{})
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": "Failed to delete composite check"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"error": "Composite check not found"})
+		return
+	}
+
+	ms.redis.Del(context.Background(), compositeHealthKey(service))
+	compositeHealthStatus.DeleteLabelValues(service)
+	c.JSON(200, gin.H{"message": "Composite check deleted"})
+}
+
+// Rolled-up status of one service; refresh=true evaluates it now
+func (ms *MonitoringService) getCompositeStatus(c *gin.Context) {
+	service := c.Param("service")
+
+	if c.Query("refresh") == "true" {
+		results, err := ms.evaluateCompositeChecks()
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to evaluate composite checks"})
+			return
+		}
+		if result, ok := results[service]; ok {
+			c.JSON(200, result)
+			return
+		}
+		c.JSON(404, gin.H{"error": "Composite check not found"})
+		return
+	}
+
+	result, err := ms.cachedCompositeResult(service)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "No composite health data available"})
+		return
+	}
+	c.JSON(200, result)
+}
+
+// Rolled-up status of every service with a composite check
+func (ms *MonitoringService) getHealthRollup(c *gin.Context) {
+	var checks []CompositeCheck
+	if err := ms.db.Where("enabled = ?", true).Order("service").Find(&checks).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch composite checks"})
+		return
+	}
+
+	overall := HealthStatusHealthy
+	services := make([]gin.H, 0, len(checks))
+	counts := map[string]int{}
+	for _, check := range checks {
+		entry := gin.H{"service": check.Service, "status": HealthStatusUnknown}
+		if result, err := ms.cachedCompositeResult(check.Service); err == nil {
+			entry["status"] = result.Status
+			entry["reason"] = result.Reason
+			entry["root_causes"] = result.RootCauses
+			entry["last_check"] = result.LastCheck
+		}
+		status := entry["status"].(string)
+		counts[status]++
+		if statusSeverity[status] > statusSeverity[overall] {
+			overall = status
+		}
+		services = append(services, entry)
+	}
+
+	c.JSON(200, gin.H{
+		"status":    overall,
+		"counts":    counts,
+		"services":  services,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+func (ms *MonitoringService) cachedCompositeResult(service string) (*CompositeHealthResult, error) {
+	data, err := ms.redis.Get(context.Background(), compositeHealthKey(service)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var result CompositeHealthResult
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (ms *MonitoringService) startCompositeHealthChecks() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := ms.evaluateCompositeChecks(); err != nil {
+			ms.logger.Error("Failed to evaluate composite checks", zap.Error(err))
+		}
+	}
+}
+
+// evaluateCompositeChecks evaluates every enabled check, resolving service
+// dependencies first so each service is checked once per pass.
+func (ms *MonitoringService) evaluateCompositeChecks() (map[string]*CompositeHealthResult, error) {
+	var checks []CompositeCheck
+	if err := ms.db.Where("enabled = ?", true).Find(&checks).Error; err != nil {
+		return nil, err
+	}
+
+	evaluator := &compositeEvaluator{
+		ms:       ms,
+		checks:   make(map[string]*CompositeCheck, len(checks)),
+		results:  make(map[string]*CompositeHealthResult, len(checks)),
+		visiting: make(map[string]bool),
+	}
+	for i := range checks {
+		evaluator.checks[checks[i].Service] = &checks[i]
+	}
+	for service := range evaluator.checks {
+		evaluator.evaluate(service)
+	}
+
+	for service, result := range evaluator.results {
+		data, _ := json.Marshal(result)
+		ms.redis.Set(context.Background(), compositeHealthKey(service), data, 5*time.Minute)
+
+		switch result.Status {
+		case HealthStatusHealthy:
+			compositeHealthStatus.WithLabelValues(service).Set(1)
+		case HealthStatusDegraded:
+			compositeHealthStatus.WithLabelValues(service).Set(0.5)
+		default:
+			compositeHealthStatus.WithLabelValues(service).Set(0)
+		}
+	}
+
+	return evaluator.results, nil
+}
+
+type compositeEvaluator struct {
+	ms       *MonitoringService
+	checks   map[string]*CompositeCheck
+	results  map[string]*CompositeHealthResult
+	visiting map[string]bool
+}
+
+func (e *compositeEvaluator) evaluate(service string) *CompositeHealthResult {
+	if result, ok := e.results[service]; ok {
+		return result
+	}
+
+	result := &CompositeHealthResult{
+		Service:    service,
+		Status:     HealthStatusHealthy,
+		Components: []ComponentResult{},
+		LastCheck:  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	check, ok := e.checks[service]
+	if !ok {
+		result.Status = HealthStatusUnknown
+		result.Reason = "no composite check defined"
+		return result
+	}
+	if e.visiting[service] {
+		result.Status = HealthStatusUnknown
+		result.Reason = "dependency cycle"
+		return result
+	}
+	e.visiting[service] = true
+	defer delete(e.visiting, service)
+
+	var components []HealthComponent
+	if err := json.Unmarshal([]byte(check.Components), &components); err != nil {
+		result.Status = HealthStatusUnknown
+		result.Reason = "invalid component definition"
+		e.results[service] = result
+		return result
+	}
+
+	var failed []string
+	rootCauses := make(map[string]bool)
+	for i := range components {
+		component := &components[i]
+		componentResult := e.checkComponent(component)
+		result.Components = append(result.Components, componentResult)
+
+		if componentResult.Status == HealthStatusHealthy {
+			continue
+		}
+		failed = append(failed, component.Name)
+
+		// Failures inside a dependency are attributed to its root causes
+		if len(componentResult.RootCauses) > 0 {
+			for _, cause := range componentResult.RootCauses {
+				rootCauses[cause] = true
+			}
+		} else {
+			rootCauses[service+"/"+component.Name] = true
+		}
+
+		status := HealthStatusDegraded
+		if component.isCritical() && componentResult.Status != HealthStatusDegraded {
+			status = HealthStatusUnhealthy
+		}
+		if statusSeverity[status] > statusSeverity[result.Status] {
+			result.Status = status
+		}
+	}
+
+	if len(failed) > 0 {
+		result.Reason = fmt.Sprintf("failing components: %s", strings.Join(failed, ", "))
+		for cause := range rootCauses {
+			result.RootCauses = append(result.RootCauses, cause)
+		}
+		sort.Strings(result.RootCauses)
+	}
+
+	e.results[service] = result
+	return result
+}
+
+func (e *compositeEvaluator) checkComponent(component *HealthComponent) ComponentResult {
+	result := ComponentResult{
+		Name:     component.Name,
+		Type:     component.Type,
+		Critical: component.isCritical(),
+		Status:   HealthStatusHealthy,
+	}
+
+	start := time.Now()
+	var err error
+	switch component.Type {
+	case ComponentTypeHTTP:
+		err = checkHTTPComponent(component)
+	case ComponentTypeTCP:
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", component.Address, component.timeout())
+		if err == nil {
+			conn.Close()
+		}
+	case ComponentTypePrometheus:
+		var value float64
+		value, err = e.ms.queryComponentValue(component)
+		if err == nil {
+			result.Value = &value
+			if comparators[component.Condition](value, component.Threshold) {
+				err = fmt.Errorf("%v %s %v", value, component.Condition, component.Threshold)
+			}
+		}
+	case ComponentTypeService:
+		dependency := e.evaluate(component.DependsOn)
+		if dependency.Status != HealthStatusHealthy {
+			result.Status = dependency.Status
+			result.Error = fmt.Sprintf("dependency %s is %s", component.DependsOn, dependency.Status)
+			result.RootCauses = dependency.RootCauses
+		}
+	default:
+		err = fmt.Errorf("unsupported type %q", component.Type)
+	}
+	result.LatencyMs = time.Since(start).Milliseconds()
+
+	if err != nil {
+		result.Status = HealthStatusUnhealthy
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func checkHTTPComponent(component *HealthComponent) error {
+	client := &http.Client{Timeout: component.timeout()}
+	resp, err := client.Get(component.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if component.ExpectedStatus != 0 {
+		if resp.StatusCode != component.ExpectedStatus {
+			return fmt.Errorf("HTTP %d, expected %d", resp.StatusCode, component.ExpectedStatus)
+		}
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// queryComponentValue runs an instant query and returns the largest sample
+func (ms *MonitoringService) queryComponentValue(component *HealthComponent) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), component.timeout())
+	defer cancel()
+
+	value, _, err := ms.prometheusAPI.Query(ctx, component.Query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	switch v := value.(type) {
+	case *model.Scalar:
+		return float64(v.Value), nil
+	case model.Vector:
+		if len(v) == 0 {
+			return 0, fmt.Errorf("query returned no samples")
+		}
+		max := float64(v[0].Value)
+		for _, sample := range v[1:] {
+			if float64(sample.Value) > max {
+				max = float64(sample.Value)
+			}
+		}
+		return max, nil
+	default:
+		return 0, fmt.Errorf("unsupported result type %s", value.Type())
+	}
+}
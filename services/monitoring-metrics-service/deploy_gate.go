@@ -0,0 +1,647 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// SLOs and the deploy gate. An SLO states the share of a service's events
+// that must be good over a window, e.g. 99.9% of requests over 30d, as two
+// PromQL queries counting bad and total events; $window in a query is
+// replaced with the SLO's window. What the target leaves over is the error
+// budget:
+//
+//	remaining = 1 - (bad / total) / (1 - target)
+//
+// Before a production deploy the deployment-service asks
+// POST /v1/monitoring/deploy-gate/check whether the service may ship. The
+// deploy is blocked while any gating SLO of the service has exhausted its
+// budget, or has less left than its block_below, and also when a budget
+// can't be computed. A blocked deploy goes ahead with an override token,
+// issued to a person for one service with a reason, an expiry and a number
+// of uses. Every decision is recorded.
+
+const (
+	GateDecisionAllowed    = "allowed"
+	GateDecisionBlocked    = "blocked"
+	GateDecisionOverridden = "overridden"
+)
+
+const (
+	overrideTokenPrefix  = "dgo_"
+	defaultSLOWindow     = "30d"
+	defaultOverrideTTL   = time.Hour
+	maxOverrideTTL       = 7 * 24 * time.Hour
+	sloQueryTimeout      = 10 * time.Second
+	defaultDecisionLimit = 100
+)
+
+// SLO is a service level objective of a service
+type SLO struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	Service     string    `json:"service" gorm:"uniqueIndex:idx_slos_service_name;not null"`
+	Name        string    `json:"name" gorm:"uniqueIndex:idx_slos_service_name;not null"`
+	Description string    `json:"description"`
+	Target      float64   `json:"target" gorm:"not null"` // e.g. 0.999
+	Window      string    `json:"window" gorm:"default:'30d'"`
+	ErrorQuery  string    `json:"error_query" gorm:"not null"` // bad events over $window
+	TotalQuery  string    `json:"total_query" gorm:"not null"` // all events over $window
+	BlockBelow  float64   `json:"block_below"`                 // budget fraction; 0 blocks once exhausted
+	GateDeploys bool      `json:"gate_deploys" gorm:"default:true"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	CreatedBy   string    `json:"created_by"`
+}
+
+// GateOverride lets blocked deploys of a service go ahead
+type GateOverride struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	Token       string     `json:"token,omitempty" gorm:"-"` // only when issued
+	TokenHash   string     `json:"-" gorm:"uniqueIndex;not null"`
+	TokenPrefix string     `json:"token_prefix"`
+	Service     string     `json:"service" gorm:"index;not null"`
+	Reason      string     `json:"reason" gorm:"not null"`
+	MaxUses     int        `json:"max_uses"`
+	Uses        int        `json:"uses"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CreatedBy   string     `json:"created_by"`
+}
+
+// GateDecision is the audit record of one deploy gate check
+type GateDecision struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	Service      string    `json:"service" gorm:"index;not null"`
+	Environment  string    `json:"environment"`
+	DeploymentID string    `json:"deployment_id" gorm:"index"`
+	Version      string    `json:"version"`
+	RequestedBy  string    `json:"requested_by"`
+	Decision     string    `json:"decision" gorm:"index"`
+	Reason       string    `json:"reason"`
+	OverrideID   *uint     `json:"override_id"`
+	Budgets      string    `json:"budgets" gorm:"type:jsonb"`
+	CreatedAt    time.Time `json:"created_at" gorm:"index"`
+}
+
+// ErrorBudget is the state of one SLO's error budget
+type ErrorBudget struct {
+	SLOID       uint     `json:"slo_id"`
+	SLO         string   `json:"slo"`
+	Target      float64  `json:"target"`
+	Window      string   `json:"window"`
+	BadEvents   float64  `json:"bad_events"`
+	TotalEvents float64  `json:"total_events"`
+	ErrorRatio  float64  `json:"error_ratio"`
+	Consumed    float64  `json:"consumed"`  // share of the budget spent
+	Remaining   *float64 `json:"remaining"` // nil when unknown
+	BlockBelow  float64  `json:"block_below"`
+	Exhausted   bool     `json:"exhausted"`
+	Error       string   `json:"error,omitempty"`
+}
+
+var (
+	errorBudgetRemaining = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "slo_error_budget_remaining",
+			Help: "Share of the error budget left over the SLO window",
+		},
+		[]string{"service", "slo"},
+	)
+
+	deployGateDecisions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "deploy_gate_decisions_total",
+			Help: "Deploy gate decisions",
+		},
+		[]string{"service", "decision"},
+	)
+)
+
+func hashOverrideToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateSLO(slo *SLO) error {
+	if slo.Service == "" || slo.Name == "" {
+		return fmt.Errorf("service and name are required")
+	}
+	if slo.Target <= 0 || slo.Target >= 1 {
+		return fmt.Errorf("target must be between 0 and 1, e.g. 0.999")
+	}
+	if slo.ErrorQuery == "" || slo.TotalQuery == "" {
+		return fmt.Errorf("error_query and total_query are required")
+	}
+	if _, err := model.ParseDuration(slo.Window); err != nil {
+		return fmt.Errorf("invalid window %q: %v", slo.Window, err)
+	}
+	if slo.BlockBelow < 0 || slo.BlockBelow >= 1 {
+		return fmt.Errorf("block_below must be at least 0 and below 1")
+	}
+	return nil
+}
+
+// errorBudget computes the budget of an SLO from Prometheus
+func (ms *MonitoringService) errorBudget(slo *SLO) ErrorBudget {
+	budget := ErrorBudget{
+		SLOID:      slo.ID,
+		SLO:        slo.Name,
+		Target:     slo.Target,
+		Window:     slo.Window,
+		BlockBelow: slo.BlockBelow,
+	}
+
+	bad, err := ms.querySLOValue(slo.ErrorQuery, slo.Window)
+	if err != nil {
+		budget.Error = "error query: " + err.Error()
+		return budget
+	}
+	total, err := ms.querySLOValue(slo.TotalQuery, slo.Window)
+	if err != nil {
+		budget.Error = "total query: " + err.Error()
+		return budget
+	}
+	budget.BadEvents = bad
+	budget.TotalEvents = total
+
+	// No traffic spends no budget
+	if total > 0 {
+		budget.ErrorRatio = bad / total
+		budget.Consumed = budget.ErrorRatio / (1 - slo.Target)
+	}
+	remaining := 1 - budget.Consumed
+	budget.Remaining = &remaining
+	budget.Exhausted = remaining <= 0
+	errorBudgetRemaining.WithLabelValues(slo.Service, slo.Name).Set(remaining)
+	return budget
+}
+
+// querySLOValue runs an SLO query over window and sums the samples; an
+// empty result counts as zero events
+func (ms *MonitoringService) querySLOValue(query, window string) (float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sloQueryTimeout)
+	defer cancel()
+
+	value, _, err := ms.prometheusAPI.Query(ctx, strings.ReplaceAll(query, "$window", window), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	var sum float64
+	switch v := value.(type) {
+	case *model.Scalar:
+		sum = float64(v.Value)
+	case model.Vector:
+		for _, sample := range v {
+			sum += float64(sample.Value)
+		}
+	default:
+		return 0, fmt.Errorf("unsupported result type %s", value.Type())
+	}
+	if math.IsNaN(sum) || math.IsInf(sum, 0) {
+		return 0, fmt.Errorf("query returned %v", sum)
+	}
+	return sum, nil
+}
+
+func (ms *MonitoringService) listSLOs(c *gin.Context) {
+	query := ms.db.Order("service, name")
+	if service := c.Query("service"); service != "" {
+		query = query.Where("service = ?", service)
+	}
+
+	var slos []SLO
+	if err := query.Find(&slos).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch SLOs"})
+		return
+	}
+
+	c.JSON(200, gin.H{"slos": slos})
+}
+
+func (ms *MonitoringService) createSLO(c *gin.Context) {
+	var slo SLO
+	if err := c.ShouldBindJSON(&slo); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if slo.Window == "" {
+		slo.Window = defaultSLOWindow
+	}
+	if err := validateSLO(&slo); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	slo.ID = 0
+	slo.CreatedAt = time.Now()
+	slo.UpdatedAt = time.Now()
+	slo.CreatedBy = c.GetHeader("X-User-ID")
+
+	// default:true would drop an explicit false on insert
+	gateDeploys := slo.GateDeploys
+	if err := ms.db.Create(&slo).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create SLO"})
+		return
+	}
+	if !gateDeploys {
+		ms.db.Model(&slo).Update("gate_deploys", false)
+		slo.GateDeploys = false
+	}
+
+	ms.logger.Info("SLO created",
+		zap.String("service", slo.Service),
+		zap.String("name", slo.Name),
+		zap.Float64("target", slo.Target))
+	c.JSON(201, slo)
+}
+
+func (ms *MonitoringService) getSLO(c *gin.Context) {
+	var slo SLO
+	if err := ms.db.First(&slo, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "SLO not found"})
+		return
+	}
+
+	c.JSON(200, slo)
+}
+
+func (ms *MonitoringService) updateSLO(c *gin.Context) {
+	var slo SLO
+	if err := ms.db.First(&slo, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "SLO not found"})
+		return
+	}
+
+	var request struct {
+		Description *string  `json:"description"`
+		Target      *float64 `json:"target"`
+		Window      *string  `json:"window"`
+		ErrorQuery  *string  `json:"error_query"`
+		TotalQuery  *string  `json:"total_query"`
+		BlockBelow  *float64 `json:"block_below"`
+		GateDeploys *bool    `json:"gate_deploys"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Description != nil {
+		slo.Description = *request.Description
+	}
+	if request.Target != nil {
+		slo.Target = *request.Target
+	}
+	if request.Window != nil {
+		slo.Window = *request.Window
+	}
+	if request.ErrorQuery != nil {
+		slo.ErrorQuery = *request.ErrorQuery
+	}
+	if request.TotalQuery != nil {
+		slo.TotalQuery = *request.TotalQuery
+	}
+	if request.BlockBelow != nil {
+		slo.BlockBelow = *request.BlockBelow
+	}
+	if request.GateDeploys != nil {
+		slo.GateDeploys = *request.GateDeploys
+	}
+	if err := validateSLO(&slo); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	slo.UpdatedAt = time.Now()
+
+	if err := ms.db.Save(&slo).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to update SLO"})
+		return
+	}
+
+	c.JSON(200, slo)
+}
+
+func (ms *MonitoringService) deleteSLO(c *gin.Context) {
+	var slo SLO
+	if err := ms.db.First(&slo, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "SLO not found"})
+		return
+	}
+	if err := ms.db.Delete(&slo).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to delete SLO"})
+		return
+	}
+
+	errorBudgetRemaining.DeleteLabelValues(slo.Service, slo.Name)
+	c.JSON(200, gin.H{"message": "SLO deleted"})
+}
+
+// Current error budget of one SLO
+func (ms *MonitoringService) getSLOBudget(c *gin.Context) {
+	var slo SLO
+	if err := ms.db.First(&slo, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "SLO not found"})
+		return
+	}
+
+	c.JSON(200, ms.errorBudget(&slo))
+}
+
+type gateCheckRequest struct {
+	Service       string `json:"service" binding:"required"`
+	Environment   string `json:"environment"`
+	DeploymentID  string `json:"deployment_id"`
+	Version       string `json:"version"`
+	RequestedBy   string `json:"requested_by"`
+	OverrideToken string `json:"override_token"`
+}
+
+// Decide whether a service may be deployed now
+func (ms *MonitoringService) checkDeployGate(c *gin.Context) {
+	var request gateCheckRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	var slos []SLO
+	if err := ms.db.Where("service = ? AND gate_deploys = ?", request.Service, true).Order("name").Find(&slos).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch SLOs"})
+		return
+	}
+
+	budgets := make([]ErrorBudget, 0, len(slos))
+	var blocking []string
+	for i := range slos {
+		budget := ms.errorBudget(&slos[i])
+		budgets = append(budgets, budget)
+		switch {
+		case budget.Remaining == nil:
+			blocking = append(blocking, fmt.Sprintf("%s: budget unavailable (%s)", budget.SLO, budget.Error))
+		case budget.Exhausted:
+			blocking = append(blocking, fmt.Sprintf("%s: error budget exhausted (%.1f%% consumed)", budget.SLO, budget.Consumed*100))
+		case *budget.Remaining < budget.BlockBelow:
+			blocking = append(blocking, fmt.Sprintf("%s: %.1f%% of the error budget left, below %.1f%%",
+				budget.SLO, *budget.Remaining*100, budget.BlockBelow*100))
+		}
+	}
+
+	decision := GateDecision{
+		Service:      request.Service,
+		Environment:  request.Environment,
+		DeploymentID: request.DeploymentID,
+		Version:      request.Version,
+		RequestedBy:  request.RequestedBy,
+		Decision:     GateDecisionAllowed,
+		CreatedAt:    time.Now(),
+	}
+	switch {
+	case len(slos) == 0:
+		decision.Reason = "no SLOs gate this service"
+	case len(blocking) == 0:
+		decision.Reason = "error budget available"
+	default:
+		decision.Decision = GateDecisionBlocked
+		decision.Reason = strings.Join(blocking, "; ")
+	}
+
+	var override *GateOverride
+	if decision.Decision == GateDecisionBlocked && request.OverrideToken != "" {
+		used, err := ms.useOverride(request.Service, request.OverrideToken)
+		if err != nil {
+			decision.Reason += "; override rejected: " + err.Error()
+		} else {
+			override = used
+			decision.Decision = GateDecisionOverridden
+			decision.OverrideID = &override.ID
+			decision.Reason += "; overridden: " + override.Reason
+		}
+	}
+
+	data, _ := json.Marshal(budgets)
+	decision.Budgets = string(data)
+	if err := ms.db.Create(&decision).Error; err != nil {
+		ms.logger.Error("Failed to record deploy gate decision",
+			zap.String("service", request.Service),
+			zap.Error(err))
+	}
+	deployGateDecisions.WithLabelValues(request.Service, decision.Decision).Inc()
+	if override != nil && decision.ID != 0 {
+		ms.recordGateOverride(&decision, override)
+	}
+
+	ms.logger.Info("Deploy gate decision",
+		zap.String("service", request.Service),
+		zap.String("deployment_id", request.DeploymentID),
+		zap.String("decision", decision.Decision),
+		zap.String("reason", decision.Reason))
+
+	response := gin.H{
+		"allowed":     decision.Decision != GateDecisionBlocked,
+		"decision":    decision.Decision,
+		"reason":      decision.Reason,
+		"decision_id": decision.ID,
+		"service":     request.Service,
+		"budgets":     budgets,
+	}
+	if override != nil {
+		response["override"] = gin.H{
+			"id":             override.ID,
+			"reason":         override.Reason,
+			"created_by":     override.CreatedBy,
+			"uses_remaining": override.MaxUses - override.Uses,
+			"expires_at":     override.ExpiresAt,
+		}
+	}
+	c.JSON(200, response)
+}
+
+// useOverride spends one use of an override token for service
+func (ms *MonitoringService) useOverride(service, token string) (*GateOverride, error) {
+	var override GateOverride
+	err := ms.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("token_hash = ?", hashOverrideToken(token)).First(&override).Error; err != nil {
+			return fmt.Errorf("unknown token")
+		}
+		switch {
+		case override.Service != service:
+			return fmt.Errorf("token is for %s", override.Service)
+		case override.RevokedAt != nil:
+			return fmt.Errorf("token revoked")
+		case time.Now().After(override.ExpiresAt):
+			return fmt.Errorf("token expired")
+		}
+
+		// Conditional, so concurrent checks can't spend the last use twice
+		result := tx.Model(&GateOverride{}).
+			Where("id = ? AND uses < max_uses", override.ID).
+			Update("uses", gorm.Expr("uses + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("token used up")
+		}
+		override.Uses++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &override, nil
+}
+
+// Issue an override token for a service
+func (ms *MonitoringService) createGateOverride(c *gin.Context) {
+	var request struct {
+		Service   string `json:"service" binding:"required"`
+		Reason    string `json:"reason" binding:"required"`
+		ExpiresIn string `json:"expires_in"` // e.g. 2h; default 1h, at most 7d
+		MaxUses   int    `json:"max_uses"`   // default 1
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	createdBy := c.GetHeader("X-User-ID")
+	if createdBy == "" {
+		c.JSON(400, gin.H{"error": "X-User-ID is required to issue an override"})
+		return
+	}
+
+	ttl := defaultOverrideTTL
+	if request.ExpiresIn != "" {
+		parsed, err := model.ParseDuration(request.ExpiresIn)
+		if err != nil || parsed <= 0 {
+			c.JSON(400, gin.H{"error": "Invalid expires_in"})
+			return
+		}
+		ttl = time.Duration(parsed)
+	}
+	if ttl > maxOverrideTTL {
+		c.JSON(400, gin.H{"error": "expires_in may be at most 7d"})
+		return
+	}
+	if request.MaxUses <= 0 {
+		request.MaxUses = 1
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	token := overrideTokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	override := GateOverride{
+		Token:       token,
+		TokenHash:   hashOverrideToken(token),
+		TokenPrefix: token[:len(overrideTokenPrefix)+6],
+		Service:     request.Service,
+		Reason:      request.Reason,
+		MaxUses:     request.MaxUses,
+		ExpiresAt:   time.Now().Add(ttl),
+		CreatedAt:   time.Now(),
+		CreatedBy:   createdBy,
+	}
+	if err := ms.db.Create(&override).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create override"})
+		return
+	}
+
+	ms.logger.Info("Deploy gate override issued",
+		zap.String("service", override.Service),
+		zap.String("created_by", override.CreatedBy),
+		zap.String("reason", override.Reason),
+		zap.Time("expires_at", override.ExpiresAt))
+	c.JSON(201, override)
+}
+
+// List override tokens, without the tokens themselves
+func (ms *MonitoringService) listGateOverrides(c *gin.Context) {
+	query := ms.db.Order("created_at DESC")
+	if service := c.Query("service"); service != "" {
+		query = query.Where("service = ?", service)
+	}
+	if c.Query("active") == "true" {
+		query = query.Where("revoked_at IS NULL AND expires_at > ? AND uses < max_uses", time.Now())
+	}
+
+	var overrides []GateOverride
+	if err := query.Find(&overrides).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch overrides"})
+		return
+	}
+
+	c.JSON(200, gin.H{"overrides": overrides})
+}
+
+func (ms *MonitoringService) revokeGateOverride(c *gin.Context) {
+	result := ms.db.Model(&GateOverride{}).
+		Where("id = ? AND revoked_at IS NULL", c.Param("id")).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": "Failed to revoke override"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(404, gin.H{"error": "Override not found"})
+		return
+	}
+
+	ms.logger.Info("Deploy gate override revoked",
+		zap.String("id", c.Param("id")),
+		zap.String("revoked_by", c.GetHeader("X-User-ID")))
+	c.JSON(200, gin.H{"message": "Override revoked"})
+}
+
+// Audit trail of gate decisions, newest first
+func (ms *MonitoringService) listGateDecisions(c *gin.Context) {
+	query := ms.db.Order("created_at DESC")
+	if service := c.Query("service"); service != "" {
+		query = query.Where("service = ?", service)
+	}
+	if decision := c.Query("decision"); decision != "" {
+		query = query.Where("decision = ?", decision)
+	}
+	if deploymentID := c.Query("deployment_id"); deploymentID != "" {
+		query = query.Where("deployment_id = ?", deploymentID)
+	}
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid since format"})
+			return
+		}
+		query = query.Where("created_at >= ?", t)
+	}
+	limit := defaultDecisionLimit
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	var decisions []GateDecision
+	if err := query.Limit(limit).Find(&decisions).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch decisions"})
+		return
+	}
+
+	c.JSON(200, gin.H{"decisions": decisions})
+}
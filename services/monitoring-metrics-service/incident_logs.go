@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// Incident log capture. When an alert fires, the logs around it are
+// snapshotted into an incident bundle by the logging-service, so the
+// evidence survives log retention. The affected services come from the
+// alert's "service" or "services" label (comma-separated), trace and
+// request IDs from "trace_ids" and "request_ids". Alerts naming none are
+// skipped. Capture is on when LOGGING_SERVICE_URL is set.
+
+var incidentCaptures = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "alert_incident_captures_total",
+		Help: "Incident log bundles requested for fired alerts",
+	},
+	[]string{"result"}, // created, existing, skipped, error
+)
+
+var incidentHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// alertLabelList reads a comma-separated label
+func alertLabelList(labels map[string]string, keys ...string) []string {
+	var values []string
+	for _, key := range keys {
+		for _, value := range strings.Split(labels[key], ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// captureIncidentLogs asks the logging-service to bundle the logs around a
+// fired alert
+func (ms *MonitoringService) captureIncidentLogs(alert Alert, firedAt time.Time) {
+	loggingURL := getEnv("LOGGING_SERVICE_URL", "")
+	if loggingURL == "" {
+		return
+	}
+
+	labels := map[string]string{}
+	if alert.Labels != "" {
+		if err := json.Unmarshal([]byte(alert.Labels), &labels); err != nil {
+			ms.logger.Warn("Alert labels are not a string map", zap.String("alert", alert.Name), zap.Error(err))
+		}
+	}
+	services := alertLabelList(labels, "service", "services")
+	traceIDs := alertLabelList(labels, "trace_ids")
+	requestIDs := alertLabelList(labels, "request_ids")
+	if len(services) == 0 && len(traceIDs) == 0 && len(requestIDs) == 0 {
+		incidentCaptures.WithLabelValues("skipped").Inc()
+		return
+	}
+
+	var summary string
+	var annotations map[string]string
+	if json.Unmarshal([]byte(alert.Annotations), &annotations) == nil {
+		summary = annotations["summary"]
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"source":      "monitoring-service",
+		"alert_id":    fmt.Sprintf("%d", alert.ID),
+		"alert_name":  alert.Name,
+		"severity":    alert.Severity,
+		"summary":     summary,
+		"fired_at":    firedAt.UTC(),
+		"services":    services,
+		"trace_ids":   traceIDs,
+		"request_ids": requestIDs,
+		"labels":      labels,
+		"created_by":  "monitoring-service",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimRight(loggingURL, "/")+"/v1/incidents/bundles", bytes.NewReader(payload))
+	if err != nil {
+		incidentCaptures.WithLabelValues("error").Inc()
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := incidentHTTPClient.Do(req)
+	if err != nil {
+		incidentCaptures.WithLabelValues("error").Inc()
+		ms.logger.Error("Failed to capture incident logs", zap.String("alert", alert.Name), zap.Error(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Bundle struct {
+			ID       string `json:"id"`
+			LogCount int    `json:"log_count"`
+		} `json:"bundle"`
+		Share *struct {
+			URL string `json:"url"`
+		} `json:"share"`
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		incidentCaptures.WithLabelValues("created").Inc()
+		fields := []zap.Field{
+			zap.String("alert", alert.Name),
+			zap.String("bundle_id", body.Bundle.ID),
+			zap.Int("logs", body.Bundle.LogCount),
+		}
+		if body.Share != nil {
+			fields = append(fields, zap.String("share_url", body.Share.URL))
+		}
+		ms.logger.Info("Captured incident logs", fields...)
+	case http.StatusOK:
+		incidentCaptures.WithLabelValues("existing").Inc()
+	default:
+		incidentCaptures.WithLabelValues("error").Inc()
+		ms.logger.Error("Logging service refused incident capture",
+			zap.String("alert", alert.Name),
+			zap.Int("status", resp.StatusCode),
+			zap.String("error", body.Error))
+	}
+}
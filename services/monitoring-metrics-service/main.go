@@ -76,6 +76,7 @@ type MonitoringService struct {
 	prometheusAPI  v1.API
 	logger         *zap.Logger
 	customMetrics  map[string]prometheus.Collector
+	discovery      scrapeDiscovery
 }
 
 // Custom metrics
@@ -149,6 +150,10 @@ func main() {
 	go monitoringService.startMetricsCollection()
 	go monitoringService.startAlertEvaluation()
 	go monitoringService.startHealthChecks()
+	go monitoringService.startCompositeHealthChecks()
+	go monitoringService.startTargetDiscovery()
+	go monitoringService.startChangeEventSubscriber()
+	go monitoringService.startChangeEventRetention()
 
 	// Initialize Gin router
 	gin.SetMode(gin.ReleaseMode)
@@ -214,6 +219,42 @@ func main() {
 		// Health check endpoints
 		v1.GET("/health/services", monitoringService.getServicesHealth)
 		v1.POST("/health/check", monitoringService.performHealthCheck)
+		v1.GET("/health/rollup", monitoringService.getHealthRollup)
+
+		// Composite health checks
+		v1.GET("/health/composite", monitoringService.listCompositeChecks)
+		v1.POST("/health/composite", monitoringService.createCompositeCheck)
+		v1.GET("/health/composite/:service", monitoringService.getCompositeCheck)
+		v1.PUT("/health/composite/:service", monitoringService.updateCompositeCheck)
+		v1.DELETE("/health/composite/:service", monitoringService.deleteCompositeCheck)
+		v1.GET("/health/composite/:service/status", monitoringService.getCompositeStatus)
+
+		// Scrape target discovery
+		v1.GET("/scrape/targets", monitoringService.listScrapeTargets)
+		v1.GET("/scrape/http_sd", monitoringService.getHTTPSDTargets)
+		v1.POST("/scrape/refresh", monitoringService.refreshScrapeTargets)
+
+		// SLOs and error budgets
+		v1.GET("/slos", monitoringService.listSLOs)
+		v1.POST("/slos", monitoringService.createSLO)
+		v1.GET("/slos/:id", monitoringService.getSLO)
+		v1.PUT("/slos/:id", monitoringService.updateSLO)
+		v1.DELETE("/slos/:id", monitoringService.deleteSLO)
+		v1.GET("/slos/:id/budget", monitoringService.getSLOBudget)
+
+		// Deploy gate
+		v1.POST("/deploy-gate/check", monitoringService.checkDeployGate)
+		v1.GET("/deploy-gate/decisions", monitoringService.listGateDecisions)
+		v1.POST("/deploy-gate/overrides", monitoringService.createGateOverride)
+		v1.GET("/deploy-gate/overrides", monitoringService.listGateOverrides)
+		v1.DELETE("/deploy-gate/overrides/:id", monitoringService.revokeGateOverride)
+
+		// Change event annotations
+		v1.GET("/annotations", monitoringService.listAnnotations)
+		v1.POST("/annotations", monitoringService.createAnnotation)
+		v1.POST("/annotations/batch", monitoringService.createAnnotationBatch)
+		v1.GET("/annotations/:id", monitoringService.getAnnotation)
+		v1.DELETE("/annotations/:id", monitoringService.deleteAnnotation)
 		
 		// System metrics
 		v1.GET("/system/resources", monitoringService.getSystemResources)
@@ -246,7 +287,7 @@ func initDatabase() (*gorm.DB, error) {
 	}
 
 	// Auto-migrate the schema
-	err = db.AutoMigrate(&MetricDefinition{}, &Alert{}, &Dashboard{})
+	err = db.AutoMigrate(&MetricDefinition{}, &Alert{}, &Dashboard{}, &CompositeCheck{}, &SLO{}, &GateOverride{}, &GateDecision{}, &ChangeEvent{})
 	if err != nil {
 		return nil, err
 	}
@@ -389,19 +430,24 @@ func (ms *MonitoringService) queryRangeMetrics(c *gin.Context) {
 }
 
 func (ms *MonitoringService) getServicesHealth(c *gin.Context) {
-	// Get service health from Redis cache
-	services := []string{
-		"api-gateway-service",
-		"user-management-service",
-		"model-management-service",
-		"data-management-service",
-		"analytics-service",
-		"authorization-service",
-	}
+	// Get service health from Redis cache for every discovered service
+	services := ms.discoveredServices()
 	
 	healthStatus := make(map[string]interface{})
 	
+	// Services with a composite check report their rolled-up status
+	var composite []CompositeCheck
+	ms.db.Where("enabled = ?", true).Find(&composite)
+	for _, check := range composite {
+		if result, err := ms.cachedCompositeResult(check.Service); err == nil {
+			healthStatus[check.Service] = result
+		}
+	}
+	
 	for _, service := range services {
+		if _, ok := healthStatus[service]; ok {
+			continue
+		}
 		key := fmt.Sprintf("health:%s", service)
 		status, err := ms.redis.Get(context.Background(), key).Result()
 		if err != nil {
@@ -478,36 +524,8 @@ func (ms *MonitoringService) collectSystemMetrics() {
 }
 
 func (ms *MonitoringService) collectServiceMetrics() {
-	// Collect service health metrics
-	services := []string{
-		"api-gateway-service",
-		"user-management-service", 
-		"model-management-service",
-		"data-management-service",
-		"analytics-service",
-		"authorization-service",
-	}
-	
-	for _, service := range services {
-		// Mock health check - in production, make actual HTTP calls
-		healthy := true // Assume healthy for demo
-		
-		if healthy {
-			serviceHealth.WithLabelValues(service, "localhost").Set(1)
-		} else {
-			serviceHealth.WithLabelValues(service, "localhost").Set(0)
-		}
-		
-		// Cache health status in Redis
-		healthData := gin.H{
-			"status":     "healthy",
-			"last_check": time.Now().UTC().Format(time.RFC3339),
-			"response_time_ms": 50,
-		}
-		
-		healthJSON, _ := json.Marshal(healthData)
-		ms.redis.Set(context.Background(), fmt.Sprintf("health:%s", service), healthJSON, 5*time.Minute)
-	}
+	// Probe the metrics endpoints discovered from the discovery-service
+	ms.probeScrapeTargets()
 }
 
 func (ms *MonitoringService) startAlertEvaluation() {
@@ -537,6 +555,7 @@ func (ms *MonitoringService) evaluateAlerts() {
 			ms.logger.Warn("Alert triggered", 
 				zap.String("alert", alert.Name),
 				zap.String("severity", alert.Severity))
+			go ms.captureIncidentLogs(alert, time.Now())
 		}
 	}
 }
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// Scrape target auto-discovery. The discovery-service catalog is pulled
+// periodically and every instance that exposes metrics becomes a scrape
+// target. Targets are published in Prometheus http_sd format, optionally
+// written to a file_sd file, and probed by the internal collection job that
+// feeds service_health_status and health:<service> in Redis.
+//
+// Instances opt in with metadata or tags:
+//
+//	metrics_port   - port serving metrics (defaults to the instance port)
+//	metrics_path   - defaults to /metrics
+//	metrics_scheme - defaults to http
+//	tag "metrics" or "prometheus" - expose on the instance port
+//	metadata metrics_scrape=false - opt out
+
+const (
+	MetaMetricsPort   = "metrics_port"
+	MetaMetricsPath   = "metrics_path"
+	MetaMetricsScheme = "metrics_scheme"
+	MetaMetricsScrape = "metrics_scrape"
+
+	scrapeProbeWorkers = 10
+)
+
+// ScrapeTarget is a discovered metrics endpoint
+type ScrapeTarget struct {
+	Service     string            `json:"service"`
+	InstanceID  string            `json:"instance_id"`
+	Address     string            `json:"address"`
+	Scheme      string            `json:"scheme"`
+	MetricsPath string            `json:"metrics_path"`
+	Status      string            `json:"status"` // status reported by discovery
+	Labels      map[string]string `json:"labels"`
+	Up          *bool             `json:"up,omitempty"`
+	LastScrape  *time.Time        `json:"last_scrape,omitempty"`
+	ScrapeError string            `json:"scrape_error,omitempty"`
+}
+
+// discoveredInstance mirrors the discovery-service ServiceInstance
+type discoveredInstance struct {
+	ID          string            `json:"id"`
+	ServiceName string            `json:"service_name"`
+	Version     string            `json:"version"`
+	Host        string            `json:"host"`
+	Port        int               `json:"port"`
+	Status      string            `json:"status"`
+	Metadata    map[string]string `json:"metadata"`
+	Tags        []string          `json:"tags"`
+	Environment string            `json:"environment"`
+	Region      string            `json:"region"`
+}
+
+// scrapeDiscovery holds the latest discovered targets
+type scrapeDiscovery struct {
+	mutex    sync.RWMutex
+	targets  []ScrapeTarget
+	services []string
+	lastSync time.Time
+	lastErr  string
+}
+
+var (
+	discoveredTargetUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discovered_target_up",
+			Help: "Whether the last probe of a discovered metrics endpoint succeeded",
+		},
+		[]string{"service", "instance"},
+	)
+
+	discoveredTargetScrapeDuration = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "discovered_target_scrape_duration_seconds",
+			Help: "Duration of the last probe of a discovered metrics endpoint",
+		},
+		[]string{"service", "instance"},
+	)
+
+	discoveredTargets = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "discovered_scrape_targets",
+			Help: "Number of scrape targets discovered from the discovery-service",
+		},
+	)
+)
+
+func (ms *MonitoringService) startTargetDiscovery() {
+	interval, err := time.ParseDuration(getEnv("SCRAPE_DISCOVERY_INTERVAL", "60s"))
+	if err != nil || interval <= 0 {
+		interval = time.Minute
+	}
+
+	ms.syncScrapeTargets()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ms.syncScrapeTargets()
+	}
+}
+
+// syncScrapeTargets pulls the catalog and replaces the target list
+func (ms *MonitoringService) syncScrapeTargets() {
+	instances, err := fetchDiscoveryCatalog()
+	if err != nil {
+		ms.logger.Warn("Scrape target discovery failed", zap.Error(err))
+		ms.discovery.mutex.Lock()
+		ms.discovery.lastErr = err.Error()
+		ms.discovery.mutex.Unlock()
+		return
+	}
+
+	serviceSet := make(map[string]bool)
+	targets := make([]ScrapeTarget, 0, len(instances))
+	for _, instance := range instances {
+		serviceSet[instance.ServiceName] = true
+		if target, ok := scrapeTargetFor(instance); ok {
+			targets = append(targets, target)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Service != targets[j].Service {
+			return targets[i].Service < targets[j].Service
+		}
+		return targets[i].Address < targets[j].Address
+	})
+	services := make([]string, 0, len(serviceSet))
+	for service := range serviceSet {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	ms.discovery.mutex.Lock()
+	previous := ms.discovery.targets
+	ms.discovery.targets = targets
+	ms.discovery.services = services
+	ms.discovery.lastSync = time.Now().UTC()
+	ms.discovery.lastErr = ""
+	ms.discovery.mutex.Unlock()
+
+	// Drop series for targets that disappeared
+	current := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		current[target.Service+"|"+target.Address] = true
+	}
+	for _, target := range previous {
+		if !current[target.Service+"|"+target.Address] {
+			discoveredTargetUp.DeleteLabelValues(target.Service, target.Address)
+			discoveredTargetScrapeDuration.DeleteLabelValues(target.Service, target.Address)
+			serviceHealth.DeleteLabelValues(target.Service, target.Address)
+		}
+	}
+	discoveredTargets.Set(float64(len(targets)))
+
+	if path := getEnv("PROMETHEUS_FILE_SD_PATH", ""); path != "" {
+		if err := writeFileSD(path, targets); err != nil {
+			ms.logger.Error("Failed to write file_sd targets", zap.String("path", path), zap.Error(err))
+		}
+	}
+
+	ms.logger.Debug("Scrape targets discovered",
+		zap.Int("services", len(services)),
+		zap.Int("targets", len(targets)))
+}
+
+func fetchDiscoveryCatalog() ([]discoveredInstance, error) {
+	url := strings.TrimRight(getEnv("DISCOVERY_SERVICE_URL", "http://discovery-service:8080"), "/") + "/v1/discovery/catalog"
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery catalog returned HTTP %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Catalog map[string]struct {
+			Instances []discoveredInstance `json:"instances"`
+		} `json:"catalog"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode discovery catalog: %w", err)
+	}
+
+	var instances []discoveredInstance
+	for _, entry := range body.Catalog {
+		instances = append(instances, entry.Instances...)
+	}
+	return instances, nil
+}
+
+func scrapeTargetFor(instance discoveredInstance) (ScrapeTarget, bool) {
+	if instance.Metadata[MetaMetricsScrape] == "false" {
+		return ScrapeTarget{}, false
+	}
+
+	exposes := instance.Metadata[MetaMetricsPort] != "" || instance.Metadata[MetaMetricsPath] != ""
+	for _, tag := range instance.Tags {
+		if tag == "metrics" || tag == "prometheus" {
+			exposes = true
+		}
+	}
+	if !exposes {
+		return ScrapeTarget{}, false
+	}
+
+	port := instance.Port
+	if value := instance.Metadata[MetaMetricsPort]; value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return ScrapeTarget{}, false
+		}
+		port = parsed
+	}
+	path := instance.Metadata[MetaMetricsPath]
+	if path == "" {
+		path = "/metrics"
+	}
+	scheme := instance.Metadata[MetaMetricsScheme]
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	return ScrapeTarget{
+		Service:     instance.ServiceName,
+		InstanceID:  instance.ID,
+		Address:     net.JoinHostPort(instance.Host, strconv.Itoa(port)),
+		Scheme:      scheme,
+		MetricsPath: path,
+		Status:      instance.Status,
+		Labels: map[string]string{
+			"service":     instance.ServiceName,
+			"instance_id": instance.ID,
+			"version":     instance.Version,
+			"environment": instance.Environment,
+			"region":      instance.Region,
+		},
+	}, true
+}
+
+// Prometheus http_sd / file_sd target groups
+func targetGroups(targets []ScrapeTarget) []gin.H {
+	groups := make([]gin.H, 0, len(targets))
+	for _, target := range targets {
+		labels := make(map[string]string, len(target.Labels)+2)
+		for key, value := range target.Labels {
+			labels[key] = value
+		}
+		labels["__metrics_path__"] = target.MetricsPath
+		labels["__scheme__"] = target.Scheme
+
+		groups = append(groups, gin.H{
+			"targets": []string{target.Address},
+			"labels":  labels,
+		})
+	}
+	return groups
+}
+
+// Write atomically so Prometheus never reads a partial file
+func writeFileSD(path string, targets []ScrapeTarget) error {
+	data, err := json.MarshalIndent(targetGroups(targets), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".file_sd-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// discoveredServices returns the service names from the last catalog sync
+func (ms *MonitoringService) discoveredServices() []string {
+	ms.discovery.mutex.RLock()
+	defer ms.discovery.mutex.RUnlock()
+	return append([]string(nil), ms.discovery.services...)
+}
+
+// probeScrapeTargets is the internal collection job: it probes every
+// discovered metrics endpoint and rolls the results up per service.
+func (ms *MonitoringService) probeScrapeTargets() {
+	ms.discovery.mutex.RLock()
+	targets := append([]ScrapeTarget(nil), ms.discovery.targets...)
+	ms.discovery.mutex.RUnlock()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < scrapeProbeWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				probeScrapeTarget(client, &targets[i])
+			}
+		}()
+	}
+	for i := range targets {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	type rollup struct {
+		total, up int
+	}
+	services := make(map[string]*rollup)
+	for _, target := range targets {
+		r, ok := services[target.Service]
+		if !ok {
+			r = &rollup{}
+			services[target.Service] = r
+		}
+		r.total++
+		if target.Up != nil && *target.Up {
+			r.up++
+			serviceHealth.WithLabelValues(target.Service, target.Address).Set(1)
+		} else {
+			serviceHealth.WithLabelValues(target.Service, target.Address).Set(0)
+		}
+	}
+
+	for service, r := range services {
+		status := "healthy"
+		if r.up == 0 {
+			status = "unhealthy"
+		} else if r.up < r.total {
+			status = "degraded"
+		}
+		healthData := gin.H{
+			"status":            status,
+			"last_check":        time.Now().UTC().Format(time.RFC3339),
+			"total_instances":   r.total,
+			"healthy_instances": r.up,
+		}
+		healthJSON, _ := json.Marshal(healthData)
+		ms.redis.Set(context.Background(), fmt.Sprintf("health:%s", service), healthJSON, 5*time.Minute)
+	}
+
+	// Keep probe results for the targets API, matched by address
+	ms.discovery.mutex.Lock()
+	byAddress := make(map[string]ScrapeTarget, len(targets))
+	for _, target := range targets {
+		byAddress[target.Service+"|"+target.Address] = target
+	}
+	for i, target := range ms.discovery.targets {
+		if probed, ok := byAddress[target.Service+"|"+target.Address]; ok {
+			ms.discovery.targets[i].Up = probed.Up
+			ms.discovery.targets[i].LastScrape = probed.LastScrape
+			ms.discovery.targets[i].ScrapeError = probed.ScrapeError
+		}
+	}
+	ms.discovery.mutex.Unlock()
+}
+
+func probeScrapeTarget(client *http.Client, target *ScrapeTarget) {
+	start := time.Now()
+	url := fmt.Sprintf("%s://%s%s", target.Scheme, target.Address, target.MetricsPath)
+
+	up := false
+	target.ScrapeError = ""
+	resp, err := client.Get(url)
+	if err != nil {
+		target.ScrapeError = err.Error()
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			up = true
+		} else {
+			target.ScrapeError = fmt.Sprintf("HTTP %d", resp.StatusCode)
+		}
+	}
+
+	now := time.Now().UTC()
+	target.Up = &up
+	target.LastScrape = &now
+
+	discoveredTargetScrapeDuration.WithLabelValues(target.Service, target.Address).Set(time.Since(start).Seconds())
+	if up {
+		discoveredTargetUp.WithLabelValues(target.Service, target.Address).Set(1)
+	} else {
+		discoveredTargetUp.WithLabelValues(target.Service, target.Address).Set(0)
+	}
+}
+
+// List discovered scrape targets
+func (ms *MonitoringService) listScrapeTargets(c *gin.Context) {
+	ms.discovery.mutex.RLock()
+	defer ms.discovery.mutex.RUnlock()
+
+	var lastSync interface{}
+	if !ms.discovery.lastSync.IsZero() {
+		lastSync = ms.discovery.lastSync
+	}
+
+	c.JSON(200, gin.H{
+		"targets":   ms.discovery.targets,
+		"total":     len(ms.discovery.targets),
+		"services":  ms.discovery.services,
+		"last_sync": lastSync,
+		"error":     ms.discovery.lastErr,
+	})
+}
+
+// Targets in Prometheus http_sd format
+func (ms *MonitoringService) getHTTPSDTargets(c *gin.Context) {
+	ms.discovery.mutex.RLock()
+	groups := targetGroups(ms.discovery.targets)
+	ms.discovery.mutex.RUnlock()
+
+	c.JSON(200, groups)
+}
+
+// Pull the catalog now
+func (ms *MonitoringService) refreshScrapeTargets(c *gin.Context) {
+	ms.syncScrapeTargets()
+
+	ms.discovery.mutex.RLock()
+	defer ms.discovery.mutex.RUnlock()
+	if ms.discovery.lastErr != "" {
+		c.JSON(502, gin.H{"error": ms.discovery.lastErr})
+		return
+	}
+	c.JSON(200, gin.H{
+		"total":     len(ms.discovery.targets),
+		"last_sync": ms.discovery.lastSync,
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"orchestration/internal/chaos"
+)
+
+// Saga types and steps that chaos rules can target
+const (
+	SagaTypeUserOnboarding = "UserOnboarding"
+	StepProvisionWorkspace = "provision_workspace"
+)
+
+var (
+	chaosInjector *chaos.Injector
+	chaosAudit    = chaos.NewMemoryAudit(500)
+
+	chaosFaultsInjected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "orchestration_chaos_faults_injected_total",
+			Help: "Saga step failures forced by chaos rules",
+		},
+		[]string{"saga_type", "step"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(chaosFaultsInjected)
+}
+
+// initChaos enables chaos mode when CHAOS_MODE_ENABLED=true and ENVIRONMENT
+// is not production
+func initChaos() {
+	env := os.Getenv("ENVIRONMENT")
+	if env == "" {
+		env = "development"
+	}
+	requested := os.Getenv("CHAOS_MODE_ENABLED") == "true"
+	chaosInjector = chaos.NewInjector(env, requested, chaos.MultiAudit{chaosAudit, pgChaosAudit{}})
+
+	switch {
+	case chaosInjector.Enabled():
+		fmt.Printf("chaos mode enabled (environment=%s)\n", env)
+	case requested:
+		fmt.Printf("chaos mode requested but refused in environment %s\n", env)
+	}
+
+	http.HandleFunc("/chaos/rules", chaosRulesHandler)
+	http.HandleFunc("/chaos/rules/", chaosRuleHandler)
+	http.HandleFunc("/chaos/audit", chaosAuditHandler)
+}
+
+// injectChaos reports whether a saga step should be forced to fail
+func injectChaos(sagaType, step, sagaId string) (bool, *chaos.Rule) {
+	fail, rule := chaosInjector.ShouldFail(sagaType, step, sagaId)
+	if fail {
+		chaosFaultsInjected.WithLabelValues(sagaType, step).Inc()
+		fmt.Printf("chaos: forcing %s/%s to fail for saga %s (rule %s)\n", sagaType, step, sagaId, rule.ID)
+	}
+	return fail, rule
+}
+
+// pgChaosAudit persists chaos audit entries to the chaos_audit table
+type pgChaosAudit struct{}
+
+func (pgChaosAudit) Record(e chaos.AuditEntry) {
+	if pgPool == nil {
+		return
+	}
+	_, err := pgPool.Exec(context.Background(),
+		"INSERT INTO chaos_audit(time,action,actor,rule_id,saga_type,step,saga_id,detail) VALUES($1,$2,$3,$4,$5,$6,$7,$8)",
+		e.Time, e.Action, e.Actor, e.RuleID, e.SagaType, e.Step, e.SagaID, e.Detail)
+	if err != nil {
+		fmt.Printf("failed to persist chaos audit entry: %v\n", err)
+	}
+}
+
+func chaosRulesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"enabled": chaosInjector.Enabled(),
+			"rules":   chaosInjector.Rules(),
+		})
+	case http.MethodPost:
+		var rule chaos.Rule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		created, err := chaosInjector.AddRule(rule, r.Header.Get("X-User-ID"))
+		if err != nil {
+			http.Error(w, err.Error(), chaosErrorStatus(err))
+			return
+		}
+		writeJSON(w, http.StatusCreated, created)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func chaosRuleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/chaos/rules/")
+	if err := chaosInjector.RemoveRule(id, r.Header.Get("X-User-ID")); err != nil {
+		http.Error(w, err.Error(), chaosErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func chaosAuditHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, chaosAudit.Entries())
+}
+
+func chaosErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, chaos.ErrDisabled):
+		return http.StatusForbidden
+	case errors.Is(err, chaos.ErrActorRequired):
+		return http.StatusUnauthorized
+	case errors.Is(err, chaos.ErrRuleNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
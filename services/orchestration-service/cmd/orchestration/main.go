@@ -36,9 +36,12 @@ const (
 
 type Saga struct {
     ID        string    `json:"id"`
+    Type      string    `json:"type,omitempty"`
     UserID    string    `json:"user_id"`
     State     SagaState `json:"state"`
+    StartedAt time.Time `json:"started_at"`
     UpdatedAt time.Time `json:"updated_at"`
+    Version   int64     `json:"version"` // of the saga's event log
 }
 
 var (
@@ -63,6 +66,9 @@ func main() {
     // init redis client for saga persistence
     initRedis()
     initPostgres()
+    initSagaLog()
+    initChaos()
+    initSLA()
 
     // Start Kafka consumer if configured
     if ks := os.Getenv("KAFKA_BOOTSTRAP"); ks != "" {
@@ -118,33 +124,46 @@ func handleUserCreated(ctx context.Context, ev map[string]interface{}) {
         }
     }
     sagaId := fmt.Sprintf("saga-%d", time.Now().UnixNano())
-    s := &Saga{ID: sagaId, UserID: userId, State: SagaStarted, UpdatedAt: time.Now()}
-    // persist to redis
-    if redisClient != nil { if err := saveSagaToRedis(s); err != nil { fmt.Printf("warning: failed to save saga: %v\n", err) } }
-    mu.Lock()
-    sagastore[sagaId] = s
-    mu.Unlock()
+    if _, err := startSaga(context.Background(), sagaId, SagaTypeUserOnboarding, userId); err != nil {
+        fmt.Printf("failed to start saga for user %s: %v\n", userId, err)
+        return
+    }
 
     // move to provisioning
     updateSaga(sagaId, SagaProvision)
 
-    // call workspace-service to provision workspace
-    ok := callProvisionWorkspaceWithRetries(ctx, userId, sagaId, 3)
+    // call workspace-service to provision workspace, unless a chaos rule forces the step to fail
+    ok := false
+    failed := map[string]interface{}{"sagaId": sagaId, "userId": userId}
+    if injected, rule := injectChaos(SagaTypeUserOnboarding, StepProvisionWorkspace, sagaId); injected {
+        failed["chaosRuleId"] = rule.ID
+        failed["failedStep"] = StepProvisionWorkspace
+    } else {
+        ok = callProvisionWorkspaceWithRetries(ctx, userId, sagaId, 3)
+    }
     if ok {
         updateSaga(sagaId, SagaCompleted)
         publishEvent("UserOnboarded", map[string]interface{}{"userId": userId, "sagaId": sagaId, "completedAt": time.Now().UTC().Format(time.RFC3339)})
     } else {
         updateSaga(sagaId, SagaFailed)
-        publishEvent("SagaFailed", map[string]interface{}{"sagaId": sagaId, "userId": userId, "failedAt": time.Now().UTC().Format(time.RFC3339)})
+        failed["failedAt"] = time.Now().UTC().Format(time.RFC3339)
+        publishEvent("SagaFailed", failed)
     }
 }
 
 func updateSaga(id string, state SagaState) {
     mu.Lock()
-    defer mu.Unlock()
-    if s, ok := sagastore[id]; ok {
-        s.State = state
-        s.UpdatedAt = time.Now()
+    current, ok := sagastore[id]
+    var s Saga
+    if ok {
+        s = *current
+    }
+    mu.Unlock()
+    if !ok {
+        return
+    }
+    if _, err := transitionSaga(context.Background(), &s, state); err != nil {
+        fmt.Printf("warning: failed to record saga %s moving to %s: %v\n", id, state, err)
     }
 }
 
@@ -366,8 +385,8 @@ func saveSagaToPostgres(s *Saga) error {
     }
     payload, _ := json.Marshal(s)
     _, err := pgPool.Exec(context.Background(),
-        "INSERT INTO sagas(id,user_id,state,updated_at,payload) VALUES($1,$2,$3,$4,$5) ON CONFLICT (id) DO UPDATE SET state=EXCLUDED.state, updated_at=EXCLUDED.updated_at, payload=EXCLUDED.payload",
-        s.ID, s.UserID, string(s.State), s.UpdatedAt, payload)
+        "INSERT INTO sagas(id,user_id,state,updated_at,payload,version) VALUES($1,$2,$3,$4,$5,$6) ON CONFLICT (id) DO UPDATE SET state=EXCLUDED.state, updated_at=EXCLUDED.updated_at, payload=EXCLUDED.payload, version=EXCLUDED.version WHERE sagas.version < EXCLUDED.version",
+        s.ID, s.UserID, string(s.State), s.UpdatedAt, payload, s.Version)
     return err
 }
 
@@ -413,16 +432,12 @@ func reconcileStuckSagas() {
             fmt.Printf("reconciling saga %s user=%s\n", saga.ID, saga.UserID)
             ok := callProvisionWorkspaceWithRetries(context.Background(), saga.UserID, saga.ID, 3)
             if ok {
-                saga.State = SagaCompleted
-                saga.UpdatedAt = time.Now()
-                if err := saveSagaToPostgres(saga); err != nil {
+                if _, err := transitionSaga(context.Background(), saga, SagaCompleted); err != nil {
                     fmt.Printf("failed to save saga after reconcile: %v\n", err)
                 }
                 publishEvent("UserOnboarded", map[string]interface{}{"userId": saga.UserID, "sagaId": saga.ID, "completedAt": time.Now().UTC().Format(time.RFC3339)})
             } else {
-                saga.State = SagaFailed
-                saga.UpdatedAt = time.Now()
-                if err := saveSagaToPostgres(saga); err != nil {
+                if _, err := transitionSaga(context.Background(), saga, SagaFailed); err != nil {
                     fmt.Printf("failed to save saga after reconcile failure: %v\n", err)
                 }
                 publishEvent("SagaFailed", map[string]interface{}{"sagaId": saga.ID, "userId": saga.UserID, "failedAt": time.Now().UTC().Format(time.RFC3339)})
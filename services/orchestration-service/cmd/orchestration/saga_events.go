@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"orchestration/internal/sagalog"
+)
+
+var (
+	sagaLog *sagalog.Log
+
+	sagaEventsRecorded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "orchestration_saga_events_total",
+			Help: "Saga events appended to the event log",
+		},
+		[]string{"type"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sagaEventsRecorded)
+}
+
+// initSagaLog keeps saga state in the saga_events log, in Postgres when it
+// is available and in memory otherwise, snapshotting every
+// SAGA_SNAPSHOT_EVERY events (default 10)
+func initSagaLog() {
+	every := 10
+	if v := os.Getenv("SAGA_SNAPSHOT_EVERY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			every = n
+		}
+	}
+
+	var store sagalog.Store = pgSagaStore{}
+	if pgPool == nil {
+		fmt.Println("postgres unavailable; saga events kept in memory")
+		store = sagalog.NewMemoryStore()
+	}
+	sagaLog = sagalog.NewLog(store, every)
+
+	http.HandleFunc("/sagas/", sagaHandler)
+}
+
+// startSaga records a new saga and adds it to the in-memory store
+func startSaga(ctx context.Context, id, sagaType, userID string) (*Saga, error) {
+	state, err := sagaLog.Start(ctx, id, sagaType, userID, string(SagaStarted))
+	if err != nil && !errors.Is(err, sagalog.ErrSnapshot) {
+		return nil, err
+	}
+	return applySagaState(state, sagalog.EventStarted, err), nil
+}
+
+// transitionSaga records a saga's move to a new state. A saga changed
+// elsewhere in the meantime is reloaded from its log and the move applied
+// on top.
+func transitionSaga(ctx context.Context, current *Saga, state SagaState) (*Saga, error) {
+	s := sagaStateOf(current)
+	if s.Version == 0 {
+		// Sagas persisted before the event log have no events; their log
+		// begins with the state they were found in
+		started, err := sagaLog.Start(ctx, s.ID, s.Type, s.UserID, s.State)
+		switch {
+		case err == nil || errors.Is(err, sagalog.ErrSnapshot):
+			s = started
+		case !errors.Is(err, sagalog.ErrConflict):
+			return nil, err
+		}
+	}
+
+	data := map[string]string{"state": string(state), "from": s.State}
+	for attempt := 1; ; attempt++ {
+		next, err := sagaLog.Record(ctx, s, sagalog.EventStateChanged, data)
+		if errors.Is(err, sagalog.ErrConflict) && attempt < 3 {
+			if s, err = sagaLog.Load(ctx, current.ID); err != nil {
+				return nil, err
+			}
+			data["from"] = s.State
+			continue
+		}
+		if err != nil && !errors.Is(err, sagalog.ErrSnapshot) {
+			return nil, err
+		}
+		return applySagaState(next, sagalog.EventStateChanged, err), nil
+	}
+}
+
+// applySagaState makes a recorded state current: in memory, in Redis and in
+// the sagas read model
+func applySagaState(state sagalog.State, eventType string, snapshotErr error) *Saga {
+	sagaEventsRecorded.WithLabelValues(eventType).Inc()
+	if snapshotErr != nil {
+		fmt.Printf("warning: %v\n", snapshotErr)
+	}
+
+	s := sagaFromState(state)
+	mu.Lock()
+	if existing, ok := sagastore[s.ID]; !ok || existing.Version < s.Version {
+		copied := *s
+		sagastore[s.ID] = &copied
+	}
+	mu.Unlock()
+
+	if redisClient != nil {
+		if err := saveSagaToRedis(s); err != nil {
+			fmt.Printf("warning: failed to save saga: %v\n", err)
+		}
+	}
+	if pgPool != nil {
+		if err := saveSagaToPostgres(s); err != nil {
+			fmt.Printf("warning: failed to update saga read model: %v\n", err)
+		}
+	}
+	return s
+}
+
+func sagaFromState(state sagalog.State) *Saga {
+	return &Saga{
+		ID:        state.ID,
+		Type:      state.Type,
+		UserID:    state.UserID,
+		State:     SagaState(state.State),
+		StartedAt: state.StartedAt,
+		UpdatedAt: state.UpdatedAt,
+		Version:   state.Version,
+	}
+}
+
+func sagaStateOf(s *Saga) sagalog.State {
+	return sagalog.State{
+		ID:        s.ID,
+		Type:      s.Type,
+		UserID:    s.UserID,
+		State:     string(s.State),
+		StartedAt: s.StartedAt,
+		UpdatedAt: s.UpdatedAt,
+		Version:   s.Version,
+	}
+}
+
+// pgSagaStore keeps the saga event log in the saga_events and
+// saga_snapshots tables
+type pgSagaStore struct{}
+
+func (pgSagaStore) Append(ctx context.Context, expected int64, events []sagalog.Event) error {
+	tx, err := pgPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// A saga that moved past expected shows in its last seq; an append
+	// racing this one hits the primary key instead
+	var last int64
+	if err := tx.QueryRow(ctx, "SELECT COALESCE(MAX(seq),0) FROM saga_events WHERE saga_id=$1", events[0].SagaID).Scan(&last); err != nil {
+		return err
+	}
+	if last != expected {
+		return sagalog.ErrConflict
+	}
+	for _, e := range events {
+		data, _ := json.Marshal(e.Data)
+		_, err := tx.Exec(ctx, "INSERT INTO saga_events(saga_id,seq,type,time,data) VALUES($1,$2,$3,$4,$5)",
+			e.SagaID, e.Seq, e.Type, e.Time, data)
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return sagalog.ErrConflict
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (pgSagaStore) Events(ctx context.Context, sagaID string, after int64, until time.Time) ([]sagalog.Event, error) {
+	query := "SELECT saga_id,seq,type,time,data FROM saga_events WHERE saga_id=$1 AND seq>$2 ORDER BY seq"
+	args := []interface{}{sagaID, after}
+	if !until.IsZero() {
+		query = "SELECT saga_id,seq,type,time,data FROM saga_events WHERE saga_id=$1 AND seq>$2 AND time<=$3 ORDER BY seq"
+		args = append(args, until)
+	}
+	rows, err := pgPool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []sagalog.Event
+	for rows.Next() {
+		var e sagalog.Event
+		var data []byte
+		if err := rows.Scan(&e.SagaID, &e.Seq, &e.Type, &e.Time, &data); err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &e.Data); err != nil {
+				return nil, err
+			}
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (pgSagaStore) SaveSnapshot(ctx context.Context, state sagalog.State) error {
+	b, _ := json.Marshal(state)
+	_, err := pgPool.Exec(ctx,
+		"INSERT INTO saga_snapshots(saga_id,version,updated_at,state) VALUES($1,$2,$3,$4) ON CONFLICT (saga_id, version) DO NOTHING",
+		state.ID, state.Version, state.UpdatedAt, b)
+	return err
+}
+
+func (pgSagaStore) Snapshot(ctx context.Context, sagaID string, until time.Time) (*sagalog.State, error) {
+	query := "SELECT state FROM saga_snapshots WHERE saga_id=$1 ORDER BY version DESC LIMIT 1"
+	args := []interface{}{sagaID}
+	if !until.IsZero() {
+		query = "SELECT state FROM saga_snapshots WHERE saga_id=$1 AND updated_at<=$2 ORDER BY version DESC LIMIT 1"
+		args = append(args, until)
+	}
+	var b []byte
+	if err := pgPool.QueryRow(ctx, query, args...).Scan(&b); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var state sagalog.State
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// sagaHandler serves a saga's state, /sagas/{id} (with ?at=RFC3339 for its
+// state at that moment), and its history, /sagas/{id}/events
+func sagaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sagas/"), "/")
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch rest {
+	case "":
+		var state sagalog.State
+		var err error
+		if at := r.URL.Query().Get("at"); at != "" {
+			t, parseErr := time.Parse(time.RFC3339, at)
+			if parseErr != nil {
+				http.Error(w, "at must be an RFC3339 time", http.StatusBadRequest)
+				return
+			}
+			state, err = sagaLog.StateAt(r.Context(), id, t)
+		} else {
+			state, err = sagaLog.Load(r.Context(), id)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), sagaLogErrorStatus(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, sagaFromState(state))
+	case "events":
+		events, err := sagaLog.History(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), sagaLogErrorStatus(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, events)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func sagaLogErrorStatus(err error) int {
+	if errors.Is(err, sagalog.ErrNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"orchestration/internal/sla"
+)
+
+var slaMonitor *sla.Monitor
+
+// initSLA loads saga SLAs from SAGA_SLAS ("SagaType=duration,...") and
+// starts the escalation loop
+func initSLA() {
+	spec := os.Getenv("SAGA_SLAS")
+	if spec == "" {
+		spec = SagaTypeUserOnboarding + "=10m"
+	}
+	slas, err := sla.ParseDefinitions(spec)
+	if err != nil {
+		fmt.Printf("invalid SAGA_SLAS, SLA monitoring disabled: %v\n", err)
+		slas = map[string]time.Duration{}
+	}
+	slaMonitor = sla.NewMonitor(slas)
+
+	interval := 30 * time.Second
+	if v := os.Getenv("SAGA_SLA_CHECK_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			interval = d
+		}
+	}
+
+	http.HandleFunc("/sagas/overdue", overdueSagasHandler)
+	go runSLAEscalation(interval)
+}
+
+// runningSagas snapshots sagas that have not reached a terminal state
+func runningSagas() []sla.Saga {
+	mu.Lock()
+	defer mu.Unlock()
+	running := make([]sla.Saga, 0, len(sagastore))
+	for _, s := range sagastore {
+		if s.State == SagaCompleted || s.State == SagaFailed {
+			continue
+		}
+		running = append(running, sla.Saga{ID: s.ID, SagaType: s.Type, Step: string(s.State), StartedAt: s.StartedAt})
+	}
+	return running
+}
+
+func runSLAEscalation(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, o := range slaMonitor.Escalate(runningSagas()) {
+			escalateOverdueSaga(o)
+		}
+	}
+}
+
+// escalateOverdueSaga publishes an escalation event for event-streaming and
+// raises it with the monitoring notification engine
+func escalateOverdueSaga(o sla.Overdue) {
+	fmt.Printf("saga %s (%s) exceeded SLA: age=%.0fs sla=%.0fs step=%s\n", o.SagaID, o.SagaType, o.AgeSeconds, o.SLASeconds, o.Step)
+	payload := map[string]interface{}{
+		"sagaId":      o.SagaID,
+		"sagaType":    o.SagaType,
+		"currentStep": o.Step,
+		"startedAt":   o.StartedAt.UTC().Format(time.RFC3339),
+		"ageSeconds":  o.AgeSeconds,
+		"slaSeconds":  o.SLASeconds,
+		"escalatedAt": o.EscalatedAt.Format(time.RFC3339),
+	}
+	publishEvent("SagaSLABreached", payload)
+
+	url := os.Getenv("MONITORING_NOTIFY_URL")
+	if url == "" {
+		return
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"source":   "orchestration-service",
+		"type":     "saga_sla_breached",
+		"severity": "warning",
+		"title":    fmt.Sprintf("Saga %s exceeded its %s SLA", o.SagaID, time.Duration(o.SLASeconds*float64(time.Second))),
+		"details":  payload,
+	})
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		fmt.Printf("failed to notify monitoring of overdue saga %s: %v\n", o.SagaID, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fmt.Printf("monitoring rejected overdue saga notification for %s: %s\n", o.SagaID, resp.Status)
+	}
+}
+
+func overdueSagasHandler(w http.ResponseWriter, r *http.Request) {
+	overdue := slaMonitor.Overdue(runningSagas())
+	if overdue == nil {
+		overdue = []sla.Overdue{}
+	}
+	writeJSON(w, http.StatusOK, overdue)
+}
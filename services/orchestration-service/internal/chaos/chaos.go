@@ -0,0 +1,274 @@
+// Package chaos forces selected saga steps to fail so that compensation
+// logic and alerting can be exercised on purpose. Rules match by saga type
+// and step name and fire for a percentage of executions. Injection is
+// refused outright in production, and every rule change and injected fault
+// is written to the audit sink.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit actions
+const (
+	ActionRuleCreated   = "rule_created"
+	ActionRuleDeleted   = "rule_deleted"
+	ActionFaultInjected = "fault_injected"
+)
+
+// Wildcard matches any saga type or step name
+const Wildcard = "*"
+
+var (
+	ErrProductionEnvironment = errors.New("chaos mode is not available in production")
+	ErrDisabled              = errors.New("chaos mode is disabled")
+	ErrRuleNotFound          = errors.New("chaos rule not found")
+	ErrActorRequired         = errors.New("actor is required for chaos changes")
+)
+
+// Rule forces a saga step to fail for a percentage of executions
+type Rule struct {
+	ID         string     `json:"id"`
+	SagaType   string     `json:"saga_type"`
+	Step       string     `json:"step"`
+	Percentage float64    `json:"percentage"`
+	Reason     string     `json:"reason"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Injected   int64      `json:"injected"`
+}
+
+func (r *Rule) matches(sagaType, step string, now time.Time) bool {
+	if r.ExpiresAt != nil && now.After(*r.ExpiresAt) {
+		return false
+	}
+	return (r.SagaType == Wildcard || r.SagaType == sagaType) &&
+		(r.Step == Wildcard || r.Step == step)
+}
+
+// AuditEntry records a chaos rule change or an injected fault
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Actor    string    `json:"actor"`
+	RuleID   string    `json:"rule_id"`
+	SagaType string    `json:"saga_type"`
+	Step     string    `json:"step"`
+	SagaID   string    `json:"saga_id,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// AuditSink receives audit entries
+type AuditSink interface {
+	Record(entry AuditEntry)
+}
+
+// IsProduction reports whether an environment name denotes production
+func IsProduction(environment string) bool {
+	switch strings.ToLower(strings.TrimSpace(environment)) {
+	case "prod", "production":
+		return true
+	}
+	return false
+}
+
+// Injector holds the active rules and decides when a step should fail
+type Injector struct {
+	mu      sync.Mutex
+	enabled bool
+	rules   map[string]*Rule
+	audit   AuditSink
+	random  *rand.Rand
+	now     func() time.Time
+	nextID  int64
+}
+
+// NewInjector returns an injector for the given environment. It is only
+// enabled when requested and the environment is not production.
+func NewInjector(environment string, enabled bool, audit AuditSink) *Injector {
+	return &Injector{
+		enabled: enabled && !IsProduction(environment),
+		rules:   make(map[string]*Rule),
+		audit:   audit,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:     time.Now,
+	}
+}
+
+// Enabled reports whether faults can be injected
+func (i *Injector) Enabled() bool {
+	return i != nil && i.enabled
+}
+
+// AddRule validates and stores a rule
+func (i *Injector) AddRule(rule Rule, actor string) (*Rule, error) {
+	if !i.Enabled() {
+		return nil, ErrDisabled
+	}
+	if actor == "" {
+		return nil, ErrActorRequired
+	}
+	if rule.SagaType == "" || rule.Step == "" {
+		return nil, errors.New("saga_type and step are required")
+	}
+	if rule.Percentage <= 0 || rule.Percentage > 100 {
+		return nil, errors.New("percentage must be in (0, 100]")
+	}
+
+	i.mu.Lock()
+	now := i.now().UTC()
+	i.nextID++
+	rule.ID = fmt.Sprintf("chaos-%d-%d", now.UnixNano(), i.nextID)
+	rule.CreatedBy = actor
+	rule.CreatedAt = now
+	rule.Injected = 0
+	stored := rule
+	i.rules[rule.ID] = &stored
+	i.mu.Unlock()
+
+	i.record(AuditEntry{
+		Time:     now,
+		Action:   ActionRuleCreated,
+		Actor:    actor,
+		RuleID:   rule.ID,
+		SagaType: rule.SagaType,
+		Step:     rule.Step,
+		Detail:   fmt.Sprintf("percentage=%g reason=%q", rule.Percentage, rule.Reason),
+	})
+	return &rule, nil
+}
+
+// RemoveRule deletes a rule
+func (i *Injector) RemoveRule(id, actor string) error {
+	if actor == "" {
+		return ErrActorRequired
+	}
+
+	i.mu.Lock()
+	rule, ok := i.rules[id]
+	if ok {
+		delete(i.rules, id)
+	}
+	i.mu.Unlock()
+	if !ok {
+		return ErrRuleNotFound
+	}
+
+	i.record(AuditEntry{
+		Time:     i.now().UTC(),
+		Action:   ActionRuleDeleted,
+		Actor:    actor,
+		RuleID:   id,
+		SagaType: rule.SagaType,
+		Step:     rule.Step,
+		Detail:   fmt.Sprintf("injected=%d", rule.Injected),
+	})
+	return nil
+}
+
+// Rules returns a snapshot of the configured rules, dropping expired ones
+func (i *Injector) Rules() []Rule {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := i.now()
+	rules := make([]Rule, 0, len(i.rules))
+	for id, rule := range i.rules {
+		if rule.ExpiresAt != nil && now.After(*rule.ExpiresAt) {
+			delete(i.rules, id)
+			continue
+		}
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+// ShouldFail reports whether the step should be forced to fail for this
+// execution and, if so, which rule fired
+func (i *Injector) ShouldFail(sagaType, step, sagaID string) (bool, *Rule) {
+	if !i.Enabled() {
+		return false, nil
+	}
+
+	i.mu.Lock()
+	now := i.now()
+	var fired *Rule
+	for _, rule := range i.rules {
+		if !rule.matches(sagaType, step, now) {
+			continue
+		}
+		if i.random.Float64()*100 < rule.Percentage {
+			rule.Injected++
+			snapshot := *rule
+			fired = &snapshot
+			break
+		}
+	}
+	i.mu.Unlock()
+
+	if fired == nil {
+		return false, nil
+	}
+
+	i.record(AuditEntry{
+		Time:     now.UTC(),
+		Action:   ActionFaultInjected,
+		Actor:    fired.CreatedBy,
+		RuleID:   fired.ID,
+		SagaType: sagaType,
+		Step:     step,
+		SagaID:   sagaID,
+	})
+	return true, fired
+}
+
+func (i *Injector) record(entry AuditEntry) {
+	if i.audit != nil {
+		i.audit.Record(entry)
+	}
+}
+
+// MemoryAudit keeps the most recent audit entries in memory
+type MemoryAudit struct {
+	mu      sync.Mutex
+	limit   int
+	entries []AuditEntry
+}
+
+// NewMemoryAudit returns a sink holding up to limit entries
+func NewMemoryAudit(limit int) *MemoryAudit {
+	return &MemoryAudit{limit: limit}
+}
+
+// Record appends an entry, evicting the oldest past the limit
+func (m *MemoryAudit) Record(entry AuditEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = append(m.entries, entry)
+	if m.limit > 0 && len(m.entries) > m.limit {
+		m.entries = m.entries[len(m.entries)-m.limit:]
+	}
+}
+
+// Entries returns a copy of the recorded entries, oldest first
+func (m *MemoryAudit) Entries() []AuditEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]AuditEntry(nil), m.entries...)
+}
+
+// MultiAudit fans entries out to several sinks
+type MultiAudit []AuditSink
+
+// Record forwards the entry to every sink
+func (m MultiAudit) Record(entry AuditEntry) {
+	for _, sink := range m {
+		sink.Record(entry)
+	}
+}
@@ -0,0 +1,81 @@
+package chaos
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInjectorRefusedInProduction(t *testing.T) {
+	inj := NewInjector("production", true, nil)
+	if inj.Enabled() {
+		t.Fatal("injector must be disabled in production")
+	}
+	if _, err := inj.AddRule(Rule{SagaType: "UserOnboarding", Step: "provision_workspace", Percentage: 100}, "alice"); err != ErrDisabled {
+		t.Fatalf("expected ErrDisabled, got %v", err)
+	}
+}
+
+func TestShouldFailMatchesAndAudits(t *testing.T) {
+	audit := NewMemoryAudit(10)
+	inj := NewInjector("staging", true, audit)
+
+	rule, err := inj.AddRule(Rule{SagaType: "UserOnboarding", Step: "provision_workspace", Percentage: 100}, "alice")
+	if err != nil {
+		t.Fatalf("add rule: %v", err)
+	}
+
+	if fail, _ := inj.ShouldFail("UserOnboarding", "other_step", "saga-1"); fail {
+		t.Fatal("rule must not match a different step")
+	}
+	fail, fired := inj.ShouldFail("UserOnboarding", "provision_workspace", "saga-1")
+	if !fail || fired == nil || fired.ID != rule.ID {
+		t.Fatalf("expected rule %s to fire, got %v %+v", rule.ID, fail, fired)
+	}
+
+	entries := audit.Entries()
+	if len(entries) != 2 || entries[0].Action != ActionRuleCreated || entries[1].Action != ActionFaultInjected {
+		t.Fatalf("unexpected audit trail: %+v", entries)
+	}
+	if entries[1].SagaID != "saga-1" || entries[1].Actor != "alice" {
+		t.Fatalf("fault entry missing context: %+v", entries[1])
+	}
+
+	if err := inj.RemoveRule(rule.ID, "bob"); err != nil {
+		t.Fatalf("remove rule: %v", err)
+	}
+	if fail, _ := inj.ShouldFail("UserOnboarding", "provision_workspace", "saga-2"); fail {
+		t.Fatal("removed rule must not fire")
+	}
+}
+
+func TestExpiredRulesDoNotFire(t *testing.T) {
+	inj := NewInjector("dev", true, nil)
+	expired := time.Now().Add(-time.Minute)
+	if _, err := inj.AddRule(Rule{SagaType: Wildcard, Step: Wildcard, Percentage: 100, ExpiresAt: &expired}, "alice"); err != nil {
+		t.Fatalf("add rule: %v", err)
+	}
+	if fail, _ := inj.ShouldFail("UserOnboarding", "provision_workspace", "saga-1"); fail {
+		t.Fatal("expired rule must not fire")
+	}
+	if len(inj.Rules()) != 0 {
+		t.Fatal("expired rule should be dropped from the listing")
+	}
+}
+
+func TestAddRuleValidation(t *testing.T) {
+	inj := NewInjector("dev", true, nil)
+	cases := []struct {
+		rule  Rule
+		actor string
+	}{
+		{Rule{SagaType: "s", Step: "x", Percentage: 50}, ""},
+		{Rule{Step: "x", Percentage: 50}, "alice"},
+		{Rule{SagaType: "s", Step: "x", Percentage: 0}, "alice"},
+		{Rule{SagaType: "s", Step: "x", Percentage: 101}, "alice"},
+	}
+	for _, c := range cases {
+		if _, err := inj.AddRule(c.rule, c.actor); err == nil {
+			t.Errorf("expected error for %+v by %q", c.rule, c.actor)
+		}
+	}
+}
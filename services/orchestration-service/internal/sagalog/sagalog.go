@@ -0,0 +1,255 @@
+// Package sagalog keeps saga state as an append-only log of events. A
+// saga's state is whatever its events add up to, so its whole history can
+// be audited and its state at any past moment rebuilt. Snapshots of the
+// state are taken every few events so that rebuilding it never replays
+// more than that many.
+package sagalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventStarted      = "saga_started"
+	EventStateChanged = "state_changed"
+)
+
+var (
+	ErrNotFound   = errors.New("saga not found")
+	ErrConflict   = errors.New("saga was changed concurrently")
+	ErrOutOfOrder = errors.New("saga event out of order")
+	ErrSnapshot   = errors.New("saga snapshot failed")
+)
+
+// Event is one change to a saga. Seq numbers a saga's events from 1 with no
+// gaps.
+type Event struct {
+	SagaID string            `json:"saga_id"`
+	Seq    int64             `json:"seq"`
+	Type   string            `json:"type"`
+	Time   time.Time         `json:"time"`
+	Data   map[string]string `json:"data,omitempty"`
+}
+
+// State is a saga as of its Version'th event
+type State struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type,omitempty"`
+	UserID    string    `json:"user_id"`
+	State     string    `json:"state"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Version   int64     `json:"version"`
+}
+
+// Apply returns the state after an event. Events must be applied in order;
+// unknown event types only advance the version.
+func Apply(s State, e Event) (State, error) {
+	if e.Seq != s.Version+1 {
+		return s, fmt.Errorf("%w: saga %s at version %d got event %d", ErrOutOfOrder, e.SagaID, s.Version, e.Seq)
+	}
+	switch e.Type {
+	case EventStarted:
+		s.ID = e.SagaID
+		s.Type = e.Data["type"]
+		s.UserID = e.Data["user_id"]
+		s.State = e.Data["state"]
+		s.StartedAt = e.Time
+	case EventStateChanged:
+		s.State = e.Data["state"]
+	}
+	s.UpdatedAt = e.Time
+	s.Version = e.Seq
+	return s, nil
+}
+
+// Store persists events and snapshots
+type Store interface {
+	// Append adds events following version expected of their saga, failing
+	// with ErrConflict when the saga has moved past it
+	Append(ctx context.Context, expected int64, events []Event) error
+	// Events returns a saga's events after seq, up to and including until
+	// unless it is zero, in order
+	Events(ctx context.Context, sagaID string, after int64, until time.Time) ([]Event, error)
+	SaveSnapshot(ctx context.Context, state State) error
+	// Snapshot returns the saga's latest snapshot last updated no later than
+	// until, any if it is zero, or nil
+	Snapshot(ctx context.Context, sagaID string, until time.Time) (*State, error)
+}
+
+// Log records saga events and rebuilds saga state from them
+type Log struct {
+	store         Store
+	snapshotEvery int64
+	now           func() time.Time
+}
+
+// NewLog returns a log snapshotting every snapshotEvery events; zero or less
+// never snapshots
+func NewLog(store Store, snapshotEvery int) *Log {
+	return &Log{store: store, snapshotEvery: int64(snapshotEvery), now: time.Now}
+}
+
+// Record appends an event to a saga whose current state is s and returns
+// the new state. It fails with ErrConflict when the saga has moved past s.
+// A failed snapshot is reported wrapped in ErrSnapshot alongside the new
+// state, which was recorded all the same.
+func (l *Log) Record(ctx context.Context, s State, eventType string, data map[string]string) (State, error) {
+	event := Event{
+		SagaID: s.ID,
+		Seq:    s.Version + 1,
+		Type:   eventType,
+		Time:   l.now().UTC(),
+		Data:   data,
+	}
+	next, err := Apply(s, event)
+	if err != nil {
+		return s, err
+	}
+	if err := l.store.Append(ctx, s.Version, []Event{event}); err != nil {
+		return s, err
+	}
+
+	if l.snapshotEvery > 0 && next.Version%l.snapshotEvery == 0 {
+		if err := l.store.SaveSnapshot(ctx, next); err != nil {
+			return next, fmt.Errorf("%w: %v", ErrSnapshot, err)
+		}
+	}
+	return next, nil
+}
+
+// Start records the first event of a new saga
+func (l *Log) Start(ctx context.Context, id, sagaType, userID, state string) (State, error) {
+	return l.Record(ctx, State{ID: id}, EventStarted, map[string]string{
+		"type":    sagaType,
+		"user_id": userID,
+		"state":   state,
+	})
+}
+
+// Load rebuilds a saga's current state
+func (l *Log) Load(ctx context.Context, id string) (State, error) {
+	return l.rebuild(ctx, id, time.Time{})
+}
+
+// StateAt rebuilds a saga's state as it was at t
+func (l *Log) StateAt(ctx context.Context, id string, t time.Time) (State, error) {
+	if t.IsZero() {
+		return State{}, errors.New("a time is required")
+	}
+	return l.rebuild(ctx, id, t)
+}
+
+// History returns all of a saga's events
+func (l *Log) History(ctx context.Context, id string) ([]Event, error) {
+	events, err := l.store.Events(ctx, id, 0, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, ErrNotFound
+	}
+	return events, nil
+}
+
+// rebuild replays the events after the latest usable snapshot
+func (l *Log) rebuild(ctx context.Context, id string, until time.Time) (State, error) {
+	var s State
+	snapshot, err := l.store.Snapshot(ctx, id, until)
+	if err != nil {
+		return s, err
+	}
+	if snapshot != nil {
+		s = *snapshot
+	}
+
+	events, err := l.store.Events(ctx, id, s.Version, until)
+	if err != nil {
+		return s, err
+	}
+	for _, e := range events {
+		if s, err = Apply(s, e); err != nil {
+			return s, err
+		}
+	}
+	if s.Version == 0 {
+		return s, ErrNotFound
+	}
+	return s, nil
+}
+
+// MemoryStore keeps events and snapshots in memory
+type MemoryStore struct {
+	mu        sync.Mutex
+	events    map[string][]Event
+	snapshots map[string][]State
+}
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		events:    make(map[string][]Event),
+		snapshots: make(map[string][]State),
+	}
+}
+
+func (m *MemoryStore) Append(ctx context.Context, expected int64, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := events[0].SagaID
+	if int64(len(m.events[id])) != expected {
+		return ErrConflict
+	}
+	m.events[id] = append(m.events[id], events...)
+	return nil
+}
+
+func (m *MemoryStore) Events(ctx context.Context, sagaID string, after int64, until time.Time) ([]Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var events []Event
+	for _, e := range m.events[sagaID] {
+		if e.Seq <= after {
+			continue
+		}
+		if !until.IsZero() && e.Time.After(until) {
+			break
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (m *MemoryStore) SaveSnapshot(ctx context.Context, state State) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snapshots[state.ID] = append(m.snapshots[state.ID], state)
+	return nil
+}
+
+func (m *MemoryStore) Snapshot(ctx context.Context, sagaID string, until time.Time) (*State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var found *State
+	for i := range m.snapshots[sagaID] {
+		s := m.snapshots[sagaID][i]
+		if !until.IsZero() && s.UpdatedAt.After(until) {
+			continue
+		}
+		if found == nil || s.Version > found.Version {
+			found = &s
+		}
+	}
+	return found, nil
+}
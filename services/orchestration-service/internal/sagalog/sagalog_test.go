@@ -0,0 +1,104 @@
+package sagalog
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRecordAndLoad(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 14, 0, 0, 0, time.UTC)
+	now := start
+	l := NewLog(NewMemoryStore(), 2)
+	l.now = func() time.Time { return now }
+
+	s, err := l.Start(ctx, "saga-1", "UserOnboarding", "user-1", "started")
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	for _, state := range []string{"provisioning_workspace", "completed"} {
+		now = now.Add(time.Minute)
+		if s, err = l.Record(ctx, s, EventStateChanged, map[string]string{"state": state}); err != nil {
+			t.Fatalf("record %s: %v", state, err)
+		}
+	}
+
+	loaded, err := l.Load(ctx, "saga-1")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if loaded != s || loaded.State != "completed" || loaded.Version != 3 || loaded.UserID != "user-1" || !loaded.StartedAt.Equal(start) {
+		t.Fatalf("unexpected state %+v, recorded %+v", loaded, s)
+	}
+
+	history, err := l.History(ctx, "saga-1")
+	if err != nil || len(history) != 3 || history[1].Data["state"] != "provisioning_workspace" {
+		t.Fatalf("unexpected history %+v (%v)", history, err)
+	}
+
+	if _, err := l.Load(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestStateAtUsesSnapshots(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 14, 0, 0, 0, time.UTC)
+	now := start
+	store := NewMemoryStore()
+	l := NewLog(store, 2)
+	l.now = func() time.Time { return now }
+
+	s, _ := l.Start(ctx, "saga-1", "UserOnboarding", "user-1", "started")
+	for i, state := range []string{"a", "b", "c", "d"} {
+		now = start.Add(time.Duration(i+1) * time.Minute)
+		s, _ = l.Record(ctx, s, EventStateChanged, map[string]string{"state": state})
+	}
+	if len(store.snapshots["saga-1"]) != 2 {
+		t.Fatalf("expected snapshots at versions 2 and 4, got %+v", store.snapshots["saga-1"])
+	}
+
+	cases := []struct {
+		at      time.Time
+		state   string
+		version int64
+	}{
+		{start, "started", 1},
+		{start.Add(90 * time.Second), "a", 2},
+		{start.Add(2 * time.Minute), "b", 3},
+		{start.Add(time.Hour), "d", 5},
+	}
+	for _, tc := range cases {
+		got, err := l.StateAt(ctx, "saga-1", tc.at)
+		if err != nil {
+			t.Fatalf("state at %s: %v", tc.at, err)
+		}
+		if got.State != tc.state || got.Version != tc.version {
+			t.Errorf("state at %s: got %s@%d, want %s@%d", tc.at, got.State, got.Version, tc.state, tc.version)
+		}
+	}
+
+	if _, err := l.StateAt(ctx, "saga-1", start.Add(-time.Second)); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound before the saga started, got %v", err)
+	}
+}
+
+func TestRecordDetectsConflicts(t *testing.T) {
+	ctx := context.Background()
+	l := NewLog(NewMemoryStore(), 0)
+
+	s, _ := l.Start(ctx, "saga-1", "UserOnboarding", "user-1", "started")
+	if _, err := l.Record(ctx, s, EventStateChanged, map[string]string{"state": "completed"}); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	// A writer still holding the older state loses
+	if _, err := l.Record(ctx, s, EventStateChanged, map[string]string{"state": "failed"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+
+	if _, err := Apply(State{}, Event{SagaID: "saga-1", Seq: 2}); !errors.Is(err, ErrOutOfOrder) {
+		t.Fatalf("expected ErrOutOfOrder, got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+// Package sla tracks saga completion deadlines. Saga types declare an
+// expected completion time; sagas still running past it are reported as
+// overdue and escalated exactly once.
+package sla
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Saga is the subset of saga state the monitor needs
+type Saga struct {
+	ID        string
+	SagaType  string
+	Step      string
+	StartedAt time.Time
+}
+
+// Overdue describes a saga running past its SLA
+type Overdue struct {
+	SagaID      string     `json:"saga_id"`
+	SagaType    string     `json:"saga_type"`
+	Step        string     `json:"current_step"`
+	StartedAt   time.Time  `json:"started_at"`
+	AgeSeconds  float64    `json:"age_seconds"`
+	SLASeconds  float64    `json:"sla_seconds"`
+	EscalatedAt *time.Time `json:"escalated_at,omitempty"`
+}
+
+// ParseDefinitions reads "SagaType=duration" pairs separated by commas,
+// e.g. "UserOnboarding=10m,Billing=1h"
+func ParseDefinitions(spec string) (map[string]time.Duration, error) {
+	slas := make(map[string]time.Duration)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid saga SLA %q, expected SagaType=duration", entry)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration for saga %s: %q", name, value)
+		}
+		slas[strings.TrimSpace(name)] = d
+	}
+	return slas, nil
+}
+
+// Monitor evaluates running sagas against their SLAs
+type Monitor struct {
+	mu        sync.Mutex
+	slas      map[string]time.Duration
+	escalated map[string]time.Time
+	now       func() time.Time
+}
+
+// NewMonitor returns a monitor for the given per-type SLAs
+func NewMonitor(slas map[string]time.Duration) *Monitor {
+	return &Monitor{
+		slas:      slas,
+		escalated: make(map[string]time.Time),
+		now:       time.Now,
+	}
+}
+
+// SLA returns the declared SLA for a saga type
+func (m *Monitor) SLA(sagaType string) (time.Duration, bool) {
+	d, ok := m.slas[sagaType]
+	return d, ok
+}
+
+// Overdue returns the running sagas past their SLA, oldest first
+func (m *Monitor) Overdue(running []Saga) []Overdue {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.overdue(running)
+}
+
+// Escalate returns sagas that became overdue since the last call and marks
+// them escalated. Sagas no longer running are forgotten.
+func (m *Monitor) Escalate(running []Saga) []Overdue {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	active := make(map[string]bool, len(running))
+	for _, s := range running {
+		active[s.ID] = true
+	}
+	for id := range m.escalated {
+		if !active[id] {
+			delete(m.escalated, id)
+		}
+	}
+
+	var fresh []Overdue
+	now := m.now().UTC()
+	for _, o := range m.overdue(running) {
+		if o.EscalatedAt != nil {
+			continue
+		}
+		m.escalated[o.SagaID] = now
+		escalatedAt := now
+		o.EscalatedAt = &escalatedAt
+		fresh = append(fresh, o)
+	}
+	return fresh
+}
+
+func (m *Monitor) overdue(running []Saga) []Overdue {
+	now := m.now()
+	var overdue []Overdue
+	for _, s := range running {
+		limit, ok := m.slas[s.SagaType]
+		if !ok || s.StartedAt.IsZero() {
+			continue
+		}
+		age := now.Sub(s.StartedAt)
+		if age <= limit {
+			continue
+		}
+		o := Overdue{
+			SagaID:     s.ID,
+			SagaType:   s.SagaType,
+			Step:       s.Step,
+			StartedAt:  s.StartedAt,
+			AgeSeconds: age.Seconds(),
+			SLASeconds: limit.Seconds(),
+		}
+		if at, ok := m.escalated[s.ID]; ok {
+			o.EscalatedAt = &at
+		}
+		overdue = append(overdue, o)
+	}
+	sort.Slice(overdue, func(i, j int) bool { return overdue[i].AgeSeconds > overdue[j].AgeSeconds })
+	return overdue
+}
@@ -0,0 +1,52 @@
+package sla
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDefinitions(t *testing.T) {
+	slas, err := ParseDefinitions("UserOnboarding=10m, Billing=1h")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if slas["UserOnboarding"] != 10*time.Minute || slas["Billing"] != time.Hour {
+		t.Fatalf("unexpected definitions: %v", slas)
+	}
+	for _, bad := range []string{"UserOnboarding", "=5m", "UserOnboarding=soon", "UserOnboarding=-1m"} {
+		if _, err := ParseDefinitions(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestEscalateOncePerSaga(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := NewMonitor(map[string]time.Duration{"UserOnboarding": 10 * time.Minute})
+	m.now = func() time.Time { return now }
+
+	running := []Saga{
+		{ID: "late", SagaType: "UserOnboarding", Step: "provisioning_workspace", StartedAt: now.Add(-15 * time.Minute)},
+		{ID: "fresh", SagaType: "UserOnboarding", Step: "started", StartedAt: now.Add(-time.Minute)},
+		{ID: "untracked", SagaType: "Other", Step: "started", StartedAt: now.Add(-time.Hour)},
+	}
+
+	escalated := m.Escalate(running)
+	if len(escalated) != 1 || escalated[0].SagaID != "late" || escalated[0].Step != "provisioning_workspace" {
+		t.Fatalf("expected only the late saga to escalate, got %+v", escalated)
+	}
+	if again := m.Escalate(running); len(again) != 0 {
+		t.Fatalf("saga escalated twice: %+v", again)
+	}
+
+	overdue := m.Overdue(running)
+	if len(overdue) != 1 || overdue[0].EscalatedAt == nil || overdue[0].AgeSeconds != 900 {
+		t.Fatalf("unexpected overdue listing: %+v", overdue)
+	}
+
+	// Once the saga finishes it is forgotten
+	m.Escalate(running[1:])
+	if len(m.escalated) != 0 {
+		t.Fatalf("finished saga still tracked: %v", m.escalated)
+	}
+}
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS chaos_audit;
\ No newline at end of file
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS chaos_audit (
+  id BIGSERIAL PRIMARY KEY,
+  time TIMESTAMP NOT NULL,
+  action TEXT NOT NULL,
+  actor TEXT,
+  rule_id TEXT,
+  saga_type TEXT,
+  step TEXT,
+  saga_id TEXT,
+  detail TEXT
+);
+CREATE INDEX IF NOT EXISTS chaos_audit_time_idx ON chaos_audit (time);
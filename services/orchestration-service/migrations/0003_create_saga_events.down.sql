@@ -0,0 +1,3 @@
+ALTER TABLE sagas DROP COLUMN IF EXISTS version;
+DROP TABLE IF EXISTS saga_snapshots;
+DROP TABLE IF EXISTS saga_events;
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS saga_events (
+  saga_id TEXT NOT NULL,
+  seq BIGINT NOT NULL,
+  type TEXT NOT NULL,
+  time TIMESTAMPTZ NOT NULL,
+  data JSONB,
+  PRIMARY KEY (saga_id, seq)
+);
+CREATE INDEX IF NOT EXISTS saga_events_time_idx ON saga_events (time);
+
+CREATE TABLE IF NOT EXISTS saga_snapshots (
+  saga_id TEXT NOT NULL,
+  version BIGINT NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL,
+  state JSONB NOT NULL,
+  PRIMARY KEY (saga_id, version)
+);
+
+ALTER TABLE sagas ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0;
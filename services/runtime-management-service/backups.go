@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Application backups are delegated to the backup-service: each persistent
+// volume claim of the application and its bound database becomes one backup
+// job there. An ApplicationBackup groups those jobs so the runtime API can
+// report a single status per backup or restore.
+
+// Backup operations and statuses
+const (
+	BackupOperationBackup  = "backup"
+	BackupOperationRestore = "restore"
+
+	AppBackupPending   = "pending"
+	AppBackupRunning   = "running"
+	AppBackupCompleted = "completed"
+	AppBackupFailed    = "failed"
+)
+
+// ApplicationBackup tracks a backup or restore of an application
+type ApplicationBackup struct {
+	ID               uint       `json:"id" gorm:"primaryKey"`
+	ApplicationID    uint       `json:"application_id" gorm:"index;not null"`
+	Operation        string     `json:"operation" gorm:"not null"`
+	Trigger          string     `json:"trigger"` // manual, schedule
+	SourceBackupID   *uint      `json:"source_backup_id"`
+	TargetAppID      uint       `json:"target_application_id"`
+	Status           string     `json:"status" gorm:"index"`
+	Components       string     `json:"components" gorm:"type:jsonb"`
+	Error            string     `json:"error,omitempty"`
+	PreviousReplicas int        `json:"-"`
+	CompletedAt      *time.Time `json:"completed_at"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+	CreatedBy        string     `json:"created_by"`
+}
+
+// BackupSchedule runs an application backup on a fixed interval
+type BackupSchedule struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	ApplicationID uint       `json:"application_id" gorm:"uniqueIndex;not null"`
+	IntervalHours int        `json:"interval_hours" gorm:"not null"`
+	Enabled       bool       `json:"enabled" gorm:"default:true"`
+	LastRunAt     *time.Time `json:"last_run_at"`
+	NextRunAt     time.Time  `json:"next_run_at" gorm:"index"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// backupComponent is one backup-service job within an ApplicationBackup
+type backupComponent struct {
+	Kind          string `json:"kind"` // volume, database
+	Name          string `json:"name"`
+	Source        string `json:"source"`
+	Destination   string `json:"destination,omitempty"`
+	BackupJobID   string `json:"backup_job_id,omitempty"`
+	BackupFileID  string `json:"backup_file_id,omitempty"`
+	RecoveryJobID string `json:"recovery_job_id,omitempty"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+}
+
+func (b *ApplicationBackup) components() []backupComponent {
+	var components []backupComponent
+	if b.Components != "" {
+		json.Unmarshal([]byte(b.Components), &components)
+	}
+	return components
+}
+
+func (b *ApplicationBackup) setComponents(components []backupComponent) {
+	encoded, _ := json.Marshal(components)
+	b.Components = string(encoded)
+}
+
+// backupClient talks to the backup-service API
+type backupClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+func newBackupClient() *backupClient {
+	return &backupClient{
+		baseURL: getEnv("BACKUP_SERVICE_URL", "http://backup-service:8080"),
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// backupServiceJob is the subset of backup/recovery job fields we read
+type backupServiceJob struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	ErrorMessage string `json:"error_message"`
+}
+
+func (bc *backupClient) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, bc.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := bc.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("backup-service unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("backup-service %s %s returned %d: %s", method, path, resp.StatusCode, bytes.TrimSpace(data))
+	}
+	if out != nil && len(data) > 0 {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// decodeJob accepts both a bare job object and one wrapped under key
+func decodeJob(raw map[string]json.RawMessage, key string) backupServiceJob {
+	var job backupServiceJob
+	if wrapped, ok := raw[key]; ok {
+		json.Unmarshal(wrapped, &job)
+		return job
+	}
+	encoded, _ := json.Marshal(raw)
+	json.Unmarshal(encoded, &job)
+	return job
+}
+
+func (bc *backupClient) startBackup(ctx context.Context, name, source string, metadata map[string]interface{}) (string, error) {
+	var raw map[string]json.RawMessage
+	err := bc.do(ctx, http.MethodPost, "/v1/backup/jobs", map[string]interface{}{
+		"name":        name,
+		"type":        "full",
+		"source":      source,
+		"destination": "s3",
+		"metadata":    metadata,
+	}, &raw)
+	if err != nil {
+		return "", err
+	}
+	job := decodeJob(raw, "job")
+	if job.ID == "" {
+		return "", fmt.Errorf("backup-service did not return a job id")
+	}
+	if err := bc.do(ctx, http.MethodPost, "/v1/backup/jobs/"+job.ID+"/start", nil, nil); err != nil {
+		return job.ID, err
+	}
+	return job.ID, nil
+}
+
+func (bc *backupClient) backupJob(ctx context.Context, id string) (backupServiceJob, error) {
+	var raw map[string]json.RawMessage
+	if err := bc.do(ctx, http.MethodGet, "/v1/backup/jobs/"+id, nil, &raw); err != nil {
+		return backupServiceJob{}, err
+	}
+	return decodeJob(raw, "job"), nil
+}
+
+// latestBackupFile returns the newest file produced by a backup job
+func (bc *backupClient) latestBackupFile(ctx context.Context, jobID string) (string, error) {
+	var response struct {
+		Files []struct {
+			ID string `json:"id"`
+		} `json:"files"`
+	}
+	if err := bc.do(ctx, http.MethodGet, "/v1/backup/files?job_id="+jobID, nil, &response); err != nil {
+		return "", err
+	}
+	if len(response.Files) == 0 {
+		return "", fmt.Errorf("backup job %s produced no files", jobID)
+	}
+	return response.Files[0].ID, nil
+}
+
+func (bc *backupClient) startRecovery(ctx context.Context, name, fileID, destination string) (string, error) {
+	var raw map[string]json.RawMessage
+	err := bc.do(ctx, http.MethodPost, "/v1/recovery/jobs", map[string]interface{}{
+		"name":           name,
+		"type":           "full",
+		"backup_file_id": fileID,
+		"destination":    destination,
+	}, &raw)
+	if err != nil {
+		return "", err
+	}
+	job := decodeJob(raw, "job")
+	if job.ID == "" {
+		return "", fmt.Errorf("backup-service did not return a recovery job id")
+	}
+	if err := bc.do(ctx, http.MethodPost, "/v1/recovery/jobs/"+job.ID+"/start", nil, nil); err != nil {
+		return job.ID, err
+	}
+	return job.ID, nil
+}
+
+func (bc *backupClient) recoveryJob(ctx context.Context, id string) (backupServiceJob, error) {
+	var raw map[string]json.RawMessage
+	if err := bc.do(ctx, http.MethodGet, "/v1/recovery/jobs/"+id, nil, &raw); err != nil {
+		return backupServiceJob{}, err
+	}
+	return decodeJob(raw, "job"), nil
+}
+
+// backupSources lists the application's volumes and bound database
+func (rs *RuntimeService) backupSources(ctx context.Context, app *Application) ([]backupComponent, error) {
+	namespace := "default"
+	claims, err := rs.k8sClient.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("app=%s", app.Name),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes: %w", err)
+	}
+
+	var components []backupComponent
+	for _, claim := range claims.Items {
+		components = append(components, backupComponent{
+			Kind:   "volume",
+			Name:   claim.Name,
+			Source: fmt.Sprintf("pvc://%s/%s", namespace, claim.Name),
+		})
+	}
+	if app.BoundDatabase != "" {
+		components = append(components, backupComponent{
+			Kind:   "database",
+			Name:   app.BoundDatabase,
+			Source: "database://" + app.BoundDatabase,
+		})
+	}
+	return components, nil
+}
+
+// startApplicationBackup submits one backup-service job per component
+func (rs *RuntimeService) startApplicationBackup(ctx context.Context, app *Application, trigger, createdBy string) (*ApplicationBackup, error) {
+	components, err := rs.backupSources(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	if len(components) == 0 {
+		return nil, fmt.Errorf("application %s has no volumes or bound database to back up", app.Name)
+	}
+
+	backup := &ApplicationBackup{
+		ApplicationID: app.ID,
+		Operation:     BackupOperationBackup,
+		Trigger:       trigger,
+		TargetAppID:   app.ID,
+		Status:        AppBackupRunning,
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+		CreatedBy:     createdBy,
+	}
+	if err := rs.db.Create(backup).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range components {
+		name := fmt.Sprintf("app-%s-%s-%d", app.Name, components[i].Name, backup.ID)
+		jobID, err := rs.backups.startBackup(ctx, name, components[i].Source, map[string]interface{}{
+			"application_id":        app.ID,
+			"application_backup_id": backup.ID,
+			"component":             components[i].Kind,
+		})
+		components[i].BackupJobID = jobID
+		components[i].Status = AppBackupRunning
+		if err != nil {
+			components[i].Status = AppBackupFailed
+			components[i].Error = err.Error()
+		}
+	}
+
+	backup.setComponents(components)
+	rs.refreshBackupStatus(backup, components)
+	rs.db.Save(backup)
+
+	rs.logger.Info("Application backup started",
+		zap.String("application", app.Name),
+		zap.Uint("backup_id", backup.ID),
+		zap.Int("components", len(components)))
+	return backup, nil
+}
+
+// refreshBackupStatus derives the overall status from the components
+func (rs *RuntimeService) refreshBackupStatus(backup *ApplicationBackup, components []backupComponent) {
+	completed, failed := 0, 0
+	for _, component := range components {
+		switch component.Status {
+		case AppBackupCompleted:
+			completed++
+		case AppBackupFailed:
+			failed++
+		}
+	}
+
+	switch {
+	case completed+failed < len(components):
+		backup.Status = AppBackupRunning
+		return
+	case failed > 0:
+		backup.Status = AppBackupFailed
+		backup.Error = fmt.Sprintf("%d of %d components failed", failed, len(components))
+	default:
+		backup.Status = AppBackupCompleted
+	}
+	now := time.Now()
+	backup.CompletedAt = &now
+	backup.UpdatedAt = now
+}
+
+// Poll running backups and restores, and start scheduled backups
+func (rs *RuntimeService) runBackupWorker() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rs.pollApplicationBackups()
+		rs.runDueBackupSchedules()
+	}
+}
+
+func (rs *RuntimeService) pollApplicationBackups() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	var running []ApplicationBackup
+	rs.db.Where("status = ?", AppBackupRunning).Find(&running)
+
+	for i := range running {
+		backup := &running[i]
+		components := backup.components()
+		for j := range components {
+			component := &components[j]
+			if component.Status != AppBackupRunning {
+				continue
+			}
+
+			var job backupServiceJob
+			var err error
+			if backup.Operation == BackupOperationBackup {
+				job, err = rs.backups.backupJob(ctx, component.BackupJobID)
+			} else {
+				job, err = rs.backups.recoveryJob(ctx, component.RecoveryJobID)
+			}
+			if err != nil {
+				rs.logger.Warn("Failed to poll backup-service job", zap.Uint("backup_id", backup.ID), zap.Error(err))
+				continue
+			}
+
+			switch job.Status {
+			case "completed":
+				component.Status = AppBackupCompleted
+				if backup.Operation == BackupOperationBackup {
+					fileID, err := rs.backups.latestBackupFile(ctx, component.BackupJobID)
+					if err != nil {
+						component.Status = AppBackupFailed
+						component.Error = err.Error()
+					}
+					component.BackupFileID = fileID
+				}
+			case "failed", "cancelled":
+				component.Status = AppBackupFailed
+				component.Error = job.ErrorMessage
+			}
+		}
+
+		backup.setComponents(components)
+		rs.refreshBackupStatus(backup, components)
+		if backup.Status != AppBackupRunning && backup.Operation == BackupOperationRestore {
+			rs.finishRestore(ctx, backup)
+		}
+		rs.db.Save(backup)
+	}
+}
+
+func (rs *RuntimeService) runDueBackupSchedules() {
+	var due []BackupSchedule
+	rs.db.Where("enabled = ? AND next_run_at <= ?", true, time.Now()).Find(&due)
+
+	for _, schedule := range due {
+		now := time.Now()
+		schedule.LastRunAt = &now
+		schedule.NextRunAt = now.Add(time.Duration(schedule.IntervalHours) * time.Hour)
+		schedule.UpdatedAt = now
+		rs.db.Save(&schedule)
+
+		var app Application
+		if err := rs.db.First(&app, schedule.ApplicationID).Error; err != nil {
+			continue
+		}
+		if _, err := rs.startApplicationBackup(context.Background(), &app, "schedule", "scheduler"); err != nil {
+			rs.logger.Error("Scheduled backup failed", zap.String("application", app.Name), zap.Error(err))
+		}
+	}
+}
+
+// scaleDeployment sets replicas and returns the previous count
+func (rs *RuntimeService) scaleDeployment(ctx context.Context, name string, replicas int) (int, error) {
+	deployments := rs.k8sClient.AppsV1().Deployments("default")
+	deployment, err := deployments.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	previous := 1
+	if deployment.Spec.Replicas != nil {
+		previous = int(*deployment.Spec.Replicas)
+	}
+	deployment.Spec.Replicas = int32Ptr(int32(replicas))
+	_, err = deployments.Update(ctx, deployment, metav1.UpdateOptions{})
+	return previous, err
+}
+
+// finishRestore brings the target application back up
+func (rs *RuntimeService) finishRestore(ctx context.Context, restore *ApplicationBackup) {
+	var target Application
+	if err := rs.db.First(&target, restore.TargetAppID).Error; err != nil {
+		return
+	}
+	if _, err := rs.scaleDeployment(ctx, target.Name, restore.PreviousReplicas); err != nil {
+		rs.logger.Error("Failed to scale application back up after restore",
+			zap.String("application", target.Name), zap.Error(err))
+	}
+	target.Status = "running"
+	if restore.Status == AppBackupFailed {
+		target.Status = "restore_failed"
+	}
+	target.UpdatedAt = time.Now()
+	rs.db.Save(&target)
+}
+
+func (rs *RuntimeService) createApplicationBackup(c *gin.Context) {
+	var app Application
+	if err := rs.db.First(&app, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Application not found"})
+		return
+	}
+
+	backup, err := rs.startApplicationBackup(c.Request.Context(), &app, "manual", c.GetHeader("X-User-ID"))
+	if err != nil {
+		c.JSON(502, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(202, backup)
+}
+
+func (rs *RuntimeService) listApplicationBackups(c *gin.Context) {
+	query := rs.db.Where("application_id = ? OR target_app_id = ?", c.Param("id"), c.Param("id"))
+	if operation := c.Query("operation"); operation != "" {
+		query = query.Where("operation = ?", operation)
+	}
+
+	var backups []ApplicationBackup
+	if err := query.Order("created_at DESC").Limit(100).Find(&backups).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch backups"})
+		return
+	}
+	c.JSON(200, gin.H{"backups": backups})
+}
+
+func (rs *RuntimeService) getApplicationBackup(c *gin.Context) {
+	var backup ApplicationBackup
+	if err := rs.db.Where("application_id = ? OR target_app_id = ?", c.Param("id"), c.Param("id")).
+		First(&backup, c.Param("backup_id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Backup not found"})
+		return
+	}
+	c.JSON(200, backup)
+}
+
+// restoreApplication restores a completed backup into the same application
+// or into a newly deployed clone
+func (rs *RuntimeService) restoreApplication(c *gin.Context) {
+	var request struct {
+		BackupID      uint   `json:"backup_id" binding:"required"`
+		CloneName     string `json:"clone_name"`
+		CloneDatabase string `json:"clone_database"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	var app Application
+	if err := rs.db.Preload("Runtime").First(&app, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Application not found"})
+		return
+	}
+	var source ApplicationBackup
+	if err := rs.db.Where("application_id = ? AND operation = ?", app.ID, BackupOperationBackup).
+		First(&source, request.BackupID).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Backup not found"})
+		return
+	}
+	if source.Status != AppBackupCompleted {
+		c.JSON(409, gin.H{"error": "Only completed backups can be restored", "status": source.Status})
+		return
+	}
+
+	ctx := c.Request.Context()
+	target := app
+	if request.CloneName != "" {
+		clone, err := rs.cloneApplication(ctx, &app, request.CloneName, request.CloneDatabase)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		target = *clone
+	}
+
+	// Stop the target while its data is replaced
+	previous, err := rs.scaleDeployment(ctx, target.Name, 0)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to stop application for restore"})
+		return
+	}
+	if request.CloneName != "" {
+		previous = app.Replicas
+	}
+	target.Status = "restoring"
+	target.UpdatedAt = time.Now()
+	rs.db.Save(&target)
+
+	sourceID := source.ID
+	restore := &ApplicationBackup{
+		ApplicationID:    app.ID,
+		Operation:        BackupOperationRestore,
+		Trigger:          "manual",
+		SourceBackupID:   &sourceID,
+		TargetAppID:      target.ID,
+		Status:           AppBackupRunning,
+		PreviousReplicas: previous,
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
+		CreatedBy:        c.GetHeader("X-User-ID"),
+	}
+	rs.db.Create(restore)
+
+	components := source.components()
+	for i := range components {
+		component := &components[i]
+		component.Destination = restoreDestination(component, &app, &target)
+		component.Status = AppBackupRunning
+		component.Error = ""
+		name := fmt.Sprintf("app-%s-%s-restore-%d", target.Name, component.Name, restore.ID)
+		jobID, err := rs.backups.startRecovery(ctx, name, component.BackupFileID, component.Destination)
+		component.RecoveryJobID = jobID
+		if err != nil {
+			component.Status = AppBackupFailed
+			component.Error = err.Error()
+		}
+	}
+
+	restore.setComponents(components)
+	rs.refreshBackupStatus(restore, components)
+	if restore.Status != AppBackupRunning {
+		rs.finishRestore(ctx, restore)
+	}
+	rs.db.Save(restore)
+
+	rs.logger.Info("Application restore started",
+		zap.String("application", app.Name),
+		zap.String("target", target.Name),
+		zap.Uint("backup_id", source.ID))
+
+	c.JSON(202, restore)
+}
+
+// restoreDestination maps a component onto the target application
+func restoreDestination(component *backupComponent, source, target *Application) string {
+	if source.ID == target.ID {
+		return component.Source
+	}
+	switch component.Kind {
+	case "database":
+		return "database://" + target.BoundDatabase
+	default:
+		// Clone volumes are named after the clone
+		name := component.Name
+		if len(name) > len(source.Name) && name[:len(source.Name)] == source.Name {
+			name = target.Name + name[len(source.Name):]
+		} else {
+			name = target.Name + "-" + name
+		}
+		return fmt.Sprintf("pvc://default/%s", name)
+	}
+}
+
+// cloneApplication deploys a copy of the application under a new name
+func (rs *RuntimeService) cloneApplication(ctx context.Context, app *Application, name, database string) (*Application, error) {
+	if database == "" && app.BoundDatabase != "" {
+		database = app.BoundDatabase + "_" + name
+	}
+
+	clone := *app
+	clone.ID = 0
+	clone.Name = name
+	clone.BoundDatabase = database
+	clone.Status = "deploying"
+	clone.URL = ""
+	clone.DeployedAt = nil
+	clone.CreatedAt = time.Now()
+	clone.UpdatedAt = time.Now()
+	if err := rs.db.Omit("Runtime").Create(&clone).Error; err != nil {
+		return nil, fmt.Errorf("failed to create clone %s: %w", name, err)
+	}
+
+	if err := rs.deployToKubernetes(&clone, &app.Runtime); err != nil {
+		clone.Status = "failed"
+		rs.db.Omit("Runtime").Save(&clone)
+		return nil, fmt.Errorf("failed to deploy clone %s: %w", name, err)
+	}
+	return &clone, nil
+}
+
+func (rs *RuntimeService) getBackupSchedule(c *gin.Context) {
+	var schedule BackupSchedule
+	if err := rs.db.Where("application_id = ?", c.Param("id")).First(&schedule).Error; err != nil {
+		c.JSON(404, gin.H{"error": "No backup schedule for this application"})
+		return
+	}
+	c.JSON(200, schedule)
+}
+
+func (rs *RuntimeService) setBackupSchedule(c *gin.Context) {
+	var request struct {
+		IntervalHours int   `json:"interval_hours" binding:"required,min=1"`
+		Enabled       *bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	appID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || rs.db.First(&Application{}, appID).Error != nil {
+		c.JSON(404, gin.H{"error": "Application not found"})
+		return
+	}
+
+	var schedule BackupSchedule
+	rs.db.Where("application_id = ?", appID).FirstOrInit(&schedule, BackupSchedule{
+		ApplicationID: uint(appID),
+		CreatedAt:     time.Now(),
+	})
+	schedule.IntervalHours = request.IntervalHours
+	schedule.Enabled = request.Enabled == nil || *request.Enabled
+	schedule.NextRunAt = time.Now().Add(time.Duration(request.IntervalHours) * time.Hour)
+	schedule.UpdatedAt = time.Now()
+	if err := rs.db.Save(&schedule).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save backup schedule"})
+		return
+	}
+	c.JSON(200, schedule)
+}
+
+func (rs *RuntimeService) deleteBackupSchedule(c *gin.Context) {
+	rs.db.Where("application_id = ?", c.Param("id")).Delete(&BackupSchedule{})
+	c.JSON(200, gin.H{"message": "Backup schedule removed"})
+}
+
+// latestBackups returns the most recent backup and restore of an application
+func (rs *RuntimeService) latestBackups(appID uint) gin.H {
+	status := gin.H{}
+	for _, operation := range []string{BackupOperationBackup, BackupOperationRestore} {
+		var latest ApplicationBackup
+		err := rs.db.Where("(application_id = ? OR target_app_id = ?) AND operation = ?", appID, appID, operation).
+			Order("created_at DESC").First(&latest).Error
+		if err == nil {
+			status["last_"+operation] = latest
+		}
+	}
+	var schedule BackupSchedule
+	if rs.db.Where("application_id = ?", appID).First(&schedule).Error == nil {
+		status["schedule"] = schedule
+	}
+	return status
+}
@@ -0,0 +1,1101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Git push deploys: every application has a bare repository served over
+// git's smart HTTP protocol at /git/<app>.git. Pushing its main (or master)
+// branch builds the pushed tree with Cloud Native Buildpacks in a Kubernetes
+// job and rolls the application onto the resulting image. The repository's
+// pre-receive hook is this binary in hook mode: it hands the pushed tree to
+// the service, relays the build and deploy output, which git shows the
+// pusher as "remote:" lines, and accepts the push only if the deploy
+// succeeded. Pushes authenticate with a platform API key as the HTTP Basic
+// password, verified by the API gateway. The key must belong to the user who
+// created the application, or hold the project:<id> scope of its project.
+
+// Git deploy statuses
+const (
+	GitDeployBuilding  = "building"
+	GitDeployDeploying = "deploying"
+	GitDeploySucceeded = "succeeded"
+	GitDeployFailed    = "failed"
+)
+
+const (
+	// gitDeployStatusTrailer carries a deploy's outcome to the hook after
+	// its output
+	gitDeployStatusTrailer = "X-Deploy-Status"
+	gitDeployLogLimit      = 64 << 10
+)
+
+var (
+	gitDeployDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "runtime_git_deploy_duration_seconds",
+			Help:    "Duration of git push builds and deploys",
+			Buckets: []float64{10, 30, 60, 120, 300, 600, 1200},
+		},
+		[]string{"status"},
+	)
+	gitPushesRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runtime_git_pushes_rejected_total",
+			Help: "Git pushes rejected before reaching the repository",
+		},
+		[]string{"reason"},
+	)
+
+	appNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	gitRevPattern  = regexp.MustCompile(`^[0-9a-f]{40}([0-9a-f]{24})?$`)
+)
+
+// GitDeploy records a build and deploy triggered by a git push
+type GitDeploy struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	ApplicationID uint       `json:"application_id" gorm:"index;not null"`
+	Ref           string     `json:"ref"`
+	OldRev        string     `json:"old_rev"`
+	NewRev        string     `json:"new_rev"`
+	Image         string     `json:"image"`
+	BuildJob      string     `json:"build_job"`
+	Status        string     `json:"status" gorm:"index"`
+	Error         string     `json:"error,omitempty"`
+	PushedBy      string     `json:"pushed_by"`
+	APIKeyID      string     `json:"api_key_id"`
+	Log           string     `json:"log,omitempty" gorm:"type:text"` // tail of the output sent to the pusher
+	CompletedAt   *time.Time `json:"completed_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// gitReceiver holds the git deploy configuration and the pushes in flight
+type gitReceiver struct {
+	reposDir       string
+	remoteBaseURL  string
+	hookURL        string
+	sourceBaseURL  string
+	namespace      string
+	builderImage   string
+	fetchImage     string
+	imageRepo      string
+	registrySecret string
+	pushScope      string
+	buildTimeout   time.Duration
+	rolloutTimeout time.Duration
+	maxPushBytes   int64 // limit on a push body, after decompression
+	keys           *apiKeyVerifier
+
+	mu      sync.Mutex
+	pushes  map[string]*gitPush // by push ID
+	sources map[uint]string     // build source tokens by deploy ID
+	active  map[uint]bool       // applications with a deploy running
+}
+
+// gitPush is one receive-pack run, which its pre-receive hook calls back
+// into with the push ID and token
+type gitPush struct {
+	id    string
+	token string
+	app   Application
+	key   apiKeyIdentity
+}
+
+func newGitReceiver() *gitReceiver {
+	buildTimeout, _ := time.ParseDuration(getEnv("GIT_BUILD_TIMEOUT", "20m"))
+	if buildTimeout <= 0 {
+		buildTimeout = 20 * time.Minute
+	}
+	rolloutTimeout, _ := time.ParseDuration(getEnv("GIT_ROLLOUT_TIMEOUT", "5m"))
+	if rolloutTimeout <= 0 {
+		rolloutTimeout = 5 * time.Minute
+	}
+	maxPushBytes, _ := strconv.ParseInt(getEnv("GIT_MAX_PUSH_BYTES", "1073741824"), 10, 64)
+	if maxPushBytes <= 0 {
+		maxPushBytes = 1 << 30
+	}
+	return &gitReceiver{
+		reposDir:       getEnv("GIT_REPOS_DIR", "/var/lib/runtime/git"),
+		remoteBaseURL:  strings.TrimSuffix(getEnv("GIT_REMOTE_BASE_URL", "https://git.002aic.com"), "/"),
+		hookURL:        "http://127.0.0.1:" + getEnv("PORT", "8080") + "/internal/git/hooks/pre-receive",
+		sourceBaseURL:  strings.TrimSuffix(getEnv("GIT_SOURCE_BASE_URL", "http://runtime-management-service:8080"), "/"),
+		namespace:      getEnv("BUILD_NAMESPACE", "default"),
+		builderImage:   getEnv("BUILDPACK_BUILDER_IMAGE", "paketobuildpacks/builder-jammy-base:latest"),
+		fetchImage:     getEnv("BUILD_FETCH_IMAGE", "busybox:1.36"),
+		imageRepo:      strings.TrimSuffix(getEnv("BUILD_IMAGE_REPOSITORY", "registry.002aic.com/apps"), "/"),
+		registrySecret: getEnv("BUILD_REGISTRY_SECRET", ""),
+		pushScope:      getEnv("GIT_PUSH_SCOPE", "runtime:deploy"),
+		buildTimeout:   buildTimeout,
+		rolloutTimeout: rolloutTimeout,
+		maxPushBytes:   maxPushBytes,
+		keys:           newAPIKeyVerifier(),
+		pushes:         make(map[string]*gitPush),
+		sources:        make(map[uint]string),
+		active:         make(map[uint]bool),
+	}
+}
+
+func (g *gitReceiver) remoteURL(app *Application) string {
+	return g.remoteBaseURL + "/git/" + app.Name + ".git"
+}
+
+func (g *gitReceiver) imageFor(app *Application, rev string) string {
+	return fmt.Sprintf("%s/%s:%s", g.imageRepo, app.Name, shortRev(rev))
+}
+
+func (g *gitReceiver) startPush(app *Application, key apiKeyIdentity) (*gitPush, error) {
+	id, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	push := &gitPush{id: id, token: token, app: *app, key: key}
+	g.mu.Lock()
+	g.pushes[id] = push
+	g.mu.Unlock()
+	return push, nil
+}
+
+func (g *gitReceiver) endPush(id string) {
+	g.mu.Lock()
+	delete(g.pushes, id)
+	g.mu.Unlock()
+}
+
+// push returns the push a hook call belongs to, or nil
+func (g *gitReceiver) push(id, token string) *gitPush {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	push := g.pushes[id]
+	if push == nil || subtle.ConstantTimeCompare([]byte(push.token), []byte(token)) != 1 {
+		return nil
+	}
+	return push
+}
+
+// lockApplication claims an application for a deploy, reporting false if
+// one is already running
+func (g *gitReceiver) lockApplication(id uint) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.active[id] {
+		return false
+	}
+	g.active[id] = true
+	return true
+}
+
+func (g *gitReceiver) unlockApplication(id uint) {
+	g.mu.Lock()
+	delete(g.active, id)
+	g.mu.Unlock()
+}
+
+func (g *gitReceiver) sourcePath(deployID uint) string {
+	return filepath.Join(g.reposDir, ".sources", fmt.Sprintf("%d.tar.gz", deployID))
+}
+
+func (g *gitReceiver) sourceTokenValid(deployID uint, token string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	expected, ok := g.sources[deployID]
+	return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// ensureRepository creates an application's bare repository if needed and
+// (re)installs its pre-receive hook, returning the repository's path
+func (g *gitReceiver) ensureRepository(name string) (string, error) {
+	dir := filepath.Join(g.reposDir, name+".git")
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); os.IsNotExist(err) {
+		if out, err := exec.Command("git", "init", "--bare", "--initial-branch=main", dir).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("git init failed: %v: %s", err, bytes.TrimSpace(out))
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	hook := "#!/bin/sh\nexec '" + strings.ReplaceAll(exe, "'", `'\''`) + "' git-hook pre-receive\n"
+	if err := os.WriteFile(filepath.Join(dir, "hooks", "pre-receive"), []byte(hook), 0o755); err != nil {
+		return "", fmt.Errorf("failed to install pre-receive hook: %w", err)
+	}
+	return dir, nil
+}
+
+// apiKeyIdentity is the API gateway's verdict on a platform API key
+type apiKeyIdentity struct {
+	Valid    bool     `json:"valid"`
+	Reason   string   `json:"reason"`
+	APIKeyID string   `json:"api_key_id"`
+	UserID   string   `json:"user_id"`
+	Scopes   []string `json:"scopes"`
+}
+
+type cachedAPIKey struct {
+	identity apiKeyIdentity
+	expires  time.Time
+}
+
+// apiKeyVerifier checks platform API keys with the API gateway, caching
+// verdicts briefly since a push makes several requests
+type apiKeyVerifier struct {
+	url        string
+	adminToken string
+	ttl        time.Duration
+	http       *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedAPIKey // by key hash
+}
+
+func newAPIKeyVerifier() *apiKeyVerifier {
+	return &apiKeyVerifier{
+		url:        strings.TrimSuffix(getEnv("API_GATEWAY_URL", "http://api-gateway-service:8080"), "/") + "/admin/v1/api-keys/verify",
+		adminToken: getEnv("API_GATEWAY_ADMIN_TOKEN", ""),
+		ttl:        30 * time.Second,
+		http:       &http.Client{Timeout: 10 * time.Second},
+		cache:      make(map[string]cachedAPIKey),
+	}
+}
+
+func (v *apiKeyVerifier) verify(ctx context.Context, key string) (apiKeyIdentity, error) {
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+
+	v.mu.Lock()
+	cached, ok := v.cache[hash]
+	v.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.identity, nil
+	}
+
+	payload, _ := json.Marshal(map[string]string{"key": key})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, bytes.NewReader(payload))
+	if err != nil {
+		return apiKeyIdentity{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Admin-Token", v.adminToken)
+
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return apiKeyIdentity{}, fmt.Errorf("api-gateway unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return apiKeyIdentity{}, fmt.Errorf("api-gateway answered %d verifying an API key", resp.StatusCode)
+	}
+	var identity apiKeyIdentity
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&identity); err != nil {
+		return apiKeyIdentity{}, err
+	}
+
+	v.mu.Lock()
+	now := time.Now()
+	for h, entry := range v.cache {
+		if now.After(entry.expires) {
+			delete(v.cache, h)
+		}
+	}
+	v.cache[hash] = cachedAPIKey{identity: identity, expires: now.Add(v.ttl)}
+	v.mu.Unlock()
+	return identity, nil
+}
+
+// grantsScope reports whether scopes include required, directly or by a
+// "*" or "prefix:*" wildcard, as the API gateway does
+func grantsScope(scopes []string, required string) bool {
+	for _, scope := range scopes {
+		switch {
+		case scope == "*", scope == required:
+			return true
+		case strings.HasSuffix(scope, ":*") && strings.HasPrefix(required, strings.TrimSuffix(scope, "*")):
+			return true
+		}
+	}
+	return false
+}
+
+// gitAuthenticate checks a git request's API key, taken from the Basic
+// password (or the username when the password is empty)
+func (rs *RuntimeService) gitAuthenticate(c *gin.Context) (apiKeyIdentity, bool) {
+	challenge := func(message string) {
+		c.Header("WWW-Authenticate", `Basic realm="002aic git"`)
+		c.String(401, message+"\n")
+	}
+
+	username, password, ok := c.Request.BasicAuth()
+	key := password
+	if key == "" {
+		key = username
+	}
+	if !ok || key == "" {
+		gitPushesRejected.WithLabelValues("unauthenticated").Inc()
+		challenge("Authenticate with a platform API key as the password")
+		return apiKeyIdentity{}, false
+	}
+
+	identity, err := rs.git.keys.verify(c.Request.Context(), key)
+	if err != nil {
+		rs.logger.Error("Failed to verify API key for git push", zap.Error(err))
+		c.String(502, "API key verification is unavailable\n")
+		return apiKeyIdentity{}, false
+	}
+	if !identity.Valid {
+		gitPushesRejected.WithLabelValues("invalid_key").Inc()
+		challenge("Invalid API key")
+		return apiKeyIdentity{}, false
+	}
+	if !grantsScope(identity.Scopes, rs.git.pushScope) {
+		gitPushesRejected.WithLabelValues("insufficient_scope").Inc()
+		c.String(403, "API key lacks the %s scope\n", rs.git.pushScope)
+		return apiKeyIdentity{}, false
+	}
+	return identity, true
+}
+
+// gitAuthorize checks that the key may deploy the application: it belongs to
+// the application's creator or is scoped to the application's project
+func (rs *RuntimeService) gitAuthorize(c *gin.Context, app *Application, identity apiKeyIdentity) bool {
+	if identity.UserID != "" && identity.UserID == app.CreatedBy {
+		return true
+	}
+	if app.ProjectID != "" && grantsScope(identity.Scopes, "project:"+app.ProjectID) {
+		return true
+	}
+	gitPushesRejected.WithLabelValues("forbidden").Inc()
+	c.String(403, "API key may not deploy %s\n", app.Name)
+	return false
+}
+
+// gitApplication finds the application a repository path names
+func (rs *RuntimeService) gitApplication(c *gin.Context) (*Application, bool) {
+	name := strings.TrimSuffix(c.Param("repo"), ".git")
+	var app Application
+	if !appNamePattern.MatchString(name) || rs.db.Where("name = ?", name).First(&app).Error != nil {
+		c.String(404, "Repository not found\n")
+		return nil, false
+	}
+	return &app, true
+}
+
+// gitInfoRefs advertises a repository's refs to git push. Fetching is not
+// offered: the repository only receives deploys.
+func (rs *RuntimeService) gitInfoRefs(c *gin.Context) {
+	if c.Query("service") != "git-receive-pack" {
+		c.String(403, "Only git push is supported\n")
+		return
+	}
+	app, ok := rs.gitApplication(c)
+	if !ok {
+		return
+	}
+	identity, ok := rs.gitAuthenticate(c)
+	if !ok || !rs.gitAuthorize(c, app, identity) {
+		return
+	}
+
+	dir, err := rs.git.ensureRepository(app.Name)
+	if err != nil {
+		rs.logger.Error("Failed to prepare git repository", zap.String("application", app.Name), zap.Error(err))
+		c.String(500, "Repository unavailable\n")
+		return
+	}
+	refs, err := exec.CommandContext(c.Request.Context(), "git", "receive-pack", "--stateless-rpc", "--advertise-refs", dir).Output()
+	if err != nil {
+		rs.logger.Error("git receive-pack failed to advertise refs", zap.String("application", app.Name), zap.Error(err))
+		c.String(500, "Repository unavailable\n")
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	var body bytes.Buffer
+	body.WriteString(pktLine("# service=git-receive-pack\n"))
+	body.WriteString("0000")
+	body.Write(refs)
+	c.Data(200, "application/x-git-receive-pack-advertisement", body.Bytes())
+}
+
+// gitReceivePack receives a push. git receive-pack runs the repository's
+// pre-receive hook, which calls back into gitPreReceive with this push's ID
+// and token; the hook's output reaches the pusher as it is written.
+func (rs *RuntimeService) gitReceivePack(c *gin.Context) {
+	app, ok := rs.gitApplication(c)
+	if !ok {
+		return
+	}
+	key, ok := rs.gitAuthenticate(c)
+	if !ok || !rs.gitAuthorize(c, app, key) {
+		return
+	}
+	dir, err := rs.git.ensureRepository(app.Name)
+	if err != nil {
+		rs.logger.Error("Failed to prepare git repository", zap.String("application", app.Name), zap.Error(err))
+		c.String(500, "Repository unavailable\n")
+		return
+	}
+
+	// Both the body and what it decompresses to are capped, so a push
+	// cannot fill the repository volume
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, rs.git.maxPushBytes)
+	if c.GetHeader("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			c.String(400, "Invalid gzip request body\n")
+			return
+		}
+		defer gz.Close()
+		body = http.MaxBytesReader(c.Writer, gz, rs.git.maxPushBytes)
+	}
+
+	push, err := rs.git.startPush(app, key)
+	if err != nil {
+		c.String(500, "Failed to start push\n")
+		return
+	}
+	defer rs.git.endPush(push.id)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(c.Request.Context(), "git", "receive-pack", "--stateless-rpc", dir)
+	cmd.Env = append(os.Environ(),
+		"RUNTIME_GIT_HOOK_URL="+rs.git.hookURL,
+		"RUNTIME_GIT_PUSH_ID="+push.id,
+		"RUNTIME_GIT_PUSH_TOKEN="+push.token,
+	)
+	cmd.Stdin = body
+	cmd.Stdout = flushWriter{c.Writer}
+	cmd.Stderr = &stderr
+
+	// receive-pack reads the whole pack before it answers, so the request
+	// body is consumed before the response starts
+	c.Header("Content-Type", "application/x-git-receive-pack-result")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(200)
+	if err := cmd.Run(); err != nil {
+		rs.logger.Error("git receive-pack failed",
+			zap.String("application", app.Name),
+			zap.String("stderr", strings.TrimSpace(stderr.String())),
+			zap.Error(err))
+	}
+}
+
+// gitPreReceive builds and deploys a pushed tree for a pre-receive hook,
+// streaming the output back and reporting the outcome in a trailer
+func (rs *RuntimeService) gitPreReceive(c *gin.Context) {
+	push := rs.git.push(c.GetHeader("X-Git-Push-ID"), c.GetHeader("X-Git-Push-Token"))
+	if push == nil {
+		c.String(403, "Unknown push\n")
+		return
+	}
+	app := push.app
+	newRev := c.GetHeader("X-Git-New-Rev")
+	if !gitRevPattern.MatchString(newRev) {
+		c.String(400, "Invalid revision\n")
+		return
+	}
+	if !rs.git.lockApplication(app.ID) {
+		c.String(409, "Another deploy of %s is in progress; push again once it finishes\n", app.Name)
+		return
+	}
+	defer rs.git.unlockApplication(app.ID)
+
+	start := time.Now()
+	deploy := GitDeploy{
+		ApplicationID: app.ID,
+		Ref:           c.GetHeader("X-Git-Ref"),
+		OldRev:        c.GetHeader("X-Git-Old-Rev"),
+		NewRev:        newRev,
+		Status:        GitDeployBuilding,
+		PushedBy:      push.key.UserID,
+		APIKeyID:      push.key.APIKeyID,
+		CreatedAt:     start,
+		UpdatedAt:     start,
+	}
+	if err := rs.db.Create(&deploy).Error; err != nil {
+		c.String(500, "Failed to record deploy\n")
+		return
+	}
+
+	// Keep the pushed tree for the build job to fetch
+	source := rs.git.sourcePath(deploy.ID)
+	if err := saveUpload(source, c.Request.Body); err != nil {
+		rs.logger.Error("Failed to store pushed source", zap.Uint("deploy", deploy.ID), zap.Error(err))
+		rs.finishGitDeploy(&deploy, "", fmt.Errorf("failed to store source: %w", err), start)
+		c.String(500, "Failed to store source\n")
+		return
+	}
+	defer os.Remove(source)
+
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Header("Trailer", gitDeployStatusTrailer)
+	c.Status(200)
+	out := &deployOutput{w: flushWriter{c.Writer}}
+
+	err := rs.runGitDeploy(c.Request.Context(), out, &app, &deploy)
+	if err != nil {
+		out.step("Deploy failed: %v", err)
+	}
+	rs.finishGitDeploy(&deploy, out.String(), err, start)
+	c.Writer.Header().Set(gitDeployStatusTrailer, deploy.Status)
+}
+
+func (rs *RuntimeService) finishGitDeploy(deploy *GitDeploy, log string, err error, start time.Time) {
+	now := time.Now()
+	deploy.Status = GitDeploySucceeded
+	if err != nil {
+		deploy.Status = GitDeployFailed
+		deploy.Error = err.Error()
+	}
+	deploy.Log = log
+	deploy.CompletedAt = &now
+	deploy.UpdatedAt = now
+	rs.db.Save(deploy)
+	gitDeployDuration.WithLabelValues(deploy.Status).Observe(time.Since(start).Seconds())
+
+	rs.logger.Info("Git deploy finished",
+		zap.Uint("deploy", deploy.ID),
+		zap.Uint("application", deploy.ApplicationID),
+		zap.String("rev", deploy.NewRev),
+		zap.String("status", deploy.Status),
+		zap.String("error", deploy.Error))
+}
+
+// runGitDeploy builds a pushed revision and rolls the application onto it
+func (rs *RuntimeService) runGitDeploy(ctx context.Context, out *deployOutput, app *Application, deploy *GitDeploy) error {
+	var runtime Runtime
+	if err := rs.db.First(&runtime, app.RuntimeID).Error; err != nil {
+		return fmt.Errorf("runtime %d not found", app.RuntimeID)
+	}
+
+	deploy.Image = rs.git.imageFor(app, deploy.NewRev)
+	rs.db.Model(deploy).Update("image", deploy.Image)
+	out.step("Building %s at %s with %s", app.Name, shortRev(deploy.NewRev), rs.git.builderImage)
+
+	rs.db.Model(app).Update("build_status", "building")
+	if err := rs.buildImage(ctx, out, app, deploy); err != nil {
+		rs.db.Model(app).Update("build_status", "failed")
+		return fmt.Errorf("build failed: %w", err)
+	}
+	rs.db.Model(app).Update("build_status", "succeeded")
+
+	deploy.Status = GitDeployDeploying
+	rs.db.Model(deploy).Update("status", deploy.Status)
+	out.step("Deploying %s", deploy.Image)
+	if err := rs.rolloutImage(ctx, out, app, &runtime, deploy.Image); err != nil {
+		return fmt.Errorf("deploy failed: %w", err)
+	}
+	out.step("Released %s to %s", shortRev(deploy.NewRev), app.URL)
+	return nil
+}
+
+// buildImage runs the buildpack lifecycle on the pushed source in a job,
+// following its logs, and waits for the image to be pushed
+func (rs *RuntimeService) buildImage(ctx context.Context, out *deployOutput, app *Application, deploy *GitDeploy) error {
+	ctx, cancel := context.WithTimeout(ctx, rs.git.buildTimeout)
+	defer cancel()
+
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+	rs.git.mu.Lock()
+	rs.git.sources[deploy.ID] = token
+	rs.git.mu.Unlock()
+	defer func() {
+		rs.git.mu.Lock()
+		delete(rs.git.sources, deploy.ID)
+		rs.git.mu.Unlock()
+	}()
+
+	name := fmt.Sprintf("git-build-%d", deploy.ID)
+	sourceURL := fmt.Sprintf("%s/internal/git/sources/%d?token=%s", rs.git.sourceBaseURL, deploy.ID, token)
+	jobs := rs.k8sClient.BatchV1().Jobs(rs.git.namespace)
+	if _, err := jobs.Create(ctx, rs.git.buildJob(name, app, deploy, sourceURL), metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create build job: %w", err)
+	}
+	deploy.BuildJob = name
+	rs.db.Model(deploy).Update("build_job", name)
+
+	// A build abandoned by the pusher or the timeout is not left running
+	defer func() {
+		if ctx.Err() != nil {
+			background := metav1.DeletePropagationBackground
+			jobs.Delete(context.Background(), name, metav1.DeleteOptions{PropagationPolicy: &background})
+		}
+	}()
+
+	pod, err := rs.waitForBuildPod(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, container := range []string{"fetch-source", "build"} {
+		if err := rs.waitForContainer(ctx, pod, container); err != nil {
+			return err
+		}
+		stream, err := rs.k8sClient.CoreV1().Pods(rs.git.namespace).
+			GetLogs(pod, &corev1.PodLogOptions{Container: container, Follow: true}).Stream(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to follow build logs: %w", err)
+		}
+		scanner := bufio.NewScanner(stream)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for scanner.Scan() {
+			out.line(scanner.Text())
+		}
+		stream.Close()
+	}
+
+	for {
+		job, err := jobs.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to read build job: %w", err)
+		}
+		if job.Status.Succeeded > 0 {
+			return nil
+		}
+		if job.Status.Failed > 0 {
+			return errors.New("the build job failed")
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("build did not finish: %w", ctx.Err())
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// buildJob runs the buildpack lifecycle creator on the source fetched from
+// this service, pushing the image with BUILD_REGISTRY_SECRET when set
+func (g *gitReceiver) buildJob(name string, app *Application, deploy *GitDeploy, sourceURL string) *batchv1.Job {
+	cnbUser := int64(1000)
+	labels := map[string]string{
+		"app":        app.Name,
+		"managed":    "002aic-platform",
+		"git-deploy": strconv.FormatUint(uint64(deploy.ID), 10),
+	}
+	workspace := corev1.VolumeMount{Name: "workspace", MountPath: "/workspace"}
+	volumes := []corev1.Volume{{Name: "workspace", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+
+	build := corev1.Container{
+		Name:  "build",
+		Image: g.builderImage,
+		Command: []string{
+			"/cnb/lifecycle/creator",
+			"-app=/workspace",
+			"-cache-image=" + fmt.Sprintf("%s/%s:build-cache", g.imageRepo, app.Name),
+			deploy.Image,
+		},
+		VolumeMounts: []corev1.VolumeMount{workspace},
+	}
+	if g.registrySecret != "" {
+		volumes = append(volumes, corev1.Volume{
+			Name: "registry",
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+				SecretName: g.registrySecret,
+				Items:      []corev1.KeyToPath{{Key: corev1.DockerConfigJsonKey, Path: "config.json"}},
+			}},
+		})
+		build.VolumeMounts = append(build.VolumeMounts, corev1.VolumeMount{Name: "registry", MountPath: "/registry", ReadOnly: true})
+		build.Env = append(build.Env, corev1.EnvVar{Name: "DOCKER_CONFIG", Value: "/registry"})
+	}
+
+	ttl := int32(3600)
+	deadline := int64(g.buildTimeout.Seconds())
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: g.namespace, Labels: labels},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            int32Ptr(0),
+			ActiveDeadlineSeconds:   &deadline,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					SecurityContext: &corev1.PodSecurityContext{
+						RunAsUser:  &cnbUser,
+						RunAsGroup: &cnbUser,
+						FSGroup:    &cnbUser,
+					},
+					InitContainers: []corev1.Container{{
+						Name:         "fetch-source",
+						Image:        g.fetchImage,
+						Command:      []string{"sh", "-c", `wget -qO- "$SOURCE_URL" | tar -xzf - -C /workspace`},
+						Env:          []corev1.EnvVar{{Name: "SOURCE_URL", Value: sourceURL}},
+						VolumeMounts: []corev1.VolumeMount{workspace},
+					}},
+					Containers: []corev1.Container{build},
+					Volumes:    volumes,
+				},
+			},
+		},
+	}
+}
+
+// waitForBuildPod returns the name of a build job's pod once it exists
+func (rs *RuntimeService) waitForBuildPod(ctx context.Context, job string) (string, error) {
+	for {
+		pods, err := rs.k8sClient.CoreV1().Pods(rs.git.namespace).List(ctx, metav1.ListOptions{LabelSelector: "job-name=" + job})
+		if err == nil && len(pods.Items) > 0 {
+			return pods.Items[0].Name, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("build pod did not start: %w", ctx.Err())
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// waitForContainer waits until a build pod's container has started, failing
+// if it never will
+func (rs *RuntimeService) waitForContainer(ctx context.Context, podName, container string) error {
+	for {
+		pod, err := rs.k8sClient.CoreV1().Pods(rs.git.namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to read build pod: %w", err)
+		}
+		statuses := append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...)
+		for _, status := range statuses {
+			if status.Name != container {
+				continue
+			}
+			if status.State.Running != nil || status.State.Terminated != nil {
+				return nil
+			}
+			if waiting := status.State.Waiting; waiting != nil {
+				switch waiting.Reason {
+				case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError":
+					return fmt.Errorf("%s container cannot start: %s %s", container, waiting.Reason, waiting.Message)
+				}
+			}
+		}
+		if pod.Status.Phase == corev1.PodFailed {
+			return fmt.Errorf("build pod failed before %s started: %s", container, pod.Status.Message)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s container did not start: %w", container, ctx.Err())
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// rolloutImage points the application's deployment at a new image,
+// creating the deployment if the application has none yet, and waits for
+// the rollout
+func (rs *RuntimeService) rolloutImage(ctx context.Context, out *deployOutput, app *Application, runtime *Runtime, image string) error {
+	app.Image = image
+	deployments := rs.k8sClient.AppsV1().Deployments("default")
+	deployment, err := deployments.Get(ctx, app.Name, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		out.line("Creating deployment " + app.Name)
+		if err := rs.deployToKubernetes(app, runtime); err != nil {
+			return err
+		}
+	case err != nil:
+		return fmt.Errorf("failed to read deployment: %w", err)
+	default:
+		containers := deployment.Spec.Template.Spec.Containers
+		index := 0
+		for i := range containers {
+			if containers[i].Name == app.Name {
+				index = i
+			}
+		}
+		containers[index].Image = image
+		if _, err := deployments.Update(ctx, deployment, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to update deployment: %w", err)
+		}
+	}
+
+	if err := rs.waitForRollout(ctx, out, app.Name); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if app.URL == "" {
+		app.URL = fmt.Sprintf("https://%s.002aic.com", app.Name)
+	}
+	app.Status = "running"
+	app.DeployedAt = &now
+	rs.db.Model(app).Updates(map[string]interface{}{
+		"image":       app.Image,
+		"status":      app.Status,
+		"url":         app.URL,
+		"deployed_at": now,
+		"updated_at":  now,
+	})
+	return nil
+}
+
+// waitForRollout waits until every replica of a deployment runs its latest
+// template, reporting progress as it changes
+func (rs *RuntimeService) waitForRollout(ctx context.Context, out *deployOutput, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, rs.git.rolloutTimeout)
+	defer cancel()
+
+	last := ""
+	for {
+		deployment, err := rs.k8sClient.AppsV1().Deployments("default").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to read deployment: %w", err)
+		}
+		want := int32(1)
+		if deployment.Spec.Replicas != nil {
+			want = *deployment.Spec.Replicas
+		}
+		status := deployment.Status
+		if status.ObservedGeneration >= deployment.Generation &&
+			status.UpdatedReplicas == want && status.Replicas == want && status.AvailableReplicas == want {
+			return nil
+		}
+
+		progress := fmt.Sprintf("%d of %d updated replicas available", min(status.UpdatedReplicas, status.AvailableReplicas), want)
+		if progress != last {
+			out.line(progress)
+			last = progress
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("rollout did not complete: %s", progress)
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// gitSource serves a push's source tarball to its build job
+func (rs *RuntimeService) gitSource(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("deploy_id"), 10, 64)
+	if err != nil || !rs.git.sourceTokenValid(uint(id), c.Query("token")) {
+		c.String(404, "Not found\n")
+		return
+	}
+	c.File(rs.git.sourcePath(uint(id)))
+}
+
+func (rs *RuntimeService) listGitDeploys(c *gin.Context) {
+	var app Application
+	if err := rs.db.First(&app, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Application not found"})
+		return
+	}
+
+	var deploys []GitDeploy
+	query := rs.db.Omit("log").Where("application_id = ?", app.ID)
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Order("created_at DESC").Limit(100).Find(&deploys).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch git deploys"})
+		return
+	}
+	c.JSON(200, gin.H{"git_remote": rs.git.remoteURL(&app), "git_deploys": deploys})
+}
+
+func (rs *RuntimeService) getGitDeploy(c *gin.Context) {
+	var deploy GitDeploy
+	if err := rs.db.Where("id = ? AND application_id = ?", c.Param("deploy_id"), c.Param("id")).First(&deploy).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Git deploy not found"})
+		return
+	}
+	c.JSON(200, deploy)
+}
+
+// runGitHook runs as a repository's pre-receive hook, started by git
+// receive-pack under gitReceivePack. It sends the tree pushed to the deploy
+// branch to the service and relays the output; a non-zero exit rejects the
+// push.
+func runGitHook(args []string) int {
+	if len(args) == 0 || args[0] != "pre-receive" {
+		fmt.Fprintln(os.Stderr, "usage: git-hook pre-receive")
+		return 2
+	}
+	hookURL := os.Getenv("RUNTIME_GIT_HOOK_URL")
+	pushID := os.Getenv("RUNTIME_GIT_PUSH_ID")
+	token := os.Getenv("RUNTIME_GIT_PUSH_TOKEN")
+	if hookURL == "" || pushID == "" || token == "" {
+		fmt.Println("Pushes are only accepted through the runtime service")
+		return 1
+	}
+
+	deployed := false
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		oldRev, newRev, ref := fields[0], fields[1], fields[2]
+		switch {
+		case ref != "refs/heads/main" && ref != "refs/heads/master":
+			fmt.Printf("Pushed %s; only main and master are deployed\n", ref)
+		case strings.Trim(newRev, "0") == "":
+			fmt.Printf("%s is the deploy branch and cannot be deleted\n", ref)
+			return 1
+		case deployed:
+			fmt.Printf("Pushed %s; already deployed this push\n", ref)
+		default:
+			if !sendGitDeploy(hookURL, pushID, token, ref, oldRev, newRev) {
+				return 1
+			}
+			deployed = true
+		}
+	}
+	return 0
+}
+
+// sendGitDeploy streams a revision's tree to the service and relays the
+// build and deploy output, reporting whether the deploy succeeded
+func sendGitDeploy(hookURL, pushID, token, ref, oldRev, newRev string) bool {
+	archive := exec.Command("git", "archive", "--format=tar.gz", newRev)
+	archive.Stderr = os.Stderr
+	tree, err := archive.StdoutPipe()
+	if err != nil {
+		fmt.Printf("Failed to archive %s: %v\n", shortRev(newRev), err)
+		return false
+	}
+	if err := archive.Start(); err != nil {
+		fmt.Printf("Failed to archive %s: %v\n", shortRev(newRev), err)
+		return false
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hookURL, tree)
+	if err != nil {
+		fmt.Printf("Failed to reach the runtime service: %v\n", err)
+		return false
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	req.Header.Set("X-Git-Push-ID", pushID)
+	req.Header.Set("X-Git-Push-Token", token)
+	req.Header.Set("X-Git-Ref", ref)
+	req.Header.Set("X-Git-Old-Rev", oldRev)
+	req.Header.Set("X-Git-New-Rev", newRev)
+
+	resp, err := http.DefaultClient.Do(req)
+	if waitErr := archive.Wait(); waitErr != nil && err == nil {
+		err = fmt.Errorf("git archive: %w", waitErr)
+	}
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		fmt.Printf("Failed to reach the runtime service: %v\n", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	io.Copy(os.Stdout, resp.Body)
+	return resp.StatusCode == http.StatusOK && resp.Trailer.Get(gitDeployStatusTrailer) == GitDeploySucceeded
+}
+
+// deployOutput writes build and deploy output for the pusher, keeping the
+// tail for the deploy record
+type deployOutput struct {
+	w   io.Writer
+	log []byte
+}
+
+func (o *deployOutput) Write(p []byte) (int, error) {
+	// A pusher who went away does not stop the deploy being logged
+	o.w.Write(p)
+	o.log = append(o.log, p...)
+	if len(o.log) > gitDeployLogLimit {
+		o.log = o.log[len(o.log)-gitDeployLogLimit:]
+	}
+	return len(p), nil
+}
+
+// step writes a headline, line writes detail under it
+func (o *deployOutput) step(format string, args ...interface{}) {
+	fmt.Fprintf(o, "-----> "+format+"\n", args...)
+}
+
+func (o *deployOutput) line(text string) {
+	fmt.Fprintf(o, "       %s\n", text)
+}
+
+func (o *deployOutput) String() string {
+	return string(o.log)
+}
+
+// flushWriter flushes every write so output streams to the client
+type flushWriter struct {
+	w gin.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.w.Flush()
+	return n, err
+}
+
+// saveUpload writes a request body to path
+func saveUpload(path string, body io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, body); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// pktLine encodes a git protocol packet line
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+func shortRev(rev string) string {
+	if len(rev) > 12 {
+		return rev[:12]
+	}
+	return rev
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
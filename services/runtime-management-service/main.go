@@ -47,16 +47,19 @@ type Runtime struct {
 type Application struct {
 	ID          uint      `json:"id" gorm:"primaryKey"`
 	Name        string    `json:"name" gorm:"uniqueIndex;not null"`
+	ProjectID   string    `json:"project_id" gorm:"index"`
 	RuntimeID   uint      `json:"runtime_id" gorm:"not null"`
 	Runtime     Runtime   `json:"runtime" gorm:"foreignKey:RuntimeID"`
 	Status      string    `json:"status" gorm:"default:'pending'"`
 	URL         string    `json:"url"`
 	SourceURL   string    `json:"source_url"`
+	Image       string    `json:"image"` // built from git pushes; the runtime's image when empty
 	BuildStatus string    `json:"build_status" gorm:"default:'pending'"`
 	Replicas    int       `json:"replicas" gorm:"default:1"`
 	CPU         string    `json:"cpu" gorm:"default:'100m'"`
 	Memory      string    `json:"memory" gorm:"default:'128Mi'"`
 	EnvVars     string    `json:"env_vars" gorm:"type:jsonb"`
+	BoundDatabase string  `json:"bound_database"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 	DeployedAt  *time.Time `json:"deployed_at"`
@@ -65,9 +68,12 @@ type Application struct {
 
 // RuntimeService handles PaaS runtime management
 type RuntimeService struct {
-	db        *gorm.DB
-	k8sClient *kubernetes.Clientset
-	logger    *zap.Logger
+	db            *gorm.DB
+	k8sClient     *kubernetes.Clientset
+	logger        *zap.Logger
+	credentialKey []byte
+	backups       *backupClient
+	git           *gitReceiver
 }
 
 // Metrics
@@ -96,6 +102,11 @@ var (
 )
 
 func main() {
+	// Repositories' pre-receive hooks run this binary in hook mode
+	if len(os.Args) > 1 && os.Args[1] == "git-hook" {
+		os.Exit(runGitHook(os.Args[2:]))
+	}
+
 	// Initialize logger
 	logger, _ := zap.NewProduction()
 	defer logger.Sync()
@@ -114,11 +125,17 @@ func main() {
 
 	// Initialize service
 	runtimeService := &RuntimeService{
-		db:        db,
-		k8sClient: k8sClient,
-		logger:    logger,
+		db:            db,
+		k8sClient:     k8sClient,
+		logger:        logger,
+		credentialKey: loadCredentialKey(),
+		backups:       newBackupClient(),
+		git:           newGitReceiver(),
 	}
 
+	// Track backup-service jobs and run scheduled backups
+	go runtimeService.runBackupWorker()
+
 	// Initialize Gin router
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
@@ -150,6 +167,13 @@ func main() {
 	// Metrics endpoint
 	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
+	// Git push deploys, authenticated with platform API keys; the internal
+	// routes serve the pre-receive hook and build jobs with per-push tokens
+	router.GET("/git/:repo/info/refs", runtimeService.gitInfoRefs)
+	router.POST("/git/:repo/git-receive-pack", runtimeService.gitReceivePack)
+	router.POST("/internal/git/hooks/pre-receive", runtimeService.gitPreReceive)
+	router.GET("/internal/git/sources/:deploy_id", runtimeService.gitSource)
+
 	// Runtime management API routes
 	v1 := router.Group("/v1/runtime")
 	{
@@ -170,14 +194,32 @@ func main() {
 		v1.POST("/applications/:id/restart", runtimeService.restartApplication)
 		v1.GET("/applications/:id/logs", runtimeService.getApplicationLogs)
 		v1.GET("/applications/:id/metrics", runtimeService.getApplicationMetrics)
+
+		// Backup and restore
+		v1.POST("/applications/:id/backups", runtimeService.createApplicationBackup)
+		v1.GET("/applications/:id/backups", runtimeService.listApplicationBackups)
+		v1.GET("/applications/:id/backups/:backup_id", runtimeService.getApplicationBackup)
+		v1.POST("/applications/:id/restore", runtimeService.restoreApplication)
+		v1.GET("/applications/:id/backup-schedule", runtimeService.getBackupSchedule)
+		v1.PUT("/applications/:id/backup-schedule", runtimeService.setBackupSchedule)
+		v1.DELETE("/applications/:id/backup-schedule", runtimeService.deleteBackupSchedule)
 		
 		// Build management
 		v1.POST("/applications/:id/build", runtimeService.buildApplication)
 		v1.GET("/applications/:id/builds", runtimeService.getBuildHistory)
+		v1.GET("/applications/:id/git-deploys", runtimeService.listGitDeploys)
+		v1.GET("/applications/:id/git-deploys/:deploy_id", runtimeService.getGitDeploy)
 		
 		// Environment management
 		v1.GET("/environments", runtimeService.listEnvironments)
 		v1.POST("/environments", runtimeService.createEnvironment)
+
+		// Private registry credentials
+		v1.GET("/projects/:project_id/registry-credentials", runtimeService.listRegistryCredentials)
+		v1.POST("/projects/:project_id/registry-credentials", runtimeService.createRegistryCredential)
+		v1.POST("/projects/:project_id/registry-credentials/:id/rotate", runtimeService.rotateRegistryCredential)
+		v1.DELETE("/projects/:project_id/registry-credentials/:id", runtimeService.deleteRegistryCredential)
+		v1.POST("/projects/:project_id/images/validate", runtimeService.validateImage)
 	}
 
 	// Start server
@@ -206,7 +248,7 @@ func initDatabase() (*gorm.DB, error) {
 	}
 
 	// Auto-migrate the schema
-	err = db.AutoMigrate(&Runtime{}, &Application{})
+	err = db.AutoMigrate(&Runtime{}, &Application{}, &RegistryCredential{}, &ApplicationBackup{}, &BackupSchedule{}, &GitDeploy{})
 	if err != nil {
 		return nil, err
 	}
@@ -294,6 +336,14 @@ func (rs *RuntimeService) deployApplication(c *gin.Context) {
 		return
 	}
 	
+	// Make sure the image can be pulled before anything is created
+	if getEnv("REGISTRY_PULL_VALIDATION", "true") == "true" {
+		if err := rs.checkImagePullable(c.Request.Context(), app.ProjectID, applicationImage(&app, &runtime)); err != nil {
+			c.JSON(422, gin.H{"error": "Image is not pullable", "details": err.Error()})
+			return
+		}
+	}
+	
 	app.CreatedAt = time.Now()
 	app.UpdatedAt = time.Now()
 	app.Status = "deploying"
@@ -350,6 +400,12 @@ func (rs *RuntimeService) deployToKubernetes(app *Application, runtime *Runtime)
 		}
 	}
 	
+	// Pull secrets for the project's private registries
+	pullSecrets, err := rs.attachPullSecrets(context.TODO(), namespace, app.ProjectID)
+	if err != nil {
+		return fmt.Errorf("failed to attach image pull secrets: %w", err)
+	}
+	
 	// Create Deployment
 	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
@@ -376,10 +432,11 @@ func (rs *RuntimeService) deployToKubernetes(app *Application, runtime *Runtime)
 					},
 				},
 				Spec: corev1.PodSpec{
+					ImagePullSecrets: pullSecrets,
 					Containers: []corev1.Container{
 						{
 							Name:  app.Name,
-							Image: runtime.Image,
+							Image: applicationImage(app, runtime),
 							Ports: []corev1.ContainerPort{
 								{
 									ContainerPort: 8080,
@@ -403,7 +460,7 @@ func (rs *RuntimeService) deployToKubernetes(app *Application, runtime *Runtime)
 		},
 	}
 	
-	_, err := rs.k8sClient.AppsV1().Deployments(namespace).Create(
+	_, err = rs.k8sClient.AppsV1().Deployments(namespace).Create(
 		context.TODO(), deployment, metav1.CreateOptions{})
 	if err != nil {
 		return fmt.Errorf("failed to create deployment: %w", err)
@@ -444,6 +501,19 @@ func (rs *RuntimeService) deployToKubernetes(app *Application, runtime *Runtime)
 	return nil
 }
 
+func (rs *RuntimeService) getApplication(c *gin.Context) {
+	var app Application
+	if err := rs.db.Preload("Runtime").First(&app, c.Param("id")).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Application not found"})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"application": app,
+		"backups":     rs.latestBackups(app.ID),
+	})
+}
+
 func (rs *RuntimeService) scaleApplication(c *gin.Context) {
 	id := c.Param("id")
 	
@@ -543,6 +613,14 @@ func (rs *RuntimeService) getApplicationLogs(c *gin.Context) {
 // Helper functions
 func int32Ptr(i int32) *int32 { return &i }
 
+// applicationImage is the image an application runs
+func applicationImage(app *Application, runtime *Runtime) string {
+	if app.Image != "" {
+		return app.Image
+	}
+	return runtime.Image
+}
+
 func parseQuantity(s string) resource.Quantity {
 	// Simplified quantity parsing
 	// In production, use resource.ParseQuantity
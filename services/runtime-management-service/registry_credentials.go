@@ -0,0 +1,563 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RegistryCredential holds a project's login for a private container registry
+type RegistryCredential struct {
+	ID              uint       `json:"id" gorm:"primaryKey"`
+	ProjectID       string     `json:"project_id" gorm:"not null;uniqueIndex:idx_registry_credential_name"`
+	Name            string     `json:"name" gorm:"not null;uniqueIndex:idx_registry_credential_name"`
+	Registry        string     `json:"registry" gorm:"not null"`
+	Username        string     `json:"username" gorm:"not null"`
+	Password        string     `json:"-" gorm:"not null"` // AES-GCM sealed
+	Email           string     `json:"email"`
+	Namespaces      string     `json:"namespaces" gorm:"type:jsonb"` // namespaces holding the pull secret
+	LastRotatedAt   *time.Time `json:"last_rotated_at"`
+	LastValidatedAt *time.Time `json:"last_validated_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	CreatedBy       string     `json:"created_by"`
+}
+
+const dockerHubRegistry = "registry-1.docker.io"
+
+var errCredentialKeyMissing = errors.New("REGISTRY_CREDENTIALS_KEY is not configured")
+
+// loadCredentialKey derives the credential encryption key from the environment
+func loadCredentialKey() []byte {
+	secret := getEnv("REGISTRY_CREDENTIALS_KEY", "")
+	if secret == "" {
+		return nil
+	}
+	key := sha256.Sum256([]byte(secret))
+	return key[:]
+}
+
+func (rs *RuntimeService) sealCredential(plaintext string) (string, error) {
+	if rs.credentialKey == nil {
+		return "", errCredentialKeyMissing
+	}
+	block, err := aes.NewCipher(rs.credentialKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plaintext), nil)), nil
+}
+
+func (rs *RuntimeService) openCredential(sealed string) (string, error) {
+	if rs.credentialKey == nil {
+		return "", errCredentialKeyMissing
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(rs.credentialKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("sealed credential is truncated")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// normalizeRegistry maps a registry host to the host serving the v2 API
+func normalizeRegistry(host string) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://"), "/")
+	switch host {
+	case "", "docker.io", "index.docker.io":
+		return dockerHubRegistry
+	}
+	return host
+}
+
+// parseImageReference splits an image into registry, repository and tag or digest
+func parseImageReference(image string) (registry, repository, reference string) {
+	name := image
+	reference = "latest"
+	if at := strings.Index(name, "@"); at >= 0 {
+		name, reference = name[:at], name[at+1:]
+	} else if colon := strings.LastIndex(name, ":"); colon > strings.LastIndex(name, "/") {
+		name, reference = name[:colon], name[colon+1:]
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		registry, repository = parts[0], parts[1]
+	} else {
+		registry, repository = dockerHubRegistry, name
+	}
+
+	registry = normalizeRegistry(registry)
+	if registry == dockerHubRegistry && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+	return registry, repository, reference
+}
+
+// pullSecretName is the Kubernetes secret holding a credential
+func pullSecretName(cred *RegistryCredential) string {
+	return "regcred-" + strings.ToLower(cred.Name)
+}
+
+func (rs *RuntimeService) dockerConfigJSON(cred *RegistryCredential) ([]byte, error) {
+	password, err := rs.openCredential(cred.Password)
+	if err != nil {
+		return nil, err
+	}
+	server := cred.Registry
+	if server == dockerHubRegistry {
+		server = "https://index.docker.io/v1/"
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(cred.Username + ":" + password))
+	return json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			server: map[string]string{
+				"username": cred.Username,
+				"password": password,
+				"email":    cred.Email,
+				"auth":     auth,
+			},
+		},
+	})
+}
+
+// ensurePullSecret creates or updates the credential's secret in a namespace
+func (rs *RuntimeService) ensurePullSecret(ctx context.Context, namespace string, cred *RegistryCredential) error {
+	config, err := rs.dockerConfigJSON(cred)
+	if err != nil {
+		return err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pullSecretName(cred),
+			Namespace: namespace,
+			Labels: map[string]string{
+				"managed": "002aic-platform",
+				"project": cred.ProjectID,
+			},
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{corev1.DockerConfigJsonKey: config},
+	}
+
+	secrets := rs.k8sClient.CoreV1().Secrets(namespace)
+	existing, err := secrets.Get(ctx, secret.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+	} else if err == nil {
+		existing.Data = secret.Data
+		existing.Type = secret.Type
+		_, err = secrets.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write pull secret %s/%s: %w", namespace, secret.Name, err)
+	}
+
+	return rs.recordSecretNamespace(cred, namespace)
+}
+
+func (rs *RuntimeService) recordSecretNamespace(cred *RegistryCredential, namespace string) error {
+	namespaces := credentialNamespaces(cred)
+	for _, ns := range namespaces {
+		if ns == namespace {
+			return nil
+		}
+	}
+	encoded, _ := json.Marshal(append(namespaces, namespace))
+	cred.Namespaces = string(encoded)
+	return rs.db.Model(cred).Update("namespaces", cred.Namespaces).Error
+}
+
+func credentialNamespaces(cred *RegistryCredential) []string {
+	var namespaces []string
+	if cred.Namespaces != "" {
+		json.Unmarshal([]byte(cred.Namespaces), &namespaces)
+	}
+	return namespaces
+}
+
+// attachPullSecrets writes the project's pull secrets into the namespace,
+// adds them to its default service account and returns the references for
+// the deployment's pod spec
+func (rs *RuntimeService) attachPullSecrets(ctx context.Context, namespace, projectID string) ([]corev1.LocalObjectReference, error) {
+	if projectID == "" {
+		return nil, nil
+	}
+
+	var creds []RegistryCredential
+	if err := rs.db.Where("project_id = ?", projectID).Find(&creds).Error; err != nil {
+		return nil, err
+	}
+
+	var refs []corev1.LocalObjectReference
+	for i := range creds {
+		if err := rs.ensurePullSecret(ctx, namespace, &creds[i]); err != nil {
+			return nil, err
+		}
+		refs = append(refs, corev1.LocalObjectReference{Name: pullSecretName(&creds[i])})
+	}
+
+	if len(refs) > 0 {
+		if err := rs.attachToServiceAccount(ctx, namespace, refs); err != nil {
+			// The pod spec carries the secrets as well, so this is not fatal
+			rs.logger.Warn("Failed to attach pull secrets to service account",
+				zap.String("namespace", namespace), zap.Error(err))
+		}
+	}
+	return refs, nil
+}
+
+func (rs *RuntimeService) attachToServiceAccount(ctx context.Context, namespace string, refs []corev1.LocalObjectReference) error {
+	accounts := rs.k8sClient.CoreV1().ServiceAccounts(namespace)
+	account, err := accounts.Get(ctx, "default", metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	present := make(map[string]bool)
+	for _, ref := range account.ImagePullSecrets {
+		present[ref.Name] = true
+	}
+	changed := false
+	for _, ref := range refs {
+		if !present[ref.Name] {
+			account.ImagePullSecrets = append(account.ImagePullSecrets, ref)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	_, err = accounts.Update(ctx, account, metav1.UpdateOptions{})
+	return err
+}
+
+// checkImagePullable asks the registry for the image manifest using the
+// project's credentials, following the v2 bearer-token handshake
+func (rs *RuntimeService) checkImagePullable(ctx context.Context, projectID, image string) error {
+	registry, repository, reference := parseImageReference(image)
+
+	var username, password string
+	if projectID != "" {
+		var cred RegistryCredential
+		err := rs.db.Where("project_id = ? AND registry = ?", projectID, registry).First(&cred).Error
+		if err == nil {
+			username = cred.Username
+			if password, err = rs.openCredential(cred.Password); err != nil {
+				return err
+			}
+		}
+	}
+
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registry, repository, reference)
+	client := &http.Client{Timeout: 15 * time.Second}
+
+	resp, err := rs.headManifest(ctx, client, manifestURL, "")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		authorization, err := registryAuthorization(ctx, client, resp.Header.Get("WWW-Authenticate"), repository, username, password)
+		if err != nil {
+			return err
+		}
+		if resp, err = rs.headManifest(ctx, client, manifestURL, authorization); err != nil {
+			return err
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("image %s not found in %s", image, registry)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Errorf("access to %s denied by %s; check the project's registry credentials", image, registry)
+	}
+	return fmt.Errorf("registry %s returned %d for %s", registry, resp.StatusCode, image)
+}
+
+func (rs *RuntimeService) headManifest(ctx context.Context, client *http.Client, manifestURL, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join([]string{
+		"application/vnd.oci.image.index.v1+json",
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.docker.distribution.manifest.v2+json",
+	}, ", "))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("registry unreachable: %w", err)
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// registryAuthorization answers a WWW-Authenticate challenge
+func registryAuthorization(ctx context.Context, client *http.Client, challenge, repository, username, password string) (string, error) {
+	scheme, params := parseAuthChallenge(challenge)
+	switch scheme {
+	case "basic":
+		if username == "" {
+			return "", errors.New("registry requires credentials and none are configured for this project")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported registry auth challenge %q", challenge)
+	}
+
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid token realm in challenge %q", challenge)
+	}
+	query := tokenURL.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", "repository:"+repository+":pull")
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token service rejected credentials (%d)", resp.StatusCode)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("invalid token response: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// parseAuthChallenge parses `Bearer realm="...",service="..."`
+func parseAuthChallenge(header string) (string, map[string]string) {
+	params := make(map[string]string)
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	for _, part := range strings.Split(rest, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			params[strings.ToLower(key)] = strings.Trim(value, `"`)
+		}
+	}
+	return strings.ToLower(scheme), params
+}
+
+func (rs *RuntimeService) createRegistryCredential(c *gin.Context) {
+	var request struct {
+		Name     string `json:"name" binding:"required"`
+		Registry string `json:"registry" binding:"required"`
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+		Email    string `json:"email"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	sealed, err := rs.sealCredential(request.Password)
+	if err != nil {
+		c.JSON(503, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	cred := RegistryCredential{
+		ProjectID:     c.Param("project_id"),
+		Name:          request.Name,
+		Registry:      normalizeRegistry(request.Registry),
+		Username:      request.Username,
+		Password:      sealed,
+		Email:         request.Email,
+		Namespaces:    "[]",
+		LastRotatedAt: &now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		CreatedBy:     c.GetHeader("X-User-ID"),
+	}
+	if err := rs.db.Create(&cred).Error; err != nil {
+		c.JSON(409, gin.H{"error": "Credential with this name already exists for the project"})
+		return
+	}
+
+	rs.logger.Info("Registry credential created",
+		zap.String("project", cred.ProjectID),
+		zap.String("name", cred.Name),
+		zap.String("registry", cred.Registry))
+
+	c.JSON(201, cred)
+}
+
+func (rs *RuntimeService) listRegistryCredentials(c *gin.Context) {
+	var creds []RegistryCredential
+	if err := rs.db.Where("project_id = ?", c.Param("project_id")).Order("name").Find(&creds).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to fetch registry credentials"})
+		return
+	}
+	c.JSON(200, gin.H{"credentials": creds})
+}
+
+// rotateRegistryCredential replaces the stored secret and pushes it to every
+// namespace already holding the pull secret
+func (rs *RuntimeService) rotateRegistryCredential(c *gin.Context) {
+	var request struct {
+		Username string `json:"username"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	var cred RegistryCredential
+	if err := rs.db.Where("project_id = ? AND id = ?", c.Param("project_id"), c.Param("id")).First(&cred).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Registry credential not found"})
+		return
+	}
+
+	sealed, err := rs.sealCredential(request.Password)
+	if err != nil {
+		c.JSON(503, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	if request.Username != "" {
+		cred.Username = request.Username
+	}
+	cred.Password = sealed
+	cred.LastRotatedAt = &now
+	cred.UpdatedAt = now
+	if err := rs.db.Save(&cred).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to rotate registry credential"})
+		return
+	}
+
+	var failed []string
+	for _, namespace := range credentialNamespaces(&cred) {
+		if err := rs.ensurePullSecret(c.Request.Context(), namespace, &cred); err != nil {
+			rs.logger.Error("Failed to update pull secret after rotation",
+				zap.String("namespace", namespace), zap.Error(err))
+			failed = append(failed, namespace)
+		}
+	}
+
+	rs.logger.Info("Registry credential rotated",
+		zap.String("project", cred.ProjectID),
+		zap.String("name", cred.Name))
+
+	c.JSON(200, gin.H{
+		"credential":        cred,
+		"failed_namespaces": failed,
+	})
+}
+
+func (rs *RuntimeService) deleteRegistryCredential(c *gin.Context) {
+	var cred RegistryCredential
+	if err := rs.db.Where("project_id = ? AND id = ?", c.Param("project_id"), c.Param("id")).First(&cred).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Registry credential not found"})
+		return
+	}
+
+	for _, namespace := range credentialNamespaces(&cred) {
+		err := rs.k8sClient.CoreV1().Secrets(namespace).Delete(c.Request.Context(), pullSecretName(&cred), metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			rs.logger.Warn("Failed to delete pull secret",
+				zap.String("namespace", namespace), zap.Error(err))
+		}
+	}
+
+	if err := rs.db.Delete(&cred).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to delete registry credential"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Registry credential deleted"})
+}
+
+func (rs *RuntimeService) validateImage(c *gin.Context) {
+	var request struct {
+		Image string `json:"image" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	projectID := c.Param("project_id")
+	if err := rs.checkImagePullable(c.Request.Context(), projectID, request.Image); err != nil {
+		c.JSON(200, gin.H{"image": request.Image, "pullable": false, "error": err.Error()})
+		return
+	}
+
+	registry, _, _ := parseImageReference(request.Image)
+	rs.db.Model(&RegistryCredential{}).
+		Where("project_id = ? AND registry = ?", projectID, registry).
+		Update("last_validated_at", time.Now())
+
+	c.JSON(200, gin.H{"image": request.Image, "pullable": true})
+}
@@ -0,0 +1,713 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Public abuse and vulnerability report intake. External researchers and
+// users submit reports without an account, as JSON or as a multipart form
+// with attachments. Every submission must carry a captcha response, which
+// is checked against a siteverify-style API (hCaptcha, Turnstile and
+// reCAPTCHA all fit), and is counted against a per-address and a global
+// sliding window on top of the usual rate limit policies.
+//
+// A report becomes a draft SecurityIncident for the default tenant, triaged
+// by keyword and by the reporter's own estimate, and the security team is
+// notified. Attachments go to the archive bucket and are never served back
+// to the public. The reporter gets an acknowledgement token, shown once and
+// stored hashed, with which they can check the report's status, read the
+// team's replies and add messages and attachments.
+
+// Report categories
+const (
+	AbuseReportCategoryVulnerability = "vulnerability"
+	AbuseReportCategoryAbuse         = "abuse"
+)
+
+// Who wrote a report message
+const (
+	AbuseReportAuthorReporter = "reporter"
+	AbuseReportAuthorTeam     = "security_team"
+)
+
+const (
+	abuseReportTokenPrefix    = "rpt_"
+	abuseReportMaxAttachments = 5
+	abuseReportObjectPrefix   = "abuse-reports/"
+)
+
+// AbuseReport is a report submitted through the public intake
+type AbuseReport struct {
+	ID            string    `json:"id" gorm:"primaryKey"`
+	IncidentID    string    `json:"incident_id" gorm:"index"`
+	Category      string    `json:"category" gorm:"index"`
+	Title         string    `json:"title"`
+	Description   string    `json:"description" gorm:"type:text"`
+	AffectedAsset string    `json:"affected_asset"`
+	ReportedLevel string    `json:"reported_severity"` // the reporter's estimate
+	TriageLevel   string    `json:"triage_severity"`
+	TriageTags    []string  `json:"triage_tags" gorm:"type:text[]"`
+	ReporterName  string    `json:"reporter_name"`
+	ReporterEmail string    `json:"reporter_email"`
+	SubmitterIP   string    `json:"submitter_ip"`
+	UserAgent     string    `json:"user_agent"`
+	TokenHash     string    `json:"-" gorm:"uniqueIndex"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// AbuseReportMessage is a follow-up between the reporter and the team
+type AbuseReportMessage struct {
+	ID        string    `json:"id" gorm:"primaryKey"`
+	ReportID  string    `json:"report_id" gorm:"index"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body" gorm:"type:text"`
+	Internal  bool      `json:"internal"` // team notes the reporter doesn't see
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AbuseReportAttachment is a file sent with a report or message
+type AbuseReportAttachment struct {
+	ID          string    `json:"id" gorm:"primaryKey"`
+	ReportID    string    `json:"report_id" gorm:"index"`
+	MessageID   string    `json:"message_id,omitempty"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type"` // sniffed, not as declared
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	ObjectKey   string    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+var abuseReportsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "abuse_reports_total",
+		Help: "Public abuse report submissions by outcome",
+	},
+	[]string{"category", "result"}, // accepted, rate_limited, captcha_failed, invalid, spam
+)
+
+func init() {
+	prometheus.MustRegister(abuseReportsTotal)
+}
+
+// triageRule raises a report to a severity when its text matches
+type triageRule struct {
+	tag      string
+	severity string
+	pattern  *regexp.Regexp
+}
+
+var abuseTriageRules = []triageRule{
+	{"remote_code_execution", ThreatLevelCritical, regexp.MustCompile(`\b(remote code execution|rce|command injection|deserialization)\b`)},
+	{"auth_bypass", ThreatLevelCritical, regexp.MustCompile(`\b(auth(entication)? bypass|account takeover|privilege escalation)\b`)},
+	{"data_exposure", ThreatLevelHigh, regexp.MustCompile(`\b(data (leak|exposure)|pii|exposed credentials|leaked (key|token|secret)s?|api keys?)\b`)},
+	{"injection", ThreatLevelHigh, regexp.MustCompile(`\b(sql injection|sqli|ssrf|xxe|path traversal)\b`)},
+	{"client_side", ThreatLevelMedium, regexp.MustCompile(`\b(xss|cross-site scripting|csrf|open redirect|clickjacking)\b`)},
+	{"phishing", ThreatLevelMedium, regexp.MustCompile(`\b(phishing|impersonat\w*|malware)\b`)},
+	{"spam", ThreatLevelLow, regexp.MustCompile(`\b(spam|scraping|fake accounts?)\b`)},
+}
+
+var threatLevelRank = map[string]int{
+	ThreatLevelLow:      1,
+	ThreatLevelMedium:   2,
+	ThreatLevelHigh:     3,
+	ThreatLevelCritical: 4,
+}
+
+// triageAbuseReport picks a starting severity. The reporter's estimate
+// counts, but alone never raises a report above high.
+func triageAbuseReport(report *AbuseReport) (string, []string) {
+	text := strings.ToLower(report.Title + " " + report.Description)
+	severity := ThreatLevelLow
+	if report.Category == AbuseReportCategoryVulnerability {
+		severity = ThreatLevelMedium
+	}
+
+	var tags []string
+	for _, rule := range abuseTriageRules {
+		if rule.pattern.MatchString(text) {
+			tags = append(tags, rule.tag)
+			if threatLevelRank[rule.severity] > threatLevelRank[severity] {
+				severity = rule.severity
+			}
+		}
+	}
+
+	estimate := report.ReportedLevel
+	if estimate == ThreatLevelCritical {
+		estimate = ThreatLevelHigh
+	}
+	if threatLevelRank[estimate] > threatLevelRank[severity] {
+		severity = estimate
+	}
+	return severity, tags
+}
+
+func hashReportToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newReportToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return abuseReportTokenPrefix + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// limitAbuseIntake counts a public request against the intake's own limits,
+// answering 429 when one is exhausted. Submissions are also limited to two a
+// minute per address and to a global hourly total. Redis failures fail
+// open, like the rate limit policies.
+func (s *SecurityService) limitAbuseIntake(c *gin.Context, action string, perIPHour int) bool {
+	policies := []RateLimitPolicy{
+		{ID: "abuse-intake:" + action, Name: "abuse-intake-" + action, Limit: perIPHour, WindowSeconds: 3600},
+	}
+	if action == "submit" {
+		policies[0].Burst, policies[0].BurstWindowSeconds = 2, 60
+		policies = append(policies, RateLimitPolicy{
+			ID: "abuse-intake:global", Name: "abuse-intake-global", Limit: s.config.AbuseReportsGlobalHour, WindowSeconds: 3600,
+		})
+	}
+
+	now := time.Now()
+	for i := range policies {
+		policy := &policies[i]
+		subject := "ip:" + c.ClientIP()
+		if policy.ID == "abuse-intake:global" {
+			subject = "global"
+		}
+		result, err := s.checkRateLimit(c.Request.Context(), policy, subject, now)
+		if err != nil {
+			log.Printf("Abuse intake rate limit check failed: %v", err)
+			continue
+		}
+		if !result.allowed {
+			rateLimitRejections.WithLabelValues(policy.Name, result.window).Inc()
+			retryAfter := policy.WindowSeconds
+			if result.window == "burst" {
+				retryAfter = policy.BurstWindowSeconds
+			}
+			c.Header("Retry-After", fmt.Sprintf("%d", retryAfter))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many reports; please try again later"})
+			return false
+		}
+	}
+	return true
+}
+
+// verifyCaptcha checks a captcha response with the provider
+func (s *SecurityService) verifyCaptcha(ctx context.Context, response, remoteIP string) (bool, error) {
+	if s.config.AbuseReportCaptchaSecret == "" {
+		// Only development runs without a captcha
+		return s.config.Environment == "development", nil
+	}
+	if response == "" {
+		return false, nil
+	}
+
+	form := url.Values{
+		"secret":   {s.config.AbuseReportCaptchaSecret},
+		"response": {response},
+		"remoteip": {remoteIP},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.AbuseReportCaptchaVerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("captcha verification returned %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
+
+// abuseReportForm is a submission, from JSON or form fields
+type abuseReportForm struct {
+	Category      string `json:"category" form:"category" binding:"required,oneof=vulnerability abuse"`
+	Title         string `json:"title" form:"title" binding:"required,max=200"`
+	Description   string `json:"description" form:"description" binding:"required,min=20,max=20000"`
+	AffectedAsset string `json:"affected_asset" form:"affected_asset" binding:"max=500"`
+	Severity      string `json:"severity" form:"severity" binding:"omitempty,oneof=low medium high critical"`
+	ReporterName  string `json:"reporter_name" form:"reporter_name" binding:"max=200"`
+	ReporterEmail string `json:"reporter_email" form:"reporter_email" binding:"omitempty,email,max=320"`
+	CaptchaToken  string `json:"captcha_token" form:"captcha_token"`
+	Website       string `json:"website" form:"website"` // honeypot; people leave it empty
+}
+
+// limitIntakeBody caps a public request at the attachments it may carry
+func (s *SecurityService) limitIntakeBody(c *gin.Context) {
+	limit := int64(abuseReportMaxAttachments*s.config.AbuseReportMaxAttachmentMB+1) << 20
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+}
+
+// readAttachments reads the files of a multipart submission
+func (s *SecurityService) readAttachments(c *gin.Context) ([]*multipart.FileHeader, error) {
+	if c.ContentType() != "multipart/form-data" {
+		return nil, nil
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, err
+	}
+	files := form.File["attachments"]
+	if len(files) == 0 {
+		return nil, nil
+	}
+	if s.archive == nil {
+		return nil, errors.New("attachments are not accepted")
+	}
+	if len(files) > abuseReportMaxAttachments {
+		return nil, fmt.Errorf("at most %d attachments are accepted", abuseReportMaxAttachments)
+	}
+	maxSize := int64(s.config.AbuseReportMaxAttachmentMB) << 20
+	for _, file := range files {
+		if file.Size > maxSize {
+			return nil, fmt.Errorf("%s is larger than %d MB", file.Filename, s.config.AbuseReportMaxAttachmentMB)
+		}
+	}
+	return files, nil
+}
+
+// storeAttachments puts a report's files in the archive bucket
+func (s *SecurityService) storeAttachments(ctx context.Context, reportID, messageID string, files []*multipart.FileHeader) ([]AbuseReportAttachment, error) {
+	var attachments []AbuseReportAttachment
+	for _, file := range files {
+		f, err := file.Open()
+		if err != nil {
+			return attachments, err
+		}
+		data, err := io.ReadAll(io.LimitReader(f, file.Size))
+		f.Close()
+		if err != nil {
+			return attachments, err
+		}
+
+		sum := sha256.Sum256(data)
+		attachment := AbuseReportAttachment{
+			ID:          uuid.New().String(),
+			ReportID:    reportID,
+			MessageID:   messageID,
+			FileName:    path.Base(strings.ReplaceAll(file.Filename, "\\", "/")),
+			ContentType: http.DetectContentType(data),
+			Size:        int64(len(data)),
+			SHA256:      hex.EncodeToString(sum[:]),
+			CreatedAt:   time.Now().UTC(),
+		}
+		attachment.ObjectKey = abuseReportObjectPrefix + reportID + "/" + attachment.ID
+		if _, err := s.archive.PutObject(ctx, s.config.ArchiveS3Bucket, attachment.ObjectKey,
+			bytes.NewReader(data), attachment.Size, minio.PutObjectOptions{ContentType: "application/octet-stream"}); err != nil {
+			return attachments, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, nil
+}
+
+// Submit a report (public)
+func (s *SecurityService) submitAbuseReport(c *gin.Context) {
+	if !s.limitAbuseIntake(c, "submit", s.config.AbuseReportsPerIPHour) {
+		abuseReportsTotal.WithLabelValues("unknown", "rate_limited").Inc()
+		return
+	}
+	s.limitIntakeBody(c)
+
+	var form abuseReportForm
+	if err := c.ShouldBind(&form); err != nil {
+		abuseReportsTotal.WithLabelValues("unknown", "invalid").Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ok, err := s.verifyCaptcha(c.Request.Context(), form.CaptchaToken, c.ClientIP())
+	if err != nil {
+		log.Printf("Captcha verification failed: %v", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Unable to verify the captcha; please try again later"})
+		return
+	}
+	if !ok {
+		abuseReportsTotal.WithLabelValues(form.Category, "captcha_failed").Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Captcha verification failed"})
+		return
+	}
+
+	files, err := s.readAttachments(c)
+	if err != nil {
+		abuseReportsTotal.WithLabelValues(form.Category, "invalid").Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := newReportToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept report"})
+		return
+	}
+
+	// Bots that fill the honeypot get the usual answer and nothing else
+	if form.Website != "" {
+		abuseReportsTotal.WithLabelValues(form.Category, "spam").Inc()
+		c.JSON(http.StatusAccepted, gin.H{
+			"report_id":             uuid.New().String(),
+			"acknowledgement_token": token,
+			"status":                "received",
+		})
+		return
+	}
+
+	now := time.Now().UTC()
+	report := &AbuseReport{
+		ID:            uuid.New().String(),
+		Category:      form.Category,
+		Title:         strings.TrimSpace(form.Title),
+		Description:   strings.TrimSpace(form.Description),
+		AffectedAsset: strings.TrimSpace(form.AffectedAsset),
+		ReportedLevel: form.Severity,
+		ReporterName:  strings.TrimSpace(form.ReporterName),
+		ReporterEmail: strings.TrimSpace(form.ReporterEmail),
+		SubmitterIP:   c.ClientIP(),
+		UserAgent:     c.Request.UserAgent(),
+		TokenHash:     hashReportToken(token),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	report.TriageLevel, report.TriageTags = triageAbuseReport(report)
+
+	attachments, err := s.storeAttachments(c.Request.Context(), report.ID, "", files)
+	if err != nil {
+		log.Printf("Failed to store attachments of abuse report %s: %v", report.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store attachments"})
+		return
+	}
+
+	reporter := "external:anonymous"
+	if report.ReporterEmail != "" {
+		reporter = "external:" + report.ReporterEmail
+	}
+	incident := &SecurityIncident{
+		ID:          uuid.New().String(),
+		TenantID:    s.config.DefaultTenant,
+		Title:       fmt.Sprintf("[External %s report] %s", report.Category, report.Title),
+		Description: report.Description,
+		Severity:    report.TriageLevel,
+		Status:      "draft",
+		Category:    "external_" + report.Category,
+		Reporter:    reporter,
+		Timeline: []map[string]interface{}{{
+			"id":        uuid.New().String(),
+			"timestamp": now.Format(time.RFC3339),
+			"type":      "external_report",
+			"actor":     reporter,
+			"message":   "Report received through the public intake",
+			"details":   map[string]interface{}{"report_id": report.ID, "triage_tags": report.TriageTags},
+		}},
+		Evidence: map[string]interface{}{
+			"abuse_report_id":   report.ID,
+			"affected_asset":    report.AffectedAsset,
+			"reported_severity": report.ReportedLevel,
+			"triage_tags":       report.TriageTags,
+			"attachments":       len(attachments),
+			"submitter_ip":      report.SubmitterIP,
+		},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	report.IncidentID = incident.ID
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(incident).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(report).Error; err != nil {
+			return err
+		}
+		if len(attachments) > 0 {
+			return tx.Create(&attachments).Error
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to save abuse report: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept report"})
+		return
+	}
+
+	abuseReportsTotal.WithLabelValues(report.Category, "accepted").Inc()
+	go s.notifySecurityIncident(incident)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"report_id":             report.ID,
+		"acknowledgement_token": token,
+		"status":                "received",
+		"message":               "Thank you. Keep the acknowledgement token to follow up on this report; it is not shown again.",
+	})
+}
+
+// reportForToken finds the report of the acknowledgement token in the
+// Authorization header, answering the request when there is none
+func (s *SecurityService) reportForToken(c *gin.Context) (*AbuseReport, bool) {
+	token := bearerToken(c)
+	if !strings.HasPrefix(token, abuseReportTokenPrefix) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Acknowledgement token required"})
+		return nil, false
+	}
+	var report AbuseReport
+	if err := s.db.First(&report, "token_hash = ?", hashReportToken(token)).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return nil, false
+	}
+	return &report, true
+}
+
+// reporterStatus is the status shown to the reporter
+func reporterStatus(incidentStatus string) string {
+	switch incidentStatus {
+	case "draft", "":
+		return "received"
+	case "resolved", "closed":
+		return "resolved"
+	case "rejected", "invalid":
+		return "closed"
+	default:
+		return "in_progress"
+	}
+}
+
+// Check on a report (public)
+func (s *SecurityService) getAbuseReportStatus(c *gin.Context) {
+	if !s.limitAbuseIntake(c, "status", 60) {
+		return
+	}
+	report, ok := s.reportForToken(c)
+	if !ok {
+		return
+	}
+
+	var incident SecurityIncident
+	s.db.Select("id", "status", "updated_at").First(&incident, "id = ?", report.IncidentID)
+
+	var messages []AbuseReportMessage
+	s.db.Where("report_id = ? AND internal = ?", report.ID, false).Order("created_at ASC").Find(&messages)
+	var attachments []AbuseReportAttachment
+	s.db.Where("report_id = ?", report.ID).Order("created_at ASC").Find(&attachments)
+
+	c.JSON(http.StatusOK, gin.H{
+		"report_id":   report.ID,
+		"category":    report.Category,
+		"title":       report.Title,
+		"status":      reporterStatus(incident.Status),
+		"submitted":   report.CreatedAt,
+		"updated_at":  report.UpdatedAt,
+		"messages":    messages,
+		"attachments": attachments,
+	})
+}
+
+// Add a message to a report (public)
+func (s *SecurityService) addAbuseReportFollowUp(c *gin.Context) {
+	if !s.limitAbuseIntake(c, "message", 20) {
+		return
+	}
+	s.limitIntakeBody(c)
+	report, ok := s.reportForToken(c)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Message string `json:"message" form:"message" binding:"required,max=20000"`
+	}
+	if err := c.ShouldBind(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	files, err := s.readAttachments(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	message := &AbuseReportMessage{
+		ID:        uuid.New().String(),
+		ReportID:  report.ID,
+		Author:    AbuseReportAuthorReporter,
+		Body:      request.Message,
+		CreatedAt: time.Now().UTC(),
+	}
+	attachments, err := s.storeAttachments(c.Request.Context(), report.ID, message.ID, files)
+	if err != nil {
+		log.Printf("Failed to store attachments of abuse report %s: %v", report.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store attachments"})
+		return
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(message).Error; err != nil {
+			return err
+		}
+		if len(attachments) > 0 {
+			if err := tx.Create(&attachments).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(report).Update("updated_at", message.CreatedAt).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add message"})
+		return
+	}
+
+	s.appendIncidentTimeline(report.IncidentID, "external_report", "reporter",
+		"Reporter added a message", map[string]interface{}{"message_id": message.ID, "attachments": len(attachments)})
+
+	c.JSON(http.StatusCreated, gin.H{"message": message, "attachments": attachments})
+}
+
+// Staff handlers
+
+// abuseReportQuery limits reports to the caller's tenant through their incidents
+func (s *SecurityService) abuseReportQuery(c *gin.Context) *gorm.DB {
+	query := s.db.Model(&AbuseReport{})
+	if tenant := tenantOf(c); tenant != "" {
+		query = query.Where("incident_id IN (?)", s.db.Model(&SecurityIncident{}).Select("id").Where("tenant_id = ?", tenant))
+	}
+	return query
+}
+
+// List reports from the public intake
+func (s *SecurityService) listAbuseReports(c *gin.Context) {
+	query := s.abuseReportQuery(c)
+	if category := c.Query("category"); category != "" {
+		query = query.Where("category = ?", category)
+	}
+	if severity := c.Query("severity"); severity != "" {
+		query = query.Where("triage_level = ?", severity)
+	}
+
+	var reports []AbuseReport
+	if err := query.Order("created_at DESC").Limit(200).Find(&reports).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reports"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reports": reports, "total": len(reports)})
+}
+
+// Get a report with its messages and attachments
+func (s *SecurityService) getAbuseReport(c *gin.Context) {
+	var report AbuseReport
+	if err := s.abuseReportQuery(c).First(&report, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return
+	}
+
+	var messages []AbuseReportMessage
+	s.db.Where("report_id = ?", report.ID).Order("created_at ASC").Find(&messages)
+	var attachments []AbuseReportAttachment
+	s.db.Where("report_id = ?", report.ID).Order("created_at ASC").Find(&attachments)
+
+	c.JSON(http.StatusOK, gin.H{"report": report, "messages": messages, "attachments": attachments})
+}
+
+// Reply to a reporter, or leave an internal note
+func (s *SecurityService) replyToAbuseReport(c *gin.Context) {
+	var report AbuseReport
+	if err := s.abuseReportQuery(c).First(&report, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return
+	}
+
+	var request struct {
+		Message  string `json:"message" binding:"required"`
+		Internal bool   `json:"internal"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	message := &AbuseReportMessage{
+		ID:        uuid.New().String(),
+		ReportID:  report.ID,
+		Author:    AbuseReportAuthorTeam,
+		Body:      request.Message,
+		Internal:  request.Internal,
+		CreatedBy: c.GetHeader("X-User-ID"),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := s.db.Create(message).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add message"})
+		return
+	}
+	s.db.Model(&report).Update("updated_at", message.CreatedAt)
+
+	c.JSON(http.StatusCreated, message)
+}
+
+// Download an attachment of a report
+func (s *SecurityService) downloadAbuseReportAttachment(c *gin.Context) {
+	var report AbuseReport
+	if err := s.abuseReportQuery(c).First(&report, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report not found"})
+		return
+	}
+	var attachment AbuseReportAttachment
+	if err := s.db.First(&attachment, "id = ? AND report_id = ?", c.Param("attachment_id"), report.ID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return
+	}
+	if s.archive == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Attachment storage is not configured"})
+		return
+	}
+
+	object, err := s.archive.GetObject(c.Request.Context(), s.config.ArchiveS3Bucket, attachment.ObjectKey, minio.GetObjectOptions{})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch attachment"})
+		return
+	}
+	defer object.Close()
+
+	// Untrusted content: always a download, never rendered
+	c.DataFromReader(http.StatusOK, attachment.Size, "application/octet-stream", object, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=%q", attachment.FileName),
+		"X-Content-SHA256":    attachment.SHA256,
+	})
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"gorm.io/gorm"
+)
+
+// Tamper-evident audit trail. SecurityEvents form one hash chain per stream
+// (the tenant): each event stores its sequence number in the stream, the hash
+// of the previous event and its own hash over its content and that previous
+// hash. Editing, deleting or reordering an event breaks the chain from that
+// point on, which /v1/events/verify detects. Periodic anchors write each
+// stream's head to object storage, outside the reach of anyone who can
+// rewrite the database. Verification reads the anchors back from object
+// storage; the AuditAnchor rows only index them for listing.
+//
+// Chaining happens in a GORM create callback, inside the insert's
+// transaction, holding a per-stream advisory lock so concurrent writers
+// cannot fork the chain. Events written before chaining have ChainSeq 0 and
+// are not verified.
+
+const (
+	auditChainGenesis  = "0000000000000000000000000000000000000000000000000000000000000000"
+	maxVerifyEvents    = 100000
+	verifyBatchSize    = 5000
+	auditAnchorsPrefix = "audit-anchors"
+)
+
+// AuditAnchor records a stream head written to object storage
+type AuditAnchor struct {
+	ID         string    `json:"id" gorm:"primaryKey"`
+	Stream     string    `json:"stream" gorm:"index;not null"`
+	ChainSeq   int64     `json:"chain_seq"`
+	EventID    string    `json:"event_id"`
+	Hash       string    `json:"hash"`
+	ObjectKey  string    `json:"object_key"`
+	AnchoredAt time.Time `json:"anchored_at" gorm:"index"`
+}
+
+// chainContent is the part of an event covered by its hash. ProcessedAt and
+// CreatedAt are bookkeeping and may change after the fact.
+type chainContent struct {
+	ID        string                 `json:"id"`
+	Stream    string                 `json:"stream"`
+	Seq       int64                  `json:"seq"`
+	PrevHash  string                 `json:"prev_hash"`
+	Type      string                 `json:"type"`
+	Severity  string                 `json:"severity"`
+	UserID    string                 `json:"user_id"`
+	IPAddress string                 `json:"ip_address"`
+	UserAgent string                 `json:"user_agent"`
+	Resource  string                 `json:"resource"`
+	Action    string                 `json:"action"`
+	Result    string                 `json:"result"`
+	Details   map[string]interface{} `json:"details"`
+	Metadata  map[string]interface{} `json:"metadata"`
+	Timestamp string                 `json:"timestamp"`
+}
+
+// chainHash computes an event's hash from its content and PrevHash
+func chainHash(event *SecurityEvent) (string, error) {
+	// Map keys are sorted by encoding/json, so the encoding is canonical
+	payload, err := json.Marshal(chainContent{
+		ID:        event.ID,
+		Stream:    event.TenantID,
+		Seq:       event.ChainSeq,
+		PrevHash:  event.PrevHash,
+		Type:      event.Type,
+		Severity:  event.Severity,
+		UserID:    event.UserID,
+		IPAddress: event.IPAddress,
+		UserAgent: event.UserAgent,
+		Resource:  event.Resource,
+		Action:    event.Action,
+		Result:    event.Result,
+		Details:   event.Details,
+		Metadata:  event.Metadata,
+		Timestamp: event.Timestamp.UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// registerAuditChainCallback links every created SecurityEvent into its
+// stream's chain
+func (s *SecurityService) registerAuditChainCallback() error {
+	return s.db.Callback().Create().Before("gorm:create").Register("security:audit_chain", func(tx *gorm.DB) {
+		event, ok := tx.Statement.Dest.(*SecurityEvent)
+		if !ok || tx.Error != nil {
+			return
+		}
+		if err := linkSecurityEvent(tx.Session(&gorm.Session{NewDB: true}), event); err != nil {
+			tx.AddError(fmt.Errorf("audit chain: %w", err))
+		}
+	})
+}
+
+func linkSecurityEvent(tx *gorm.DB, event *SecurityEvent) error {
+	if event.TenantID == "" {
+		event.TenantID = "default"
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	// Postgres keeps microseconds; hash what will be read back
+	event.Timestamp = event.Timestamp.UTC().Truncate(time.Microsecond)
+
+	// Serialize writers of this stream until the insert commits
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", "security_events:"+event.TenantID).Error; err != nil {
+		return err
+	}
+
+	var head SecurityEvent
+	err := tx.Select("chain_seq", "hash").
+		Where("tenant_id = ? AND chain_seq > 0", event.TenantID).
+		Order("chain_seq DESC").Limit(1).Find(&head).Error
+	if err != nil {
+		return err
+	}
+
+	event.ChainSeq = head.ChainSeq + 1
+	event.PrevHash = head.Hash
+	if event.PrevHash == "" {
+		event.PrevHash = auditChainGenesis
+	}
+	event.Hash, err = chainHash(event)
+	return err
+}
+
+// chainBreak describes the first inconsistency found in a stream
+type chainBreak struct {
+	ChainSeq int64  `json:"chain_seq"`
+	EventID  string `json:"event_id,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// verifyChain checks the stream between two sequence numbers (inclusive; 0
+// for open ends). The first event's PrevHash is trusted unless its
+// predecessor is still in the database.
+func (s *SecurityService) verifyChain(stream string, fromSeq, toSeq int64) (int64, *chainBreak, error) {
+	query := s.db.Where("tenant_id = ? AND chain_seq > 0", stream)
+	if fromSeq > 1 {
+		var prev SecurityEvent
+		if err := s.db.Where("tenant_id = ? AND chain_seq = ?", stream, fromSeq-1).Limit(1).Find(&prev).Error; err != nil {
+			return 0, nil, err
+		}
+		if prev.ID != "" {
+			fromSeq--
+		}
+	}
+	if fromSeq > 0 {
+		query = query.Where("chain_seq >= ?", fromSeq)
+	}
+	if toSeq > 0 {
+		query = query.Where("chain_seq <= ?", toSeq)
+	}
+
+	var (
+		checked  int64
+		lastSeq  int64
+		lastHash string
+	)
+	for {
+		var events []SecurityEvent
+		if err := query.Session(&gorm.Session{}).Where("chain_seq > ?", lastSeq).
+			Order("chain_seq ASC").Limit(verifyBatchSize).Find(&events).Error; err != nil {
+			return checked, nil, err
+		}
+
+		for i := range events {
+			event := &events[i]
+			if lastSeq > 0 {
+				if event.ChainSeq != lastSeq+1 {
+					return checked, &chainBreak{ChainSeq: lastSeq + 1, Reason: "event missing from chain"}, nil
+				}
+				if event.PrevHash != lastHash {
+					return checked, &chainBreak{ChainSeq: event.ChainSeq, EventID: event.ID, Reason: "previous hash does not match preceding event"}, nil
+				}
+			}
+			hash, err := chainHash(event)
+			if err != nil {
+				return checked, nil, err
+			}
+			if hash != event.Hash {
+				return checked, &chainBreak{ChainSeq: event.ChainSeq, EventID: event.ID, Reason: "event content does not match its hash"}, nil
+			}
+
+			lastSeq, lastHash = event.ChainSeq, event.Hash
+			checked++
+			if checked >= maxVerifyEvents {
+				return checked, nil, nil
+			}
+		}
+
+		if len(events) < verifyBatchSize {
+			return checked, nil, nil
+		}
+	}
+}
+
+// Verify audit chain integrity for a stream over a range
+func (s *SecurityService) verifyEventChain(c *gin.Context) {
+	// Platform admins pick the stream to verify
+	stream := tenantOf(c)
+	if stream == "" {
+		stream = c.Query("tenant_id")
+	}
+	if stream == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tenant_id is required to select the stream"})
+		return
+	}
+
+	fromSeq, _ := strconv.ParseInt(c.Query("from_seq"), 10, 64)
+	toSeq, _ := strconv.ParseInt(c.Query("to_seq"), 10, 64)
+
+	// Time bounds translate to the sequence numbers they cover
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be RFC3339"})
+			return
+		}
+		var first SecurityEvent
+		s.db.Select("chain_seq").Where("tenant_id = ? AND chain_seq > 0 AND timestamp >= ?", stream, t).
+			Order("chain_seq ASC").Limit(1).Find(&first)
+		if first.ChainSeq > fromSeq {
+			fromSeq = first.ChainSeq
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "until must be RFC3339"})
+			return
+		}
+		var last SecurityEvent
+		s.db.Select("chain_seq").Where("tenant_id = ? AND chain_seq > 0 AND timestamp < ?", stream, t).
+			Order("chain_seq DESC").Limit(1).Find(&last)
+		if toSeq == 0 || last.ChainSeq < toSeq {
+			toSeq = last.ChainSeq
+			if toSeq == 0 {
+				toSeq = -1 // nothing before until
+			}
+		}
+	}
+
+	response := gin.H{
+		"stream":   stream,
+		"from_seq": fromSeq,
+		"to_seq":   toSeq,
+	}
+	if toSeq < 0 {
+		response["valid"] = true
+		response["events_checked"] = 0
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	checked, broken, err := s.verifyChain(stream, fromSeq, toSeq)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify audit chain"})
+		return
+	}
+	response["events_checked"] = checked
+	response["truncated"] = checked >= maxVerifyEvents
+
+	// Anchored heads in the range must still match
+	anchorsChecked := 0
+	if broken == nil && s.archive != nil {
+		anchors, err := s.storedAnchors(c.Request.Context(), stream, fromSeq, toSeq)
+		if err != nil {
+			log.Printf("Failed to read audit anchors for stream %s: %v", stream, err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to read audit anchors from object storage"})
+			return
+		}
+		for _, anchor := range anchors {
+			var event SecurityEvent
+			s.db.Select("id", "hash").Where("tenant_id = ? AND chain_seq = ?", stream, anchor.ChainSeq).Limit(1).Find(&event)
+			if event.ID == "" {
+				// Archived out of the hot store
+				continue
+			}
+			anchorsChecked++
+			if event.Hash != anchor.Hash {
+				broken = &chainBreak{ChainSeq: anchor.ChainSeq, EventID: event.ID, Reason: "event hash differs from anchored digest " + anchor.ObjectKey}
+				break
+			}
+		}
+	}
+	response["anchors_checked"] = anchorsChecked
+	response["anchors_available"] = s.archive != nil
+
+	response["valid"] = broken == nil
+	if broken != nil {
+		response["break"] = broken
+		log.Printf("⚠️ Audit chain for stream %s broken at seq %d: %s", stream, broken.ChainSeq, broken.Reason)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// storedAnchors reads a stream's anchors in a sequence range from object
+// storage
+func (s *SecurityService) storedAnchors(ctx context.Context, stream string, fromSeq, toSeq int64) ([]AuditAnchor, error) {
+	var anchors []AuditAnchor
+	prefix := fmt.Sprintf("%s/%s/", auditAnchorsPrefix, stream)
+	for object := range s.archive.ListObjects(ctx, s.config.ArchiveS3Bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		// Keys end in -<seq>.json
+		name := strings.TrimSuffix(path.Base(object.Key), ".json")
+		seq, err := strconv.ParseInt(name[strings.LastIndex(name, "-")+1:], 10, 64)
+		if err != nil || seq < fromSeq || (toSeq > 0 && seq > toSeq) {
+			continue
+		}
+
+		reader, err := s.archive.GetObject(ctx, s.config.ArchiveS3Bucket, object.Key, minio.GetObjectOptions{})
+		if err != nil {
+			return nil, err
+		}
+		var anchor AuditAnchor
+		err = json.NewDecoder(io.LimitReader(reader, 64<<10)).Decode(&anchor)
+		reader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("anchor %s is unreadable: %w", object.Key, err)
+		}
+		if anchor.Stream != stream || anchor.ChainSeq != seq {
+			return nil, fmt.Errorf("anchor %s does not match its key", object.Key)
+		}
+		anchor.ObjectKey = object.Key
+		anchors = append(anchors, anchor)
+	}
+	sort.Slice(anchors, func(i, j int) bool { return anchors[i].ChainSeq < anchors[j].ChainSeq })
+	return anchors, nil
+}
+
+// anchorAuditChains writes the current head of every stream to object storage
+func (s *SecurityService) anchorAuditChains() error {
+	var heads []SecurityEvent
+	if err := s.db.Raw(`SELECT DISTINCT ON (tenant_id) id, tenant_id, chain_seq, hash
+		FROM security_events WHERE chain_seq > 0
+		ORDER BY tenant_id, chain_seq DESC`).Scan(&heads).Error; err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	for _, head := range heads {
+		var last AuditAnchor
+		s.db.Where("stream = ?", head.TenantID).Order("chain_seq DESC").Limit(1).Find(&last)
+		if last.ChainSeq == head.ChainSeq {
+			continue
+		}
+
+		now := time.Now().UTC()
+		anchor := &AuditAnchor{
+			ID:         uuid.New().String(),
+			Stream:     head.TenantID,
+			ChainSeq:   head.ChainSeq,
+			EventID:    head.ID,
+			Hash:       head.Hash,
+			AnchoredAt: now,
+		}
+		anchor.ObjectKey = fmt.Sprintf("%s/%s/%s-%d.json", auditAnchorsPrefix, head.TenantID, now.Format("20060102T150405Z"), head.ChainSeq)
+
+		payload, err := json.Marshal(anchor)
+		if err != nil {
+			return err
+		}
+		if _, err := s.archive.PutObject(ctx, s.config.ArchiveS3Bucket, anchor.ObjectKey,
+			bytes.NewReader(payload), int64(len(payload)), minio.PutObjectOptions{
+				ContentType: "application/json",
+			}); err != nil {
+			return fmt.Errorf("failed to upload anchor for stream %s: %w", head.TenantID, err)
+		}
+		if err := s.db.Create(anchor).Error; err != nil {
+			return fmt.Errorf("failed to record anchor for stream %s: %w", head.TenantID, err)
+		}
+	}
+	return nil
+}
+
+func (s *SecurityService) startAuditAnchorWorker() {
+	if s.archive == nil || s.config.AuditAnchorInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.config.AuditAnchorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.anchorAuditChains(); err != nil {
+				log.Printf("Audit chain anchoring failed: %v", err)
+			}
+		}
+	}
+}
+
+// List anchors of the caller's stream
+func (s *SecurityService) listAuditAnchors(c *gin.Context) {
+	query := s.db.Model(&AuditAnchor{})
+	if stream := tenantOf(c); stream != "" {
+		query = query.Where("stream = ?", stream)
+	}
+
+	var anchors []AuditAnchor
+	if err := applyListFilters(c, query, "stream").Order("anchored_at DESC").Find(&anchors).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list audit anchors"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"anchors": anchors,
+		"total":   len(anchors),
+	})
+}
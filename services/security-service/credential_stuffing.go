@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// Brute-force and credential-stuffing detection across the platform. The
+// API gateway publishes every request it rejects for bad credentials on the
+// AUTH_FAILURE_CHANNEL Redis channel, and failed logins reported to
+// /v1/auth/attempts are counted alongside them. Failures are aggregated in
+// one-minute buckets in Redis: a total, HyperLogLogs of distinct source IPs
+// and distinct identities (the account, or a fingerprint of the credential
+// presented), and per-IP and per-path counts.
+//
+// Every evaluation the last CREDENTIAL_STUFFING_WINDOW minutes are checked
+// for two patterns:
+//
+//   - brute force from one address: a single IP with at least
+//     BRUTE_FORCE_IP_THRESHOLD failures
+//   - credential stuffing: many failures against many identities from many
+//     IPs, each IP staying under CREDENTIAL_STUFFING_MAX_PER_IP failures on
+//     average so per-IP limits never trip
+//
+// Each raises a ThreatDetection and pushes the recommended gateway response
+// (IP blocks, tighter rate limits on the targeted paths) to notification
+// channels subscribed to the "response" kind.
+
+const (
+	ThreatTypeCredentialStuffing = "credential_stuffing"
+
+	NotificationKindResponse = "response"
+
+	authFailureBucket       = time.Minute
+	authFailureEvalInterval = 30 * time.Second
+	stuffingMaxBlockedIPs   = 50
+	stuffingTopPaths        = 5
+	stuffingSuggestedRPM    = 5
+)
+
+// Recommended response actions
+const (
+	ResponseActionBlockIP          = "block_ip"
+	ResponseActionTightenRateLimit = "tighten_rate_limit"
+)
+
+// authFailure is one rejected authentication, as published by the gateway
+type authFailure struct {
+	Source     string    `json:"source"`
+	IPAddress  string    `json:"ip_address"`
+	UserID     string    `json:"user_id,omitempty"`
+	Credential string    `json:"credential,omitempty"` // fingerprint of the presented key or token
+	Method     string    `json:"method,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Honeytoken string    `json:"honeytoken,omitempty"` // ID of the decoy credential presented
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// identity is what the failure tried to authenticate as
+func (f *authFailure) identity() string {
+	if f.UserID != "" {
+		return "user:" + f.UserID
+	}
+	if f.Credential != "" {
+		return "credential:" + f.Credential
+	}
+	return ""
+}
+
+// responseAction is a gateway change recommended in answer to an attack
+type responseAction struct {
+	Type            string `json:"type"`
+	IPAddress       string `json:"ip_address,omitempty"`
+	DurationMinutes int    `json:"duration_minutes,omitempty"`
+	RoutePrefix     string `json:"route_prefix,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+	Limit           int    `json:"limit,omitempty"`
+	WindowSeconds   int    `json:"window_seconds,omitempty"`
+	Reason          string `json:"reason"`
+}
+
+type authFailureKeys struct {
+	total, ips, identities, byIP, byPath string
+}
+
+func authFailureBucketKeys(bucket int64) authFailureKeys {
+	base := fmt.Sprintf("auth_failures:%d", bucket)
+	return authFailureKeys{
+		total:      base + ":total",
+		ips:        base + ":ips",
+		identities: base + ":identities",
+		byIP:       base + ":by_ip",
+		byPath:     base + ":by_path",
+	}
+}
+
+// recordAuthFailure counts a failure in the current bucket
+func (s *SecurityService) recordAuthFailure(ctx context.Context, failure *authFailure) error {
+	if failure.Timestamp.IsZero() {
+		failure.Timestamp = time.Now().UTC()
+	}
+	keys := authFailureBucketKeys(failure.Timestamp.Unix() / int64(authFailureBucket.Seconds()))
+	ttl := s.config.StuffingWindow + 2*authFailureBucket
+
+	pipe := s.redis.TxPipeline()
+	pipe.Incr(ctx, keys.total)
+	pipe.Expire(ctx, keys.total, ttl)
+	if failure.IPAddress != "" {
+		pipe.PFAdd(ctx, keys.ips, failure.IPAddress)
+		pipe.Expire(ctx, keys.ips, ttl)
+		pipe.ZIncrBy(ctx, keys.byIP, 1, failure.IPAddress)
+		pipe.Expire(ctx, keys.byIP, ttl)
+	}
+	if identity := failure.identity(); identity != "" {
+		pipe.PFAdd(ctx, keys.identities, identity)
+		pipe.Expire(ctx, keys.identities, ttl)
+	}
+	if failure.Path != "" {
+		pipe.ZIncrBy(ctx, keys.byPath, 1, failure.Path)
+		pipe.Expire(ctx, keys.byPath, ttl)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// authFailureWindow is the aggregate of the buckets in the detection window
+type authFailureWindow struct {
+	Failures   int64     `json:"failures"`
+	IPs        int64     `json:"distinct_ips"`
+	Identities int64     `json:"distinct_identities"`
+	PerIP      float64   `json:"failures_per_ip"`
+	TopIPs     []redis.Z `json:"-"`
+	TopPaths   []redis.Z `json:"-"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+}
+
+func (s *SecurityService) loadAuthFailureWindow(ctx context.Context, now time.Time) (*authFailureWindow, error) {
+	size := int64(authFailureBucket.Seconds())
+	current := now.Unix() / size
+	buckets := int64(s.config.StuffingWindow / authFailureBucket)
+	if buckets < 1 {
+		buckets = 1
+	}
+
+	var totals, ips, identities, byIP, byPath []string
+	for bucket := current - buckets + 1; bucket <= current; bucket++ {
+		keys := authFailureBucketKeys(bucket)
+		totals = append(totals, keys.total)
+		ips = append(ips, keys.ips)
+		identities = append(identities, keys.identities)
+		byIP = append(byIP, keys.byIP)
+		byPath = append(byPath, keys.byPath)
+	}
+
+	window := &authFailureWindow{
+		From: time.Unix((current-buckets+1)*size, 0).UTC(),
+		To:   now.UTC(),
+	}
+	values, err := s.redis.MGet(ctx, totals...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range values {
+		if text, ok := value.(string); ok {
+			n, _ := strconv.ParseInt(text, 10, 64)
+			window.Failures += n
+		}
+	}
+	if window.Failures == 0 {
+		return window, nil
+	}
+
+	if window.IPs, err = s.redis.PFCount(ctx, ips...).Result(); err != nil {
+		return nil, err
+	}
+	if window.Identities, err = s.redis.PFCount(ctx, identities...).Result(); err != nil {
+		return nil, err
+	}
+	if window.TopIPs, err = s.redis.ZUnionWithScores(ctx, redis.ZStore{Keys: byIP}).Result(); err != nil {
+		return nil, err
+	}
+	if window.TopPaths, err = s.redis.ZUnionWithScores(ctx, redis.ZStore{Keys: byPath}).Result(); err != nil {
+		return nil, err
+	}
+	sortByScore(window.TopIPs)
+	sortByScore(window.TopPaths)
+	if window.IPs > 0 {
+		window.PerIP = float64(window.Failures) / float64(window.IPs)
+	}
+	return window, nil
+}
+
+func sortByScore(members []redis.Z) {
+	sort.SliceStable(members, func(i, j int) bool { return members[i].Score > members[j].Score })
+}
+
+// evaluateAuthFailures checks the detection window for both attack patterns
+func (s *SecurityService) evaluateAuthFailures() {
+	ctx := context.Background()
+	window, err := s.loadAuthFailureWindow(ctx, time.Now())
+	if err != nil {
+		log.Printf("Credential stuffing detection: failed to load window: %v", err)
+		return
+	}
+	if window.Failures == 0 {
+		return
+	}
+
+	// Brute force from one address
+	for _, member := range window.TopIPs {
+		if int(member.Score) < s.config.BruteForceIPThreshold {
+			break
+		}
+		ip, _ := member.Member.(string)
+		if s.claimAuthFailureAlert(ctx, "ip:"+ip) {
+			s.raiseIPBruteForce(ip, int(member.Score), window)
+		}
+	}
+
+	// Distributed credential stuffing
+	if window.Failures >= int64(s.config.StuffingMinFailures) &&
+		window.Identities >= int64(s.config.StuffingMinIdentities) &&
+		window.IPs >= int64(s.config.StuffingMinIPs) &&
+		window.PerIP <= float64(s.config.StuffingMaxPerIP) &&
+		s.claimAuthFailureAlert(ctx, "stuffing") {
+		s.raiseCredentialStuffing(window)
+	}
+}
+
+// claimAuthFailureAlert makes sure an attack is reported once per window,
+// across replicas
+func (s *SecurityService) claimAuthFailureAlert(ctx context.Context, subject string) bool {
+	claimed, err := s.redis.SetNX(ctx, "auth_failures:alerted:"+subject, time.Now().UTC().Unix(), s.config.StuffingWindow).Result()
+	return err == nil && claimed
+}
+
+func (s *SecurityService) raiseIPBruteForce(ip string, failures int, window *authFailureWindow) {
+	actions := []responseAction{{
+		Type:            ResponseActionBlockIP,
+		IPAddress:       ip,
+		DurationMinutes: int(defaultBlockDuration.Minutes()),
+		Reason:          fmt.Sprintf("%d failed authentications in %s", failures, s.config.StuffingWindow),
+	}}
+	threat := &ThreatDetection{
+		ID:          uuid.New().String(),
+		TenantID:    s.config.DefaultTenant,
+		Type:        ThreatTypeBruteForce,
+		ThreatLevel: ThreatLevelHigh,
+		Source:      ip,
+		Target:      "gateway",
+		Description: fmt.Sprintf("%d failed authentications from %s within %s", failures, ip, s.config.StuffingWindow),
+		Indicators:  []string{ip},
+		Evidence: map[string]interface{}{
+			"failures":       failures,
+			"window_minutes": int(s.config.StuffingWindow.Minutes()),
+			"window_from":    window.From.Format(time.RFC3339),
+			"recommended":    actions,
+		},
+		Status: "open",
+	}
+	s.raiseAuthThreat(threat, actions)
+}
+
+func (s *SecurityService) raiseCredentialStuffing(window *authFailureWindow) {
+	threatLevel := ThreatLevelHigh
+	if window.Failures >= int64(10*s.config.StuffingMinFailures) {
+		threatLevel = ThreatLevelCritical
+	}
+
+	// Block the addresses doing more than their share of the attack
+	var actions []responseAction
+	var indicators []string
+	topIPs := []gin.H{}
+	for _, member := range window.TopIPs {
+		if len(indicators) >= stuffingMaxBlockedIPs || member.Score < window.PerIP {
+			break
+		}
+		ip, _ := member.Member.(string)
+		indicators = append(indicators, ip)
+		topIPs = append(topIPs, gin.H{"ip_address": ip, "failures": int(member.Score)})
+		actions = append(actions, responseAction{
+			Type:            ResponseActionBlockIP,
+			IPAddress:       ip,
+			DurationMinutes: int(defaultBlockDuration.Minutes()),
+			Reason:          fmt.Sprintf("%d failed authentications during credential stuffing", int(member.Score)),
+		})
+	}
+
+	// Tighten per-IP limits on the paths under attack
+	topPaths := []gin.H{}
+	for i, member := range window.TopPaths {
+		if i >= stuffingTopPaths {
+			break
+		}
+		path, _ := member.Member.(string)
+		topPaths = append(topPaths, gin.H{"path": path, "failures": int(member.Score)})
+		actions = append(actions, responseAction{
+			Type:          ResponseActionTightenRateLimit,
+			RoutePrefix:   path,
+			Scope:         RateLimitScopeIP,
+			Limit:         stuffingSuggestedRPM,
+			WindowSeconds: 60,
+			Reason:        fmt.Sprintf("%d failed authentications on %s", int(member.Score), path),
+		})
+	}
+
+	threat := &ThreatDetection{
+		ID:          uuid.New().String(),
+		TenantID:    s.config.DefaultTenant,
+		Type:        ThreatTypeCredentialStuffing,
+		ThreatLevel: threatLevel,
+		Source:      fmt.Sprintf("%d addresses", window.IPs),
+		Target:      "gateway",
+		Description: fmt.Sprintf("Credential stuffing: %d failed authentications against %d identities from %d addresses within %s",
+			window.Failures, window.Identities, window.IPs, s.config.StuffingWindow),
+		Indicators: indicators,
+		Evidence: map[string]interface{}{
+			"failures":            window.Failures,
+			"distinct_ips":        window.IPs,
+			"distinct_identities": window.Identities,
+			"failures_per_ip":     window.PerIP,
+			"window_minutes":      int(s.config.StuffingWindow.Minutes()),
+			"window_from":         window.From.Format(time.RFC3339),
+			"top_ips":             topIPs,
+			"top_paths":           topPaths,
+			"recommended":         actions,
+		},
+		Status: "open",
+	}
+	s.raiseAuthThreat(threat, actions)
+}
+
+// raiseAuthThreat stores a detection and pushes its recommended response
+func (s *SecurityService) raiseAuthThreat(threat *ThreatDetection, actions []responseAction) {
+	now := time.Now().UTC()
+	threat.CreatedAt = now
+	threat.UpdatedAt = now
+	if err := s.db.Create(threat).Error; err != nil {
+		log.Printf("Failed to record %s threat: %v", threat.Type, err)
+		return
+	}
+	threatsDetected.WithLabelValues(threat.Type, threat.ThreatLevel).Inc()
+	log.Printf("🚨 %s", threat.Description)
+
+	go s.notifyThreatDetection(threat)
+	if len(actions) > 0 {
+		go s.dispatchNotification(&SecurityNotification{
+			TenantID:    threat.TenantID,
+			Kind:        NotificationKindResponse,
+			ID:          threat.ID,
+			Title:       fmt.Sprintf("Recommended gateway response to %s", threat.Type),
+			Description: threat.Description,
+			Severity:    threat.ThreatLevel,
+			Category:    threat.Type,
+			Timestamp:   now,
+			Details: map[string]interface{}{
+				"threat_id": threat.ID,
+				"actions":   actions,
+			},
+		})
+	}
+}
+
+// Consume the gateway's auth failures and evaluate the window periodically
+func (s *SecurityService) startCredentialStuffingDetector() {
+	if !s.config.ThreatDetectionEnabled || s.config.AuthFailureChannel == "" {
+		return
+	}
+
+	ctx := context.Background()
+	pubsub := s.redis.Subscribe(ctx, s.config.AuthFailureChannel)
+	defer pubsub.Close()
+
+	ticker := time.NewTicker(authFailureEvalInterval)
+	defer ticker.Stop()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			var failure authFailure
+			if err := json.Unmarshal([]byte(message.Payload), &failure); err != nil {
+				log.Printf("Ignoring malformed auth failure event: %v", err)
+				continue
+			}
+			if failure.Source == "" {
+				failure.Source = "gateway"
+			}
+			if failure.Honeytoken != "" {
+				s.recordGatewayHoneytoken(&failure)
+			}
+			if err := s.recordAuthFailure(ctx, &failure); err != nil {
+				log.Printf("Failed to record auth failure: %v", err)
+			}
+		case <-ticker.C:
+			s.evaluateAuthFailures()
+		}
+	}
+}
+
+// Current auth failure window, as the detectors see it
+func (s *SecurityService) getAuthFailureSummary(c *gin.Context) {
+	window, err := s.loadAuthFailureWindow(c.Request.Context(), time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load auth failures"})
+		return
+	}
+
+	topIPs := []gin.H{}
+	for i, member := range window.TopIPs {
+		if i >= 20 {
+			break
+		}
+		topIPs = append(topIPs, gin.H{"ip_address": member.Member, "failures": int(member.Score)})
+	}
+	topPaths := []gin.H{}
+	for i, member := range window.TopPaths {
+		if i >= 20 {
+			break
+		}
+		topPaths = append(topPaths, gin.H{"path": member.Member, "failures": int(member.Score)})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"window":    window,
+		"top_ips":   topIPs,
+		"top_paths": topPaths,
+		"thresholds": gin.H{
+			"brute_force_ip_failures": s.config.BruteForceIPThreshold,
+			"stuffing_min_failures":   s.config.StuffingMinFailures,
+			"stuffing_min_identities": s.config.StuffingMinIdentities,
+			"stuffing_min_ips":        s.config.StuffingMinIPs,
+			"stuffing_max_per_ip":     s.config.StuffingMaxPerIP,
+		},
+	})
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+)
+
+// Honeytokens are decoy credentials (fake API keys, database logins, canary
+// URLs) that no legitimate caller ever uses. Only SHA-256 hashes of their
+// secret parts are stored. Active hashes are mirrored into the Redis hash
+// honeytokenIndexKey (hash -> honeytoken ID) so the gateway and other
+// services can check presented credentials with a single HGET. The gateway
+// reports hits with its auth failures; other platform services, holding the
+// issuer key, post them to /v1/honeytokens/check. Every use raises a
+// critical ThreatDetection carrying the full request context.
+
+const (
+	EventTypeHoneytokenTriggered  = "honeytoken_triggered"
+	ThreatTypeHoneytokenTriggered = "honeytoken_triggered"
+
+	HoneytokenTypeAPIKey       = "api_key"
+	HoneytokenTypeDBCredential = "db_credential"
+	HoneytokenTypeCanaryURL    = "canary_url"
+
+	honeytokenIndexKey = "honeytokens:index"
+)
+
+type Honeytoken struct {
+	ID              string     `json:"id" gorm:"primaryKey"`
+	TenantID        string     `json:"tenant_id" gorm:"index;not null;default:'default'"`
+	Name            string     `json:"name" gorm:"not null"`
+	Type            string     `json:"type" gorm:"index;not null"`
+	Description     string     `json:"description"`
+	Location        string     `json:"location"` // where the decoy was planted
+	Fingerprint     string     `json:"fingerprint"`
+	Hashes          []string   `json:"-" gorm:"type:text[]"`
+	IsActive        bool       `json:"is_active" gorm:"default:true"`
+	TriggerCount    int        `json:"trigger_count"`
+	LastTriggeredAt *time.Time `json:"last_triggered_at"`
+	CreatedBy       string     `json:"created_by"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+var honeytokenTriggers = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "honeytoken_triggers_total",
+		Help: "Honeytoken uses by token type and reporting source",
+	},
+	[]string{"type", "source"},
+)
+
+func init() {
+	prometheus.MustRegister(honeytokenTriggers)
+}
+
+func honeytokenHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// maskSecret keeps enough of a value to recognise it in logs
+func maskSecret(value string) string {
+	if len(value) <= 12 {
+		return strings.Repeat("*", len(value))
+	}
+	return value[:8] + "..." + value[len(value)-4:]
+}
+
+// generateHoneytoken fills in the decoy material for token and returns the
+// secret parts, which are shown to the caller once and never stored
+func (s *SecurityService) generateHoneytoken(token *Honeytoken, database string) (gin.H, error) {
+	switch token.Type {
+	case HoneytokenTypeAPIKey:
+		random, err := randomHex(20)
+		if err != nil {
+			return nil, err
+		}
+		key := s.config.HoneytokenAPIKeyPrefix + random
+		token.Fingerprint = maskSecret(key)
+		token.Hashes = []string{honeytokenHash(key)}
+		return gin.H{"api_key": key}, nil
+
+	case HoneytokenTypeDBCredential:
+		suffix, err := randomHex(4)
+		if err != nil {
+			return nil, err
+		}
+		password, err := randomHex(16)
+		if err != nil {
+			return nil, err
+		}
+		username := "svc_" + suffix
+		if database == "" {
+			database = "app"
+		}
+		token.Fingerprint = username
+		// Database proxies usually see the username before any password
+		token.Hashes = []string{honeytokenHash(username), honeytokenHash(password)}
+		return gin.H{
+			"username":          username,
+			"password":          password,
+			"host":              s.config.HoneytokenDBHost,
+			"database":          database,
+			"connection_string": fmt.Sprintf("postgres://%s:%s@%s/%s", username, password, s.config.HoneytokenDBHost, database),
+		}, nil
+
+	case HoneytokenTypeCanaryURL:
+		canary, err := randomHex(16)
+		if err != nil {
+			return nil, err
+		}
+		url := strings.TrimRight(s.config.HoneytokenCanaryBaseURL, "/") + "/canary/" + canary
+		token.Fingerprint = maskSecret(canary)
+		token.Hashes = []string{honeytokenHash(canary)}
+		return gin.H{"url": url}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported honeytoken type %q", token.Type)
+}
+
+// indexHoneytoken publishes or withdraws a token's hashes in Redis
+func (s *SecurityService) indexHoneytoken(ctx context.Context, token *Honeytoken) error {
+	if len(token.Hashes) == 0 {
+		return nil
+	}
+	if !token.IsActive {
+		return s.redis.HDel(ctx, honeytokenIndexKey, token.Hashes...).Err()
+	}
+	values := make(map[string]interface{}, len(token.Hashes))
+	for _, hash := range token.Hashes {
+		values[hash] = token.ID
+	}
+	return s.redis.HSet(ctx, honeytokenIndexKey, values).Err()
+}
+
+// syncHoneytokenIndex rebuilds the Redis index from the database
+func (s *SecurityService) syncHoneytokenIndex() error {
+	ctx := context.Background()
+
+	var tokens []Honeytoken
+	if err := s.db.Where("is_active = ?", true).Find(&tokens).Error; err != nil {
+		return err
+	}
+	if err := s.redis.Del(ctx, honeytokenIndexKey).Err(); err != nil {
+		return err
+	}
+	for i := range tokens {
+		if err := s.indexHoneytoken(ctx, &tokens[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupHoneytoken returns the active honeytoken a presented value belongs
+// to, or nil
+func (s *SecurityService) lookupHoneytoken(ctx context.Context, value string) *Honeytoken {
+	if value == "" {
+		return nil
+	}
+	id, err := s.redis.HGet(ctx, honeytokenIndexKey, honeytokenHash(value)).Result()
+	if err != nil {
+		return nil
+	}
+	var token Honeytoken
+	if err := s.db.First(&token, "id = ? AND is_active = ?", id, true).Error; err != nil {
+		return nil
+	}
+	return &token
+}
+
+// requestContext captures everything known about the request that used a
+// honeytoken
+func requestContext(c *gin.Context) map[string]interface{} {
+	headers := make(map[string]interface{}, len(c.Request.Header))
+	for name, values := range c.Request.Header {
+		headers[name] = strings.Join(values, ", ")
+	}
+	return map[string]interface{}{
+		"method":      c.Request.Method,
+		"host":        c.Request.Host,
+		"path":        c.Request.URL.Path,
+		"query":       c.Request.URL.RawQuery,
+		"client_ip":   c.ClientIP(),
+		"remote_addr": c.Request.RemoteAddr,
+		"user_agent":  c.Request.UserAgent(),
+		"referer":     c.Request.Referer(),
+		"proto":       c.Request.Proto,
+		"headers":     headers,
+	}
+}
+
+// triggerHoneytoken records a honeytoken use as a critical threat
+func (s *SecurityService) triggerHoneytoken(token *Honeytoken, source, ipAddress, userAgent string, request map[string]interface{}) (*ThreatDetection, error) {
+	now := time.Now().UTC()
+
+	s.db.Model(&Honeytoken{}).Where("id = ?", token.ID).Updates(map[string]interface{}{
+		"trigger_count":     gorm.Expr("trigger_count + 1"),
+		"last_triggered_at": now,
+	})
+	honeytokenTriggers.WithLabelValues(token.Type, source).Inc()
+
+	event := &SecurityEvent{
+		ID:        uuid.New().String(),
+		TenantID:  token.TenantID,
+		Type:      EventTypeHoneytokenTriggered,
+		Severity:  ThreatLevelCritical,
+		IPAddress: ipAddress,
+		UserAgent: userAgent,
+		Resource:  "honeytoken:" + token.ID,
+		Action:    "use",
+		Result:    "detected",
+		Details: map[string]interface{}{
+			"honeytoken_id":   token.ID,
+			"honeytoken_type": token.Type,
+			"source":          source,
+		},
+		Timestamp: now,
+		CreatedAt: now,
+	}
+	if err := s.db.Create(event).Error; err != nil {
+		log.Printf("Failed to record honeytoken event for %s: %v", token.ID, err)
+	} else {
+		securityEventsTotal.WithLabelValues(event.Type, event.Severity).Inc()
+	}
+
+	indicators := []string{}
+	if ipAddress != "" {
+		indicators = append(indicators, ipAddress)
+	}
+
+	threat := &ThreatDetection{
+		ID:          uuid.New().String(),
+		TenantID:    token.TenantID,
+		Type:        ThreatTypeHoneytokenTriggered,
+		ThreatLevel: ThreatLevelCritical,
+		Source:      ipAddress,
+		Target:      token.Name,
+		Description: fmt.Sprintf("Honeytoken %q (%s) was used via %s", token.Name, token.Type, source),
+		Indicators:  indicators,
+		Evidence: map[string]interface{}{
+			"security_event_id": event.ID,
+			"honeytoken_id":     token.ID,
+			"honeytoken_type":   token.Type,
+			"fingerprint":       token.Fingerprint,
+			"location":          token.Location,
+			"reported_by":       source,
+			"request":           request,
+		},
+		Status:    "open",
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.db.Create(threat).Error; err != nil {
+		return nil, err
+	}
+	threatsDetected.WithLabelValues(threat.Type, threat.ThreatLevel).Inc()
+
+	// Notify now rather than on the dispatcher's next pass
+	go s.notifyThreatDetection(threat)
+
+	log.Printf("🍯 Honeytoken %s (%s) triggered from %s via %s", token.ID, token.Type, ipAddress, source)
+	return threat, nil
+}
+
+// honeytokenMiddleware catches decoy credentials presented to this service
+func (s *SecurityService) honeytokenMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		candidates := []string{bearerToken(c), c.GetHeader("X-API-Key")}
+		if _, password, ok := c.Request.BasicAuth(); ok {
+			candidates = append(candidates, password)
+		}
+
+		for _, candidate := range candidates {
+			if token := s.lookupHoneytoken(c.Request.Context(), candidate); token != nil {
+				s.triggerHoneytoken(token, "security-service", c.ClientIP(), c.Request.UserAgent(), requestContext(c))
+				// Indistinguishable from any other bad credential
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// recordGatewayHoneytoken raises the alert for a honeytoken the gateway
+// rejected, as published with its auth failure
+func (s *SecurityService) recordGatewayHoneytoken(failure *authFailure) {
+	var token Honeytoken
+	if err := s.db.First(&token, "id = ? AND is_active = ?", failure.Honeytoken, true).Error; err != nil {
+		log.Printf("Gateway reported unknown honeytoken %s: %v", failure.Honeytoken, err)
+		return
+	}
+	request := map[string]interface{}{
+		"method":      failure.Method,
+		"path":        failure.Path,
+		"client_ip":   failure.IPAddress,
+		"user_agent":  failure.UserAgent,
+		"reason":      failure.Reason,
+		"observed_at": failure.Timestamp,
+	}
+	if _, err := s.triggerHoneytoken(&token, failure.Source, failure.IPAddress, failure.UserAgent, request); err != nil {
+		log.Printf("Failed to record honeytoken %s reported by %s: %v", token.ID, failure.Source, err)
+	}
+}
+
+// Canary URL hit. Always answers like a missing page.
+func (s *SecurityService) handleCanary(c *gin.Context) {
+	if token := s.lookupHoneytoken(c.Request.Context(), c.Param("token")); token != nil && token.Type == HoneytokenTypeCanaryURL {
+		s.triggerHoneytoken(token, "canary_url", c.ClientIP(), c.Request.UserAgent(), requestContext(c))
+	}
+	c.Status(http.StatusNotFound)
+}
+
+// Create a honeytoken
+func (s *SecurityService) createHoneytoken(c *gin.Context) {
+	var request struct {
+		Name        string `json:"name" binding:"required"`
+		Type        string `json:"type" binding:"required,oneof=api_key db_credential canary_url"`
+		Description string `json:"description"`
+		Location    string `json:"location"`
+		Database    string `json:"database"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now().UTC()
+	token := &Honeytoken{
+		ID:          uuid.New().String(),
+		TenantID:    s.writeTenant(c),
+		Name:        request.Name,
+		Type:        request.Type,
+		Description: request.Description,
+		Location:    request.Location,
+		IsActive:    true,
+		CreatedBy:   c.GetHeader("X-User-ID"),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	secret, err := s.generateHoneytoken(token, request.Database)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate honeytoken"})
+		return
+	}
+	if err := s.db.Create(token).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create honeytoken"})
+		return
+	}
+	if err := s.indexHoneytoken(c.Request.Context(), token); err != nil {
+		log.Printf("Failed to index honeytoken %s: %v", token.ID, err)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"honeytoken": token,
+		"secret":     secret,
+	})
+}
+
+// List honeytokens
+func (s *SecurityService) listHoneytokens(c *gin.Context) {
+	query := s.scoped(c).Model(&Honeytoken{})
+	if active := c.Query("is_active"); active != "" {
+		query = query.Where("is_active = ?", active == "true")
+	}
+	if c.Query("triggered") == "true" {
+		query = query.Where("trigger_count > 0")
+	}
+	query = applyListFilters(c, query, "type")
+
+	var tokens []Honeytoken
+	if err := query.Order("created_at DESC").Find(&tokens).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list honeytokens"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"honeytokens": tokens,
+		"total":       len(tokens),
+	})
+}
+
+// Get a honeytoken
+func (s *SecurityService) getHoneytoken(c *gin.Context) {
+	var token Honeytoken
+	if err := s.scoped(c).First(&token, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Honeytoken not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, token)
+}
+
+// Retire a honeytoken; its uses are no longer tracked
+func (s *SecurityService) deactivateHoneytoken(c *gin.Context) {
+	var token Honeytoken
+	if err := s.scoped(c).First(&token, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Honeytoken not found"})
+		return
+	}
+
+	token.IsActive = false
+	token.UpdatedAt = time.Now().UTC()
+	if err := s.db.Save(&token).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deactivate honeytoken"})
+		return
+	}
+	if err := s.indexHoneytoken(c.Request.Context(), &token); err != nil {
+		log.Printf("Failed to unindex honeytoken %s: %v", token.ID, err)
+	}
+
+	c.JSON(http.StatusOK, token)
+}
+
+// Threats raised by a honeytoken
+func (s *SecurityService) listHoneytokenTriggers(c *gin.Context) {
+	var token Honeytoken
+	if err := s.scoped(c).First(&token, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Honeytoken not found"})
+		return
+	}
+
+	var threats []ThreatDetection
+	query := s.db.Where("type = ? AND evidence->>'honeytoken_id' = ?", ThreatTypeHoneytokenTriggered, token.ID)
+	if err := applyListFilters(c, query).Order("created_at DESC").Find(&threats).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list honeytoken triggers"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"honeytoken": token,
+		"triggers":   threats,
+		"total":      len(threats),
+	})
+}
+
+// Check a credential seen by another service. Callers pass along the context
+// of the request that presented it.
+func (s *SecurityService) checkHoneytoken(c *gin.Context) {
+	// Only platform services may ask, or a stolen credential could be tested
+	// for being a decoy
+	if !platformCaller(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Honeytoken checks are reserved for platform services"})
+		return
+	}
+
+	var request struct {
+		Value     string                 `json:"value" binding:"required"`
+		Service   string                 `json:"service" binding:"required"`
+		IPAddress string                 `json:"ip_address"`
+		UserAgent string                 `json:"user_agent"`
+		Request   map[string]interface{} `json:"request"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token := s.lookupHoneytoken(c.Request.Context(), request.Value)
+	if token == nil {
+		c.JSON(http.StatusOK, gin.H{"honeytoken": false})
+		return
+	}
+
+	details := request.Request
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	details["reporter_ip"] = c.ClientIP()
+
+	threat, err := s.triggerHoneytoken(token, request.Service, request.IPAddress, request.UserAgent, details)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record honeytoken use"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"honeytoken": true,
+		"threat_id":  threat.ID,
+	})
+}
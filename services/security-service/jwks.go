@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// JWT signing keys. Tokens are signed with the single active RS256/ES256 key
+// and carry its kid. On rotation the previous key stays valid for
+// verification for JWTKeyOverlap so tokens it signed don't fail mid-flight.
+// Active and overlapping keys are published at /.well-known/jwks.json;
+// revoked keys are dropped from the set immediately. Tokens without a kid
+// fall back to the legacy HMAC secret when JWTAllowHS256 is set.
+//
+// Tokens are issued only to platform admins and to services presenting
+// TokenIssuerKey in X-Token-Issuer-Key. Besides the registered claims, which
+// the service sets itself, only JWTIssuableClaims may be signed.
+
+// Signing key statuses
+const (
+	SigningKeyActive     = "active"
+	SigningKeyVerifyOnly = "verify_only"
+	SigningKeyExpired    = "expired"
+	SigningKeyRevoked    = "revoked"
+)
+
+// Key management event type
+const EventTypeKeyManagement = "key_management"
+
+const (
+	signingKeyRotationLock = "jwks:rotation_lock"
+	signingKeyReload       = 30 * time.Second
+	insecureJWTSecret      = "your-secret-key"
+)
+
+// Claims the service sets on every token it issues
+var registeredClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "nbf": true, "iat": true, "jti": true,
+}
+
+// SigningKey is a JWT signing key pair
+type SigningKey struct {
+	KID          string     `json:"kid" gorm:"primaryKey"`
+	Algorithm    string     `json:"algorithm" gorm:"not null"`
+	PrivateKey   string     `json:"-" gorm:"type:text;not null"` // sealed PKCS#8 PEM
+	PublicKey    string     `json:"public_key" gorm:"type:text;not null"`
+	Status       string     `json:"status" gorm:"index"`
+	ActivatedAt  time.Time  `json:"activated_at"`
+	RetiresAt    *time.Time `json:"retires_at"`
+	RevokedAt    *time.Time `json:"revoked_at"`
+	RevokeReason string     `json:"revoke_reason,omitempty"`
+	CreatedBy    string     `json:"created_by"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// loadedKey is a parsed SigningKey
+type loadedKey struct {
+	record  SigningKey
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// keyRing holds the keys currently valid for signing and verification
+type keyRing struct {
+	mutex  sync.RWMutex
+	active *loadedKey
+	keys   map[string]*loadedKey
+}
+
+func signingMethod(algorithm string) jwt.SigningMethod {
+	switch algorithm {
+	case "RS256":
+		return jwt.SigningMethodRS256
+	case "ES256":
+		return jwt.SigningMethodES256
+	}
+	return nil
+}
+
+func generateKeyPair(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case "RS256":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+}
+
+// rotateSigningKey creates a new active key and moves the current one to
+// verify-only for the overlap period. A Redis lock keeps replicas from
+// rotating at the same time.
+func (s *SecurityService) rotateSigningKey(algorithm, createdBy string) (*SigningKey, error) {
+	if algorithm == "" {
+		algorithm = s.config.JWTAlgorithm
+	}
+	if signingMethod(algorithm) == nil {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+
+	ctx := context.Background()
+	locked, err := s.redis.SetNX(ctx, signingKeyRotationLock, createdBy, time.Minute).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire rotation lock: %w", err)
+	}
+	if !locked {
+		return nil, errors.New("a key rotation is already in progress")
+	}
+	defer s.redis.Del(ctx, signingKeyRotationLock)
+
+	private, err := generateKeyPair(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.sealSecret(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	key := &SigningKey{
+		KID:         uuid.New().String(),
+		Algorithm:   algorithm,
+		PrivateKey:  sealed,
+		PublicKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})),
+		Status:      SigningKeyActive,
+		ActivatedAt: now,
+		CreatedBy:   createdBy,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	retiresAt := now.Add(s.config.JWTKeyOverlap)
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&SigningKey{}).Where("status = ?", SigningKeyActive).Updates(map[string]interface{}{
+			"status":     SigningKeyVerifyOnly,
+			"retires_at": retiresAt,
+			"updated_at": now,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(key).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store signing key: %w", err)
+	}
+
+	log.Printf("Rotated JWT signing key: new kid %s (%s)", key.KID, key.Algorithm)
+	s.reloadSigningKeys()
+	return key, nil
+}
+
+// reloadSigningKeys rebuilds the in-memory key ring from the database
+func (s *SecurityService) reloadSigningKeys() {
+	now := time.Now().UTC()
+
+	// Overlapping keys past their retirement stop verifying
+	s.db.Model(&SigningKey{}).
+		Where("status = ? AND retires_at < ?", SigningKeyVerifyOnly, now).
+		Updates(map[string]interface{}{"status": SigningKeyExpired, "updated_at": now})
+
+	var records []SigningKey
+	if err := s.db.Where("status IN ?", []string{SigningKeyActive, SigningKeyVerifyOnly}).Find(&records).Error; err != nil {
+		log.Printf("Failed to load signing keys: %v", err)
+		return
+	}
+
+	keys := make(map[string]*loadedKey, len(records))
+	var active *loadedKey
+	for _, record := range records {
+		loaded, err := s.parseSigningKey(record)
+		if err != nil {
+			log.Printf("Skipping unreadable signing key %s: %v", record.KID, err)
+			continue
+		}
+		keys[record.KID] = loaded
+		if record.Status == SigningKeyActive && (active == nil || record.ActivatedAt.After(active.record.ActivatedAt)) {
+			active = loaded
+		}
+	}
+
+	s.signingKeys.mutex.Lock()
+	s.signingKeys.keys = keys
+	s.signingKeys.active = active
+	s.signingKeys.mutex.Unlock()
+}
+
+func (s *SecurityService) parseSigningKey(record SigningKey) (*loadedKey, error) {
+	privatePEM, err := s.openSecret(record.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(privatePEM))
+	if block == nil {
+		return nil, errors.New("invalid private key PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot sign")
+	}
+	return &loadedKey{record: record, private: signer, public: signer.Public()}, nil
+}
+
+// Rotate on schedule and keep the key ring in sync with other replicas
+func (s *SecurityService) startKeyRotationWorker() {
+	s.reloadSigningKeys()
+
+	ticker := time.NewTicker(signingKeyReload)
+	defer ticker.Stop()
+
+	for {
+		s.signingKeys.mutex.RLock()
+		active := s.signingKeys.active
+		s.signingKeys.mutex.RUnlock()
+
+		if active == nil || time.Since(active.record.ActivatedAt) > s.config.JWTKeyRotationInterval {
+			if _, err := s.rotateSigningKey("", "scheduler"); err != nil {
+				log.Printf("Scheduled key rotation skipped: %v", err)
+			}
+		}
+
+		<-ticker.C
+		s.reloadSigningKeys()
+	}
+}
+
+// JWKS document for downstream verifiers
+func (s *SecurityService) getJWKS(c *gin.Context) {
+	s.signingKeys.mutex.RLock()
+	keys := make([]gin.H, 0, len(s.signingKeys.keys))
+	for _, key := range s.signingKeys.keys {
+		if jwk := publicJWK(key); jwk != nil {
+			keys = append(keys, jwk)
+		}
+	}
+	s.signingKeys.mutex.RUnlock()
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+func publicJWK(key *loadedKey) gin.H {
+	encode := base64.RawURLEncoding.EncodeToString
+	jwk := gin.H{
+		"kid": key.record.KID,
+		"alg": key.record.Algorithm,
+		"use": "sig",
+	}
+
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = encode(public.N.Bytes())
+		jwk["e"] = encode(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		jwk["kty"] = "EC"
+		jwk["crv"] = public.Curve.Params().Name
+		jwk["x"] = encode(public.X.FillBytes(make([]byte, size)))
+		jwk["y"] = encode(public.Y.FillBytes(make([]byte, size)))
+	default:
+		return nil
+	}
+	return jwk
+}
+
+// List signing keys (public material only)
+func (s *SecurityService) listSigningKeys(c *gin.Context) {
+	if !signingKeyAdmin(c) {
+		return
+	}
+
+	query := s.db.Model(&SigningKey{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var keys []SigningKey
+	if err := query.Order("created_at DESC").Find(&keys).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list signing keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"keys":  keys,
+		"total": len(keys),
+	})
+}
+
+// Force a key rotation
+func (s *SecurityService) forceKeyRotation(c *gin.Context) {
+	if !signingKeyAdmin(c) {
+		return
+	}
+
+	var request struct {
+		Algorithm string `json:"algorithm"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	actor := c.GetString(contextSubject)
+	key, err := s.rotateSigningKey(request.Algorithm, actor)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	s.recordKeyEvent(c, "rotate", key.KID, map[string]interface{}{"algorithm": key.Algorithm})
+
+	c.JSON(http.StatusCreated, key)
+}
+
+// Revoke a key; tokens it signed stop validating immediately
+func (s *SecurityService) revokeSigningKey(c *gin.Context) {
+	if !signingKeyAdmin(c) {
+		return
+	}
+
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var key SigningKey
+	if err := s.db.First(&key, "kid = ?", c.Param("kid")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Signing key not found"})
+		return
+	}
+	if key.Status == SigningKeyRevoked {
+		c.JSON(http.StatusConflict, gin.H{"error": "Signing key already revoked"})
+		return
+	}
+
+	wasActive := key.Status == SigningKeyActive
+	now := time.Now().UTC()
+	key.Status = SigningKeyRevoked
+	key.RevokedAt = &now
+	key.RevokeReason = request.Reason
+	key.UpdatedAt = now
+	if err := s.db.Save(&key).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke signing key"})
+		return
+	}
+
+	s.recordKeyEvent(c, "revoke", key.KID, map[string]interface{}{
+		"reason":     request.Reason,
+		"was_active": wasActive,
+	})
+
+	response := gin.H{"revoked": key}
+
+	// Never leave the service without a signing key
+	if wasActive {
+		replacement, err := s.rotateSigningKey(key.Algorithm, "revocation")
+		if err != nil {
+			s.reloadSigningKeys()
+			response["warning"] = "Key revoked but no replacement could be created: " + err.Error()
+		} else {
+			response["replacement_kid"] = replacement.KID
+		}
+	} else {
+		s.reloadSigningKeys()
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Issue a token signed with the active key
+func (s *SecurityService) issueToken(c *gin.Context) {
+	var request struct {
+		Subject    string                 `json:"subject" binding:"required"`
+		Audience   string                 `json:"audience"`
+		Claims     map[string]interface{} `json:"claims"`
+		TTLSeconds int                    `json:"ttl_seconds"`
+	}
+
+	if !s.mayIssueTokens(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Issuing tokens requires the platform admin role or the token issuer key"})
+		return
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for name := range request.Claims {
+		if registeredClaims[name] || !s.issuableClaim(name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Claim %q may not be issued", name)})
+			return
+		}
+	}
+
+	ttl := s.config.JWTTokenTTL
+	if request.TTLSeconds > 0 {
+		ttl = time.Duration(request.TTLSeconds) * time.Second
+	}
+	// A token must not outlive the overlap window of the key that signed it
+	if ttl > s.config.JWTKeyOverlap {
+		ttl = s.config.JWTKeyOverlap
+	}
+
+	s.signingKeys.mutex.RLock()
+	active := s.signingKeys.active
+	s.signingKeys.mutex.RUnlock()
+	if active == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No active signing key"})
+		return
+	}
+
+	now := time.Now().UTC()
+	claims := jwt.MapClaims{}
+	for name, value := range request.Claims {
+		claims[name] = value
+	}
+	claims["sub"] = request.Subject
+	claims["iss"] = s.config.JWTIssuer
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Unix()
+	claims["jti"] = uuid.New().String()
+	if request.Audience != "" {
+		claims["aud"] = request.Audience
+	}
+
+	token := jwt.NewWithClaims(signingMethod(active.record.Algorithm), claims)
+	token.Header["kid"] = active.record.KID
+	signed, err := token.SignedString(active.private)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":      signed,
+		"kid":        active.record.KID,
+		"expires_at": now.Add(ttl).Format(time.RFC3339),
+	})
+}
+
+// signingKeyAdmin answers 403 unless the caller is a platform admin; the
+// key ring is shared by every tenant
+func signingKeyAdmin(c *gin.Context) bool {
+	if c.GetBool(contextTenantAdmin) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "Signing keys can only be managed by platform admins"})
+	return false
+}
+
+// mayIssueTokens reports whether the caller is a platform admin or a service
+// holding the issuer key
+func (s *SecurityService) mayIssueTokens(c *gin.Context) bool {
+	return platformCaller(c)
+}
+
+func (s *SecurityService) issuableClaim(name string) bool {
+	for _, allowed := range s.config.JWTIssuableClaims {
+		if strings.TrimSpace(allowed) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseToken verifies a JWT against the key ring and returns it with its kid
+func (s *SecurityService) parseToken(raw string) (*jwt.Token, string, error) {
+	methods := []string{"RS256", "ES256"}
+	if s.config.JWTAllowHS256 {
+		methods = append(methods, "HS256")
+	}
+
+	var kid string
+	token, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		kid, _ = token.Header["kid"].(string)
+		if kid == "" {
+			if token.Method.Alg() != "HS256" {
+				return nil, errors.New("token has no kid")
+			}
+			return []byte(s.config.JWTSecret), nil
+		}
+
+		s.signingKeys.mutex.RLock()
+		key, ok := s.signingKeys.keys[kid]
+		s.signingKeys.mutex.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown or revoked key %s", kid)
+		}
+		if token.Method.Alg() != key.record.Algorithm {
+			return nil, fmt.Errorf("algorithm %s does not match key %s", token.Method.Alg(), kid)
+		}
+		return key.public, nil
+	}, jwt.WithValidMethods(methods))
+	if err != nil {
+		return nil, kid, err
+	}
+	if !token.Valid {
+		return nil, kid, errors.New("invalid token")
+	}
+	return token, kid, nil
+}
+
+// Validate a JWT against the key ring
+func (s *SecurityService) validateToken(c *gin.Context) {
+	var request struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, kid, err := s.parseToken(request.Token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"valid": false, "error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"valid":     true,
+		"kid":       kid,
+		"algorithm": token.Method.Alg(),
+		"claims":    token.Claims,
+	})
+}
+
+func (s *SecurityService) recordKeyEvent(c *gin.Context, action, kid string, details map[string]interface{}) {
+	details["kid"] = kid
+	now := time.Now().UTC()
+	event := &SecurityEvent{
+		ID:        uuid.New().String(),
+		Type:      EventTypeKeyManagement,
+		Severity:  ThreatLevelMedium,
+		UserID:    c.GetString(contextSubject),
+		IPAddress: c.ClientIP(),
+		UserAgent: c.GetHeader("User-Agent"),
+		Resource:  "signing_key",
+		Action:    action,
+		Result:    "success",
+		Details:   details,
+		Timestamp: now,
+		CreatedAt: now,
+	}
+	if err := s.db.Create(event).Error; err != nil {
+		log.Printf("Failed to record key %s event: %v", action, err)
+		return
+	}
+	securityEventsTotal.WithLabelValues(event.Type, event.Severity).Inc()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"gorm.io/gorm"
+)
+
+// Streaming export of security events for downstream SIEMs. Every stored
+// SecurityEvent and ThreatDetection is published as a structured-mode
+// CloudEvents 1.0 message. Publishing is asynchronous so request paths never
+// wait on the brokers; failed writes are retried with backoff and then sent
+// to the dead-letter topic together with the error.
+
+const (
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsContentType = "application/cloudevents+json"
+
+	exportQueueSize = 10000
+	exportBackoff   = 500 * time.Millisecond
+)
+
+// cloudEvent is the structured-mode CloudEvents envelope
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            time.Time   `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+type exportMessage struct {
+	topic string
+	key   string
+	event cloudEvent
+}
+
+// eventExporter publishes security records to Kafka
+type eventExporter struct {
+	writer *kafka.Writer
+	queue  chan exportMessage
+	config *Config
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var securityExportTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "security_export_messages_total",
+		Help: "Security records exported to Kafka by topic and result",
+	},
+	[]string{"topic", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(securityExportTotal)
+}
+
+// initEventExporter returns nil when no brokers are configured
+func initEventExporter(config *Config) *eventExporter {
+	if len(config.KafkaBrokers) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &eventExporter{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(config.KafkaBrokers...),
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			MaxAttempts:  1, // retries are handled by the exporter
+			WriteTimeout: 10 * time.Second,
+		},
+		queue:  make(chan exportMessage, exportQueueSize),
+		config: config,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// registerExportCallbacks publishes every created SecurityEvent and
+// ThreatDetection, wherever in the service it is written
+func (s *SecurityService) registerExportCallbacks() error {
+	if s.exporter == nil {
+		return nil
+	}
+
+	return s.db.Callback().Create().After("gorm:create").Register("security:export", func(tx *gorm.DB) {
+		if tx.Error != nil || tx.Statement.Schema == nil {
+			return
+		}
+
+		switch record := tx.Statement.Dest.(type) {
+		case *SecurityEvent:
+			s.exporter.publishSecurityEvent(record)
+		case *ThreatDetection:
+			s.exporter.publishThreat(record)
+		}
+	})
+}
+
+func (e *eventExporter) publishSecurityEvent(event *SecurityEvent) {
+	e.enqueue(exportMessage{
+		topic: e.config.KafkaEventsTopic,
+		key:   event.UserID,
+		event: cloudEvent{
+			SpecVersion:     cloudEventsSpecVersion,
+			ID:              event.ID,
+			Source:          e.config.KafkaEventSource,
+			Type:            "com.002aic.security.event." + event.Type,
+			Subject:         event.UserID,
+			Time:            event.Timestamp,
+			DataContentType: "application/json",
+			Data:            event,
+		},
+	})
+}
+
+func (e *eventExporter) publishThreat(threat *ThreatDetection) {
+	e.enqueue(exportMessage{
+		topic: e.config.KafkaThreatsTopic,
+		key:   threat.Target,
+		event: cloudEvent{
+			SpecVersion:     cloudEventsSpecVersion,
+			ID:              threat.ID,
+			Source:          e.config.KafkaEventSource,
+			Type:            "com.002aic.security.threat." + threat.Type,
+			Subject:         threat.Target,
+			Time:            threat.CreatedAt,
+			DataContentType: "application/json",
+			Data:            threat,
+		},
+	})
+}
+
+func (e *eventExporter) enqueue(msg exportMessage) {
+	select {
+	case e.queue <- msg:
+	default:
+		// Never block the caller; the record is still in the database
+		securityExportTotal.WithLabelValues(msg.topic, "dropped").Inc()
+		log.Printf("Kafka export queue full, dropping %s %s", msg.event.Type, msg.event.ID)
+	}
+}
+
+// run delivers queued messages until the exporter is closed
+func (e *eventExporter) run() {
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case msg := <-e.queue:
+			e.deliver(e.ctx, msg)
+		}
+	}
+}
+
+func (e *eventExporter) close() {
+	e.cancel()
+	if err := e.writer.Close(); err != nil {
+		log.Printf("Failed to close Kafka writer: %v", err)
+	}
+}
+
+func (e *eventExporter) deliver(ctx context.Context, msg exportMessage) {
+	value, err := json.Marshal(msg.event)
+	if err != nil {
+		log.Printf("Failed to encode %s %s: %v", msg.event.Type, msg.event.ID, err)
+		securityExportTotal.WithLabelValues(msg.topic, "failed").Inc()
+		return
+	}
+
+	message := kafka.Message{
+		Topic: msg.topic,
+		Key:   []byte(msg.key),
+		Value: value,
+		Headers: []kafka.Header{
+			{Key: "content-type", Value: []byte(cloudEventsContentType)},
+			{Key: "ce_id", Value: []byte(msg.event.ID)},
+			{Key: "ce_type", Value: []byte(msg.event.Type)},
+		},
+	}
+
+	backoff := exportBackoff
+	for attempt := 1; ; attempt++ {
+		err = e.writer.WriteMessages(ctx, message)
+		if err == nil {
+			securityExportTotal.WithLabelValues(msg.topic, "delivered").Inc()
+			return
+		}
+		if attempt >= e.config.KafkaMaxRetries || ctx.Err() != nil {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	log.Printf("Failed to export %s %s to %s after retries: %v", msg.event.Type, msg.event.ID, msg.topic, err)
+	securityExportTotal.WithLabelValues(msg.topic, "failed").Inc()
+	e.deadLetter(message, err)
+}
+
+// deadLetter parks an undeliverable message with the reason it failed
+func (e *eventExporter) deadLetter(message kafka.Message, cause error) {
+	if e.config.KafkaDeadLetterTopic == "" {
+		return
+	}
+
+	message.Headers = append(message.Headers,
+		kafka.Header{Key: "dlq_original_topic", Value: []byte(message.Topic)},
+		kafka.Header{Key: "dlq_error", Value: []byte(cause.Error())},
+		kafka.Header{Key: "dlq_failed_at", Value: []byte(time.Now().UTC().Format(time.RFC3339))},
+		kafka.Header{Key: "dlq_id", Value: []byte(uuid.New().String())},
+	)
+	message.Topic = e.config.KafkaDeadLetterTopic
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.writer.WriteMessages(ctx, message); err != nil {
+		log.Printf("Failed to write to dead-letter topic %s: %v", e.config.KafkaDeadLetterTopic, err)
+		securityExportTotal.WithLabelValues(e.config.KafkaDeadLetterTopic, "failed").Inc()
+		return
+	}
+	securityExportTotal.WithLabelValues(e.config.KafkaDeadLetterTopic, "delivered").Inc()
+}
+
+// parseBrokers splits a comma-separated broker list, ignoring blanks
+func parseBrokers(value string) []string {
+	var brokers []string
+	for _, broker := range strings.Split(value, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	return brokers
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Brute-force account lockout enforcement. Auth services report every login
+// attempt; failures are counted per tenant and user in Redis and the account
+// is locked for LockoutDuration once MaxLoginAttempts is reached. Only
+// platform services (holding the issuer key) and admins may report attempts
+// or lift a lockout; tenants see their own lockouts.
+
+const (
+	EventTypeAccountLockout = "account_lockout"
+	ThreatTypeBruteForce    = "brute_force"
+)
+
+func loginAttemptsKey(tenantID, userID string) string {
+	return fmt.Sprintf("login_attempts:%s:%s", tenantID, userID)
+}
+
+func loginAttemptIPsKey(tenantID, userID string) string {
+	return fmt.Sprintf("login_attempt_ips:%s:%s", tenantID, userID)
+}
+
+func lockoutKey(tenantID, userID string) string {
+	return fmt.Sprintf("lockout:%s:%s", tenantID, userID)
+}
+
+// lockoutOperator answers 403 unless the caller is a platform service or admin
+func lockoutOperator(c *gin.Context) bool {
+	if platformCaller(c) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "Only auth services and admins may do this"})
+	return false
+}
+
+// Record a login attempt reported by an auth service
+func (s *SecurityService) recordLoginAttempt(c *gin.Context) {
+	if !lockoutOperator(c) {
+		return
+	}
+
+	var request struct {
+		UserID    string `json:"user_id" binding:"required"`
+		Success   bool   `json:"success"`
+		IPAddress string `json:"ip_address"`
+		UserAgent string `json:"user_agent"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.IPAddress == "" {
+		request.IPAddress = c.ClientIP()
+	}
+
+	ctx := context.Background()
+	tenant := s.writeTenant(c)
+	attemptsKey := loginAttemptsKey(tenant, request.UserID)
+	ipsKey := loginAttemptIPsKey(tenant, request.UserID)
+
+	// Attempts against a locked account are rejected without touching the counter
+	if ttl, err := s.redis.TTL(ctx, lockoutKey(tenant, request.UserID)).Result(); err == nil && ttl > 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"user_id":      request.UserID,
+			"locked":       true,
+			"locked_until": time.Now().UTC().Add(ttl).Format(time.RFC3339),
+		})
+		return
+	}
+
+	if request.Success {
+		s.redis.Del(ctx, attemptsKey, ipsKey)
+		c.JSON(http.StatusOK, gin.H{
+			"user_id":            request.UserID,
+			"locked":             false,
+			"remaining_attempts": s.config.MaxLoginAttempts,
+		})
+		return
+	}
+
+	failedLoginAttempts.WithLabelValues(request.UserID, request.IPAddress).Inc()
+	if err := s.recordAuthFailure(ctx, &authFailure{
+		Source:    "login",
+		IPAddress: request.IPAddress,
+		UserID:    request.UserID,
+		UserAgent: request.UserAgent,
+		Reason:    "login_failed",
+	}); err != nil {
+		log.Printf("Failed to record auth failure for %s: %v", request.UserID, err)
+	}
+
+	// Failures are counted within a sliding window of LockoutDuration
+	pipe := s.redis.TxPipeline()
+	count := pipe.Incr(ctx, attemptsKey)
+	pipe.Expire(ctx, attemptsKey, s.config.LockoutDuration)
+	pipe.SAdd(ctx, ipsKey, request.IPAddress)
+	pipe.Expire(ctx, ipsKey, s.config.LockoutDuration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record login attempt"})
+		return
+	}
+
+	attempts := int(count.Val())
+	if attempts < s.config.MaxLoginAttempts {
+		c.JSON(http.StatusOK, gin.H{
+			"user_id":            request.UserID,
+			"locked":             false,
+			"failed_attempts":    attempts,
+			"remaining_attempts": s.config.MaxLoginAttempts - attempts,
+		})
+		return
+	}
+
+	lockedUntil := time.Now().UTC().Add(s.config.LockoutDuration)
+	if err := s.redis.Set(ctx, lockoutKey(tenant, request.UserID), lockedUntil.Format(time.RFC3339), s.config.LockoutDuration).Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to lock account"})
+		return
+	}
+	ips, _ := s.redis.SMembers(ctx, ipsKey).Result()
+	s.redis.Del(ctx, attemptsKey, ipsKey)
+
+	go s.recordLockout(tenant, request.UserID, request.IPAddress, request.UserAgent, attempts, ips, lockedUntil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":         request.UserID,
+		"locked":          true,
+		"failed_attempts": attempts,
+		"locked_until":    lockedUntil.Format(time.RFC3339),
+	})
+}
+
+// Persist the SecurityEvent and ThreatDetection for a lockout
+func (s *SecurityService) recordLockout(tenantID, userID, ipAddress, userAgent string, attempts int, ips []string, lockedUntil time.Time) {
+	now := time.Now().UTC()
+
+	event := &SecurityEvent{
+		ID:        uuid.New().String(),
+		TenantID:  tenantID,
+		Type:      EventTypeAccountLockout,
+		Severity:  ThreatLevelHigh,
+		UserID:    userID,
+		IPAddress: ipAddress,
+		UserAgent: userAgent,
+		Resource:  "account",
+		Action:    "lock",
+		Result:    "locked",
+		Details: map[string]interface{}{
+			"failed_attempts": attempts,
+			"source_ips":      ips,
+			"locked_until":    lockedUntil.Format(time.RFC3339),
+		},
+		Timestamp: now,
+		CreatedAt: now,
+	}
+	if err := s.db.Create(event).Error; err != nil {
+		log.Printf("Failed to record lockout event for %s: %v", userID, err)
+	} else {
+		securityEventsTotal.WithLabelValues(event.Type, event.Severity).Inc()
+	}
+
+	// Failures from several addresses suggest a distributed attack
+	threatLevel := ThreatLevelMedium
+	if len(ips) > 1 {
+		threatLevel = ThreatLevelHigh
+	}
+
+	threat := &ThreatDetection{
+		ID:          uuid.New().String(),
+		TenantID:    tenantID,
+		Type:        ThreatTypeBruteForce,
+		ThreatLevel: threatLevel,
+		Source:      strings.Join(ips, ","),
+		Target:      userID,
+		Description: fmt.Sprintf("Account %s locked after %d failed login attempts", userID, attempts),
+		Indicators:  ips,
+		Evidence: map[string]interface{}{
+			"security_event_id": event.ID,
+			"failed_attempts":   attempts,
+			"window_seconds":    int(s.config.LockoutDuration.Seconds()),
+		},
+		Status:    "open",
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := s.db.Create(threat).Error; err != nil {
+		log.Printf("Failed to record brute-force threat for %s: %v", userID, err)
+		return
+	}
+	threatsDetected.WithLabelValues(threat.Type, threat.ThreatLevel).Inc()
+}
+
+// Query lockout state for a user, or list the active lockouts of the
+// caller's tenant (all tenants for admins)
+func (s *SecurityService) getLockouts(c *gin.Context) {
+	ctx := context.Background()
+
+	if userID := c.Query("user_id"); userID != "" {
+		tenant := s.writeTenant(c)
+		response := gin.H{"user_id": userID, "tenant_id": tenant, "locked": false}
+		if ttl, err := s.redis.TTL(ctx, lockoutKey(tenant, userID)).Result(); err == nil && ttl > 0 {
+			response["locked"] = true
+			response["locked_until"] = time.Now().UTC().Add(ttl).Format(time.RFC3339)
+		}
+		failed, _ := s.redis.Get(ctx, loginAttemptsKey(tenant, userID)).Int()
+		remaining := s.config.MaxLoginAttempts - failed
+		if remaining < 0 {
+			remaining = 0
+		}
+		response["failed_attempts"] = failed
+		response["remaining_attempts"] = remaining
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	pattern := lockoutKey(tenantOf(c), "*")
+	if tenantOf(c) == "" {
+		pattern = lockoutKey("*", "*")
+	}
+
+	lockouts := []gin.H{}
+	iter := s.redis.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		ttl, err := s.redis.TTL(ctx, key).Result()
+		if err != nil || ttl <= 0 {
+			continue
+		}
+		// lockout:<tenant>:<user>; user IDs may contain colons
+		parts := strings.SplitN(strings.TrimPrefix(key, "lockout:"), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		lockouts = append(lockouts, gin.H{
+			"tenant_id":    parts[0],
+			"user_id":      parts[1],
+			"locked_until": time.Now().UTC().Add(ttl).Format(time.RFC3339),
+		})
+	}
+	if err := iter.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list lockouts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"lockouts": lockouts,
+		"total":    len(lockouts),
+	})
+}
+
+// Manually lift a lockout
+func (s *SecurityService) clearLockout(c *gin.Context) {
+	if !lockoutOperator(c) {
+		return
+	}
+
+	userID := c.Param("user_id")
+	tenant := s.writeTenant(c)
+	ctx := context.Background()
+
+	deleted, err := s.redis.Del(ctx, lockoutKey(tenant, userID), loginAttemptsKey(tenant, userID), loginAttemptIPsKey(tenant, userID)).Result()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear lockout"})
+		return
+	}
+
+	now := time.Now().UTC()
+	s.db.Create(&SecurityEvent{
+		ID:        uuid.New().String(),
+		TenantID:  tenant,
+		Type:      EventTypeAccountLockout,
+		Severity:  ThreatLevelLow,
+		UserID:    userID,
+		IPAddress: c.ClientIP(),
+		UserAgent: c.GetHeader("User-Agent"),
+		Resource:  "account",
+		Action:    "unlock",
+		Result:    "unlocked",
+		Details:   map[string]interface{}{"unlocked_by": c.GetString(contextSubject)},
+		Timestamp: now,
+		CreatedAt: now,
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id": userID,
+		"cleared": deleted > 0,
+		"message": "Lockout cleared",
+	})
+}
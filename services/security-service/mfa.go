@@ -0,0 +1,943 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Multi-factor authentication. Users enroll TOTP authenticator apps and
+// WebAuthn security keys in two steps (enroll, then confirm with a first
+// code or attestation). The first confirmed factor also issues a set of
+// single-use backup codes. Verification and enrollment confirmation attempts
+// share a per-user limit in Redis, and every enrollment change is recorded
+// as a SecurityEvent.
+//
+// Factors belong to a tenant and a user. Users manage only their own, named
+// by their token's subject; tenant admins and platform services (the auth
+// service verifying a login) may name any user of the tenant. Enrolling a
+// further factor, removing one or regenerating backup codes needs a second
+// factor verified within mfaStepUpTTL once the user has an active one.
+
+const (
+	EventTypeMFAEnrollment   = "mfa_enrollment"
+	EventTypeMFAVerification = "mfa_verification"
+
+	MFATypeTOTP       = "totp"
+	MFATypeWebAuthn   = "webauthn"
+	MFATypeBackupCode = "backup_code"
+
+	MFAStatusPending = "pending"
+	MFAStatusActive  = "active"
+
+	mfaBackupCodeCount    = 10
+	mfaBackupCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	mfaEnrollmentTTL      = 10 * time.Minute
+	mfaChallengeTTL       = 5 * time.Minute
+	mfaStepUpTTL          = 5 * time.Minute
+)
+
+// MFAFactor is an enrolled second factor
+type MFAFactor struct {
+	ID           string     `json:"id" gorm:"primaryKey"`
+	TenantID     string     `json:"tenant_id" gorm:"index;not null;default:'default'"`
+	UserID       string     `json:"user_id" gorm:"index;not null"`
+	Type         string     `json:"type" gorm:"index;not null"`
+	Name         string     `json:"name"`
+	Status       string     `json:"status" gorm:"index"`
+	Secret       string     `json:"-"`                                    // encrypted TOTP secret
+	CredentialID string     `json:"credential_id,omitempty" gorm:"index"` // base64url WebAuthn credential ID
+	Credential   []byte     `json:"-" gorm:"type:bytea"`                  // serialized webauthn.Credential
+	LastUsedAt   *time.Time `json:"last_used_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// MFABackupCode is a single-use recovery code, stored hashed
+type MFABackupCode struct {
+	ID        string     `json:"id" gorm:"primaryKey"`
+	TenantID  string     `json:"tenant_id" gorm:"index;not null;default:'default'"`
+	UserID    string     `json:"user_id" gorm:"index;not null"`
+	CodeHash  string     `json:"-" gorm:"not null"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// mfaUser adapts a user's WebAuthn factors to webauthn.User
+type mfaUser struct {
+	id          string
+	name        string
+	credentials []webauthn.Credential
+}
+
+func (u *mfaUser) WebAuthnID() []byte                         { return []byte(u.id) }
+func (u *mfaUser) WebAuthnName() string                       { return u.name }
+func (u *mfaUser) WebAuthnDisplayName() string                { return u.name }
+func (u *mfaUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+var mfaVerifications = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mfa_verifications_total",
+		Help: "Total number of MFA verification attempts",
+	},
+	[]string{"method", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(mfaVerifications)
+}
+
+func mfaAttemptsKey(tenantID, userID string) string {
+	return fmt.Sprintf("mfa_attempts:%s:%s", tenantID, userID)
+}
+
+func mfaStepUpKey(tenantID, userID string) string {
+	return fmt.Sprintf("mfa_step_up:%s:%s", tenantID, userID)
+}
+
+// mfaSubject resolves the user an MFA request acts on and answers 400, 401
+// or 403 when there is none the caller may act on
+func (s *SecurityService) mfaSubject(c *gin.Context, requested string) (string, bool) {
+	subject := c.GetString(contextSubject)
+	if platformCaller(c) {
+		if requested == "" {
+			requested = subject
+		}
+		if requested == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id is required"})
+			return "", false
+		}
+		return requested, true
+	}
+	if subject == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "A token naming the user is required"})
+		return "", false
+	}
+	if requested != "" && requested != subject {
+		c.JSON(http.StatusForbidden, gin.H{"error": "MFA factors of other users cannot be managed"})
+		return "", false
+	}
+	return subject, true
+}
+
+// requireMFAStepUp answers 403 unless a user without active factors, or one
+// who verified a second factor within mfaStepUpTTL
+func (s *SecurityService) requireMFAStepUp(c *gin.Context, userID string) bool {
+	var activeFactors int64
+	s.scoped(c).Model(&MFAFactor{}).Where("user_id = ? AND status = ?", userID, MFAStatusActive).Count(&activeFactors)
+	if activeFactors == 0 {
+		return true
+	}
+	verified, err := s.redis.Exists(context.Background(), mfaStepUpKey(s.writeTenant(c), userID)).Result()
+	if err != nil || verified == 0 {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":        "Verify a current second factor first",
+			"mfa_required": true,
+		})
+		return false
+	}
+	return true
+}
+
+// countMFAAttempt counts an attempt against the user's limit before the code
+// is checked, with a single INCR so concurrent attempts cannot slip past it.
+// It answers 429 (or 503 without Redis) and returns false when the attempt
+// may not proceed.
+func (s *SecurityService) countMFAAttempt(c *gin.Context, userID, method string) (int, bool) {
+	ctx := context.Background()
+	key := mfaAttemptsKey(s.writeTenant(c), userID)
+	attempts, err := s.redis.Incr(ctx, key).Result()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "MFA verification is unavailable"})
+		return 0, false
+	}
+	if attempts == 1 {
+		s.redis.Expire(ctx, key, s.config.MFAAttemptWindow)
+	} else if ttl, _ := s.redis.TTL(ctx, key).Result(); ttl < 0 {
+		// The first attempt's EXPIRE was lost
+		s.redis.Expire(ctx, key, s.config.MFAAttemptWindow)
+	}
+
+	if int(attempts) > s.config.MFAMaxAttempts {
+		ttl, _ := s.redis.TTL(ctx, key).Result()
+		mfaVerifications.WithLabelValues(method, "rate_limited").Inc()
+		c.Header("Retry-After", fmt.Sprintf("%d", int(ttl.Seconds())))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":       "Too many MFA verification attempts",
+			"retry_after": int(ttl.Seconds()),
+		})
+		return int(attempts), false
+	}
+	return int(attempts), true
+}
+
+func mfaRegistrationKey(factorID string) string {
+	return fmt.Sprintf("mfa_webauthn_registration:%s", factorID)
+}
+
+func mfaChallengeKey(tenantID, userID string) string {
+	return fmt.Sprintf("mfa_webauthn_challenge:%s:%s", tenantID, userID)
+}
+
+func mfaTOTPUsedKey(factorID, code string) string {
+	return fmt.Sprintf("mfa_totp_used:%s:%s", factorID, code)
+}
+
+func initWebAuthn(config *Config) (*webauthn.WebAuthn, error) {
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          config.WebAuthnRPID,
+		RPDisplayName: config.MFAIssuer,
+		RPOrigins:     config.WebAuthnRPOrigins,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure WebAuthn: %w", err)
+	}
+	return wa, nil
+}
+
+// Start enrolling a TOTP or WebAuthn factor
+func (s *SecurityService) enrollMFA(c *gin.Context) {
+	var request struct {
+		UserID      string `json:"user_id"`
+		Type        string `json:"type" binding:"required"`
+		Name        string `json:"name"`
+		AccountName string `json:"account_name"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID, ok := s.mfaSubject(c, request.UserID)
+	if !ok {
+		return
+	}
+	request.UserID = userID
+	if !s.requireMFAStepUp(c, request.UserID) {
+		return
+	}
+	if request.AccountName == "" {
+		request.AccountName = request.UserID
+	}
+	if request.Name == "" {
+		request.Name = request.Type
+	}
+
+	now := time.Now().UTC()
+	factor := &MFAFactor{
+		ID:        uuid.New().String(),
+		TenantID:  s.writeTenant(c),
+		UserID:    request.UserID,
+		Type:      request.Type,
+		Name:      request.Name,
+		Status:    MFAStatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	response := gin.H{"factor_id": factor.ID, "type": factor.Type, "status": factor.Status}
+
+	switch request.Type {
+	case MFATypeTOTP:
+		key, err := totp.Generate(totp.GenerateOpts{
+			Issuer:      s.config.MFAIssuer,
+			AccountName: request.AccountName,
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate TOTP secret"})
+			return
+		}
+		secret, err := s.sealSecret(key.Secret())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to protect TOTP secret"})
+			return
+		}
+		factor.Secret = secret
+		response["secret"] = key.Secret()
+		response["otpauth_url"] = key.URL()
+
+	case MFATypeWebAuthn:
+		user, err := s.loadMFAUser(s.scoped(c), request.UserID, request.AccountName)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load existing credentials"})
+			return
+		}
+		exclusions := make([]protocol.CredentialDescriptor, 0, len(user.credentials))
+		for _, credential := range user.credentials {
+			exclusions = append(exclusions, credential.Descriptor())
+		}
+		creation, session, err := s.webauthn.BeginRegistration(user, webauthn.WithExclusions(exclusions))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start WebAuthn registration"})
+			return
+		}
+		sessionJSON, _ := json.Marshal(session)
+		if err := s.redis.Set(context.Background(), mfaRegistrationKey(factor.ID), sessionJSON, mfaEnrollmentTTL).Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store registration session"})
+			return
+		}
+		response["options"] = creation
+
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be totp or webauthn"})
+		return
+	}
+
+	if err := s.db.Create(factor).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create MFA factor"})
+		return
+	}
+
+	s.recordMFAEvent(c, request.UserID, "enroll_start", "pending", ThreatLevelLow, map[string]interface{}{
+		"factor_id": factor.ID,
+		"type":      factor.Type,
+	})
+
+	response["expires_at"] = now.Add(mfaEnrollmentTTL).Format(time.RFC3339)
+	c.JSON(http.StatusCreated, response)
+}
+
+// Confirm a pending factor with a first TOTP code or WebAuthn attestation
+func (s *SecurityService) confirmMFAEnrollment(c *gin.Context) {
+	var request struct {
+		Code       string          `json:"code"`
+		Credential json.RawMessage `json:"credential"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var factor MFAFactor
+	if err := s.scoped(c).Where("id = ? AND status = ?", c.Param("id"), MFAStatusPending).First(&factor).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pending MFA factor not found"})
+		return
+	}
+	if _, ok := s.mfaSubject(c, factor.UserID); !ok {
+		return
+	}
+	if time.Since(factor.CreatedAt) > mfaEnrollmentTTL {
+		s.db.Delete(&factor)
+		c.JSON(http.StatusGone, gin.H{"error": "Enrollment expired, start again"})
+		return
+	}
+
+	// Confirmation codes count against the same limit as verification
+	if _, ok := s.countMFAAttempt(c, factor.UserID, factor.Type); !ok {
+		return
+	}
+
+	switch factor.Type {
+	case MFATypeTOTP:
+		if !s.checkTOTP(&factor, request.Code) {
+			s.recordMFAEvent(c, factor.UserID, "enroll_confirm", "failed", ThreatLevelLow, map[string]interface{}{
+				"factor_id": factor.ID,
+				"type":      factor.Type,
+			})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid TOTP code"})
+			return
+		}
+
+	case MFATypeWebAuthn:
+		ctx := context.Background()
+		sessionJSON, err := s.redis.Get(ctx, mfaRegistrationKey(factor.ID)).Bytes()
+		if err != nil {
+			c.JSON(http.StatusGone, gin.H{"error": "Registration session expired, start again"})
+			return
+		}
+		var session webauthn.SessionData
+		if err := json.Unmarshal(sessionJSON, &session); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Corrupt registration session"})
+			return
+		}
+		parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(request.Credential))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid WebAuthn credential: " + err.Error()})
+			return
+		}
+		user, err := s.loadMFAUser(s.scoped(c), factor.UserID, factor.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load existing credentials"})
+			return
+		}
+		credential, err := s.webauthn.CreateCredential(user, session, parsed)
+		if err != nil {
+			s.recordMFAEvent(c, factor.UserID, "enroll_confirm", "failed", ThreatLevelLow, map[string]interface{}{
+				"factor_id": factor.ID,
+				"type":      factor.Type,
+				"error":     err.Error(),
+			})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "WebAuthn attestation failed"})
+			return
+		}
+		credentialJSON, _ := json.Marshal(credential)
+		factor.Credential = credentialJSON
+		factor.CredentialID = base64.RawURLEncoding.EncodeToString(credential.ID)
+		s.redis.Del(ctx, mfaRegistrationKey(factor.ID))
+	}
+
+	s.redis.Del(context.Background(), mfaAttemptsKey(factor.TenantID, factor.UserID))
+
+	var activeFactors int64
+	s.tenantDB(factor.TenantID).Model(&MFAFactor{}).Where("user_id = ? AND status = ?", factor.UserID, MFAStatusActive).Count(&activeFactors)
+
+	factor.Status = MFAStatusActive
+	factor.UpdatedAt = time.Now().UTC()
+	if err := s.db.Save(&factor).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate MFA factor"})
+		return
+	}
+
+	response := gin.H{"factor": factor}
+
+	// The first factor comes with recovery codes
+	if activeFactors == 0 {
+		codes, err := s.issueBackupCodes(factor.TenantID, factor.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Factor enrolled but backup codes could not be issued"})
+			return
+		}
+		response["backup_codes"] = codes
+	}
+
+	s.recordMFAEvent(c, factor.UserID, "enroll", "enrolled", ThreatLevelMedium, map[string]interface{}{
+		"factor_id":           factor.ID,
+		"type":                factor.Type,
+		"backup_codes_issued": activeFactors == 0,
+	})
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Verify a second factor. WebAuthn assertions need a challenge from
+// /mfa/verify/challenge first.
+func (s *SecurityService) verifyMFA(c *gin.Context) {
+	var request struct {
+		UserID    string          `json:"user_id"`
+		Method    string          `json:"method" binding:"required"`
+		Code      string          `json:"code"`
+		Assertion json.RawMessage `json:"assertion"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, ok := s.mfaSubject(c, request.UserID)
+	if !ok {
+		return
+	}
+	request.UserID = userID
+
+	ctx := context.Background()
+	tenant := s.writeTenant(c)
+
+	// Refuse attempts while the user is over the limit
+	attempts, ok := s.countMFAAttempt(c, request.UserID, request.Method)
+	if !ok {
+		return
+	}
+
+	var (
+		factorID string
+		err      error
+	)
+	switch request.Method {
+	case MFATypeTOTP:
+		factorID, err = s.verifyTOTPCode(s.scoped(c), request.UserID, request.Code)
+	case MFATypeWebAuthn:
+		factorID, err = s.verifyWebAuthnAssertion(s.scoped(c), tenant, request.UserID, request.Assertion)
+	case MFATypeBackupCode:
+		factorID, err = s.redeemBackupCode(s.scoped(c), request.UserID, request.Code)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "method must be totp, webauthn or backup_code"})
+		return
+	}
+
+	if err != nil {
+		mfaVerifications.WithLabelValues(request.Method, "failure").Inc()
+
+		failed := attempts
+		severity := ThreatLevelLow
+		if failed >= s.config.MFAMaxAttempts {
+			severity = ThreatLevelHigh
+		}
+		s.recordMFAEvent(c, request.UserID, "verify", "failed", severity, map[string]interface{}{
+			"method":          request.Method,
+			"failed_attempts": failed,
+			"error":           err.Error(),
+		})
+
+		remaining := s.config.MFAMaxAttempts - failed
+		if remaining < 0 {
+			remaining = 0
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"verified":           false,
+			"error":              err.Error(),
+			"remaining_attempts": remaining,
+		})
+		return
+	}
+
+	mfaVerifications.WithLabelValues(request.Method, "success").Inc()
+	s.redis.Del(ctx, mfaAttemptsKey(tenant, request.UserID))
+	s.redis.Set(ctx, mfaStepUpKey(tenant, request.UserID), "1", mfaStepUpTTL)
+
+	response := gin.H{
+		"verified": true,
+		"user_id":  request.UserID,
+		"method":   request.Method,
+	}
+	if factorID != "" {
+		response["factor_id"] = factorID
+	}
+	if request.Method == MFATypeBackupCode {
+		var remaining int64
+		s.scoped(c).Model(&MFABackupCode{}).Where("user_id = ? AND used_at IS NULL", request.UserID).Count(&remaining)
+		response["backup_codes_remaining"] = remaining
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// Issue a WebAuthn assertion challenge
+func (s *SecurityService) createMFAChallenge(c *gin.Context) {
+	var request struct {
+		UserID string `json:"user_id"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID, ok := s.mfaSubject(c, request.UserID)
+	if !ok {
+		return
+	}
+	request.UserID = userID
+
+	user, err := s.loadMFAUser(s.scoped(c), request.UserID, request.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load credentials"})
+		return
+	}
+	if len(user.credentials) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No WebAuthn credentials enrolled"})
+		return
+	}
+
+	assertion, session, err := s.webauthn.BeginLogin(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create challenge"})
+		return
+	}
+	sessionJSON, _ := json.Marshal(session)
+	if err := s.redis.Set(context.Background(), mfaChallengeKey(s.writeTenant(c), request.UserID), sessionJSON, mfaChallengeTTL).Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store challenge"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"options":    assertion,
+		"expires_at": time.Now().UTC().Add(mfaChallengeTTL).Format(time.RFC3339),
+	})
+}
+
+// List a user's factors and backup code status
+func (s *SecurityService) listMFAFactors(c *gin.Context) {
+	userID, ok := s.mfaSubject(c, c.Query("user_id"))
+	if !ok {
+		return
+	}
+
+	var factors []MFAFactor
+	if err := s.scoped(c).Where("user_id = ?", userID).Order("created_at ASC").Find(&factors).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list MFA factors"})
+		return
+	}
+
+	var backupCodes int64
+	s.scoped(c).Model(&MFABackupCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&backupCodes)
+
+	enrolled := false
+	for _, factor := range factors {
+		if factor.Status == MFAStatusActive {
+			enrolled = true
+			break
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":                userID,
+		"enrolled":               enrolled,
+		"factors":                factors,
+		"backup_codes_remaining": backupCodes,
+	})
+}
+
+// Remove a factor; removing the last one also revokes backup codes
+func (s *SecurityService) deleteMFAFactor(c *gin.Context) {
+	var factor MFAFactor
+	if err := s.scoped(c).Where("id = ?", c.Param("id")).First(&factor).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "MFA factor not found"})
+		return
+	}
+	if _, ok := s.mfaSubject(c, factor.UserID); !ok {
+		return
+	}
+	if !s.requireMFAStepUp(c, factor.UserID) {
+		return
+	}
+
+	var remaining int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&factor).Error; err != nil {
+			return err
+		}
+		tx.Model(&MFAFactor{}).Where("tenant_id = ? AND user_id = ? AND status = ?", factor.TenantID, factor.UserID, MFAStatusActive).Count(&remaining)
+		if remaining == 0 {
+			return tx.Where("tenant_id = ? AND user_id = ?", factor.TenantID, factor.UserID).Delete(&MFABackupCode{}).Error
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete MFA factor"})
+		return
+	}
+
+	severity := ThreatLevelMedium
+	if remaining == 0 && factor.Status == MFAStatusActive {
+		severity = ThreatLevelHigh
+	}
+	s.recordMFAEvent(c, factor.UserID, "remove", "removed", severity, map[string]interface{}{
+		"factor_id":         factor.ID,
+		"type":              factor.Type,
+		"remaining_factors": remaining,
+		"removed_by":        c.GetString(contextSubject),
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":           "MFA factor removed",
+		"remaining_factors": remaining,
+	})
+}
+
+// Replace a user's backup codes
+func (s *SecurityService) regenerateBackupCodes(c *gin.Context) {
+	var request struct {
+		UserID string `json:"user_id"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID, ok := s.mfaSubject(c, request.UserID)
+	if !ok {
+		return
+	}
+	request.UserID = userID
+
+	var activeFactors int64
+	s.scoped(c).Model(&MFAFactor{}).Where("user_id = ? AND status = ?", request.UserID, MFAStatusActive).Count(&activeFactors)
+	if activeFactors == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User has no active MFA factor"})
+		return
+	}
+	if !s.requireMFAStepUp(c, request.UserID) {
+		return
+	}
+
+	codes, err := s.issueBackupCodes(s.writeTenant(c), request.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue backup codes"})
+		return
+	}
+
+	s.recordMFAEvent(c, request.UserID, "backup_codes_regenerate", "regenerated", ThreatLevelMedium, map[string]interface{}{
+		"count": len(codes),
+	})
+
+	c.JSON(http.StatusOK, gin.H{"backup_codes": codes})
+}
+
+func (s *SecurityService) verifyTOTPCode(db *gorm.DB, userID, code string) (string, error) {
+	var factors []MFAFactor
+	db.Where("user_id = ? AND type = ? AND status = ?", userID, MFATypeTOTP, MFAStatusActive).Find(&factors)
+	if len(factors) == 0 {
+		return "", errors.New("no TOTP factor enrolled")
+	}
+
+	for i := range factors {
+		if s.checkTOTP(&factors[i], code) {
+			// A code is accepted once per factor within its validity window
+			ok, err := s.redis.SetNX(context.Background(), mfaTOTPUsedKey(factors[i].ID, code), "1", 90*time.Second).Result()
+			if err != nil || !ok {
+				return "", errors.New("TOTP code already used")
+			}
+			s.touchMFAFactor(&factors[i])
+			return factors[i].ID, nil
+		}
+	}
+	return "", errors.New("invalid TOTP code")
+}
+
+func (s *SecurityService) checkTOTP(factor *MFAFactor, code string) bool {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false
+	}
+	secret, err := s.openSecret(factor.Secret)
+	if err != nil {
+		log.Printf("Failed to decrypt TOTP secret for factor %s: %v", factor.ID, err)
+		return false
+	}
+	valid, err := totp.ValidateCustom(code, secret, time.Now().UTC(), totp.ValidateOpts{
+		Period:    30,
+		Skew:      1,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	return err == nil && valid
+}
+
+func (s *SecurityService) verifyWebAuthnAssertion(db *gorm.DB, tenantID, userID string, assertion json.RawMessage) (string, error) {
+	if len(assertion) == 0 {
+		return "", errors.New("assertion is required")
+	}
+
+	ctx := context.Background()
+	sessionJSON, err := s.redis.GetDel(ctx, mfaChallengeKey(tenantID, userID)).Bytes()
+	if err != nil {
+		return "", errors.New("no pending WebAuthn challenge")
+	}
+	var session webauthn.SessionData
+	if err := json.Unmarshal(sessionJSON, &session); err != nil {
+		return "", errors.New("corrupt WebAuthn challenge")
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(assertion))
+	if err != nil {
+		return "", fmt.Errorf("invalid assertion: %w", err)
+	}
+
+	user, err := s.loadMFAUser(db, userID, userID)
+	if err != nil {
+		return "", err
+	}
+	credential, err := s.webauthn.ValidateLogin(user, session, parsed)
+	if err != nil {
+		return "", fmt.Errorf("assertion rejected: %w", err)
+	}
+
+	// Persist the new signature counter
+	var factor MFAFactor
+	credentialID := base64.RawURLEncoding.EncodeToString(credential.ID)
+	if err := db.Where("user_id = ? AND credential_id = ?", userID, credentialID).First(&factor).Error; err != nil {
+		return "", errors.New("credential not found")
+	}
+	credentialJSON, _ := json.Marshal(credential)
+	factor.Credential = credentialJSON
+	s.touchMFAFactor(&factor)
+
+	if credential.Authenticator.CloneWarning {
+		log.Printf("WebAuthn clone warning for user %s, factor %s", userID, factor.ID)
+	}
+	return factor.ID, nil
+}
+
+func (s *SecurityService) redeemBackupCode(db *gorm.DB, userID, code string) (string, error) {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if code == "" {
+		return "", errors.New("invalid backup code")
+	}
+
+	var codes []MFABackupCode
+	db.Where("user_id = ? AND used_at IS NULL", userID).Find(&codes)
+	for _, candidate := range codes {
+		if bcrypt.CompareHashAndPassword([]byte(candidate.CodeHash), []byte(code)) != nil {
+			continue
+		}
+		// Conditional update so a code cannot be redeemed twice concurrently
+		now := time.Now().UTC()
+		result := s.db.Model(&MFABackupCode{}).
+			Where("id = ? AND used_at IS NULL", candidate.ID).
+			Update("used_at", now)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return "", errors.New("backup code already used")
+		}
+		return "", nil
+	}
+	return "", errors.New("invalid backup code")
+}
+
+// issueBackupCodes replaces any existing codes and returns the new plaintext codes
+func (s *SecurityService) issueBackupCodes(tenantID, userID string) ([]string, error) {
+	codes := make([]string, 0, mfaBackupCodeCount)
+	records := make([]MFABackupCode, 0, mfaBackupCodeCount)
+	now := time.Now().UTC()
+
+	for i := 0; i < mfaBackupCodeCount; i++ {
+		code, err := randomBackupCode()
+		if err != nil {
+			return nil, err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code[:4]+"-"+code[4:])
+		records = append(records, MFABackupCode{
+			ID:        uuid.New().String(),
+			TenantID:  tenantID,
+			UserID:    userID,
+			CodeHash:  string(hash),
+			CreatedAt: now,
+		})
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("tenant_id = ? AND user_id = ?", tenantID, userID).Delete(&MFABackupCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func randomBackupCode() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i, b := range buf {
+		buf[i] = mfaBackupCodeAlphabet[int(b)%len(mfaBackupCodeAlphabet)]
+	}
+	return string(buf), nil
+}
+
+func (s *SecurityService) loadMFAUser(db *gorm.DB, userID, name string) (*mfaUser, error) {
+	var factors []MFAFactor
+	if err := db.Where("user_id = ? AND type = ? AND status = ?", userID, MFATypeWebAuthn, MFAStatusActive).Find(&factors).Error; err != nil {
+		return nil, err
+	}
+
+	user := &mfaUser{id: userID, name: name}
+	for _, factor := range factors {
+		var credential webauthn.Credential
+		if err := json.Unmarshal(factor.Credential, &credential); err != nil {
+			log.Printf("Skipping unreadable WebAuthn credential %s: %v", factor.ID, err)
+			continue
+		}
+		user.credentials = append(user.credentials, credential)
+	}
+	return user, nil
+}
+
+func (s *SecurityService) touchMFAFactor(factor *MFAFactor) {
+	now := time.Now().UTC()
+	factor.LastUsedAt = &now
+	factor.UpdatedAt = now
+	if err := s.db.Save(factor).Error; err != nil {
+		log.Printf("Failed to update MFA factor %s: %v", factor.ID, err)
+	}
+}
+
+func (s *SecurityService) recordMFAEvent(c *gin.Context, userID, action, result, severity string, details map[string]interface{}) {
+	eventType := EventTypeMFAEnrollment
+	if action == "verify" {
+		eventType = EventTypeMFAVerification
+	}
+
+	now := time.Now().UTC()
+	event := &SecurityEvent{
+		ID:        uuid.New().String(),
+		TenantID:  s.writeTenant(c),
+		Type:      eventType,
+		Severity:  severity,
+		UserID:    userID,
+		IPAddress: c.ClientIP(),
+		UserAgent: c.GetHeader("User-Agent"),
+		Resource:  "mfa",
+		Action:    action,
+		Result:    result,
+		Details:   details,
+		Timestamp: now,
+		CreatedAt: now,
+	}
+	if err := s.db.Create(event).Error; err != nil {
+		log.Printf("Failed to record MFA event for %s: %v", userID, err)
+		return
+	}
+	securityEventsTotal.WithLabelValues(event.Type, event.Severity).Inc()
+}
+
+// Secrets at rest (TOTP seeds, signing keys) are sealed with AES-GCM under a
+// key derived from SecretEncryptionKey
+func (s *SecurityService) secretCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(s.config.SecretEncryptionKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *SecurityService) sealSecret(secret string) (string, error) {
+	gcm, err := s.secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *SecurityService) openSecret(encoded string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := s.secretCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Incident and threat notification dispatch. Channels belong to a tenant
+// and receive only that tenant's notifications; platform admins may mark a
+// channel all_tenants to receive every tenant's.
+
+// Notification channel types
+const (
+	ChannelTypeWebhook   = "webhook"
+	ChannelTypeSlack     = "slack"
+	ChannelTypePagerDuty = "pagerduty"
+	ChannelTypeEmail     = "email"
+)
+
+// Notification kinds
+const (
+	NotificationKindIncident = "incident"
+	NotificationKindThreat   = "threat"
+)
+
+const (
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+	redactedValue      = "********"
+)
+
+// NotificationChannel is a destination plus the severities routed to it
+type NotificationChannel struct {
+	ID             string                 `json:"id" gorm:"primaryKey"`
+	TenantID       string                 `json:"tenant_id" gorm:"uniqueIndex:idx_notification_channel_tenant_name;not null;default:'default'"`
+	AllTenants     bool                   `json:"all_tenants" gorm:"default:false"`
+	Name           string                 `json:"name" gorm:"uniqueIndex:idx_notification_channel_tenant_name;not null"`
+	Type           string                 `json:"type" gorm:"index;not null"`
+	Config         map[string]interface{} `json:"config" gorm:"type:jsonb"`
+	Severities     []string               `json:"severities" gorm:"type:text[]"`
+	Kinds          []string               `json:"kinds" gorm:"type:text[]"`
+	IsActive       bool                   `json:"is_active" gorm:"default:true"`
+	LastDeliveryAt *time.Time             `json:"last_delivery_at"`
+	LastError      string                 `json:"last_error"`
+	CreatedBy      string                 `json:"created_by"`
+	CreatedAt      time.Time              `json:"created_at"`
+	UpdatedAt      time.Time              `json:"updated_at"`
+}
+
+// SecurityNotification is the channel-independent message body
+type SecurityNotification struct {
+	TenantID    string                 `json:"tenant_id"`
+	Kind        string                 `json:"kind"`
+	ID          string                 `json:"id"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description"`
+	Severity    string                 `json:"severity"`
+	Category    string                 `json:"category"`
+	Timestamp   time.Time              `json:"timestamp"`
+	Details     map[string]interface{} `json:"details"`
+}
+
+var notificationsSent = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "security_notifications_sent_total",
+		Help: "Total number of security notifications sent",
+	},
+	[]string{"channel_type", "status"},
+)
+
+func init() {
+	prometheus.MustRegister(notificationsSent)
+}
+
+// Required config keys per channel type
+var channelRequiredConfig = map[string][]string{
+	ChannelTypeWebhook:   {"url"},
+	ChannelTypeSlack:     {"webhook_url"},
+	ChannelTypePagerDuty: {"routing_key"},
+	ChannelTypeEmail:     {"recipients"},
+}
+
+type notificationChannelRequest struct {
+	Name       string                 `json:"name" binding:"required"`
+	Type       string                 `json:"type" binding:"required"`
+	Config     map[string]interface{} `json:"config" binding:"required"`
+	Severities []string               `json:"severities"`
+	Kinds      []string               `json:"kinds"`
+	AllTenants bool                   `json:"all_tenants"`
+	IsActive   *bool                  `json:"is_active"`
+}
+
+func (r *notificationChannelRequest) validate() error {
+	required, ok := channelRequiredConfig[r.Type]
+	if !ok {
+		return fmt.Errorf("unsupported channel type: %s", r.Type)
+	}
+	for _, key := range required {
+		if _, ok := r.Config[key]; !ok {
+			return fmt.Errorf("%s channels require config.%s", r.Type, key)
+		}
+	}
+	for _, severity := range r.Severities {
+		switch severity {
+		case ThreatLevelLow, ThreatLevelMedium, ThreatLevelHigh, ThreatLevelCritical:
+		default:
+			return fmt.Errorf("invalid severity: %s", severity)
+		}
+	}
+	for _, kind := range r.Kinds {
+		if kind != NotificationKindIncident && kind != NotificationKindThreat && kind != NotificationKindResponse {
+			return fmt.Errorf("invalid kind: %s", kind)
+		}
+	}
+	return nil
+}
+
+// Create a notification channel
+func (s *SecurityService) createNotificationChannel(c *gin.Context) {
+	var request notificationChannelRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := request.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.AllTenants && !c.GetBool(contextTenantAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only platform admins may create channels for all tenants"})
+		return
+	}
+
+	channel := &NotificationChannel{
+		ID:         uuid.New().String(),
+		TenantID:   s.writeTenant(c),
+		AllTenants: request.AllTenants,
+		Name:       request.Name,
+		Type:       request.Type,
+		Config:     request.Config,
+		Severities: request.Severities,
+		Kinds:      request.Kinds,
+		IsActive:   request.IsActive == nil || *request.IsActive,
+		CreatedBy:  c.GetHeader("X-User-ID"),
+		CreatedAt:  time.Now().UTC(),
+		UpdatedAt:  time.Now().UTC(),
+	}
+
+	if err := s.db.Create(channel).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create notification channel"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, redactChannel(channel))
+}
+
+// List notification channels
+func (s *SecurityService) listNotificationChannels(c *gin.Context) {
+	query := s.scoped(c).Model(&NotificationChannel{})
+	if channelType := c.Query("type"); channelType != "" {
+		query = query.Where("type = ?", channelType)
+	}
+
+	var channels []NotificationChannel
+	if err := query.Order("name").Find(&channels).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list notification channels"})
+		return
+	}
+
+	redacted := make([]NotificationChannel, 0, len(channels))
+	for i := range channels {
+		redacted = append(redacted, *redactChannel(&channels[i]))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"channels": redacted,
+		"total":    len(redacted),
+	})
+}
+
+// Get a notification channel
+func (s *SecurityService) getNotificationChannel(c *gin.Context) {
+	var channel NotificationChannel
+	if err := s.scoped(c).First(&channel, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification channel not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, redactChannel(&channel))
+}
+
+// Update a notification channel
+func (s *SecurityService) updateNotificationChannel(c *gin.Context) {
+	var channel NotificationChannel
+	if err := s.scoped(c).First(&channel, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification channel not found"})
+		return
+	}
+
+	var request notificationChannelRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := request.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (request.AllTenants || channel.AllTenants) && !c.GetBool(contextTenantAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only platform admins may manage channels for all tenants"})
+		return
+	}
+
+	// Keep stored credentials when the redacted placeholder is sent back
+	for key, value := range request.Config {
+		if value == redactedValue {
+			request.Config[key] = channel.Config[key]
+		}
+	}
+
+	channel.Name = request.Name
+	channel.Type = request.Type
+	channel.Config = request.Config
+	channel.Severities = request.Severities
+	channel.Kinds = request.Kinds
+	channel.AllTenants = request.AllTenants
+	if request.IsActive != nil {
+		channel.IsActive = *request.IsActive
+	}
+	channel.UpdatedAt = time.Now().UTC()
+
+	if err := s.db.Save(&channel).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notification channel"})
+		return
+	}
+
+	c.JSON(http.StatusOK, redactChannel(&channel))
+}
+
+// Delete a notification channel
+func (s *SecurityService) deleteNotificationChannel(c *gin.Context) {
+	query := s.scoped(c)
+	if !c.GetBool(contextTenantAdmin) {
+		query = query.Where("all_tenants = ?", false)
+	}
+	result := query.Delete(&NotificationChannel{}, "id = ?", c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete notification channel"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification channel not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Notification channel deleted successfully"})
+}
+
+// Send a test notification through a channel
+func (s *SecurityService) testNotificationChannel(c *gin.Context) {
+	var channel NotificationChannel
+	if err := s.scoped(c).First(&channel, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification channel not found"})
+		return
+	}
+
+	notification := &SecurityNotification{
+		TenantID:    channel.TenantID,
+		Kind:        NotificationKindIncident,
+		ID:          "test-" + uuid.New().String(),
+		Title:       "Test notification from security-service",
+		Description: fmt.Sprintf("Channel %q is configured correctly", channel.Name),
+		Severity:    ThreatLevelLow,
+		Category:    "test",
+		Timestamp:   time.Now().UTC(),
+	}
+
+	if err := s.deliverNotification(&channel, notification); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Test notification delivered"})
+}
+
+// Notify about a newly created incident
+func (s *SecurityService) notifySecurityIncident(incident *SecurityIncident) {
+	s.dispatchNotification(&SecurityNotification{
+		TenantID:    incident.TenantID,
+		Kind:        NotificationKindIncident,
+		ID:          incident.ID,
+		Title:       incident.Title,
+		Description: incident.Description,
+		Severity:    incident.Severity,
+		Category:    incident.Category,
+		Timestamp:   incident.CreatedAt,
+		Details: map[string]interface{}{
+			"status":      incident.Status,
+			"reporter":    incident.Reporter,
+			"assigned_to": incident.AssignedTo,
+			"impact":      incident.Impact,
+		},
+	})
+}
+
+// Notify about a newly detected threat (critical threats only)
+func (s *SecurityService) notifyThreatDetection(threat *ThreatDetection) {
+	if threat.ThreatLevel != ThreatLevelCritical {
+		return
+	}
+
+	s.dispatchNotification(&SecurityNotification{
+		TenantID:    threat.TenantID,
+		Kind:        NotificationKindThreat,
+		ID:          threat.ID,
+		Title:       fmt.Sprintf("Critical threat detected: %s", threat.Type),
+		Description: threat.Description,
+		Severity:    threat.ThreatLevel,
+		Category:    threat.Type,
+		Timestamp:   threat.CreatedAt,
+		Details: map[string]interface{}{
+			"source":     threat.Source,
+			"target":     threat.Target,
+			"indicators": threat.Indicators,
+			"status":     threat.Status,
+		},
+	})
+}
+
+// Route a notification to every matching channel of its tenant and to the
+// all-tenant channels. Each notification is sent at most once, however many
+// code paths report it.
+func (s *SecurityService) dispatchNotification(notification *SecurityNotification) {
+	ctx := context.Background()
+	key := fmt.Sprintf("notified:%s:%s", notification.Kind, notification.ID)
+	if fresh, err := s.redis.SetNX(ctx, key, time.Now().UTC().Unix(), 7*24*time.Hour).Result(); err == nil && !fresh {
+		return
+	}
+
+	var channels []NotificationChannel
+	err := s.db.Where("is_active = ? AND (tenant_id = ? OR all_tenants = ?)", true, notification.TenantID, true).
+		Find(&channels).Error
+	if err != nil {
+		log.Printf("Notification dispatch: failed to load channels: %v", err)
+		return
+	}
+
+	for i := range channels {
+		channel := &channels[i]
+		if !channelMatches(channel, notification) {
+			continue
+		}
+
+		err := s.deliverNotification(channel, notification)
+		now := time.Now().UTC()
+		updates := map[string]interface{}{"last_delivery_at": now, "last_error": ""}
+		if err != nil {
+			log.Printf("Notification dispatch: channel %s failed: %v", channel.Name, err)
+			updates = map[string]interface{}{"last_error": err.Error()}
+		}
+		s.db.Model(channel).Updates(updates)
+	}
+}
+
+func channelMatches(channel *NotificationChannel, notification *SecurityNotification) bool {
+	return matchesAny(channel.Severities, notification.Severity) && matchesAny(channel.Kinds, notification.Kind)
+}
+
+// An empty filter matches everything
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Deliver with retries and exponential backoff
+func (s *SecurityService) deliverNotification(channel *NotificationChannel, notification *SecurityNotification) error {
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<attempt) * time.Second)
+		}
+
+		switch channel.Type {
+		case ChannelTypeWebhook:
+			err = s.sendWebhookNotification(channel, notification)
+		case ChannelTypeSlack:
+			err = s.sendSlackNotification(channel, notification)
+		case ChannelTypePagerDuty:
+			err = s.sendPagerDutyNotification(channel, notification)
+		case ChannelTypeEmail:
+			err = s.sendEmailNotification(channel, notification)
+		default:
+			err = fmt.Errorf("unsupported channel type: %s", channel.Type)
+		}
+
+		if err == nil {
+			notificationsSent.WithLabelValues(channel.Type, "success").Inc()
+			return nil
+		}
+	}
+
+	notificationsSent.WithLabelValues(channel.Type, "failed").Inc()
+	return err
+}
+
+func (s *SecurityService) sendWebhookNotification(channel *NotificationChannel, notification *SecurityNotification) error {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{"X-Security-Event": notification.Kind}
+	if secret := configString(channel.Config, "secret"); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(payload)
+		headers["X-Signature-256"] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	return s.postJSON(configString(channel.Config, "url"), payload, headers)
+}
+
+func (s *SecurityService) sendSlackNotification(channel *NotificationChannel, notification *SecurityNotification) error {
+	colors := map[string]string{
+		ThreatLevelLow:      "#36a64f",
+		ThreatLevelMedium:   "#f2c744",
+		ThreatLevelHigh:     "#e8912d",
+		ThreatLevelCritical: "#d00000",
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"text": fmt.Sprintf("[%s] %s", strings.ToUpper(notification.Severity), notification.Title),
+		"attachments": []map[string]interface{}{
+			{
+				"color": colors[notification.Severity],
+				"text":  notification.Description,
+				"fields": []map[string]interface{}{
+					{"title": "Kind", "value": notification.Kind, "short": true},
+					{"title": "Category", "value": notification.Category, "short": true},
+					{"title": "ID", "value": notification.ID, "short": false},
+				},
+				"ts": notification.Timestamp.Unix(),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.postJSON(configString(channel.Config, "webhook_url"), payload, nil)
+}
+
+func (s *SecurityService) sendPagerDutyNotification(channel *NotificationChannel, notification *SecurityNotification) error {
+	severities := map[string]string{
+		ThreatLevelLow:      "info",
+		ThreatLevelMedium:   "warning",
+		ThreatLevelHigh:     "error",
+		ThreatLevelCritical: "critical",
+	}
+	severity, ok := severities[notification.Severity]
+	if !ok {
+		severity = "warning"
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"routing_key":  configString(channel.Config, "routing_key"),
+		"event_action": "trigger",
+		"dedup_key":    fmt.Sprintf("%s-%s", notification.Kind, notification.ID),
+		"payload": map[string]interface{}{
+			"summary":        notification.Title,
+			"source":         "security-service",
+			"severity":       severity,
+			"class":          notification.Category,
+			"timestamp":      notification.Timestamp.Format(time.RFC3339),
+			"custom_details": notification.Details,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	url := configString(channel.Config, "events_url")
+	if url == "" {
+		url = pagerDutyEventsURL
+	}
+	return s.postJSON(url, payload, nil)
+}
+
+func (s *SecurityService) sendEmailNotification(channel *NotificationChannel, notification *SecurityNotification) error {
+	if s.config.SMTPHost == "" {
+		return fmt.Errorf("SMTP is not configured")
+	}
+
+	var candidates []string
+	switch value := channel.Config["recipients"].(type) {
+	case string:
+		candidates = strings.Split(value, ",")
+	case []interface{}:
+		for _, recipient := range value {
+			if r, ok := recipient.(string); ok {
+				candidates = append(candidates, r)
+			}
+		}
+	}
+	var recipients []string
+	for _, candidate := range candidates {
+		address, err := mail.ParseAddress(strings.TrimSpace(candidate))
+		if err != nil {
+			return fmt.Errorf("invalid email recipient %q", candidate)
+		}
+		recipients = append(recipients, address.Address)
+	}
+	if len(recipients) == 0 {
+		return fmt.Errorf("no email recipients configured")
+	}
+
+	subject := fmt.Sprintf("[%s] %s", strings.ToUpper(notification.Severity), notification.Title)
+	body := fmt.Sprintf("%s\r\n\r\nKind: %s\r\nCategory: %s\r\nID: %s\r\nTime: %s\r\n",
+		notification.Description,
+		notification.Kind,
+		notification.Category,
+		notification.ID,
+		notification.Timestamp.Format(time.RFC1123),
+	)
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		s.config.SMTPFrom, strings.Join(recipients, ", "), headerValue(subject), body)
+
+	var auth smtp.Auth
+	if s.config.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", s.config.SMTPUsername, s.config.SMTPPassword, s.config.SMTPHost)
+	}
+
+	addr := fmt.Sprintf("%s:%s", s.config.SMTPHost, s.config.SMTPPort)
+	return smtp.SendMail(addr, auth, s.config.SMTPFrom, recipients, []byte(message))
+}
+
+// newNotificationClient returns the client for user-supplied destinations.
+// Unless allowPrivate is set it refuses to connect to loopback, private,
+// link-local and other internal addresses, checked on the resolved address
+// of every connection so redirects and DNS rebinding cannot get around it.
+func newNotificationClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || internalAddress(ip) {
+				return fmt.Errorf("destination %s is not allowed", host)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+func internalAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// 100.64.0.0/10, used for carrier-grade NAT and by some cluster networks
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// headerValue strips CR and LF so a value cannot start a new header, and
+// MIME-encodes anything that is not plain ASCII
+func headerValue(value string) string {
+	value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+	return mime.QEncoding.Encode("utf-8", value)
+}
+
+func (s *SecurityService) postJSON(url string, payload []byte, headers map[string]string) error {
+	if url == "" {
+		return fmt.Errorf("no destination URL configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := s.notify.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("destination returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Pick up incidents and critical threats created anywhere since the last run
+func (s *SecurityService) startNotificationDispatcher() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	since := time.Now().UTC()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now().UTC()
+
+			var incidents []SecurityIncident
+			s.db.Where("created_at > ?", since).Find(&incidents)
+			for i := range incidents {
+				s.notifySecurityIncident(&incidents[i])
+			}
+
+			var threats []ThreatDetection
+			s.db.Where("created_at > ? AND threat_level = ?", since, ThreatLevelCritical).Find(&threats)
+			for i := range threats {
+				s.notifyThreatDetection(&threats[i])
+			}
+
+			since = now
+		}
+	}
+}
+
+// Hide credentials in channel config before returning it
+func redactChannel(channel *NotificationChannel) *NotificationChannel {
+	redacted := *channel
+	redacted.Config = make(map[string]interface{}, len(channel.Config))
+	for key, value := range channel.Config {
+		switch key {
+		case "secret", "routing_key", "webhook_url":
+			redacted.Config[key] = redactedValue
+		default:
+			redacted.Config[key] = value
+		}
+	}
+	return &redacted
+}
+
+func configString(config map[string]interface{}, key string) string {
+	if value, ok := config[key].(string); ok {
+		return value
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Breached password check against the Have I Been Pwned range API. Only the
+// first five characters of the password's SHA-1 hash leave the service
+// (k-anonymity); the returned suffix list is matched locally. Ranges are
+// cached in Redis since they change rarely and the API is shared.
+
+const hibpRangeCachePrefix = "hibp_range:"
+
+var passwordBreachChecks = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "password_breach_checks_total",
+		Help: "Password breach checks by result",
+	},
+	[]string{"result"}, // clean, breached, error
+)
+
+func init() {
+	prometheus.MustRegister(passwordBreachChecks)
+}
+
+// checkPasswordBreach returns how many times the password appears in known
+// breaches
+func (s *SecurityService) checkPasswordBreach(ctx context.Context, password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	body, err := s.hibpRange(ctx, prefix)
+	if err != nil {
+		passwordBreachChecks.WithLabelValues("error").Inc()
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		candidate, count, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok || candidate != suffix {
+			continue
+		}
+		// Padding entries carry a count of zero
+		n, _ := strconv.Atoi(count)
+		if n > 0 {
+			passwordBreachChecks.WithLabelValues("breached").Inc()
+			return n, nil
+		}
+		break
+	}
+
+	passwordBreachChecks.WithLabelValues("clean").Inc()
+	return 0, nil
+}
+
+// hibpRange fetches the hash suffixes for a prefix, via the Redis cache
+func (s *SecurityService) hibpRange(ctx context.Context, prefix string) (string, error) {
+	key := hibpRangeCachePrefix + prefix
+	if cached, err := s.redis.Get(ctx, key).Result(); err == nil {
+		return cached, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.config.HIBPAPIURL+"/range/"+prefix, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Add-Padding", "true")
+	req.Header.Set("User-Agent", "002aic-security-service")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d from breach API", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return "", err
+	}
+	body := string(data)
+
+	s.redis.Set(ctx, key, body, s.config.PasswordBreachCacheTTL)
+	return body, nil
+}
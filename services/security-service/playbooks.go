@@ -0,0 +1,672 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Incident playbooks. A playbook matches incidents by category and severity
+// and runs once per incident when it is opened: it assigns an owner, runs its
+// containment actions and records every step in the incident timeline. If
+// the incident is still unresolved when the playbook SLA runs out it is
+// escalated.
+
+// Incident statuses
+const (
+	IncidentStatusOpen          = "open"
+	IncidentStatusInvestigating = "investigating"
+	IncidentStatusContained     = "contained"
+	IncidentStatusResolved      = "resolved"
+)
+
+// Playbook action types
+const (
+	PlaybookActionTimeline  = "timeline"
+	PlaybookActionBlockIP   = "block_ip"
+	PlaybookActionWebhook   = "webhook"
+	PlaybookActionNotify    = "notify"
+	PlaybookActionSetStatus = "set_status"
+)
+
+// Playbook run statuses
+const (
+	PlaybookRunCompleted = "completed"
+	PlaybookRunPartial   = "partial"
+)
+
+const defaultBlockDuration = time.Hour
+
+// IncidentPlaybook is a workflow triggered when a matching incident opens
+type IncidentPlaybook struct {
+	ID          string                   `json:"id" gorm:"primaryKey"`
+	Name        string                   `json:"name" gorm:"uniqueIndex;not null"`
+	Description string                   `json:"description"`
+	Categories  []string                 `json:"categories" gorm:"type:text[]"`
+	Severities  []string                 `json:"severities" gorm:"type:text[]"`
+	AssignTo    string                   `json:"assign_to"`
+	SLAMinutes  int                      `json:"sla_minutes"`
+	Escalation  map[string]interface{}   `json:"escalation" gorm:"type:jsonb"`
+	Actions     []map[string]interface{} `json:"actions" gorm:"type:jsonb"`
+	IsActive    bool                     `json:"is_active" gorm:"default:true"`
+	Priority    int                      `json:"priority" gorm:"default:0"`
+	CreatedBy   string                   `json:"created_by"`
+	CreatedAt   time.Time                `json:"created_at"`
+	UpdatedAt   time.Time                `json:"updated_at"`
+}
+
+// IncidentPlaybookRun records that a playbook ran for an incident
+type IncidentPlaybookRun struct {
+	ID          string                   `json:"id" gorm:"primaryKey"`
+	IncidentID  string                   `json:"incident_id" gorm:"uniqueIndex:idx_playbook_run_incident"`
+	PlaybookID  string                   `json:"playbook_id" gorm:"uniqueIndex:idx_playbook_run_incident"`
+	Status      string                   `json:"status"`
+	Results     []map[string]interface{} `json:"results" gorm:"type:jsonb"`
+	SLADeadline *time.Time               `json:"sla_deadline" gorm:"index"`
+	EscalatedAt *time.Time               `json:"escalated_at"`
+	CreatedAt   time.Time                `json:"created_at"`
+}
+
+// PlaybookAction is the typed form of an entry in IncidentPlaybook.Actions
+type PlaybookAction struct {
+	Type            string            `json:"type"`
+	Message         string            `json:"message,omitempty"`
+	IP              string            `json:"ip,omitempty"`
+	EvidenceKey     string            `json:"evidence_key,omitempty"`
+	DurationMinutes int               `json:"duration_minutes,omitempty"`
+	URL             string            `json:"url,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	Status          string            `json:"status,omitempty"`
+}
+
+// PlaybookEscalation is the typed form of IncidentPlaybook.Escalation
+type PlaybookEscalation struct {
+	AssignTo string `json:"assign_to"`
+	Severity string `json:"severity"`
+	Notify   bool   `json:"notify"`
+}
+
+var severityRank = map[string]int{
+	ThreatLevelLow:      1,
+	ThreatLevelMedium:   2,
+	ThreatLevelHigh:     3,
+	ThreatLevelCritical: 4,
+}
+
+type playbookRequest struct {
+	Name        string                   `json:"name" binding:"required"`
+	Description string                   `json:"description"`
+	Categories  []string                 `json:"categories"`
+	Severities  []string                 `json:"severities"`
+	AssignTo    string                   `json:"assign_to"`
+	SLAMinutes  int                      `json:"sla_minutes"`
+	Escalation  map[string]interface{}   `json:"escalation"`
+	Actions     []map[string]interface{} `json:"actions"`
+	IsActive    *bool                    `json:"is_active"`
+	Priority    int                      `json:"priority"`
+}
+
+func (r *playbookRequest) validate() error {
+	if r.SLAMinutes < 0 {
+		return fmt.Errorf("sla_minutes must not be negative")
+	}
+	for _, severity := range r.Severities {
+		if _, ok := severityRank[severity]; !ok {
+			return fmt.Errorf("unknown severity %q", severity)
+		}
+	}
+	if r.Escalation != nil {
+		escalation, err := decodeEscalation(r.Escalation)
+		if err != nil {
+			return fmt.Errorf("invalid escalation: %w", err)
+		}
+		if _, ok := severityRank[escalation.Severity]; escalation.Severity != "" && !ok {
+			return fmt.Errorf("unknown escalation severity %q", escalation.Severity)
+		}
+	}
+	actions, err := decodeActions(r.Actions)
+	if err != nil {
+		return err
+	}
+	for i, action := range actions {
+		switch action.Type {
+		case PlaybookActionTimeline:
+			if action.Message == "" {
+				return fmt.Errorf("action %d: timeline requires message", i)
+			}
+		case PlaybookActionBlockIP:
+			if action.IP != "" && net.ParseIP(action.IP) == nil {
+				return fmt.Errorf("action %d: invalid ip %q", i, action.IP)
+			}
+		case PlaybookActionWebhook:
+			if action.URL == "" {
+				return fmt.Errorf("action %d: webhook requires url", i)
+			}
+		case PlaybookActionSetStatus:
+			switch action.Status {
+			case IncidentStatusOpen, IncidentStatusInvestigating, IncidentStatusContained:
+			default:
+				return fmt.Errorf("action %d: unsupported status %q", i, action.Status)
+			}
+		case PlaybookActionNotify:
+		default:
+			return fmt.Errorf("action %d: unknown type %q", i, action.Type)
+		}
+	}
+	return nil
+}
+
+func decodeActions(raw []map[string]interface{}) ([]PlaybookAction, error) {
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var actions []PlaybookAction
+	if err := json.Unmarshal(data, &actions); err != nil {
+		return nil, fmt.Errorf("invalid actions: %w", err)
+	}
+	return actions, nil
+}
+
+func decodeEscalation(raw map[string]interface{}) (PlaybookEscalation, error) {
+	var escalation PlaybookEscalation
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return escalation, err
+	}
+	err = json.Unmarshal(data, &escalation)
+	return escalation, err
+}
+
+// Create an incident playbook
+func (s *SecurityService) createPlaybook(c *gin.Context) {
+	var request playbookRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := request.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now().UTC()
+	playbook := &IncidentPlaybook{
+		ID:          uuid.New().String(),
+		Name:        request.Name,
+		Description: request.Description,
+		Categories:  request.Categories,
+		Severities:  request.Severities,
+		AssignTo:    request.AssignTo,
+		SLAMinutes:  request.SLAMinutes,
+		Escalation:  request.Escalation,
+		Actions:     request.Actions,
+		IsActive:    request.IsActive == nil || *request.IsActive,
+		Priority:    request.Priority,
+		CreatedBy:   c.GetHeader("X-User-ID"),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	if err := s.db.Create(playbook).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create playbook"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, playbook)
+}
+
+// List incident playbooks
+func (s *SecurityService) listPlaybooks(c *gin.Context) {
+	query := s.db.Model(&IncidentPlaybook{})
+	if active := c.Query("is_active"); active != "" {
+		query = query.Where("is_active = ?", active == "true")
+	}
+
+	var playbooks []IncidentPlaybook
+	if err := query.Order("priority DESC, name ASC").Find(&playbooks).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list playbooks"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"playbooks": playbooks,
+		"total":     len(playbooks),
+	})
+}
+
+// Get an incident playbook
+func (s *SecurityService) getPlaybook(c *gin.Context) {
+	var playbook IncidentPlaybook
+	if err := s.db.First(&playbook, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Playbook not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, playbook)
+}
+
+// Replace an incident playbook
+func (s *SecurityService) updatePlaybook(c *gin.Context) {
+	var playbook IncidentPlaybook
+	if err := s.db.First(&playbook, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Playbook not found"})
+		return
+	}
+
+	var request playbookRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := request.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	playbook.Name = request.Name
+	playbook.Description = request.Description
+	playbook.Categories = request.Categories
+	playbook.Severities = request.Severities
+	playbook.AssignTo = request.AssignTo
+	playbook.SLAMinutes = request.SLAMinutes
+	playbook.Escalation = request.Escalation
+	playbook.Actions = request.Actions
+	playbook.Priority = request.Priority
+	if request.IsActive != nil {
+		playbook.IsActive = *request.IsActive
+	}
+	playbook.UpdatedAt = time.Now().UTC()
+
+	if err := s.db.Save(&playbook).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update playbook"})
+		return
+	}
+
+	c.JSON(http.StatusOK, playbook)
+}
+
+// Delete an incident playbook
+func (s *SecurityService) deletePlaybook(c *gin.Context) {
+	result := s.db.Delete(&IncidentPlaybook{}, "id = ?", c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete playbook"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Playbook not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Playbook deleted"})
+}
+
+// Run a playbook against an incident on demand
+func (s *SecurityService) runPlaybook(c *gin.Context) {
+	var incident SecurityIncident
+	if err := s.scoped(c).First(&incident, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Incident not found"})
+		return
+	}
+	var playbook IncidentPlaybook
+	if err := s.db.First(&playbook, "id = ?", c.Param("playbook_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Playbook not found"})
+		return
+	}
+
+	run, err := s.executePlaybook(&playbook, &incident, c.GetHeader("X-User-ID"))
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, run)
+}
+
+// Get an incident's timeline and playbook runs
+func (s *SecurityService) getIncidentTimeline(c *gin.Context) {
+	var incident SecurityIncident
+	if err := s.scoped(c).First(&incident, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Incident not found"})
+		return
+	}
+
+	var runs []IncidentPlaybookRun
+	s.db.Where("incident_id = ?", incident.ID).Order("created_at ASC").Find(&runs)
+
+	timeline := incident.Timeline
+	if timeline == nil {
+		timeline = []map[string]interface{}{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"incident_id":   incident.ID,
+		"timeline":      timeline,
+		"playbook_runs": runs,
+	})
+}
+
+// Add a manual note to an incident's timeline
+func (s *SecurityService) addIncidentTimelineEntry(c *gin.Context) {
+	var request struct {
+		Message string                 `json:"message" binding:"required"`
+		Type    string                 `json:"type"`
+		Details map[string]interface{} `json:"details"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Type == "" {
+		request.Type = "note"
+	}
+
+	var incident SecurityIncident
+	if err := s.scoped(c).Select("id").First(&incident, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Incident not found"})
+		return
+	}
+
+	actor := c.GetHeader("X-User-ID")
+	if actor == "" {
+		actor = "unknown"
+	}
+
+	entry, err := s.appendIncidentTimeline(c.Param("id"), request.Type, actor, request.Message, request.Details)
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Incident not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update timeline"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, entry)
+}
+
+// appendIncidentTimeline adds an entry under a row lock so concurrent
+// writers don't lose each other's entries
+func (s *SecurityService) appendIncidentTimeline(incidentID, entryType, actor, message string, details map[string]interface{}) (map[string]interface{}, error) {
+	entry := map[string]interface{}{
+		"id":        uuid.New().String(),
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"type":      entryType,
+		"actor":     actor,
+		"message":   message,
+	}
+	if len(details) > 0 {
+		entry["details"] = details
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var incident SecurityIncident
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&incident, "id = ?", incidentID).Error; err != nil {
+			return err
+		}
+		incident.Timeline = append(incident.Timeline, entry)
+		incident.UpdatedAt = time.Now().UTC()
+		return tx.Save(&incident).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func playbookMatches(playbook *IncidentPlaybook, incident *SecurityIncident) bool {
+	return matchesAny(playbook.Categories, incident.Category) && matchesAny(playbook.Severities, incident.Severity)
+}
+
+// executePlaybook runs a playbook once for an incident. Action failures are
+// recorded in the timeline and the run is marked partial; they don't stop
+// the remaining actions.
+func (s *SecurityService) executePlaybook(playbook *IncidentPlaybook, incident *SecurityIncident, triggeredBy string) (*IncidentPlaybookRun, error) {
+	now := time.Now().UTC()
+	run := &IncidentPlaybookRun{
+		ID:         uuid.New().String(),
+		IncidentID: incident.ID,
+		PlaybookID: playbook.ID,
+		Status:     PlaybookRunCompleted,
+		CreatedAt:  now,
+	}
+	if playbook.SLAMinutes > 0 {
+		deadline := now.Add(time.Duration(playbook.SLAMinutes) * time.Minute)
+		run.SLADeadline = &deadline
+	}
+
+	// The unique index makes the run record the claim, so two runners never
+	// execute the same playbook for the same incident
+	if err := s.db.Create(run).Error; err != nil {
+		return nil, fmt.Errorf("playbook %s already ran for incident %s", playbook.Name, incident.ID)
+	}
+
+	actor := "playbook:" + playbook.Name
+	details := map[string]interface{}{"playbook_id": playbook.ID, "run_id": run.ID}
+	if triggeredBy != "" {
+		details["triggered_by"] = triggeredBy
+	}
+	s.appendIncidentTimeline(incident.ID, "playbook", actor, fmt.Sprintf("Playbook %s started", playbook.Name), details)
+
+	if playbook.AssignTo != "" && incident.AssignedTo == "" {
+		s.db.Model(&SecurityIncident{}).Where("id = ?", incident.ID).Updates(map[string]interface{}{
+			"assigned_to": playbook.AssignTo,
+			"updated_at":  time.Now().UTC(),
+		})
+		incident.AssignedTo = playbook.AssignTo
+		s.appendIncidentTimeline(incident.ID, "assignment", actor, fmt.Sprintf("Assigned to %s", playbook.AssignTo), nil)
+	}
+
+	actions, err := decodeActions(playbook.Actions)
+	if err != nil {
+		actions = nil
+		run.Status = PlaybookRunPartial
+		run.Results = append(run.Results, map[string]interface{}{"error": err.Error()})
+	}
+
+	for i, action := range actions {
+		result := map[string]interface{}{"index": i, "type": action.Type}
+		message, err := s.executePlaybookAction(action, incident)
+		if err != nil {
+			run.Status = PlaybookRunPartial
+			result["status"] = "failed"
+			result["error"] = err.Error()
+			s.appendIncidentTimeline(incident.ID, "action", actor, fmt.Sprintf("Action %s failed: %v", action.Type, err), nil)
+		} else {
+			result["status"] = "succeeded"
+			if message != "" {
+				s.appendIncidentTimeline(incident.ID, "action", actor, message, nil)
+			}
+		}
+		run.Results = append(run.Results, result)
+	}
+
+	if err := s.db.Save(run).Error; err != nil {
+		log.Printf("Failed to record playbook run %s: %v", run.ID, err)
+	}
+	return run, nil
+}
+
+// executePlaybookAction performs one action and returns the timeline message
+func (s *SecurityService) executePlaybookAction(action PlaybookAction, incident *SecurityIncident) (string, error) {
+	switch action.Type {
+	case PlaybookActionTimeline:
+		return action.Message, nil
+
+	case PlaybookActionBlockIP:
+		ip := action.IP
+		if ip == "" {
+			key := action.EvidenceKey
+			if key == "" {
+				key = "ip_address"
+			}
+			ip, _ = incident.Evidence[key].(string)
+		}
+		if net.ParseIP(ip) == nil {
+			return "", fmt.Errorf("no valid IP address to block")
+		}
+		duration := defaultBlockDuration
+		if action.DurationMinutes > 0 {
+			duration = time.Duration(action.DurationMinutes) * time.Minute
+		}
+		if err := s.blockIP(ip, duration, "incident:"+incident.ID); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Blocked IP %s for %s", ip, duration), nil
+
+	case PlaybookActionWebhook:
+		payload, _ := json.Marshal(map[string]interface{}{
+			"event":    "incident_playbook_action",
+			"incident": incident,
+		})
+		if err := s.postJSON(action.URL, payload, action.Headers); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Called containment webhook %s", action.URL), nil
+
+	case PlaybookActionNotify:
+		s.notifySecurityIncident(incident)
+		return "Notification dispatched", nil
+
+	case PlaybookActionSetStatus:
+		err := s.db.Model(&SecurityIncident{}).Where("id = ?", incident.ID).Updates(map[string]interface{}{
+			"status":     action.Status,
+			"updated_at": time.Now().UTC(),
+		}).Error
+		if err != nil {
+			return "", err
+		}
+		incident.Status = action.Status
+		return fmt.Sprintf("Status set to %s", action.Status), nil
+	}
+	return "", fmt.Errorf("unknown action type %q", action.Type)
+}
+
+// blockIP adds an address to the block list enforced by securityMiddleware
+func (s *SecurityService) blockIP(ip string, duration time.Duration, reason string) error {
+	key := fmt.Sprintf("blocked_ip:%s", ip)
+	return s.redis.Set(context.Background(), key, reason, duration).Err()
+}
+
+// Escalate incidents whose playbook SLA has passed
+func (s *SecurityService) escalateBreachedIncidents() {
+	now := time.Now().UTC()
+
+	var runs []IncidentPlaybookRun
+	s.db.Where("escalated_at IS NULL AND sla_deadline IS NOT NULL AND sla_deadline < ?", now).Find(&runs)
+
+	for i := range runs {
+		run := &runs[i]
+
+		// Claim the escalation before acting on it
+		claimed := s.db.Model(&IncidentPlaybookRun{}).
+			Where("id = ? AND escalated_at IS NULL", run.ID).
+			Update("escalated_at", now)
+		if claimed.Error != nil || claimed.RowsAffected == 0 {
+			continue
+		}
+
+		var incident SecurityIncident
+		if err := s.db.First(&incident, "id = ?", run.IncidentID).Error; err != nil {
+			continue
+		}
+		if incident.ResolvedAt != nil || incident.Status == IncidentStatusResolved {
+			continue
+		}
+
+		var playbook IncidentPlaybook
+		if err := s.db.First(&playbook, "id = ?", run.PlaybookID).Error; err != nil {
+			continue
+		}
+		escalation, _ := decodeEscalation(playbook.Escalation)
+
+		updates := map[string]interface{}{"updated_at": now}
+		if escalation.AssignTo != "" {
+			updates["assigned_to"] = escalation.AssignTo
+			incident.AssignedTo = escalation.AssignTo
+		}
+		if severityRank[escalation.Severity] > severityRank[incident.Severity] {
+			updates["severity"] = escalation.Severity
+			incident.Severity = escalation.Severity
+		}
+		s.db.Model(&SecurityIncident{}).Where("id = ?", incident.ID).Updates(updates)
+
+		s.appendIncidentTimeline(incident.ID, "escalation", "playbook:"+playbook.Name,
+			fmt.Sprintf("SLA of %d minutes breached, incident escalated", playbook.SLAMinutes),
+			map[string]interface{}{
+				"assigned_to":  incident.AssignedTo,
+				"severity":     incident.Severity,
+				"sla_deadline": run.SLADeadline.Format(time.RFC3339),
+			})
+
+		if escalation.Notify {
+			s.dispatchNotification(&SecurityNotification{
+				TenantID:    incident.TenantID,
+				Kind:        NotificationKindIncident,
+				ID:          incident.ID + ":escalated",
+				Title:       fmt.Sprintf("Escalated: %s", incident.Title),
+				Description: fmt.Sprintf("Incident unresolved after the %d minute SLA of playbook %s", playbook.SLAMinutes, playbook.Name),
+				Severity:    incident.Severity,
+				Category:    incident.Category,
+				Timestamp:   now,
+				Details: map[string]interface{}{
+					"incident_id": incident.ID,
+					"assigned_to": incident.AssignedTo,
+					"status":      incident.Status,
+				},
+			})
+		}
+	}
+}
+
+// Run matching playbooks for newly opened incidents and enforce SLAs
+func (s *SecurityService) startPlaybookRunner() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var playbooks []IncidentPlaybook
+		if err := s.db.Where("is_active = ?", true).Order("priority DESC").Find(&playbooks).Error; err != nil {
+			log.Printf("Playbook runner: failed to load playbooks: %v", err)
+			continue
+		}
+
+		if len(playbooks) > 0 {
+			// Incidents without a run yet for some matching playbook
+			var incidents []SecurityIncident
+			s.db.Where("resolved_at IS NULL AND created_at > ?", time.Now().UTC().Add(-24*time.Hour)).Find(&incidents)
+
+			for i := range incidents {
+				incident := &incidents[i]
+				var ran []string
+				s.db.Model(&IncidentPlaybookRun{}).Where("incident_id = ?", incident.ID).Pluck("playbook_id", &ran)
+				done := make(map[string]bool, len(ran))
+				for _, id := range ran {
+					done[id] = true
+				}
+
+				for j := range playbooks {
+					// Playbooks apply to incidents opened after they were created
+					if done[playbooks[j].ID] || incident.CreatedAt.Before(playbooks[j].CreatedAt) || !playbookMatches(&playbooks[j], incident) {
+						continue
+					}
+					if _, err := s.executePlaybook(&playbooks[j], incident, ""); err != nil {
+						log.Printf("Playbook runner: %v", err)
+					}
+				}
+			}
+		}
+
+		s.escalateBreachedIncidents()
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Policy decision log. Every access decision, whether made for
+// /v1/validate/access or the /v1/policies/evaluate API, is recorded with
+// its full input so it can be audited and replayed against changed
+// policies. Entries are pruned after DECISION_LOG_RETENTION_DAYS.
+
+// Decision sources
+const (
+	DecisionSourceValidateAccess = "validate_access"
+	DecisionSourceEvaluate       = "evaluate"
+)
+
+const decisionPruneBatch = 5000
+
+// PolicyDecisionLog records one access decision
+type PolicyDecisionLog struct {
+	ID                string    `json:"id" gorm:"primaryKey"`
+	TenantID          string    `json:"tenant_id" gorm:"index;not null;default:'default'"`
+	Source            string    `json:"source" gorm:"index"`
+	SubjectID         string    `json:"subject_id" gorm:"index"`
+	Action            string    `json:"action"`
+	Resource          string    `json:"resource"`
+	Decision          string    `json:"decision" gorm:"index"`
+	PolicyID          string    `json:"policy_id" gorm:"index"`
+	PolicyName        string    `json:"policy_name"`
+	Reason            string    `json:"reason"`
+	EvaluatedPolicies int       `json:"evaluated_policies"`
+	InvalidPolicies   int       `json:"invalid_policies"`
+	Input             string    `json:"input" gorm:"type:jsonb"`
+	DurationMicros    int64     `json:"duration_us"`
+	CreatedAt         time.Time `json:"created_at" gorm:"index"`
+}
+
+var (
+	policyDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "security_policy_decisions_total",
+			Help: "Access policy decisions",
+		},
+		[]string{"source", "decision"},
+	)
+
+	policyEvaluationDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "security_policy_evaluation_duration_seconds",
+			Help:    "Time to evaluate access policies for a request",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(policyDecisions)
+	prometheus.MustRegister(policyEvaluationDuration)
+}
+
+// logDecision assigns the decision an ID and records it in the background
+func (s *SecurityService) logDecision(tenantID, source string, request *AccessRequest, decision *AccessDecision, took time.Duration) {
+	decision.DecisionID = uuid.New().String()
+	policyDecisions.WithLabelValues(source, decision.Decision).Inc()
+	policyEvaluationDuration.Observe(took.Seconds())
+
+	input, _ := json.Marshal(regoInput(request))
+	entry := &PolicyDecisionLog{
+		ID:                decision.DecisionID,
+		TenantID:          tenantID,
+		Source:            source,
+		SubjectID:         request.UserID,
+		Action:            request.Action,
+		Resource:          request.Resource,
+		Decision:          decision.Decision,
+		PolicyID:          decision.PolicyID,
+		PolicyName:        decision.PolicyName,
+		Reason:            decision.Reason,
+		EvaluatedPolicies: decision.EvaluatedCount,
+		InvalidPolicies:   len(decision.InvalidPolicies),
+		Input:             string(input),
+		DurationMicros:    took.Microseconds(),
+		CreatedAt:         time.Now().UTC(),
+	}
+	go func() {
+		if err := s.db.Create(entry).Error; err != nil {
+			log.Printf("Failed to log policy decision %s: %v", entry.ID, err)
+		}
+	}()
+}
+
+type policyEvaluationRequest struct {
+	Subject struct {
+		ID         string                 `json:"id" binding:"required"`
+		Roles      []string               `json:"roles"`
+		Attributes map[string]interface{} `json:"attributes"`
+	} `json:"subject" binding:"required"`
+	Action   string                 `json:"action" binding:"required"`
+	Resource string                 `json:"resource" binding:"required"`
+	Context  map[string]interface{} `json:"context"`
+
+	// Evaluate only these policies, active or not, e.g. to try out a
+	// policy before activating it
+	PolicyIDs []string `json:"policy_ids"`
+}
+
+// Evaluate access policies for a subject, action and resource
+func (s *SecurityService) evaluatePolicies(c *gin.Context) {
+	var req policyEvaluationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	request := AccessRequest{
+		UserID:     req.Subject.ID,
+		Roles:      req.Subject.Roles,
+		Attributes: req.Subject.Attributes,
+		Resource:   req.Resource,
+		Action:     req.Action,
+		Context:    req.Context,
+	}
+	// The context may pin the client address and the time of the request
+	if ip, ok := req.Context["ip_address"].(string); ok {
+		request.IPAddress = ip
+	} else {
+		request.IPAddress = c.ClientIP()
+	}
+	request.Time = time.Now().UTC()
+	if at, ok := req.Context["time"].(string); ok {
+		parsed, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "context.time must be RFC3339"})
+			return
+		}
+		request.Time = parsed
+	}
+	delete(request.Context, "ip_address")
+	delete(request.Context, "time")
+
+	query := s.scoped(c).Where("type = ?", PolicyTypeAccess)
+	if len(req.PolicyIDs) > 0 {
+		query = query.Where("id IN ?", req.PolicyIDs)
+	} else {
+		query = query.Where("is_active = ?", true)
+	}
+	var policies []SecurityPolicy
+	if err := query.Order("priority DESC, created_at ASC").Find(&policies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load access policies"})
+		return
+	}
+
+	start := time.Now()
+	decision := s.evaluateAccess(c.Request.Context(), policies, &request)
+	s.logDecision(s.writeTenant(c), DecisionSourceEvaluate, &request, decision, time.Since(start))
+
+	c.JSON(http.StatusOK, gin.H{
+		"decision": decision,
+		"input":    regoInput(&request),
+	})
+}
+
+// List logged policy decisions
+func (s *SecurityService) listPolicyDecisions(c *gin.Context) {
+	query, ok := applyTimeRange(c, s.scoped(c).Model(&PolicyDecisionLog{}), "created_at")
+	if !ok {
+		return
+	}
+
+	var decisions []PolicyDecisionLog
+	if err := applyListFilters(c, query, "source", "subject_id", "decision", "policy_id", "action").
+		Order("created_at DESC").Find(&decisions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list policy decisions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"decisions": decisions,
+		"total":     len(decisions),
+	})
+}
+
+// pruneDecisionLogs deletes decisions older than the retention period
+func (s *SecurityService) pruneDecisionLogs() error {
+	cutoff := time.Now().Add(-s.config.DecisionLogRetention)
+	for {
+		result := s.db.Exec(
+			"DELETE FROM policy_decision_logs WHERE id IN (SELECT id FROM policy_decision_logs WHERE created_at < ? LIMIT ?)",
+			cutoff, decisionPruneBatch)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected < decisionPruneBatch {
+			return nil
+		}
+	}
+}
+
+func (s *SecurityService) startDecisionLogPruner() {
+	if s.config.DecisionLogRetention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.pruneDecisionLogs(); err != nil {
+				log.Printf("Failed to prune policy decision logs: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Access policy evaluation for /v1/validate/access.
+//
+// Access policies keep their statements in SecurityPolicy.Rules:
+//
+//	{
+//	  "statements": [{
+//	    "effect": "allow" | "deny",
+//	    "users": ["alice", "*"],          // optional, glob patterns
+//	    "roles": ["admin"],               // optional, any role matches
+//	    "resources": ["models/*"],        // optional, glob patterns
+//	    "actions": ["read", "deploy"],    // optional, glob patterns
+//	    "conditions": {
+//	      "time_of_day": {"start": "09:00", "end": "18:00", "timezone": "Europe/Berlin"},
+//	      "days_of_week": ["mon", "tue", "wed", "thu", "fri"],
+//	      "ip_ranges": ["10.0.0.0/8"],
+//	      "not_ip_ranges": ["10.13.0.0/16"]
+//	    }
+//	  }]
+//	}
+//
+// A rules object with a top-level "effect" is treated as a single statement.
+// Policies with language "rego" hold a Rego module instead (see
+// policy_rego.go). Policies are evaluated in priority order with
+// deny-overrides semantics: any matching deny wins, otherwise the
+// highest-priority matching allow applies, and a request no statement
+// matches is denied. Every decision is written to the decision log (see
+// policy_decisions.go).
+
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// AccessRequest is the input to policy evaluation
+type AccessRequest struct {
+	UserID     string                 `json:"user_id" binding:"required"`
+	Roles      []string               `json:"roles"`
+	Attributes map[string]interface{} `json:"attributes"` // subject attributes, for Rego policies
+	Resource   string                 `json:"resource" binding:"required"`
+	Action     string                 `json:"action" binding:"required"`
+	IPAddress  string                 `json:"ip_address"`
+	Time       time.Time              `json:"time"`
+	Context    map[string]interface{} `json:"context"` // further request context, for Rego policies
+}
+
+// AccessDecision is the result of policy evaluation
+type AccessDecision struct {
+	DecisionID      string   `json:"decision_id,omitempty"`
+	Allowed         bool     `json:"allowed"`
+	Decision        string   `json:"decision"`
+	PolicyID        string   `json:"policy_id,omitempty"`
+	PolicyName      string   `json:"policy_name,omitempty"`
+	Statement       int      `json:"statement"`
+	Reason          string   `json:"reason"`
+	EvaluatedCount  int      `json:"evaluated_policies"`
+	InvalidPolicies []string `json:"invalid_policies,omitempty"`
+}
+
+type policyStatement struct {
+	Effect     string
+	Users      []string
+	Roles      []string
+	Resources  []string
+	Actions    []string
+	Conditions policyConditions
+}
+
+type policyConditions struct {
+	TimeStart   int // minutes after midnight, -1 when unset
+	TimeEnd     int
+	Location    *time.Location
+	DaysOfWeek  map[time.Weekday]bool
+	IPRanges    []*net.IPNet
+	NotIPRanges []*net.IPNet
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Validate access against active access policies
+func (s *SecurityService) validateAccess(c *gin.Context) {
+	var request AccessRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.IPAddress == "" {
+		request.IPAddress = c.ClientIP()
+	}
+	if request.Time.IsZero() {
+		request.Time = time.Now().UTC()
+	}
+
+	var policies []SecurityPolicy
+	if err := s.scoped(c).Where("type = ? AND is_active = ?", PolicyTypeAccess, true).
+		Order("priority DESC, created_at ASC").
+		Find(&policies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load access policies"})
+		return
+	}
+
+	start := time.Now()
+	decision := s.evaluateAccess(c.Request.Context(), policies, &request)
+	s.logDecision(s.writeTenant(c), DecisionSourceValidateAccess, &request, decision, time.Since(start))
+
+	if !decision.Allowed {
+		go s.recordAccessDenied(s.writeTenant(c), &request, decision, c.GetHeader("User-Agent"))
+	}
+
+	c.JSON(http.StatusOK, decision)
+}
+
+// evaluateAccess applies deny-overrides over policies sorted by priority
+func (s *SecurityService) evaluateAccess(ctx context.Context, policies []SecurityPolicy, request *AccessRequest) *AccessDecision {
+	decision := &AccessDecision{
+		Decision:  EffectDeny,
+		Statement: -1,
+		Reason:    "no matching policy",
+	}
+
+	var (
+		allow *AccessDecision
+		input map[string]interface{}
+	)
+	for i := range policies {
+		policy := &policies[i]
+		if policy.Language == PolicyLanguageRego {
+			if input == nil {
+				input = regoInput(request)
+			}
+			effect, reason, err := s.evaluateRego(ctx, policy, input)
+			if err != nil {
+				// A policy that can't be evaluated may have been meant to
+				// deny, so fail closed rather than let another policy allow
+				log.Printf("Access policy %s failed to evaluate: %v", policy.ID, err)
+				decision.InvalidPolicies = append(decision.InvalidPolicies, policy.ID)
+				decision.PolicyID = policy.ID
+				decision.PolicyName = policy.Name
+				decision.Reason = fmt.Sprintf("policy %s could not be evaluated", policy.Name)
+				return decision
+			}
+			decision.EvaluatedCount++
+
+			switch effect {
+			case EffectDeny:
+				if reason == "" {
+					reason = fmt.Sprintf("denied by policy %s", policy.Name)
+				}
+				decision.PolicyID = policy.ID
+				decision.PolicyName = policy.Name
+				decision.Reason = reason
+				return decision
+			case EffectAllow:
+				if allow == nil {
+					allow = &AccessDecision{PolicyID: policy.ID, PolicyName: policy.Name, Statement: -1, Reason: reason}
+				}
+			}
+			continue
+		}
+
+		statements, err := compilePolicyRules(policy.Rules)
+		if err != nil {
+			log.Printf("Skipping invalid access policy %s: %v", policy.ID, err)
+			decision.InvalidPolicies = append(decision.InvalidPolicies, policy.ID)
+			continue
+		}
+		decision.EvaluatedCount++
+
+		for i, statement := range statements {
+			if !statement.matches(request) {
+				continue
+			}
+			if statement.Effect == EffectDeny {
+				decision.Decision = EffectDeny
+				decision.PolicyID = policy.ID
+				decision.PolicyName = policy.Name
+				decision.Statement = i
+				decision.Reason = fmt.Sprintf("denied by policy %s", policy.Name)
+				return decision
+			}
+			if allow == nil {
+				allow = &AccessDecision{PolicyID: policy.ID, PolicyName: policy.Name, Statement: i}
+			}
+		}
+	}
+
+	if allow != nil {
+		decision.Allowed = true
+		decision.Decision = EffectAllow
+		decision.PolicyID = allow.PolicyID
+		decision.PolicyName = allow.PolicyName
+		decision.Statement = allow.Statement
+		decision.Reason = allow.Reason
+		if decision.Reason == "" {
+			decision.Reason = fmt.Sprintf("allowed by policy %s", allow.PolicyName)
+		}
+	}
+	return decision
+}
+
+func (st *policyStatement) matches(request *AccessRequest) bool {
+	if len(st.Users) > 0 && !matchesPattern(st.Users, request.UserID) {
+		return false
+	}
+	if len(st.Roles) > 0 {
+		found := false
+		for _, role := range request.Roles {
+			if matchesPattern(st.Roles, role) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(st.Resources) > 0 && !matchesPattern(st.Resources, request.Resource) {
+		return false
+	}
+	if len(st.Actions) > 0 && !matchesPattern(st.Actions, request.Action) {
+		return false
+	}
+	return st.Conditions.matches(request)
+}
+
+func (pc *policyConditions) matches(request *AccessRequest) bool {
+	at := request.Time.In(pc.Location)
+
+	if len(pc.DaysOfWeek) > 0 && !pc.DaysOfWeek[at.Weekday()] {
+		return false
+	}
+
+	if pc.TimeStart >= 0 {
+		minute := at.Hour()*60 + at.Minute()
+		if pc.TimeStart <= pc.TimeEnd {
+			if minute < pc.TimeStart || minute >= pc.TimeEnd {
+				return false
+			}
+		} else if minute < pc.TimeStart && minute >= pc.TimeEnd {
+			// Window wraps past midnight
+			return false
+		}
+	}
+
+	if len(pc.IPRanges) > 0 || len(pc.NotIPRanges) > 0 {
+		ip := net.ParseIP(request.IPAddress)
+		if ip == nil {
+			return false
+		}
+		if len(pc.IPRanges) > 0 && !inRanges(pc.IPRanges, ip) {
+			return false
+		}
+		if inRanges(pc.NotIPRanges, ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compilePolicyRules parses SecurityPolicy.Rules into statements
+func compilePolicyRules(rules map[string]interface{}) ([]policyStatement, error) {
+	var raw []interface{}
+	if _, ok := rules["effect"]; ok {
+		raw = []interface{}{rules}
+	} else if list, ok := rules["statements"].([]interface{}); ok {
+		raw = list
+	} else {
+		return nil, fmt.Errorf("rules must contain statements or an effect")
+	}
+
+	statements := make([]policyStatement, 0, len(raw))
+	for i, item := range raw {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("statement %d is not an object", i)
+		}
+
+		effect, _ := fields["effect"].(string)
+		effect = strings.ToLower(effect)
+		if effect != EffectAllow && effect != EffectDeny {
+			return nil, fmt.Errorf("statement %d: effect must be allow or deny", i)
+		}
+
+		statement := policyStatement{
+			Effect:    effect,
+			Users:     stringList(fields["users"]),
+			Roles:     stringList(fields["roles"]),
+			Resources: stringList(fields["resources"]),
+			Actions:   stringList(fields["actions"]),
+		}
+
+		conditions, _ := fields["conditions"].(map[string]interface{})
+		compiled, err := compileConditions(conditions)
+		if err != nil {
+			return nil, fmt.Errorf("statement %d: %w", i, err)
+		}
+		statement.Conditions = compiled
+
+		statements = append(statements, statement)
+	}
+	return statements, nil
+}
+
+func compileConditions(conditions map[string]interface{}) (policyConditions, error) {
+	compiled := policyConditions{TimeStart: -1, TimeEnd: -1, Location: time.UTC}
+
+	if window, ok := conditions["time_of_day"].(map[string]interface{}); ok {
+		start, err := parseClock(window["start"])
+		if err != nil {
+			return compiled, fmt.Errorf("time_of_day.start: %w", err)
+		}
+		end, err := parseClock(window["end"])
+		if err != nil {
+			return compiled, fmt.Errorf("time_of_day.end: %w", err)
+		}
+		compiled.TimeStart, compiled.TimeEnd = start, end
+
+		if tz, _ := window["timezone"].(string); tz != "" {
+			location, err := time.LoadLocation(tz)
+			if err != nil {
+				return compiled, fmt.Errorf("time_of_day.timezone: %w", err)
+			}
+			compiled.Location = location
+		}
+	}
+
+	if days := stringList(conditions["days_of_week"]); len(days) > 0 {
+		compiled.DaysOfWeek = make(map[time.Weekday]bool)
+		for _, day := range days {
+			key := strings.ToLower(day)
+			if len(key) > 3 {
+				key = key[:3]
+			}
+			weekday, ok := weekdays[key]
+			if !ok {
+				return compiled, fmt.Errorf("invalid day of week %q", day)
+			}
+			compiled.DaysOfWeek[weekday] = true
+		}
+	}
+
+	var err error
+	if compiled.IPRanges, err = parseCIDRs(stringList(conditions["ip_ranges"])); err != nil {
+		return compiled, err
+	}
+	if compiled.NotIPRanges, err = parseCIDRs(stringList(conditions["not_ip_ranges"])); err != nil {
+		return compiled, err
+	}
+
+	return compiled, nil
+}
+
+// parseClock converts "HH:MM" into minutes after midnight
+func parseClock(value interface{}) (int, error) {
+	str, _ := value.(string)
+	parsed, err := time.Parse("15:04", str)
+	if err != nil {
+		return 0, fmt.Errorf("expected HH:MM, got %q", str)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// parseCIDRs accepts CIDR ranges or bare addresses
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	ranges := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil {
+				bits := 32
+				if ip.To4() == nil {
+					bits = 128
+				}
+				value = fmt.Sprintf("%s/%d", value, bits)
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range %q", value)
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return ranges, nil
+}
+
+func inRanges(ranges []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ranges {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPattern reports whether value matches one of the glob patterns. A
+// trailing "*" matches any suffix, including further path segments.
+func matchesPattern(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == value {
+			return true
+		}
+		if strings.HasSuffix(pattern, "*") && !strings.ContainsAny(pattern[:len(pattern)-1], "*?[") {
+			if strings.HasPrefix(value, pattern[:len(pattern)-1]) {
+				return true
+			}
+			continue
+		}
+		if ok, err := path.Match(pattern, value); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if str, ok := item.(string); ok {
+				list = append(list, str)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// Record denied access decisions as permission_denied security events
+func (s *SecurityService) recordAccessDenied(tenantID string, request *AccessRequest, decision *AccessDecision, userAgent string) {
+	now := time.Now().UTC()
+	event := &SecurityEvent{
+		ID:        uuid.New().String(),
+		TenantID:  tenantID,
+		Type:      EventTypePermissionDenied,
+		Severity:  ThreatLevelLow,
+		UserID:    request.UserID,
+		IPAddress: request.IPAddress,
+		UserAgent: userAgent,
+		Resource:  request.Resource,
+		Action:    request.Action,
+		Result:    EffectDeny,
+		Details: map[string]interface{}{
+			"policy_id":   decision.PolicyID,
+			"policy_name": decision.PolicyName,
+			"reason":      decision.Reason,
+			"roles":       request.Roles,
+		},
+		Timestamp: now,
+		CreatedAt: now,
+	}
+	if err := s.db.Create(event).Error; err != nil {
+		log.Printf("Failed to record access denial for %s: %v", request.UserID, err)
+		return
+	}
+	securityEventsTotal.WithLabelValues(event.Type, event.Severity).Inc()
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+)
+
+// Rego access policies. An access policy with language "rego" keeps an OPA
+// Rego module (Rego v1 syntax) in Source instead of JSON statements in
+// Rules. The module is evaluated with the request as input:
+//
+//	{
+//	  "subject":  {"id": "alice", "roles": ["admin"], "attributes": {...}},
+//	  "action":   "deploy",
+//	  "resource": "models/fraud",
+//	  "context":  {"ip_address": "10.0.0.1", "time": "2024-03-17T10:00:00Z", "weekday": "sun", ...}
+//	}
+//
+// and its package may define:
+//
+//	allow  - true to allow the request
+//	deny   - true, or a non-empty set of messages, to deny it
+//	reason - a message explaining the decision
+//
+// For example:
+//
+//	package models.deploy
+//
+//	default allow := false
+//
+//	allow if {
+//	    input.action == "deploy"
+//	    "ml-engineer" in input.subject.roles
+//	}
+//
+//	deny contains "deploys are frozen on weekends" if {
+//	    input.context.weekday in {"sat", "sun"}
+//	}
+//
+// A Rego policy takes part in the same deny-overrides evaluation as
+// statement policies: deny acts like a matching deny statement, allow like a
+// matching allow statement, and neither like no match. A policy that fails
+// to compile or evaluate, or takes longer than regoEvalTimeout, denies.
+
+// Policy languages
+const (
+	PolicyLanguageStatements = "statements"
+	PolicyLanguageRego       = "rego"
+)
+
+const regoEvalTimeout = 2 * time.Second
+
+type preparedRego struct {
+	updatedAt time.Time
+	query     rego.PreparedEvalQuery
+}
+
+// regoCache keeps prepared Rego policies by policy ID, preparing a policy
+// again when it has been updated
+type regoCache struct {
+	mu       sync.Mutex
+	policies map[string]*preparedRego
+}
+
+func newRegoCache() *regoCache {
+	return &regoCache{policies: make(map[string]*preparedRego)}
+}
+
+// prepareRego compiles a Rego module into a query for its package document
+func prepareRego(ctx context.Context, name, source string) (rego.PreparedEvalQuery, error) {
+	filename := name + ".rego"
+	module, err := ast.ParseModule(filename, source)
+	if err != nil {
+		return rego.PreparedEvalQuery{}, err
+	}
+	if module == nil {
+		return rego.PreparedEvalQuery{}, fmt.Errorf("empty Rego module")
+	}
+
+	return rego.New(
+		rego.Query(module.Package.Path.String()),
+		rego.Module(filename, source),
+	).PrepareForEval(ctx)
+}
+
+func (rc *regoCache) get(ctx context.Context, policy *SecurityPolicy) (rego.PreparedEvalQuery, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if prepared, ok := rc.policies[policy.ID]; ok && prepared.updatedAt.Equal(policy.UpdatedAt) {
+		return prepared.query, nil
+	}
+	query, err := prepareRego(ctx, policy.ID, policy.Source)
+	if err != nil {
+		delete(rc.policies, policy.ID)
+		return rego.PreparedEvalQuery{}, err
+	}
+	rc.policies[policy.ID] = &preparedRego{updatedAt: policy.UpdatedAt, query: query}
+	return query, nil
+}
+
+func (rc *regoCache) forget(policyID string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	delete(rc.policies, policyID)
+}
+
+// regoInput is the input document a request is evaluated against
+func regoInput(request *AccessRequest) map[string]interface{} {
+	roles := request.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	attributes := request.Attributes
+	if attributes == nil {
+		attributes = map[string]interface{}{}
+	}
+
+	environment := make(map[string]interface{}, len(request.Context)+3)
+	for key, value := range request.Context {
+		environment[key] = value
+	}
+	environment["ip_address"] = request.IPAddress
+	environment["time"] = request.Time.UTC().Format(time.RFC3339)
+	environment["weekday"] = strings.ToLower(request.Time.UTC().Weekday().String()[:3])
+
+	return map[string]interface{}{
+		"subject": map[string]interface{}{
+			"id":         request.UserID,
+			"roles":      roles,
+			"attributes": attributes,
+		},
+		"action":   request.Action,
+		"resource": request.Resource,
+		"context":  environment,
+	}
+}
+
+// evaluateRego runs a Rego policy and returns its effect, or "" when it
+// neither allows nor denies the request
+func (s *SecurityService) evaluateRego(ctx context.Context, policy *SecurityPolicy, input map[string]interface{}) (string, string, error) {
+	query, err := s.regoPolicies.get(ctx, policy)
+	if err != nil {
+		return "", "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, regoEvalTimeout)
+	defer cancel()
+
+	results, err := query.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return "", "", err
+	}
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		return "", "", nil
+	}
+	document, _ := results[0].Expressions[0].Value.(map[string]interface{})
+	reason, _ := document["reason"].(string)
+
+	switch deny := document["deny"].(type) {
+	case bool:
+		if deny {
+			return EffectDeny, reason, nil
+		}
+	case []interface{}:
+		if len(deny) > 0 {
+			if reason == "" {
+				messages := make([]string, 0, len(deny))
+				for _, message := range deny {
+					messages = append(messages, fmt.Sprint(message))
+				}
+				reason = strings.Join(messages, "; ")
+			}
+			return EffectDeny, reason, nil
+		}
+	}
+	if allow, _ := document["allow"].(bool); allow {
+		return EffectAllow, reason, nil
+	}
+	return "", "", nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Security posture scoring. A background scorer periodically rates the
+// platform, and each tenant, from 0 (worst) to 100 from four components:
+// open vulnerabilities weighted by CVSS, unresolved incidents, coverage of the
+// core policy types, and the trend of high-severity events. Snapshots are
+// kept so regressions show up both in the API and as a drop in the
+// security_posture_score gauge.
+
+// Component weights; they sum to 1
+const (
+	postureWeightVulnerabilities = 0.40
+	postureWeightIncidents       = 0.25
+	postureWeightPolicyCoverage  = 0.20
+	postureWeightEventTrend      = 0.15
+
+	// Penalty at which a component has dropped to about 37 (1/e) of 100
+	postureVulnerabilityScale = 40.0
+	postureIncidentScale      = 20.0
+
+	// Tenant label used for the platform-wide score
+	posturePlatformLabel = "_platform"
+)
+
+// Policy types every tenant is expected to have at least one active policy for
+var posturePolicyTypes = []string{
+	PolicyTypePassword,
+	PolicyTypeAccess,
+	PolicyTypeEncryption,
+	PolicyTypeAudit,
+	PolicyTypeCompliance,
+}
+
+// Assumed CVSS base score for vulnerabilities reported without one
+var severityCVSS = map[string]float64{
+	ThreatLevelCritical: 9.5,
+	ThreatLevelHigh:     7.5,
+	ThreatLevelMedium:   5.0,
+	ThreatLevelLow:      2.0,
+}
+
+var incidentSeverityWeight = map[string]float64{
+	ThreatLevelCritical: 10,
+	ThreatLevelHigh:     5,
+	ThreatLevelMedium:   2,
+	ThreatLevelLow:      1,
+}
+
+// PostureScore is one snapshot of a tenant's (or, with an empty TenantID, the
+// platform's) security posture
+type PostureScore struct {
+	ID         string                 `json:"id" gorm:"primaryKey"`
+	TenantID   string                 `json:"tenant_id" gorm:"index"`
+	Score      float64                `json:"score"`
+	Grade      string                 `json:"grade"`
+	Components map[string]interface{} `json:"components" gorm:"type:jsonb"`
+	ComputedAt time.Time              `json:"computed_at" gorm:"index"`
+}
+
+var (
+	postureScoreGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "security_posture_score",
+			Help: "Security posture score from 0 to 100",
+		},
+		[]string{"tenant"},
+	)
+
+	postureComponentGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "security_posture_component_score",
+			Help: "Security posture component scores from 0 to 100",
+		},
+		[]string{"tenant", "component"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(postureScoreGauge)
+	prometheus.MustRegister(postureComponentGauge)
+}
+
+func postureGrade(score float64) string {
+	switch {
+	case score >= 90:
+		return "A"
+	case score >= 80:
+		return "B"
+	case score >= 70:
+		return "C"
+	case score >= 60:
+		return "D"
+	default:
+		return "F"
+	}
+}
+
+func roundScore(score float64) float64 {
+	return math.Round(score*10) / 10
+}
+
+// computePosture scores one tenant; an empty tenant scores the platform
+func (s *SecurityService) computePosture(tenantID string) (*PostureScore, error) {
+	db := s.tenantDB(tenantID)
+	now := time.Now().UTC()
+
+	// Open vulnerabilities, weighted by CVSS base score
+	var vulns []VulnerabilityReport
+	if err := db.Select("severity", "details").Where("resolved_at IS NULL").Find(&vulns).Error; err != nil {
+		return nil, err
+	}
+	cvssTotal := 0.0
+	for _, vuln := range vulns {
+		score, ok := vuln.Details["cvss_score"].(float64)
+		if !ok || score <= 0 {
+			score = severityCVSS[vuln.Severity]
+		}
+		cvssTotal += score
+	}
+	vulnScore := 100 * math.Exp(-cvssTotal/postureVulnerabilityScale)
+
+	// Unresolved incidents, weighted by severity
+	var incidents []struct {
+		Severity string
+		Count    int64
+	}
+	if err := db.Model(&SecurityIncident{}).Select("severity, COUNT(*) AS count").
+		Where("resolved_at IS NULL").Group("severity").Scan(&incidents).Error; err != nil {
+		return nil, err
+	}
+	incidentWeight, openIncidents := 0.0, int64(0)
+	for _, row := range incidents {
+		weight, ok := incidentSeverityWeight[row.Severity]
+		if !ok {
+			weight = 1
+		}
+		incidentWeight += weight * float64(row.Count)
+		openIncidents += row.Count
+	}
+	incidentScore := 100 * math.Exp(-incidentWeight/postureIncidentScale)
+
+	// Policy types with at least one active policy
+	var coveredTypes []string
+	if err := db.Model(&SecurityPolicy{}).Where("is_active = ? AND type IN ?", true, posturePolicyTypes).
+		Distinct().Pluck("type", &coveredTypes).Error; err != nil {
+		return nil, err
+	}
+	coverageScore := 100 * float64(len(coveredTypes)) / float64(len(posturePolicyTypes))
+
+	// High-severity events in the last day against the previous week's daily
+	// average. Holding steady or improving scores 100.
+	severe := []string{ThreatLevelHigh, ThreatLevelCritical}
+	var recent, baseline int64
+	db.Model(&SecurityEvent{}).Where("severity IN ? AND timestamp >= ?", severe, now.Add(-24*time.Hour)).Count(&recent)
+	db.Model(&SecurityEvent{}).Where("severity IN ? AND timestamp >= ? AND timestamp < ?",
+		severe, now.Add(-8*24*time.Hour), now.Add(-24*time.Hour)).Count(&baseline)
+	baselineDaily := float64(baseline) / 7
+	trendRatio := (float64(recent) + 1) / (baselineDaily + 1)
+	trendScore := math.Min(100, 100/trendRatio)
+
+	score := postureWeightVulnerabilities*vulnScore +
+		postureWeightIncidents*incidentScore +
+		postureWeightPolicyCoverage*coverageScore +
+		postureWeightEventTrend*trendScore
+
+	return &PostureScore{
+		ID:       uuid.New().String(),
+		TenantID: tenantID,
+		Score:    roundScore(score),
+		Grade:    postureGrade(score),
+		Components: map[string]interface{}{
+			"vulnerabilities": map[string]interface{}{
+				"score":      roundScore(vulnScore),
+				"weight":     postureWeightVulnerabilities,
+				"open":       len(vulns),
+				"cvss_total": roundScore(cvssTotal),
+			},
+			"incidents": map[string]interface{}{
+				"score":           roundScore(incidentScore),
+				"weight":          postureWeightIncidents,
+				"open":            openIncidents,
+				"severity_weight": incidentWeight,
+			},
+			"policy_coverage": map[string]interface{}{
+				"score":    roundScore(coverageScore),
+				"weight":   postureWeightPolicyCoverage,
+				"covered":  coveredTypes,
+				"expected": posturePolicyTypes,
+			},
+			"event_trend": map[string]interface{}{
+				"score":               roundScore(trendScore),
+				"weight":              postureWeightEventTrend,
+				"severe_last_24h":     recent,
+				"severe_daily_avg_7d": roundScore(baselineDaily),
+				"ratio":               roundScore(trendRatio),
+			},
+		},
+		ComputedAt: now,
+	}, nil
+}
+
+// scorePosture computes, stores and exports the platform score and the
+// score of every tenant with security data
+func (s *SecurityService) scorePosture() {
+	tenants := map[string]bool{"": true}
+	for _, model := range []interface{}{&SecurityEvent{}, &VulnerabilityReport{}, &SecurityIncident{}, &SecurityPolicy{}} {
+		var ids []string
+		s.db.Model(model).Distinct().Pluck("tenant_id", &ids)
+		for _, id := range ids {
+			tenants[id] = true
+		}
+	}
+
+	for tenantID := range tenants {
+		posture, err := s.computePosture(tenantID)
+		if err != nil {
+			log.Printf("Posture scoring failed for tenant %q: %v", tenantID, err)
+			continue
+		}
+		if err := s.db.Create(posture).Error; err != nil {
+			log.Printf("Failed to store posture score for tenant %q: %v", tenantID, err)
+		}
+
+		label := tenantID
+		if label == "" {
+			label = posturePlatformLabel
+		}
+		postureScoreGauge.WithLabelValues(label).Set(posture.Score)
+		for name, component := range posture.Components {
+			if values, ok := component.(map[string]interface{}); ok {
+				postureComponentGauge.WithLabelValues(label, name).Set(values["score"].(float64))
+			}
+		}
+	}
+
+	s.db.Where("computed_at < ?", time.Now().UTC().Add(-s.config.PostureHistoryRetention)).Delete(&PostureScore{})
+}
+
+func (s *SecurityService) startPostureScorer() {
+	if s.config.PostureScoreInterval <= 0 {
+		return
+	}
+
+	s.scorePosture()
+
+	ticker := time.NewTicker(s.config.PostureScoreInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.scorePosture()
+		}
+	}
+}
+
+// Current security posture of the caller's tenant, or of the platform for
+// platform admins, with its recent history
+func (s *SecurityService) getSecurityPosture(c *gin.Context) {
+	tenantID := tenantOf(c)
+
+	var latest PostureScore
+	if err := s.db.Where("tenant_id = ?", tenantID).Order("computed_at DESC").First(&latest).Error; err != nil {
+		// Not scored yet
+		posture, err := s.computePosture(tenantID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute security posture"})
+			return
+		}
+		latest = *posture
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", "7"))
+	if err != nil || days <= 0 {
+		days = 7
+	}
+	var history []PostureScore
+	s.db.Select("score", "grade", "computed_at").
+		Where("tenant_id = ? AND computed_at >= ?", tenantID, time.Now().UTC().AddDate(0, 0, -days)).
+		Order("computed_at ASC").Find(&history)
+
+	response := gin.H{
+		"posture": latest,
+		"history": history,
+	}
+	if len(history) > 0 {
+		change := roundScore(latest.Score - history[0].Score)
+		response["change"] = change
+		response["regressed"] = change < 0
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// List and get handlers for security records. All reads go through
+// scoped(c) so callers only ever see their own tenant's data.
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// applyListFilters adds equality filters for the given query parameters and
+// pagination
+func applyListFilters(c *gin.Context, query *gorm.DB, columns ...string) *gorm.DB {
+	for _, column := range columns {
+		if value := c.Query(column); value != "" {
+			query = query.Where(column+" = ?", value)
+		}
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultListLimit)))
+	if err != nil || limit <= 0 || limit > maxListLimit {
+		limit = defaultListLimit
+	}
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if offset < 0 {
+		offset = 0
+	}
+	return query.Limit(limit).Offset(offset)
+}
+
+// applyTimeRange filters column by the optional RFC3339 since/until parameters
+func applyTimeRange(c *gin.Context, query *gorm.DB, column string) (*gorm.DB, bool) {
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be RFC3339"})
+			return nil, false
+		}
+		query = query.Where(column+" >= ?", t)
+	}
+	if until := c.Query("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "until must be RFC3339"})
+			return nil, false
+		}
+		query = query.Where(column+" < ?", t)
+	}
+	return query, true
+}
+
+// List security events
+func (s *SecurityService) listSecurityEvents(c *gin.Context) {
+	query, ok := applyTimeRange(c, s.scoped(c).Model(&SecurityEvent{}), "timestamp")
+	if !ok {
+		return
+	}
+	query = applyListFilters(c, query, "type", "severity", "user_id", "ip_address", "resource")
+
+	var events []SecurityEvent
+	if err := query.Order("timestamp DESC").Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list security events"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events": events,
+		"total":  len(events),
+	})
+}
+
+// Get a security event
+func (s *SecurityService) getSecurityEvent(c *gin.Context) {
+	var event SecurityEvent
+	if err := s.scoped(c).First(&event, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Security event not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, event)
+}
+
+// List detected threats
+func (s *SecurityService) listThreats(c *gin.Context) {
+	query, ok := applyTimeRange(c, s.scoped(c).Model(&ThreatDetection{}), "created_at")
+	if !ok {
+		return
+	}
+	query = applyListFilters(c, query, "type", "threat_level", "status", "assigned_to")
+
+	var threats []ThreatDetection
+	if err := query.Order("created_at DESC").Find(&threats).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list threats"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"threats": threats,
+		"total":   len(threats),
+	})
+}
+
+// Get a detected threat
+func (s *SecurityService) getThreat(c *gin.Context) {
+	var threat ThreatDetection
+	if err := s.scoped(c).First(&threat, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Threat not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, threat)
+}
+
+// List security policies
+func (s *SecurityService) listSecurityPolicies(c *gin.Context) {
+	query := s.scoped(c).Model(&SecurityPolicy{})
+	if active := c.Query("is_active"); active != "" {
+		query = query.Where("is_active = ?", active == "true")
+	}
+	query = applyListFilters(c, query, "type")
+
+	var policies []SecurityPolicy
+	if err := query.Order("priority DESC, name ASC").Find(&policies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list policies"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"policies": policies,
+		"total":    len(policies),
+	})
+}
+
+// Get a security policy
+func (s *SecurityService) getSecurityPolicy(c *gin.Context) {
+	var policy SecurityPolicy
+	if err := s.scoped(c).First(&policy, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Policy not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// List vulnerability reports
+func (s *SecurityService) listVulnerabilities(c *gin.Context) {
+	query, ok := applyTimeRange(c, s.scoped(c).Model(&VulnerabilityReport{}), "created_at")
+	if !ok {
+		return
+	}
+	query = applyListFilters(c, query, "severity", "status", "cve_id", "component", "assigned_to")
+
+	var vulnerabilities []VulnerabilityReport
+	if err := query.Order("created_at DESC").Find(&vulnerabilities).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list vulnerabilities"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"vulnerabilities": vulnerabilities,
+		"total":           len(vulnerabilities),
+	})
+}
+
+// Get a vulnerability report
+func (s *SecurityService) getVulnerability(c *gin.Context) {
+	var vulnerability VulnerabilityReport
+	if err := s.scoped(c).First(&vulnerability, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Vulnerability not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, vulnerability)
+}
+
+// List security incidents
+func (s *SecurityService) listSecurityIncidents(c *gin.Context) {
+	query, ok := applyTimeRange(c, s.scoped(c).Model(&SecurityIncident{}), "created_at")
+	if !ok {
+		return
+	}
+	query = applyListFilters(c, query, "severity", "status", "category", "assigned_to")
+
+	var incidents []SecurityIncident
+	if err := query.Order("created_at DESC").Find(&incidents).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list incidents"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"incidents": incidents,
+		"total":     len(incidents),
+	})
+}
+
+// Get a security incident
+func (s *SecurityService) getSecurityIncident(c *gin.Context) {
+	var incident SecurityIncident
+	if err := s.scoped(c).First(&incident, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Incident not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, incident)
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Rate limiting. Policies live in Postgres and apply to every request whose
+// path starts with RoutePrefix, counted per client IP, per user or globally.
+// Each policy has a sustained limit over WindowSeconds and an optional burst
+// limit over BurstWindowSeconds; both are sliding-window counters in Redis
+// (current fixed window plus the overlapping share of the previous one).
+// Policies are cached in memory and reloaded when any replica changes them,
+// and every rateLimitReloadInterval as a fallback. Policies are platform-wide,
+// so only platform admins may see or change them.
+
+const (
+	RateLimitScopeIP     = "ip"
+	RateLimitScopeUser   = "user"
+	RateLimitScopeGlobal = "global"
+
+	rateLimitChannel        = "rate_limit_policies:changed"
+	rateLimitReloadInterval = 30 * time.Second
+)
+
+type RateLimitPolicy struct {
+	ID                 string    `json:"id" gorm:"primaryKey"`
+	Name               string    `json:"name" gorm:"uniqueIndex;not null"`
+	Description        string    `json:"description"`
+	RoutePrefix        string    `json:"route_prefix" gorm:"index"`
+	Scope              string    `json:"scope" gorm:"not null"`
+	Limit              int       `json:"limit" gorm:"not null"`
+	WindowSeconds      int       `json:"window_seconds" gorm:"not null"`
+	Burst              int       `json:"burst"`
+	BurstWindowSeconds int       `json:"burst_window_seconds"`
+	IsActive           bool      `json:"is_active" gorm:"default:true"`
+	CreatedBy          string    `json:"created_by"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+type rateLimitPolicyRequest struct {
+	Name               string `json:"name" binding:"required"`
+	Description        string `json:"description"`
+	RoutePrefix        string `json:"route_prefix"`
+	Scope              string `json:"scope" binding:"required,oneof=ip user global"`
+	Limit              int    `json:"limit" binding:"required,min=1"`
+	WindowSeconds      int    `json:"window_seconds" binding:"required,min=1"`
+	Burst              int    `json:"burst" binding:"min=0"`
+	BurstWindowSeconds int    `json:"burst_window_seconds" binding:"min=0"`
+	IsActive           *bool  `json:"is_active"`
+}
+
+func (r *rateLimitPolicyRequest) validate() error {
+	if r.RoutePrefix != "" && !strings.HasPrefix(r.RoutePrefix, "/") {
+		return fmt.Errorf("route_prefix must start with /")
+	}
+	if r.Burst > 0 {
+		if r.BurstWindowSeconds <= 0 {
+			r.BurstWindowSeconds = 1
+		}
+		if r.BurstWindowSeconds >= r.WindowSeconds {
+			return fmt.Errorf("burst_window_seconds must be shorter than window_seconds")
+		}
+	}
+	return nil
+}
+
+func (r *rateLimitPolicyRequest) apply(policy *RateLimitPolicy) {
+	policy.Name = r.Name
+	policy.Description = r.Description
+	policy.RoutePrefix = r.RoutePrefix
+	policy.Scope = r.Scope
+	policy.Limit = r.Limit
+	policy.WindowSeconds = r.WindowSeconds
+	policy.Burst = r.Burst
+	policy.BurstWindowSeconds = r.BurstWindowSeconds
+	if r.IsActive != nil {
+		policy.IsActive = *r.IsActive
+	}
+}
+
+// rateLimiter holds the active policies, longest route prefix first
+type rateLimiter struct {
+	mu       sync.RWMutex
+	policies []RateLimitPolicy
+}
+
+func (l *rateLimiter) set(policies []RateLimitPolicy) {
+	sort.SliceStable(policies, func(i, j int) bool {
+		return len(policies[i].RoutePrefix) > len(policies[j].RoutePrefix)
+	})
+	l.mu.Lock()
+	l.policies = policies
+	l.mu.Unlock()
+}
+
+// matching returns the policies that apply to path
+func (l *rateLimiter) matching(path string) []RateLimitPolicy {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var matched []RateLimitPolicy
+	for _, policy := range l.policies {
+		if strings.HasPrefix(path, policy.RoutePrefix) {
+			matched = append(matched, policy)
+		}
+	}
+	return matched
+}
+
+var rateLimitRejections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rate_limit_rejections_total",
+		Help: "Requests rejected by rate limit policy",
+	},
+	[]string{"policy", "window"},
+)
+
+func init() {
+	prometheus.MustRegister(rateLimitRejections)
+}
+
+// Checks the sustained and burst windows together so a request rejected by
+// either is not counted against the other. Returns {allowed, sustained
+// estimate, burst estimate}.
+var slidingWindowScript = redis.NewScript(`
+local function estimate(current_key, previous_key, weight)
+  local current = tonumber(redis.call('GET', current_key) or '0')
+  local previous = tonumber(redis.call('GET', previous_key) or '0')
+  return previous * weight + current
+end
+
+local sustained = estimate(KEYS[1], KEYS[2], tonumber(ARGV[1]))
+if sustained >= tonumber(ARGV[2]) then
+  return {0, math.floor(sustained), -1}
+end
+
+local burst = -1
+if #KEYS == 4 then
+  burst = estimate(KEYS[3], KEYS[4], tonumber(ARGV[4]))
+  if burst >= tonumber(ARGV[5]) then
+    return {0, math.floor(sustained), math.floor(burst)}
+  end
+  redis.call('INCR', KEYS[3])
+  redis.call('EXPIRE', KEYS[3], tonumber(ARGV[6]))
+  burst = burst + 1
+end
+
+redis.call('INCR', KEYS[1])
+redis.call('EXPIRE', KEYS[1], tonumber(ARGV[3]))
+return {1, math.floor(sustained + 1), math.floor(burst)}
+`)
+
+// windowKeys returns the current and previous window keys for a counter and
+// how much of the previous window still overlaps the sliding window
+func windowKeys(base string, window time.Duration, now time.Time) (string, string, float64) {
+	size := window.Nanoseconds()
+	index := now.UnixNano() / size
+	elapsed := float64(now.UnixNano()-index*size) / float64(size)
+	return fmt.Sprintf("%s:%d", base, index), fmt.Sprintf("%s:%d", base, index-1), 1 - elapsed
+}
+
+type rateLimitResult struct {
+	allowed   bool
+	policy    *RateLimitPolicy
+	remaining int
+	window    string // sustained, burst
+}
+
+// checkRateLimit counts the request against one policy
+func (s *SecurityService) checkRateLimit(ctx context.Context, policy *RateLimitPolicy, subject string, now time.Time) (*rateLimitResult, error) {
+	base := fmt.Sprintf("rate_limit:%s:%s", policy.ID, subject)
+	window := time.Duration(policy.WindowSeconds) * time.Second
+
+	current, previous, weight := windowKeys(base, window, now)
+	keys := []string{current, previous}
+	args := []interface{}{weight, policy.Limit, policy.WindowSeconds * 2}
+
+	if policy.Burst > 0 {
+		burstWindow := time.Duration(policy.BurstWindowSeconds) * time.Second
+		burstCurrent, burstPrevious, burstWeight := windowKeys(base+":burst", burstWindow, now)
+		keys = append(keys, burstCurrent, burstPrevious)
+		args = append(args, burstWeight, policy.Burst, policy.BurstWindowSeconds*2)
+	}
+
+	values, err := slidingWindowScript.Run(ctx, s.redis, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &rateLimitResult{
+		allowed:   values[0] == 1,
+		policy:    policy,
+		remaining: policy.Limit - int(values[1]),
+		window:    "sustained",
+	}
+	if !result.allowed && values[2] >= 0 && int(values[1]) < policy.Limit {
+		result.window = "burst"
+	}
+	if result.remaining < 0 {
+		result.remaining = 0
+	}
+	return result, nil
+}
+
+// rateLimitSubject identifies who a request is counted against
+func (s *SecurityService) rateLimitSubject(c *gin.Context, scope string) string {
+	switch scope {
+	case RateLimitScopeGlobal:
+		return "global"
+	case RateLimitScopeUser:
+		if raw := bearerToken(c); raw != "" {
+			if token, _, err := s.parseToken(raw); err == nil {
+				if claims, ok := token.Claims.(jwt.MapClaims); ok {
+					if sub, ok := claims["sub"].(string); ok && sub != "" {
+						return "user:" + sub
+					}
+				}
+			}
+		}
+		if userID := c.GetHeader("X-User-ID"); userID != "" {
+			return "user:" + userID
+		}
+		// Anonymous callers are limited by address
+		return "ip:" + c.ClientIP()
+	default:
+		return "ip:" + c.ClientIP()
+	}
+}
+
+// Check if the request exceeds any matching rate limit policy. Redis
+// failures fail open.
+func (s *SecurityService) isRateLimited(c *gin.Context) bool {
+	policies := s.rateLimits.matching(c.Request.URL.Path)
+	if len(policies) == 0 {
+		return false
+	}
+
+	now := time.Now()
+	var tightest *rateLimitResult
+	for i := range policies {
+		policy := &policies[i]
+		result, err := s.checkRateLimit(c.Request.Context(), policy, s.rateLimitSubject(c, policy.Scope), now)
+		if err != nil {
+			log.Printf("Rate limit check failed for policy %s: %v", policy.Name, err)
+			continue
+		}
+		if !result.allowed {
+			rateLimitRejections.WithLabelValues(policy.Name, result.window).Inc()
+			c.Header("X-RateLimit-Policy", policy.Name)
+			c.Header("X-RateLimit-Limit", strconv.Itoa(policy.Limit))
+			c.Header("X-RateLimit-Remaining", "0")
+			retryAfter := policy.WindowSeconds
+			if result.window == "burst" {
+				retryAfter = policy.BurstWindowSeconds
+			}
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			return true
+		}
+		if tightest == nil || result.remaining < tightest.remaining {
+			tightest = result
+		}
+	}
+
+	if tightest != nil {
+		c.Header("X-RateLimit-Limit", strconv.Itoa(tightest.policy.Limit))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(tightest.remaining))
+	}
+	return false
+}
+
+// reloadRateLimitPolicies refreshes the in-memory policies from Postgres
+func (s *SecurityService) reloadRateLimitPolicies() error {
+	var policies []RateLimitPolicy
+	if err := s.db.Where("is_active = ?", true).Find(&policies).Error; err != nil {
+		return err
+	}
+	s.rateLimits.set(policies)
+	return nil
+}
+
+// initializeRateLimitPolicies seeds the default policy, which keeps the
+// historical limit of RateLimitDefaultRPM requests per minute per IP
+func (s *SecurityService) initializeRateLimitPolicies() error {
+	var count int64
+	if err := s.db.Model(&RateLimitPolicy{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		policy := &RateLimitPolicy{
+			ID:            uuid.New().String(),
+			Name:          "default",
+			Description:   "Per-IP limit for all routes",
+			Scope:         RateLimitScopeIP,
+			Limit:         s.config.RateLimitDefaultRPM,
+			WindowSeconds: 60,
+			IsActive:      true,
+			CreatedBy:     "system",
+			CreatedAt:     time.Now().UTC(),
+			UpdatedAt:     time.Now().UTC(),
+		}
+		if err := s.db.Create(policy).Error; err != nil {
+			return err
+		}
+	}
+	return s.reloadRateLimitPolicies()
+}
+
+// Reload policies when another replica changes them, and periodically in
+// case a notification was missed
+func (s *SecurityService) startRateLimitPolicyWatcher() {
+	ctx := context.Background()
+	pubsub := s.redis.Subscribe(ctx, rateLimitChannel)
+	defer pubsub.Close()
+
+	ticker := time.NewTicker(rateLimitReloadInterval)
+	defer ticker.Stop()
+
+	changes := pubsub.Channel()
+	for {
+		select {
+		case <-changes:
+		case <-ticker.C:
+		}
+		if err := s.reloadRateLimitPolicies(); err != nil {
+			log.Printf("Failed to reload rate limit policies: %v", err)
+		}
+	}
+}
+
+func (s *SecurityService) publishRateLimitChange(ctx context.Context) {
+	if err := s.reloadRateLimitPolicies(); err != nil {
+		log.Printf("Failed to reload rate limit policies: %v", err)
+	}
+	if err := s.redis.Publish(ctx, rateLimitChannel, time.Now().UTC().Unix()).Err(); err != nil {
+		log.Printf("Failed to announce rate limit policy change: %v", err)
+	}
+}
+
+// Create a rate limit policy
+func (s *SecurityService) createRateLimitPolicy(c *gin.Context) {
+	var request rateLimitPolicyRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := request.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	policy := &RateLimitPolicy{
+		ID:        uuid.New().String(),
+		IsActive:  true,
+		CreatedBy: c.GetHeader("X-User-ID"),
+		CreatedAt: time.Now().UTC(),
+		UpdatedAt: time.Now().UTC(),
+	}
+	request.apply(policy)
+
+	if err := s.db.Create(policy).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Failed to create rate limit policy: " + err.Error()})
+		return
+	}
+	s.publishRateLimitChange(c.Request.Context())
+
+	c.JSON(http.StatusCreated, policy)
+}
+
+// List rate limit policies
+func (s *SecurityService) listRateLimitPolicies(c *gin.Context) {
+	var policies []RateLimitPolicy
+	if err := s.db.Order("route_prefix ASC, name ASC").Find(&policies).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list rate limit policies"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"policies": policies,
+		"total":    len(policies),
+	})
+}
+
+// Get a rate limit policy
+func (s *SecurityService) getRateLimitPolicy(c *gin.Context) {
+	var policy RateLimitPolicy
+	if err := s.db.First(&policy, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rate limit policy not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// Update a rate limit policy
+func (s *SecurityService) updateRateLimitPolicy(c *gin.Context) {
+	var policy RateLimitPolicy
+	if err := s.db.First(&policy, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rate limit policy not found"})
+		return
+	}
+
+	var request rateLimitPolicyRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := request.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	request.apply(&policy)
+	policy.UpdatedAt = time.Now().UTC()
+	if err := s.db.Save(&policy).Error; err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Failed to update rate limit policy: " + err.Error()})
+		return
+	}
+	s.publishRateLimitChange(c.Request.Context())
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// Delete a rate limit policy
+func (s *SecurityService) deleteRateLimitPolicy(c *gin.Context) {
+	result := s.db.Where("id = ?", c.Param("id")).Delete(&RateLimitPolicy{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete rate limit policy"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rate limit policy not found"})
+		return
+	}
+	s.publishRateLimitChange(c.Request.Context())
+
+	c.JSON(http.StatusOK, gin.H{"message": "Rate limit policy deleted"})
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Security event retention. Events older than EventHotRetention are moved
+// out of Postgres into object storage as gzipped NDJSON, one object per
+// UTC day per archival run:
+//
+//	events/2024/03/17/<partition id>.ndjson.gz
+//
+// Every object is recorded as an EventArchivePartition so the audit query
+// API can find the partitions overlapping a time range without listing the
+// bucket, and read them transparently alongside the hot rows.
+
+const (
+	archiveBatchSize        = 50000
+	archiveDeleteChunk      = 1000
+	maxAuditQueryLimit      = 10000
+	maxAuditQueryPartitions = 400
+)
+
+// EventArchivePartition describes one archived object
+type EventArchivePartition struct {
+	ID           string    `json:"id" gorm:"primaryKey"`
+	Day          time.Time `json:"day" gorm:"index;type:date"`
+	ObjectKey    string    `json:"object_key" gorm:"uniqueIndex;not null"`
+	EventCount   int       `json:"event_count"`
+	MinTimestamp time.Time `json:"min_timestamp" gorm:"index"`
+	MaxTimestamp time.Time `json:"max_timestamp" gorm:"index"`
+	SizeBytes    int64     `json:"size_bytes"`
+	SHA256       string    `json:"sha256"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Guards against overlapping archival runs in one process
+var archiveMutex sync.Mutex
+
+func initEventArchive(config *Config) (*minio.Client, error) {
+	if config.ArchiveS3Endpoint == "" {
+		return nil, nil
+	}
+
+	client, err := minio.New(config.ArchiveS3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.ArchiveS3AccessKey, config.ArchiveS3SecretKey, ""),
+		Secure: config.ArchiveS3UseSSL,
+		Region: config.ArchiveS3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize event archive: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, config.ArchiveS3Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check archive bucket: %w", err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, config.ArchiveS3Bucket, minio.MakeBucketOptions{Region: config.ArchiveS3Region}); err != nil {
+			return nil, fmt.Errorf("failed to create archive bucket: %w", err)
+		}
+	}
+
+	return client, nil
+}
+
+func (s *SecurityService) hotRetentionCutoff() time.Time {
+	return time.Now().UTC().Add(-s.config.EventHotRetention)
+}
+
+func (s *SecurityService) startEventArchivalWorker() {
+	if s.archive == nil || s.config.EventHotRetention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := s.archiveExpiredEvents(); err != nil {
+				log.Printf("Event archival failed: %v", err)
+			}
+		}
+	}
+}
+
+// archiveExpiredEvents moves events past hot retention into object storage.
+// Rows are deleted only after their partition has been uploaded and recorded.
+func (s *SecurityService) archiveExpiredEvents() (int, error) {
+	archiveMutex.Lock()
+	defer archiveMutex.Unlock()
+
+	cutoff := s.hotRetentionCutoff()
+	archived := 0
+
+	for {
+		var events []SecurityEvent
+		if err := s.db.Where("timestamp < ?", cutoff).
+			Order("timestamp ASC").
+			Limit(archiveBatchSize).
+			Find(&events).Error; err != nil {
+			return archived, fmt.Errorf("failed to load expired events: %w", err)
+		}
+		if len(events) == 0 {
+			return archived, nil
+		}
+
+		// Split the batch into UTC days
+		start := 0
+		for i := 1; i <= len(events); i++ {
+			if i < len(events) && sameUTCDay(events[i].Timestamp, events[start].Timestamp) {
+				continue
+			}
+			if err := s.archivePartition(events[start:i]); err != nil {
+				return archived, err
+			}
+			archived += i - start
+			start = i
+		}
+
+		if len(events) < archiveBatchSize {
+			return archived, nil
+		}
+	}
+}
+
+func (s *SecurityService) archivePartition(events []SecurityEvent) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	encoder := json.NewEncoder(gz)
+	for i := range events {
+		if err := encoder.Encode(&events[i]); err != nil {
+			return fmt.Errorf("failed to encode event %s: %w", events[i].ID, err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress partition: %w", err)
+	}
+
+	day := events[0].Timestamp.UTC()
+	partition := &EventArchivePartition{
+		ID:           uuid.New().String(),
+		Day:          time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC),
+		EventCount:   len(events),
+		MinTimestamp: events[0].Timestamp,
+		MaxTimestamp: events[len(events)-1].Timestamp,
+		SizeBytes:    int64(buf.Len()),
+		CreatedAt:    time.Now().UTC(),
+	}
+	partition.ObjectKey = fmt.Sprintf("events/%s/%s.ndjson.gz", day.Format("2006/01/02"), partition.ID)
+	sum := sha256.Sum256(buf.Bytes())
+	partition.SHA256 = hex.EncodeToString(sum[:])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	if _, err := s.archive.PutObject(ctx, s.config.ArchiveS3Bucket, partition.ObjectKey,
+		bytes.NewReader(buf.Bytes()), int64(buf.Len()), minio.PutObjectOptions{
+			ContentType:     "application/x-ndjson",
+			ContentEncoding: "gzip",
+		}); err != nil {
+		return fmt.Errorf("failed to upload partition %s: %w", partition.ObjectKey, err)
+	}
+
+	if err := s.db.Create(partition).Error; err != nil {
+		return fmt.Errorf("failed to record partition %s: %w", partition.ObjectKey, err)
+	}
+
+	ids := make([]string, 0, len(events))
+	for i := range events {
+		ids = append(ids, events[i].ID)
+	}
+	for start := 0; start < len(ids); start += archiveDeleteChunk {
+		end := start + archiveDeleteChunk
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := s.db.Where("id IN ?", ids[start:end]).Delete(&SecurityEvent{}).Error; err != nil {
+			return fmt.Errorf("failed to delete archived events: %w", err)
+		}
+	}
+
+	log.Printf("Archived %d security events to %s", len(events), partition.ObjectKey)
+	return nil
+}
+
+func sameUTCDay(a, b time.Time) bool {
+	a, b = a.UTC(), b.UTC()
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay()
+}
+
+// Query events across hot storage and archived partitions
+func (s *SecurityService) queryAuditEvents(c *gin.Context) {
+	end := time.Now().UTC()
+	start := end.Add(-24 * time.Hour)
+	var err error
+	if value := c.Query("start"); value != "" {
+		if start, err = time.Parse(time.RFC3339, value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start time format"})
+			return
+		}
+	}
+	if value := c.Query("end"); value != "" {
+		if end, err = time.Parse(time.RFC3339, value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end time format"})
+			return
+		}
+	}
+	if !end.After(start) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end must be after start"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "1000"))
+	if limit <= 0 || limit > maxAuditQueryLimit {
+		limit = 1000
+	}
+
+	filters := map[string]string{
+		"type":       c.Query("type"),
+		"severity":   c.Query("severity"),
+		"user_id":    c.Query("user_id"),
+		"ip_address": c.Query("ip_address"),
+		"resource":   c.Query("resource"),
+	}
+
+	// Hot rows
+	query := s.scoped(c).Where("timestamp >= ? AND timestamp < ?", start, end)
+	for column, value := range filters {
+		if value != "" {
+			query = query.Where(column+" = ?", value)
+		}
+	}
+	var events []SecurityEvent
+	if err := query.Order("timestamp DESC").Limit(limit).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query events"})
+		return
+	}
+	hotCount := len(events)
+
+	// Archived partitions overlapping the range
+	var partitions []EventArchivePartition
+	if s.archive != nil {
+		s.db.Where("min_timestamp < ? AND max_timestamp >= ?", end, start).
+			Order("max_timestamp DESC").
+			Find(&partitions)
+	}
+	if len(partitions) > maxAuditQueryPartitions {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":      "Range covers too many archived partitions, narrow the time range",
+			"partitions": len(partitions),
+			"limit":      maxAuditQueryPartitions,
+		})
+		return
+	}
+
+	archivedCount := 0
+	for _, partition := range partitions {
+		matched, err := s.readArchivedEvents(partition.ObjectKey, func(event *SecurityEvent) bool {
+			if event.Timestamp.Before(start) || !event.Timestamp.Before(end) {
+				return false
+			}
+			if !tenantVisible(c, archivedEventTenant(event)) {
+				return false
+			}
+			return archivedEventMatches(event, filters)
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read archived partition %s", partition.ID)})
+			return
+		}
+		archivedCount += len(matched)
+		events = append(events, matched...)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Timestamp.After(events[j].Timestamp)
+	})
+	truncated := len(events) > limit
+	if truncated {
+		events = events[:limit]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"events":    events,
+		"count":     len(events),
+		"truncated": truncated,
+		"sources": gin.H{
+			"hot":                 hotCount,
+			"archived":            archivedCount,
+			"archived_partitions": len(partitions),
+		},
+		"start": start,
+		"end":   end,
+	})
+}
+
+// Events archived before tenancy was introduced belong to the default tenant
+func archivedEventTenant(event *SecurityEvent) string {
+	if event.TenantID == "" {
+		return "default"
+	}
+	return event.TenantID
+}
+
+func archivedEventMatches(event *SecurityEvent, filters map[string]string) bool {
+	fields := map[string]string{
+		"type":       event.Type,
+		"severity":   event.Severity,
+		"user_id":    event.UserID,
+		"ip_address": event.IPAddress,
+		"resource":   event.Resource,
+	}
+	for key, value := range filters {
+		if value != "" && fields[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Stream a partition and return the events accepted by match
+func (s *SecurityService) readArchivedEvents(key string, match func(*SecurityEvent) bool) ([]SecurityEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	object, err := s.archive.GetObject(ctx, s.config.ArchiveS3Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	gz, err := gzip.NewReader(object)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var matched []SecurityEvent
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event SecurityEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, err
+		}
+		if match(&event) {
+			matched = append(matched, event)
+		}
+	}
+	return matched, scanner.Err()
+}
+
+// Retention policy and storage statistics
+func (s *SecurityService) getRetentionStatus(c *gin.Context) {
+	var hotCount int64
+	s.db.Model(&SecurityEvent{}).Count(&hotCount)
+
+	var oldest SecurityEvent
+	oldestHot := interface{}(nil)
+	if err := s.db.Select("timestamp").Order("timestamp ASC").First(&oldest).Error; err == nil {
+		oldestHot = oldest.Timestamp
+	}
+
+	var archived struct {
+		Partitions int64
+		Events     int64
+		Bytes      int64
+	}
+	s.db.Model(&EventArchivePartition{}).
+		Select("COUNT(*) AS partitions, COALESCE(SUM(event_count), 0) AS events, COALESCE(SUM(size_bytes), 0) AS bytes").
+		Scan(&archived)
+
+	c.JSON(http.StatusOK, gin.H{
+		"hot_retention_days": int(s.config.EventHotRetention.Hours() / 24),
+		"hot_cutoff":         s.hotRetentionCutoff(),
+		"archive_enabled":    s.archive != nil,
+		"archive_bucket":     s.config.ArchiveS3Bucket,
+		"format":             "ndjson+gzip",
+		"hot": gin.H{
+			"events": hotCount,
+			"oldest": oldestHot,
+		},
+		"archived": gin.H{
+			"partitions": archived.Partitions,
+			"events":     archived.Events,
+			"size_bytes": archived.Bytes,
+		},
+	})
+}
+
+// List archived partitions
+func (s *SecurityService) listArchivePartitions(c *gin.Context) {
+	query := s.db.Model(&EventArchivePartition{})
+	if day := c.Query("day"); day != "" {
+		query = query.Where("day = ?", day)
+	}
+
+	var partitions []EventArchivePartition
+	if err := query.Order("day DESC, created_at DESC").Limit(500).Find(&partitions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list archive partitions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"partitions": partitions,
+		"total":      len(partitions),
+	})
+}
+
+// Run archival now
+func (s *SecurityService) triggerEventArchival(c *gin.Context) {
+	if s.archive == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Event archive storage is not configured"})
+		return
+	}
+
+	archived, err := s.archiveExpiredEvents()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "archived": archived})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"archived":   archived,
+		"hot_cutoff": s.hotRetentionCutoff(),
+	})
+}
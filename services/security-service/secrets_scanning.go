@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Secrets scanning for text blobs and git diffs. Content is matched against
+// pattern sets: the built-in "default" set plus custom sets stored as
+// SecretPattern rows. Pattern hits are confirmed findings and create
+// VulnerabilityReports; high-entropy strings are reported as low-confidence
+// findings and only create reports when explicitly requested.
+
+const (
+	DefaultPatternSet = "default"
+	RuleHighEntropy   = "high_entropy_string"
+
+	ConfidenceHigh = "high"
+	ConfidenceLow  = "low"
+
+	// Scanner limits
+	maxScanContentBytes = 5 << 20
+	minEntropyTokenLen  = 20
+	base64EntropyLimit  = 4.5
+	hexEntropyLimit     = 3.0
+)
+
+// SecretPattern is a custom detection rule
+type SecretPattern struct {
+	ID          string    `json:"id" gorm:"primaryKey"`
+	PatternSet  string    `json:"pattern_set" gorm:"index;not null"`
+	Name        string    `json:"name" gorm:"not null"`
+	Regex       string    `json:"regex" gorm:"not null"`
+	Severity    string    `json:"severity"`
+	Description string    `json:"description"`
+	IsActive    bool      `json:"is_active" gorm:"default:true"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// SecretFinding is a single detected secret
+type SecretFinding struct {
+	Rule        string `json:"rule"`
+	PatternSet  string `json:"pattern_set"`
+	Severity    string `json:"severity"`
+	Confidence  string `json:"confidence"`
+	File        string `json:"file,omitempty"`
+	Line        int    `json:"line"`
+	Column      int    `json:"column"`
+	Match       string `json:"match"` // redacted
+	Fingerprint string `json:"fingerprint"`
+	ReportID    string `json:"report_id,omitempty"`
+}
+
+type secretRule struct {
+	Name       string
+	PatternSet string
+	Severity   string
+	Regex      *regexp.Regexp
+}
+
+var secretsDetected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "secrets_detected_total",
+		Help: "Total number of secrets detected by the scanner",
+	},
+	[]string{"rule", "confidence"},
+)
+
+// Built-in rules. When a rule has a capture group, the first group is the secret.
+var defaultSecretRules = []secretRule{
+	{Name: "aws_access_key_id", Severity: ThreatLevelCritical, Regex: regexp.MustCompile(`\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`)},
+	{Name: "aws_secret_access_key", Severity: ThreatLevelCritical, Regex: regexp.MustCompile(`(?i)aws.{0,20}secret.{0,20}['"=:\s]([A-Za-z0-9/+]{40})\b`)},
+	{Name: "private_key", Severity: ThreatLevelCritical, Regex: regexp.MustCompile(`-----BEGIN (?:RSA |EC |DSA |OPENSSH |PGP |ENCRYPTED )?PRIVATE KEY(?: BLOCK)?-----`)},
+	{Name: "jwt", Severity: ThreatLevelHigh, Regex: regexp.MustCompile(`\b(eyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,})`)},
+	{Name: "github_token", Severity: ThreatLevelCritical, Regex: regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,})\b`)},
+	{Name: "slack_token", Severity: ThreatLevelHigh, Regex: regexp.MustCompile(`\b(xox[abprs]-[A-Za-z0-9-]{10,})\b`)},
+	{Name: "google_api_key", Severity: ThreatLevelHigh, Regex: regexp.MustCompile(`\b(AIza[0-9A-Za-z_-]{35})\b`)},
+	{Name: "stripe_secret_key", Severity: ThreatLevelCritical, Regex: regexp.MustCompile(`\b((?:sk|rk)_live_[0-9A-Za-z]{24,})\b`)},
+	{Name: "generic_credential", Severity: ThreatLevelMedium, Regex: regexp.MustCompile(`(?i)(?:api[_-]?key|secret|token|passw(?:or)?d)["']?\s*[:=]\s*["']([^"'\s]{12,})["']`)},
+}
+
+func init() {
+	prometheus.MustRegister(secretsDetected)
+	for i := range defaultSecretRules {
+		defaultSecretRules[i].PatternSet = DefaultPatternSet
+	}
+}
+
+var (
+	diffHunkHeader = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+	entropyToken   = regexp.MustCompile(`[A-Za-z0-9+/=_-]{20,}`)
+	hexToken       = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+)
+
+// Scan a text blob or git diff for embedded credentials
+func (s *SecurityService) scanSecrets(c *gin.Context) {
+	var request struct {
+		Content       string   `json:"content" binding:"required"`
+		Type          string   `json:"type"` // text (default) or diff
+		Filename      string   `json:"filename"`
+		Source        string   `json:"source"` // repository or service name
+		Commit        string   `json:"commit"`
+		PatternSets   []string `json:"pattern_sets"`
+		Entropy       *bool    `json:"entropy"`
+		ReportEntropy bool     `json:"report_entropy"`
+		CreateReports *bool    `json:"create_reports"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(request.Content) > maxScanContentBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "content exceeds scan limit", "limit": maxScanContentBytes})
+		return
+	}
+	if request.Type == "" {
+		request.Type = "text"
+	}
+	if request.Type != "text" && request.Type != "diff" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type must be text or diff"})
+		return
+	}
+	if len(request.PatternSets) == 0 {
+		request.PatternSets = []string{DefaultPatternSet}
+	}
+
+	rules, err := s.loadSecretRules(request.PatternSets)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	entropy := request.Entropy == nil || *request.Entropy
+	findings := scanContent(request.Content, request.Type == "diff", request.Filename, rules, entropy)
+
+	createReports := request.CreateReports == nil || *request.CreateReports
+	blocking := 0
+	for i := range findings {
+		finding := &findings[i]
+		secretsDetected.WithLabelValues(finding.Rule, finding.Confidence).Inc()
+		if finding.Confidence == ConfidenceHigh {
+			blocking++
+		}
+		if createReports && (finding.Confidence == ConfidenceHigh || request.ReportEntropy) {
+			reportID, err := s.recordSecretFinding(s.writeTenant(c), finding, request.Source, request.Commit)
+			if err != nil {
+				log.Printf("Secrets scan: failed to record finding %s: %v", finding.Fingerprint, err)
+				continue
+			}
+			finding.ReportID = reportID
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"passed":       blocking == 0,
+		"findings":     findings,
+		"total":        len(findings),
+		"blocking":     blocking,
+		"pattern_sets": request.PatternSets,
+	})
+}
+
+// Resolve pattern set names into compiled rules
+func (s *SecurityService) loadSecretRules(sets []string) ([]secretRule, error) {
+	var rules []secretRule
+	custom := make([]string, 0, len(sets))
+	for _, set := range sets {
+		if set == DefaultPatternSet {
+			rules = append(rules, defaultSecretRules...)
+		} else {
+			custom = append(custom, set)
+		}
+	}
+	if len(custom) == 0 {
+		return rules, nil
+	}
+
+	var patterns []SecretPattern
+	if err := s.db.Where("pattern_set IN ? AND is_active = ?", custom, true).Find(&patterns).Error; err != nil {
+		return nil, fmt.Errorf("failed to load pattern sets: %w", err)
+	}
+	for _, pattern := range patterns {
+		compiled, err := regexp.Compile(pattern.Regex)
+		if err != nil {
+			log.Printf("Secrets scan: skipping invalid pattern %s: %v", pattern.ID, err)
+			continue
+		}
+		severity := pattern.Severity
+		if severity == "" {
+			severity = ThreatLevelHigh
+		}
+		rules = append(rules, secretRule{Name: pattern.Name, PatternSet: pattern.PatternSet, Severity: severity, Regex: compiled})
+	}
+	return rules, nil
+}
+
+// scanContent runs the rules over content. For diffs only added lines are
+// scanned, and file names and line numbers come from the diff headers.
+func scanContent(content string, diff bool, filename string, rules []secretRule, entropy bool) []SecretFinding {
+	findings := []SecretFinding{}
+	seen := make(map[string]bool)
+
+	file := filename
+	line := 0
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), maxScanContentBytes)
+	for scanner.Scan() {
+		text := scanner.Text()
+
+		if diff {
+			switch {
+			case strings.HasPrefix(text, "+++ "):
+				file = strings.TrimPrefix(strings.TrimPrefix(text, "+++ "), "b/")
+				continue
+			case strings.HasPrefix(text, "--- "), strings.HasPrefix(text, "diff --git"):
+				continue
+			case strings.HasPrefix(text, "@@"):
+				if m := diffHunkHeader.FindStringSubmatch(text); m != nil {
+					start, _ := strconv.Atoi(m[1])
+					line = start - 1
+				}
+				continue
+			case strings.HasPrefix(text, "+"):
+				line++
+				text = text[1:]
+			case strings.HasPrefix(text, "-"):
+				continue
+			default:
+				line++
+				continue
+			}
+		} else {
+			line++
+		}
+
+		matched := false
+		for _, rule := range rules {
+			for _, loc := range rule.Regex.FindAllStringSubmatchIndex(text, -1) {
+				start, end := loc[0], loc[1]
+				if len(loc) >= 4 && loc[2] >= 0 {
+					start, end = loc[2], loc[3]
+				}
+				secret := text[start:end]
+				finding := newSecretFinding(rule.Name, rule.PatternSet, rule.Severity, ConfidenceHigh, file, line, start, secret)
+				if !seen[finding.Fingerprint] {
+					seen[finding.Fingerprint] = true
+					findings = append(findings, finding)
+				}
+				matched = true
+			}
+		}
+
+		if entropy && !matched {
+			for _, loc := range entropyToken.FindAllStringIndex(text, -1) {
+				token := text[loc[0]:loc[1]]
+				if !isHighEntropy(token) {
+					continue
+				}
+				finding := newSecretFinding(RuleHighEntropy, DefaultPatternSet, ThreatLevelMedium, ConfidenceLow, file, line, loc[0], token)
+				if !seen[finding.Fingerprint] {
+					seen[finding.Fingerprint] = true
+					findings = append(findings, finding)
+				}
+			}
+		}
+	}
+	return findings
+}
+
+func newSecretFinding(rule, set, severity, confidence, file string, line, column int, secret string) SecretFinding {
+	sum := sha256.Sum256([]byte(rule + ":" + secret))
+	return SecretFinding{
+		Rule:        rule,
+		PatternSet:  set,
+		Severity:    severity,
+		Confidence:  confidence,
+		File:        file,
+		Line:        line,
+		Column:      column + 1,
+		Match:       redactSecret(secret),
+		Fingerprint: hex.EncodeToString(sum[:16]),
+	}
+}
+
+// Keep only a short prefix of the secret
+func redactSecret(secret string) string {
+	if len(secret) <= 8 {
+		return strings.Repeat("*", len(secret))
+	}
+	return secret[:4] + strings.Repeat("*", 8)
+}
+
+func isHighEntropy(token string) bool {
+	if len(token) < minEntropyTokenLen {
+		return false
+	}
+	if hexToken.MatchString(token) {
+		return shannonEntropy(token) > hexEntropyLimit
+	}
+	return shannonEntropy(token) > base64EntropyLimit
+}
+
+func shannonEntropy(value string) float64 {
+	counts := make(map[rune]int)
+	for _, r := range value {
+		counts[r]++
+	}
+	entropy := 0.0
+	length := float64(len(value))
+	for _, count := range counts {
+		p := float64(count) / length
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// Create a VulnerabilityReport for a finding, deduplicated by fingerprint
+func (s *SecurityService) recordSecretFinding(tenantID string, finding *SecretFinding, source, commit string) (string, error) {
+	var existing VulnerabilityReport
+	err := s.tenantDB(tenantID).Select("id").
+		Where("reported_by = ? AND details->>'fingerprint' = ? AND status = ?", "secrets-scanner", finding.Fingerprint, VulnerabilityStatusOpen).
+		First(&existing).Error
+	if err == nil {
+		return existing.ID, nil
+	}
+
+	location := finding.File
+	if location == "" {
+		location = "content"
+	}
+
+	report := &VulnerabilityReport{
+		ID:          uuid.New().String(),
+		TenantID:    tenantID,
+		Title:       fmt.Sprintf("Exposed secret (%s) in %s", finding.Rule, location),
+		Description: fmt.Sprintf("A %s was detected at %s:%d. Rotate the credential and remove it from source.", finding.Rule, location, finding.Line),
+		Severity:    finding.Severity,
+		Component:   source,
+		Version:     commit,
+		Status:      VulnerabilityStatusOpen,
+		ReportedBy:  "secrets-scanner",
+		Details: map[string]interface{}{
+			"rule":        finding.Rule,
+			"pattern_set": finding.PatternSet,
+			"confidence":  finding.Confidence,
+			"file":        finding.File,
+			"line":        finding.Line,
+			"column":      finding.Column,
+			"match":       finding.Match,
+			"fingerprint": finding.Fingerprint,
+		},
+		CreatedAt: time.Now().UTC(),
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	if err := s.db.Create(report).Error; err != nil {
+		return "", err
+	}
+
+	vulnerabilitiesFound.WithLabelValues(report.Severity, report.Component).Inc()
+	return report.ID, nil
+}
+
+// Create a custom secret pattern
+func (s *SecurityService) createSecretPattern(c *gin.Context) {
+	var pattern SecretPattern
+	if err := c.ShouldBindJSON(&pattern); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if pattern.PatternSet == "" || pattern.Name == "" || pattern.Regex == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "pattern_set, name and regex are required"})
+		return
+	}
+	if pattern.PatternSet == DefaultPatternSet {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The default pattern set is built in"})
+		return
+	}
+	if _, err := regexp.Compile(pattern.Regex); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid regex: %v", err)})
+		return
+	}
+
+	pattern.ID = uuid.New().String()
+	pattern.IsActive = true
+	pattern.CreatedBy = c.GetHeader("X-User-ID")
+	pattern.CreatedAt = time.Now().UTC()
+	pattern.UpdatedAt = time.Now().UTC()
+
+	if err := s.db.Create(&pattern).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create secret pattern"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, pattern)
+}
+
+// List secret patterns, including the built-in set
+func (s *SecurityService) listSecretPatterns(c *gin.Context) {
+	query := s.db.Model(&SecretPattern{})
+	if set := c.Query("pattern_set"); set != "" {
+		query = query.Where("pattern_set = ?", set)
+	}
+
+	var patterns []SecretPattern
+	if err := query.Order("pattern_set, name").Find(&patterns).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list secret patterns"})
+		return
+	}
+
+	builtin := make([]gin.H, 0, len(defaultSecretRules))
+	for _, rule := range defaultSecretRules {
+		builtin = append(builtin, gin.H{
+			"pattern_set": rule.PatternSet,
+			"name":        rule.Name,
+			"regex":       rule.Regex.String(),
+			"severity":    rule.Severity,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"builtin":  builtin,
+		"patterns": patterns,
+	})
+}
+
+// Delete a custom secret pattern
+func (s *SecurityService) deleteSecretPattern(c *gin.Context) {
+	result := s.db.Delete(&SecretPattern{}, "id = ?", c.Param("id"))
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete secret pattern"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Secret pattern not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Secret pattern deleted"})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+// Tenant isolation. Every /v1 request is bound to the tenant named in the
+// caller's JWT (TenantClaim); a token without the claim falls into
+// DefaultTenant. Only tokens this service issued, signed with a key-ring key
+// and carrying JWTIssuer, are accepted here; legacy HS256 tokens are not.
+// Without a token only the exempt routes can be called, unless
+// TenantRequireToken is turned off, when callers fall into DefaultTenant.
+// Reads of events, threats, policies, vulnerabilities and incidents go
+// through scoped(c), which filters on tenant_id. Holders of TenantAdminRole
+// see all tenants and may narrow to one with ?tenant_id= or X-Tenant-ID.
+// Platform services authenticate with X-Token-Issuer-Key instead of a token
+// and act in the tenant they name, or DefaultTenant.
+
+const (
+	contextTenantID    = "tenant_id"
+	contextTenantAdmin = "tenant_admin"
+	contextSubject     = "subject"
+	contextService     = "platform_service"
+)
+
+// Routes callable without a token when TenantRequireToken is set
+var tenantExemptRoutes = map[string]bool{
+	"/v1/validate/token":    true,
+	"/v1/validate/password": true,
+}
+
+func (s *SecurityService) tenantMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant := s.config.DefaultTenant
+		admin := false
+		subject := ""
+		service := s.trustedService(c)
+
+		if raw := bearerToken(c); raw != "" {
+			token, kid, err := s.parseToken(raw)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token: " + err.Error()})
+				c.Abort()
+				return
+			}
+			claims, _ := token.Claims.(jwt.MapClaims)
+			if kid == "" || claims["iss"] != s.config.JWTIssuer {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Token was not issued by this service"})
+				c.Abort()
+				return
+			}
+			if claimed, ok := claims[s.config.TenantClaim].(string); ok && claimed != "" {
+				tenant = claimed
+			}
+			admin = hasRole(claims, s.config.TenantAdminRole)
+			subject, _ = claims["sub"].(string)
+		} else if s.config.TenantRequireToken && !service && !tenantExemptRoutes[c.FullPath()] {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Bearer token required"})
+			c.Abort()
+			return
+		}
+
+		requested := c.Query("tenant_id")
+		if requested == "" {
+			requested = c.GetHeader("X-Tenant-ID")
+		}
+		if admin {
+			// Empty means all tenants
+			tenant = requested
+		} else if service && requested != "" {
+			tenant = requested
+		} else if requested != "" && requested != tenant {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access to other tenants is not allowed"})
+			c.Abort()
+			return
+		}
+
+		c.Set(contextTenantID, tenant)
+		c.Set(contextTenantAdmin, admin)
+		c.Set(contextSubject, subject)
+		c.Set(contextService, service)
+		c.Next()
+	}
+}
+
+// trustedService reports whether the caller holds the platform issuer key
+func (s *SecurityService) trustedService(c *gin.Context) bool {
+	key := c.GetHeader("X-Token-Issuer-Key")
+	return s.config.TokenIssuerKey != "" && key != "" &&
+		subtle.ConstantTimeCompare([]byte(key), []byte(s.config.TokenIssuerKey)) == 1
+}
+
+// platformCaller reports whether the caller is a tenant admin or a platform
+// service
+func platformCaller(c *gin.Context) bool {
+	return c.GetBool(contextTenantAdmin) || c.GetBool(contextService)
+}
+
+// platformAdmin restricts platform-wide settings to holders of
+// TenantAdminRole
+func platformAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.GetBool(contextTenantAdmin) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This setting applies to all tenants and requires the platform admin role"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+func hasRole(claims jwt.MapClaims, role string) bool {
+	if role == "" {
+		return false
+	}
+	switch roles := claims["roles"].(type) {
+	case []interface{}:
+		for _, r := range roles {
+			if r == role {
+				return true
+			}
+		}
+	case string:
+		for _, r := range strings.Fields(strings.ReplaceAll(roles, ",", " ")) {
+			if r == role {
+				return true
+			}
+		}
+	}
+	return claims["role"] == role
+}
+
+// tenantOf returns the caller's tenant; empty means all tenants
+func tenantOf(c *gin.Context) string {
+	return c.GetString(contextTenantID)
+}
+
+// tenantVisible reports whether the caller may see a record of the tenant
+func tenantVisible(c *gin.Context, tenantID string) bool {
+	tenant := tenantOf(c)
+	return tenant == "" || tenant == tenantID
+}
+
+// tenantDB returns a reusable handle filtered to one tenant, or the
+// unfiltered handle for an empty tenant
+func (s *SecurityService) tenantDB(tenantID string) *gorm.DB {
+	if tenantID == "" {
+		return s.db
+	}
+	return s.db.Where("tenant_id = ?", tenantID).Session(&gorm.Session{})
+}
+
+// scoped is the database handle for the caller's tenant
+func (s *SecurityService) scoped(c *gin.Context) *gorm.DB {
+	return s.tenantDB(tenantOf(c))
+}
+
+// writeTenant is the tenant stamped on records the caller creates
+func (s *SecurityService) writeTenant(c *gin.Context) string {
+	if tenant := tenantOf(c); tenant != "" {
+		return tenant
+	}
+	return s.config.DefaultTenant
+}
+
+type tenantSummary struct {
+	TenantID       string `json:"tenant_id"`
+	Events         int64  `json:"events"`
+	CriticalEvents int64  `json:"critical_events"`
+	OpenThreats    int64  `json:"open_threats"`
+	OpenVulns      int64  `json:"open_vulnerabilities"`
+	OpenIncidents  int64  `json:"open_incidents"`
+	ActivePolicies int64  `json:"active_policies"`
+}
+
+// Per-tenant overview for platform admins
+func (s *SecurityService) getTenantsAnalytics(c *gin.Context) {
+	if !c.GetBool(contextTenantAdmin) || tenantOf(c) != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cross-tenant analytics require the platform admin role"})
+		return
+	}
+
+	since := analyticsSince(c)
+	summaries := make(map[string]*tenantSummary)
+	collect := func(query *gorm.DB, assign func(*tenantSummary, int64)) {
+		var rows []struct {
+			TenantID string
+			Count    int64
+		}
+		query.Select("tenant_id, COUNT(*) AS count").Group("tenant_id").Scan(&rows)
+		for _, row := range rows {
+			summary, ok := summaries[row.TenantID]
+			if !ok {
+				summary = &tenantSummary{TenantID: row.TenantID}
+				summaries[row.TenantID] = summary
+			}
+			assign(summary, row.Count)
+		}
+	}
+
+	collect(s.db.Model(&SecurityEvent{}).Where("timestamp >= ?", since),
+		func(t *tenantSummary, n int64) { t.Events = n })
+	collect(s.db.Model(&SecurityEvent{}).Where("timestamp >= ? AND severity = ?", since, ThreatLevelCritical),
+		func(t *tenantSummary, n int64) { t.CriticalEvents = n })
+	collect(s.db.Model(&ThreatDetection{}).Where("resolved_at IS NULL"),
+		func(t *tenantSummary, n int64) { t.OpenThreats = n })
+	collect(s.db.Model(&VulnerabilityReport{}).Where("resolved_at IS NULL"),
+		func(t *tenantSummary, n int64) { t.OpenVulns = n })
+	collect(s.db.Model(&SecurityIncident{}).Where("resolved_at IS NULL"),
+		func(t *tenantSummary, n int64) { t.OpenIncidents = n })
+	collect(s.db.Model(&SecurityPolicy{}).Where("is_active = ?", true),
+		func(t *tenantSummary, n int64) { t.ActivePolicies = n })
+
+	tenants := make([]*tenantSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		tenants = append(tenants, summary)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].TenantID < tenants[j].TenantID })
+
+	c.JSON(http.StatusOK, gin.H{
+		"tenants": tenants,
+		"since":   since,
+	})
+}
+
+// Security posture of a single tenant
+func (s *SecurityService) getTenantAnalytics(c *gin.Context) {
+	tenantID := c.Param("tenant_id")
+	if !tenantVisible(c, tenantID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access to other tenants is not allowed"})
+		return
+	}
+
+	since := analyticsSince(c)
+	db := s.tenantDB(tenantID)
+	groupBy := func(model interface{}, column string, where string, args ...interface{}) map[string]int64 {
+		var rows []struct {
+			Key   string
+			Count int64
+		}
+		db.Model(model).Select(column+" AS key, COUNT(*) AS count").Where(where, args...).Group(column).Scan(&rows)
+		counts := make(map[string]int64, len(rows))
+		for _, row := range rows {
+			counts[row.Key] = row.Count
+		}
+		return counts
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tenant_id": tenantID,
+		"since":     since,
+		"events": gin.H{
+			"by_type":     groupBy(&SecurityEvent{}, "type", "timestamp >= ?", since),
+			"by_severity": groupBy(&SecurityEvent{}, "severity", "timestamp >= ?", since),
+		},
+		"threats": gin.H{
+			"by_status": groupBy(&ThreatDetection{}, "status", "created_at >= ?", since),
+			"by_level":  groupBy(&ThreatDetection{}, "threat_level", "created_at >= ?", since),
+		},
+		"vulnerabilities": gin.H{
+			"open_by_severity": groupBy(&VulnerabilityReport{}, "severity", "resolved_at IS NULL"),
+			"by_status":        groupBy(&VulnerabilityReport{}, "status", "created_at >= ?", since),
+		},
+		"incidents": gin.H{
+			"by_status":   groupBy(&SecurityIncident{}, "status", "created_at >= ?", since),
+			"by_severity": groupBy(&SecurityIncident{}, "severity", "created_at >= ?", since),
+		},
+		"policies": gin.H{
+			"active_by_type": groupBy(&SecurityPolicy{}, "type", "is_active = ?", true),
+		},
+	})
+}
+
+func analyticsSince(c *gin.Context) time.Time {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+	return time.Now().UTC().AddDate(0, 0, -days)
+}
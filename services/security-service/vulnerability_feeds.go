@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// CVE feed ingestion - matches the registered component inventory against
+// OSV advisories and enriches CVE aliases with CVSS scores from NVD.
+// Inventories belong to a tenant, and so do the reports raised from them.
+// Open reports for a component version that is no longer registered are
+// resolved on the next scan. NVD requests are paced to its rate limit and
+// capped per scan, and a scan stops at a deadline so it cannot overrun the
+// next one.
+
+// Vulnerability feed sources
+const (
+	FeedSourceOSV = "osv"
+	FeedSourceNVD = "nvd"
+)
+
+// Vulnerability scan limits. NVD allows 5 requests per 30 seconds without
+// an API key and 50 with one.
+const (
+	vulnerabilityScanTimeout = 50 * time.Minute
+	nvdRequestInterval       = 6 * time.Second
+	nvdKeyedRequestInterval  = 600 * time.Millisecond
+	maxNVDLookupsPerScan     = 250
+)
+
+// Vulnerability report statuses
+const (
+	VulnerabilityStatusOpen     = "open"
+	VulnerabilityStatusResolved = "resolved"
+)
+
+// Component is a single dependency from a service's SBOM
+type Component struct {
+	ID        string     `json:"id" gorm:"primaryKey"`
+	TenantID  string     `json:"tenant_id" gorm:"index;not null;default:'default'"`
+	Service   string     `json:"service" gorm:"index;not null"`
+	Name      string     `json:"name" gorm:"index;not null"`
+	Version   string     `json:"version" gorm:"not null"`
+	Ecosystem string     `json:"ecosystem" gorm:"index"`
+	PURL      string     `json:"purl"`
+	ScannedAt *time.Time `json:"scanned_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+type componentInput struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Ecosystem string `json:"ecosystem"`
+	PURL      string `json:"purl"`
+}
+
+// purl types mapped to OSV ecosystem names
+var purlEcosystems = map[string]string{
+	"golang":   "Go",
+	"npm":      "npm",
+	"pypi":     "PyPI",
+	"maven":    "Maven",
+	"cargo":    "crates.io",
+	"gem":      "RubyGems",
+	"nuget":    "NuGet",
+	"composer": "Packagist",
+}
+
+// Register (replace) the component inventory of a service
+func (s *SecurityService) registerComponents(c *gin.Context) {
+	var request struct {
+		Service    string           `json:"service" binding:"required"`
+		Components []componentInput `json:"components"`
+		// CycloneDX JSON document, used when components is empty
+		SBOM *struct {
+			Components []componentInput `json:"components"`
+		} `json:"sbom"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	inputs := request.Components
+	if len(inputs) == 0 && request.SBOM != nil {
+		inputs = request.SBOM.Components
+	}
+	if len(inputs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No components provided"})
+		return
+	}
+
+	tenant := s.writeTenant(c)
+	now := time.Now().UTC()
+	components := make([]Component, 0, len(inputs))
+	for _, input := range inputs {
+		ecosystem := input.Ecosystem
+		if ecosystem == "" {
+			ecosystem = ecosystemFromPURL(input.PURL)
+		}
+		if input.Name == "" || input.Version == "" || ecosystem == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":     "Each component requires name, version and ecosystem (or a purl)",
+				"component": input,
+			})
+			return
+		}
+		components = append(components, Component{
+			ID:        uuid.New().String(),
+			TenantID:  tenant,
+			Service:   request.Service,
+			Name:      input.Name,
+			Version:   strings.TrimPrefix(input.Version, "v"),
+			Ecosystem: ecosystem,
+			PURL:      input.PURL,
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Where("tenant_id = ? AND service = ?", tenant, request.Service).Delete(&Component{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to replace component inventory"})
+		return
+	}
+	if err := tx.CreateInBatches(components, 100).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store components"})
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store components"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"service":    request.Service,
+		"components": len(components),
+		"message":    "Component inventory registered successfully",
+	})
+}
+
+// List registered components
+func (s *SecurityService) listComponents(c *gin.Context) {
+	query := s.scoped(c).Model(&Component{})
+	if service := c.Query("service"); service != "" {
+		query = query.Where("service = ?", service)
+	}
+	if ecosystem := c.Query("ecosystem"); ecosystem != "" {
+		query = query.Where("ecosystem = ?", ecosystem)
+	}
+	if name := c.Query("name"); name != "" {
+		query = query.Where("name = ?", name)
+	}
+
+	var components []Component
+	if err := query.Order("service, name").Find(&components).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list components"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"components": components,
+		"total":      len(components),
+	})
+}
+
+// Remove a service's component inventory
+func (s *SecurityService) deleteComponents(c *gin.Context) {
+	service := c.Param("service")
+	result := s.scoped(c).Where("service = ?", service).Delete(&Component{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete components"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"service": service,
+		"deleted": result.RowsAffected,
+	})
+}
+
+// vulnerabilityScan paces and bounds the NVD lookups of a single scan
+type vulnerabilityScan struct {
+	ctx        context.Context
+	nvd        *time.Ticker
+	nvdLookups int
+}
+
+// Scan the component inventory against the vulnerability feeds
+func (s *SecurityService) scanVulnerabilities() {
+	resolved := s.resolveUnregisteredVulnerabilities()
+
+	var components []Component
+	if err := s.db.Find(&components).Error; err != nil {
+		log.Printf("Vulnerability scan: failed to load components: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vulnerabilityScanTimeout)
+	defer cancel()
+	interval := nvdRequestInterval
+	if s.config.NVDAPIKey != "" {
+		interval = nvdKeyedRequestInterval
+	}
+	scan := &vulnerabilityScan{ctx: ctx, nvd: time.NewTicker(interval)}
+	defer scan.nvd.Stop()
+
+	created, scanned := 0, 0
+	for i := range components {
+		if ctx.Err() != nil {
+			log.Printf("Vulnerability scan: deadline reached after %d of %d components", scanned, len(components))
+			break
+		}
+		component := &components[i]
+		advisories, err := s.queryOSV(component)
+		if err != nil {
+			log.Printf("Vulnerability scan: OSV query failed for %s@%s: %v", component.Name, component.Version, err)
+			continue
+		}
+
+		for _, advisory := range advisories {
+			ok, err := s.recordAdvisory(scan, component, advisory)
+			if err != nil {
+				log.Printf("Vulnerability scan: failed to record %s: %v", advisory.ID, err)
+				continue
+			}
+			if ok {
+				created++
+			}
+		}
+
+		now := time.Now().UTC()
+		s.db.Model(component).Update("scanned_at", now)
+		scanned++
+	}
+
+	log.Printf("Vulnerability scan completed: %d components, %d new vulnerabilities, %d resolved", scanned, created, resolved)
+}
+
+// Resolve open feed reports whose component version is no longer in its
+// tenant's inventory
+func (s *SecurityService) resolveUnregisteredVulnerabilities() int64 {
+	registered := s.db.Model(&Component{}).Select("1").
+		Where("components.tenant_id = vulnerability_reports.tenant_id AND components.name = vulnerability_reports.component AND components.version = vulnerability_reports.version")
+
+	now := time.Now().UTC()
+	result := s.db.Model(&VulnerabilityReport{}).
+		Where("status = ? AND reported_by = ?", VulnerabilityStatusOpen, "cve-feed").
+		Where("NOT EXISTS (?)", registered).
+		Updates(map[string]interface{}{
+			"status":      VulnerabilityStatusResolved,
+			"resolved_at": now,
+			"updated_at":  now,
+		})
+	if result.Error != nil {
+		log.Printf("Vulnerability scan: failed to resolve unregistered components: %v", result.Error)
+		return 0
+	}
+	return result.RowsAffected
+}
+
+// OSV advisory (subset of https://ossf.github.io/osv-schema/)
+type osvAdvisory struct {
+	ID       string   `json:"id"`
+	Summary  string   `json:"summary"`
+	Details  string   `json:"details"`
+	Aliases  []string `json:"aliases"`
+	Severity []struct {
+		Type  string `json:"type"`
+		Score string `json:"score"`
+	} `json:"severity"`
+	DatabaseSpecific struct {
+		Severity string `json:"severity"`
+	} `json:"database_specific"`
+	Affected []struct {
+		Ranges []struct {
+			Events []map[string]string `json:"events"`
+		} `json:"ranges"`
+	} `json:"affected"`
+	References []struct {
+		URL string `json:"url"`
+	} `json:"references"`
+}
+
+func (s *SecurityService) queryOSV(component *Component) ([]osvAdvisory, error) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"version": component.Version,
+		"package": map[string]string{
+			"name":      component.Name,
+			"ecosystem": component.Ecosystem,
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.OSVAPIURL+"/v1/query", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Vulns []osvAdvisory `json:"vulns"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode OSV response: %w", err)
+	}
+	return result.Vulns, nil
+}
+
+// Create a VulnerabilityReport for an advisory unless one already exists.
+// Returns true when a new report was created.
+func (s *SecurityService) recordAdvisory(scan *vulnerabilityScan, component *Component, advisory osvAdvisory) (bool, error) {
+	cveID := advisory.ID
+	for _, alias := range advisory.Aliases {
+		if strings.HasPrefix(alias, "CVE-") {
+			cveID = alias
+			break
+		}
+	}
+
+	var existing int64
+	s.db.Model(&VulnerabilityReport{}).
+		Where("tenant_id = ? AND cve_id = ? AND component = ? AND version = ?", component.TenantID, cveID, component.Name, component.Version).
+		Count(&existing)
+	if existing > 0 {
+		return false, nil
+	}
+
+	score, vector, source := 0.0, "", FeedSourceOSV
+	if strings.HasPrefix(cveID, "CVE-") {
+		if nvdScore, nvdVector, err := s.lookupNVDScore(scan, cveID); err == nil && nvdScore > 0 {
+			score, vector, source = nvdScore, nvdVector, FeedSourceNVD
+		} else if err != nil {
+			log.Printf("Vulnerability scan: NVD lookup failed for %s: %v", cveID, err)
+		}
+	}
+	if vector == "" {
+		for _, severity := range advisory.Severity {
+			if strings.HasPrefix(severity.Type, "CVSS") {
+				vector = severity.Score
+				if base, ok := cvssBaseScore(vector); ok {
+					score = base
+				}
+				break
+			}
+		}
+	}
+
+	// Advisories without a usable CVSS v3 vector fall back to the severity
+	// the source database assigned
+	level := severityFromCVSS(score)
+	if score == 0 {
+		if databaseLevel, ok := severityFromLabel(advisory.DatabaseSpecific.Severity); ok {
+			level = databaseLevel
+		}
+	}
+
+	references := make([]string, 0, len(advisory.References))
+	for _, ref := range advisory.References {
+		references = append(references, ref.URL)
+	}
+
+	title := advisory.Summary
+	if title == "" {
+		title = fmt.Sprintf("%s in %s", cveID, component.Name)
+	}
+
+	report := &VulnerabilityReport{
+		ID:           uuid.New().String(),
+		TenantID:     component.TenantID,
+		Title:        title,
+		Description:  advisory.Details,
+		Severity:     level,
+		CVEId:        cveID,
+		Component:    component.Name,
+		Version:      component.Version,
+		FixedVersion: fixedVersion(advisory),
+		Status:       VulnerabilityStatusOpen,
+		ReportedBy:   "cve-feed",
+		Details: map[string]interface{}{
+			"service":     component.Service,
+			"ecosystem":   component.Ecosystem,
+			"purl":        component.PURL,
+			"osv_id":      advisory.ID,
+			"aliases":     advisory.Aliases,
+			"cvss_score":  score,
+			"cvss_vector": vector,
+			"source":      source,
+			"references":  references,
+		},
+		CreatedAt: time.Now().UTC(),
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	if err := s.db.Create(report).Error; err != nil {
+		return false, err
+	}
+
+	vulnerabilitiesFound.WithLabelValues(report.Severity, report.Component).Inc()
+	return true, nil
+}
+
+// Look up the CVSS base score of a CVE in NVD, cached in Redis. Uncached
+// lookups wait their turn on the scan's NVD ticker.
+func (s *SecurityService) lookupNVDScore(scan *vulnerabilityScan, cveID string) (float64, string, error) {
+	ctx, cancel := context.WithTimeout(scan.ctx, 30*time.Second)
+	defer cancel()
+
+	cacheKey := fmt.Sprintf("nvd_cvss:%s", cveID)
+	if cached, err := s.redis.Get(ctx, cacheKey).Result(); err == nil {
+		parts := strings.SplitN(cached, "|", 2)
+		score, _ := strconv.ParseFloat(parts[0], 64)
+		vector := ""
+		if len(parts) == 2 {
+			vector = parts[1]
+		}
+		return score, vector, nil
+	}
+
+	if scan.nvdLookups >= maxNVDLookupsPerScan {
+		return 0, "", fmt.Errorf("NVD lookup limit of %d per scan reached", maxNVDLookupsPerScan)
+	}
+	select {
+	case <-scan.nvd.C:
+	case <-scan.ctx.Done():
+		return 0, "", scan.ctx.Err()
+	}
+	scan.nvdLookups++
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.config.NVDAPIURL+"?cveId="+cveID, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	if s.config.NVDAPIKey != "" {
+		req.Header.Set("apiKey", s.config.NVDAPIKey)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	type cvssMetric struct {
+		CVSSData struct {
+			BaseScore    float64 `json:"baseScore"`
+			VectorString string  `json:"vectorString"`
+		} `json:"cvssData"`
+	}
+	var result struct {
+		Vulnerabilities []struct {
+			CVE struct {
+				Metrics struct {
+					V31 []cvssMetric `json:"cvssMetricV31"`
+					V30 []cvssMetric `json:"cvssMetricV30"`
+					V2  []cvssMetric `json:"cvssMetricV2"`
+				} `json:"metrics"`
+			} `json:"cve"`
+		} `json:"vulnerabilities"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, "", fmt.Errorf("failed to decode NVD response: %w", err)
+	}
+	if len(result.Vulnerabilities) == 0 {
+		return 0, "", nil
+	}
+
+	metrics := result.Vulnerabilities[0].CVE.Metrics
+	var score float64
+	var vector string
+	for _, set := range [][]cvssMetric{metrics.V31, metrics.V30, metrics.V2} {
+		if len(set) > 0 {
+			score = set[0].CVSSData.BaseScore
+			vector = set[0].CVSSData.VectorString
+			break
+		}
+	}
+
+	s.redis.Set(ctx, cacheKey, fmt.Sprintf("%.1f|%s", score, vector), 24*time.Hour)
+	return score, vector, nil
+}
+
+// Map a CVSS base score to a severity
+func severityFromCVSS(score float64) string {
+	switch {
+	case score >= 9.0:
+		return ThreatLevelCritical
+	case score >= 7.0:
+		return ThreatLevelHigh
+	case score >= 4.0:
+		return ThreatLevelMedium
+	default:
+		return ThreatLevelLow
+	}
+}
+
+// Map a database-specific severity label (GHSA, PyPA, ...) to a severity
+func severityFromLabel(label string) (string, bool) {
+	switch strings.ToUpper(strings.TrimSpace(label)) {
+	case "CRITICAL":
+		return ThreatLevelCritical, true
+	case "HIGH":
+		return ThreatLevelHigh, true
+	case "MODERATE", "MEDIUM":
+		return ThreatLevelMedium, true
+	case "LOW":
+		return ThreatLevelLow, true
+	default:
+		return "", false
+	}
+}
+
+// CVSS v3.x metric weights (https://www.first.org/cvss/v3.1/specification-document)
+var cvssWeights = map[string]map[string]float64{
+	"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+	"AC": {"L": 0.77, "H": 0.44},
+	"PR": {"N": 0.85, "L": 0.62, "H": 0.27},
+	"UI": {"N": 0.85, "R": 0.62},
+	"C":  {"H": 0.56, "L": 0.22, "N": 0},
+	"I":  {"H": 0.56, "L": 0.22, "N": 0},
+	"A":  {"H": 0.56, "L": 0.22, "N": 0},
+}
+
+// Compute the base score of a CVSS v3.x vector such as
+// CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H. Other versions are not scored.
+func cvssBaseScore(vector string) (float64, bool) {
+	parts := strings.Split(vector, "/")
+	if len(parts) < 9 || !strings.HasPrefix(parts[0], "CVSS:3.") {
+		return 0, false
+	}
+
+	metrics := make(map[string]string, len(parts)-1)
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) == 2 {
+			metrics[kv[0]] = kv[1]
+		}
+	}
+
+	scope := metrics["S"]
+	if scope != "U" && scope != "C" {
+		return 0, false
+	}
+	weights := make(map[string]float64, len(cvssWeights))
+	for metric, values := range cvssWeights {
+		weight, ok := values[metrics[metric]]
+		if !ok {
+			return 0, false
+		}
+		weights[metric] = weight
+	}
+	if scope == "C" {
+		// Privileges required weigh less when the scope changes
+		switch metrics["PR"] {
+		case "L":
+			weights["PR"] = 0.68
+		case "H":
+			weights["PR"] = 0.5
+		}
+	}
+
+	iss := 1 - (1-weights["C"])*(1-weights["I"])*(1-weights["A"])
+	impact := 6.42 * iss
+	if scope == "C" {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0, true
+	}
+	exploitability := 8.22 * weights["AV"] * weights["AC"] * weights["PR"] * weights["UI"]
+
+	base := impact + exploitability
+	if scope == "C" {
+		base *= 1.08
+	}
+	return cvssRoundUp(math.Min(base, 10)), true
+}
+
+// Round up to one decimal place as the CVSS v3.1 specification defines it
+func cvssRoundUp(value float64) float64 {
+	scaled := int(math.Round(value * 100000))
+	if scaled%10000 == 0 {
+		return float64(scaled) / 100000
+	}
+	return float64(scaled/10000+1) / 10
+}
+
+// Return the first fixed version listed in an advisory's affected ranges
+func fixedVersion(advisory osvAdvisory) string {
+	for _, affected := range advisory.Affected {
+		for _, r := range affected.Ranges {
+			for _, event := range r.Events {
+				if fixed, ok := event["fixed"]; ok {
+					return fixed
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Derive the OSV ecosystem from a package URL (pkg:type/namespace/name@version)
+func ecosystemFromPURL(purl string) string {
+	if !strings.HasPrefix(purl, "pkg:") {
+		return ""
+	}
+	purlType := strings.SplitN(strings.TrimPrefix(purl, "pkg:"), "/", 2)[0]
+	return purlEcosystems[purlType]
+}